@@ -166,7 +166,8 @@ int lv_domain_undefine(const char* name) {
         return LV_ERR_NOT_FOUND;
     }
 
-    int ret = virDomainUndefine(dom);
+    /* Drop any managed save image too, or libvirt refuses to undefine */
+    int ret = virDomainUndefineFlags(dom, VIR_DOMAIN_UNDEFINE_MANAGED_SAVE);
     virDomainFree(dom);
 
     if (ret < 0) {
@@ -315,6 +316,29 @@ int lv_domain_resume(const char* name) {
     return LV_OK;
 }
 
+int lv_domain_managed_save(const char* name) {
+    if (g_conn == NULL) {
+        set_error("Not connected");
+        return LV_ERR_CONNECT;
+    }
+
+    virDomainPtr dom = virDomainLookupByName(g_conn, name);
+    if (dom == NULL) {
+        set_error("Domain not found");
+        return LV_ERR_NOT_FOUND;
+    }
+
+    int ret = virDomainManagedSave(dom, 0);
+    virDomainFree(dom);
+
+    if (ret < 0) {
+        set_error("Failed to save domain");
+        return LV_ERR_OPERATION;
+    }
+
+    return LV_OK;
+}
+
 /*
  * Domain information
  */
@@ -359,6 +383,10 @@ int lv_domain_get_info(const char* name, lv_domain_info_t* info) {
         info->cpu_time_ns = dom_info.cpuTime;
     }
 
+    int max_vcpus = virDomainGetVcpusFlags(dom, VIR_DOMAIN_AFFECT_CURRENT | VIR_DOMAIN_VCPU_MAXIMUM);
+    info->max_vcpus = max_vcpus > 0 ? (uint32_t)max_vcpus : info->vcpus;
+    info->has_managed_save = virDomainHasManagedSaveImage(dom, 0) == 1;
+
     virDomainFree(dom);
     return LV_OK;
 }
@@ -416,6 +444,82 @@ char* lv_domain_get_xml(const char* name) {
     return xml;
 }
 
+int lv_domain_screenshot(const char* name, unsigned char** data, size_t* len, char** mime) {
+    if (g_conn == NULL) {
+        set_error("Not connected");
+        return LV_ERR_CONNECT;
+    }
+
+    virDomainPtr dom = virDomainLookupByName(g_conn, name);
+    if (dom == NULL) {
+        set_error("Domain not found");
+        return LV_ERR_NOT_FOUND;
+    }
+
+    virStreamPtr st = virStreamNew(g_conn, 0);
+    if (st == NULL) {
+        set_error("Failed to create stream");
+        virDomainFree(dom);
+        return LV_ERR_OPERATION;
+    }
+
+    char* type = virDomainScreenshot(dom, st, 0, 0);
+    virDomainFree(dom);
+    if (type == NULL) {
+        set_error("Failed to take screenshot");
+        virStreamFree(st);
+        return LV_ERR_OPERATION;
+    }
+
+    size_t size = 0, cap = 65536;
+    unsigned char* buf = malloc(cap);
+    if (buf == NULL) {
+        set_error("Out of memory");
+        virStreamAbort(st);
+        virStreamFree(st);
+        free(type);
+        return LV_ERR_MEMORY;
+    }
+
+    for (;;) {
+        if (cap - size < 65536) {
+            unsigned char* grown = realloc(buf, cap * 2);
+            if (grown == NULL) {
+                set_error("Out of memory");
+                virStreamAbort(st);
+                virStreamFree(st);
+                free(buf);
+                free(type);
+                return LV_ERR_MEMORY;
+            }
+            buf = grown;
+            cap *= 2;
+        }
+
+        int n = virStreamRecv(st, (char*)buf + size, cap - size);
+        if (n < 0) {
+            set_error("Failed to read screenshot");
+            virStreamAbort(st);
+            virStreamFree(st);
+            free(buf);
+            free(type);
+            return LV_ERR_OPERATION;
+        }
+        if (n == 0) {
+            break;
+        }
+        size += n;
+    }
+
+    virStreamFinish(st);
+    virStreamFree(st);
+
+    *data = buf;
+    *len = size;
+    *mime = type;
+    return LV_OK;
+}
+
 int lv_domain_get_state(const char* name) {
     if (g_conn == NULL) {
         return -1;
@@ -633,6 +737,136 @@ int lv_domain_set_memory(const char* name, uint64_t memory_kb) {
     return LV_OK;
 }
 
+int lv_domain_set_vcpus_flags(const char* name, uint32_t count, unsigned int flags) {
+    if (g_conn == NULL) {
+        set_error("Not connected");
+        return LV_ERR_CONNECT;
+    }
+
+    virDomainPtr dom = virDomainLookupByName(g_conn, name);
+    if (dom == NULL) {
+        set_error("Domain not found");
+        return LV_ERR_NOT_FOUND;
+    }
+
+    unsigned int vir_flags = 0;
+    if (flags & LV_AFFECT_LIVE) vir_flags |= VIR_DOMAIN_AFFECT_LIVE;
+    if (flags & LV_AFFECT_CONFIG) vir_flags |= VIR_DOMAIN_AFFECT_CONFIG;
+    if (flags & LV_SET_MAXIMUM) vir_flags |= VIR_DOMAIN_VCPU_MAXIMUM;
+
+    int ret = virDomainSetVcpusFlags(dom, count, vir_flags);
+    virDomainFree(dom);
+
+    if (ret < 0) {
+        set_error("Failed to set vCPUs");
+        return LV_ERR_OPERATION;
+    }
+
+    return LV_OK;
+}
+
+int lv_domain_set_memory_flags(const char* name, uint64_t memory_kb, unsigned int flags) {
+    if (g_conn == NULL) {
+        set_error("Not connected");
+        return LV_ERR_CONNECT;
+    }
+
+    virDomainPtr dom = virDomainLookupByName(g_conn, name);
+    if (dom == NULL) {
+        set_error("Domain not found");
+        return LV_ERR_NOT_FOUND;
+    }
+
+    unsigned int vir_flags = 0;
+    if (flags & LV_AFFECT_LIVE) vir_flags |= VIR_DOMAIN_AFFECT_LIVE;
+    if (flags & LV_AFFECT_CONFIG) vir_flags |= VIR_DOMAIN_AFFECT_CONFIG;
+    if (flags & LV_SET_MAXIMUM) vir_flags |= VIR_DOMAIN_MEM_MAXIMUM;
+
+    int ret = virDomainSetMemoryFlags(dom, memory_kb, vir_flags);
+    virDomainFree(dom);
+
+    if (ret < 0) {
+        set_error("Failed to set memory");
+        return LV_ERR_OPERATION;
+    }
+
+    return LV_OK;
+}
+
+int lv_domain_pin_cpus(const char* name, const unsigned char* cpumap, int maplen, unsigned int flags) {
+    if (g_conn == NULL) {
+        set_error("Not connected");
+        return LV_ERR_CONNECT;
+    }
+
+    virDomainPtr dom = virDomainLookupByName(g_conn, name);
+    if (dom == NULL) {
+        set_error("Domain not found");
+        return LV_ERR_NOT_FOUND;
+    }
+
+    /* The running domain and its definition count vCPUs differently, so
+     * each is pinned on its own */
+    unsigned int affects[2];
+    int naffects = 0;
+    if (flags & LV_AFFECT_LIVE) affects[naffects++] = VIR_DOMAIN_AFFECT_LIVE;
+    if (flags & LV_AFFECT_CONFIG) affects[naffects++] = VIR_DOMAIN_AFFECT_CONFIG;
+
+    int ret = 0;
+    for (int i = 0; i < naffects && ret == 0; i++) {
+        /* The definition also pins the vCPUs that are not online yet */
+        unsigned int count_flags = affects[i];
+        if (affects[i] == VIR_DOMAIN_AFFECT_CONFIG) count_flags |= VIR_DOMAIN_VCPU_MAXIMUM;
+
+        int vcpus = virDomainGetVcpusFlags(dom, count_flags);
+        if (vcpus < 0) {
+            ret = -1;
+            break;
+        }
+        for (int vcpu = 0; vcpu < vcpus && ret == 0; vcpu++) {
+            ret = virDomainPinVcpuFlags(dom, vcpu, (unsigned char*)cpumap, maplen, affects[i]);
+        }
+        if (ret == 0) {
+            ret = virDomainPinEmulator(dom, (unsigned char*)cpumap, maplen, affects[i]);
+        }
+    }
+    virDomainFree(dom);
+
+    if (ret < 0) {
+        set_error("Failed to pin CPUs");
+        return LV_ERR_OPERATION;
+    }
+
+    return LV_OK;
+}
+
+int lv_domain_migrate(const char* name, const char* dest_uri) {
+    if (g_conn == NULL) {
+        set_error("Not connected");
+        return LV_ERR_CONNECT;
+    }
+
+    virDomainPtr dom = virDomainLookupByName(g_conn, name);
+    if (dom == NULL) {
+        set_error("Domain not found");
+        return LV_ERR_NOT_FOUND;
+    }
+
+    /* The source libvirtd drives the migration, and the domain ends up
+     * defined on the target only */
+    unsigned long flags = VIR_MIGRATE_LIVE | VIR_MIGRATE_PEER2PEER |
+                          VIR_MIGRATE_PERSIST_DEST | VIR_MIGRATE_UNDEFINE_SOURCE;
+    int ret = virDomainMigrateToURI(dom, dest_uri, flags, NULL, 0);
+    virDomainFree(dom);
+
+    if (ret < 0) {
+        set_error("Failed to migrate domain");
+        return LV_ERR_OPERATION;
+    }
+
+    return LV_OK;
+}
+
 /*
  * Storage (simplified)
  */
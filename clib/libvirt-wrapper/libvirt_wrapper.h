@@ -8,6 +8,7 @@
 #ifndef LIBVIRT_WRAPPER_H
 #define LIBVIRT_WRAPPER_H
 
+#include <stddef.h>
 #include <stdint.h>
 
 #ifdef __cplusplus
@@ -39,9 +40,11 @@ typedef struct {
     char*    name;
     int      state;
     uint32_t vcpus;
+    uint32_t max_vcpus;
     uint64_t memory_kb;
     uint64_t max_memory_kb;
     uint64_t cpu_time_ns;
+    int      has_managed_save;  /* Shut off with its memory saved to disk */
 } lv_domain_info_t;
 
 /* Domain statistics */
@@ -127,6 +130,10 @@ int lv_domain_suspend(const char* name);
 /* Resume a suspended domain */
 int lv_domain_resume(const char* name);
 
+/* Save a running domain's memory to disk and stop it; the next start
+ * restores it */
+int lv_domain_managed_save(const char* name);
+
 /*
  * Domain information
  */
@@ -143,6 +150,11 @@ void lv_free_domain_info(lv_domain_info_t* info);
 /* Get domain XML configuration */
 char* lv_domain_get_xml(const char* name);
 
+/* Take a screenshot of a running domain's first display. On success *data
+ * holds *len bytes of the image and *mime its MIME type; the caller frees
+ * both with free() */
+int lv_domain_screenshot(const char* name, unsigned char** data, size_t* len, char** mime);
+
 /* Get domain state */
 int lv_domain_get_state(const char* name);
 
@@ -178,6 +190,25 @@ int lv_domain_set_vcpus(const char* name, uint32_t count);
 /* Set domain memory (in KB) */
 int lv_domain_set_memory(const char* name, uint64_t memory_kb);
 
+/* Flags for the *_flags setters (mirror libvirt) */
+#define LV_AFFECT_LIVE        1  /* Change the running domain */
+#define LV_AFFECT_CONFIG      2  /* Change the persistent definition */
+#define LV_SET_MAXIMUM        4  /* Change the maximum instead of the current value */
+
+/* Set domain vCPU count with LV_AFFECT_* and LV_SET_MAXIMUM flags */
+int lv_domain_set_vcpus_flags(const char* name, uint32_t count, unsigned int flags);
+
+/* Set domain memory (in KB) with LV_AFFECT_* and LV_SET_MAXIMUM flags */
+int lv_domain_set_memory_flags(const char* name, uint64_t memory_kb, unsigned int flags);
+
+/* Pin every vCPU and the emulator threads of a domain to the host CPUs set
+ * in cpumap (one bit per CPU) with LV_AFFECT_* flags */
+int lv_domain_pin_cpus(const char* name, const unsigned char* cpumap, int maplen, unsigned int flags);
+
+/* Live migrate a running domain to the libvirtd at dest_uri, leaving it
+ * defined there and undefined here */
+int lv_domain_migrate(const char* name, const char* dest_uri);
+
 /*
  * Storage (simplified interface)
  */
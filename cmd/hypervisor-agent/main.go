@@ -90,6 +90,8 @@ func runAgent(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	config.Version = Version
+
 	logger.Info("starting hypervisor agent",
 		zap.String("version", Version),
 		zap.String("hostname", config.Hostname),
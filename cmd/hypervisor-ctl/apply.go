@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/compute/driver"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v3"
+)
+
+// instanceManifest is the declarative form of an instance, as read by apply.
+type instanceManifest struct {
+	Kind             string            `yaml:"kind"`
+	Name             string            `yaml:"name"`
+	Type             string            `yaml:"type"`
+	Labels           map[string]string `yaml:"labels"`
+	Annotations      map[string]string `yaml:"annotations"`
+	HighAvailability bool              `yaml:"highAvailability"`
+	Placement        struct {
+		Node   string `yaml:"node"`
+		Region string `yaml:"region"`
+		Zone   string `yaml:"zone"`
+
+		// Spread across node, zone or region from instances matching
+		// matchLabels (default: the instance's labels)
+		Spread []struct {
+			TopologyKey string            `yaml:"topologyKey"`
+			MatchLabels map[string]string `yaml:"matchLabels"`
+		} `yaml:"spread"`
+
+		// Labels the node must have, and node taints to place despite
+		NodeSelector map[string]string `yaml:"nodeSelector"`
+		Tolerations  []struct {
+			Key      string `yaml:"key"`
+			Operator string `yaml:"operator"` // Equal (default) or Exists
+			Value    string `yaml:"value"`
+			Effect   string `yaml:"effect"` // Empty matches every effect
+		} `yaml:"tolerations"`
+	} `yaml:"placement"`
+	Spec instanceManifestSpec `yaml:"spec"`
+}
+
+type instanceManifestSpec struct {
+	Image      string            `yaml:"image"`
+	Arch       string            `yaml:"arch"` // amd64 or arm64; empty runs on any node
+	CPUs       int32             `yaml:"cpus"`
+	Memory     string            `yaml:"memory"` // e.g. 2Gi
+	Kernel     string            `yaml:"kernel"`
+	Initrd     string            `yaml:"initrd"`
+	KernelArgs string            `yaml:"kernelArgs"`
+	Command    []string          `yaml:"command"`
+	Args       []string          `yaml:"args"`
+	Env        map[string]string `yaml:"env"`
+	Runtime    string            `yaml:"runtime"` // Container runtime: runc, kata, gvisor; empty uses the node's default
+	HugePages  bool              `yaml:"hugepages"`
+
+	GPU *struct {
+		Count  int32  `yaml:"count"`
+		Vendor string `yaml:"vendor"` // nvidia, amd, intel or a PCI vendor ID
+		Device string `yaml:"device"` // PCI device ID, e.g. 20b0
+	} `yaml:"gpu"`
+
+	CPUPlacement *struct {
+		DedicatedCores bool   `yaml:"dedicatedCores"`
+		NUMANode       *int32 `yaml:"numaNode"`
+	} `yaml:"cpuPlacement"`
+
+	Disks []struct {
+		Name   string `yaml:"name"`
+		Size   string `yaml:"size"`
+		Type   string `yaml:"type"`
+		Source string `yaml:"source"`
+		Boot   bool   `yaml:"boot"`
+	} `yaml:"disks"`
+
+	Network *struct {
+		Network        string   `yaml:"network"`
+		Subnet         string   `yaml:"subnet"`
+		Port           string   `yaml:"port"` // Existing port ID to attach
+		IP             string   `yaml:"ip"`
+		MAC            string   `yaml:"mac"`
+		SecurityGroups []string `yaml:"securityGroups"`
+		PublicIP       bool     `yaml:"publicIP"`
+		Binding        string   `yaml:"binding"` // ovs (default), vhost-user or sriov
+	} `yaml:"network"`
+
+	Limits *struct {
+		CPUQuota   int64  `yaml:"cpuQuota"`
+		CPUPeriod  int64  `yaml:"cpuPeriod"`
+		Memory     string `yaml:"memory"`
+		MemorySwap string `yaml:"memorySwap"`
+		IOReadBPS  int64  `yaml:"ioReadBps"`
+		IOWriteBPS int64  `yaml:"ioWriteBps"`
+	} `yaml:"limits"`
+
+	CPU *struct {
+		Mode             string   `yaml:"mode"`
+		Model            string   `yaml:"model"`
+		RequiredFeatures []string `yaml:"requiredFeatures"`
+		DisabledFeatures []string `yaml:"disabledFeatures"`
+	} `yaml:"cpu"`
+}
+
+func applyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "apply -f <file>",
+		Short: "Create or update resources from a YAML manifest",
+		Long: `Create or update resources from a YAML manifest. A file may hold several
+documents separated by "---"; use "-f -" to read standard input.
+
+Instances are matched by name. A new instance is created along with a
+network port when spec.network names a network. For an existing instance,
+labels, annotations and highAvailability are updated in place; other spec
+changes require deleting the instance first.
+
+Sizes accept binary (Ki, Mi, Gi, Ti) and decimal (K, M, G, T) suffixes;
+plain numbers are bytes.
+
+Example:
+  kind: Instance
+  name: web-1
+  type: vm
+  labels: {app: web}
+  placement:
+    spread:
+      - {topologyKey: zone}   # away from other app=web instances
+  spec:
+    image: ubuntu-22.04
+    cpus: 2
+    memory: 2Gi
+    disks:
+      - {name: data, size: 20Gi, type: ssd}
+    network:
+      network: <network-id>
+      subnet: <subnet-id>
+      securityGroups: [<sg-id>]`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			files, _ := cmd.Flags().GetStringSlice("filename")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			var manifests []*instanceManifest
+			for _, file := range files {
+				m, err := readManifests(file)
+				if err != nil {
+					return withExitCode(exitUsage, err)
+				}
+				manifests = append(manifests, m...)
+			}
+
+			return applyManifests(manifests, dryRun)
+		},
+	}
+
+	cmd.Flags().StringSliceP("filename", "f", nil, "manifest file(s) to apply, or - for stdin (required)")
+	cmd.Flags().Bool("dry-run", false, "show what would change without applying it")
+	cmd.MarkFlagRequired("filename")
+
+	return cmd
+}
+
+// readManifests parses every document in a manifest file.
+func readManifests(file string) ([]*instanceManifest, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	var manifests []*instanceManifest
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	for i := 1; ; i++ {
+		var m instanceManifest
+		if err := decoder.Decode(&m); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("%s: document %d: %w", file, i, err)
+		}
+		if err := m.validate(); err != nil {
+			return nil, fmt.Errorf("%s: document %d: %w", file, i, err)
+		}
+		manifests = append(manifests, &m)
+	}
+	return manifests, nil
+}
+
+func (m *instanceManifest) validate() error {
+	if !strings.EqualFold(m.Kind, "Instance") {
+		return fmt.Errorf("unsupported kind %q (expected Instance)", m.Kind)
+	}
+	if m.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if m.Spec.Image == "" {
+		return fmt.Errorf("instance/%s: spec.image is required", m.Name)
+	}
+	if m.Type == "" {
+		m.Type = "vm"
+	}
+	if _, err := parseInstanceType(m.Type); err != nil {
+		return fmt.Errorf("instance/%s: %w", m.Name, err)
+	}
+	if net := m.Spec.Network; net != nil && net.Port != "" && (net.IP != "" || net.MAC != "") {
+		return fmt.Errorf("instance/%s: spec.network.port cannot be combined with ip or mac", m.Name)
+	}
+	if net := m.Spec.Network; net != nil {
+		switch net.Binding {
+		case "", "ovs", "vhost-user", "sriov":
+		default:
+			return fmt.Errorf("instance/%s: spec.network.binding must be ovs, vhost-user or sriov, got %q", m.Name, net.Binding)
+		}
+	}
+	if m.Spec.Runtime != "" {
+		// Normalized so it compares equal to the runtime the server stores
+		runtime, err := driver.ParseRuntime(m.Spec.Runtime)
+		if err != nil {
+			return fmt.Errorf("instance/%s: spec.runtime: %w", m.Name, err)
+		}
+		m.Spec.Runtime = runtime
+	}
+	return nil
+}
+
+// toProtoSpec converts the manifest spec to its API form.
+func (m *instanceManifest) toProtoSpec() (*v1.InstanceSpec, error) {
+	s := m.Spec
+	spec := &v1.InstanceSpec{
+		Image:        s.Image,
+		CpuCores:     s.CPUs,
+		Kernel:       s.Kernel,
+		Initrd:       s.Initrd,
+		KernelArgs:   s.KernelArgs,
+		Command:      s.Command,
+		Args:         s.Args,
+		Env:          s.Env,
+		Hugepages:    s.HugePages,
+		Architecture: s.Arch,
+		Runtime:      s.Runtime,
+	}
+	if spec.CpuCores == 0 {
+		spec.CpuCores = 1
+	}
+	if g := s.GPU; g != nil {
+		spec.Gpu = &v1.GPURequest{Count: g.Count, Vendor: g.Vendor, DeviceId: g.Device}
+	}
+	if p := s.CPUPlacement; p != nil {
+		spec.CpuPlacement = &v1.CPUPlacement{DedicatedCores: p.DedicatedCores, NumaNode: p.NUMANode}
+	}
+	spec.NodeSelector = m.Placement.NodeSelector
+	for _, t := range m.Placement.Tolerations {
+		spec.Tolerations = append(spec.Tolerations, &v1.Toleration{
+			Key:      t.Key,
+			Operator: t.Operator,
+			Value:    t.Value,
+			Effect:   t.Effect,
+		})
+	}
+
+	var err error
+	if spec.MemoryBytes, err = parseSize(s.Memory, 512*1024*1024); err != nil {
+		return nil, fmt.Errorf("spec.memory: %w", err)
+	}
+
+	for i, d := range s.Disks {
+		size, err := parseSize(d.Size, 0)
+		if err != nil {
+			return nil, fmt.Errorf("spec.disks[%d].size: %w", i, err)
+		}
+		spec.Disks = append(spec.Disks, &v1.DiskSpec{
+			Name:       d.Name,
+			SizeBytes:  size,
+			Type:       d.Type,
+			Boot:       d.Boot,
+			SourcePath: d.Source,
+		})
+	}
+
+	if net := s.Network; net != nil {
+		spec.Network = &v1.NetworkSpec{
+			NetworkId:      net.Network,
+			SubnetId:       net.Subnet,
+			SecurityGroups: net.SecurityGroups,
+			AssignPublicIp: net.PublicIP,
+			IpAddress:      net.IP,
+			MacAddress:     net.MAC,
+			BindingType:    net.Binding,
+		}
+	}
+
+	if l := s.Limits; l != nil {
+		spec.Limits = &v1.ResourceLimits{
+			CpuQuota:   l.CPUQuota,
+			CpuPeriod:  l.CPUPeriod,
+			IoReadBps:  l.IOReadBPS,
+			IoWriteBps: l.IOWriteBPS,
+		}
+		if spec.Limits.MemoryLimit, err = parseSize(l.Memory, 0); err != nil {
+			return nil, fmt.Errorf("spec.limits.memory: %w", err)
+		}
+		if spec.Limits.MemorySwap, err = parseSize(l.MemorySwap, 0); err != nil {
+			return nil, fmt.Errorf("spec.limits.memorySwap: %w", err)
+		}
+	}
+
+	if c := s.CPU; c != nil {
+		spec.Cpu = &v1.CPUSpec{
+			Mode:             c.Mode,
+			Model:            c.Model,
+			RequiredFeatures: c.RequiredFeatures,
+			DisabledFeatures: c.DisabledFeatures,
+		}
+	}
+
+	return spec, nil
+}
+
+// parseSize parses a size such as "512Mi", "20G" or "1073741824" into bytes.
+// An empty string yields def.
+func parseSize(s string, def int64) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+
+	factor := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, factor = strings.TrimSuffix(s, u.suffix), u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, usageErrorf("invalid size %q", s)
+	}
+	return n * factor, nil
+}
+
+func applyManifests(manifests []*instanceManifest, dryRun bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	list, err := v1.NewComputeServiceClient(conn).ListInstances(ctx, &v1.ListInstancesRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list instances: %w", err)
+	}
+	existing := make(map[string]*v1.Instance, len(list.Instances))
+	for _, inst := range list.Instances {
+		existing[inst.Name] = inst
+	}
+
+	suffix := ""
+	if dryRun {
+		suffix = " (dry run)"
+	}
+
+	structured := output == "json" || output == "yaml"
+	items := make([]map[string]any, 0, len(manifests))
+	var failed int
+	var lastErr error
+	for _, m := range manifests {
+		item := map[string]any{"kind": "instance", "name": m.Name, "dry_run": dryRun}
+		items = append(items, item)
+
+		result, err := applyInstance(ctx, conn, m, existing[m.Name], dryRun)
+		if err != nil {
+			if len(manifests) > 1 {
+				fmt.Fprintf(os.Stderr, "instance/%s: %v\n", m.Name, err)
+			}
+			item["error"] = err.Error()
+			lastErr = fmt.Errorf("instance/%s: %w", m.Name, err)
+			failed++
+			continue
+		}
+		item["result"] = result
+		if !structured {
+			fmt.Printf("instance/%s %s%s\n", m.Name, result, suffix)
+		}
+	}
+
+	if structured {
+		if err := printStructured(items); err != nil {
+			return err
+		}
+	}
+	switch {
+	case failed == 0:
+		return nil
+	case len(manifests) == 1:
+		// Keep the cause so the exit code tells what went wrong
+		return lastErr
+	default:
+		return fmt.Errorf("%d of %d resources failed to apply", failed, len(manifests))
+	}
+}
+
+// applyInstance creates or updates one instance and returns what was done.
+func applyInstance(ctx context.Context, conn *grpc.ClientConn, m *instanceManifest, current *v1.Instance, dryRun bool) (string, error) {
+	spec, err := m.toProtoSpec()
+	if err != nil {
+		return "", err
+	}
+	instanceType, _ := parseInstanceType(m.Type)
+	compute := v1.NewComputeServiceClient(conn)
+
+	if current != nil {
+		if current.Type != instanceType {
+			return "", fmt.Errorf("type cannot change from %s; delete the instance and apply again", current.Type)
+		}
+		if diff := immutableSpecDiff(spec, current.Spec); len(diff) > 0 {
+			return "", fmt.Errorf("immutable fields changed (%s); delete the instance and apply again",
+				strings.Join(diff, ", "))
+		}
+
+		if maps.Equal(m.Labels, current.Metadata.GetLabels()) &&
+			maps.Equal(m.Annotations, current.Metadata.GetAnnotations()) &&
+			m.HighAvailability == current.HighAvailability {
+			return "unchanged", nil
+		}
+		if dryRun {
+			return "configured", nil
+		}
+
+		_, err := compute.UpdateInstance(ctx, &v1.UpdateInstanceRequest{
+			InstanceId:       current.Id,
+			Metadata:         &v1.Metadata{Labels: m.Labels, Annotations: m.Annotations},
+			HighAvailability: m.HighAvailability,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to update instance: %w", err)
+		}
+		return "configured", nil
+	}
+
+	if dryRun {
+		return "created", nil
+	}
+
+	// Attach an existing port or create one for the instance
+	network := v1.NewNetworkServiceClient(conn)
+	var port *v1.Port
+	createdPort := false
+	if net := m.Spec.Network; net != nil && net.Port != "" {
+		resp, err := network.GetPort(ctx, &v1.GetPortRequest{PortId: net.Port})
+		if err != nil {
+			return "", fmt.Errorf("failed to get port %s: %w", net.Port, err)
+		}
+		port = resp.Port
+	} else if net != nil && net.Network != "" {
+		resp, err := network.CreatePort(ctx, &v1.CreatePortRequest{
+			Name:           m.Name,
+			NetworkId:      net.Network,
+			SubnetId:       net.Subnet,
+			MacAddress:     net.MAC,
+			IpAddress:      net.IP,
+			SecurityGroups: net.SecurityGroups,
+			Zone:           m.Placement.Zone,
+			BindingType:    protoPortBinding(net.Binding),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create port: %w", err)
+		}
+		port, createdPort = resp.Port, true
+	}
+	if port != nil {
+		spec.Network.NetworkId = port.NetworkId
+		spec.Network.SubnetId = port.SubnetId
+		spec.Network.IpAddress = port.IpAddress
+		spec.Network.MacAddress = port.MacAddress
+
+		// The node plugs vhost-user and SR-IOV ports itself, and binds them
+		// to the device it plugged
+		if binding := manifestPortBinding(port.BindingType); binding != "" {
+			spec.Network.PortId = port.Id
+			spec.Network.BindingType = binding
+		}
+	}
+
+	var spread []*v1.SpreadConstraint
+	for _, c := range m.Placement.Spread {
+		spread = append(spread, &v1.SpreadConstraint{TopologyKey: c.TopologyKey, MatchLabels: c.MatchLabels})
+	}
+
+	inst, err := compute.CreateInstance(ctx, &v1.CreateInstanceRequest{
+		Name:              m.Name,
+		Type:              instanceType,
+		Spec:              spec,
+		Metadata:          &v1.Metadata{Labels: m.Labels, Annotations: m.Annotations},
+		PreferredNodeId:   m.Placement.Node,
+		Region:            m.Placement.Region,
+		Zone:              m.Placement.Zone,
+		HighAvailability:  m.HighAvailability,
+		SpreadConstraints: spread,
+	})
+	if err != nil {
+		if createdPort {
+			_, _ = network.DeletePort(ctx, &v1.DeletePortRequest{PortId: port.Id})
+		}
+		return "", fmt.Errorf("failed to create instance: %w", err)
+	}
+
+	if port != nil && spec.Network.PortId == "" {
+		_, err := network.BindPort(ctx, &v1.BindPortRequest{
+			PortId:     port.Id,
+			InstanceId: inst.Id,
+			NodeId:     inst.NodeId,
+		})
+		if err != nil {
+			return "", fmt.Errorf("instance %s created but failed to bind port %s: %w", inst.Id, port.Id, err)
+		}
+	}
+
+	return "created", nil
+}
+
+// protoPortBinding returns the binding type of a port created for a
+// manifest's network binding.
+func protoPortBinding(binding string) v1.PortBindingType {
+	switch binding {
+	case "vhost-user":
+		return v1.PortBindingType_PORT_BINDING_VHOST_USER
+	case "sriov":
+		return v1.PortBindingType_PORT_BINDING_SRIOV
+	}
+	return v1.PortBindingType_PORT_BINDING_UNSPECIFIED
+}
+
+// manifestPortBinding returns the instance binding a port needs, or "" for
+// a port bound on the integration bridge like any other.
+func manifestPortBinding(t v1.PortBindingType) string {
+	switch t {
+	case v1.PortBindingType_PORT_BINDING_VHOST_USER:
+		return "vhost-user"
+	case v1.PortBindingType_PORT_BINDING_SRIOV:
+		return "sriov"
+	}
+	return ""
+}
+
+// immutableSpecDiff lists the spec fields that differ between the manifest
+// and the running instance and cannot be changed in place.
+func immutableSpecDiff(want, have *v1.InstanceSpec) []string {
+	if have == nil {
+		have = &v1.InstanceSpec{}
+	}
+
+	var diff []string
+	check := func(field string, changed bool) {
+		if changed {
+			diff = append(diff, field)
+		}
+	}
+
+	check("spec.image", want.Image != have.Image)
+	check("spec.cpus", want.CpuCores != have.CpuCores)
+	check("spec.memory", want.MemoryBytes>>20 != have.MemoryBytes>>20) // Stored in whole MiB
+	check("spec.kernel", want.Kernel != have.Kernel)
+	check("spec.hugepages", want.Hugepages != have.Hugepages)
+	check("spec.arch", want.Architecture != have.Architecture)
+	check("spec.runtime", want.Runtime != "" && want.Runtime != have.Runtime) // Unset takes the node's default
+	check("spec.gpu", want.Gpu.GetCount() != have.Gpu.GetCount() || want.Gpu.GetVendor() != have.Gpu.GetVendor() ||
+		want.Gpu.GetDeviceId() != have.Gpu.GetDeviceId())
+	check("spec.cpuPlacement", want.CpuPlacement.GetDedicatedCores() != have.CpuPlacement.GetDedicatedCores() ||
+		numaNodeName(want.CpuPlacement) != numaNodeName(have.CpuPlacement))
+	check("spec.disks", !slices.EqualFunc(want.Disks, have.Disks, func(a, b *v1.DiskSpec) bool {
+		// Sizes are stored in whole GiB
+		return a.Name == b.Name && a.Type == b.Type && a.Boot == b.Boot &&
+			a.SizeBytes>>30 == b.SizeBytes>>30 && a.SourcePath == b.SourcePath
+	}))
+	check("spec.network.network", want.Network.GetNetworkId() != "" && want.Network.GetNetworkId() != have.Network.GetNetworkId())
+	check("spec.network.subnet", want.Network.GetSubnetId() != "" && want.Network.GetSubnetId() != have.Network.GetSubnetId())
+	check("spec.cpu", want.Cpu.GetMode() != have.Cpu.GetMode() || want.Cpu.GetModel() != have.Cpu.GetModel() ||
+		!slices.Equal(want.Cpu.GetRequiredFeatures(), have.Cpu.GetRequiredFeatures()))
+
+	return diff
+}
+
+// numaNodeName returns the preferred NUMA node of a placement, or "" for
+// none, so that node 0 differs from no preference.
+func numaNodeName(p *v1.CPUPlacement) string {
+	if p == nil || p.NumaNode == nil {
+		return ""
+	}
+	return fmt.Sprint(*p.NumaNode)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func bgpCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bgp",
+		Short: "Advertise the addresses of external networks to upstream routers",
+	}
+
+	// network bgp set <network-id>
+	setCmd := &cobra.Command{
+		Use:   "set <network-id>",
+		Short: "Advertise the floating IPs and router gateways of an external network over BGP",
+		Long: `Make gateway nodes advertise the floating IPs associated with a port and the
+router gateway addresses of an external network, each as a /32 with the node
+as next hop, for sites where the upstream routers share no L2 segment with
+the nodes. Each gateway node runs a speaker dialing the peers.
+
+This replaces the whole BGP configuration of the network. Passwords are
+never returned, so give them again on every change.`,
+		Example: `  hypervisor-ctl network bgp set <network-id> --local-as 64512 --node gw-1 --node gw-2 --peer 10.1.0.1:65000
+  hypervisor-ctl network bgp set <network-id> --local-as 64512 --node gw-1 --node gw-2 \
+      --peer 10.1.0.1:65000:gw-1 --peer 10.2.0.1:65000:gw-2 --password secret`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := &v1.BGPConfig{}
+			config.LocalAs, _ = cmd.Flags().GetUint32("local-as")
+			config.Nodes, _ = cmd.Flags().GetStringArray("node")
+			specs, _ := cmd.Flags().GetStringArray("peer")
+			password, _ := cmd.Flags().GetString("password")
+
+			peers, err := parseBGPPeers(specs, password)
+			if err != nil {
+				return err
+			}
+			config.Peers = peers
+			return setNetworkBGP(args[0], config)
+		},
+	}
+	setCmd.Flags().Uint32("local-as", 0, "AS number of the speakers")
+	setCmd.Flags().StringArray("node", nil, "gateway node running a speaker (repeatable)")
+	setCmd.Flags().StringArray("peer", nil, "upstream router as <address>:<remote-as>[:<node>,...] (repeatable); nodes limit the speakers peering with it")
+	setCmd.Flags().String("password", "", "TCP MD5 password of the BGP sessions")
+	setCmd.MarkFlagRequired("local-as")
+	setCmd.MarkFlagRequired("node")
+	setCmd.MarkFlagRequired("peer")
+	cmd.AddCommand(setCmd)
+
+	// network bgp show <network-id>
+	showCmd := &cobra.Command{
+		Use:   "show <network-id>",
+		Short: "Show the BGP configuration of an external network",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return showNetworkBGP(args[0])
+		},
+	}
+	cmd.AddCommand(showCmd)
+
+	// network bgp clear <network-id>
+	clearCmd := &cobra.Command{
+		Use:   "clear <network-id>",
+		Short: "Stop advertising the addresses of an external network",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return setNetworkBGP(args[0], nil)
+		},
+	}
+	cmd.AddCommand(clearCmd)
+
+	return cmd
+}
+
+func parseBGPPeers(specs []string, password string) ([]*v1.BGPPeer, error) {
+	peers := make([]*v1.BGPPeer, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 || net.ParseIP(parts[0]).To4() == nil {
+			return nil, usageErrorf("invalid peer %q: want <address>:<remote-as>[:<node>,...]", spec)
+		}
+		as, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil || as == 0 {
+			return nil, usageErrorf("invalid remote AS in peer %q: must be 1-4294967295", spec)
+		}
+		peer := &v1.BGPPeer{Address: parts[0], RemoteAs: uint32(as), Password: password}
+		if len(parts) == 3 {
+			peer.Nodes = strings.Split(parts[2], ",")
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// setNetworkBGP replaces the BGP configuration of a network; nil stops
+// advertising.
+func setNetworkBGP(networkID string, config *v1.BGPConfig) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).UpdateNetwork(ctx, &v1.UpdateNetworkRequest{
+		NetworkId:  networkID,
+		Network:    &v1.Network{Bgp: config},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"bgp"}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update network: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Network))
+	}
+	if config == nil {
+		fmt.Printf("Network %s no longer advertised over BGP\n", networkID)
+		return nil
+	}
+	return printNetworkBGP(resp.Network)
+}
+
+func showNetworkBGP(networkID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).GetNetwork(ctx, &v1.GetNetworkRequest{NetworkId: networkID})
+	if err != nil {
+		return fmt.Errorf("failed to get network: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Network.GetBgp()))
+	}
+	return printNetworkBGP(resp.Network)
+}
+
+func printNetworkBGP(network *v1.Network) error {
+	config := network.GetBgp()
+	if config == nil {
+		fmt.Printf("Network %s is not advertised over BGP\n", network.Id)
+		return nil
+	}
+
+	fmt.Printf("Network %s advertised from AS %d by %s\n", network.Id, config.LocalAs, strings.Join(config.Nodes, ", "))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tREMOTE AS\tSPEAKERS")
+	for _, peer := range config.Peers {
+		speakers := "all"
+		if len(peer.Nodes) > 0 {
+			speakers = strings.Join(peer.Nodes, ",")
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", peer.Address, peer.RemoteAs, speakers)
+	}
+	w.Flush()
+
+	return nil
+}
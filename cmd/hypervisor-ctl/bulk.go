@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+// bulkOpTimeout bounds a single node operation within a bulk run.
+const bulkOpTimeout = 5 * time.Minute
+
+// nodeOp performs an operation on one node and returns a short detail line.
+type nodeOp func(ctx context.Context, client v1.ClusterServiceClient, nodeID string) (string, error)
+
+// bulkResult is the outcome of a node operation.
+type bulkResult struct {
+	nodeID string
+	detail string
+	err    error
+}
+
+// addBulkFlags adds the label selector and parallelism flags to a node command.
+func addBulkFlags(cmd *cobra.Command, defaultParallel int) {
+	cmd.Flags().StringP("selector", "l", "", "label selector (e.g. rack=r12,zone=z2)")
+	cmd.Flags().Int("max-parallel", defaultParallel, "maximum number of nodes processed at once")
+}
+
+// runNodeOp runs op against the nodes named in args or matched by the
+// command's label selector.
+func runNodeOp(cmd *cobra.Command, args []string, verb string, op nodeOp) error {
+	selector, _ := cmd.Flags().GetString("selector")
+	maxParallel, _ := cmd.Flags().GetInt("max-parallel")
+
+	if len(args) > 0 && selector != "" {
+		return usageErrorf("specify node IDs or a label selector, not both")
+	}
+	if len(args) == 0 && selector == "" {
+		return usageErrorf("specify node IDs or a label selector (-l)")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+	client := v1.NewClusterServiceClient(conn)
+
+	nodeIDs := args
+	if selector != "" {
+		if nodeIDs, err = selectNodes(client, selector); err != nil {
+			return err
+		}
+		if len(nodeIDs) == 0 {
+			if output == "json" || output == "yaml" {
+				return printStructured([]any{})
+			}
+			fmt.Printf("No nodes match selector %q\n", selector)
+			return nil
+		}
+		progressf("Selector %q matched %d node(s)\n", selector, len(nodeIDs))
+	}
+
+	results := runBulk(client, nodeIDs, maxParallel, verb, op)
+	return printBulkSummary(verb, results)
+}
+
+// parseSelector parses a "key=value,key=value" label selector.
+func parseSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(term, "=")
+		if !ok || key == "" {
+			return nil, usageErrorf("invalid selector term %q: expected key=value", term)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if len(labels) == 0 {
+		return nil, usageErrorf("empty label selector")
+	}
+	return labels, nil
+}
+
+// selectNodes returns the IDs of nodes matching a label selector.
+func selectNodes(client v1.ClusterServiceClient, selector string) ([]string, error) {
+	labels, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := client.ListNodes(ctx, &v1.ListNodesRequest{LabelSelector: labels})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	nodeIDs := make([]string, 0, len(resp.Nodes))
+	for _, node := range resp.Nodes {
+		nodeIDs = append(nodeIDs, node.Id)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs, nil
+}
+
+// runBulk runs op on each node with at most maxParallel in flight, printing
+// a progress line to stderr as each node finishes.
+func runBulk(client v1.ClusterServiceClient, nodeIDs []string, maxParallel int, verb string, op nodeOp) []bulkResult {
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+
+	results := make([]bulkResult, len(nodeIDs))
+	sem := make(chan struct{}, maxParallel)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		finished int
+	)
+
+	for i, nodeID := range nodeIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, nodeID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), bulkOpTimeout)
+			defer cancel()
+
+			detail, err := op(ctx, client, nodeID)
+			results[i] = bulkResult{nodeID: nodeID, detail: detail, err: err}
+
+			mu.Lock()
+			finished++
+			if err != nil {
+				progressf("[%d/%d] %s: %s failed: %v\n", finished, len(nodeIDs), nodeID, verb, err)
+			} else {
+				progressf("[%d/%d] %s: %s\n", finished, len(nodeIDs), nodeID, detail)
+			}
+			mu.Unlock()
+		}(i, nodeID)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// printBulkSummary prints the failures of a bulk run, or every result with
+// structured output, and returns an error if any node failed.
+func printBulkSummary(verb string, results []bulkResult) error {
+	var failed []bulkResult
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, r)
+		}
+	}
+	summary := fmt.Errorf("%s failed on %d of %d nodes", verb, len(failed), len(results))
+
+	if output == "json" || output == "yaml" {
+		items := make([]map[string]any, 0, len(results))
+		for _, r := range results {
+			item := map[string]any{"node_id": r.nodeID, "succeeded": r.err == nil}
+			if r.err != nil {
+				item["error"] = r.err.Error()
+			} else {
+				item["result"] = r.detail
+			}
+			items = append(items, item)
+		}
+		if err := printStructured(items); err != nil {
+			return err
+		}
+		if len(failed) > 0 {
+			return summary
+		}
+		return nil
+	}
+
+	fmt.Println()
+	fmt.Printf("%s: %d succeeded, %d failed\n", verb, len(results)-len(failed), len(failed))
+	if len(failed) == 0 {
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE ID\tERROR")
+	for _, r := range failed {
+		fmt.Fprintf(w, "%s\t%v\n", r.nodeID, r.err)
+	}
+	w.Flush()
+
+	return summary
+}
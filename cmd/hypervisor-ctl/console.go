@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func consoleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "console <instance-id>",
+		Short: "Show the console output of a running instance",
+		Long: `Stream the console output of a running instance until interrupted. The
+command fails early when the instance's driver does not support consoles;
+"instance describe" lists the operations an instance supports.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return attachConsole(args[0])
+		},
+	}
+	return cmd
+}
+
+func attachConsole(id string) error {
+	// The console is a raw byte stream with no structured form
+	if output != "table" {
+		return usageErrorf("console does not support --output %s", output)
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	compute := v1.NewComputeServiceClient(conn)
+	inst, err := compute.GetInstance(ctx, &v1.GetInstanceRequest{InstanceId: id})
+	if err != nil {
+		return fmt.Errorf("failed to get instance: %w", err)
+	}
+	if caps := inst.Capabilities; caps != nil && !caps.Console {
+		return withExitCode(exitUnsupported, fmt.Errorf("console is not supported by driver %s", caps.Driver))
+	}
+
+	stream, err := compute.AttachConsole(ctx, &v1.AttachConsoleRequest{InstanceId: id, Tty: true})
+	if err != nil {
+		return consoleError(err)
+	}
+	for {
+		data, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return consoleError(err)
+		}
+		if _, err := os.Stdout.Write(data.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// consoleError reports an unsupported console by the server's message alone,
+// which names the driver, rather than as an opaque RPC failure.
+func consoleError(err error) error {
+	if st, ok := status.FromError(err); ok && st.Code() == codes.Unimplemented {
+		return withExitCode(exitUnsupported, errors.New(st.Message()))
+	}
+	return fmt.Errorf("failed to attach to console: %w", err)
+}
+
+// capabilityNames lists the optional operations a driver supports.
+func capabilityNames(caps *v1.InstanceCapabilities) string {
+	var names []string
+	if caps.Console {
+		names = append(names, "console")
+	}
+	if caps.Exec {
+		names = append(names, "exec")
+	}
+	if caps.Logs {
+		names = append(names, "logs")
+	}
+	if caps.Pause {
+		names = append(names, "pause")
+	}
+	if caps.Suspend {
+		names = append(names, "suspend")
+	}
+	if caps.Resize {
+		names = append(names, "resize")
+	}
+	if caps.Migrate {
+		names = append(names, "migrate")
+	}
+	if caps.Diagnostics {
+		names = append(names, "diagnostics")
+	}
+	if len(names) == 0 {
+		return "<none>"
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func debugCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "debug",
+		Short: "Collect data for troubleshooting",
+	}
+
+	// debug bundle --node <id>
+	bundleCmd := &cobra.Command{
+		Use:   "bundle",
+		Short: "Download a support bundle of a node",
+		Long: `Have a node's agent gather its journal and state, driver and instance
+states, the end of each instance's log, OVS bridges and flows, network
+namespaces and the etcd keys about the node into a gzipped tar archive, and
+save it for offline troubleshooting.
+
+The bundle may contain sensitive data, such as instance environment
+variables and console output; review it before sharing.`,
+		Example: `  hypervisor-ctl debug bundle --node node-1
+  hypervisor-ctl debug bundle --node node-1 --since 2h --file /tmp/node-1.tar.gz`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			nodeID, _ := cmd.Flags().GetString("node")
+			since, _ := cmd.Flags().GetDuration("since")
+			file, _ := cmd.Flags().GetString("file")
+			return collectSupportBundle(nodeID, since, file)
+		},
+	}
+	bundleCmd.Flags().String("node", "", "node to collect the bundle of (required)")
+	bundleCmd.Flags().Duration("since", 24*time.Hour, "how much of the agent's journal to include")
+	bundleCmd.Flags().StringP("file", "f", "", "file to save the bundle to, or - for stdout (default bundle-<node>-<time>.tar.gz)")
+	bundleCmd.MarkFlagRequired("node")
+	cmd.AddCommand(bundleCmd)
+
+	return cmd
+}
+
+func collectSupportBundle(nodeID string, since time.Duration, file string) (err error) {
+	if since < 0 {
+		return usageErrorf("--since cannot be negative")
+	}
+	if file == "" {
+		file = fmt.Sprintf("bundle-%s-%s.tar.gz", nodeID, time.Now().Format("20060102-150405"))
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	stream, err := v1.NewClusterServiceClient(conn).CollectSupportBundle(ctx, &v1.CollectSupportBundleRequest{
+		NodeId:          nodeID,
+		LogSinceSeconds: int64(since / time.Second),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to collect support bundle: %w", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", file, err)
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(file)
+			}
+		}()
+		w = f
+		progressf("Collecting support bundle of node %s...\n", nodeID)
+	}
+
+	var size int64
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to collect support bundle: %w", err)
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+		size += int64(len(chunk.Data))
+	}
+
+	if file != "-" {
+		fmt.Printf("Support bundle saved to %s (%s)\n", file, formatBytes(float64(size)))
+	}
+	return nil
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// describeEventLimit is how many recent events a describe report includes.
+const describeEventLimit = 20
+
+// condition is a derived health check shown in describe reports.
+type condition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"` // True, False, Unknown
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// instanceReport aggregates everything known about one instance. Sections
+// that could not be fetched are listed in Errors rather than failing the
+// whole report, since describe is most useful when something is broken.
+type instanceReport struct {
+	Instance   *v1.Instance
+	Conditions []condition
+	Ports      []*v1.Port
+	Stats      *v1.InstanceStats
+	History    []*v1.InstanceStateTransition
+	Events     []*v1.Event
+	Errors     map[string]string
+}
+
+// nodeReport aggregates everything known about one node.
+type nodeReport struct {
+	Node      *v1.Node
+	Instances []*v1.Instance
+	Ports     []*v1.Port
+	Events    []*v1.Event
+	Errors    map[string]string
+}
+
+func describeInstance(id string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	report, err := buildInstanceReport(ctx, conn, id)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(report.structured())
+	}
+	report.print(os.Stdout)
+	return nil
+}
+
+func buildInstanceReport(ctx context.Context, conn *grpc.ClientConn, id string) (*instanceReport, error) {
+	compute := v1.NewComputeServiceClient(conn)
+	inst, err := compute.GetInstance(ctx, &v1.GetInstanceRequest{InstanceId: id})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance: %w", err)
+	}
+
+	report := &instanceReport{Instance: inst, Errors: make(map[string]string)}
+
+	if resp, err := compute.GetInstanceHistory(ctx, &v1.GetInstanceHistoryRequest{InstanceId: id}); err != nil {
+		report.Errors["history"] = err.Error()
+	} else {
+		report.History = resp.Transitions
+	}
+
+	if resp, err := v1.NewNetworkServiceClient(conn).ListPorts(ctx, &v1.ListPortsRequest{InstanceId: id}); err != nil {
+		report.Errors["ports"] = err.Error()
+	} else {
+		report.Ports = resp.Ports
+	}
+
+	// Stats come from the agent and only exist while the instance runs
+	if inst.State == v1.InstanceState_INSTANCE_STATE_RUNNING {
+		if stats, err := compute.GetInstanceStats(ctx, &v1.GetInstanceStatsRequest{InstanceId: id}); err != nil {
+			report.Errors["stats"] = err.Error()
+		} else {
+			report.Stats = stats
+		}
+	}
+
+	if resp, err := v1.NewClusterServiceClient(conn).ListEvents(ctx, &v1.ListEventsRequest{
+		Kind:     "instance",
+		ObjectId: id,
+		Limit:    describeEventLimit,
+	}); err != nil {
+		report.Errors["events"] = err.Error()
+	} else {
+		report.Events = resp.Events
+	}
+
+	report.Conditions = instanceConditions(report)
+	return report, nil
+}
+
+// instanceConditions derives the instance's health from the report.
+func instanceConditions(r *instanceReport) []condition {
+	inst := r.Instance
+	var conditions []condition
+
+	if inst.NodeId != "" {
+		conditions = append(conditions, condition{Type: "Scheduled", Status: "True", Message: "on node " + inst.NodeId})
+	} else {
+		conditions = append(conditions, condition{Type: "Scheduled", Status: "False", Reason: "NoNode"})
+	}
+
+	ready := condition{Type: "Running", Status: "False", Reason: stateName(inst.State), Message: inst.StateReason}
+	if inst.State == v1.InstanceState_INSTANCE_STATE_RUNNING {
+		ready = condition{Type: "Running", Status: "True"}
+	}
+	conditions = append(conditions, ready)
+
+	if inst.DesiredState != v1.InstanceState_INSTANCE_STATE_UNSPECIFIED {
+		synced := condition{Type: "DesiredStateReached", Status: "True"}
+		if inst.State != inst.DesiredState {
+			synced = condition{
+				Type:    "DesiredStateReached",
+				Status:  "False",
+				Reason:  "Reconciling",
+				Message: fmt.Sprintf("desired %s, observed %s", stateName(inst.DesiredState), stateName(inst.State)),
+			}
+		}
+		conditions = append(conditions, synced)
+	}
+
+	if inst.Spec.GetNetwork().GetNetworkId() != "" {
+		attached := condition{Type: "NetworkAttached", Status: "Unknown", Reason: "PortsUnavailable"}
+		if _, failed := r.Errors["ports"]; !failed {
+			attached = condition{Type: "NetworkAttached", Status: "False", Reason: "NoPort"}
+			if len(r.Ports) > 0 {
+				attached = condition{Type: "NetworkAttached", Status: "True", Message: fmt.Sprintf("%d port(s)", len(r.Ports))}
+			}
+		}
+		conditions = append(conditions, attached)
+	}
+
+	return conditions
+}
+
+func (r *instanceReport) print(out io.Writer) {
+	inst := r.Instance
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", inst.Id)
+	fmt.Fprintf(w, "Name:\t%s\n", inst.Name)
+	fmt.Fprintf(w, "Type:\t%s\n", strings.ToLower(strings.TrimPrefix(inst.Type.String(), "INSTANCE_TYPE_")))
+	fmt.Fprintf(w, "State:\t%s\n", stateName(inst.State))
+	if inst.DesiredState != v1.InstanceState_INSTANCE_STATE_UNSPECIFIED {
+		fmt.Fprintf(w, "Desired State:\t%s\n", stateName(inst.DesiredState))
+	}
+	if inst.StateReason != "" {
+		fmt.Fprintf(w, "Reason:\t%s\n", inst.StateReason)
+	}
+	fmt.Fprintf(w, "Node:\t%s\n", inst.NodeId)
+	fmt.Fprintf(w, "IP:\t%s\n", inst.IpAddress)
+	if inst.Spec != nil {
+		fmt.Fprintf(w, "Image:\t%s\n", inst.Spec.Image)
+		if inst.Spec.Architecture != "" {
+			fmt.Fprintf(w, "Architecture:\t%s\n", inst.Spec.Architecture)
+		}
+		if inst.Spec.Runtime != "" {
+			fmt.Fprintf(w, "Runtime:\t%s\n", inst.Spec.Runtime)
+		}
+		fmt.Fprintf(w, "CPUs:\t%d\n", inst.Spec.CpuCores)
+		fmt.Fprintf(w, "Memory:\t%s\n", formatBytes(float64(inst.Spec.MemoryBytes)))
+		if len(inst.Spec.GpuDevices) > 0 {
+			fmt.Fprintf(w, "GPUs:\t%s\n", strings.Join(inst.Spec.GpuDevices, ", "))
+		} else if inst.Spec.GetGpu().GetCount() > 0 {
+			fmt.Fprintf(w, "GPUs:\t%d requested\n", inst.Spec.Gpu.Count)
+		}
+		if len(inst.Spec.PinnedCpus) > 0 {
+			fmt.Fprintf(w, "Dedicated Cores:\t%s\n", formatCPUList(inst.Spec.PinnedCpus))
+		}
+		if len(inst.Spec.NumaNodes) > 0 {
+			fmt.Fprintf(w, "NUMA Nodes:\t%s\n", formatCPUList(inst.Spec.NumaNodes))
+		}
+	}
+	if labels := inst.Metadata.GetLabels(); len(labels) > 0 {
+		fmt.Fprintf(w, "Labels:\t%s\n", formatLabels(labels))
+	}
+	if inst.CreatedAt != nil {
+		fmt.Fprintf(w, "Created:\t%s\n", inst.CreatedAt.AsTime().Local().Format(time.DateTime))
+	}
+	if inst.HighAvailability {
+		fmt.Fprintf(w, "Rescheduled:\t%d times\n", inst.RescheduleCount)
+	}
+	for _, c := range inst.SpreadConstraints {
+		fmt.Fprintf(w, "Spread:\tacross %ss from %s\n", c.TopologyKey, formatLabels(c.MatchLabels))
+	}
+	if caps := inst.Capabilities; caps != nil {
+		fmt.Fprintf(w, "Driver:\t%s\n", caps.Driver)
+		fmt.Fprintf(w, "Operations:\t%s\n", capabilityNames(caps))
+	}
+	w.Flush()
+
+	printConditions(out, r.Conditions)
+	printScheduling(out, inst.LastScheduling)
+
+	fmt.Fprintln(out, "\nVolumes:")
+	if len(inst.Spec.GetDisks()) == 0 {
+		fmt.Fprintln(out, "  <none>")
+	} else {
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  NAME\tSIZE\tTYPE\tBOOT\tSOURCE")
+		for _, d := range inst.Spec.Disks {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%t\t%s\n", d.Name, formatBytes(float64(d.SizeBytes)), d.Type, d.Boot, d.SourcePath)
+		}
+		w.Flush()
+	}
+
+	fmt.Fprintln(out, "\nPorts:")
+	printPorts(out, r.Ports, r.Errors["ports"])
+
+	fmt.Fprintln(out, "\nStats:")
+	switch {
+	case r.Errors["stats"] != "":
+		fmt.Fprintf(out, "  <unavailable: %s>\n", r.Errors["stats"])
+	case r.Stats == nil:
+		fmt.Fprintln(out, "  <not running>")
+	default:
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "  CPU:\t%.1f%%\n", r.Stats.CpuUsagePercent)
+		fmt.Fprintf(w, "  Memory:\t%s\n", formatBytes(float64(r.Stats.MemoryUsedBytes)))
+		fmt.Fprintf(w, "  Disk R/W:\t%s / %s\n", formatBytes(float64(r.Stats.DiskReadBytes)), formatBytes(float64(r.Stats.DiskWriteBytes)))
+		fmt.Fprintf(w, "  Net RX/TX:\t%s / %s\n", formatBytes(float64(r.Stats.NetworkRxBytes)), formatBytes(float64(r.Stats.NetworkTxBytes)))
+		w.Flush()
+	}
+
+	fmt.Fprintln(out, "\nState history:")
+	if r.Errors["history"] != "" {
+		fmt.Fprintf(out, "  <unavailable: %s>\n", r.Errors["history"])
+	} else if len(r.History) == 0 {
+		fmt.Fprintln(out, "  <none>")
+	} else {
+		transitionState := func(s v1.InstanceState) string {
+			if s == v1.InstanceState_INSTANCE_STATE_UNSPECIFIED {
+				return "-"
+			}
+			return stateName(s)
+		}
+
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  TIME\tFROM\tTO\tNODE\tREASON")
+		for _, t := range r.History {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n",
+				t.Time.AsTime().Local().Format(time.DateTime),
+				transitionState(t.FromState), transitionState(t.ToState), t.NodeId, t.Reason)
+		}
+		w.Flush()
+	}
+
+	fmt.Fprintln(out, "\nEvents:")
+	printEvents(out, r.Events, r.Errors["events"])
+}
+
+// printScheduling prints the last scheduling attempt of an instance and why
+// each rejected node was rejected.
+func printScheduling(out io.Writer, attempt *v1.SchedulingAttempt) {
+	fmt.Fprintln(out, "\nLast scheduling:")
+	if attempt == nil {
+		fmt.Fprintln(out, "  <none>")
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  Time:\t%s\n", attempt.Time.AsTime().Local().Format(time.DateTime))
+	if attempt.Error != "" {
+		fmt.Fprintf(w, "  Result:\tfailed, %d nodes considered\n", attempt.Candidates)
+		fmt.Fprintf(w, "  Error:\t%s\n", attempt.Error)
+	} else {
+		fmt.Fprintf(w, "  Result:\tplaced on %s, %d nodes considered\n", attempt.NodeId, attempt.Candidates)
+	}
+	w.Flush()
+	if len(attempt.Rejected) == 0 {
+		return
+	}
+
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  REJECTED NODE\tREASON")
+	for _, id := range slices.Sorted(maps.Keys(attempt.Rejected)) {
+		fmt.Fprintf(w, "  %s\t%s\n", id, attempt.Rejected[id])
+	}
+	w.Flush()
+}
+
+func (r *instanceReport) structured() map[string]any {
+	return map[string]any{
+		"instance":   protoJSON(r.Instance),
+		"conditions": r.Conditions,
+		"ports":      protoJSONList(r.Ports),
+		"stats":      protoJSON(r.Stats),
+		"history":    protoJSONList(r.History),
+		"events":     protoJSONList(r.Events),
+		"errors":     r.Errors,
+	}
+}
+
+func describeNode(id string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	report, err := buildNodeReport(ctx, conn, id)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(report.structured())
+	}
+	report.print(os.Stdout)
+	return nil
+}
+
+func buildNodeReport(ctx context.Context, conn *grpc.ClientConn, id string) (*nodeReport, error) {
+	cluster := v1.NewClusterServiceClient(conn)
+	node, err := cluster.GetNode(ctx, &v1.GetNodeRequest{NodeId: id})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node: %w", err)
+	}
+
+	report := &nodeReport{Node: node, Errors: make(map[string]string)}
+
+	if resp, err := v1.NewComputeServiceClient(conn).ListInstances(ctx, &v1.ListInstancesRequest{NodeId: id}); err != nil {
+		report.Errors["instances"] = err.Error()
+	} else {
+		report.Instances = resp.Instances
+	}
+
+	if resp, err := v1.NewNetworkServiceClient(conn).ListPorts(ctx, &v1.ListPortsRequest{NodeId: id}); err != nil {
+		report.Errors["ports"] = err.Error()
+	} else {
+		report.Ports = resp.Ports
+	}
+
+	if resp, err := cluster.ListEvents(ctx, &v1.ListEventsRequest{NodeId: id, Limit: describeEventLimit}); err != nil {
+		report.Errors["events"] = err.Error()
+	} else {
+		report.Events = resp.Events
+	}
+
+	return report, nil
+}
+
+func (r *nodeReport) print(out io.Writer) {
+	node := r.Node
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", node.Id)
+	fmt.Fprintf(w, "Hostname:\t%s\n", node.Hostname)
+	fmt.Fprintf(w, "Address:\t%s:%d\n", node.Ip, node.Port)
+	fmt.Fprintf(w, "Role:\t%s\n", strings.ToLower(strings.TrimPrefix(node.Role.String(), "NODE_ROLE_")))
+	fmt.Fprintf(w, "Status:\t%s\n", strings.ToLower(strings.TrimPrefix(node.Status.String(), "NODE_STATUS_")))
+	if node.Region != "" || node.Zone != "" {
+		fmt.Fprintf(w, "Location:\t%s/%s\n", node.Region, node.Zone)
+	}
+	if labels := node.Metadata.GetLabels(); len(labels) > 0 {
+		fmt.Fprintf(w, "Labels:\t%s\n", formatLabels(labels))
+	}
+	if len(node.Taints) > 0 {
+		fmt.Fprintf(w, "Taints:\t%s\n", formatTaints(node.Taints))
+	}
+	if len(node.SupportedInstanceTypes) > 0 {
+		fmt.Fprintf(w, "Instance Types:\t%s\n", strings.Join(node.SupportedInstanceTypes, ", "))
+	}
+	for _, t := range node.SupportedInstanceTypes {
+		if caps, ok := node.Capabilities[t]; ok {
+			fmt.Fprintf(w, "Operations (%s):\t%s via %s\n", t, capabilityNames(caps), caps.Driver)
+			if len(caps.Runtimes) > 0 {
+				fmt.Fprintf(w, "Runtimes (%s):\t%s\n", t, strings.Join(caps.Runtimes, ", "))
+			}
+		}
+	}
+	if node.Cpu != nil {
+		fmt.Fprintf(w, "CPU:\t%s (%s)\n", node.Cpu.ModelName, node.Cpu.Vendor)
+	}
+	if host := node.Host; host != nil {
+		fmt.Fprintf(w, "Platform:\t%s, kernel %s, %s\n", host.Architecture, valueOrDash(host.KernelVersion), valueOrDash(host.OsImage))
+		fmt.Fprintf(w, "Virtualization:\tKVM %t, %s, nested %t\n", host.Kvm, valueOrDash(host.Virtualization), host.NestedVirtualization)
+		if host.VhostUser {
+			fmt.Fprintf(w, "Datapath:\tOVS-DPDK, vhost-user ports\n")
+		}
+		for _, fs := range host.Filesystems {
+			fmt.Fprintf(w, "Storage:\t%s: %s free of %s\n", fs.Path,
+				formatBytes(float64(fs.AvailableBytes)), formatBytes(float64(fs.CapacityBytes)))
+		}
+	}
+	if node.LastSeen != nil {
+		fmt.Fprintf(w, "Last Seen:\t%s (%s ago)\n",
+			node.LastSeen.AsTime().Local().Format(time.DateTime),
+			time.Since(node.LastSeen.AsTime()).Truncate(time.Second))
+	}
+	w.Flush()
+
+	conditions := make([]condition, 0, len(node.Conditions))
+	for _, c := range node.Conditions {
+		conditions = append(conditions, condition{Type: c.Type, Status: c.Status, Reason: c.Reason, Message: c.Message})
+	}
+	printConditions(out, conditions)
+
+	fmt.Fprintln(out, "\nResources:")
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  RESOURCE\tALLOCATED\tALLOCATABLE\tCAPACITY")
+	fmt.Fprintf(w, "  cpu\t%d\t%d\t%d\n",
+		node.Allocated.GetCpuCores(), node.Allocatable.GetCpuCores(), node.Capacity.GetCpuCores())
+	fmt.Fprintf(w, "  memory\t%s\t%s\t%s\n",
+		formatBytes(float64(node.Allocated.GetMemoryBytes())),
+		formatBytes(float64(node.Allocatable.GetMemoryBytes())),
+		formatBytes(float64(node.Capacity.GetMemoryBytes())))
+	fmt.Fprintf(w, "  disk\t%s\t%s\t%s\n",
+		formatBytes(float64(node.Allocated.GetDiskBytes())),
+		formatBytes(float64(node.Allocatable.GetDiskBytes())),
+		formatBytes(float64(node.Capacity.GetDiskBytes())))
+	if node.Capacity.GetGpuCount() > 0 {
+		fmt.Fprintf(w, "  gpu\t%d\t%d\t%d\n",
+			node.Allocated.GetGpuCount(), node.Allocatable.GetGpuCount(), node.Capacity.GetGpuCount())
+	}
+	w.Flush()
+
+	if len(node.Numa) > 0 {
+		fmt.Fprintln(out, "\nNUMA:")
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  NODE\tCPUS\tDEDICATED\tMEMORY")
+		for _, numa := range node.Numa {
+			fmt.Fprintf(w, "  %d\t%s\t%d/%d\t%s\n", numa.Id, formatCPUList(numa.Cpus),
+				numa.PinnedCpus, len(numa.Cpus), formatBytes(float64(numa.MemoryBytes)))
+		}
+		w.Flush()
+	}
+
+	if len(node.Gpus) > 0 {
+		fmt.Fprintln(out, "\nGPUs:")
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  ADDRESS\tVENDOR:DEVICE\tIOMMU GROUP\tDRIVER\tINSTANCE")
+		for _, gpu := range node.Gpus {
+			group := "-"
+			if gpu.IommuGroup >= 0 {
+				group = fmt.Sprint(gpu.IommuGroup)
+			}
+			fmt.Fprintf(w, "  %s\t%s:%s\t%s\t%s\t%s\n", gpu.Address, gpu.VendorId, gpu.DeviceId, group, gpu.Driver, gpu.InstanceId)
+		}
+		w.Flush()
+	}
+
+	if len(node.Vfs) > 0 {
+		fmt.Fprintln(out, "\nSR-IOV VFs:")
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  ADDRESS\tPF\tVF\tVENDOR:DEVICE\tIOMMU GROUP\tINSTANCE")
+		for _, vf := range node.Vfs {
+			group := "-"
+			if vf.IommuGroup >= 0 {
+				group = fmt.Sprint(vf.IommuGroup)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%d\t%s:%s\t%s\t%s\n", vf.Address, vf.PfName, vf.VfIndex, vf.VendorId, vf.DeviceId, group, vf.InstanceId)
+		}
+		w.Flush()
+	}
+
+	if creates := node.Creates; creates.GetInFlight() > 0 || creates.GetQueued() > 0 || creates.GetLimit() > 0 {
+		limit := "unlimited"
+		if creates.GetLimit() > 0 {
+			limit = fmt.Sprintf("limit %d", creates.GetLimit())
+		}
+		fmt.Fprintf(out, "\nCreates: %d in flight, %d queued (%s)\n", creates.GetInFlight(), creates.GetQueued(), limit)
+	}
+
+	fmt.Fprintln(out, "\nInstances:")
+	switch {
+	case r.Errors["instances"] != "":
+		fmt.Fprintf(out, "  <unavailable: %s>\n", r.Errors["instances"])
+	case len(r.Instances) == 0:
+		fmt.Fprintln(out, "  <none>")
+	default:
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  ID\tNAME\tTYPE\tSTATE\tCPU\tMEMORY")
+		for _, inst := range r.Instances {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%d\t%s\n",
+				inst.Id, inst.Name,
+				strings.ToLower(strings.TrimPrefix(inst.Type.String(), "INSTANCE_TYPE_")),
+				stateName(inst.State),
+				inst.Spec.GetCpuCores(), formatBytes(float64(inst.Spec.GetMemoryBytes())))
+		}
+		w.Flush()
+	}
+
+	fmt.Fprintln(out, "\nPorts:")
+	printPorts(out, r.Ports, r.Errors["ports"])
+
+	fmt.Fprintln(out, "\nEvents:")
+	printEvents(out, r.Events, r.Errors["events"])
+}
+
+func (r *nodeReport) structured() map[string]any {
+	return map[string]any{
+		"node":      protoJSON(r.Node),
+		"instances": protoJSONList(r.Instances),
+		"ports":     protoJSONList(r.Ports),
+		"events":    protoJSONList(r.Events),
+		"errors":    r.Errors,
+	}
+}
+
+func printConditions(out io.Writer, conditions []condition) {
+	fmt.Fprintln(out, "\nConditions:")
+	if len(conditions) == 0 {
+		fmt.Fprintln(out, "  <none>")
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  TYPE\tSTATUS\tREASON\tMESSAGE")
+	for _, c := range conditions {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", c.Type, c.Status, c.Reason, c.Message)
+	}
+	w.Flush()
+}
+
+func printPorts(out io.Writer, ports []*v1.Port, fetchErr string) {
+	switch {
+	case fetchErr != "":
+		fmt.Fprintf(out, "  <unavailable: %s>\n", fetchErr)
+	case len(ports) == 0:
+		fmt.Fprintln(out, "  <none>")
+	default:
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  ID\tNETWORK\tIP\tMAC\tDEVICE\tSTATUS")
+		for _, p := range ports {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\n", p.Id, p.NetworkId, p.IpAddress, p.MacAddress, p.DeviceName, p.Status)
+		}
+		w.Flush()
+	}
+}
+
+func printEvents(out io.Writer, events []*v1.Event, fetchErr string) {
+	switch {
+	case fetchErr != "":
+		fmt.Fprintf(out, "  <unavailable: %s>\n", fetchErr)
+	case len(events) == 0:
+		fmt.Fprintln(out, "  <none>")
+	default:
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  TIME\tTYPE\tREASON\tMESSAGE")
+		for _, e := range events {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n",
+				e.Time.AsTime().Local().Format(time.DateTime), e.Type, e.Reason, e.Message)
+		}
+		w.Flush()
+	}
+}
+
+// stateName returns the short lowercase name of an instance state.
+func stateName(s v1.InstanceState) string {
+	return strings.ToLower(strings.TrimPrefix(s.String(), "INSTANCE_STATE_"))
+}
+
+// formatLabels renders labels as comma-separated key=value pairs.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// formatCPUList renders CPU or NUMA node numbers as a kernel CPU list, e.g.
+// "0-3,8".
+func formatCPUList(ids []int32) string {
+	sorted := slices.Clone(ids)
+	slices.Sort(sorted)
+
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprint(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// protoJSON renders a proto message with its proto field names, so JSON and
+// YAML reports match the API rather than the generated Go structs.
+func protoJSON(m proto.Message) json.RawMessage {
+	if m == nil || !m.ProtoReflect().IsValid() {
+		return json.RawMessage("null")
+	}
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return data
+}
+
+func protoJSONList[T proto.Message](items []T) []json.RawMessage {
+	list := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		list = append(list, protoJSON(item))
+	}
+	return list
+}
+
+// printStructured writes v as indented JSON, or as YAML with -o yaml.
+func printStructured(v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode output: %w", err)
+	}
+	if output != "yaml" {
+		fmt.Println(string(data))
+		return nil
+	}
+
+	// Round-trip through a generic value so YAML keys match the JSON ones
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return fmt.Errorf("failed to encode output: %w", err)
+	}
+	out, err := yaml.Marshal(generic)
+	if err != nil {
+		return fmt.Errorf("failed to encode output: %w", err)
+	}
+	fmt.Print(string(out))
+	return nil
+}
+
+// printStreamed writes one item of a stream as a single line of JSON, or as
+// its own YAML document with -o yaml, so items can be read as they arrive.
+func printStreamed(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode output: %w", err)
+	}
+	if output != "yaml" {
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Println("---")
+	return printStructured(json.RawMessage(data))
+}
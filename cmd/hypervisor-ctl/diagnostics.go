@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func diagnosticsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diagnostics <instance-id>",
+		Short: "Show a screenshot and the serial output of an instance",
+		Long: `Collect boot diagnostics for an instance that does not become reachable:
+the last lines of its serial console and, for a running VM with a display,
+a screenshot of its screen. Use --screenshot to save the screenshot.`,
+		Example: `  hypervisor-ctl instance diagnostics <id>
+  hypervisor-ctl instance diagnostics <id> --lines 500 --screenshot boot.png`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			lines, _ := cmd.Flags().GetInt32("lines")
+			screenshot, _ := cmd.Flags().GetString("screenshot")
+			return bootDiagnostics(args[0], lines, screenshot)
+		},
+	}
+	cmd.Flags().Int32("lines", 100, "serial output lines to show")
+	cmd.Flags().String("screenshot", "", "file to save the screenshot to")
+	return cmd
+}
+
+func bootDiagnostics(id string, lines int32, screenshotPath string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	diag, err := v1.NewComputeServiceClient(conn).GetBootDiagnostics(ctx, &v1.GetBootDiagnosticsRequest{
+		InstanceId: id,
+		Lines:      lines,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get boot diagnostics: %w", err)
+	}
+
+	if screenshotPath != "" {
+		if len(diag.Screenshot) == 0 {
+			return fmt.Errorf("instance %s has no screenshot (not running or no display)", id)
+		}
+		if err := os.WriteFile(screenshotPath, diag.Screenshot, 0o644); err != nil {
+			return fmt.Errorf("failed to save screenshot: %w", err)
+		}
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(diag))
+	}
+
+	fmt.Printf("Instance:  %s\n", diag.InstanceId)
+	fmt.Printf("Node:      %s\n", diag.NodeId)
+	if diag.CollectedAt != nil {
+		fmt.Printf("Collected: %s\n", diag.CollectedAt.AsTime().Local().Format(time.DateTime))
+	}
+	switch {
+	case len(diag.Screenshot) == 0:
+		fmt.Println("Screenshot: <none>")
+	case screenshotPath != "":
+		fmt.Printf("Screenshot: saved to %s (%s, %s)\n", screenshotPath, diag.ScreenshotFormat, formatBytes(float64(len(diag.Screenshot))))
+	default:
+		fmt.Printf("Screenshot: %s, %s (save with --screenshot FILE)\n", diag.ScreenshotFormat, formatBytes(float64(len(diag.Screenshot))))
+	}
+
+	fmt.Println("\nSerial output:")
+	if len(diag.SerialOutput) == 0 {
+		fmt.Println("  <none>")
+	}
+	for _, line := range diag.SerialOutput {
+		fmt.Println("  " + line)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func eventsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "events",
+		Short: "Show the cluster event log",
+		Long: `Show recorded events about instances, nodes and networks, oldest first.
+
+Examples:
+  hypervisor-ctl events --kind instance --object <instance-id>
+  hypervisor-ctl events --node node-1 --type Warning --since 1h`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &v1.ListEventsRequest{}
+			req.Kind, _ = cmd.Flags().GetString("kind")
+			req.ObjectId, _ = cmd.Flags().GetString("object")
+			req.NodeId, _ = cmd.Flags().GetString("node")
+			req.Type, _ = cmd.Flags().GetString("type")
+			req.Reason, _ = cmd.Flags().GetString("reason")
+			limit, _ := cmd.Flags().GetInt("limit")
+			req.Limit = int32(limit)
+
+			since, _ := cmd.Flags().GetDuration("since")
+			if since > 0 {
+				req.Since = timestamppb.New(time.Now().Add(-since))
+			}
+
+			return listEvents(req)
+		},
+	}
+
+	cmd.Flags().String("kind", "", "object kind (instance, node, network, subnet, port, security-group)")
+	cmd.Flags().String("object", "", "object ID")
+	cmd.Flags().StringP("node", "n", "", "node ID")
+	cmd.Flags().String("type", "", "event type (Normal, Warning)")
+	cmd.Flags().String("reason", "", "event reason (e.g. Started, Drained)")
+	cmd.Flags().Duration("since", 0, "only show events newer than this (e.g. 30m, 24h)")
+	cmd.Flags().Int("limit", 100, "show at most the newest N events (0 = all)")
+
+	return cmd
+}
+
+func listEvents(req *v1.ListEventsRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewClusterServiceClient(conn).ListEvents(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to list events: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Events))
+	}
+	if len(resp.Events) == 0 {
+		fmt.Println("No events found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTYPE\tKIND\tOBJECT\tREASON\tACTOR\tMESSAGE")
+	for _, e := range resp.Events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.AsTime().Local().Format(time.DateTime),
+			e.Type, e.Kind, e.ObjectId, e.Reason, e.Actor, e.Message)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func notificationsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "notifications",
+		Short: "Show event webhook delivery status",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			recent, _ := cmd.Flags().GetBool("recent")
+			return notificationStatus(recent)
+		},
+	}
+	cmd.Flags().Bool("recent", false, "also list each webhook's recent deliveries")
+	return cmd
+}
+
+func notificationStatus(recent bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewClusterServiceClient(conn).GetNotificationStatus(ctx, &v1.GetNotificationStatusRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to get notification status: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp))
+	}
+
+	if !resp.Enabled {
+		fmt.Println("Notifications are disabled")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WEBHOOK\tFORMAT\tURL\tDELIVERED\tFAILED\tDROPPED\tLAST DELIVERED\tLAST ERROR")
+	for _, wh := range resp.Webhooks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+			wh.Name, wh.Format, wh.Url, wh.Delivered, wh.Failed, wh.Dropped,
+			formatOptionalTime(wh.LastDeliveredAt), wh.LastError)
+	}
+	w.Flush()
+
+	if !recent {
+		return nil
+	}
+	for _, wh := range resp.Webhooks {
+		fmt.Printf("\n%s:\n", wh.Name)
+		if len(wh.Recent) == 0 {
+			fmt.Println("  <none>")
+			continue
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  TIME\tREASON\tOBJECT\tRESULT\tATTEMPTS\tERROR")
+		for _, d := range wh.Recent {
+			result := "ok"
+			if !d.Success {
+				result = "failed"
+			}
+			if d.StatusCode != 0 {
+				result += fmt.Sprintf(" (%d)", d.StatusCode)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%d\t%s\n",
+				d.Time.AsTime().Local().Format(time.DateTime),
+				d.Reason, d.ObjectId, result, d.Attempts, d.Error)
+		}
+		w.Flush()
+	}
+
+	return nil
+}
+
+// formatOptionalTime renders a timestamp in local time, or "-" if unset.
+func formatOptionalTime(t *timestamppb.Timestamp) string {
+	if t == nil {
+		return "-"
+	}
+	return t.AsTime().Local().Format(time.DateTime)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"hypervisor/pkg/apierror"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Exit codes. They are part of the CLI contract scripts rely on, so existing
+// values must not change.
+const (
+	exitOK          = 0 // Success
+	exitFailure     = 1 // Any other failure, including partial bulk failures
+	exitNotFound    = 2 // A named resource does not exist
+	exitConflict    = 3 // Already exists, in use, or not in a state that allows the operation
+	exitCapacity    = 4 // Not enough capacity or quota
+	exitUsage       = 5 // Invalid flags, arguments or request fields
+	exitUnavailable = 6 // Server unreachable or timed out
+	exitDenied      = 7 // Not authenticated or not permitted
+	exitUnsupported = 8 // Not supported by the server or the instance's driver
+)
+
+// exitCodesHelp documents the exit codes in the root command's help.
+const exitCodesHelp = `
+Output:
+  Results go to stdout, in the format chosen with --output. With json or yaml
+  stdout holds a single document and nothing else; progress messages and
+  errors always go to stderr, errors as {"error": {...}} with --output json.
+
+Exit codes:
+  0  success
+  1  failure not covered below, including partial failures of bulk commands
+  2  not found
+  3  conflict: already exists, in use, or wrong state for the operation
+  4  insufficient capacity
+  5  invalid usage, flags or arguments
+  6  server unavailable, timed out or rate limited
+  7  permission denied
+  8  not supported`
+
+// exitError sets the exit code of an error that carries no gRPC status.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode makes err exit with code.
+func withExitCode(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// usageErrorf formats an error in how the command was invoked.
+func usageErrorf(format string, args ...any) error {
+	return withExitCode(exitUsage, fmt.Errorf(format, args...))
+}
+
+// exitCode returns the exit code for an error returned by a command.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.NotFound:
+			return exitNotFound
+		case codes.AlreadyExists, codes.FailedPrecondition, codes.Aborted:
+			return exitConflict
+		case codes.ResourceExhausted:
+			// Rate limited calls succeed when retried later
+			if errorReason(s) == apierror.ReasonRateLimited {
+				return exitUnavailable
+			}
+			return exitCapacity
+		case codes.InvalidArgument, codes.OutOfRange:
+			return exitUsage
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return exitUnavailable
+		case codes.PermissionDenied, codes.Unauthenticated:
+			return exitDenied
+		case codes.Unimplemented:
+			return exitUnsupported
+		}
+	}
+	// Cobra reports unknown commands and flags without a type
+	for _, prefix := range []string{"unknown command", "unknown flag", "unknown shorthand flag", "required flag"} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return exitUsage
+		}
+	}
+	return exitFailure
+}
+
+// reportError writes err to stderr, as a JSON object with --output json.
+// Details the server attached, such as why each node was rejected, follow
+// the message.
+func reportError(err error) {
+	s, isStatus := status.FromError(err)
+	if output != "json" {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if isStatus {
+			for _, line := range detailLines(s) {
+				fmt.Fprintf(os.Stderr, "  %s\n", line)
+			}
+		}
+		return
+	}
+
+	code := "Unknown"
+	details := map[string]any{
+		"message":   err.Error(),
+		"exit_code": exitCode(err),
+	}
+	if isStatus {
+		code = s.Code().String()
+		if delay := retryDelay(s); delay > 0 {
+			details["retry_after_seconds"] = delay.Seconds()
+		}
+		addStatusDetails(details, s)
+	}
+	details["code"] = code
+	data, _ := json.Marshal(map[string]any{"error": details})
+	fmt.Fprintln(os.Stderr, string(data))
+}
+
+// errorReason returns the ErrorInfo reason of a status, if any.
+func errorReason(s *status.Status) string {
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.GetReason()
+		}
+	}
+	return ""
+}
+
+// retryDelay returns the delay the server suggested retrying after, if any.
+func retryDelay(s *status.Status) time.Duration {
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.GetRetryDelay().AsDuration()
+		}
+	}
+	return 0
+}
+
+// detailLines renders the typed details of a status, one line each.
+func detailLines(s *status.Status) []string {
+	var lines []string
+	for _, detail := range s.Details() {
+		switch d := detail.(type) {
+		case *errdetails.PreconditionFailure:
+			for _, v := range d.GetViolations() {
+				if v.GetType() == apierror.ViolationNode {
+					lines = append(lines, fmt.Sprintf("node %s: %s", v.GetSubject(), v.GetDescription()))
+					continue
+				}
+				lines = append(lines, fmt.Sprintf("%s: %s", v.GetSubject(), v.GetDescription()))
+			}
+		case *errdetails.BadRequest:
+			for _, v := range d.GetFieldViolations() {
+				lines = append(lines, fmt.Sprintf("field %s: %s", v.GetField(), v.GetDescription()))
+			}
+		}
+	}
+	return lines
+}
+
+// addStatusDetails adds the ErrorInfo and typed details of a status to a
+// JSON error object, so scripts can branch on the reason.
+func addStatusDetails(details map[string]any, s *status.Status) {
+	for _, detail := range s.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			details["reason"] = d.GetReason()
+			if len(d.GetMetadata()) > 0 {
+				details["metadata"] = d.GetMetadata()
+			}
+		case *errdetails.PreconditionFailure:
+			var violations []map[string]string
+			for _, v := range d.GetViolations() {
+				violations = append(violations, map[string]string{
+					"type":        v.GetType(),
+					"subject":     v.GetSubject(),
+					"description": v.GetDescription(),
+				})
+			}
+			details["violations"] = violations
+		case *errdetails.BadRequest:
+			var violations []map[string]string
+			for _, v := range d.GetFieldViolations() {
+				violations = append(violations, map[string]string{
+					"field":       v.GetField(),
+					"description": v.GetDescription(),
+				})
+			}
+			details["field_violations"] = violations
+		}
+	}
+}
+
+// markUsageErrors makes positional argument errors of cmd and its
+// subcommands exit with exitUsage.
+func markUsageErrors(cmd *cobra.Command) {
+	if args := cmd.Args; args != nil {
+		cmd.Args = func(cmd *cobra.Command, a []string) error {
+			if err := args(cmd, a); err != nil {
+				return withExitCode(exitUsage, err)
+			}
+			return nil
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		markUsageErrors(sub)
+	}
+}
+
+// progressf writes a progress message. Progress goes to stderr so that
+// stdout only carries results.
+func progressf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format, args...)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// groupLabel is the label the server sets on every instance of a group.
+const groupLabel = "hypervisor.io/instance-group"
+
+func groupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "group",
+		Aliases: []string{"instance-group"},
+		Short:   "Manage instance groups, kept at a number of identical instances",
+	}
+
+	// group create <name>
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create an instance group",
+		Example: `  hypervisor-ctl group create web --replicas 3 --image ubuntu:22.04 --cpus 2 --memory 2048
+  hypervisor-ctl group create cache --replicas 2 --image redis:7 --type container --labels app=cache`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return createGroup(cmd, args[0])
+		},
+	}
+	createCmd.Flags().Int("replicas", 1, "number of instances to keep")
+	createCmd.Flags().StringP("type", "t", "vm", "instance type (vm, container, microvm)")
+	createCmd.Flags().StringP("image", "i", "", "image name (required)")
+	createCmd.Flags().Int("cpus", 1, "number of CPUs per instance")
+	createCmd.Flags().Int("memory", 512, "memory per instance in MB")
+	createCmd.Flags().String("labels", "", "labels of every instance (key=value,...)")
+	createCmd.Flags().String("region", "", "region to place instances in")
+	createCmd.Flags().String("zone", "", "zone to place instances in")
+	createCmd.Flags().Bool("ha", false, "reschedule instances onto a healthy node if their host fails")
+	createCmd.MarkFlagRequired("image")
+	cmd.AddCommand(createCmd)
+
+	// group list
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List instance groups",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listGroups()
+		},
+	})
+
+	// group get <name>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "get <name>",
+		Short: "Show an instance group and its instances",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return getGroup(args[0])
+		},
+	})
+
+	// group scale <name> <replicas>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "scale <name> <replicas>",
+		Short: "Change the number of instances of a group",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			replicas, err := strconv.Atoi(args[1])
+			if err != nil || replicas < 0 {
+				return usageErrorf("invalid replicas %q: must be a number of instances", args[1])
+			}
+			return scaleGroup(args[0], replicas)
+		},
+	})
+
+	// group delete <name>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "delete <name>",
+		Short: "Delete an instance group and its instances",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteGroup(args[0])
+		},
+	})
+
+	return cmd
+}
+
+func createGroup(cmd *cobra.Command, name string) error {
+	flags := cmd.Flags()
+	replicas, _ := flags.GetInt("replicas")
+	instanceType, _ := flags.GetString("type")
+	image, _ := flags.GetString("image")
+	cpus, _ := flags.GetInt("cpus")
+	memory, _ := flags.GetInt("memory")
+	labelsFlag, _ := flags.GetString("labels")
+	region, _ := flags.GetString("region")
+	zone, _ := flags.GetString("zone")
+	ha, _ := flags.GetBool("ha")
+
+	t, err := parseInstanceType(instanceType)
+	if err != nil {
+		return err
+	}
+	template := &v1.InstanceTemplate{
+		Type: t,
+		Spec: &v1.InstanceSpec{
+			Image:       image,
+			CpuCores:    int32(cpus),
+			MemoryBytes: int64(memory) * 1024 * 1024,
+		},
+		Region:           region,
+		Zone:             zone,
+		HighAvailability: ha,
+	}
+	if labelsFlag != "" {
+		labels, err := parseSelector(labelsFlag)
+		if err != nil {
+			return usageErrorf("invalid --labels: %w", err)
+		}
+		template.Metadata = &v1.Metadata{Labels: labels}
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	group, err := v1.NewComputeServiceClient(conn).CreateInstanceGroup(ctx, &v1.CreateInstanceGroupRequest{
+		Name:     name,
+		Replicas: int32(replicas),
+		Template: template,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create instance group: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(group))
+	}
+	fmt.Printf("Instance group %s created with %d replicas\n", group.Name, group.Replicas)
+	return nil
+}
+
+func listGroups() error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewComputeServiceClient(conn).ListInstanceGroups(ctx, &v1.ListInstanceGroupsRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list instance groups: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Groups))
+	}
+	if len(resp.Groups) == 0 {
+		fmt.Println("No instance groups found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDESIRED\tCURRENT\tREADY\tIMAGE\tAGE")
+	for _, g := range resp.Groups {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n",
+			g.Name, g.Replicas, g.Status.GetReplicas(), g.Status.GetReadyReplicas(),
+			valueOrDash(g.Template.GetSpec().GetImage()),
+			time.Since(g.CreatedAt.AsTime()).Round(time.Second))
+	}
+	w.Flush()
+	return nil
+}
+
+func getGroup(name string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client := v1.NewComputeServiceClient(conn)
+	group, err := client.GetInstanceGroup(ctx, &v1.GetInstanceGroupRequest{Name: name})
+	if err != nil {
+		return fmt.Errorf("failed to get instance group: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(group))
+	}
+	printGroup(os.Stdout, group)
+
+	resp, err := client.ListInstances(ctx, &v1.ListInstancesRequest{
+		LabelSelector: map[string]string{groupLabel: name},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list group instances: %w", err)
+	}
+	fmt.Println()
+	if len(resp.Instances) == 0 {
+		fmt.Println("No instances")
+		return nil
+	}
+	printInstanceTable(resp.Instances)
+	return nil
+}
+
+func scaleGroup(name string, replicas int) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	group, err := v1.NewComputeServiceClient(conn).UpdateInstanceGroup(ctx, &v1.UpdateInstanceGroupRequest{
+		Name:       name,
+		Replicas:   int32(replicas),
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"replicas"}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scale instance group: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(group))
+	}
+	fmt.Printf("Instance group %s scaled to %d replicas (%d current)\n",
+		group.Name, group.Replicas, group.Status.GetReplicas())
+	return nil
+}
+
+func deleteGroup(name string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if _, err := v1.NewComputeServiceClient(conn).DeleteInstanceGroup(ctx, &v1.DeleteInstanceGroupRequest{
+		Name: name,
+	}); err != nil {
+		return fmt.Errorf("failed to delete instance group: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(map[string]any{"name": name, "deleted": true})
+	}
+	fmt.Printf("Instance group %s deleted\n", name)
+	return nil
+}
+
+func printGroup(out io.Writer, g *v1.InstanceGroup) {
+	t := g.Template
+	fmt.Fprintf(out, "Name:      %s\n", g.Name)
+	fmt.Fprintf(out, "Replicas:  %d desired, %d current, %d ready\n",
+		g.Replicas, g.Status.GetReplicas(), g.Status.GetReadyReplicas())
+	fmt.Fprintf(out, "Type:      %s\n", strings.ToLower(strings.TrimPrefix(t.GetType().String(), "INSTANCE_TYPE_")))
+	fmt.Fprintf(out, "Image:     %s\n", valueOrDash(t.GetSpec().GetImage()))
+	fmt.Fprintf(out, "Resources: %d CPUs, %s\n", t.GetSpec().GetCpuCores(), formatBytes(float64(t.GetSpec().GetMemoryBytes())))
+	if labels := t.GetMetadata().GetLabels(); len(labels) > 0 {
+		fmt.Fprintf(out, "Labels:    %s\n", formatLabels(labels))
+	}
+	if t.GetRegion() != "" || t.GetZone() != "" {
+		fmt.Fprintf(out, "Placement: region %s, zone %s\n", valueOrDash(t.GetRegion()), valueOrDash(t.GetZone()))
+	}
+	fmt.Fprintf(out, "HA:        %t\n", t.GetHighAvailability())
+	for _, c := range t.GetSpreadConstraints() {
+		fmt.Fprintf(out, "Spread:    across %ss from %s\n", c.TopologyKey, formatLabels(c.MatchLabels))
+	}
+	fmt.Fprintf(out, "Created:   %s\n", g.CreatedAt.AsTime().Format(time.RFC3339))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func healthCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "health",
+		Short: "Show the health checks of the server and every node's agent",
+		Long: `Show the last result of each health check of the server answering and of
+every node's agent: etcd connectivity, drivers and the SDN. Exits with 6 if
+any check fails or an agent cannot be reached.
+
+Examples:
+  hypervisor-ctl cluster health
+  hypervisor-ctl cluster health -o json`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return clusterHealth()
+		},
+	}
+}
+
+func clusterHealth() error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	health, err := v1.NewClusterServiceClient(conn).GetClusterHealth(ctx, &v1.GetClusterHealthRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to get cluster health: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		if err := printStructured(protoJSON(health)); err != nil {
+			return err
+		}
+	} else {
+		printHealthTable(health)
+	}
+
+	if !health.Healthy {
+		return withExitCode(exitUnavailable, errors.New("cluster is not healthy"))
+	}
+	return nil
+}
+
+func printHealthTable(health *v1.ClusterHealth) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPONENT\tNAME\tCHECK\tSTATUS\tCHECKED\tMESSAGE")
+	for _, component := range health.Components {
+		if component.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\t-\tunreachable\t-\t%s\n", component.Component, component.Name, component.Error)
+			continue
+		}
+		for _, check := range component.Checks {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				component.Component, component.Name, check.Name, healthStatus(check.Healthy),
+				formatOptionalTime(check.CheckedAt), valueOrDash(check.Message))
+		}
+	}
+	w.Flush()
+
+	fmt.Printf("\nCluster: %s\n", healthStatus(health.Healthy))
+}
+
+func healthStatus(healthy bool) string {
+	if healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func imageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "image",
+		Short: "Manage node image caches",
+	}
+
+	// image prefetch <ref>
+	prefetchCmd := &cobra.Command{
+		Use:   "prefetch <image-ref>",
+		Short: "Pull an image on nodes ahead of a rollout",
+		Example: `  hypervisor-ctl image prefetch ubuntu-24.04
+  hypervisor-ctl image prefetch docker.io/library/nginx:1.27 --type container --selector pool=web
+  hypervisor-ctl image prefetch https://images.example.com/debian-12.qcow2 --nodes node-a,node-b`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			typeName, _ := cmd.Flags().GetString("type")
+			nodes, _ := cmd.Flags().GetStringSlice("nodes")
+			selector, _ := cmd.Flags().GetString("selector")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+
+			instanceType, err := parseInstanceType(typeName)
+			if err != nil {
+				return err
+			}
+			req := &v1.PrefetchImageRequest{
+				ImageRef: args[0],
+				Type:     instanceType,
+				NodeIds:  nodes,
+			}
+			if selector != "" {
+				if req.LabelSelector, err = parseSelector(selector); err != nil {
+					return err
+				}
+			}
+			return prefetchImage(req, timeout)
+		},
+	}
+	prefetchCmd.Flags().String("type", "vm", "instance type whose driver caches the image (vm, container, microvm)")
+	prefetchCmd.Flags().StringSlice("nodes", nil, "nodes to prefetch on (default: all ready workers)")
+	prefetchCmd.Flags().String("selector", "", "only nodes with these labels (key=value,...)")
+	prefetchCmd.Flags().Duration("timeout", 30*time.Minute, "how long to wait for the pulls")
+	cmd.AddCommand(prefetchCmd)
+
+	return cmd
+}
+
+func prefetchImage(req *v1.PrefetchImageRequest, timeout time.Duration) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := v1.NewComputeServiceClient(conn).PrefetchImage(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to prefetch image: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp))
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tSTATUS\tSIZE\tERROR")
+	for _, r := range resp.Results {
+		size := "-"
+		if r.SizeBytes > 0 {
+			size = formatBytes(float64(r.SizeBytes))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.NodeId, r.Status, size, r.Error)
+		if r.Status == "failed" {
+			failed++
+		}
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("prefetch failed on %d of %d node(s)", failed, len(resp.Results))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func latencyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "latency",
+		Short: "Show the network latency the agents measured between nodes",
+		Long: `Show the average round-trip time from each node (rows) to each other node
+(columns) in milliseconds. "lost" means no probe was answered, "-" that the
+pair has not been measured. Stale rows come from nodes that stopped probing.
+
+Latency is measured over the node addresses (the underlay) by agents with
+latency probing enabled.
+
+Examples:
+  hypervisor-ctl cluster latency
+  hypervisor-ctl cluster latency --detail`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			detail, _ := cmd.Flags().GetBool("detail")
+			return clusterLatency(detail)
+		},
+	}
+	cmd.Flags().Bool("detail", false, "list every measurement with its loss and min/max RTT")
+	return cmd
+}
+
+func clusterLatency(detail bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	matrix, err := v1.NewClusterServiceClient(conn).GetLatencyMatrix(ctx, &v1.GetLatencyMatrixRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to get latency matrix: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(matrix))
+	}
+	if len(matrix.Nodes) == 0 {
+		fmt.Println("No nodes found")
+		return nil
+	}
+
+	hostnames := make(map[string]string, len(matrix.Nodes))
+	for _, node := range matrix.Nodes {
+		hostnames[node.NodeId] = valueOrDash(node.Hostname)
+	}
+
+	if detail {
+		printLatencyDetail(matrix, hostnames)
+		return nil
+	}
+
+	measured := make(map[[2]string]*v1.LatencyMeasurement)
+	for _, m := range matrix.Measurements {
+		measured[[2]string{m.SourceNodeId, m.TargetNodeId}] = m
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(w, "FROM \\ TO\t")
+	for _, node := range matrix.Nodes {
+		fmt.Fprintf(w, "%s\t", hostnames[node.NodeId])
+	}
+	fmt.Fprintln(w, "MEASURED\t")
+	for _, from := range matrix.Nodes {
+		fmt.Fprintf(w, "%s\t", hostnames[from.NodeId])
+		for _, to := range matrix.Nodes {
+			m, ok := measured[[2]string{from.NodeId, to.NodeId}]
+			switch {
+			case from.NodeId == to.NodeId:
+				fmt.Fprint(w, "\t")
+			case !ok:
+				fmt.Fprint(w, "-\t")
+			case m.Received == 0:
+				fmt.Fprint(w, "lost\t")
+			default:
+				fmt.Fprintf(w, "%.2f\t", m.AvgRttMs)
+			}
+		}
+		when := formatOptionalTime(from.MeasuredAt)
+		if from.Stale {
+			when += " (stale)"
+		}
+		fmt.Fprintf(w, "%s\t\n", when)
+	}
+	w.Flush()
+	return nil
+}
+
+func printLatencyDetail(matrix *v1.LatencyMatrix, hostnames map[string]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FROM\tTO\tPATH\tADDRESS\tLOSS\tMIN\tAVG\tMAX\tERROR")
+	for _, m := range matrix.Measurements {
+		loss := "-"
+		if m.Sent > 0 {
+			loss = fmt.Sprintf("%.0f%%", 100*float64(m.Sent-m.Received)/float64(m.Sent))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.2f\t%.2f\t%.2f\t%s\n",
+			hostnames[m.SourceNodeId], hostnames[m.TargetNodeId], m.Path, m.Address, loss,
+			m.MinRttMs, m.AvgRttMs, m.MaxRttMs, valueOrDash(m.Error))
+	}
+	w.Flush()
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func loadBalancerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "lb",
+		Aliases: []string{"load-balancer"},
+		Short:   "Spread TCP connections to a stable VIP over several instances",
+	}
+
+	// network lb create <subnet-id>
+	createCmd := &cobra.Command{
+		Use:   "create <subnet-id>",
+		Short: "Create a load balancer with a VIP on a subnet",
+		Long: `Create a load balancer with a VIP on a subnet attached to a distributed router.
+One node serves the VIP with haproxy, forwarding each listener's connections
+to the members of its pool; members may be on any subnet of the router, and
+see connections coming from the VIP. With --port, the load balancer is
+created with a first listener.`,
+		Example: `  hypervisor-ctl network lb create <subnet-id> --name web --port 80 --member 10.0.1.11:8080 --member 10.0.1.12:8080
+  hypervisor-ctl network lb create <subnet-id> --vip 10.0.0.100 --port 443 --algorithm least_connections --health-check`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &v1.CreateLoadBalancerRequest{SubnetId: args[0]}
+			req.Name, _ = cmd.Flags().GetString("name")
+			req.TenantId, _ = cmd.Flags().GetString("tenant")
+			req.VipAddress, _ = cmd.Flags().GetString("vip")
+			req.NodeId, _ = cmd.Flags().GetString("node")
+
+			listener, err := listenerFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+			if listener != nil {
+				req.Listeners = []*v1.LBListener{listener}
+			}
+			return createLoadBalancer(req)
+		},
+	}
+	createCmd.Flags().String("name", "", "load balancer name")
+	createCmd.Flags().String("tenant", "", "tenant ID (default: the tenant of the subnet's network)")
+	createCmd.Flags().String("vip", "", "VIP address (default: allocated from the subnet)")
+	createCmd.Flags().String("node", "", "node serving the VIP (default: the least loaded)")
+	addListenerFlags(createCmd, false)
+	cmd.AddCommand(createCmd)
+
+	// network lb list
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List load balancers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tenantID, _ := cmd.Flags().GetString("tenant")
+			return listLoadBalancers(tenantID)
+		},
+	}
+	listCmd.Flags().String("tenant", "", "only load balancers of this tenant")
+	cmd.AddCommand(listCmd)
+
+	// network lb show <lb-id>
+	showCmd := &cobra.Command{
+		Use:   "show <lb-id>",
+		Short: "Show a load balancer with its listeners and members",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return showLoadBalancer(args[0])
+		},
+	}
+	cmd.AddCommand(showCmd)
+
+	// network lb delete <lb-id>
+	deleteCmd := &cobra.Command{
+		Use:   "delete <lb-id>",
+		Short: "Delete a load balancer and release its VIP",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteLoadBalancer(args[0])
+		},
+	}
+	cmd.AddCommand(deleteCmd)
+
+	// network lb add-listener <lb-id>
+	addListenerCmd := &cobra.Command{
+		Use:     "add-listener <lb-id>",
+		Short:   "Accept connections on another port of the VIP",
+		Example: `  hypervisor-ctl network lb add-listener <lb-id> --port 443 --member 10.0.1.11:8443 --health-check`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			listener, err := listenerFromFlags(cmd)
+			if err != nil {
+				return err
+			}
+			return updateLoadBalancer("add listener", func(ctx context.Context, client v1.NetworkServiceClient) (*v1.LoadBalancer, error) {
+				resp, err := client.AddListener(ctx, &v1.AddListenerRequest{LoadBalancerId: args[0], Listener: listener})
+				return resp.GetLoadBalancer(), err
+			})
+		},
+	}
+	addListenerFlags(addListenerCmd, true)
+	cmd.AddCommand(addListenerCmd)
+
+	// network lb remove-listener <lb-id> <listener-id>
+	removeListenerCmd := &cobra.Command{
+		Use:   "remove-listener <lb-id> <listener-id>",
+		Short: "Stop accepting connections on a listener's port",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateLoadBalancer("remove listener", func(ctx context.Context, client v1.NetworkServiceClient) (*v1.LoadBalancer, error) {
+				resp, err := client.RemoveListener(ctx, &v1.RemoveListenerRequest{LoadBalancerId: args[0], ListenerId: args[1]})
+				return resp.GetLoadBalancer(), err
+			})
+		},
+	}
+	cmd.AddCommand(removeListenerCmd)
+
+	// network lb add-members <lb-id> <listener-id> <address>:<port>[:<weight>]...
+	addMembersCmd := &cobra.Command{
+		Use:     "add-members <lb-id> <listener-id> <address>:<port>[:<weight>]...",
+		Short:   "Add members to the pool of a listener",
+		Example: `  hypervisor-ctl network lb add-members <lb-id> <listener-id> 10.0.1.13:8080 10.0.1.14:8080:2`,
+		Args:    cobra.MinimumNArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			members, err := parseMembers(args[2:])
+			if err != nil {
+				return err
+			}
+			return updateLoadBalancer("add members", func(ctx context.Context, client v1.NetworkServiceClient) (*v1.LoadBalancer, error) {
+				resp, err := client.AddPoolMembers(ctx, &v1.AddPoolMembersRequest{LoadBalancerId: args[0], ListenerId: args[1], Members: members})
+				return resp.GetLoadBalancer(), err
+			})
+		},
+	}
+	cmd.AddCommand(addMembersCmd)
+
+	// network lb remove-members <lb-id> <listener-id> <address>:<port>...
+	removeMembersCmd := &cobra.Command{
+		Use:   "remove-members <lb-id> <listener-id> <address>:<port>...",
+		Short: "Remove members from the pool of a listener",
+		Args:  cobra.MinimumNArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			members, err := parseMembers(args[2:])
+			if err != nil {
+				return err
+			}
+			return updateLoadBalancer("remove members", func(ctx context.Context, client v1.NetworkServiceClient) (*v1.LoadBalancer, error) {
+				resp, err := client.RemovePoolMembers(ctx, &v1.RemovePoolMembersRequest{LoadBalancerId: args[0], ListenerId: args[1], Members: members})
+				return resp.GetLoadBalancer(), err
+			})
+		},
+	}
+	cmd.AddCommand(removeMembersCmd)
+
+	// network lb health-check <lb-id> <listener-id>
+	healthCmd := &cobra.Command{
+		Use:   "health-check <lb-id> <listener-id>",
+		Short: "Set or remove the health monitor of a listener's pool",
+		Long: `Check the members of a listener's pool by connecting to them. A member that
+fails --max-retries checks in a row gets no new connections until a check
+succeeds again. Without a health monitor, members are assumed up.`,
+		Example: `  hypervisor-ctl network lb health-check <lb-id> <listener-id> --interval 10 --timeout 3
+  hypervisor-ctl network lb health-check <lb-id> <listener-id> --remove`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &v1.SetHealthMonitorRequest{LoadBalancerId: args[0], ListenerId: args[1]}
+			if remove, _ := cmd.Flags().GetBool("remove"); !remove {
+				req.HealthMonitor = healthMonitorFromFlags(cmd)
+			}
+			return updateLoadBalancer("set health monitor", func(ctx context.Context, client v1.NetworkServiceClient) (*v1.LoadBalancer, error) {
+				resp, err := client.SetHealthMonitor(ctx, req)
+				return resp.GetLoadBalancer(), err
+			})
+		},
+	}
+	addHealthMonitorFlags(healthCmd)
+	healthCmd.Flags().Bool("remove", false, "remove the health monitor")
+	cmd.AddCommand(healthCmd)
+
+	return cmd
+}
+
+// addListenerFlags adds the flags describing a listener and its pool.
+func addListenerFlags(cmd *cobra.Command, required bool) {
+	cmd.Flags().Uint32("port", 0, "port of the VIP the listener accepts connections on")
+	cmd.Flags().String("listener-name", "", "listener name")
+	cmd.Flags().String("algorithm", "round_robin", "how members are picked: round_robin, least_connections or source_ip")
+	cmd.Flags().StringArray("member", nil, "pool member as <address>:<port>[:<weight>] (repeatable)")
+	cmd.Flags().Bool("health-check", false, "check members by connecting to them")
+	addHealthMonitorFlags(cmd)
+	if required {
+		cmd.MarkFlagRequired("port")
+	}
+}
+
+func addHealthMonitorFlags(cmd *cobra.Command) {
+	cmd.Flags().Uint32("interval", 5, "seconds between health checks")
+	cmd.Flags().Uint32("timeout", 5, "seconds a health check may take")
+	cmd.Flags().Uint32("max-retries", 3, "failed checks before a member is taken out")
+}
+
+// listenerFromFlags builds a listener from its flags, or returns nil
+// without --port.
+func listenerFromFlags(cmd *cobra.Command) (*v1.LBListener, error) {
+	flags := cmd.Flags()
+	port, _ := flags.GetUint32("port")
+	if port == 0 {
+		return nil, nil
+	}
+	if port > 65535 {
+		return nil, usageErrorf("invalid --port %d: must be 1-65535", port)
+	}
+
+	algorithmName, _ := flags.GetString("algorithm")
+	algorithm, err := parseLBAlgorithm(algorithmName)
+	if err != nil {
+		return nil, err
+	}
+	specs, _ := flags.GetStringArray("member")
+	members, err := parseMembers(specs)
+	if err != nil {
+		return nil, err
+	}
+
+	listener := &v1.LBListener{
+		Protocol: "tcp",
+		Port:     port,
+		Pool:     &v1.LBPool{Algorithm: algorithm, Members: members},
+	}
+	listener.Name, _ = flags.GetString("listener-name")
+	if check, _ := flags.GetBool("health-check"); check {
+		listener.Pool.HealthMonitor = healthMonitorFromFlags(cmd)
+	}
+	return listener, nil
+}
+
+func healthMonitorFromFlags(cmd *cobra.Command) *v1.LBHealthMonitor {
+	monitor := &v1.LBHealthMonitor{Type: "tcp"}
+	monitor.IntervalSeconds, _ = cmd.Flags().GetUint32("interval")
+	monitor.TimeoutSeconds, _ = cmd.Flags().GetUint32("timeout")
+	monitor.MaxRetries, _ = cmd.Flags().GetUint32("max-retries")
+	return monitor
+}
+
+func parseLBAlgorithm(s string) (v1.LBAlgorithm, error) {
+	switch s {
+	case "round_robin":
+		return v1.LBAlgorithm_LB_ALGORITHM_ROUND_ROBIN, nil
+	case "least_connections":
+		return v1.LBAlgorithm_LB_ALGORITHM_LEAST_CONNECTIONS, nil
+	case "source_ip":
+		return v1.LBAlgorithm_LB_ALGORITHM_SOURCE_IP, nil
+	}
+	return 0, usageErrorf("invalid --algorithm %q: must be round_robin, least_connections or source_ip", s)
+}
+
+// parseMembers parses pool members given as <address>:<port>[:<weight>].
+func parseMembers(specs []string) ([]*v1.LBMember, error) {
+	members := make([]*v1.LBMember, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 || net.ParseIP(parts[0]) == nil {
+			return nil, usageErrorf("invalid member %q: want <address>:<port>[:<weight>]", spec)
+		}
+		port, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil || port == 0 {
+			return nil, usageErrorf("invalid port in member %q: must be 1-65535", spec)
+		}
+		member := &v1.LBMember{Address: parts[0], Port: uint32(port)}
+		if len(parts) == 3 {
+			weight, err := strconv.ParseUint(parts[2], 10, 32)
+			if err != nil || weight < 1 || weight > 256 {
+				return nil, usageErrorf("invalid weight in member %q: must be 1-256", spec)
+			}
+			member.Weight = uint32(weight)
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func createLoadBalancer(req *v1.CreateLoadBalancerRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).CreateLoadBalancer(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to create load balancer: %w", err)
+	}
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.LoadBalancer))
+	}
+	lb := resp.LoadBalancer
+	fmt.Printf("Load balancer %s created: VIP %s on node %s\n", lb.Id, lb.VipAddress, lb.NodeId)
+	return nil
+}
+
+func listLoadBalancers(tenantID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).ListLoadBalancers(ctx, &v1.ListLoadBalancersRequest{TenantId: tenantID})
+	if err != nil {
+		return fmt.Errorf("failed to list load balancers: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.LoadBalancers))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LB ID\tNAME\tVIP\tPORTS\tNODE\tSTATUS")
+	for _, lb := range resp.LoadBalancers {
+		ports := make([]string, len(lb.Listeners))
+		for i, l := range lb.Listeners {
+			ports[i] = strconv.Itoa(int(l.Port))
+		}
+		if len(ports) == 0 {
+			ports = []string{"-"}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", lb.Id, lb.Name, lb.VipAddress, strings.Join(ports, ","), lb.NodeId, lb.Status)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func showLoadBalancer(lbID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).GetLoadBalancer(ctx, &v1.GetLoadBalancerRequest{LoadBalancerId: lbID})
+	if err != nil {
+		return fmt.Errorf("failed to get load balancer: %w", err)
+	}
+	return printLoadBalancer(resp.LoadBalancer)
+}
+
+func deleteLoadBalancer(lbID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewNetworkServiceClient(conn).DeleteLoadBalancer(ctx, &v1.DeleteLoadBalancerRequest{LoadBalancerId: lbID}); err != nil {
+		return fmt.Errorf("failed to delete load balancer: %w", err)
+	}
+	fmt.Printf("Load balancer %s deleted\n", lbID)
+	return nil
+}
+
+// updateLoadBalancer runs a change to a load balancer and prints the result.
+func updateLoadBalancer(what string, update func(context.Context, v1.NetworkServiceClient) (*v1.LoadBalancer, error)) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	lb, err := update(ctx, v1.NewNetworkServiceClient(conn))
+	if err != nil {
+		return fmt.Errorf("failed to %s: %w", what, err)
+	}
+	return printLoadBalancer(lb)
+}
+
+func printLoadBalancer(lb *v1.LoadBalancer) error {
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(lb))
+	}
+
+	fmt.Printf("Load balancer %s", lb.Id)
+	if lb.Name != "" {
+		fmt.Printf(" (%s)", lb.Name)
+	}
+	fmt.Printf(": VIP %s on subnet %s via router %s, served by node %s, %s\n",
+		lb.VipAddress, lb.SubnetId, lb.RouterId, lb.NodeId, lb.Status)
+	if len(lb.Listeners) == 0 {
+		fmt.Println("No listeners")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LISTENER ID\tPORT\tALGORITHM\tHEALTH CHECK\tMEMBERS")
+	for _, l := range lb.Listeners {
+		pool := l.GetPool()
+		check := "-"
+		if hm := pool.GetHealthMonitor(); hm != nil {
+			check = fmt.Sprintf("every %ds, %d retries", hm.IntervalSeconds, hm.MaxRetries)
+		}
+		members := make([]string, len(pool.GetMembers()))
+		for i, m := range pool.GetMembers() {
+			members[i] = net.JoinHostPort(m.Address, strconv.Itoa(int(m.Port)))
+			if m.Weight > 1 {
+				members[i] += fmt.Sprintf(" (weight %d)", m.Weight)
+			}
+		}
+		if len(members) == 0 {
+			members = []string{"-"}
+		}
+		fmt.Fprintf(w, "%s\t%s/%d\t%s\t%s\t%s\n", l.Id, l.Protocol, l.Port, describeLBAlgorithm(pool.GetAlgorithm()), check, strings.Join(members, ", "))
+	}
+	w.Flush()
+
+	return nil
+}
+
+func describeLBAlgorithm(a v1.LBAlgorithm) string {
+	switch a {
+	case v1.LBAlgorithm_LB_ALGORITHM_LEAST_CONNECTIONS:
+		return "least_connections"
+	case v1.LBAlgorithm_LB_ALGORITHM_SOURCE_IP:
+		return "source_ip"
+	}
+	return "round_robin"
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func logsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "logs <instance-id>",
+		Short: "Show the log of an instance",
+		Long: `Print the log of an instance: the serial console of VMs and microVMs, or
+the stdout and stderr of containers. With --follow, keep printing what is
+written until interrupted.`,
+		Example: `  hypervisor-ctl instance logs -f web-1
+  hypervisor-ctl instance logs --tail 100 web-1`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			follow, _ := cmd.Flags().GetBool("follow")
+			tail, _ := cmd.Flags().GetInt("tail")
+			return instanceLogs(args[0], tail, follow)
+		},
+	}
+	cmd.Flags().BoolP("follow", "f", false, "keep printing the log as it is written")
+	cmd.Flags().Int("tail", 0, "lines from the end of the log to show (default all)")
+	return cmd
+}
+
+func instanceLogs(id string, tail int, follow bool) error {
+	// The log is a raw byte stream with no structured form
+	if output != "table" {
+		return usageErrorf("logs does not support --output %s", output)
+	}
+	if tail < 0 {
+		return usageErrorf("--tail cannot be negative")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := v1.NewComputeServiceClient(conn).GetInstanceLogs(ctx, &v1.GetInstanceLogsRequest{
+		InstanceId: id,
+		TailLines:  int32(tail),
+		Follow:     follow,
+	})
+	if err != nil {
+		return logsError(err)
+	}
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return logsError(err)
+		}
+		if _, err := os.Stdout.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// logsError reports logs a driver cannot read by the server's message
+// alone, which names the driver, rather than as an opaque RPC failure.
+func logsError(err error) error {
+	if st, ok := status.FromError(err); ok && st.Code() == codes.Unimplemented {
+		return withExitCode(exitUnsupported, errors.New(st.Message()))
+	}
+	return fmt.Errorf("failed to get instance logs: %w", err)
+}
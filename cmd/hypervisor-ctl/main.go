@@ -3,13 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"os/signal"
+	"strings"
 	"text/tabwriter"
 	"time"
 
+	v1 "hypervisor/api/gen"
+
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 var (
@@ -28,21 +36,55 @@ func main() {
 		Use:   "hypervisor-ctl",
 		Short: "Hypervisor command-line interface",
 		Long: `hypervisor-ctl is the CLI tool for managing the hypervisor cluster.
-It provides commands for managing nodes, instances, and cluster operations.`,
+It provides commands for managing nodes, instances, and cluster operations.
+` + exitCodesHelp,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			switch output {
+			case "table", "json", "yaml":
+			case "dot":
+				if cmd.Annotations[dotOutputAnnotation] == "" {
+					return usageErrorf("--output dot is not supported by %s", cmd.CommandPath())
+				}
+			default:
+				return usageErrorf("invalid --output %q (expected table, json or yaml)", output)
+			}
+			return startTracing(cmd)
+		},
 	}
+	rootCmd.SetFlagErrorFunc(func(_ *cobra.Command, err error) error {
+		return withExitCode(exitUsage, err)
+	})
 
 	// Global flags
 	rootCmd.PersistentFlags().StringVar(&serverAddr, "server", "localhost:50051", "server address")
-	rootCmd.PersistentFlags().StringVarP(&output, "output", "o", "table", "output format (table, json, yaml)")
+	rootCmd.PersistentFlags().StringVarP(&output, "output", "o", "table", "output format (table, json, yaml; dot for graphs)")
+	rootCmd.PersistentFlags().BoolVar(&traceEnabled, "trace", false, "trace the command across the server and agents and print the trace ID")
+	rootCmd.PersistentFlags().StringVar(&traceEndpoint, "trace-endpoint", defaultTraceEndpoint(), "OTLP/gRPC collector to export the trace to, as host:port or an http(s) URL")
 
 	// Add commands
 	rootCmd.AddCommand(versionCmd())
 	rootCmd.AddCommand(nodeCmd())
 	rootCmd.AddCommand(instanceCmd())
+	rootCmd.AddCommand(groupCmd())
+	rootCmd.AddCommand(maintenanceCmd())
 	rootCmd.AddCommand(clusterCmd())
+	rootCmd.AddCommand(networkCmd())
+	rootCmd.AddCommand(securityGroupCmd())
+	rootCmd.AddCommand(routerCmd())
+	rootCmd.AddCommand(eventsCmd())
+	rootCmd.AddCommand(applyCmd())
+	rootCmd.AddCommand(imageCmd())
+	rootCmd.AddCommand(registryCmd())
+	rootCmd.AddCommand(debugCmd())
 
-	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
+	markUsageErrors(rootCmd)
+	err := rootCmd.Execute()
+	finishTracing(err)
+	if err != nil {
+		reportError(err)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -50,10 +92,18 @@ func versionCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "version",
 		Short: "Print version information",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output == "json" || output == "yaml" {
+				return printStructured(map[string]string{
+					"version":    Version,
+					"build_time": BuildTime,
+					"git_commit": GitCommit,
+				})
+			}
 			fmt.Printf("hypervisor-ctl %s\n", Version)
 			fmt.Printf("  Build Time: %s\n", BuildTime)
 			fmt.Printf("  Git Commit: %s\n", GitCommit)
+			return nil
 		},
 	}
 }
@@ -83,35 +133,60 @@ func nodeCmd() *cobra.Command {
 		},
 	})
 
-	// node drain <id>
+	// node describe <id>
 	cmd.AddCommand(&cobra.Command{
-		Use:   "drain <node-id>",
-		Short: "Drain a node (prepare for maintenance)",
+		Use:   "describe <node-id>",
+		Short: "Show node details with its instances, ports, conditions and events",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return drainNode(args[0])
+			return describeNode(args[0])
 		},
 	})
 
-	// node cordon <id>
-	cmd.AddCommand(&cobra.Command{
-		Use:   "cordon <node-id>",
-		Short: "Mark node as unschedulable",
-		Args:  cobra.ExactArgs(1),
+	// node drain <id...> | -l <selector>
+	drainCmd := &cobra.Command{
+		Use:   "drain [node-id...]",
+		Short: "Drain nodes (prepare for maintenance)",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return cordonNode(args[0])
+			force, _ := cmd.Flags().GetBool("force")
+			return runNodeOp(cmd, args, "drain", drainNode(force))
 		},
-	})
+	}
+	drainCmd.Flags().BoolP("force", "f", false, "force stop instances")
+	addBulkFlags(drainCmd, 1)
+	cmd.AddCommand(drainCmd)
 
-	// node uncordon <id>
-	cmd.AddCommand(&cobra.Command{
-		Use:   "uncordon <node-id>",
-		Short: "Mark node as schedulable",
-		Args:  cobra.ExactArgs(1),
+	// node cordon <id...> | -l <selector>
+	cordonCmd := &cobra.Command{
+		Use:   "cordon [node-id...]",
+		Short: "Mark nodes as unschedulable",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return uncordonNode(args[0])
+			return runNodeOp(cmd, args, "cordon", cordonNode)
 		},
-	})
+	}
+	addBulkFlags(cordonCmd, 10)
+	cmd.AddCommand(cordonCmd)
+
+	// node uncordon <id...> | -l <selector>
+	uncordonCmd := &cobra.Command{
+		Use:   "uncordon [node-id...]",
+		Short: "Mark nodes as schedulable",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runNodeOp(cmd, args, "uncordon", uncordonNode)
+		},
+	}
+	addBulkFlags(uncordonCmd, 10)
+	cmd.AddCommand(uncordonCmd)
+
+	// node label|taint <id> ...
+	cmd.AddCommand(nodeLabelCmd())
+	cmd.AddCommand(nodeTaintCmd())
+
+	// node command send|list
+	cmd.AddCommand(nodeCommandCmd())
+
+	// node collect-logs <id>
+	cmd.AddCommand(collectLogsCmd())
 
 	return cmd
 }
@@ -127,14 +202,24 @@ func instanceCmd() *cobra.Command {
 	listCmd := &cobra.Command{
 		Use:   "list",
 		Short: "List instances",
+		Long: `List instances, optionally only those on a node, of a type or whose labels
+match a selector. Selector terms are comma-separated and must all match:
+key=value, key!=value, key in (v1,v2), key notin (v1,v2), key (the label is
+set) and !key (the label is not set).
+
+Examples:
+  hypervisor-ctl instance list --node node-1
+  hypervisor-ctl instance list -l 'app=web,tier in (frontend,cache),env!=test'`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			nodeID, _ := cmd.Flags().GetString("node")
 			instanceType, _ := cmd.Flags().GetString("type")
-			return listInstances(nodeID, instanceType)
+			selector, _ := cmd.Flags().GetString("selector")
+			return listInstances(nodeID, instanceType, selector)
 		},
 	}
 	listCmd.Flags().StringP("node", "n", "", "filter by node ID")
 	listCmd.Flags().StringP("type", "t", "", "filter by type (vm, container, microvm)")
+	listCmd.Flags().StringP("selector", "l", "", "filter by label selector, e.g. 'app=web,env!=test'")
 	cmd.AddCommand(listCmd)
 
 	// instance get <id>
@@ -147,6 +232,137 @@ func instanceCmd() *cobra.Command {
 		},
 	})
 
+	// instance describe <id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "describe <instance-id>",
+		Short: "Show instance details with ports, volumes, stats, conditions, history and events",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return describeInstance(args[0])
+		},
+	})
+
+	// instance top <id>
+	topCmd := &cobra.Command{
+		Use:   "top <instance-id>",
+		Short: "Show live CPU, memory, disk and network usage of an instance",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			history, _ := cmd.Flags().GetBool("history")
+			return topInstance(args[0], history)
+		},
+	}
+	topCmd.Flags().Bool("history", false, "show recent samples before live ones")
+	cmd.AddCommand(topCmd)
+
+	// instance console <id>
+	cmd.AddCommand(consoleCmd())
+
+	// instance logs <id>
+	cmd.AddCommand(logsCmd())
+
+	// instance diagnostics <id>
+	cmd.AddCommand(diagnosticsCmd())
+
+	// instance stats [id...]
+	statsCmd := &cobra.Command{
+		Use:   "stats [instance-id...]",
+		Short: "Show current usage of many instances at once",
+		Long: `Show current CPU, memory, disk and network usage of the given instances,
+or of all running instances matching --node and --selector when none are given.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &v1.BatchGetInstanceStatsRequest{InstanceIds: args}
+			req.NodeId, _ = cmd.Flags().GetString("node")
+			if selector, _ := cmd.Flags().GetString("selector"); selector != "" {
+				labels, err := parseSelector(selector)
+				if err != nil {
+					return err
+				}
+				req.LabelSelector = labels
+			}
+			return batchInstanceStats(req)
+		},
+	}
+	statsCmd.Flags().StringP("node", "n", "", "only instances on this node")
+	statsCmd.Flags().StringP("selector", "l", "", "only instances matching labels (key=value,...)")
+	cmd.AddCommand(statsCmd)
+
+	// instance recommendations [id...]
+	recommendationsCmd := &cobra.Command{
+		Use:   "recommendations [instance-id...]",
+		Short: "Suggest resizing chronically over-provisioned or starved instances",
+		Long: `Compare the p95 CPU and memory usage of the given instances, or of all
+running instances matching --node and --selector when none are given, with
+what they request, and suggest new sizes for those far below or close to it.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &v1.GetRecommendationsRequest{InstanceIds: args}
+			req.NodeId, _ = cmd.Flags().GetString("node")
+			if selector, _ := cmd.Flags().GetString("selector"); selector != "" {
+				labels, err := parseSelector(selector)
+				if err != nil {
+					return err
+				}
+				req.LabelSelector = labels
+			}
+			showSkipped, _ := cmd.Flags().GetBool("show-skipped")
+			return instanceRecommendations(req, showSkipped)
+		},
+	}
+	recommendationsCmd.Flags().StringP("node", "n", "", "only instances on this node")
+	recommendationsCmd.Flags().StringP("selector", "l", "", "only instances matching labels (key=value,...)")
+	recommendationsCmd.Flags().Bool("show-skipped", false, "list instances that could not be judged and why")
+	cmd.AddCommand(recommendationsCmd)
+
+	// instance watch
+	watchCmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Stream instance lifecycle changes as they happen",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &v1.WatchInstancesRequest{}
+			req.NodeId, _ = cmd.Flags().GetString("node")
+			req.IncludeExisting, _ = cmd.Flags().GetBool("existing")
+
+			instanceType, _ := cmd.Flags().GetString("type")
+			if instanceType != "" {
+				t, err := parseInstanceType(instanceType)
+				if err != nil {
+					return err
+				}
+				req.Type = t
+			}
+
+			selector, _ := cmd.Flags().GetString("selector")
+			if selector != "" {
+				labels, err := parseSelector(selector)
+				if err != nil {
+					return err
+				}
+				req.LabelSelector = labels
+			}
+
+			return watchInstances(req)
+		},
+	}
+	watchCmd.Flags().StringP("node", "n", "", "filter by node ID")
+	watchCmd.Flags().StringP("type", "t", "", "filter by type (vm, container, microvm)")
+	watchCmd.Flags().StringP("selector", "l", "", "filter by labels (key=value,...)")
+	watchCmd.Flags().Bool("existing", false, "list existing instances before streaming changes")
+	cmd.AddCommand(watchCmd)
+
+	// instance validate-migration <id> --target <node>
+	validateMigrationCmd := &cobra.Command{
+		Use:   "validate-migration <instance-id>",
+		Short: "Check whether an instance can be live migrated to a node",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, _ := cmd.Flags().GetString("target")
+			return validateMigration(args[0], target)
+		},
+	}
+	validateMigrationCmd.Flags().String("target", "", "target node ID (required)")
+	validateMigrationCmd.MarkFlagRequired("target")
+	cmd.AddCommand(validateMigrationCmd)
+
 	// instance create
 	createCmd := &cobra.Command{
 		Use:   "create",
@@ -157,7 +373,10 @@ func instanceCmd() *cobra.Command {
 			image, _ := cmd.Flags().GetString("image")
 			cpus, _ := cmd.Flags().GetInt("cpus")
 			memory, _ := cmd.Flags().GetInt("memory")
-			return createInstance(name, instanceType, image, cpus, memory)
+			arch, _ := cmd.Flags().GetString("arch")
+			runtime, _ := cmd.Flags().GetString("runtime")
+			key, _ := cmd.Flags().GetString("idempotency-key")
+			return createInstance(name, instanceType, image, arch, runtime, cpus, memory, key)
 		},
 	}
 	createCmd.Flags().String("name", "", "instance name (required)")
@@ -165,19 +384,25 @@ func instanceCmd() *cobra.Command {
 	createCmd.Flags().StringP("image", "i", "", "image name (required)")
 	createCmd.Flags().Int("cpus", 1, "number of CPUs")
 	createCmd.Flags().Int("memory", 512, "memory in MB")
+	createCmd.Flags().String("arch", "", "architecture the image is built for (amd64, arm64); default any node")
+	createCmd.Flags().String("runtime", "", "container runtime (runc, kata, gvisor or io.containerd.<name>.<version>); default the node's")
+	createCmd.Flags().String("idempotency-key", "", "retrying with the same key returns the first instance instead of creating another")
 	createCmd.MarkFlagRequired("name")
 	createCmd.MarkFlagRequired("image")
 	cmd.AddCommand(createCmd)
 
 	// instance start <id>
-	cmd.AddCommand(&cobra.Command{
+	startCmd := &cobra.Command{
 		Use:   "start <instance-id>",
 		Short: "Start an instance",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return startInstance(args[0])
+			key, _ := cmd.Flags().GetString("idempotency-key")
+			return startInstance(args[0], key)
 		},
-	})
+	}
+	startCmd.Flags().String("idempotency-key", "", "retrying with the same key returns the first result")
+	cmd.AddCommand(startCmd)
 
 	// instance stop <id>
 	stopCmd := &cobra.Command{
@@ -186,12 +411,37 @@ func instanceCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			force, _ := cmd.Flags().GetBool("force")
-			return stopInstance(args[0], force)
+			key, _ := cmd.Flags().GetString("idempotency-key")
+			return stopInstance(args[0], force, key)
 		},
 	}
 	stopCmd.Flags().BoolP("force", "f", false, "force stop")
+	stopCmd.Flags().String("idempotency-key", "", "retrying with the same key returns the first result")
 	cmd.AddCommand(stopCmd)
 
+	// instance pause <id>
+	pauseCmd := &cobra.Command{
+		Use:   "pause <instance-id>",
+		Short: "Freeze an instance in memory, or save it to disk with --to-disk",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			toDisk, _ := cmd.Flags().GetBool("to-disk")
+			return pauseInstance(args[0], toDisk)
+		},
+	}
+	pauseCmd.Flags().Bool("to-disk", false, "save the memory to disk and stop the instance")
+	cmd.AddCommand(pauseCmd)
+
+	// instance resume <id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "resume <instance-id>",
+		Short: "Continue a paused instance or restore a suspended one",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return resumeInstance(args[0])
+		},
+	})
+
 	// instance delete <id>
 	deleteCmd := &cobra.Command{
 		Use:   "delete <instance-id>",
@@ -199,12 +449,55 @@ func instanceCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			force, _ := cmd.Flags().GetBool("force")
-			return deleteInstance(args[0], force)
+			key, _ := cmd.Flags().GetString("idempotency-key")
+			return deleteInstance(args[0], force, key)
 		},
 	}
 	deleteCmd.Flags().BoolP("force", "f", false, "force delete")
+	deleteCmd.Flags().String("idempotency-key", "", "retrying with the same key succeeds once the instance is deleted")
 	cmd.AddCommand(deleteCmd)
 
+	// instance update <id>
+	updateCmd := &cobra.Command{
+		Use:   "update <instance-id>",
+		Short: "Change fields of an instance, leaving the others as they are",
+		Example: `  hypervisor-ctl instance update <id> --description "build runner"
+  hypervisor-ctl instance update <id> --labels env=prod,team=ci
+  hypervisor-ctl instance update <id> --memory-limit 2147483648`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateInstance(cmd, args[0])
+		},
+	}
+	updateCmd.Flags().String("description", "", "instance description")
+	updateCmd.Flags().String("labels", "", "replace all labels (key=value,...; empty clears)")
+	updateCmd.Flags().String("annotations", "", "replace all annotations (key=value,...; empty clears)")
+	updateCmd.Flags().Bool("ha", false, "reschedule onto a healthy node if the host fails")
+	updateCmd.Flags().Int64("cpu-quota", 0, "CPU quota in microseconds per period")
+	updateCmd.Flags().Int64("cpu-period", 0, "CPU period in microseconds")
+	updateCmd.Flags().Int64("memory-limit", 0, "memory limit in bytes")
+	updateCmd.Flags().Int64("io-read-bps", 0, "disk read limit in bytes per second")
+	updateCmd.Flags().Int64("io-write-bps", 0, "disk write limit in bytes per second")
+	cmd.AddCommand(updateCmd)
+
+	// instance resize <id>
+	resizeCmd := &cobra.Command{
+		Use:   "resize <instance-id>",
+		Short: "Change the vCPUs and memory of an instance",
+		Example: `  hypervisor-ctl instance resize <id> --cpus 4
+  hypervisor-ctl instance resize <id> --cpus 8 --memory 16Gi --allow-restart`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return resizeInstance(cmd, args[0])
+		},
+	}
+	resizeCmd.Flags().Int("cpus", 0, "new number of vCPUs")
+	resizeCmd.Flags().String("memory", "", "new memory size (e.g. 4096Mi, 8Gi)")
+	resizeCmd.Flags().Bool("allow-restart", false, "stop and start the instance if the change cannot be hot-plugged")
+	resizeCmd.Flags().BoolP("force", "f", false, "force stop when restarting")
+	resizeCmd.Flags().Int("timeout", 0, "seconds to wait for a graceful stop when restarting")
+	cmd.AddCommand(resizeCmd)
+
 	return cmd
 }
 
@@ -223,6 +516,18 @@ func clusterCmd() *cobra.Command {
 		},
 	})
 
+	// cluster notifications
+	cmd.AddCommand(notificationsCmd())
+
+	// cluster upgrade plan
+	cmd.AddCommand(upgradeCmd())
+
+	// cluster latency
+	cmd.AddCommand(latencyCmd())
+
+	// cluster health
+	cmd.AddCommand(healthCmd())
+
 	return cmd
 }
 
@@ -232,102 +537,789 @@ func getClient() (*grpc.ClientConn, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	return grpc.DialContext(ctx, serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts := append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, traceDialOptions()...)
+	return grpc.DialContext(ctx, serverAddr, opts...)
 }
 
 func listNodes() error {
-	fmt.Println("Fetching nodes from", serverAddr)
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewClusterServiceClient(conn).ListNodes(ctx, &v1.ListNodesRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Nodes))
+	}
+	if len(resp.Nodes) == 0 {
+		fmt.Println("No nodes found")
+		return nil
+	}
+	printNodeTable(resp.Nodes)
+	return nil
+}
+
+func getNode(id string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	node, err := v1.NewClusterServiceClient(conn).GetNode(ctx, &v1.GetNodeRequest{NodeId: id})
+	if err != nil {
+		return fmt.Errorf("failed to get node: %w", err)
+	}
 
-	// TODO: Implement actual gRPC call
-	// For now, just show a placeholder
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(node))
+	}
+	printNodeTable([]*v1.Node{node})
+	return nil
+}
+
+// printNodeTable prints one row per node with its allocated and allocatable
+// CPU and memory.
+func printNodeTable(nodes []*v1.Node) {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 	fmt.Fprintln(w, "NODE ID\tHOSTNAME\tSTATUS\tROLE\tREGION\tZONE\tCPU\tMEMORY")
-	fmt.Fprintln(w, "node-1\tworker-1\tReady\tworker\tus-west\tzone-a\t4/8\t8Gi/16Gi")
+	for _, node := range nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d/%d\t%s/%s\n",
+			node.Id, node.Hostname,
+			strings.ToLower(strings.TrimPrefix(node.Status.String(), "NODE_STATUS_")),
+			strings.ToLower(strings.TrimPrefix(node.Role.String(), "NODE_ROLE_")),
+			node.Region, node.Zone,
+			node.Allocated.GetCpuCores(), node.Allocatable.GetCpuCores(),
+			formatBytes(float64(node.Allocated.GetMemoryBytes())),
+			formatBytes(float64(node.Allocatable.GetMemoryBytes())))
+	}
 	w.Flush()
+}
 
-	return nil
+func drainNode(force bool) nodeOp {
+	return func(ctx context.Context, client v1.ClusterServiceClient, nodeID string) (string, error) {
+		resp, err := client.DrainNode(ctx, &v1.DrainNodeRequest{NodeId: nodeID, Force: force})
+		if err != nil {
+			return "", err
+		}
+		if len(resp.FailedInstanceIds) > 0 {
+			return "", fmt.Errorf("stopped %d instances, failed to stop %s",
+				resp.StoppedInstances, strings.Join(resp.FailedInstanceIds, ", "))
+		}
+		return fmt.Sprintf("drained (%d instances stopped)", resp.StoppedInstances), nil
+	}
 }
 
-func getNode(id string) error {
-	fmt.Printf("Getting node: %s\n", id)
-	// TODO: Implement
+func cordonNode(ctx context.Context, client v1.ClusterServiceClient, nodeID string) (string, error) {
+	if _, err := client.CordonNode(ctx, &v1.CordonNodeRequest{NodeId: nodeID}); err != nil {
+		return "", err
+	}
+	return "cordoned", nil
+}
+
+func uncordonNode(ctx context.Context, client v1.ClusterServiceClient, nodeID string) (string, error) {
+	if _, err := client.UncordonNode(ctx, &v1.CordonNodeRequest{NodeId: nodeID}); err != nil {
+		return "", err
+	}
+	return "uncordoned", nil
+}
+
+func listInstances(nodeID, instanceType, selector string) error {
+	req := &v1.ListInstancesRequest{NodeId: nodeID, Selector: selector}
+	if instanceType != "" {
+		t, err := parseInstanceType(instanceType)
+		if err != nil {
+			return err
+		}
+		req.Type = t
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewComputeServiceClient(conn).ListInstances(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Instances))
+	}
+	if len(resp.Instances) == 0 {
+		fmt.Println("No instances found")
+		return nil
+	}
+	printInstanceTable(resp.Instances)
 	return nil
 }
 
-func drainNode(id string) error {
-	fmt.Printf("Draining node: %s\n", id)
-	// TODO: Implement
+func getInstance(id string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	inst, err := v1.NewComputeServiceClient(conn).GetInstance(ctx, &v1.GetInstanceRequest{InstanceId: id})
+	if err != nil {
+		return fmt.Errorf("failed to get instance: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(inst))
+	}
+	printInstanceTable([]*v1.Instance{inst})
 	return nil
 }
 
-func cordonNode(id string) error {
-	fmt.Printf("Cordoning node: %s\n", id)
-	// TODO: Implement
+// printInstanceTable prints one row per instance.
+func printInstanceTable(instances []*v1.Instance) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE ID\tNAME\tTYPE\tSTATUS\tNODE\tCPU\tMEMORY")
+	for _, inst := range instances {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			inst.Id, inst.Name,
+			strings.ToLower(strings.TrimPrefix(inst.Type.String(), "INSTANCE_TYPE_")),
+			stateName(inst.State), valueOrDash(inst.NodeId),
+			inst.Spec.GetCpuCores(), formatBytes(float64(inst.Spec.GetMemoryBytes())))
+	}
+	w.Flush()
+}
+
+func watchInstances(req *v1.WatchInstancesRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	stream, err := v1.NewComputeServiceClient(conn).WatchInstances(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to watch instances: %w", err)
+	}
+
+	structured := output == "json" || output == "yaml"
+	if !structured {
+		fmt.Printf("%-10s %-9s %-36s %-20s %-10s %-10s %s\n",
+			"TIME", "EVENT", "INSTANCE ID", "NAME", "TYPE", "STATE", "NODE")
+	}
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("watch stream failed: %w", err)
+		}
+		if structured {
+			if err := printStreamed(protoJSON(event)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		inst := event.Instance
+		fmt.Printf("%-10s %-9s %-36s %-20s %-10s %-10s %s\n",
+			time.Now().Format(time.TimeOnly),
+			strings.TrimPrefix(event.Type.String(), "EVENT_TYPE_"),
+			inst.Id, inst.Name,
+			strings.ToLower(strings.TrimPrefix(inst.Type.String(), "INSTANCE_TYPE_")),
+			strings.ToLower(strings.TrimPrefix(inst.State.String(), "INSTANCE_STATE_")),
+			inst.NodeId)
+	}
+}
+
+// parseInstanceType converts a CLI instance type name to its proto value.
+func parseInstanceType(s string) (v1.InstanceType, error) {
+	switch strings.ToLower(s) {
+	case "vm":
+		return v1.InstanceType_INSTANCE_TYPE_VM, nil
+	case "container":
+		return v1.InstanceType_INSTANCE_TYPE_CONTAINER, nil
+	case "microvm":
+		return v1.InstanceType_INSTANCE_TYPE_MICROVM, nil
+	default:
+		return 0, usageErrorf("unknown instance type %q (expected vm, container or microvm)", s)
+	}
+}
+
+func validateMigration(id, target string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report, err := v1.NewComputeServiceClient(conn).ValidateMigration(ctx, &v1.ValidateMigrationRequest{
+		InstanceId:   id,
+		TargetNodeId: target,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to validate migration: %w", err)
+	}
+
+	incompatible := withExitCode(exitConflict,
+		fmt.Errorf("instance %s cannot be migrated to %s", report.InstanceId, report.TargetNodeId))
+	if output == "json" || output == "yaml" {
+		if err := printStructured(protoJSON(report)); err != nil {
+			return err
+		}
+		if !report.Compatible {
+			return incompatible
+		}
+		return nil
+	}
+
+	fmt.Printf("Instance %s: %s -> %s\n", report.InstanceId, report.SourceNodeId, report.TargetNodeId)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tMESSAGE")
+	for _, check := range report.Checks {
+		result := "PASS"
+		if !check.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, result, check.Message)
+	}
+	w.Flush()
+
+	if !report.Compatible {
+		return incompatible
+	}
+	fmt.Println("Migration is possible")
 	return nil
 }
 
-func uncordonNode(id string) error {
-	fmt.Printf("Uncordoning node: %s\n", id)
-	// TODO: Implement
+func topInstance(id string, history bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	stream, err := v1.NewComputeServiceClient(conn).StreamInstanceStats(ctx, &v1.StreamInstanceStatsRequest{
+		InstanceId:     id,
+		IncludeHistory: history,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stream instance stats: %w", err)
+	}
+
+	structured := output == "json" || output == "yaml"
+	if !structured {
+		fmt.Printf("%-10s %7s %10s %12s %12s %12s %12s\n",
+			"TIME", "CPU%", "MEMORY", "NET RX/s", "NET TX/s", "DISK R/s", "DISK W/s")
+	}
+	for {
+		sample, err := stream.Recv()
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("stats stream failed: %w", err)
+		}
+		if structured {
+			if err := printStreamed(protoJSON(sample)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		stats := sample.Stats
+		fmt.Printf("%-10s %7.1f %10s %12s %12s %12s %12s\n",
+			stats.CollectedAt.AsTime().Local().Format("15:04:05"),
+			sample.CpuPercent,
+			formatBytes(float64(stats.MemoryUsedBytes)),
+			formatBytes(sample.NetworkRxBytesPerSec),
+			formatBytes(sample.NetworkTxBytesPerSec),
+			formatBytes(sample.DiskReadBytesPerSec),
+			formatBytes(sample.DiskWriteBytesPerSec),
+		)
+	}
+}
+
+// formatBytes formats a byte count with a binary unit suffix.
+func batchInstanceStats(req *v1.BatchGetInstanceStatsRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewComputeServiceClient(conn).BatchGetInstanceStats(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to get instance stats: %w", err)
+	}
+
+	var failed int
+	for _, r := range resp.Results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	partial := fmt.Errorf("failed to get stats for %d of %d instances", failed, len(resp.Results))
+	if output == "json" || output == "yaml" {
+		if err := printStructured(protoJSON(resp)); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return partial
+		}
+		return nil
+	}
+
+	if len(resp.Results) == 0 {
+		fmt.Println("No instances found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE ID\tNODE\tCPU%\tMEMORY\tDISK READ\tDISK WRITE\tNET RX\tNET TX")
+	for _, r := range resp.Results {
+		if r.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\terror: %s\n", r.InstanceId, r.NodeId, r.Error)
+			continue
+		}
+		s := r.Stats
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%s\t%s\t%s\t%s\t%s\n",
+			r.InstanceId, r.NodeId, s.CpuUsagePercent,
+			formatBytes(float64(s.MemoryUsedBytes)),
+			formatBytes(float64(s.DiskReadBytes)), formatBytes(float64(s.DiskWriteBytes)),
+			formatBytes(float64(s.NetworkRxBytes)), formatBytes(float64(s.NetworkTxBytes)))
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return partial
+	}
 	return nil
 }
 
-func listInstances(nodeID, instanceType string) error {
-	fmt.Println("Fetching instances from", serverAddr)
+func instanceRecommendations(req *v1.GetRecommendationsRequest, showSkipped bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
 
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewComputeServiceClient(conn).GetRecommendations(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to get recommendations: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp))
+	}
+
+	if len(resp.Recommendations) == 0 {
+		fmt.Println("No recommendations")
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "INSTANCE\tNODE\tRESOURCE\tKIND\tREQUESTED\tP95\tSUGGESTED")
+		for _, r := range resp.Recommendations {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				valueOrDash(r.InstanceName), r.NodeId, r.Resource, r.Kind,
+				formatAmount(r.Requested, r.Unit), formatAmount(r.P95, r.Unit), formatAmount(r.Suggested, r.Unit))
+		}
+		w.Flush()
+	}
+
+	if len(resp.Skipped) == 0 {
+		return nil
+	}
+	if !showSkipped {
+		fmt.Printf("\n%d instance(s) skipped (--show-skipped lists them)\n", len(resp.Skipped))
+		return nil
+	}
+	fmt.Println("\nSkipped:")
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(w, "INSTANCE ID\tNAME\tTYPE\tSTATUS\tNODE\tCPU\tMEMORY")
-	fmt.Fprintln(w, "i-123456\tmy-vm\tvm\trunning\tnode-1\t2\t4Gi")
+	for _, s := range resp.Skipped {
+		fmt.Fprintf(w, "  %s\t%s\n", s.InstanceId, s.Reason)
+	}
 	w.Flush()
+	return nil
+}
+
+// formatAmount formats a recommendation amount in its unit.
+func formatAmount(v float64, unit string) string {
+	if unit == "MiB" {
+		return formatBytes(v * (1 << 20))
+	}
+	return fmt.Sprintf("%.2f %s", v, unit)
+}
+
+func formatBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0fB", b)
+	}
+	exp := 0
+	for n := b / unit; n >= unit && exp < 4; n /= unit {
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ci", b/math.Pow(unit, float64(exp+1)), "KMGTP"[exp])
+}
 
+func createInstance(name, instanceType, image, arch, runtime string, cpus, memory int, idempotencyKey string) error {
+	t, err := parseInstanceType(instanceType)
+	if err != nil {
+		return err
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	inst, err := v1.NewComputeServiceClient(conn).CreateInstance(ctx, &v1.CreateInstanceRequest{
+		Name: name,
+		Type: t,
+		Spec: &v1.InstanceSpec{
+			Image:        image,
+			CpuCores:     int32(cpus),
+			MemoryBytes:  int64(memory) * 1024 * 1024,
+			Architecture: arch,
+			Runtime:      runtime,
+		},
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create instance: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(inst))
+	}
+	fmt.Printf("Instance %s (%s) created on node %s\n", inst.Name, inst.Id, inst.NodeId)
 	return nil
 }
 
-func getInstance(id string) error {
-	fmt.Printf("Getting instance: %s\n", id)
-	// TODO: Implement
+func startInstance(id, idempotencyKey string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	inst, err := v1.NewComputeServiceClient(conn).StartInstance(ctx, &v1.StartInstanceRequest{
+		InstanceId:     id,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start instance: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(inst))
+	}
+	fmt.Printf("Instance %s %s\n", inst.Id, stateName(inst.State))
 	return nil
 }
 
-func createInstance(name, instanceType, image string, cpus, memory int) error {
-	fmt.Printf("Creating instance: %s (type=%s, image=%s, cpus=%d, memory=%dMB)\n",
-		name, instanceType, image, cpus, memory)
-	// TODO: Implement
+func stopInstance(id string, force bool, idempotencyKey string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	inst, err := v1.NewComputeServiceClient(conn).StopInstance(ctx, &v1.StopInstanceRequest{
+		InstanceId:     id,
+		Force:          force,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stop instance: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(inst))
+	}
+	fmt.Printf("Instance %s %s\n", inst.Id, stateName(inst.State))
 	return nil
 }
 
-func startInstance(id string) error {
-	fmt.Printf("Starting instance: %s\n", id)
-	// TODO: Implement
+func pauseInstance(id string, toDisk bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	// Saving memory to disk takes a while for large guests
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	inst, err := v1.NewComputeServiceClient(conn).PauseInstance(ctx, &v1.PauseInstanceRequest{
+		InstanceId: id,
+		ToDisk:     toDisk,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pause instance: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(inst))
+	}
+	fmt.Printf("Instance %s %s\n", inst.Id, stateName(inst.State))
 	return nil
 }
 
-func stopInstance(id string, force bool) error {
-	fmt.Printf("Stopping instance: %s (force=%v)\n", id, force)
-	// TODO: Implement
+func resumeInstance(id string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	inst, err := v1.NewComputeServiceClient(conn).ResumeInstance(ctx, &v1.ResumeInstanceRequest{InstanceId: id})
+	if err != nil {
+		return fmt.Errorf("failed to resume instance: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(inst))
+	}
+	fmt.Printf("Instance %s %s\n", inst.Id, stateName(inst.State))
+	return nil
+}
+
+func deleteInstance(id string, force bool, idempotencyKey string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	_, err = v1.NewComputeServiceClient(conn).DeleteInstance(ctx, &v1.DeleteInstanceRequest{
+		InstanceId:     id,
+		Force:          force,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete instance: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(map[string]any{"id": id, "deleted": true})
+	}
+	fmt.Printf("Instance %s deleted\n", id)
+	return nil
+}
+
+// updateInstance sends the fields whose flags were given, with an update
+// mask naming exactly those fields.
+func updateInstance(cmd *cobra.Command, id string) error {
+	instance := &v1.Instance{
+		Metadata: &v1.Metadata{},
+		Spec:     &v1.InstanceSpec{Limits: &v1.ResourceLimits{}},
+	}
+	flags := cmd.Flags()
+	var paths []string
+
+	if flags.Changed("description") {
+		instance.Description, _ = flags.GetString("description")
+		paths = append(paths, "description")
+	}
+	for _, field := range []string{"labels", "annotations"} {
+		if !flags.Changed(field) {
+			continue
+		}
+		value, _ := flags.GetString(field)
+		m := map[string]string{}
+		if value != "" {
+			var err error
+			if m, err = parseSelector(value); err != nil {
+				return usageErrorf("invalid --%s: %w", field, err)
+			}
+		}
+		if field == "labels" {
+			instance.Metadata.Labels = m
+		} else {
+			instance.Metadata.Annotations = m
+		}
+		paths = append(paths, "metadata."+field)
+	}
+	if flags.Changed("ha") {
+		instance.HighAvailability, _ = flags.GetBool("ha")
+		paths = append(paths, "high_availability")
+	}
+
+	limits := []struct {
+		flag  string
+		path  string
+		value *int64
+	}{
+		{"cpu-quota", "cpu_quota", &instance.Spec.Limits.CpuQuota},
+		{"cpu-period", "cpu_period", &instance.Spec.Limits.CpuPeriod},
+		{"memory-limit", "memory_limit", &instance.Spec.Limits.MemoryLimit},
+		{"io-read-bps", "io_read_bps", &instance.Spec.Limits.IoReadBps},
+		{"io-write-bps", "io_write_bps", &instance.Spec.Limits.IoWriteBps},
+	}
+	for _, limit := range limits {
+		if flags.Changed(limit.flag) {
+			*limit.value, _ = flags.GetInt64(limit.flag)
+			paths = append(paths, "spec.limits."+limit.path)
+		}
+	}
+
+	if len(paths) == 0 {
+		return usageErrorf("nothing to update: give at least one field flag")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewComputeServiceClient(conn).UpdateInstance(ctx, &v1.UpdateInstanceRequest{
+		InstanceId: id,
+		Instance:   instance,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update instance: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp))
+	}
+	fmt.Printf("Instance %s updated: %s\n", resp.Id, strings.Join(paths, ", "))
 	return nil
 }
 
-func deleteInstance(id string, force bool) error {
-	fmt.Printf("Deleting instance: %s (force=%v)\n", id, force)
-	// TODO: Implement
+func resizeInstance(cmd *cobra.Command, id string) error {
+	flags := cmd.Flags()
+	cpus, _ := flags.GetInt("cpus")
+	memoryFlag, _ := flags.GetString("memory")
+	allowRestart, _ := flags.GetBool("allow-restart")
+	force, _ := flags.GetBool("force")
+	timeout, _ := flags.GetInt("timeout")
+
+	memory, err := parseSize(memoryFlag, 0)
+	if err != nil {
+		return usageErrorf("invalid --memory: %w", err)
+	}
+	if cpus == 0 && memory == 0 {
+		return usageErrorf("nothing to resize: give --cpus, --memory or both")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	// A restart waits for the guest to stop, so allow for it
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second+time.Duration(max(timeout, 60))*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewComputeServiceClient(conn).ResizeInstance(ctx, &v1.ResizeInstanceRequest{
+		InstanceId:     id,
+		CpuCores:       int32(cpus),
+		MemoryBytes:    memory,
+		AllowRestart:   allowRestart,
+		Force:          force,
+		TimeoutSeconds: int32(timeout),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to resize instance: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp))
+	}
+	spec := resp.Instance.GetSpec()
+	fmt.Printf("Instance %s resized to %d vCPUs, %s memory (%s)\n",
+		id, spec.GetCpuCores(), formatBytes(float64(spec.GetMemoryBytes())), resp.Method)
 	return nil
 }
 
 func clusterInfo() error {
-	fmt.Println("Cluster Information")
-	fmt.Println("===================")
-	fmt.Println("Cluster ID:    default")
-	fmt.Println("Cluster Name:  hypervisor-cluster")
-	fmt.Println("Version:       0.1.0")
-	fmt.Println()
-	fmt.Println("Nodes:         3 (3 ready)")
-	fmt.Println("Instances:     12")
-	fmt.Println()
-	fmt.Println("Resources:")
-	fmt.Println("  CPU:         24 cores (12 allocated)")
-	fmt.Println("  Memory:      48 GB (24 GB allocated)")
-	fmt.Println("  Disk:        1 TB (500 GB allocated)")
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	info, err := v1.NewClusterServiceClient(conn).GetClusterInfo(ctx, &emptypb.Empty{})
+	if err != nil {
+		return fmt.Errorf("failed to get cluster info: %w", err)
+	}
 
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(info))
+	}
+
+	capacity, allocated := info.TotalCapacity, info.TotalAllocated
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Cluster ID:\t%s\n", info.ClusterId)
+	fmt.Fprintf(w, "Cluster Name:\t%s\n", info.ClusterName)
+	fmt.Fprintf(w, "Version:\t%s\n", info.Version)
+	fmt.Fprintf(w, "Nodes:\t%d (%d ready)\n", info.TotalNodes, info.ReadyNodes)
+	fmt.Fprintf(w, "CPU:\t%d cores (%d allocated)\n", capacity.GetCpuCores(), allocated.GetCpuCores())
+	fmt.Fprintf(w, "Memory:\t%s (%s allocated)\n",
+		formatBytes(float64(capacity.GetMemoryBytes())), formatBytes(float64(allocated.GetMemoryBytes())))
+	fmt.Fprintf(w, "Disk:\t%s (%s allocated)\n",
+		formatBytes(float64(capacity.GetDiskBytes())), formatBytes(float64(allocated.GetDiskBytes())))
+	w.Flush()
 	return nil
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func maintenanceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "maintenance",
+		Aliases: []string{"maintenance-window", "mw"},
+		Short:   "Manage recurring node maintenance windows",
+		Long: `A maintenance window cordons its nodes, or drains them with --drain, and
+puts them into maintenance when its cron schedule fires. When its duration
+is over the nodes are uncordoned. Nodes that are not ready when the window
+starts, e.g. already cordoned, are left alone.`,
+	}
+
+	// maintenance create <name>
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a maintenance window",
+		Example: `  hypervisor-ctl maintenance create patch-tuesday --nodes node-1,node-2 --schedule "0 2 * * tue" --duration 2h
+  hypervisor-ctl maintenance create rack-a --selector rack=a --schedule "@monthly" --duration 4h --drain --time-zone Europe/Berlin`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return createMaintenanceWindow(cmd, args[0])
+		},
+	}
+	createCmd.Flags().StringSlice("nodes", nil, "IDs of the nodes the window applies to")
+	createCmd.Flags().StringP("selector", "l", "", "labels of the nodes the window applies to (key=value,...)")
+	createCmd.Flags().String("schedule", "", "cron expression for when the window starts, e.g. \"0 2 * * sun\" (required)")
+	createCmd.Flags().String("time-zone", "", "time zone of the schedule (default UTC)")
+	createCmd.Flags().Duration("duration", time.Hour, "how long the window lasts")
+	createCmd.Flags().Bool("drain", false, "stop the nodes' instances when the window starts")
+	createCmd.Flags().Bool("force", false, "force-stop instances when draining")
+	createCmd.MarkFlagRequired("schedule")
+	cmd.AddCommand(createCmd)
+
+	// maintenance list
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List maintenance windows",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listMaintenanceWindows()
+		},
+	})
+
+	// maintenance get <name>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "get <name>",
+		Short: "Show a maintenance window",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return getMaintenanceWindow(args[0])
+		},
+	})
+
+	// maintenance delete <name>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "delete <name>",
+		Short: "Delete a maintenance window, ending it if it is running",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteMaintenanceWindow(args[0])
+		},
+	})
+
+	return cmd
+}
+
+func createMaintenanceWindow(cmd *cobra.Command, name string) error {
+	flags := cmd.Flags()
+	nodes, _ := flags.GetStringSlice("nodes")
+	selectorFlag, _ := flags.GetString("selector")
+	schedule, _ := flags.GetString("schedule")
+	timeZone, _ := flags.GetString("time-zone")
+	duration, _ := flags.GetDuration("duration")
+	drain, _ := flags.GetBool("drain")
+	force, _ := flags.GetBool("force")
+
+	req := &v1.CreateMaintenanceWindowRequest{
+		Name:            name,
+		NodeIds:         nodes,
+		Schedule:        schedule,
+		TimeZone:        timeZone,
+		DurationSeconds: int64(duration / time.Second),
+		Drain:           drain,
+		Force:           force,
+	}
+	if selectorFlag != "" {
+		selector, err := parseSelector(selectorFlag)
+		if err != nil {
+			return usageErrorf("invalid --selector: %w", err)
+		}
+		req.NodeSelector = selector
+	}
+	if len(req.NodeIds) == 0 && len(req.NodeSelector) == 0 {
+		return usageErrorf("--nodes or --selector is required")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	window, err := v1.NewClusterServiceClient(conn).CreateMaintenanceWindow(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to create maintenance window: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(window))
+	}
+	fmt.Printf("Maintenance window %s created, next start %s\n", window.Name, formatWindowTime(window.Status.GetNextStart()))
+	return nil
+}
+
+func listMaintenanceWindows() error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewClusterServiceClient(conn).ListMaintenanceWindows(ctx, &v1.ListMaintenanceWindowsRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list maintenance windows: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Windows))
+	}
+	if len(resp.Windows) == 0 {
+		fmt.Println("No maintenance windows found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tNODES\tSCHEDULE\tDURATION\tDRAIN\tACTIVE\tNEXT START")
+	for _, mw := range resp.Windows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%t\t%s\n",
+			mw.Name, windowNodes(mw), mw.Schedule,
+			time.Duration(mw.DurationSeconds)*time.Second,
+			mw.Drain, mw.Status.GetActive(),
+			formatWindowTime(mw.Status.GetNextStart()))
+	}
+	w.Flush()
+	return nil
+}
+
+func getMaintenanceWindow(name string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	mw, err := v1.NewClusterServiceClient(conn).GetMaintenanceWindow(ctx, &v1.GetMaintenanceWindowRequest{Name: name})
+	if err != nil {
+		return fmt.Errorf("failed to get maintenance window: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(mw))
+	}
+
+	st := mw.Status
+	fmt.Printf("Name:        %s\n", mw.Name)
+	fmt.Printf("Nodes:       %s\n", windowNodes(mw))
+	fmt.Printf("Schedule:    %s (%s)\n", mw.Schedule, valueOrDash(mw.TimeZone))
+	fmt.Printf("Duration:    %s\n", time.Duration(mw.DurationSeconds)*time.Second)
+	fmt.Printf("Drain:       %t (force %t)\n", mw.Drain, mw.Force)
+	if st.GetActive() {
+		fmt.Printf("Active:      since %s on %s\n", formatWindowTime(st.ActiveSince), valueOrDash(strings.Join(st.NodeIds, ", ")))
+	} else {
+		fmt.Printf("Active:      no\n")
+	}
+	fmt.Printf("Next Start:  %s\n", formatWindowTime(st.GetNextStart()))
+	fmt.Printf("Last Start:  %s\n", formatWindowTime(st.GetLastStarted()))
+	fmt.Printf("Last End:    %s\n", formatWindowTime(st.GetLastEnded()))
+	fmt.Printf("Created:     %s\n", mw.CreatedAt.AsTime().Format(time.RFC3339))
+	return nil
+}
+
+func deleteMaintenanceWindow(name string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if _, err := v1.NewClusterServiceClient(conn).DeleteMaintenanceWindow(ctx, &v1.DeleteMaintenanceWindowRequest{
+		Name: name,
+	}); err != nil {
+		return fmt.Errorf("failed to delete maintenance window: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(map[string]any{"name": name, "deleted": true})
+	}
+	fmt.Printf("Maintenance window %s deleted\n", name)
+	return nil
+}
+
+// windowNodes describes the nodes a window applies to.
+func windowNodes(mw *v1.MaintenanceWindow) string {
+	var parts []string
+	if len(mw.NodeIds) > 0 {
+		parts = append(parts, strings.Join(mw.NodeIds, ","))
+	}
+	if len(mw.NodeSelector) > 0 {
+		parts = append(parts, formatLabels(mw.NodeSelector))
+	}
+	return strings.Join(parts, " + ")
+}
+
+func formatWindowTime(t *timestamppb.Timestamp) string {
+	if t == nil {
+		return "-"
+	}
+	return t.AsTime().Local().Format(time.DateTime)
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func networkCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "network",
+		Aliases: []string{"net"},
+		Short:   "Manage virtual networks",
+	}
+
+	cmd.AddCommand(subnetCmd())
+	cmd.AddCommand(portCmd())
+	cmd.AddCommand(trunkCmd())
+	cmd.AddCommand(loadBalancerCmd())
+	cmd.AddCommand(vpnCmd())
+	cmd.AddCommand(bgpCmd())
+	cmd.AddCommand(topologyCmd())
+	cmd.AddCommand(pingCmd())
+
+	// network update <id>
+	updateCmd := &cobra.Command{
+		Use:   "update <network-id>",
+		Short: "Change fields of a network, leaving the others as they are",
+		Example: `  hypervisor-ctl network update <id> --description "tenant A frontends"
+  hypervisor-ctl network update <id> --admin-state=false`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateNetwork(cmd, args[0])
+		},
+	}
+	updateCmd.Flags().String("name", "", "network name")
+	updateCmd.Flags().String("description", "", "network description")
+	updateCmd.Flags().Bool("admin-state", true, "administratively enable the network")
+	updateCmd.Flags().Bool("shared", false, "share the network across tenants")
+	updateCmd.Flags().String("labels", "", "replace all labels (key=value,...; empty clears)")
+	cmd.AddCommand(updateCmd)
+
+	return cmd
+}
+
+// updateNetwork sends the fields whose flags were given, with an update mask
+// naming exactly those fields.
+func updateNetwork(cmd *cobra.Command, id string) error {
+	network := &v1.Network{Metadata: &v1.Metadata{}}
+	flags := cmd.Flags()
+	var paths []string
+
+	if flags.Changed("name") {
+		network.Name, _ = flags.GetString("name")
+		paths = append(paths, "name")
+	}
+	if flags.Changed("description") {
+		network.Description, _ = flags.GetString("description")
+		paths = append(paths, "description")
+	}
+	if flags.Changed("admin-state") {
+		network.AdminState, _ = flags.GetBool("admin-state")
+		paths = append(paths, "admin_state")
+	}
+	if flags.Changed("shared") {
+		network.Shared, _ = flags.GetBool("shared")
+		paths = append(paths, "shared")
+	}
+	if flags.Changed("labels") {
+		value, _ := flags.GetString("labels")
+		network.Metadata.Labels = map[string]string{}
+		if value != "" {
+			labels, err := parseSelector(value)
+			if err != nil {
+				return usageErrorf("invalid --labels: %w", err)
+			}
+			network.Metadata.Labels = labels
+		}
+		paths = append(paths, "metadata.labels")
+	}
+
+	if len(paths) == 0 {
+		return usageErrorf("nothing to update: give at least one field flag")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).UpdateNetwork(ctx, &v1.UpdateNetworkRequest{
+		NetworkId:  id,
+		Network:    network,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update network: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Network))
+	}
+	fmt.Printf("Network %s updated: %s\n", resp.Network.Id, strings.Join(paths, ", "))
+	return nil
+}
+
+func subnetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "subnet",
+		Short: "Manage subnets",
+	}
+
+	// network subnet expand <id>
+	expandCmd := &cobra.Command{
+		Use:   "expand <subnet-id>",
+		Short: "Grow a subnet's allocation pools, optionally widening its CIDR",
+		Long: `Grow a subnet's allocation pools. Without --cidr, unused addresses in the
+current CIDR are added as pools. With --cidr, the subnet is widened to the
+given CIDR (which must contain the current one) and router interfaces on the
+subnet are re-addressed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cidr, _ := cmd.Flags().GetString("cidr")
+			zone, _ := cmd.Flags().GetString("zone")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			return expandSubnet(args[0], cidr, zone, dryRun)
+		},
+	}
+	expandCmd.Flags().String("cidr", "", "wider CIDR containing the current one")
+	expandCmd.Flags().String("zone", "", "zone affinity for the added pools")
+	expandCmd.Flags().Bool("dry-run", false, "show the result without applying it")
+	cmd.AddCommand(expandCmd)
+
+	// network subnet split <id> --zones a,b
+	splitCmd := &cobra.Command{
+		Use:   "split <subnet-id>",
+		Short: "Split a subnet into one subnet per zone",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			zones, _ := cmd.Flags().GetStringSlice("zones")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			return splitSubnet(args[0], zones, dryRun)
+		},
+	}
+	splitCmd.Flags().StringSlice("zones", nil, "zones to create subnets for (required)")
+	splitCmd.Flags().Bool("dry-run", false, "show the planned subnets without applying them")
+	splitCmd.MarkFlagRequired("zones")
+	cmd.AddCommand(splitCmd)
+
+	// network subnet delete <id>
+	deleteCmd := &cobra.Command{
+		Use:   "delete <subnet-id>",
+		Short: "Delete a subnet",
+		Long: `Delete a subnet. A subnet with router interfaces, ports or IP allocations is
+only deleted with --cascade, which detaches the router interfaces, deletes the
+ports and releases the allocations first. Ports and addresses used by
+instances are never removed; detach them from their instances first.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cascade, _ := cmd.Flags().GetBool("cascade")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			return deleteSubnet(args[0], cascade, dryRun)
+		},
+	}
+	deleteCmd.Flags().Bool("cascade", false, "remove the subnet's dependencies first")
+	deleteCmd.Flags().Bool("dry-run", false, "only list the subnet's dependencies")
+	cmd.AddCommand(deleteCmd)
+
+	cmd.AddCommand(reservationCmd())
+
+	return cmd
+}
+
+func expandSubnet(subnetID, cidr, zone string, dryRun bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).ExpandSubnet(ctx, &v1.ExpandSubnetRequest{
+		SubnetId: subnetID,
+		Cidr:     cidr,
+		Zone:     zone,
+		DryRun:   dryRun,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to expand subnet: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp))
+	}
+	if dryRun {
+		progressf("Dry run, no changes applied\n")
+	}
+	fmt.Printf("Subnet %s: %s\n", resp.Subnet.Id, resp.Subnet.Cidr)
+	fmt.Println("Added pools:")
+	printPools(resp.AddedPools)
+	if len(resp.UpdatedRouterIds) > 0 {
+		fmt.Printf("Updated router interfaces: %s\n", strings.Join(resp.UpdatedRouterIds, ", "))
+	}
+
+	return nil
+}
+
+func splitSubnet(subnetID string, zones []string, dryRun bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).SplitSubnet(ctx, &v1.SplitSubnetRequest{
+		SubnetId: subnetID,
+		Zones:    zones,
+		DryRun:   dryRun,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to split subnet: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp))
+	}
+	if dryRun {
+		progressf("Dry run, no changes applied\n")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBNET ID\tNAME\tCIDR\tGATEWAY\tZONE\tPOOL")
+	for _, subnet := range resp.Subnets {
+		for _, pool := range subnet.AllocationPools {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s-%s\n",
+				subnet.Id, subnet.Name, subnet.Cidr, subnet.GatewayIp, pool.Zone, pool.Start, pool.End)
+		}
+	}
+	w.Flush()
+
+	return nil
+}
+
+func deleteSubnet(subnetID string, cascade, dryRun bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).DeleteSubnet(ctx, &v1.DeleteSubnetRequest{
+		SubnetId: subnetID,
+		Cascade:  cascade,
+		DryRun:   dryRun,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete subnet: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Dependencies))
+	}
+
+	if dryRun {
+		if len(resp.Dependencies) == 0 {
+			fmt.Printf("Subnet %s has no dependencies and can be deleted\n", subnetID)
+			return nil
+		}
+		progressf("Dry run, no changes applied\n")
+	} else {
+		fmt.Printf("Subnet %s deleted\n", subnetID)
+		if len(resp.Dependencies) == 0 {
+			return nil
+		}
+		fmt.Println("Removed dependencies:")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tID\tDETAIL\tBLOCKING")
+	for _, dep := range resp.Dependencies {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", dep.Kind, dep.Id, dep.Detail, dep.Blocking)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func portCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "port",
+		Short: "Manage ports",
+	}
+
+	// network port qos <id>
+	qosCmd := &cobra.Command{
+		Use:   "qos <port-id>",
+		Short: "Set or clear the bandwidth limits of a port",
+		Long: `Set the bandwidth limits of a port, replacing its current ones. Directions
+are those of the instance: egress is what it sends, ingress what it receives.
+A zero rate leaves the direction unlimited. With --clear, all limits are
+removed.`,
+		Example: `  hypervisor-ctl network port qos <id> --egress-rate 100000 --ingress-rate 200000
+  hypervisor-ctl network port qos <id> --clear`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return setPortQoS(cmd, args[0])
+		},
+	}
+	qosCmd.Flags().Uint64("ingress-rate", 0, "ingress rate limit in kbit/s")
+	qosCmd.Flags().Uint64("ingress-burst", 0, "ingress burst in kbit")
+	qosCmd.Flags().Uint64("egress-rate", 0, "egress rate limit in kbit/s")
+	qosCmd.Flags().Uint64("egress-burst", 0, "egress burst in kbit")
+	qosCmd.Flags().Bool("clear", false, "remove all limits")
+	cmd.AddCommand(qosCmd)
+
+	// network port stats <id>
+	statsCmd := &cobra.Command{
+		Use:   "stats <port-id>",
+		Short: "Show the traffic counters of a bound port",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return showPortStats(args[0])
+		},
+	}
+	cmd.AddCommand(statsCmd)
+
+	cmd.AddCommand(mirrorCmd())
+
+	return cmd
+}
+
+func mirrorCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "mirror",
+		Short: "Copy the traffic of a port elsewhere for troubleshooting",
+	}
+
+	// network port mirror create <source-port-id>
+	createCmd := &cobra.Command{
+		Use:   "create <source-port-id>",
+		Short: "Mirror a port to another port or a tunnel",
+		Long: `Mirror the traffic of a port to another port bound to the same node, or to a
+remote collector over a GRE or VXLAN tunnel. Directions are those of the
+instance: ingress is what it receives, egress what it sends.`,
+		Example: `  hypervisor-ctl network port mirror create <port-id> --to-port <capture-port-id>
+  hypervisor-ctl network port mirror create <port-id> --tunnel gre --remote-ip 192.0.2.10 --direction egress`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return createMirror(cmd, args[0])
+		},
+	}
+	createCmd.Flags().String("name", "", "mirror name")
+	createCmd.Flags().String("direction", "both", "traffic to mirror: ingress, egress or both")
+	createCmd.Flags().String("to-port", "", "port receiving the copies")
+	createCmd.Flags().String("tunnel", "", "tunnel type to a remote collector: gre or vxlan")
+	createCmd.Flags().String("remote-ip", "", "address of the remote collector")
+	createCmd.Flags().Uint32("key", 0, "GRE key or VNI of the tunnel")
+	cmd.AddCommand(createCmd)
+
+	// network port mirror list
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List port mirrors",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			portID, _ := cmd.Flags().GetString("port")
+			return listMirrors(portID)
+		},
+	}
+	listCmd.Flags().String("port", "", "only mirrors from or to this port")
+	cmd.AddCommand(listCmd)
+
+	// network port mirror delete <mirror-id>
+	deleteCmd := &cobra.Command{
+		Use:   "delete <mirror-id>",
+		Short: "Stop and delete a port mirror",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteMirror(args[0])
+		},
+	}
+	cmd.AddCommand(deleteCmd)
+
+	return cmd
+}
+
+func createMirror(cmd *cobra.Command, sourcePortID string) error {
+	flags := cmd.Flags()
+	req := &v1.MirrorPortRequest{SourcePortId: sourcePortID}
+	req.Name, _ = flags.GetString("name")
+	req.TargetPortId, _ = flags.GetString("to-port")
+
+	direction, _ := flags.GetString("direction")
+	switch direction {
+	case "ingress":
+		req.Direction = v1.MirrorDirection_MIRROR_DIRECTION_INGRESS
+	case "egress":
+		req.Direction = v1.MirrorDirection_MIRROR_DIRECTION_EGRESS
+	case "both":
+		req.Direction = v1.MirrorDirection_MIRROR_DIRECTION_BOTH
+	default:
+		return usageErrorf("invalid --direction %q: must be ingress, egress or both", direction)
+	}
+
+	if tunnelType, _ := flags.GetString("tunnel"); tunnelType != "" {
+		req.Tunnel = &v1.MirrorTunnel{Type: tunnelType}
+		req.Tunnel.RemoteIp, _ = flags.GetString("remote-ip")
+		req.Tunnel.Key, _ = flags.GetUint32("key")
+	}
+	if (req.TargetPortId == "") == (req.Tunnel == nil) {
+		return usageErrorf("give either --to-port or --tunnel")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).MirrorPort(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to mirror port: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Mirror))
+	}
+	fmt.Printf("Mirror %s created: %s\n", resp.Mirror.Id, describeMirror(resp.Mirror))
+	return nil
+}
+
+func listMirrors(portID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).ListPortMirrors(ctx, &v1.ListPortMirrorsRequest{PortId: portID})
+	if err != nil {
+		return fmt.Errorf("failed to list mirrors: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Mirrors))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MIRROR ID\tNAME\tMIRROR\tSTATUS")
+	for _, mirror := range resp.Mirrors {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", mirror.Id, mirror.Name, describeMirror(mirror), mirror.Status)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func deleteMirror(mirrorID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewNetworkServiceClient(conn).DeletePortMirror(ctx, &v1.DeletePortMirrorRequest{MirrorId: mirrorID}); err != nil {
+		return fmt.Errorf("failed to delete mirror: %w", err)
+	}
+	fmt.Printf("Mirror %s deleted\n", mirrorID)
+	return nil
+}
+
+// describeMirror summarizes a mirror as "<source> <direction> -> <target>".
+func describeMirror(mirror *v1.PortMirror) string {
+	direction := strings.ToLower(strings.TrimPrefix(mirror.Direction.String(), "MIRROR_DIRECTION_"))
+	target := "port " + mirror.TargetPortId
+	if t := mirror.Tunnel; t != nil {
+		target = fmt.Sprintf("%s %s", t.Type, t.RemoteIp)
+		if t.Key != 0 {
+			target += fmt.Sprintf(" key %d", t.Key)
+		}
+	}
+	return fmt.Sprintf("port %s %s -> %s", mirror.SourcePortId, direction, target)
+}
+
+func setPortQoS(cmd *cobra.Command, portID string) error {
+	flags := cmd.Flags()
+	clearQoS, _ := flags.GetBool("clear")
+
+	var qos *v1.PortQoS
+	if !clearQoS {
+		qos = &v1.PortQoS{}
+		qos.IngressRateKbps, _ = flags.GetUint64("ingress-rate")
+		qos.IngressBurstKb, _ = flags.GetUint64("ingress-burst")
+		qos.EgressRateKbps, _ = flags.GetUint64("egress-rate")
+		qos.EgressBurstKb, _ = flags.GetUint64("egress-burst")
+		if qos.IngressRateKbps == 0 && qos.EgressRateKbps == 0 {
+			return usageErrorf("give --ingress-rate or --egress-rate, or --clear")
+		}
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).SetPortQoS(ctx, &v1.SetPortQoSRequest{
+		PortId: portID,
+		Qos:    qos,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set port QoS: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Port))
+	}
+	if resp.Port.Qos == nil {
+		fmt.Printf("Port %s: no bandwidth limits\n", resp.Port.Id)
+		return nil
+	}
+	fmt.Printf("Port %s: ingress %s, egress %s\n", resp.Port.Id,
+		formatRate(resp.Port.Qos.IngressRateKbps, resp.Port.Qos.IngressBurstKb),
+		formatRate(resp.Port.Qos.EgressRateKbps, resp.Port.Qos.EgressBurstKb))
+	return nil
+}
+
+func formatRate(rateKbps, burstKb uint64) string {
+	if rateKbps == 0 {
+		return "unlimited"
+	}
+	if burstKb == 0 {
+		return fmt.Sprintf("%d kbit/s", rateKbps)
+	}
+	return fmt.Sprintf("%d kbit/s (burst %d kbit)", rateKbps, burstKb)
+}
+
+func showPortStats(portID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).GetPortStats(ctx, &v1.GetPortStatsRequest{PortId: portID})
+	if err != nil {
+		return fmt.Errorf("failed to get port stats: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Stats))
+	}
+
+	stats := resp.Stats
+	fmt.Printf("Port %s on node %s, as of %s\n", stats.PortId, stats.NodeId,
+		stats.UpdatedAt.AsTime().Local().Format(time.RFC3339))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTION\tPACKETS\tBYTES\tDROPPED\tERRORS")
+	fmt.Fprintf(w, "rx\t%d\t%d\t%d\t%d\n", stats.RxPackets, stats.RxBytes, stats.RxDropped, stats.RxErrors)
+	fmt.Fprintf(w, "tx\t%d\t%d\t%d\t%d\n", stats.TxPackets, stats.TxBytes, stats.TxDropped, stats.TxErrors)
+	w.Flush()
+
+	return nil
+}
+
+func printPools(pools []*v1.IPPool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "START\tEND\tTYPE\tZONE")
+	for _, pool := range pools {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", pool.Start, pool.End, pool.Type, pool.Zone)
+	}
+	w.Flush()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func nodeCommandCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "command",
+		Short: "Send commands to node agents and read their results",
+		Long: `Commands are queued per node and run by the node's agent, which picks
+them up with its next heartbeat and reports back a result. Cordon, uncordon
+and drain queue their own commands.`,
+	}
+
+	// node command send <node-id> <type>
+	sendCmd := &cobra.Command{
+		Use:   "send <node-id> <upgrade|collect-logs>",
+		Short: "Queue a command for a node's agent",
+		Example: `  hypervisor-ctl node command send node-1 upgrade --param version=v1.4.0 --wait 1m
+  hypervisor-ctl node command send node-1 collect-logs --param lines=500`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			params, _ := cmd.Flags().GetStringToString("param")
+			wait, _ := cmd.Flags().GetDuration("wait")
+			return sendNodeCommand(args[0], args[1], params, wait)
+		},
+	}
+	sendCmd.Flags().StringToString("param", nil, "command parameter as key=value (repeatable)")
+	sendCmd.Flags().Duration("wait", 0, "wait up to this long for the agent to finish")
+	cmd.AddCommand(sendCmd)
+
+	// node command list <node-id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list <node-id>",
+		Short: "List the commands queued for a node in the last day",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listNodeCommands(args[0])
+		},
+	})
+
+	return cmd
+}
+
+func collectLogsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "collect-logs <node-id>",
+		Short: "Collect agent state and instance console logs from a node",
+		Long: `Have a node's agent collect its instances, work queue and the end of each
+instance's serial console, and print what it sent back.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			lines, _ := cmd.Flags().GetInt("lines")
+			instanceID, _ := cmd.Flags().GetString("instance")
+			wait, _ := cmd.Flags().GetDuration("wait")
+
+			params := map[string]string{"lines": fmt.Sprint(lines)}
+			if instanceID != "" {
+				params["instance_id"] = instanceID
+			}
+			return sendNodeCommand(args[0], "collect-logs", params, wait)
+		},
+	}
+	cmd.Flags().Int("lines", 100, "console lines per instance")
+	cmd.Flags().String("instance", "", "only collect the console of this instance")
+	cmd.Flags().Duration("wait", time.Minute, "how long to wait for the agent")
+	return cmd
+}
+
+func sendNodeCommand(nodeID, commandType string, params map[string]string, wait time.Duration) error {
+	if wait < 0 {
+		return usageErrorf("--wait cannot be negative")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second+wait)
+	defer cancel()
+
+	if wait > 0 {
+		progressf("Waiting up to %s for node %s to run %s...\n", wait, nodeID, commandType)
+	}
+	cmd, err := v1.NewClusterServiceClient(conn).SendNodeCommand(ctx, &v1.SendNodeCommandRequest{
+		NodeId:      nodeID,
+		Type:        commandType,
+		Parameters:  params,
+		WaitSeconds: int32(wait.Seconds()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		if err := printStructured(protoJSON(cmd)); err != nil {
+			return err
+		}
+	} else {
+		printNodeCommand(cmd)
+	}
+
+	switch {
+	case cmd.State == "failed":
+		return fmt.Errorf("command %s failed: %s", cmd.Id, cmd.Message)
+	case wait > 0 && cmd.State != "succeeded":
+		return withExitCode(exitUnavailable, fmt.Errorf("command %s still %s after %s", cmd.Id, cmd.State, wait))
+	}
+	return nil
+}
+
+func listNodeCommands(nodeID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewClusterServiceClient(conn).ListNodeCommands(ctx, &v1.ListNodeCommandsRequest{NodeId: nodeID})
+	if err != nil {
+		return fmt.Errorf("failed to list commands: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Commands))
+	}
+	if len(resp.Commands) == 0 {
+		fmt.Println("No commands found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tSTATE\tCREATED\tMESSAGE")
+	for _, cmd := range resp.Commands {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			cmd.Id, cmd.Type, cmd.State,
+			cmd.CreatedAt.AsTime().Local().Format(time.DateTime),
+			valueOrDash(cmd.Message))
+	}
+	w.Flush()
+	return nil
+}
+
+// printNodeCommand prints a command and, once the agent has reported it,
+// its result with multi-line values such as console logs indented below
+// their key.
+func printNodeCommand(cmd *v1.NodeCommand) {
+	fmt.Printf("Command: %s\n", cmd.Id)
+	fmt.Printf("Node:    %s\n", cmd.NodeId)
+	fmt.Printf("Type:    %s\n", cmd.Type)
+	fmt.Printf("State:   %s\n", cmd.State)
+	if cmd.Message != "" {
+		fmt.Printf("Message: %s\n", cmd.Message)
+	}
+	if len(cmd.Result) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(cmd.Result))
+	for k := range cmd.Result {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Println("\nResult:")
+	for _, k := range keys {
+		value := strings.TrimRight(cmd.Result[k], "\n")
+		if !strings.Contains(value, "\n") {
+			fmt.Printf("  %s: %s\n", k, valueOrDash(value))
+			continue
+		}
+		fmt.Printf("  %s:\n", k)
+		for _, line := range strings.Split(value, "\n") {
+			fmt.Println("    " + line)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func nodeLabelCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "label <node-id> <key=value|key->...",
+		Short: "Set or remove node labels",
+		Long: `Set labels with key=value and remove them with key-. Labels are kept
+across agent restarts; labels under hypervisor.io/ are discovered by the
+node's agent and cannot be changed.`,
+		Example: `  hypervisor-ctl node label node-1 workload=database tier=gold
+  hypervisor-ctl node label node-1 tier-`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &v1.UpdateNodeRequest{NodeId: args[0], Labels: map[string]string{}}
+			for _, arg := range args[1:] {
+				if key, ok := strings.CutSuffix(arg, "-"); ok && !strings.Contains(arg, "=") {
+					req.RemoveLabels = append(req.RemoveLabels, key)
+					continue
+				}
+				key, value, ok := strings.Cut(arg, "=")
+				if !ok || key == "" {
+					return usageErrorf("invalid label %q: expected key=value or key-", arg)
+				}
+				req.Labels[key] = value
+			}
+			return updateNode(req)
+		},
+	}
+}
+
+func nodeTaintCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "taint <node-id> <key[=value]:Effect|key[:Effect]->...",
+		Short: "Add or remove node taints",
+		Long: `Taints keep instances that do not tolerate them off a node. With the
+NoSchedule effect such instances are never placed on the node; with
+PreferNoSchedule only when no other node fits. Instances already on the node
+are left alone. A trailing - removes the taints with that key, or only the
+one with that key and effect.`,
+		Example: `  hypervisor-ctl node taint node-1 dedicated=database:NoSchedule
+  hypervisor-ctl node taint node-1 dedicated:NoSchedule-
+  hypervisor-ctl node taint node-1 dedicated-`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &v1.UpdateNodeRequest{NodeId: args[0]}
+			for _, arg := range args[1:] {
+				spec, remove := strings.CutSuffix(arg, "-")
+				taint, err := parseTaint(spec, remove)
+				if err != nil {
+					return usageErrorf("invalid taint %q: %w", arg, err)
+				}
+				if remove {
+					req.RemoveTaints = append(req.RemoveTaints, taint)
+				} else {
+					req.Taints = append(req.Taints, taint)
+				}
+			}
+			return updateNode(req)
+		},
+	}
+}
+
+// parseTaint parses key[=value]:Effect. The effect is optional when the
+// taint is to be removed.
+func parseTaint(s string, remove bool) (*v1.Taint, error) {
+	keyValue, effect, hasEffect := strings.Cut(s, ":")
+	if !hasEffect && !remove {
+		return nil, fmt.Errorf("expected key[=value]:Effect")
+	}
+	key, value, _ := strings.Cut(keyValue, "=")
+	if key == "" {
+		return nil, fmt.Errorf("taint key is required")
+	}
+	return &v1.Taint{Key: key, Value: value, Effect: effect}, nil
+}
+
+func updateNode(req *v1.UpdateNodeRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	node, err := v1.NewClusterServiceClient(conn).UpdateNode(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to update node: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(node))
+	}
+	fmt.Printf("Node %s updated\n", node.Id)
+	if labels := node.Metadata.GetLabels(); len(labels) > 0 {
+		fmt.Printf("Labels: %s\n", formatLabels(labels))
+	}
+	if len(node.Taints) > 0 {
+		fmt.Printf("Taints: %s\n", formatTaints(node.Taints))
+	}
+	return nil
+}
+
+// formatTaints renders taints as comma-separated key=value:Effect.
+func formatTaints(taints []*v1.Taint) string {
+	formatted := make([]string, len(taints))
+	for i, t := range taints {
+		formatted[i] = t.Key
+		if t.Value != "" {
+			formatted[i] += "=" + t.Value
+		}
+		formatted[i] += ":" + t.Effect
+	}
+	return strings.Join(formatted, ",")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func pingCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ping <source-port-id> <destination-port-id>",
+		Short: "Check hop by hop whether one port can reach another",
+		Long: `Check whether a probe sent by one port reaches another, and report the hop
+where it fails: the security groups of either port, the flows of the source
+node, the router between their subnets, the tunnel between their nodes, or
+the flows of the destination node.
+
+The probe is traced through the flow tables of the nodes without being sent.
+With --live, the destination is also pinged from its subnet's router
+namespace on its node. The trace of each failed flow hop is printed below
+the hops.`,
+		Example: `  hypervisor-ctl network ping <port-a> <port-b>
+  hypervisor-ctl network ping <port-a> <port-b> --protocol tcp --port 22 --live`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			protocol, _ := cmd.Flags().GetString("protocol")
+			port, _ := cmd.Flags().GetUint32("port")
+			live, _ := cmd.Flags().GetBool("live")
+			return checkConnectivity(&v1.CheckConnectivityRequest{
+				SourcePortId:      args[0],
+				DestinationPortId: args[1],
+				Protocol:          protocol,
+				DestinationPort:   port,
+				Ping:              live,
+			})
+		},
+	}
+	cmd.Flags().String("protocol", "icmp", "probe protocol (icmp, tcp, udp)")
+	cmd.Flags().Uint32("port", 0, "destination port of tcp and udp probes")
+	cmd.Flags().Bool("live", false, "also ping the destination from its subnet's router namespace")
+	return cmd
+}
+
+func checkConnectivity(req *v1.CheckConnectivityRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).CheckConnectivity(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to check connectivity: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOP\tNODE\tSTATUS\tDETAIL")
+	for _, hop := range resp.Hops {
+		node := hop.NodeId
+		if node == "" {
+			node = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", hop.Name, node, hop.Status, hop.Detail)
+	}
+	w.Flush()
+
+	for _, hop := range resp.Hops {
+		if hop.Trace != "" {
+			fmt.Printf("\nTrace of %s on %s:\n  %s\n", hop.Name, hop.NodeId,
+				strings.ReplaceAll(strings.TrimSpace(hop.Trace), "\n", "\n  "))
+		}
+	}
+
+	switch {
+	case resp.Reachable:
+		fmt.Printf("\n%s reaches %s\n", req.SourcePortId, req.DestinationPortId)
+	case resp.FailedHop != "":
+		fmt.Printf("\n%s does not reach %s: %s failed\n", req.SourcePortId, req.DestinationPortId, resp.FailedHop)
+	default:
+		fmt.Printf("\nCould not tell whether %s reaches %s: some hops could not be checked\n", req.SourcePortId, req.DestinationPortId)
+	}
+	return nil
+}
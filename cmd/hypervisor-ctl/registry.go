@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func registryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "registry",
+		Short: "Manage the credentials container images are pulled with",
+		Long: `Registry credentials let agents pull container images from private OCI
+registries. They are stored in the cluster, one per registry host, and
+cached by every agent. Secrets are never shown again once stored.`,
+	}
+
+	// registry login <host>
+	loginCmd := &cobra.Command{
+		Use:   "login <registry>",
+		Short: "Store the credential of a registry",
+		Example: `  echo "$GHCR_TOKEN" | hypervisor-ctl registry login ghcr.io --username octocat --password-stdin
+  hypervisor-ctl registry login registry.example.com:5000 --username ci --password-stdin < token.txt
+  hypervisor-ctl registry login myregistry.azurecr.io --identity-token-stdin < refresh-token.txt`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return registryLogin(cmd, args[0])
+		},
+	}
+	loginCmd.Flags().StringP("username", "u", "", "username")
+	loginCmd.Flags().Bool("password-stdin", false, "read the password or access token from stdin")
+	loginCmd.Flags().Bool("identity-token-stdin", false, "read an OAuth2 identity (refresh) token from stdin instead of a password")
+	cmd.AddCommand(loginCmd)
+
+	// registry list
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List registries with stored credentials",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listRegistryCredentials()
+		},
+	})
+
+	// registry logout <host>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "logout <registry>",
+		Short: "Delete the credential of a registry",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return registryLogout(args[0])
+		},
+	})
+
+	return cmd
+}
+
+func registryLogin(cmd *cobra.Command, registry string) error {
+	flags := cmd.Flags()
+	username, _ := flags.GetString("username")
+	passwordStdin, _ := flags.GetBool("password-stdin")
+	tokenStdin, _ := flags.GetBool("identity-token-stdin")
+
+	req := &v1.SetRegistryCredentialRequest{Registry: registry, Username: username}
+	switch {
+	case passwordStdin && tokenStdin:
+		return usageErrorf("--password-stdin and --identity-token-stdin are mutually exclusive")
+	case passwordStdin:
+		if username == "" {
+			return usageErrorf("--username is required with --password-stdin")
+		}
+		secret, err := readSecret(os.Stdin)
+		if err != nil {
+			return err
+		}
+		req.Password = secret
+	case tokenStdin:
+		secret, err := readSecret(os.Stdin)
+		if err != nil {
+			return err
+		}
+		req.IdentityToken = secret
+	default:
+		return usageErrorf("--password-stdin or --identity-token-stdin is required")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	credential, err := v1.NewClusterServiceClient(conn).SetRegistryCredential(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to store registry credential: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(credential))
+	}
+	fmt.Printf("Credential for %s stored\n", credential.Registry)
+	return nil
+}
+
+// readSecret reads a secret from the first line of r.
+func readSecret(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read secret from stdin: %w", err)
+	}
+	secret := strings.TrimRight(line, "\r\n")
+	if secret == "" {
+		return "", usageErrorf("no secret on stdin")
+	}
+	return secret, nil
+}
+
+func listRegistryCredentials() error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewClusterServiceClient(conn).ListRegistryCredentials(ctx, &v1.ListRegistryCredentialsRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list registry credentials: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Credentials))
+	}
+	if len(resp.Credentials) == 0 {
+		fmt.Println("No registry credentials found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REGISTRY\tUSERNAME\tAUTH\tUPDATED")
+	for _, c := range resp.Credentials {
+		auth := "password"
+		if c.HasIdentityToken {
+			auth = "identity-token"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			c.Registry, valueOrDash(c.Username), auth,
+			c.UpdatedAt.AsTime().Local().Format(time.DateTime))
+	}
+	w.Flush()
+	return nil
+}
+
+func registryLogout(registry string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewClusterServiceClient(conn).DeleteRegistryCredential(ctx, &v1.DeleteRegistryCredentialRequest{
+		Registry: registry,
+	}); err != nil {
+		return fmt.Errorf("failed to delete registry credential: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(map[string]any{"registry": registry, "deleted": true})
+	}
+	fmt.Printf("Credential for %s deleted\n", registry)
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func reservationCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reservation",
+		Short: "Reserve subnet addresses or assign them statically to appliances",
+	}
+
+	// network subnet reservation create <subnet-id> <ip>
+	createCmd := &cobra.Command{
+		Use:   "create <subnet-id> <ip>",
+		Short: "Reserve an address of a subnet",
+		Long: `Reserve an address of a subnet so it is never allocated to a port. With
+--static, the address is instead assigned to something outside the SDN, such
+as a firewall or storage appliance, identified by its MAC address or
+hostname. The address may be inside or outside the subnet's allocation pools,
+but not its network, broadcast or gateway address.`,
+		Example: `  hypervisor-ctl network subnet reservation create <subnet-id> 10.0.0.50 --description "future VIP"
+  hypervisor-ctl network subnet reservation create <subnet-id> 10.0.0.10 --static --mac 52:54:00:12:34:56 --hostname fw1`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			static, _ := cmd.Flags().GetBool("static")
+			mac, _ := cmd.Flags().GetString("mac")
+			hostname, _ := cmd.Flags().GetString("hostname")
+			description, _ := cmd.Flags().GetString("description")
+			if !static && (mac != "" || hostname != "") {
+				return usageErrorf("--mac and --hostname identify the appliance of a --static allocation")
+			}
+			return createReservation(&v1.CreateReservationRequest{
+				SubnetId:    args[0],
+				IpAddress:   args[1],
+				Static:      static,
+				MacAddress:  mac,
+				Hostname:    hostname,
+				Description: description,
+			})
+		},
+	}
+	createCmd.Flags().Bool("static", false, "assign the address to an appliance rather than only hold it back")
+	createCmd.Flags().String("mac", "", "MAC address of the appliance")
+	createCmd.Flags().String("hostname", "", "hostname of the appliance")
+	createCmd.Flags().String("description", "", "what the address is reserved for")
+	cmd.AddCommand(createCmd)
+
+	// network subnet reservation list <subnet-id>
+	listCmd := &cobra.Command{
+		Use:   "list <subnet-id>",
+		Short: "List the reservations and static allocations of a subnet",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listReservations(args[0])
+		},
+	}
+	cmd.AddCommand(listCmd)
+
+	// network subnet reservation delete <subnet-id> <ip>
+	deleteCmd := &cobra.Command{
+		Use:   "delete <subnet-id> <ip>",
+		Short: "Release a reservation or static allocation",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteReservation(args[0], args[1])
+		},
+	}
+	cmd.AddCommand(deleteCmd)
+
+	return cmd
+}
+
+func createReservation(req *v1.CreateReservationRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).CreateReservation(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to create reservation: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Reservation))
+	}
+	fmt.Printf("Address %s of subnet %s is %s\n", resp.Reservation.IpAddress, resp.Reservation.SubnetId, resp.Reservation.Status)
+	return nil
+}
+
+func listReservations(subnetID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).ListReservations(ctx, &v1.ListReservationsRequest{
+		SubnetId: subnetID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list reservations: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Reservations))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IP ADDRESS\tSTATUS\tMAC ADDRESS\tHOSTNAME\tDESCRIPTION")
+	for _, r := range resp.Reservations {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.IpAddress, r.Status, r.MacAddress, r.Hostname, r.Description)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func deleteReservation(subnetID, ipAddress string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewNetworkServiceClient(conn).DeleteReservation(ctx, &v1.DeleteReservationRequest{
+		SubnetId:  subnetID,
+		IpAddress: ipAddress,
+	}); err != nil {
+		return fmt.Errorf("failed to delete reservation: %w", err)
+	}
+
+	fmt.Printf("Reservation of %s in subnet %s released\n", ipAddress, subnetID)
+	return nil
+}
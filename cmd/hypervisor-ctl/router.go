@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func routerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "router",
+		Short: "Manage virtual routers",
+	}
+
+	// router create <name>
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a router",
+		Example: `  hypervisor-ctl router create edge
+  hypervisor-ctl router create edge --external-network <network-id> --snat`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tenant, _ := cmd.Flags().GetString("tenant")
+			distributed, _ := cmd.Flags().GetBool("distributed")
+			externalNetwork, _ := cmd.Flags().GetString("external-network")
+			snat, _ := cmd.Flags().GetBool("snat")
+
+			req := &v1.CreateRouterRequest{
+				Name:        args[0],
+				TenantId:    tenant,
+				Distributed: distributed,
+			}
+			if externalNetwork != "" {
+				req.ExternalGateway = &v1.ExternalGateway{
+					NetworkId:  externalNetwork,
+					EnableSnat: snat,
+				}
+			}
+			return createRouter(req)
+		},
+	}
+	createCmd.Flags().String("tenant", "", "owning tenant")
+	createCmd.Flags().Bool("distributed", true, "run the router on every node (DVR)")
+	createCmd.Flags().String("external-network", "", "external network to use as the gateway")
+	createCmd.Flags().Bool("snat", true, "masquerade outbound traffic to the gateway IP")
+	cmd.AddCommand(createCmd)
+
+	// router list
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List routers",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tenant, _ := cmd.Flags().GetString("tenant")
+			return listRouters(tenant)
+		},
+	}
+	listCmd.Flags().String("tenant", "", "only list routers of this tenant")
+	cmd.AddCommand(listCmd)
+
+	// router get <id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "get <router-id>",
+		Short: "Show a router, its gateway and interfaces",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return getRouter(args[0])
+		},
+	})
+
+	// router delete <id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "delete <router-id>",
+		Short: "Delete a router that has no interfaces",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteRouter(args[0])
+		},
+	})
+
+	// router add-interface <id> <subnet-id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "add-interface <router-id> <subnet-id>",
+		Short: "Attach a subnet to a router at the subnet's gateway IP",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return addRouterInterface(args[0], args[1])
+		},
+	})
+
+	// router remove-interface <id> <subnet-id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove-interface <router-id> <subnet-id>",
+		Short: "Detach a subnet from a router",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return removeRouterInterface(args[0], args[1])
+		},
+	})
+
+	// router set-gateway <id> <network-id>
+	setGatewayCmd := &cobra.Command{
+		Use:   "set-gateway <router-id> <network-id>",
+		Short: "Connect a router to an external network",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snat, _ := cmd.Flags().GetBool("snat")
+			return setExternalGateway(args[0], args[1], snat)
+		},
+	}
+	setGatewayCmd.Flags().Bool("snat", true, "masquerade outbound traffic to the gateway IP")
+	cmd.AddCommand(setGatewayCmd)
+
+	// router clear-gateway <id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "clear-gateway <router-id>",
+		Short: "Disconnect a router from its external network",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return setExternalGateway(args[0], "", false)
+		},
+	})
+
+	return cmd
+}
+
+func createRouter(req *v1.CreateRouterRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).CreateRouter(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to create router: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Router))
+	}
+	fmt.Printf("Router %s created: %s\n", resp.Router.Name, resp.Router.Id)
+	if gw := resp.Router.ExternalGateway; gw != nil && len(gw.ExternalFixedIps) > 0 {
+		fmt.Printf("Gateway IP: %s\n", gw.ExternalFixedIps[0].IpAddress)
+	}
+	return nil
+}
+
+func listRouters(tenant string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).ListRouters(ctx, &v1.ListRoutersRequest{
+		TenantId: tenant,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list routers: %w", err)
+	}
+
+	routers := resp.Routers
+	sort.Slice(routers, func(i, j int) bool { return routers[i].Name < routers[j].Name })
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(routers))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTENANT\tSTATUS\tDISTRIBUTED\tGATEWAY")
+	for _, r := range routers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\n", r.Id, r.Name, r.TenantId, r.Status, r.Distributed, gatewaySummary(r.ExternalGateway))
+	}
+	w.Flush()
+
+	return nil
+}
+
+func getRouter(id string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).GetRouter(ctx, &v1.GetRouterRequest{
+		RouterId: id,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get router: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Router))
+	}
+	printRouter(os.Stdout, resp.Router)
+	return nil
+}
+
+func deleteRouter(id string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewNetworkServiceClient(conn).DeleteRouter(ctx, &v1.DeleteRouterRequest{
+		RouterId: id,
+	}); err != nil {
+		return fmt.Errorf("failed to delete router: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(map[string]any{"id": id, "deleted": true})
+	}
+	fmt.Printf("Router %s deleted\n", id)
+	return nil
+}
+
+func addRouterInterface(routerID, subnetID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).AddRouterInterface(ctx, &v1.AddRouterInterfaceRequest{
+		RouterId: routerID,
+		SubnetId: subnetID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add router interface: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp))
+	}
+	fmt.Printf("Subnet %s attached to router %s at %s (port %s)\n",
+		subnetID, routerID, resp.RouterInterface.GetIpAddress(), resp.PortId)
+	return nil
+}
+
+func removeRouterInterface(routerID, subnetID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewNetworkServiceClient(conn).RemoveRouterInterface(ctx, &v1.RemoveRouterInterfaceRequest{
+		RouterId: routerID,
+		SubnetId: subnetID,
+	}); err != nil {
+		return fmt.Errorf("failed to remove router interface: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(map[string]any{"router_id": routerID, "subnet_id": subnetID, "removed": true})
+	}
+	fmt.Printf("Subnet %s detached from router %s\n", subnetID, routerID)
+	return nil
+}
+
+func setExternalGateway(routerID, networkID string, snat bool) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).SetExternalGateway(ctx, &v1.SetExternalGatewayRequest{
+		RouterId:   routerID,
+		NetworkId:  networkID,
+		EnableSnat: snat,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set external gateway: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Router))
+	}
+	if networkID == "" {
+		fmt.Printf("External gateway of router %s cleared\n", routerID)
+		return nil
+	}
+	fmt.Printf("Router %s gateway: %s\n", routerID, gatewaySummary(resp.Router.ExternalGateway))
+	return nil
+}
+
+func printRouter(out io.Writer, r *v1.Router) {
+	fmt.Fprintf(out, "ID:          %s\n", r.Id)
+	fmt.Fprintf(out, "Name:        %s\n", r.Name)
+	fmt.Fprintf(out, "Tenant:      %s\n", r.TenantId)
+	fmt.Fprintf(out, "Status:      %s\n", r.Status)
+	fmt.Fprintf(out, "Distributed: %t\n", r.Distributed)
+	fmt.Fprintf(out, "Gateway:     %s\n", gatewaySummary(r.ExternalGateway))
+	if r.UpdatedAt != nil {
+		fmt.Fprintf(out, "Updated:     %s\n", r.UpdatedAt.AsTime().Format(time.RFC3339))
+	}
+
+	fmt.Fprintln(out, "\nInterfaces:")
+	if len(r.Interfaces) == 0 {
+		fmt.Fprintln(out, "  <none>")
+	} else {
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  SUBNET\tCIDR\tIP\tMAC\tPORT")
+		for _, iface := range r.Interfaces {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", iface.SubnetId, iface.Cidr, iface.IpAddress, iface.MacAddress, iface.PortId)
+		}
+		w.Flush()
+	}
+
+	if len(r.Routes) > 0 {
+		fmt.Fprintln(out, "\nRoutes:")
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  DESTINATION\tNEXTHOP")
+		for _, route := range r.Routes {
+			fmt.Fprintf(w, "  %s\t%s\n", route.Destination, route.Nexthop)
+		}
+		w.Flush()
+	}
+}
+
+// gatewaySummary describes a router's external gateway in one line.
+func gatewaySummary(gw *v1.ExternalGateway) string {
+	if gw == nil || gw.NetworkId == "" {
+		return "-"
+	}
+
+	s := gw.NetworkId
+	if len(gw.ExternalFixedIps) > 0 {
+		s += " " + gw.ExternalFixedIps[0].IpAddress
+	}
+	if gw.EnableSnat {
+		s += " (SNAT)"
+	}
+	return s
+}
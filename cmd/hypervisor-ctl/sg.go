@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func securityGroupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "sg",
+		Aliases: []string{"security-group"},
+		Short:   "Manage security groups",
+	}
+
+	// sg create <name>
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a security group",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			description, _ := cmd.Flags().GetString("description")
+			tenant, _ := cmd.Flags().GetString("tenant")
+			return createSecurityGroup(args[0], description, tenant)
+		},
+	}
+	createCmd.Flags().String("description", "", "security group description")
+	createCmd.Flags().String("tenant", "", "owning tenant")
+	cmd.AddCommand(createCmd)
+
+	// sg list
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List security groups",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tenant, _ := cmd.Flags().GetString("tenant")
+			return listSecurityGroups(tenant)
+		},
+	}
+	listCmd.Flags().String("tenant", "", "only list groups of this tenant")
+	cmd.AddCommand(listCmd)
+
+	// sg get <id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "get <sg-id>",
+		Short: "Show a security group and its rules",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return getSecurityGroup(args[0])
+		},
+	})
+
+	// sg update <id>
+	updateCmd := &cobra.Command{
+		Use:   "update <sg-id>",
+		Short: "Rename a security group or change its description",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name, _ := cmd.Flags().GetString("name")
+			description, _ := cmd.Flags().GetString("description")
+			return updateSecurityGroup(args[0], name, description)
+		},
+	}
+	updateCmd.Flags().String("name", "", "new name")
+	updateCmd.Flags().String("description", "", "new description")
+	cmd.AddCommand(updateCmd)
+
+	// sg delete <id>
+	cmd.AddCommand(&cobra.Command{
+		Use:   "delete <sg-id>",
+		Short: "Delete a security group that no port uses",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteSecurityGroup(args[0])
+		},
+	})
+
+	cmd.AddCommand(securityRuleCmd())
+
+	return cmd
+}
+
+func securityRuleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rule",
+		Short: "Manage security group rules",
+	}
+
+	// sg rule add <sg-id>
+	addCmd := &cobra.Command{
+		Use:   "add <sg-id>",
+		Short: "Add a rule to a security group",
+		Example: `  hypervisor-ctl sg rule add <sg-id> --direction ingress --protocol tcp --port 443 --remote-ip 0.0.0.0/0
+  hypervisor-ctl sg rule add <sg-id> --protocol tcp --port 5432 --remote-group <other-sg-id>`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			direction, _ := cmd.Flags().GetString("direction")
+			etherType, _ := cmd.Flags().GetString("ether-type")
+			protocol, _ := cmd.Flags().GetString("protocol")
+			ports, _ := cmd.Flags().GetString("port")
+			remoteIP, _ := cmd.Flags().GetString("remote-ip")
+			remoteGroup, _ := cmd.Flags().GetString("remote-group")
+
+			req := &v1.AddSecurityRuleRequest{
+				SecurityGroupId: args[0],
+				Protocol:        protocol,
+				RemoteIpPrefix:  remoteIP,
+				RemoteGroupId:   remoteGroup,
+			}
+
+			var err error
+			if req.Direction, err = parseRuleDirection(direction); err != nil {
+				return err
+			}
+			if req.EtherType, err = parseEtherType(etherType); err != nil {
+				return err
+			}
+			if req.PortRangeMin, req.PortRangeMax, err = parsePortRange(ports); err != nil {
+				return err
+			}
+
+			return addSecurityRule(req)
+		},
+	}
+	addCmd.Flags().String("direction", "ingress", "traffic direction (ingress, egress)")
+	addCmd.Flags().String("ether-type", "IPv4", "ether type (IPv4, IPv6)")
+	addCmd.Flags().String("protocol", "any", "protocol (tcp, udp, icmp, any)")
+	addCmd.Flags().String("port", "", "port or port range, e.g. 22 or 8000-8100")
+	addCmd.Flags().String("remote-ip", "", "remote CIDR the rule applies to")
+	addCmd.Flags().String("remote-group", "", "remote security group the rule applies to")
+	cmd.AddCommand(addCmd)
+
+	// sg rule remove <sg-id> <rule-id>
+	cmd.AddCommand(&cobra.Command{
+		Use:     "remove <sg-id> <rule-id>",
+		Aliases: []string{"rm"},
+		Short:   "Remove a rule from a security group",
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return removeSecurityRule(args[0], args[1])
+		},
+	})
+
+	return cmd
+}
+
+func createSecurityGroup(name, description, tenant string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).CreateSecurityGroup(ctx, &v1.CreateSecurityGroupRequest{
+		Name:        name,
+		Description: description,
+		TenantId:    tenant,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create security group: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.SecurityGroup))
+	}
+	fmt.Printf("Security group %s created: %s\n", resp.SecurityGroup.Name, resp.SecurityGroup.Id)
+	return nil
+}
+
+func listSecurityGroups(tenant string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).ListSecurityGroups(ctx, &v1.ListSecurityGroupsRequest{
+		TenantId: tenant,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list security groups: %w", err)
+	}
+
+	groups := resp.SecurityGroups
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(groups))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTENANT\tRULES\tDESCRIPTION")
+	for _, sg := range groups {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", sg.Id, sg.Name, sg.TenantId, len(sg.Rules), sg.Description)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func getSecurityGroup(id string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).GetSecurityGroup(ctx, &v1.GetSecurityGroupRequest{
+		SecurityGroupId: id,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get security group: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.SecurityGroup))
+	}
+	printSecurityGroup(os.Stdout, resp.SecurityGroup)
+	return nil
+}
+
+func updateSecurityGroup(id, name, description string) error {
+	if name == "" && description == "" {
+		return usageErrorf("specify --name and/or --description")
+	}
+
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).UpdateSecurityGroup(ctx, &v1.UpdateSecurityGroupRequest{
+		SecurityGroupId: id,
+		Name:            name,
+		Description:     description,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update security group: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.SecurityGroup))
+	}
+	fmt.Printf("Security group %s updated\n", resp.SecurityGroup.Id)
+	return nil
+}
+
+func deleteSecurityGroup(id string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewNetworkServiceClient(conn).DeleteSecurityGroup(ctx, &v1.DeleteSecurityGroupRequest{
+		SecurityGroupId: id,
+	}); err != nil {
+		return fmt.Errorf("failed to delete security group: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(map[string]any{"id": id, "deleted": true})
+	}
+	fmt.Printf("Security group %s deleted\n", id)
+	return nil
+}
+
+func addSecurityRule(req *v1.AddSecurityRuleRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).AddSecurityRule(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to add security rule: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.Rule))
+	}
+	fmt.Printf("Rule %s added to security group %s\n", resp.Rule.Id, req.SecurityGroupId)
+	return nil
+}
+
+func removeSecurityRule(sgID, ruleID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewNetworkServiceClient(conn).RemoveSecurityRule(ctx, &v1.RemoveSecurityRuleRequest{
+		SecurityGroupId: sgID,
+		RuleId:          ruleID,
+	}); err != nil {
+		return fmt.Errorf("failed to remove security rule: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(map[string]any{"security_group_id": sgID, "rule_id": ruleID, "removed": true})
+	}
+	fmt.Printf("Rule %s removed from security group %s\n", ruleID, sgID)
+	return nil
+}
+
+func printSecurityGroup(out io.Writer, sg *v1.SecurityGroup) {
+	fmt.Fprintf(out, "ID:          %s\n", sg.Id)
+	fmt.Fprintf(out, "Name:        %s\n", sg.Name)
+	fmt.Fprintf(out, "Description: %s\n", sg.Description)
+	fmt.Fprintf(out, "Tenant:      %s\n", sg.TenantId)
+	if sg.UpdatedAt != nil {
+		fmt.Fprintf(out, "Updated:     %s\n", sg.UpdatedAt.AsTime().Format(time.RFC3339))
+	}
+
+	fmt.Fprintln(out, "\nRules:")
+	if len(sg.Rules) == 0 {
+		fmt.Fprintln(out, "  <none>")
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  ID\tDIRECTION\tETHER TYPE\tPROTOCOL\tPORTS\tREMOTE")
+	for _, rule := range sg.Rules {
+		ports := "any"
+		if rule.PortRangeMin != 0 {
+			ports = strconv.FormatUint(uint64(rule.PortRangeMin), 10)
+			if rule.PortRangeMax != rule.PortRangeMin {
+				ports += fmt.Sprintf("-%d", rule.PortRangeMax)
+			}
+		}
+		remote := "any"
+		switch {
+		case rule.RemoteIpPrefix != "":
+			remote = rule.RemoteIpPrefix
+		case rule.RemoteGroupId != "":
+			remote = "group " + rule.RemoteGroupId
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\n",
+			rule.Id,
+			strings.ToLower(strings.TrimPrefix(rule.Direction.String(), "SECURITY_RULE_DIRECTION_")),
+			strings.TrimPrefix(rule.EtherType.String(), "ETHER_TYPE_"),
+			rule.Protocol, ports, remote)
+	}
+	w.Flush()
+}
+
+func parseRuleDirection(s string) (v1.SecurityRuleDirection, error) {
+	switch strings.ToLower(s) {
+	case "ingress", "in":
+		return v1.SecurityRuleDirection_SECURITY_RULE_DIRECTION_INGRESS, nil
+	case "egress", "out":
+		return v1.SecurityRuleDirection_SECURITY_RULE_DIRECTION_EGRESS, nil
+	default:
+		return 0, usageErrorf("invalid direction %q (use ingress or egress)", s)
+	}
+}
+
+func parseEtherType(s string) (v1.EtherType, error) {
+	switch strings.ToLower(s) {
+	case "ipv4", "4":
+		return v1.EtherType_ETHER_TYPE_IPV4, nil
+	case "ipv6", "6":
+		return v1.EtherType_ETHER_TYPE_IPV6, nil
+	default:
+		return 0, usageErrorf("invalid ether type %q (use IPv4 or IPv6)", s)
+	}
+}
+
+// parsePortRange parses "22" or "8000-8100"; an empty string means any port.
+func parsePortRange(s string) (uint32, uint32, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+
+	minStr, maxStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		maxStr = minStr
+	}
+	min, err := strconv.ParseUint(minStr, 10, 16)
+	if err != nil {
+		return 0, 0, usageErrorf("invalid port %q", minStr)
+	}
+	max, err := strconv.ParseUint(maxStr, 10, 16)
+	if err != nil {
+		return 0, 0, usageErrorf("invalid port %q", maxStr)
+	}
+	if min == 0 || min > max {
+		return 0, 0, usageErrorf("invalid port range %q", s)
+	}
+	return uint32(min), uint32(max), nil
+}
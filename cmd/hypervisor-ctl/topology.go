@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+// dotOutputAnnotation marks the commands that support --output dot.
+const dotOutputAnnotation = "output-dot"
+
+func topologyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "topology",
+		Short: "Show the graph of networks, routers, ports, instances and tunnels",
+		Long: `Show the graph of the overlay: networks with their subnets, the routers
+attached to them, the ports on them with their instances, and the VTEPs the
+ports are bound to with the tunnels between them. Tunnels are down when one
+of their ends has no live VTEP.
+
+With --output dot the graph is printed in Graphviz format.`,
+		Example: `  hypervisor-ctl network topology
+  hypervisor-ctl network topology --network <network-id> -o dot | dot -Tsvg > topology.svg`,
+		Args:        cobra.NoArgs,
+		Annotations: map[string]string{dotOutputAnnotation: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			networkID, _ := cmd.Flags().GetString("network")
+			tenantID, _ := cmd.Flags().GetString("tenant")
+			return showTopology(networkID, tenantID)
+		},
+	}
+	cmd.Flags().String("network", "", "only this network and what connects to it")
+	cmd.Flags().String("tenant", "", "only the networks of this tenant")
+	return cmd
+}
+
+func showTopology(networkID, tenantID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).GetNetworkTopology(ctx, &v1.GetNetworkTopologyRequest{
+		NetworkId: networkID,
+		TenantId:  tenantID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get network topology: %w", err)
+	}
+
+	switch output {
+	case "json", "yaml":
+		return printStructured(protoJSON(resp))
+	case "dot":
+		fmt.Print(topologyDOT(resp))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tID\tNAME\tSTATUS\tDETAILS")
+	for _, node := range resp.Nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", node.Kind, strings.TrimPrefix(node.Id, node.Kind+"/"),
+			node.Name, node.Status, topologyDetail(node))
+	}
+	w.Flush()
+
+	var down []string
+	for _, edge := range resp.Edges {
+		if edge.Kind == "tunnel" && edge.Status != "up" {
+			down = append(down, fmt.Sprintf("%s <-> %s", strings.TrimPrefix(edge.From, "vtep/"), strings.TrimPrefix(edge.To, "vtep/")))
+		}
+	}
+	if len(down) > 0 {
+		fmt.Printf("\nTunnels down:\n  %s\n", strings.Join(down, "\n  "))
+	}
+	return nil
+}
+
+// topologyDetail is the most telling attribute of a vertex.
+func topologyDetail(node *v1.TopologyNode) string {
+	switch node.Kind {
+	case "network":
+		if vni := node.Attributes["vni"]; vni != "" {
+			return node.Attributes["type"] + " vni " + vni
+		}
+		if vlan := node.Attributes["vlan_id"]; vlan != "" {
+			return node.Attributes["type"] + " vlan " + vlan
+		}
+		return node.Attributes["type"]
+	case "subnet":
+		return node.Attributes["cidr"]
+	case "router":
+		return node.Attributes["external_ip"]
+	case "port", "vtep":
+		return node.Attributes["ip"]
+	}
+	return ""
+}
+
+// topologyShapes are the Graphviz shapes of the vertex kinds.
+var topologyShapes = map[string]string{
+	"network":  "box3d",
+	"subnet":   "box",
+	"router":   "diamond",
+	"port":     "ellipse",
+	"instance": "component",
+	"vtep":     "hexagon",
+}
+
+// topologyDOT renders the topology in Graphviz format. Vertices and tunnels
+// that are down are drawn red; tunnels are undirected and dashed.
+func topologyDOT(topology *v1.GetNetworkTopologyResponse) string {
+	var b strings.Builder
+	b.WriteString("digraph topology {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [fontname=\"Helvetica\", fontsize=10];\n")
+	b.WriteString("  edge [fontname=\"Helvetica\", fontsize=8];\n")
+
+	for _, node := range topology.Nodes {
+		name := node.Name
+		if name == "" {
+			name = strings.TrimPrefix(node.Id, node.Kind+"/")
+		}
+		label := node.Kind + "\n" + name
+		if detail := topologyDetail(node); detail != "" {
+			label += "\n" + detail
+		}
+		shape, ok := topologyShapes[node.Kind]
+		if !ok {
+			shape = "ellipse"
+		}
+		fmt.Fprintf(&b, "  %s [label=%s, shape=%s%s];\n", dotQuote(node.Id), dotQuote(label), shape, dotColor(node.Status))
+	}
+
+	for _, edge := range topology.Edges {
+		attrs := "label=" + dotQuote(edge.Kind)
+		if edge.Kind == "tunnel" {
+			attrs += ", dir=none, style=dashed"
+		}
+		attrs += dotColor(edge.Status)
+		fmt.Fprintf(&b, "  %s -> %s [%s];\n", dotQuote(edge.From), dotQuote(edge.To), attrs)
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// dotColor returns the color attribute for a status, if it is a failure.
+func dotColor(status string) string {
+	switch status {
+	case "down", "error", "missing", "inactive":
+		return ", color=red, fontcolor=red"
+	}
+	return ""
+}
+
+// dotQuote quotes a Graphviz ID, keeping newlines as line breaks.
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"hypervisor/pkg/tracing"
+
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+var (
+	traceEnabled  bool
+	traceEndpoint string
+
+	// The command's root span and the function flushing it, set by
+	// startTracing with --trace
+	traceSpan       trace.Span
+	shutdownTracing func(context.Context) error
+)
+
+// defaultTraceEndpoint is the collector the CLI exports to unless
+// --trace-endpoint is given.
+func defaultTraceEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return tracing.DefaultConfig().Endpoint
+}
+
+// startTracing starts the trace of the command with --trace. Every call the
+// command makes continues it, through the server down to the agents.
+func startTracing(cmd *cobra.Command) error {
+	if !traceEnabled {
+		return nil
+	}
+
+	config := tracing.DefaultConfig()
+	config.Enabled = true
+	config.Endpoint = traceEndpoint
+	shutdown, err := tracing.Setup(context.Background(), config, "hypervisor-ctl", Version)
+	if err != nil {
+		return err
+	}
+	shutdownTracing = shutdown
+	_, traceSpan = tracing.StartTrace(context.Background(), cmd.CommandPath())
+	return nil
+}
+
+// finishTracing ends the command's trace, exports it and prints its ID to
+// look it up in the tracing backend.
+func finishTracing(err error) {
+	if traceSpan == nil {
+		return
+	}
+	tracing.End(traceSpan, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		progressf("failed to export trace: %v\n", err)
+	}
+	progressf("Trace ID: %s\n", traceSpan.SpanContext().TraceID())
+}
+
+// traceDialOptions make the calls over a connection part of the command's
+// trace.
+func traceDialOptions() []grpc.DialOption {
+	withSpan := func(ctx context.Context) context.Context {
+		if traceSpan == nil || trace.SpanContextFromContext(ctx).IsValid() {
+			return ctx
+		}
+		return trace.ContextWithSpan(ctx, traceSpan)
+	}
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(withSpan(ctx), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(withSpan(ctx), desc, cc, method, opts...)
+		}),
+		tracing.DialOption(),
+	}
+}
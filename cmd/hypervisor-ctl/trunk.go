@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func trunkCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trunk",
+		Short: "Carry several networks over one port as VLAN-tagged subports",
+	}
+
+	// network trunk create <parent-port-id>
+	createCmd := &cobra.Command{
+		Use:   "create <parent-port-id>",
+		Short: "Make a port the parent of a trunk",
+		Long: `Make a port the parent of a trunk. The instance bound to the parent reaches the
+network of each subport over the parent's vNIC, tagged with the subport's
+VLAN; untagged traffic stays on the parent's network. Subports must be
+unbound, and are bound wherever the parent is.`,
+		Example: `  hypervisor-ctl network trunk create <port-id> --subport <port-id>:100 --subport <port-id>:200`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name, _ := cmd.Flags().GetString("name")
+			specs, _ := cmd.Flags().GetStringArray("subport")
+			subPorts, err := parseSubPorts(specs)
+			if err != nil {
+				return err
+			}
+			return createTrunk(&v1.CreateTrunkRequest{
+				Name:         name,
+				ParentPortId: args[0],
+				SubPorts:     subPorts,
+			})
+		},
+	}
+	createCmd.Flags().String("name", "", "trunk name")
+	createCmd.Flags().StringArray("subport", nil, "subport as <port-id>:<vlan> (repeatable)")
+	cmd.AddCommand(createCmd)
+
+	// network trunk list
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List trunks",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listTrunks()
+		},
+	}
+	cmd.AddCommand(listCmd)
+
+	// network trunk add-subports <trunk-id> <port-id>:<vlan>...
+	addCmd := &cobra.Command{
+		Use:     "add-subports <trunk-id> <port-id>:<vlan>...",
+		Short:   "Add subports to a trunk",
+		Example: `  hypervisor-ctl network trunk add-subports <trunk-id> <port-id>:300`,
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			subPorts, err := parseSubPorts(args[1:])
+			if err != nil {
+				return err
+			}
+			return addSubPorts(args[0], subPorts)
+		},
+	}
+	cmd.AddCommand(addCmd)
+
+	// network trunk remove-subports <trunk-id> <port-id>...
+	removeCmd := &cobra.Command{
+		Use:   "remove-subports <trunk-id> <port-id>...",
+		Short: "Remove subports from a trunk, unbinding them",
+		Args:  cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return removeSubPorts(args[0], args[1:])
+		},
+	}
+	cmd.AddCommand(removeCmd)
+
+	// network trunk delete <trunk-id>
+	deleteCmd := &cobra.Command{
+		Use:   "delete <trunk-id>",
+		Short: "Delete a trunk without subports",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteTrunk(args[0])
+		},
+	}
+	cmd.AddCommand(deleteCmd)
+
+	return cmd
+}
+
+// parseSubPorts parses subports given as <port-id>:<vlan>.
+func parseSubPorts(specs []string) ([]*v1.SubPort, error) {
+	subPorts := make([]*v1.SubPort, 0, len(specs))
+	for _, spec := range specs {
+		portID, tag, ok := strings.Cut(spec, ":")
+		if !ok || portID == "" {
+			return nil, usageErrorf("invalid subport %q: want <port-id>:<vlan>", spec)
+		}
+		vlan, err := strconv.ParseUint(tag, 10, 16)
+		if err != nil || vlan < 1 || vlan > 4094 {
+			return nil, usageErrorf("invalid VLAN tag in subport %q: must be 1-4094", spec)
+		}
+		subPorts = append(subPorts, &v1.SubPort{PortId: portID, VlanTag: uint32(vlan)})
+	}
+	return subPorts, nil
+}
+
+func createTrunk(req *v1.CreateTrunkRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).CreateTrunk(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to create trunk: %w", err)
+	}
+	return printTrunk("created", resp.Trunk)
+}
+
+func listTrunks() error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).ListTrunks(ctx, &v1.ListTrunksRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list trunks: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.Trunks))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TRUNK ID\tNAME\tPARENT PORT\tSUBPORTS")
+	for _, trunk := range resp.Trunks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", trunk.Id, trunk.Name, trunk.ParentPortId, describeSubPorts(trunk.SubPorts))
+	}
+	w.Flush()
+
+	return nil
+}
+
+func addSubPorts(trunkID string, subPorts []*v1.SubPort) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).AddSubPorts(ctx, &v1.AddSubPortsRequest{
+		TrunkId:  trunkID,
+		SubPorts: subPorts,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add subports: %w", err)
+	}
+	return printTrunk("updated", resp.Trunk)
+}
+
+func removeSubPorts(trunkID string, portIDs []string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).RemoveSubPorts(ctx, &v1.RemoveSubPortsRequest{
+		TrunkId: trunkID,
+		PortIds: portIDs,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove subports: %w", err)
+	}
+	return printTrunk("updated", resp.Trunk)
+}
+
+func deleteTrunk(trunkID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewNetworkServiceClient(conn).DeleteTrunk(ctx, &v1.DeleteTrunkRequest{TrunkId: trunkID}); err != nil {
+		return fmt.Errorf("failed to delete trunk: %w", err)
+	}
+	fmt.Printf("Trunk %s deleted\n", trunkID)
+	return nil
+}
+
+func printTrunk(verb string, trunk *v1.Trunk) error {
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(trunk))
+	}
+	fmt.Printf("Trunk %s %s: parent port %s, subports %s\n", trunk.Id, verb, trunk.ParentPortId, describeSubPorts(trunk.SubPorts))
+	return nil
+}
+
+// describeSubPorts summarizes subports as "<port-id>:<vlan>,...".
+func describeSubPorts(subPorts []*v1.SubPort) string {
+	if len(subPorts) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(subPorts))
+	for i, sp := range subPorts {
+		parts[i] = fmt.Sprintf("%s:%d", sp.PortId, sp.VlanTag)
+	}
+	return strings.Join(parts, ",")
+}
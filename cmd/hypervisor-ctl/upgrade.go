@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func upgradeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Plan cluster upgrades",
+	}
+
+	planCmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Show what upgrading to a release takes, without changing anything",
+		Long: `Inspect the versions of the servers, agents, drivers and etcd schema and
+the deprecated APIs clients still call, and report the upgrade steps and
+anything blocking the upgrade. Exits non-zero if the upgrade is blocked.
+
+Examples:
+  hypervisor-ctl cluster upgrade plan --target v0.2`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, _ := cmd.Flags().GetString("target")
+			return upgradePlan(target)
+		},
+	}
+	planCmd.Flags().String("target", "", "release to upgrade to (e.g. v0.2)")
+	planCmd.MarkFlagRequired("target")
+	cmd.AddCommand(planCmd)
+
+	return cmd
+}
+
+func upgradePlan(target string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	plan, err := v1.NewClusterServiceClient(conn).GetUpgradePlan(ctx, &v1.GetUpgradePlanRequest{TargetVersion: target})
+	if err != nil {
+		return fmt.Errorf("failed to plan upgrade: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		if err := printStructured(protoJSON(plan)); err != nil {
+			return err
+		}
+	} else {
+		printUpgradePlan(plan)
+	}
+
+	if !plan.Ready {
+		return withExitCode(exitConflict, fmt.Errorf("upgrade to %s is blocked by %d issue(s)", plan.TargetVersion, len(plan.Blockers)))
+	}
+	return nil
+}
+
+func printUpgradePlan(plan *v1.UpgradePlan) {
+	fmt.Printf("Upgrade plan for %s\n\n", plan.TargetVersion)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tNODE\tVERSION\tACTION\tNOTE")
+	for _, c := range plan.Components {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.Kind, c.Name, valueOrDash(c.NodeId), valueOrDash(c.Version), c.Action, c.Note)
+	}
+	w.Flush()
+
+	fmt.Println("\nSteps:")
+	if len(plan.Steps) == 0 {
+		fmt.Println("  <none, already at the target>")
+	}
+	for i, step := range plan.Steps {
+		fmt.Printf("  %d. %s\n", i+1, step)
+	}
+
+	if len(plan.DeprecatedCalls) > 0 {
+		fmt.Println("\nDeprecated APIs in use:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  METHOD\tCALLS\tLAST CALLER\tLAST SEEN")
+		for _, call := range plan.DeprecatedCalls {
+			fmt.Fprintf(w, "  %s\t%d\t%s\t%s\n",
+				call.Method, call.Count, call.LastCaller, formatOptionalTime(call.LastSeen))
+		}
+		w.Flush()
+	}
+
+	if len(plan.Warnings) > 0 {
+		fmt.Println("\nWarnings:")
+		for _, warning := range plan.Warnings {
+			fmt.Printf("  - %s\n", warning)
+		}
+	}
+
+	if len(plan.Blockers) > 0 {
+		fmt.Println("\nBlockers:")
+		for _, blocker := range plan.Blockers {
+			fmt.Printf("  - %s\n", blocker)
+		}
+	}
+}
+
+// valueOrDash returns s, or "-" if it is empty.
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
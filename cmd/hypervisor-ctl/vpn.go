@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"github.com/spf13/cobra"
+)
+
+func vpnCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "vpn",
+		Short: "Connect the subnets of a router to remote sites over WireGuard",
+	}
+
+	// network vpn create <router-id>
+	createCmd := &cobra.Command{
+		Use:   "create <router-id>",
+		Short: "Create a VPN service on a router",
+		Long: `Create a VPN service on a distributed router with an external gateway. One
+node serves a WireGuard tunnel from the router's namespace, listening on the
+gateway's address; traffic to the peers' CIDRs is routed into it there.
+
+A key pair is generated for the service. Configure its public key and
+endpoint on each peer; the private key never leaves the cluster. With
+--peer-key, the service is created with a first peer.`,
+		Example: `  hypervisor-ctl network vpn create <router-id> --name office
+  hypervisor-ctl network vpn create <router-id> --peer-key <base64> --peer-endpoint vpn.example.com:51820 --allowed-cidr 192.168.0.0/24`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &v1.CreateVPNServiceRequest{RouterId: args[0]}
+			req.Name, _ = cmd.Flags().GetString("name")
+			req.TenantId, _ = cmd.Flags().GetString("tenant")
+			req.ListenPort, _ = cmd.Flags().GetUint32("port")
+			req.NodeId, _ = cmd.Flags().GetString("node")
+
+			peer, err := peerFromFlags(cmd, "peer-key", "peer-")
+			if err != nil {
+				return err
+			}
+			if peer != nil {
+				req.Peers = []*v1.VPNPeer{peer}
+			}
+			return createVPNService(req)
+		},
+	}
+	createCmd.Flags().String("name", "", "VPN service name")
+	createCmd.Flags().String("tenant", "", "tenant ID (default: the tenant of the router)")
+	createCmd.Flags().Uint32("port", 0, "UDP port WireGuard listens on (default 51820)")
+	createCmd.Flags().String("node", "", "node serving the tunnel (default: the least loaded)")
+	createCmd.Flags().String("peer-key", "", "public key of a first peer, in base64")
+	addPeerFlags(createCmd, "peer-")
+	cmd.AddCommand(createCmd)
+
+	// network vpn list
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List VPN services",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tenantID, _ := cmd.Flags().GetString("tenant")
+			return listVPNServices(tenantID)
+		},
+	}
+	listCmd.Flags().String("tenant", "", "only VPN services of this tenant")
+	cmd.AddCommand(listCmd)
+
+	// network vpn show <vpn-id>
+	showCmd := &cobra.Command{
+		Use:   "show <vpn-id>",
+		Short: "Show a VPN service with its peers and their tunnels",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return showVPNService(args[0])
+		},
+	}
+	cmd.AddCommand(showCmd)
+
+	// network vpn delete <vpn-id>
+	deleteCmd := &cobra.Command{
+		Use:   "delete <vpn-id>",
+		Short: "Delete a VPN service and close its tunnels",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteVPNService(args[0])
+		},
+	}
+	cmd.AddCommand(deleteCmd)
+
+	// network vpn add-peer <vpn-id>
+	addPeerCmd := &cobra.Command{
+		Use:     "add-peer <vpn-id>",
+		Short:   "Connect a remote site to a VPN service",
+		Example: `  hypervisor-ctl network vpn add-peer <vpn-id> --public-key <base64> --endpoint 203.0.113.5:51820 --allowed-cidr 192.168.1.0/24`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			peer, err := peerFromFlags(cmd, "public-key", "")
+			if err != nil {
+				return err
+			}
+			return updateVPNService("add peer", func(ctx context.Context, client v1.NetworkServiceClient) (*v1.VPNService, error) {
+				resp, err := client.AddVPNPeer(ctx, &v1.AddVPNPeerRequest{VpnServiceId: args[0], Peer: peer})
+				return resp.GetVpnService(), err
+			})
+		},
+	}
+	addPeerCmd.Flags().String("public-key", "", "public key of the peer, in base64")
+	addPeerCmd.MarkFlagRequired("public-key")
+	addPeerFlags(addPeerCmd, "")
+	addPeerCmd.MarkFlagRequired("allowed-cidr")
+	cmd.AddCommand(addPeerCmd)
+
+	// network vpn remove-peer <vpn-id> <peer-id>
+	removePeerCmd := &cobra.Command{
+		Use:   "remove-peer <vpn-id> <peer-id>",
+		Short: "Disconnect a remote site from a VPN service",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateVPNService("remove peer", func(ctx context.Context, client v1.NetworkServiceClient) (*v1.VPNService, error) {
+				resp, err := client.RemoveVPNPeer(ctx, &v1.RemoveVPNPeerRequest{VpnServiceId: args[0], PeerId: args[1]})
+				return resp.GetVpnService(), err
+			})
+		},
+	}
+	cmd.AddCommand(removePeerCmd)
+
+	// network vpn rotate-key <vpn-id>
+	rotateCmd := &cobra.Command{
+		Use:   "rotate-key <vpn-id>",
+		Short: "Give a VPN service a new key pair",
+		Long: `Give a VPN service a new key pair. Its tunnels stay down until the peers are
+configured with the new public key.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateVPNService("rotate key", func(ctx context.Context, client v1.NetworkServiceClient) (*v1.VPNService, error) {
+				resp, err := client.RotateVPNKey(ctx, &v1.RotateVPNKeyRequest{VpnServiceId: args[0]})
+				return resp.GetVpnService(), err
+			})
+		},
+	}
+	cmd.AddCommand(rotateCmd)
+
+	return cmd
+}
+
+// addPeerFlags adds the flags describing a peer, other than its key, with
+// names starting with prefix.
+func addPeerFlags(cmd *cobra.Command, prefix string) {
+	cmd.Flags().String(prefix+"name", "", "peer name")
+	cmd.Flags().String(prefix+"endpoint", "", "host:port of the peer (default: wait for the peer to connect)")
+	cmd.Flags().StringArray("allowed-cidr", nil, "remote subnet reached through the peer (repeatable)")
+	cmd.Flags().Uint32(prefix+"keepalive", 0, "seconds between keepalives, for peers behind NAT (0 disables)")
+}
+
+// peerFromFlags builds a peer from the flags added by addPeerFlags with
+// prefix, or returns nil if keyFlag is not set.
+func peerFromFlags(cmd *cobra.Command, keyFlag, prefix string) (*v1.VPNPeer, error) {
+	flags := cmd.Flags()
+	key, _ := flags.GetString(keyFlag)
+	cidrs, _ := flags.GetStringArray("allowed-cidr")
+	if key == "" {
+		if len(cidrs) > 0 {
+			return nil, usageErrorf("--allowed-cidr needs --%s", keyFlag)
+		}
+		return nil, nil
+	}
+	if len(cidrs) == 0 {
+		return nil, usageErrorf("specify the remote subnets of the peer with --allowed-cidr")
+	}
+
+	peer := &v1.VPNPeer{PublicKey: key, AllowedCidrs: cidrs}
+	peer.Name, _ = flags.GetString(prefix + "name")
+	peer.Endpoint, _ = flags.GetString(prefix + "endpoint")
+	peer.PersistentKeepalive, _ = flags.GetUint32(prefix + "keepalive")
+	return peer, nil
+}
+
+func createVPNService(req *v1.CreateVPNServiceRequest) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).CreateVPNService(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to create VPN service: %w", err)
+	}
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(resp.VpnService))
+	}
+	vpn := resp.VpnService
+	fmt.Printf("VPN service %s created on node %s\n", vpn.Id, vpn.NodeId)
+	fmt.Printf("Configure the peers with endpoint %s and public key %s\n", vpn.Endpoint, vpn.PublicKey)
+	return nil
+}
+
+func listVPNServices(tenantID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).ListVPNServices(ctx, &v1.ListVPNServicesRequest{TenantId: tenantID})
+	if err != nil {
+		return fmt.Errorf("failed to list VPN services: %w", err)
+	}
+
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSONList(resp.VpnServices))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VPN ID\tNAME\tROUTER\tENDPOINT\tPEERS\tNODE\tSTATUS")
+	for _, vpn := range resp.VpnServices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", vpn.Id, vpn.Name, vpn.RouterId, vpn.Endpoint, len(vpn.Peers), vpn.NodeId, vpn.Status)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func showVPNService(vpnID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := v1.NewNetworkServiceClient(conn).GetVPNService(ctx, &v1.GetVPNServiceRequest{VpnServiceId: vpnID})
+	if err != nil {
+		return fmt.Errorf("failed to get VPN service: %w", err)
+	}
+	return printVPNService(resp.VpnService)
+}
+
+func deleteVPNService(vpnID string) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := v1.NewNetworkServiceClient(conn).DeleteVPNService(ctx, &v1.DeleteVPNServiceRequest{VpnServiceId: vpnID}); err != nil {
+		return fmt.Errorf("failed to delete VPN service: %w", err)
+	}
+	fmt.Printf("VPN service %s deleted\n", vpnID)
+	return nil
+}
+
+// updateVPNService runs a change to a VPN service and prints the result.
+func updateVPNService(what string, update func(context.Context, v1.NetworkServiceClient) (*v1.VPNService, error)) error {
+	conn, err := getClient()
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	vpn, err := update(ctx, v1.NewNetworkServiceClient(conn))
+	if err != nil {
+		return fmt.Errorf("failed to %s: %w", what, err)
+	}
+	return printVPNService(vpn)
+}
+
+func printVPNService(vpn *v1.VPNService) error {
+	if output == "json" || output == "yaml" {
+		return printStructured(protoJSON(vpn))
+	}
+
+	fmt.Printf("VPN service %s", vpn.Id)
+	if vpn.Name != "" {
+		fmt.Printf(" (%s)", vpn.Name)
+	}
+	fmt.Printf(" on router %s, served by node %s, %s\n", vpn.RouterId, vpn.NodeId, vpn.Status)
+	fmt.Printf("Endpoint:   %s\n", vpn.Endpoint)
+	fmt.Printf("Public key: %s\n", vpn.PublicKey)
+	if len(vpn.Peers) == 0 {
+		fmt.Println("No peers")
+		return nil
+	}
+
+	statuses := make(map[string]*v1.VPNPeerStatus, len(vpn.PeerStatuses))
+	for _, s := range vpn.PeerStatuses {
+		statuses[s.PeerId] = s
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER ID\tNAME\tENDPOINT\tALLOWED CIDRS\tTUNNEL\tLAST HANDSHAKE\tRX\tTX")
+	for _, p := range vpn.Peers {
+		endpoint := p.Endpoint
+		tunnel, handshake, rx, tx := "-", "-", "-", "-"
+		if s, ok := statuses[p.Id]; ok {
+			tunnel = "down"
+			if s.Connected {
+				tunnel = "up"
+			}
+			if s.Endpoint != "" {
+				endpoint = s.Endpoint
+			}
+			if s.LatestHandshake != nil {
+				handshake = time.Since(s.LatestHandshake.AsTime()).Truncate(time.Second).String() + " ago"
+			}
+			rx, tx = formatBytes(float64(s.RxBytes)), formatBytes(float64(s.TxBytes))
+		}
+		if endpoint == "" {
+			endpoint = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			p.Id, p.Name, endpoint, strings.Join(p.AllowedCidrs, ","), tunnel, handshake, rx, tx)
+	}
+	w.Flush()
+
+	return nil
+}
@@ -70,6 +70,8 @@ func runServer(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	config.Version = Version
+
 	logger.Info("starting hypervisor server",
 		zap.String("version", Version),
 		zap.String("grpc_addr", config.GRPCAddr),
@@ -3,19 +3,37 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/commands"
 	"hypervisor/pkg/cluster/etcd"
 	"hypervisor/pkg/cluster/heartbeat"
+	"hypervisor/pkg/cluster/latency"
 	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/cluster/registryauth"
+	"hypervisor/pkg/compute/containerd"
 	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/compute/firecracker"
 	"hypervisor/pkg/compute/libvirt"
-
+	"hypervisor/pkg/compute/qemu"
+	"hypervisor/pkg/health"
+	"hypervisor/pkg/metrics"
+	"hypervisor/pkg/network"
+	"hypervisor/pkg/network/cgo"
+	"hypervisor/pkg/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -36,6 +54,9 @@ type Config struct {
 	// Port is the port for the agent gRPC server.
 	Port int `mapstructure:"port"`
 
+	// MetricsAddr is the address for the Prometheus /metrics endpoint (empty disables it).
+	MetricsAddr string `mapstructure:"metrics_addr"`
+
 	// Role is the role of this node.
 	Role string `mapstructure:"role"`
 
@@ -51,17 +72,86 @@ type Config struct {
 	// Labels are custom labels for this node.
 	Labels map[string]string `mapstructure:"labels"`
 
+	// DiscoverLabels adds well-known hypervisor.io/ labels describing the
+	// host (CPU, NICs, storage, KVM, DPDK), refreshed with resource reports.
+	DiscoverLabels bool `mapstructure:"discover_labels"`
+
 	// Etcd configuration
 	Etcd etcd.Config `mapstructure:"etcd"`
 
 	// Heartbeat configuration
 	Heartbeat heartbeat.Config `mapstructure:"heartbeat"`
 
+	// VMDriver selects the driver of vm instances: "libvirt", or "qemu" to
+	// run qemu-system directly over QMP without libvirt
+	VMDriver string `mapstructure:"vm_driver"`
+
 	// Libvirt configuration
 	Libvirt libvirt.Config `mapstructure:"libvirt"`
 
-	// SupportedInstanceTypes lists the instance types this node supports.
+	// Qemu configuration, used when VMDriver is "qemu"
+	Qemu qemu.Config `mapstructure:"qemu"`
+
+	// Containerd configuration
+	Containerd containerd.Config `mapstructure:"containerd"`
+
+	// RegistryAuth configures the cache of the cluster's registry
+	// credentials containers are pulled with.
+	RegistryAuth RegistryAuthConfig `mapstructure:"registry_auth"`
+
+	// Firecracker configuration
+	Firecracker firecracker.Config `mapstructure:"firecracker"`
+
+	// Datapath configuration for the node's OVS datapath
+	Datapath network.DatapathConfig `mapstructure:"datapath"`
+
+	// Stats configuration for per-instance stats collection
+	Stats StatsConfig `mapstructure:"stats"`
+
+	// Network configures the node's OVS bridge and VTEP bootstrap.
+	Network NetworkConfig `mapstructure:"network"`
+
+	// Reconcile configures the loop that refreshes instance state from the drivers.
+	Reconcile LoopConfig `mapstructure:"reconcile"`
+
+	// ResourceReport configures the loop that reports node usage to etcd.
+	ResourceReport LoopConfig `mapstructure:"resource_report"`
+
+	// Inventory configures the host capacity and platform reported with the
+	// node.
+	Inventory InventoryConfig `mapstructure:"inventory"`
+
+	// SupportedInstanceTypes lists the instance types this node supports:
+	// vm (libvirt), container (containerd) and microvm (firecracker). Only
+	// the types whose driver initializes are advertised.
 	SupportedInstanceTypes []string `mapstructure:"supported_instance_types"`
+
+	// MaxConcurrentCreates limits the instance creates (and so image pulls)
+	// running at once; further creates queue. Zero disables the limit.
+	MaxConcurrentCreates int `mapstructure:"max_concurrent_creates"`
+
+	// Capacity configures overcommit and the resources reserved for the
+	// host, which together set the node's allocatable resources.
+	Capacity CapacityConfig `mapstructure:"capacity"`
+
+	// Metadata configures the instance metadata service.
+	Metadata MetadataConfig `mapstructure:"metadata"`
+
+	// Latency configures the probes measuring network latency to other nodes.
+	Latency latency.Config `mapstructure:"latency"`
+
+	// Shutdown configures what happens to instances when the agent stops.
+	Shutdown ShutdownConfig `mapstructure:"shutdown"`
+
+	// Health configures the checks served by the gRPC health service and
+	// the /healthz and /readyz endpoints.
+	Health health.Config `mapstructure:"health"`
+
+	// Tracing configures the export of request traces.
+	Tracing tracing.Config `mapstructure:"tracing"`
+
+	// Version is the agent release, set by the binary rather than configured.
+	Version string `mapstructure:"-"`
 }
 
 // DefaultConfig returns the default agent configuration.
@@ -71,15 +161,35 @@ func DefaultConfig() Config {
 	return Config{
 		Hostname:               hostname,
 		Port:                   50052,
+		MetricsAddr:            ":9091",
 		Role:                   "worker",
 		Region:                 "default",
 		Zone:                   "default",
 		ServerAddr:             "localhost:50051",
 		Labels:                 make(map[string]string),
+		DiscoverLabels:         true,
 		Etcd:                   etcd.DefaultConfig(),
 		Heartbeat:              heartbeat.DefaultConfig(),
+		VMDriver:               "libvirt",
 		Libvirt:                libvirt.DefaultConfig(),
+		Qemu:                   qemu.DefaultConfig(),
+		Containerd:             containerd.DefaultConfig(),
+		RegistryAuth:           DefaultRegistryAuthConfig(),
+		Firecracker:            firecracker.DefaultConfig(),
+		Datapath:               network.DefaultDatapathConfig(),
+		Stats:                  DefaultStatsConfig(),
+		Network:                DefaultNetworkConfig(),
+		Reconcile:              DefaultReconcileLoopConfig(),
+		ResourceReport:         DefaultResourceReportLoopConfig(),
+		Inventory:              DefaultInventoryConfig(),
 		SupportedInstanceTypes: []string{"vm", "container", "microvm"},
+		MaxConcurrentCreates:   4,
+		Capacity:               DefaultCapacityConfig(),
+		Metadata:               DefaultMetadataConfig(),
+		Latency:                latency.DefaultConfig(),
+		Shutdown:               DefaultShutdownConfig(),
+		Health:                 health.DefaultConfig(),
+		Tracing:                tracing.DefaultConfig(),
 	}
 }
 
@@ -100,14 +210,58 @@ type Agent struct {
 	// Compute drivers
 	drivers map[driver.InstanceType]driver.Driver
 
+	// Credentials for pulls from private registries
+	registryCredentials *registryCredentials
+
 	// gRPC servers and connections
-	grpcServer *grpc.Server     // Agent gRPC server (for server to call)
-	serverConn *grpc.ClientConn // Connection to hypervisor-server
+	grpcServer      *grpc.Server         // Agent gRPC server (for server to call)
+	metricsServer   *metrics.Server      // Prometheus metrics endpoint
+	metricsRegistry *prometheus.Registry // Metrics of this agent, served next to metrics.Registry
+	serverConn      *grpc.ClientConn     // Connection to hypervisor-server
 
 	// Instance tracking
 	instances   map[string]*driver.Instance
 	instancesMu sync.RWMutex
 
+	// Per-instance operation queue
+	workQueue *workQueue
+
+	// Node-wide limit on concurrent instance creates
+	creates *createLimiter
+
+	// GPUs available for passthrough
+	gpus *gpuPool
+
+	// SR-IOV virtual functions available for port bindings
+	vfs *vfPool
+
+	// Host cores available to dedicate to instances
+	cpus *cpuPool
+
+	// Per-instance stats history
+	stats *statsCollector
+
+	// Overlay network bootstrap (nil until started or when disabled)
+	sdn *sdnState
+
+	// Instance metadata service (nil when disabled or not started)
+	metadata *metadataService
+
+	// Latency probe responder (nil when disabled or not started)
+	latencyResponder *latency.Responder
+
+	// Runs the commands the server queues for this node
+	commands *commandRunner
+
+	// Checks of etcd, the drivers and the SDN
+	health *health.Checker
+
+	// Flushes and stops the trace exporter
+	shutdownTracing func(context.Context) error
+
+	// Set by cordon and drain commands: new instances are refused
+	cordoned atomic.Bool
+
 	mu      sync.RWMutex
 	running bool
 	stopCh  chan struct{}
@@ -119,6 +273,21 @@ func New(config Config, logger *zap.Logger) (*Agent, error) {
 		logger = zap.NewNop()
 	}
 
+	// Reject datapath modes that cannot serve the features in use before
+	// touching any cluster state.
+	if err := config.Datapath.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid datapath configuration: %w", err)
+	}
+	if err := config.Shutdown.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid shutdown configuration: %w", err)
+	}
+
+	// Export traces before anything traced runs
+	shutdownTracing, err := tracing.Setup(context.Background(), config.Tracing, "hypervisor-agent", config.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
 	// Connect to etcd
 	etcdClient, err := etcd.New(config.Etcd, logger.Named("etcd"))
 	if err != nil {
@@ -128,21 +297,8 @@ func New(config Config, logger *zap.Logger) (*Agent, error) {
 	// Create registry
 	reg := registry.NewEtcdRegistry(etcdClient, logger.Named("registry"))
 
-	// Initialize compute drivers
-	drivers := make(map[driver.InstanceType]driver.Driver)
-
-	// Initialize libvirt driver if supported
-	for _, t := range config.SupportedInstanceTypes {
-		if t == "vm" {
-			lvDriver, err := libvirt.New(config.Libvirt, logger.Named("libvirt"))
-			if err != nil {
-				logger.Warn("failed to initialize libvirt driver", zap.Error(err))
-			} else {
-				drivers[driver.InstanceTypeVM] = lvDriver
-			}
-		}
-		// TODO: Initialize containerd and firecracker drivers
-	}
+	// Initialize the compute driver of each supported instance type
+	drivers := newDrivers(config, logger)
 
 	a := &Agent{
 		config:       config,
@@ -151,8 +307,53 @@ func New(config Config, logger *zap.Logger) (*Agent, error) {
 		nodeRegistry: reg,
 		drivers:      drivers,
 		instances:    make(map[string]*driver.Instance),
+		workQueue:    newWorkQueue(logger.Named("workqueue")),
+		creates:      newCreateLimiter(config.MaxConcurrentCreates, logger.Named("creates")),
 		stopCh:       make(chan struct{}),
+
+		shutdownTracing: shutdownTracing,
+	}
+
+	// Pick up the node ID and instances saved at the last shutdown
+	a.restoreState()
+
+	// Pull private images with the cluster's registry credentials
+	a.registryCredentials = newRegistryCredentials(config.RegistryAuth, registryauth.NewStore(etcdClient), logger.Named("registry-auth"))
+	a.useRegistryCredentials()
+
+	// Discover GPUs for passthrough
+	hostGPUs, err := driver.DetectGPUs("/sys")
+	if err != nil {
+		logger.Warn("failed to detect GPUs", zap.Error(err))
+	}
+	a.gpus = newGPUPool(hostGPUs)
+
+	// Discover SR-IOV virtual functions for port bindings
+	hostVFs, err := driver.DetectVFs("/sys", config.Network.SRIOVPhysicalFunctions)
+	if err != nil {
+		logger.Warn("failed to detect SR-IOV virtual functions", zap.Error(err))
 	}
+	a.vfs = newVFPool(hostVFs)
+
+	// Discover the NUMA topology for dedicated cores
+	numaNodes, err := driver.DetectNUMA("/sys")
+	if err != nil {
+		logger.Warn("failed to detect NUMA topology", zap.Error(err))
+	}
+	a.cpus = newCPUPool(reserveCPUs(numaNodes, config.Capacity.ReservedCPUCores))
+
+	a.stats = newStatsCollector(config.Stats, a, logger.Named("stats"))
+	a.health = a.newHealthChecker()
+
+	a.metricsRegistry = prometheus.NewRegistry()
+	metrics.RegisterWorkQueueDepth(a.metricsRegistry, func() float64 {
+		stats := a.workQueue.Stats()
+		return float64(stats.Pending + stats.Running)
+	})
+	metrics.RegisterCreateLoad(a.metricsRegistry,
+		func() float64 { return float64(a.creates.Load().InFlight) },
+		func() float64 { return float64(a.creates.Load().Queued) },
+	)
 
 	return a, nil
 }
@@ -167,18 +368,18 @@ func (a *Agent) Start(ctx context.Context) error {
 	a.running = true
 	a.mu.Unlock()
 
-	// Get host resources
-	resources, err := a.getHostResources()
+	// Apply OVS datapath configuration
+	a.configureDatapath()
+
+	// Collect host capacity and inventory
+	resources, inventory, err := a.collectInventory(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get host resources: %w", err)
+		return fmt.Errorf("failed to collect host inventory: %w", err)
 	}
 
-	// Build node information
-	supportedTypes := make([]registry.InstanceType, 0, len(a.config.SupportedInstanceTypes))
-	for _, t := range a.config.SupportedInstanceTypes {
-		supportedTypes = append(supportedTypes, registry.InstanceType(t))
-	}
+	resources.GPUCount = a.gpus.assignable()
 
+	numa := a.cpus.status(a.pinnedCPUsInUse())
 	node := &registry.Node{
 		ID:                     a.config.NodeID,
 		Hostname:               a.config.Hostname,
@@ -189,9 +390,19 @@ func (a *Agent) Start(ctx context.Context) error {
 		Region:                 a.config.Region,
 		Zone:                   a.config.Zone,
 		Capacity:               resources,
-		Allocatable:            resources,
-		Labels:                 a.config.Labels,
-		SupportedInstanceTypes: supportedTypes,
+		Allocatable:            a.config.Capacity.allocatable(resources, dedicatedCPUs(numa)),
+		Labels:                 a.nodeLabels(nil),
+		SupportedInstanceTypes: a.supportedInstanceTypes(),
+		Capabilities:           a.driverCapabilities(),
+		CPU:                    detectHostCPU(),
+		Host:                   inventory,
+		GPUs:                   a.gpus.status(a.gpusInUse()),
+		VFs:                    a.vfs.status(a.vfsInUse()),
+		NUMA:                   numa,
+		Creates:                a.creates.Load(),
+		Images:                 a.cachedImages(ctx),
+		AgentVersion:           a.config.Version,
+		DriverVersions:         a.driverVersions(ctx),
 		Conditions: []registry.NodeCondition{
 			{
 				Type:               registry.ConditionReady,
@@ -203,6 +414,17 @@ func (a *Agent) Start(ctx context.Context) error {
 		},
 	}
 
+	// Ports must not be bound here until the overlay network is up
+	if a.config.Network.Enabled {
+		node.Conditions = append(node.Conditions, registry.NodeCondition{
+			Type:               registry.ConditionNetworkUnavailable,
+			Status:             registry.ConditionTrue,
+			Reason:             "Bootstrapping",
+			Message:            "OVS bridges and VTEP are not set up yet",
+			LastTransitionTime: time.Now(),
+		})
+	}
+
 	// Register node
 	nodeID, err := a.nodeRegistry.Register(ctx, node)
 	if err != nil {
@@ -212,6 +434,11 @@ func (a *Agent) Start(ctx context.Context) error {
 	a.nodeID = nodeID
 	a.node = node
 
+	// Back from a planned shutdown: the server manages the node again
+	if err := a.nodeRegistry.ClearShutdown(ctx, nodeID); err != nil {
+		a.logger.Warn("failed to clear planned shutdown", zap.Error(err))
+	}
+
 	a.logger.Info("node registered",
 		zap.String("node_id", nodeID),
 		zap.String("hostname", a.config.Hostname),
@@ -227,6 +454,10 @@ func (a *Agent) Start(ctx context.Context) error {
 		a.logger.Named("heartbeat"),
 	)
 
+	// Run the commands queued for this node as heartbeats go out
+	a.commands = newCommandRunner(a, commands.NewQueue(a.etcdClient, a.logger.Named("commands")), a.logger.Named("commands"))
+	a.heartbeatService.OnHeartbeat(a.commands.trigger)
+
 	if err := a.heartbeatService.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start heartbeat service: %w", err)
 	}
@@ -236,11 +467,22 @@ func (a *Agent) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to start gRPC server: %w", err)
 	}
 
+	// Start metrics endpoint
+	if a.config.MetricsAddr != "" {
+		a.metricsServer = metrics.NewServer(a.config.MetricsAddr, a.logger.Named("metrics"), a.metricsRegistry)
+		a.metricsServer.Handle("/healthz", a.health.LivenessHandler())
+		a.metricsServer.Handle("/readyz", a.health.ReadinessHandler())
+		if err := a.metricsServer.Start(); err != nil {
+			return fmt.Errorf("failed to start metrics server: %w", err)
+		}
+	}
+
 	// Connect to server
 	if a.config.ServerAddr != "" {
 		conn, err := grpc.Dial(
 			a.config.ServerAddr,
 			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			tracing.DialOption(),
 		)
 		if err != nil {
 			a.logger.Warn("failed to connect to server", zap.Error(err))
@@ -249,9 +491,31 @@ func (a *Agent) Start(ctx context.Context) error {
 		}
 	}
 
+	// Bring up the overlay network, retrying in the background
+	a.startNetwork(ctx)
+
+	// Serve instance metadata; instances boot without it if it cannot listen
+	if a.config.Metadata.Enabled {
+		metadata := newMetadataService(a, a.logger.Named("metadata"))
+		if err := metadata.start(ctx); err != nil {
+			a.logger.Warn("failed to start metadata service", zap.Error(err))
+		} else {
+			a.metadata = metadata
+		}
+	}
+
 	// Start background tasks
-	go a.runReconcileLoop(ctx)
-	go a.runResourceCollector(ctx)
+	go a.runLoop(ctx, "reconcile", a.config.Reconcile.withDefaults(DefaultReconcileLoopConfig()), a.reconcileInstances)
+	go a.runLoop(ctx, "resource-report", a.config.ResourceReport.withDefaults(DefaultResourceReportLoopConfig()), a.collectAndReportResources)
+	go a.runLoop(ctx, "inventory", a.config.Inventory.Refresh.withDefaults(DefaultInventoryConfig().Refresh), a.refreshInventory)
+	go a.stats.run(ctx, a.stopCh)
+	go a.registryCredentials.run(ctx)
+
+	// Measure latency to the other nodes
+	a.startLatencyProbes(ctx)
+
+	// Report health once everything it checks is started
+	go a.health.Run(ctx)
 
 	a.logger.Info("agent started")
 	return nil
@@ -267,6 +531,18 @@ func (a *Agent) Stop() error {
 	}
 
 	a.running = false
+
+	// Have load balancers and the server stop sending requests
+	a.health.Shutdown()
+
+	// Apply the shutdown policy while the node is still registered and
+	// the agent still serves the control plane
+	policy, running := a.shutdownInstances()
+	a.logger.Info("instances handled for shutdown",
+		zap.String("policy", policy),
+		zap.Int("left_running", len(running)),
+	)
+
 	close(a.stopCh)
 
 	// Stop heartbeat service
@@ -279,6 +555,38 @@ func (a *Agent) Stop() error {
 		a.grpcServer.GracefulStop()
 	}
 
+	// Wait for queued instance operations to finish
+	a.workQueue.Wait()
+
+	// Stop metrics endpoint
+	if a.metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := a.metricsServer.Stop(ctx); err != nil {
+			a.logger.Warn("failed to stop metrics server", zap.Error(err))
+		}
+	}
+
+	// Stop metadata service
+	if a.metadata != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := a.metadata.stop(ctx); err != nil {
+			a.logger.Warn("failed to stop metadata service", zap.Error(err))
+		}
+	}
+
+	// Stop latency probes
+	a.stopLatencyProbes()
+
+	// Withdraw the local VTEP
+	a.stopNetwork()
+
+	// Save state and announce the shutdown before the node disappears, so
+	// the server does not mistake it for a failure
+	a.saveState(policy)
+	a.announceShutdown(policy, running)
+
 	// Deregister node
 	if a.nodeID != "" {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -301,61 +609,107 @@ func (a *Agent) Stop() error {
 	// Close etcd client
 	a.etcdClient.Close()
 
+	// Export the last spans
+	tracingCtx, tracingCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer tracingCancel()
+	if err := a.shutdownTracing(tracingCtx); err != nil {
+		a.logger.Warn("failed to flush traces", zap.Error(err))
+	}
+
 	a.logger.Info("agent stopped")
 	return nil
 }
 
-// getHostResources collects host resource information.
-func (a *Agent) getHostResources() (registry.Resources, error) {
-	// Try to get resources from libvirt driver
-	if lvDriver, ok := a.drivers[driver.InstanceTypeVM]; ok {
-		if hostDriver, ok := lvDriver.(driver.HostDriver); ok {
-			ctx := context.Background()
-			info, err := hostDriver.GetHostInfo(ctx)
-			if err == nil {
-				return registry.Resources{
-					CPUCores:    info.CPUCores,
-					MemoryBytes: info.MemoryBytes,
-					// Disk would need to be collected separately
-				}, nil
-			}
-		}
+// configureDatapath applies the configured OVS datapath mode to this node.
+func (a *Agent) configureDatapath() {
+	ovs := cgo.NewOVSBridge("")
+	if err := ovs.ConfigureDatapath(&a.config.Datapath); err != nil {
+		a.logger.Warn("failed to configure OVS datapath",
+			zap.String("mode", string(a.config.Datapath.Mode)),
+			zap.Error(err),
+		)
+		return
 	}
 
-	// Fallback to defaults
-	return registry.Resources{
-		CPUCores:    4,
-		MemoryBytes: 8 * 1024 * 1024 * 1024,   // 8GB
-		DiskBytes:   100 * 1024 * 1024 * 1024, // 100GB
-	}, nil
+	a.logger.Info("OVS datapath configured",
+		zap.String("mode", string(a.config.Datapath.Mode)),
+		zap.String("datapath_type", a.config.Datapath.BridgeDatapathType()),
+	)
 }
 
-// runReconcileLoop periodically reconciles instance state.
-func (a *Agent) runReconcileLoop(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// driverVersions returns the hypervisor version behind each driver that
+// reports one.
+func (a *Agent) driverVersions(ctx context.Context) map[string]string {
+	versions := make(map[string]string)
+	for _, d := range a.drivers {
+		hostDriver, ok := d.(driver.HostDriver)
+		if !ok {
+			continue
+		}
+		if info, err := hostDriver.GetHostInfo(ctx); err == nil && info.HypervisorVersion != "" {
+			versions[d.Name()] = info.HypervisorVersion
+		}
+	}
+	return versions
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-a.stopCh:
-			return
-		case <-ticker.C:
-			a.reconcileInstances(ctx)
+// detectHostCPU reads the host CPU vendor, model and feature flags from
+// /proc/cpuinfo. Returns nil if they cannot be determined.
+func detectHostCPU() *driver.HostCPU {
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return nil
+	}
+
+	var vendor, modelName string
+	var flags []string
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "vendor_id":
+			vendor = strings.TrimSpace(value)
+		case "model name":
+			modelName = strings.TrimSpace(value)
+		case "flags", "Features":
+			flags = strings.Fields(value)
+		}
+		// All processors report the same flags; the first one is enough
+		if vendor != "" && modelName != "" && flags != nil {
+			break
 		}
 	}
+
+	if len(flags) == 0 {
+		return nil
+	}
+	return driver.NewHostCPU(vendor, modelName, flags)
+}
+
+// reconcileInstances checks and updates instance states, and moves the
+// instances without dedicated cores onto the current shared cores. It fails
+// only if no driver could be listed.
+func (a *Agent) reconcileInstances(ctx context.Context) error {
+	if err := a.listInstances(ctx); err != nil {
+		return err
+	}
+	a.confineShared(ctx)
+	return nil
 }
 
-// reconcileInstances checks and updates instance states.
-func (a *Agent) reconcileInstances(ctx context.Context) {
+// listInstances refreshes the local cache of instances from the drivers.
+func (a *Agent) listInstances(ctx context.Context) error {
 	a.instancesMu.Lock()
 	defer a.instancesMu.Unlock()
 
+	var errs []error
 	for _, d := range a.drivers {
 		instances, err := d.List(ctx)
 		if err != nil {
 			a.logger.Warn("failed to list instances", zap.Error(err))
+			errs = append(errs, err)
 			continue
 		}
 
@@ -364,29 +718,17 @@ func (a *Agent) reconcileInstances(ctx context.Context) {
 			a.instances[instance.ID] = instance
 		}
 	}
-}
 
-// runResourceCollector periodically collects and reports resource usage.
-func (a *Agent) runResourceCollector(ctx context.Context) {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-a.stopCh:
-			return
-		case <-ticker.C:
-			a.collectAndReportResources(ctx)
-		}
+	if len(errs) > 0 && len(errs) == len(a.drivers) {
+		return fmt.Errorf("failed to list instances: %w", errors.Join(errs...))
 	}
+	return nil
 }
 
 // collectAndReportResources collects resource usage and updates node status.
-func (a *Agent) collectAndReportResources(ctx context.Context) {
+func (a *Agent) collectAndReportResources(ctx context.Context) error {
 	if a.node == nil {
-		return
+		return nil
 	}
 
 	// Calculate allocated resources from running instances
@@ -401,13 +743,50 @@ func (a *Agent) collectAndReportResources(ctx context.Context) {
 	}
 	a.instancesMu.RUnlock()
 
-	// Update node status
-	a.node.Allocated = allocated
-	a.node.LastSeen = time.Now()
+	gpus := a.gpus.status(a.gpusInUse())
+	for _, gpu := range gpus {
+		if gpu.InstanceID != "" {
+			allocated.GPUCount++
+		}
+	}
 
-	if err := a.nodeRegistry.Update(ctx, a.node); err != nil {
-		a.logger.Warn("failed to update node status", zap.Error(err))
+	stats := a.workQueue.Stats()
+	if stats.Pending > 0 || stats.Running > 0 {
+		a.logger.Debug("instance work queue",
+			zap.Int("pending", stats.Pending),
+			zap.Int("running", stats.Running),
+			zap.Int("max_depth", stats.MaxDepth),
+			zap.Uint64("deduplicated", stats.Deduplicated),
+		)
 	}
+
+	// Update node usage on the latest registry copy so that changes made by
+	// the control plane (cordon, drain, labels, taints) are not overwritten
+	vfs := a.vfs.status(a.vfsInUse())
+	numa := a.cpus.status(a.pinnedCPUsInUse())
+	creates := a.creates.Load()
+	images := a.cachedImages(ctx)
+	driverVersions := a.driverVersions(ctx)
+	node, err := a.nodeRegistry.Modify(ctx, a.nodeID, func(node *registry.Node) error {
+		node.Allocated = allocated
+		// Dedicating cores takes them out of the overcommitted pool
+		node.Allocatable = a.config.Capacity.allocatable(node.Capacity, dedicatedCPUs(numa))
+		node.GPUs = gpus
+		node.VFs = vfs
+		node.NUMA = numa
+		node.Creates = creates
+		node.Images = images
+		node.Labels = a.nodeLabels(node.Labels)
+		node.AgentVersion = a.config.Version
+		node.DriverVersions = driverVersions
+		node.LastSeen = time.Now()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update node status: %w", err)
+	}
+	a.node = node
+	return nil
 }
 
 // CreateInstance creates an instance on this node.
@@ -417,10 +796,51 @@ func (a *Agent) CreateInstance(ctx context.Context, spec *driver.InstanceSpec, i
 		return nil, fmt.Errorf("unsupported instance type: %s", instanceType)
 	}
 
-	instance, err := d.Create(ctx, spec)
+	// Wait for a create slot so bursts do not pull images in parallel
+	release, err := a.creates.acquire(ctx, spec.Image)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for a create slot: %w", err)
+	}
+	defer release()
+
+	releaseGPUs, err := a.gpus.assign(spec, a.gpusInUse())
 	if err != nil {
 		return nil, err
 	}
+	defer releaseGPUs()
+
+	vf, releaseVF, err := a.vfs.assign(spec, a.vfsInUse())
+	if err != nil {
+		return nil, err
+	}
+	defer releaseVF()
+	if err := a.prepareSRIOVPort(ctx, spec, vf); err != nil {
+		return nil, err
+	}
+	a.prepareNetworkMTU(ctx, spec)
+
+	releaseCPUs, err := a.cpus.assign(spec, a.pinnedCPUsInUse())
+	if err != nil {
+		return nil, err
+	}
+	defer releaseCPUs()
+	if len(spec.PinnedCPUs) > 0 {
+		// Move the instances sharing cores off the ones just dedicated
+		a.confineShared(ctx)
+	}
+
+	unplugVhostUser, err := a.plugVhostUserPort(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := traceDriver(ctx, d, "create", spec.InstanceID)
+	instance, err := d.Create(ctx, spec)
+	tracing.End(span, err)
+	if err != nil {
+		unplugVhostUser()
+		return nil, a.observeDriverErr(d, "create", err)
+	}
 
 	a.instancesMu.Lock()
 	a.instances[instance.ID] = instance
@@ -429,64 +849,270 @@ func (a *Agent) CreateInstance(ctx context.Context, spec *driver.InstanceSpec, i
 	return instance, nil
 }
 
-// StartInstance starts an instance.
-func (a *Agent) StartInstance(ctx context.Context, id string) error {
-	instance, err := a.getInstance(id)
-	if err != nil {
-		return err
+// discardInstance deletes an instance whose creation could not be completed.
+func (a *Agent) discardInstance(ctx context.Context, instanceType driver.InstanceType, id string) {
+	if err := a.drivers[instanceType].Delete(ctx, id); err != nil {
+		a.logger.Warn("failed to delete partially created instance", zap.String("id", id), zap.Error(err))
 	}
 
-	d, ok := a.drivers[instance.Type]
+	a.instancesMu.Lock()
+	instance := a.instances[id]
+	delete(a.instances, id)
+	a.instancesMu.Unlock()
+
+	if instance != nil {
+		a.unplugVhostUserPort(instance.Spec.Network)
+	}
+}
+
+// PullImage fetches an image into the cache of the driver for instanceType.
+// Pulls share the create concurrency limit, since creates pull images too.
+func (a *Agent) PullImage(ctx context.Context, instanceType driver.InstanceType, ref string, progress func(driver.PullProgress)) (*driver.ImageInfo, error) {
+	d, ok := a.drivers[instanceType]
 	if !ok {
-		return fmt.Errorf("unsupported instance type: %s", instance.Type)
+		return nil, fmt.Errorf("unsupported instance type: %s", instanceType)
+	}
+	images, ok := d.(driver.ImageDriver)
+	if !ok {
+		return nil, fmt.Errorf("%s driver does not manage an image cache", d.Name())
+	}
+
+	release, err := a.creates.acquire(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for a create slot: %w", err)
 	}
+	defer release()
 
-	return d.Start(ctx, id)
+	ctx, span := tracing.Start(ctx, "driver.pull",
+		attribute.String("driver", d.Name()),
+		attribute.String("image", ref),
+	)
+	image, err := images.PullImage(ctx, ref, progress)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, a.observeDriverErr(d, "pull", err)
+	}
+	return image, nil
+}
+
+// cachedImages returns the sorted names of the images cached by all drivers.
+func (a *Agent) cachedImages(ctx context.Context) []string {
+	seen := make(map[string]bool)
+	for _, d := range a.drivers {
+		images, ok := d.(driver.ImageDriver)
+		if !ok {
+			continue
+		}
+		list, err := images.ListImages(ctx)
+		if err != nil {
+			a.logger.Debug("failed to list images", zap.String("driver", d.Name()), zap.Error(err))
+			continue
+		}
+		for _, image := range list {
+			seen[image.Ref] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StartInstance starts an instance.
+func (a *Agent) StartInstance(ctx context.Context, id string) error {
+	return a.workQueue.Do(ctx, id, opStart, func(ctx context.Context) error {
+		d, err := a.driverFor(id)
+		if err != nil {
+			return err
+		}
+		ctx, span := traceDriver(ctx, d, "start", id)
+		err = d.Start(ctx, id)
+		tracing.End(span, err)
+		return a.observeDriverErr(d, "start", err)
+	})
 }
 
 // StopInstance stops an instance.
 func (a *Agent) StopInstance(ctx context.Context, id string, force bool) error {
-	instance, err := a.getInstance(id)
-	if err != nil {
-		return err
+	op := opStop
+	if force {
+		op = opStopForce
 	}
 
-	d, ok := a.drivers[instance.Type]
-	if !ok {
-		return fmt.Errorf("unsupported instance type: %s", instance.Type)
+	return a.workQueue.Do(ctx, id, op, func(ctx context.Context) error {
+		d, err := a.driverFor(id)
+		if err != nil {
+			return err
+		}
+		ctx, span := traceDriver(ctx, d, "stop", id)
+		err = d.Stop(ctx, id, force)
+		tracing.End(span, err)
+		return a.observeDriverErr(d, "stop", err)
+	})
+}
+
+// RestartInstance restarts an instance.
+func (a *Agent) RestartInstance(ctx context.Context, id string, force bool) error {
+	op := opRestart
+	if force {
+		op = opRestartForce
 	}
 
-	return d.Stop(ctx, id, force)
+	return a.workQueue.Do(ctx, id, op, func(ctx context.Context) error {
+		d, err := a.driverFor(id)
+		if err != nil {
+			return err
+		}
+		ctx, span := traceDriver(ctx, d, "restart", id)
+		err = d.Restart(ctx, id, force)
+		tracing.End(span, err)
+		return a.observeDriverErr(d, "restart", err)
+	})
+}
+
+// PauseInstance freezes a running instance in memory.
+func (a *Agent) PauseInstance(ctx context.Context, id string) error {
+	return a.workQueue.Do(ctx, id, opPause, func(ctx context.Context) error {
+		d, err := a.driverFor(id)
+		if err != nil {
+			return err
+		}
+		pd, ok := d.(driver.PauseDriver)
+		if !ok {
+			return fmt.Errorf("%s driver cannot pause instances: %w", d.Name(), driver.ErrNotSupported)
+		}
+		ctx, span := traceDriver(ctx, d, "pause", id)
+		err = pd.Pause(ctx, id)
+		tracing.End(span, err)
+		return a.observeDriverErr(d, "pause", err)
+	})
+}
+
+// ResumeInstance continues a paused instance, or restores one suspended to
+// disk by starting it.
+func (a *Agent) ResumeInstance(ctx context.Context, id string) error {
+	return a.workQueue.Do(ctx, id, opResume, func(ctx context.Context) error {
+		d, err := a.driverFor(id)
+		if err != nil {
+			return err
+		}
+		instance, err := d.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		var resume func(ctx context.Context, id string) error
+		switch instance.State {
+		case driver.StateSuspended:
+			resume = d.Start
+		case driver.StatePaused:
+			pd, ok := d.(driver.PauseDriver)
+			if !ok {
+				return fmt.Errorf("%s driver cannot resume instances: %w", d.Name(), driver.ErrNotSupported)
+			}
+			resume = pd.Resume
+		case driver.StateRunning:
+			return nil
+		default:
+			return fmt.Errorf("instance is %s, not paused or suspended: %w", instance.State, driver.ErrInstanceStopped)
+		}
+
+		ctx, span := traceDriver(ctx, d, "resume", id)
+		err = resume(ctx, id)
+		tracing.End(span, err)
+		return a.observeDriverErr(d, "resume", err)
+	})
+}
+
+// SuspendInstance saves a running or paused instance's memory to disk and
+// stops it.
+func (a *Agent) SuspendInstance(ctx context.Context, id string) error {
+	return a.workQueue.Do(ctx, id, opSuspend, func(ctx context.Context) error {
+		d, err := a.driverFor(id)
+		if err != nil {
+			return err
+		}
+		sd, ok := d.(driver.SuspendDriver)
+		if !ok {
+			return fmt.Errorf("%s driver cannot suspend instances to disk: %w", d.Name(), driver.ErrNotSupported)
+		}
+		ctx, span := traceDriver(ctx, d, "suspend", id)
+		err = sd.Suspend(ctx, id)
+		tracing.End(span, err)
+		return a.observeDriverErr(d, "suspend", err)
+	})
 }
 
 // DeleteInstance deletes an instance.
 func (a *Agent) DeleteInstance(ctx context.Context, id string) error {
-	instance, err := a.getInstance(id)
-	if err != nil {
-		return err
-	}
+	return a.workQueue.Do(ctx, id, opDelete, func(ctx context.Context) error {
+		d, err := a.driverFor(id)
+		if err != nil {
+			return err
+		}
+		instance, err := a.getInstance(id)
+		if err != nil {
+			return err
+		}
 
-	d, ok := a.drivers[instance.Type]
-	if !ok {
-		return fmt.Errorf("unsupported instance type: %s", instance.Type)
-	}
+		ctx, span := traceDriver(ctx, d, "delete", id)
+		err = d.Delete(ctx, id)
+		tracing.End(span, err)
+		if err != nil {
+			return a.observeDriverErr(d, "delete", err)
+		}
 
-	if err := d.Delete(ctx, id); err != nil {
-		return err
-	}
+		a.instancesMu.Lock()
+		delete(a.instances, id)
+		a.instancesMu.Unlock()
+		a.unplugVhostUserPort(instance.Spec.Network)
 
-	a.instancesMu.Lock()
-	delete(a.instances, id)
-	a.instancesMu.Unlock()
+		// The port outlives the instance; free it for the next one
+		if err := a.unbindPort(ctx, instance.Spec.Network); err != nil {
+			a.logger.Warn("failed to unbind port", zap.String("id", id), zap.Error(err))
+		}
 
-	return nil
+		return nil
+	})
 }
 
-// GetInstance retrieves an instance.
+// WorkQueueStats returns the per-instance work queue depth and counters.
+func (a *Agent) WorkQueueStats() WorkQueueStats {
+	return a.workQueue.Stats()
+}
+
+// GetInstance retrieves an instance. One missing from the cache, such as an
+// instance just migrated here, is looked for in the drivers before it is
+// reported not found.
 func (a *Agent) GetInstance(ctx context.Context, id string) (*driver.Instance, error) {
+	instance, err := a.getInstance(id)
+	if !errors.Is(err, driver.ErrInstanceNotFound) {
+		return instance, err
+	}
+	if err := a.listInstances(ctx); err != nil {
+		return nil, err
+	}
 	return a.getInstance(id)
 }
 
+// BootDiagnostics collects a screenshot and the last serial console lines of
+// an instance, to tell whether it booted.
+func (a *Agent) BootDiagnostics(ctx context.Context, id string, lines int) (*driver.BootDiagnostics, error) {
+	d, err := a.driverFor(id)
+	if err != nil {
+		return nil, err
+	}
+	dd, ok := d.(driver.DiagnosticsDriver)
+	if !ok {
+		return nil, fmt.Errorf("%s driver cannot collect boot diagnostics: %w", d.Name(), driver.ErrNotSupported)
+	}
+	diag, err := dd.BootDiagnostics(ctx, id, lines)
+	return diag, a.observeDriverErr(d, "diagnostics", err)
+}
+
 // ListInstances lists all instances on this node.
 func (a *Agent) ListInstances(ctx context.Context) ([]*driver.Instance, error) {
 	a.instancesMu.RLock()
@@ -512,6 +1138,39 @@ func (a *Agent) getInstance(id string) (*driver.Instance, error) {
 	return instance, nil
 }
 
+// driverFor returns the driver managing the given instance. It is looked up
+// inside queued operations so that an instance deleted by an earlier
+// operation is reported as not found.
+func (a *Agent) driverFor(id string) (driver.Driver, error) {
+	instance, err := a.getInstance(id)
+	if err != nil {
+		return nil, err
+	}
+
+	d, ok := a.drivers[instance.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported instance type: %s", instance.Type)
+	}
+
+	return d, nil
+}
+
+// observeDriverErr records a failed driver operation and returns err.
+func (a *Agent) observeDriverErr(d driver.Driver, operation string, err error) error {
+	if err != nil {
+		metrics.ObserveDriverFailure(string(d.Type()), operation)
+	}
+	return err
+}
+
+// traceDriver starts the span of a driver operation on an instance.
+func traceDriver(ctx context.Context, d driver.Driver, operation, id string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "driver."+operation,
+		attribute.String("driver", d.Name()),
+		attribute.String("instance.id", id),
+	)
+}
+
 // startGRPCServer starts the agent gRPC server.
 func (a *Agent) startGRPCServer() error {
 	addr := fmt.Sprintf(":%d", a.config.Port)
@@ -520,12 +1179,19 @@ func (a *Agent) startGRPCServer() error {
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
-	a.grpcServer = grpc.NewServer()
+	a.grpcServer = grpc.NewServer(
+		grpc.UnaryInterceptor(metrics.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(metrics.StreamServerInterceptor()),
+		tracing.ServerOption(),
+	)
 
 	// Register agent service
 	agentService := NewAgentGRPCService(a)
 	v1.RegisterAgentServiceServer(a.grpcServer, agentService)
 
+	// Register the health service for probes
+	a.health.Register(a.grpcServer)
+
 	// Register reflection for debugging
 	reflection.Register(a.grpcServer)
 
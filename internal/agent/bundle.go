@@ -0,0 +1,325 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"hypervisor/pkg/cluster/commands"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/network/overlay"
+)
+
+const (
+	// defaultBundleLogSince is how far back the agent's journal goes in a
+	// support bundle when the request does not say.
+	defaultBundleLogSince = 24 * time.Hour
+
+	// bundleCommandTimeout bounds each host command run for a bundle.
+	bundleCommandTimeout = 30 * time.Second
+
+	// bundleInstanceLogBytes is how much of the end of each instance's log
+	// goes into a bundle.
+	bundleInstanceLogBytes = 1024 * 1024
+)
+
+// supportBundle writes the files of a support bundle into a gzipped tar
+// archive. Failures to collect a part are recorded in errors.txt rather
+// than ending the bundle.
+type supportBundle struct {
+	tw     *tar.Writer
+	prefix string
+	now    time.Time
+	errors []string
+}
+
+func (b *supportBundle) add(name string, data []byte) error {
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name:    b.prefix + name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: b.now,
+	}); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+func (b *supportBundle) addJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.failf("%s: %v", name, err)
+		return nil
+	}
+	return b.add(name, append(data, '\n'))
+}
+
+func (b *supportBundle) failf(format string, args ...any) {
+	b.errors = append(b.errors, fmt.Sprintf(format, args...))
+}
+
+// WriteSupportBundle writes a gzipped tar archive for troubleshooting the
+// node offline: the agent's state and journal, driver and instance states,
+// the end of each instance's log, OVS bridges and flows, network
+// namespaces, and the etcd keys about this node. logSince bounds the
+// journal, 24 hours if zero.
+func (a *Agent) WriteSupportBundle(ctx context.Context, w io.Writer, logSince time.Duration) error {
+	if logSince <= 0 {
+		logSince = defaultBundleLogSince
+	}
+
+	gz := gzip.NewWriter(w)
+	b := &supportBundle{
+		tw:     tar.NewWriter(gz),
+		prefix: fmt.Sprintf("bundle-%s-%s/", a.nodeID, time.Now().UTC().Format("20060102T150405Z")),
+		now:    time.Now(),
+	}
+
+	for _, collect := range []func(context.Context, *supportBundle) error{
+		a.bundleAgent,
+		a.bundleDrivers,
+		a.bundleInstances,
+		a.bundleEtcd,
+		func(ctx context.Context, b *supportBundle) error { return a.bundleCommands(ctx, b, logSince) },
+	} {
+		if err := collect(ctx, b); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	if len(b.errors) > 0 {
+		if err := b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n")); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+	}
+	if err := b.tw.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// bundleAgent adds the agent's own state.
+func (a *Agent) bundleAgent(ctx context.Context, b *supportBundle) error {
+	hostname, _ := os.Hostname()
+	drivers := make(map[string]any, len(a.drivers))
+	for instanceType, d := range a.drivers {
+		drivers[string(instanceType)] = map[string]any{
+			"name":         d.Name(),
+			"capabilities": d.Capabilities(),
+		}
+	}
+	return b.addJSON("agent.json", map[string]any{
+		"node_id":      a.nodeID,
+		"hostname":     hostname,
+		"version":      a.config.Version,
+		"cordoned":     a.cordoned.Load(),
+		"work_queue":   a.WorkQueueStats(),
+		"creates":      a.creates.Load(),
+		"drivers":      drivers,
+		"collected_at": b.now,
+	})
+}
+
+// bundleDrivers adds the instances each driver knows about, which may
+// differ from what the agent tracks.
+func (a *Agent) bundleDrivers(ctx context.Context, b *supportBundle) error {
+	for instanceType, d := range a.drivers {
+		instances, err := d.List(ctx)
+		if err != nil {
+			b.failf("list %s instances: %v", d.Name(), err)
+			continue
+		}
+		if err := b.addJSON("drivers/"+string(instanceType)+".json", instances); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleInstances adds each instance as the agent tracks it, and the end of
+// its log.
+func (a *Agent) bundleInstances(ctx context.Context, b *supportBundle) error {
+	instances, _ := a.ListInstances(ctx)
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+
+	for _, instance := range instances {
+		if err := b.addJSON("instances/"+instance.ID+".json", instance); err != nil {
+			return err
+		}
+
+		path, err := a.InstanceLogPath(ctx, instance.ID)
+		if err != nil {
+			b.failf("log of instance %s: %v", instance.ID, err)
+			continue
+		}
+		data, err := tailBytes(path, bundleInstanceLogBytes)
+		if err != nil {
+			b.failf("log of instance %s: %v", instance.ID, err)
+			continue
+		}
+		if data != nil {
+			if err := b.add("instances/"+instance.ID+".log", data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bundleEtcd adds the etcd keys about this node: its registration,
+// settings, VTEP and commands, its instances and the ports bound to it.
+func (a *Agent) bundleEtcd(ctx context.Context, b *supportBundle) error {
+	type keyValue struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+	var kvs []keyValue
+	add := func(key, value string) {
+		raw := json.RawMessage(value)
+		if !json.Valid(raw) {
+			raw, _ = json.Marshal(value)
+		}
+		kvs = append(kvs, keyValue{Key: key, Value: raw})
+	}
+	get := func(key string) {
+		value, err := a.etcdClient.Get(ctx, key)
+		if err != nil {
+			b.failf("etcd %s: %v", key, err)
+			return
+		}
+		add(key, value)
+	}
+	list := func(prefix string, match func(value string) bool) []string {
+		found, err := a.etcdClient.GetWithPrefixKV(ctx, prefix)
+		if err != nil {
+			b.failf("etcd %s: %v", prefix, err)
+			return nil
+		}
+		var keys []string
+		for _, kv := range found {
+			if match == nil || match(kv.Value) {
+				add(kv.Key, kv.Value)
+				keys = append(keys, kv.Key)
+			}
+		}
+		return keys
+	}
+
+	id := a.nodeID
+	for _, key := range []string{
+		registry.NodePrefix + id,
+		registry.NodeSettingsPrefix + id,
+		registry.ShutdownPrefix + id,
+		overlay.VTEPKeyPrefix + id,
+	} {
+		get(key)
+	}
+	list(commands.KeyPrefix+id+"/", nil)
+	for _, key := range list(registry.InstanceByNodePrefix+id+"/", nil) {
+		get(registry.InstancePrefix + key[strings.LastIndex(key, "/")+1:])
+	}
+	list(portKeyPrefix, func(value string) bool {
+		return strings.Contains(value, `"`+id+`"`)
+	})
+
+	return b.addJSON("etcd.json", kvs)
+}
+
+// bundleCommands adds the output of host commands: the agent's journal,
+// OVS state and the network namespaces.
+func (a *Agent) bundleCommands(ctx context.Context, b *supportBundle, logSince time.Duration) error {
+	commands := map[string][]string{
+		"logs/agent.log": {"journalctl", "-u", "hypervisor-agent", "--no-pager", "-o", "short-iso",
+			"--since", fmt.Sprintf("-%ds", int64(logSince/time.Second))},
+		"ovs/vsctl-show.txt":    {"ovs-vsctl", "show"},
+		"ovs/dpctl-flows.txt":   {"ovs-appctl", "dpctl/dump-flows"},
+		"network/addr.txt":      {"ip", "-d", "addr"},
+		"network/route.txt":     {"ip", "route", "show", "table", "all"},
+		"network/neighbour.txt": {"ip", "neigh"},
+		"network/netns.txt":     {"ip", "netns", "list"},
+	}
+	for _, bridge := range a.config.Datapath.Bridges {
+		commands["ovs/"+bridge+"-show.txt"] = []string{"ovs-ofctl", "show", bridge}
+		commands["ovs/"+bridge+"-flows.txt"] = []string{"ovs-ofctl", "dump-flows", bridge}
+	}
+
+	// Each namespace's addresses and routes, e.g. those of containers
+	netns, _ := runBundleCommand(ctx, "ip", "netns", "list")
+	for _, line := range strings.Split(string(netns), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			ns := fields[0]
+			commands["network/netns/"+ns+"-addr.txt"] = []string{"ip", "-n", ns, "-d", "addr"}
+			commands["network/netns/"+ns+"-route.txt"] = []string{"ip", "-n", ns, "route", "show", "table", "all"}
+		}
+	}
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args := commands[name]
+		out, err := runBundleCommand(ctx, args[0], args[1:]...)
+		if err != nil {
+			b.failf("%s: %v", strings.Join(args, " "), err)
+			if len(out) == 0 {
+				continue
+			}
+		}
+		if err := b.add(name, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBundleCommand runs a host command, returning its combined output.
+func runBundleCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, bundleCommandTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// tailBytes returns up to the last n bytes of the file at path. A missing
+// file is nil.
+func tailBytes(path string, n int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open log: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat log: %w", err)
+	}
+	offset := info.Size() - n
+	if offset < 0 {
+		offset = 0
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.NewSectionReader(f, offset, info.Size()-offset)); err != nil {
+		return nil, fmt.Errorf("failed to read log: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"sort"
+
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+)
+
+// CapacityConfig controls how much of the host is offered to instances.
+type CapacityConfig struct {
+	// CPUOvercommitRatio multiplies the cores left after the reservation,
+	// e.g. 4 offers four vCPUs per core. Dedicated cores are never
+	// overcommitted.
+	CPUOvercommitRatio float64 `mapstructure:"cpu_overcommit_ratio"`
+
+	// MemoryOvercommitRatio multiplies the memory left after the reservation.
+	MemoryOvercommitRatio float64 `mapstructure:"memory_overcommit_ratio"`
+
+	// ReservedCPUCores are kept for the host and the agent. They are the
+	// lowest-numbered CPUs, which are never dedicated to instances either.
+	ReservedCPUCores int `mapstructure:"reserved_cpu_cores"`
+
+	// ReservedMemoryMB is kept for the host and the agent.
+	ReservedMemoryMB int64 `mapstructure:"reserved_memory_mb"`
+}
+
+// DefaultCapacityConfig returns the default capacity configuration.
+func DefaultCapacityConfig() CapacityConfig {
+	return CapacityConfig{
+		CPUOvercommitRatio:    1,
+		MemoryOvercommitRatio: 1,
+		ReservedCPUCores:      1,
+		ReservedMemoryMB:      1024,
+	}
+}
+
+// allocatable returns the part of capacity the scheduler may place instances
+// on: capacity less the reservation, times the overcommit ratio. Of the
+// cores, the dedicated ones are offered once and only the shared rest is
+// overcommitted. An unset ratio means no overcommit.
+func (c CapacityConfig) allocatable(capacity registry.Resources, dedicatedCPUs int) registry.Resources {
+	allocatable := capacity
+	cpus := max(0, capacity.CPUCores-c.ReservedCPUCores)
+	dedicated := min(dedicatedCPUs, cpus)
+	allocatable.CPUCores = dedicated + int(float64(cpus-dedicated)*overcommitRatio(c.CPUOvercommitRatio))
+	memory := max(0, capacity.MemoryBytes-c.ReservedMemoryMB*1024*1024)
+	allocatable.MemoryBytes = int64(float64(memory) * overcommitRatio(c.MemoryOvercommitRatio))
+	return allocatable
+}
+
+// dedicatedCPUs returns how many cores of the NUMA nodes are dedicated to
+// instances.
+func dedicatedCPUs(nodes []driver.NUMANode) int {
+	n := 0
+	for _, node := range nodes {
+		n += node.PinnedCPUs
+	}
+	return n
+}
+
+func overcommitRatio(ratio float64) float64 {
+	if ratio <= 0 {
+		return 1
+	}
+	return ratio
+}
+
+// reserveCPUs removes the n lowest-numbered CPUs of the host from its NUMA
+// nodes, so they are not dedicated to instances.
+func reserveCPUs(nodes []driver.NUMANode, n int) []driver.NUMANode {
+	if n <= 0 {
+		return nodes
+	}
+	var all []int
+	for _, node := range nodes {
+		all = append(all, node.CPUs...)
+	}
+	sort.Ints(all)
+	reserved := make(map[int]bool, n)
+	for _, cpu := range all[:min(n, len(all))] {
+		reserved[cpu] = true
+	}
+
+	result := make([]driver.NUMANode, 0, len(nodes))
+	for _, node := range nodes {
+		cpus := make([]int, 0, len(node.CPUs))
+		for _, cpu := range node.CPUs {
+			if !reserved[cpu] {
+				cpus = append(cpus, cpu)
+			}
+		}
+		node.CPUs = cpus
+		result = append(result, node)
+	}
+	return result
+}
@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/commands"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultCollectLogsLines is how many console lines per instance collect-logs
+// returns unless the command asks for a different number.
+const defaultCollectLogsLines = 100
+
+// commandRunner runs the commands the server queued for this node. It is
+// triggered by every heartbeat and runs the pending commands one at a time,
+// in the order they were queued.
+type commandRunner struct {
+	agent  *Agent
+	queue  *commands.Queue
+	logger *zap.Logger
+
+	busy      atomic.Bool // A batch of commands is running
+	recovered bool        // Commands interrupted by a restart were handled
+}
+
+func newCommandRunner(agent *Agent, queue *commands.Queue, logger *zap.Logger) *commandRunner {
+	return &commandRunner{
+		agent:  agent,
+		queue:  queue,
+		logger: logger,
+	}
+}
+
+// trigger runs the pending commands in the background unless a previous
+// batch is still running; that batch picks up newer commands on the next
+// heartbeat. Commands such as drain take long, so they must not hold up
+// heartbeats.
+func (r *commandRunner) trigger(ctx context.Context) {
+	if !r.busy.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer r.busy.Store(false)
+		r.runPending(ctx)
+	}()
+}
+
+func (r *commandRunner) runPending(ctx context.Context) {
+	if !r.recovered {
+		if err := r.queue.Recover(ctx, r.agent.nodeID); err != nil {
+			r.logger.Warn("failed to recover interrupted node commands", zap.Error(err))
+			return
+		}
+		r.recovered = true
+	}
+
+	pending, err := r.queue.Pending(ctx, r.agent.nodeID)
+	if err != nil {
+		r.logger.Warn("failed to list pending node commands", zap.Error(err))
+		return
+	}
+
+	for _, cmd := range pending {
+		started, err := r.queue.Start(ctx, cmd)
+		if err != nil {
+			r.logger.Warn("failed to start node command", zap.String("command_id", cmd.ID), zap.Error(err))
+			continue
+		}
+		if !started {
+			continue
+		}
+
+		r.logger.Info("running node command",
+			zap.String("command_id", cmd.ID),
+			zap.String("type", cmd.Type),
+		)
+		message, result, runErr := r.run(ctx, cmd)
+		if err := r.queue.Ack(ctx, cmd, message, result, runErr); err != nil {
+			r.logger.Warn("failed to acknowledge node command", zap.String("command_id", cmd.ID), zap.Error(err))
+		}
+	}
+}
+
+// run executes a command and returns a summary and its output.
+func (r *commandRunner) run(ctx context.Context, cmd *commands.Command) (string, map[string]string, error) {
+	switch cmd.Type {
+	case commands.TypeCordon:
+		r.agent.cordoned.Store(true)
+		if err := r.agent.updateNodeStatus(ctx, registry.NodeStatusMaintenance, registry.NodeStatusReady); err != nil {
+			return "", nil, err
+		}
+		return "node cordoned, new instances are refused", nil, nil
+	case commands.TypeUncordon:
+		r.agent.cordoned.Store(false)
+		if err := r.agent.updateNodeStatus(ctx, registry.NodeStatusReady,
+			registry.NodeStatusMaintenance, registry.NodeStatusDraining); err != nil {
+			return "", nil, err
+		}
+		return "node uncordoned", nil, nil
+	case commands.TypeDrain:
+		return r.drain(ctx, cmd.Parameters["force"] == "true")
+	case commands.TypeUpgrade:
+		return r.upgrade(cmd.Parameters["version"])
+	case commands.TypeCollectLogs:
+		return r.collectLogs(ctx, cmd.Parameters)
+	default:
+		return "", nil, fmt.Errorf("unsupported command type %q", cmd.Type)
+	}
+}
+
+// drain refuses new instances and stops the instances still running.
+func (r *commandRunner) drain(ctx context.Context, force bool) (string, map[string]string, error) {
+	r.agent.cordoned.Store(true)
+	if err := r.agent.updateNodeStatus(ctx, registry.NodeStatusDraining,
+		registry.NodeStatusReady, registry.NodeStatusMaintenance); err != nil {
+		return "", nil, err
+	}
+
+	instances, err := r.agent.ListInstances(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	stopped := 0
+	var failed []string
+	for _, instance := range instances {
+		if instance.State != driver.StateRunning {
+			continue
+		}
+		if err := r.stop(ctx, instance.ID, force); err != nil {
+			r.logger.Warn("failed to stop instance while draining",
+				zap.String("instance_id", instance.ID),
+				zap.Error(err),
+			)
+			failed = append(failed, instance.ID)
+			continue
+		}
+		stopped++
+	}
+
+	result := map[string]string{"stopped": strconv.Itoa(stopped)}
+	if len(failed) > 0 {
+		result["failed"] = strings.Join(failed, ",")
+		return "", result, fmt.Errorf("stopped %d instances, failed to stop %s", stopped, strings.Join(failed, ", "))
+	}
+	return fmt.Sprintf("drained, %d instances stopped", stopped), result, nil
+}
+
+// stop stops an instance through the server, which records the stop as the
+// instance's desired state so the reconciler does not start it again. Only
+// instances the control plane does not know, or every instance when the
+// agent has no server, are stopped on the node alone.
+func (r *commandRunner) stop(ctx context.Context, id string, force bool) error {
+	if conn := r.agent.serverConn; conn != nil {
+		_, err := v1.NewComputeServiceClient(conn).StopInstance(ctx, &v1.StopInstanceRequest{
+			InstanceId: id,
+			Force:      force,
+		})
+		if status.Code(err) != codes.NotFound {
+			return err
+		}
+	}
+	return r.agent.StopInstance(ctx, id, force)
+}
+
+// updateNodeStatus sets the node's status in the registry, which the
+// scheduler reads, if it is one of from. The change is a compare-and-swap
+// on the latest node, so what the control plane set meanwhile is kept.
+func (a *Agent) updateNodeStatus(ctx context.Context, nodeStatus registry.NodeStatus, from ...registry.NodeStatus) error {
+	if a.nodeID == "" {
+		return nil
+	}
+	_, err := a.nodeRegistry.Modify(ctx, a.nodeID, func(node *registry.Node) error {
+		if slices.Contains(from, node.Status) {
+			node.Status = nodeStatus
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update node status: %w", err)
+	}
+	return nil
+}
+
+// upgrade reports whether the agent runs the requested release. The agent
+// does not replace its own binary: packages are installed by the host's
+// configuration management, which restarts the agent.
+func (r *commandRunner) upgrade(version string) (string, map[string]string, error) {
+	current := r.agent.config.Version
+	result := map[string]string{"current_version": current}
+	if version == "" {
+		return "", result, fmt.Errorf("upgrade needs a version parameter")
+	}
+	if version == current {
+		return fmt.Sprintf("already running %s", version), result, nil
+	}
+	return "", result, fmt.Errorf("agent runs %s and cannot upgrade itself to %s; install the release on the node and restart the agent", current, version)
+}
+
+// collectLogs collects the agent's view of the node: its instances, work
+// queue and the end of every instance's serial console. Parameters:
+// "instance_id" limits the consoles to one instance, "lines" sets how many
+// lines each console returns.
+func (r *commandRunner) collectLogs(ctx context.Context, parameters map[string]string) (string, map[string]string, error) {
+	lines := defaultCollectLogsLines
+	if v := parameters["lines"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return "", nil, fmt.Errorf("invalid lines parameter %q", v)
+		}
+		lines = n
+	}
+
+	instances, err := r.agent.ListInstances(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+
+	var summary strings.Builder
+	for _, instance := range instances {
+		fmt.Fprintf(&summary, "%s\t%s\t%s\t%s\n", instance.ID, instance.Name, instance.Type, instance.State)
+	}
+	queue := r.agent.WorkQueueStats()
+	result := map[string]string{
+		"agent_version": r.agent.config.Version,
+		"cordoned":      strconv.FormatBool(r.agent.cordoned.Load()),
+		"instances":     summary.String(),
+		"work_queue":    fmt.Sprintf("pending=%d running=%d", queue.Pending, queue.Running),
+	}
+
+	only := parameters["instance_id"]
+	found, collected := false, 0
+	for _, instance := range instances {
+		if only != "" && instance.ID != only {
+			continue
+		}
+		found = true
+		diag, err := r.agent.BootDiagnostics(ctx, instance.ID, lines)
+		if err != nil {
+			result["console/"+instance.ID] = fmt.Sprintf("unavailable: %v", err)
+			continue
+		}
+		result["console/"+instance.ID] = strings.Join(diag.SerialOutput, "\n")
+		collected++
+	}
+	if only != "" && !found {
+		return "", result, fmt.Errorf("instance %s not found on node", only)
+	}
+
+	return fmt.Sprintf("collected %d instance consoles", collected), result, nil
+}
@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/registry"
+)
+
+// createLimiter bounds the number of instance creates running at once, so a
+// burst of creates landing on one node (e.g. an instance group scaling up)
+// does not thrash on parallel image pulls. Creates over the limit wait for a
+// slot in arrival order.
+type createLimiter struct {
+	limit  int
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	inFlight int
+	waiters  []chan struct{}
+}
+
+// newCreateLimiter creates a limiter; a limit of zero or less disables it.
+func newCreateLimiter(limit int, logger *zap.Logger) *createLimiter {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &createLimiter{
+		limit:  limit,
+		logger: logger,
+	}
+}
+
+// acquire waits for a create slot and returns the function that frees it.
+func (l *createLimiter) acquire(ctx context.Context, image string) (func(), error) {
+	if l.limit <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	if l.inFlight < l.limit {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	position := len(l.waiters)
+	l.mu.Unlock()
+
+	l.logger.Info("instance create queued",
+		zap.String("image", image),
+		zap.Int("position", position),
+		zap.Int("limit", l.limit),
+	)
+
+	select {
+	case <-ready:
+		l.logger.Info("instance create dequeued", zap.String("image", image))
+		return l.release, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, w := range l.waiters {
+			if w == ready {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				return nil, ctx.Err()
+			}
+		}
+		// The slot was handed over while giving up; pass it on
+		l.releaseLocked()
+		return nil, ctx.Err()
+	}
+}
+
+// release frees a slot, handing it straight to the oldest waiter if any.
+func (l *createLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+func (l *createLimiter) releaseLocked() {
+	if len(l.waiters) > 0 {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		return
+	}
+	l.inFlight--
+}
+
+// Load returns the limit and the number of creates running and queued.
+func (l *createLimiter) Load() registry.CreateLoad {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return registry.CreateLoad{
+		Limit:    max(l.limit, 0),
+		InFlight: l.inFlight,
+		Queued:   len(l.waiters),
+	}
+}
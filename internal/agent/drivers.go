@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"fmt"
+
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/containerd"
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/compute/firecracker"
+	"hypervisor/pkg/compute/libvirt"
+	"hypervisor/pkg/compute/qemu"
+
+	"go.uber.org/zap"
+)
+
+// newDrivers initializes the driver of each supported instance type. A
+// driver that fails to initialize, e.g. because its daemon is not running,
+// is left out and its type is not advertised; the agent serves the other
+// types. Restart the agent once the driver's dependency is available.
+func newDrivers(config Config, logger *zap.Logger) map[driver.InstanceType]driver.Driver {
+	drivers := make(map[driver.InstanceType]driver.Driver)
+	for _, t := range config.SupportedInstanceTypes {
+		instanceType := driver.InstanceType(t)
+		if _, ok := drivers[instanceType]; ok {
+			continue
+		}
+
+		d, err := newDriver(config, instanceType, logger)
+		if err != nil {
+			logger.Warn("instance type unavailable: failed to initialize its driver",
+				zap.String("type", t),
+				zap.Error(err),
+			)
+			continue
+		}
+		drivers[instanceType] = d
+	}
+
+	if len(drivers) == 0 {
+		logger.Error("no compute driver could be initialized; the node cannot run instances",
+			zap.Strings("configured_types", config.SupportedInstanceTypes),
+		)
+	}
+	return drivers
+}
+
+func newDriver(config Config, t driver.InstanceType, logger *zap.Logger) (driver.Driver, error) {
+	switch t {
+	case driver.InstanceTypeVM:
+		switch config.VMDriver {
+		case "", "libvirt":
+			return libvirt.New(config.Libvirt, logger.Named("libvirt"))
+		case "qemu":
+			return qemu.New(config.Qemu, logger.Named("qemu"))
+		default:
+			return nil, fmt.Errorf("unknown vm driver %q", config.VMDriver)
+		}
+	case driver.InstanceTypeContainer:
+		return containerd.New(config.Containerd, logger.Named("containerd"))
+	case driver.InstanceTypeMicroVM:
+		return firecracker.New(config.Firecracker, logger.Named("firecracker"))
+	default:
+		return nil, fmt.Errorf("unknown instance type %q", t)
+	}
+}
+
+// vmImagePath returns the image directory of the configured VM driver.
+func (c *Config) vmImagePath() string {
+	if c.VMDriver == "qemu" {
+		return c.Qemu.ImagePath
+	}
+	return c.Libvirt.ImagePath
+}
+
+// supportedInstanceTypes returns the instance types whose driver is
+// running, in the configured order.
+func (a *Agent) supportedInstanceTypes() []registry.InstanceType {
+	types := make([]registry.InstanceType, 0, len(a.drivers))
+	seen := make(map[driver.InstanceType]bool, len(a.drivers))
+	for _, t := range a.config.SupportedInstanceTypes {
+		instanceType := driver.InstanceType(t)
+		if _, ok := a.drivers[instanceType]; ok && !seen[instanceType] {
+			seen[instanceType] = true
+			types = append(types, registry.InstanceType(t))
+		}
+	}
+	return types
+}
+
+// driverCapabilities returns the optional operations of each running
+// driver, keyed by the instance type it handles.
+func (a *Agent) driverCapabilities() map[registry.InstanceType]registry.InstanceCapabilities {
+	caps := make(map[registry.InstanceType]registry.InstanceCapabilities, len(a.drivers))
+	for t, d := range a.drivers {
+		caps[registry.InstanceType(t)] = registry.DriverCapabilities(d.Name(), d.Capabilities())
+	}
+	return caps
+}
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+
+	"hypervisor/pkg/compute/driver"
+)
+
+// gpuPool hands out the node's GPUs to instances. Which GPU an instance
+// holds is recovered from the PCI devices its driver reports, so the pool
+// only tracks assignments of creates still in progress.
+type gpuPool struct {
+	gpus []driver.HostGPU
+
+	mu      sync.Mutex
+	pending map[string]string // PCI address -> instance ID
+}
+
+func newGPUPool(gpus []driver.HostGPU) *gpuPool {
+	return &gpuPool{gpus: gpus, pending: make(map[string]string)}
+}
+
+// assignable returns how many of the node's GPUs can be passed through.
+func (p *gpuPool) assignable() int {
+	n := 0
+	for _, gpu := range p.gpus {
+		if gpu.Assignable() {
+			n++
+		}
+	}
+	return n
+}
+
+// assign picks free GPUs matching the spec's request and records them in
+// spec.GPUDevices. The returned release drops the pending assignment once
+// the instance reports the devices itself or its create failed.
+func (p *gpuPool) assign(spec *driver.InstanceSpec, inUse map[string]string) (func(), error) {
+	spec.GPUDevices = nil
+	if spec.GPU.Count == 0 {
+		return func() {}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var picked []string
+	for _, gpu := range p.gpus {
+		if len(picked) == spec.GPU.Count {
+			break
+		}
+		if !gpu.Assignable() || !spec.GPU.Matches(gpu) {
+			continue
+		}
+		if _, ok := inUse[gpu.Address]; ok {
+			continue
+		}
+		if _, ok := p.pending[gpu.Address]; ok {
+			continue
+		}
+		picked = append(picked, gpu.Address)
+	}
+	if len(picked) < spec.GPU.Count {
+		return nil, fmt.Errorf("need %d free gpus matching the request, node has %d", spec.GPU.Count, len(picked))
+	}
+
+	for _, addr := range picked {
+		p.pending[addr] = spec.InstanceID
+	}
+	spec.GPUDevices = picked
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, addr := range picked {
+			delete(p.pending, addr)
+		}
+	}, nil
+}
+
+// status returns the node's GPUs with the instance each is assigned to.
+func (p *gpuPool) status(inUse map[string]string) []driver.HostGPU {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	gpus := make([]driver.HostGPU, len(p.gpus))
+	copy(gpus, p.gpus)
+	for i := range gpus {
+		if id, ok := inUse[gpus[i].Address]; ok {
+			gpus[i].InstanceID = id
+		} else if id, ok := p.pending[gpus[i].Address]; ok {
+			gpus[i].InstanceID = id
+		}
+	}
+	return gpus
+}
+
+// gpusInUse maps the PCI address of every GPU an instance holds to the
+// instance.
+func (a *Agent) gpusInUse() map[string]string {
+	a.instancesMu.RLock()
+	defer a.instancesMu.RUnlock()
+
+	inUse := make(map[string]string)
+	for _, instance := range a.instances {
+		for _, addr := range instance.Spec.GPUDevices {
+			inUse[addr] = instance.ID
+		}
+	}
+	return inUse
+}
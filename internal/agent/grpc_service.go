@@ -1,11 +1,17 @@
 package agent
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/apiconv"
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/registry"
 	"hypervisor/pkg/compute/driver"
 
 	"google.golang.org/grpc/codes"
@@ -27,34 +33,80 @@ func NewAgentGRPCService(agent *Agent) *AgentGRPCService {
 	}
 }
 
+// unsupported returns the error for an operation the driver of an instance
+// cannot do, naming the driver so clients can tell which instances it
+// affects.
+func (s *AgentGRPCService) unsupported(instanceID, operation string, err error) error {
+	name := ""
+	if d, derr := s.agent.driverFor(instanceID); derr == nil {
+		name = d.Name()
+	}
+	return apierror.Unsupported(name, operation, err.Error())
+}
+
 // CreateInstance creates an instance on this agent.
 func (s *AgentGRPCService) CreateInstance(ctx context.Context, req *v1.AgentCreateInstanceRequest) (*v1.Instance, error) {
+	if s.agent.cordoned.Load() {
+		return nil, status.Errorf(codes.FailedPrecondition, "node is cordoned")
+	}
+
 	// Convert proto spec to driver spec
 	spec := protoSpecToDriverSpec(req.Spec)
+	spec.InstanceID = req.InstanceId
+	spec.Name = req.Name
 
 	// Get instance type
 	instanceType := protoTypeToDriverType(req.Type)
 
-	// Create instance using agent
-	instance, err := s.agent.CreateInstance(ctx, spec, instanceType)
+	// Serialize on the server-assigned ID so a racing delete waits for
+	// the create to finish
+	key := req.InstanceId
+	if key == "" {
+		key = req.Name
+	}
+
+	var instance *driver.Instance
+	err := s.agent.workQueue.Do(ctx, key, opCreate, func(ctx context.Context) error {
+		created, err := s.agent.CreateInstance(ctx, spec, instanceType)
+		if err != nil {
+			return err
+		}
+
+		// Bind the SDN port to the device the driver plugged in
+		instanceID := req.InstanceId
+		if instanceID == "" {
+			instanceID = created.ID
+		}
+		if err := s.agent.bindPort(ctx, instanceID, created.Spec.Network); err != nil {
+			s.agent.discardInstance(ctx, instanceType, created.ID)
+			return err
+		}
+
+		// Override ID if provided by server and re-key the local cache
+		s.agent.instancesMu.Lock()
+		delete(s.agent.instances, created.ID)
+		if req.InstanceId != "" {
+			created.ID = req.InstanceId
+		}
+		created.Name = req.Name
+		created.Metadata = req.Labels
+		s.agent.instances[created.ID] = created
+		s.agent.instancesMu.Unlock()
+
+		instance = created
+		return nil
+	})
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create instance: %v", err)
 	}
-
-	// Override ID if provided by server
-	if req.InstanceId != "" {
-		instance.ID = req.InstanceId
+	if instance == nil {
+		// Deduplicated into a concurrent create of the same instance
+		if instance, err = s.agent.GetInstance(ctx, key); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get instance after create: %v", err)
+		}
 	}
-	instance.Name = req.Name
-	instance.Metadata = req.Labels
-
-	// Update local cache with correct ID
-	s.agent.instancesMu.Lock()
-	delete(s.agent.instances, instance.ID)
-	s.agent.instances[instance.ID] = instance
-	s.agent.instancesMu.Unlock()
 
-	return driverInstanceToProto(instance, s.agent.nodeID), nil
+	return s.instanceToProto(instance), nil
 }
 
 // DeleteInstance deletes an instance on this agent.
@@ -84,7 +136,7 @@ func (s *AgentGRPCService) StartInstance(ctx context.Context, req *v1.AgentInsta
 		return nil, status.Errorf(codes.Internal, "failed to get instance after start: %v", err)
 	}
 
-	return driverInstanceToProto(instance, s.agent.nodeID), nil
+	return s.instanceToProto(instance), nil
 }
 
 // StopInstance stops an instance on this agent.
@@ -102,33 +154,95 @@ func (s *AgentGRPCService) StopInstance(ctx context.Context, req *v1.AgentStopIn
 		return nil, status.Errorf(codes.Internal, "failed to get instance after stop: %v", err)
 	}
 
-	return driverInstanceToProto(instance, s.agent.nodeID), nil
+	return s.instanceToProto(instance), nil
 }
 
 // RestartInstance restarts an instance on this agent.
 func (s *AgentGRPCService) RestartInstance(ctx context.Context, req *v1.AgentRestartInstanceRequest) (*v1.Instance, error) {
-	// Get instance to find driver
-	instance, err := s.agent.getInstance(req.InstanceId)
+	if err := s.agent.RestartInstance(ctx, req.InstanceId, req.Force); err != nil {
+		if err == driver.ErrInstanceNotFound {
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceId)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to restart instance: %v", err)
+	}
+
+	// Get updated instance
+	updated, err := s.agent.GetInstance(ctx, req.InstanceId)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceId)
+		return nil, status.Errorf(codes.Internal, "failed to get instance after restart: %v", err)
 	}
 
-	d, ok := s.agent.drivers[instance.Type]
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "unsupported instance type: %s", instance.Type)
+	return s.instanceToProto(updated), nil
+}
+
+// ResizeInstance changes the CPU and memory of an instance on this agent.
+func (s *AgentGRPCService) ResizeInstance(ctx context.Context, req *v1.AgentResizeInstanceRequest) (*v1.AgentResizeInstanceResponse, error) {
+	if req.CpuCores < 0 || req.MemoryBytes < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "cpu_cores and memory_bytes cannot be negative")
 	}
 
-	if err := d.Restart(ctx, req.InstanceId, req.Force); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to restart instance: %v", err)
+	restarted, err := s.agent.ResizeInstance(ctx, req.InstanceId, int(req.CpuCores), req.MemoryBytes/(1024*1024), ResizeOptions{
+		AllowRestart: req.AllowRestart,
+		Force:        req.Force,
+		StopTimeout:  time.Duration(req.TimeoutSeconds) * time.Second,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, driver.ErrInstanceNotFound):
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceId)
+		case errors.Is(err, driver.ErrRestartRequired):
+			return nil, status.Errorf(codes.FailedPrecondition, "instance %s cannot be resized while running: %v", req.InstanceId, err)
+		case errors.Is(err, driver.ErrNotSupported):
+			return nil, s.unsupported(req.InstanceId, "resize", err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to resize instance: %v", err)
 	}
 
-	// Get updated instance
-	updated, err := s.agent.GetInstance(ctx, req.InstanceId)
+	instance, err := s.agent.GetInstance(ctx, req.InstanceId)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to get instance after restart: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to get instance after resize: %v", err)
 	}
 
-	return driverInstanceToProto(updated, s.agent.nodeID), nil
+	return &v1.AgentResizeInstanceResponse{
+		Instance:  s.instanceToProto(instance),
+		Restarted: restarted,
+	}, nil
+}
+
+// PauseInstance freezes an instance on this agent in memory.
+func (s *AgentGRPCService) PauseInstance(ctx context.Context, req *v1.AgentInstanceRequest) (*v1.Instance, error) {
+	return s.pauseOp(ctx, req.InstanceId, "pause", s.agent.PauseInstance)
+}
+
+// ResumeInstance continues a paused or suspended instance on this agent.
+func (s *AgentGRPCService) ResumeInstance(ctx context.Context, req *v1.AgentInstanceRequest) (*v1.Instance, error) {
+	return s.pauseOp(ctx, req.InstanceId, "resume", s.agent.ResumeInstance)
+}
+
+// SuspendInstance saves an instance's memory to disk and stops it.
+func (s *AgentGRPCService) SuspendInstance(ctx context.Context, req *v1.AgentInstanceRequest) (*v1.Instance, error) {
+	return s.pauseOp(ctx, req.InstanceId, "suspend", s.agent.SuspendInstance)
+}
+
+// pauseOp runs a pause, resume or suspend and returns the updated instance.
+func (s *AgentGRPCService) pauseOp(ctx context.Context, id, name string, op func(context.Context, string) error) (*v1.Instance, error) {
+	if err := op(ctx, id); err != nil {
+		switch {
+		case errors.Is(err, driver.ErrInstanceNotFound):
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", id)
+		case errors.Is(err, driver.ErrInstanceStopped):
+			return nil, status.Errorf(codes.FailedPrecondition, "cannot %s instance %s: %v", name, id, err)
+		case errors.Is(err, driver.ErrNotSupported):
+			return nil, s.unsupported(id, name, err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to %s instance: %v", name, err)
+	}
+
+	instance, err := s.agent.GetInstance(ctx, id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get instance after %s: %v", name, err)
+	}
+	return s.instanceToProto(instance), nil
 }
 
 // GetInstance retrieves an instance from this agent.
@@ -141,7 +255,7 @@ func (s *AgentGRPCService) GetInstance(ctx context.Context, req *v1.AgentInstanc
 		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
 	}
 
-	return driverInstanceToProto(instance, s.agent.nodeID), nil
+	return s.instanceToProto(instance), nil
 }
 
 // ListInstances lists all instances on this agent.
@@ -153,7 +267,7 @@ func (s *AgentGRPCService) ListInstances(ctx context.Context, _ *emptypb.Empty)
 
 	protoInstances := make([]*v1.Instance, len(instances))
 	for i, instance := range instances {
-		protoInstances[i] = driverInstanceToProto(instance, s.agent.nodeID)
+		protoInstances[i] = s.instanceToProto(instance)
 	}
 
 	return &v1.AgentListInstancesResponse{
@@ -181,6 +295,102 @@ func (s *AgentGRPCService) GetInstanceStats(ctx context.Context, req *v1.AgentIn
 	return driverStatsToProto(stats), nil
 }
 
+// BatchGetInstanceStats retrieves statistics for several instances on this
+// agent in one call. Per-instance failures are reported in the results.
+func (s *AgentGRPCService) BatchGetInstanceStats(ctx context.Context, req *v1.AgentBatchGetInstanceStatsRequest) (*v1.BatchGetInstanceStatsResponse, error) {
+	resp := &v1.BatchGetInstanceStatsResponse{}
+	for _, result := range s.agent.BatchInstanceStats(ctx, req.InstanceIds) {
+		item := &v1.InstanceStatsResult{
+			InstanceId: result.InstanceID,
+			NodeId:     s.agent.nodeID,
+		}
+		if result.Err != nil {
+			item.Error = result.Err.Error()
+		} else {
+			item.Stats = driverStatsToProto(result.Stats)
+		}
+		resp.Results = append(resp.Results, item)
+	}
+	return resp, nil
+}
+
+// StreamInstanceStats streams stats samples for an instance as the agent
+// collects them, optionally preceded by the recent history.
+func (s *AgentGRPCService) StreamInstanceStats(req *v1.StreamInstanceStatsRequest, stream v1.AgentService_StreamInstanceStatsServer) error {
+	if _, err := s.agent.getInstance(req.InstanceId); err != nil {
+		return status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceId)
+	}
+
+	// Subscribe before sending history so no sample falls in between
+	samples, cancel := s.agent.stats.Subscribe(req.InstanceId)
+	defer cancel()
+
+	if req.IncludeHistory {
+		for _, sample := range s.agent.stats.History(req.InstanceId) {
+			if err := stream.Send(statsSampleToProto(sample)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case sample := <-samples:
+			if err := stream.Send(statsSampleToProto(sample)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// GetInstanceUsage returns the usage summaries of instances for right-sizing.
+// Instances without collected samples are left out.
+func (s *AgentGRPCService) GetInstanceUsage(ctx context.Context, req *v1.AgentGetInstanceUsageRequest) (*v1.AgentGetInstanceUsageResponse, error) {
+	resp := &v1.AgentGetInstanceUsageResponse{}
+	for _, id := range req.InstanceIds {
+		usage, ok := s.agent.stats.Usage(id)
+		if !ok {
+			continue
+		}
+		resp.Usage = append(resp.Usage, usageToProto(usage))
+	}
+	return resp, nil
+}
+
+// PullImage pulls an image into the node's cache, streaming progress.
+func (s *AgentGRPCService) PullImage(req *v1.PullImageRequest, stream v1.AgentService_PullImageServer) error {
+	if req.ImageRef == "" {
+		return status.Error(codes.InvalidArgument, "image_ref is required")
+	}
+
+	var sendErr error
+	image, err := s.agent.PullImage(stream.Context(), protoTypeToDriverType(req.Type), req.ImageRef, func(p driver.PullProgress) {
+		if sendErr == nil {
+			sendErr = stream.Send(&v1.PullImageProgress{
+				Status:  p.Status,
+				Current: p.Current,
+				Total:   p.Total,
+			})
+		}
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to pull image: %v", err)
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+
+	return stream.Send(&v1.PullImageProgress{
+		Status:    "completed",
+		Current:   image.SizeBytes,
+		Total:     image.SizeBytes,
+		Completed: true,
+		Image:     image.Ref,
+	})
+}
+
 // AttachConsole attaches to an instance console (bidirectional streaming).
 func (s *AgentGRPCService) AttachConsole(stream v1.AgentService_AttachConsoleServer) error {
 	// Read first message to get instance ID
@@ -206,6 +416,9 @@ func (s *AgentGRPCService) AttachConsole(stream v1.AgentService_AttachConsoleSer
 	if !ok {
 		return status.Errorf(codes.Internal, "unsupported instance type: %s", instance.Type)
 	}
+	if !d.Capabilities().Console {
+		return apierror.Unsupported(d.Name(), "console", fmt.Sprintf("console is not supported by driver %s", d.Name()))
+	}
 
 	// Attach to console
 	conn, err := d.Attach(stream.Context(), instanceID, driver.AttachOptions{
@@ -215,6 +428,9 @@ func (s *AgentGRPCService) AttachConsole(stream v1.AgentService_AttachConsoleSer
 		Stderr: true,
 	})
 	if err != nil {
+		if errors.Is(err, driver.ErrNotSupported) {
+			return apierror.Unsupported(d.Name(), "console", fmt.Sprintf("console is not supported by driver %s", d.Name()))
+		}
 		return status.Errorf(codes.Internal, "failed to attach to console: %v", err)
 	}
 	defer conn.Close()
@@ -278,6 +494,210 @@ func (s *AgentGRPCService) AttachConsole(stream v1.AgentService_AttachConsoleSer
 	return nil
 }
 
+// defaultDiagnosticsLines is how many serial output lines boot diagnostics
+// return when the request does not say.
+const defaultDiagnosticsLines = 100
+
+// GetBootDiagnostics returns a screenshot and the end of the serial console
+// of an instance on this agent.
+func (s *AgentGRPCService) GetBootDiagnostics(ctx context.Context, req *v1.AgentGetBootDiagnosticsRequest) (*v1.BootDiagnostics, error) {
+	lines := int(req.Lines)
+	if lines <= 0 {
+		lines = defaultDiagnosticsLines
+	}
+
+	diag, err := s.agent.BootDiagnostics(ctx, req.InstanceId, lines)
+	if err != nil {
+		switch {
+		case errors.Is(err, driver.ErrInstanceNotFound):
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceId)
+		case errors.Is(err, driver.ErrNotSupported):
+			return nil, s.unsupported(req.InstanceId, "boot-diagnostics", err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to collect boot diagnostics: %v", err)
+	}
+
+	return &v1.BootDiagnostics{
+		InstanceId:       req.InstanceId,
+		NodeId:           s.agent.nodeID,
+		Screenshot:       diag.Screenshot,
+		ScreenshotFormat: diag.ScreenshotFormat,
+		SerialOutput:     diag.SerialOutput,
+		CollectedAt:      timestamppb.New(diag.CollectedAt),
+	}, nil
+}
+
+// GetInstanceLogs streams the log of an instance on this agent.
+func (s *AgentGRPCService) GetInstanceLogs(req *v1.GetInstanceLogsRequest, stream v1.AgentService_GetInstanceLogsServer) error {
+	if req.TailLines < 0 {
+		return status.Errorf(codes.InvalidArgument, "tail_lines cannot be negative")
+	}
+
+	path, err := s.agent.InstanceLogPath(stream.Context(), req.InstanceId)
+	if err != nil {
+		switch {
+		case errors.Is(err, driver.ErrInstanceNotFound):
+			return status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceId)
+		case errors.Is(err, driver.ErrNotSupported):
+			return s.unsupported(req.InstanceId, "logs", err)
+		}
+		return status.Errorf(codes.Internal, "failed to get instance log: %v", err)
+	}
+
+	gone := func() bool {
+		_, err := s.agent.getInstance(req.InstanceId)
+		return err != nil
+	}
+	send := func(data []byte) error {
+		return stream.Send(&v1.InstanceLogChunk{Data: data})
+	}
+	if err := streamLog(stream.Context(), path, int(req.TailLines), req.Follow, gone, send); err != nil {
+		return status.Errorf(codes.Internal, "failed to stream instance log: %v", err)
+	}
+	return nil
+}
+
+// CollectSupportBundle streams a support bundle of this node.
+func (s *AgentGRPCService) CollectSupportBundle(req *v1.CollectSupportBundleRequest, stream v1.AgentService_CollectSupportBundleServer) error {
+	if req.LogSinceSeconds < 0 {
+		return status.Errorf(codes.InvalidArgument, "log_since_seconds cannot be negative")
+	}
+
+	w := bufio.NewWriterSize(streamWriter(func(data []byte) error {
+		return stream.Send(&v1.SupportBundleChunk{Data: data})
+	}), logChunkSize)
+	logSince := time.Duration(req.LogSinceSeconds) * time.Second
+	if err := s.agent.WriteSupportBundle(stream.Context(), w, logSince); err != nil {
+		return status.Errorf(codes.Internal, "failed to collect support bundle: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	s.agent.logger.Info("support bundle collected")
+	return nil
+}
+
+// streamWriter is an io.Writer sending each write as a message.
+type streamWriter func(data []byte) error
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	if err := w(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// GetHealth returns the last results of the agent's health checks.
+func (s *AgentGRPCService) GetHealth(ctx context.Context, _ *emptypb.Empty) (*v1.ComponentHealth, error) {
+	resp := &v1.ComponentHealth{
+		Component: "agent",
+		Name:      s.agent.nodeID,
+		Healthy:   true,
+	}
+	for _, result := range s.agent.health.Results() {
+		check := &v1.HealthCheck{
+			Name:    result.Name,
+			Healthy: result.Healthy,
+			Message: result.Message,
+		}
+		if !result.CheckedAt.IsZero() {
+			check.CheckedAt = timestamppb.New(result.CheckedAt)
+		}
+		resp.Checks = append(resp.Checks, check)
+		resp.Healthy = resp.Healthy && result.Healthy
+	}
+	return resp, nil
+}
+
+// CheckMigrationTarget runs the host-local checks for migrating an
+// instance to this node.
+func (s *AgentGRPCService) CheckMigrationTarget(ctx context.Context, req *v1.AgentCheckMigrationTargetRequest) (*v1.AgentCheckMigrationTargetResponse, error) {
+	if req.Spec == nil {
+		return nil, status.Error(codes.InvalidArgument, "spec is required")
+	}
+
+	resp := &v1.AgentCheckMigrationTargetResponse{}
+	for _, check := range s.agent.CheckMigrationTarget(protoSpecToDriverSpec(req.Spec)) {
+		resp.Checks = append(resp.Checks, &v1.MigrationCheck{
+			Name:    check.Name,
+			Passed:  check.Passed,
+			Message: check.Message,
+		})
+	}
+	return resp, nil
+}
+
+// MigrateInstance live migrates an instance on this agent to another node.
+func (s *AgentGRPCService) MigrateInstance(ctx context.Context, req *v1.AgentMigrateInstanceRequest) (*emptypb.Empty, error) {
+	if req.TargetNodeId == "" || req.TargetHost == "" {
+		return nil, status.Error(codes.InvalidArgument, "target node and host are required")
+	}
+
+	if err := s.agent.MigrateInstance(ctx, req.InstanceId, req.TargetNodeId, req.TargetHost); err != nil {
+		switch {
+		case errors.Is(err, driver.ErrInstanceNotFound):
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceId)
+		case errors.Is(err, driver.ErrNotSupported):
+			return nil, s.unsupported(req.InstanceId, "migrate", err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to migrate instance: %v", err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// TraceNetworkProbe traces a probe packet through this node's flow tables
+// for a connectivity check.
+func (s *AgentGRPCService) TraceNetworkProbe(ctx context.Context, req *v1.AgentTraceNetworkProbeRequest) (*v1.AgentTraceNetworkProbeResponse, error) {
+	if s.agent.sdn == nil {
+		return nil, status.Error(codes.FailedPrecondition, "overlay network is not set up on this node")
+	}
+	if req.DstIp == "" {
+		return nil, status.Error(codes.InvalidArgument, "dst_ip is required")
+	}
+
+	resp, err := s.agent.traceNetworkProbe(ctx, req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return resp, nil
+}
+
+// GetPortStats reads the traffic counters of a port bound to this node, for
+// the server to serve.
+func (s *AgentGRPCService) GetPortStats(ctx context.Context, req *v1.AgentGetPortStatsRequest) (*v1.PortStats, error) {
+	var ports *networkAgent
+	if sdn := s.agent.sdn; sdn != nil {
+		sdn.mu.Lock()
+		ports = sdn.ports
+		sdn.mu.Unlock()
+	}
+	if ports == nil {
+		return nil, status.Error(codes.FailedPrecondition, "overlay network is not set up on this node")
+	}
+
+	stats, err := ports.stats(req.PortId)
+	if errors.Is(err, errNoPortCounters) {
+		return nil, status.Errorf(codes.NotFound, "%v: %s", err, req.PortId)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &v1.PortStats{
+		PortId:    stats.PortID,
+		NodeId:    stats.NodeID,
+		RxPackets: stats.RxPackets,
+		TxPackets: stats.TxPackets,
+		RxBytes:   stats.RxBytes,
+		TxBytes:   stats.TxBytes,
+		RxDropped: stats.RxDropped,
+		TxDropped: stats.TxDropped,
+		RxErrors:  stats.RxErrors,
+		TxErrors:  stats.TxErrors,
+		UpdatedAt: timestamppb.New(stats.UpdatedAt),
+	}, nil
+}
+
 // ============================================================================
 // Conversion helpers
 // ============================================================================
@@ -304,10 +724,11 @@ func protoSpecToDriverSpec(spec *v1.InstanceSpec) *driver.InstanceSpec {
 		ds.Disks = make([]driver.DiskSpec, len(spec.Disks))
 		for i, d := range spec.Disks {
 			ds.Disks[i] = driver.DiskSpec{
-				Name:   d.Name,
-				SizeGB: d.SizeBytes / (1024 * 1024 * 1024),
-				Type:   d.Type,
-				Boot:   d.Boot,
+				Name:       d.Name,
+				SizeGB:     d.SizeBytes / (1024 * 1024 * 1024),
+				Type:       d.Type,
+				SourcePath: d.SourcePath,
+				Boot:       d.Boot,
 			}
 		}
 	}
@@ -319,6 +740,11 @@ func protoSpecToDriverSpec(spec *v1.InstanceSpec) *driver.InstanceSpec {
 			SubnetID:       spec.Network.SubnetId,
 			SecurityGroups: spec.Network.SecurityGroups,
 			AssignPublicIP: spec.Network.AssignPublicIp,
+			IPAddress:      spec.Network.IpAddress,
+			MACAddress:     spec.Network.MacAddress,
+			PortID:         spec.Network.PortId,
+			BindingType:    driver.PortBindingType(spec.Network.BindingType),
+			VFAddress:      spec.Network.VfAddress,
 		}
 	}
 
@@ -333,6 +759,32 @@ func protoSpecToDriverSpec(spec *v1.InstanceSpec) *driver.InstanceSpec {
 		}
 	}
 
+	// Convert CPU
+	if spec.Cpu != nil {
+		ds.CPU = driver.CPUSpec{
+			Mode:             driver.CPUMode(spec.Cpu.Mode),
+			Model:            spec.Cpu.Model,
+			RequiredFeatures: spec.Cpu.RequiredFeatures,
+			DisabledFeatures: spec.Cpu.DisabledFeatures,
+		}
+	}
+	ds.HugePages = spec.Hugepages
+	ds.Architecture = spec.Architecture
+	ds.Runtime = spec.Runtime
+	ds.UserData = spec.UserData
+	ds.SSHKeys = spec.SshKeys
+	if spec.Gpu != nil {
+		ds.GPU = driver.GPURequest{
+			Count:    int(spec.Gpu.Count),
+			Vendor:   spec.Gpu.Vendor,
+			DeviceID: spec.Gpu.DeviceId,
+		}
+	}
+	ds.GPUDevices = spec.GpuDevices
+	ds.CPUPlacement = apiconv.CPUPlacementFromProto(spec.CpuPlacement)
+	ds.PinnedCPUs = apiconv.Ints(spec.PinnedCpus)
+	ds.NUMANodes = apiconv.Ints(spec.NumaNodes)
+
 	return ds
 }
 
@@ -373,7 +825,9 @@ func driverStateToProto(s driver.InstanceState) v1.InstanceState {
 	case driver.StateStopped:
 		return v1.InstanceState_INSTANCE_STATE_STOPPED
 	case driver.StatePaused:
-		return v1.InstanceState_INSTANCE_STATE_STOPPED
+		return v1.InstanceState_INSTANCE_STATE_PAUSED
+	case driver.StateSuspended:
+		return v1.InstanceState_INSTANCE_STATE_SUSPENDED
 	case driver.StateFailed:
 		return v1.InstanceState_INSTANCE_STATE_FAILED
 	default:
@@ -381,6 +835,19 @@ func driverStateToProto(s driver.InstanceState) v1.InstanceState {
 	}
 }
 
+// instanceToProto converts an instance and adds the capabilities of the
+// driver running it.
+func (s *AgentGRPCService) instanceToProto(instance *driver.Instance) *v1.Instance {
+	proto := driverInstanceToProto(instance, s.agent.nodeID)
+	if proto == nil {
+		return nil
+	}
+	if d, ok := s.agent.drivers[instance.Type]; ok {
+		proto.Capabilities = apiconv.CapabilitiesToProto(registry.DriverCapabilities(d.Name(), d.Capabilities()))
+	}
+	return proto
+}
+
 func driverInstanceToProto(instance *driver.Instance, nodeID string) *v1.Instance {
 	if instance == nil {
 		return nil
@@ -403,15 +870,27 @@ func driverInstanceToProto(instance *driver.Instance, nodeID string) *v1.Instanc
 
 	// Convert spec
 	proto.Spec = &v1.InstanceSpec{
-		Image:       instance.Spec.Image,
-		CpuCores:    int32(instance.Spec.CPUCores),
-		MemoryBytes: instance.Spec.MemoryMB * 1024 * 1024,
-		Kernel:      instance.Spec.Kernel,
-		Initrd:      instance.Spec.Initrd,
-		KernelArgs:  instance.Spec.KernelArgs,
-		Command:     instance.Spec.Command,
-		Args:        instance.Spec.Args,
-		Env:         instance.Spec.Env,
+		Image:        instance.Spec.Image,
+		CpuCores:     int32(instance.Spec.CPUCores),
+		MemoryBytes:  instance.Spec.MemoryMB * 1024 * 1024,
+		Kernel:       instance.Spec.Kernel,
+		Initrd:       instance.Spec.Initrd,
+		KernelArgs:   instance.Spec.KernelArgs,
+		Command:      instance.Spec.Command,
+		Args:         instance.Spec.Args,
+		Env:          instance.Spec.Env,
+		GpuDevices:   instance.Spec.GPUDevices,
+		CpuPlacement: apiconv.CPUPlacementToProto(instance.Spec.CPUPlacement),
+		PinnedCpus:   apiconv.Int32s(instance.Spec.PinnedCPUs),
+		NumaNodes:    apiconv.Int32s(instance.Spec.NUMANodes),
+		Runtime:      instance.Spec.Runtime,
+	}
+	if gpu := instance.Spec.GPU; gpu.Count > 0 {
+		proto.Spec.Gpu = &v1.GPURequest{
+			Count:    int32(gpu.Count),
+			Vendor:   gpu.Vendor,
+			DeviceId: gpu.DeviceID,
+		}
 	}
 
 	// Convert metadata
@@ -442,3 +921,27 @@ func driverStatsToProto(stats *driver.InstanceStats) *v1.InstanceStats {
 		CollectedAt:      timestamppb.New(stats.CollectedAt),
 	}
 }
+
+func usageToProto(usage InstanceUsage) *v1.InstanceUsage {
+	return &v1.InstanceUsage{
+		InstanceId:     usage.InstanceID,
+		Points:         int32(usage.Points),
+		WindowStart:    timestamppb.New(usage.WindowStart),
+		WindowEnd:      timestamppb.New(usage.WindowEnd),
+		CpuP95Percent:  usage.CPUP95Percent,
+		CpuMaxPercent:  usage.CPUMaxPercent,
+		MemoryP95Bytes: int64(usage.MemoryP95Bytes),
+		MemoryMaxBytes: int64(usage.MemoryMaxBytes),
+	}
+}
+
+func statsSampleToProto(sample StatsSample) *v1.InstanceStatsSample {
+	return &v1.InstanceStatsSample{
+		Stats:                driverStatsToProto(&sample.Stats),
+		CpuPercent:           sample.CPUPercent,
+		DiskReadBytesPerSec:  sample.DiskReadBytesPerSec,
+		DiskWriteBytesPerSec: sample.DiskWriteBytesPerSec,
+		NetworkRxBytesPerSec: sample.NetworkRxBytesPerSec,
+		NetworkTxBytesPerSec: sample.NetworkTxBytesPerSec,
+	}
+}
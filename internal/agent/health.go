@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/health"
+)
+
+// newHealthChecker creates the checker of what the agent needs to serve:
+// etcd, which the agent service cannot work without, each driver and the
+// overlay network.
+func (a *Agent) newHealthChecker() *health.Checker {
+	checker := health.NewChecker(a.config.Health, a.logger.Named("health"))
+	checker.AddCheck("etcd", a.etcdClient.Ping, v1.AgentService_ServiceDesc.ServiceName)
+
+	for instanceType, d := range a.drivers {
+		checker.AddCheck("driver."+string(instanceType), func(ctx context.Context) error {
+			if _, err := d.List(ctx); err != nil {
+				return fmt.Errorf("%s driver: %w", d.Name(), err)
+			}
+			return nil
+		})
+	}
+
+	if a.config.Network.Enabled {
+		checker.AddCheck("sdn", a.sdnHealth)
+	}
+	return checker
+}
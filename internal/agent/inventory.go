@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// InventoryConfig configures the host inventory reported with the node.
+type InventoryConfig struct {
+	// DiskPaths are the directories instance images and disks are stored
+	// under. The node's disk capacity is the size of the filesystems they
+	// are on, each counted once. Defaults to the libvirt image path.
+	DiskPaths []string `mapstructure:"disk_paths"`
+
+	// Refresh configures how often the inventory is collected again, to
+	// pick up added memory, CPUs brought online or grown filesystems.
+	Refresh LoopConfig `mapstructure:"refresh"`
+}
+
+// DefaultInventoryConfig returns the default inventory configuration.
+func DefaultInventoryConfig() InventoryConfig {
+	return InventoryConfig{
+		Refresh: LoopConfig{
+			Interval:   5 * time.Minute,
+			Jitter:     0.2,
+			MaxBackoff: 30 * time.Minute,
+		},
+	}
+}
+
+// diskPaths returns the configured disk paths, or the VM image path.
+func (a *Agent) diskPaths() []string {
+	if len(a.config.Inventory.DiskPaths) > 0 {
+		return a.config.Inventory.DiskPaths
+	}
+	if path := a.config.vmImagePath(); path != "" {
+		return []string{path}
+	}
+	return nil
+}
+
+// collectInventory returns the host's capacity and inventory. CPU and
+// memory come from /proc and /sys, falling back to a driver's host
+// information; it fails if the memory size cannot be determined at all.
+// Disk capacity is zero if none of the disk paths can be read.
+func (a *Agent) collectInventory(ctx context.Context) (registry.Resources, *registry.HostInventory, error) {
+	var resources registry.Resources
+	resources.CPUCores = onlineCPUs()
+	resources.MemoryBytes = memTotal()
+
+	if resources.MemoryBytes == 0 {
+		for _, d := range a.drivers {
+			hostDriver, ok := d.(driver.HostDriver)
+			if !ok {
+				continue
+			}
+			if info, err := hostDriver.GetHostInfo(ctx); err == nil && info.MemoryBytes > 0 {
+				resources.CPUCores = info.CPUCores
+				resources.MemoryBytes = info.MemoryBytes
+				break
+			}
+		}
+	}
+	if resources.MemoryBytes == 0 {
+		return registry.Resources{}, nil, fmt.Errorf("failed to determine host memory from /proc/meminfo or a driver")
+	}
+
+	inventory := &registry.HostInventory{
+		Architecture: driver.HostArchitecture(),
+		OSImage:      osImage(),
+	}
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err == nil {
+		// A 32-bit agent can run on a 64-bit kernel; the kernel's machine
+		// is what guests run on
+		machine := unix.ByteSliceToString(uname.Machine[:])
+		if arch, err := driver.ParseArchitecture(machine); err == nil {
+			inventory.Architecture = arch
+		} else {
+			inventory.Architecture = machine
+		}
+		inventory.KernelVersion = unix.ByteSliceToString(uname.Release[:])
+	}
+
+	_, err := os.Stat("/dev/kvm")
+	inventory.KVM = err == nil
+	if cpu := detectHostCPU(); cpu != nil {
+		switch {
+		case cpu.HasFeature("vmx"):
+			inventory.Virtualization = "vmx"
+		case cpu.HasFeature("svm"):
+			inventory.Virtualization = "svm"
+		}
+	}
+	inventory.NestedVirtualization = nestedVirtualization()
+	inventory.VhostUser = a.vhostUserSupported()
+
+	seen := make(map[uint64]bool)
+	for _, path := range a.diskPaths() {
+		fs, dev, err := statFilesystem(path)
+		if err != nil {
+			a.logger.Debug("failed to stat disk path", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		inventory.Filesystems = append(inventory.Filesystems, fs)
+		// Paths on the same filesystem share its capacity
+		if !seen[dev] {
+			seen[dev] = true
+			resources.DiskBytes += fs.CapacityBytes
+		}
+	}
+
+	return resources, inventory, nil
+}
+
+// refreshInventory collects the inventory again and updates the node's
+// capacity and allocatable resources with it.
+func (a *Agent) refreshInventory(ctx context.Context) error {
+	if a.node == nil {
+		return nil
+	}
+
+	resources, inventory, err := a.collectInventory(ctx)
+	if err != nil {
+		return err
+	}
+	resources.GPUCount = a.gpus.assignable()
+
+	dedicated := dedicatedCPUs(a.cpus.status(a.pinnedCPUsInUse()))
+	var previous registry.Resources
+	if _, err := a.nodeRegistry.Modify(ctx, a.nodeID, func(node *registry.Node) error {
+		previous = node.Capacity
+		node.Capacity = resources
+		node.Allocatable = a.config.Capacity.allocatable(resources, dedicated)
+		node.Host = inventory
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to update node inventory: %w", err)
+	}
+
+	if resources != previous {
+		a.logger.Info("host capacity changed",
+			zap.Int("cpu_cores", resources.CPUCores),
+			zap.Int64("memory_bytes", resources.MemoryBytes),
+			zap.Int64("disk_bytes", resources.DiskBytes),
+		)
+	}
+	return nil
+}
+
+// onlineCPUs returns the number of online CPUs from sysfs, or the CPUs the
+// agent may run on if sysfs cannot be read.
+func onlineCPUs() int {
+	data, err := os.ReadFile("/sys/devices/system/cpu/online")
+	if err == nil {
+		if cpus, err := driver.ParseCPUList(strings.TrimSpace(string(data))); err == nil && len(cpus) > 0 {
+			return len(cpus)
+		}
+	}
+	return runtime.NumCPU()
+}
+
+// memTotal returns the host memory from /proc/meminfo, or 0.
+func memTotal() int64 {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || key != "MemTotal" {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return 0
+		}
+		kb, _ := strconv.ParseInt(fields[0], 10, 64)
+		return kb * 1024
+	}
+	return 0
+}
+
+// osImage returns the PRETTY_NAME of /etc/os-release, or "".
+func osImage() string {
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
+
+// nestedVirtualization reports whether the loaded KVM module lets guests
+// run hypervisors of their own.
+func nestedVirtualization() bool {
+	for _, module := range []string{"kvm_intel", "kvm_amd"} {
+		data, err := os.ReadFile(filepath.Join("/sys/module", module, "parameters", "nested"))
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(data))
+		return value == "Y" || value == "1"
+	}
+	return false
+}
+
+// statFilesystem returns the size of the filesystem path is on, and its
+// device to tell filesystems apart. A path that does not exist yet is
+// measured at its closest existing parent.
+func statFilesystem(path string) (registry.Filesystem, uint64, error) {
+	dir := filepath.Clean(path)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return registry.Filesystem{}, 0, fmt.Errorf("no existing parent of %s", path)
+		}
+		dir = parent
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return registry.Filesystem{}, 0, fmt.Errorf("failed to stat filesystem of %s: %w", path, err)
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(dir, &stat); err != nil {
+		return registry.Filesystem{}, 0, fmt.Errorf("failed to stat %s: %w", dir, err)
+	}
+
+	return registry.Filesystem{
+		Path:           path,
+		CapacityBytes:  int64(st.Blocks) * int64(st.Bsize),
+		AvailableBytes: int64(st.Bavail) * int64(st.Bsize),
+	}, uint64(stat.Dev), nil
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/network"
+)
+
+// discoveredLabelPrefix marks the node labels the agent maintains itself.
+// Labels under it are replaced on every refresh; other labels are left alone.
+const discoveredLabelPrefix = "hypervisor.io/"
+
+// Well-known node labels discovered by the agent.
+const (
+	LabelArch         = discoveredLabelPrefix + "arch"          // amd64, arm64
+	LabelCPUVendor    = discoveredLabelPrefix + "cpu-vendor"    // intel, amd, arm
+	LabelCPUFamily    = discoveredLabelPrefix + "cpu-family"    // xeon, epyc, core, ...
+	LabelKVM          = discoveredLabelPrefix + "kvm"           // "true" if /dev/kvm exists
+	LabelNICSpeed     = discoveredLabelPrefix + "nic-speed"     // Fastest physical NIC link, in Mbit/s
+	LabelStorageClass = discoveredLabelPrefix + "storage-class" // ssd, hdd or mixed
+	LabelOVSDPDK      = discoveredLabelPrefix + "ovs-dpdk"      // "true" with the DPDK datapath
+)
+
+// cpuFamilies are the model name keywords reported as the CPU family, most
+// specific first.
+var cpuFamilies = []string{
+	"xeon", "epyc", "threadripper", "ryzen", "opteron",
+	"core", "atom", "pentium", "celeron", "neoverse", "graviton", "ampere",
+}
+
+// discoverLabels returns the well-known labels describing this host. Labels
+// whose value cannot be determined are omitted.
+func (a *Agent) discoverLabels() map[string]string {
+	labels := make(map[string]string)
+	labels[LabelArch] = driver.HostArchitecture()
+
+	if cpu := detectHostCPU(); cpu != nil {
+		if vendor := cpuVendorLabel(cpu.Vendor); vendor != "" {
+			labels[LabelCPUVendor] = vendor
+		}
+		if family := cpuFamilyLabel(cpu.ModelName); family != "" {
+			labels[LabelCPUFamily] = family
+		}
+	}
+
+	_, err := os.Stat("/dev/kvm")
+	labels[LabelKVM] = strconv.FormatBool(err == nil)
+
+	if speed := maxNICSpeed(); speed > 0 {
+		labels[LabelNICSpeed] = strconv.Itoa(speed)
+	}
+	if class := storageClass(); class != "" {
+		labels[LabelStorageClass] = class
+	}
+
+	labels[LabelOVSDPDK] = strconv.FormatBool(a.config.Datapath.Mode == network.DatapathDPDK)
+	return labels
+}
+
+// nodeLabels merges labels with freshly discovered labels and the configured
+// ones. Configured labels win, so an operator can override a discovered value.
+func (a *Agent) nodeLabels(labels map[string]string) map[string]string {
+	merged := make(map[string]string, len(labels))
+	for k, v := range labels {
+		// Drop discovered labels that no longer apply
+		if !strings.HasPrefix(k, discoveredLabelPrefix) {
+			merged[k] = v
+		}
+	}
+
+	if a.config.DiscoverLabels {
+		for k, v := range a.discoverLabels() {
+			merged[k] = v
+		}
+	}
+	for k, v := range a.config.Labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+func cpuVendorLabel(vendor string) string {
+	switch vendor {
+	case "GenuineIntel":
+		return "intel"
+	case "AuthenticAMD":
+		return "amd"
+	case "":
+		return ""
+	}
+	if strings.HasPrefix(vendor, "0x") {
+		// arm64 reports the implementer code instead of a vendor string
+		return "arm"
+	}
+	return strings.ToLower(vendor)
+}
+
+func cpuFamilyLabel(modelName string) string {
+	lower := strings.ToLower(modelName)
+	for _, family := range cpuFamilies {
+		if strings.Contains(lower, family) {
+			return family
+		}
+	}
+	return ""
+}
+
+// maxNICSpeed returns the link speed in Mbit/s of the fastest physical NIC
+// with a link, or 0 if there is none.
+func maxNICSpeed() int {
+	entries, err := os.ReadDir("/sys/class/net")
+	if err != nil {
+		return 0
+	}
+
+	fastest := 0
+	for _, entry := range entries {
+		dir := filepath.Join("/sys/class/net", entry.Name())
+		// Virtual interfaces (bridges, taps, veths) have no backing device
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "speed"))
+		if err != nil {
+			continue
+		}
+		// -1 when the link is down
+		if speed, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && speed > fastest {
+			fastest = speed
+		}
+	}
+	return fastest
+}
+
+// storageClass reports whether the host's disks are all solid state, all
+// rotational or a mix of both.
+func storageClass() string {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return ""
+	}
+
+	var ssd, hdd bool
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") ||
+			strings.HasPrefix(name, "dm-") || strings.HasPrefix(name, "zram") ||
+			strings.HasPrefix(name, "sr") || strings.HasPrefix(name, "md") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/sys/block", name, "queue", "rotational"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(data)) == "1" {
+			hdd = true
+		} else {
+			ssd = true
+		}
+	}
+
+	switch {
+	case ssd && hdd:
+		return "mixed"
+	case ssd:
+		return "ssd"
+	case hdd:
+		return "hdd"
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/latency"
+	"hypervisor/pkg/cluster/registry"
+
+	"go.uber.org/zap"
+)
+
+// latencyProbeParallelism bounds the peers probed at once.
+const latencyProbeParallelism = 8
+
+// startLatencyProbes answers latency probes from other nodes and measures
+// this node's row of the latency matrix in the background.
+func (a *Agent) startLatencyProbes(ctx context.Context) {
+	if !a.config.Latency.Enabled {
+		return
+	}
+
+	responder, err := latency.NewResponder(a.config.Latency.Port, a.logger.Named("latency"))
+	if err != nil {
+		a.logger.Warn("latency probes disabled", zap.Error(err))
+		return
+	}
+	a.latencyResponder = responder
+
+	loop := LoopConfig{Interval: a.config.Latency.Interval, Jitter: 0.2}.withDefaults(LoopConfig{
+		Interval:   latency.DefaultConfig().Interval,
+		Jitter:     0.2,
+		MaxBackoff: 10 * time.Minute,
+	})
+	go a.runLoop(ctx, "latency-probe", loop, a.measureLatency)
+}
+
+// stopLatencyProbes stops answering probes and withdraws this node's row.
+func (a *Agent) stopLatencyProbes() {
+	if a.latencyResponder == nil {
+		return
+	}
+	a.latencyResponder.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := latency.NewStore(a.etcdClient).Delete(ctx, a.nodeID); err != nil {
+		a.logger.Warn("failed to withdraw latency row", zap.Error(err))
+	}
+}
+
+// measureLatency probes every other ready node over the underlay and
+// publishes the results.
+func (a *Agent) measureLatency(ctx context.Context) error {
+	nodes, err := a.nodeRegistry.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	config := a.config.Latency
+	if config.Count <= 0 {
+		config.Count = latency.DefaultConfig().Count
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = latency.DefaultConfig().Timeout
+	}
+
+	row := &latency.Row{
+		NodeID: a.nodeID,
+		Peers:  make(map[string]map[latency.Path]*latency.PathLatency),
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, latencyProbeParallelism)
+	)
+	for _, node := range nodes {
+		if node.ID == a.nodeID || node.Status != registry.NodeStatusReady || node.IP == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			address := net.JoinHostPort(node.IP, strconv.Itoa(config.Port))
+			result, err := latency.Probe(ctx, address, config.Count, config.Timeout)
+			if err != nil {
+				result = &latency.PathLatency{Address: address, Error: err.Error()}
+			}
+			paths := map[latency.Path]*latency.PathLatency{latency.PathUnderlay: result}
+
+			mu.Lock()
+			row.Peers[node.ID] = paths
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	row.MeasuredAt = time.Now()
+	return latency.NewStore(a.etcdClient).Publish(ctx, row)
+}
@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"hypervisor/pkg/compute/driver"
+)
+
+const (
+	// logPollInterval is how often a followed log is checked for output.
+	logPollInterval = 250 * time.Millisecond
+
+	// logChunkSize bounds the log data read and sent at once.
+	logChunkSize = 32 * 1024
+)
+
+// InstanceLogPath returns the log file of an instance: its serial console,
+// or its stdout and stderr for containers.
+func (a *Agent) InstanceLogPath(ctx context.Context, id string) (string, error) {
+	d, err := a.driverFor(id)
+	if err != nil {
+		return "", err
+	}
+	ld, ok := d.(driver.LogDriver)
+	if !ok {
+		return "", fmt.Errorf("%s driver cannot read instance logs: %w", d.Name(), driver.ErrNotSupported)
+	}
+	path, err := ld.LogPath(ctx, id)
+	return path, a.observeDriverErr(d, "logs", err)
+}
+
+// streamLog sends the log file at path to send, starting tailLines lines
+// from its end, or at its start when tailLines is 0. With follow it keeps
+// sending what is appended until ctx is done or gone reports the instance
+// deleted, starting over when the file is truncated or replaced.
+func streamLog(ctx context.Context, path string, tailLines int, follow bool, gone func() bool, send func([]byte) error) error {
+	f, err := openLog(path, tailLines)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	buf := make([]byte, logChunkSize)
+	for {
+		if f != nil {
+			for {
+				n, err := f.Read(buf)
+				if n > 0 {
+					if err := send(buf[:n]); err != nil {
+						return err
+					}
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("failed to read log: %w", err)
+				}
+			}
+		}
+		if !follow {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(logPollInterval):
+		}
+		if gone() {
+			return nil
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			// Not written yet, or removed; keep what is open
+			continue
+		}
+		if f != nil {
+			current, err := f.Stat()
+			if err != nil {
+				return fmt.Errorf("failed to stat log: %w", err)
+			}
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return fmt.Errorf("failed to seek log: %w", err)
+			}
+			switch {
+			case !os.SameFile(info, current):
+				// Rotated: what remains of the old file was read above
+				f.Close()
+				f = nil
+			case info.Size() < offset:
+				// Truncated: read it again from the start
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					return fmt.Errorf("failed to seek log: %w", err)
+				}
+				continue
+			default:
+				continue
+			}
+		}
+		if f, err = openLog(path, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// openLog opens the log file at path positioned tailLines lines from its
+// end, or at its start when tailLines is 0. A missing file is nil.
+func openLog(path string, tailLines int) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open log: %w", err)
+	}
+	if tailLines <= 0 {
+		return f, nil
+	}
+
+	offset, err := tailOffset(f, tailLines)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to seek log: %w", err)
+	}
+	return f, nil
+}
+
+// tailOffset returns the offset of the line n lines from the end of f,
+// reading it backwards.
+func tailOffset(f *os.File, n int) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	end := info.Size()
+	buf := make([]byte, logChunkSize)
+	if end > 0 {
+		// A final newline ends the last line rather than starting another
+		if _, err := f.ReadAt(buf[:1], end-1); err != nil {
+			return 0, err
+		}
+		if buf[0] == '\n' {
+			end--
+		}
+	}
+
+	for pos := end; pos > 0; {
+		size := int64(len(buf))
+		if pos < size {
+			size = pos
+		}
+		pos -= size
+		if _, err := f.ReadAt(buf[:size], pos); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := size - 1; i >= 0; i-- {
+			if buf[i] == '\n' {
+				if n--; n == 0 {
+					return pos + i + 1, nil
+				}
+			}
+		}
+	}
+	return 0, nil
+}
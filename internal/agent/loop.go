@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LoopConfig configures a periodic agent task.
+type LoopConfig struct {
+	// Interval is the nominal time between runs.
+	Interval time.Duration `mapstructure:"interval"`
+
+	// Jitter is the fraction of Interval (0-1) by which each delay is
+	// randomly lengthened or shortened, so that agents started together do
+	// not hit etcd in lockstep.
+	Jitter float64 `mapstructure:"jitter"`
+
+	// MaxBackoff caps the delay after consecutive failures. The delay
+	// doubles with each failure, starting from Interval.
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+}
+
+// DefaultReconcileLoopConfig returns the default instance reconcile loop configuration.
+func DefaultReconcileLoopConfig() LoopConfig {
+	return LoopConfig{
+		Interval:   30 * time.Second,
+		Jitter:     0.2,
+		MaxBackoff: 5 * time.Minute,
+	}
+}
+
+// DefaultResourceReportLoopConfig returns the default resource report loop configuration.
+func DefaultResourceReportLoopConfig() LoopConfig {
+	return LoopConfig{
+		Interval:   10 * time.Second,
+		Jitter:     0.2,
+		MaxBackoff: 2 * time.Minute,
+	}
+}
+
+// withDefaults fills in unset or invalid fields from def.
+func (c LoopConfig) withDefaults(def LoopConfig) LoopConfig {
+	if c.Interval <= 0 {
+		c.Interval = def.Interval
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		c.Jitter = def.Jitter
+	}
+	if c.MaxBackoff < c.Interval {
+		c.MaxBackoff = c.Interval
+	}
+	return c
+}
+
+// delay returns the wait before the next run after the given number of
+// consecutive failures.
+func (c LoopConfig) delay(failures int) time.Duration {
+	d := c.Interval
+	for i := 0; i < failures && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return jitter(d, c.Jitter)
+}
+
+// jitter randomly spreads d by up to ±fraction of itself.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
+}
+
+// runLoop calls fn periodically until ctx is cancelled or the agent stops.
+// The first run is delayed by a random part of the interval to spread agents
+// that start at the same time, and failing runs back off exponentially.
+func (a *Agent) runLoop(ctx context.Context, name string, config LoopConfig, fn func(context.Context) error) {
+	timer := time.NewTimer(time.Duration(rand.Int64N(int64(config.Interval))))
+	defer timer.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.stopCh:
+			return
+		case <-timer.C:
+		}
+
+		if err := fn(ctx); err != nil {
+			failures++
+			next := config.delay(failures)
+			a.logger.Warn("periodic task failed, backing off",
+				zap.String("task", name),
+				zap.Int("failures", failures),
+				zap.Duration("retry_in", next),
+				zap.Error(err),
+			)
+			timer.Reset(next)
+			continue
+		}
+
+		if failures > 0 {
+			a.logger.Info("periodic task recovered",
+				zap.String("task", name),
+				zap.Int("failures", failures),
+			)
+			failures = 0
+		}
+		timer.Reset(config.delay(0))
+	}
+}
@@ -0,0 +1,432 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/network"
+	"hypervisor/pkg/network/sdn"
+
+	"go.uber.org/zap"
+)
+
+// portKeyPrefix is where the SDN controller stores ports.
+const portKeyPrefix = sdn.PortKeyPrefix
+
+// MetadataConfig configures the node's instance metadata service.
+type MetadataConfig struct {
+	// Enabled serves instance metadata over HTTP.
+	Enabled bool `mapstructure:"enabled"`
+
+	// Addr is the listen address. The well-known link-local address must be
+	// assigned on the host side of the instances' network (or DNATed to
+	// Addr) so that requests keep the instance's source IP.
+	Addr string `mapstructure:"addr"`
+}
+
+// DefaultMetadataConfig returns the default metadata service configuration.
+func DefaultMetadataConfig() MetadataConfig {
+	return MetadataConfig{
+		Enabled: true,
+		Addr:    "169.254.169.254:80",
+	}
+}
+
+// metadataService answers metadata queries from the instances on this node
+// with EC2 and OpenStack compatible paths, as read by cloud-init. The caller
+// is identified by its source IP: first among the ports bound to this node,
+// then among the addresses reported by the local drivers.
+type metadataService struct {
+	agent     *Agent
+	instances *registry.EtcdInstanceRegistry
+	logger    *zap.Logger
+	server    *http.Server
+
+	// Ports bound to this node, by IP address
+	mu    sync.RWMutex
+	ports map[string][]*network.Port
+}
+
+// metadataIdentity is the instance a request comes from.
+type metadataIdentity struct {
+	instance *registry.Instance
+	ip       string
+	mac      string
+	mtu      uint16 // MTU of the port's network, if known
+}
+
+func newMetadataService(a *Agent, logger *zap.Logger) *metadataService {
+	m := &metadataService{
+		agent:     a,
+		instances: registry.NewEtcdInstanceRegistry(a.etcdClient, logger.Named("registry")),
+		logger:    logger,
+		ports:     make(map[string][]*network.Port),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", m.handle)
+	m.server = &http.Server{
+		Addr:              a.config.Metadata.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return m
+}
+
+// start loads this node's ports, follows changes to them and starts serving.
+func (m *metadataService) start(ctx context.Context) error {
+	kvs, err := m.agent.etcdClient.GetWithPrefixKV(ctx, portKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list ports: %w", err)
+	}
+	for _, kv := range kvs {
+		m.handlePortEvent(etcd.WatchEvent{Type: etcd.EventTypePut, Key: kv.Key, Value: kv.Value})
+	}
+	go m.watchPorts(ctx)
+
+	listener, err := net.Listen("tcp", m.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", m.server.Addr, err)
+	}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.logger.Error("metadata server failed", zap.Error(err))
+		}
+	}()
+
+	m.logger.Info("metadata service started", zap.String("addr", m.server.Addr))
+	return nil
+}
+
+// stop shuts the HTTP server down.
+func (m *metadataService) stop(ctx context.Context) error {
+	return m.server.Shutdown(ctx)
+}
+
+// watchPorts keeps the port index up to date.
+func (m *metadataService) watchPorts(ctx context.Context) {
+	watchCh := m.agent.etcdClient.WatchPrefixEvents(ctx, portKeyPrefix)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watchCh:
+			if !ok {
+				m.logger.Warn("port watch channel closed, reconnecting...")
+				time.Sleep(time.Second)
+				watchCh = m.agent.etcdClient.WatchPrefixEvents(ctx, portKeyPrefix)
+				continue
+			}
+			m.handlePortEvent(event)
+		}
+	}
+}
+
+// handlePortEvent indexes a port bound to this node, or drops a port that
+// was deleted or moved away.
+func (m *metadataService) handlePortEvent(event etcd.WatchEvent) {
+	portID := strings.TrimPrefix(event.Key, portKeyPrefix)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for ip, ports := range m.ports {
+		kept := ports[:0]
+		for _, p := range ports {
+			if p.ID != portID {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.ports, ip)
+		} else {
+			m.ports[ip] = kept
+		}
+	}
+
+	if event.Type != etcd.EventTypePut {
+		return
+	}
+	var port network.Port
+	if err := json.Unmarshal([]byte(event.Value), &port); err != nil {
+		m.logger.Warn("failed to unmarshal port event", zap.Error(err))
+		return
+	}
+	if port.NodeID != m.agent.nodeID || port.InstanceID == "" || port.IPAddress == "" {
+		return
+	}
+	m.ports[port.IPAddress] = append(m.ports[port.IPAddress], &port)
+}
+
+// identify returns the instance a request comes from.
+func (m *metadataService) identify(r *http.Request) (*metadataIdentity, error) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+	}
+
+	var instanceID, mac, networkID string
+	m.mu.RLock()
+	ports := m.ports[ip]
+	m.mu.RUnlock()
+	switch len(ports) {
+	case 0:
+		instanceID = m.localInstanceByIP(ip)
+	case 1:
+		instanceID, mac, networkID = ports[0].InstanceID, ports[0].MACAddress, ports[0].NetworkID
+	default:
+		// Overlapping tenant networks; the source IP alone is ambiguous
+		return nil, fmt.Errorf("%d ports on this node have IP %s", len(ports), ip)
+	}
+	if instanceID == "" {
+		return nil, fmt.Errorf("no instance on this node has IP %s", ip)
+	}
+
+	instance, err := m.instances.Get(r.Context(), instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance %s: %w", instanceID, err)
+	}
+	if instance.NodeID != m.agent.nodeID {
+		return nil, fmt.Errorf("instance %s is not on this node", instanceID)
+	}
+
+	id := &metadataIdentity{instance: instance, ip: ip, mac: mac}
+	if networkID != "" {
+		var portNet network.Network
+		if err := m.agent.getSDNObject(r.Context(), networkKeyPrefix+networkID, &portNet); err != nil {
+			m.logger.Debug("failed to get network for its MTU", zap.String("network_id", networkID), zap.Error(err))
+		} else {
+			id.mtu = portNet.MTU
+		}
+	}
+	return id, nil
+}
+
+// localInstanceByIP returns the ID of the local instance the drivers report
+// at ip, for instances without an SDN port.
+func (m *metadataService) localInstanceByIP(ip string) string {
+	m.agent.instancesMu.RLock()
+	defer m.agent.instancesMu.RUnlock()
+
+	for id, instance := range m.agent.instances {
+		if instance.IPAddress == ip {
+			return id
+		}
+	}
+	return ""
+}
+
+// handle serves every metadata path.
+func (m *metadataService) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// Also tells cloud-init that IMDSv2 session tokens are not supported
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := m.identify(r)
+	if err != nil {
+		m.logger.Debug("rejected metadata request",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("path", r.URL.Path),
+			zap.Error(err),
+		)
+		http.Error(w, "unknown instance", http.StatusNotFound)
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		writeMetadata(w, "latest")
+		return
+	}
+
+	segments := strings.SplitN(path, "/", 2)
+	rest := ""
+	if len(segments) == 2 {
+		rest = segments[1]
+	}
+
+	var tree map[string]string
+	if segments[0] == "openstack" {
+		tree = m.openstackTree(id)
+		if rest == "" {
+			writeMetadata(w, "latest")
+			return
+		}
+		// Every OpenStack metadata version is answered with the latest
+		_, rest, _ = strings.Cut(rest, "/")
+	} else {
+		// Likewise for EC2 versions such as 2009-04-04
+		tree = m.ec2Tree(id)
+	}
+
+	if value, ok := tree[rest]; ok {
+		writeMetadata(w, value)
+		return
+	}
+	if listing := listMetadata(tree, rest); listing != "" {
+		writeMetadata(w, listing)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// ec2Tree returns the EC2 style metadata of an instance by path.
+func (m *metadataService) ec2Tree(id *metadataIdentity) map[string]string {
+	inst := id.instance
+	hostname := metadataHostname(inst.Name)
+
+	tree := map[string]string{
+		"meta-data/instance-id":                 inst.ID,
+		"meta-data/hostname":                    hostname,
+		"meta-data/local-hostname":              hostname,
+		"meta-data/local-ipv4":                  id.ip,
+		"meta-data/ami-id":                      inst.Spec.Image,
+		"meta-data/instance-type":               string(inst.Type),
+		"meta-data/placement/availability-zone": m.agent.config.Zone,
+		"meta-data/placement/region":            m.agent.config.Region,
+	}
+	if id.mac != "" {
+		tree["meta-data/mac"] = id.mac
+	}
+	if inst.Spec.UserData != "" {
+		tree["user-data"] = inst.Spec.UserData
+	}
+
+	if len(inst.Spec.SSHKeys) > 0 {
+		// Key indexes list as "0=key-0" rather than as directories
+		names := make([]string, len(inst.Spec.SSHKeys))
+		for i, key := range inst.Spec.SSHKeys {
+			names[i] = fmt.Sprintf("%d=key-%d", i, i)
+			tree["meta-data/public-keys/"+strconv.Itoa(i)+"/openssh-key"] = key
+		}
+		tree["meta-data/public-keys"] = strings.Join(names, "\n")
+	}
+	return tree
+}
+
+// openstackTree returns the OpenStack style metadata of an instance by path
+// below the version.
+func (m *metadataService) openstackTree(id *metadataIdentity) map[string]string {
+	inst := id.instance
+
+	keys := make(map[string]string, len(inst.Spec.SSHKeys))
+	for i, key := range inst.Spec.SSHKeys {
+		keys[fmt.Sprintf("key-%d", i)] = key
+	}
+	meta := inst.Labels
+	if meta == nil {
+		meta = map[string]string{}
+	}
+
+	metaData, _ := json.Marshal(map[string]any{
+		"uuid":              inst.ID,
+		"name":              inst.Name,
+		"hostname":          metadataHostname(inst.Name),
+		"availability_zone": m.agent.config.Zone,
+		"public_keys":       keys,
+		"meta":              meta,
+		"launch_index":      0,
+	})
+
+	tree := map[string]string{
+		"meta_data.json":   string(metaData),
+		"vendor_data.json": "{}",
+	}
+	if inst.Spec.UserData != "" {
+		tree["user_data"] = inst.Spec.UserData
+	}
+
+	// The NIC keeps DHCP, but with the MTU of its network, which
+	// cloud-init applies even when the guest driver ignores the host's
+	if id.mac != "" && id.mtu != 0 {
+		networkData, _ := json.Marshal(map[string]any{
+			"links": []map[string]any{{
+				"id":                   "nic0",
+				"type":                 "phy",
+				"ethernet_mac_address": id.mac,
+				"mtu":                  id.mtu,
+			}},
+			"networks": []map[string]any{{
+				"id":   "network0",
+				"link": "nic0",
+				"type": "ipv4_dhcp",
+			}},
+			"services": []any{},
+		})
+		tree["network_data.json"] = string(networkData)
+	}
+	return tree
+}
+
+// listMetadata lists the entries directly below dir, marking directories
+// with a trailing slash. It returns "" if dir has no entries.
+func listMetadata(tree map[string]string, dir string) string {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	seen := make(map[string]bool)
+	for path := range tree {
+		rest, ok := strings.CutPrefix(path, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		name, _, isDir := strings.Cut(rest, "/")
+		if isDir {
+			if _, leaf := tree[prefix+name]; leaf {
+				// Listed by its own value, like public-keys
+				name = strings.TrimSuffix(name, "/")
+			} else {
+				name += "/"
+			}
+		}
+		seen[name] = true
+	}
+
+	entries := make([]string, 0, len(seen))
+	for name := range seen {
+		entries = append(entries, name)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, "\n")
+}
+
+func writeMetadata(w http.ResponseWriter, value string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, value)
+}
+
+// metadataHostname turns an instance name into a valid hostname label.
+func metadataHostname(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			b.WriteRune(r)
+		case r == '_' || r == '.' || r == ' ':
+			b.WriteByte('-')
+		}
+	}
+	hostname := strings.Trim(b.String(), "-")
+	if len(hostname) > 63 {
+		hostname = strings.TrimRight(hostname[:63], "-")
+	}
+	if hostname == "" {
+		return "instance"
+	}
+	return hostname
+}
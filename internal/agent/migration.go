@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/tracing"
+)
+
+// MigrationCheck is the result of one host-local pre-migration check.
+type MigrationCheck struct {
+	Name    string
+	Passed  bool
+	Message string
+}
+
+// CheckMigrationTarget runs the checks that can only be answered on this
+// node when an instance with spec is about to be migrated to it.
+func (a *Agent) CheckMigrationTarget(spec *driver.InstanceSpec) []MigrationCheck {
+	return []MigrationCheck{
+		a.checkHugePages(spec),
+		a.checkStorage(spec),
+	}
+}
+
+// MigrateInstance live migrates a running instance to the node targetNodeID,
+// whose hypervisor is reached at host, and hands its port over to that node.
+// The server checks the target with CheckMigrationTarget first.
+func (a *Agent) MigrateInstance(ctx context.Context, id, targetNodeID, host string) error {
+	return a.workQueue.Do(ctx, id, opMigrate, func(ctx context.Context) error {
+		d, err := a.driverFor(id)
+		if err != nil {
+			return err
+		}
+		md, ok := d.(driver.MigrateDriver)
+		if !ok {
+			return fmt.Errorf("%s driver cannot live migrate instances: %w", d.Name(), driver.ErrNotSupported)
+		}
+		instance, err := a.getInstance(id)
+		if err != nil {
+			return err
+		}
+		if instance.Spec.Network.BindingType == driver.PortBindingVhostUser {
+			// The target has no vhost-user port plugged for the guest
+			return fmt.Errorf("instances with vhost-user ports cannot be live migrated: %w", driver.ErrNotSupported)
+		}
+
+		ctx, span := traceDriver(ctx, d, "migrate", id)
+		err = md.Migrate(ctx, id, host)
+		tracing.End(span, err)
+		if err != nil {
+			return a.observeDriverErr(d, "migrate", err)
+		}
+
+		a.instancesMu.Lock()
+		delete(a.instances, id)
+		a.instancesMu.Unlock()
+
+		// The guest's traffic now enters the overlay on the target
+		netSpec := instance.Spec.Network
+		if netSpec.PortID == "" || netSpec.DeviceName == "" || a.serverConn == nil {
+			return nil
+		}
+		if _, err := v1.NewNetworkServiceClient(a.serverConn).BindPort(ctx, &v1.BindPortRequest{
+			PortId:     netSpec.PortID,
+			InstanceId: id,
+			NodeId:     targetNodeID,
+			DeviceName: netSpec.DeviceName,
+		}); err != nil {
+			return fmt.Errorf("instance migrated but failed to move port %s: %w", netSpec.PortID, err)
+		}
+		return nil
+	})
+}
+
+// checkHugePages verifies that enough free hugepages exist to back the
+// instance's memory.
+func (a *Agent) checkHugePages(spec *driver.InstanceSpec) MigrationCheck {
+	check := MigrationCheck{Name: "hugepages", Passed: true}
+	if !spec.HugePages {
+		check.Message = "instance does not use hugepages"
+		return check
+	}
+
+	free, err := freeHugePageBytes()
+	if err != nil {
+		check.Passed = false
+		check.Message = fmt.Sprintf("failed to read hugepage availability: %v", err)
+		return check
+	}
+
+	required := spec.MemoryMB * 1024 * 1024
+	if free < required {
+		check.Passed = false
+		check.Message = fmt.Sprintf("%d MiB of hugepages free, %d MiB required", free/(1024*1024), spec.MemoryMB)
+		return check
+	}
+
+	check.Message = fmt.Sprintf("%d MiB of hugepages free", free/(1024*1024))
+	return check
+}
+
+// checkStorage verifies that the instance's disks are reachable from this
+// node, i.e. that they live on storage shared with the source node.
+func (a *Agent) checkStorage(spec *driver.InstanceSpec) MigrationCheck {
+	check := MigrationCheck{Name: "storage", Passed: true}
+
+	var paths []string
+	if imagePath := a.config.vmImagePath(); spec.Image != "" && imagePath != "" {
+		paths = append(paths, filepath.Join(imagePath, spec.Image+".qcow2"))
+	}
+	for _, disk := range spec.Disks {
+		if disk.SourcePath != "" {
+			paths = append(paths, disk.SourcePath)
+		}
+	}
+
+	var unreachable []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			unreachable = append(unreachable, path)
+		}
+	}
+
+	if len(unreachable) > 0 {
+		check.Passed = false
+		check.Message = fmt.Sprintf("not reachable on target: %s", strings.Join(unreachable, ", "))
+		return check
+	}
+
+	check.Message = fmt.Sprintf("%d disk(s) reachable", len(paths))
+	return check
+}
+
+// freeHugePageBytes returns the free default-size hugepage memory from
+// /proc/meminfo.
+func freeHugePageBytes() (int64, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+
+	var freePages, pageSizeKB int64
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch key {
+		case "HugePages_Free":
+			freePages, _ = strconv.ParseInt(fields[0], 10, 64)
+		case "Hugepagesize":
+			pageSizeKB, _ = strconv.ParseInt(fields[0], 10, 64)
+		}
+	}
+
+	return freePages * pageSizeKB * 1024, nil
+}
@@ -0,0 +1,650 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/metrics"
+	"hypervisor/pkg/network"
+	"hypervisor/pkg/network/sdn"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// Keys of the SDN controller: where it stores networks and port mirrors.
+const (
+	networkKeyPrefix = "/hypervisor/network/networks/"
+	mirrorKeyPrefix  = "/hypervisor/network/mirrors/"
+)
+
+// errNoPortCounters is returned for the counters of a port that has no
+// device of its own on this node's integration bridge.
+var errNoPortCounters = errors.New("port has no traffic counters on this node")
+
+// Statuses of ports and port mirrors reported by the network agent.
+const (
+	statusActive = "active"
+	statusDown   = "down"
+	statusError  = "error"
+)
+
+// networkAgent programs the ports bound to this node: it installs their
+// OpenFlow rules and bandwidth limits on the integration bridge, keeps a
+// tunnel mesh up for the VNIs of their networks while any of them is here,
+// reports each port active, or in error, once it is programmed, and reads
+// the traffic counters of programmed ports for the server. It follows the networks of
+// those ports, reprogramming them when a network's forwarding changes; the
+// ports of a network that is administratively down get no flows and are
+// reported down. The server only records bindings; the flows have to exist
+// on the node the port lands on. For the
+// ports of those networks bound to other nodes it installs ARP responders,
+// so that requests for their addresses are answered here rather than
+// flooded to every node. It also applies the mirrors of programmed ports.
+type networkAgent struct {
+	agent  *Agent
+	state  *sdnState
+	flows  *sdn.FlowManager
+	logger *zap.Logger
+	ctx    context.Context // Of start, for status reports outside events
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	ports    map[string]*network.Port       // Programmed ports, by ID
+	networks map[string]*network.Network    // Networks of programmed ports
+	users    map[string]int                 // Programmed ports per network
+	remote   map[string]*network.Port       // Ports bound to other nodes, by ID
+	mirrors  map[string]*network.PortMirror // All port mirrors, by ID
+	applied  map[string]string              // Applied mirrors, to their tunnel device if any
+}
+
+func newNetworkAgent(a *Agent, state *sdnState, logger *zap.Logger) (*networkAgent, error) {
+	flows, err := sdn.NewFlowManager(state.config, logger.Named("flows"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create flow manager: %w", err)
+	}
+	flows.SetOVSClient(state.ovs)
+
+	return &networkAgent{
+		agent:    a,
+		state:    state,
+		flows:    flows,
+		logger:   logger,
+		ports:    make(map[string]*network.Port),
+		networks: make(map[string]*network.Network),
+		users:    make(map[string]int),
+		remote:   make(map[string]*network.Port),
+		mirrors:  make(map[string]*network.PortMirror),
+		applied:  make(map[string]string),
+	}, nil
+}
+
+// start programs the ports bound to this node and follows changes to them,
+// to their networks and to port mirrors until stop. Meanwhile it audits
+// their flows.
+func (n *networkAgent) start(ctx context.Context) {
+	ctx, n.cancel = context.WithCancel(ctx)
+	n.ctx = ctx
+	go n.follow(ctx, "port", portKeyPrefix, n.handlePortEvent, n.forgetPorts)
+	go n.follow(ctx, "network", networkKeyPrefix, n.handleNetworkEvent, nil)
+	go n.follow(ctx, "mirror", mirrorKeyPrefix, n.handleMirrorEvent, n.forgetMirrors)
+
+	audit := n.agent.config.Network.FlowAudit.withDefaults(DefaultNetworkConfig().FlowAudit)
+	go n.agent.runLoop(ctx, "flow-audit", audit, n.auditFlows)
+}
+
+func (n *networkAgent) stop() {
+	if n.cancel != nil {
+		n.cancel()
+	}
+}
+
+// follow lists a prefix, applies its entries and then the changes made
+// after the listing. When the watch ends it lists the prefix again, so no
+// change is missed while it was down.
+func (n *networkAgent) follow(ctx context.Context, name, prefix string, handle func(context.Context, etcd.WatchEvent), forget func(present map[string]bool)) {
+	for {
+		rev, err := n.resync(ctx, prefix, handle, forget)
+		if err != nil {
+			n.logger.Warn("failed to list "+name+"s", zap.Error(err))
+		} else {
+			watchCtx := clientv3.WithRequireLeader(ctx)
+			for event := range n.agent.etcdClient.WatchPrefixEvents(watchCtx, prefix, clientv3.WithRev(rev+1)) {
+				handle(ctx, event)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		n.logger.Warn(name + " watch ended, resyncing")
+	}
+}
+
+// resync applies the current entries of a prefix, then has forget, if any,
+// drop those no longer listed. It returns the revision it read at.
+func (n *networkAgent) resync(ctx context.Context, prefix string, handle func(context.Context, etcd.WatchEvent), forget func(present map[string]bool)) (int64, error) {
+	kvs, rev, err := n.agent.etcdClient.GetWithPrefixRevision(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	present := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		present[strings.TrimPrefix(kv.Key, prefix)] = true
+		handle(ctx, etcd.WatchEvent{Type: etcd.EventTypePut, Key: kv.Key, Value: kv.Value})
+	}
+	if forget != nil {
+		forget(present)
+	}
+
+	return rev, nil
+}
+
+// forgetPorts unprograms and forgets the ports that no longer exist.
+func (n *networkAgent) forgetPorts(present map[string]bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var gone []string
+	for id := range n.ports {
+		if !present[id] {
+			gone = append(gone, id)
+		}
+	}
+	for _, id := range gone {
+		n.unprogram(id)
+	}
+	for id := range n.remote {
+		if !present[id] {
+			n.forgetRemote(id)
+		}
+	}
+}
+
+// handlePortEvent programs a port bound to this node, and unprograms one
+// that was deleted or moved away. Ports bound to other nodes are recorded
+// for ARP responders.
+func (n *networkAgent) handlePortEvent(ctx context.Context, event etcd.WatchEvent) {
+	portID := strings.TrimPrefix(event.Key, portKeyPrefix)
+
+	var port network.Port
+	if event.Type == etcd.EventTypePut {
+		if err := json.Unmarshal([]byte(event.Value), &port); err != nil {
+			n.logger.Warn("failed to unmarshal port event", zap.Error(err))
+			return
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if event.Type == etcd.EventTypePut && port.NodeID != "" && port.NodeID != n.agent.nodeID {
+		n.recordRemote(&port)
+	} else {
+		n.forgetRemote(portID)
+	}
+
+	if event.Type != etcd.EventTypePut || port.NodeID != n.agent.nodeID || port.DeviceName == "" {
+		n.unprogram(portID)
+		return
+	}
+
+	if programmed, ok := n.ports[port.ID]; ok && sameFlows(programmed, &port) {
+		n.ports[port.ID] = &port
+		return
+	}
+	n.unprogram(port.ID)
+	n.apply(ctx, &port)
+}
+
+// handleNetworkEvent reprograms the ports here of a network whose
+// forwarding changed. Networks without ports here are read when their first
+// port is programmed, and cannot be deleted while they have ports.
+func (n *networkAgent) handleNetworkEvent(ctx context.Context, event etcd.WatchEvent) {
+	if event.Type != etcd.EventTypePut {
+		return
+	}
+	var net network.Network
+	if err := json.Unmarshal([]byte(event.Value), &net); err != nil {
+		n.logger.Warn("failed to unmarshal network event", zap.Error(err))
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	current, ok := n.networks[net.ID]
+	if !ok {
+		return
+	}
+	if sameForwarding(current, &net) {
+		n.networks[net.ID] = &net
+		return
+	}
+
+	var ports []*network.Port
+	for _, port := range n.ports {
+		if port.NetworkID == net.ID {
+			ports = append(ports, port)
+		}
+	}
+	for _, port := range ports {
+		n.unprogram(port.ID)
+	}
+	n.networks[net.ID] = &net
+	for _, port := range ports {
+		n.apply(ctx, port)
+	}
+	n.logger.Info("reprogrammed ports of changed network",
+		zap.String("network_id", net.ID),
+		zap.Bool("admin_state", net.AdminState),
+		zap.Int("ports", len(ports)),
+	)
+}
+
+// apply programs a port and reports its status. Called with mu held.
+func (n *networkAgent) apply(ctx context.Context, port *network.Port) {
+	status := statusActive
+	if err := n.program(ctx, port); err != nil {
+		n.logger.Error("failed to program port",
+			zap.String("port_id", port.ID),
+			zap.String("device", port.DeviceName),
+			zap.Error(err),
+		)
+		status = statusError
+	} else if !n.networks[port.NetworkID].AdminState {
+		status = statusDown
+	}
+	if port.Status != status {
+		n.reportStatus(ctx, port.ID, status)
+	}
+}
+
+// program installs the flows of a port and, for the first port of a VXLAN
+// network here, joins the network's tunnel mesh. Called with mu held.
+func (n *networkAgent) program(ctx context.Context, port *network.Port) error {
+	net, err := n.network(ctx, port.NetworkID)
+	if err != nil {
+		return err
+	}
+
+	vxlan := net.Type == network.NetworkTypeVXLAN
+	if vxlan && n.users[net.ID] == 0 {
+		if err := n.state.vxlanMgr.RegisterNetwork(net); err != nil {
+			return fmt.Errorf("failed to register network %s: %w", net.ID, err)
+		}
+		for _, vni := range net.VNIs() {
+			if err := n.state.vtepMgr.EstablishMesh(vni); err != nil {
+				n.logger.Warn("failed to establish tunnel mesh",
+					zap.String("network_id", net.ID),
+					zap.Uint32("vni", vni),
+					zap.Error(err),
+				)
+			}
+		}
+		n.installResponders(net)
+	}
+	n.users[net.ID]++
+	n.ports[port.ID] = port
+
+	// Other networks are bridged by the driver, with nothing to program
+	if hasPortFlows(net) {
+		if err := n.flows.InstallPortFlows(port, net); err != nil {
+			// Forgotten, so that the next event for the port retries
+			n.unprogram(port.ID)
+			return fmt.Errorf("failed to install flows: %w", err)
+		}
+		if ownsDevice(port) && !port.QoS.IsZero() {
+			if err := n.state.ovs.SetPortQoS(port.DeviceName, port.ID, port.QoS); err != nil {
+				n.unprogram(port.ID)
+				return fmt.Errorf("failed to apply QoS: %w", err)
+			}
+		}
+	}
+
+	n.logger.Info("programmed port",
+		zap.String("port_id", port.ID),
+		zap.String("network_id", net.ID),
+		zap.String("device", port.DeviceName),
+	)
+	n.applyMirrorsOf(ctx, port.ID)
+	return nil
+}
+
+// unprogram removes the flows of a port and leaves the tunnel mesh of its
+// network once no port of the network is left here. Called with mu held.
+func (n *networkAgent) unprogram(portID string) {
+	port, ok := n.ports[portID]
+	if !ok {
+		return
+	}
+	n.unapplyMirrorsOf(portID)
+	delete(n.ports, portID)
+	net := n.networks[port.NetworkID]
+	vxlan := net.Type == network.NetworkTypeVXLAN
+
+	if hasPortFlows(net) {
+		if err := n.flows.RemovePortFlows(port); err != nil {
+			n.logger.Warn("failed to remove port flows",
+				zap.String("port_id", portID),
+				zap.Error(err),
+			)
+		}
+		if ownsDevice(port) && !port.QoS.IsZero() {
+			if err := n.state.ovs.ClearPortQoS(port.DeviceName, port.ID); err != nil {
+				n.logger.Warn("failed to clear port QoS",
+					zap.String("port_id", portID),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+	n.logger.Info("unprogrammed port", zap.String("port_id", portID))
+
+	if n.users[net.ID]--; n.users[net.ID] > 0 {
+		return
+	}
+	delete(n.users, net.ID)
+	delete(n.networks, net.ID)
+	if !vxlan {
+		return
+	}
+	n.removeResponders(net.ID)
+	for _, vni := range net.VNIs() {
+		if err := n.state.vtepMgr.TeardownMesh(vni); err != nil {
+			n.logger.Warn("failed to teardown tunnel mesh",
+				zap.String("network_id", net.ID),
+				zap.Uint32("vni", vni),
+				zap.Error(err),
+			)
+		}
+	}
+	n.state.vxlanMgr.UnregisterNetwork(net.ID)
+}
+
+// reprogram reinstalls the flows of every programmed port, after Open
+// vSwitch lost them.
+func (n *networkAgent) reprogram() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, port := range n.ports {
+		net := n.networks[port.NetworkID]
+		if !hasPortFlows(net) {
+			continue
+		}
+		n.reinstallPortFlows(port, net)
+		if ownsDevice(port) && !port.QoS.IsZero() {
+			if err := n.state.ovs.SetPortQoS(port.DeviceName, port.ID, port.QoS); err != nil {
+				n.logger.Error("failed to reapply port QoS", zap.String("port_id", port.ID), zap.Error(err))
+			}
+		}
+	}
+	for _, port := range n.remote {
+		if net, ok := n.networks[port.NetworkID]; ok && n.users[net.ID] > 0 && net.Type == network.NetworkTypeVXLAN {
+			n.installResponder(port, net)
+		}
+	}
+	n.reapplyMirrors()
+	n.logger.Info("reprogrammed ports", zap.Int("count", len(n.ports)))
+}
+
+// reinstallPortFlows replaces the flows of a programmed port. Called with
+// mu held.
+func (n *networkAgent) reinstallPortFlows(port *network.Port, net *network.Network) {
+	if err := n.flows.RemovePortFlows(port); err != nil {
+		n.logger.Warn("failed to remove port flows", zap.String("port_id", port.ID), zap.Error(err))
+	}
+	if err := n.flows.InstallPortFlows(port, net); err != nil {
+		n.logger.Error("failed to reinstall port flows", zap.String("port_id", port.ID), zap.Error(err))
+	}
+}
+
+// auditFlows compares the integration bridge with the flows installed for
+// the programmed ports and the ARP responders, and reinstalls those of the
+// ones missing flows. Losing every flow, the base flows included, is
+// repaired by the network check instead.
+func (n *networkAgent) auditFlows(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	audit, err := n.flows.AuditFlows()
+	if err != nil {
+		return fmt.Errorf("failed to audit flows: %w", err)
+	}
+	if !audit.Drifted() {
+		return nil
+	}
+
+	metrics.ObserveFlowDrift(metrics.FlowOwnerPort, audit.PortFlowsMissing)
+	metrics.ObserveFlowDrift(metrics.FlowOwnerARPResponder, audit.ResponderFlowsMissing)
+	n.logger.Warn("flows missing from the integration bridge, reinstalling",
+		zap.Int("checked", audit.Checked),
+		zap.Int("port_flows_missing", audit.PortFlowsMissing),
+		zap.Int("responder_flows_missing", audit.ResponderFlowsMissing),
+		zap.Strings("ports", audit.Ports),
+		zap.Strings("responders", audit.Responders),
+	)
+
+	for _, id := range audit.Ports {
+		if port, ok := n.ports[id]; ok {
+			n.reinstallPortFlows(port, n.networks[port.NetworkID])
+		}
+	}
+	for _, id := range audit.Responders {
+		port, ok := n.remote[id]
+		if !ok {
+			continue
+		}
+		if net, ok := n.networks[port.NetworkID]; ok {
+			n.installResponder(port, net)
+		}
+	}
+	return nil
+}
+
+// recordRemote records a port bound to another node and, while its network
+// has ports here, answers ARP requests for it. Called with mu held.
+func (n *networkAgent) recordRemote(port *network.Port) {
+	if old, ok := n.remote[port.ID]; ok && sameAddresses(old, port) {
+		return
+	}
+	n.forgetRemote(port.ID)
+	n.remote[port.ID] = port
+
+	if net, ok := n.networks[port.NetworkID]; ok && n.users[net.ID] > 0 && net.Type == network.NetworkTypeVXLAN {
+		n.installResponder(port, net)
+	}
+}
+
+// forgetRemote stops answering for a port that is no longer bound to
+// another node. Called with mu held.
+func (n *networkAgent) forgetRemote(portID string) {
+	if _, ok := n.remote[portID]; !ok {
+		return
+	}
+	delete(n.remote, portID)
+	n.removeResponder(portID)
+}
+
+// installResponders answers ARP requests for the ports of a network bound
+// to other nodes, once the network has a port here. Called with mu held.
+func (n *networkAgent) installResponders(net *network.Network) {
+	for _, port := range n.remote {
+		if port.NetworkID == net.ID {
+			n.installResponder(port, net)
+		}
+	}
+}
+
+// removeResponders stops answering for the ports of a network, once it has
+// no port here. Called with mu held.
+func (n *networkAgent) removeResponders(networkID string) {
+	for _, port := range n.remote {
+		if port.NetworkID == networkID {
+			n.removeResponder(port.ID)
+		}
+	}
+}
+
+func (n *networkAgent) installResponder(port *network.Port, net *network.Network) {
+	if err := n.flows.InstallARPResponder(port, net); err != nil {
+		n.logger.Warn("failed to install ARP responder",
+			zap.String("port_id", port.ID),
+			zap.String("ip_address", port.IPAddress),
+			zap.Error(err),
+		)
+	}
+}
+
+func (n *networkAgent) removeResponder(portID string) {
+	if err := n.flows.RemoveARPResponder(portID); err != nil {
+		n.logger.Warn("failed to remove ARP responder", zap.String("port_id", portID), zap.Error(err))
+	}
+}
+
+// network returns a network, read from etcd the first time one of its
+// ports is programmed here and then kept current by the network watch.
+// Called with mu held.
+func (n *networkAgent) network(ctx context.Context, networkID string) (*network.Network, error) {
+	if net, ok := n.networks[networkID]; ok {
+		return net, nil
+	}
+
+	value, err := n.agent.etcdClient.Get(ctx, networkKeyPrefix+networkID)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return nil, fmt.Errorf("network %s not found", networkID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network %s: %w", networkID, err)
+	}
+
+	var net network.Network
+	if err := json.Unmarshal([]byte(value), &net); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal network %s: %w", networkID, err)
+	}
+	n.networks[networkID] = &net
+	return &net, nil
+}
+
+// stats reads the traffic counters of a programmed port's device. The
+// device's receive counters are what the instance sent, and the other way
+// round.
+func (n *networkAgent) stats(portID string) (*network.PortStats, error) {
+	n.mu.Lock()
+	port, ok := n.ports[portID]
+	// Only ports on the integration bridge have counters there
+	ok = ok && ownsDevice(port) && n.networks[port.NetworkID].Type == network.NetworkTypeVXLAN
+	n.mu.Unlock()
+	if !ok {
+		return nil, errNoPortCounters
+	}
+
+	counters, err := n.state.ovs.GetPortStats(n.state.config.OVSBridge, port.DeviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read port counters: %w", err)
+	}
+	return &network.PortStats{
+		PortID:    port.ID,
+		NodeID:    n.agent.nodeID,
+		RxPackets: counters.TxPackets,
+		TxPackets: counters.RxPackets,
+		RxBytes:   counters.TxBytes,
+		TxBytes:   counters.RxBytes,
+		RxDropped: counters.TxDropped,
+		TxDropped: counters.RxDropped,
+		RxErrors:  counters.TxErrors,
+		TxErrors:  counters.RxErrors,
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+// reportStatus records the status of a port still bound to this node.
+func (n *networkAgent) reportStatus(ctx context.Context, portID, status string) {
+	_, err := n.agent.etcdClient.Modify(ctx, portKeyPrefix+portID, func(value string) (string, error) {
+		var port network.Port
+		if err := json.Unmarshal([]byte(value), &port); err != nil {
+			return "", fmt.Errorf("failed to unmarshal port: %w", err)
+		}
+		if port.NodeID != n.agent.nodeID {
+			return value, nil
+		}
+		port.Status = status
+		port.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(&port)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal port: %w", err)
+		}
+		return string(data), nil
+	})
+	if err != nil && !errors.Is(err, etcd.ErrKeyNotFound) {
+		n.logger.Warn("failed to report port status",
+			zap.String("port_id", portID),
+			zap.String("status", status),
+			zap.Error(err),
+		)
+	}
+}
+
+// sameFlows reports whether two versions of a port are programmed the same,
+// so that status updates do not reinstall its flows.
+func sameFlows(a, b *network.Port) bool {
+	return a.NetworkID == b.NetworkID &&
+		a.MACAddress == b.MACAddress &&
+		a.IPAddress == b.IPAddress &&
+		a.DeviceName == b.DeviceName &&
+		a.Zone == b.Zone &&
+		a.ParentPortID == b.ParentPortID &&
+		a.VLANTag == b.VLANTag &&
+		slices.Equal(a.SecurityGroups, b.SecurityGroups) &&
+		sameQoS(a.QoS, b.QoS)
+}
+
+// sameForwarding reports whether two versions of a network program its
+// ports the same, so that renames and label changes do not reprogram them.
+func sameForwarding(a, b *network.Network) bool {
+	return a.Type == b.Type &&
+		a.VNI == b.VNI &&
+		a.VLANID == b.VLANID &&
+		a.MTU == b.MTU &&
+		a.AdminState == b.AdminState &&
+		slices.Equal(a.Segments, b.Segments)
+}
+
+// hasPortFlows reports whether the ports of a network get flows: those of
+// VXLAN networks that are administratively up.
+func hasPortFlows(net *network.Network) bool {
+	return net.Type == network.NetworkTypeVXLAN && net.AdminState
+}
+
+// ownsDevice reports whether a port's device is its own. A subport of a
+// trunk shares its parent's, whose QoS and counters are the parent's.
+func ownsDevice(port *network.Port) bool {
+	return port.ParentPortID == ""
+}
+
+func sameQoS(a, b *network.PortQoS) bool {
+	if a.IsZero() || b.IsZero() {
+		return a.IsZero() == b.IsZero()
+	}
+	return *a == *b
+}
+
+// sameAddresses reports whether two versions of a port bound elsewhere are
+// answered for the same.
+func sameAddresses(a, b *network.Port) bool {
+	return a.NetworkID == b.NetworkID &&
+		a.MACAddress == b.MACAddress &&
+		a.IPAddress == b.IPAddress
+}
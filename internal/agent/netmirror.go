@@ -0,0 +1,252 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+
+	"go.uber.org/zap"
+)
+
+// handleMirrorEvent applies a mirror whose source port is programmed here,
+// and removes one that was deleted or changed.
+func (n *networkAgent) handleMirrorEvent(ctx context.Context, event etcd.WatchEvent) {
+	mirrorID := strings.TrimPrefix(event.Key, mirrorKeyPrefix)
+
+	var mirror network.PortMirror
+	if event.Type == etcd.EventTypePut {
+		if err := json.Unmarshal([]byte(event.Value), &mirror); err != nil {
+			n.logger.Warn("failed to unmarshal mirror event", zap.Error(err))
+			return
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if event.Type != etcd.EventTypePut {
+		n.unapplyMirror(mirrorID, "")
+		delete(n.mirrors, mirrorID)
+		return
+	}
+
+	// Status reports come back through the watch
+	if old, ok := n.mirrors[mirror.ID]; ok && sameMirror(old, &mirror) {
+		old.Status = mirror.Status
+		return
+	}
+	n.unapplyMirror(mirror.ID, "")
+	n.mirrors[mirror.ID] = &mirror
+	n.applyMirror(ctx, &mirror)
+}
+
+// forgetMirrors removes and forgets the mirrors that no longer exist.
+func (n *networkAgent) forgetMirrors(present map[string]bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for id := range n.mirrors {
+		if !present[id] {
+			n.unapplyMirror(id, "")
+			delete(n.mirrors, id)
+		}
+	}
+}
+
+// applyMirrorsOf applies the mirrors of a port just programmed, as their
+// source or target. Called with mu held.
+func (n *networkAgent) applyMirrorsOf(ctx context.Context, portID string) {
+	for id, mirror := range n.mirrors {
+		if _, ok := n.applied[id]; ok {
+			continue
+		}
+		if mirror.SourcePortID == portID || mirror.TargetPortID == portID {
+			n.applyMirror(ctx, mirror)
+		}
+	}
+}
+
+// unapplyMirrorsOf removes the mirrors of a port about to be unprogrammed,
+// as their source or target, reporting them down. Called with mu held.
+func (n *networkAgent) unapplyMirrorsOf(portID string) {
+	for id, mirror := range n.mirrors {
+		if mirror.SourcePortID == portID || mirror.TargetPortID == portID {
+			n.unapplyMirror(id, statusDown)
+		}
+	}
+}
+
+// reapplyMirrors applies the applied mirrors again, after Open vSwitch lost
+// them. Called with mu held.
+func (n *networkAgent) reapplyMirrors() {
+	ids := make([]string, 0, len(n.applied))
+	for id := range n.applied {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		n.unapplyMirror(id, "")
+		n.applyMirror(n.ctx, n.mirrors[id])
+	}
+}
+
+// applyMirror mirrors the source port of a mirror, if programmed here, to
+// its target port or tunnel, and reports the outcome. Called with mu held.
+func (n *networkAgent) applyMirror(ctx context.Context, mirror *network.PortMirror) {
+	source, ok := n.ports[mirror.SourcePortID]
+	if !ok {
+		return
+	}
+
+	tunnel, err := n.addMirror(mirror, source)
+	status := statusActive
+	if err != nil {
+		n.logger.Error("failed to apply port mirror",
+			zap.String("mirror_id", mirror.ID),
+			zap.String("source_port_id", mirror.SourcePortID),
+			zap.Error(err),
+		)
+		status = statusError
+	} else {
+		n.applied[mirror.ID] = tunnel
+		n.logger.Info("applied port mirror",
+			zap.String("mirror_id", mirror.ID),
+			zap.String("source_port_id", mirror.SourcePortID),
+			zap.String("direction", string(mirror.Direction)),
+		)
+	}
+	if mirror.Status != status {
+		n.reportMirrorStatus(ctx, mirror, status)
+	}
+}
+
+// addMirror creates the mirror on the integration bridge, and the tunnel
+// port it outputs to if it has one, whose name it returns.
+func (n *networkAgent) addMirror(mirror *network.PortMirror, source *network.Port) (string, error) {
+	if n.networks[source.NetworkID].Type != network.NetworkTypeVXLAN {
+		return "", fmt.Errorf("source port %s is not on the integration bridge", source.ID)
+	}
+	bridge := n.state.config.OVSBridge
+
+	var output, tunnel string
+	switch {
+	case mirror.Tunnel != nil:
+		tunnel = mirrorTunnelDevice(mirror.ID)
+		options := map[string]string{
+			"type":              mirror.Tunnel.Type,
+			"options:remote_ip": mirror.Tunnel.RemoteIP,
+		}
+		if mirror.Tunnel.Key != 0 {
+			options["options:key"] = fmt.Sprint(mirror.Tunnel.Key)
+		}
+		if err := n.state.ovs.AddPort(bridge, tunnel, options); err != nil {
+			return "", fmt.Errorf("failed to add mirror tunnel: %w", err)
+		}
+		output = tunnel
+	default:
+		target, ok := n.ports[mirror.TargetPortID]
+		if !ok {
+			return "", fmt.Errorf("target port %s is not bound to this node", mirror.TargetPortID)
+		}
+		output = target.DeviceName
+	}
+
+	egress := mirror.Direction == network.MirrorEgress || mirror.Direction == network.MirrorBoth
+	ingress := mirror.Direction == network.MirrorIngress || mirror.Direction == network.MirrorBoth
+	// The bridge receives what the instance sends, and sends what it receives
+	if err := n.state.ovs.AddMirror(bridge, mirrorName(mirror.ID), source.DeviceName, output, egress, ingress); err != nil {
+		if tunnel != "" {
+			_ = n.state.ovs.DeletePort(bridge, tunnel)
+		}
+		return "", err
+	}
+	return tunnel, nil
+}
+
+// unapplyMirror removes an applied mirror from the bridge, reporting status
+// unless empty. Called with mu held.
+func (n *networkAgent) unapplyMirror(mirrorID, status string) {
+	tunnel, ok := n.applied[mirrorID]
+	if !ok {
+		return
+	}
+	delete(n.applied, mirrorID)
+
+	bridge := n.state.config.OVSBridge
+	if err := n.state.ovs.DeleteMirror(bridge, mirrorName(mirrorID)); err != nil {
+		n.logger.Warn("failed to remove port mirror", zap.String("mirror_id", mirrorID), zap.Error(err))
+	}
+	if tunnel != "" {
+		if err := n.state.ovs.DeletePort(bridge, tunnel); err != nil {
+			n.logger.Warn("failed to remove mirror tunnel", zap.String("mirror_id", mirrorID), zap.Error(err))
+		}
+	}
+	n.logger.Info("removed port mirror", zap.String("mirror_id", mirrorID))
+
+	if mirror, ok := n.mirrors[mirrorID]; ok && status != "" && mirror.Status != status {
+		n.reportMirrorStatus(n.ctx, mirror, status)
+	}
+}
+
+// reportMirrorStatus records the status of a mirror that still exists.
+func (n *networkAgent) reportMirrorStatus(ctx context.Context, mirror *network.PortMirror, status string) {
+	_, err := n.agent.etcdClient.Modify(ctx, mirrorKeyPrefix+mirror.ID, func(value string) (string, error) {
+		var stored network.PortMirror
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			return "", fmt.Errorf("failed to unmarshal mirror: %w", err)
+		}
+		stored.Status = status
+		stored.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(&stored)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal mirror: %w", err)
+		}
+		return string(data), nil
+	})
+	if err != nil && !errors.Is(err, etcd.ErrKeyNotFound) {
+		n.logger.Warn("failed to report mirror status",
+			zap.String("mirror_id", mirror.ID),
+			zap.String("status", status),
+			zap.Error(err),
+		)
+		return
+	}
+	mirror.Status = status
+}
+
+// sameMirror reports whether two versions of a mirror are applied the same,
+// so that status reports do not reapply it.
+func sameMirror(a, b *network.PortMirror) bool {
+	return a.SourcePortID == b.SourcePortID &&
+		a.TargetPortID == b.TargetPortID &&
+		a.Direction == b.Direction &&
+		sameMirrorTunnel(a.Tunnel, b.Tunnel)
+}
+
+func sameMirrorTunnel(a, b *network.MirrorTunnel) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// mirrorName is the name of a mirror on the bridge.
+func mirrorName(mirrorID string) string {
+	return "mirror-" + mirrorID
+}
+
+// mirrorTunnelDevice names the tunnel port of a mirror, within the 15
+// characters of an interface name.
+func mirrorTunnelDevice(mirrorID string) string {
+	id := strings.ReplaceAll(mirrorID, "-", "")
+	if len(id) > 11 {
+		id = id[:11]
+	}
+	return "mir-" + id
+}
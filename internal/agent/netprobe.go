@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/network/cgo"
+)
+
+// probePingCount is how many echo requests a connectivity check sends.
+const probePingCount = 3
+
+var pingSummaryRe = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+
+// traceNetworkProbe traces a probe packet through the integration bridge
+// and, if asked, pings its destination from a router namespace here, for
+// the server's connectivity checks. The overlay network must be set up.
+func (a *Agent) traceNetworkProbe(ctx context.Context, req *v1.AgentTraceNetworkProbeRequest) (*v1.AgentTraceNetworkProbeResponse, error) {
+	sdn := a.sdn
+
+	resp := &v1.AgentTraceNetworkProbeResponse{LastTable: -1}
+	if req.InPort != "" {
+		result, err := sdn.ovs.Trace(sdn.config.OVSBridge, &cgo.TraceProbe{
+			InPort:   req.InPort,
+			TunnelID: req.TunnelId,
+			VLANTag:  uint16(req.VlanTag),
+			SrcMAC:   req.SrcMac,
+			DstMAC:   req.DstMac,
+			SrcIP:    req.SrcIp,
+			DstIP:    req.DstIp,
+			Protocol: req.Protocol,
+			DstPort:  uint16(req.DstPort),
+		})
+		if err != nil {
+			return nil, err
+		}
+		resp.Dropped = result.Dropped
+		resp.Outputs = result.Outputs
+		resp.Flooded = result.Flooded
+		resp.TunnelDst = result.TunnelDst
+		resp.LastTable = int32(result.LastTable)
+		resp.DatapathActions = result.DatapathActions
+		resp.Trace = result.Output
+	}
+
+	if req.PingRouterId != "" {
+		ns, ok := sdn.dvr.GetNamespace(req.PingRouterId)
+		if !ok {
+			resp.PingError = fmt.Sprintf("router %s has no namespace on this node", req.PingRouterId)
+			return resp, nil
+		}
+		resp.PingSent, resp.PingReceived, resp.PingError = ping(ctx, ns.Name, req.DstIp)
+	}
+	return resp, nil
+}
+
+// ping sends echo requests to ip from a network namespace and returns how
+// many were sent and answered, or why none could be sent.
+func ping(ctx context.Context, namespace, ip string) (int32, int32, string) {
+	cmd := exec.CommandContext(ctx, "ip", "netns", "exec", namespace,
+		"ping", "-c", strconv.Itoa(probePingCount), "-i", "0.2", "-W", "1", "-q", ip)
+	// ping exits non-zero when nothing answers, which the summary tells
+	out, err := cmd.CombinedOutput()
+	m := pingSummaryRe.FindStringSubmatch(string(out))
+	if m == nil {
+		if err == nil {
+			err = errors.New("no summary in output")
+		}
+		return 0, 0, fmt.Sprintf("ping failed: %s: %v", strings.TrimSpace(string(out)), err)
+	}
+	sent, _ := strconv.Atoi(m[1])
+	received, _ := strconv.Atoi(m[2])
+	return int32(sent), int32(received), ""
+}
@@ -0,0 +1,457 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/network"
+	"hypervisor/pkg/network/cgo"
+	"hypervisor/pkg/network/overlay"
+	"hypervisor/pkg/network/router"
+
+	"go.uber.org/zap"
+)
+
+// NetworkConfig configures the node's overlay network bootstrap.
+type NetworkConfig struct {
+	// Enabled creates the OVS bridges, registers this node's VTEP and runs
+	// the distributed router on startup. Ports can only be bound to nodes
+	// that have done so.
+	Enabled bool `mapstructure:"enabled"`
+
+	// LocalIP is the VXLAN tunnel endpoint address (defaults to the node IP).
+	LocalIP string `mapstructure:"local_ip"`
+
+	// ARPResponder answers ARP requests for the addresses of ports bound
+	// to other nodes locally, instead of flooding them across the overlay.
+	ARPResponder bool `mapstructure:"arp_responder"`
+
+	// SRIOVPhysicalFunctions limits the SR-IOV virtual functions handed to
+	// instances to those of these network devices; empty offers every VF
+	// found on the node.
+	SRIOVPhysicalFunctions []string `mapstructure:"sriov_physical_functions"`
+
+	// VhostUserSocketDir holds the sockets QEMU serves vhost-user ports on
+	// for Open vSwitch to connect to. QEMU must be able to create them.
+	VhostUserSocketDir string `mapstructure:"vhost_user_socket_dir"`
+
+	// Check configures the loop that retries the bootstrap until it succeeds
+	// and then repairs bridges or flows lost to an Open vSwitch restart.
+	Check LoopConfig `mapstructure:"check"`
+
+	// FlowAudit configures the loop that compares the integration bridge
+	// with the flows installed for the ports bound here, and reinstalls
+	// those found missing.
+	FlowAudit LoopConfig `mapstructure:"flow_audit"`
+}
+
+// DefaultNetworkConfig returns the default network bootstrap configuration.
+func DefaultNetworkConfig() NetworkConfig {
+	return NetworkConfig{
+		Enabled:            true,
+		ARPResponder:       true,
+		VhostUserSocketDir: "/var/run/hypervisor/vhost-user",
+		Check: LoopConfig{
+			Interval:   10 * time.Second,
+			Jitter:     0.2,
+			MaxBackoff: 2 * time.Minute,
+		},
+		FlowAudit: LoopConfig{
+			Interval:   time.Minute,
+			Jitter:     0.2,
+			MaxBackoff: 5 * time.Minute,
+		},
+	}
+}
+
+// sdnState tracks the node's overlay network bootstrap.
+type sdnState struct {
+	config   *network.NetworkConfig
+	localIP  net.IP
+	ovs      *cgo.OVSBridge
+	vxlanMgr *overlay.VXLANManager
+	vtepMgr  *overlay.VTEPManager
+	dvr      *router.DVR
+	lbs      *router.LoadBalancerManager
+	vpns     *router.VPNManager
+	bgp      *router.BGPManager
+	ports    *networkAgent // Programs the ports bound here, once started
+
+	mu          sync.Mutex
+	vtepStarted bool
+	dvrStarted  bool
+	lbsStarted  bool
+	vpnsStarted bool
+	bgpStarted  bool
+	lastErr     error // Of the last bootstrap or repair, for health checks
+}
+
+// newSDNState prepares the overlay managers for this node.
+func (a *Agent) newSDNState() (*sdnState, error) {
+	ip := a.config.Network.LocalIP
+	if ip == "" {
+		ip = a.config.IP
+	}
+	localIP := net.ParseIP(ip)
+	if localIP == nil {
+		return nil, fmt.Errorf("invalid or missing VTEP address %q (set network.local_ip or ip)", ip)
+	}
+
+	config := network.DefaultNetworkConfig()
+	config.VXLANLocalIP = localIP.String()
+	config.ARPResponder = a.config.Network.ARPResponder
+
+	ovs := cgo.NewOVSBridge(config.OVSBridge)
+	vxlanMgr, err := overlay.NewVXLANManager(config, a.logger.Named("vxlan"), ovs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create VXLAN manager: %w", err)
+	}
+
+	dvr := router.NewDVR(config, a.etcdClient, a.nodeID, a.logger.Named("dvr"))
+	lbs := router.NewLoadBalancerManager(config, a.etcdClient, a.nodeID, a.logger.Named("lbaas"))
+	lbs.SetPortBinder(a.bindVIPPort)
+
+	return &sdnState{
+		config:   config,
+		localIP:  localIP,
+		ovs:      ovs,
+		vxlanMgr: vxlanMgr,
+		vtepMgr:  overlay.NewVTEPManager(a.etcdClient, vxlanMgr, a.logger.Named("vtep")),
+		dvr:      dvr,
+		lbs:      lbs,
+		vpns:     router.NewVPNManager(config, a.etcdClient, dvr, a.nodeID, a.logger.Named("vpnaas")),
+		bgp:      router.NewBGPManager(config, a.etcdClient, dvr, a.nodeID, a.logger.Named("bgp")),
+	}, nil
+}
+
+// startNetwork bootstraps the overlay network now and then keeps it healthy
+// in the background. Failures are retried, so the agent starts even if
+// Open vSwitch is not running yet; the node reports NetworkUnavailable until
+// the bootstrap succeeds.
+func (a *Agent) startNetwork(ctx context.Context) {
+	if !a.config.Network.Enabled {
+		return
+	}
+
+	sdn, err := a.newSDNState()
+	if err != nil {
+		a.logger.Error("network bootstrap disabled", zap.Error(err))
+		a.setNetworkCondition(ctx, registry.ConditionTrue, "InvalidConfig", err.Error())
+		return
+	}
+	a.sdn = sdn
+
+	if err := a.ensureNetwork(ctx); err != nil {
+		a.logger.Warn("network bootstrap failed, will retry", zap.Error(err))
+	}
+
+	check := a.config.Network.Check.withDefaults(DefaultNetworkConfig().Check)
+	go a.runLoop(ctx, "network-check", check, a.ensureNetwork)
+}
+
+// ensureNetwork creates or repairs the bridges and base flows, registers the
+// local VTEP and starts the distributed router, the load balancers and VPN
+// services placed here and the BGP speakers. It is safe to run repeatedly.
+func (a *Agent) ensureNetwork(ctx context.Context) (err error) {
+	sdn := a.sdn
+	sdn.mu.Lock()
+	defer sdn.mu.Unlock()
+	defer func() { sdn.lastErr = err }()
+
+	reason, problem := "", error(nil)
+	if err := sdn.vxlanMgr.CheckBridges(); err != nil {
+		reason, problem = "BridgeMissing", err
+	} else if ok, err := a.hasBaseFlow(); err != nil {
+		reason, problem = "OVSUnavailable", err
+	} else if !ok {
+		reason, problem = "FlowsMissing", fmt.Errorf("base flows missing on %s", sdn.config.OVSBridge)
+	}
+
+	if problem != nil {
+		if sdn.vtepStarted {
+			a.logger.Warn("overlay network degraded, repairing", zap.String("reason", reason), zap.Error(problem))
+		}
+		if err := sdn.vxlanMgr.Initialize(ctx, a.nodeID, sdn.localIP); err != nil {
+			a.setNetworkCondition(ctx, registry.ConditionTrue, "BridgeSetupFailed", err.Error())
+			return fmt.Errorf("failed to initialize OVS bridges: %w", err)
+		}
+		if sdn.ports != nil {
+			sdn.ports.reprogram()
+		}
+	}
+
+	if !sdn.vtepStarted {
+		if err := sdn.vtepMgr.Start(a.nodeID, a.config.Zone, sdn.localIP, sdn.config.VXLANPort); err != nil {
+			a.setNetworkCondition(ctx, registry.ConditionTrue, "VTEPRegistrationFailed", err.Error())
+			return fmt.Errorf("failed to start VTEP manager: %w", err)
+		}
+		sdn.vtepStarted = true
+		a.logger.Info("overlay network ready",
+			zap.String("local_ip", sdn.localIP.String()),
+			zap.String("bridge", sdn.config.OVSBridge),
+			zap.String("tunnel_bridge", sdn.config.OVSTunnelBridge),
+		)
+	}
+
+	// Materialize routers once the bridges their interfaces plug into exist
+	if !sdn.dvrStarted {
+		if err := sdn.dvr.Start(); err != nil {
+			a.setNetworkCondition(ctx, registry.ConditionTrue, "RouterSetupFailed", err.Error())
+			return fmt.Errorf("failed to start distributed router: %w", err)
+		}
+		sdn.dvrStarted = true
+	}
+
+	// Serve the load balancers placed here, whose VIPs plug into the same
+	// bridges
+	if !sdn.lbsStarted {
+		if err := sdn.lbs.Start(); err != nil {
+			a.setNetworkCondition(ctx, registry.ConditionTrue, "LoadBalancerSetupFailed", err.Error())
+			return fmt.Errorf("failed to start load balancer manager: %w", err)
+		}
+		sdn.lbsStarted = true
+	}
+
+	// Serve the VPN services placed here, in the router namespaces
+	if !sdn.vpnsStarted {
+		if err := sdn.vpns.Start(); err != nil {
+			a.setNetworkCondition(ctx, registry.ConditionTrue, "VPNSetupFailed", err.Error())
+			return fmt.Errorf("failed to start VPN manager: %w", err)
+		}
+		sdn.vpnsStarted = true
+	}
+
+	// Announce the external addresses of the networks naming this node as a
+	// BGP gateway
+	if !sdn.bgpStarted {
+		if err := sdn.bgp.Start(); err != nil {
+			a.setNetworkCondition(ctx, registry.ConditionTrue, "BGPSetupFailed", err.Error())
+			return fmt.Errorf("failed to start BGP manager: %w", err)
+		}
+		sdn.bgpStarted = true
+	}
+
+	// Program the ports bound here once their bridges exist
+	if sdn.ports == nil {
+		ports, err := newNetworkAgent(a, sdn, a.logger.Named("netagent"))
+		if err != nil {
+			a.setNetworkCondition(ctx, registry.ConditionTrue, "PortAgentFailed", err.Error())
+			return err
+		}
+		ports.start(ctx)
+		sdn.ports = ports
+	}
+
+	a.setNetworkCondition(ctx, registry.ConditionFalse, "SDNReady",
+		fmt.Sprintf("bridges %s and %s are set up, VTEP %s registered", sdn.config.OVSBridge, sdn.config.OVSTunnelBridge, sdn.localIP))
+	return nil
+}
+
+// hasBaseFlow reports whether the integration bridge still has the flows
+// installed by the bootstrap.
+func (a *Agent) hasBaseFlow() (bool, error) {
+	flows, err := a.sdn.ovs.DumpFlows(a.sdn.config.OVSBridge)
+	if err != nil {
+		return false, fmt.Errorf("failed to dump flows: %w", err)
+	}
+	for _, flow := range flows {
+		if flow.Cookie == overlay.BaseFlowCookie {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// stopNetwork stops programming ports, the distributed router, load
+// balancers, VPN services and BGP speakers, and deregisters the local VTEP
+// so no new ports are bound here. Flows already programmed, load balancers
+// already served and routes already announced stay, for the instances left
+// running.
+func (a *Agent) stopNetwork() {
+	if a.sdn == nil {
+		return
+	}
+	a.sdn.mu.Lock()
+	defer a.sdn.mu.Unlock()
+
+	if a.sdn.ports != nil {
+		a.sdn.ports.stop()
+	}
+	// VPN tunnels live in the router namespaces the DVR removes
+	if a.sdn.vpnsStarted {
+		if err := a.sdn.vpns.Stop(); err != nil {
+			a.logger.Warn("failed to stop VPN manager", zap.Error(err))
+		}
+	}
+	if a.sdn.dvrStarted {
+		if err := a.sdn.dvr.Stop(); err != nil {
+			a.logger.Warn("failed to stop distributed router", zap.Error(err))
+		}
+	}
+	if a.sdn.lbsStarted {
+		if err := a.sdn.lbs.Stop(); err != nil {
+			a.logger.Warn("failed to stop load balancer manager", zap.Error(err))
+		}
+	}
+	if a.sdn.bgpStarted {
+		if err := a.sdn.bgp.Stop(); err != nil {
+			a.logger.Warn("failed to stop BGP manager", zap.Error(err))
+		}
+	}
+	if !a.sdn.vtepStarted {
+		return
+	}
+	if err := a.sdn.vtepMgr.Stop(); err != nil {
+		a.logger.Warn("failed to stop VTEP manager", zap.Error(err))
+	}
+}
+
+// errConditionUnchanged aborts a node update that would not change the
+// node's conditions.
+var errConditionUnchanged = errors.New("node condition unchanged")
+
+// setNetworkCondition records the node's NetworkUnavailable condition.
+func (a *Agent) setNetworkCondition(ctx context.Context, status registry.ConditionStatus, reason, message string) {
+	if a.nodeID == "" {
+		return
+	}
+
+	condition := registry.NodeCondition{
+		Type:               registry.ConditionNetworkUnavailable,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: time.Now(),
+	}
+	node, err := a.nodeRegistry.Modify(ctx, a.nodeID, func(node *registry.Node) error {
+		if !node.SetCondition(condition) {
+			return errConditionUnchanged
+		}
+		return nil
+	})
+	if errors.Is(err, errConditionUnchanged) {
+		return
+	}
+	if err != nil {
+		a.logger.Warn("failed to update network condition", zap.Error(err))
+		return
+	}
+	a.node = node
+}
+
+// prepareNetworkMTU fills in the MTU of an instance's network, from the
+// network itself or that of its port, so the driver sizes the tap or veth it
+// plugs, and tells the guest, to match the rest of the datapath. An MTU
+// already in the spec is kept. If the network cannot be read, the driver's
+// default is left rather than failing the create.
+func (a *Agent) prepareNetworkMTU(ctx context.Context, spec *driver.InstanceSpec) {
+	netSpec := &spec.Network
+	if netSpec.MTU != 0 {
+		return
+	}
+
+	networkID := netSpec.NetworkID
+	if networkID == "" && netSpec.PortID != "" {
+		var port network.Port
+		if err := a.getSDNObject(ctx, portKeyPrefix+netSpec.PortID, &port); err != nil {
+			a.logger.Warn("failed to get port for its network MTU",
+				zap.String("port_id", netSpec.PortID),
+				zap.Error(err),
+			)
+			return
+		}
+		networkID = port.NetworkID
+	}
+	if networkID == "" {
+		return
+	}
+
+	var portNet network.Network
+	if err := a.getSDNObject(ctx, networkKeyPrefix+networkID, &portNet); err != nil {
+		a.logger.Warn("failed to get network for its MTU",
+			zap.String("network_id", networkID),
+			zap.Error(err),
+		)
+		return
+	}
+	netSpec.MTU = portNet.MTU
+}
+
+// bindPort binds an instance's SDN port to the device its driver plugged into
+// the integration bridge. Instances without a port, or whose driver did not
+// plug a device for it, are left alone.
+func (a *Agent) bindPort(ctx context.Context, instanceID string, netSpec driver.NetworkSpec) error {
+	if netSpec.PortID == "" || netSpec.DeviceName == "" {
+		return nil
+	}
+	if a.serverConn == nil {
+		return fmt.Errorf("failed to bind port %s: not connected to the server", netSpec.PortID)
+	}
+
+	if _, err := v1.NewNetworkServiceClient(a.serverConn).BindPort(ctx, &v1.BindPortRequest{
+		PortId:     netSpec.PortID,
+		InstanceId: instanceID,
+		NodeId:     a.nodeID,
+		DeviceName: netSpec.DeviceName,
+	}); err != nil {
+		return fmt.Errorf("failed to bind port %s: %w", netSpec.PortID, err)
+	}
+	return nil
+}
+
+// bindVIPPort binds the VIP port of a load balancer served here to the
+// interface plugged for it.
+func (a *Agent) bindVIPPort(ctx context.Context, portID, deviceName string) error {
+	if a.serverConn == nil {
+		return fmt.Errorf("failed to bind port %s: not connected to the server", portID)
+	}
+
+	if _, err := v1.NewNetworkServiceClient(a.serverConn).BindPort(ctx, &v1.BindPortRequest{
+		PortId:     portID,
+		NodeId:     a.nodeID,
+		DeviceName: deviceName,
+	}); err != nil {
+		return fmt.Errorf("failed to bind port %s: %w", portID, err)
+	}
+	return nil
+}
+
+// unbindPort releases an instance's SDN port after the instance is deleted.
+func (a *Agent) unbindPort(ctx context.Context, netSpec driver.NetworkSpec) error {
+	if netSpec.PortID == "" || a.serverConn == nil {
+		return nil
+	}
+
+	if _, err := v1.NewNetworkServiceClient(a.serverConn).UnbindPort(ctx, &v1.UnbindPortRequest{
+		PortId: netSpec.PortID,
+	}); err != nil {
+		return fmt.Errorf("failed to unbind port %s: %w", netSpec.PortID, err)
+	}
+	return nil
+}
+
+// sdnHealth reports whether the overlay network is set up and its last
+// check found it intact.
+func (a *Agent) sdnHealth(ctx context.Context) error {
+	sdn := a.sdn
+	if sdn == nil {
+		return errors.New("overlay network is not set up")
+	}
+	sdn.mu.Lock()
+	defer sdn.mu.Unlock()
+
+	switch {
+	case sdn.lastErr != nil:
+		return sdn.lastErr
+	case !sdn.vtepStarted || !sdn.dvrStarted || !sdn.lbsStarted || !sdn.vpnsStarted || !sdn.bgpStarted:
+		return errors.New("overlay network is not set up yet")
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+)
+
+// cpuPool dedicates host cores to instances that ask for them. Like the GPU
+// pool it recovers which cores an instance holds from its driver and only
+// tracks assignments of creates still in progress.
+type cpuPool struct {
+	nodes []driver.NUMANode
+
+	mu      sync.Mutex
+	pending map[int]string // Host CPU -> instance ID
+}
+
+func newCPUPool(nodes []driver.NUMANode) *cpuPool {
+	return &cpuPool{nodes: nodes, pending: make(map[int]string)}
+}
+
+// assign places the spec's vCPUs and memory according to its CPU placement,
+// recording the dedicated cores in spec.PinnedCPUs, or else the shared
+// cores in spec.SharedCPUs, and the memory's NUMA nodes in spec.NUMANodes. Cores come from the preferred NUMA node when it
+// has enough free, else from the single node with the most free, and only
+// span nodes when no node has enough on its own. The returned release drops
+// the pending assignment once the instance reports the cores itself or its
+// create failed.
+func (p *cpuPool) assign(spec *driver.InstanceSpec, inUse map[int]string) (func(), error) {
+	spec.PinnedCPUs, spec.NUMANodes, spec.SharedCPUs = nil, nil, nil
+	placement := spec.CPUPlacement
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !placement.DedicatedCores {
+		spec.SharedCPUs = p.shared(inUse)
+	}
+	if placement.IsZero() {
+		return func() {}, nil
+	}
+
+	// The NUMA node is a preference, so one this host lacks is ignored
+	if placement.NUMANode != nil && p.node(*placement.NUMANode) == nil {
+		placement.NUMANode = nil
+	}
+	if !placement.DedicatedCores {
+		if placement.NUMANode != nil {
+			spec.NUMANodes = []int{*placement.NUMANode}
+		}
+		return func() {}, nil
+	}
+
+	free := make(map[int][]int, len(p.nodes))
+	order := make([]int, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		for _, cpu := range node.CPUs {
+			if _, ok := inUse[cpu]; ok {
+				continue
+			}
+			if _, ok := p.pending[cpu]; ok {
+				continue
+			}
+			free[node.ID] = append(free[node.ID], cpu)
+		}
+		order = append(order, node.ID)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if pref := placement.NUMANode; pref != nil && (order[i] == *pref) != (order[j] == *pref) {
+			return order[i] == *pref
+		}
+		return len(free[order[i]]) > len(free[order[j]])
+	})
+
+	want := spec.CPUCores
+	var picked, nodes []int
+	for _, id := range order {
+		if len(free[id]) >= want {
+			picked, nodes = free[id][:want], []int{id}
+			break
+		}
+	}
+	if picked == nil {
+		for _, id := range order {
+			if len(picked) == want {
+				break
+			}
+			if n := min(want-len(picked), len(free[id])); n > 0 {
+				picked = append(picked, free[id][:n]...)
+				nodes = append(nodes, id)
+			}
+		}
+	}
+	if len(picked) < want {
+		return nil, fmt.Errorf("need %d dedicated cores, node has %d free", want, len(picked))
+	}
+
+	for _, cpu := range picked {
+		p.pending[cpu] = spec.InstanceID
+	}
+	spec.PinnedCPUs, spec.NUMANodes = picked, nodes
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, cpu := range picked {
+			delete(p.pending, cpu)
+		}
+	}, nil
+}
+
+// shared returns the host cores instances without dedicated cores run on:
+// those neither dedicated nor being dedicated to an instance. Called with
+// mu held.
+func (p *cpuPool) shared(inUse map[int]string) []int {
+	var cpus []int
+	for _, node := range p.nodes {
+		for _, cpu := range node.CPUs {
+			_, used := inUse[cpu]
+			_, pending := p.pending[cpu]
+			if !used && !pending {
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+	return cpus
+}
+
+// sharedCPUs returns the host cores instances without dedicated cores run
+// on.
+func (p *cpuPool) sharedCPUs(inUse map[int]string) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.shared(inUse)
+}
+
+// node returns the NUMA node with the given ID.
+func (p *cpuPool) node(id int) *driver.NUMANode {
+	for i := range p.nodes {
+		if p.nodes[i].ID == id {
+			return &p.nodes[i]
+		}
+	}
+	return nil
+}
+
+// status returns the host's NUMA nodes with the cores dedicated on each.
+func (p *cpuPool) status(inUse map[int]string) []driver.NUMANode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	nodes := make([]driver.NUMANode, len(p.nodes))
+	copy(nodes, p.nodes)
+	for i := range nodes {
+		nodes[i].PinnedCPUs = 0
+		for _, cpu := range nodes[i].CPUs {
+			_, used := inUse[cpu]
+			_, pending := p.pending[cpu]
+			if used || pending {
+				nodes[i].PinnedCPUs++
+			}
+		}
+	}
+	return nodes
+}
+
+// pinnedCPUsInUse maps every host core dedicated to an instance to the
+// instance.
+func (a *Agent) pinnedCPUsInUse() map[int]string {
+	a.instancesMu.RLock()
+	defer a.instancesMu.RUnlock()
+
+	inUse := make(map[int]string)
+	for _, instance := range a.instances {
+		for _, cpu := range instance.Spec.PinnedCPUs {
+			inUse[cpu] = instance.ID
+		}
+	}
+	return inUse
+}
+
+// confineShared moves the instances without dedicated cores whose shared
+// cores are out of date onto the current ones, keeping them off the cores
+// dedicated since they started and letting them use released ones.
+func (a *Agent) confineShared(ctx context.Context) {
+	cpus := a.cpus.sharedCPUs(a.pinnedCPUsInUse())
+	if len(cpus) == 0 {
+		return
+	}
+	want := driver.FormatCPUList(cpus)
+
+	a.instancesMu.RLock()
+	var stale []*driver.Instance
+	for _, instance := range a.instances {
+		spec := instance.Spec
+		if len(spec.PinnedCPUs) == 0 && driver.FormatCPUList(spec.SharedCPUs) != want {
+			stale = append(stale, instance)
+		}
+	}
+	a.instancesMu.RUnlock()
+
+	for _, instance := range stale {
+		d, ok := a.drivers[instance.Type].(driver.CPUSetDriver)
+		if !ok {
+			continue
+		}
+		if err := d.SetSharedCPUs(ctx, instance.ID, cpus); err != nil {
+			a.logger.Warn("failed to move instance to shared cores",
+				zap.String("id", instance.ID),
+				zap.String("cpus", want),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		a.instancesMu.Lock()
+		if current, ok := a.instances[instance.ID]; ok {
+			current.Spec.SharedCPUs = cpus
+		}
+		a.instancesMu.Unlock()
+	}
+}
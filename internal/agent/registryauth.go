@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/registryauth"
+	"hypervisor/pkg/compute/containerd"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+)
+
+// RegistryAuthConfig configures the agent's cache of the cluster's registry
+// credentials.
+type RegistryAuthConfig struct {
+	// CacheFile keeps the credentials across restarts, readable by the
+	// agent's user only, so images can be pulled while etcd is unreachable
+	// (empty keeps them in memory only).
+	CacheFile string `mapstructure:"cache_file"`
+
+	// ResyncInterval is how long to wait before watching again after the
+	// watch on etcd ended.
+	ResyncInterval time.Duration `mapstructure:"resync_interval"`
+}
+
+// DefaultRegistryAuthConfig returns the default registry credential cache
+// configuration.
+func DefaultRegistryAuthConfig() RegistryAuthConfig {
+	return RegistryAuthConfig{
+		CacheFile:      "/var/lib/hypervisor/registry-credentials.json",
+		ResyncInterval: 10 * time.Second,
+	}
+}
+
+// registryCredentials caches the cluster's registry credentials for image
+// pulls, following the store in etcd.
+type registryCredentials struct {
+	config RegistryAuthConfig
+	store  *registryauth.Store
+	logger *zap.Logger
+
+	mu          sync.RWMutex
+	credentials map[string]*registryauth.Credential
+}
+
+func newRegistryCredentials(config RegistryAuthConfig, store *registryauth.Store, logger *zap.Logger) *registryCredentials {
+	c := &registryCredentials{
+		config:      config,
+		store:       store,
+		logger:      logger,
+		credentials: make(map[string]*registryauth.Credential),
+	}
+	c.load()
+	return c
+}
+
+// lookup returns the credential of a registry host, for
+// containerd.CredentialsFunc.
+func (c *registryCredentials) lookup(registry string) (username, secret string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	credential, ok := c.credentials[registry]
+	if !ok {
+		return "", "", false
+	}
+	username, secret = credential.Secret()
+	return username, secret, true
+}
+
+// run keeps the cache in sync with etcd until ctx is done: it lists the
+// credentials, then follows the changes made after the list, starting over
+// whenever the watch ends.
+func (c *registryCredentials) run(ctx context.Context) {
+	for {
+		if rev, err := c.sync(ctx); err != nil {
+			c.logger.Warn("failed to sync registry credentials", zap.Error(err))
+		} else {
+			for event := range c.store.Watch(ctx, rev) {
+				c.apply(event)
+			}
+		}
+
+		interval := c.config.ResyncInterval
+		if interval <= 0 {
+			interval = DefaultRegistryAuthConfig().ResyncInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// sync replaces the cache with the credentials stored in etcd and returns
+// the revision they were read at.
+func (c *registryCredentials) sync(ctx context.Context) (int64, error) {
+	list, rev, err := c.store.ListRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	credentials := make(map[string]*registryauth.Credential, len(list))
+	for _, credential := range list {
+		credentials[credential.Registry] = credential
+	}
+
+	c.mu.Lock()
+	c.credentials = credentials
+	c.mu.Unlock()
+	c.save()
+	return rev, nil
+}
+
+func (c *registryCredentials) apply(event registryauth.Event) {
+	c.mu.Lock()
+	if event.Credential != nil {
+		c.credentials[event.Registry] = event.Credential
+	} else {
+		delete(c.credentials, event.Registry)
+	}
+	c.mu.Unlock()
+	c.save()
+
+	c.logger.Info("registry credential updated",
+		zap.String("registry", event.Registry),
+		zap.Bool("deleted", event.Credential == nil),
+	)
+}
+
+// load fills the cache from the cache file.
+func (c *registryCredentials) load() {
+	if c.config.CacheFile == "" {
+		return
+	}
+	data, err := os.ReadFile(c.config.CacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.logger.Warn("failed to read registry credential cache", zap.Error(err))
+		}
+		return
+	}
+
+	var credentials map[string]*registryauth.Credential
+	if err := json.Unmarshal(data, &credentials); err != nil || credentials == nil {
+		c.logger.Warn("ignoring unreadable registry credential cache", zap.String("path", c.config.CacheFile), zap.Error(err))
+		return
+	}
+	c.mu.Lock()
+	c.credentials = credentials
+	c.mu.Unlock()
+}
+
+// save writes the cache file, readable by the agent's user only.
+func (c *registryCredentials) save() {
+	if c.config.CacheFile == "" {
+		return
+	}
+	if err := c.writeCache(); err != nil {
+		c.logger.Warn("failed to write registry credential cache", zap.Error(err))
+	}
+}
+
+func (c *registryCredentials) writeCache() error {
+	c.mu.RLock()
+	data, err := json.Marshal(c.credentials)
+	c.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode credentials: %w", err)
+	}
+
+	path := c.config.CacheFile
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".registry-credentials-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// CreateTemp creates the file 0600, before any secret is written
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace cache file: %w", err)
+	}
+	return nil
+}
+
+// useRegistryCredentials has the drivers that pull from OCI registries
+// authenticate with the cluster's registry credentials.
+func (a *Agent) useRegistryCredentials() {
+	if d, ok := a.drivers[driver.InstanceTypeContainer].(*containerd.Driver); ok {
+		d.SetCredentials(a.registryCredentials.lookup)
+	}
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+)
+
+// defaultResizeStopTimeout bounds the wait for a graceful stop when a resize
+// restarts an instance.
+const defaultResizeStopTimeout = 60 * time.Second
+
+// ResizeOptions controls how a resize that cannot be applied live is handled.
+type ResizeOptions struct {
+	// AllowRestart stops, resizes and starts a running instance whose
+	// driver cannot resize it live.
+	AllowRestart bool
+
+	// Force stops the instance immediately instead of shutting it down.
+	Force bool
+
+	// StopTimeout is how long to wait for the instance to stop.
+	StopTimeout time.Duration
+}
+
+// ResizeInstance changes the vCPUs and memory of an instance; zero leaves a
+// value unchanged. It reports whether the instance was restarted for it.
+func (a *Agent) ResizeInstance(ctx context.Context, id string, cpuCores int, memoryMB int64, opts ResizeOptions) (bool, error) {
+	var restarted bool
+	op := fmt.Sprintf("%s:%d:%d", opResize, cpuCores, memoryMB)
+
+	err := a.workQueue.Do(ctx, id, op, func(ctx context.Context) error {
+		d, err := a.driverFor(id)
+		if err != nil {
+			return err
+		}
+		rd, ok := d.(driver.ResizeDriver)
+		if !ok {
+			return fmt.Errorf("%s driver cannot resize instances: %w", d.Name(), driver.ErrNotSupported)
+		}
+
+		// Added vCPUs would float over the host instead of getting cores of
+		// their own
+		if instance, err := a.getInstance(id); err == nil && cpuCores > 0 &&
+			cpuCores != instance.Spec.CPUCores && len(instance.Spec.PinnedCPUs) > 0 {
+			return fmt.Errorf("cannot change the vcpus of an instance with dedicated cores: %w", driver.ErrNotSupported)
+		}
+
+		err = rd.Resize(ctx, id, cpuCores, memoryMB)
+		if errors.Is(err, driver.ErrRestartRequired) && opts.AllowRestart {
+			err = a.resizeStopped(ctx, rd, id, cpuCores, memoryMB, opts)
+			restarted = err == nil
+		}
+		if err != nil {
+			return a.observeDriverErr(d, "resize", err)
+		}
+
+		a.instancesMu.Lock()
+		if instance, ok := a.instances[id]; ok {
+			if cpuCores > 0 {
+				instance.Spec.CPUCores = cpuCores
+			}
+			if memoryMB > 0 {
+				instance.Spec.MemoryMB = memoryMB
+			}
+		}
+		a.instancesMu.Unlock()
+		return nil
+	})
+	return restarted, err
+}
+
+// resizeStopped stops an instance, resizes it and starts it again. It is
+// started again even if the resize fails, so a failed resize does not leave
+// it down.
+func (a *Agent) resizeStopped(ctx context.Context, d driver.ResizeDriver, id string, cpuCores int, memoryMB int64, opts ResizeOptions) error {
+	timeout := opts.StopTimeout
+	if timeout <= 0 {
+		timeout = defaultResizeStopTimeout
+	}
+
+	a.logger.Info("restarting instance to resize it",
+		zap.String("id", id),
+		zap.Int("cpu_cores", cpuCores),
+		zap.Int64("memory_mb", memoryMB),
+	)
+
+	if err := d.Stop(ctx, id, opts.Force); err != nil {
+		return fmt.Errorf("failed to stop instance: %w", err)
+	}
+	if err := waitForState(ctx, d, id, driver.StateStopped, timeout); err != nil {
+		return err
+	}
+
+	resizeErr := d.Resize(ctx, id, cpuCores, memoryMB)
+	if err := d.Start(ctx, id); err != nil {
+		if resizeErr != nil {
+			return fmt.Errorf("failed to resize instance: %w (and to start it again: %v)", resizeErr, err)
+		}
+		return fmt.Errorf("failed to start resized instance: %w", err)
+	}
+	if resizeErr != nil {
+		return fmt.Errorf("failed to resize instance: %w", resizeErr)
+	}
+	return nil
+}
+
+// waitForState polls an instance until its driver reports state.
+func waitForState(ctx context.Context, d driver.Driver, id string, state driver.InstanceState, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		instance, err := d.Get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to get instance: %w", err)
+		}
+		if instance.State == state {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("instance did not become %s within %s", state, timeout)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+)
+
+// ShutdownConfig controls what happens to the node's instances when the
+// agent stops.
+type ShutdownConfig struct {
+	// Policy is leave-running, stop-all or migrate:
+	//   - leave-running keeps instances running unmanaged. The agent saves
+	//     its state and announces how long it will be gone, so the server
+	//     holds off failing the instances over.
+	//   - stop-all stops every instance, forcing those that do not stop
+	//     within StopTimeout.
+	//   - migrate marks the node draining so nothing new is placed on it
+	//     and has the server live migrate its instances to the nodes the
+	//     scheduler picks, for up to MigrateTimeout. Instances still on the
+	//     node afterwards get the Fallback policy.
+	Policy string `mapstructure:"policy"`
+
+	// StopTimeout is how long stop-all waits for an instance to shut down
+	// gracefully before forcing it off.
+	StopTimeout time.Duration `mapstructure:"stop_timeout"`
+
+	// MigrateTimeout bounds how long migrate spends moving instances.
+	MigrateTimeout time.Duration `mapstructure:"migrate_timeout"`
+
+	// Fallback is the policy (leave-running or stop-all) for instances
+	// migrate could not move.
+	Fallback string `mapstructure:"fallback"`
+
+	// MaxDowntime is how long the server waits for the agent to come back
+	// after a leave-running shutdown before failing the instances over.
+	MaxDowntime time.Duration `mapstructure:"max_downtime"`
+
+	// StateFile is where the agent saves its node ID and instances on
+	// shutdown and restores them from on start (empty disables it).
+	StateFile string `mapstructure:"state_file"`
+}
+
+// DefaultShutdownConfig returns the default shutdown configuration.
+func DefaultShutdownConfig() ShutdownConfig {
+	return ShutdownConfig{
+		Policy:         registry.ShutdownLeaveRunning,
+		StopTimeout:    time.Minute,
+		MigrateTimeout: 10 * time.Minute,
+		Fallback:       registry.ShutdownLeaveRunning,
+		MaxDowntime:    10 * time.Minute,
+		StateFile:      "/var/lib/hypervisor/agent-state.json",
+	}
+}
+
+// Validate checks that the policies are known.
+func (c ShutdownConfig) Validate() error {
+	switch c.Policy {
+	case registry.ShutdownLeaveRunning, registry.ShutdownStopAll, registry.ShutdownMigrate:
+	default:
+		return fmt.Errorf("unknown shutdown policy %q", c.Policy)
+	}
+	if c.Policy == registry.ShutdownMigrate {
+		switch c.Fallback {
+		case registry.ShutdownLeaveRunning, registry.ShutdownStopAll:
+		default:
+			return fmt.Errorf("shutdown fallback must be %s or %s, not %q",
+				registry.ShutdownLeaveRunning, registry.ShutdownStopAll, c.Fallback)
+		}
+	}
+	return nil
+}
+
+// forceStopTimeout bounds forcing off an instance that did not stop
+// gracefully.
+const forceStopTimeout = 30 * time.Second
+
+// shutdownInstances applies the shutdown policy and returns the policy that
+// ended up applying (the fallback when migrate could not empty the node)
+// and the instances still running.
+func (a *Agent) shutdownInstances() (string, []string) {
+	config := a.config.Shutdown
+	policy := config.Policy
+	if policy == registry.ShutdownLeaveRunning {
+		return policy, a.runningInstances(context.Background())
+	}
+
+	// Nothing new may land here while instances are stopped or moved
+	a.cordoned.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := a.updateNodeStatus(ctx, registry.NodeStatusDraining, registry.NodeStatusReady, registry.NodeStatusMaintenance)
+	cancel()
+	if err != nil {
+		a.logger.Warn("failed to mark node draining", zap.Error(err))
+	}
+
+	if policy == registry.ShutdownMigrate {
+		remaining := a.migrateInstances(config.MigrateTimeout)
+		if len(remaining) == 0 {
+			return policy, nil
+		}
+		a.logger.Warn("instances not migrated before shutdown, applying fallback policy",
+			zap.Strings("instance_ids", remaining),
+			zap.String("fallback", config.Fallback),
+		)
+		policy = config.Fallback
+		if policy == registry.ShutdownLeaveRunning {
+			return policy, remaining
+		}
+	}
+
+	a.stopAllInstances(config.StopTimeout)
+	return policy, a.runningInstances(context.Background())
+}
+
+// stopAllInstances stops the running instances in parallel, forcing off
+// those that do not stop within timeout.
+func (a *Agent) stopAllInstances(timeout time.Duration) {
+	ids := a.runningInstances(context.Background())
+	a.logger.Info("stopping instances for shutdown", zap.Int("count", len(ids)))
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := a.StopInstance(ctx, id, false)
+			cancel()
+			if err == nil {
+				return
+			}
+
+			a.logger.Warn("instance did not stop gracefully, forcing it off",
+				zap.String("instance_id", id),
+				zap.Error(err),
+			)
+			ctx, cancel = context.WithTimeout(context.Background(), forceStopTimeout)
+			defer cancel()
+			if err := a.StopInstance(ctx, id, true); err != nil {
+				a.logger.Error("failed to stop instance for shutdown",
+					zap.String("instance_id", id),
+					zap.Error(err),
+				)
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+// migrateInstances has the server live migrate the running instances off
+// the node, one at a time so the copies do not compete for the network,
+// for up to timeout. It returns the instances still running here.
+func (a *Agent) migrateInstances(timeout time.Duration) []string {
+	ids := a.runningInstances(context.Background())
+	if len(ids) == 0 {
+		return nil
+	}
+	if a.serverConn == nil {
+		a.logger.Warn("not connected to the server, cannot migrate instances")
+		return ids
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	a.logger.Info("migrating instances off the node", zap.Int("count", len(ids)))
+	client := v1.NewComputeServiceClient(a.serverConn)
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		instance, err := client.MigrateInstance(ctx, &v1.MigrateInstanceRequest{InstanceId: id})
+		if err != nil {
+			a.logger.Warn("failed to migrate instance for shutdown",
+				zap.String("instance_id", id),
+				zap.Error(err),
+			)
+			continue
+		}
+		a.logger.Info("instance migrated for shutdown",
+			zap.String("instance_id", id),
+			zap.String("node_id", instance.NodeId),
+		)
+	}
+	return a.runningInstances(context.Background())
+}
+
+// runningInstances returns the IDs of the instances the drivers report
+// running. The drivers are asked rather than the cache, which keeps
+// instances that were moved away; they are listed before the cache is
+// locked, as listing can be slow.
+func (a *Agent) runningInstances(ctx context.Context) []string {
+	var running []*driver.Instance
+	for _, d := range a.drivers {
+		instances, err := d.List(ctx)
+		if err != nil {
+			a.logger.Warn("failed to list instances", zap.String("driver", d.Name()), zap.Error(err))
+			continue
+		}
+		for _, instance := range instances {
+			if instance.State == driver.StateRunning {
+				running = append(running, instance)
+			}
+		}
+	}
+
+	a.instancesMu.RLock()
+	defer a.instancesMu.RUnlock()
+
+	ids := make([]string, 0, len(running))
+	for _, instance := range running {
+		// Report instances by the ID the control plane knows them by
+		id := instance.ID
+		for cachedID, cached := range a.instances {
+			if cached.Spec.InstanceID != "" && cached.Spec.InstanceID == instance.Spec.InstanceID {
+				id = cachedID
+				break
+			}
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// announceShutdown tells the server the agent is stopping on purpose, so
+// instances left running are not failed over while it is gone.
+func (a *Agent) announceShutdown(policy string, running []string) {
+	if a.nodeID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	if err := a.nodeRegistry.MarkShutdown(ctx, &registry.Shutdown{
+		NodeID:           a.nodeID,
+		Policy:           policy,
+		Time:             now,
+		Until:            now.Add(a.config.Shutdown.MaxDowntime),
+		RunningInstances: running,
+	}); err != nil {
+		a.logger.Warn("failed to announce shutdown", zap.Error(err))
+	}
+}
+
+// agentState is what the agent saves on shutdown to pick up where it left
+// off when it starts again.
+type agentState struct {
+	NodeID    string             `json:"node_id"`
+	Policy    string             `json:"policy"`
+	SavedAt   time.Time          `json:"saved_at"`
+	Instances []*driver.Instance `json:"instances"`
+}
+
+// saveState writes the node ID and the instance cache to the state file.
+func (a *Agent) saveState(policy string) {
+	path := a.config.Shutdown.StateFile
+	if path == "" || a.nodeID == "" {
+		return
+	}
+
+	state := agentState{NodeID: a.nodeID, Policy: policy, SavedAt: time.Now()}
+	a.instancesMu.RLock()
+	for _, instance := range a.instances {
+		state.Instances = append(state.Instances, instance)
+	}
+	a.instancesMu.RUnlock()
+	sort.Slice(state.Instances, func(i, j int) bool { return state.Instances[i].ID < state.Instances[j].ID })
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		a.logger.Warn("failed to encode agent state", zap.Error(err))
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		a.logger.Warn("failed to create agent state directory", zap.Error(err))
+		return
+	}
+	// Write then rename so a crash never leaves a truncated file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		a.logger.Warn("failed to save agent state", zap.Error(err))
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		a.logger.Warn("failed to save agent state", zap.Error(err))
+		return
+	}
+	a.logger.Info("agent state saved",
+		zap.String("path", path),
+		zap.Int("instances", len(state.Instances)),
+	)
+}
+
+// restoreState reads the state saved at the last shutdown: the node keeps
+// its ID unless one is configured, and the instance cache its control plane
+// IDs, names and labels until the drivers are reconciled.
+func (a *Agent) restoreState() {
+	path := a.config.Shutdown.StateFile
+	if path == "" {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			a.logger.Warn("failed to read agent state", zap.Error(err))
+		}
+		return
+	}
+	var state agentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		a.logger.Warn("ignoring unreadable agent state", zap.String("path", path), zap.Error(err))
+		return
+	}
+
+	if a.config.NodeID == "" {
+		a.config.NodeID = state.NodeID
+	}
+	a.instancesMu.Lock()
+	for _, instance := range state.Instances {
+		a.instances[instance.ID] = instance
+	}
+	a.instancesMu.Unlock()
+
+	a.logger.Info("agent state restored",
+		zap.String("node_id", state.NodeID),
+		zap.String("policy", state.Policy),
+		zap.Time("saved_at", state.SavedAt),
+		zap.Int("instances", len(state.Instances)),
+	)
+}
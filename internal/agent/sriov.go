@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/network"
+)
+
+// vfPool hands out the node's SR-IOV virtual functions to instances. Like
+// the GPU pool, it recovers which VF an instance holds from the instance's
+// spec and only tracks assignments of creates still in progress.
+type vfPool struct {
+	vfs []driver.HostVF
+
+	mu      sync.Mutex
+	pending map[string]string // PCI address -> instance ID
+}
+
+func newVFPool(vfs []driver.HostVF) *vfPool {
+	return &vfPool{vfs: vfs, pending: make(map[string]string)}
+}
+
+// assign picks a free VF for an instance whose port is bound with SR-IOV
+// and records it in spec.Network.VFAddress. The returned release drops the
+// pending assignment once the instance reports the VF itself or its create
+// failed.
+func (p *vfPool) assign(spec *driver.InstanceSpec, inUse map[string]string) (*driver.HostVF, func(), error) {
+	spec.Network.VFAddress = ""
+	if spec.Network.BindingType != driver.PortBindingSRIOV {
+		return nil, func() {}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.vfs {
+		vf := &p.vfs[i]
+		if !vf.Assignable() {
+			continue
+		}
+		if _, ok := inUse[vf.Address]; ok {
+			continue
+		}
+		if _, ok := p.pending[vf.Address]; ok {
+			continue
+		}
+
+		p.pending[vf.Address] = spec.InstanceID
+		spec.Network.VFAddress = vf.Address
+		release := func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			delete(p.pending, vf.Address)
+		}
+		return vf, release, nil
+	}
+	return nil, nil, fmt.Errorf("no free SR-IOV virtual function on this node")
+}
+
+// status returns the node's VFs with the instance each is assigned to.
+func (p *vfPool) status(inUse map[string]string) []driver.HostVF {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vfs := make([]driver.HostVF, len(p.vfs))
+	copy(vfs, p.vfs)
+	for i := range vfs {
+		if id, ok := inUse[vfs[i].Address]; ok {
+			vfs[i].InstanceID = id
+		} else if id, ok := p.pending[vfs[i].Address]; ok {
+			vfs[i].InstanceID = id
+		}
+	}
+	return vfs
+}
+
+// vfsInUse maps the PCI address of every VF an instance holds to the
+// instance.
+func (a *Agent) vfsInUse() map[string]string {
+	a.instancesMu.RLock()
+	defer a.instancesMu.RUnlock()
+
+	inUse := make(map[string]string)
+	for _, instance := range a.instances {
+		if addr := instance.Spec.Network.VFAddress; addr != "" {
+			inUse[addr] = instance.ID
+		}
+	}
+	return inUse
+}
+
+// prepareSRIOVPort fills in the MAC address and VLAN of the SR-IOV port an
+// instance is created with, from the port and its network, and programs
+// them into the VF the instance was assigned. The physical function then
+// tags what the guest sends and accepts only what is addressed to it,
+// whichever driver passes the VF through.
+func (a *Agent) prepareSRIOVPort(ctx context.Context, spec *driver.InstanceSpec, vf *driver.HostVF) error {
+	if vf == nil {
+		return nil
+	}
+	netSpec := &spec.Network
+	if netSpec.PortID == "" {
+		return fmt.Errorf("an SR-IOV binding needs a port")
+	}
+
+	var port network.Port
+	if err := a.getSDNObject(ctx, portKeyPrefix+netSpec.PortID, &port); err != nil {
+		return fmt.Errorf("failed to get port %s: %w", netSpec.PortID, err)
+	}
+	if port.BindingType != network.PortBindingSRIOV {
+		return fmt.Errorf("port %s is not an SR-IOV port", port.ID)
+	}
+	var portNet network.Network
+	if err := a.getSDNObject(ctx, networkKeyPrefix+port.NetworkID, &portNet); err != nil {
+		return fmt.Errorf("failed to get network %s: %w", port.NetworkID, err)
+	}
+
+	netSpec.MACAddress = port.MACAddress
+	netSpec.VLANID = 0
+	if portNet.Type == network.NetworkTypeVLAN {
+		netSpec.VLANID = portNet.VLANID
+	}
+	if port.IPAddress != "" {
+		netSpec.IPAddress = port.IPAddress
+	}
+	// The VF is the port's device on this node
+	netSpec.DeviceName = vf.Address
+
+	return configureVF(vf, netSpec.MACAddress, netSpec.VLANID)
+}
+
+// getSDNObject reads an object of the SDN controller from etcd into v.
+func (a *Agent) getSDNObject(ctx context.Context, key string, v any) error {
+	value, err := a.etcdClient.Get(ctx, key)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return errors.New("not found")
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(value), v)
+}
+
+// configureVF sets the MAC address and VLAN of a VF through its physical
+// function.
+func configureVF(vf *driver.HostVF, mac string, vlan uint16) error {
+	pf, err := netlink.LinkByName(vf.PFName)
+	if err != nil {
+		return fmt.Errorf("failed to find physical function %s: %w", vf.PFName, err)
+	}
+	if mac != "" {
+		hwAddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return fmt.Errorf("invalid MAC address %q: %w", mac, err)
+		}
+		if err := netlink.LinkSetVfHardwareAddr(pf, vf.VFIndex, hwAddr); err != nil {
+			return fmt.Errorf("failed to set MAC of VF %d on %s: %w", vf.VFIndex, vf.PFName, err)
+		}
+	}
+	if err := netlink.LinkSetVfVlan(pf, vf.VFIndex, int(vlan)); err != nil {
+		return fmt.Errorf("failed to set VLAN of VF %d on %s: %w", vf.VFIndex, vf.PFName, err)
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+)
+
+// StatsConfig controls per-instance stats collection.
+type StatsConfig struct {
+	// Interval is how often driver stats are polled for running instances.
+	Interval time.Duration `mapstructure:"interval"`
+
+	// History is the number of samples kept per instance.
+	History int `mapstructure:"history"`
+
+	// UsageWindow is how long per-instance usage is summarized for
+	// right-sizing recommendations.
+	UsageWindow time.Duration `mapstructure:"usage_window"`
+
+	// UsageInterval is the resolution of the usage summary: samples are
+	// averaged (CPU) or maxed (memory) over each interval.
+	UsageInterval time.Duration `mapstructure:"usage_interval"`
+}
+
+// DefaultStatsConfig returns the default stats collection configuration.
+func DefaultStatsConfig() StatsConfig {
+	return StatsConfig{
+		Interval:      5 * time.Second,
+		History:       120,
+		UsageWindow:   24 * time.Hour,
+		UsageInterval: time.Minute,
+	}
+}
+
+// StatsSample is a driver stats snapshot plus rates derived from the
+// previous sample of the same instance.
+type StatsSample struct {
+	Stats driver.InstanceStats
+
+	// CPUPercent is CPU time used over the sample interval, as a percentage
+	// of one core.
+	CPUPercent float64
+
+	DiskReadBytesPerSec  float64
+	DiskWriteBytesPerSec float64
+	NetworkRxBytesPerSec float64
+	NetworkTxBytesPerSec float64
+}
+
+// statsRing is a fixed-size ring buffer of samples.
+type statsRing struct {
+	samples []StatsSample
+	next    int
+	full    bool
+}
+
+func (r *statsRing) add(sample StatsSample) {
+	r.samples[r.next] = sample
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns the most recent sample.
+func (r *statsRing) last() (StatsSample, bool) {
+	if !r.full && r.next == 0 {
+		return StatsSample{}, false
+	}
+	return r.samples[(r.next+len(r.samples)-1)%len(r.samples)], true
+}
+
+// list returns the samples oldest first.
+func (r *statsRing) list() []StatsSample {
+	if !r.full {
+		return append([]StatsSample(nil), r.samples[:r.next]...)
+	}
+	return append(append([]StatsSample(nil), r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+// statsCollector polls driver stats for running instances, keeps a short
+// history per instance and fans new samples out to subscribers.
+type statsCollector struct {
+	config StatsConfig
+	agent  *Agent
+	logger *zap.Logger
+
+	mu          sync.RWMutex
+	rings       map[string]*statsRing
+	usage       map[string]*usageTracker
+	subscribers map[string]map[chan StatsSample]struct{}
+}
+
+// newStatsCollector creates a stats collector for the agent's instances.
+func newStatsCollector(config StatsConfig, agent *Agent, logger *zap.Logger) *statsCollector {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultStatsConfig().Interval
+	}
+	if config.History <= 0 {
+		config.History = DefaultStatsConfig().History
+	}
+	if config.UsageWindow <= 0 {
+		config.UsageWindow = DefaultStatsConfig().UsageWindow
+	}
+	if config.UsageInterval <= 0 {
+		config.UsageInterval = DefaultStatsConfig().UsageInterval
+	}
+
+	return &statsCollector{
+		config:      config,
+		agent:       agent,
+		logger:      logger,
+		rings:       make(map[string]*statsRing),
+		usage:       make(map[string]*usageTracker),
+		subscribers: make(map[string]map[chan StatsSample]struct{}),
+	}
+}
+
+// run polls stats until ctx is cancelled or stopCh is closed.
+func (c *statsCollector) run(ctx context.Context, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			c.collect(ctx)
+		}
+	}
+}
+
+// collect takes one sample of every running instance and drops the history
+// of instances that are gone.
+func (c *statsCollector) collect(ctx context.Context) {
+	instances, _ := c.agent.ListInstances(ctx)
+
+	present := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		present[instance.ID] = true
+		if instance.State != driver.StateRunning {
+			continue
+		}
+
+		d, ok := c.agent.drivers[instance.Type]
+		if !ok {
+			continue
+		}
+
+		stats, err := d.Stats(ctx, instance.ID)
+		if err != nil {
+			c.logger.Debug("failed to collect instance stats",
+				zap.String("instance_id", instance.ID),
+				zap.Error(err),
+			)
+			continue
+		}
+		if stats.CollectedAt.IsZero() {
+			stats.CollectedAt = time.Now()
+		}
+
+		c.record(instance.ID, stats)
+	}
+
+	c.mu.Lock()
+	for id := range c.rings {
+		if !present[id] {
+			delete(c.rings, id)
+		}
+	}
+	for id := range c.usage {
+		if !present[id] {
+			delete(c.usage, id)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// record stores a sample and sends it to the instance's subscribers.
+// Subscribers that are not keeping up miss samples rather than block
+// collection.
+func (c *statsCollector) record(instanceID string, stats *driver.InstanceStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ring, ok := c.rings[instanceID]
+	if !ok {
+		ring = &statsRing{samples: make([]StatsSample, c.config.History)}
+		c.rings[instanceID] = ring
+	}
+
+	sample := StatsSample{
+		Stats:      *stats,
+		CPUPercent: stats.CPUUsagePercent,
+	}
+	if prev, ok := ring.last(); ok {
+		sample.deriveRates(prev)
+	}
+	ring.add(sample)
+
+	usage, ok := c.usage[instanceID]
+	if !ok {
+		usage = &usageTracker{}
+		c.usage[instanceID] = usage
+	}
+	usage.add(sample, c.config.UsageInterval, c.config.UsageWindow)
+
+	for ch := range c.subscribers[instanceID] {
+		select {
+		case ch <- sample:
+		default:
+		}
+	}
+}
+
+// deriveRates fills in rates from the previous sample. Counters that went
+// backwards (e.g. after an instance restart) yield no rate.
+func (s *StatsSample) deriveRates(prev StatsSample) {
+	elapsed := s.Stats.CollectedAt.Sub(prev.Stats.CollectedAt).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	rate := func(cur, old uint64) float64 {
+		if cur < old {
+			return 0
+		}
+		return float64(cur-old) / elapsed
+	}
+
+	if s.Stats.CPUTimeNs >= prev.Stats.CPUTimeNs && s.Stats.CPUTimeNs > 0 {
+		s.CPUPercent = rate(s.Stats.CPUTimeNs, prev.Stats.CPUTimeNs) / 1e9 * 100
+	}
+	s.DiskReadBytesPerSec = rate(s.Stats.DiskReadBytes, prev.Stats.DiskReadBytes)
+	s.DiskWriteBytesPerSec = rate(s.Stats.DiskWriteBytes, prev.Stats.DiskWriteBytes)
+	s.NetworkRxBytesPerSec = rate(s.Stats.NetworkRxBytes, prev.Stats.NetworkRxBytes)
+	s.NetworkTxBytesPerSec = rate(s.Stats.NetworkTxBytes, prev.Stats.NetworkTxBytes)
+}
+
+// History returns the recent samples of an instance, oldest first.
+func (c *statsCollector) History(instanceID string) []StatsSample {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ring, ok := c.rings[instanceID]
+	if !ok {
+		return nil
+	}
+	return ring.list()
+}
+
+// Latest returns the newest sample of an instance if it is no older than
+// maxAge.
+func (c *statsCollector) Latest(instanceID string, maxAge time.Duration) (StatsSample, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ring, ok := c.rings[instanceID]
+	if !ok {
+		return StatsSample{}, false
+	}
+	sample, ok := ring.last()
+	if !ok || time.Since(sample.Stats.CollectedAt) > maxAge {
+		return StatsSample{}, false
+	}
+	return sample, true
+}
+
+// batchStatsParallelism bounds the driver stats calls a batch makes at once.
+const batchStatsParallelism = 8
+
+// InstanceStatsResult is the outcome of fetching one instance's stats in a
+// batch.
+type InstanceStatsResult struct {
+	InstanceID string
+	Stats      *driver.InstanceStats
+	Err        error
+}
+
+// BatchInstanceStats returns stats for many instances at once, in the order
+// requested. Recent collector samples are used where available so a batch
+// rarely touches the drivers; the rest are polled concurrently.
+func (a *Agent) BatchInstanceStats(ctx context.Context, instanceIDs []string) []InstanceStatsResult {
+	results := make([]InstanceStatsResult, len(instanceIDs))
+	maxAge := 2 * a.stats.config.Interval
+
+	sem := make(chan struct{}, batchStatsParallelism)
+	var wg sync.WaitGroup
+	for i, id := range instanceIDs {
+		results[i].InstanceID = id
+
+		if sample, ok := a.stats.Latest(id, maxAge); ok {
+			stats := sample.Stats
+			results[i].Stats = &stats
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *InstanceStatsResult) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				result.Err = ctx.Err()
+				return
+			}
+
+			result.Stats, result.Err = a.instanceStats(ctx, result.InstanceID)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results
+}
+
+// instanceStats polls the driver for an instance's current stats.
+func (a *Agent) instanceStats(ctx context.Context, instanceID string) (*driver.InstanceStats, error) {
+	instance, err := a.getInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	d, ok := a.drivers[instance.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported instance type: %s", instance.Type)
+	}
+
+	stats, err := d.Stats(ctx, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance stats: %w", err)
+	}
+	return stats, nil
+}
+
+// Subscribe returns a channel receiving new samples of an instance and a
+// function that cancels the subscription.
+func (c *statsCollector) Subscribe(instanceID string) (<-chan StatsSample, func()) {
+	ch := make(chan StatsSample, 16)
+
+	c.mu.Lock()
+	if c.subscribers[instanceID] == nil {
+		c.subscribers[instanceID] = make(map[chan StatsSample]struct{})
+	}
+	c.subscribers[instanceID][ch] = struct{}{}
+	c.mu.Unlock()
+
+	return ch, func() {
+		c.mu.Lock()
+		delete(c.subscribers[instanceID], ch)
+		if len(c.subscribers[instanceID]) == 0 {
+			delete(c.subscribers, instanceID)
+		}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+// usagePoint summarizes an instance's usage over one usage interval.
+type usagePoint struct {
+	Start       time.Time
+	CPUPercent  float64 // Mean over the interval
+	MemoryBytes uint64  // Peak over the interval
+}
+
+// usageTracker keeps the usage points of an instance for the usage window.
+// Points are much coarser than samples, so a day of them costs about as
+// much as the sample history.
+type usageTracker struct {
+	points []usagePoint
+
+	// The interval being accumulated
+	current usagePoint
+	cpuSum  float64
+	count   int
+
+	// When the newest sample was collected
+	last time.Time
+}
+
+// add accounts a sample, closing the current point once the sample falls
+// past its interval and dropping points older than the window.
+func (t *usageTracker) add(sample StatsSample, interval, window time.Duration) {
+	at := sample.Stats.CollectedAt
+
+	if t.count > 0 && at.Sub(t.current.Start) >= interval {
+		t.current.CPUPercent = t.cpuSum / float64(t.count)
+		t.points = append(t.points, t.current)
+		t.current, t.cpuSum, t.count = usagePoint{}, 0, 0
+	}
+	if t.count == 0 {
+		t.current.Start = at
+	}
+	t.last = at
+	t.cpuSum += sample.CPUPercent
+	t.count++
+	t.current.MemoryBytes = max(t.current.MemoryBytes, sample.Stats.MemoryUsedBytes)
+
+	cutoff := at.Add(-window)
+	drop := 0
+	for drop < len(t.points) && t.points[drop].Start.Before(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		t.points = slices.Delete(t.points, 0, drop)
+	}
+}
+
+// list returns the usage points oldest first, including the interval still
+// being accumulated.
+func (t *usageTracker) list() []usagePoint {
+	points := slices.Clone(t.points)
+	if t.count > 0 {
+		current := t.current
+		current.CPUPercent = t.cpuSum / float64(t.count)
+		points = append(points, current)
+	}
+	return points
+}
+
+// InstanceUsage summarizes an instance's resource usage over the usage
+// window.
+type InstanceUsage struct {
+	InstanceID  string
+	Points      int
+	WindowStart time.Time
+	WindowEnd   time.Time
+
+	// CPU usage as a percentage of one core
+	CPUP95Percent float64
+	CPUMaxPercent float64
+
+	MemoryP95Bytes uint64
+	MemoryMaxBytes uint64
+}
+
+// Usage returns the usage summary of an instance, or false if no samples
+// of it have been collected.
+func (c *statsCollector) Usage(instanceID string) (InstanceUsage, bool) {
+	c.mu.RLock()
+	tracker, ok := c.usage[instanceID]
+	var (
+		points []usagePoint
+		last   time.Time
+	)
+	if ok {
+		points, last = tracker.list(), tracker.last
+	}
+	c.mu.RUnlock()
+
+	if len(points) == 0 {
+		return InstanceUsage{}, false
+	}
+
+	cpu := make([]float64, len(points))
+	memory := make([]uint64, len(points))
+	for i, point := range points {
+		cpu[i] = point.CPUPercent
+		memory[i] = point.MemoryBytes
+	}
+	slices.Sort(cpu)
+	slices.Sort(memory)
+
+	return InstanceUsage{
+		InstanceID:     instanceID,
+		Points:         len(points),
+		WindowStart:    points[0].Start,
+		WindowEnd:      last,
+		CPUP95Percent:  cpu[percentileIndex(len(cpu), 95)],
+		CPUMaxPercent:  cpu[len(cpu)-1],
+		MemoryP95Bytes: memory[percentileIndex(len(memory), 95)],
+		MemoryMaxBytes: memory[len(memory)-1],
+	}, true
+}
+
+// percentileIndex returns the index of the pth percentile of n sorted
+// values, by the nearest-rank method.
+func percentileIndex(n int, p float64) int {
+	rank := int(math.Ceil(p / 100 * float64(n)))
+	return min(max(rank, 1), n) - 1
+}
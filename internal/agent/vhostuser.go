@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/network"
+	"hypervisor/pkg/network/cgo"
+
+	"go.uber.org/zap"
+)
+
+// vhostUserPrefix names the vhost-user ports plugged into the integration
+// bridge, and their sockets.
+const vhostUserPrefix = "vhu"
+
+// vhostUserPortName returns the name of the vhost-user port of an
+// instance's SDN port, or of the instance without one.
+func vhostUserPortName(netSpec *driver.NetworkSpec, instanceID string) string {
+	id := netSpec.PortID
+	if id == "" {
+		id = instanceID
+	}
+	id = strings.ReplaceAll(id, "-", "")
+	if len(id) > 11 {
+		id = id[:11]
+	}
+	return vhostUserPrefix + id
+}
+
+// integrationBridge returns the OVS bridge instances are plugged into.
+func (a *Agent) integrationBridge() string {
+	if a.sdn != nil {
+		return a.sdn.config.OVSBridge
+	}
+	return network.DefaultNetworkConfig().OVSBridge
+}
+
+// vhostUserSupported reports whether Open vSwitch on this node runs the
+// DPDK datapath and can plug vhost-user ports.
+func (a *Agent) vhostUserSupported() bool {
+	if a.config.Datapath.Mode != network.DatapathDPDK {
+		return false
+	}
+	supported, err := cgo.NewOVSBridge("").VhostUserSupported()
+	if err != nil {
+		a.logger.Debug("failed to detect vhost-user support", zap.Error(err))
+		return false
+	}
+	return supported
+}
+
+// plugVhostUserPort plugs a vhost-user port into the integration bridge for
+// an instance whose port is bound with vhost-user, and records its socket
+// and name in spec.Network for the driver. Guest memory is shared with
+// Open vSwitch, which needs it backed by hugepages. The returned unplug
+// removes the port again if the create fails.
+func (a *Agent) plugVhostUserPort(spec *driver.InstanceSpec) (func(), error) {
+	netSpec := &spec.Network
+	netSpec.VhostUserSocket = ""
+	if netSpec.BindingType != driver.PortBindingVhostUser {
+		return func() {}, nil
+	}
+	if !a.vhostUserSupported() {
+		return nil, fmt.Errorf("this node cannot plug vhost-user ports: Open vSwitch does not run the DPDK datapath")
+	}
+
+	dir := a.config.Network.VhostUserSocketDir
+	if dir == "" {
+		dir = DefaultNetworkConfig().VhostUserSocketDir
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create vhost-user socket directory: %w", err)
+	}
+
+	name := vhostUserPortName(netSpec, spec.InstanceID)
+	socket := filepath.Join(dir, name)
+	externalIDs := map[string]string{
+		"external_ids:vm-id":        spec.InstanceID,
+		"external_ids:iface-status": "active",
+	}
+	if netSpec.PortID != "" {
+		externalIDs["external_ids:iface-id"] = netSpec.PortID
+	}
+	if netSpec.MACAddress != "" {
+		externalIDs["external_ids:attached-mac"] = netSpec.MACAddress
+	}
+
+	bridge := a.integrationBridge()
+	if err := cgo.NewOVSBridge(bridge).AddVhostUserPort(bridge, name, socket, netSpec.MTU, externalIDs); err != nil {
+		return nil, fmt.Errorf("failed to plug vhost-user port %s into %s: %w", name, bridge, err)
+	}
+
+	netSpec.VhostUserSocket = socket
+	netSpec.DeviceName = name
+	spec.HugePages = true
+
+	return func() { a.unplugVhostUserPort(*netSpec) }, nil
+}
+
+// unplugVhostUserPort removes the vhost-user port of a deleted instance from
+// the integration bridge, along with the socket QEMU left behind.
+func (a *Agent) unplugVhostUserPort(netSpec driver.NetworkSpec) {
+	if netSpec.VhostUserSocket == "" {
+		return
+	}
+	name := filepath.Base(netSpec.VhostUserSocket)
+
+	bridge := a.integrationBridge()
+	if err := cgo.NewOVSBridge(bridge).DeletePort(bridge, name); err != nil {
+		a.logger.Warn("failed to unplug vhost-user port", zap.String("port", name), zap.Error(err))
+	}
+	if err := os.Remove(netSpec.VhostUserSocket); err != nil && !os.IsNotExist(err) {
+		a.logger.Warn("failed to remove vhost-user socket", zap.String("path", netSpec.VhostUserSocket), zap.Error(err))
+	}
+}
@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Instance operation names used as work queue dedup keys.
+const (
+	opCreate       = "create"
+	opStart        = "start"
+	opStop         = "stop"
+	opStopForce    = "stop-force"
+	opRestart      = "restart"
+	opRestartForce = "restart-force"
+	opResize       = "resize"
+	opPause        = "pause"
+	opResume       = "resume"
+	opSuspend      = "suspend"
+	opMigrate      = "migrate"
+	opDelete       = "delete"
+)
+
+// workItem is a single queued operation on an instance.
+type workItem struct {
+	op   string
+	ctx  context.Context
+	fn   func(ctx context.Context) error
+	done chan struct{}
+	err  error
+}
+
+// WorkQueueStats reports work queue depth and throughput.
+type WorkQueueStats struct {
+	// Pending is the number of queued operations not yet started.
+	Pending int
+	// Running is the number of operations currently executing.
+	Running int
+	// MaxDepth is the deepest any single instance queue has been.
+	MaxDepth int
+	// Depths is the per-instance queue depth (pending + running).
+	Depths map[string]int
+	// Processed is the number of operations completed.
+	Processed uint64
+	// Failed is the number of operations that returned an error.
+	Failed uint64
+	// Deduplicated is the number of requests merged into a pending operation.
+	Deduplicated uint64
+}
+
+// workQueue serializes operations per instance so that concurrent RPCs on
+// the same instance (e.g. stop racing delete) run one at a time, in arrival
+// order. A request for the same operation as the last queued one, which has
+// not started yet, joins it instead of queueing a duplicate.
+type workQueue struct {
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	queues  map[string][]*workItem
+	running map[string]string
+
+	maxDepth     int
+	processed    uint64
+	failed       uint64
+	deduplicated uint64
+
+	wg sync.WaitGroup
+}
+
+// newWorkQueue creates a new per-instance work queue.
+func newWorkQueue(logger *zap.Logger) *workQueue {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &workQueue{
+		logger:  logger,
+		queues:  make(map[string][]*workItem),
+		running: make(map[string]string),
+	}
+}
+
+// Do queues fn for instanceID and waits for it to finish. The operation runs
+// detached from ctx cancellation so a client disconnect cannot abandon a
+// driver call half way; ctx only bounds how long the caller waits.
+func (q *workQueue) Do(ctx context.Context, instanceID, op string, fn func(ctx context.Context) error) error {
+	q.mu.Lock()
+
+	// Only the last queued operation can absorb the request: joining an
+	// earlier one would reorder it around the operations in between, so
+	// start/stop/start must not collapse to start/stop
+	var item *workItem
+	if pending := q.queues[instanceID]; len(pending) > 0 && pending[len(pending)-1].op == op {
+		item = pending[len(pending)-1]
+		q.deduplicated++
+	}
+
+	if item == nil {
+		item = &workItem{
+			op:   op,
+			ctx:  context.WithoutCancel(ctx),
+			fn:   fn,
+			done: make(chan struct{}),
+		}
+		q.queues[instanceID] = append(q.queues[instanceID], item)
+
+		depth := len(q.queues[instanceID])
+		if _, busy := q.running[instanceID]; busy {
+			depth++
+		} else {
+			q.running[instanceID] = ""
+			q.wg.Add(1)
+			go q.worker(instanceID)
+		}
+		if depth > q.maxDepth {
+			q.maxDepth = depth
+		}
+
+		if depth > 1 {
+			q.logger.Debug("instance operation queued",
+				zap.String("instance_id", instanceID),
+				zap.String("op", op),
+				zap.Int("depth", depth),
+			)
+		}
+	} else {
+		q.logger.Debug("instance operation deduplicated",
+			zap.String("instance_id", instanceID),
+			zap.String("op", op),
+		)
+	}
+
+	q.mu.Unlock()
+
+	select {
+	case <-item.done:
+		return item.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// worker drains the queue for one instance and exits when it is empty.
+func (q *workQueue) worker(instanceID string) {
+	defer q.wg.Done()
+
+	for {
+		q.mu.Lock()
+		items := q.queues[instanceID]
+		if len(items) == 0 {
+			delete(q.queues, instanceID)
+			delete(q.running, instanceID)
+			q.mu.Unlock()
+			return
+		}
+		item := items[0]
+		q.queues[instanceID] = items[1:]
+		q.running[instanceID] = item.op
+		q.mu.Unlock()
+
+		item.err = item.fn(item.ctx)
+		close(item.done)
+
+		q.mu.Lock()
+		q.processed++
+		if item.err != nil {
+			q.failed++
+		}
+		q.mu.Unlock()
+	}
+}
+
+// Stats returns a snapshot of queue depth and throughput counters.
+func (q *workQueue) Stats() WorkQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := WorkQueueStats{
+		MaxDepth:     q.maxDepth,
+		Depths:       make(map[string]int, len(q.running)),
+		Processed:    q.processed,
+		Failed:       q.failed,
+		Deduplicated: q.deduplicated,
+	}
+
+	for instanceID, op := range q.running {
+		depth := len(q.queues[instanceID])
+		stats.Pending += depth
+		if op != "" {
+			stats.Running++
+			depth++
+		}
+		stats.Depths[instanceID] = depth
+	}
+
+	return stats
+}
+
+// Wait blocks until all queued operations have finished.
+func (q *workQueue) Wait() {
+	q.wg.Wait()
+}
@@ -2,53 +2,229 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	v1 "hypervisor/api/gen"
 	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/metrics"
+	"hypervisor/pkg/tracing"
 
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
-// AgentClientPool manages gRPC connections to agent nodes.
+// AgentPoolConfig configures the server's connections to agents.
+type AgentPoolConfig struct {
+	// HealthCheckInterval is how often connection states are checked.
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval"`
+
+	// ConnectTimeout bounds a connection attempt, and so how long a call
+	// to an unreachable agent can wait for one.
+	ConnectTimeout time.Duration `mapstructure:"connect_timeout"`
+
+	// InitialBackoff and MaxBackoff bound the exponential backoff between
+	// reconnection attempts.
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+
+	// EvictAfter is how long a connection may stay down before it is
+	// closed; the next call dials the address the node registered anew.
+	EvictAfter time.Duration `mapstructure:"evict_after"`
+}
+
+// DefaultAgentPoolConfig returns the default agent pool configuration.
+func DefaultAgentPoolConfig() AgentPoolConfig {
+	return AgentPoolConfig{
+		HealthCheckInterval: 10 * time.Second,
+		ConnectTimeout:      5 * time.Second,
+		InitialBackoff:      time.Second,
+		MaxBackoff:          30 * time.Second,
+		EvictAfter:          2 * time.Minute,
+	}
+}
+
+// Eviction reasons reported in metrics.
+const (
+	evictUnhealthy    = "unhealthy"
+	evictDeregistered = "deregistered"
+	evictMoved        = "address_changed"
+	evictShutdown     = "shutdown"
+)
+
+// AgentClientPool manages gRPC connections to agent nodes. A health checker
+// watches every connection: calls to an agent whose connection is down fail
+// at once with Unavailable and a retry hint instead of waiting, gRPC
+// reconnects with exponential backoff, and connections down for too long or
+// to an agent that moved are closed.
 type AgentClientPool struct {
 	registry *registry.EtcdRegistry
+	config   AgentPoolConfig
 	logger   *zap.Logger
 
+	// Agent ownership in active-active mode (nil otherwise), and the
+	// credentials calls are forwarded to the owning servers with
+	ownership *agentOwnership
+	peerCreds credentials.TransportCredentials
+
 	mu      sync.RWMutex
 	clients map[string]*agentConnection
+	peers   map[string]*grpc.ClientConn // Other servers, by address
+
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 // agentConnection holds a gRPC connection and client to an agent.
 type agentConnection struct {
 	conn   *grpc.ClientConn
 	client v1.AgentServiceClient
+	addr   string
+
+	mu        sync.Mutex
+	downSince time.Time // When the connection last went down (zero while healthy)
+	failures  int       // Consecutive health checks that found it down
 }
 
 // NewAgentClientPool creates a new agent client pool.
-func NewAgentClientPool(reg *registry.EtcdRegistry, logger *zap.Logger) *AgentClientPool {
+func NewAgentClientPool(reg *registry.EtcdRegistry, config AgentPoolConfig, logger *zap.Logger) *AgentClientPool {
 	if logger == nil {
 		logger = zap.NewNop()
 	}
 
 	return &AgentClientPool{
 		registry: reg,
+		config:   config,
 		logger:   logger,
 		clients:  make(map[string]*agentConnection),
+		peers:    make(map[string]*grpc.ClientConn),
 	}
 }
 
+// Start starts the health checker.
+func (p *AgentClientPool) Start(ctx context.Context) {
+	if p.config.HealthCheckInterval <= 0 {
+		return
+	}
+
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(p.config.HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.checkConnections(ctx)
+			}
+		}
+	}()
+}
+
+// SetOwnership makes the pool connect only to the agents this server owns
+// and forward calls for the other agents to their owners over peerCreds.
+func (p *AgentClientPool) SetOwnership(o *agentOwnership, peerCreds credentials.TransportCredentials) {
+	p.ownership = o
+	p.peerCreds = peerCreds
+}
+
 // GetClient returns an AgentServiceClient for the given node.
-// It caches connections for reuse.
+// It caches connections for reuse. In active-active mode, calls for an
+// agent owned by another server go through that server.
 func (p *AgentClientPool) GetClient(ctx context.Context, nodeID string) (v1.AgentServiceClient, error) {
+	if p.ownership != nil {
+		owned, owner, err := p.ownership.owns(ctx, nodeID)
+		if err != nil {
+			return nil, err
+		}
+		if !owned {
+			return p.forwardClient(owner, nodeID)
+		}
+	}
+
+	ac, err := p.connection(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return ac.client, nil
+}
+
+// ownedConn returns the connection to an agent this server owns, for
+// relaying calls forwarded by other servers.
+func (p *AgentClientPool) ownedConn(ctx context.Context, nodeID string) (*grpc.ClientConn, error) {
+	if p.ownership == nil {
+		return nil, status.Error(codes.FailedPrecondition, "agent call forwarding is disabled on this server")
+	}
+	owned, owner, err := p.ownership.owns(ctx, nodeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to look up agent owner: %v", err)
+	}
+	if !owned {
+		// Never forward twice. The call fails; the forwarding server's
+		// watch picks up the new owner for its next calls.
+		return nil, status.Errorf(codes.Unavailable, "agent %s is owned by %s", nodeID, owner)
+	}
+
+	ac, err := p.connection(ctx, nodeID)
+	if err != nil {
+		return nil, agentUnavailable(err)
+	}
+	return ac.conn, nil
+}
+
+// forwardClient returns a client whose calls the owning server relays.
+func (p *AgentClientPool) forwardClient(owner, nodeID string) (v1.AgentServiceClient, error) {
+	p.mu.RLock()
+	conn, ok := p.peers[owner]
+	p.mu.RUnlock()
+
+	if !ok {
+		newConn, err := grpc.NewClient(owner,
+			grpc.WithTransportCredentials(p.peerCreds),
+			tracing.DialOption(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to server %s owning agent %s: %w", owner, nodeID, err)
+		}
+
+		p.mu.Lock()
+		if conn, ok = p.peers[owner]; ok {
+			newConn.Close()
+		} else {
+			conn = newConn
+			p.peers[owner] = conn
+		}
+		p.mu.Unlock()
+	}
+
+	return v1.NewAgentServiceClient(forwardedConn{conn: conn, nodeID: nodeID}), nil
+}
+
+// connection returns the direct connection to an agent, creating it if
+// needed.
+func (p *AgentClientPool) connection(ctx context.Context, nodeID string) (*agentConnection, error) {
 	// Try to get from cache first
 	p.mu.RLock()
 	if ac, ok := p.clients[nodeID]; ok {
 		p.mu.RUnlock()
-		return ac.client, nil
+		if err := p.failFast(nodeID, ac); err != nil {
+			return nil, err
+		}
+		return ac, nil
 	}
 	p.mu.RUnlock()
 
@@ -64,26 +240,37 @@ func (p *AgentClientPool) GetClient(ctx context.Context, nodeID string) (v1.Agen
 	// Create gRPC connection
 	conn, err := grpc.NewClient(addr,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		tracing.DialOption(),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  p.config.InitialBackoff,
+				Multiplier: backoff.DefaultConfig.Multiplier,
+				Jitter:     backoff.DefaultConfig.Jitter,
+				MaxDelay:   p.config.MaxBackoff,
+			},
+			MinConnectTimeout: p.config.ConnectTimeout,
+		}),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to agent %s at %s: %w", nodeID, addr, err)
 	}
 
 	// Create client
-	client := v1.NewAgentServiceClient(conn)
+	ac := &agentConnection{
+		conn:   conn,
+		client: v1.NewAgentServiceClient(conn),
+		addr:   addr,
+	}
 
 	// Cache the connection
 	p.mu.Lock()
 	// Double-check in case another goroutine created it
-	if ac, ok := p.clients[nodeID]; ok {
+	if cached, ok := p.clients[nodeID]; ok {
 		p.mu.Unlock()
 		conn.Close() // Close our new connection since we'll use the cached one
-		return ac.client, nil
-	}
-	p.clients[nodeID] = &agentConnection{
-		conn:   conn,
-		client: client,
+		return cached, nil
 	}
+	p.clients[nodeID] = ac
 	p.mu.Unlock()
 
 	p.logger.Debug("created agent connection",
@@ -91,24 +278,173 @@ func (p *AgentClientPool) GetClient(ctx context.Context, nodeID string) (v1.Agen
 		zap.String("addr", addr),
 	)
 
-	return client, nil
+	return ac, nil
 }
 
 // RemoveClient removes a cached client connection.
 // This should be called when a node is deregistered or unhealthy.
 func (p *AgentClientPool) RemoveClient(nodeID string) {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-
 	if ac, ok := p.clients[nodeID]; ok {
 		ac.conn.Close()
 		delete(p.clients, nodeID)
 		p.logger.Debug("removed agent connection", zap.String("node_id", nodeID))
 	}
+	p.mu.Unlock()
+
+	if p.ownership != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p.ownership.release(ctx, nodeID)
+	}
+}
+
+// failFast refuses a call over a connection that is down, with a hint of
+// when gRPC will have tried to reconnect, and asks gRPC to reconnect now if
+// the connection went idle.
+func (p *AgentClientPool) failFast(nodeID string, ac *agentConnection) error {
+	switch ac.conn.GetState() {
+	case connectivity.TransientFailure:
+		ac.mu.Lock()
+		failures := ac.failures
+		ac.mu.Unlock()
+		metrics.ObserveAgentPoolFailFast()
+		return agentDownError(nodeID, p.retryDelay(failures))
+	case connectivity.Shutdown:
+		p.evict(nodeID, ac, evictShutdown)
+		return agentDownError(nodeID, p.config.InitialBackoff)
+	case connectivity.Idle:
+		ac.conn.Connect()
+	}
+	return nil
 }
 
-// Close closes all cached connections.
+// retryDelay is the backoff after the given number of consecutive failed
+// health checks.
+func (p *AgentClientPool) retryDelay(failures int) time.Duration {
+	delay := p.config.InitialBackoff
+	for i := 0; i < failures && delay < p.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, p.config.MaxBackoff)
+}
+
+// checkConnections records the state of every connection and closes those
+// that have been down too long or whose agent deregistered or moved.
+func (p *AgentClientPool) checkConnections(ctx context.Context) {
+	p.mu.RLock()
+	conns := make(map[string]*agentConnection, len(p.clients))
+	for nodeID, ac := range p.clients {
+		conns[nodeID] = ac
+	}
+	p.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for nodeID, ac := range conns {
+		state := ac.conn.GetState()
+		counts[state.String()]++
+
+		if reason := p.evictionReason(ctx, nodeID, ac, state); reason != "" {
+			p.evict(nodeID, ac, reason)
+		}
+	}
+	metrics.SetAgentPoolConnections(counts)
+}
+
+// evictionReason updates the health of a connection and returns why it
+// should be closed, if it should.
+func (p *AgentClientPool) evictionReason(ctx context.Context, nodeID string, ac *agentConnection, state connectivity.State) string {
+	if state == connectivity.Shutdown {
+		return evictShutdown
+	}
+
+	node, err := p.registry.Get(ctx, nodeID)
+	switch {
+	case errors.Is(err, registry.ErrNodeNotFound):
+		return evictDeregistered
+	case err == nil && fmt.Sprintf("%s:%d", node.IP, node.Port) != ac.addr:
+		return evictMoved
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	switch state {
+	case connectivity.Ready, connectivity.Idle:
+		if ac.failures > 0 {
+			p.logger.Info("agent connection recovered",
+				zap.String("node_id", nodeID),
+				zap.Int("failed_checks", ac.failures),
+			)
+		}
+		ac.downSince, ac.failures = time.Time{}, 0
+		return ""
+	case connectivity.Connecting:
+		// Still trying; only counts once it has been down before
+		if ac.downSince.IsZero() {
+			return ""
+		}
+	}
+
+	if ac.downSince.IsZero() {
+		ac.downSince = time.Now()
+		p.logger.Warn("agent connection down",
+			zap.String("node_id", nodeID),
+			zap.String("addr", ac.addr),
+		)
+	}
+	ac.failures++
+	if p.config.EvictAfter > 0 && time.Since(ac.downSince) >= p.config.EvictAfter {
+		return evictUnhealthy
+	}
+	return ""
+}
+
+// evict closes a connection unless it was already replaced.
+func (p *AgentClientPool) evict(nodeID string, ac *agentConnection, reason string) {
+	p.mu.Lock()
+	if p.clients[nodeID] != ac {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.clients, nodeID)
+	p.mu.Unlock()
+
+	ac.conn.Close()
+	metrics.ObserveAgentPoolEviction(reason)
+	p.logger.Info("closed agent connection",
+		zap.String("node_id", nodeID),
+		zap.String("addr", ac.addr),
+		zap.String("reason", reason),
+	)
+}
+
+// agentDownError is the Unavailable error of a call refused because the
+// agent's connection is down. It carries a RetryInfo detail with delay.
+func agentDownError(nodeID string, delay time.Duration) error {
+	st := status.Newf(codes.Unavailable, "agent %s is unreachable, retry in %s", nodeID, delay)
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// agentUnavailable turns an error getting an agent client into an
+// Unavailable status, keeping the status and retry hint of a call refused
+// by the pool.
+func agentUnavailable(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.Unavailable, "failed to connect to agent: %v", err)
+}
+
+// Close stops the health checker and closes all cached connections.
 func (p *AgentClientPool) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+		<-p.done
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -121,7 +457,17 @@ func (p *AgentClientPool) Close() error {
 		}
 	}
 
+	for addr, conn := range p.peers {
+		if err := conn.Close(); err != nil {
+			p.logger.Warn("failed to close server connection",
+				zap.String("addr", addr),
+				zap.Error(err),
+			)
+		}
+	}
+
 	p.clients = make(map[string]*agentConnection)
+	p.peers = make(map[string]*grpc.ClientConn)
 	return nil
 }
 
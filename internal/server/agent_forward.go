@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	v1 "hypervisor/api/gen"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// forwardNodeKey is the metadata key naming the agent a forwarded call
+	// is for.
+	forwardNodeKey = "x-hypervisor-agent-node"
+
+	// forwardCodecName is the content-subtype of forwarded agent calls. The
+	// owning server relays their messages without decoding them.
+	forwardCodecName = "hypervisor-forward"
+)
+
+func init() {
+	encoding.RegisterCodec(frameCodec{name: forwardCodecName})
+}
+
+// frame is a message relayed as is.
+type frame struct {
+	payload []byte
+}
+
+// frameCodec passes frames through and encodes anything else as protobuf.
+type frameCodec struct {
+	name string
+}
+
+func (c frameCodec) Marshal(v any) ([]byte, error) {
+	if f, ok := v.(*frame); ok {
+		return f.payload, nil
+	}
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (c frameCodec) Unmarshal(data []byte, v any) error {
+	if f, ok := v.(*frame); ok {
+		f.payload = append([]byte(nil), data...)
+		return nil
+	}
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+func (c frameCodec) Name() string {
+	return c.name
+}
+
+// peerCredentials builds the mutual TLS credentials of the calls between
+// servers: serving requires a client certificate signed by the cluster CA,
+// and forwarding presents this server's certificate and verifies the
+// owner's.
+func (c CoordinationConfig) peerCredentials() (server, client credentials.TransportCredentials, err error) {
+	if c.CertFile == "" || c.KeyFile == "" || c.CAFile == "" {
+		return nil, nil, fmt.Errorf("coordination needs cert_file, key_file and ca_file to authenticate the other servers")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("no certificates in cluster CA %s", c.CAFile)
+	}
+
+	server = credentials.NewTLS(&tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	client = credentials.NewTLS(&tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	})
+	return server, client, nil
+}
+
+// authorizePeer checks that a forwarded call comes from another server: its
+// certificate was verified against the cluster CA by the TLS handshake and,
+// if the configuration lists peer names, carries one of them.
+func (s *Server) authorizePeer(ctx context.Context) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "forwarded agent call without a peer")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return status.Error(codes.Unauthenticated, "forwarded agent call without a verified server certificate")
+	}
+
+	names := s.config.Coordination.PeerNames
+	if len(names) == 0 {
+		return nil
+	}
+	cert := info.State.VerifiedChains[0][0]
+	if slices.Contains(names, cert.Subject.CommonName) {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if slices.Contains(names, name) {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "server certificate %q is not an allowed peer", cert.Subject.CommonName)
+}
+
+// forwardedConn sends agent calls for one node through the server owning
+// that agent.
+type forwardedConn struct {
+	conn   *grpc.ClientConn
+	nodeID string
+}
+
+func (c forwardedConn) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardNodeKey, c.nodeID)
+	opts = append(opts, grpc.CallContentSubtype(forwardCodecName))
+	return c.conn.Invoke(ctx, method, args, reply, opts...)
+}
+
+func (c forwardedConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardNodeKey, c.nodeID)
+	opts = append(opts, grpc.CallContentSubtype(forwardCodecName))
+	return c.conn.NewStream(ctx, desc, method, opts...)
+}
+
+// forwardAgentStream relays an agent call forwarded by another server to
+// the agent this server owns. It serves every method of the peer listener,
+// so anything but forwarded AgentService calls from an authenticated
+// server is rejected.
+func (s *Server) forwardAgentStream(_ any, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	method, _ := grpc.MethodFromServerStream(stream)
+	if !strings.HasPrefix(method, "/"+v1.AgentService_ServiceDesc.ServiceName+"/") {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+	if err := s.authorizePeer(ctx); err != nil {
+		s.logger.Warn("rejected forwarded agent call",
+			zap.String("method", method),
+			zap.String("caller", callerAddr(ctx)),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	nodes := md.Get(forwardNodeKey)
+	if len(nodes) != 1 {
+		return status.Errorf(codes.InvalidArgument, "forwarded agent call without %s", forwardNodeKey)
+	}
+
+	conn, err := s.agentClients.ownedConn(ctx, nodes[0])
+	if err != nil {
+		return err
+	}
+
+	clientCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	desc := &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
+	client, err := conn.NewStream(clientCtx, desc, method, grpc.ForceCodec(frameCodec{name: "proto"}))
+	if err != nil {
+		return err
+	}
+
+	// Requests: caller to agent
+	go func() {
+		for {
+			var f frame
+			if err := stream.RecvMsg(&f); err != nil {
+				if errors.Is(err, io.EOF) {
+					client.CloseSend()
+				} else {
+					cancel()
+				}
+				return
+			}
+			if err := client.SendMsg(&f); err != nil {
+				// The receive loop below reports the agent's status
+				return
+			}
+		}
+	}()
+
+	// Responses: agent to caller
+	for first := true; ; first = false {
+		var f frame
+		err := client.RecvMsg(&f)
+		if first {
+			if header, herr := client.Header(); herr == nil {
+				stream.SetHeader(header)
+			}
+		}
+		if err != nil {
+			stream.SetTrailer(client.Trailer())
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err := stream.SendMsg(&f); err != nil {
+			s.logger.Debug("forwarded agent call aborted by caller",
+				zap.String("method", method),
+				zap.String("node_id", nodes[0]),
+				zap.Error(err),
+			)
+			return err
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/registry"
+)
+
+// instanceCapabilities returns the optional operations of the driver
+// running an instance: those its node advertises for the instance type, or
+// else those the agent last reported with the instance. It returns nil if
+// neither is known, e.g. for a node running an older agent, which leaves
+// refusing an operation to the agent. Operations an older agent did not
+// report are taken as supported for the same reason.
+func (s *ComputeService) instanceCapabilities(ctx context.Context, instance *registry.Instance) *registry.InstanceCapabilities {
+	if instance.NodeID != "" {
+		if node, err := s.nodeRegistry.Get(ctx, instance.NodeID); err == nil {
+			if caps := node.CapabilitiesFor(registry.InstanceType(instance.Type)); caps != nil {
+				return caps
+			}
+		}
+	}
+	if instance.Capabilities == nil || instance.Capabilities.ReportsOperations {
+		return instance.Capabilities
+	}
+	caps := *instance.Capabilities
+	caps.Pause, caps.Suspend, caps.Resize, caps.Migrate, caps.Diagnostics = true, true, true, true, true
+	return &caps
+}
+
+// requireCapability refuses an operation the driver is known not to
+// support with Unimplemented, before the agent is contacted. supported
+// picks the operation from caps.
+func requireCapability(caps *registry.InstanceCapabilities, operation string, supported func(*registry.InstanceCapabilities) bool) error {
+	if caps == nil || supported(caps) {
+		return nil
+	}
+	return apierror.Unsupported(caps.Driver, operation, fmt.Sprintf("%s is not supported by driver %s", operation, caps.Driver))
+}
@@ -2,9 +2,21 @@ package server
 
 import (
 	"context"
+	"io"
+	"time"
 
 	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/apiconv"
+	"hypervisor/pkg/cluster/commands"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/latency"
+	"hypervisor/pkg/cluster/maintenance"
+	"hypervisor/pkg/cluster/notify"
 	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/cluster/registryauth"
+	"hypervisor/pkg/cluster/upgrade"
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/health"
 
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -36,6 +48,9 @@ func (h *ClusterGRPCHandler) RegisterNode(ctx context.Context, req *v1.RegisterN
 	if req.Capacity != nil {
 		serviceReq.Capacity = protoResourcesToRegistry(req.Capacity)
 	}
+	if req.Allocatable != nil {
+		serviceReq.Allocatable = protoResourcesToRegistry(req.Allocatable)
+	}
 
 	if req.Metadata != nil {
 		serviceReq.Labels = req.Metadata.Labels
@@ -121,6 +136,188 @@ func (h *ClusterGRPCHandler) UpdateNodeStatus(ctx context.Context, req *v1.Updat
 	return registryNodeToProto(node), nil
 }
 
+// UpdateNode implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) UpdateNode(ctx context.Context, req *v1.UpdateNodeRequest) (*v1.Node, error) {
+	node, err := h.service.UpdateNode(ctx, &UpdateNodeRequest{
+		NodeID:       req.NodeId,
+		Labels:       req.Labels,
+		RemoveLabels: req.RemoveLabels,
+		Taints:       protoTaintsToDriver(req.Taints),
+		RemoveTaints: protoTaintsToDriver(req.RemoveTaints),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return registryNodeToProto(node), nil
+}
+
+// CordonNode implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) CordonNode(ctx context.Context, req *v1.CordonNodeRequest) (*v1.Node, error) {
+	node, err := h.service.CordonNode(ctx, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	return registryNodeToProto(node), nil
+}
+
+// UncordonNode implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) UncordonNode(ctx context.Context, req *v1.CordonNodeRequest) (*v1.Node, error) {
+	node, err := h.service.UncordonNode(ctx, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	return registryNodeToProto(node), nil
+}
+
+// DrainNode implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) DrainNode(ctx context.Context, req *v1.DrainNodeRequest) (*v1.DrainNodeResponse, error) {
+	resp, err := h.service.DrainNode(ctx, &DrainNodeRequest{
+		NodeID: req.NodeId,
+		Force:  req.Force,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.DrainNodeResponse{
+		Node:              registryNodeToProto(resp.Node),
+		StoppedInstances:  int32(resp.StoppedInstances),
+		FailedInstanceIds: resp.FailedInstanceIDs,
+	}, nil
+}
+
+// CreateMaintenanceWindow implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) CreateMaintenanceWindow(ctx context.Context, req *v1.CreateMaintenanceWindowRequest) (*v1.MaintenanceWindow, error) {
+	window, err := h.service.CreateMaintenanceWindow(ctx, &CreateMaintenanceWindowRequest{
+		Name:         req.Name,
+		NodeIDs:      req.NodeIds,
+		NodeSelector: req.NodeSelector,
+		Schedule:     req.Schedule,
+		TimeZone:     req.TimeZone,
+		Duration:     time.Duration(req.DurationSeconds) * time.Second,
+		Drain:        req.Drain,
+		Force:        req.Force,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return maintenanceWindowToProto(window), nil
+}
+
+// GetMaintenanceWindow implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) GetMaintenanceWindow(ctx context.Context, req *v1.GetMaintenanceWindowRequest) (*v1.MaintenanceWindow, error) {
+	window, err := h.service.GetMaintenanceWindow(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return maintenanceWindowToProto(window), nil
+}
+
+// ListMaintenanceWindows implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) ListMaintenanceWindows(ctx context.Context, req *v1.ListMaintenanceWindowsRequest) (*v1.ListMaintenanceWindowsResponse, error) {
+	windows, err := h.service.ListMaintenanceWindows(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.ListMaintenanceWindowsResponse{}
+	for _, window := range windows {
+		resp.Windows = append(resp.Windows, maintenanceWindowToProto(window))
+	}
+	return resp, nil
+}
+
+// DeleteMaintenanceWindow implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) DeleteMaintenanceWindow(ctx context.Context, req *v1.DeleteMaintenanceWindowRequest) (*emptypb.Empty, error) {
+	if err := h.service.DeleteMaintenanceWindow(ctx, req.Name); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// SetRegistryCredential implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) SetRegistryCredential(ctx context.Context, req *v1.SetRegistryCredentialRequest) (*v1.RegistryCredential, error) {
+	credential, err := h.service.SetRegistryCredential(ctx, &SetRegistryCredentialRequest{
+		Registry:      req.Registry,
+		Username:      req.Username,
+		Password:      req.Password,
+		IdentityToken: req.IdentityToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return registryCredentialToProto(credential), nil
+}
+
+// ListRegistryCredentials implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) ListRegistryCredentials(ctx context.Context, req *v1.ListRegistryCredentialsRequest) (*v1.ListRegistryCredentialsResponse, error) {
+	credentials, err := h.service.ListRegistryCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.ListRegistryCredentialsResponse{}
+	for _, credential := range credentials {
+		resp.Credentials = append(resp.Credentials, registryCredentialToProto(credential))
+	}
+	return resp, nil
+}
+
+// DeleteRegistryCredential implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) DeleteRegistryCredential(ctx context.Context, req *v1.DeleteRegistryCredentialRequest) (*emptypb.Empty, error) {
+	if err := h.service.DeleteRegistryCredential(ctx, req.Registry); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// CollectSupportBundle implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) CollectSupportBundle(req *v1.CollectSupportBundleRequest, stream v1.ClusterService_CollectSupportBundleServer) error {
+	agentStream, err := h.service.CollectSupportBundle(stream.Context(), &CollectSupportBundleRequest{
+		NodeID:          req.NodeId,
+		LogSinceSeconds: req.LogSinceSeconds,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		chunk, err := agentStream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// GetClusterHealth implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) GetClusterHealth(ctx context.Context, req *v1.GetClusterHealthRequest) (*v1.ClusterHealth, error) {
+	clusterHealth, err := h.service.GetClusterHealth(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.ClusterHealth{Healthy: clusterHealth.Healthy}
+	for _, component := range clusterHealth.Components {
+		item := &v1.ComponentHealth{
+			Component: component.Component,
+			Name:      component.Name,
+			Healthy:   component.Healthy,
+			Error:     component.Error,
+		}
+		for _, check := range component.Checks {
+			item.Checks = append(item.Checks, healthCheckToProto(check))
+		}
+		resp.Components = append(resp.Components, item)
+	}
+	return resp, nil
+}
+
 // Heartbeat implements v1.ClusterServiceServer.
 func (h *ClusterGRPCHandler) Heartbeat(ctx context.Context, req *v1.HeartbeatRequest) (*v1.HeartbeatResponse, error) {
 	resp, err := h.service.Heartbeat(ctx, &HeartbeatRequest{
@@ -135,11 +332,7 @@ func (h *ClusterGRPCHandler) Heartbeat(ctx context.Context, req *v1.HeartbeatReq
 
 	commands := make([]*v1.NodeCommand, len(resp.Commands))
 	for i, cmd := range resp.Commands {
-		commands[i] = &v1.NodeCommand{
-			Id:         cmd.ID,
-			Type:       cmd.Type,
-			Parameters: cmd.Parameters,
-		}
+		commands[i] = nodeCommandToProto(cmd)
 	}
 
 	return &v1.HeartbeatResponse{
@@ -149,6 +342,36 @@ func (h *ClusterGRPCHandler) Heartbeat(ctx context.Context, req *v1.HeartbeatReq
 	}, nil
 }
 
+// SendNodeCommand implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) SendNodeCommand(ctx context.Context, req *v1.SendNodeCommandRequest) (*v1.NodeCommand, error) {
+	cmd, err := h.service.SendNodeCommand(ctx, &SendNodeCommandRequest{
+		NodeID:     req.NodeId,
+		Type:       req.Type,
+		Parameters: req.Parameters,
+		Wait:       time.Duration(req.WaitSeconds) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodeCommandToProto(cmd), nil
+}
+
+// ListNodeCommands implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) ListNodeCommands(ctx context.Context, req *v1.ListNodeCommandsRequest) (*v1.ListNodeCommandsResponse, error) {
+	list, err := h.service.ListNodeCommands(ctx, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.ListNodeCommandsResponse{
+		Commands: make([]*v1.NodeCommand, len(list)),
+	}
+	for i, cmd := range list {
+		resp.Commands[i] = nodeCommandToProto(cmd)
+	}
+	return resp, nil
+}
+
 // WatchNodes implements v1.ClusterServiceServer.
 func (h *ClusterGRPCHandler) WatchNodes(req *v1.WatchNodesRequest, stream v1.ClusterService_WatchNodesServer) error {
 	return h.service.WatchNodes(stream.Context(), &WatchNodesRequest{
@@ -181,6 +404,70 @@ func (h *ClusterGRPCHandler) GetClusterInfo(ctx context.Context, _ *emptypb.Empt
 	}, nil
 }
 
+// ListEvents implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) ListEvents(ctx context.Context, req *v1.ListEventsRequest) (*v1.ListEventsResponse, error) {
+	filter := events.Filter{
+		Kind:     req.Kind,
+		ObjectID: req.ObjectId,
+		NodeID:   req.NodeId,
+		Type:     req.Type,
+		Reason:   req.Reason,
+		Limit:    int(req.Limit),
+	}
+	if req.Since != nil {
+		filter.Since = req.Since.AsTime()
+	}
+
+	list, err := h.service.ListEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.ListEventsResponse{
+		Events: make([]*v1.Event, len(list)),
+	}
+	for i, event := range list {
+		resp.Events[i] = eventToProto(event)
+	}
+	return resp, nil
+}
+
+// GetNotificationStatus implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) GetNotificationStatus(ctx context.Context, _ *v1.GetNotificationStatusRequest) (*v1.GetNotificationStatusResponse, error) {
+	enabled, list, err := h.service.GetNotificationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.GetNotificationStatusResponse{
+		Enabled:  enabled,
+		Webhooks: make([]*v1.WebhookStatus, len(list)),
+	}
+	for i, st := range list {
+		resp.Webhooks[i] = webhookStatusToProto(st)
+	}
+	return resp, nil
+}
+
+// GetUpgradePlan implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) GetUpgradePlan(ctx context.Context, req *v1.GetUpgradePlanRequest) (*v1.UpgradePlan, error) {
+	plan, err := h.service.GetUpgradePlan(ctx, req.TargetVersion)
+	if err != nil {
+		return nil, err
+	}
+	return upgradePlanToProto(plan), nil
+}
+
+// GetLatencyMatrix implements v1.ClusterServiceServer.
+func (h *ClusterGRPCHandler) GetLatencyMatrix(ctx context.Context, req *v1.GetLatencyMatrixRequest) (*v1.LatencyMatrix, error) {
+	path := latency.Path(req.Path)
+	nodes, matrix, err := h.service.GetLatencyMatrix(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return latencyMatrixToProto(nodes, matrix, path), nil
+}
+
 // ============================================================================
 // Conversion helpers
 // ============================================================================
@@ -314,8 +601,14 @@ func registryNodeToProto(node *registry.Node) *v1.Node {
 		Allocatable: registryResourcesToProto(node.Allocatable),
 		Allocated:   registryResourcesToProto(node.Allocated),
 		Conditions:  registryConditionsToProto(node.Conditions),
-		CreatedAt:   timestamppb.New(node.CreatedAt),
-		LastSeen:    timestamppb.New(node.LastSeen),
+		Creates: &v1.CreateLoad{
+			Limit:    int32(node.Creates.Limit),
+			InFlight: int32(node.Creates.InFlight),
+			Queued:   int32(node.Creates.Queued),
+		},
+		Images:    node.Images,
+		CreatedAt: timestamppb.New(node.CreatedAt),
+		LastSeen:  timestamppb.New(node.LastSeen),
 	}
 
 	// Convert metadata
@@ -331,9 +624,89 @@ func registryNodeToProto(node *registry.Node) *v1.Node {
 		proto.SupportedInstanceTypes = append(proto.SupportedInstanceTypes, string(t))
 	}
 
+	// Convert host CPU
+	if node.CPU != nil {
+		proto.Cpu = &v1.HostCPU{
+			Vendor:    node.CPU.Vendor,
+			ModelName: node.CPU.ModelName,
+			Features:  node.CPU.Features,
+			Models:    node.CPU.Models,
+		}
+	}
+
+	for _, gpu := range node.GPUs {
+		proto.Gpus = append(proto.Gpus, &v1.HostGPU{
+			Address:    gpu.Address,
+			VendorId:   gpu.VendorID,
+			DeviceId:   gpu.DeviceID,
+			IommuGroup: int32(gpu.IOMMUGroup),
+			Driver:     gpu.Driver,
+			InstanceId: gpu.InstanceID,
+		})
+	}
+
+	for _, vf := range node.VFs {
+		proto.Vfs = append(proto.Vfs, &v1.HostVF{
+			Address:    vf.Address,
+			PfName:     vf.PFName,
+			VfIndex:    int32(vf.VFIndex),
+			VendorId:   vf.VendorID,
+			DeviceId:   vf.DeviceID,
+			IommuGroup: int32(vf.IOMMUGroup),
+			InstanceId: vf.InstanceID,
+		})
+	}
+
+	for _, numa := range node.NUMA {
+		proto.Numa = append(proto.Numa, &v1.NUMANode{
+			Id:          int32(numa.ID),
+			Cpus:        apiconv.Int32s(numa.CPUs),
+			MemoryBytes: numa.MemoryBytes,
+			PinnedCpus:  int32(numa.PinnedCPUs),
+		})
+	}
+
+	if host := node.Host; host != nil {
+		proto.Host = &v1.HostInventory{
+			Architecture:         host.Architecture,
+			KernelVersion:        host.KernelVersion,
+			OsImage:              host.OSImage,
+			Kvm:                  host.KVM,
+			Virtualization:       host.Virtualization,
+			NestedVirtualization: host.NestedVirtualization,
+			VhostUser:            host.VhostUser,
+		}
+		for _, fs := range host.Filesystems {
+			proto.Host.Filesystems = append(proto.Host.Filesystems, &v1.Filesystem{
+				Path:           fs.Path,
+				CapacityBytes:  fs.CapacityBytes,
+				AvailableBytes: fs.AvailableBytes,
+			})
+		}
+	}
+
+	for _, taint := range node.Taints {
+		proto.Taints = append(proto.Taints, &v1.Taint{Key: taint.Key, Value: taint.Value, Effect: taint.Effect})
+	}
+
+	if len(node.Capabilities) > 0 {
+		proto.Capabilities = make(map[string]*v1.InstanceCapabilities, len(node.Capabilities))
+		for t, caps := range node.Capabilities {
+			proto.Capabilities[string(t)] = apiconv.CapabilitiesToProto(caps)
+		}
+	}
+
 	return proto
 }
 
+func protoTaintsToDriver(taints []*v1.Taint) []driver.Taint {
+	var result []driver.Taint
+	for _, t := range taints {
+		result = append(result, driver.Taint{Key: t.Key, Value: t.Value, Effect: t.Effect})
+	}
+	return result
+}
+
 func registryEventTypeToProto(t registry.EventType) v1.EventType {
 	switch t {
 	case registry.EventAdded:
@@ -346,3 +719,194 @@ func registryEventTypeToProto(t registry.EventType) v1.EventType {
 		return v1.EventType_EVENT_TYPE_UNSPECIFIED
 	}
 }
+
+func nodeCommandToProto(cmd *commands.Command) *v1.NodeCommand {
+	pb := &v1.NodeCommand{
+		Id:         cmd.ID,
+		Type:       cmd.Type,
+		Parameters: cmd.Parameters,
+		NodeId:     cmd.NodeID,
+		State:      string(cmd.State),
+		Message:    cmd.Message,
+		Result:     cmd.Result,
+		CreatedAt:  timestamppb.New(cmd.CreatedAt),
+	}
+	if !cmd.FinishedAt.IsZero() {
+		pb.FinishedAt = timestamppb.New(cmd.FinishedAt)
+	}
+	return pb
+}
+
+func eventToProto(e *events.Event) *v1.Event {
+	return &v1.Event{
+		Id:        e.ID,
+		Time:      timestamppb.New(e.Time),
+		Type:      e.Type,
+		Kind:      e.Kind,
+		ObjectId:  e.ObjectID,
+		NodeId:    e.NodeID,
+		Reason:    e.Reason,
+		Message:   e.Message,
+		Actor:     e.Actor,
+		Component: e.Component,
+	}
+}
+
+func webhookStatusToProto(s *notify.WebhookStatus) *v1.WebhookStatus {
+	recent := make([]*v1.WebhookDelivery, len(s.Recent))
+	for i, d := range s.Recent {
+		recent[i] = &v1.WebhookDelivery{
+			Time:       timestamppb.New(d.Time),
+			EventId:    d.EventID,
+			Reason:     d.Reason,
+			ObjectId:   d.ObjectID,
+			Success:    d.Success,
+			StatusCode: int32(d.StatusCode),
+			Attempts:   int32(d.Attempts),
+			Error:      d.Error,
+		}
+	}
+
+	return &v1.WebhookStatus{
+		Name:            s.Name,
+		Url:             s.URL,
+		Format:          s.Format,
+		Delivered:       s.Delivered,
+		Failed:          s.Failed,
+		Dropped:         s.Dropped,
+		LastDeliveredAt: optionalTimestamp(s.LastDeliveredAt),
+		LastFailedAt:    optionalTimestamp(s.LastFailedAt),
+		LastDroppedAt:   optionalTimestamp(s.LastDroppedAt),
+		LastError:       s.LastError,
+		Recent:          recent,
+	}
+}
+
+// optionalTimestamp converts t, leaving the zero time unset.
+func maintenanceWindowToProto(w *maintenance.Window) *v1.MaintenanceWindow {
+	proto := &v1.MaintenanceWindow{
+		Name:            w.Name,
+		NodeIds:         w.NodeIDs,
+		NodeSelector:    w.NodeSelector,
+		Schedule:        w.Schedule,
+		TimeZone:        w.TimeZone,
+		DurationSeconds: int64(w.Duration / time.Second),
+		Drain:           w.Drain,
+		Force:           w.Force,
+		Status: &v1.MaintenanceWindowStatus{
+			Active:      w.Active(),
+			ActiveSince: optionalTimestamp(w.Status.ActiveSince),
+			NodeIds:     w.Status.Nodes,
+			LastStarted: optionalTimestamp(w.Status.LastStarted),
+			LastEnded:   optionalTimestamp(w.Status.LastEnded),
+		},
+		CreatedAt: timestamppb.New(w.CreatedAt),
+	}
+	if next, err := w.Next(time.Now()); err == nil {
+		proto.Status.NextStart = optionalTimestamp(next)
+	}
+	return proto
+}
+
+// registryCredentialToProto converts a redacted credential, telling which
+// secrets it was stored with.
+func registryCredentialToProto(c *registryauth.Credential) *v1.RegistryCredential {
+	return &v1.RegistryCredential{
+		Registry:         c.Registry,
+		Username:         c.Username,
+		HasPassword:      c.HasPassword,
+		HasIdentityToken: c.HasIdentityToken,
+		CreatedAt:        timestamppb.New(c.CreatedAt),
+		UpdatedAt:        timestamppb.New(c.UpdatedAt),
+	}
+}
+
+func optionalTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func upgradePlanToProto(p *upgrade.Plan) *v1.UpgradePlan {
+	plan := &v1.UpgradePlan{
+		TargetVersion:   p.Target,
+		Ready:           p.Ready(),
+		Components:      make([]*v1.UpgradeComponent, len(p.Components)),
+		Steps:           p.Steps,
+		DeprecatedCalls: make([]*v1.DeprecatedCall, len(p.Deprecated)),
+		Blockers:        p.Blockers,
+		Warnings:        p.Warnings,
+	}
+	for i, c := range p.Components {
+		plan.Components[i] = &v1.UpgradeComponent{
+			Kind:    string(c.Kind),
+			Name:    c.Name,
+			NodeId:  c.NodeID,
+			Version: c.Version,
+			Action:  string(c.Action),
+			Note:    c.Note,
+		}
+	}
+	for i, call := range p.Deprecated {
+		plan.DeprecatedCalls[i] = &v1.DeprecatedCall{
+			Method:     call.Method,
+			Count:      call.Count,
+			LastCaller: call.LastCaller,
+			LastSeen:   timestamppb.New(call.LastSeen),
+		}
+	}
+	return plan
+}
+
+// latencyMatrixToProto converts the matrix rows of the given nodes, limited
+// to one path if path is set.
+func latencyMatrixToProto(nodes []*registry.Node, matrix latency.Matrix, path latency.Path) *v1.LatencyMatrix {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+	resp := &v1.LatencyMatrix{Nodes: make([]*v1.LatencyNode, 0, len(nodes))}
+	for _, node := range nodes {
+		item := &v1.LatencyNode{NodeId: node.ID, Hostname: node.Hostname}
+		row, ok := matrix[node.ID]
+		if !ok {
+			resp.Nodes = append(resp.Nodes, item)
+			continue
+		}
+		item.MeasuredAt = timestamppb.New(row.MeasuredAt)
+		item.Stale = row.Stale()
+		resp.Nodes = append(resp.Nodes, item)
+
+		for _, target := range nodes {
+			// Rows may still hold paths that are no longer probed
+			result, ok := row.Peers[target.ID][latency.PathUnderlay]
+			if !ok || (path != "" && path != latency.PathUnderlay) {
+				continue
+			}
+			resp.Measurements = append(resp.Measurements, &v1.LatencyMeasurement{
+				SourceNodeId: node.ID,
+				TargetNodeId: target.ID,
+				Path:         string(latency.PathUnderlay),
+				Address:      result.Address,
+				Sent:         int32(result.Sent),
+				Received:     int32(result.Received),
+				MinRttMs:     ms(result.MinRTT),
+				AvgRttMs:     ms(result.AvgRTT),
+				MaxRttMs:     ms(result.MaxRTT),
+				Error:        result.Error,
+			})
+		}
+	}
+	return resp
+}
+
+func healthCheckToProto(r health.Result) *v1.HealthCheck {
+	pb := &v1.HealthCheck{
+		Name:    r.Name,
+		Healthy: r.Healthy,
+		Message: r.Message,
+	}
+	if !r.CheckedAt.IsZero() {
+		pb.CheckedAt = timestamppb.New(r.CheckedAt)
+	}
+	return pb
+}
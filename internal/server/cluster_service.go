@@ -2,9 +2,25 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/commands"
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/latency"
+	"hypervisor/pkg/cluster/maintenance"
+	"hypervisor/pkg/cluster/notify"
 	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/cluster/registryauth"
+	"hypervisor/pkg/cluster/upgrade"
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/health"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
@@ -14,17 +30,65 @@ import (
 // ClusterService implements the ClusterService gRPC service.
 type ClusterService struct {
 	registry *registry.EtcdRegistry
+	compute  *ComputeService
+	events   *events.Recorder
+	notifier *notify.Notifier
+	etcd     *etcd.Client
+	commands *commands.Queue
 	logger   *zap.Logger
+
+	// Maintenance windows and the controller that runs them
+	maintenance           *maintenance.Store
+	maintenanceController *MaintenanceController
+
+	// Credentials agents pull private images with
+	registryAuth *registryauth.Store
+
+	// This server's health checks and the address it reports them under
+	health     *health.Checker
+	healthName string
 }
 
 // NewClusterService creates a new ClusterService.
-func NewClusterService(reg *registry.EtcdRegistry, logger *zap.Logger) *ClusterService {
+func NewClusterService(reg *registry.EtcdRegistry, compute *ComputeService, recorder *events.Recorder, logger *zap.Logger) *ClusterService {
 	return &ClusterService{
 		registry: reg,
+		compute:  compute,
+		events:   recorder,
 		logger:   logger,
 	}
 }
 
+// SetNotifier sets the notifier whose delivery status is reported by
+// GetNotificationStatus.
+func (s *ClusterService) SetNotifier(notifier *notify.Notifier) {
+	s.notifier = notifier
+}
+
+// SetEtcdClient sets the client GetUpgradePlan reads component versions
+// through, node commands are queued in and maintenance windows and registry
+// credentials are kept in.
+func (s *ClusterService) SetEtcdClient(client *etcd.Client) {
+	s.etcd = client
+	s.commands = commands.NewQueue(client, s.logger.Named("commands"))
+	s.maintenance = maintenance.NewStore(client)
+	s.registryAuth = registryauth.NewStore(client)
+}
+
+// SetHealthChecker sets the checker whose results GetClusterHealth reports
+// for this server, under name.
+func (s *ClusterService) SetHealthChecker(checker *health.Checker, name string) {
+	s.health = checker
+	s.healthName = name
+}
+
+// SetMaintenanceController sets the controller told about new maintenance
+// windows, so that a window created while its schedule is running starts
+// right away.
+func (s *ClusterService) SetMaintenanceController(controller *MaintenanceController) {
+	s.maintenanceController = controller
+}
+
 // RegisterNodeRequest represents a node registration request.
 type RegisterNodeRequest struct {
 	Hostname               string
@@ -34,6 +98,7 @@ type RegisterNodeRequest struct {
 	Region                 string
 	Zone                   string
 	Capacity               registry.Resources
+	Allocatable            registry.Resources // Zero means all of Capacity
 	Labels                 map[string]string
 	SupportedInstanceTypes []registry.InstanceType
 }
@@ -47,6 +112,11 @@ type RegisterNodeResponse struct {
 
 // RegisterNode registers a new node in the cluster.
 func (s *ClusterService) RegisterNode(ctx context.Context, req *RegisterNodeRequest) (*RegisterNodeResponse, error) {
+	allocatable := req.Allocatable
+	if allocatable == (registry.Resources{}) {
+		allocatable = req.Capacity
+	}
+
 	node := &registry.Node{
 		Hostname:               req.Hostname,
 		IP:                     req.IP,
@@ -56,7 +126,7 @@ func (s *ClusterService) RegisterNode(ctx context.Context, req *RegisterNodeRequ
 		Region:                 req.Region,
 		Zone:                   req.Zone,
 		Capacity:               req.Capacity,
-		Allocatable:            req.Capacity, // Initially all capacity is allocatable
+		Allocatable:            allocatable,
 		Labels:                 req.Labels,
 		SupportedInstanceTypes: req.SupportedInstanceTypes,
 		Conditions: []registry.NodeCondition{
@@ -81,6 +151,8 @@ func (s *ClusterService) RegisterNode(ctx context.Context, req *RegisterNodeRequ
 		zap.String("hostname", req.Hostname),
 		zap.String("role", string(req.Role)),
 	)
+	s.recordNodeEvent(ctx, events.TypeNormal, nodeID, "Registered",
+		fmt.Sprintf("%s (%s) registered as %s", req.Hostname, req.IP, req.Role))
 
 	return &RegisterNodeResponse{
 		NodeID:                   nodeID,
@@ -105,6 +177,7 @@ func (s *ClusterService) DeregisterNode(ctx context.Context, req *DeregisterNode
 	}
 
 	s.logger.Info("node deregistered", zap.String("node_id", req.NodeID))
+	s.recordNodeEvent(ctx, events.TypeNormal, req.NodeID, "Deregistered", "")
 	return nil
 }
 
@@ -207,7 +280,246 @@ type UpdateNodeStatusRequest struct {
 
 // UpdateNodeStatus updates a node's status.
 func (s *ClusterService) UpdateNodeStatus(ctx context.Context, req *UpdateNodeStatusRequest) (*registry.Node, error) {
-	node, err := s.registry.Get(ctx, req.NodeID)
+	node, err := s.registry.Modify(ctx, req.NodeID, func(node *registry.Node) error {
+		node.Status = req.Status
+		node.Conditions = req.Conditions
+		node.Allocated = req.Allocated
+		node.LastSeen = time.Now()
+		return nil
+	})
+	if err != nil {
+		if err == registry.ErrNodeNotFound {
+			return nil, status.Errorf(codes.NotFound, "node not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to update node: %v", err)
+	}
+
+	return node, nil
+}
+
+// reservedLabelPrefix marks the node labels agents discover and maintain
+// themselves, which cannot be set through UpdateNode.
+const reservedLabelPrefix = "hypervisor.io/"
+
+// UpdateNodeRequest changes the labels and taints set on a node.
+type UpdateNodeRequest struct {
+	NodeID       string
+	Labels       map[string]string // Labels to set
+	RemoveLabels []string          // Label keys to remove
+	Taints       []driver.Taint    // Taints to add, replacing those with the same key and effect
+	RemoveTaints []driver.Taint    // Taints to remove by key, and effect if set
+}
+
+// UpdateNode sets and removes labels and taints on a node. They are stored
+// apart from the node's registration so they survive agent restarts, and
+// take effect for instances scheduled from then on.
+func (s *ClusterService) UpdateNode(ctx context.Context, req *UpdateNodeRequest) (*registry.Node, error) {
+	if err := validateUpdateNode(req); err != nil {
+		return nil, err
+	}
+	if _, err := s.registry.Get(ctx, req.NodeID); err != nil {
+		if errors.Is(err, registry.ErrNodeNotFound) {
+			return nil, status.Errorf(codes.NotFound, "node not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get node: %v", err)
+	}
+
+	node, err := s.registry.UpdateSettings(ctx, req.NodeID, func(settings *registry.NodeSettings) {
+		for key, value := range req.Labels {
+			settings.Labels[key] = value
+		}
+		for _, key := range req.RemoveLabels {
+			delete(settings.Labels, key)
+		}
+
+		taints := slices.DeleteFunc(slices.Clone(settings.Taints), func(t driver.Taint) bool {
+			for _, remove := range slices.Concat(req.Taints, req.RemoveTaints) {
+				if t.Key == remove.Key && (remove.Effect == "" || t.Effect == remove.Effect) {
+					return true
+				}
+			}
+			return false
+		})
+		settings.Taints = append(taints, req.Taints...)
+	})
+	if err != nil {
+		if errors.Is(err, registry.ErrNodeNotFound) {
+			return nil, status.Errorf(codes.NotFound, "node not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to update node: %v", err)
+	}
+
+	var changes []string
+	if len(req.Labels) > 0 {
+		changes = append(changes, "set labels "+formatNodeLabels(req.Labels))
+	}
+	if len(req.RemoveLabels) > 0 {
+		changes = append(changes, "removed labels "+strings.Join(req.RemoveLabels, ","))
+	}
+	if len(req.Taints) > 0 {
+		changes = append(changes, "added taints "+formatTaints(req.Taints))
+	}
+	if len(req.RemoveTaints) > 0 {
+		changes = append(changes, "removed taints "+formatTaints(req.RemoveTaints))
+	}
+	s.logger.Info("node updated", zap.String("node_id", req.NodeID), zap.Strings("changes", changes))
+	s.recordNodeEvent(ctx, events.TypeNormal, req.NodeID, "Updated", strings.Join(changes, ", "))
+
+	return node, nil
+}
+
+func validateUpdateNode(req *UpdateNodeRequest) error {
+	for key := range req.Labels {
+		if err := validateNodeLabelKey(key); err != nil {
+			return apierror.InvalidField("labels", err.Error())
+		}
+	}
+	for _, key := range req.RemoveLabels {
+		if err := validateNodeLabelKey(key); err != nil {
+			return apierror.InvalidField("remove_labels", err.Error())
+		}
+	}
+	for _, taint := range req.Taints {
+		if err := taint.Validate(); err != nil {
+			return apierror.InvalidField("taints", err.Error())
+		}
+	}
+	for _, taint := range req.RemoveTaints {
+		if taint.Key == "" {
+			return apierror.InvalidField("remove_taints", "taint key is required")
+		}
+	}
+	return nil
+}
+
+func validateNodeLabelKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("label keys cannot be empty")
+	}
+	if strings.HasPrefix(key, reservedLabelPrefix) {
+		return fmt.Errorf("label %q: keys under %s are maintained by the node's agent", key, reservedLabelPrefix)
+	}
+	return nil
+}
+
+// formatNodeLabels formats labels as sorted key=value pairs.
+func formatNodeLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func formatTaints(taints []driver.Taint) string {
+	formatted := make([]string, len(taints))
+	for i, taint := range taints {
+		if taint.Effect == "" {
+			formatted[i] = taint.Key
+		} else {
+			formatted[i] = taint.String()
+		}
+	}
+	return strings.Join(formatted, ",")
+}
+
+// CordonNode marks a node unschedulable by putting it into maintenance.
+// Instances already on the node keep running.
+// The node's agent is told to refuse instances placed on it regardless.
+func (s *ClusterService) CordonNode(ctx context.Context, nodeID string) (*registry.Node, error) {
+	node, err := s.setNodeStatus(ctx, nodeID, registry.NodeStatusMaintenance, "Cordoned")
+	if err != nil {
+		return nil, err
+	}
+	s.enqueueCommand(ctx, nodeID, commands.TypeCordon, nil)
+	return node, nil
+}
+
+// UncordonNode makes a cordoned or drained node schedulable again.
+func (s *ClusterService) UncordonNode(ctx context.Context, nodeID string) (*registry.Node, error) {
+	node, err := s.setNodeStatus(ctx, nodeID, registry.NodeStatusReady, "Uncordoned")
+	if err != nil {
+		return nil, err
+	}
+	s.enqueueCommand(ctx, nodeID, commands.TypeUncordon, nil)
+	return node, nil
+}
+
+// DrainNodeRequest represents a drain node request.
+type DrainNodeRequest struct {
+	NodeID string
+	Force  bool
+}
+
+// DrainNodeResponse represents a drain node response.
+type DrainNodeResponse struct {
+	Node              *registry.Node
+	StoppedInstances  int
+	FailedInstanceIDs []string
+}
+
+// DrainNode cordons a node and stops the instances running on it. The node
+// stays in the draining state until it is uncordoned. Its agent then stops
+// whatever the server could not reach and refuses new instances.
+func (s *ClusterService) DrainNode(ctx context.Context, req *DrainNodeRequest) (*DrainNodeResponse, error) {
+	node, err := s.setNodeStatus(ctx, req.NodeID, registry.NodeStatusDraining, "Draining")
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := s.compute.ListInstances(ctx, &ListInstancesRequest{NodeID: req.NodeID})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &DrainNodeResponse{Node: node}
+	for _, instance := range list.Instances {
+		if !instance.IsRunning() {
+			continue
+		}
+
+		if _, err := s.compute.StopInstance(ctx, &StopInstanceRequest{
+			InstanceID: instance.ID,
+			Force:      req.Force,
+		}); err != nil {
+			s.logger.Warn("failed to stop instance while draining node",
+				zap.String("node_id", req.NodeID),
+				zap.String("instance_id", instance.ID),
+				zap.Error(err),
+			)
+			resp.FailedInstanceIDs = append(resp.FailedInstanceIDs, instance.ID)
+			continue
+		}
+		resp.StoppedInstances++
+	}
+
+	s.logger.Info("node drained",
+		zap.String("node_id", req.NodeID),
+		zap.Int("stopped", resp.StoppedInstances),
+		zap.Int("failed", len(resp.FailedInstanceIDs)),
+	)
+
+	eventType := events.TypeNormal
+	if len(resp.FailedInstanceIDs) > 0 {
+		eventType = events.TypeWarning
+	}
+	s.recordNodeEvent(ctx, eventType, req.NodeID, "Drained",
+		fmt.Sprintf("stopped %d instances, %d failed", resp.StoppedInstances, len(resp.FailedInstanceIDs)))
+
+	var params map[string]string
+	if req.Force {
+		params = map[string]string{"force": "true"}
+	}
+	s.enqueueCommand(ctx, req.NodeID, commands.TypeDrain, params)
+
+	return resp, nil
+}
+
+// setNodeStatus changes only a node's status, leaving reported conditions
+// and resource usage untouched, and records reason as an event.
+func (s *ClusterService) setNodeStatus(ctx context.Context, nodeID string, nodeStatus registry.NodeStatus, reason string) (*registry.Node, error) {
+	node, err := s.registry.Get(ctx, nodeID)
 	if err != nil {
 		if err == registry.ErrNodeNotFound {
 			return nil, status.Errorf(codes.NotFound, "node not found")
@@ -215,18 +527,56 @@ func (s *ClusterService) UpdateNodeStatus(ctx context.Context, req *UpdateNodeSt
 		return nil, status.Errorf(codes.Internal, "failed to get node: %v", err)
 	}
 
-	node.Status = req.Status
-	node.Conditions = req.Conditions
-	node.Allocated = req.Allocated
-	node.LastSeen = time.Now()
+	if node.Status == nodeStatus {
+		return node, nil
+	}
 
-	if err := s.registry.Update(ctx, node); err != nil {
+	previous := node.Status
+	node, err = s.registry.Modify(ctx, nodeID, func(node *registry.Node) error {
+		previous = node.Status
+		node.Status = nodeStatus
+		return nil
+	})
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to update node: %v", err)
 	}
 
+	s.logger.Info("node status changed",
+		zap.String("node_id", nodeID),
+		zap.String("from", string(previous)),
+		zap.String("to", string(nodeStatus)),
+	)
+	s.recordNodeEvent(ctx, events.TypeNormal, nodeID, reason,
+		fmt.Sprintf("status changed from %s to %s", previous, nodeStatus))
+
 	return node, nil
 }
 
+// recordNodeEvent records an event about a node.
+func (s *ClusterService) recordNodeEvent(ctx context.Context, eventType, nodeID, reason, message string) {
+	s.events.Record(ctx, events.Event{
+		Type:     eventType,
+		Kind:     events.KindNode,
+		ObjectID: nodeID,
+		NodeID:   nodeID,
+		Reason:   reason,
+		Message:  message,
+	})
+}
+
+// ListEvents returns recorded cluster events matching filter, oldest first.
+func (s *ClusterService) ListEvents(ctx context.Context, filter events.Filter) ([]*events.Event, error) {
+	if s.events == nil {
+		return nil, status.Errorf(codes.Unavailable, "event recording is not configured")
+	}
+
+	list, err := s.events.List(ctx, filter)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list events: %v", err)
+	}
+	return list, nil
+}
+
 // HeartbeatRequest represents a heartbeat request.
 type HeartbeatRequest struct {
 	NodeID     string
@@ -239,46 +589,132 @@ type HeartbeatRequest struct {
 type HeartbeatResponse struct {
 	Accepted             bool
 	NextHeartbeatSeconds int64
-	Commands             []NodeCommand
-}
-
-// NodeCommand represents a command to be executed by the agent.
-type NodeCommand struct {
-	ID         string
-	Type       string
-	Parameters map[string]string
+	Commands             []*commands.Command // Pending commands for the node
 }
 
 // Heartbeat processes a heartbeat from an agent.
 func (s *ClusterService) Heartbeat(ctx context.Context, req *HeartbeatRequest) (*HeartbeatResponse, error) {
-	node, err := s.registry.Get(ctx, req.NodeID)
+	// Update node status
+	_, err := s.registry.Modify(ctx, req.NodeID, func(node *registry.Node) error {
+		node.Status = req.Status
+		node.Conditions = req.Conditions
+		node.Allocated = req.Allocated
+		node.LastSeen = time.Now()
+		return nil
+	})
 	if err != nil {
 		if err == registry.ErrNodeNotFound {
 			return &HeartbeatResponse{Accepted: false}, nil
 		}
-		return nil, status.Errorf(codes.Internal, "failed to get node: %v", err)
-	}
-
-	// Update node status
-	node.Status = req.Status
-	node.Conditions = req.Conditions
-	node.Allocated = req.Allocated
-	node.LastSeen = time.Now()
-
-	if err := s.registry.Update(ctx, node); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to update node: %v", err)
 	}
 
-	// TODO: Check for pending commands for this node
-	commands := []NodeCommand{}
+	// The agent marks the commands running through the queue when it
+	// picks them up, so a command handed out twice still runs once
+	var pending []*commands.Command
+	if s.commands != nil {
+		if pending, err = s.commands.Pending(ctx, req.NodeID); err != nil {
+			s.logger.Warn("failed to list pending node commands",
+				zap.String("node_id", req.NodeID),
+				zap.Error(err),
+			)
+		}
+	}
 
 	return &HeartbeatResponse{
 		Accepted:             true,
 		NextHeartbeatSeconds: 10,
-		Commands:             commands,
+		Commands:             pending,
 	}, nil
 }
 
+// SendNodeCommandRequest represents a request to run a command on a node.
+type SendNodeCommandRequest struct {
+	NodeID     string
+	Type       string
+	Parameters map[string]string
+	Wait       time.Duration // How long to wait for the agent to finish (0 = don't wait)
+}
+
+// SendNodeCommand queues a command for a node's agent, which picks it up
+// with its next heartbeat. With a wait it returns once the agent has
+// finished the command or the wait is over, whichever comes first. Cordon,
+// uncordon and drain also change how the node is scheduled, so they are
+// only queued through CordonNode, UncordonNode and DrainNode.
+func (s *ClusterService) SendNodeCommand(ctx context.Context, req *SendNodeCommandRequest) (*commands.Command, error) {
+	if s.commands == nil {
+		return nil, status.Errorf(codes.Unavailable, "node commands are not configured")
+	}
+	switch req.Type {
+	case commands.TypeCordon, commands.TypeUncordon, commands.TypeDrain:
+		return nil, status.Errorf(codes.InvalidArgument, "use the %s operation to %s a node", req.Type, req.Type)
+	}
+	if !commands.ValidType(req.Type) {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown command type %q", req.Type)
+	}
+	if _, err := s.GetNode(ctx, &GetNodeRequest{NodeID: req.NodeID}); err != nil {
+		return nil, err
+	}
+
+	cmd, err := s.commands.Enqueue(ctx, req.NodeID, req.Type, req.Parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to queue command: %v", err)
+	}
+	s.recordNodeEvent(ctx, events.TypeNormal, req.NodeID, "CommandQueued",
+		fmt.Sprintf("%s command %s queued", cmd.Type, cmd.ID))
+
+	if req.Wait <= 0 {
+		return cmd, nil
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, req.Wait)
+	defer cancel()
+	finished, err := s.commands.Wait(waitCtx, req.NodeID, cmd.ID)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && finished != nil {
+			// Still pending or running; the caller can poll for the result
+			return finished, nil
+		}
+		if errors.Is(err, commands.ErrCommandNotFound) {
+			return nil, status.Errorf(codes.NotFound, "command %s disappeared", cmd.ID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to wait for command: %v", err)
+	}
+	return finished, nil
+}
+
+// ListNodeCommands returns the commands queued for a node that have not
+// expired, oldest first.
+func (s *ClusterService) ListNodeCommands(ctx context.Context, nodeID string) ([]*commands.Command, error) {
+	if s.commands == nil {
+		return nil, status.Errorf(codes.Unavailable, "node commands are not configured")
+	}
+	if nodeID == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "node_id is required")
+	}
+
+	list, err := s.commands.List(ctx, nodeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list commands: %v", err)
+	}
+	return list, nil
+}
+
+// enqueueCommand queues a command telling a node's agent about a change
+// already made in the registry. Failures are logged: the registry stays
+// authoritative for scheduling.
+func (s *ClusterService) enqueueCommand(ctx context.Context, nodeID, commandType string, parameters map[string]string) {
+	if s.commands == nil {
+		return
+	}
+	if _, err := s.commands.Enqueue(ctx, nodeID, commandType, parameters); err != nil {
+		s.logger.Warn("failed to queue node command",
+			zap.String("node_id", nodeID),
+			zap.String("type", commandType),
+			zap.Error(err),
+		)
+	}
+}
+
 // WatchNodesRequest represents a watch nodes request.
 type WatchNodesRequest struct {
 	Role   registry.NodeRole
@@ -360,3 +796,76 @@ func (s *ClusterService) GetClusterInfo(ctx context.Context) (*GetClusterInfoRes
 		TotalAllocated: totalAllocated,
 	}, nil
 }
+
+// GetUpgradePlan inspects the versions of the servers, agents, drivers and
+// etcd schema and the deprecated APIs in use, and works out what upgrading
+// to target takes. Nothing is changed.
+func (s *ClusterService) GetUpgradePlan(ctx context.Context, target string) (*upgrade.Plan, error) {
+	version, err := upgrade.ParseVersion(target)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid target version: %v", err)
+	}
+	if s.etcd == nil {
+		return nil, status.Errorf(codes.Unavailable, "upgrade planning is not available")
+	}
+
+	nodes, err := s.registry.List(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list nodes: %v", err)
+	}
+	state, err := upgrade.Inspect(ctx, s.etcd, nodes)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to inspect cluster: %v", err)
+	}
+
+	return upgrade.BuildPlan(state, version), nil
+}
+
+// GetNotificationStatus reports whether event notifications are enabled and
+// the delivery status of each webhook.
+func (s *ClusterService) GetNotificationStatus(ctx context.Context) (bool, []*notify.WebhookStatus, error) {
+	if s.notifier == nil || !s.notifier.Enabled() {
+		return false, nil, nil
+	}
+
+	list, err := s.notifier.Status(ctx)
+	if err != nil {
+		return false, nil, status.Errorf(codes.Internal, "failed to get notification status: %v", err)
+	}
+	return true, list, nil
+}
+
+// GetLatencyMatrix returns the registered nodes and the latency they
+// measured to each other. Rows of nodes that are no longer registered are
+// left out. Path, if set, must name a latency path; the caller limits the
+// result to it.
+func (s *ClusterService) GetLatencyMatrix(ctx context.Context, path latency.Path) ([]*registry.Node, latency.Matrix, error) {
+	if path != "" && path != latency.PathUnderlay {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "unknown path %q (want underlay)", path)
+	}
+	if s.etcd == nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "latency matrix is not available")
+	}
+
+	nodes, err := s.registry.List(ctx)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "failed to list nodes: %v", err)
+	}
+	matrix, err := latency.NewStore(s.etcd).Matrix(ctx)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	registered := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		registered[node.ID] = true
+	}
+	for id := range matrix {
+		if !registered[id] {
+			delete(matrix, id)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Hostname < nodes[j].Hostname })
+	return nodes, matrix, nil
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"context"
+	"io"
 
 	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/apiconv"
 	"hypervisor/pkg/cluster/registry"
 	"hypervisor/pkg/compute/driver"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -30,9 +34,19 @@ func (h *ComputeGRPCHandler) CreateInstance(ctx context.Context, req *v1.CreateI
 		Type:            protoTypeToDriverType(req.Type),
 		Spec:            protoSpecToDriverSpec(req.Spec),
 		Metadata:        protoMetadataToLabels(req.Metadata),
+		Annotations:     req.Metadata.GetAnnotations(),
 		PreferredNodeID: req.PreferredNodeId,
 		Region:          req.Region,
 		Zone:            req.Zone,
+
+		HighAvailability: req.HighAvailability,
+		Description:      req.Description,
+		IdempotencyKey:   req.IdempotencyKey,
+
+		SpreadConstraints: protoSpreadToRegistry(req.SpreadConstraints),
+	}
+	if err := rejectGroupLabel(serviceReq.Metadata, "metadata.labels"); err != nil {
+		return nil, err
 	}
 
 	instance, err := h.service.CreateInstance(ctx, serviceReq)
@@ -46,8 +60,9 @@ func (h *ComputeGRPCHandler) CreateInstance(ctx context.Context, req *v1.CreateI
 // DeleteInstance implements v1.ComputeServiceServer.
 func (h *ComputeGRPCHandler) DeleteInstance(ctx context.Context, req *v1.DeleteInstanceRequest) (*emptypb.Empty, error) {
 	err := h.service.DeleteInstance(ctx, &DeleteInstanceRequest{
-		InstanceID: req.InstanceId,
-		Force:      req.Force,
+		InstanceID:     req.InstanceId,
+		Force:          req.Force,
+		IdempotencyKey: req.IdempotencyKey,
 	})
 	if err != nil {
 		return nil, err
@@ -55,6 +70,40 @@ func (h *ComputeGRPCHandler) DeleteInstance(ctx context.Context, req *v1.DeleteI
 	return &emptypb.Empty{}, nil
 }
 
+// UpdateInstance implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) UpdateInstance(ctx context.Context, req *v1.UpdateInstanceRequest) (*v1.Instance, error) {
+	serviceReq := &UpdateInstanceRequest{
+		InstanceID:       req.InstanceId,
+		Labels:           req.Metadata.GetLabels(),
+		Annotations:      req.Metadata.GetAnnotations(),
+		HighAvailability: req.HighAvailability,
+	}
+
+	if req.UpdateMask != nil {
+		mask, err := parseUpdateMask(req.UpdateMask, &v1.Instance{}, instanceMutableFields)
+		if err != nil {
+			return nil, err
+		}
+		if id := req.Instance.GetId(); id != "" && id != req.InstanceId {
+			return nil, status.Errorf(codes.InvalidArgument, "instance.id %s does not match instance_id %s", id, req.InstanceId)
+		}
+
+		src := req.Instance
+		serviceReq.Mask = mask
+		serviceReq.Description = src.GetDescription()
+		serviceReq.Labels = src.GetMetadata().GetLabels()
+		serviceReq.Annotations = src.GetMetadata().GetAnnotations()
+		serviceReq.HighAvailability = src.GetHighAvailability()
+		serviceReq.Limits = protoSpecToDriverSpec(src.GetSpec()).Limits
+	}
+
+	instance, err := h.service.UpdateInstance(ctx, serviceReq)
+	if err != nil {
+		return nil, err
+	}
+	return registryInstanceToProto(instance), nil
+}
+
 // GetInstance implements v1.ComputeServiceServer.
 func (h *ComputeGRPCHandler) GetInstance(ctx context.Context, req *v1.GetInstanceRequest) (*v1.Instance, error) {
 	instance, err := h.service.GetInstance(ctx, &GetInstanceRequest{
@@ -66,13 +115,38 @@ func (h *ComputeGRPCHandler) GetInstance(ctx context.Context, req *v1.GetInstanc
 	return registryInstanceToProto(instance), nil
 }
 
+// GetInstanceHistory implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) GetInstanceHistory(ctx context.Context, req *v1.GetInstanceHistoryRequest) (*v1.GetInstanceHistoryResponse, error) {
+	history, err := h.service.GetInstanceHistory(ctx, req.InstanceId)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.GetInstanceHistoryResponse{}
+	for _, t := range history {
+		resp.Transitions = append(resp.Transitions, &v1.InstanceStateTransition{
+			Time:      timestamppb.New(t.Time),
+			FromState: driverStateToProtoState(t.From),
+			ToState:   driverStateToProtoState(t.To),
+			Reason:    t.Reason,
+			NodeId:    t.NodeID,
+		})
+	}
+	return resp, nil
+}
+
 // ListInstances implements v1.ComputeServiceServer.
 func (h *ComputeGRPCHandler) ListInstances(ctx context.Context, req *v1.ListInstancesRequest) (*v1.ListInstancesResponse, error) {
+	selector, err := registry.ParseSelector(req.Selector)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	resp, err := h.service.ListInstances(ctx, &ListInstancesRequest{
 		Type:          protoTypeToDriverType(req.Type),
 		State:         protoStateToDriverState(req.State),
 		NodeID:        req.NodeId,
-		LabelSelector: req.LabelSelector,
+		LabelSelector: append(registry.SelectorFromLabels(req.LabelSelector), selector...),
 		PageSize:      int(req.PageSize),
 		PageToken:     req.PageToken,
 	})
@@ -95,7 +169,8 @@ func (h *ComputeGRPCHandler) ListInstances(ctx context.Context, req *v1.ListInst
 // StartInstance implements v1.ComputeServiceServer.
 func (h *ComputeGRPCHandler) StartInstance(ctx context.Context, req *v1.StartInstanceRequest) (*v1.Instance, error) {
 	instance, err := h.service.StartInstance(ctx, &StartInstanceRequest{
-		InstanceID: req.InstanceId,
+		InstanceID:     req.InstanceId,
+		IdempotencyKey: req.IdempotencyKey,
 	})
 	if err != nil {
 		return nil, err
@@ -109,6 +184,7 @@ func (h *ComputeGRPCHandler) StopInstance(ctx context.Context, req *v1.StopInsta
 		InstanceID:     req.InstanceId,
 		Force:          req.Force,
 		TimeoutSeconds: int(req.TimeoutSeconds),
+		IdempotencyKey: req.IdempotencyKey,
 	})
 	if err != nil {
 		return nil, err
@@ -128,6 +204,123 @@ func (h *ComputeGRPCHandler) RestartInstance(ctx context.Context, req *v1.Restar
 	return registryInstanceToProto(instance), nil
 }
 
+// PauseInstance implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) PauseInstance(ctx context.Context, req *v1.PauseInstanceRequest) (*v1.Instance, error) {
+	instance, err := h.service.PauseInstance(ctx, &PauseInstanceRequest{
+		InstanceID: req.InstanceId,
+		ToDisk:     req.ToDisk,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return registryInstanceToProto(instance), nil
+}
+
+// ResumeInstance implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) ResumeInstance(ctx context.Context, req *v1.ResumeInstanceRequest) (*v1.Instance, error) {
+	instance, err := h.service.ResumeInstance(ctx, &ResumeInstanceRequest{
+		InstanceID: req.InstanceId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return registryInstanceToProto(instance), nil
+}
+
+// ResizeInstance implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) ResizeInstance(ctx context.Context, req *v1.ResizeInstanceRequest) (*v1.ResizeInstanceResponse, error) {
+	instance, method, err := h.service.ResizeInstance(ctx, &ResizeInstanceRequest{
+		InstanceID:     req.InstanceId,
+		CPUCores:       int(req.CpuCores),
+		MemoryMB:       req.MemoryBytes / (1024 * 1024),
+		AllowRestart:   req.AllowRestart,
+		Force:          req.Force,
+		TimeoutSeconds: int(req.TimeoutSeconds),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ResizeInstanceResponse{
+		Instance: registryInstanceToProto(instance),
+		Method:   method,
+	}, nil
+}
+
+// CreateInstanceGroup implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) CreateInstanceGroup(ctx context.Context, req *v1.CreateInstanceGroupRequest) (*v1.InstanceGroup, error) {
+	group, err := h.service.CreateInstanceGroup(ctx, &CreateInstanceGroupRequest{
+		Name:     req.Name,
+		Replicas: int(req.Replicas),
+		Template: protoTemplateToRegistry(req.Template),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groupStatusToProto(group), nil
+}
+
+// GetInstanceGroup implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) GetInstanceGroup(ctx context.Context, req *v1.GetInstanceGroupRequest) (*v1.InstanceGroup, error) {
+	group, err := h.service.GetInstanceGroup(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return groupStatusToProto(group), nil
+}
+
+// ListInstanceGroups implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) ListInstanceGroups(ctx context.Context, req *v1.ListInstanceGroupsRequest) (*v1.ListInstanceGroupsResponse, error) {
+	groups, err := h.service.ListInstanceGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.ListInstanceGroupsResponse{Groups: make([]*v1.InstanceGroup, 0, len(groups))}
+	for _, group := range groups {
+		resp.Groups = append(resp.Groups, groupStatusToProto(group))
+	}
+	return resp, nil
+}
+
+// UpdateInstanceGroup implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) UpdateInstanceGroup(ctx context.Context, req *v1.UpdateInstanceGroupRequest) (*v1.InstanceGroup, error) {
+	serviceReq := &UpdateInstanceGroupRequest{Name: req.Name}
+
+	replicas := int(req.Replicas)
+	template := protoTemplateToRegistry(req.Template)
+	if req.UpdateMask != nil {
+		mask, err := parseUpdateMask(req.UpdateMask, &v1.InstanceGroup{}, groupMutableFields)
+		if err != nil {
+			return nil, err
+		}
+		if mask.has("replicas") {
+			serviceReq.Replicas = &replicas
+		}
+		if mask.has("template") {
+			serviceReq.Template = &template
+		}
+	} else {
+		serviceReq.Replicas = &replicas
+		if req.Template != nil {
+			serviceReq.Template = &template
+		}
+	}
+
+	group, err := h.service.UpdateInstanceGroup(ctx, serviceReq)
+	if err != nil {
+		return nil, err
+	}
+	return groupStatusToProto(group), nil
+}
+
+// DeleteInstanceGroup implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) DeleteInstanceGroup(ctx context.Context, req *v1.DeleteInstanceGroupRequest) (*emptypb.Empty, error) {
+	if err := h.service.DeleteInstanceGroup(ctx, req.Name); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
 // GetInstanceStats implements v1.ComputeServiceServer.
 func (h *ComputeGRPCHandler) GetInstanceStats(ctx context.Context, req *v1.GetInstanceStatsRequest) (*v1.InstanceStats, error) {
 	stats, err := h.service.GetInstanceStats(ctx, &GetInstanceStatsRequest{
@@ -139,6 +332,237 @@ func (h *ComputeGRPCHandler) GetInstanceStats(ctx context.Context, req *v1.GetIn
 	return driverStatsToProtoStats(stats), nil
 }
 
+// BatchGetInstanceStats implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) BatchGetInstanceStats(ctx context.Context, req *v1.BatchGetInstanceStatsRequest) (*v1.BatchGetInstanceStatsResponse, error) {
+	results, err := h.service.BatchGetInstanceStats(ctx, &BatchGetInstanceStatsRequest{
+		InstanceIDs:   req.InstanceIds,
+		NodeID:        req.NodeId,
+		LabelSelector: req.LabelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.BatchGetInstanceStatsResponse{Results: make([]*v1.InstanceStatsResult, 0, len(results))}
+	for _, result := range results {
+		item := &v1.InstanceStatsResult{
+			InstanceId: result.InstanceID,
+			NodeId:     result.NodeID,
+		}
+		if result.Err != nil {
+			item.Error = result.Err.Error()
+		} else {
+			item.Stats = driverStatsToProtoStats(result.Stats)
+		}
+		resp.Results = append(resp.Results, item)
+	}
+	return resp, nil
+}
+
+// GetRecommendations implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) GetRecommendations(ctx context.Context, req *v1.GetRecommendationsRequest) (*v1.GetRecommendationsResponse, error) {
+	recommendations, skipped, err := h.service.GetRecommendations(ctx, &GetRecommendationsRequest{
+		InstanceIDs:   req.InstanceIds,
+		NodeID:        req.NodeId,
+		LabelSelector: req.LabelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.GetRecommendationsResponse{
+		Recommendations: make([]*v1.Recommendation, 0, len(recommendations)),
+		Skipped:         make([]*v1.SkippedInstance, 0, len(skipped)),
+	}
+	for _, r := range recommendations {
+		resp.Recommendations = append(resp.Recommendations, &v1.Recommendation{
+			InstanceId:   r.InstanceID,
+			InstanceName: r.InstanceName,
+			NodeId:       r.NodeID,
+			Resource:     r.Resource,
+			Kind:         r.Kind,
+			Requested:    r.Requested,
+			P95:          r.P95,
+			Suggested:    r.Suggested,
+			Unit:         r.Unit,
+			Reason:       r.Reason,
+			Usage:        r.Usage,
+		})
+	}
+	for _, s := range skipped {
+		resp.Skipped = append(resp.Skipped, &v1.SkippedInstance{InstanceId: s.InstanceID, Reason: s.Reason})
+	}
+	return resp, nil
+}
+
+// StreamInstanceStats implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) StreamInstanceStats(req *v1.StreamInstanceStatsRequest, stream v1.ComputeService_StreamInstanceStatsServer) error {
+	agentStream, err := h.service.StreamInstanceStats(stream.Context(), &StreamInstanceStatsRequest{
+		InstanceID:     req.InstanceId,
+		IncludeHistory: req.IncludeHistory,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		sample, err := agentStream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(sample); err != nil {
+			return err
+		}
+	}
+}
+
+// GetInstanceLogs implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) GetInstanceLogs(req *v1.GetInstanceLogsRequest, stream v1.ComputeService_GetInstanceLogsServer) error {
+	agentStream, err := h.service.GetInstanceLogs(stream.Context(), &GetInstanceLogsRequest{
+		InstanceID: req.InstanceId,
+		TailLines:  int(req.TailLines),
+		Follow:     req.Follow,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		chunk, err := agentStream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// GetBootDiagnostics implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) GetBootDiagnostics(ctx context.Context, req *v1.GetBootDiagnosticsRequest) (*v1.BootDiagnostics, error) {
+	diag, err := h.service.GetBootDiagnostics(ctx, &GetBootDiagnosticsRequest{
+		InstanceID: req.InstanceId,
+		Lines:      int(req.Lines),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v1.BootDiagnostics{
+		InstanceId:       diag.InstanceID,
+		NodeId:           diag.NodeID,
+		Screenshot:       diag.Screenshot,
+		ScreenshotFormat: diag.ScreenshotFormat,
+		SerialOutput:     diag.SerialOutput,
+		CollectedAt:      timestamppb.New(diag.CollectedAt),
+	}, nil
+}
+
+// AttachConsole implements v1.ComputeServiceServer. The RPC only streams to
+// the client, so console output is relayed but no input is sent.
+func (h *ComputeGRPCHandler) AttachConsole(req *v1.AttachConsoleRequest, stream v1.ComputeService_AttachConsoleServer) error {
+	console, err := h.service.OpenConsole(stream.Context(), &AttachConsoleRequest{
+		InstanceID: req.InstanceId,
+		Width:      int(req.Width),
+		Height:     int(req.Height),
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		out, err := console.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&v1.ConsoleData{Data: out.Data}); err != nil {
+			return err
+		}
+	}
+}
+
+// WatchInstance implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) WatchInstance(req *v1.WatchInstanceRequest, stream v1.ComputeService_WatchInstanceServer) error {
+	if req.InstanceId == "" {
+		return status.Error(codes.InvalidArgument, "instance_id is required")
+	}
+
+	return h.service.WatchInstances(stream.Context(), &WatchInstancesRequest{
+		InstanceID: req.InstanceId,
+	}, func(event *registry.InstanceEvent) error {
+		return stream.Send(registryInstanceEventToProto(event))
+	})
+}
+
+// WatchInstances implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) WatchInstances(req *v1.WatchInstancesRequest, stream v1.ComputeService_WatchInstancesServer) error {
+	return h.service.WatchInstances(stream.Context(), &WatchInstancesRequest{
+		NodeID:          req.NodeId,
+		Type:            protoTypeToDriverType(req.Type),
+		LabelSelector:   req.LabelSelector,
+		IncludeExisting: req.IncludeExisting,
+	}, func(event *registry.InstanceEvent) error {
+		return stream.Send(registryInstanceEventToProto(event))
+	})
+}
+
+// ValidateMigration implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) ValidateMigration(ctx context.Context, req *v1.ValidateMigrationRequest) (*v1.MigrationValidationReport, error) {
+	report, err := h.service.ValidateMigration(ctx, &ValidateMigrationRequest{
+		InstanceID:   req.InstanceId,
+		TargetNodeID: req.TargetNodeId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return migrationReportToProto(report), nil
+}
+
+// MigrateInstance implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) MigrateInstance(ctx context.Context, req *v1.MigrateInstanceRequest) (*v1.Instance, error) {
+	instance, err := h.service.MigrateInstance(ctx, &MigrateInstanceRequest{
+		InstanceID:   req.InstanceId,
+		TargetNodeID: req.TargetNodeId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return registryInstanceToProto(instance), nil
+}
+
+// PrefetchImage implements v1.ComputeServiceServer.
+func (h *ComputeGRPCHandler) PrefetchImage(ctx context.Context, req *v1.PrefetchImageRequest) (*v1.PrefetchImageResponse, error) {
+	results, err := h.service.PrefetchImage(ctx, &PrefetchImageRequest{
+		ImageRef:      req.ImageRef,
+		Type:          protoTypeToDriverType(req.Type),
+		NodeIDs:       req.NodeIds,
+		LabelSelector: req.LabelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &v1.PrefetchImageResponse{Results: make([]*v1.PrefetchImageResult, 0, len(results))}
+	for _, r := range results {
+		resp.Results = append(resp.Results, &v1.PrefetchImageResult{
+			NodeId:    r.NodeID,
+			Status:    r.Status,
+			Image:     r.Image,
+			SizeBytes: r.SizeBytes,
+			Error:     r.Error,
+		})
+	}
+	return resp, nil
+}
+
 // ============================================================================
 // Conversion helpers
 // ============================================================================
@@ -178,10 +602,11 @@ func protoSpecToDriverSpec(spec *v1.InstanceSpec) driver.InstanceSpec {
 		ds.Disks = make([]driver.DiskSpec, len(spec.Disks))
 		for i, d := range spec.Disks {
 			ds.Disks[i] = driver.DiskSpec{
-				Name:   d.Name,
-				SizeGB: d.SizeBytes / (1024 * 1024 * 1024),
-				Type:   d.Type,
-				Boot:   d.Boot,
+				Name:       d.Name,
+				SizeGB:     d.SizeBytes / (1024 * 1024 * 1024),
+				Type:       d.Type,
+				SourcePath: d.SourcePath,
+				Boot:       d.Boot,
 			}
 		}
 	}
@@ -193,6 +618,11 @@ func protoSpecToDriverSpec(spec *v1.InstanceSpec) driver.InstanceSpec {
 			SubnetID:       spec.Network.SubnetId,
 			SecurityGroups: spec.Network.SecurityGroups,
 			AssignPublicIP: spec.Network.AssignPublicIp,
+			IPAddress:      spec.Network.IpAddress,
+			MACAddress:     spec.Network.MacAddress,
+			PortID:         spec.Network.PortId,
+			BindingType:    driver.PortBindingType(spec.Network.BindingType),
+			VFAddress:      spec.Network.VfAddress,
 		}
 	}
 
@@ -207,6 +637,41 @@ func protoSpecToDriverSpec(spec *v1.InstanceSpec) driver.InstanceSpec {
 		}
 	}
 
+	// Convert CPU
+	if spec.Cpu != nil {
+		ds.CPU = driver.CPUSpec{
+			Mode:             driver.CPUMode(spec.Cpu.Mode),
+			Model:            spec.Cpu.Model,
+			RequiredFeatures: spec.Cpu.RequiredFeatures,
+			DisabledFeatures: spec.Cpu.DisabledFeatures,
+		}
+	}
+	ds.HugePages = spec.Hugepages
+	ds.Architecture = spec.Architecture
+	ds.Runtime = spec.Runtime
+	ds.UserData = spec.UserData
+	ds.SSHKeys = spec.SshKeys
+	if spec.Gpu != nil {
+		ds.GPU = driver.GPURequest{
+			Count:    int(spec.Gpu.Count),
+			Vendor:   spec.Gpu.Vendor,
+			DeviceID: spec.Gpu.DeviceId,
+		}
+	}
+	ds.GPUDevices = spec.GpuDevices
+	ds.CPUPlacement = apiconv.CPUPlacementFromProto(spec.CpuPlacement)
+	ds.PinnedCPUs = apiconv.Ints(spec.PinnedCpus)
+	ds.NUMANodes = apiconv.Ints(spec.NumaNodes)
+	ds.NodeSelector = spec.NodeSelector
+	for _, t := range spec.Tolerations {
+		ds.Tolerations = append(ds.Tolerations, driver.Toleration{
+			Key:      t.Key,
+			Operator: t.Operator,
+			Value:    t.Value,
+			Effect:   t.Effect,
+		})
+	}
+
 	return ds
 }
 
@@ -225,12 +690,18 @@ func registryInstanceToProto(inst *registry.Instance) *v1.Instance {
 	proto := &v1.Instance{
 		Id:          inst.ID,
 		Name:        inst.Name,
+		Description: inst.Description,
 		Type:        driverTypeToProtoType(inst.Type),
 		State:       driverStateToProtoState(inst.State),
 		StateReason: inst.StateReason,
 		NodeId:      inst.NodeID,
 		IpAddress:   inst.IPAddress,
 		CreatedAt:   timestamppb.New(inst.CreatedAt),
+
+		DesiredState: driverStateToProtoState(inst.DesiredState),
+
+		HighAvailability: inst.HighAvailability,
+		RescheduleCount:  int32(inst.RescheduleCount),
 	}
 
 	if inst.StartedAt != nil {
@@ -240,6 +711,27 @@ func registryInstanceToProto(inst *registry.Instance) *v1.Instance {
 	// Convert spec
 	proto.Spec = driverSpecToProtoSpec(&inst.Spec)
 
+	if inst.Capabilities != nil {
+		proto.Capabilities = apiconv.CapabilitiesToProto(*inst.Capabilities)
+	}
+
+	for _, c := range inst.SpreadConstraints {
+		proto.SpreadConstraints = append(proto.SpreadConstraints, &v1.SpreadConstraint{
+			TopologyKey: c.TopologyKey,
+			MatchLabels: c.MatchLabels,
+		})
+	}
+
+	if attempt := inst.LastScheduling; attempt != nil {
+		proto.LastScheduling = &v1.SchedulingAttempt{
+			Time:       timestamppb.New(attempt.Time),
+			NodeId:     attempt.NodeID,
+			Candidates: int32(attempt.Candidates),
+			Rejected:   attempt.Rejected,
+			Error:      attempt.Error,
+		}
+	}
+
 	// Convert metadata
 	if len(inst.Labels) > 0 || len(inst.Annotations) > 0 {
 		proto.Metadata = &v1.Metadata{
@@ -251,6 +743,74 @@ func registryInstanceToProto(inst *registry.Instance) *v1.Instance {
 	return proto
 }
 
+func protoSpreadToRegistry(constraints []*v1.SpreadConstraint) []registry.SpreadConstraint {
+	var result []registry.SpreadConstraint
+	for _, c := range constraints {
+		result = append(result, registry.SpreadConstraint{
+			TopologyKey: c.TopologyKey,
+			MatchLabels: c.MatchLabels,
+		})
+	}
+	return result
+}
+
+func protoTemplateToRegistry(t *v1.InstanceTemplate) registry.InstanceTemplate {
+	if t == nil {
+		return registry.InstanceTemplate{}
+	}
+	return registry.InstanceTemplate{
+		Type:              protoTypeToDriverType(t.Type),
+		Spec:              protoSpecToDriverSpec(t.Spec),
+		Labels:            protoMetadataToLabels(t.Metadata),
+		Annotations:       t.Metadata.GetAnnotations(),
+		Region:            t.Region,
+		Zone:              t.Zone,
+		HighAvailability:  t.HighAvailability,
+		SpreadConstraints: protoSpreadToRegistry(t.SpreadConstraints),
+	}
+}
+
+func groupStatusToProto(s *InstanceGroupStatus) *v1.InstanceGroup {
+	group, t := s.Group, s.Group.Template
+
+	template := &v1.InstanceTemplate{
+		Type:             driverTypeToProtoType(t.Type),
+		Spec:             driverSpecToProtoSpec(&t.Spec),
+		Region:           t.Region,
+		Zone:             t.Zone,
+		HighAvailability: t.HighAvailability,
+	}
+	if len(t.Labels) > 0 || len(t.Annotations) > 0 {
+		template.Metadata = &v1.Metadata{
+			Labels:      t.Labels,
+			Annotations: t.Annotations,
+		}
+	}
+	for _, c := range t.SpreadConstraints {
+		template.SpreadConstraints = append(template.SpreadConstraints, &v1.SpreadConstraint{
+			TopologyKey: c.TopologyKey,
+			MatchLabels: c.MatchLabels,
+		})
+	}
+
+	groupStatus := &v1.InstanceGroupStatus{Replicas: int32(len(s.Instances))}
+	for _, instance := range s.Instances {
+		if instance.IsRunning() {
+			groupStatus.ReadyReplicas++
+		}
+		groupStatus.InstanceIds = append(groupStatus.InstanceIds, instance.ID)
+	}
+
+	return &v1.InstanceGroup{
+		Name:      group.Name,
+		Replicas:  int32(group.Replicas),
+		Template:  template,
+		Status:    groupStatus,
+		CreatedAt: timestamppb.New(group.CreatedAt),
+		UpdatedAt: timestamppb.New(group.UpdatedAt),
+	}
+}
+
 func driverStateToProtoState(s driver.InstanceState) v1.InstanceState {
 	switch s {
 	case driver.StatePending:
@@ -261,6 +821,10 @@ func driverStateToProtoState(s driver.InstanceState) v1.InstanceState {
 		return v1.InstanceState_INSTANCE_STATE_RUNNING
 	case driver.StateStopped:
 		return v1.InstanceState_INSTANCE_STATE_STOPPED
+	case driver.StatePaused:
+		return v1.InstanceState_INSTANCE_STATE_PAUSED
+	case driver.StateSuspended:
+		return v1.InstanceState_INSTANCE_STATE_SUSPENDED
 	case driver.StateFailed:
 		return v1.InstanceState_INSTANCE_STATE_FAILED
 	default:
@@ -285,3 +849,27 @@ func driverStatsToProtoStats(stats *driver.InstanceStats) *v1.InstanceStats {
 		CollectedAt:      timestamppb.New(stats.CollectedAt),
 	}
 }
+
+func migrationReportToProto(report *MigrationReport) *v1.MigrationValidationReport {
+	proto := &v1.MigrationValidationReport{
+		InstanceId:   report.InstanceID,
+		SourceNodeId: report.SourceNodeID,
+		TargetNodeId: report.TargetNodeID,
+		Compatible:   report.Compatible,
+	}
+	for _, check := range report.Checks {
+		proto.Checks = append(proto.Checks, &v1.MigrationCheck{
+			Name:    check.Name,
+			Passed:  check.Passed,
+			Message: check.Message,
+		})
+	}
+	return proto
+}
+
+func registryInstanceEventToProto(event *registry.InstanceEvent) *v1.InstanceEvent {
+	return &v1.InstanceEvent{
+		Type:     registryEventTypeToProto(event.Type),
+		Instance: registryInstanceToProto(event.Instance),
+	}
+}
@@ -2,14 +2,27 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/apiconv"
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/idempotency"
+	"hypervisor/pkg/cluster/latency"
 	"hypervisor/pkg/cluster/registry"
 	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/metrics"
+	"hypervisor/pkg/tracing"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -20,7 +33,21 @@ type ComputeService struct {
 	nodeRegistry     *registry.EtcdRegistry
 	instanceRegistry *registry.EtcdInstanceRegistry
 	agentClients     *AgentClientPool
+	network          NetworkChecker
+	latency          *latency.Store
+	recommendations  RecommendationConfig
+	events           *events.Recorder
+	idempotency      *idempotency.Store
+	groupController  *GroupController
 	logger           *zap.Logger
+
+	// Creates this server has sent to each node and not yet seen finish.
+	// Node reports lag by a resource report interval, so a burst of creates
+	// would otherwise all land on the same node. In active-active mode the
+	// other servers' creates are counted through ownership.
+	creates   map[string]int
+	createsMu sync.Mutex
+	ownership *agentOwnership
 }
 
 // NewComputeService creates a new ComputeService.
@@ -28,41 +55,171 @@ func NewComputeService(
 	nodeReg *registry.EtcdRegistry,
 	instanceReg *registry.EtcdInstanceRegistry,
 	agentClients *AgentClientPool,
+	recorder *events.Recorder,
 	logger *zap.Logger,
 ) *ComputeService {
 	return &ComputeService{
 		nodeRegistry:     nodeReg,
 		instanceRegistry: instanceReg,
 		agentClients:     agentClients,
+		recommendations:  DefaultRecommendationConfig(),
+		events:           recorder,
 		logger:           logger,
+		creates:          make(map[string]int),
 	}
 }
 
+// recordEvent records an event about an instance.
+func (s *ComputeService) recordEvent(ctx context.Context, eventType, instanceID, nodeID, reason, message string) {
+	s.events.Record(ctx, events.Event{
+		Type:     eventType,
+		Kind:     events.KindInstance,
+		ObjectID: instanceID,
+		NodeID:   nodeID,
+		Reason:   reason,
+		Message:  message,
+	})
+}
+
 // CreateInstanceRequest represents a create instance request.
 type CreateInstanceRequest struct {
 	Name            string
 	Type            driver.InstanceType
 	Spec            driver.InstanceSpec
 	Metadata        map[string]string
+	Annotations     map[string]string
 	PreferredNodeID string
 	Region          string
 	Zone            string
+
+	// HighAvailability reschedules the instance onto a healthy node if its host fails.
+	HighAvailability bool
+
+	Description string
+
+	// IdempotencyKey makes retries of the create return the first
+	// instance created instead of creating another
+	IdempotencyKey string
+
+	// Spread the instance away from others sharing labels
+	SpreadConstraints []registry.SpreadConstraint
+
+	// Latency of the candidate nodes to the instance's latency group, set
+	// while scheduling
+	latency *latencyPlacement
+
+	// Outcome of scheduling, set by scheduleInstance
+	scheduling *registry.SchedulingAttempt
+
+	// Matching instances per topology domain, set while scheduling
+	spread *spreadPlacement
 }
 
 // CreateInstance creates a new instance.
 func (s *ComputeService) CreateInstance(ctx context.Context, req *CreateInstanceRequest) (*registry.Instance, error) {
-	// Validate instance type
+	return s.runIdempotent(ctx, req.IdempotencyKey, idempotentCreate, req, func(ctx context.Context, record *idempotency.Record) (*registry.Instance, error) {
+		return s.createInstance(ctx, req, record)
+	})
+}
+
+// validateCreateRequest checks a create request and normalizes it: the type
+// defaults to a VM and node-assigned fields of the spec are cleared.
+func validateCreateRequest(req *CreateInstanceRequest) error {
 	if req.Type == "" {
 		req.Type = driver.InstanceTypeVM
 	}
+	if req.Spec.Architecture != "" {
+		arch, err := driver.ParseArchitecture(req.Spec.Architecture)
+		if err != nil {
+			return apierror.InvalidField("spec.architecture", err.Error())
+		}
+		req.Spec.Architecture = arch
+	}
+	if req.Spec.Runtime != "" {
+		if req.Type != driver.InstanceTypeContainer {
+			return apierror.InvalidField("spec.runtime", fmt.Sprintf("a runtime can only be set for containers, got %s", req.Type))
+		}
+		runtime, err := driver.ParseRuntime(req.Spec.Runtime)
+		if err != nil {
+			return apierror.InvalidField("spec.runtime", err.Error())
+		}
+		req.Spec.Runtime = runtime
+	}
+	if err := req.Spec.CPU.Validate(); err != nil {
+		return apierror.InvalidField("spec.cpu", fmt.Sprintf("invalid cpu spec: %v", err))
+	}
+	if err := req.Spec.GPU.Validate(); err != nil {
+		return apierror.InvalidField("spec.gpu", fmt.Sprintf("invalid gpu request: %v", err))
+	}
+	if req.Spec.GPU.Count > 0 && req.Type != driver.InstanceTypeVM {
+		return apierror.InvalidField("spec.gpu", fmt.Sprintf("gpu passthrough requires a vm, got %s", req.Type))
+	}
+	switch req.Spec.Network.BindingType {
+	case "", driver.PortBindingOVS:
+	case driver.PortBindingVhostUser:
+		if req.Type != driver.InstanceTypeVM {
+			return apierror.InvalidField("spec.network.binding_type", fmt.Sprintf("a vhost-user binding requires a vm, got %s", req.Type))
+		}
+		// Open vSwitch reads and writes guest memory directly, which must
+		// be shared hugepages
+		req.Spec.HugePages = true
+	case driver.PortBindingSRIOV:
+		if req.Type != driver.InstanceTypeVM {
+			return apierror.InvalidField("spec.network.binding_type", fmt.Sprintf("an sriov binding requires a vm, got %s", req.Type))
+		}
+		if req.Spec.Network.PortID == "" {
+			return apierror.InvalidField("spec.network.port_id", "an sriov binding requires an SR-IOV port")
+		}
+	default:
+		return apierror.InvalidField("spec.network.binding_type", fmt.Sprintf("unsupported binding type %q", req.Spec.Network.BindingType))
+	}
+	if err := req.Spec.CPUPlacement.Validate(); err != nil {
+		return apierror.InvalidField("spec.cpu_placement", fmt.Sprintf("invalid cpu placement: %v", err))
+	}
+	if !req.Spec.CPUPlacement.IsZero() && req.Type != driver.InstanceTypeVM {
+		return apierror.InvalidField("spec.cpu_placement", fmt.Sprintf("cpu placement requires a vm, got %s", req.Type))
+	}
+	if err := validateNodeAffinity(&req.Spec); err != nil {
+		return err
+	}
+	if err := validateSpread(req); err != nil {
+		return err
+	}
+	// Devices and cores are assigned by the node
+	req.Spec.GPUDevices = nil
+	req.Spec.Network.VFAddress = ""
+	req.Spec.Network.VhostUserSocket = ""
+	req.Spec.PinnedCPUs, req.Spec.NUMANodes = nil, nil
+	return nil
+}
+
+// createInstance creates an instance. With an idempotency record, the
+// instance keeps the ID of earlier attempts and what they left behind is
+// resolved first.
+func (s *ComputeService) createInstance(ctx context.Context, req *CreateInstanceRequest, record *idempotency.Record) (*registry.Instance, error) {
+	if err := validateCreateRequest(req); err != nil {
+		return nil, err
+	}
 
 	// Generate instance ID
 	instanceID := uuid.New().String()
+	if record != nil {
+		if record.InstanceID != "" {
+			instanceID = record.InstanceID
+			instance, err := s.resumeCreate(ctx, record)
+			if err != nil || instance != nil {
+				return instance, err
+			}
+		}
+		record.InstanceID, record.NodeID = instanceID, ""
+	}
 
 	// Find suitable node for scheduling
 	node, err := s.scheduleInstance(ctx, req)
 	if err != nil {
-		return nil, status.Errorf(codes.ResourceExhausted, "no suitable node found: %v", err)
+		s.recordEvent(ctx, events.TypeWarning, instanceID, "", "FailedScheduling",
+			fmt.Sprintf("no suitable node found for %s: %v", req.Name, err))
+		return nil, schedulingFailed(err)
 	}
 
 	s.logger.Info("instance scheduled",
@@ -75,8 +232,28 @@ func (s *ComputeService) CreateInstance(ctx context.Context, req *CreateInstance
 	// Get agent client
 	agentClient, err := s.agentClients.GetClient(ctx, node.ID)
 	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "failed to connect to agent: %v", err)
+		return nil, agentUnavailable(err)
+	}
+
+	// Remember the node before asking it to create anything, so a retry
+	// can clean up after a failure
+	if record != nil {
+		record.NodeID = node.ID
+		if err := s.idempotency.Save(ctx, record); err != nil {
+			if errors.Is(err, idempotency.ErrSuperseded) {
+				return nil, status.Errorf(codes.Aborted, "%v", err)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to record idempotency key: %v", err)
+		}
+	}
+
+	if load := s.createLoad(node); load.Saturated() {
+		s.recordEvent(ctx, events.TypeNormal, instanceID, node.ID, "CreateQueued",
+			fmt.Sprintf("node %s has %d creates pending (limit %d); %s will wait for a slot",
+				node.ID, load.Pending(), load.Limit, req.Name))
 	}
+	done := s.beginCreate(ctx, node.ID, instanceID)
+	defer done()
 
 	// Call agent to create instance
 	agentReq := &v1.AgentCreateInstanceRequest{
@@ -89,23 +266,44 @@ func (s *ComputeService) CreateInstance(ctx context.Context, req *CreateInstance
 
 	agentResp, err := agentClient.CreateInstance(ctx, agentReq)
 	if err != nil {
+		s.recordEvent(ctx, events.TypeWarning, instanceID, node.ID, "FailedCreate", err.Error())
 		return nil, status.Errorf(codes.Internal, "agent failed to create instance: %v", err)
 	}
 
-	// Create instance record for registry
+	// Create instance record for registry. New instances are left as the
+	// driver created them (usually stopped) until the user starts them.
+	state := protoStateToDriverState(agentResp.State)
+	desired := driver.StateStopped
+	if state == driver.StateRunning {
+		desired = driver.StateRunning
+	}
+
 	now := time.Now()
 	instance := &registry.Instance{
-		ID:          instanceID,
-		Name:        req.Name,
-		Type:        req.Type,
-		State:       protoStateToDriverState(agentResp.State),
-		StateReason: agentResp.StateReason,
-		Spec:        req.Spec,
-		NodeID:      node.ID,
-		IPAddress:   agentResp.IpAddress,
-		Labels:      req.Metadata,
-		CreatedAt:   now,
-		UpdatedAt:   now,
+		ID:           instanceID,
+		Name:         req.Name,
+		Description:  req.Description,
+		Type:         req.Type,
+		State:        state,
+		DesiredState: desired,
+		StateReason:  agentResp.StateReason,
+		Spec:         req.Spec,
+		NodeID:       node.ID,
+		IPAddress:    agentResp.IpAddress,
+		Capabilities: apiconv.CapabilitiesFromProto(agentResp.Capabilities),
+		Labels:       req.Metadata,
+		Annotations:  req.Annotations,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+
+		HighAvailability:  req.HighAvailability,
+		SpreadConstraints: req.SpreadConstraints,
+		LastScheduling:    req.scheduling,
+	}
+	// Record the runtime the node ran a container under when none was
+	// asked for
+	if instance.Spec.Runtime == "" {
+		instance.Spec.Runtime = agentResp.GetSpec().GetRuntime()
 	}
 
 	// Store in etcd
@@ -124,19 +322,158 @@ func (s *ComputeService) CreateInstance(ctx context.Context, req *CreateInstance
 		zap.String("name", req.Name),
 		zap.String("node_id", node.ID),
 	)
+	s.recordEvent(ctx, events.TypeNormal, instanceID, node.ID, "Created",
+		fmt.Sprintf("created %s %s on node %s", req.Type, req.Name, node.ID))
+
+	return instance, nil
+}
+
+// RescheduleInstance recreates an instance from a failed node on a healthy one.
+// The instance keeps its ID; the registry record is moved to the new node.
+func (s *ComputeService) RescheduleInstance(ctx context.Context, instance *registry.Instance) (*registry.Instance, error) {
+	failedNodeID := instance.NodeID
+
+	req := &CreateInstanceRequest{
+		Name:        instance.Name,
+		Type:        instance.Type,
+		Spec:        instance.Spec,
+		Metadata:    instance.Labels,
+		Annotations: instance.Annotations,
+
+		SpreadConstraints: instance.SpreadConstraints,
+	}
+	node, err := s.scheduleInstance(ctx, req)
+	if err != nil {
+		// Keep the attempt on the instance so describe shows why it is
+		// stuck on the failed node
+		instance.LastScheduling = req.scheduling
+		if _, updateErr := s.instanceRegistry.Modify(ctx, instance.ID, func(i *registry.Instance) error {
+			i.LastScheduling = req.scheduling
+			return nil
+		}); updateErr != nil {
+			s.logger.Warn("failed to record scheduling attempt", zap.String("instance_id", instance.ID), zap.Error(updateErr))
+		}
+		s.recordEvent(ctx, events.TypeWarning, instance.ID, failedNodeID, "FailedScheduling",
+			fmt.Sprintf("no suitable node found to reschedule %s: %v", instance.Name, err))
+		return nil, fmt.Errorf("no suitable node found: %w", err)
+	}
+	if node.ID == failedNodeID {
+		return nil, fmt.Errorf("no healthy node available other than %s", failedNodeID)
+	}
+
+	agentClient, err := s.agentClients.GetClient(ctx, node.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to agent: %w", err)
+	}
+
+	done := s.beginCreate(ctx, node.ID, instance.ID)
+	defer done()
+
+	agentResp, err := agentClient.CreateInstance(ctx, &v1.AgentCreateInstanceRequest{
+		InstanceId: instance.ID,
+		Name:       instance.Name,
+		Type:       driverTypeToProtoType(instance.Type),
+		Spec:       driverSpecToProtoSpec(&instance.Spec),
+		Labels:     instance.Labels,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("agent failed to create instance: %w", err)
+	}
+
+	// Bring it back up if it was running before the failure
+	state := protoStateToDriverState(agentResp.State)
+	if state != driver.StateRunning {
+		if startResp, err := agentClient.StartInstance(ctx, &v1.AgentInstanceRequest{InstanceId: instance.ID}); err != nil {
+			s.logger.Warn("failed to start rescheduled instance",
+				zap.String("instance_id", instance.ID),
+				zap.String("node_id", node.ID),
+				zap.Error(err),
+			)
+		} else {
+			agentResp = startResp
+			state = protoStateToDriverState(startResp.State)
+		}
+	}
+
+	// Move the record unless the instance was deleted or moved meanwhile,
+	// in which case the copy just created is not wanted
+	moved, err := s.instanceRegistry.Modify(ctx, instance.ID, func(i *registry.Instance) error {
+		if i.NodeID != failedNodeID {
+			return errInstanceMoved
+		}
+		i.NodeID = node.ID
+		i.State = state
+		i.DesiredState = driver.StateRunning
+		i.StateReason = fmt.Sprintf("rescheduled from failed node %s", failedNodeID)
+		i.IPAddress = agentResp.IpAddress
+		i.Capabilities = apiconv.CapabilitiesFromProto(agentResp.Capabilities)
+		i.RescheduleCount++
+		i.LastScheduling = req.scheduling
+		i.StartedAt = nil
+		if agentResp.StartedAt != nil {
+			t := agentResp.StartedAt.AsTime()
+			i.StartedAt = &t
+		}
+		return nil
+	})
+	if err != nil {
+		_, _ = agentClient.DeleteInstance(ctx, &v1.AgentDeleteInstanceRequest{InstanceId: instance.ID})
+		return nil, fmt.Errorf("failed to update instance: %w", err)
+	}
+	instance = moved
+
+	s.logger.Info("instance rescheduled",
+		zap.String("instance_id", instance.ID),
+		zap.String("from_node", failedNodeID),
+		zap.String("to_node", node.ID),
+		zap.Int("reschedule_count", instance.RescheduleCount),
+	)
+	s.recordEvent(ctx, events.TypeWarning, instance.ID, node.ID, "Rescheduled",
+		fmt.Sprintf("rescheduled from failed node %s to %s", failedNodeID, node.ID))
 
 	return instance, nil
 }
 
-// scheduleInstance finds a suitable node for the instance.
+// scheduleInstance finds a suitable node for the instance. The attempt,
+// including why each rejected node was rejected, is kept on req.
 func (s *ComputeService) scheduleInstance(ctx context.Context, req *CreateInstanceRequest) (*registry.Node, error) {
+	attempt := &registry.SchedulingAttempt{Time: time.Now()}
+	req.scheduling = attempt
+
+	ctx, span := tracing.Start(ctx, "schedule",
+		attribute.String("instance.name", req.Name),
+		attribute.String("instance.type", string(req.Type)),
+	)
+	node, err := s.selectNode(ctx, req, attempt)
+	if err != nil {
+		attempt.Error = err.Error()
+		tracing.End(span, err)
+		return nil, err
+	}
+	attempt.NodeID = node.ID
+	span.SetAttributes(
+		attribute.String("node.id", node.ID),
+		attribute.Int("candidates", attempt.Candidates),
+	)
+	tracing.End(span, nil)
+	return node, nil
+}
+
+// selectNode filters and scores the nodes for an instance, recording each
+// rejected node and its reason in attempt.
+func (s *ComputeService) selectNode(ctx context.Context, req *CreateInstanceRequest, attempt *registry.SchedulingAttempt) (*registry.Node, error) {
 	var nodes []*registry.Node
 	var err error
+	rejected := make(map[string]string)
+	attempt.Rejected = rejected
 
-	// If preferred node is specified, try it first
+	// If preferred node is specified, try it first unless it is busy
+	// creating other instances
 	if req.PreferredNodeID != "" {
 		node, err := s.nodeRegistry.Get(ctx, req.PreferredNodeID)
-		if err == nil && s.canScheduleOn(node, req) {
+		if err == nil && s.canScheduleOn(node, req) && !s.createLoad(node).Saturated() {
+			attempt.Candidates = 1
+			metrics.ObserveSchedulingAttempt(metrics.ScheduleSuccess)
 			return node, nil
 		}
 	}
@@ -144,49 +481,157 @@ func (s *ComputeService) scheduleInstance(ctx context.Context, req *CreateInstan
 	// List all worker nodes
 	nodes, err = s.nodeRegistry.ListByRole(ctx, registry.NodeRoleWorker)
 	if err != nil {
+		metrics.ObserveSchedulingAttempt(metrics.ScheduleError)
 		return nil, fmt.Errorf("failed to list nodes: %w", err)
 	}
+	attempt.Candidates = len(nodes)
 
-	// Filter by region and zone
+	// Filter by region and zone, remembering why each node was rejected
 	filtered := make([]*registry.Node, 0)
 	for _, node := range nodes {
-		if !node.IsReady() {
+		if reason := notReadyReason(node); reason != "" {
+			rejected[node.ID] = reason
 			continue
 		}
 
 		if req.Region != "" && node.Region != req.Region {
+			rejected[node.ID] = fmt.Sprintf("node is in region %q, not %q", node.Region, req.Region)
 			continue
 		}
 
 		if req.Zone != "" && node.Zone != req.Zone {
+			rejected[node.ID] = fmt.Sprintf("node is in zone %q, not %q", node.Zone, req.Zone)
 			continue
 		}
 
-		if s.canScheduleOn(node, req) {
-			filtered = append(filtered, node)
+		if reason := s.unschedulableReason(node, req); reason != "" {
+			rejected[node.ID] = reason
+			continue
 		}
+		filtered = append(filtered, node)
 	}
 
 	if len(filtered) == 0 {
-		return nil, fmt.Errorf("no suitable node found")
+		metrics.ObserveSchedulingAttempt(metrics.ScheduleNoNode)
+		return nil, &schedulingError{nodes: rejected}
 	}
 
-	// Simple bin-packing: select node with least available resources
+	// Keep latency groups close together
+	filtered, err = s.placeLatencyGroup(ctx, req, filtered, rejected)
+	if err != nil {
+		metrics.ObserveSchedulingAttempt(metrics.ScheduleNoNode)
+		return nil, err
+	}
+
+	// Skip nodes at their create limit. If every node is, queue on the one
+	// with the fewest pending creates.
+	filtered = s.filterCreateSaturated(filtered, rejected)
+
+	// Count the instances to spread away from
+	if err := s.prepareSpread(ctx, req, nodes); err != nil {
+		metrics.ObserveSchedulingAttempt(metrics.ScheduleError)
+		return nil, err
+	}
+
+	// Select the node with the highest weighted score
 	selected := filtered[0]
 	for _, node := range filtered[1:] {
-		if s.scoreNode(node) > s.scoreNode(selected) {
+		if s.scoreNode(node, req) > s.scoreNode(selected, req) {
 			selected = node
 		}
 	}
 
+	metrics.ObserveSchedulingAttempt(metrics.ScheduleSuccess)
 	return selected, nil
 }
 
+// notReadyReason returns why a node takes no new instances, or "" if it is
+// ready.
+func notReadyReason(node *registry.Node) string {
+	switch node.Status {
+	case registry.NodeStatusReady:
+		if !node.IsReady() {
+			return "node is not ready: its ready condition is not true"
+		}
+		return ""
+	case registry.NodeStatusMaintenance:
+		return "node is cordoned"
+	case registry.NodeStatusDraining:
+		return "node is draining"
+	default:
+		return fmt.Sprintf("node is not ready (status %s)", node.Status)
+	}
+}
+
 // canScheduleOn checks if an instance can be scheduled on a node.
 func (s *ComputeService) canScheduleOn(node *registry.Node, req *CreateInstanceRequest) bool {
+	return s.unschedulableReason(node, req) == ""
+}
+
+// unschedulableReason returns why an instance cannot be scheduled on a
+// node, or "" if it can.
+func (s *ComputeService) unschedulableReason(node *registry.Node, req *CreateInstanceRequest) string {
 	// Check if node supports the instance type
 	if !node.SupportsInstanceType(registry.InstanceType(req.Type)) {
-		return false
+		return fmt.Sprintf("node does not run %s instances", req.Type)
+	}
+
+	// Check the node runs the image's architecture. Nodes that have not
+	// reported their inventory only take instances without one.
+	if arch := req.Spec.Architecture; arch != "" && node.Architecture() != arch {
+		if node.Architecture() == "" {
+			return "node has not reported its architecture"
+		}
+		return fmt.Sprintf("node is %s, image is %s", node.Architecture(), arch)
+	}
+
+	// Check the node has the container runtime installed. Nodes that do
+	// not report their runtimes are left to refuse it on create.
+	if runtime := req.Spec.Runtime; runtime != "" {
+		if caps := node.CapabilitiesFor(registry.InstanceType(req.Type)); caps != nil && !caps.SupportsRuntime(runtime) {
+			return fmt.Sprintf("node does not have the %s runtime", runtime)
+		}
+	}
+
+	// Check the node's labels and taints
+	if reason := nodeAffinityReason(node, &req.Spec); reason != "" {
+		return reason
+	}
+
+	// Check CPU model and features. Nodes that have not reported their CPU
+	// only take instances without CPU requirements.
+	if req.Spec.CPU.Mode == driver.CPUModeCustom || len(req.Spec.CPU.RequiredFeatures) > 0 {
+		if node.CPU == nil {
+			return "node has not reported its cpu model"
+		}
+		if err := node.CPU.Supports(req.Spec.CPU); err != nil {
+			return fmt.Sprintf("cpu does not match: %v", err)
+		}
+	}
+
+	// Check GPUs of the requested vendor and model are free
+	if req.Spec.GPU.Count > 0 {
+		if free := node.FreeGPUs(req.Spec.GPU); free < req.Spec.GPU.Count {
+			return fmt.Sprintf("insufficient matching gpus (%d free, %d requested)", free, req.Spec.GPU.Count)
+		}
+	}
+
+	// Check Open vSwitch can plug a vhost-user port
+	if req.Spec.Network.BindingType == driver.PortBindingVhostUser && (node.Host == nil || !node.Host.VhostUser) {
+		return "no OVS-DPDK datapath for vhost-user ports"
+	}
+
+	// Check an SR-IOV virtual function is free for the port
+	if req.Spec.Network.BindingType == driver.PortBindingSRIOV && node.FreeVFs() == 0 {
+		return "no free SR-IOV virtual function"
+	}
+
+	// Check enough cores are left to dedicate; dedicated cores are never
+	// shared, so they cannot be overcommitted
+	if req.Spec.CPUPlacement.DedicatedCores {
+		if free := node.FreeDedicatedCPUs(nil); free < req.Spec.CPUCores {
+			return fmt.Sprintf("insufficient cores to dedicate (%d free, %d requested)", free, req.Spec.CPUCores)
+		}
 	}
 
 	// Check resources
@@ -194,30 +639,305 @@ func (s *ComputeService) canScheduleOn(node *registry.Node, req *CreateInstanceR
 		CPUCores:    req.Spec.CPUCores,
 		MemoryBytes: req.Spec.MemoryMB * 1024 * 1024,
 		DiskBytes:   req.Spec.DiskGB * 1024 * 1024 * 1024,
+		GPUCount:    req.Spec.GPU.Count,
 	}
+	if node.CanSchedule(required) {
+		return ""
+	}
+
+	avail := node.AvailableResources()
+	switch {
+	case avail.CPUCores < required.CPUCores:
+		return fmt.Sprintf("insufficient cpu (%d cores free, %d requested)", avail.CPUCores, required.CPUCores)
+	case avail.MemoryBytes < required.MemoryBytes:
+		return fmt.Sprintf("insufficient memory (%d MiB free, %d MiB requested)", avail.MemoryBytes>>20, required.MemoryBytes>>20)
+	case avail.DiskBytes < required.DiskBytes:
+		return fmt.Sprintf("insufficient disk (%d GiB free, %d GiB requested)", avail.DiskBytes>>30, required.DiskBytes>>30)
+	default:
+		return fmt.Sprintf("insufficient gpus (%d free, %d requested)", avail.GPUCount, required.GPUCount)
+	}
+}
+
+// schedulingError reports that no node could take an instance and why each
+// node was rejected.
+type schedulingError struct {
+	nodes map[string]string // Node ID to the reason it was rejected
+}
+
+// maxReasonsInMessage bounds the node reasons spelled out in the error
+// message; all of them are in the error details.
+const maxReasonsInMessage = 3
+
+func (e *schedulingError) Error() string {
+	if len(e.nodes) == 0 {
+		return "no worker nodes registered"
+	}
+
+	ids := make([]string, 0, len(e.nodes))
+	for id := range e.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
 
-	return node.CanSchedule(required)
+	parts := make([]string, 0, maxReasonsInMessage+1)
+	for _, id := range ids {
+		if len(parts) == maxReasonsInMessage {
+			parts = append(parts, fmt.Sprintf("and %d more", len(ids)-maxReasonsInMessage))
+			break
+		}
+		parts = append(parts, id+": "+e.nodes[id])
+	}
+	return fmt.Sprintf("%d nodes rejected: %s", len(ids), strings.Join(parts, "; "))
 }
 
-// scoreNode calculates a scheduling score for a node (higher is better).
-func (s *ComputeService) scoreNode(node *registry.Node) float64 {
+// schedulingFailed turns a scheduling error into the status returned to
+// clients, with the reason of every rejected node attached.
+func schedulingFailed(err error) error {
+	var schedErr *schedulingError
+	if errors.As(err, &schedErr) {
+		return apierror.SchedulingFailed(fmt.Sprintf("no suitable node found: %v", err), schedErr.nodes)
+	}
+	return apierror.SchedulingFailed(fmt.Sprintf("no suitable node found: %v", err), nil)
+}
+
+// filterCreateSaturated drops nodes at their concurrent create limit,
+// recording them in rejected. If all nodes are at the limit, it returns the
+// one with the fewest pending creates.
+func (s *ComputeService) filterCreateSaturated(nodes []*registry.Node, rejected map[string]string) []*registry.Node {
+	available := make([]*registry.Node, 0, len(nodes))
+	var leastBusy *registry.Node
+	for _, node := range nodes {
+		load := s.createLoad(node)
+		if !load.Saturated() {
+			available = append(available, node)
+			continue
+		}
+		if leastBusy == nil || load.Pending() < s.createLoad(leastBusy).Pending() {
+			leastBusy = node
+		}
+	}
+
+	if len(available) == 0 {
+		return []*registry.Node{leastBusy}
+	}
+	for _, node := range nodes {
+		if load := s.createLoad(node); load.Saturated() {
+			rejected[node.ID] = fmt.Sprintf("node is busy with %d creates (limit %d)", load.Pending(), load.Limit)
+		}
+	}
+	return available
+}
+
+// createLoad returns a node's create load, counting creates the servers have
+// sent since the node last reported.
+func (s *ComputeService) createLoad(node *registry.Node) registry.CreateLoad {
+	load := node.Creates
+
+	s.createsMu.Lock()
+	sent := s.creates[node.ID]
+	s.createsMu.Unlock()
+	if s.ownership != nil {
+		sent += s.ownership.pendingCreates(node.ID)
+	}
+
+	if sent > load.Pending() {
+		load.InFlight = sent - load.Queued
+	}
+	return load
+}
+
+// beginCreate counts a create sent to a node until the returned function is
+// called.
+func (s *ComputeService) beginCreate(ctx context.Context, nodeID, instanceID string) func() {
+	s.createsMu.Lock()
+	s.creates[nodeID]++
+	s.createsMu.Unlock()
+
+	shared := func() {}
+	if s.ownership != nil {
+		shared = s.ownership.beginCreate(ctx, nodeID, instanceID)
+	}
+
+	return func() {
+		shared()
+
+		s.createsMu.Lock()
+		defer s.createsMu.Unlock()
+		if s.creates[nodeID]--; s.creates[nodeID] <= 0 {
+			delete(s.creates, nodeID)
+		}
+	}
+}
+
+// scorePlugin scores how well a node suits an instance, from 0 to 1.
+type scorePlugin struct {
+	name   string
+	weight float64
+	score  func(node *registry.Node, req *CreateInstanceRequest) float64
+}
+
+// scorePlugins are combined by scoreNode into a node's scheduling score.
+var scorePlugins = []scorePlugin{
+	{name: "resources", weight: 1, score: resourceScore},
+	{name: "image-locality", weight: 0.5, score: imageLocalityScore},
+	{name: "latency", weight: 2, score: latencyScore},
+	{name: "numa", weight: 1, score: numaScore},
+	{name: "spread", weight: 2, score: spreadScore},
+	{name: "taints", weight: 10, score: taintScore},
+}
+
+// scoreNode calculates a scheduling score for a node (higher is better) as
+// the weighted sum of the score plugins.
+func (s *ComputeService) scoreNode(node *registry.Node, req *CreateInstanceRequest) float64 {
+	var total float64
+	for _, plugin := range scorePlugins {
+		total += plugin.weight * plugin.score(node, req)
+	}
+	return total
+}
+
+// resourceScore prefers nodes with more free CPU and memory.
+func resourceScore(node *registry.Node, _ *CreateInstanceRequest) float64 {
 	avail := node.AvailableResources()
 
-	// Simple scoring based on available resources
-	cpuScore := float64(avail.CPUCores) / float64(node.Capacity.CPUCores+1)
-	memScore := float64(avail.MemoryBytes) / float64(node.Capacity.MemoryBytes+1)
+	cpuScore := float64(avail.CPUCores) / float64(node.Allocatable.CPUCores+1)
+	memScore := float64(avail.MemoryBytes) / float64(node.Allocatable.MemoryBytes+1)
 
 	return (cpuScore + memScore) / 2
 }
 
+// imageLocalityScore prefers nodes that already have the instance's image,
+// so the create does not wait for a pull.
+func imageLocalityScore(node *registry.Node, req *CreateInstanceRequest) float64 {
+	if req.Spec.Image != "" && node.HasImage(req.Spec.Image) {
+		return 1
+	}
+	return 0
+}
+
+// numaScore prefers nodes whose preferred NUMA node can hold the instance:
+// all of its dedicated cores when it asks for them, else just exists.
+func numaScore(node *registry.Node, req *CreateInstanceRequest) float64 {
+	pref := req.Spec.CPUPlacement.NUMANode
+	if pref == nil {
+		return 0
+	}
+	for _, numa := range node.NUMA {
+		if numa.ID != *pref {
+			continue
+		}
+		if req.Spec.CPUPlacement.DedicatedCores && numa.FreeCPUs() < req.Spec.CPUCores {
+			return 0
+		}
+		return 1
+	}
+	return 0
+}
+
+// UpdateInstanceRequest represents an update instance request. Without a
+// mask it replaces the labels, annotations and high availability setting;
+// with one, only the fields the mask names are changed.
+type UpdateInstanceRequest struct {
+	InstanceID       string
+	Mask             updateMask
+	Description      string
+	Labels           map[string]string
+	Annotations      map[string]string
+	HighAvailability bool
+	Limits           driver.ResourceLimits
+}
+
+// UpdateInstance updates an instance's mutable fields. The change is applied
+// atomically to the stored instance, so concurrent updates of other fields
+// are not lost. The label naming an instance's group cannot be set, changed
+// or removed.
+func (s *ComputeService) UpdateInstance(ctx context.Context, req *UpdateInstanceRequest) (*registry.Instance, error) {
+	var labelErr error
+	instance, err := s.instanceRegistry.Modify(ctx, req.InstanceID, func(instance *registry.Instance) error {
+		current := instance.Labels
+		if req.Mask == nil {
+			instance.Labels = req.Labels
+			instance.Annotations = req.Annotations
+			instance.HighAvailability = req.HighAvailability
+		} else {
+			applyInstanceUpdate(instance, req)
+		}
+		instance.Labels, labelErr = keepGroupLabel(current, instance.Labels)
+		return labelErr
+	})
+	if err != nil {
+		if labelErr != nil {
+			return nil, labelErr
+		}
+		if err == registry.ErrInstanceNotFound {
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceID)
+		}
+		if errors.Is(err, etcd.ErrConflict) {
+			return nil, status.Errorf(codes.Aborted, "instance %s is being updated concurrently, retry", req.InstanceID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to update instance: %v", err)
+	}
+
+	message := "updated instance metadata"
+	if req.Mask != nil {
+		message = "updated " + strings.Join(req.Mask, ", ")
+	}
+	s.recordEvent(ctx, events.TypeNormal, instance.ID, instance.NodeID, "Updated", message)
+	return instance, nil
+}
+
+// applyInstanceUpdate copies the fields named by the request's mask.
+func applyInstanceUpdate(instance *registry.Instance, req *UpdateInstanceRequest) {
+	mask := req.Mask
+	if mask.has("description") {
+		instance.Description = req.Description
+	}
+	if mask.has("metadata.labels") {
+		instance.Labels = req.Labels
+	}
+	if mask.has("metadata.annotations") {
+		instance.Annotations = req.Annotations
+	}
+	if mask.has("high_availability") {
+		instance.HighAvailability = req.HighAvailability
+	}
+
+	limits := &instance.Spec.Limits
+	if mask.has("spec.limits.cpu_quota") {
+		limits.CPUQuota = req.Limits.CPUQuota
+	}
+	if mask.has("spec.limits.cpu_period") {
+		limits.CPUPeriod = req.Limits.CPUPeriod
+	}
+	if mask.has("spec.limits.memory_limit") {
+		limits.MemoryLimit = req.Limits.MemoryLimit
+	}
+	if mask.has("spec.limits.io_read_bps") {
+		limits.IOReadBPS = req.Limits.IOReadBPS
+	}
+	if mask.has("spec.limits.io_write_bps") {
+		limits.IOWriteBPS = req.Limits.IOWriteBPS
+	}
+}
+
 // DeleteInstanceRequest represents a delete instance request.
 type DeleteInstanceRequest struct {
-	InstanceID string
-	Force      bool
+	InstanceID     string
+	Force          bool
+	IdempotencyKey string
 }
 
-// DeleteInstance deletes an instance.
+// DeleteInstance deletes an instance. A retry with the idempotency key of a
+// delete that went through succeeds instead of reporting the instance
+// missing.
 func (s *ComputeService) DeleteInstance(ctx context.Context, req *DeleteInstanceRequest) error {
+	_, err := s.runIdempotent(ctx, req.IdempotencyKey, idempotentDelete, req, func(ctx context.Context, _ *idempotency.Record) (*registry.Instance, error) {
+		return nil, s.deleteInstance(ctx, req)
+	})
+	return err
+}
+
+func (s *ComputeService) deleteInstance(ctx context.Context, req *DeleteInstanceRequest) error {
 	// Get instance from registry
 	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
 	if err != nil {
@@ -227,6 +947,15 @@ func (s *ComputeService) DeleteInstance(ctx context.Context, req *DeleteInstance
 		return status.Errorf(codes.Internal, "failed to get instance: %v", err)
 	}
 
+	// Stop managing the instance first so the reconciler does not recreate
+	// it between the agent delete and the registry delete
+	if _, err := s.instanceRegistry.Modify(ctx, req.InstanceID, func(instance *registry.Instance) error {
+		instance.DesiredState = ""
+		return nil
+	}); err != nil && err != registry.ErrInstanceNotFound {
+		return status.Errorf(codes.Internal, "failed to update instance: %v", err)
+	}
+
 	// Get agent client
 	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
 	if err != nil {
@@ -255,6 +984,7 @@ func (s *ComputeService) DeleteInstance(ctx context.Context, req *DeleteInstance
 	}
 
 	s.logger.Info("instance deleted", zap.String("instance_id", req.InstanceID))
+	s.recordEvent(ctx, events.TypeNormal, req.InstanceID, instance.NodeID, "Deleted", "")
 	return nil
 }
 
@@ -276,12 +1006,26 @@ func (s *ComputeService) GetInstance(ctx context.Context, req *GetInstanceReques
 	return instance, nil
 }
 
+// GetInstanceHistory returns an instance's recent state transitions,
+// oldest first.
+func (s *ComputeService) GetInstanceHistory(ctx context.Context, instanceID string) ([]registry.StateTransition, error) {
+	if _, err := s.GetInstance(ctx, &GetInstanceRequest{InstanceID: instanceID}); err != nil {
+		return nil, err
+	}
+
+	history, err := s.instanceRegistry.History(ctx, instanceID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get instance history: %v", err)
+	}
+	return history, nil
+}
+
 // ListInstancesRequest represents a list instances request.
 type ListInstancesRequest struct {
 	Type          driver.InstanceType
 	State         driver.InstanceState
 	NodeID        string
-	LabelSelector map[string]string
+	LabelSelector registry.Selector
 	PageSize      int
 	PageToken     string
 }
@@ -298,9 +1042,11 @@ func (s *ComputeService) ListInstances(ctx context.Context, req *ListInstancesRe
 	var instances []*registry.Instance
 	var err error
 
-	// Get instances based on filters
+	// Get instances from the narrowest index, then apply the other filters
 	if req.NodeID != "" {
 		instances, err = s.instanceRegistry.ListByNode(ctx, req.NodeID)
+	} else if len(req.LabelSelector) > 0 {
+		instances, err = s.instanceRegistry.ListBySelector(ctx, req.LabelSelector)
 	} else if req.Type != "" {
 		instances, err = s.instanceRegistry.ListByType(ctx, req.Type)
 	} else if req.State != "" {
@@ -313,21 +1059,15 @@ func (s *ComputeService) ListInstances(ctx context.Context, req *ListInstancesRe
 		return nil, status.Errorf(codes.Internal, "failed to list instances: %v", err)
 	}
 
-	// Apply additional filters
 	filtered := make([]*registry.Instance, 0, len(instances))
 	for _, instance := range instances {
-		// Type filter (if not already filtered)
-		if req.Type != "" && req.NodeID != "" && instance.Type != req.Type {
+		if req.Type != "" && instance.Type != req.Type {
 			continue
 		}
-
-		// State filter (if not already filtered)
-		if req.State != "" && req.NodeID != "" && instance.State != req.State {
+		if req.State != "" && instance.State != req.State {
 			continue
 		}
-
-		// Label selector
-		if len(req.LabelSelector) > 0 && !instance.MatchesLabels(req.LabelSelector) {
+		if !req.LabelSelector.Matches(instance.Labels) {
 			continue
 		}
 
@@ -343,11 +1083,19 @@ func (s *ComputeService) ListInstances(ctx context.Context, req *ListInstancesRe
 
 // StartInstanceRequest represents a start instance request.
 type StartInstanceRequest struct {
-	InstanceID string
+	InstanceID     string
+	IdempotencyKey string
 }
 
-// StartInstance starts an instance.
+// StartInstance starts an instance. A retry with the idempotency key of a
+// start that went through returns the instance as that start left it.
 func (s *ComputeService) StartInstance(ctx context.Context, req *StartInstanceRequest) (*registry.Instance, error) {
+	return s.runIdempotent(ctx, req.IdempotencyKey, idempotentStart, req, func(ctx context.Context, _ *idempotency.Record) (*registry.Instance, error) {
+		return s.startInstance(ctx, req)
+	})
+}
+
+func (s *ComputeService) startInstance(ctx context.Context, req *StartInstanceRequest) (*registry.Instance, error) {
 	// Get instance from registry
 	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
 	if err != nil {
@@ -357,10 +1105,16 @@ func (s *ComputeService) StartInstance(ctx context.Context, req *StartInstanceRe
 		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
 	}
 
+	// Record the intent first so the reconciler finishes the job if the
+	// agent call fails
+	if err := s.setDesiredState(ctx, instance, driver.StateRunning); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update instance: %v", err)
+	}
+
 	// Get agent client
 	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
 	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "failed to connect to agent: %v", err)
+		return nil, agentUnavailable(err)
 	}
 
 	// Call agent to start instance
@@ -368,22 +1122,15 @@ func (s *ComputeService) StartInstance(ctx context.Context, req *StartInstanceRe
 		InstanceId: req.InstanceID,
 	})
 	if err != nil {
+		s.recordEvent(ctx, events.TypeWarning, req.InstanceID, instance.NodeID, "FailedStart", err.Error())
 		return nil, status.Errorf(codes.Internal, "agent failed to start instance: %v", err)
 	}
 
 	// Update registry
-	instance.State = protoStateToDriverState(agentResp.State)
-	instance.StateReason = agentResp.StateReason
-	if agentResp.StartedAt != nil {
-		t := agentResp.StartedAt.AsTime()
-		instance.StartedAt = &t
-	}
-
-	if err := s.instanceRegistry.Update(ctx, instance); err != nil {
-		s.logger.Warn("failed to update instance in registry", zap.Error(err))
-	}
+	instance = s.recordAgentState(ctx, instance, agentResp)
 
 	s.logger.Info("instance started", zap.String("instance_id", req.InstanceID))
+	s.recordEvent(ctx, events.TypeNormal, req.InstanceID, instance.NodeID, "Started", "")
 	return instance, nil
 }
 
@@ -392,10 +1139,18 @@ type StopInstanceRequest struct {
 	InstanceID     string
 	Force          bool
 	TimeoutSeconds int
+	IdempotencyKey string
 }
 
-// StopInstance stops an instance.
+// StopInstance stops an instance. A retry with the idempotency key of a
+// stop that went through returns the instance as that stop left it.
 func (s *ComputeService) StopInstance(ctx context.Context, req *StopInstanceRequest) (*registry.Instance, error) {
+	return s.runIdempotent(ctx, req.IdempotencyKey, idempotentStop, req, func(ctx context.Context, _ *idempotency.Record) (*registry.Instance, error) {
+		return s.stopInstance(ctx, req)
+	})
+}
+
+func (s *ComputeService) stopInstance(ctx context.Context, req *StopInstanceRequest) (*registry.Instance, error) {
 	// Get instance from registry
 	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
 	if err != nil {
@@ -405,10 +1160,16 @@ func (s *ComputeService) StopInstance(ctx context.Context, req *StopInstanceRequ
 		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
 	}
 
+	// Record the intent first so the reconciler finishes the job if the
+	// agent call fails
+	if err := s.setDesiredState(ctx, instance, driver.StateStopped); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update instance: %v", err)
+	}
+
 	// Get agent client
 	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
 	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "failed to connect to agent: %v", err)
+		return nil, agentUnavailable(err)
 	}
 
 	// Call agent to stop instance
@@ -418,18 +1179,16 @@ func (s *ComputeService) StopInstance(ctx context.Context, req *StopInstanceRequ
 		TimeoutSeconds: int32(req.TimeoutSeconds),
 	})
 	if err != nil {
+		s.recordEvent(ctx, events.TypeWarning, req.InstanceID, instance.NodeID, "FailedStop", err.Error())
 		return nil, status.Errorf(codes.Internal, "agent failed to stop instance: %v", err)
 	}
 
 	// Update registry
-	instance.State = protoStateToDriverState(agentResp.State)
-	instance.StateReason = agentResp.StateReason
-
-	if err := s.instanceRegistry.Update(ctx, instance); err != nil {
-		s.logger.Warn("failed to update instance in registry", zap.Error(err))
-	}
+	instance = s.recordAgentState(ctx, instance, agentResp)
 
 	s.logger.Info("instance stopped", zap.String("instance_id", req.InstanceID))
+	s.recordEvent(ctx, events.TypeNormal, req.InstanceID, instance.NodeID, "Stopped",
+		fmt.Sprintf("force=%t", req.Force))
 	return instance, nil
 }
 
@@ -450,10 +1209,16 @@ func (s *ComputeService) RestartInstance(ctx context.Context, req *RestartInstan
 		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
 	}
 
+	// Record the intent first so the reconciler finishes the job if the
+	// agent call fails
+	if err := s.setDesiredState(ctx, instance, driver.StateRunning); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update instance: %v", err)
+	}
+
 	// Get agent client
 	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
 	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "failed to connect to agent: %v", err)
+		return nil, agentUnavailable(err)
 	}
 
 	// Call agent to restart instance
@@ -462,23 +1227,57 @@ func (s *ComputeService) RestartInstance(ctx context.Context, req *RestartInstan
 		Force:      req.Force,
 	})
 	if err != nil {
+		s.recordEvent(ctx, events.TypeWarning, req.InstanceID, instance.NodeID, "FailedRestart", err.Error())
 		return nil, status.Errorf(codes.Internal, "agent failed to restart instance: %v", err)
 	}
 
 	// Update registry
-	instance.State = protoStateToDriverState(agentResp.State)
-	instance.StateReason = agentResp.StateReason
-	if agentResp.StartedAt != nil {
-		t := agentResp.StartedAt.AsTime()
-		instance.StartedAt = &t
+	instance = s.recordAgentState(ctx, instance, agentResp)
+
+	s.logger.Info("instance restarted", zap.String("instance_id", req.InstanceID))
+	s.recordEvent(ctx, events.TypeNormal, req.InstanceID, instance.NodeID, "Restarted",
+		fmt.Sprintf("force=%t", req.Force))
+	return instance, nil
+}
+
+// setDesiredState persists the state the reconciler should keep the
+// instance in, and refreshes instance with the stored one.
+func (s *ComputeService) setDesiredState(ctx context.Context, instance *registry.Instance, desired driver.InstanceState) error {
+	if instance.DesiredState == desired {
+		return nil
 	}
+	updated, err := s.instanceRegistry.Modify(ctx, instance.ID, func(i *registry.Instance) error {
+		i.DesiredState = desired
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*instance = *updated
+	return nil
+}
 
-	if err := s.instanceRegistry.Update(ctx, instance); err != nil {
-		s.logger.Warn("failed to update instance in registry", zap.Error(err))
+// recordAgentState records the state an agent reported after acting on an
+// instance, returning the updated instance, or instance with the state
+// applied if it cannot be recorded.
+func (s *ComputeService) recordAgentState(ctx context.Context, instance *registry.Instance, resp *v1.Instance) *registry.Instance {
+	apply := func(i *registry.Instance) error {
+		i.State = protoStateToDriverState(resp.State)
+		i.StateReason = resp.StateReason
+		if resp.StartedAt != nil {
+			t := resp.StartedAt.AsTime()
+			i.StartedAt = &t
+		}
+		return nil
 	}
 
-	s.logger.Info("instance restarted", zap.String("instance_id", req.InstanceID))
-	return instance, nil
+	updated, err := s.instanceRegistry.Modify(ctx, instance.ID, apply)
+	if err != nil {
+		s.logger.Warn("failed to update instance in registry", zap.Error(err))
+		_ = apply(instance)
+		return instance
+	}
+	return updated
 }
 
 // GetInstanceStatsRequest represents a get instance stats request.
@@ -500,7 +1299,7 @@ func (s *ComputeService) GetInstanceStats(ctx context.Context, req *GetInstanceS
 	// Get agent client
 	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
 	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "failed to connect to agent: %v", err)
+		return nil, agentUnavailable(err)
 	}
 
 	// Call agent to get stats
@@ -511,18 +1310,280 @@ func (s *ComputeService) GetInstanceStats(ctx context.Context, req *GetInstanceS
 		return nil, status.Errorf(codes.Internal, "agent failed to get instance stats: %v", err)
 	}
 
-	return &driver.InstanceStats{
-		InstanceID:       agentResp.InstanceId,
-		CPUUsagePercent:  agentResp.CpuUsagePercent,
-		CPUTimeNs:        uint64(agentResp.CpuTimeNs),
-		MemoryUsedBytes:  uint64(agentResp.MemoryUsedBytes),
-		MemoryCacheBytes: uint64(agentResp.MemoryCacheBytes),
-		DiskReadBytes:    uint64(agentResp.DiskReadBytes),
-		DiskWriteBytes:   uint64(agentResp.DiskWriteBytes),
-		NetworkRxBytes:   uint64(agentResp.NetworkRxBytes),
-		NetworkTxBytes:   uint64(agentResp.NetworkTxBytes),
-		CollectedAt:      agentResp.CollectedAt.AsTime(),
-	}, nil
+	return protoStatsToDriverStats(agentResp), nil
+}
+
+const (
+	// maxBatchStatsInstances caps the instances one batch stats call may name.
+	maxBatchStatsInstances = 1000
+
+	// batchStatsNodeParallelism bounds the agents queried at once.
+	batchStatsNodeParallelism = 32
+
+	// batchStatsNodeTimeout bounds each agent's share of a batch, so one
+	// slow node only fails its own instances.
+	batchStatsNodeTimeout = 10 * time.Second
+)
+
+// BatchGetInstanceStatsRequest represents a batch get instance stats request.
+// When InstanceIDs is empty, all running instances matching NodeID and
+// LabelSelector are included.
+type BatchGetInstanceStatsRequest struct {
+	InstanceIDs   []string
+	NodeID        string
+	LabelSelector map[string]string
+}
+
+// InstanceStatsResult is the outcome for one instance of a batch stats call.
+type InstanceStatsResult struct {
+	InstanceID string
+	NodeID     string
+	Stats      *driver.InstanceStats
+	Err        error
+}
+
+// BatchGetInstanceStats retrieves stats for many instances, asking each
+// node's agent once for all of its instances and querying nodes in
+// parallel. Failures are reported per instance; the call itself only fails
+// if the instances cannot be resolved.
+func (s *ComputeService) BatchGetInstanceStats(ctx context.Context, req *BatchGetInstanceStatsRequest) ([]InstanceStatsResult, error) {
+	if len(req.InstanceIDs) > maxBatchStatsInstances {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d instances per batch, got %d",
+			maxBatchStatsInstances, len(req.InstanceIDs))
+	}
+
+	results, err := s.resolveBatchStatsInstances(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group by node, remembering each instance's position in the results
+	byNode := make(map[string][]int)
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		if results[i].NodeID == "" {
+			results[i].Err = fmt.Errorf("instance is not scheduled on a node")
+			continue
+		}
+		byNode[results[i].NodeID] = append(byNode[results[i].NodeID], i)
+	}
+
+	sem := make(chan struct{}, batchStatsNodeParallelism)
+	var wg sync.WaitGroup
+	for nodeID, indexes := range byNode {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			// Each goroutine writes only its own node's entries
+			s.batchStatsFromNode(ctx, nodeID, indexes, results)
+		}()
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// resolveBatchStatsInstances returns one result per selected instance, with
+// NodeID filled in, or Err set for instances that do not exist.
+func (s *ComputeService) resolveBatchStatsInstances(ctx context.Context, req *BatchGetInstanceStatsRequest) ([]InstanceStatsResult, error) {
+	var (
+		instances []*registry.Instance
+		err       error
+	)
+	if req.NodeID != "" {
+		instances, err = s.instanceRegistry.ListByNode(ctx, req.NodeID)
+	} else {
+		instances, err = s.instanceRegistry.List(ctx)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list instances: %v", err)
+	}
+
+	if len(req.InstanceIDs) == 0 {
+		var results []InstanceStatsResult
+		for _, instance := range instances {
+			if !instance.IsRunning() || !instance.MatchesLabels(req.LabelSelector) {
+				continue
+			}
+			results = append(results, InstanceStatsResult{InstanceID: instance.ID, NodeID: instance.NodeID})
+		}
+		return results, nil
+	}
+
+	byID := make(map[string]*registry.Instance, len(instances))
+	for _, instance := range instances {
+		byID[instance.ID] = instance
+	}
+
+	results := make([]InstanceStatsResult, 0, len(req.InstanceIDs))
+	seen := make(map[string]bool, len(req.InstanceIDs))
+	for _, id := range req.InstanceIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		result := InstanceStatsResult{InstanceID: id}
+		instance, ok := byID[id]
+		switch {
+		case !ok || !instance.MatchesLabels(req.LabelSelector):
+			result.Err = fmt.Errorf("instance not found: %s", id)
+		case !instance.IsRunning():
+			result.NodeID = instance.NodeID
+			result.Err = fmt.Errorf("instance is %s", instance.State)
+		default:
+			result.NodeID = instance.NodeID
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// batchStatsFromNode fetches stats for the results at indexes, which all
+// live on nodeID, with a single agent call.
+func (s *ComputeService) batchStatsFromNode(ctx context.Context, nodeID string, indexes []int, results []InstanceStatsResult) {
+	fail := func(err error) {
+		for _, i := range indexes {
+			results[i].Err = err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, batchStatsNodeTimeout)
+	defer cancel()
+
+	agentClient, err := s.agentClients.GetClient(ctx, nodeID)
+	if err != nil {
+		fail(fmt.Errorf("failed to connect to agent on %s: %w", nodeID, err))
+		return
+	}
+
+	ids := make([]string, len(indexes))
+	for n, i := range indexes {
+		ids[n] = results[i].InstanceID
+	}
+
+	resp, err := agentClient.BatchGetInstanceStats(ctx, &v1.AgentBatchGetInstanceStatsRequest{InstanceIds: ids})
+	if err != nil {
+		fail(fmt.Errorf("agent on %s failed to get instance stats: %w", nodeID, err))
+		return
+	}
+
+	byID := make(map[string]*v1.InstanceStatsResult, len(resp.Results))
+	for _, item := range resp.Results {
+		byID[item.InstanceId] = item
+	}
+	for _, i := range indexes {
+		item, ok := byID[results[i].InstanceID]
+		switch {
+		case !ok:
+			results[i].Err = fmt.Errorf("agent on %s returned no stats", nodeID)
+		case item.Error != "":
+			results[i].Err = errors.New(item.Error)
+		default:
+			results[i].Stats = protoStatsToDriverStats(item.Stats)
+		}
+	}
+}
+
+// StreamInstanceStatsRequest represents a stream instance stats request.
+type StreamInstanceStatsRequest struct {
+	InstanceID     string
+	IncludeHistory bool
+}
+
+// StreamInstanceStats opens a stats stream from the agent running the instance.
+func (s *ComputeService) StreamInstanceStats(ctx context.Context, req *StreamInstanceStatsRequest) (v1.AgentService_StreamInstanceStatsClient, error) {
+	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
+	if err != nil {
+		if err == registry.ErrInstanceNotFound {
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
+	}
+
+	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
+	if err != nil {
+		return nil, agentUnavailable(err)
+	}
+
+	stream, err := agentClient.StreamInstanceStats(ctx, &v1.StreamInstanceStatsRequest{
+		InstanceId:     req.InstanceID,
+		IncludeHistory: req.IncludeHistory,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "agent failed to stream instance stats: %v", err)
+	}
+
+	return stream, nil
+}
+
+// WatchInstancesRequest represents a watch instances request. Empty
+// fields match every instance.
+type WatchInstancesRequest struct {
+	InstanceID      string
+	NodeID          string
+	Type            driver.InstanceType
+	LabelSelector   map[string]string
+	IncludeExisting bool
+}
+
+// matches returns true if the instance passes the request's filters.
+func (r *WatchInstancesRequest) matches(instance *registry.Instance) bool {
+	if r.InstanceID != "" && instance.ID != r.InstanceID {
+		return false
+	}
+	if r.NodeID != "" && instance.NodeID != r.NodeID {
+		return false
+	}
+	if r.Type != "" && instance.Type != r.Type {
+		return false
+	}
+	if len(r.LabelSelector) > 0 && !instance.MatchesLabels(r.LabelSelector) {
+		return false
+	}
+	return true
+}
+
+// WatchInstances streams instance changes matching the request's filters
+// until ctx is cancelled.
+func (s *ComputeService) WatchInstances(ctx context.Context, req *WatchInstancesRequest, send func(*registry.InstanceEvent) error) error {
+	// Start watching before listing so no change falls in between
+	events, err := s.instanceRegistry.Watch(ctx)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to watch instances: %v", err)
+	}
+
+	if req.IncludeExisting {
+		instances, err := s.instanceRegistry.List(ctx)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to list instances: %v", err)
+		}
+		for _, instance := range instances {
+			if !req.matches(instance) {
+				continue
+			}
+			if err := send(&registry.InstanceEvent{Type: registry.EventAdded, Instance: instance}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for event := range events {
+		if !req.matches(event.Instance) {
+			continue
+		}
+
+		if err := send(&event); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // ============================================================================
@@ -552,6 +1613,10 @@ func protoStateToDriverState(s v1.InstanceState) driver.InstanceState {
 		return driver.StateRunning
 	case v1.InstanceState_INSTANCE_STATE_STOPPED:
 		return driver.StateStopped
+	case v1.InstanceState_INSTANCE_STATE_PAUSED:
+		return driver.StatePaused
+	case v1.InstanceState_INSTANCE_STATE_SUSPENDED:
+		return driver.StateSuspended
 	case v1.InstanceState_INSTANCE_STATE_FAILED:
 		return driver.StateFailed
 	default:
@@ -559,6 +1624,24 @@ func protoStateToDriverState(s v1.InstanceState) driver.InstanceState {
 	}
 }
 
+func protoStatsToDriverStats(stats *v1.InstanceStats) *driver.InstanceStats {
+	if stats == nil {
+		return nil
+	}
+	return &driver.InstanceStats{
+		InstanceID:       stats.InstanceId,
+		CPUUsagePercent:  stats.CpuUsagePercent,
+		CPUTimeNs:        uint64(stats.CpuTimeNs),
+		MemoryUsedBytes:  uint64(stats.MemoryUsedBytes),
+		MemoryCacheBytes: uint64(stats.MemoryCacheBytes),
+		DiskReadBytes:    uint64(stats.DiskReadBytes),
+		DiskWriteBytes:   uint64(stats.DiskWriteBytes),
+		NetworkRxBytes:   uint64(stats.NetworkRxBytes),
+		NetworkTxBytes:   uint64(stats.NetworkTxBytes),
+		CollectedAt:      stats.CollectedAt.AsTime(),
+	}
+}
+
 func driverSpecToProtoSpec(spec *driver.InstanceSpec) *v1.InstanceSpec {
 	if spec == nil {
 		return nil
@@ -581,10 +1664,11 @@ func driverSpecToProtoSpec(spec *driver.InstanceSpec) *v1.InstanceSpec {
 		protoSpec.Disks = make([]*v1.DiskSpec, len(spec.Disks))
 		for i, d := range spec.Disks {
 			protoSpec.Disks[i] = &v1.DiskSpec{
-				Name:      d.Name,
-				SizeBytes: d.SizeGB * 1024 * 1024 * 1024,
-				Type:      d.Type,
-				Boot:      d.Boot,
+				Name:       d.Name,
+				SizeBytes:  d.SizeGB * 1024 * 1024 * 1024,
+				Type:       d.Type,
+				Boot:       d.Boot,
+				SourcePath: d.SourcePath,
 			}
 		}
 	}
@@ -595,6 +1679,11 @@ func driverSpecToProtoSpec(spec *driver.InstanceSpec) *v1.InstanceSpec {
 		SubnetId:       spec.Network.SubnetID,
 		SecurityGroups: spec.Network.SecurityGroups,
 		AssignPublicIp: spec.Network.AssignPublicIP,
+		IpAddress:      spec.Network.IPAddress,
+		MacAddress:     spec.Network.MACAddress,
+		PortId:         spec.Network.PortID,
+		BindingType:    string(spec.Network.BindingType),
+		VfAddress:      spec.Network.VFAddress,
 	}
 
 	// Convert limits
@@ -608,5 +1697,40 @@ func driverSpecToProtoSpec(spec *driver.InstanceSpec) *v1.InstanceSpec {
 		}
 	}
 
+	// Convert CPU
+	if !spec.CPU.IsZero() {
+		protoSpec.Cpu = &v1.CPUSpec{
+			Mode:             string(spec.CPU.Mode),
+			Model:            spec.CPU.Model,
+			RequiredFeatures: spec.CPU.RequiredFeatures,
+			DisabledFeatures: spec.CPU.DisabledFeatures,
+		}
+	}
+	protoSpec.Hugepages = spec.HugePages
+	protoSpec.Architecture = spec.Architecture
+	protoSpec.Runtime = spec.Runtime
+	protoSpec.UserData = spec.UserData
+	protoSpec.SshKeys = spec.SSHKeys
+	if spec.GPU.Count > 0 {
+		protoSpec.Gpu = &v1.GPURequest{
+			Count:    int32(spec.GPU.Count),
+			Vendor:   spec.GPU.Vendor,
+			DeviceId: spec.GPU.DeviceID,
+		}
+	}
+	protoSpec.GpuDevices = spec.GPUDevices
+	protoSpec.CpuPlacement = apiconv.CPUPlacementToProto(spec.CPUPlacement)
+	protoSpec.PinnedCpus = apiconv.Int32s(spec.PinnedCPUs)
+	protoSpec.NumaNodes = apiconv.Int32s(spec.NUMANodes)
+	protoSpec.NodeSelector = spec.NodeSelector
+	for _, t := range spec.Tolerations {
+		protoSpec.Tolerations = append(protoSpec.Tolerations, &v1.Toleration{
+			Key:      t.Key,
+			Operator: t.Operator,
+			Value:    t.Value,
+			Effect:   t.Effect,
+		})
+	}
+
 	return protoSpec
 }
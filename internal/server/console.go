@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AttachConsoleRequest represents an attach console request.
+type AttachConsoleRequest struct {
+	InstanceID string
+	Width      int
+	Height     int
+}
+
+// OpenConsole opens the console of a running instance on its node. An
+// instance whose driver reported no console support is refused with
+// Unimplemented before the agent is contacted.
+func (s *ComputeService) OpenConsole(ctx context.Context, req *AttachConsoleRequest) (v1.AgentService_AttachConsoleClient, error) {
+	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
+	if err != nil {
+		if err == registry.ErrInstanceNotFound {
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
+	}
+
+	if err := requireCapability(s.instanceCapabilities(ctx, instance), "console", func(caps *registry.InstanceCapabilities) bool {
+		return caps.Console
+	}); err != nil {
+		return nil, err
+	}
+	if instance.NodeID == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "instance %s is not scheduled", req.InstanceID)
+	}
+	if instance.State != driver.StateRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "instance %s is %s, not running", req.InstanceID, instance.State)
+	}
+
+	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
+	if err != nil {
+		return nil, agentUnavailable(err)
+	}
+
+	console, err := agentClient.AttachConsole(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to open console stream: %v", err)
+	}
+
+	// The agent expects the instance ID as the first message
+	if err := console.Send(&v1.AgentConsoleInput{
+		Input: &v1.AgentConsoleInput_Data{Data: []byte(req.InstanceID)},
+	}); err != nil {
+		return nil, consoleErr(console, err)
+	}
+	if req.Width > 0 && req.Height > 0 {
+		if err := console.Send(&v1.AgentConsoleInput{
+			Input: &v1.AgentConsoleInput_Resize{Resize: &v1.AgentConsoleResize{
+				Width:  int32(req.Width),
+				Height: int32(req.Height),
+			}},
+		}); err != nil {
+			return nil, consoleErr(console, err)
+		}
+	}
+	return console, nil
+}
+
+// consoleErr returns the agent's status for a failed console send. A send
+// fails with io.EOF once the agent has ended the stream, and the reason is
+// only available from Recv.
+func consoleErr(console v1.AgentService_AttachConsoleClient, err error) error {
+	if errors.Is(err, io.EOF) {
+		if _, recvErr := console.Recv(); recvErr != nil && recvErr != io.EOF {
+			return recvErr
+		}
+	}
+	return status.Errorf(codes.Unavailable, "failed to send to console: %v", err)
+}
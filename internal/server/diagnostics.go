@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetBootDiagnosticsRequest represents a boot diagnostics request.
+type GetBootDiagnosticsRequest struct {
+	InstanceID string
+	Lines      int
+}
+
+// BootDiagnostics are the boot diagnostics of an instance and the node they
+// were collected on.
+type BootDiagnostics struct {
+	driver.BootDiagnostics
+	InstanceID string
+	NodeID     string
+}
+
+// GetBootDiagnostics collects a screenshot and the last serial console lines
+// of an instance from its node, for triaging instances that never become
+// reachable.
+func (s *ComputeService) GetBootDiagnostics(ctx context.Context, req *GetBootDiagnosticsRequest) (*BootDiagnostics, error) {
+	if req.Lines < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "lines cannot be negative")
+	}
+
+	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
+	if err != nil {
+		if err == registry.ErrInstanceNotFound {
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
+	}
+	if instance.NodeID == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "instance %s is not scheduled", req.InstanceID)
+	}
+	if err := requireCapability(s.instanceCapabilities(ctx, instance), "diagnostics", func(caps *registry.InstanceCapabilities) bool {
+		return caps.Diagnostics
+	}); err != nil {
+		return nil, err
+	}
+
+	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
+	if err != nil {
+		return nil, agentUnavailable(err)
+	}
+
+	resp, err := agentClient.GetBootDiagnostics(ctx, &v1.AgentGetBootDiagnosticsRequest{
+		InstanceId: req.InstanceID,
+		Lines:      int32(req.Lines),
+	})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.NotFound, codes.Unimplemented:
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "agent failed to collect boot diagnostics: %v", err)
+	}
+
+	diag := &BootDiagnostics{
+		BootDiagnostics: driver.BootDiagnostics{
+			Screenshot:       resp.Screenshot,
+			ScreenshotFormat: resp.ScreenshotFormat,
+			SerialOutput:     resp.SerialOutput,
+		},
+		InstanceID: req.InstanceID,
+		NodeID:     instance.NodeID,
+	}
+	if resp.CollectedAt != nil {
+		diag.CollectedAt = resp.CollectedAt.AsTime()
+	}
+	return diag, nil
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+)
+
+// FailoverConfig holds the node-failure controller configuration.
+type FailoverConfig struct {
+	// Enabled turns on automatic handling of failed nodes.
+	Enabled bool `mapstructure:"enabled"`
+
+	// GracePeriod is how long a node must stay down before its instances are failed over.
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+
+	// MaxReschedules caps how many times an HA instance is moved (0 = unlimited).
+	MaxReschedules int `mapstructure:"max_reschedules"`
+}
+
+// DefaultFailoverConfig returns the default failover configuration.
+func DefaultFailoverConfig() FailoverConfig {
+	return FailoverConfig{
+		Enabled:        true,
+		GracePeriod:    30 * time.Second,
+		MaxReschedules: 3,
+	}
+}
+
+// FailureController detects dead nodes and fails over their instances.
+// Nodes are considered dead when the heartbeat monitor marks them NotReady
+// or when their registry lease expires and the node key is deleted.
+type FailureController struct {
+	config           FailoverConfig
+	nodeRegistry     *registry.EtcdRegistry
+	instanceRegistry *registry.EtcdInstanceRegistry
+	compute          *ComputeService
+	logger           *zap.Logger
+
+	// Nodes with a pending or running failover
+	pending   map[string]struct{}
+	pendingMu sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewFailureController creates a new node-failure controller.
+func NewFailureController(
+	config FailoverConfig,
+	nodeReg *registry.EtcdRegistry,
+	instanceReg *registry.EtcdInstanceRegistry,
+	compute *ComputeService,
+	logger *zap.Logger,
+) *FailureController {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &FailureController{
+		config:           config,
+		nodeRegistry:     nodeReg,
+		instanceRegistry: instanceReg,
+		compute:          compute,
+		logger:           logger,
+		pending:          make(map[string]struct{}),
+	}
+}
+
+// Start starts watching the node registry for failures.
+func (c *FailureController) Start(ctx context.Context) error {
+	if !c.config.Enabled {
+		c.logger.Info("failure controller disabled")
+		return nil
+	}
+
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	events, err := c.nodeRegistry.Watch(c.ctx)
+	if err != nil {
+		c.cancel()
+		return fmt.Errorf("failed to watch nodes: %w", err)
+	}
+
+	c.wg.Add(1)
+	go c.watchNodes(events)
+
+	c.logger.Info("failure controller started",
+		zap.Duration("grace_period", c.config.GracePeriod),
+		zap.Int("max_reschedules", c.config.MaxReschedules),
+	)
+	return nil
+}
+
+// Stop stops the controller and waits for in-flight failovers.
+func (c *FailureController) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	c.wg.Wait()
+	c.logger.Info("failure controller stopped")
+}
+
+// NodeDown is the heartbeat monitor callback entry point.
+func (c *FailureController) NodeDown(nodeID string) {
+	if c.ctx == nil {
+		return
+	}
+	c.scheduleFailover(nodeID)
+}
+
+// watchNodes reacts to node status changes and lease expiry.
+func (c *FailureController) watchNodes(events <-chan registry.NodeEvent) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				c.logger.Warn("node watch channel closed, reconnecting...")
+				time.Sleep(time.Second)
+				var err error
+				events, err = c.nodeRegistry.Watch(c.ctx)
+				if err != nil {
+					c.logger.Error("failed to re-watch nodes", zap.Error(err))
+					return
+				}
+				continue
+			}
+
+			switch event.Type {
+			case registry.EventDeleted:
+				// Lease expired (or node deregistered without draining)
+				c.scheduleFailover(event.Node.ID)
+			case registry.EventModified:
+				if event.Node.Status == registry.NodeStatusNotReady {
+					c.scheduleFailover(event.Node.ID)
+				}
+			}
+		}
+	}
+}
+
+// scheduleFailover fails over a node after the grace period unless it recovers.
+func (c *FailureController) scheduleFailover(nodeID string) {
+	c.pendingMu.Lock()
+	if _, ok := c.pending[nodeID]; ok {
+		c.pendingMu.Unlock()
+		return
+	}
+	c.pending[nodeID] = struct{}{}
+	c.pendingMu.Unlock()
+
+	c.logger.Warn("node failure detected, waiting for grace period",
+		zap.String("node_id", nodeID),
+		zap.Duration("grace_period", c.config.GracePeriod),
+	)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() {
+			c.pendingMu.Lock()
+			delete(c.pending, nodeID)
+			c.pendingMu.Unlock()
+		}()
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.config.GracePeriod):
+		}
+
+		// The node may have come back during the grace period
+		if c.nodeRecovered(nodeID) {
+			c.logger.Info("node recovered within grace period", zap.String("node_id", nodeID))
+			return
+		}
+
+		shutdown, err := c.nodeRegistry.GetShutdown(c.ctx, nodeID)
+		if err != nil {
+			c.logger.Warn("failed to check for planned shutdown", zap.String("node_id", nodeID), zap.Error(err))
+		}
+		if shutdown != nil && shutdown.Policy == registry.ShutdownLeaveRunning {
+			// The instances are still running; give the agent the
+			// downtime it announced to come back and manage them
+			c.logger.Info("node agent shut down leaving instances running, holding off failover",
+				zap.String("node_id", nodeID),
+				zap.Time("until", shutdown.Until),
+			)
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(time.Until(shutdown.Until)):
+			}
+			if c.nodeRecovered(nodeID) {
+				c.logger.Info("node agent returned after planned shutdown", zap.String("node_id", nodeID))
+				return
+			}
+			shutdown = nil
+		}
+
+		c.failoverNode(nodeID, shutdown)
+	}()
+}
+
+// nodeRecovered returns true if the node is registered and ready.
+func (c *FailureController) nodeRecovered(nodeID string) bool {
+	node, err := c.nodeRegistry.Get(c.ctx, nodeID)
+	return err == nil && node.IsReady()
+}
+
+// failoverNode marks the node's instances failed and reschedules HA
+// instances. After a planned shutdown that stopped or moved the instances,
+// those left behind are marked stopped instead.
+func (c *FailureController) failoverNode(nodeID string, shutdown *registry.Shutdown) {
+	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Minute)
+	defer cancel()
+
+	instances, err := c.instanceRegistry.ListByNode(ctx, nodeID)
+	if err != nil {
+		c.logger.Error("failed to list instances on failed node",
+			zap.String("node_id", nodeID),
+			zap.Error(err),
+		)
+		return
+	}
+
+	var failed, rescheduled int
+	for _, instance := range instances {
+		// Only instances that were supposed to be running are affected
+		if instance.State == driver.StateStopped || instance.State == driver.StateSuspended || instance.State == driver.StateFailed {
+			continue
+		}
+
+		state, reason := driver.StateFailed, fmt.Sprintf("node %s failed", nodeID)
+		if shutdown != nil {
+			state, reason = driver.StateStopped, fmt.Sprintf("node %s agent shut down (%s)", nodeID, shutdown.Policy)
+		}
+		if err := c.instanceRegistry.UpdateState(ctx, instance.ID, state, reason); err != nil {
+			c.logger.Error("failed to update instance state",
+				zap.String("instance_id", instance.ID),
+				zap.Error(err),
+			)
+			continue
+		}
+		instance.State = state
+		instance.StateReason = reason
+		failed++
+
+		if !instance.HighAvailability {
+			continue
+		}
+		if c.config.MaxReschedules > 0 && instance.RescheduleCount >= c.config.MaxReschedules {
+			c.logger.Warn("instance reached reschedule limit",
+				zap.String("instance_id", instance.ID),
+				zap.Int("reschedule_count", instance.RescheduleCount),
+			)
+			continue
+		}
+
+		// The failed node may still be running the old copy if it is only
+		// partitioned; its agent reconciles against the registry on rejoin.
+		if _, err := c.compute.RescheduleInstance(ctx, instance); err != nil {
+			c.logger.Error("failed to reschedule instance",
+				zap.String("instance_id", instance.ID),
+				zap.String("node_id", nodeID),
+				zap.Error(err),
+			)
+			continue
+		}
+		rescheduled++
+	}
+
+	c.logger.Info("node failover complete",
+		zap.String("node_id", nodeID),
+		zap.Int("instances", len(instances)),
+		zap.Int("failed", failed),
+		zap.Int("rescheduled", rescheduled),
+	)
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GroupControllerConfig holds the instance group controller configuration.
+type GroupControllerConfig struct {
+	// Enabled turns on keeping instance groups at their replica count.
+	Enabled bool `mapstructure:"enabled"`
+
+	// Interval is how often every group is checked. Changes made through
+	// the API are acted on immediately.
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// DefaultGroupControllerConfig returns the default group controller
+// configuration.
+func DefaultGroupControllerConfig() GroupControllerConfig {
+	return GroupControllerConfig{
+		Enabled:  true,
+		Interval: 15 * time.Second,
+	}
+}
+
+// groupOperationTimeout bounds creating, starting or deleting one instance
+// of a group.
+const groupOperationTimeout = 5 * time.Minute
+
+// GroupController keeps every instance group at its replica count. It
+// replaces failed instances, starts stopped ones, creates instances from
+// the group's template when there are too few and deletes the surplus when
+// there are too many, preferring instances that are not running and then
+// the newest.
+//
+// Instances on nodes that went down are left to the failure controller
+// until it marks them failed.
+type GroupController struct {
+	config           GroupControllerConfig
+	instanceRegistry *registry.EtcdInstanceRegistry
+	compute          *ComputeService
+	logger           *zap.Logger
+
+	trigger chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewGroupController creates a new instance group controller.
+func NewGroupController(
+	config GroupControllerConfig,
+	instanceReg *registry.EtcdInstanceRegistry,
+	compute *ComputeService,
+	logger *zap.Logger,
+) *GroupController {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &GroupController{
+		config:           config,
+		instanceRegistry: instanceReg,
+		compute:          compute,
+		logger:           logger,
+		trigger:          make(chan struct{}, 1),
+	}
+}
+
+// Start starts the periodic group reconciliation loop.
+func (c *GroupController) Start(ctx context.Context) error {
+	if !c.config.Enabled {
+		c.logger.Info("group controller disabled")
+		return nil
+	}
+	if c.config.Interval <= 0 {
+		return fmt.Errorf("invalid group controller interval: %s", c.config.Interval)
+	}
+
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	c.wg.Add(1)
+	go c.run()
+
+	c.logger.Info("group controller started", zap.Duration("interval", c.config.Interval))
+	return nil
+}
+
+// Stop stops the group controller and waits for the current pass to finish.
+func (c *GroupController) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	c.wg.Wait()
+	c.logger.Info("group controller stopped")
+}
+
+// Trigger requests a pass over all groups without waiting for the next
+// interval. It does not block; on a server that is not leading, the request
+// is picked up if it starts leading.
+func (c *GroupController) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (c *GroupController) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	c.reconcileAll()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.reconcileAll()
+		case <-c.trigger:
+			c.reconcileAll()
+		}
+	}
+}
+
+// reconcileAll makes one pass over every instance group.
+func (c *GroupController) reconcileAll() {
+	groups, err := c.instanceRegistry.ListGroups(c.ctx)
+	if err != nil {
+		c.logger.Error("failed to list instance groups", zap.Error(err))
+		return
+	}
+	if len(groups) == 0 {
+		return
+	}
+
+	instances, err := c.instanceRegistry.List(c.ctx)
+	if err != nil {
+		c.logger.Error("failed to list instances", zap.Error(err))
+		return
+	}
+	members := make(map[string][]*registry.Instance)
+	for _, instance := range instances {
+		if name, ok := instance.Labels[registry.GroupLabel]; ok {
+			members[name] = append(members[name], instance)
+		}
+	}
+
+	for _, group := range groups {
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.reconcileGroup(group, members[group.Name])
+	}
+}
+
+// reconcileGroup brings one group to its replica count.
+func (c *GroupController) reconcileGroup(group *registry.InstanceGroup, members []*registry.Instance) {
+	logger := c.logger.With(zap.String("group", group.Name))
+
+	live := make([]*registry.Instance, 0, len(members))
+	for _, instance := range members {
+		if !instance.IsFailed() {
+			live = append(live, instance)
+			continue
+		}
+		if err := c.deleteInstance(instance); err != nil {
+			logger.Warn("failed to delete failed group instance", zap.String("instance_id", instance.ID), zap.Error(err))
+			continue
+		}
+		logger.Info("deleted failed group instance", zap.String("instance_id", instance.ID))
+		c.compute.recordGroupEvent(c.ctx, events.TypeWarning, group.Name, "ReplacingFailedInstance",
+			fmt.Sprintf("deleted failed instance %s (%s): %s", instance.Name, instance.ID, instance.StateReason))
+	}
+
+	switch {
+	case len(live) > group.Replicas:
+		c.scaleDown(group, live, len(live)-group.Replicas)
+		live = live[:group.Replicas]
+	case len(live) < group.Replicas:
+		c.scaleUp(group, group.Replicas-len(live))
+	}
+
+	for _, instance := range live {
+		if instance.DesiredState == driver.StateRunning || c.ctx.Err() != nil {
+			continue
+		}
+		if err := c.startInstance(instance); err != nil {
+			logger.Warn("failed to start group instance", zap.String("instance_id", instance.ID), zap.Error(err))
+		}
+	}
+}
+
+// scaleUp creates and starts count instances from the group's template.
+// It stops as soon as the group is changed or deleted, removing an instance
+// created from the stale template, and leaves the rest to the next pass.
+func (c *GroupController) scaleUp(group *registry.InstanceGroup, count int) {
+	rev, ok := c.groupRevision(group)
+	if !ok {
+		return
+	}
+
+	created := 0
+	var lastErr error
+	for range count {
+		if c.ctx.Err() != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.ctx, groupOperationTimeout)
+		instance, err := c.compute.CreateInstance(ctx, groupInstanceRequest(group))
+		cancel()
+		if err != nil {
+			// The rest would most likely fail the same way
+			lastErr = err
+			break
+		}
+
+		if !c.groupUnchanged(group.Name, rev) {
+			if err := c.deleteInstance(instance); err != nil {
+				c.logger.Warn("failed to delete instance of a changed group",
+					zap.String("group", group.Name),
+					zap.String("instance_id", instance.ID),
+					zap.Error(err),
+				)
+			}
+			break
+		}
+		created++
+		c.logger.Info("created group instance",
+			zap.String("group", group.Name),
+			zap.String("instance_id", instance.ID),
+			zap.String("node_id", instance.NodeID),
+		)
+		if err := c.startInstance(instance); err != nil {
+			c.logger.Warn("failed to start group instance",
+				zap.String("group", group.Name),
+				zap.String("instance_id", instance.ID),
+				zap.Error(err),
+			)
+		}
+	}
+
+	if created > 0 {
+		c.compute.recordGroupEvent(c.ctx, events.TypeNormal, group.Name, "ScaledUp",
+			fmt.Sprintf("created %d instances", created))
+	}
+	if lastErr != nil {
+		c.logger.Warn("failed to create group instance", zap.String("group", group.Name), zap.Error(lastErr))
+		c.compute.recordGroupEvent(c.ctx, events.TypeWarning, group.Name, "FailedCreate",
+			fmt.Sprintf("created %d of %d missing instances: %s", created, count, status.Convert(lastErr).Message()))
+	}
+}
+
+// scaleDown deletes count of the group's instances, those not running
+// first, then the newest. live is reordered so that the kept instances come
+// first.
+func (c *GroupController) scaleDown(group *registry.InstanceGroup, live []*registry.Instance, count int) {
+	sort.SliceStable(live, func(i, j int) bool {
+		if live[i].IsRunning() != live[j].IsRunning() {
+			return live[i].IsRunning()
+		}
+		return live[i].CreatedAt.Before(live[j].CreatedAt)
+	})
+
+	deleted := 0
+	for _, instance := range live[len(live)-count:] {
+		if c.ctx.Err() != nil {
+			break
+		}
+		if err := c.deleteInstance(instance); err != nil {
+			c.logger.Warn("failed to delete surplus group instance",
+				zap.String("group", group.Name),
+				zap.String("instance_id", instance.ID),
+				zap.Error(err),
+			)
+			continue
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		c.logger.Info("scaled down instance group", zap.String("group", group.Name), zap.Int("deleted", deleted))
+		c.compute.recordGroupEvent(c.ctx, events.TypeNormal, group.Name, "ScaledDown",
+			fmt.Sprintf("deleted %d instances", deleted))
+	}
+}
+
+// groupRevision re-reads group and returns its revision, or false if it
+// was changed or deleted since it was listed.
+func (c *GroupController) groupRevision(group *registry.InstanceGroup) (int64, bool) {
+	current, rev, err := c.instanceRegistry.GetGroupRevision(c.ctx, group.Name)
+	if err != nil {
+		if !errors.Is(err, registry.ErrGroupNotFound) {
+			c.logger.Warn("failed to get instance group", zap.String("group", group.Name), zap.Error(err))
+		}
+		return 0, false
+	}
+	return rev, current.UpdatedAt.Equal(group.UpdatedAt)
+}
+
+// groupUnchanged reports whether the group named name is still at rev. A
+// failed read counts as changed.
+func (c *GroupController) groupUnchanged(name string, rev int64) bool {
+	_, current, err := c.instanceRegistry.GetGroupRevision(c.ctx, name)
+	if err != nil {
+		if !errors.Is(err, registry.ErrGroupNotFound) {
+			c.logger.Warn("failed to get instance group", zap.String("group", name), zap.Error(err))
+		}
+		return false
+	}
+	return current == rev
+}
+
+func (c *GroupController) startInstance(instance *registry.Instance) error {
+	ctx, cancel := context.WithTimeout(c.ctx, groupOperationTimeout)
+	defer cancel()
+	_, err := c.compute.StartInstance(ctx, &StartInstanceRequest{InstanceID: instance.ID})
+	return err
+}
+
+func (c *GroupController) deleteInstance(instance *registry.Instance) error {
+	ctx, cancel := context.WithTimeout(c.ctx, groupOperationTimeout)
+	defer cancel()
+	err := c.compute.DeleteInstance(ctx, &DeleteInstanceRequest{InstanceID: instance.ID, Force: true})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	return err
+}
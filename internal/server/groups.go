@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/registry"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// groupNamePattern limits group names to DNS labels, as they become part of
+// etcd keys, instance labels and instance names.
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// maxGroupReplicas bounds the size of one instance group.
+const maxGroupReplicas = 1000
+
+// SetGroupController sets the controller that keeps instance groups at
+// their replica count, so that changes to a group take effect without
+// waiting for its next pass.
+func (s *ComputeService) SetGroupController(controller *GroupController) {
+	s.groupController = controller
+}
+
+// InstanceGroupStatus is an instance group with its current instances.
+type InstanceGroupStatus struct {
+	Group     *registry.InstanceGroup
+	Instances []*registry.Instance
+}
+
+// CreateInstanceGroupRequest represents a create instance group request.
+type CreateInstanceGroupRequest struct {
+	Name     string
+	Replicas int
+	Template registry.InstanceTemplate
+}
+
+// UpdateInstanceGroupRequest represents an update instance group request.
+// Nil fields are left as stored.
+type UpdateInstanceGroupRequest struct {
+	Name     string
+	Replicas *int
+	Template *registry.InstanceTemplate
+}
+
+// CreateInstanceGroup creates an instance group. Its instances are created
+// by the group controller.
+func (s *ComputeService) CreateInstanceGroup(ctx context.Context, req *CreateInstanceGroupRequest) (*InstanceGroupStatus, error) {
+	if !groupNamePattern.MatchString(req.Name) {
+		return nil, apierror.InvalidField("name",
+			fmt.Sprintf("invalid group name %q, must be a lowercase DNS label", req.Name))
+	}
+	group := &registry.InstanceGroup{
+		Name:     req.Name,
+		Replicas: req.Replicas,
+		Template: req.Template,
+	}
+	if err := validateGroup(group); err != nil {
+		return nil, err
+	}
+
+	if err := s.instanceRegistry.CreateGroup(ctx, group); err != nil {
+		if errors.Is(err, registry.ErrGroupExists) {
+			return nil, status.Errorf(codes.AlreadyExists, "instance group already exists: %s", req.Name)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to create instance group: %v", err)
+	}
+
+	s.logger.Info("instance group created",
+		zap.String("group", group.Name),
+		zap.Int("replicas", group.Replicas),
+	)
+	s.recordGroupEvent(ctx, events.TypeNormal, group.Name, "Created",
+		fmt.Sprintf("created with %d replicas", group.Replicas))
+	s.triggerGroups()
+	return &InstanceGroupStatus{Group: group}, nil
+}
+
+// GetInstanceGroup returns an instance group and its instances.
+func (s *ComputeService) GetInstanceGroup(ctx context.Context, name string) (*InstanceGroupStatus, error) {
+	group, err := s.getGroup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	members, err := s.instanceRegistry.ListGroupInstances(ctx, name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list group instances: %v", err)
+	}
+	return &InstanceGroupStatus{Group: group, Instances: members}, nil
+}
+
+// ListInstanceGroups returns all instance groups with their instances,
+// oldest first.
+func (s *ComputeService) ListInstanceGroups(ctx context.Context) ([]*InstanceGroupStatus, error) {
+	groups, err := s.instanceRegistry.ListGroups(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list instance groups: %v", err)
+	}
+	instances, err := s.instanceRegistry.List(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list instances: %v", err)
+	}
+
+	members := make(map[string][]*registry.Instance)
+	for _, instance := range instances {
+		if name, ok := instance.Labels[registry.GroupLabel]; ok {
+			members[name] = append(members[name], instance)
+		}
+	}
+	result := make([]*InstanceGroupStatus, 0, len(groups))
+	for _, group := range groups {
+		instances := members[group.Name]
+		slices.SortFunc(instances, func(a, b *registry.Instance) int { return a.CreatedAt.Compare(b.CreatedAt) })
+		result = append(result, &InstanceGroupStatus{Group: group, Instances: instances})
+	}
+	return result, nil
+}
+
+// UpdateInstanceGroup scales an instance group or replaces its template. A
+// new template applies to instances created afterwards; existing instances
+// are kept.
+func (s *ComputeService) UpdateInstanceGroup(ctx context.Context, req *UpdateInstanceGroupRequest) (*InstanceGroupStatus, error) {
+	var previous int
+	group, err := s.instanceRegistry.ModifyGroup(ctx, req.Name, func(group *registry.InstanceGroup) error {
+		previous = group.Replicas
+		if req.Replicas != nil {
+			group.Replicas = *req.Replicas
+		}
+		if req.Template != nil {
+			group.Template = *req.Template
+		}
+		return validateGroup(group)
+	})
+	if err != nil {
+		if errors.Is(err, registry.ErrGroupNotFound) {
+			return nil, status.Errorf(codes.NotFound, "instance group not found: %s", req.Name)
+		}
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "failed to update instance group: %v", err)
+	}
+
+	if group.Replicas != previous {
+		s.logger.Info("instance group scaled",
+			zap.String("group", group.Name),
+			zap.Int("from", previous),
+			zap.Int("to", group.Replicas),
+		)
+		s.recordGroupEvent(ctx, events.TypeNormal, group.Name, "Scaled",
+			fmt.Sprintf("scaled from %d to %d replicas", previous, group.Replicas))
+	}
+	if req.Template != nil {
+		s.recordGroupEvent(ctx, events.TypeNormal, group.Name, "TemplateUpdated",
+			"new instances are created from the updated template")
+	}
+	s.triggerGroups()
+	return s.GetInstanceGroup(ctx, group.Name)
+}
+
+// DeleteInstanceGroup deletes an instance group and its instances. The group
+// is scaled to zero first, so that if deleting an instance fails, the
+// controller does not replace the instances already deleted and the delete
+// can be retried.
+func (s *ComputeService) DeleteInstanceGroup(ctx context.Context, name string) error {
+	_, err := s.instanceRegistry.ModifyGroup(ctx, name, func(group *registry.InstanceGroup) error {
+		group.Replicas = 0
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, registry.ErrGroupNotFound) {
+			return status.Errorf(codes.NotFound, "instance group not found: %s", name)
+		}
+		return status.Errorf(codes.Internal, "failed to scale down instance group: %v", err)
+	}
+
+	members, err := s.instanceRegistry.ListGroupInstances(ctx, name)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list group instances: %v", err)
+	}
+	for _, instance := range members {
+		err := s.DeleteInstance(ctx, &DeleteInstanceRequest{InstanceID: instance.ID, Force: true})
+		if err != nil && status.Code(err) != codes.NotFound {
+			return status.Errorf(status.Code(err), "failed to delete group instance %s: %v", instance.ID, status.Convert(err).Message())
+		}
+	}
+
+	if err := s.instanceRegistry.DeleteGroup(ctx, name); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete instance group: %v", err)
+	}
+
+	s.logger.Info("instance group deleted",
+		zap.String("group", name),
+		zap.Int("instances", len(members)),
+	)
+	s.recordGroupEvent(ctx, events.TypeNormal, name, "Deleted",
+		fmt.Sprintf("deleted with %d instances", len(members)))
+	return nil
+}
+
+func (s *ComputeService) getGroup(ctx context.Context, name string) (*registry.InstanceGroup, error) {
+	group, err := s.instanceRegistry.GetGroup(ctx, name)
+	if err != nil {
+		if errors.Is(err, registry.ErrGroupNotFound) {
+			return nil, status.Errorf(codes.NotFound, "instance group not found: %s", name)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get instance group: %v", err)
+	}
+	return group, nil
+}
+
+func (s *ComputeService) triggerGroups() {
+	if s.groupController != nil {
+		s.groupController.Trigger()
+	}
+}
+
+func (s *ComputeService) recordGroupEvent(ctx context.Context, eventType, group, reason, message string) {
+	s.events.Record(ctx, events.Event{
+		Type:     eventType,
+		Kind:     events.KindInstanceGroup,
+		ObjectID: group,
+		Reason:   reason,
+		Message:  message,
+	})
+}
+
+// validateGroup checks the replica count and template of a group the same
+// way as a create of one of its instances, and stores the normalized
+// template.
+func validateGroup(group *registry.InstanceGroup) error {
+	if group.Replicas < 0 || group.Replicas > maxGroupReplicas {
+		return apierror.InvalidField("replicas",
+			fmt.Sprintf("replicas must be between 0 and %d, got %d", maxGroupReplicas, group.Replicas))
+	}
+	if err := rejectGroupLabel(group.Template.Labels, "template.labels"); err != nil {
+		return err
+	}
+	req := groupInstanceRequest(group)
+	if err := validateCreateRequest(req); err != nil {
+		return err
+	}
+	group.Template.Type = req.Type
+	group.Template.Spec = req.Spec
+	return nil
+}
+
+// rejectGroupLabel refuses labels that set GroupLabel, which only the
+// group controller sets on the instances it creates.
+func rejectGroupLabel(labels map[string]string, field string) error {
+	if _, ok := labels[registry.GroupLabel]; ok {
+		return apierror.InvalidField(field, fmt.Sprintf("label %s is reserved for instance groups", registry.GroupLabel))
+	}
+	return nil
+}
+
+// keepGroupLabel returns labels replacing those of an instance with
+// current labels, keeping its GroupLabel. Labels may repeat the instance's
+// group but not set or change it.
+func keepGroupLabel(current, labels map[string]string) (map[string]string, error) {
+	group, member := current[registry.GroupLabel]
+	if value, ok := labels[registry.GroupLabel]; ok && (!member || value != group) {
+		return nil, apierror.InvalidField("metadata.labels",
+			fmt.Sprintf("label %s is reserved for instance groups", registry.GroupLabel))
+	}
+	if !member {
+		return labels, nil
+	}
+	labels = maps.Clone(labels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[registry.GroupLabel] = group
+	return labels, nil
+}
+
+// groupInstanceRequest returns the request creating a new instance of a
+// group. Without spread constraints of their own, a group's instances are
+// spread across nodes.
+func groupInstanceRequest(group *registry.InstanceGroup) *CreateInstanceRequest {
+	t := group.Template
+
+	labels := maps.Clone(t.Labels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[registry.GroupLabel] = group.Name
+
+	spread := slices.Clone(t.SpreadConstraints)
+	if len(spread) == 0 {
+		spread = []registry.SpreadConstraint{{
+			TopologyKey: registry.SpreadTopologyNode,
+			MatchLabels: map[string]string{registry.GroupLabel: group.Name},
+		}}
+	}
+
+	return &CreateInstanceRequest{
+		Name:              group.Name + "-" + uuid.New().String()[:8],
+		Type:              t.Type,
+		Spec:              t.Spec,
+		Metadata:          labels,
+		Annotations:       maps.Clone(t.Annotations),
+		Region:            t.Region,
+		Zone:              t.Zone,
+		HighAvailability:  t.HighAvailability,
+		Description:       fmt.Sprintf("Instance of group %s", group.Name),
+		SpreadConstraints: spread,
+	}
+}
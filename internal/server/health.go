@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/health"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// agentHealthTimeout bounds how long GetClusterHealth waits for an agent.
+const agentHealthTimeout = 5 * time.Second
+
+// newHealthChecker creates the checker of what the server needs to serve:
+// etcd, which every service stores its state in, and the SDN controller.
+func (s *Server) newHealthChecker() *health.Checker {
+	checker := health.NewChecker(s.config.Health, s.logger.Named("health"))
+
+	services := []string{
+		v1.ClusterService_ServiceDesc.ServiceName,
+		v1.ComputeService_ServiceDesc.ServiceName,
+	}
+	if s.networkService != nil {
+		services = append(services, v1.NetworkService_ServiceDesc.ServiceName)
+	}
+	checker.AddCheck("etcd", s.etcdClient.Ping, services...)
+
+	if s.networkService != nil {
+		checker.AddCheck("sdn", s.networkService.Healthy, v1.NetworkService_ServiceDesc.ServiceName)
+	}
+	return checker
+}
+
+// ComponentHealth is the health of a server or a node's agent.
+type ComponentHealth struct {
+	// Component is "server" or "agent".
+	Component string
+
+	// Name is the server's address or the agent's node ID.
+	Name string
+
+	Healthy bool
+	Checks  []health.Result
+
+	// Error is why the component could not be asked.
+	Error string
+}
+
+// ClusterHealth is the health of the cluster's components.
+type ClusterHealth struct {
+	Healthy    bool
+	Components []ComponentHealth
+}
+
+// GetClusterHealth reports the last results of this server's health checks
+// and asks every node's agent for its own. An agent that cannot be reached
+// in time is reported unhealthy.
+func (s *ClusterService) GetClusterHealth(ctx context.Context) (*ClusterHealth, error) {
+	nodes, err := s.registry.List(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list nodes: %v", err)
+	}
+
+	components := make([]ComponentHealth, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			components[i] = s.agentHealth(ctx, node.ID)
+		}()
+	}
+	wg.Wait()
+	sort.Slice(components, func(i, j int) bool { return components[i].Name < components[j].Name })
+
+	if s.health != nil {
+		server := ComponentHealth{Component: "server", Name: s.healthName, Healthy: true}
+		server.Checks = s.health.Results()
+		for _, check := range server.Checks {
+			server.Healthy = server.Healthy && check.Healthy
+		}
+		components = append([]ComponentHealth{server}, components...)
+	}
+
+	result := &ClusterHealth{Healthy: true, Components: components}
+	for _, component := range components {
+		result.Healthy = result.Healthy && component.Healthy
+	}
+	return result, nil
+}
+
+func (s *ClusterService) agentHealth(ctx context.Context, nodeID string) ComponentHealth {
+	component := ComponentHealth{Component: "agent", Name: nodeID}
+
+	ctx, cancel := context.WithTimeout(ctx, agentHealthTimeout)
+	defer cancel()
+
+	agentClient, err := s.compute.agentClients.GetClient(ctx, nodeID)
+	if err != nil {
+		component.Error = status.Convert(agentUnavailable(err)).Message()
+		return component
+	}
+	resp, err := agentClient.GetHealth(ctx, &emptypb.Empty{})
+	if err != nil {
+		component.Error = status.Convert(err).Message()
+		return component
+	}
+
+	component.Healthy = resp.Healthy
+	for _, check := range resp.Checks {
+		result := health.Result{Name: check.Name, Healthy: check.Healthy, Message: check.Message}
+		if check.CheckedAt != nil {
+			result.CheckedAt = check.CheckedAt.AsTime()
+		}
+		component.Checks = append(component.Checks, result)
+	}
+	return component
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/idempotency"
+	"hypervisor/pkg/cluster/registry"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Operations recorded with idempotency keys. A key belongs to one operation.
+const (
+	idempotentCreate = "create"
+	idempotentStart  = "start"
+	idempotentStop   = "stop"
+	idempotentDelete = "delete"
+)
+
+// idempotencyWriteTimeout bounds recording the outcome of a request, which
+// happens even if the client has gone away.
+const idempotencyWriteTimeout = 5 * time.Second
+
+// SetIdempotencyStore sets the store of idempotency keys. Without one, keys
+// sent with requests are ignored.
+func (s *ComputeService) SetIdempotencyStore(store *idempotency.Store) {
+	s.idempotency = store
+}
+
+// runIdempotent runs an instance operation once per idempotency key of the
+// caller. A repeated key gets the instance the first successful run
+// returned; after a failed run, the retry runs the operation again with the
+// record of the failed attempt. A run is bounded by the attempt timeout, so
+// that no retry takes it over while it still runs. Without a key, the
+// operation just runs.
+func (s *ComputeService) runIdempotent(
+	ctx context.Context,
+	key, operation string,
+	request any,
+	run func(ctx context.Context, record *idempotency.Record) (*registry.Instance, error),
+) (*registry.Instance, error) {
+	if key == "" || s.idempotency == nil {
+		return run(ctx, nil)
+	}
+
+	fingerprint, err := idempotency.Fingerprint(request)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to hash request: %v", err)
+	}
+	record, err := s.idempotency.Begin(ctx, callerIdentity(ctx), key, operation, fingerprint)
+	if err != nil {
+		switch {
+		case errors.Is(err, idempotency.ErrInvalidKey):
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		case errors.Is(err, idempotency.ErrKeyReused):
+			return nil, status.Errorf(codes.InvalidArgument, "idempotency key %q was used for a different %s request", key, operation)
+		case errors.Is(err, idempotency.ErrInProgress):
+			return nil, status.Errorf(codes.Aborted, "a request with idempotency key %q is still in progress, retry later", key)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to check idempotency key: %v", err)
+	}
+
+	if record.State == idempotency.StateSucceeded {
+		s.logger.Info("returning result of earlier request with idempotency key",
+			zap.String("key", key),
+			zap.String("operation", operation),
+			zap.String("instance_id", record.InstanceID),
+		)
+		if len(record.Result) == 0 {
+			return nil, nil
+		}
+		var instance registry.Instance
+		if err := json.Unmarshal(record.Result, &instance); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read stored result: %v", err)
+		}
+		return &instance, nil
+	}
+
+	runCtx, cancelRun := context.WithTimeout(ctx, idempotency.AttemptTimeout)
+	instance, runErr := run(runCtx, record)
+	cancelRun()
+
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idempotencyWriteTimeout)
+	defer cancel()
+	if runErr != nil {
+		if err := s.idempotency.Fail(writeCtx, record, runErr); err != nil {
+			s.logger.Warn("failed to record failed request", zap.String("key", key), zap.Error(err))
+		}
+		return nil, runErr
+	}
+
+	var result any
+	if instance != nil {
+		record.InstanceID = instance.ID
+		result = instance
+	}
+	if err := s.idempotency.Complete(writeCtx, record, result); err != nil {
+		// The operation went through; a retry runs it again, which start,
+		// stop and delete tolerate and create resolves from the record
+		s.logger.Warn("failed to record result of request", zap.String("key", key), zap.Error(err))
+	}
+	return instance, nil
+}
+
+// resumeCreate resolves what an earlier failed attempt to create the
+// record's instance left behind. It returns the instance if the attempt got
+// as far as storing it. Otherwise it removes whatever the attempt created on
+// its node, so that the retry can create the instance afresh without a
+// duplicate, and returns nil.
+func (s *ComputeService) resumeCreate(ctx context.Context, record *idempotency.Record) (*registry.Instance, error) {
+	instance, err := s.instanceRegistry.Get(ctx, record.InstanceID)
+	if err == nil {
+		return instance, nil
+	}
+	if err != registry.ErrInstanceNotFound {
+		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
+	}
+	if record.NodeID == "" {
+		// The attempt failed before it got to a node
+		return nil, nil
+	}
+
+	agentClient, err := s.agentClients.GetClient(ctx, record.NodeID)
+	if err != nil {
+		// The node may hold the instance; creating it elsewhere could
+		// duplicate it
+		return nil, agentUnavailable(err)
+	}
+	_, err = agentClient.DeleteInstance(ctx, &v1.AgentDeleteInstanceRequest{
+		InstanceId: record.InstanceID,
+		Force:      true,
+	})
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, status.Errorf(codes.Internal, "failed to clean up earlier attempt on node %s: %v", record.NodeID, err)
+	}
+	if err == nil {
+		s.logger.Info("removed instance left behind by failed create",
+			zap.String("instance_id", record.InstanceID),
+			zap.String("node_id", record.NodeID),
+		)
+	}
+	return nil, nil
+}
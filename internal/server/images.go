@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// prefetchParallelism bounds the nodes pulling an image at the same time.
+const prefetchParallelism = 8
+
+// Prefetch result statuses.
+const (
+	PrefetchCached = "cached"
+	PrefetchPulled = "pulled"
+	PrefetchFailed = "failed"
+)
+
+// PrefetchImageRequest selects the nodes whose caches to warm with an image.
+type PrefetchImageRequest struct {
+	ImageRef      string
+	Type          driver.InstanceType
+	NodeIDs       []string          // Empty means every ready worker supporting Type
+	LabelSelector map[string]string // Only nodes with all of these labels
+}
+
+// PrefetchResult is the outcome of a prefetch on one node.
+type PrefetchResult struct {
+	NodeID    string
+	Status    string
+	Image     string
+	SizeBytes int64
+	Error     string
+}
+
+// PrefetchImage pulls an image on the selected nodes ahead of a rollout, so
+// creates there do not wait for the pull and the scheduler's image locality
+// score sees the image on them. Nodes that report the image cached are
+// skipped. The result has one entry per node; a failure on some nodes does
+// not fail the call.
+func (s *ComputeService) PrefetchImage(ctx context.Context, req *PrefetchImageRequest) ([]PrefetchResult, error) {
+	if req.ImageRef == "" {
+		return nil, status.Error(codes.InvalidArgument, "image_ref is required")
+	}
+	if req.Type == "" {
+		req.Type = driver.InstanceTypeVM
+	}
+
+	nodes, err := s.prefetchTargets(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "no nodes match the prefetch request")
+	}
+
+	results := make([]PrefetchResult, len(nodes))
+	sem := make(chan struct{}, prefetchParallelism)
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		if node.HasImage(req.ImageRef) {
+			results[i] = PrefetchResult{NodeID: node.ID, Status: PrefetchCached, Image: req.ImageRef}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, node *registry.Node) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = s.prefetchOnNode(ctx, node.ID, req)
+		}(i, node)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Status == PrefetchFailed {
+			s.events.Record(ctx, events.Event{
+				Type:     events.TypeWarning,
+				Kind:     events.KindNode,
+				ObjectID: result.NodeID,
+				NodeID:   result.NodeID,
+				Reason:   "FailedImagePrefetch",
+				Message:  fmt.Sprintf("failed to prefetch %s: %s", req.ImageRef, result.Error),
+			})
+		}
+	}
+
+	s.logger.Info("prefetched image",
+		zap.String("image", req.ImageRef),
+		zap.Int("nodes", len(results)),
+	)
+	return results, nil
+}
+
+// prefetchTargets returns the nodes a prefetch applies to, sorted by ID.
+func (s *ComputeService) prefetchTargets(ctx context.Context, req *PrefetchImageRequest) ([]*registry.Node, error) {
+	var nodes []*registry.Node
+	if len(req.NodeIDs) > 0 {
+		for _, id := range req.NodeIDs {
+			node, err := s.nodeRegistry.Get(ctx, id)
+			if err != nil {
+				return nil, status.Errorf(codes.NotFound, "node not found: %s", id)
+			}
+			if !node.SupportsInstanceType(registry.InstanceType(req.Type)) {
+				return nil, status.Errorf(codes.FailedPrecondition, "node %s does not support %s instances", id, req.Type)
+			}
+			nodes = append(nodes, node)
+		}
+	} else {
+		workers, err := s.nodeRegistry.ListByRole(ctx, registry.NodeRoleWorker)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list nodes: %v", err)
+		}
+		for _, node := range workers {
+			if node.IsReady() && node.SupportsInstanceType(registry.InstanceType(req.Type)) {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	selected := nodes[:0]
+	for _, node := range nodes {
+		if matchesLabels(node.Labels, req.LabelSelector) {
+			selected = append(selected, node)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].ID < selected[j].ID })
+	return selected, nil
+}
+
+// prefetchOnNode pulls the image on one node and waits for the pull to
+// finish.
+func (s *ComputeService) prefetchOnNode(ctx context.Context, nodeID string, req *PrefetchImageRequest) PrefetchResult {
+	result := PrefetchResult{NodeID: nodeID, Status: PrefetchFailed}
+
+	agentClient, err := s.agentClients.GetClient(ctx, nodeID)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to connect to agent: %v", err)
+		return result
+	}
+
+	stream, err := agentClient.PullImage(ctx, &v1.PullImageRequest{
+		ImageRef: req.ImageRef,
+		Type:     driverTypeToProtoType(req.Type),
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	cached := false
+	for {
+		progress, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			result.Error = "agent ended the pull without completing it"
+			return result
+		}
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if progress.Status == PrefetchCached {
+			cached = true
+		}
+		if progress.Completed {
+			result.Status = PrefetchPulled
+			if cached {
+				result.Status = PrefetchCached
+			}
+			result.Image = progress.Image
+			result.SizeBytes = progress.Total
+			return result
+		}
+	}
+}
+
+// matchesLabels reports whether labels contain every selector entry.
+func matchesLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
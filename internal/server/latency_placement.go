@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"hypervisor/pkg/cluster/latency"
+	"hypervisor/pkg/cluster/registry"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// LatencyGroupLabel places the instances sharing its value on nodes
+	// close to each other in the latency matrix.
+	LatencyGroupLabel = "hypervisor.io/latency-group"
+
+	// MaxLatencyAnnotation caps the round-trip time (e.g. "500us") from the
+	// node an instance of a latency group is placed on to the nodes of the
+	// group's other instances. Nodes with unmeasured latency are excluded.
+	MaxLatencyAnnotation = "hypervisor.io/max-latency"
+)
+
+// latencyPlacement is how far each candidate node is from the nodes already
+// running an instance's latency group.
+type latencyPlacement struct {
+	mean    map[string]time.Duration // By candidate node; missing if unmeasured
+	maxMean time.Duration
+}
+
+// SetLatencyStore sets the store of the latency matrix that latency groups
+// are placed by.
+func (s *ComputeService) SetLatencyStore(store *latency.Store) {
+	s.latency = store
+}
+
+// placeLatencyGroup scores candidates by their latency to the instance's
+// latency group, if it has one, and drops those beyond its max latency,
+// recording them in rejected. The scores are kept on req for latencyScore.
+func (s *ComputeService) placeLatencyGroup(ctx context.Context, req *CreateInstanceRequest, nodes []*registry.Node, rejected map[string]string) ([]*registry.Node, error) {
+	group := req.Metadata[LatencyGroupLabel]
+	if group == "" {
+		return nodes, nil
+	}
+
+	var limit time.Duration
+	if value := req.Annotations[MaxLatencyAnnotation]; value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid %s annotation %q", MaxLatencyAnnotation, value)
+		}
+		limit = d
+	}
+
+	members, err := s.latencyGroupNodes(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nodes, nil
+	}
+
+	if s.latency == nil {
+		s.logger.Warn("latency matrix unavailable, placing latency group without it", zap.String("group", group))
+		return nodes, nil
+	}
+	matrix, err := s.latency.Matrix(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	placement := &latencyPlacement{mean: make(map[string]time.Duration)}
+	kept := make([]*registry.Node, 0, len(nodes))
+	for _, node := range nodes {
+		var total, worst time.Duration
+		measured := true
+		for member := range members {
+			rtt, ok := matrix.RTT(node.ID, member)
+			if !ok {
+				measured = false
+				break
+			}
+			total += rtt
+			worst = max(worst, rtt)
+		}
+
+		if limit > 0 && !measured {
+			rejected[node.ID] = fmt.Sprintf("latency to latency group %s is not measured", group)
+			continue
+		}
+		if limit > 0 && worst > limit {
+			rejected[node.ID] = fmt.Sprintf("latency to latency group %s is %s, over %s", group, worst, limit)
+			continue
+		}
+		kept = append(kept, node)
+		if measured {
+			mean := total / time.Duration(len(members))
+			placement.mean[node.ID] = mean
+			placement.maxMean = max(placement.maxMean, mean)
+		}
+	}
+
+	if len(kept) == 0 {
+		return nil, &schedulingError{nodes: rejected}
+	}
+	req.latency = placement
+	return kept, nil
+}
+
+// latencyGroupNodes returns the nodes running instances of a latency group.
+// Instances that are not running, such as those on a failed node, do not
+// pull the group's placement toward their node.
+func (s *ComputeService) latencyGroupNodes(ctx context.Context, group string) (map[string]bool, error) {
+	instances, err := s.instanceRegistry.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	nodes := make(map[string]bool)
+	for _, instance := range instances {
+		if instance.Labels[LatencyGroupLabel] == group && instance.NodeID != "" && instance.IsRunning() {
+			nodes[instance.NodeID] = true
+		}
+	}
+	return nodes, nil
+}
+
+// latencyScore prefers nodes close to the instance's latency group: nodes
+// running the group score 1, the furthest measured node 0.5 and nodes with
+// unmeasured latency 0.
+func latencyScore(node *registry.Node, req *CreateInstanceRequest) float64 {
+	if req.latency == nil {
+		return 0
+	}
+	mean, ok := req.latency.mean[node.ID]
+	if !ok {
+		return 0
+	}
+	if req.latency.maxMean == 0 {
+		return 1
+	}
+	return 1 - 0.5*float64(mean)/float64(req.latency.maxMean)
+}
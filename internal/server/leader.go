@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	v1 "hypervisor/api/gen"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LeaderElectionConfig holds the control-plane leader election configuration.
+type LeaderElectionConfig struct {
+	// Enabled elects a single active server; the others run as standbys.
+	Enabled bool `mapstructure:"enabled"`
+
+	// ID identifies this server in the election (defaults to hostname + gRPC address).
+	ID string `mapstructure:"id"`
+
+	// Prefix is the etcd key prefix the election runs under.
+	Prefix string `mapstructure:"prefix"`
+
+	// TTL is the leader lease TTL; a crashed leader is replaced after it expires.
+	TTL time.Duration `mapstructure:"ttl"`
+}
+
+// DefaultLeaderElectionConfig returns the default leader election configuration.
+func DefaultLeaderElectionConfig() LeaderElectionConfig {
+	return LeaderElectionConfig{
+		Enabled: true,
+		Prefix:  "/hypervisor/leader",
+		TTL:     15 * time.Second,
+	}
+}
+
+// electionID returns the configured election ID or derives one from the host.
+func (c LeaderElectionConfig) electionID(grpcAddr string) string {
+	if c.ID != "" {
+		return c.ID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return hostname + grpcAddr
+}
+
+// IsLeader returns true if this server runs the cluster controllers.
+func (s *Server) IsLeader() bool {
+	if s.elector == nil {
+		return true
+	}
+	return s.elector.IsLeader()
+}
+
+// startLeading starts the controllers that must run on exactly one server:
+// the heartbeat monitor, the node-failure controller, the reconciler, the
+// instance group controller, the maintenance window controller, the event
+// notifier and the SDN controller's background tasks. They stop when ctx is
+// cancelled.
+func (s *Server) startLeading(ctx context.Context) {
+	s.logger.Info("starting cluster controllers")
+
+	if err := s.monitor.Start(ctx); err != nil {
+		s.logger.Error("failed to start heartbeat monitor", zap.Error(err))
+	}
+
+	if err := s.failureController.Start(ctx); err != nil {
+		s.logger.Error("failed to start failure controller", zap.Error(err))
+	}
+
+	if err := s.reconciler.Start(ctx); err != nil {
+		s.logger.Error("failed to start reconciler", zap.Error(err))
+	}
+
+	if err := s.groupController.Start(ctx); err != nil {
+		s.logger.Error("failed to start group controller", zap.Error(err))
+	}
+
+	if err := s.maintenanceController.Start(ctx); err != nil {
+		s.logger.Error("failed to start maintenance controller", zap.Error(err))
+	}
+
+	if err := s.notifier.Start(ctx); err != nil {
+		s.logger.Error("failed to start notifier", zap.Error(err))
+	}
+
+	if s.networkService != nil {
+		s.networkService.StartLeading(ctx)
+	}
+}
+
+// stopLeading stops the leader-only controllers.
+func (s *Server) stopLeading() {
+	s.logger.Info("stopping cluster controllers")
+
+	s.monitor.Stop()
+	s.failureController.Stop()
+	s.reconciler.Stop()
+	s.groupController.Stop()
+	s.maintenanceController.Stop()
+	s.notifier.Stop()
+}
+
+// checkLeader rejects mutating RPCs on a standby server. Reads are served
+// from etcd-backed state, so any server can answer them. In active-active
+// mode every server accepts every RPC.
+func (s *Server) checkLeader(ctx context.Context, fullMethod string) error {
+	if s.IsLeader() || s.config.Coordination.Enabled || isReadOnlyMethod(fullMethod) {
+		return nil
+	}
+
+	leader, err := s.elector.Leader(ctx)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "server is a standby and no leader is elected")
+	}
+	return status.Errorf(codes.Unavailable, "server is a standby; send %s to the leader (%s)", fullMethod, leader)
+}
+
+// standbyMethods are the hypervisor RPCs a standby serves itself: reads,
+// and node heartbeats, which only refresh the node's own lease. Every other
+// hypervisor RPC is sent to the leader.
+var standbyMethods = map[string]bool{
+	v1.ClusterService_GetNode_FullMethodName:                 true,
+	v1.ClusterService_ListNodes_FullMethodName:               true,
+	v1.ClusterService_GetMaintenanceWindow_FullMethodName:    true,
+	v1.ClusterService_ListMaintenanceWindows_FullMethodName:  true,
+	v1.ClusterService_ListRegistryCredentials_FullMethodName: true,
+	v1.ClusterService_Heartbeat_FullMethodName:               true,
+	v1.ClusterService_ListNodeCommands_FullMethodName:        true,
+	v1.ClusterService_WatchNodes_FullMethodName:              true,
+	v1.ClusterService_GetClusterInfo_FullMethodName:          true,
+	v1.ClusterService_ListEvents_FullMethodName:              true,
+	v1.ClusterService_GetNotificationStatus_FullMethodName:   true,
+	v1.ClusterService_GetUpgradePlan_FullMethodName:          true,
+	v1.ClusterService_GetLatencyMatrix_FullMethodName:        true,
+	v1.ClusterService_GetClusterHealth_FullMethodName:        true,
+	v1.ClusterService_CollectSupportBundle_FullMethodName:    true,
+
+	v1.ComputeService_GetInstance_FullMethodName:           true,
+	v1.ComputeService_ListInstances_FullMethodName:         true,
+	v1.ComputeService_GetInstanceHistory_FullMethodName:    true,
+	v1.ComputeService_GetInstanceGroup_FullMethodName:      true,
+	v1.ComputeService_ListInstanceGroups_FullMethodName:    true,
+	v1.ComputeService_GetInstanceStats_FullMethodName:      true,
+	v1.ComputeService_BatchGetInstanceStats_FullMethodName: true,
+	v1.ComputeService_StreamInstanceStats_FullMethodName:   true,
+	v1.ComputeService_GetRecommendations_FullMethodName:    true,
+	v1.ComputeService_WatchInstance_FullMethodName:         true,
+	v1.ComputeService_WatchInstances_FullMethodName:        true,
+	v1.ComputeService_GetBootDiagnostics_FullMethodName:    true,
+	v1.ComputeService_GetInstanceLogs_FullMethodName:       true,
+	v1.ComputeService_ListImages_FullMethodName:            true,
+	v1.ComputeService_ValidateMigration_FullMethodName:     true,
+
+	v1.NetworkService_GetNetwork_FullMethodName:         true,
+	v1.NetworkService_ListNetworks_FullMethodName:       true,
+	v1.NetworkService_GetSubnet_FullMethodName:          true,
+	v1.NetworkService_ListSubnets_FullMethodName:        true,
+	v1.NetworkService_ListAllocations_FullMethodName:    true,
+	v1.NetworkService_ListReservations_FullMethodName:   true,
+	v1.NetworkService_GetPort_FullMethodName:            true,
+	v1.NetworkService_ListPorts_FullMethodName:          true,
+	v1.NetworkService_GetPortStats_FullMethodName:       true,
+	v1.NetworkService_GetPortMirror_FullMethodName:      true,
+	v1.NetworkService_ListPortMirrors_FullMethodName:    true,
+	v1.NetworkService_GetTrunk_FullMethodName:           true,
+	v1.NetworkService_ListTrunks_FullMethodName:         true,
+	v1.NetworkService_GetLoadBalancer_FullMethodName:    true,
+	v1.NetworkService_ListLoadBalancers_FullMethodName:  true,
+	v1.NetworkService_GetVPNService_FullMethodName:      true,
+	v1.NetworkService_ListVPNServices_FullMethodName:    true,
+	v1.NetworkService_GetSecurityGroup_FullMethodName:   true,
+	v1.NetworkService_ListSecurityGroups_FullMethodName: true,
+	v1.NetworkService_GetRouter_FullMethodName:          true,
+	v1.NetworkService_ListRouters_FullMethodName:        true,
+	v1.NetworkService_ListFloatingIPs_FullMethodName:    true,
+	v1.NetworkService_ListVTEPs_FullMethodName:          true,
+	v1.NetworkService_GetNetworkTopology_FullMethodName: true,
+	v1.NetworkService_CheckConnectivity_FullMethodName:  true,
+
+	v1.AgentService_CheckMigrationTarget_FullMethodName: true,
+	v1.AgentService_CollectSupportBundle_FullMethodName: true,
+	v1.AgentService_TraceNetworkProbe_FullMethodName:    true,
+	v1.AgentService_GetPortStats_FullMethodName:         true,
+}
+
+// isReadOnlyMethod reports whether a gRPC method may be served by a standby.
+func isReadOnlyMethod(fullMethod string) bool {
+	// Only hypervisor services are gated (reflection, health, etc. are not)
+	if !strings.HasPrefix(fullMethod, "/hypervisor.") {
+		return true
+	}
+	return standbyMethods[fullMethod]
+}
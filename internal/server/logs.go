@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/registry"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetInstanceLogsRequest represents an instance logs request.
+type GetInstanceLogsRequest struct {
+	InstanceID string
+	TailLines  int
+	Follow     bool
+}
+
+// GetInstanceLogs opens a stream of an instance's log from its node: the
+// serial console of VMs and microVMs, the stdout and stderr of containers.
+func (s *ComputeService) GetInstanceLogs(ctx context.Context, req *GetInstanceLogsRequest) (v1.AgentService_GetInstanceLogsClient, error) {
+	if req.TailLines < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "tail_lines cannot be negative")
+	}
+
+	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
+	if err != nil {
+		if err == registry.ErrInstanceNotFound {
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
+	}
+	if instance.NodeID == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "instance %s is not scheduled", req.InstanceID)
+	}
+	if err := requireCapability(s.instanceCapabilities(ctx, instance), "logs", func(caps *registry.InstanceCapabilities) bool {
+		return caps.Logs
+	}); err != nil {
+		return nil, err
+	}
+
+	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
+	if err != nil {
+		return nil, agentUnavailable(err)
+	}
+
+	stream, err := agentClient.GetInstanceLogs(ctx, &v1.GetInstanceLogsRequest{
+		InstanceId: req.InstanceID,
+		TailLines:  int32(req.TailLines),
+		Follow:     req.Follow,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "agent failed to stream instance logs: %v", err)
+	}
+	return stream, nil
+}
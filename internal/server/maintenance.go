@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/maintenance"
+	"hypervisor/pkg/cluster/registry"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CreateMaintenanceWindowRequest represents a maintenance window creation
+// request.
+type CreateMaintenanceWindowRequest struct {
+	Name         string
+	NodeIDs      []string
+	NodeSelector map[string]string
+	Schedule     string
+	TimeZone     string
+	Duration     time.Duration
+	Drain        bool
+	Force        bool
+}
+
+// CreateMaintenanceWindow stores a maintenance window. If the window's
+// schedule covers the current time, it starts with the controller's next
+// pass.
+func (s *ClusterService) CreateMaintenanceWindow(ctx context.Context, req *CreateMaintenanceWindowRequest) (*maintenance.Window, error) {
+	if s.maintenance == nil {
+		return nil, status.Error(codes.Unavailable, "maintenance windows are not available")
+	}
+
+	window := &maintenance.Window{
+		Name:         req.Name,
+		NodeIDs:      req.NodeIDs,
+		NodeSelector: req.NodeSelector,
+		Schedule:     req.Schedule,
+		TimeZone:     req.TimeZone,
+		Duration:     req.Duration,
+		Drain:        req.Drain,
+		Force:        req.Force,
+		CreatedAt:    time.Now(),
+	}
+	if _, _, err := window.Validate(); err != nil {
+		return nil, apierror.InvalidField("maintenance_window", err.Error())
+	}
+
+	if err := s.maintenance.Create(ctx, window); err != nil {
+		if errors.Is(err, maintenance.ErrWindowExists) {
+			return nil, status.Errorf(codes.AlreadyExists, "maintenance window %s already exists", req.Name)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to create maintenance window: %v", err)
+	}
+
+	s.logger.Info("maintenance window created",
+		zap.String("window", window.Name),
+		zap.String("schedule", window.Schedule),
+		zap.Duration("duration", window.Duration),
+	)
+	s.recordWindowEvent(ctx, events.TypeNormal, window.Name, "Created",
+		fmt.Sprintf("schedule %q, duration %s", window.Schedule, window.Duration))
+
+	if s.maintenanceController != nil {
+		s.maintenanceController.Trigger()
+	}
+	return window, nil
+}
+
+// GetMaintenanceWindow returns a maintenance window by name.
+func (s *ClusterService) GetMaintenanceWindow(ctx context.Context, name string) (*maintenance.Window, error) {
+	if s.maintenance == nil {
+		return nil, status.Error(codes.Unavailable, "maintenance windows are not available")
+	}
+
+	window, err := s.maintenance.Get(ctx, name)
+	if err != nil {
+		if errors.Is(err, maintenance.ErrWindowNotFound) {
+			return nil, status.Errorf(codes.NotFound, "maintenance window %s not found", name)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get maintenance window: %v", err)
+	}
+	return window, nil
+}
+
+// ListMaintenanceWindows returns all maintenance windows sorted by name.
+func (s *ClusterService) ListMaintenanceWindows(ctx context.Context) ([]*maintenance.Window, error) {
+	if s.maintenance == nil {
+		return nil, status.Error(codes.Unavailable, "maintenance windows are not available")
+	}
+
+	windows, err := s.maintenance.List(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list maintenance windows: %v", err)
+	}
+	return windows, nil
+}
+
+// DeleteMaintenanceWindow deletes a maintenance window. A window in
+// progress is ended first, making its nodes schedulable again.
+func (s *ClusterService) DeleteMaintenanceWindow(ctx context.Context, name string) error {
+	window, err := s.GetMaintenanceWindow(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if window.Active() {
+		if err := s.endMaintenance(ctx, window, "window deleted"); err != nil {
+			return status.Errorf(codes.Internal, "failed to end maintenance window: %v", err)
+		}
+	}
+
+	if err := s.maintenance.Delete(ctx, name); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete maintenance window: %v", err)
+	}
+
+	s.logger.Info("maintenance window deleted", zap.String("window", name))
+	s.recordWindowEvent(ctx, events.TypeNormal, name, "Deleted", "")
+	return nil
+}
+
+// startMaintenance starts the run of a window that began at start. It
+// records the nodes it takes over before touching them, so a server that
+// fails half way leaves a window its successor can end. Nodes that are not
+// ready, e.g. cordoned by an operator, are left alone.
+func (s *ClusterService) startMaintenance(ctx context.Context, window *maintenance.Window, start time.Time) error {
+	nodes, err := s.windowNodes(ctx, window)
+	if err != nil {
+		return err
+	}
+
+	var taken, skipped []string
+	for _, node := range nodes {
+		if node.Status == registry.NodeStatusReady {
+			taken = append(taken, node.ID)
+		} else {
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", node.ID, node.Status))
+		}
+	}
+
+	if _, err := s.maintenance.Modify(ctx, window.Name, func(w *maintenance.Window) error {
+		w.Status.ActiveSince = start
+		w.Status.LastStarted = start
+		w.Status.Nodes = taken
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to record maintenance window start: %w", err)
+	}
+
+	var failed []string
+	for _, nodeID := range taken {
+		if err := s.startNodeMaintenance(ctx, window, nodeID); err != nil {
+			s.logger.Warn("failed to put node into maintenance",
+				zap.String("window", window.Name),
+				zap.String("node_id", nodeID),
+				zap.Error(err),
+			)
+			failed = append(failed, nodeID)
+		}
+	}
+
+	s.logger.Info("maintenance window started",
+		zap.String("window", window.Name),
+		zap.Strings("nodes", taken),
+		zap.Strings("skipped", skipped),
+		zap.Strings("failed", failed),
+	)
+
+	message := fmt.Sprintf("window until %s: nodes %s in maintenance",
+		start.Add(window.Duration).Format(time.RFC3339), listOrNone(taken))
+	if len(skipped) > 0 {
+		message += ", skipped " + strings.Join(skipped, ", ")
+	}
+	eventType := events.TypeNormal
+	if len(failed) > 0 {
+		eventType = events.TypeWarning
+		message += ", failed " + strings.Join(failed, ", ")
+	}
+	s.recordWindowEvent(ctx, eventType, window.Name, "MaintenanceStarted", message)
+	return nil
+}
+
+// startNodeMaintenance cordons a node, draining it first if the window
+// says so, and leaves it in maintenance.
+func (s *ClusterService) startNodeMaintenance(ctx context.Context, window *maintenance.Window, nodeID string) error {
+	if !window.Drain {
+		_, err := s.CordonNode(ctx, nodeID)
+		return err
+	}
+
+	resp, err := s.DrainNode(ctx, &DrainNodeRequest{NodeID: nodeID, Force: window.Force})
+	if err != nil {
+		return err
+	}
+	if _, err := s.setNodeStatus(ctx, nodeID, registry.NodeStatusMaintenance, "MaintenanceStarted"); err != nil {
+		return err
+	}
+	if len(resp.FailedInstanceIDs) > 0 {
+		return fmt.Errorf("failed to stop instances %s", strings.Join(resp.FailedInstanceIDs, ", "))
+	}
+	return nil
+}
+
+// endMaintenance ends the run of a window in progress, uncordoning the
+// nodes it put into maintenance that are still there. Nodes an operator
+// already uncordoned, or that went down, are left alone.
+func (s *ClusterService) endMaintenance(ctx context.Context, window *maintenance.Window, reason string) error {
+	var released, failed []string
+	for _, nodeID := range window.Status.Nodes {
+		node, err := s.registry.Get(ctx, nodeID)
+		if err != nil {
+			if !errors.Is(err, registry.ErrNodeNotFound) {
+				failed = append(failed, nodeID)
+			}
+			continue
+		}
+		if node.Status != registry.NodeStatusMaintenance && node.Status != registry.NodeStatusDraining {
+			continue
+		}
+
+		if _, err := s.UncordonNode(ctx, nodeID); err != nil {
+			s.logger.Warn("failed to take node out of maintenance",
+				zap.String("window", window.Name),
+				zap.String("node_id", nodeID),
+				zap.Error(err),
+			)
+			failed = append(failed, nodeID)
+			continue
+		}
+		released = append(released, nodeID)
+	}
+
+	// Nodes that could not be uncordoned stay recorded, so the next pass
+	// retries them
+	if _, err := s.maintenance.Modify(ctx, window.Name, func(w *maintenance.Window) error {
+		w.Status.Nodes = failed
+		if len(failed) == 0 {
+			w.Status.ActiveSince = time.Time{}
+			w.Status.LastEnded = time.Now()
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to record maintenance window end: %w", err)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to uncordon nodes %s", strings.Join(failed, ", "))
+	}
+
+	s.logger.Info("maintenance window ended",
+		zap.String("window", window.Name),
+		zap.String("reason", reason),
+		zap.Strings("nodes", released),
+	)
+	s.recordWindowEvent(ctx, events.TypeNormal, window.Name, "MaintenanceEnded",
+		fmt.Sprintf("%s: nodes %s uncordoned", reason, listOrNone(released)))
+	return nil
+}
+
+// windowNodes returns the nodes a window applies to: those it names and
+// those matching its node selector.
+func (s *ClusterService) windowNodes(ctx context.Context, window *maintenance.Window) ([]*registry.Node, error) {
+	nodes, err := s.registry.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []*registry.Node
+	for _, node := range nodes {
+		if slices.Contains(window.NodeIDs, node.ID) ||
+			(len(window.NodeSelector) > 0 && node.MatchesSelector(window.NodeSelector)) {
+			matched = append(matched, node)
+		}
+	}
+	slices.SortFunc(matched, func(a, b *registry.Node) int { return strings.Compare(a.ID, b.ID) })
+	return matched, nil
+}
+
+// recordWindowEvent records an event about a maintenance window.
+func (s *ClusterService) recordWindowEvent(ctx context.Context, eventType, name, reason, message string) {
+	s.events.Record(ctx, events.Event{
+		Type:     eventType,
+		Kind:     events.KindMaintenanceWindow,
+		ObjectID: name,
+		Reason:   reason,
+		Message:  message,
+	})
+}
+
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/maintenance"
+
+	"go.uber.org/zap"
+)
+
+// MaintenanceControllerConfig holds the maintenance window controller
+// configuration.
+type MaintenanceControllerConfig struct {
+	// Enabled turns on starting and ending maintenance windows.
+	Enabled bool `mapstructure:"enabled"`
+
+	// Interval is how often windows are checked, and so how late a window
+	// may start or end.
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// DefaultMaintenanceControllerConfig returns the default maintenance window
+// controller configuration.
+func DefaultMaintenanceControllerConfig() MaintenanceControllerConfig {
+	return MaintenanceControllerConfig{
+		Enabled:  true,
+		Interval: 30 * time.Second,
+	}
+}
+
+// maintenanceOperationTimeout bounds starting or ending one window,
+// including draining its nodes.
+const maintenanceOperationTimeout = 15 * time.Minute
+
+// MaintenanceController starts maintenance windows when their schedule
+// fires, cordoning or draining their nodes and putting them into
+// maintenance, and ends them when their duration is over, making the nodes
+// schedulable again.
+type MaintenanceController struct {
+	config  MaintenanceControllerConfig
+	cluster *ClusterService
+	logger  *zap.Logger
+
+	trigger chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMaintenanceController creates a new maintenance window controller.
+func NewMaintenanceController(config MaintenanceControllerConfig, cluster *ClusterService, logger *zap.Logger) *MaintenanceController {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &MaintenanceController{
+		config:  config,
+		cluster: cluster,
+		logger:  logger,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// Start starts the periodic window check loop.
+func (c *MaintenanceController) Start(ctx context.Context) error {
+	if !c.config.Enabled {
+		c.logger.Info("maintenance controller disabled")
+		return nil
+	}
+	if c.config.Interval <= 0 {
+		return fmt.Errorf("invalid maintenance controller interval: %s", c.config.Interval)
+	}
+
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	c.wg.Add(1)
+	go c.run()
+
+	c.logger.Info("maintenance controller started", zap.Duration("interval", c.config.Interval))
+	return nil
+}
+
+// Stop stops the maintenance controller and waits for the current pass to
+// finish.
+func (c *MaintenanceController) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	c.wg.Wait()
+	c.logger.Info("maintenance controller stopped")
+}
+
+// Trigger requests a pass over all windows without waiting for the next
+// interval. It does not block.
+func (c *MaintenanceController) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (c *MaintenanceController) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	c.checkAll()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.checkAll()
+		case <-c.trigger:
+			c.checkAll()
+		}
+	}
+}
+
+// checkAll starts the windows whose schedule fired and ends those whose
+// duration is over.
+func (c *MaintenanceController) checkAll() {
+	windows, err := c.cluster.ListMaintenanceWindows(c.ctx)
+	if err != nil {
+		c.logger.Error("failed to list maintenance windows", zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	for _, window := range windows {
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.check(window, now)
+	}
+}
+
+func (c *MaintenanceController) check(window *maintenance.Window, now time.Time) {
+	current, err := window.Current(now)
+	if err != nil {
+		c.logger.Warn("invalid maintenance window", zap.String("window", window.Name), zap.Error(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, maintenanceOperationTimeout)
+	defer cancel()
+
+	switch {
+	case window.Active() && !current.Equal(window.Status.ActiveSince):
+		// The run is over; a run that follows straight on starts with the
+		// next pass
+		if err := c.cluster.endMaintenance(ctx, window, "window ended"); err != nil {
+			c.logger.Error("failed to end maintenance window", zap.String("window", window.Name), zap.Error(err))
+		}
+	case !window.Active() && !current.IsZero() && current.After(window.Status.LastStarted):
+		if err := c.cluster.startMaintenance(ctx, window, current); err != nil {
+			c.logger.Error("failed to start maintenance window", zap.String("window", window.Name), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NetworkChecker verifies that an instance's network is available on a node.
+type NetworkChecker interface {
+	CheckNodeNetwork(ctx context.Context, spec driver.NetworkSpec, nodeID string) error
+}
+
+// SetNetworkChecker sets the checker used to validate network presence on
+// migration targets.
+func (s *ComputeService) SetNetworkChecker(checker NetworkChecker) {
+	s.network = checker
+}
+
+// ValidateMigrationRequest represents a validate migration request.
+type ValidateMigrationRequest struct {
+	InstanceID   string
+	TargetNodeID string
+}
+
+// MigrationCheck is the result of one pre-migration check.
+type MigrationCheck struct {
+	Name    string
+	Passed  bool
+	Message string
+}
+
+// MigrationReport is the outcome of validating a migration.
+type MigrationReport struct {
+	InstanceID   string
+	SourceNodeID string
+	TargetNodeID string
+	Compatible   bool
+	Checks       []MigrationCheck
+}
+
+// add appends a check result, marking the report incompatible on failure.
+func (r *MigrationReport) add(name string, err error, okMessage string) {
+	check := MigrationCheck{Name: name, Passed: err == nil, Message: okMessage}
+	if err != nil {
+		check.Message = err.Error()
+		r.Compatible = false
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// ValidateMigration checks whether an instance can be live migrated to a
+// target node without changing anything. Every check runs even if an
+// earlier one fails, so the report lists all problems at once.
+func (s *ComputeService) ValidateMigration(ctx context.Context, req *ValidateMigrationRequest) (*MigrationReport, error) {
+	if req.TargetNodeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "target node is required")
+	}
+
+	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
+	if err != nil {
+		if err == registry.ErrInstanceNotFound {
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
+	}
+
+	target, err := s.migrationTarget(ctx, req.TargetNodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := s.checkMigration(ctx, instance, target)
+	s.logger.Info("migration validated",
+		zap.String("instance_id", instance.ID),
+		zap.String("source_node_id", instance.NodeID),
+		zap.String("target_node_id", target.ID),
+		zap.Bool("compatible", report.Compatible),
+	)
+
+	return report, nil
+}
+
+// MigrateInstanceRequest represents a migrate instance request.
+type MigrateInstanceRequest struct {
+	InstanceID   string
+	TargetNodeID string // Empty lets the scheduler pick the target
+}
+
+// MigrateInstance live migrates a running instance to another node. The
+// move is refused unless every check ValidateMigration runs passes. The
+// source agent drives the migration and hands the instance's port over to
+// the target; the registry then records the instance on the target.
+func (s *ComputeService) MigrateInstance(ctx context.Context, req *MigrateInstanceRequest) (*registry.Instance, error) {
+	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
+	if err != nil {
+		if err == registry.ErrInstanceNotFound {
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
+	}
+	if instance.State != driver.StateRunning {
+		return nil, status.Errorf(codes.FailedPrecondition, "instance %s is %s; only running instances can be live migrated", instance.ID, instance.State)
+	}
+
+	targetID := req.TargetNodeID
+	if targetID == "" {
+		// The source is draining or cordoned when its instances are moved
+		// off, so the scheduler does not pick it
+		node, err := s.scheduleInstance(ctx, &CreateInstanceRequest{
+			Name:        instance.Name,
+			Type:        instance.Type,
+			Spec:        instance.Spec,
+			Metadata:    instance.Labels,
+			Annotations: instance.Annotations,
+
+			SpreadConstraints: instance.SpreadConstraints,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.ResourceExhausted, "no suitable node found: %v", err)
+		}
+		targetID = node.ID
+	}
+	target, err := s.migrationTarget(ctx, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := s.checkMigration(ctx, instance, target)
+	if !report.Compatible {
+		var failed []string
+		for _, check := range report.Checks {
+			if !check.Passed {
+				failed = append(failed, fmt.Sprintf("%s: %s", check.Name, check.Message))
+			}
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot migrate instance %s to node %s: %s",
+			instance.ID, target.ID, strings.Join(failed, "; "))
+	}
+
+	sourceID := instance.NodeID
+	agentClient, err := s.agentClients.GetClient(ctx, sourceID)
+	if err != nil {
+		return nil, agentUnavailable(err)
+	}
+
+	s.recordEvent(ctx, events.TypeNormal, instance.ID, sourceID, "Migrating", fmt.Sprintf("migrating to node %s", target.ID))
+	if _, err := agentClient.MigrateInstance(ctx, &v1.AgentMigrateInstanceRequest{
+		InstanceId:   instance.ID,
+		TargetNodeId: target.ID,
+		TargetHost:   target.IP,
+	}); err != nil {
+		s.recordEvent(ctx, events.TypeWarning, instance.ID, sourceID, "FailedMigrate", err.Error())
+		switch status.Code(err) {
+		case codes.NotFound, codes.FailedPrecondition, codes.Unimplemented:
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "agent failed to migrate instance: %v", err)
+	}
+
+	updated, err := s.instanceRegistry.Modify(ctx, instance.ID, func(instance *registry.Instance) error {
+		if instance.NodeID != sourceID {
+			return errInstanceMoved
+		}
+		instance.NodeID = target.ID
+		instance.StateReason = fmt.Sprintf("migrated from node %s", sourceID)
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "instance migrated to node %s but failed to record it: %v", target.ID, err)
+	}
+
+	s.logger.Info("instance migrated",
+		zap.String("instance_id", instance.ID),
+		zap.String("source_node_id", sourceID),
+		zap.String("target_node_id", target.ID),
+	)
+	s.recordEvent(ctx, events.TypeNormal, instance.ID, target.ID, "Migrated", fmt.Sprintf("migrated from node %s", sourceID))
+	return updated, nil
+}
+
+// migrationTarget returns the node an instance is to be migrated to.
+func (s *ComputeService) migrationTarget(ctx context.Context, nodeID string) (*registry.Node, error) {
+	target, err := s.nodeRegistry.Get(ctx, nodeID)
+	if err != nil {
+		if err == registry.ErrNodeNotFound {
+			return nil, status.Errorf(codes.NotFound, "node not found: %s", nodeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get node: %v", err)
+	}
+	return target, nil
+}
+
+// checkMigration runs the pre-migration checks of moving instance to target.
+func (s *ComputeService) checkMigration(ctx context.Context, instance *registry.Instance, target *registry.Node) *MigrationReport {
+	// The source node may be gone; checks that need it report that
+	source, _ := s.nodeRegistry.Get(ctx, instance.NodeID)
+
+	report := &MigrationReport{
+		InstanceID:   instance.ID,
+		SourceNodeID: instance.NodeID,
+		TargetNodeID: target.ID,
+		Compatible:   true,
+	}
+
+	report.add("instance", checkMigratableInstance(instance), fmt.Sprintf("%s instance in state %s", instance.Type, instance.State))
+	report.add("target-node", checkMigrationTargetNode(instance, target), fmt.Sprintf("node %s is ready", target.ID))
+	report.add("architecture", checkMigrationArchitecture(instance, source, target), "target runs the instance's architecture")
+	report.add("driver", checkMigrationCapabilities(instance, source, target), "drivers on both nodes support live migration")
+
+	var sourceCPU *driver.HostCPU
+	if source != nil {
+		sourceCPU = source.CPU
+	}
+	report.add("cpu", driver.CheckCPUMigration(instance.Spec.CPU, sourceCPU, target.CPU), cpuCheckMessage(instance.Spec.CPU, target))
+
+	required := registry.Resources{
+		CPUCores:    instance.Spec.CPUCores,
+		MemoryBytes: instance.Spec.MemoryMB * 1024 * 1024,
+		DiskBytes:   instance.Spec.DiskGB * 1024 * 1024 * 1024,
+	}
+	var resourcesErr error
+	if !target.CanSchedule(required) {
+		avail := target.AvailableResources()
+		resourcesErr = fmt.Errorf("insufficient resources: need %d cpus, %d MiB memory; available %d cpus, %d MiB memory",
+			required.CPUCores, required.MemoryBytes/(1024*1024), avail.CPUCores, avail.MemoryBytes/(1024*1024))
+	}
+	report.add("resources", resourcesErr, "enough free cpu, memory and disk")
+
+	report.add("network", s.checkMigrationNetwork(ctx, instance, target.ID), "network is available on target")
+
+	s.runTargetAgentChecks(ctx, instance, target.ID, report)
+	return report
+}
+
+// checkMigratableInstance verifies that the instance type supports live
+// migration.
+func checkMigratableInstance(instance *registry.Instance) error {
+	if instance.Type != driver.InstanceTypeVM {
+		return fmt.Errorf("live migration is only supported for vm instances, not %s", instance.Type)
+	}
+	if instance.Spec.GPU.Count > 0 {
+		return fmt.Errorf("instances with passed-through gpus cannot be live migrated")
+	}
+	if instance.Spec.Network.BindingType == driver.PortBindingSRIOV {
+		return fmt.Errorf("instances with SR-IOV ports cannot be live migrated")
+	}
+	if instance.Spec.Network.BindingType == driver.PortBindingVhostUser {
+		// The target node has no vhost-user port plugged for the guest
+		return fmt.Errorf("instances with vhost-user ports cannot be live migrated")
+	}
+	if instance.Spec.CPUPlacement.DedicatedCores {
+		// The pinning names host cores that may be taken on the target
+		return fmt.Errorf("instances with dedicated cores cannot be live migrated")
+	}
+	return nil
+}
+
+// checkMigrationTargetNode verifies that the target node can accept the
+// instance at all.
+func checkMigrationTargetNode(instance *registry.Instance, target *registry.Node) error {
+	if target.ID == instance.NodeID {
+		return fmt.Errorf("instance is already on node %s", target.ID)
+	}
+	if !target.IsReady() {
+		return fmt.Errorf("node %s is %s", target.ID, target.Status)
+	}
+	if !target.SupportsInstanceType(registry.InstanceType(instance.Type)) {
+		return fmt.Errorf("node %s does not support %s instances", target.ID, instance.Type)
+	}
+	return nil
+}
+
+// checkMigrationArchitecture verifies that the target runs the instance's
+// architecture: the one in its spec, or else the source node's. A guest
+// cannot be live migrated across architectures.
+func checkMigrationArchitecture(instance *registry.Instance, source, target *registry.Node) error {
+	arch := instance.Spec.Architecture
+	if arch == "" && source != nil {
+		arch = source.Architecture()
+	}
+	if arch == "" || target.Architecture() == "" || arch == target.Architecture() {
+		return nil
+	}
+	return fmt.Errorf("node %s is %s, instance is %s", target.ID, target.Architecture(), arch)
+}
+
+// checkMigrationCapabilities verifies that the drivers on the source and
+// target node can live migrate the instance. Nodes that do not report their
+// capabilities pass.
+func checkMigrationCapabilities(instance *registry.Instance, source, target *registry.Node) error {
+	t := registry.InstanceType(instance.Type)
+	for _, node := range []*registry.Node{source, target} {
+		if node == nil {
+			continue
+		}
+		if caps := node.CapabilitiesFor(t); caps != nil && !caps.Migrate {
+			return fmt.Errorf("driver %s on node %s cannot live migrate %s instances", caps.Driver, node.ID, instance.Type)
+		}
+	}
+	return nil
+}
+
+// cpuCheckMessage describes a passing CPU check.
+func cpuCheckMessage(spec driver.CPUSpec, target *registry.Node) string {
+	mode := spec.Mode
+	if mode == "" {
+		mode = driver.CPUModeHostModel
+	}
+	if mode == driver.CPUModeCustom {
+		return fmt.Sprintf("target supports cpu model %s", spec.Model)
+	}
+	if target.CPU != nil {
+		return fmt.Sprintf("target cpu %s is compatible with %s", target.CPU.ModelName, mode)
+	}
+	return fmt.Sprintf("target cpu is compatible with %s", mode)
+}
+
+// checkMigrationNetwork verifies that the instance's network reaches the
+// target node.
+func (s *ComputeService) checkMigrationNetwork(ctx context.Context, instance *registry.Instance, nodeID string) error {
+	net := instance.Spec.Network
+	if net.NetworkID == "" && net.VNI == 0 {
+		return nil
+	}
+	if s.network == nil {
+		return fmt.Errorf("network service unavailable")
+	}
+	return s.network.CheckNodeNetwork(ctx, net, nodeID)
+}
+
+// runTargetAgentChecks asks the target agent for the checks only it can
+// answer (hugepages, storage reachability) and adds them to report.
+func (s *ComputeService) runTargetAgentChecks(ctx context.Context, instance *registry.Instance, nodeID string, report *MigrationReport) {
+	agentClient, err := s.agentClients.GetClient(ctx, nodeID)
+	if err != nil {
+		report.add("target-agent", fmt.Errorf("failed to connect to agent: %w", err), "")
+		return
+	}
+
+	resp, err := agentClient.CheckMigrationTarget(ctx, &v1.AgentCheckMigrationTargetRequest{
+		InstanceId: instance.ID,
+		Spec:       driverSpecToProtoSpec(&instance.Spec),
+	})
+	if err != nil {
+		report.add("target-agent", fmt.Errorf("agent failed to check migration target: %w", err), "")
+		return
+	}
+
+	for _, check := range resp.Checks {
+		report.Checks = append(report.Checks, MigrationCheck{
+			Name:    check.Name,
+			Passed:  check.Passed,
+			Message: check.Message,
+		})
+		if !check.Passed {
+			report.Compatible = false
+		}
+	}
+}
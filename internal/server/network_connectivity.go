@@ -0,0 +1,424 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/network"
+	"hypervisor/pkg/network/overlay"
+	"hypervisor/pkg/network/router"
+	"hypervisor/pkg/network/sdn"
+)
+
+// Hops of a connectivity check, in path order.
+const (
+	hopEgressSecurityGroup  = "egress-security-group"
+	hopSourceFlow           = "source-flow"
+	hopRouter               = "router"
+	hopTunnel               = "tunnel"
+	hopDestinationFlow      = "destination-flow"
+	hopIngressSecurityGroup = "ingress-security-group"
+	hopPing                 = "ping"
+)
+
+// Statuses of the hops of a connectivity check.
+const (
+	hopOK      = "ok"
+	hopFailed  = "failed"
+	hopError   = "error" // The hop could not be checked
+	hopSkipped = "skipped"
+)
+
+// Security tables of the integration bridge, where flows drop what the
+// security groups of a port do not allow.
+const (
+	ingressSecurityTable = 30
+	egressSecurityTable  = 31
+)
+
+// CheckConnectivity checks hop by hop whether a probe sent by one port
+// reaches another: that the security groups of both ports let it through,
+// and, by tracing it through the flow tables of their nodes, that the
+// source node delivers it or sends it over the tunnel to the destination
+// node, through the router between their subnets if they differ, and that
+// the destination node delivers it to the port. With ping, the destination
+// is also pinged from its subnet's router namespace on its node.
+//
+// The probe is only traced, not sent, except for the ping. The response is
+// reachable when no hop failed or could not be checked, and names the first
+// hop along the path that failed.
+func (s *NetworkService) CheckConnectivity(ctx context.Context, req *v1.CheckConnectivityRequest) (*v1.CheckConnectivityResponse, error) {
+	if s.agents == nil {
+		return nil, status.Error(codes.FailedPrecondition, "connectivity checks need connections to the agents")
+	}
+
+	protocol := strings.ToLower(req.Protocol)
+	switch protocol {
+	case "", "icmp":
+		protocol = "icmp"
+		if req.DestinationPort != 0 {
+			return nil, network.Invalidf("destination ports are only valid for tcp and udp probes")
+		}
+	case "tcp", "udp":
+		if req.DestinationPort == 0 || req.DestinationPort > 65535 {
+			return nil, network.Invalidf("%s probes need a destination port (1-65535)", protocol)
+		}
+	default:
+		return nil, network.Invalidf("invalid protocol %q (must be icmp, tcp or udp)", req.Protocol)
+	}
+	if req.SourcePortId == "" || req.DestinationPortId == "" {
+		return nil, network.Invalidf("source and destination ports are required")
+	}
+	if req.SourcePortId == req.DestinationPortId {
+		return nil, network.Invalidf("source and destination must be different ports")
+	}
+
+	c := &connectivityCheck{
+		service:  s,
+		protocol: protocol,
+		dstPort:  uint16(req.DestinationPort),
+	}
+	var err error
+	if c.src, c.srcNet, err = s.probePort(ctx, req.SourcePortId); err != nil {
+		return nil, err
+	}
+	if c.dst, c.dstNet, err = s.probePort(ctx, req.DestinationPortId); err != nil {
+		return nil, err
+	}
+
+	c.run(ctx, req.Ping)
+
+	resp := &v1.CheckConnectivityResponse{Reachable: true, Hops: c.hops}
+	for _, hop := range c.hops {
+		switch hop.Status {
+		case hopFailed:
+			if resp.FailedHop == "" {
+				resp.FailedHop = hop.Name
+			}
+			resp.Reachable = false
+		case hopError:
+			resp.Reachable = false
+		}
+	}
+	return resp, nil
+}
+
+// probePort returns a port a probe is sent from or to, and its network.
+func (s *NetworkService) probePort(ctx context.Context, portID string) (*network.Port, *network.Network, error) {
+	port, err := s.controller.GetPort(ctx, portID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if port.IPAddress == "" {
+		return nil, nil, network.Invalidf("port %s has no IP address", portID)
+	}
+	net, err := s.controller.GetNetwork(ctx, port.NetworkID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return port, net, nil
+}
+
+// connectivityCheck collects the hops of a connectivity check.
+type connectivityCheck struct {
+	service        *NetworkService
+	src, dst       *network.Port
+	srcNet, dstNet *network.Network
+	protocol       string
+	dstPort        uint16
+
+	// Interfaces of the router between the ports' subnets, if they differ
+	srcIface, dstIface *network.RouterInterface
+
+	// Trace of the probe leaving the source node, for the tunnel hop
+	exit *v1.AgentTraceNetworkProbeResponse
+
+	hops []*v1.ConnectivityHop
+}
+
+func (c *connectivityCheck) add(name, nodeID, status, detail string) *v1.ConnectivityHop {
+	hop := &v1.ConnectivityHop{Name: name, NodeId: nodeID, Status: status, Detail: detail}
+	c.hops = append(c.hops, hop)
+	return hop
+}
+
+// run checks the hops along the path in order. Every hop is checked even
+// after one failed, so that a single run shows all that is broken.
+func (c *connectivityCheck) run(ctx context.Context, ping bool) {
+	routed := c.src.SubnetID != c.dst.SubnetID
+	var routerErr error
+	if routed {
+		c.srcIface, c.dstIface, routerErr = c.service.controller.ConnectingRouter(ctx, c.src.SubnetID, c.dst.SubnetID)
+	}
+
+	c.checkSecurityGroups(ctx, hopEgressSecurityGroup, c.src, "egress", c.dst)
+	c.checkSourceFlow(ctx, routerErr)
+	if routed {
+		c.checkRouter(ctx, routerErr)
+	}
+	c.checkTunnel(ctx)
+	c.checkDestinationFlow(ctx, routerErr)
+	c.checkSecurityGroups(ctx, hopIngressSecurityGroup, c.dst, "ingress", c.src)
+	if ping {
+		c.checkPing(ctx)
+	}
+}
+
+// crossesNodes reports whether the probe has to be tunneled between the
+// ports' nodes.
+func (c *connectivityCheck) crossesNodes() bool {
+	return bound(c.src) && bound(c.dst) && c.src.NodeID != c.dst.NodeID &&
+		c.dstNet.Type == network.NetworkTypeVXLAN
+}
+
+func bound(port *network.Port) bool {
+	return port.NodeID != "" && port.DeviceName != ""
+}
+
+func (c *connectivityCheck) checkSecurityGroups(ctx context.Context, name string, port *network.Port, direction string, peer *network.Port) {
+	allowed, reason, err := c.service.controller.SecurityGroupsAllow(ctx, port, direction, peer, c.protocol, c.dstPort)
+	switch {
+	case err != nil:
+		c.add(name, port.NodeID, hopError, err.Error())
+	case allowed:
+		c.add(name, port.NodeID, hopOK, reason)
+	default:
+		c.add(name, port.NodeID, hopFailed, reason)
+	}
+}
+
+// checkSourceFlow traces the probe from the source port's device: it must
+// reach the router interface when routed, the destination port's device
+// on the same node, or else a tunnel.
+func (c *connectivityCheck) checkSourceFlow(ctx context.Context, routerErr error) {
+	if !bound(c.src) {
+		c.add(hopSourceFlow, c.src.NodeID, hopFailed, fmt.Sprintf("port %s is not bound to a node", c.src.ID))
+		return
+	}
+	if c.srcNet.Type != network.NetworkTypeVXLAN {
+		c.add(hopSourceFlow, c.src.NodeID, hopSkipped, fmt.Sprintf("%s networks are bridged by the instance driver, without flows", c.srcNet.Type))
+		return
+	}
+	if routerErr != nil {
+		c.add(hopSourceFlow, c.src.NodeID, hopSkipped, "no router to send the probe to")
+		return
+	}
+
+	probe := c.probe(c.src.DeviceName, 0, c.src.MACAddress, c.dst.MACAddress)
+	probe.VlanTag = uint32(c.src.VLANTag)
+	expect := c.dst.DeviceName
+	switch {
+	case c.srcIface != nil:
+		probe.DstMac = c.srcIface.MACAddress
+		expect = router.InterfaceDevice(c.srcIface.PortID)
+	case c.crossesNodes():
+		expect = ""
+	}
+
+	hop, resp := c.trace(ctx, hopSourceFlow, c.src.NodeID, probe, expect, "egress")
+	if hop.Status == hopOK && c.srcIface == nil {
+		c.exit = resp
+	}
+}
+
+// checkRouter checks that a router connects the ports' subnets, and traces
+// the probe from its interface on the destination subnet, on the source
+// node where the distributed router forwards it.
+func (c *connectivityCheck) checkRouter(ctx context.Context, routerErr error) {
+	if errors.Is(routerErr, sdn.ErrRouterNotFound) {
+		c.add(hopRouter, c.src.NodeID, hopFailed, routerErr.Error())
+		return
+	}
+	if routerErr != nil {
+		c.add(hopRouter, c.src.NodeID, hopError, routerErr.Error())
+		return
+	}
+	if !bound(c.src) || c.dstNet.Type != network.NetworkTypeVXLAN {
+		c.add(hopRouter, c.src.NodeID, hopOK, fmt.Sprintf("router %s connects the subnets", c.srcIface.RouterID))
+		return
+	}
+
+	probe := c.probe(router.InterfaceDevice(c.dstIface.PortID), c.dstIface.VNI, c.dstIface.MACAddress, c.dst.MACAddress)
+	expect := c.dst.DeviceName
+	if c.crossesNodes() {
+		expect = ""
+	}
+	hop, resp := c.trace(ctx, hopRouter, c.src.NodeID, probe, expect, "")
+	if hop.Status == hopOK {
+		hop.Detail = fmt.Sprintf("router %s: %s", c.srcIface.RouterID, hop.Detail)
+		c.exit = resp
+	}
+}
+
+// checkTunnel checks that both nodes have a live VTEP, and that the probe
+// leaving the source node is sent to the destination node's.
+func (c *connectivityCheck) checkTunnel(ctx context.Context) {
+	if !c.crossesNodes() {
+		c.add(hopTunnel, "", hopSkipped, "the probe does not cross nodes over a tunnel")
+		return
+	}
+
+	var dstIP string
+	for _, nodeID := range []string{c.src.NodeID, c.dst.NodeID} {
+		vtep, err := c.service.vtepMgr.LookupVTEP(ctx, nodeID)
+		if errors.Is(err, overlay.ErrVTEPNotFound) {
+			c.add(hopTunnel, nodeID, hopFailed, fmt.Sprintf("node %s has no live VTEP", nodeID))
+			return
+		}
+		if err != nil {
+			c.add(hopTunnel, nodeID, hopError, err.Error())
+			return
+		}
+		if vtep.Status != "" && vtep.Status != "active" {
+			c.add(hopTunnel, nodeID, hopFailed, fmt.Sprintf("VTEP of node %s is %s", nodeID, vtep.Status))
+			return
+		}
+		dstIP = vtep.IP.String()
+	}
+
+	if c.exit != nil && c.exit.TunnelDst != dstIP {
+		c.add(hopTunnel, c.src.NodeID, hopFailed, fmt.Sprintf("probe is tunneled to %s, but the VTEP of node %s is %s", c.exit.TunnelDst, c.dst.NodeID, dstIP))
+		return
+	}
+	c.add(hopTunnel, c.src.NodeID, hopOK, fmt.Sprintf("tunneled from node %s to %s at %s", c.src.NodeID, c.dst.NodeID, dstIP))
+}
+
+// checkDestinationFlow traces the probe arriving over the tunnel on the
+// destination node, where it must reach the destination port's device.
+func (c *connectivityCheck) checkDestinationFlow(ctx context.Context, routerErr error) {
+	switch {
+	case !bound(c.dst):
+		c.add(hopDestinationFlow, c.dst.NodeID, hopFailed, fmt.Sprintf("port %s is not bound to a node", c.dst.ID))
+		return
+	case c.dstNet.Type != network.NetworkTypeVXLAN:
+		c.add(hopDestinationFlow, c.dst.NodeID, hopSkipped, fmt.Sprintf("%s networks are bridged by the instance driver, without flows", c.dstNet.Type))
+		return
+	case !c.crossesNodes():
+		c.add(hopDestinationFlow, c.dst.NodeID, hopSkipped, "delivered by the source node")
+		return
+	case routerErr != nil:
+		c.add(hopDestinationFlow, c.dst.NodeID, hopSkipped, "no router to send the probe from")
+		return
+	}
+
+	srcMAC := c.src.MACAddress
+	if c.dstIface != nil {
+		srcMAC = c.dstIface.MACAddress
+	}
+	probe := c.probe("patch-tun", c.dstNet.SegmentVNI(c.dst.Zone), srcMAC, c.dst.MACAddress)
+	c.trace(ctx, hopDestinationFlow, c.dst.NodeID, probe, c.dst.DeviceName, "ingress")
+}
+
+// checkPing pings the destination from the namespace of its subnet's
+// router on its node.
+func (c *connectivityCheck) checkPing(ctx context.Context) {
+	if !bound(c.dst) {
+		c.add(hopPing, "", hopSkipped, fmt.Sprintf("port %s is not bound to a node", c.dst.ID))
+		return
+	}
+
+	routerID := ""
+	if c.dstIface != nil {
+		routerID = c.dstIface.RouterID
+	} else {
+		routerIDs, err := c.service.controller.SubnetRouters(ctx, c.dst.SubnetID)
+		if err != nil {
+			c.add(hopPing, c.dst.NodeID, hopError, err.Error())
+			return
+		}
+		if len(routerIDs) == 0 {
+			c.add(hopPing, c.dst.NodeID, hopSkipped, fmt.Sprintf("subnet %s has no router to ping from", c.dst.SubnetID))
+			return
+		}
+		slices.Sort(routerIDs)
+		routerID = routerIDs[0]
+	}
+
+	resp, err := c.callAgent(ctx, c.dst.NodeID, &v1.AgentTraceNetworkProbeRequest{
+		DstIp:        c.dst.IPAddress,
+		Protocol:     "icmp",
+		PingRouterId: routerID,
+	})
+	switch {
+	case err != nil:
+		c.add(hopPing, c.dst.NodeID, hopError, err.Error())
+	case resp.PingError != "":
+		c.add(hopPing, c.dst.NodeID, hopError, resp.PingError)
+	case resp.PingReceived == 0:
+		c.add(hopPing, c.dst.NodeID, hopFailed, fmt.Sprintf("no reply to %d echo requests from router %s", resp.PingSent, routerID))
+	default:
+		c.add(hopPing, c.dst.NodeID, hopOK, fmt.Sprintf("%d of %d echo requests from router %s answered", resp.PingReceived, resp.PingSent, routerID))
+	}
+}
+
+// probe returns the probe entering a node's integration bridge on inPort.
+func (c *connectivityCheck) probe(inPort string, tunnelID uint32, srcMAC, dstMAC string) *v1.AgentTraceNetworkProbeRequest {
+	return &v1.AgentTraceNetworkProbeRequest{
+		InPort:   inPort,
+		TunnelId: tunnelID,
+		SrcMac:   srcMAC,
+		DstMac:   dstMAC,
+		SrcIp:    c.src.IPAddress,
+		DstIp:    c.dst.IPAddress,
+		Protocol: c.protocol,
+		DstPort:  uint32(c.dstPort),
+	}
+}
+
+// trace traces a probe on a node and adds the hop: it is ok if the probe
+// is output to the expected device or, without one, leaves over a tunnel.
+// Drops in the security table of direction are told apart.
+func (c *connectivityCheck) trace(ctx context.Context, name, nodeID string, probe *v1.AgentTraceNetworkProbeRequest, expect, direction string) (*v1.ConnectivityHop, *v1.AgentTraceNetworkProbeResponse) {
+	resp, err := c.callAgent(ctx, nodeID, probe)
+	if err != nil {
+		return c.add(name, nodeID, hopError, err.Error()), nil
+	}
+
+	var hop *v1.ConnectivityHop
+	switch {
+	case resp.Dropped:
+		detail := fmt.Sprintf("dropped in table %d", resp.LastTable)
+		if (direction == "egress" && resp.LastTable == egressSecurityTable) || (direction == "ingress" && resp.LastTable == ingressSecurityTable) {
+			detail = fmt.Sprintf("dropped by the %s security table %d", direction, resp.LastTable)
+		}
+		hop = c.add(name, nodeID, hopFailed, detail)
+	case expect != "" && slices.Contains(resp.Outputs, expect):
+		hop = c.add(name, nodeID, hopOK, "delivered to "+expect)
+	case expect == "" && resp.TunnelDst != "":
+		hop = c.add(name, nodeID, hopOK, "tunneled to "+resp.TunnelDst)
+	case resp.Flooded:
+		hop = c.add(name, nodeID, hopFailed, fmt.Sprintf("flooded without reaching %s: no flow for %s", destination(expect), probe.DstMac))
+	default:
+		hop = c.add(name, nodeID, hopFailed, fmt.Sprintf("output to %s instead of %s", strings.Join(resp.Outputs, ", "), destination(expect)))
+	}
+	if hop.Status != hopOK {
+		hop.Trace = resp.Trace
+	}
+	return hop, resp
+}
+
+func destination(device string) string {
+	if device == "" {
+		return "a tunnel"
+	}
+	return device
+}
+
+func (c *connectivityCheck) callAgent(ctx context.Context, nodeID string, req *v1.AgentTraceNetworkProbeRequest) (*v1.AgentTraceNetworkProbeResponse, error) {
+	client, err := c.service.agents.GetClient(ctx, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the agent of node %s: %w", nodeID, err)
+	}
+	resp, err := client.TraceNetworkProbe(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to trace probe on node %s: %w", nodeID, err)
+	}
+	return resp, nil
+}
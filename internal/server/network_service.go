@@ -3,14 +3,24 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"time"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
 
+	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	v1 "hypervisor/api/gen"
 	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
 	"hypervisor/pkg/network"
 	"hypervisor/pkg/network/cgo"
 	"hypervisor/pkg/network/ipam"
@@ -27,16 +37,70 @@ type NetworkService struct {
 	vtepMgr    *overlay.VTEPManager
 	ipam       *ipam.IPAM
 	dvr        *router.DVR
+	events     *events.Recorder
+	instances  registry.InstanceRegistry // Names instances in the topology, if set
+	agents     *AgentClientPool          // Traces connectivity probes, if set
 	logger     *zap.Logger
+
+	// startErr is why Start failed, or errNetworkNotStarted before it ran
+	startMu  sync.RWMutex
+	startErr error
+}
+
+var errNetworkNotStarted = errors.New("SDN controller not started")
+
+// NetworkConfig configures the SDN controller. Networks and zone segments
+// created without a VNI are given a free one from their range; the ranges
+// should not overlap. Networks default to the largest MTU the underlay
+// carries, less the VXLAN overhead for VXLAN networks. Zero keeps a
+// setting's default.
+type NetworkConfig struct {
+	VNIMin        uint32 `mapstructure:"vni_min"`
+	VNIMax        uint32 `mapstructure:"vni_max"`
+	SegmentVNIMin uint32 `mapstructure:"segment_vni_min"`
+	SegmentVNIMax uint32 `mapstructure:"segment_vni_max"`
+	UnderlayMTU   uint16 `mapstructure:"underlay_mtu"`
+	VXLANOverhead uint16 `mapstructure:"vxlan_overhead"`
+}
+
+// DefaultNetworkConfig returns the default SDN controller configuration.
+func DefaultNetworkConfig() NetworkConfig {
+	defaults := network.DefaultNetworkConfig()
+	return NetworkConfig{
+		VNIMin:        defaults.VNIMin,
+		VNIMax:        defaults.VNIMax,
+		SegmentVNIMin: defaults.SegmentVNIMin,
+		SegmentVNIMax: defaults.SegmentVNIMax,
+		UnderlayMTU:   defaults.UnderlayMTU,
+		VXLANOverhead: defaults.VXLANOverhead,
+	}
 }
 
 // NewNetworkService creates a new network service.
-func NewNetworkService(etcdClient *etcd.Client, logger *zap.Logger) (*NetworkService, error) {
-	// Create IPAM
-	ipamMgr := ipam.NewIPAM(etcdClient, logger.Named("ipam"))
+func NewNetworkService(networkConfig NetworkConfig, etcdClient *etcd.Client, recorder *events.Recorder, logger *zap.Logger) (*NetworkService, error) {
+	if networkConfig.VNIMin > networkConfig.VNIMax && networkConfig.VNIMax != 0 {
+		return nil, fmt.Errorf("invalid network config: vni_min %d is above vni_max %d", networkConfig.VNIMin, networkConfig.VNIMax)
+	}
+	if networkConfig.SegmentVNIMin > networkConfig.SegmentVNIMax && networkConfig.SegmentVNIMax != 0 {
+		return nil, fmt.Errorf("invalid network config: segment_vni_min %d is above segment_vni_max %d", networkConfig.SegmentVNIMin, networkConfig.SegmentVNIMax)
+	}
 
-	// Create default network config
+	// Create network config
 	config := network.DefaultNetworkConfig()
+	config.VNIMin, config.VNIMax = networkConfig.VNIMin, networkConfig.VNIMax
+	config.SegmentVNIMin, config.SegmentVNIMax = networkConfig.SegmentVNIMin, networkConfig.SegmentVNIMax
+	if networkConfig.UnderlayMTU != 0 {
+		config.UnderlayMTU = networkConfig.UnderlayMTU
+	}
+	if networkConfig.VXLANOverhead != 0 {
+		config.VXLANOverhead = networkConfig.VXLANOverhead
+	}
+	if config.MaxMTU(network.NetworkTypeVXLAN) < network.MinMTU {
+		return nil, fmt.Errorf("invalid network config: underlay_mtu %d less vxlan_overhead %d is below the minimum MTU of %d", config.UnderlayMTU, config.VXLANOverhead, network.MinMTU)
+	}
+
+	// Create IPAM
+	ipamMgr := ipam.NewIPAM(etcdClient, logger.Named("ipam"))
 
 	// Create OVS bridge wrapper for VXLANManager
 	ovsBridge := cgo.NewOVSBridge(config.OVSBridge)
@@ -55,9 +119,12 @@ func NewNetworkService(etcdClient *etcd.Client, logger *zap.Logger) (*NetworkSer
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SDN controller: %w", err)
 	}
+	controller.SetEventRecorder(recorder)
 
-	// Create DVR
+	// Create DVR, which takes routers from the SDN controller's watch
 	dvr := router.NewDVR(config, etcdClient, "server-node", logger.Named("dvr"))
+	dvr.SetExternalRouterWatch(true)
+	controller.SetRouterProgrammer(dvr)
 
 	return &NetworkService{
 		etcdClient: etcdClient,
@@ -66,16 +133,34 @@ func NewNetworkService(etcdClient *etcd.Client, logger *zap.Logger) (*NetworkSer
 		vtepMgr:    vtepMgr,
 		ipam:       ipamMgr,
 		dvr:        dvr,
+		events:     recorder,
 		logger:     logger,
+		startErr:   errNetworkNotStarted,
 	}, nil
 }
 
+// SetInstanceRegistry sets where the names and states of the instances in
+// the network topology are looked up. Without one, instances are shown by ID
+// only.
+func (s *NetworkService) SetInstanceRegistry(instances registry.InstanceRegistry) {
+	s.instances = instances
+}
+
+// SetAgentClients sets the connections to the agents that connectivity
+// checks trace probes on. Without them, connectivity cannot be checked.
+func (s *NetworkService) SetAgentClients(agents *AgentClientPool) {
+	s.agents = agents
+}
+
 // Start starts the network service.
 func (s *NetworkService) Start() error {
 	// Start SDN controller
 	if err := s.controller.Start(); err != nil {
-		return fmt.Errorf("failed to start SDN controller: %w", err)
+		err = fmt.Errorf("failed to start SDN controller: %w", err)
+		s.setStartErr(err)
+		return err
 	}
+	s.setStartErr(nil)
 
 	// Start DVR
 	if err := s.dvr.Start(); err != nil {
@@ -86,8 +171,29 @@ func (s *NetworkService) Start() error {
 	return nil
 }
 
+func (s *NetworkService) setStartErr(err error) {
+	s.startMu.Lock()
+	s.startErr = err
+	s.startMu.Unlock()
+}
+
+// Healthy reports whether the SDN controller was started, for health
+// checks.
+func (s *NetworkService) Healthy(ctx context.Context) error {
+	s.startMu.RLock()
+	defer s.startMu.RUnlock()
+	return s.startErr
+}
+
+// StartLeading starts leader-only SDN tasks until ctx is cancelled.
+func (s *NetworkService) StartLeading(ctx context.Context) {
+	s.controller.StartLeading(ctx)
+}
+
 // Stop stops the network service.
 func (s *NetworkService) Stop() error {
+	s.setStartErr(errNetworkNotStarted)
+
 	if err := s.controller.Stop(); err != nil {
 		s.logger.Warn("failed to stop SDN controller", zap.Error(err))
 	}
@@ -111,6 +217,16 @@ func (s *NetworkService) CreateNetwork(ctx context.Context, req *v1.CreateNetwor
 		MTU:      uint16(req.Mtu),
 		External: req.External,
 		Shared:   req.Shared,
+
+		Description: req.Description,
+		Labels:      req.Metadata.GetLabels(),
+		Annotations: req.Metadata.GetAnnotations(),
+	}
+	for _, segment := range req.Segments {
+		net.Segments = append(net.Segments, network.NetworkSegment{
+			Zone: segment.Zone,
+			VNI:  segment.Vni,
+		})
 	}
 
 	if err := s.controller.CreateNetwork(ctx, net); err != nil {
@@ -125,9 +241,55 @@ func (s *NetworkService) GetNetwork(ctx context.Context, networkID string) (*net
 	return s.controller.GetNetwork(ctx, networkID)
 }
 
+// GetNetworkByName retrieves a network by its name within a tenant.
+func (s *NetworkService) GetNetworkByName(ctx context.Context, tenantID, name string) (*network.Network, error) {
+	id, err := s.controller.LookupName(ctx, sdn.NameKindNetwork, tenantID, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.controller.GetNetwork(ctx, id)
+}
+
 // ListNetworks lists all networks with optional filters.
-func (s *NetworkService) ListNetworks(ctx context.Context, tenantID string) ([]*network.Network, error) {
-	return s.controller.ListNetworks(ctx, tenantID)
+func (s *NetworkService) ListNetworks(ctx context.Context, tenantID, name string) ([]*network.Network, error) {
+	networks, err := s.controller.ListNetworks(ctx, tenantID)
+	if err != nil || name == "" {
+		return networks, err
+	}
+	return filterByName(networks, name, func(net *network.Network) string { return net.Name }), nil
+}
+
+// UpdateNetwork copies the fields named by mask from src to the stored
+// network.
+func (s *NetworkService) UpdateNetwork(ctx context.Context, networkID string, src *v1.Network, mask updateMask) (*network.Network, error) {
+	if mask.has("name") && src.GetName() == "" {
+		return nil, network.Invalidf("network name cannot be empty")
+	}
+
+	return s.controller.UpdateNetwork(ctx, networkID, func(net *network.Network) error {
+		if mask.has("name") {
+			net.Name = src.GetName()
+		}
+		if mask.has("description") {
+			net.Description = src.GetDescription()
+		}
+		if mask.has("admin_state") {
+			net.AdminState = src.GetAdminState()
+		}
+		if mask.has("shared") {
+			net.Shared = src.GetShared()
+		}
+		if mask.has("metadata.labels") {
+			net.Labels = src.GetMetadata().GetLabels()
+		}
+		if mask.has("metadata.annotations") {
+			net.Annotations = src.GetMetadata().GetAnnotations()
+		}
+		if mask.has("bgp") {
+			net.BGP = keepBGPPasswords(fromProtoBGPConfig(src.GetBgp()), net.BGP)
+		}
+		return nil
+	})
 }
 
 // DeleteNetwork deletes a network.
@@ -149,15 +311,13 @@ func (s *NetworkService) CreateSubnet(ctx context.Context, req *v1.CreateSubnetR
 
 	// Convert allocation pools
 	for _, pool := range req.AllocationPools {
-		subnet.AllocationPools = append(subnet.AllocationPools, network.IPPool{
-			Start: pool.Start,
-			End:   pool.End,
-		})
+		subnet.AllocationPools = append(subnet.AllocationPools, fromProtoIPPool(pool))
 	}
 
-	if err := s.ipam.CreateSubnet(ctx, subnet); err != nil {
+	if err := s.controller.CreateSubnet(ctx, subnet); err != nil {
 		return nil, fmt.Errorf("failed to create subnet: %w", err)
 	}
+	s.recordSubnetEvent(ctx, subnet.ID, "Created", fmt.Sprintf("created subnet %s on network %s", subnet.CIDR, subnet.NetworkID))
 
 	return subnet, nil
 }
@@ -167,14 +327,56 @@ func (s *NetworkService) GetSubnet(ctx context.Context, subnetID string) (*netwo
 	return s.ipam.GetSubnet(ctx, subnetID)
 }
 
-// ListSubnets lists all subnets with optional network filter.
-func (s *NetworkService) ListSubnets(ctx context.Context, networkID string) ([]*network.Subnet, error) {
-	return s.ipam.ListSubnets(ctx, networkID)
+// GetSubnetByName retrieves a subnet by its name within the tenant of its
+// network.
+func (s *NetworkService) GetSubnetByName(ctx context.Context, tenantID, name string) (*network.Subnet, error) {
+	id, err := s.controller.LookupName(ctx, sdn.NameKindSubnet, tenantID, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.ipam.GetSubnet(ctx, id)
+}
+
+// ListSubnets lists all subnets with optional network and name filters.
+func (s *NetworkService) ListSubnets(ctx context.Context, networkID, name string) ([]*network.Subnet, error) {
+	subnets, err := s.ipam.ListSubnets(ctx, networkID)
+	if err != nil || name == "" {
+		return subnets, err
+	}
+	return filterByName(subnets, name, func(subnet *network.Subnet) string { return subnet.Name }), nil
+}
+
+// DeleteSubnet deletes a subnet, removing its dependencies first if cascade
+// is set. On a dry run it only returns the dependencies.
+func (s *NetworkService) DeleteSubnet(ctx context.Context, req *v1.DeleteSubnetRequest) ([]sdn.SubnetDependency, error) {
+	if req.DryRun {
+		if _, err := s.ipam.GetSubnet(ctx, req.SubnetId); err != nil {
+			return nil, err
+		}
+		return s.controller.SubnetDependencies(ctx, req.SubnetId)
+	}
+
+	removed, err := s.controller.DeleteSubnet(ctx, req.SubnetId, req.Cascade)
+	if err != nil {
+		return nil, err
+	}
+
+	message := ""
+	if len(removed) > 0 {
+		message = fmt.Sprintf("cascaded to %d dependent resource(s)", len(removed))
+	}
+	s.recordSubnetEvent(ctx, req.SubnetId, "Deleted", message)
+	return removed, nil
 }
 
-// DeleteSubnet deletes a subnet.
-func (s *NetworkService) DeleteSubnet(ctx context.Context, subnetID string) error {
-	return s.ipam.DeleteSubnet(ctx, subnetID)
+// recordSubnetEvent records an event about a subnet.
+func (s *NetworkService) recordSubnetEvent(ctx context.Context, subnetID, reason, message string) {
+	s.events.Record(ctx, events.Event{
+		Kind:     events.KindSubnet,
+		ObjectID: subnetID,
+		Reason:   reason,
+		Message:  message,
+	})
 }
 
 // CreatePort creates a new port.
@@ -187,6 +389,9 @@ func (s *NetworkService) CreatePort(ctx context.Context, req *v1.CreatePortReque
 		MACAddress:     req.MacAddress,
 		IPAddress:      req.IpAddress,
 		SecurityGroups: req.SecurityGroups,
+		Zone:           req.Zone,
+		QoS:            fromProtoPortQoS(req.Qos),
+		BindingType:    fromProtoPortBindingType(req.BindingType),
 	}
 
 	if err := s.controller.CreatePort(ctx, port); err != nil {
@@ -201,9 +406,39 @@ func (s *NetworkService) GetPort(ctx context.Context, portID string) (*network.P
 	return s.controller.GetPort(ctx, portID)
 }
 
+// GetPortByName retrieves a port by its name within the tenant of its
+// network.
+func (s *NetworkService) GetPortByName(ctx context.Context, tenantID, name string) (*network.Port, error) {
+	id, err := s.controller.LookupName(ctx, sdn.NameKindPort, tenantID, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.controller.GetPort(ctx, id)
+}
+
 // ListPorts lists ports with optional filters.
-func (s *NetworkService) ListPorts(ctx context.Context, networkID, instanceID, nodeID string) ([]*network.Port, error) {
-	return s.controller.ListPorts(ctx, networkID, instanceID, nodeID)
+func (s *NetworkService) ListPorts(ctx context.Context, networkID, instanceID, nodeID, name string) ([]*network.Port, error) {
+	ports, err := s.controller.ListPorts(ctx, networkID, instanceID, nodeID)
+	if err != nil || name == "" {
+		return ports, err
+	}
+	return filterByName(ports, name, func(port *network.Port) string { return port.Name }), nil
+}
+
+// filterByName returns the items named name.
+func filterByName[T any](items []T, name string, nameOf func(T) string) []T {
+	filtered := make([]T, 0, 1)
+	for _, item := range items {
+		if nameOf(item) == name {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// UnbindPort detaches a port from its instance.
+func (s *NetworkService) UnbindPort(ctx context.Context, portID string) (*network.Port, error) {
+	return s.controller.UnbindPort(ctx, portID)
 }
 
 // DeletePort deletes a port.
@@ -211,214 +446,1522 @@ func (s *NetworkService) DeletePort(ctx context.Context, portID string) error {
 	return s.controller.DeletePort(ctx, portID)
 }
 
-// BindPort binds a port to an instance.
-func (s *NetworkService) BindPort(ctx context.Context, portID, instanceID, nodeID, deviceName string) error {
-	return s.controller.BindPort(ctx, portID, instanceID, nodeID, deviceName)
+// SetPortQoS replaces the bandwidth limits of a port.
+func (s *NetworkService) SetPortQoS(ctx context.Context, portID string, qos *network.PortQoS) (*network.Port, error) {
+	return s.controller.SetPortQoS(ctx, portID, qos)
 }
 
-// AllocateIP allocates an IP from a subnet.
-func (s *NetworkService) AllocateIP(ctx context.Context, subnetID, ipAddress, instanceID, portID string) (*network.IPAllocation, error) {
-	return s.ipam.AllocateIP(ctx, subnetID, ipam.AllocationOptions{
-		IPAddress:  ipAddress,
-		InstanceID: instanceID,
-		PortID:     portID,
-	})
+// GetPortStats reads the traffic counters of a port from the agent of the
+// node it is bound to.
+func (s *NetworkService) GetPortStats(ctx context.Context, portID string) (*v1.PortStats, error) {
+	if s.agents == nil {
+		return nil, status.Error(codes.FailedPrecondition, "port stats need connections to the agents")
+	}
+	port, err := s.controller.GetPort(ctx, portID)
+	if err != nil {
+		return nil, err
+	}
+	if port.NodeID == "" {
+		return nil, fmt.Errorf("%w: %s is not bound to a node", sdn.ErrPortStatsNotFound, portID)
+	}
+
+	client, err := s.agents.GetClient(ctx, port.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the agent of node %s: %w", port.NodeID, err)
+	}
+	return client.GetPortStats(ctx, &v1.AgentGetPortStatsRequest{PortId: portID})
 }
 
-// ReleaseIP releases an allocated IP.
-func (s *NetworkService) ReleaseIP(ctx context.Context, subnetID, ipAddress string) error {
-	return s.ipam.ReleaseIP(ctx, subnetID, ipAddress)
+// MirrorPort mirrors a port to another port or a tunnel.
+func (s *NetworkService) MirrorPort(ctx context.Context, req *v1.MirrorPortRequest) (*network.PortMirror, error) {
+	mirror := &network.PortMirror{
+		ID:           generateID(),
+		Name:         req.Name,
+		SourcePortID: req.SourcePortId,
+		Direction:    fromProtoMirrorDirection(req.Direction),
+		TargetPortID: req.TargetPortId,
+	}
+	if t := req.Tunnel; t != nil {
+		mirror.Tunnel = &network.MirrorTunnel{Type: t.Type, RemoteIP: t.RemoteIp, Key: t.Key}
+	}
+
+	if err := s.controller.CreateMirror(ctx, mirror); err != nil {
+		return nil, fmt.Errorf("failed to mirror port: %w", err)
+	}
+	return mirror, nil
 }
 
-// NetworkGRPCHandler implements the gRPC NetworkService.
-type NetworkGRPCHandler struct {
-	v1.UnimplementedNetworkServiceServer
-	service *NetworkService
+// GetPortMirror retrieves a port mirror by ID.
+func (s *NetworkService) GetPortMirror(ctx context.Context, mirrorID string) (*network.PortMirror, error) {
+	return s.controller.GetMirror(ctx, mirrorID)
 }
 
-// NewNetworkGRPCHandler creates a new network gRPC handler.
-func NewNetworkGRPCHandler(service *NetworkService) *NetworkGRPCHandler {
-	return &NetworkGRPCHandler{service: service}
+// ListPortMirrors lists port mirrors, optionally those from or to a port.
+func (s *NetworkService) ListPortMirrors(ctx context.Context, portID string) ([]*network.PortMirror, error) {
+	return s.controller.ListMirrors(ctx, portID)
 }
 
-// CreateNetwork implements the gRPC CreateNetwork method.
-func (h *NetworkGRPCHandler) CreateNetwork(ctx context.Context, req *v1.CreateNetworkRequest) (*v1.CreateNetworkResponse, error) {
-	net, err := h.service.CreateNetwork(ctx, req)
+// DeletePortMirror deletes a port mirror.
+func (s *NetworkService) DeletePortMirror(ctx context.Context, mirrorID string) error {
+	return s.controller.DeleteMirror(ctx, mirrorID)
+}
+
+// CreateTrunk makes a port the parent of a trunk of subports.
+func (s *NetworkService) CreateTrunk(ctx context.Context, req *v1.CreateTrunkRequest) (*network.Trunk, error) {
+	subPorts, err := fromProtoSubPorts(req.SubPorts)
 	if err != nil {
 		return nil, err
 	}
+	trunk := &network.Trunk{
+		ID:           generateID(),
+		Name:         req.Name,
+		ParentPortID: req.ParentPortId,
+		SubPorts:     subPorts,
+	}
 
-	return &v1.CreateNetworkResponse{
-		Network: toProtoNetwork(net),
-	}, nil
+	if err := s.controller.CreateTrunk(ctx, trunk); err != nil {
+		return nil, fmt.Errorf("failed to create trunk: %w", err)
+	}
+	return trunk, nil
 }
 
-// GetNetwork implements the gRPC GetNetwork method.
-func (h *NetworkGRPCHandler) GetNetwork(ctx context.Context, req *v1.GetNetworkRequest) (*v1.GetNetworkResponse, error) {
-	net, err := h.service.GetNetwork(ctx, req.NetworkId)
+// GetTrunk retrieves a trunk by ID.
+func (s *NetworkService) GetTrunk(ctx context.Context, trunkID string) (*network.Trunk, error) {
+	return s.controller.GetTrunk(ctx, trunkID)
+}
+
+// ListTrunks lists the trunks.
+func (s *NetworkService) ListTrunks(ctx context.Context) ([]*network.Trunk, error) {
+	return s.controller.ListTrunks(ctx)
+}
+
+// DeleteTrunk deletes a trunk without subports.
+func (s *NetworkService) DeleteTrunk(ctx context.Context, trunkID string) error {
+	return s.controller.DeleteTrunk(ctx, trunkID)
+}
+
+// AddSubPorts adds subports to a trunk.
+func (s *NetworkService) AddSubPorts(ctx context.Context, trunkID string, subPorts []*v1.SubPort) (*network.Trunk, error) {
+	converted, err := fromProtoSubPorts(subPorts)
 	if err != nil {
 		return nil, err
 	}
+	return s.controller.AddSubPorts(ctx, trunkID, converted)
+}
 
-	return &v1.GetNetworkResponse{
-		Network: toProtoNetwork(net),
-	}, nil
+// RemoveSubPorts removes subports from a trunk.
+func (s *NetworkService) RemoveSubPorts(ctx context.Context, trunkID string, portIDs []string) (*network.Trunk, error) {
+	return s.controller.RemoveSubPorts(ctx, trunkID, portIDs)
 }
 
-// ListNetworks implements the gRPC ListNetworks method.
-func (h *NetworkGRPCHandler) ListNetworks(ctx context.Context, req *v1.ListNetworksRequest) (*v1.ListNetworksResponse, error) {
-	networks, err := h.service.ListNetworks(ctx, req.TenantId)
+// CreateLoadBalancer creates a load balancer on the requested node, or on
+// the node serving the fewest of those that finished their SDN bootstrap.
+func (s *NetworkService) CreateLoadBalancer(ctx context.Context, req *v1.CreateLoadBalancerRequest) (*network.LoadBalancer, error) {
+	listeners := make([]network.LBListener, 0, len(req.Listeners))
+	for _, l := range req.Listeners {
+		listener, err := fromProtoLBListener(l)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, *listener)
+	}
+	lb := &network.LoadBalancer{
+		ID:         generateID(),
+		Name:       req.Name,
+		TenantID:   req.TenantId,
+		SubnetID:   req.SubnetId,
+		VIPAddress: req.VipAddress,
+		VIPPortID:  generateID(),
+		NodeID:     req.NodeId,
+		Listeners:  listeners,
+	}
+
+	nodes, err := s.candidateNodes(ctx, req.NodeId)
 	if err != nil {
 		return nil, err
 	}
-
-	protoNetworks := make([]*v1.Network, len(networks))
-	for i, net := range networks {
-		protoNetworks[i] = toProtoNetwork(net)
+	if err := s.controller.CreateLoadBalancer(ctx, lb, nodes); err != nil {
+		return nil, fmt.Errorf("failed to create load balancer: %w", err)
 	}
+	return lb, nil
+}
 
-	return &v1.ListNetworksResponse{
-		Networks: protoNetworks,
-	}, nil
+// GetLoadBalancer retrieves a load balancer by ID.
+func (s *NetworkService) GetLoadBalancer(ctx context.Context, lbID string) (*network.LoadBalancer, error) {
+	return s.controller.GetLoadBalancer(ctx, lbID)
 }
 
-// DeleteNetwork implements the gRPC DeleteNetwork method.
-func (h *NetworkGRPCHandler) DeleteNetwork(ctx context.Context, req *v1.DeleteNetworkRequest) (*v1.DeleteNetworkResponse, error) {
-	if err := h.service.DeleteNetwork(ctx, req.NetworkId); err != nil {
-		return nil, err
-	}
-	return &v1.DeleteNetworkResponse{}, nil
+// ListLoadBalancers lists load balancers, optionally those of a tenant.
+func (s *NetworkService) ListLoadBalancers(ctx context.Context, tenantID string) ([]*network.LoadBalancer, error) {
+	return s.controller.ListLoadBalancers(ctx, tenantID)
 }
 
-// CreateSubnet implements the gRPC CreateSubnet method.
-func (h *NetworkGRPCHandler) CreateSubnet(ctx context.Context, req *v1.CreateSubnetRequest) (*v1.CreateSubnetResponse, error) {
-	subnet, err := h.service.CreateSubnet(ctx, req)
+// DeleteLoadBalancer deletes a load balancer.
+func (s *NetworkService) DeleteLoadBalancer(ctx context.Context, lbID string) error {
+	return s.controller.DeleteLoadBalancer(ctx, lbID)
+}
+
+// AddListener adds a listener to a load balancer.
+func (s *NetworkService) AddListener(ctx context.Context, lbID string, l *v1.LBListener) (*network.LoadBalancer, error) {
+	if l == nil {
+		return nil, network.Invalidf("listener is required")
+	}
+	listener, err := fromProtoLBListener(l)
 	if err != nil {
 		return nil, err
 	}
+	return s.controller.AddListener(ctx, lbID, listener)
+}
 
-	return &v1.CreateSubnetResponse{
-		Subnet: toProtoSubnet(subnet),
-	}, nil
+// RemoveListener removes a listener from a load balancer.
+func (s *NetworkService) RemoveListener(ctx context.Context, lbID, listenerID string) (*network.LoadBalancer, error) {
+	return s.controller.RemoveListener(ctx, lbID, listenerID)
 }
 
-// GetSubnet implements the gRPC GetSubnet method.
-func (h *NetworkGRPCHandler) GetSubnet(ctx context.Context, req *v1.GetSubnetRequest) (*v1.GetSubnetResponse, error) {
-	subnet, err := h.service.GetSubnet(ctx, req.SubnetId)
+// AddPoolMembers adds members to the pool of a listener.
+func (s *NetworkService) AddPoolMembers(ctx context.Context, lbID, listenerID string, members []*v1.LBMember) (*network.LoadBalancer, error) {
+	converted, err := fromProtoLBMembers(members)
 	if err != nil {
 		return nil, err
 	}
-
-	return &v1.GetSubnetResponse{
-		Subnet: toProtoSubnet(subnet),
-	}, nil
+	return s.controller.AddPoolMembers(ctx, lbID, listenerID, converted)
 }
 
-// ListSubnets implements the gRPC ListSubnets method.
-func (h *NetworkGRPCHandler) ListSubnets(ctx context.Context, req *v1.ListSubnetsRequest) (*v1.ListSubnetsResponse, error) {
-	subnets, err := h.service.ListSubnets(ctx, req.NetworkId)
+// RemovePoolMembers removes members from the pool of a listener.
+func (s *NetworkService) RemovePoolMembers(ctx context.Context, lbID, listenerID string, members []*v1.LBMember) (*network.LoadBalancer, error) {
+	converted, err := fromProtoLBMembers(members)
 	if err != nil {
 		return nil, err
 	}
+	return s.controller.RemovePoolMembers(ctx, lbID, listenerID, converted)
+}
 
-	protoSubnets := make([]*v1.Subnet, len(subnets))
-	for i, subnet := range subnets {
-		protoSubnets[i] = toProtoSubnet(subnet)
-	}
-
-	return &v1.ListSubnetsResponse{
-		Subnets: protoSubnets,
-	}, nil
+// SetHealthMonitor sets or removes the health monitor of a listener's pool.
+func (s *NetworkService) SetHealthMonitor(ctx context.Context, lbID, listenerID string, monitor *v1.LBHealthMonitor) (*network.LoadBalancer, error) {
+	return s.controller.SetHealthMonitor(ctx, lbID, listenerID, fromProtoLBHealthMonitor(monitor))
 }
 
-// DeleteSubnet implements the gRPC DeleteSubnet method.
-func (h *NetworkGRPCHandler) DeleteSubnet(ctx context.Context, req *v1.DeleteSubnetRequest) (*v1.DeleteSubnetResponse, error) {
-	if err := h.service.DeleteSubnet(ctx, req.SubnetId); err != nil {
+// CreateVPNService creates a VPN service on the requested node, or on the
+// node serving the fewest of those that finished their SDN bootstrap.
+func (s *NetworkService) CreateVPNService(ctx context.Context, req *v1.CreateVPNServiceRequest) (*network.VPNService, error) {
+	if req.ListenPort > 65535 {
+		return nil, network.Invalidf("invalid listen port %d", req.ListenPort)
+	}
+	peers := make([]network.VPNPeer, 0, len(req.Peers))
+	for _, p := range req.Peers {
+		peers = append(peers, *fromProtoVPNPeer(p))
+	}
+	vpn := &network.VPNService{
+		ID:         generateID(),
+		Name:       req.Name,
+		TenantID:   req.TenantId,
+		RouterID:   req.RouterId,
+		NodeID:     req.NodeId,
+		ListenPort: uint16(req.ListenPort),
+		Peers:      peers,
+	}
+
+	nodes, err := s.candidateNodes(ctx, req.NodeId)
+	if err != nil {
 		return nil, err
 	}
-	return &v1.DeleteSubnetResponse{}, nil
+	if err := s.controller.CreateVPNService(ctx, vpn, nodes); err != nil {
+		return nil, fmt.Errorf("failed to create VPN service: %w", err)
+	}
+	return vpn, nil
 }
 
-// CreatePort implements the gRPC CreatePort method.
-func (h *NetworkGRPCHandler) CreatePort(ctx context.Context, req *v1.CreatePortRequest) (*v1.CreatePortResponse, error) {
-	port, err := h.service.CreatePort(ctx, req)
+// GetVPNService retrieves a VPN service by ID, with the state of its
+// tunnels if the node serving it reported any.
+func (s *NetworkService) GetVPNService(ctx context.Context, vpnID string) (*network.VPNService, *network.VPNStatus, error) {
+	vpn, err := s.controller.GetVPNService(ctx, vpnID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	status, err := s.controller.GetVPNStatus(ctx, vpn)
+	if err != nil {
+		return nil, nil, err
 	}
+	return vpn, status, nil
+}
 
-	return &v1.CreatePortResponse{
-		Port: toProtoPort(port),
-	}, nil
+// ListVPNServices lists VPN services, optionally those of a tenant.
+func (s *NetworkService) ListVPNServices(ctx context.Context, tenantID string) ([]*network.VPNService, error) {
+	return s.controller.ListVPNServices(ctx, tenantID)
 }
 
-// GetPort implements the gRPC GetPort method.
-func (h *NetworkGRPCHandler) GetPort(ctx context.Context, req *v1.GetPortRequest) (*v1.GetPortResponse, error) {
-	port, err := h.service.GetPort(ctx, req.PortId)
-	if err != nil {
-		return nil, err
+// DeleteVPNService deletes a VPN service.
+func (s *NetworkService) DeleteVPNService(ctx context.Context, vpnID string) error {
+	return s.controller.DeleteVPNService(ctx, vpnID)
+}
+
+// AddVPNPeer adds a remote site to a VPN service.
+func (s *NetworkService) AddVPNPeer(ctx context.Context, vpnID string, p *v1.VPNPeer) (*network.VPNService, error) {
+	if p == nil {
+		return nil, network.Invalidf("peer is required")
 	}
+	return s.controller.AddVPNPeer(ctx, vpnID, fromProtoVPNPeer(p))
+}
 
-	return &v1.GetPortResponse{
-		Port: toProtoPort(port),
-	}, nil
+// RemoveVPNPeer removes a remote site from a VPN service.
+func (s *NetworkService) RemoveVPNPeer(ctx context.Context, vpnID, peerID string) (*network.VPNService, error) {
+	return s.controller.RemoveVPNPeer(ctx, vpnID, peerID)
 }
 
-// ListPorts implements the gRPC ListPorts method.
-func (h *NetworkGRPCHandler) ListPorts(ctx context.Context, req *v1.ListPortsRequest) (*v1.ListPortsResponse, error) {
-	ports, err := h.service.ListPorts(ctx, req.NetworkId, req.InstanceId, req.NodeId)
+// RotateVPNKey gives a VPN service a new key pair.
+func (s *NetworkService) RotateVPNKey(ctx context.Context, vpnID string) (*network.VPNService, error) {
+	return s.controller.RotateVPNKey(ctx, vpnID)
+}
+
+// candidateNodes returns the nodes a load balancer or VPN service may be
+// placed on: the requested node, which must have finished its SDN bootstrap,
+// or without one, every node that has.
+func (s *NetworkService) candidateNodes(ctx context.Context, nodeID string) ([]string, error) {
+	if nodeID != "" {
+		if err := s.checkBootstrapped(ctx, nodeID); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	vteps, err := s.vtepMgr.ListVTEPs(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	protoPorts := make([]*v1.Port, len(ports))
-	for i, port := range ports {
-		protoPorts[i] = toProtoPort(port)
+	nodes := make([]string, 0, len(vteps))
+	for _, vtep := range vteps {
+		nodes = append(nodes, vtep.NodeID)
 	}
+	return nodes, nil
+}
 
-	return &v1.ListPortsResponse{
-		Ports: protoPorts,
-	}, nil
+// BindPort binds a port to an instance. The node must have finished its
+// SDN bootstrap, which it signals by registering its VTEP.
+func (s *NetworkService) BindPort(ctx context.Context, portID, instanceID, nodeID, deviceName string) error {
+	if nodeID != "" {
+		if err := s.checkBootstrapped(ctx, nodeID); err != nil {
+			return err
+		}
+	}
+	return s.controller.BindPort(ctx, portID, instanceID, nodeID, deviceName)
 }
 
-// DeletePort implements the gRPC DeletePort method.
-func (h *NetworkGRPCHandler) DeletePort(ctx context.Context, req *v1.DeletePortRequest) (*v1.DeletePortResponse, error) {
-	if err := h.service.DeletePort(ctx, req.PortId); err != nil {
-		return nil, err
+// checkBootstrapped fails unless a node has registered its VTEP.
+func (s *NetworkService) checkBootstrapped(ctx context.Context, nodeID string) error {
+	if _, err := s.vtepMgr.LookupVTEP(ctx, nodeID); err != nil {
+		if errors.Is(err, overlay.ErrVTEPNotFound) {
+			return status.Errorf(codes.FailedPrecondition, "node %s has not finished SDN bootstrap (no VTEP registered)", nodeID)
+		}
+		return fmt.Errorf("failed to look up VTEP of node %s: %w", nodeID, err)
 	}
-	return &v1.DeletePortResponse{}, nil
+	return nil
 }
 
-// AllocateIP implements the gRPC AllocateIP method.
-func (h *NetworkGRPCHandler) AllocateIP(ctx context.Context, req *v1.AllocateIPRequest) (*v1.AllocateIPResponse, error) {
-	alloc, err := h.service.AllocateIP(ctx, req.SubnetId, req.IpAddress, req.InstanceId, req.PortId)
+// AddAllocationPool adds an allocation pool to a subnet.
+func (s *NetworkService) AddAllocationPool(ctx context.Context, subnetID string, pool network.IPPool) (*network.Subnet, error) {
+	return s.ipam.AddAllocationPool(ctx, subnetID, pool)
+}
+
+// RemoveAllocationPool removes an allocation pool from a subnet.
+func (s *NetworkService) RemoveAllocationPool(ctx context.Context, subnetID, start string) (*network.Subnet, error) {
+	return s.ipam.RemoveAllocationPool(ctx, subnetID, start)
+}
+
+// ExpandSubnet grows a subnet's allocation pools, widening its CIDR if
+// requested, and re-addresses router interfaces on the subnet. It returns the
+// subnet, the added pools and the routers that were updated.
+func (s *NetworkService) ExpandSubnet(ctx context.Context, req *v1.ExpandSubnetRequest) (*network.Subnet, []network.IPPool, []string, error) {
+	subnet, added, err := s.ipam.ExpandSubnet(ctx, req.SubnetId, ipam.ExpandOptions{
+		CIDR:   req.Cidr,
+		Zone:   req.Zone,
+		DryRun: req.DryRun,
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, fmt.Errorf("failed to expand subnet: %w", err)
 	}
 
-	return &v1.AllocateIPResponse{
-		Allocation: &v1.IPAllocation{
-			Id:         alloc.ID,
-			SubnetId:   alloc.SubnetID,
-			IpAddress:  alloc.IPAddress,
-			MacAddress: alloc.MACAddress,
-			InstanceId: alloc.InstanceID,
-			PortId:     alloc.PortID,
-			Hostname:   alloc.Hostname,
-			Status:     alloc.Status,
-			CreatedAt:  timestamppb.New(alloc.CreatedAt),
-		},
-	}, nil
+	if req.DryRun {
+		return subnet, added, nil, nil
+	}
+	s.recordSubnetEvent(ctx, subnet.ID, "Expanded", fmt.Sprintf("added %d pools, CIDR %s", len(added), subnet.CIDR))
+	if req.Cidr == "" {
+		return subnet, added, nil, nil
+	}
+
+	routerIDs, err := s.controller.UpdateSubnetInterfaces(ctx, subnet)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to update router interfaces: %w", err)
+	}
+
+	return subnet, added, routerIDs, nil
 }
 
-// ReleaseIP implements the gRPC ReleaseIP method.
-func (h *NetworkGRPCHandler) ReleaseIP(ctx context.Context, req *v1.ReleaseIPRequest) (*v1.ReleaseIPResponse, error) {
-	if err := h.service.ReleaseIP(ctx, req.SubnetId, req.IpAddress); err != nil {
+// SplitSubnet replaces a subnet with one child subnet per zone. Subnets
+// attached to a router must be detached first.
+func (s *NetworkService) SplitSubnet(ctx context.Context, req *v1.SplitSubnetRequest) ([]*network.Subnet, error) {
+	subnet, err := s.ipam.GetSubnet(ctx, req.SubnetId)
+	if err != nil {
 		return nil, err
 	}
-	return &v1.ReleaseIPResponse{}, nil
-}
 
-// Helper functions to convert between internal and proto types
+	children, err := s.ipam.PlanSplit(subnet, req.Zones)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan subnet split: %w", err)
+	}
+	for _, child := range children {
+		child.ID = generateID()
+	}
+
+	if req.DryRun {
+		return children, nil
+	}
+
+	routerIDs, err := s.controller.SubnetRouters(ctx, subnet.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(routerIDs) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "subnet %s is attached to routers %v, remove the router interfaces first", subnet.ID, routerIDs)
+	}
+
+	if err := s.controller.SplitSubnet(ctx, subnet.ID, children); err != nil {
+		return nil, fmt.Errorf("failed to split subnet: %w", err)
+	}
+
+	cidrs := make([]string, len(children))
+	for i, child := range children {
+		cidrs[i] = child.CIDR
+	}
+	s.recordSubnetEvent(ctx, subnet.ID, "Split", fmt.Sprintf("split %s into %s", subnet.CIDR, strings.Join(cidrs, ", ")))
+
+	return children, nil
+}
+
+// AllocateIP allocates an IP from a subnet.
+func (s *NetworkService) AllocateIP(ctx context.Context, req *v1.AllocateIPRequest) (*network.IPAllocation, error) {
+	return s.ipam.AllocateIP(ctx, req.SubnetId, ipam.AllocationOptions{
+		IPAddress:  req.IpAddress,
+		MACAddress: req.MacAddress,
+		InstanceID: req.InstanceId,
+		PortID:     req.PortId,
+		Hostname:   req.Hostname,
+		Zone:       req.Zone,
+	})
+}
+
+// ReleaseIP releases an allocated IP.
+func (s *NetworkService) ReleaseIP(ctx context.Context, subnetID, ipAddress string) error {
+	return s.ipam.ReleaseIP(ctx, subnetID, ipAddress)
+}
+
+// CreateReservation reserves an IP of a subnet, or allocates it statically to
+// an appliance.
+func (s *NetworkService) CreateReservation(ctx context.Context, req *v1.CreateReservationRequest) (*network.IPAllocation, error) {
+	alloc, err := s.ipam.ReserveIP(ctx, req.SubnetId, ipam.ReservationOptions{
+		IPAddress:   req.IpAddress,
+		Static:      req.Static,
+		MACAddress:  req.MacAddress,
+		Hostname:    req.Hostname,
+		Description: req.Description,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.recordSubnetEvent(ctx, req.SubnetId, "Reserved", fmt.Sprintf("reserved %s (%s)", alloc.IPAddress, alloc.Status))
+	return alloc, nil
+}
+
+// ListReservations lists the reservations and static allocations of a subnet.
+func (s *NetworkService) ListReservations(ctx context.Context, subnetID string) ([]*network.IPAllocation, error) {
+	return s.ipam.ListReservations(ctx, subnetID)
+}
+
+// DeleteReservation releases a reservation or static allocation.
+func (s *NetworkService) DeleteReservation(ctx context.Context, subnetID, ipAddress string) error {
+	if err := s.ipam.DeleteReservation(ctx, subnetID, ipAddress); err != nil {
+		return err
+	}
+	s.recordSubnetEvent(ctx, subnetID, "Unreserved", fmt.Sprintf("released reservation of %s", ipAddress))
+	return nil
+}
+
+// CreateSecurityGroup creates a new security group.
+func (s *NetworkService) CreateSecurityGroup(ctx context.Context, req *v1.CreateSecurityGroupRequest) (*network.SecurityGroup, error) {
+	sg := &network.SecurityGroup{
+		ID:          generateID(),
+		Name:        req.Name,
+		Description: req.Description,
+		TenantID:    req.TenantId,
+	}
+
+	if err := s.controller.CreateSecurityGroup(ctx, sg); err != nil {
+		return nil, fmt.Errorf("failed to create security group: %w", err)
+	}
+
+	return sg, nil
+}
+
+// GetSecurityGroup retrieves a security group by ID.
+func (s *NetworkService) GetSecurityGroup(ctx context.Context, sgID string) (*network.SecurityGroup, error) {
+	return s.controller.GetSecurityGroup(ctx, sgID)
+}
+
+// ListSecurityGroups lists security groups with an optional tenant filter.
+func (s *NetworkService) ListSecurityGroups(ctx context.Context, tenantID string) ([]*network.SecurityGroup, error) {
+	return s.controller.ListSecurityGroups(ctx, tenantID)
+}
+
+// UpdateSecurityGroup updates a security group's name and description.
+func (s *NetworkService) UpdateSecurityGroup(ctx context.Context, req *v1.UpdateSecurityGroupRequest) (*network.SecurityGroup, error) {
+	if req.Name == "" && req.Description == "" {
+		return nil, network.Invalidf("nothing to update")
+	}
+	return s.controller.UpdateSecurityGroup(ctx, req.SecurityGroupId, req.Name, req.Description)
+}
+
+// DeleteSecurityGroup deletes a security group.
+func (s *NetworkService) DeleteSecurityGroup(ctx context.Context, sgID string) error {
+	return s.controller.DeleteSecurityGroup(ctx, sgID)
+}
+
+// AddSecurityRule adds a rule to a security group.
+func (s *NetworkService) AddSecurityRule(ctx context.Context, req *v1.AddSecurityRuleRequest) (*network.SecurityGroupRule, error) {
+	if req.PortRangeMin > 65535 || req.PortRangeMax > 65535 {
+		return nil, network.Invalidf("invalid port range %d-%d", req.PortRangeMin, req.PortRangeMax)
+	}
+
+	rule := network.SecurityGroupRule{
+		ID:             generateID(),
+		Direction:      fromProtoRuleDirection(req.Direction),
+		EtherType:      fromProtoEtherType(req.EtherType),
+		Protocol:       req.Protocol,
+		PortRangeMin:   uint16(req.PortRangeMin),
+		PortRangeMax:   uint16(req.PortRangeMax),
+		RemoteIPPrefix: req.RemoteIpPrefix,
+		RemoteGroupID:  req.RemoteGroupId,
+	}
+
+	added, err := s.controller.AddSecurityGroupRule(ctx, req.SecurityGroupId, rule)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add security rule: %w", err)
+	}
+	return added, nil
+}
+
+// RemoveSecurityRule removes a rule from a security group.
+func (s *NetworkService) RemoveSecurityRule(ctx context.Context, sgID, ruleID string) error {
+	return s.controller.RemoveSecurityGroupRule(ctx, sgID, ruleID)
+}
+
+// CreateRouter creates a router, with an external gateway if one is given.
+func (s *NetworkService) CreateRouter(ctx context.Context, req *v1.CreateRouterRequest) (*network.Router, error) {
+	router := &network.Router{
+		ID:          generateID(),
+		Name:        req.Name,
+		TenantID:    req.TenantId,
+		Distributed: req.Distributed,
+	}
+	if gw := req.ExternalGateway; gw != nil && gw.NetworkId != "" {
+		router.ExternalGatewayInfo = &network.ExternalGateway{
+			NetworkID:  gw.NetworkId,
+			EnableSNAT: gw.EnableSnat,
+		}
+	}
+
+	if err := s.controller.CreateRouter(ctx, router, generateID()); err != nil {
+		return nil, fmt.Errorf("failed to create router: %w", err)
+	}
+
+	return router, nil
+}
+
+// GetRouter retrieves a router and its interfaces.
+func (s *NetworkService) GetRouter(ctx context.Context, routerID string) (*network.Router, []*network.RouterInterface, error) {
+	router, err := s.controller.GetRouter(ctx, routerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	interfaces, err := s.controller.ListRouterInterfaces(ctx, routerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return router, interfaces, nil
+}
+
+// ListRouters lists routers with an optional tenant filter.
+func (s *NetworkService) ListRouters(ctx context.Context, tenantID string) ([]*network.Router, error) {
+	return s.controller.ListRouters(ctx, tenantID)
+}
+
+// DeleteRouter deletes a router.
+func (s *NetworkService) DeleteRouter(ctx context.Context, routerID string) error {
+	return s.controller.DeleteRouter(ctx, routerID)
+}
+
+// AddRouterInterface attaches a subnet to a router.
+func (s *NetworkService) AddRouterInterface(ctx context.Context, routerID, subnetID string) (*network.RouterInterface, error) {
+	iface, err := s.controller.AddRouterInterface(ctx, routerID, subnetID, generateID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to add router interface: %w", err)
+	}
+	return iface, nil
+}
+
+// RemoveRouterInterface detaches a subnet from a router.
+func (s *NetworkService) RemoveRouterInterface(ctx context.Context, routerID, subnetID string) error {
+	return s.controller.RemoveRouterInterface(ctx, routerID, subnetID)
+}
+
+// SetExternalGateway sets or clears a router's external gateway.
+func (s *NetworkService) SetExternalGateway(ctx context.Context, req *v1.SetExternalGatewayRequest) (*network.Router, error) {
+	router, err := s.controller.SetExternalGateway(ctx, req.RouterId, req.NetworkId, req.EnableSnat, generateID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to set external gateway: %w", err)
+	}
+	return router, nil
+}
+
+// CheckNodeNetwork verifies that an instance's overlay network can reach
+// nodeID: the network exists with the expected VNI and the node has a
+// registered VTEP to carry it.
+func (s *NetworkService) CheckNodeNetwork(ctx context.Context, spec driver.NetworkSpec, nodeID string) error {
+	vni := spec.VNI
+	if spec.NetworkID != "" {
+		net, err := s.controller.GetNetwork(ctx, spec.NetworkID)
+		if err != nil {
+			return fmt.Errorf("network %s not found: %w", spec.NetworkID, err)
+		}
+		if vni != 0 && !slices.Contains(net.VNIs(), vni) {
+			return fmt.Errorf("network %s has VNI %d, instance expects %d", net.ID, net.VNI, vni)
+		}
+		if vni == 0 {
+			vni = net.VNI
+		}
+	}
+	if vni == 0 {
+		return nil
+	}
+
+	if _, err := s.vtepMgr.LookupVTEP(ctx, nodeID); err != nil {
+		if errors.Is(err, overlay.ErrVTEPNotFound) {
+			return fmt.Errorf("node %s has no VTEP for VNI %d", nodeID, vni)
+		}
+		return fmt.Errorf("failed to look up VTEP of node %s: %w", nodeID, err)
+	}
+	return nil
+}
+
+// networkErr converts an error of the network service to a gRPC status,
+// choosing the code from the network error kind it wraps. Errors that
+// already carry a status are returned as is.
+func networkErr(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Internal
+	switch {
+	case errors.Is(err, network.ErrNotFound), errors.Is(err, etcd.ErrKeyNotFound):
+		code = codes.NotFound
+	case errors.Is(err, network.ErrAlreadyExists):
+		code = codes.AlreadyExists
+	case errors.Is(err, network.ErrInUse):
+		code = codes.FailedPrecondition
+	case errors.Is(err, network.ErrInvalid):
+		code = codes.InvalidArgument
+	case errors.Is(err, network.ErrExhausted):
+		code = codes.ResourceExhausted
+	case errors.Is(err, etcd.ErrConflict):
+		code = codes.Aborted
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+// NetworkGRPCHandler implements the gRPC NetworkService.
+type NetworkGRPCHandler struct {
+	v1.UnimplementedNetworkServiceServer
+	service *NetworkService
+}
+
+// NewNetworkGRPCHandler creates a new network gRPC handler.
+func NewNetworkGRPCHandler(service *NetworkService) *NetworkGRPCHandler {
+	return &NetworkGRPCHandler{service: service}
+}
+
+// CreateNetwork implements the gRPC CreateNetwork method.
+func (h *NetworkGRPCHandler) CreateNetwork(ctx context.Context, req *v1.CreateNetworkRequest) (*v1.CreateNetworkResponse, error) {
+	net, err := h.service.CreateNetwork(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.CreateNetworkResponse{
+		Network: toProtoNetwork(net),
+	}, nil
+}
+
+// GetNetwork implements the gRPC GetNetwork method.
+func (h *NetworkGRPCHandler) GetNetwork(ctx context.Context, req *v1.GetNetworkRequest) (*v1.GetNetworkResponse, error) {
+	var net *network.Network
+	var err error
+	switch {
+	case req.NetworkId != "":
+		net, err = h.service.GetNetwork(ctx, req.NetworkId)
+	case req.Name != "":
+		net, err = h.service.GetNetworkByName(ctx, req.TenantId, req.Name)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "network_id or name is required")
+	}
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetNetworkResponse{
+		Network: toProtoNetwork(net),
+	}, nil
+}
+
+// ListNetworks implements the gRPC ListNetworks method.
+func (h *NetworkGRPCHandler) ListNetworks(ctx context.Context, req *v1.ListNetworksRequest) (*v1.ListNetworksResponse, error) {
+	networks, err := h.service.ListNetworks(ctx, req.TenantId, req.Name)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	protoNetworks := make([]*v1.Network, len(networks))
+	for i, net := range networks {
+		protoNetworks[i] = toProtoNetwork(net)
+	}
+
+	return &v1.ListNetworksResponse{
+		Networks: protoNetworks,
+	}, nil
+}
+
+// UpdateNetwork implements the gRPC UpdateNetwork method.
+func (h *NetworkGRPCHandler) UpdateNetwork(ctx context.Context, req *v1.UpdateNetworkRequest) (*v1.UpdateNetworkResponse, error) {
+	mask, err := parseUpdateMask(req.UpdateMask, &v1.Network{}, networkMutableFields)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+	if id := req.Network.GetId(); id != "" && id != req.NetworkId {
+		return nil, status.Errorf(codes.InvalidArgument, "network.id %s does not match network_id %s", id, req.NetworkId)
+	}
+
+	net, err := h.service.UpdateNetwork(ctx, req.NetworkId, req.Network, mask)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.UpdateNetworkResponse{
+		Network: toProtoNetwork(net),
+	}, nil
+}
+
+// DeleteNetwork implements the gRPC DeleteNetwork method.
+func (h *NetworkGRPCHandler) DeleteNetwork(ctx context.Context, req *v1.DeleteNetworkRequest) (*v1.DeleteNetworkResponse, error) {
+	if err := h.service.DeleteNetwork(ctx, req.NetworkId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.DeleteNetworkResponse{}, nil
+}
+
+// CreateSubnet implements the gRPC CreateSubnet method.
+func (h *NetworkGRPCHandler) CreateSubnet(ctx context.Context, req *v1.CreateSubnetRequest) (*v1.CreateSubnetResponse, error) {
+	subnet, err := h.service.CreateSubnet(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.CreateSubnetResponse{
+		Subnet: toProtoSubnet(subnet),
+	}, nil
+}
+
+// GetSubnet implements the gRPC GetSubnet method.
+func (h *NetworkGRPCHandler) GetSubnet(ctx context.Context, req *v1.GetSubnetRequest) (*v1.GetSubnetResponse, error) {
+	var subnet *network.Subnet
+	var err error
+	switch {
+	case req.SubnetId != "":
+		subnet, err = h.service.GetSubnet(ctx, req.SubnetId)
+	case req.Name != "":
+		subnet, err = h.service.GetSubnetByName(ctx, req.TenantId, req.Name)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "subnet_id or name is required")
+	}
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetSubnetResponse{
+		Subnet: toProtoSubnet(subnet),
+	}, nil
+}
+
+// ListSubnets implements the gRPC ListSubnets method.
+func (h *NetworkGRPCHandler) ListSubnets(ctx context.Context, req *v1.ListSubnetsRequest) (*v1.ListSubnetsResponse, error) {
+	subnets, err := h.service.ListSubnets(ctx, req.NetworkId, req.Name)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	protoSubnets := make([]*v1.Subnet, len(subnets))
+	for i, subnet := range subnets {
+		protoSubnets[i] = toProtoSubnet(subnet)
+	}
+
+	return &v1.ListSubnetsResponse{
+		Subnets: protoSubnets,
+	}, nil
+}
+
+// DeleteSubnet implements the gRPC DeleteSubnet method.
+func (h *NetworkGRPCHandler) DeleteSubnet(ctx context.Context, req *v1.DeleteSubnetRequest) (*v1.DeleteSubnetResponse, error) {
+	deps, err := h.service.DeleteSubnet(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	protoDeps := make([]*v1.SubnetDependency, len(deps))
+	for i, dep := range deps {
+		protoDeps[i] = &v1.SubnetDependency{
+			Kind:     dep.Kind,
+			Id:       dep.ID,
+			Detail:   dep.Detail,
+			Blocking: dep.Blocking,
+		}
+	}
+
+	return &v1.DeleteSubnetResponse{
+		Dependencies: protoDeps,
+	}, nil
+}
+
+// AddAllocationPool implements the gRPC AddAllocationPool method.
+func (h *NetworkGRPCHandler) AddAllocationPool(ctx context.Context, req *v1.AddAllocationPoolRequest) (*v1.AddAllocationPoolResponse, error) {
+	if req.Pool == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "pool is required")
+	}
+
+	subnet, err := h.service.AddAllocationPool(ctx, req.SubnetId, fromProtoIPPool(req.Pool))
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.AddAllocationPoolResponse{
+		Subnet: toProtoSubnet(subnet),
+	}, nil
+}
+
+// RemoveAllocationPool implements the gRPC RemoveAllocationPool method.
+func (h *NetworkGRPCHandler) RemoveAllocationPool(ctx context.Context, req *v1.RemoveAllocationPoolRequest) (*v1.RemoveAllocationPoolResponse, error) {
+	subnet, err := h.service.RemoveAllocationPool(ctx, req.SubnetId, req.Start)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.RemoveAllocationPoolResponse{
+		Subnet: toProtoSubnet(subnet),
+	}, nil
+}
+
+// ExpandSubnet implements the gRPC ExpandSubnet method.
+func (h *NetworkGRPCHandler) ExpandSubnet(ctx context.Context, req *v1.ExpandSubnetRequest) (*v1.ExpandSubnetResponse, error) {
+	subnet, added, routerIDs, err := h.service.ExpandSubnet(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	pools := make([]*v1.IPPool, len(added))
+	for i := range added {
+		pools[i] = toProtoIPPool(added[i])
+	}
+
+	return &v1.ExpandSubnetResponse{
+		Subnet:           toProtoSubnet(subnet),
+		AddedPools:       pools,
+		UpdatedRouterIds: routerIDs,
+	}, nil
+}
+
+// SplitSubnet implements the gRPC SplitSubnet method.
+func (h *NetworkGRPCHandler) SplitSubnet(ctx context.Context, req *v1.SplitSubnetRequest) (*v1.SplitSubnetResponse, error) {
+	subnets, err := h.service.SplitSubnet(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	resp := &v1.SplitSubnetResponse{
+		Subnets: make([]*v1.Subnet, len(subnets)),
+	}
+	for i, subnet := range subnets {
+		resp.Subnets[i] = toProtoSubnet(subnet)
+	}
+	return resp, nil
+}
+
+// CreatePort implements the gRPC CreatePort method.
+func (h *NetworkGRPCHandler) CreatePort(ctx context.Context, req *v1.CreatePortRequest) (*v1.CreatePortResponse, error) {
+	port, err := h.service.CreatePort(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.CreatePortResponse{
+		Port: toProtoPort(port),
+	}, nil
+}
+
+// GetPort implements the gRPC GetPort method.
+func (h *NetworkGRPCHandler) GetPort(ctx context.Context, req *v1.GetPortRequest) (*v1.GetPortResponse, error) {
+	var port *network.Port
+	var err error
+	switch {
+	case req.PortId != "":
+		port, err = h.service.GetPort(ctx, req.PortId)
+	case req.Name != "":
+		port, err = h.service.GetPortByName(ctx, req.TenantId, req.Name)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "port_id or name is required")
+	}
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetPortResponse{
+		Port: toProtoPort(port),
+	}, nil
+}
+
+// ListPorts implements the gRPC ListPorts method.
+func (h *NetworkGRPCHandler) ListPorts(ctx context.Context, req *v1.ListPortsRequest) (*v1.ListPortsResponse, error) {
+	ports, err := h.service.ListPorts(ctx, req.NetworkId, req.InstanceId, req.NodeId, req.Name)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	protoPorts := make([]*v1.Port, len(ports))
+	for i, port := range ports {
+		protoPorts[i] = toProtoPort(port)
+	}
+
+	return &v1.ListPortsResponse{
+		Ports: protoPorts,
+	}, nil
+}
+
+// BindPort implements the gRPC BindPort method.
+func (h *NetworkGRPCHandler) BindPort(ctx context.Context, req *v1.BindPortRequest) (*v1.BindPortResponse, error) {
+	if err := h.service.BindPort(ctx, req.PortId, req.InstanceId, req.NodeId, req.DeviceName); err != nil {
+		return nil, networkErr(err)
+	}
+
+	port, err := h.service.GetPort(ctx, req.PortId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.BindPortResponse{
+		Port: toProtoPort(port),
+	}, nil
+}
+
+// UnbindPort implements the gRPC UnbindPort method.
+func (h *NetworkGRPCHandler) UnbindPort(ctx context.Context, req *v1.UnbindPortRequest) (*v1.UnbindPortResponse, error) {
+	port, err := h.service.UnbindPort(ctx, req.PortId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.UnbindPortResponse{
+		Port: toProtoPort(port),
+	}, nil
+}
+
+// DeletePort implements the gRPC DeletePort method.
+func (h *NetworkGRPCHandler) DeletePort(ctx context.Context, req *v1.DeletePortRequest) (*v1.DeletePortResponse, error) {
+	if err := h.service.DeletePort(ctx, req.PortId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.DeletePortResponse{}, nil
+}
+
+// SetPortQoS implements the gRPC SetPortQoS method.
+func (h *NetworkGRPCHandler) SetPortQoS(ctx context.Context, req *v1.SetPortQoSRequest) (*v1.SetPortQoSResponse, error) {
+	port, err := h.service.SetPortQoS(ctx, req.PortId, fromProtoPortQoS(req.Qos))
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.SetPortQoSResponse{
+		Port: toProtoPort(port),
+	}, nil
+}
+
+// GetPortStats implements the gRPC GetPortStats method.
+func (h *NetworkGRPCHandler) GetPortStats(ctx context.Context, req *v1.GetPortStatsRequest) (*v1.GetPortStatsResponse, error) {
+	stats, err := h.service.GetPortStats(ctx, req.PortId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetPortStatsResponse{
+		Stats: stats,
+	}, nil
+}
+
+// MirrorPort implements the gRPC MirrorPort method.
+func (h *NetworkGRPCHandler) MirrorPort(ctx context.Context, req *v1.MirrorPortRequest) (*v1.MirrorPortResponse, error) {
+	mirror, err := h.service.MirrorPort(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.MirrorPortResponse{
+		Mirror: toProtoPortMirror(mirror),
+	}, nil
+}
+
+// GetPortMirror implements the gRPC GetPortMirror method.
+func (h *NetworkGRPCHandler) GetPortMirror(ctx context.Context, req *v1.GetPortMirrorRequest) (*v1.GetPortMirrorResponse, error) {
+	mirror, err := h.service.GetPortMirror(ctx, req.MirrorId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetPortMirrorResponse{
+		Mirror: toProtoPortMirror(mirror),
+	}, nil
+}
+
+// ListPortMirrors implements the gRPC ListPortMirrors method.
+func (h *NetworkGRPCHandler) ListPortMirrors(ctx context.Context, req *v1.ListPortMirrorsRequest) (*v1.ListPortMirrorsResponse, error) {
+	mirrors, err := h.service.ListPortMirrors(ctx, req.PortId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	resp := &v1.ListPortMirrorsResponse{
+		Mirrors: make([]*v1.PortMirror, len(mirrors)),
+	}
+	for i, mirror := range mirrors {
+		resp.Mirrors[i] = toProtoPortMirror(mirror)
+	}
+	return resp, nil
+}
+
+// DeletePortMirror implements the gRPC DeletePortMirror method.
+func (h *NetworkGRPCHandler) DeletePortMirror(ctx context.Context, req *v1.DeletePortMirrorRequest) (*v1.DeletePortMirrorResponse, error) {
+	if err := h.service.DeletePortMirror(ctx, req.MirrorId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.DeletePortMirrorResponse{}, nil
+}
+
+// CreateTrunk implements the gRPC CreateTrunk method.
+func (h *NetworkGRPCHandler) CreateTrunk(ctx context.Context, req *v1.CreateTrunkRequest) (*v1.CreateTrunkResponse, error) {
+	trunk, err := h.service.CreateTrunk(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.CreateTrunkResponse{
+		Trunk: toProtoTrunk(trunk),
+	}, nil
+}
+
+// GetTrunk implements the gRPC GetTrunk method.
+func (h *NetworkGRPCHandler) GetTrunk(ctx context.Context, req *v1.GetTrunkRequest) (*v1.GetTrunkResponse, error) {
+	trunk, err := h.service.GetTrunk(ctx, req.TrunkId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetTrunkResponse{
+		Trunk: toProtoTrunk(trunk),
+	}, nil
+}
+
+// ListTrunks implements the gRPC ListTrunks method.
+func (h *NetworkGRPCHandler) ListTrunks(ctx context.Context, req *v1.ListTrunksRequest) (*v1.ListTrunksResponse, error) {
+	trunks, err := h.service.ListTrunks(ctx)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	resp := &v1.ListTrunksResponse{
+		Trunks: make([]*v1.Trunk, len(trunks)),
+	}
+	for i, trunk := range trunks {
+		resp.Trunks[i] = toProtoTrunk(trunk)
+	}
+	return resp, nil
+}
+
+// DeleteTrunk implements the gRPC DeleteTrunk method.
+func (h *NetworkGRPCHandler) DeleteTrunk(ctx context.Context, req *v1.DeleteTrunkRequest) (*v1.DeleteTrunkResponse, error) {
+	if err := h.service.DeleteTrunk(ctx, req.TrunkId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.DeleteTrunkResponse{}, nil
+}
+
+// AddSubPorts implements the gRPC AddSubPorts method.
+func (h *NetworkGRPCHandler) AddSubPorts(ctx context.Context, req *v1.AddSubPortsRequest) (*v1.AddSubPortsResponse, error) {
+	trunk, err := h.service.AddSubPorts(ctx, req.TrunkId, req.SubPorts)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.AddSubPortsResponse{
+		Trunk: toProtoTrunk(trunk),
+	}, nil
+}
+
+// RemoveSubPorts implements the gRPC RemoveSubPorts method.
+func (h *NetworkGRPCHandler) RemoveSubPorts(ctx context.Context, req *v1.RemoveSubPortsRequest) (*v1.RemoveSubPortsResponse, error) {
+	trunk, err := h.service.RemoveSubPorts(ctx, req.TrunkId, req.PortIds)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.RemoveSubPortsResponse{
+		Trunk: toProtoTrunk(trunk),
+	}, nil
+}
+
+// CreateLoadBalancer implements the gRPC CreateLoadBalancer method.
+func (h *NetworkGRPCHandler) CreateLoadBalancer(ctx context.Context, req *v1.CreateLoadBalancerRequest) (*v1.CreateLoadBalancerResponse, error) {
+	lb, err := h.service.CreateLoadBalancer(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.CreateLoadBalancerResponse{
+		LoadBalancer: toProtoLoadBalancer(lb),
+	}, nil
+}
+
+// GetLoadBalancer implements the gRPC GetLoadBalancer method.
+func (h *NetworkGRPCHandler) GetLoadBalancer(ctx context.Context, req *v1.GetLoadBalancerRequest) (*v1.GetLoadBalancerResponse, error) {
+	lb, err := h.service.GetLoadBalancer(ctx, req.LoadBalancerId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetLoadBalancerResponse{
+		LoadBalancer: toProtoLoadBalancer(lb),
+	}, nil
+}
+
+// ListLoadBalancers implements the gRPC ListLoadBalancers method.
+func (h *NetworkGRPCHandler) ListLoadBalancers(ctx context.Context, req *v1.ListLoadBalancersRequest) (*v1.ListLoadBalancersResponse, error) {
+	lbs, err := h.service.ListLoadBalancers(ctx, req.TenantId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	resp := &v1.ListLoadBalancersResponse{
+		LoadBalancers: make([]*v1.LoadBalancer, len(lbs)),
+	}
+	for i, lb := range lbs {
+		resp.LoadBalancers[i] = toProtoLoadBalancer(lb)
+	}
+	return resp, nil
+}
+
+// DeleteLoadBalancer implements the gRPC DeleteLoadBalancer method.
+func (h *NetworkGRPCHandler) DeleteLoadBalancer(ctx context.Context, req *v1.DeleteLoadBalancerRequest) (*v1.DeleteLoadBalancerResponse, error) {
+	if err := h.service.DeleteLoadBalancer(ctx, req.LoadBalancerId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.DeleteLoadBalancerResponse{}, nil
+}
+
+// AddListener implements the gRPC AddListener method.
+func (h *NetworkGRPCHandler) AddListener(ctx context.Context, req *v1.AddListenerRequest) (*v1.AddListenerResponse, error) {
+	lb, err := h.service.AddListener(ctx, req.LoadBalancerId, req.Listener)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.AddListenerResponse{
+		LoadBalancer: toProtoLoadBalancer(lb),
+	}, nil
+}
+
+// RemoveListener implements the gRPC RemoveListener method.
+func (h *NetworkGRPCHandler) RemoveListener(ctx context.Context, req *v1.RemoveListenerRequest) (*v1.RemoveListenerResponse, error) {
+	lb, err := h.service.RemoveListener(ctx, req.LoadBalancerId, req.ListenerId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.RemoveListenerResponse{
+		LoadBalancer: toProtoLoadBalancer(lb),
+	}, nil
+}
+
+// AddPoolMembers implements the gRPC AddPoolMembers method.
+func (h *NetworkGRPCHandler) AddPoolMembers(ctx context.Context, req *v1.AddPoolMembersRequest) (*v1.AddPoolMembersResponse, error) {
+	lb, err := h.service.AddPoolMembers(ctx, req.LoadBalancerId, req.ListenerId, req.Members)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.AddPoolMembersResponse{
+		LoadBalancer: toProtoLoadBalancer(lb),
+	}, nil
+}
+
+// RemovePoolMembers implements the gRPC RemovePoolMembers method.
+func (h *NetworkGRPCHandler) RemovePoolMembers(ctx context.Context, req *v1.RemovePoolMembersRequest) (*v1.RemovePoolMembersResponse, error) {
+	lb, err := h.service.RemovePoolMembers(ctx, req.LoadBalancerId, req.ListenerId, req.Members)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.RemovePoolMembersResponse{
+		LoadBalancer: toProtoLoadBalancer(lb),
+	}, nil
+}
+
+// SetHealthMonitor implements the gRPC SetHealthMonitor method.
+func (h *NetworkGRPCHandler) SetHealthMonitor(ctx context.Context, req *v1.SetHealthMonitorRequest) (*v1.SetHealthMonitorResponse, error) {
+	lb, err := h.service.SetHealthMonitor(ctx, req.LoadBalancerId, req.ListenerId, req.HealthMonitor)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.SetHealthMonitorResponse{
+		LoadBalancer: toProtoLoadBalancer(lb),
+	}, nil
+}
+
+// CreateVPNService implements the gRPC CreateVPNService method.
+func (h *NetworkGRPCHandler) CreateVPNService(ctx context.Context, req *v1.CreateVPNServiceRequest) (*v1.CreateVPNServiceResponse, error) {
+	vpn, err := h.service.CreateVPNService(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.CreateVPNServiceResponse{
+		VpnService: toProtoVPNService(vpn, nil),
+	}, nil
+}
+
+// GetVPNService implements the gRPC GetVPNService method.
+func (h *NetworkGRPCHandler) GetVPNService(ctx context.Context, req *v1.GetVPNServiceRequest) (*v1.GetVPNServiceResponse, error) {
+	vpn, status, err := h.service.GetVPNService(ctx, req.VpnServiceId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetVPNServiceResponse{
+		VpnService: toProtoVPNService(vpn, status),
+	}, nil
+}
+
+// ListVPNServices implements the gRPC ListVPNServices method.
+func (h *NetworkGRPCHandler) ListVPNServices(ctx context.Context, req *v1.ListVPNServicesRequest) (*v1.ListVPNServicesResponse, error) {
+	services, err := h.service.ListVPNServices(ctx, req.TenantId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	resp := &v1.ListVPNServicesResponse{
+		VpnServices: make([]*v1.VPNService, len(services)),
+	}
+	for i, vpn := range services {
+		resp.VpnServices[i] = toProtoVPNService(vpn, nil)
+	}
+	return resp, nil
+}
+
+// DeleteVPNService implements the gRPC DeleteVPNService method.
+func (h *NetworkGRPCHandler) DeleteVPNService(ctx context.Context, req *v1.DeleteVPNServiceRequest) (*v1.DeleteVPNServiceResponse, error) {
+	if err := h.service.DeleteVPNService(ctx, req.VpnServiceId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.DeleteVPNServiceResponse{}, nil
+}
+
+// AddVPNPeer implements the gRPC AddVPNPeer method.
+func (h *NetworkGRPCHandler) AddVPNPeer(ctx context.Context, req *v1.AddVPNPeerRequest) (*v1.AddVPNPeerResponse, error) {
+	vpn, err := h.service.AddVPNPeer(ctx, req.VpnServiceId, req.Peer)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.AddVPNPeerResponse{
+		VpnService: toProtoVPNService(vpn, nil),
+	}, nil
+}
+
+// RemoveVPNPeer implements the gRPC RemoveVPNPeer method.
+func (h *NetworkGRPCHandler) RemoveVPNPeer(ctx context.Context, req *v1.RemoveVPNPeerRequest) (*v1.RemoveVPNPeerResponse, error) {
+	vpn, err := h.service.RemoveVPNPeer(ctx, req.VpnServiceId, req.PeerId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.RemoveVPNPeerResponse{
+		VpnService: toProtoVPNService(vpn, nil),
+	}, nil
+}
+
+// RotateVPNKey implements the gRPC RotateVPNKey method.
+func (h *NetworkGRPCHandler) RotateVPNKey(ctx context.Context, req *v1.RotateVPNKeyRequest) (*v1.RotateVPNKeyResponse, error) {
+	vpn, err := h.service.RotateVPNKey(ctx, req.VpnServiceId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.RotateVPNKeyResponse{
+		VpnService: toProtoVPNService(vpn, nil),
+	}, nil
+}
+
+// AllocateIP implements the gRPC AllocateIP method.
+func (h *NetworkGRPCHandler) AllocateIP(ctx context.Context, req *v1.AllocateIPRequest) (*v1.AllocateIPResponse, error) {
+	alloc, err := h.service.AllocateIP(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.AllocateIPResponse{
+		Allocation: toProtoIPAllocation(alloc),
+	}, nil
+}
+
+// ReleaseIP implements the gRPC ReleaseIP method.
+func (h *NetworkGRPCHandler) ReleaseIP(ctx context.Context, req *v1.ReleaseIPRequest) (*v1.ReleaseIPResponse, error) {
+	if err := h.service.ReleaseIP(ctx, req.SubnetId, req.IpAddress); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.ReleaseIPResponse{}, nil
+}
+
+// CreateReservation implements the gRPC CreateReservation method.
+func (h *NetworkGRPCHandler) CreateReservation(ctx context.Context, req *v1.CreateReservationRequest) (*v1.CreateReservationResponse, error) {
+	alloc, err := h.service.CreateReservation(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.CreateReservationResponse{
+		Reservation: toProtoIPAllocation(alloc),
+	}, nil
+}
+
+// ListReservations implements the gRPC ListReservations method.
+func (h *NetworkGRPCHandler) ListReservations(ctx context.Context, req *v1.ListReservationsRequest) (*v1.ListReservationsResponse, error) {
+	allocs, err := h.service.ListReservations(ctx, req.SubnetId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	reservations := make([]*v1.IPAllocation, 0, len(allocs))
+	for _, alloc := range allocs {
+		reservations = append(reservations, toProtoIPAllocation(alloc))
+	}
+	return &v1.ListReservationsResponse{Reservations: reservations}, nil
+}
+
+// DeleteReservation implements the gRPC DeleteReservation method.
+func (h *NetworkGRPCHandler) DeleteReservation(ctx context.Context, req *v1.DeleteReservationRequest) (*v1.DeleteReservationResponse, error) {
+	if err := h.service.DeleteReservation(ctx, req.SubnetId, req.IpAddress); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.DeleteReservationResponse{}, nil
+}
+
+// CreateSecurityGroup implements the gRPC CreateSecurityGroup method.
+func (h *NetworkGRPCHandler) CreateSecurityGroup(ctx context.Context, req *v1.CreateSecurityGroupRequest) (*v1.CreateSecurityGroupResponse, error) {
+	sg, err := h.service.CreateSecurityGroup(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.CreateSecurityGroupResponse{
+		SecurityGroup: toProtoSecurityGroup(sg),
+	}, nil
+}
+
+// GetSecurityGroup implements the gRPC GetSecurityGroup method.
+func (h *NetworkGRPCHandler) GetSecurityGroup(ctx context.Context, req *v1.GetSecurityGroupRequest) (*v1.GetSecurityGroupResponse, error) {
+	sg, err := h.service.GetSecurityGroup(ctx, req.SecurityGroupId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetSecurityGroupResponse{
+		SecurityGroup: toProtoSecurityGroup(sg),
+	}, nil
+}
+
+// ListSecurityGroups implements the gRPC ListSecurityGroups method.
+func (h *NetworkGRPCHandler) ListSecurityGroups(ctx context.Context, req *v1.ListSecurityGroupsRequest) (*v1.ListSecurityGroupsResponse, error) {
+	groups, err := h.service.ListSecurityGroups(ctx, req.TenantId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	protoGroups := make([]*v1.SecurityGroup, len(groups))
+	for i, sg := range groups {
+		protoGroups[i] = toProtoSecurityGroup(sg)
+	}
+
+	return &v1.ListSecurityGroupsResponse{
+		SecurityGroups: protoGroups,
+	}, nil
+}
+
+// UpdateSecurityGroup implements the gRPC UpdateSecurityGroup method.
+func (h *NetworkGRPCHandler) UpdateSecurityGroup(ctx context.Context, req *v1.UpdateSecurityGroupRequest) (*v1.UpdateSecurityGroupResponse, error) {
+	sg, err := h.service.UpdateSecurityGroup(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.UpdateSecurityGroupResponse{
+		SecurityGroup: toProtoSecurityGroup(sg),
+	}, nil
+}
+
+// DeleteSecurityGroup implements the gRPC DeleteSecurityGroup method.
+func (h *NetworkGRPCHandler) DeleteSecurityGroup(ctx context.Context, req *v1.DeleteSecurityGroupRequest) (*v1.DeleteSecurityGroupResponse, error) {
+	if err := h.service.DeleteSecurityGroup(ctx, req.SecurityGroupId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.DeleteSecurityGroupResponse{}, nil
+}
+
+// AddSecurityRule implements the gRPC AddSecurityRule method.
+func (h *NetworkGRPCHandler) AddSecurityRule(ctx context.Context, req *v1.AddSecurityRuleRequest) (*v1.AddSecurityRuleResponse, error) {
+	rule, err := h.service.AddSecurityRule(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.AddSecurityRuleResponse{
+		Rule: toProtoSecurityGroupRule(rule),
+	}, nil
+}
+
+// RemoveSecurityRule implements the gRPC RemoveSecurityRule method.
+func (h *NetworkGRPCHandler) RemoveSecurityRule(ctx context.Context, req *v1.RemoveSecurityRuleRequest) (*v1.RemoveSecurityRuleResponse, error) {
+	if err := h.service.RemoveSecurityRule(ctx, req.SecurityGroupId, req.RuleId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.RemoveSecurityRuleResponse{}, nil
+}
+
+// CreateRouter implements the gRPC CreateRouter method.
+func (h *NetworkGRPCHandler) CreateRouter(ctx context.Context, req *v1.CreateRouterRequest) (*v1.CreateRouterResponse, error) {
+	router, err := h.service.CreateRouter(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.CreateRouterResponse{
+		Router: toProtoRouter(router, nil),
+	}, nil
+}
+
+// GetRouter implements the gRPC GetRouter method.
+func (h *NetworkGRPCHandler) GetRouter(ctx context.Context, req *v1.GetRouterRequest) (*v1.GetRouterResponse, error) {
+	router, interfaces, err := h.service.GetRouter(ctx, req.RouterId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.GetRouterResponse{
+		Router: toProtoRouter(router, interfaces),
+	}, nil
+}
+
+// ListRouters implements the gRPC ListRouters method.
+func (h *NetworkGRPCHandler) ListRouters(ctx context.Context, req *v1.ListRoutersRequest) (*v1.ListRoutersResponse, error) {
+	routers, err := h.service.ListRouters(ctx, req.TenantId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	protoRouters := make([]*v1.Router, len(routers))
+	for i, router := range routers {
+		protoRouters[i] = toProtoRouter(router, nil)
+	}
+
+	return &v1.ListRoutersResponse{
+		Routers: protoRouters,
+	}, nil
+}
+
+// DeleteRouter implements the gRPC DeleteRouter method.
+func (h *NetworkGRPCHandler) DeleteRouter(ctx context.Context, req *v1.DeleteRouterRequest) (*v1.DeleteRouterResponse, error) {
+	if err := h.service.DeleteRouter(ctx, req.RouterId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.DeleteRouterResponse{}, nil
+}
+
+// AddRouterInterface implements the gRPC AddRouterInterface method.
+func (h *NetworkGRPCHandler) AddRouterInterface(ctx context.Context, req *v1.AddRouterInterfaceRequest) (*v1.AddRouterInterfaceResponse, error) {
+	iface, err := h.service.AddRouterInterface(ctx, req.RouterId, req.SubnetId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.AddRouterInterfaceResponse{
+		PortId:          iface.PortID,
+		RouterInterface: toProtoRouterInterface(iface),
+	}, nil
+}
+
+// RemoveRouterInterface implements the gRPC RemoveRouterInterface method.
+func (h *NetworkGRPCHandler) RemoveRouterInterface(ctx context.Context, req *v1.RemoveRouterInterfaceRequest) (*v1.RemoveRouterInterfaceResponse, error) {
+	if err := h.service.RemoveRouterInterface(ctx, req.RouterId, req.SubnetId); err != nil {
+		return nil, networkErr(err)
+	}
+	return &v1.RemoveRouterInterfaceResponse{}, nil
+}
+
+// SetExternalGateway implements the gRPC SetExternalGateway method.
+func (h *NetworkGRPCHandler) SetExternalGateway(ctx context.Context, req *v1.SetExternalGatewayRequest) (*v1.SetExternalGatewayResponse, error) {
+	router, err := h.service.SetExternalGateway(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+
+	return &v1.SetExternalGatewayResponse{
+		Router: toProtoRouter(router, nil),
+	}, nil
+}
+
+// GetNetworkTopology implements the gRPC GetNetworkTopology method.
+func (h *NetworkGRPCHandler) GetNetworkTopology(ctx context.Context, req *v1.GetNetworkTopologyRequest) (*v1.GetNetworkTopologyResponse, error) {
+	resp, err := h.service.GetNetworkTopology(ctx, req.NetworkId, req.TenantId)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+	return resp, nil
+}
+
+// CheckConnectivity implements the gRPC CheckConnectivity method.
+func (h *NetworkGRPCHandler) CheckConnectivity(ctx context.Context, req *v1.CheckConnectivityRequest) (*v1.CheckConnectivityResponse, error) {
+	resp, err := h.service.CheckConnectivity(ctx, req)
+	if err != nil {
+		return nil, networkErr(err)
+	}
+	return resp, nil
+}
+
+// Helper functions to convert between internal and proto types
 
 func toProtoNetwork(n *network.Network) *v1.Network {
 	return &v1.Network{
@@ -433,16 +1976,98 @@ func toProtoNetwork(n *network.Network) *v1.Network {
 		AdminState: n.AdminState,
 		CreatedAt:  timestamppb.New(n.CreatedAt),
 		UpdatedAt:  timestamppb.New(n.UpdatedAt),
+
+		Description: n.Description,
+		Metadata: &v1.Metadata{
+			Labels:      n.Labels,
+			Annotations: n.Annotations,
+		},
+		Segments: toProtoSegments(n.Segments),
+		Bgp:      toProtoBGPConfig(n.BGP),
+	}
+}
+
+// toProtoBGPConfig converts a BGP configuration, leaving out the peer
+// passwords.
+func toProtoBGPConfig(c *network.BGPConfig) *v1.BGPConfig {
+	if c == nil {
+		return nil
+	}
+	config := &v1.BGPConfig{LocalAs: c.LocalAS, Nodes: c.Nodes}
+	for _, peer := range c.Peers {
+		config.Peers = append(config.Peers, &v1.BGPPeer{
+			Address:  peer.Address,
+			RemoteAs: peer.RemoteAS,
+			Nodes:    peer.Nodes,
+		})
+	}
+	return config
+}
+
+func fromProtoBGPConfig(c *v1.BGPConfig) *network.BGPConfig {
+	if c == nil {
+		return nil
+	}
+	config := &network.BGPConfig{LocalAS: c.LocalAs, Nodes: c.Nodes}
+	for _, peer := range c.Peers {
+		config.Peers = append(config.Peers, network.BGPPeer{
+			Address:  peer.Address,
+			RemoteAS: peer.RemoteAs,
+			Password: peer.Password,
+			Nodes:    peer.Nodes,
+		})
+	}
+	return config
+}
+
+// keepBGPPasswords gives the peers of an updated BGP configuration without
+// a password the stored password of the same peer, since passwords are
+// never returned for a client to send back.
+func keepBGPPasswords(config, stored *network.BGPConfig) *network.BGPConfig {
+	if config == nil || stored == nil {
+		return config
+	}
+	for i := range config.Peers {
+		peer := &config.Peers[i]
+		if peer.Password != "" {
+			continue
+		}
+		for _, old := range stored.Peers {
+			if sameBGPPeer(old.Address, peer.Address) {
+				peer.Password = old.Password
+				break
+			}
+		}
+	}
+	return config
+}
+
+// sameBGPPeer reports whether two peer addresses are the same, stored ones
+// being normalized.
+func sameBGPPeer(a, b string) bool {
+	ipA, errA := netip.ParseAddr(a)
+	ipB, errB := netip.ParseAddr(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return ipA.Unmap() == ipB.Unmap()
+}
+
+func toProtoSegments(segments []network.NetworkSegment) []*v1.NetworkSegment {
+	if len(segments) == 0 {
+		return nil
 	}
+	result := make([]*v1.NetworkSegment, len(segments))
+	for i, segment := range segments {
+		result[i] = &v1.NetworkSegment{Zone: segment.Zone, Vni: segment.VNI}
+	}
+	return result
 }
 
 func toProtoSubnet(s *network.Subnet) *v1.Subnet {
 	pools := make([]*v1.IPPool, len(s.AllocationPools))
 	for i, pool := range s.AllocationPools {
-		pools[i] = &v1.IPPool{
-			Start: pool.Start,
-			End:   pool.End,
-		}
+		pools[i] = toProtoIPPool(pool)
 	}
 
 	return &v1.Subnet{
@@ -460,6 +2085,43 @@ func toProtoSubnet(s *network.Subnet) *v1.Subnet {
 	}
 }
 
+func toProtoIPPool(p network.IPPool) *v1.IPPool {
+	return &v1.IPPool{
+		Start:       p.Start,
+		End:         p.End,
+		Name:        p.Name,
+		Type:        string(p.Type),
+		Zone:        p.Zone,
+		ReservedFor: p.ReservedFor,
+	}
+}
+
+func toProtoIPAllocation(a *network.IPAllocation) *v1.IPAllocation {
+	return &v1.IPAllocation{
+		Id:          a.ID,
+		SubnetId:    a.SubnetID,
+		IpAddress:   a.IPAddress,
+		MacAddress:  a.MACAddress,
+		InstanceId:  a.InstanceID,
+		PortId:      a.PortID,
+		Hostname:    a.Hostname,
+		Status:      a.Status,
+		Description: a.Description,
+		CreatedAt:   timestamppb.New(a.CreatedAt),
+	}
+}
+
+func fromProtoIPPool(p *v1.IPPool) network.IPPool {
+	return network.IPPool{
+		Name:        p.Name,
+		Start:       p.Start,
+		End:         p.End,
+		Type:        network.IPPoolType(p.Type),
+		Zone:        p.Zone,
+		ReservedFor: p.ReservedFor,
+	}
+}
+
 func toProtoPort(p *network.Port) *v1.Port {
 	return &v1.Port{
 		Id:             p.ID,
@@ -474,12 +2136,443 @@ func toProtoPort(p *network.Port) *v1.Port {
 		SecurityGroups: p.SecurityGroups,
 		Status:         p.Status,
 		AdminState:     p.AdminState,
+		Zone:           p.Zone,
+		Qos:            toProtoPortQoS(p.QoS),
+		BindingType:    toProtoPortBindingType(p.BindingType),
+		ParentPortId:   p.ParentPortID,
+		VlanTag:        uint32(p.VLANTag),
 		CreatedAt:      timestamppb.New(p.CreatedAt),
 		UpdatedAt:      timestamppb.New(p.UpdatedAt),
 	}
 }
 
+func toProtoPortQoS(q *network.PortQoS) *v1.PortQoS {
+	if q == nil {
+		return nil
+	}
+	return &v1.PortQoS{
+		IngressRateKbps: q.IngressRateKbps,
+		IngressBurstKb:  q.IngressBurstKb,
+		EgressRateKbps:  q.EgressRateKbps,
+		EgressBurstKb:   q.EgressBurstKb,
+	}
+}
+
+func fromProtoPortQoS(q *v1.PortQoS) *network.PortQoS {
+	if q == nil {
+		return nil
+	}
+	return &network.PortQoS{
+		IngressRateKbps: q.IngressRateKbps,
+		IngressBurstKb:  q.IngressBurstKb,
+		EgressRateKbps:  q.EgressRateKbps,
+		EgressBurstKb:   q.EgressBurstKb,
+	}
+}
+
+func toProtoPortMirror(m *network.PortMirror) *v1.PortMirror {
+	direction := v1.MirrorDirection_MIRROR_DIRECTION_UNSPECIFIED
+	switch m.Direction {
+	case network.MirrorIngress:
+		direction = v1.MirrorDirection_MIRROR_DIRECTION_INGRESS
+	case network.MirrorEgress:
+		direction = v1.MirrorDirection_MIRROR_DIRECTION_EGRESS
+	case network.MirrorBoth:
+		direction = v1.MirrorDirection_MIRROR_DIRECTION_BOTH
+	}
+
+	var tunnel *v1.MirrorTunnel
+	if t := m.Tunnel; t != nil {
+		tunnel = &v1.MirrorTunnel{Type: t.Type, RemoteIp: t.RemoteIP, Key: t.Key}
+	}
+
+	return &v1.PortMirror{
+		Id:           m.ID,
+		Name:         m.Name,
+		SourcePortId: m.SourcePortID,
+		Direction:    direction,
+		TargetPortId: m.TargetPortID,
+		Tunnel:       tunnel,
+		Status:       m.Status,
+		CreatedAt:    timestamppb.New(m.CreatedAt),
+		UpdatedAt:    timestamppb.New(m.UpdatedAt),
+	}
+}
+
+func toProtoTrunk(t *network.Trunk) *v1.Trunk {
+	subPorts := make([]*v1.SubPort, len(t.SubPorts))
+	for i, sp := range t.SubPorts {
+		subPorts[i] = &v1.SubPort{PortId: sp.PortID, VlanTag: uint32(sp.VLANTag)}
+	}
+	return &v1.Trunk{
+		Id:           t.ID,
+		Name:         t.Name,
+		ParentPortId: t.ParentPortID,
+		SubPorts:     subPorts,
+		CreatedAt:    timestamppb.New(t.CreatedAt),
+		UpdatedAt:    timestamppb.New(t.UpdatedAt),
+	}
+}
+
+// fromProtoSubPorts converts subports, rejecting tags that do not fit a
+// VLAN ID rather than truncating them.
+func fromProtoSubPorts(subPorts []*v1.SubPort) ([]network.SubPort, error) {
+	converted := make([]network.SubPort, 0, len(subPorts))
+	for _, sp := range subPorts {
+		if sp.VlanTag > 4094 {
+			return nil, network.Invalidf("invalid VLAN tag %d of subport %s (must be 1-4094)", sp.VlanTag, sp.PortId)
+		}
+		converted = append(converted, network.SubPort{PortID: sp.PortId, VLANTag: uint16(sp.VlanTag)})
+	}
+	return converted, nil
+}
+
+func toProtoLoadBalancer(lb *network.LoadBalancer) *v1.LoadBalancer {
+	listeners := make([]*v1.LBListener, len(lb.Listeners))
+	for i, l := range lb.Listeners {
+		members := make([]*v1.LBMember, len(l.Pool.Members))
+		for j, m := range l.Pool.Members {
+			members[j] = &v1.LBMember{Address: m.Address, Port: uint32(m.Port), Weight: uint32(m.Weight)}
+		}
+		var monitor *v1.LBHealthMonitor
+		if hm := l.Pool.HealthMonitor; hm != nil {
+			monitor = &v1.LBHealthMonitor{
+				Type:            hm.Type,
+				IntervalSeconds: uint32(hm.Interval),
+				TimeoutSeconds:  uint32(hm.Timeout),
+				MaxRetries:      uint32(hm.MaxRetries),
+			}
+		}
+		listeners[i] = &v1.LBListener{
+			Id:       l.ID,
+			Name:     l.Name,
+			Protocol: l.Protocol,
+			Port:     uint32(l.Port),
+			Pool: &v1.LBPool{
+				Algorithm:     toProtoLBAlgorithm(l.Pool.Algorithm),
+				Members:       members,
+				HealthMonitor: monitor,
+			},
+		}
+	}
+
+	return &v1.LoadBalancer{
+		Id:         lb.ID,
+		Name:       lb.Name,
+		TenantId:   lb.TenantID,
+		NetworkId:  lb.NetworkID,
+		SubnetId:   lb.SubnetID,
+		RouterId:   lb.RouterID,
+		VipAddress: lb.VIPAddress,
+		VipPortId:  lb.VIPPortID,
+		NodeId:     lb.NodeID,
+		Listeners:  listeners,
+		Status:     lb.Status,
+		CreatedAt:  timestamppb.New(lb.CreatedAt),
+		UpdatedAt:  timestamppb.New(lb.UpdatedAt),
+	}
+}
+
+// fromProtoLBListener converts a new listener, giving it an ID and
+// rejecting ports that do not fit rather than truncating them.
+func fromProtoLBListener(l *v1.LBListener) (*network.LBListener, error) {
+	if l.Port > 65535 {
+		return nil, network.Invalidf("invalid listener port %d", l.Port)
+	}
+	listener := &network.LBListener{
+		ID:       generateID(),
+		Name:     l.Name,
+		Protocol: l.Protocol,
+		Port:     uint16(l.Port),
+	}
+	if pool := l.Pool; pool != nil {
+		members, err := fromProtoLBMembers(pool.Members)
+		if err != nil {
+			return nil, err
+		}
+		listener.Pool = network.LBPool{
+			Algorithm:     fromProtoLBAlgorithm(pool.Algorithm),
+			Members:       members,
+			HealthMonitor: fromProtoLBHealthMonitor(pool.HealthMonitor),
+		}
+	}
+	return listener, nil
+}
+
+func fromProtoLBMembers(members []*v1.LBMember) ([]network.LBMember, error) {
+	converted := make([]network.LBMember, 0, len(members))
+	for _, m := range members {
+		if m.Port > 65535 {
+			return nil, network.Invalidf("invalid port %d of member %s", m.Port, m.Address)
+		}
+		converted = append(converted, network.LBMember{Address: m.Address, Port: uint16(m.Port), Weight: int(m.Weight)})
+	}
+	return converted, nil
+}
+
+func fromProtoLBHealthMonitor(m *v1.LBHealthMonitor) *network.LBHealthMonitor {
+	if m == nil {
+		return nil
+	}
+	return &network.LBHealthMonitor{
+		Type:       m.Type,
+		Interval:   int(m.IntervalSeconds),
+		Timeout:    int(m.TimeoutSeconds),
+		MaxRetries: int(m.MaxRetries),
+	}
+}
+
+func toProtoLBAlgorithm(a network.LBAlgorithm) v1.LBAlgorithm {
+	switch a {
+	case network.LBRoundRobin:
+		return v1.LBAlgorithm_LB_ALGORITHM_ROUND_ROBIN
+	case network.LBLeastConnections:
+		return v1.LBAlgorithm_LB_ALGORITHM_LEAST_CONNECTIONS
+	case network.LBSourceIP:
+		return v1.LBAlgorithm_LB_ALGORITHM_SOURCE_IP
+	}
+	return v1.LBAlgorithm_LB_ALGORITHM_UNSPECIFIED
+}
+
+func fromProtoLBAlgorithm(a v1.LBAlgorithm) network.LBAlgorithm {
+	switch a {
+	case v1.LBAlgorithm_LB_ALGORITHM_ROUND_ROBIN:
+		return network.LBRoundRobin
+	case v1.LBAlgorithm_LB_ALGORITHM_LEAST_CONNECTIONS:
+		return network.LBLeastConnections
+	case v1.LBAlgorithm_LB_ALGORITHM_SOURCE_IP:
+		return network.LBSourceIP
+	}
+	return ""
+}
+
+// toProtoVPNService converts a VPN service, with the state of its tunnels
+// if status is not nil.
+func toProtoVPNService(vpn *network.VPNService, status *network.VPNStatus) *v1.VPNService {
+	peers := make([]*v1.VPNPeer, len(vpn.Peers))
+	for i, p := range vpn.Peers {
+		peers[i] = &v1.VPNPeer{
+			Id:                  p.ID,
+			Name:                p.Name,
+			PublicKey:           p.PublicKey,
+			Endpoint:            p.Endpoint,
+			AllowedCidrs:        p.AllowedCIDRs,
+			PersistentKeepalive: uint32(p.PersistentKeepalive),
+		}
+	}
+
+	var peerStatuses []*v1.VPNPeerStatus
+	if status != nil {
+		peerStatuses = make([]*v1.VPNPeerStatus, len(status.Peers))
+		for i, p := range status.Peers {
+			peerStatuses[i] = &v1.VPNPeerStatus{
+				PeerId:    p.PeerID,
+				Endpoint:  p.Endpoint,
+				RxBytes:   p.RxBytes,
+				TxBytes:   p.TxBytes,
+				Connected: p.Connected,
+			}
+			if !p.LatestHandshake.IsZero() {
+				peerStatuses[i].LatestHandshake = timestamppb.New(p.LatestHandshake)
+			}
+		}
+	}
+
+	return &v1.VPNService{
+		Id:           vpn.ID,
+		Name:         vpn.Name,
+		TenantId:     vpn.TenantID,
+		RouterId:     vpn.RouterID,
+		NodeId:       vpn.NodeID,
+		PublicKey:    vpn.PublicKey,
+		ListenPort:   uint32(vpn.ListenPort),
+		Endpoint:     vpn.Endpoint,
+		Peers:        peers,
+		Status:       vpn.Status,
+		PeerStatuses: peerStatuses,
+		CreatedAt:    timestamppb.New(vpn.CreatedAt),
+		UpdatedAt:    timestamppb.New(vpn.UpdatedAt),
+	}
+}
+
+// fromProtoVPNPeer converts a new peer, giving it an ID.
+func fromProtoVPNPeer(p *v1.VPNPeer) *network.VPNPeer {
+	return &network.VPNPeer{
+		ID:                  generateID(),
+		Name:                p.Name,
+		PublicKey:           p.PublicKey,
+		Endpoint:            p.Endpoint,
+		AllowedCIDRs:        append([]string(nil), p.AllowedCidrs...),
+		PersistentKeepalive: int(p.PersistentKeepalive),
+	}
+}
+
+func toProtoSecurityGroup(sg *network.SecurityGroup) *v1.SecurityGroup {
+	rules := make([]*v1.SecurityGroupRule, len(sg.Rules))
+	for i := range sg.Rules {
+		rules[i] = toProtoSecurityGroupRule(&sg.Rules[i])
+	}
+
+	return &v1.SecurityGroup{
+		Id:          sg.ID,
+		Name:        sg.Name,
+		Description: sg.Description,
+		TenantId:    sg.TenantID,
+		Rules:       rules,
+		CreatedAt:   timestamppb.New(sg.CreatedAt),
+		UpdatedAt:   timestamppb.New(sg.UpdatedAt),
+	}
+}
+
+func toProtoSecurityGroupRule(r *network.SecurityGroupRule) *v1.SecurityGroupRule {
+	direction := v1.SecurityRuleDirection_SECURITY_RULE_DIRECTION_UNSPECIFIED
+	switch r.Direction {
+	case "ingress":
+		direction = v1.SecurityRuleDirection_SECURITY_RULE_DIRECTION_INGRESS
+	case "egress":
+		direction = v1.SecurityRuleDirection_SECURITY_RULE_DIRECTION_EGRESS
+	}
+
+	etherType := v1.EtherType_ETHER_TYPE_UNSPECIFIED
+	switch r.EtherType {
+	case "IPv4":
+		etherType = v1.EtherType_ETHER_TYPE_IPV4
+	case "IPv6":
+		etherType = v1.EtherType_ETHER_TYPE_IPV6
+	}
+
+	return &v1.SecurityGroupRule{
+		Id:              r.ID,
+		SecurityGroupId: r.SecurityGroupID,
+		Direction:       direction,
+		EtherType:       etherType,
+		Protocol:        r.Protocol,
+		PortRangeMin:    uint32(r.PortRangeMin),
+		PortRangeMax:    uint32(r.PortRangeMax),
+		RemoteIpPrefix:  r.RemoteIPPrefix,
+		RemoteGroupId:   r.RemoteGroupID,
+	}
+}
+
+func toProtoRouter(r *network.Router, interfaces []*network.RouterInterface) *v1.Router {
+	routes := make([]*v1.Route, len(r.Routes))
+	for i, route := range r.Routes {
+		routes[i] = &v1.Route{
+			Destination: route.Destination,
+			Nexthop:     route.NextHop,
+		}
+	}
+
+	var gateway *v1.ExternalGateway
+	if gw := r.ExternalGatewayInfo; gw != nil {
+		fixedIPs := make([]*v1.FixedIP, len(gw.ExternalFixedIPs))
+		for i, ip := range gw.ExternalFixedIPs {
+			fixedIPs[i] = &v1.FixedIP{
+				SubnetId:  ip.SubnetID,
+				IpAddress: ip.IPAddress,
+			}
+		}
+		gateway = &v1.ExternalGateway{
+			NetworkId:        gw.NetworkID,
+			EnableSnat:       gw.EnableSNAT,
+			ExternalFixedIps: fixedIPs,
+			PortId:           gw.PortID,
+		}
+	}
+
+	protoInterfaces := make([]*v1.RouterInterface, len(interfaces))
+	for i, iface := range interfaces {
+		protoInterfaces[i] = toProtoRouterInterface(iface)
+	}
+
+	return &v1.Router{
+		Id:              r.ID,
+		Name:            r.Name,
+		TenantId:        r.TenantID,
+		AdminState:      r.AdminState,
+		Status:          r.Status,
+		ExternalGateway: gateway,
+		Routes:          routes,
+		Distributed:     r.Distributed,
+		CreatedAt:       timestamppb.New(r.CreatedAt),
+		UpdatedAt:       timestamppb.New(r.UpdatedAt),
+		Interfaces:      protoInterfaces,
+	}
+}
+
+func toProtoRouterInterface(i *network.RouterInterface) *v1.RouterInterface {
+	return &v1.RouterInterface{
+		RouterId:   i.RouterID,
+		SubnetId:   i.SubnetID,
+		PortId:     i.PortID,
+		NetworkId:  i.NetworkID,
+		IpAddress:  i.IPAddress,
+		MacAddress: i.MACAddress,
+		Cidr:       i.CIDR,
+	}
+}
+
+func fromProtoRuleDirection(d v1.SecurityRuleDirection) string {
+	switch d {
+	case v1.SecurityRuleDirection_SECURITY_RULE_DIRECTION_INGRESS:
+		return "ingress"
+	case v1.SecurityRuleDirection_SECURITY_RULE_DIRECTION_EGRESS:
+		return "egress"
+	}
+	return ""
+}
+
+func fromProtoMirrorDirection(d v1.MirrorDirection) network.MirrorDirection {
+	switch d {
+	case v1.MirrorDirection_MIRROR_DIRECTION_INGRESS:
+		return network.MirrorIngress
+	case v1.MirrorDirection_MIRROR_DIRECTION_EGRESS:
+		return network.MirrorEgress
+	case v1.MirrorDirection_MIRROR_DIRECTION_BOTH:
+		return network.MirrorBoth
+	}
+	return ""
+}
+
+func toProtoPortBindingType(t network.PortBindingType) v1.PortBindingType {
+	switch t {
+	case network.PortBindingOVS:
+		return v1.PortBindingType_PORT_BINDING_OVS
+	case network.PortBindingLinuxBridge:
+		return v1.PortBindingType_PORT_BINDING_LINUX_BRIDGE
+	case network.PortBindingVhostUser:
+		return v1.PortBindingType_PORT_BINDING_VHOST_USER
+	case network.PortBindingSRIOV:
+		return v1.PortBindingType_PORT_BINDING_SRIOV
+	}
+	return v1.PortBindingType_PORT_BINDING_UNSPECIFIED
+}
+
+func fromProtoPortBindingType(t v1.PortBindingType) network.PortBindingType {
+	switch t {
+	case v1.PortBindingType_PORT_BINDING_OVS:
+		return network.PortBindingOVS
+	case v1.PortBindingType_PORT_BINDING_LINUX_BRIDGE:
+		return network.PortBindingLinuxBridge
+	case v1.PortBindingType_PORT_BINDING_VHOST_USER:
+		return network.PortBindingVhostUser
+	case v1.PortBindingType_PORT_BINDING_SRIOV:
+		return network.PortBindingSRIOV
+	}
+	return ""
+}
+
+func fromProtoEtherType(t v1.EtherType) string {
+	switch t {
+	case v1.EtherType_ETHER_TYPE_IPV4:
+		return "IPv4"
+	case v1.EtherType_ETHER_TYPE_IPV6:
+		return "IPv6"
+	}
+	return ""
+}
+
 // generateID generates a unique ID for network resources.
 func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+	return uuid.New().String()
 }
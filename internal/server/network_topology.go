@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/network"
+)
+
+// Vertex kinds of the network topology.
+const (
+	topoNetwork  = "network"
+	topoSubnet   = "subnet"
+	topoRouter   = "router"
+	topoPort     = "port"
+	topoInstance = "instance"
+	topoVTEP     = "vtep"
+)
+
+// topology collects the vertices and edges of the network topology.
+type topology struct {
+	nodes map[string]*v1.TopologyNode
+	edges []*v1.TopologyEdge
+}
+
+// add adds a vertex and returns its ID. Adding a vertex twice keeps the
+// first.
+func (t *topology) add(kind, id, name, status string, attributes map[string]string) string {
+	vertexID := kind + "/" + id
+	if _, ok := t.nodes[vertexID]; !ok {
+		t.nodes[vertexID] = &v1.TopologyNode{Id: vertexID, Kind: kind, Name: name, Status: status, Attributes: attributes}
+	}
+	return vertexID
+}
+
+func (t *topology) connect(from, to, kind, status string) {
+	t.edges = append(t.edges, &v1.TopologyEdge{From: from, To: to, Kind: kind, Status: status})
+}
+
+// GetNetworkTopology returns the graph of the overlay: networks with their
+// subnets, the routers attached to them, the ports on them with their
+// instances, and the VTEPs the ports are bound to with the tunnels between
+// them. With a network ID, only that network and what connects to it is
+// included; otherwise every network of the tenant, or of all tenants.
+//
+// Every pair of registered VTEPs is joined by a tunnel. A node with ports
+// bound but no live VTEP registration is included as a missing VTEP, with
+// its tunnels down.
+func (s *NetworkService) GetNetworkTopology(ctx context.Context, networkID, tenantID string) (*v1.GetNetworkTopologyResponse, error) {
+	var networks []*network.Network
+	if networkID != "" {
+		net, err := s.controller.GetNetwork(ctx, networkID)
+		if err != nil {
+			return nil, err
+		}
+		networks = []*network.Network{net}
+	} else {
+		var err error
+		if networks, err = s.controller.ListNetworks(ctx, tenantID); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &topology{nodes: make(map[string]*v1.TopologyNode)}
+	networkVertex := make(map[string]string, len(networks))
+	subnetVertex := make(map[string]string)
+	for _, net := range networks {
+		status := "down"
+		if net.AdminState {
+			status = "up"
+		}
+		attributes := map[string]string{
+			"type": string(net.Type),
+			"mtu":  strconv.Itoa(int(net.MTU)),
+		}
+		if net.VNI != 0 {
+			attributes["vni"] = strconv.FormatUint(uint64(net.VNI), 10)
+		}
+		if net.VLANID != 0 {
+			attributes["vlan_id"] = strconv.Itoa(int(net.VLANID))
+		}
+		if net.External {
+			attributes["external"] = "true"
+		}
+		networkVertex[net.ID] = t.add(topoNetwork, net.ID, net.Name, status, attributes)
+
+		subnets, err := s.ipam.ListSubnets(ctx, net.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list subnets of network %s: %w", net.ID, err)
+		}
+		for _, subnet := range subnets {
+			subnetVertex[subnet.ID] = t.add(topoSubnet, subnet.ID, subnet.Name, "", map[string]string{
+				"cidr":       subnet.CIDR,
+				"gateway_ip": subnet.GatewayIP,
+			})
+			t.connect(networkVertex[net.ID], subnetVertex[subnet.ID], "subnet", "")
+		}
+	}
+
+	if err := s.addRouterTopology(ctx, t, tenantID, networkVertex, subnetVertex); err != nil {
+		return nil, err
+	}
+	bound, err := s.addPortTopology(ctx, t, networkVertex, subnetVertex)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addVTEPTopology(ctx, t, bound, networkID == ""); err != nil {
+		return nil, err
+	}
+
+	resp := &v1.GetNetworkTopologyResponse{Nodes: make([]*v1.TopologyNode, 0, len(t.nodes)), Edges: t.edges}
+	for _, node := range t.nodes {
+		resp.Nodes = append(resp.Nodes, node)
+	}
+	sort.Slice(resp.Nodes, func(i, j int) bool { return resp.Nodes[i].Id < resp.Nodes[j].Id })
+	sort.SliceStable(resp.Edges, func(i, j int) bool {
+		if resp.Edges[i].From != resp.Edges[j].From {
+			return resp.Edges[i].From < resp.Edges[j].From
+		}
+		return resp.Edges[i].To < resp.Edges[j].To
+	})
+	return resp, nil
+}
+
+// addRouterTopology adds the routers with an interface on one of the
+// subnets, or a gateway on one of the networks, of the topology.
+func (s *NetworkService) addRouterTopology(ctx context.Context, t *topology, tenantID string, networkVertex, subnetVertex map[string]string) error {
+	routers, err := s.controller.ListRouters(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	for _, router := range routers {
+		interfaces, err := s.controller.ListRouterInterfaces(ctx, router.ID)
+		if err != nil {
+			return err
+		}
+
+		var vertex string
+		addRouter := func() string {
+			if vertex == "" {
+				attributes := map[string]string{"distributed": strconv.FormatBool(router.Distributed)}
+				if gw := router.ExternalGatewayInfo; gw != nil && len(gw.ExternalFixedIPs) > 0 {
+					attributes["external_ip"] = gw.ExternalFixedIPs[0].IPAddress
+				}
+				vertex = t.add(topoRouter, router.ID, router.Name, router.Status, attributes)
+			}
+			return vertex
+		}
+
+		for _, iface := range interfaces {
+			if subnet, ok := subnetVertex[iface.SubnetID]; ok {
+				t.connect(subnet, addRouter(), "interface", "")
+			}
+		}
+		if gw := router.ExternalGatewayInfo; gw != nil {
+			if net, ok := networkVertex[gw.NetworkID]; ok {
+				t.connect(addRouter(), net, "gateway", "")
+			}
+		}
+	}
+	return nil
+}
+
+// addPortTopology adds the ports on the networks of the topology, other
+// than router ports shown as interfaces and gateways, with their instances.
+// It returns the nodes ports are bound to, with the vertices of their
+// ports.
+func (s *NetworkService) addPortTopology(ctx context.Context, t *topology, networkVertex, subnetVertex map[string]string) (map[string][]string, error) {
+	ports, err := s.controller.ListPorts(ctx, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var instances map[string]*instanceSummary
+	bound := make(map[string][]string)
+	for _, port := range ports {
+		if port.RouterID != "" {
+			continue
+		}
+		parent, ok := subnetVertex[port.SubnetID]
+		if !ok {
+			parent, ok = networkVertex[port.NetworkID]
+		}
+		if !ok {
+			continue
+		}
+
+		attributes := map[string]string{"ip": port.IPAddress, "mac": port.MACAddress}
+		if port.DeviceName != "" {
+			attributes["device"] = port.DeviceName
+		}
+		if port.LoadBalancerID != "" {
+			attributes["load_balancer_id"] = port.LoadBalancerID
+		}
+		vertex := t.add(topoPort, port.ID, port.Name, port.Status, attributes)
+		t.connect(parent, vertex, "port", "")
+
+		if port.InstanceID != "" {
+			if instances == nil {
+				instances = s.instanceSummaries(ctx)
+			}
+			name, status := "", ""
+			if instance, ok := instances[port.InstanceID]; ok {
+				name, status = instance.name, instance.state
+			}
+			t.connect(vertex, t.add(topoInstance, port.InstanceID, name, status, nil), "attachment", "")
+		}
+		if port.NodeID != "" {
+			bound[port.NodeID] = append(bound[port.NodeID], vertex)
+		}
+	}
+	return bound, nil
+}
+
+// instanceSummary is what the topology shows of an instance.
+type instanceSummary struct {
+	name  string
+	state string
+}
+
+// instanceSummaries returns the instances known to the registry, by ID. The
+// topology is still useful without them, so failures are only logged.
+func (s *NetworkService) instanceSummaries(ctx context.Context) map[string]*instanceSummary {
+	summaries := make(map[string]*instanceSummary)
+	if s.instances == nil {
+		return summaries
+	}
+	instances, err := s.instances.List(ctx)
+	if err != nil {
+		s.logger.Warn("failed to list instances for network topology", zap.Error(err))
+		return summaries
+	}
+	for _, instance := range instances {
+		summaries[instance.ID] = &instanceSummary{name: instance.Name, state: string(instance.State)}
+	}
+	return summaries
+}
+
+// addVTEPTopology adds the VTEPs of the nodes ports are bound to, or with
+// all set every registered VTEP, and the tunnels between them.
+func (s *NetworkService) addVTEPTopology(ctx context.Context, t *topology, bound map[string][]string, all bool) error {
+	vteps, err := s.vtepMgr.ListVTEPs(ctx)
+	if err != nil {
+		return err
+	}
+	registered := make(map[string]*network.VTEP, len(vteps))
+	for _, vtep := range vteps {
+		registered[vtep.NodeID] = vtep
+	}
+
+	nodes := make([]string, 0, len(bound))
+	for nodeID := range bound {
+		nodes = append(nodes, nodeID)
+	}
+	if all {
+		for nodeID := range registered {
+			if _, ok := bound[nodeID]; !ok {
+				nodes = append(nodes, nodeID)
+			}
+		}
+	}
+	sort.Strings(nodes)
+
+	vertices := make([]string, len(nodes))
+	up := make([]bool, len(nodes))
+	for i, nodeID := range nodes {
+		status := "missing"
+		var attributes map[string]string
+		if vtep, ok := registered[nodeID]; ok {
+			status = vtep.Status
+			up[i] = vtep.Status == "active"
+			attributes = map[string]string{
+				"ip":   vtep.IP.String(),
+				"port": strconv.Itoa(int(vtep.Port)),
+			}
+		}
+		vertices[i] = t.add(topoVTEP, nodeID, nodeID, status, attributes)
+		for _, port := range bound[nodeID] {
+			t.connect(port, vertices[i], "binding", "")
+		}
+	}
+
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			status := "down"
+			if up[i] && up[j] {
+				status = "up"
+			}
+			t.connect(vertices[i], vertices[j], "tunnel", status)
+		}
+	}
+	return nil
+}
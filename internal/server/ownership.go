@@ -0,0 +1,408 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// CoordinationConfig configures active-active serving, where every server
+// accepts mutating RPCs. Each agent's connection is owned by one server at a
+// time, recorded in etcd under a lease of that server; the other servers
+// forward their agent calls to the owner. Cluster controllers still run on
+// the elected leader only.
+type CoordinationConfig struct {
+	// Enabled lets every server accept mutating RPCs.
+	Enabled bool `mapstructure:"enabled"`
+
+	// PeerAddr is where this server accepts the agent calls other servers
+	// forward to it, over mutual TLS.
+	PeerAddr string `mapstructure:"peer_addr"`
+
+	// AdvertiseAddr is the address other servers forward agent calls to
+	// (defaults to hostname + the PeerAddr port).
+	AdvertiseAddr string `mapstructure:"advertise_addr"`
+
+	// TLS of the calls between servers, required to enable coordination.
+	// CertFile and KeyFile are this server's certificate, used both to
+	// serve and to forward; CAFile is the CA every server's certificate
+	// must be signed by.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	CAFile   string `mapstructure:"ca_file"`
+
+	// PeerNames restricts forwarded calls to servers whose certificate
+	// carries one of these names (DNS SAN or common name). Empty accepts
+	// any certificate signed by CAFile.
+	PeerNames []string `mapstructure:"peer_names"`
+
+	// Prefix is the etcd key prefix of the agent ownership records.
+	Prefix string `mapstructure:"prefix"`
+
+	// LeaseTTL is how long a crashed server keeps its agents before another
+	// server takes them over.
+	LeaseTTL time.Duration `mapstructure:"lease_ttl"`
+}
+
+// DefaultCoordinationConfig returns the default coordination configuration.
+func DefaultCoordinationConfig() CoordinationConfig {
+	return CoordinationConfig{
+		Enabled:  false,
+		PeerAddr: ":50053",
+		Prefix:   "/hypervisor/agent-owners/",
+		LeaseTTL: 15 * time.Second,
+	}
+}
+
+// advertiseAddr returns the configured address or derives one from the host
+// and the port of listenAddr.
+func (c CoordinationConfig) advertiseAddr(listenAddr string) string {
+	if c.AdvertiseAddr != "" {
+		return c.AdvertiseAddr
+	}
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		if host, err = os.Hostname(); err != nil {
+			host = "localhost"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// pendingCreatePrefix is the etcd key prefix under which servers record
+// the creates they have sent to a node and not yet seen finish, as
+// <prefix><node ID>/<instance ID> = <server>.
+const pendingCreatePrefix = "/hypervisor/pending-creates/"
+
+// SetOwnership makes the scheduler count the creates other servers have
+// pending on a node, in active-active mode.
+func (s *ComputeService) SetOwnership(o *agentOwnership) {
+	s.ownership = o
+}
+
+// agentOwnership tracks which server owns the connection to each agent. An
+// agent without an owner is claimed by the first server that calls it. The
+// records are attached to this server's lease, so they disappear when the
+// server stops or crashes and the agents are claimed again elsewhere.
+type agentOwnership struct {
+	client *etcd.Client
+	prefix string
+	self   string
+	ttl    time.Duration
+	logger *zap.Logger
+
+	mu      sync.RWMutex
+	leaseID clientv3.LeaseID
+	owners  map[string]string // Node ID -> owning server address
+
+	// Creates the other servers have pending, so that together the
+	// servers keep to each node's create limit
+	remoteCreates    map[string]int    // Node ID -> pending creates
+	remoteCreateKeys map[string]string // Pending create key -> node ID
+}
+
+func newAgentOwnership(client *etcd.Client, config CoordinationConfig, self string, logger *zap.Logger) *agentOwnership {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	prefix := config.Prefix
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &agentOwnership{
+		client: client,
+		prefix: prefix,
+		self:   self,
+		ttl:    config.LeaseTTL,
+		logger: logger,
+		owners: make(map[string]string),
+
+		remoteCreates:    make(map[string]int),
+		remoteCreateKeys: make(map[string]string),
+	}
+}
+
+// start grants this server's lease, loads the current owners and keeps both
+// up to date until ctx is cancelled.
+func (o *agentOwnership) start(ctx context.Context) error {
+	if err := o.grant(ctx); err != nil {
+		return err
+	}
+
+	kvs, err := o.client.GetWithPrefixKV(ctx, o.prefix)
+	if err != nil {
+		return fmt.Errorf("failed to load agent owners: %w", err)
+	}
+	o.mu.Lock()
+	for _, kv := range kvs {
+		o.owners[strings.TrimPrefix(kv.Key, o.prefix)] = kv.Value
+	}
+	o.mu.Unlock()
+
+	rev, err := o.loadCreates(ctx)
+	if err != nil {
+		return err
+	}
+
+	go o.keepAlive(ctx)
+	go o.watch(ctx)
+	go o.watchCreates(ctx, rev)
+
+	o.logger.Info("agent ownership started",
+		zap.String("self", o.self),
+		zap.Int("owned_elsewhere", len(kvs)),
+	)
+	return nil
+}
+
+func (o *agentOwnership) grant(ctx context.Context) error {
+	lease, err := o.client.Grant(ctx, int64(o.ttl.Seconds()))
+	if err != nil {
+		return fmt.Errorf("failed to grant ownership lease: %w", err)
+	}
+	o.mu.Lock()
+	o.leaseID = lease.ID
+	o.mu.Unlock()
+	return nil
+}
+
+// keepAlive refreshes the lease. If it is lost (e.g. etcd was unreachable
+// for longer than the TTL), this server's records are gone and a new lease
+// is granted; agents are claimed again on their next call.
+func (o *agentOwnership) keepAlive(ctx context.Context) {
+	for ctx.Err() == nil {
+		o.mu.RLock()
+		leaseID := o.leaseID
+		o.mu.RUnlock()
+
+		ch, err := o.client.KeepAlive(ctx, leaseID)
+		if err == nil {
+			for range ch {
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		o.logger.Warn("ownership lease lost, granting a new one")
+		time.Sleep(time.Second)
+		if err := o.grant(ctx); err != nil {
+			o.logger.Warn("failed to renew ownership lease", zap.Error(err))
+		}
+	}
+}
+
+// watch follows ownership changes made by every server.
+func (o *agentOwnership) watch(ctx context.Context) {
+	watchCh := o.client.WatchPrefixEvents(ctx, o.prefix)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watchCh:
+			if !ok {
+				o.logger.Warn("agent ownership watch channel closed, reconnecting...")
+				time.Sleep(time.Second)
+				watchCh = o.client.WatchPrefixEvents(ctx, o.prefix)
+				continue
+			}
+
+			nodeID := strings.TrimPrefix(event.Key, o.prefix)
+			o.mu.Lock()
+			if event.Type == etcd.EventTypePut {
+				o.owners[nodeID] = event.Value
+			} else {
+				delete(o.owners, nodeID)
+			}
+			o.mu.Unlock()
+		}
+	}
+}
+
+// loadCreates replaces the pending creates of the other servers with
+// those stored in etcd and returns the revision they were read at.
+func (o *agentOwnership) loadCreates(ctx context.Context) (int64, error) {
+	resp, err := o.client.Raw().Get(ctx, pendingCreatePrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to load pending creates: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	clear(o.remoteCreates)
+	clear(o.remoteCreateKeys)
+	for _, kv := range resp.Kvs {
+		o.applyCreate(etcd.WatchEvent{Type: etcd.EventTypePut, Key: string(kv.Key), Value: string(kv.Value)})
+	}
+	return resp.Header.Revision, nil
+}
+
+// watchCreates follows the creates the other servers record, from the
+// revision after rev.
+func (o *agentOwnership) watchCreates(ctx context.Context, rev int64) {
+	for ctx.Err() == nil {
+		for event := range o.client.WatchPrefixEvents(ctx, pendingCreatePrefix, clientv3.WithRev(rev+1)) {
+			o.mu.Lock()
+			o.applyCreate(event)
+			o.mu.Unlock()
+		}
+
+		// Closed, e.g. compacted past rev; reload and follow on from there
+		for ctx.Err() == nil {
+			o.logger.Warn("pending create watch channel closed, reloading...")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+
+			var err error
+			if rev, err = o.loadCreates(ctx); err == nil {
+				break
+			}
+			o.logger.Warn("failed to reload pending creates", zap.Error(err))
+		}
+	}
+}
+
+// applyCreate counts a pending create of another server in or out. o.mu
+// must be held.
+func (o *agentOwnership) applyCreate(event etcd.WatchEvent) {
+	nodeID, _, ok := strings.Cut(strings.TrimPrefix(event.Key, pendingCreatePrefix), "/")
+	if !ok {
+		return
+	}
+	_, counted := o.remoteCreateKeys[event.Key]
+	switch {
+	case event.Type == etcd.EventTypePut && event.Value != o.self && !counted:
+		o.remoteCreateKeys[event.Key] = nodeID
+		o.remoteCreates[nodeID]++
+	case event.Type == etcd.EventTypeDelete && counted:
+		delete(o.remoteCreateKeys, event.Key)
+		if o.remoteCreates[nodeID]--; o.remoteCreates[nodeID] <= 0 {
+			delete(o.remoteCreates, nodeID)
+		}
+	}
+}
+
+// beginCreate records a create this server sends to nodeID, under its
+// lease, until the returned function is called.
+func (o *agentOwnership) beginCreate(ctx context.Context, nodeID, instanceID string) func() {
+	o.mu.RLock()
+	leaseID := o.leaseID
+	o.mu.RUnlock()
+
+	key := pendingCreatePrefix + nodeID + "/" + instanceID
+	if _, err := o.client.Raw().Put(ctx, key, o.self, clientv3.WithLease(leaseID)); err != nil {
+		// The other servers undercount this node until the create finishes
+		o.logger.Warn("failed to record pending create", zap.String("node_id", nodeID), zap.Error(err))
+		return func() {}
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := o.client.Raw().Delete(ctx, key); err != nil {
+			o.logger.Warn("failed to clear pending create", zap.String("node_id", nodeID), zap.Error(err))
+		}
+	}
+}
+
+// pendingCreates returns the creates other servers have sent to nodeID and
+// not yet seen finish.
+func (o *agentOwnership) pendingCreates(nodeID string) int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.remoteCreates[nodeID]
+}
+
+// owner returns the address of the server owning the agent on nodeID,
+// claiming it for this server if no server does.
+func (o *agentOwnership) owner(ctx context.Context, nodeID string) (string, error) {
+	o.mu.RLock()
+	owner, ok := o.owners[nodeID]
+	leaseID := o.leaseID
+	o.mu.RUnlock()
+	if ok {
+		return owner, nil
+	}
+
+	key := o.prefix + nodeID
+	resp, err := o.client.Raw().Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, o.self, clientv3.WithLease(leaseID))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return "", fmt.Errorf("failed to claim agent %s: %w", nodeID, err)
+	}
+
+	owner = o.self
+	if !resp.Succeeded {
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) == 0 {
+			return "", fmt.Errorf("failed to claim agent %s: %w", nodeID, etcd.ErrConflict)
+		}
+		owner = string(kvs[0].Value)
+	} else {
+		o.logger.Info("claimed agent", zap.String("node_id", nodeID))
+	}
+
+	o.mu.Lock()
+	o.owners[nodeID] = owner
+	o.mu.Unlock()
+	return owner, nil
+}
+
+// owns reports whether this server owns the agent on nodeID, claiming it if
+// no server does.
+func (o *agentOwnership) owns(ctx context.Context, nodeID string) (bool, string, error) {
+	owner, err := o.owner(ctx, nodeID)
+	if err != nil {
+		return false, "", err
+	}
+	return owner == o.self, owner, nil
+}
+
+// release gives up this server's ownership of an agent, if it has it.
+func (o *agentOwnership) release(ctx context.Context, nodeID string) {
+	key := o.prefix + nodeID
+	if _, err := o.client.Raw().Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", o.self)).
+		Then(clientv3.OpDelete(key)).
+		Commit(); err != nil {
+		o.logger.Warn("failed to release agent", zap.String("node_id", nodeID), zap.Error(err))
+	}
+
+	o.mu.Lock()
+	if o.owners[nodeID] == o.self {
+		delete(o.owners, nodeID)
+	}
+	o.mu.Unlock()
+}
+
+// stop revokes the lease, handing every owned agent over to the other
+// servers straight away.
+func (o *agentOwnership) stop(ctx context.Context) {
+	o.mu.RLock()
+	leaseID := o.leaseID
+	o.mu.RUnlock()
+
+	if err := o.client.Revoke(ctx, leaseID); err != nil {
+		o.logger.Warn("failed to revoke ownership lease", zap.Error(err))
+	}
+}
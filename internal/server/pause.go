@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errInstanceMoved aborts recording the outcome of an operation an agent
+// made on an instance that has since moved to another node.
+var errInstanceMoved = errors.New("instance moved to another node")
+
+// PauseInstanceRequest represents a pause instance request.
+type PauseInstanceRequest struct {
+	InstanceID string
+	ToDisk     bool
+}
+
+// PauseInstance freezes a running instance in memory, or with ToDisk saves
+// its memory to disk and stops it. The paused or suspended state is kept as
+// the desired state, so the reconciler leaves the instance alone until it is
+// resumed.
+func (s *ComputeService) PauseInstance(ctx context.Context, req *PauseInstanceRequest) (*registry.Instance, error) {
+	desired, op, done := driver.StatePaused, "Pause", "Paused"
+	if req.ToDisk {
+		desired, op, done = driver.StateSuspended, "Suspend", "Suspended"
+	}
+
+	supported := func(caps *registry.InstanceCapabilities) bool { return caps.Pause }
+	if req.ToDisk {
+		supported = func(caps *registry.InstanceCapabilities) bool { return caps.Suspend }
+	}
+
+	return s.pauseOp(ctx, req.InstanceID, desired, op, done, supported, func(agentClient v1.AgentServiceClient) (*v1.Instance, error) {
+		if req.ToDisk {
+			return agentClient.SuspendInstance(ctx, &v1.AgentInstanceRequest{InstanceId: req.InstanceID})
+		}
+		return agentClient.PauseInstance(ctx, &v1.AgentInstanceRequest{InstanceId: req.InstanceID})
+	})
+}
+
+// ResumeInstanceRequest represents a resume instance request.
+type ResumeInstanceRequest struct {
+	InstanceID string
+}
+
+// ResumeInstance continues a paused instance, or restores a suspended one
+// from disk.
+func (s *ComputeService) ResumeInstance(ctx context.Context, req *ResumeInstanceRequest) (*registry.Instance, error) {
+	return s.pauseOp(ctx, req.InstanceID, driver.StateRunning, "Resume", "Resumed", nil, func(agentClient v1.AgentServiceClient) (*v1.Instance, error) {
+		return agentClient.ResumeInstance(ctx, &v1.AgentInstanceRequest{InstanceId: req.InstanceID})
+	})
+}
+
+// pauseOp runs a pause, suspend or resume on the instance's agent and stores
+// the desired state and the state the agent observed. op and done name the
+// operation in events, e.g. "Pause" and "Paused". If supported is not nil,
+// the operation is refused up front when the driver lacks it.
+func (s *ComputeService) pauseOp(ctx context.Context, instanceID string, desired driver.InstanceState, op, done string,
+	supported func(*registry.InstanceCapabilities) bool, call func(v1.AgentServiceClient) (*v1.Instance, error)) (*registry.Instance, error) {
+	instance, err := s.instanceRegistry.Get(ctx, instanceID)
+	if err != nil {
+		if err == registry.ErrInstanceNotFound {
+			return nil, status.Errorf(codes.NotFound, "instance not found: %s", instanceID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get instance: %v", err)
+	}
+	if instance.NodeID == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "instance %s is not scheduled", instanceID)
+	}
+	if supported != nil {
+		if err := requireCapability(s.instanceCapabilities(ctx, instance), strings.ToLower(op), supported); err != nil {
+			return nil, err
+		}
+	}
+
+	agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
+	if err != nil {
+		return nil, agentUnavailable(err)
+	}
+
+	agentResp, err := call(agentClient)
+	if err != nil {
+		s.recordEvent(ctx, events.TypeWarning, instanceID, instance.NodeID, "Failed"+op, err.Error())
+		switch status.Code(err) {
+		case codes.NotFound, codes.FailedPrecondition, codes.Unimplemented:
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "agent failed to %s instance: %v", strings.ToLower(op), err)
+	}
+
+	// The desired state is only recorded once the agent made the change, so
+	// a failed pause does not stop the reconciler from managing the instance.
+	// Only the fields the agent reported are written, over the latest stored
+	// instance, so concurrent updates to it are kept.
+	nodeID := instance.NodeID
+	updated, err := s.instanceRegistry.Modify(ctx, instanceID, func(instance *registry.Instance) error {
+		if instance.NodeID != nodeID {
+			return errInstanceMoved
+		}
+		instance.DesiredState = desired
+		instance.State = protoStateToDriverState(agentResp.State)
+		instance.StateReason = agentResp.StateReason
+		if agentResp.StartedAt != nil {
+			t := agentResp.StartedAt.AsTime()
+			instance.StartedAt = &t
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Warn("failed to update instance in registry",
+			zap.String("instance_id", instanceID),
+			zap.Error(err),
+		)
+	} else {
+		instance = updated
+	}
+
+	s.logger.Info("instance "+strings.ToLower(done),
+		zap.String("instance_id", instanceID),
+		zap.String("state", string(instance.State)),
+	)
+	s.recordEvent(ctx, events.TypeNormal, instanceID, instance.NodeID, done, "")
+	return instance, nil
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/metrics"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// RateLimitConfig limits the control-plane calls clients can make, so that
+// one misbehaving client cannot overload the server and etcd. Clients are
+// told by their authenticated identity, or else by their address. Rates are in calls per second, 0 disabling the
+// limit; only unary calls count towards the in-flight limits, since streams
+// such as watches stay open.
+type RateLimitConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+
+	// GlobalRate and GlobalBurst limit the calls of all clients together.
+	GlobalRate  float64 `mapstructure:"global_rate"`
+	GlobalBurst int     `mapstructure:"global_burst"`
+
+	// ClientRate and ClientBurst limit the calls of each client.
+	ClientRate  float64 `mapstructure:"client_rate"`
+	ClientBurst int     `mapstructure:"client_burst"`
+
+	// MaxInFlight bounds the calls being served at once, of all clients
+	// together and of each client.
+	MaxInFlight       int `mapstructure:"max_in_flight"`
+	MaxClientInFlight int `mapstructure:"max_client_in_flight"`
+
+	// Methods tightens the per-client limits of expensive methods, e.g.
+	// CreateInstance, on top of the limits above.
+	Methods []MethodRateLimit `mapstructure:"methods"`
+
+	// Exempt lists methods never limited, e.g. agent heartbeats, which
+	// must get through for nodes not to be declared down.
+	Exempt []string `mapstructure:"exempt"`
+
+	// ClientIdleTimeout is how long the limits of a client that stopped
+	// calling are kept.
+	ClientIdleTimeout time.Duration `mapstructure:"client_idle_timeout"`
+}
+
+// MethodRateLimit is the per-client limit of one method.
+type MethodRateLimit struct {
+	// Method is the method name, e.g. "CreateInstance", or the full
+	// method, e.g. "/hypervisor.v1.ComputeService/CreateInstance".
+	Method string `mapstructure:"method"`
+
+	Rate        float64 `mapstructure:"rate"`
+	Burst       int     `mapstructure:"burst"`
+	MaxInFlight int     `mapstructure:"max_in_flight"`
+}
+
+// DefaultRateLimitConfig returns the default rate limit configuration.
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Enabled:           true,
+		GlobalRate:        500,
+		GlobalBurst:       1000,
+		ClientRate:        50,
+		ClientBurst:       100,
+		MaxInFlight:       256,
+		MaxClientInFlight: 32,
+		Methods: []MethodRateLimit{
+			{Method: "CreateInstance", Rate: 5, Burst: 10, MaxInFlight: 4},
+		},
+		Exempt:            []string{"Heartbeat"},
+		ClientIdleTimeout: 10 * time.Minute,
+	}
+}
+
+// inFlightRetryDelay is the retry delay suggested when a call is refused
+// for too many calls in flight, which end at no predictable time.
+const inFlightRetryDelay = time.Second
+
+// rateLimiter enforces a RateLimitConfig on the calls served.
+type rateLimiter struct {
+	config  RateLimitConfig
+	methods map[string]MethodRateLimit
+	exempt  map[string]bool
+	logger  *zap.Logger
+
+	global *tokenBucket
+
+	mu        sync.Mutex
+	inFlight  int
+	clients   map[string]*clientLimits
+	lastSweep time.Time
+}
+
+// clientLimits are the limits and in-flight calls of one client.
+type clientLimits struct {
+	limiter  *tokenBucket
+	methods  map[string]*tokenBucket
+	inFlight map[string]int // By method, "" for all methods
+	lastSeen time.Time
+}
+
+func newRateLimiter(config RateLimitConfig, logger *zap.Logger) *rateLimiter {
+	r := &rateLimiter{
+		config:    config,
+		methods:   make(map[string]MethodRateLimit),
+		exempt:    make(map[string]bool),
+		logger:    logger,
+		global:    newTokenBucket(config.GlobalRate, config.GlobalBurst),
+		clients:   make(map[string]*clientLimits),
+		lastSweep: time.Now(),
+	}
+	for _, m := range config.Methods {
+		r.methods[m.Method] = m
+	}
+	for _, method := range config.Exempt {
+		r.exempt[method] = true
+	}
+	return r
+}
+
+// tokenBucket allows calls at a rate, with bursts of up to burst calls.
+// A rate of 0 allows every call. The rateLimiter's mutex guards it.
+type tokenBucket struct {
+	rate     float64 // Tokens per second
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate > 0 && burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{
+		rate:     rate,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		lastFill: time.Now(),
+	}
+}
+
+// wait refills the bucket and returns how long until it holds a token, 0
+// if it does now.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.lastFill).Seconds()*b.rate)
+	b.lastFill = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take takes a token, which wait must have found.
+func (b *tokenBucket) take() {
+	if b.rate > 0 {
+		b.tokens--
+	}
+}
+
+// limited reports whether calls of fullMethod are subject to limits: the
+// hypervisor services' calls, except exempt methods and the agent calls
+// relayed between servers.
+func (r *rateLimiter) limited(fullMethod string) bool {
+	if !strings.HasPrefix(fullMethod, "/hypervisor.") || strings.HasPrefix(fullMethod, "/hypervisor.v1.AgentService/") {
+		return false
+	}
+	return !r.exempt[fullMethod] && !r.exempt[methodName(fullMethod)]
+}
+
+// methodLimit returns the per-method limit configured for fullMethod.
+func (r *rateLimiter) methodLimit(fullMethod string) (MethodRateLimit, bool) {
+	if m, ok := r.methods[fullMethod]; ok {
+		return m, true
+	}
+	m, ok := r.methods[methodName(fullMethod)]
+	return m, ok
+}
+
+// acquire admits a call of fullMethod, or returns the ResourceExhausted
+// error to refuse it with. Unary calls hold their in-flight slots until
+// release is called.
+func (r *rateLimiter) acquire(ctx context.Context, fullMethod string, unary bool) (release func(), err error) {
+	noop := func() {}
+	if !r.config.Enabled || !r.limited(fullMethod) {
+		return noop, nil
+	}
+
+	client := clientID(ctx)
+	now := time.Now()
+	method, hasMethodLimit := r.methodLimit(fullMethod)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sweep(now)
+	c := r.client(client, now)
+
+	if unary {
+		switch {
+		case r.config.MaxInFlight > 0 && r.inFlight >= r.config.MaxInFlight:
+			return nil, r.refuse(ctx, client, fullMethod, "max_in_flight", inFlightRetryDelay,
+				fmt.Sprintf("server is serving %d calls, the most allowed", r.inFlight))
+		case r.config.MaxClientInFlight > 0 && c.inFlight[""] >= r.config.MaxClientInFlight:
+			return nil, r.refuse(ctx, client, fullMethod, "max_client_in_flight", inFlightRetryDelay,
+				fmt.Sprintf("client %s has %d calls in flight, the most allowed", client, c.inFlight[""]))
+		case hasMethodLimit && method.MaxInFlight > 0 && c.inFlight[fullMethod] >= method.MaxInFlight:
+			return nil, r.refuse(ctx, client, fullMethod, "method_in_flight", inFlightRetryDelay,
+				fmt.Sprintf("client %s has %d %s calls in flight, the most allowed", client, c.inFlight[fullMethod], methodName(fullMethod)))
+		}
+	}
+
+	type bucket struct {
+		limiter *tokenBucket
+		limit   string
+		message string
+	}
+	buckets := []bucket{
+		{r.global, "global_rate", "server is receiving more calls than it accepts"},
+		{c.limiter, "client_rate", fmt.Sprintf("client %s is calling faster than allowed", client)},
+	}
+	if hasMethodLimit {
+		limiter, ok := c.methods[fullMethod]
+		if !ok {
+			limiter = newTokenBucket(method.Rate, method.Burst)
+			c.methods[fullMethod] = limiter
+		}
+		buckets = append(buckets, bucket{limiter, "method_rate",
+			fmt.Sprintf("client %s is calling %s faster than allowed", client, methodName(fullMethod))})
+	}
+
+	// Take from the buckets only once all of them allow the call, so that
+	// a refused call does not count against the limits it passed
+	for _, b := range buckets {
+		if delay := b.limiter.wait(now); delay > 0 {
+			return nil, r.refuse(ctx, client, fullMethod, b.limit, delay, b.message)
+		}
+	}
+	for _, b := range buckets {
+		b.limiter.take()
+	}
+
+	if !unary {
+		return noop, nil
+	}
+	r.inFlight++
+	c.inFlight[""]++
+	c.inFlight[fullMethod]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.inFlight--
+			c.inFlight[""]--
+			if c.inFlight[fullMethod]--; c.inFlight[fullMethod] == 0 {
+				delete(c.inFlight, fullMethod)
+			}
+			c.lastSeen = time.Now()
+		})
+	}, nil
+}
+
+// client returns the limits of a client, creating them on its first call.
+// r.mu must be held.
+func (r *rateLimiter) client(client string, now time.Time) *clientLimits {
+	c, ok := r.clients[client]
+	if !ok {
+		c = &clientLimits{
+			limiter:  newTokenBucket(r.config.ClientRate, r.config.ClientBurst),
+			methods:  make(map[string]*tokenBucket),
+			inFlight: make(map[string]int),
+		}
+		r.clients[client] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// sweep forgets the clients idle for ClientIdleTimeout, at most once per
+// timeout. r.mu must be held.
+func (r *rateLimiter) sweep(now time.Time) {
+	timeout := r.config.ClientIdleTimeout
+	if timeout <= 0 {
+		timeout = DefaultRateLimitConfig().ClientIdleTimeout
+	}
+	if now.Sub(r.lastSweep) < timeout {
+		return
+	}
+	r.lastSweep = now
+
+	for client, c := range r.clients {
+		if c.inFlight[""] == 0 && now.Sub(c.lastSeen) >= timeout {
+			delete(r.clients, client)
+		}
+	}
+}
+
+// refuse returns the error refusing a call for exceeding limit, and tells
+// the caller in the retry-after header, in whole seconds, when to retry.
+func (r *rateLimiter) refuse(ctx context.Context, client, fullMethod, limit string, delay time.Duration, message string) error {
+	seconds := int64(math.Ceil(delay.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.FormatInt(seconds, 10)))
+
+	metrics.ObserveRateLimited(fullMethod, limit)
+	r.logger.Debug("call rate limited",
+		zap.String("client", client),
+		zap.String("method", fullMethod),
+		zap.String("limit", limit),
+		zap.Duration("retry_after", delay),
+	)
+	return apierror.RateLimited(fmt.Sprintf("%s, retry in %s", message, delay.Round(time.Millisecond)), limit, delay)
+}
+
+// clientID returns who makes a call: the identity of an authenticated
+// client, so that clients sharing an address behind NAT or a load balancer
+// get limits of their own, or else the client's address without its port,
+// so that a client's connections share its limits.
+func clientID(ctx context.Context) string {
+	if identity := callerIdentity(ctx); identity != "" {
+		return "cn=" + identity
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// methodName returns the method of a full gRPC method name, e.g.
+// CreateInstance for /hypervisor.v1.ComputeService/CreateInstance.
+func methodName(fullMethod string) string {
+	return fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+}
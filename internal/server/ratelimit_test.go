@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"hypervisor/pkg/apierror"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	listMethod   = "/hypervisor.v1.ComputeService/ListInstances"
+	createMethod = "/hypervisor.v1.ComputeService/CreateInstance"
+)
+
+func TestTokenBucketWait(t *testing.T) {
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		taken   int           // Tokens taken at start
+		elapsed time.Duration // Time after start the bucket is checked at
+		want    time.Duration
+	}{
+		{name: "zero rate is unlimited", rate: 0, burst: 0, taken: 100},
+		{name: "full bucket allows a call", rate: 1, burst: 5},
+		{name: "burst allows calls up to its size", rate: 1, burst: 5, taken: 4},
+		{name: "empty bucket waits for a token", rate: 2, burst: 5, taken: 5, want: 500 * time.Millisecond},
+		{name: "empty bucket refills over time", rate: 2, burst: 5, taken: 5, elapsed: 500 * time.Millisecond},
+		{name: "partial refill waits for the rest", rate: 1, burst: 1, taken: 1, elapsed: 250 * time.Millisecond, want: 750 * time.Millisecond},
+		{name: "missing burst defaults to the rate", rate: 3, burst: 0, taken: 3, want: time.Second / 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.burst)
+			b.lastFill = start
+			for range tt.taken {
+				b.wait(start)
+				b.take()
+			}
+			got := b.wait(start.Add(tt.elapsed))
+			if diff := got - tt.want; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("wait() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// rateLimitCall is one call made against a rateLimiter.
+type rateLimitCall struct {
+	client string // Peer address, or "cn=<name>" for a TLS client
+	method string
+	stream bool
+	done   bool   // Release the call before the next one
+	limit  string // Limit expected to refuse it, "" if admitted
+}
+
+func TestRateLimiterAcquire(t *testing.T) {
+	config := RateLimitConfig{
+		Enabled:           true,
+		ClientRate:        1,
+		ClientBurst:       2,
+		MaxClientInFlight: 10,
+		Methods:           []MethodRateLimit{{Method: "CreateInstance", Rate: 100, Burst: 100, MaxInFlight: 1}},
+		Exempt:            []string{"Heartbeat"},
+	}
+
+	tests := []struct {
+		name   string
+		config func(*RateLimitConfig)
+		calls  []rateLimitCall
+	}{
+		{
+			name: "client burst then refused",
+			calls: []rateLimitCall{
+				{client: "10.0.0.1:1000", method: listMethod, done: true},
+				{client: "10.0.0.1:1001", method: listMethod, done: true},
+				{client: "10.0.0.1:1002", method: listMethod, done: true, limit: "client_rate"},
+			},
+		},
+		{
+			name: "clients at different addresses have their own limits",
+			calls: []rateLimitCall{
+				{client: "10.0.0.1:1000", method: listMethod, done: true},
+				{client: "10.0.0.1:1000", method: listMethod, done: true},
+				{client: "10.0.0.2:1000", method: listMethod, done: true},
+			},
+		},
+		{
+			name: "authenticated clients behind one address have their own limits",
+			calls: []rateLimitCall{
+				{client: "cn=alice", method: listMethod, done: true},
+				{client: "cn=alice", method: listMethod, done: true},
+				{client: "cn=bob", method: listMethod, done: true},
+				{client: "cn=alice", method: listMethod, done: true, limit: "client_rate"},
+			},
+		},
+		{
+			name: "exempt and agent methods are not limited",
+			calls: []rateLimitCall{
+				{client: "10.0.0.1:1000", method: "/hypervisor.v1.ClusterService/Heartbeat", done: true},
+				{client: "10.0.0.1:1000", method: "/hypervisor.v1.ClusterService/Heartbeat", done: true},
+				{client: "10.0.0.1:1000", method: "/hypervisor.v1.AgentService/GetInstance", done: true},
+				{client: "10.0.0.1:1000", method: "/grpc.health.v1.Health/Check", done: true},
+				{client: "10.0.0.1:1000", method: listMethod, done: true},
+			},
+		},
+		{
+			name: "method in-flight limit until released",
+			calls: []rateLimitCall{
+				{client: "10.0.0.1:1000", method: createMethod},
+				{client: "10.0.0.1:1000", method: createMethod, limit: "method_in_flight"},
+				{client: "10.0.0.2:1000", method: createMethod},
+			},
+		},
+		{
+			name: "released calls free their slot",
+			calls: []rateLimitCall{
+				{client: "10.0.0.1:1000", method: createMethod, done: true},
+				{client: "10.0.0.1:1000", method: createMethod, done: true},
+			},
+		},
+		{
+			name: "streams do not count as in flight",
+			config: func(c *RateLimitConfig) {
+				c.ClientRate = 0
+				c.MaxClientInFlight = 1
+			},
+			calls: []rateLimitCall{
+				{client: "10.0.0.1:1000", method: "/hypervisor.v1.ComputeService/WatchInstances", stream: true},
+				{client: "10.0.0.1:1000", method: listMethod},
+				{client: "10.0.0.1:1000", method: listMethod, limit: "max_client_in_flight"},
+			},
+		},
+		{
+			name: "global rate covers all clients",
+			config: func(c *RateLimitConfig) {
+				c.GlobalRate, c.GlobalBurst = 1, 1
+			},
+			calls: []rateLimitCall{
+				{client: "10.0.0.1:1000", method: listMethod, done: true},
+				{client: "10.0.0.2:1000", method: listMethod, done: true, limit: "global_rate"},
+			},
+		},
+		{
+			name: "disabled admits everything",
+			config: func(c *RateLimitConfig) {
+				c.Enabled = false
+			},
+			calls: []rateLimitCall{
+				{client: "10.0.0.1:1000", method: listMethod},
+				{client: "10.0.0.1:1000", method: listMethod},
+				{client: "10.0.0.1:1000", method: listMethod},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config
+			if tt.config != nil {
+				tt.config(&cfg)
+			}
+			r := newRateLimiter(cfg, zap.NewNop())
+
+			for i, c := range tt.calls {
+				release, err := r.acquire(peerContext(t, c.client), c.method, !c.stream)
+				if c.limit == "" {
+					if err != nil {
+						t.Fatalf("call %d: unexpected refusal: %v", i, err)
+					}
+					if c.done {
+						release()
+					}
+					continue
+				}
+				if err == nil {
+					t.Fatalf("call %d: admitted, want refused by %s", i, c.limit)
+				}
+				if info := apierror.Info(err); info == nil || info.Metadata["limit"] != c.limit {
+					t.Fatalf("call %d: refused with %v, want limit %s", i, err, c.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestClientID(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "no peer", ctx: context.Background(), want: "unknown"},
+		{name: "address without port", ctx: peerContext(t, "10.0.0.1:5000"), want: "10.0.0.1"},
+		{name: "IPv6 address", ctx: peerContext(t, "[fd00::1]:5000"), want: "fd00::1"},
+		{name: "authenticated identity", ctx: peerContext(t, "cn=alice"), want: "cn=alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientID(tt.ctx); got != tt.want {
+				t.Errorf("clientID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// peerContext returns the context of a call from client: a peer address,
+// or "cn=<name>" for a TLS client with a verified certificate for name,
+// connecting from a shared address.
+func peerContext(t *testing.T, client string) context.Context {
+	t.Helper()
+	if name, ok := strings.CutPrefix(client, "cn="); ok {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		return peer.NewContext(context.Background(), &peer.Peer{
+			Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443},
+			AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			}},
+		})
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/registry"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RecommendationConfig holds the thresholds of right-sizing recommendations.
+type RecommendationConfig struct {
+	// MinObserved is how much usage history an instance needs before it is
+	// judged, so short spikes or quiet spells are not taken as chronic.
+	MinObserved time.Duration `mapstructure:"min_observed"`
+
+	// OverProvisionedBelow flags a resource whose p95 usage is below this
+	// fraction of the requested amount.
+	OverProvisionedBelow float64 `mapstructure:"over_provisioned_below"`
+
+	// StarvedAbove flags a resource whose p95 usage is above this fraction
+	// of the requested amount.
+	StarvedAbove float64 `mapstructure:"starved_above"`
+
+	// TargetUtilization is the p95 utilization suggested sizes aim for.
+	TargetUtilization float64 `mapstructure:"target_utilization"`
+}
+
+// DefaultRecommendationConfig returns the default recommendation thresholds.
+func DefaultRecommendationConfig() RecommendationConfig {
+	return RecommendationConfig{
+		MinObserved:          6 * time.Hour,
+		OverProvisionedBelow: 0.3,
+		StarvedAbove:         0.9,
+		TargetUtilization:    0.7,
+	}
+}
+
+// SetRecommendationConfig sets the thresholds of right-sizing
+// recommendations.
+func (s *ComputeService) SetRecommendationConfig(config RecommendationConfig) {
+	s.recommendations = config
+}
+
+const (
+	// Recommendation kinds
+	RecommendationOverProvisioned = "over-provisioned"
+	RecommendationStarved         = "starved"
+
+	// Resources recommendations are made for
+	ResourceCPU    = "cpu"
+	ResourceMemory = "memory"
+
+	// memoryStepMiB is the granularity of suggested memory sizes.
+	memoryStepMiB = 128
+)
+
+// GetRecommendationsRequest represents a get recommendations request. When
+// InstanceIDs is empty, all running instances matching NodeID and
+// LabelSelector are included.
+type GetRecommendationsRequest struct {
+	InstanceIDs   []string
+	NodeID        string
+	LabelSelector map[string]string
+}
+
+// Recommendation suggests resizing one resource of an instance. Amounts are
+// in Unit: cores for CPU, MiB for memory.
+type Recommendation struct {
+	InstanceID   string
+	InstanceName string
+	NodeID       string
+	Resource     string
+	Kind         string
+	Requested    float64
+	P95          float64
+	Suggested    float64
+	Unit         string
+	Reason       string
+	Usage        *v1.InstanceUsage
+}
+
+// SkippedInstance is a selected instance no recommendation could be made for.
+type SkippedInstance struct {
+	InstanceID string
+	Reason     string
+}
+
+// GetRecommendations compares the p95 CPU and memory usage the agents have
+// summarized for instances with what the instances request, and suggests
+// resizing chronically over-provisioned or starved ones. Instances that
+// cannot be judged are reported as skipped.
+func (s *ComputeService) GetRecommendations(ctx context.Context, req *GetRecommendationsRequest) ([]Recommendation, []SkippedInstance, error) {
+	if len(req.InstanceIDs) > maxBatchStatsInstances {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "at most %d instances per request, got %d",
+			maxBatchStatsInstances, len(req.InstanceIDs))
+	}
+
+	selected, err := s.resolveBatchStatsInstances(ctx, &BatchGetInstanceStatsRequest{
+		InstanceIDs:   req.InstanceIDs,
+		NodeID:        req.NodeID,
+		LabelSelector: req.LabelSelector,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var skipped []SkippedInstance
+	byNode := make(map[string][]string)
+	for _, result := range selected {
+		switch {
+		case result.Err != nil:
+			skipped = append(skipped, SkippedInstance{InstanceID: result.InstanceID, Reason: result.Err.Error()})
+		case result.NodeID == "":
+			skipped = append(skipped, SkippedInstance{InstanceID: result.InstanceID, Reason: "instance is not scheduled on a node"})
+		default:
+			byNode[result.NodeID] = append(byNode[result.NodeID], result.InstanceID)
+		}
+	}
+
+	instances, err := s.instanceRegistry.List(ctx)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "failed to list instances: %v", err)
+	}
+	byID := make(map[string]*registry.Instance, len(instances))
+	for _, instance := range instances {
+		byID[instance.ID] = instance
+	}
+
+	var (
+		mu     sync.Mutex
+		usage  = make(map[string]*v1.InstanceUsage)
+		failed = make(map[string]error)
+		sem    = make(chan struct{}, batchStatsNodeParallelism)
+		wg     sync.WaitGroup
+	)
+	for nodeID, ids := range byNode {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			items, err := s.usageFromNode(ctx, nodeID, ids)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed[nodeID] = err
+				return
+			}
+			for _, item := range items {
+				usage[item.InstanceId] = item
+			}
+		}()
+	}
+	wg.Wait()
+
+	var recommendations []Recommendation
+	for nodeID, ids := range byNode {
+		for _, id := range ids {
+			u, ok := usage[id]
+			instance, found := byID[id]
+			switch {
+			case failed[nodeID] != nil:
+				skipped = append(skipped, SkippedInstance{InstanceID: id, Reason: failed[nodeID].Error()})
+				continue
+			case !found:
+				skipped = append(skipped, SkippedInstance{InstanceID: id, Reason: "instance was deleted"})
+				continue
+			case !ok:
+				skipped = append(skipped, SkippedInstance{InstanceID: id, Reason: "no usage collected yet"})
+				continue
+			}
+
+			recs, reason := s.recommend(instance, u)
+			if reason != "" {
+				skipped = append(skipped, SkippedInstance{InstanceID: id, Reason: reason})
+				continue
+			}
+			recommendations = append(recommendations, recs...)
+		}
+	}
+
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].InstanceName != recommendations[j].InstanceName {
+			return recommendations[i].InstanceName < recommendations[j].InstanceName
+		}
+		return recommendations[i].Resource < recommendations[j].Resource
+	})
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].InstanceID < skipped[j].InstanceID })
+	return recommendations, skipped, nil
+}
+
+// usageFromNode fetches the usage summaries of instances on one node.
+func (s *ComputeService) usageFromNode(ctx context.Context, nodeID string, ids []string) ([]*v1.InstanceUsage, error) {
+	ctx, cancel := context.WithTimeout(ctx, batchStatsNodeTimeout)
+	defer cancel()
+
+	agentClient, err := s.agentClients.GetClient(ctx, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to agent on %s: %w", nodeID, err)
+	}
+
+	resp, err := agentClient.GetInstanceUsage(ctx, &v1.AgentGetInstanceUsageRequest{InstanceIds: ids})
+	if err != nil {
+		return nil, fmt.Errorf("agent on %s failed to get instance usage: %w", nodeID, err)
+	}
+	return resp.Usage, nil
+}
+
+// recommend judges an instance's usage against its requested resources. It
+// returns the reason the instance was not judged, if it was not.
+func (s *ComputeService) recommend(instance *registry.Instance, usage *v1.InstanceUsage) ([]Recommendation, string) {
+	config := s.recommendations
+
+	observed := usage.WindowEnd.AsTime().Sub(usage.WindowStart.AsTime())
+	if observed < config.MinObserved {
+		return nil, fmt.Sprintf("only %s of usage collected, %s needed",
+			observed.Round(time.Minute), config.MinObserved)
+	}
+
+	base := Recommendation{
+		InstanceID:   instance.ID,
+		InstanceName: instance.Name,
+		NodeID:       instance.NodeID,
+		Usage:        usage,
+	}
+
+	var recs []Recommendation
+	if cores := float64(instance.Spec.CPUCores); cores > 0 {
+		p95 := usage.CpuP95Percent / 100
+		suggested := math.Max(1, math.Ceil(p95/config.TargetUtilization))
+		if rec, ok := s.judge(base, ResourceCPU, "cores", cores, p95, suggested); ok {
+			recs = append(recs, rec)
+		}
+	}
+	if mib := float64(instance.Spec.MemoryMB); mib > 0 {
+		p95 := float64(usage.MemoryP95Bytes) / (1 << 20)
+		suggested := math.Max(memoryStepMiB, math.Ceil(p95/config.TargetUtilization/memoryStepMiB)*memoryStepMiB)
+		if rec, ok := s.judge(base, ResourceMemory, "MiB", mib, p95, suggested); ok {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, ""
+}
+
+// judge flags a resource whose p95 usage is far below or close to what is
+// requested. Over-provisioned resources are only flagged when a smaller
+// size is actually possible.
+func (s *ComputeService) judge(base Recommendation, resource, unit string, requested, p95, suggested float64) (Recommendation, bool) {
+	config := s.recommendations
+	utilization := p95 / requested
+
+	rec := base
+	rec.Resource = resource
+	rec.Unit = unit
+	rec.Requested = requested
+	rec.P95 = p95
+	rec.Suggested = suggested
+
+	switch {
+	case utilization > config.StarvedAbove && suggested > requested:
+		rec.Kind = RecommendationStarved
+		rec.Reason = fmt.Sprintf("p95 %s usage is %.0f%% of the %g %s requested", resource, utilization*100, requested, unit)
+	case utilization < config.OverProvisionedBelow && suggested < requested:
+		rec.Kind = RecommendationOverProvisioned
+		rec.Reason = fmt.Sprintf("p95 %s usage is only %.0f%% of the %g %s requested", resource, utilization*100, requested, unit)
+	default:
+		return Recommendation{}, false
+	}
+	return rec, true
+}
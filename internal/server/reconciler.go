@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/apiconv"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ReconcilerConfig holds the instance reconciler configuration.
+type ReconcilerConfig struct {
+	// Enabled turns on desired-state reconciliation.
+	Enabled bool `mapstructure:"enabled"`
+
+	// Interval is how often every instance is compared with its node.
+	Interval time.Duration `mapstructure:"interval"`
+
+	// MaxBackoff caps the delay between retries for an instance that keeps
+	// failing to converge.
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+}
+
+// DefaultReconcilerConfig returns the default reconciler configuration.
+func DefaultReconcilerConfig() ReconcilerConfig {
+	return ReconcilerConfig{
+		Enabled:    true,
+		Interval:   30 * time.Second,
+		MaxBackoff: 10 * time.Minute,
+	}
+}
+
+// reconcileTimeout bounds the agent calls made for one instance.
+const reconcileTimeout = 2 * time.Minute
+
+var (
+	// errNotReconcilable aborts a status update or recreate of an instance
+	// whose desired state was cleared, e.g. by a delete.
+	errNotReconcilable = errors.New("instance is no longer reconciled")
+
+	// errStatusUnchanged skips the write when the status already matches.
+	errStatusUnchanged = errors.New("instance status unchanged")
+)
+
+// Reconciler drives every instance's observed state toward its desired
+// state. It polls the instance's agent, records what it finds as the
+// instance status, and starts, stops or recreates the instance when the two
+// disagree, e.g. when a start failed half way or a VM crashed.
+//
+// Instances on nodes that are not ready are left to the failure controller.
+type Reconciler struct {
+	config           ReconcilerConfig
+	nodeRegistry     *registry.EtcdRegistry
+	instanceRegistry *registry.EtcdInstanceRegistry
+	compute          *ComputeService
+	logger           *zap.Logger
+
+	// Retry state for instances that failed to converge
+	backoff   map[string]*reconcileBackoff
+	backoffMu sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type reconcileBackoff struct {
+	failures int
+	next     time.Time
+}
+
+// NewReconciler creates a new instance reconciler.
+func NewReconciler(
+	config ReconcilerConfig,
+	nodeReg *registry.EtcdRegistry,
+	instanceReg *registry.EtcdInstanceRegistry,
+	compute *ComputeService,
+	logger *zap.Logger,
+) *Reconciler {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Reconciler{
+		config:           config,
+		nodeRegistry:     nodeReg,
+		instanceRegistry: instanceReg,
+		compute:          compute,
+		logger:           logger,
+		backoff:          make(map[string]*reconcileBackoff),
+	}
+}
+
+// Start starts the periodic reconciliation loop.
+func (r *Reconciler) Start(ctx context.Context) error {
+	if !r.config.Enabled {
+		r.logger.Info("reconciler disabled")
+		return nil
+	}
+	if r.config.Interval <= 0 {
+		return fmt.Errorf("invalid reconcile interval: %s", r.config.Interval)
+	}
+
+	r.ctx, r.cancel = context.WithCancel(ctx)
+
+	r.wg.Add(1)
+	go r.run()
+
+	r.logger.Info("reconciler started", zap.Duration("interval", r.config.Interval))
+	return nil
+}
+
+// Stop stops the reconciler and waits for the current pass to finish.
+func (r *Reconciler) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.wg.Wait()
+	r.logger.Info("reconciler stopped")
+}
+
+func (r *Reconciler) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.reconcileAll()
+		}
+	}
+}
+
+// reconcileAll makes one pass over every managed instance.
+func (r *Reconciler) reconcileAll() {
+	instances, err := r.instanceRegistry.List(r.ctx)
+	if err != nil {
+		r.logger.Error("failed to list instances", zap.Error(err))
+		return
+	}
+
+	nodes := make(map[string]*registry.Node)
+	seen := make(map[string]struct{}, len(instances))
+	for _, instance := range instances {
+		if r.ctx.Err() != nil {
+			return
+		}
+		seen[instance.ID] = struct{}{}
+
+		if !reconcilable(instance) || !r.due(instance.ID) {
+			continue
+		}
+
+		node, ok := nodes[instance.NodeID]
+		if !ok {
+			node, _ = r.nodeRegistry.Get(r.ctx, instance.NodeID)
+			nodes[instance.NodeID] = node
+		}
+		if node == nil || !node.IsReady() {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(r.ctx, reconcileTimeout)
+		err := r.reconcile(ctx, instance)
+		cancel()
+		r.recordResult(instance, err)
+	}
+
+	// Forget retry state for deleted instances
+	r.backoffMu.Lock()
+	for id := range r.backoff {
+		if _, ok := seen[id]; !ok {
+			delete(r.backoff, id)
+		}
+	}
+	r.backoffMu.Unlock()
+}
+
+// reconcile compares one instance with its agent and acts on any difference.
+func (r *Reconciler) reconcile(ctx context.Context, instance *registry.Instance) error {
+	// Act on the latest desired state; the listing may be stale by now
+	instance, err := r.instanceRegistry.Get(ctx, instance.ID)
+	if err != nil {
+		if err == registry.ErrInstanceNotFound {
+			return nil
+		}
+		return fmt.Errorf("failed to get instance: %w", err)
+	}
+	if !reconcilable(instance) {
+		return nil
+	}
+
+	agentClient, err := r.compute.agentClients.GetClient(ctx, instance.NodeID)
+	if err != nil {
+		return fmt.Errorf("failed to connect to agent: %w", err)
+	}
+
+	observed, err := agentClient.GetInstance(ctx, &v1.AgentInstanceRequest{InstanceId: instance.ID})
+	recreated := false
+	if status.Code(err) == codes.NotFound {
+		// Lost by the node, e.g. a create that never completed or a host
+		// reinstall; recreate it from the stored spec. Claim the recreate on
+		// the stored instance first so a stop or delete that raced with the
+		// listing is seen before the node builds it again.
+		instance, err = r.instanceRegistry.Modify(ctx, instance.ID, func(instance *registry.Instance) error {
+			if !reconcilable(instance) {
+				return errNotReconcilable
+			}
+			instance.State = driver.StateCreating
+			instance.StateReason = "recreating instance missing on its node"
+			return nil
+		})
+		if err != nil {
+			if err == registry.ErrInstanceNotFound || errors.Is(err, errNotReconcilable) {
+				return nil
+			}
+			return fmt.Errorf("failed to claim instance for recreate: %w", err)
+		}
+
+		observed, err = agentClient.CreateInstance(ctx, &v1.AgentCreateInstanceRequest{
+			InstanceId: instance.ID,
+			Name:       instance.Name,
+			Type:       driverTypeToProtoType(instance.Type),
+			Spec:       driverSpecToProtoSpec(&instance.Spec),
+			Labels:     instance.Labels,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to recreate instance: %w", err)
+		}
+		recreated = true
+		r.compute.recordEvent(ctx, events.TypeWarning, instance.ID, instance.NodeID, "Recreated",
+			"instance was missing on its node and was recreated")
+	} else if err != nil {
+		return fmt.Errorf("failed to get instance from agent: %w", err)
+	}
+
+	actual := protoStateToDriverState(observed.State)
+	reason := observed.StateReason
+
+	switch {
+	case instance.DesiredState == driver.StateRunning && (actual == driver.StateStopped || actual == driver.StateFailed):
+		if observed, err = agentClient.StartInstance(ctx, &v1.AgentInstanceRequest{InstanceId: instance.ID}); err != nil {
+			return fmt.Errorf("failed to start instance: %w", err)
+		}
+		r.compute.recordEvent(ctx, events.TypeNormal, instance.ID, instance.NodeID, "Reconciled",
+			fmt.Sprintf("instance was %s, started it", actual))
+		actual = protoStateToDriverState(observed.State)
+		reason = "started to match desired state"
+
+	case instance.DesiredState == driver.StateStopped && actual == driver.StateRunning:
+		if observed, err = agentClient.StopInstance(ctx, &v1.AgentStopInstanceRequest{InstanceId: instance.ID}); err != nil {
+			return fmt.Errorf("failed to stop instance: %w", err)
+		}
+		actual = protoStateToDriverState(observed.State)
+		reason = "stopped to match desired state"
+		r.compute.recordEvent(ctx, events.TypeNormal, instance.ID, instance.NodeID, "Reconciled",
+			"instance was running, stopped it")
+	}
+
+	err = r.updateStatus(ctx, instance.ID, actual, reason, observed)
+	if err == registry.ErrInstanceNotFound || errors.Is(err, errNotReconcilable) {
+		if recreated {
+			// Deleted while the node was recreating it; don't leave it behind
+			if _, err := agentClient.DeleteInstance(ctx, &v1.AgentDeleteInstanceRequest{InstanceId: instance.ID, Force: true}); err != nil {
+				return fmt.Errorf("failed to delete recreated instance: %w", err)
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+// updateStatus records the observed state on the stored instance, leaving
+// its desired state untouched. It returns registry.ErrInstanceNotFound or
+// errNotReconcilable when the instance was deleted in the meantime.
+func (r *Reconciler) updateStatus(ctx context.Context, instanceID string, actual driver.InstanceState, reason string, observed *v1.Instance) error {
+	caps := apiconv.CapabilitiesFromProto(observed.Capabilities)
+	_, err := r.instanceRegistry.Modify(ctx, instanceID, func(instance *registry.Instance) error {
+		if !reconcilable(instance) {
+			return errNotReconcilable
+		}
+
+		capsChanged := caps != nil && (instance.Capabilities == nil || !reflect.DeepEqual(caps, instance.Capabilities))
+		if instance.State == actual && (observed.IpAddress == "" || instance.IPAddress == observed.IpAddress) && !capsChanged {
+			return errStatusUnchanged
+		}
+
+		instance.State = actual
+		instance.StateReason = reason
+		if observed.IpAddress != "" {
+			instance.IPAddress = observed.IpAddress
+		}
+		if observed.StartedAt != nil {
+			t := observed.StartedAt.AsTime()
+			instance.StartedAt = &t
+		}
+		if capsChanged {
+			instance.Capabilities = caps
+		}
+		return nil
+	})
+	switch {
+	case err == nil, errors.Is(err, errStatusUnchanged):
+		return nil
+	case err == registry.ErrInstanceNotFound, errors.Is(err, errNotReconcilable):
+		return err
+	default:
+		return fmt.Errorf("failed to update instance: %w", err)
+	}
+}
+
+// reconcilable reports whether the instance has a desired state the
+// reconciler knows how to reach.
+func reconcilable(instance *registry.Instance) bool {
+	return instance.DesiredState == driver.StateRunning || instance.DesiredState == driver.StateStopped
+}
+
+// due reports whether an instance's retry backoff has elapsed.
+func (r *Reconciler) due(instanceID string) bool {
+	r.backoffMu.Lock()
+	defer r.backoffMu.Unlock()
+
+	b, ok := r.backoff[instanceID]
+	return !ok || !time.Now().Before(b.next)
+}
+
+// recordResult resets or extends an instance's retry backoff.
+func (r *Reconciler) recordResult(instance *registry.Instance, err error) {
+	r.backoffMu.Lock()
+	defer r.backoffMu.Unlock()
+
+	if err == nil {
+		delete(r.backoff, instance.ID)
+		return
+	}
+
+	b, ok := r.backoff[instance.ID]
+	if !ok {
+		b = &reconcileBackoff{}
+		r.backoff[instance.ID] = b
+	}
+	b.failures++
+
+	// Double the interval per consecutive failure, up to MaxBackoff
+	delay := r.config.Interval
+	for i := 1; i < b.failures && delay < r.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if r.config.MaxBackoff > 0 && delay > r.config.MaxBackoff {
+		delay = r.config.MaxBackoff
+	}
+	b.next = time.Now().Add(delay)
+
+	r.logger.Warn("failed to reconcile instance",
+		zap.String("instance_id", instance.ID),
+		zap.String("node_id", instance.NodeID),
+		zap.String("desired_state", string(instance.DesiredState)),
+		zap.Int("failures", b.failures),
+		zap.Duration("retry_in", delay),
+		zap.Error(err),
+	)
+	r.compute.recordEvent(r.ctx, events.TypeWarning, instance.ID, instance.NodeID, "ReconcileFailed",
+		fmt.Sprintf("failed to reach desired state %s (attempt %d): %v", instance.DesiredState, b.failures, err))
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/registryauth"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SetRegistryCredentialRequest represents a request to store the credential
+// of a registry.
+type SetRegistryCredentialRequest struct {
+	Registry      string
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+// SetRegistryCredential stores the credential agents pull images from a
+// registry with, replacing any it had. The returned credential carries no
+// secrets.
+func (s *ClusterService) SetRegistryCredential(ctx context.Context, req *SetRegistryCredentialRequest) (*registryauth.Credential, error) {
+	if s.registryAuth == nil {
+		return nil, status.Error(codes.Unavailable, "registry credentials are not available")
+	}
+
+	host, err := registryauth.NormalizeHost(req.Registry)
+	if err != nil {
+		return nil, apierror.InvalidField("registry", err.Error())
+	}
+	now := time.Now()
+	credential := &registryauth.Credential{
+		Registry:      host,
+		Username:      req.Username,
+		Password:      req.Password,
+		IdentityToken: req.IdentityToken,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := credential.Validate(); err != nil {
+		return nil, apierror.InvalidField("credential", err.Error())
+	}
+
+	reason := "Created"
+	existing, err := s.registryAuth.Get(ctx, host)
+	switch {
+	case err == nil:
+		credential.CreatedAt = existing.CreatedAt
+		reason = "Updated"
+	case !errors.Is(err, registryauth.ErrCredentialNotFound):
+		return nil, status.Errorf(codes.Internal, "failed to get registry credential: %v", err)
+	}
+
+	if err := s.registryAuth.Put(ctx, credential); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store registry credential: %v", err)
+	}
+
+	s.logger.Info("registry credential stored",
+		zap.String("registry", host),
+		zap.String("username", credential.Username),
+	)
+	s.recordRegistryCredentialEvent(ctx, host, reason)
+	return credential.Redacted(), nil
+}
+
+// ListRegistryCredentials returns the stored credentials sorted by
+// registry, without their secrets.
+func (s *ClusterService) ListRegistryCredentials(ctx context.Context) ([]*registryauth.Credential, error) {
+	if s.registryAuth == nil {
+		return nil, status.Error(codes.Unavailable, "registry credentials are not available")
+	}
+
+	credentials, err := s.registryAuth.List(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list registry credentials: %v", err)
+	}
+	for i, credential := range credentials {
+		credentials[i] = credential.Redacted()
+	}
+	return credentials, nil
+}
+
+// DeleteRegistryCredential deletes the credential of a registry; agents
+// pull from it anonymously again, or with their configured credentials.
+func (s *ClusterService) DeleteRegistryCredential(ctx context.Context, registry string) error {
+	if s.registryAuth == nil {
+		return status.Error(codes.Unavailable, "registry credentials are not available")
+	}
+
+	host, err := registryauth.NormalizeHost(registry)
+	if err != nil {
+		return apierror.InvalidField("registry", err.Error())
+	}
+	if _, err := s.registryAuth.Get(ctx, host); err != nil {
+		if errors.Is(err, registryauth.ErrCredentialNotFound) {
+			return status.Errorf(codes.NotFound, "no credential for registry %s", host)
+		}
+		return status.Errorf(codes.Internal, "failed to get registry credential: %v", err)
+	}
+
+	if err := s.registryAuth.Delete(ctx, host); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete registry credential: %v", err)
+	}
+
+	s.logger.Info("registry credential deleted", zap.String("registry", host))
+	s.recordRegistryCredentialEvent(ctx, host, "Deleted")
+	return nil
+}
+
+func (s *ClusterService) recordRegistryCredentialEvent(ctx context.Context, registry, reason string) {
+	s.events.Record(ctx, events.Event{
+		Type:     events.TypeNormal,
+		Kind:     events.KindRegistryCredential,
+		ObjectID: registry,
+		Reason:   reason,
+	})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/cluster/registry"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// How a resize was applied.
+const (
+	ResizeLive    = "live"
+	ResizeRestart = "restart"
+	ResizeOffline = "offline"
+
+	// ResizeUnchanged is returned when the instance already has the size.
+	ResizeUnchanged = "unchanged"
+)
+
+// ResizeInstanceRequest represents a resize instance request.
+type ResizeInstanceRequest struct {
+	InstanceID     string
+	CPUCores       int
+	MemoryMB       int64
+	AllowRestart   bool
+	Force          bool
+	TimeoutSeconds int
+}
+
+// ResizeInstance changes the vCPUs and memory of an instance; zero leaves a
+// value unchanged. Growth must fit the free capacity of the instance's node.
+// The agent hot-plugs the change if the driver can, or stops, resizes and
+// starts the instance if the request allows it; the stored spec is updated
+// once the change is applied. It returns how the change was applied.
+func (s *ComputeService) ResizeInstance(ctx context.Context, req *ResizeInstanceRequest) (*registry.Instance, string, error) {
+	if req.CPUCores < 0 || req.MemoryMB < 0 {
+		return nil, "", status.Errorf(codes.InvalidArgument, "cpu cores and memory cannot be negative")
+	}
+	if req.CPUCores == 0 && req.MemoryMB == 0 {
+		return nil, "", status.Errorf(codes.InvalidArgument, "give the new cpu cores, memory or both")
+	}
+
+	instance, err := s.instanceRegistry.Get(ctx, req.InstanceID)
+	if err != nil {
+		if err == registry.ErrInstanceNotFound {
+			return nil, "", status.Errorf(codes.NotFound, "instance not found: %s", req.InstanceID)
+		}
+		return nil, "", status.Errorf(codes.Internal, "failed to get instance: %v", err)
+	}
+
+	cpuCores, memoryMB := instance.Spec.CPUCores, instance.Spec.MemoryMB
+	if req.CPUCores > 0 {
+		cpuCores = req.CPUCores
+	}
+	if req.MemoryMB > 0 {
+		memoryMB = req.MemoryMB
+	}
+	if cpuCores == instance.Spec.CPUCores && memoryMB == instance.Spec.MemoryMB {
+		return instance, ResizeUnchanged, nil
+	}
+
+	method := ResizeOffline
+	if instance.NodeID != "" {
+		if err := requireCapability(s.instanceCapabilities(ctx, instance), "resize", func(caps *registry.InstanceCapabilities) bool {
+			return caps.Resize
+		}); err != nil {
+			return nil, "", err
+		}
+		if err := s.checkResizeCapacity(ctx, instance, cpuCores, memoryMB); err != nil {
+			return nil, "", err
+		}
+
+		agentClient, err := s.agentClients.GetClient(ctx, instance.NodeID)
+		if err != nil {
+			return nil, "", agentUnavailable(err)
+		}
+
+		resp, err := agentClient.ResizeInstance(ctx, &v1.AgentResizeInstanceRequest{
+			InstanceId:     req.InstanceID,
+			CpuCores:       int32(req.CPUCores),
+			MemoryBytes:    req.MemoryMB * 1024 * 1024,
+			AllowRestart:   req.AllowRestart,
+			Force:          req.Force,
+			TimeoutSeconds: int32(req.TimeoutSeconds),
+		})
+		if err != nil {
+			s.recordEvent(ctx, events.TypeWarning, req.InstanceID, instance.NodeID, "FailedResize", err.Error())
+			switch status.Code(err) {
+			case codes.FailedPrecondition:
+				return nil, "", status.Errorf(codes.FailedPrecondition,
+					"instance %s cannot be resized while running; retry with allow_restart to stop and start it", req.InstanceID)
+			case codes.Unimplemented, codes.NotFound, codes.InvalidArgument:
+				return nil, "", err
+			}
+			return nil, "", status.Errorf(codes.Internal, "agent failed to resize instance: %v", err)
+		}
+
+		switch {
+		case resp.Restarted:
+			method = ResizeRestart
+		case instance.IsRunning():
+			method = ResizeLive
+		}
+	}
+
+	updated, err := s.instanceRegistry.Modify(ctx, req.InstanceID, func(instance *registry.Instance) error {
+		instance.Spec.CPUCores = cpuCores
+		instance.Spec.MemoryMB = memoryMB
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, etcd.ErrConflict) {
+			return nil, "", status.Errorf(codes.Aborted, "instance %s is being updated concurrently, retry", req.InstanceID)
+		}
+		return nil, "", status.Errorf(codes.Internal, "failed to update instance: %v", err)
+	}
+
+	var changes []string
+	if cpuCores != instance.Spec.CPUCores {
+		changes = append(changes, fmt.Sprintf("cpus %d -> %d", instance.Spec.CPUCores, cpuCores))
+	}
+	if memoryMB != instance.Spec.MemoryMB {
+		changes = append(changes, fmt.Sprintf("memory %d -> %d MiB", instance.Spec.MemoryMB, memoryMB))
+	}
+	message := fmt.Sprintf("%s (%s)", strings.Join(changes, ", "), method)
+
+	s.logger.Info("instance resized",
+		zap.String("instance_id", req.InstanceID),
+		zap.Int("cpu_cores", cpuCores),
+		zap.Int64("memory_mb", memoryMB),
+		zap.String("method", method),
+	)
+	s.recordEvent(ctx, events.TypeNormal, req.InstanceID, instance.NodeID, "Resized", message)
+	return updated, method, nil
+}
+
+// checkResizeCapacity verifies that the instance's node has room for the
+// growth of a resize. Shrinking always fits.
+func (s *ComputeService) checkResizeCapacity(ctx context.Context, instance *registry.Instance, cpuCores int, memoryMB int64) error {
+	node, err := s.nodeRegistry.Get(ctx, instance.NodeID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get node %s: %v", instance.NodeID, err)
+	}
+
+	required := registry.Resources{
+		CPUCores:    max(0, cpuCores-instance.Spec.CPUCores),
+		MemoryBytes: max(0, memoryMB-instance.Spec.MemoryMB) * 1024 * 1024,
+	}
+	if !node.CanSchedule(required) {
+		avail := node.AvailableResources()
+		reason := fmt.Sprintf("resize needs %d more cpus, %d MiB more memory; available %d cpus, %d MiB memory",
+			required.CPUCores, required.MemoryBytes/(1024*1024), avail.CPUCores, avail.MemoryBytes/(1024*1024))
+		return apierror.InsufficientCapacity(fmt.Sprintf("node %s lacks capacity: %s", node.ID, reason), node.ID, reason)
+	}
+	return nil
+}
@@ -6,15 +6,26 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	v1 "hypervisor/api/gen"
 	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
 	"hypervisor/pkg/cluster/heartbeat"
+	"hypervisor/pkg/cluster/idempotency"
+	"hypervisor/pkg/cluster/latency"
+	"hypervisor/pkg/cluster/notify"
 	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/cluster/upgrade"
 	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/health"
+	"hypervisor/pkg/metrics"
+	"hypervisor/pkg/tracing"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
 )
 
@@ -26,23 +37,98 @@ type Config struct {
 	// HTTPAddr is the address for the HTTP/REST gateway.
 	HTTPAddr string `mapstructure:"http_addr"`
 
+	// MetricsAddr is the address for the Prometheus /metrics endpoint (empty disables it).
+	MetricsAddr string `mapstructure:"metrics_addr"`
+
 	// Etcd configuration
 	Etcd etcd.Config `mapstructure:"etcd"`
 
 	// Heartbeat configuration
 	Heartbeat heartbeat.Config `mapstructure:"heartbeat"`
+
+	// Failover configuration
+	Failover FailoverConfig `mapstructure:"failover"`
+
+	// Desired-state reconciler configuration
+	Reconciler ReconcilerConfig `mapstructure:"reconciler"`
+
+	// Instance group controller configuration
+	Groups GroupControllerConfig `mapstructure:"groups"`
+
+	// Maintenance window controller configuration
+	Maintenance MaintenanceControllerConfig `mapstructure:"maintenance"`
+
+	// Leader election configuration
+	LeaderElection LeaderElectionConfig `mapstructure:"leader_election"`
+
+	// Active-active coordination configuration
+	Coordination CoordinationConfig `mapstructure:"coordination"`
+
+	// Connections to agents: health checking and reconnection
+	AgentPool AgentPoolConfig `mapstructure:"agent_pool"`
+
+	// Events configuration
+	Events events.Config `mapstructure:"events"`
+
+	// Event notification (webhook) configuration
+	Notifications notify.Config `mapstructure:"notifications"`
+
+	// Right-sizing recommendation thresholds
+	Recommendations RecommendationConfig `mapstructure:"recommendations"`
+
+	// Health checks served over gRPC and on the metrics endpoint
+	Health health.Config `mapstructure:"health"`
+
+	// Export of request traces
+	Tracing tracing.Config `mapstructure:"tracing"`
+
+	// Rate and concurrency limits of client calls
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+
+	// In-memory cache of the node and instance registries
+	RegistryCache RegistryCacheConfig `mapstructure:"registry_cache"`
+
+	// SDN controller configuration
+	Network NetworkConfig `mapstructure:"network"`
+
+	// Version is the server release, set by the binary rather than configured.
+	Version string `mapstructure:"-"`
 }
 
 // DefaultConfig returns the default server configuration.
 func DefaultConfig() Config {
 	return Config{
-		GRPCAddr:  ":50051",
-		HTTPAddr:  ":8080",
-		Etcd:      etcd.DefaultConfig(),
-		Heartbeat: heartbeat.DefaultConfig(),
+		GRPCAddr:       ":50051",
+		HTTPAddr:       ":8080",
+		MetricsAddr:    ":9090",
+		Etcd:           etcd.DefaultConfig(),
+		Heartbeat:      heartbeat.DefaultConfig(),
+		Failover:       DefaultFailoverConfig(),
+		Reconciler:     DefaultReconcilerConfig(),
+		Groups:         DefaultGroupControllerConfig(),
+		Maintenance:    DefaultMaintenanceControllerConfig(),
+		LeaderElection: DefaultLeaderElectionConfig(),
+		Coordination:   DefaultCoordinationConfig(),
+		AgentPool:      DefaultAgentPoolConfig(),
+		Events:         events.DefaultConfig(),
+		Notifications:  notify.DefaultConfig(),
+
+		Recommendations: DefaultRecommendationConfig(),
+		Health:          health.DefaultConfig(),
+		Tracing:         tracing.DefaultConfig(),
+		RateLimit:       DefaultRateLimitConfig(),
+		RegistryCache:   RegistryCacheConfig{Enabled: true},
+		Network:         DefaultNetworkConfig(),
 	}
 }
 
+// RegistryCacheConfig configures the in-memory copy of the nodes and
+// instances that serves registry reads, kept in sync by etcd watches so
+// that gets and filtered lists do not read etcd on every request.
+type RegistryCacheConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
 // Server is the hypervisor control plane server.
 type Server struct {
 	config Config
@@ -51,21 +137,65 @@ type Server struct {
 	// gRPC server
 	grpcServer *grpc.Server
 
+	// Prometheus metrics endpoint
+	metricsServer *metrics.Server
+
 	// Cluster components
 	etcdClient       *etcd.Client
 	registry         *registry.EtcdRegistry
 	instanceRegistry *registry.EtcdInstanceRegistry
 	monitor          *heartbeat.Monitor
 
+	// Compute service, node-failure controller, desired-state reconciler
+	// and instance group controller
+	computeService    *ComputeService
+	failureController *FailureController
+	reconciler        *Reconciler
+	groupController   *GroupController
+
+	// Cluster service and maintenance window controller
+	clusterService        *ClusterService
+	maintenanceController *MaintenanceController
+
 	// Agent client pool
 	agentClients *AgentClientPool
 
+	// Agent ownership in active-active mode, and the server relaying the
+	// agent calls other servers forward (nil when disabled)
+	ownership       *agentOwnership
+	ownershipCancel context.CancelFunc
+	peerServer      *grpc.Server
+
+	// Cluster event log and webhook notifications
+	events   *events.Recorder
+	notifier *notify.Notifier
+
 	// Network service
 	networkService *NetworkService
 
+	// Health checks of etcd and the SDN controller
+	health *health.Checker
+
+	// Flushes and stops the trace exporter
+	shutdownTracing func(context.Context) error
+
+	// Rate and concurrency limits of client calls
+	rateLimiter *rateLimiter
+
 	// Compute drivers (for managing instances across the cluster)
 	drivers map[driver.InstanceType]driver.Driver
 
+	// Version record and deprecated API audit, read by upgrade plans
+	member      *upgrade.Member
+	auditor     *upgrade.Auditor
+	auditCancel context.CancelFunc
+	auditDone   chan struct{}
+
+	// Leader election (nil when disabled)
+	elector        *etcd.Elector
+	electionCancel context.CancelFunc
+	electionDone   chan struct{}
+
 	mu      sync.RWMutex
 	running bool
 }
@@ -76,6 +206,20 @@ func New(config Config, logger *zap.Logger) (*Server, error) {
 		logger = zap.NewNop()
 	}
 
+	// Export traces before anything traced runs
+	shutdownTracing, err := tracing.Setup(context.Background(), config.Tracing, "hypervisor-server", config.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	// Servers authenticate each other for active-active coordination
+	var peerServerCreds, peerClientCreds credentials.TransportCredentials
+	if config.Coordination.Enabled {
+		if peerServerCreds, peerClientCreds, err = config.Coordination.peerCredentials(); err != nil {
+			return nil, fmt.Errorf("invalid coordination config: %w", err)
+		}
+	}
+
 	// Connect to etcd
 	etcdClient, err := etcd.New(config.Etcd, logger.Named("etcd"))
 	if err != nil {
@@ -88,44 +232,140 @@ func New(config Config, logger *zap.Logger) (*Server, error) {
 	// Create instance registry
 	instanceReg := registry.NewEtcdInstanceRegistry(etcdClient, logger.Named("instance-registry"))
 
+	// Serve registry reads from memory; Stop closes the registries, which
+	// stops their caches
+	if config.RegistryCache.Enabled {
+		reg.EnableCache(context.Background())
+		instanceReg.EnableCache(context.Background())
+	}
+
 	// Create agent client pool
-	agentClients := NewAgentClientPool(reg, logger.Named("agent-clients"))
+	agentClients := NewAgentClientPool(reg, config.AgentPool, logger.Named("agent-clients"))
+
+	// Create event recorder
+	recorder := events.NewRecorder(etcdClient, config.Events, "server", logger.Named("events"))
+
+	// Create event notifier
+	notifier, err := notify.NewNotifier(config.Notifications, recorder, etcdClient, logger.Named("notify"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification config: %w", err)
+	}
+
+	// Create compute service and node-failure controller
+	computeService := NewComputeService(reg, instanceReg, agentClients, recorder.WithComponent("compute"), logger.Named("compute"))
+	computeService.SetRecommendationConfig(config.Recommendations)
+	computeService.SetLatencyStore(latency.NewStore(etcdClient))
+	computeService.SetIdempotencyStore(idempotency.NewStore(etcdClient, logger.Named("idempotency")))
+	failureController := NewFailureController(config.Failover, reg, instanceReg, computeService, logger.Named("failover"))
+	reconciler := NewReconciler(config.Reconciler, reg, instanceReg, computeService, logger.Named("reconciler"))
+	groupController := NewGroupController(config.Groups, instanceReg, computeService, logger.Named("groups"))
+	computeService.SetGroupController(groupController)
+
+	// Create cluster service and maintenance window controller
+	clusterService := NewClusterService(reg, computeService, recorder.WithComponent("cluster"), logger.Named("cluster"))
+	clusterService.SetNotifier(notifier)
+	clusterService.SetEtcdClient(etcdClient)
+	maintenanceController := NewMaintenanceController(config.Maintenance, clusterService, logger.Named("maintenance"))
+	clusterService.SetMaintenanceController(maintenanceController)
 
 	// Create heartbeat monitor
 	monitor := heartbeat.NewMonitor(reg, config.Heartbeat, func(nodeID string, alive bool) {
 		if !alive {
 			logger.Warn("node is down", zap.String("node_id", nodeID))
-			// TODO: Reschedule instances from the dead node
+			recorder.Record(context.Background(), events.Event{
+				Type:     events.TypeWarning,
+				Kind:     events.KindNode,
+				ObjectID: nodeID,
+				NodeID:   nodeID,
+				Reason:   "NodeNotReady",
+				Message:  "node stopped sending heartbeats",
+			})
+			failureController.NodeDown(nodeID)
 		}
 	}, logger.Named("monitor"))
 
 	// Create network service
-	networkService, err := NewNetworkService(etcdClient, logger.Named("network"))
+	networkService, err := NewNetworkService(config.Network, etcdClient, recorder.WithComponent("sdn"), logger.Named("network"))
 	if err != nil {
 		logger.Warn("failed to create network service (networking features will be unavailable)", zap.Error(err))
+	} else {
+		computeService.SetNetworkChecker(networkService)
+		networkService.SetInstanceRegistry(instanceReg)
+		networkService.SetAgentClients(agentClients)
 	}
 
 	s := &Server{
-		config:           config,
-		logger:           logger,
-		etcdClient:       etcdClient,
-		registry:         reg,
-		instanceRegistry: instanceReg,
-		agentClients:     agentClients,
-		monitor:          monitor,
-		networkService:   networkService,
-		drivers:          make(map[driver.InstanceType]driver.Driver),
+		config:                config,
+		logger:                logger,
+		etcdClient:            etcdClient,
+		registry:              reg,
+		instanceRegistry:      instanceReg,
+		agentClients:          agentClients,
+		events:                recorder,
+		notifier:              notifier,
+		monitor:               monitor,
+		computeService:        computeService,
+		failureController:     failureController,
+		reconciler:            reconciler,
+		groupController:       groupController,
+		clusterService:        clusterService,
+		maintenanceController: maintenanceController,
+		networkService:        networkService,
+		drivers:               make(map[driver.InstanceType]driver.Driver),
+		shutdownTracing:       shutdownTracing,
+		rateLimiter:           newRateLimiter(config.RateLimit, logger.Named("ratelimit")),
 	}
 
-	// Create gRPC server with interceptors
-	s.grpcServer = grpc.NewServer(
+	serverID := config.Coordination.advertiseAddr(config.GRPCAddr)
+	s.health = s.newHealthChecker()
+	clusterService.SetHealthChecker(s.health, serverID)
+	s.member = upgrade.NewMember(etcdClient, serverID, config.Version, logger.Named("member"))
+	s.auditor = upgrade.NewAuditor(etcdClient, serverID, logger.Named("audit"))
+
+	if config.LeaderElection.Enabled {
+		s.elector = etcd.NewElector(
+			etcdClient,
+			config.LeaderElection.Prefix,
+			config.LeaderElection.electionID(config.GRPCAddr),
+			config.LeaderElection.TTL,
+			logger.Named("election"),
+		)
+	}
+
+	serverOpts := []grpc.ServerOption{
 		grpc.UnaryInterceptor(s.unaryInterceptor),
 		grpc.StreamInterceptor(s.streamInterceptor),
-	)
+		tracing.ServerOption(),
+	}
+
+	if config.Coordination.Enabled {
+		s.ownership = newAgentOwnership(
+			etcdClient,
+			config.Coordination,
+			config.Coordination.advertiseAddr(config.Coordination.PeerAddr),
+			logger.Named("ownership"),
+		)
+		agentClients.SetOwnership(s.ownership, peerClientCreds)
+		computeService.SetOwnership(s.ownership)
+
+		// Relay agent calls other servers forward to this one, on a
+		// listener of its own that only authenticated servers can call
+		s.peerServer = grpc.NewServer(
+			grpc.Creds(peerServerCreds),
+			grpc.UnknownServiceHandler(s.forwardAgentStream),
+			tracing.ServerOption(),
+		)
+	}
+
+	// Create gRPC server with interceptors
+	s.grpcServer = grpc.NewServer(serverOpts...)
 
 	// Register services
 	s.registerServices()
 
+	// Serve grpc.health.v1.Health
+	s.health.Register(s.grpcServer)
+
 	// Enable reflection for debugging
 	reflection.Register(s.grpcServer)
 
@@ -135,13 +375,11 @@ func New(config Config, logger *zap.Logger) (*Server, error) {
 // registerServices registers gRPC services.
 func (s *Server) registerServices() {
 	// Register ClusterService
-	clusterService := NewClusterService(s.registry, s.logger.Named("cluster"))
-	clusterHandler := NewClusterGRPCHandler(clusterService)
+	clusterHandler := NewClusterGRPCHandler(s.clusterService)
 	v1.RegisterClusterServiceServer(s.grpcServer, clusterHandler)
 
 	// Register ComputeService
-	computeService := NewComputeService(s.registry, s.instanceRegistry, s.agentClients, s.logger.Named("compute"))
-	computeHandler := NewComputeGRPCHandler(computeService)
+	computeHandler := NewComputeGRPCHandler(s.computeService)
 	v1.RegisterComputeServiceServer(s.grpcServer, computeHandler)
 
 	// Register NetworkService
@@ -161,11 +399,63 @@ func (s *Server) Start(ctx context.Context) error {
 	s.running = true
 	s.mu.Unlock()
 
-	// Start heartbeat monitor
-	if err := s.monitor.Start(ctx); err != nil {
-		return fmt.Errorf("failed to start heartbeat monitor: %w", err)
+	// Start metrics endpoint
+	if s.config.MetricsAddr != "" {
+		s.metricsServer = metrics.NewServer(s.config.MetricsAddr, s.logger.Named("metrics"))
+		s.metricsServer.Handle("/healthz", s.health.LivenessHandler())
+		s.metricsServer.Handle("/readyz", s.health.ReadinessHandler())
+		if err := s.metricsServer.Start(); err != nil {
+			return fmt.Errorf("failed to start metrics server: %w", err)
+		}
+	}
+
+	// Refuse to serve data written by a newer release
+	schema, err := upgrade.EnsureSchema(ctx, s.etcdClient)
+	if err != nil {
+		return fmt.Errorf("failed to check etcd schema: %w", err)
+	}
+
+	// Publish this server's version for upgrade plans
+	if err := s.member.Start(ctx); err != nil {
+		s.logger.Warn("failed to publish server version", zap.Error(err))
+	}
+	auditCtx, auditCancel := context.WithCancel(ctx)
+	s.auditCancel = auditCancel
+	s.auditDone = make(chan struct{})
+	go func() {
+		defer close(s.auditDone)
+		s.auditor.Run(auditCtx)
+	}()
+
+	s.logger.Info("cluster versions",
+		zap.String("version", s.config.Version),
+		zap.Int("schema_version", schema),
+	)
+
+	// Take part in agent ownership before serving any agent call
+	if s.ownership != nil {
+		ownershipCtx, cancel := context.WithCancel(ctx)
+		if err := s.ownership.start(ownershipCtx); err != nil {
+			cancel()
+			return fmt.Errorf("failed to start agent ownership: %w", err)
+		}
+		s.ownershipCancel = cancel
+
+		peerListener, err := net.Listen("tcp", s.config.Coordination.PeerAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", s.config.Coordination.PeerAddr, err)
+		}
+		s.logger.Info("accepting forwarded agent calls", zap.String("addr", s.config.Coordination.PeerAddr))
+		go func() {
+			if err := s.peerServer.Serve(peerListener); err != nil {
+				s.logger.Error("peer gRPC server error", zap.Error(err))
+			}
+		}()
 	}
 
+	// Watch the health of agent connections
+	s.agentClients.Start(ctx)
+
 	// Start network service
 	if s.networkService != nil {
 		if err := s.networkService.Start(); err != nil {
@@ -173,6 +463,22 @@ func (s *Server) Start(ctx context.Context) error {
 		}
 	}
 
+	// Start cluster controllers, or campaign for the right to run them
+	if s.elector == nil {
+		s.startLeading(ctx)
+	} else {
+		electionCtx, cancel := context.WithCancel(ctx)
+		s.electionCancel = cancel
+		s.electionDone = make(chan struct{})
+		go func() {
+			defer close(s.electionDone)
+			s.elector.Run(electionCtx, s.startLeading, s.stopLeading)
+		}()
+		s.logger.Info("leader election enabled, serving read-only until elected",
+			zap.String("id", s.elector.ID()),
+		)
+	}
+
 	// Start gRPC server
 	listener, err := net.Listen("tcp", s.config.GRPCAddr)
 	if err != nil {
@@ -187,6 +493,8 @@ func (s *Server) Start(ctx context.Context) error {
 		}
 	}()
 
+	go s.health.Run(ctx)
+
 	return nil
 }
 
@@ -201,14 +509,31 @@ func (s *Server) Stop() error {
 
 	s.running = false
 
-	// Stop heartbeat monitor
-	s.monitor.Stop()
+	// Report not serving while shutting down
+	s.health.Shutdown()
+
+	// Stop cluster controllers and give up leadership
+	if s.elector == nil {
+		s.stopLeading()
+	} else if s.electionCancel != nil {
+		s.electionCancel()
+		<-s.electionDone
+	}
 
 	// Stop network service
 	if s.networkService != nil {
 		s.networkService.Stop()
 	}
 
+	// Hand owned agents over to the other servers
+	if s.ownership != nil {
+		s.peerServer.GracefulStop()
+		s.ownershipCancel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s.ownership.stop(ctx)
+		cancel()
+	}
+
 	// Close agent clients
 	if s.agentClients != nil {
 		s.agentClients.Close()
@@ -217,6 +542,24 @@ func (s *Server) Stop() error {
 	// Gracefully stop gRPC server
 	s.grpcServer.GracefulStop()
 
+	// Write the last deprecated calls and withdraw this server's version
+	if s.auditCancel != nil {
+		s.auditCancel()
+		<-s.auditDone
+	}
+	memberCtx, memberCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	s.member.Stop(memberCtx)
+	memberCancel()
+
+	// Stop metrics endpoint
+	if s.metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.metricsServer.Stop(ctx); err != nil {
+			s.logger.Warn("failed to stop metrics server", zap.Error(err))
+		}
+	}
+
 	// Close instance registry
 	if s.instanceRegistry != nil {
 		s.instanceRegistry.Close()
@@ -228,6 +571,13 @@ func (s *Server) Stop() error {
 	// Close etcd client
 	s.etcdClient.Close()
 
+	// Export the last spans
+	tracingCtx, tracingCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer tracingCancel()
+	if err := s.shutdownTracing(tracingCtx); err != nil {
+		s.logger.Warn("failed to flush traces", zap.Error(err))
+	}
+
 	s.logger.Info("server stopped")
 	return nil
 }
@@ -243,10 +593,26 @@ func (s *Server) unaryInterceptor(
 		zap.String("method", info.FullMethod),
 	)
 
+	start := time.Now()
+	release, err := s.rateLimiter.acquire(ctx, info.FullMethod, true)
+	if err != nil {
+		metrics.ObserveGRPCRequest(info.FullMethod, start, err)
+		return nil, err
+	}
+	defer release()
+
+	if err := s.checkLeader(ctx, info.FullMethod); err != nil {
+		metrics.ObserveGRPCRequest(info.FullMethod, start, err)
+		return nil, err
+	}
+	s.auditor.Record(info.FullMethod, callerAddr(ctx))
+
 	resp, err := handler(ctx, req)
+	metrics.ObserveGRPCRequest(info.FullMethod, start, err)
 	if err != nil {
 		s.logger.Error("gRPC error",
 			zap.String("method", info.FullMethod),
+			zap.String("trace_id", tracing.TraceID(ctx)),
 			zap.Error(err),
 		)
 	}
@@ -265,5 +631,26 @@ func (s *Server) streamInterceptor(
 		zap.String("method", info.FullMethod),
 	)
 
-	return handler(srv, ss)
+	start := time.Now()
+	if _, err := s.rateLimiter.acquire(ss.Context(), info.FullMethod, false); err != nil {
+		metrics.ObserveGRPCRequest(info.FullMethod, start, err)
+		return err
+	}
+	if err := s.checkLeader(ss.Context(), info.FullMethod); err != nil {
+		metrics.ObserveGRPCRequest(info.FullMethod, start, err)
+		return err
+	}
+	s.auditor.Record(info.FullMethod, callerAddr(ss.Context()))
+
+	err := handler(srv, ss)
+	metrics.ObserveGRPCRequest(info.FullMethod, start, err)
+	return err
+}
+
+// callerAddr returns the address of the client making a call.
+func callerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return "unknown"
 }
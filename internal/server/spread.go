@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/registry"
+)
+
+// spreadPlacement is how many instances matching each of an instance's
+// spread constraints run in each topology domain, counted once per
+// scheduling run.
+type spreadPlacement struct {
+	constraints []registry.SpreadConstraint
+	counts      []map[string]int // By constraint, then domain
+}
+
+// validateSpread checks the spread constraints of a create request and
+// defaults their labels to the instance's own.
+func validateSpread(req *CreateInstanceRequest) error {
+	for i := range req.SpreadConstraints {
+		c := &req.SpreadConstraints[i]
+		switch c.TopologyKey {
+		case registry.SpreadTopologyNode, registry.SpreadTopologyZone, registry.SpreadTopologyRegion:
+		default:
+			return apierror.InvalidField("spread_constraints.topology_key",
+				fmt.Sprintf("unknown topology key %q, must be node, zone or region", c.TopologyKey))
+		}
+		if len(c.MatchLabels) == 0 {
+			if len(req.Metadata) == 0 {
+				return apierror.InvalidField("spread_constraints.match_labels",
+					"spread constraint needs match_labels or an instance with labels")
+			}
+			c.MatchLabels = maps.Clone(req.Metadata)
+		}
+	}
+	return nil
+}
+
+// topologyDomain returns the domain of a node for a topology key. Zone
+// names are only unique within their region.
+func topologyDomain(node *registry.Node, key string) string {
+	switch key {
+	case registry.SpreadTopologyRegion:
+		return node.Region
+	case registry.SpreadTopologyZone:
+		return node.Region + "/" + node.Zone
+	default:
+		return node.ID
+	}
+}
+
+// prepareSpread counts the instances matching the request's spread
+// constraints per topology domain of the given nodes, for spreadScore.
+func (s *ComputeService) prepareSpread(ctx context.Context, req *CreateInstanceRequest, nodes []*registry.Node) error {
+	if len(req.SpreadConstraints) == 0 {
+		return nil
+	}
+
+	instances, err := s.instanceRegistry.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list instances: %w", err)
+	}
+	byID := make(map[string]*registry.Node, len(nodes))
+	for _, node := range nodes {
+		byID[node.ID] = node
+	}
+
+	placement := &spreadPlacement{constraints: req.SpreadConstraints}
+	for _, c := range req.SpreadConstraints {
+		counts := make(map[string]int)
+		// Empty domains are listed too, so that they score best
+		for _, node := range nodes {
+			counts[topologyDomain(node, c.TopologyKey)] = 0
+		}
+		for _, instance := range instances {
+			node, ok := byID[instance.NodeID]
+			if !ok || instance.IsFailed() || !instance.MatchesLabels(c.MatchLabels) {
+				continue
+			}
+			counts[topologyDomain(node, c.TopologyKey)]++
+		}
+		placement.counts = append(placement.counts, counts)
+	}
+	req.spread = placement
+	return nil
+}
+
+// spreadScore prefers nodes in the domains running the fewest matching
+// instances: 1 for the emptiest domain down to 0 for the fullest, averaged
+// over the constraints.
+func spreadScore(node *registry.Node, req *CreateInstanceRequest) float64 {
+	if req.spread == nil {
+		return 0
+	}
+
+	var total float64
+	for i, c := range req.spread.constraints {
+		counts := req.spread.counts[i]
+		least, most := -1, 0
+		for _, n := range counts {
+			if least < 0 || n < least {
+				least = n
+			}
+			most = max(most, n)
+		}
+		if most == least {
+			total++
+			continue
+		}
+		n := counts[topologyDomain(node, c.TopologyKey)]
+		total += float64(most-n) / float64(most-least)
+	}
+	return total / float64(len(req.spread.constraints))
+}
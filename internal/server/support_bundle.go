@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/registry"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CollectSupportBundleRequest represents a support bundle request.
+type CollectSupportBundleRequest struct {
+	NodeID          string
+	LogSinceSeconds int64
+}
+
+// CollectSupportBundle opens a stream of a node's support bundle from its
+// agent: a gzipped tar archive of the agent's logs and state, driver and
+// instance states, OVS flows, network namespaces and the node's etcd keys.
+func (s *ClusterService) CollectSupportBundle(ctx context.Context, req *CollectSupportBundleRequest) (v1.AgentService_CollectSupportBundleClient, error) {
+	if req.LogSinceSeconds < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "log_since_seconds cannot be negative")
+	}
+	if _, err := s.registry.Get(ctx, req.NodeID); err != nil {
+		if err == registry.ErrNodeNotFound {
+			return nil, status.Errorf(codes.NotFound, "node not found: %s", req.NodeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get node: %v", err)
+	}
+
+	agentClient, err := s.compute.agentClients.GetClient(ctx, req.NodeID)
+	if err != nil {
+		return nil, agentUnavailable(err)
+	}
+
+	stream, err := agentClient.CollectSupportBundle(ctx, &v1.CollectSupportBundleRequest{
+		LogSinceSeconds: req.LogSinceSeconds,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "agent failed to collect support bundle: %v", err)
+	}
+
+	s.logger.Info("support bundle requested", zap.String("node_id", req.NodeID))
+	return stream, nil
+}
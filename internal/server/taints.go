@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"hypervisor/pkg/apierror"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+)
+
+// validateNodeAffinity checks the node selector and tolerations of a create
+// request.
+func validateNodeAffinity(spec *driver.InstanceSpec) error {
+	for key := range spec.NodeSelector {
+		if key == "" {
+			return apierror.InvalidField("spec.node_selector", "node selector keys cannot be empty")
+		}
+	}
+	for _, toleration := range spec.Tolerations {
+		if err := toleration.Validate(); err != nil {
+			return apierror.InvalidField("spec.tolerations", fmt.Sprintf("invalid toleration: %v", err))
+		}
+	}
+	return nil
+}
+
+// nodeAffinityReason returns why an instance's node selector or tolerations
+// keep it off a node, or "" if they do not.
+func nodeAffinityReason(node *registry.Node, spec *driver.InstanceSpec) string {
+	if !node.MatchesSelector(spec.NodeSelector) {
+		keys := make([]string, 0, len(spec.NodeSelector))
+		for key := range spec.NodeSelector {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		var missing []string
+		for _, key := range keys {
+			if node.Labels[key] != spec.NodeSelector[key] {
+				missing = append(missing, key+"="+spec.NodeSelector[key])
+			}
+		}
+		return fmt.Sprintf("node does not have labels %s of the node selector", strings.Join(missing, ","))
+	}
+
+	if taints := node.UntoleratedTaints(spec.Tolerations, driver.TaintNoSchedule); len(taints) > 0 {
+		return fmt.Sprintf("node has taint %s the instance does not tolerate", taints[0])
+	}
+	return ""
+}
+
+// taintScore prefers nodes without PreferNoSchedule taints the instance does
+// not tolerate. Its weight outweighs the other plugins together, so such
+// nodes are only used when no other node fits.
+func taintScore(node *registry.Node, req *CreateInstanceRequest) float64 {
+	if len(node.UntoleratedTaints(req.Spec.Tolerations, driver.TaintPreferNoSchedule)) > 0 {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// updateMask is a validated set of field paths to update. A path covers its
+// subfields, so "metadata" updates both labels and annotations.
+type updateMask []string
+
+// instanceMutableFields are the Instance paths UpdateInstance can change.
+var instanceMutableFields = []string{
+	"description",
+	"metadata",
+	"high_availability",
+	"spec.limits",
+}
+
+// groupMutableFields are the InstanceGroup paths UpdateInstanceGroup can
+// change.
+var groupMutableFields = []string{
+	"replicas",
+	"template",
+}
+
+// networkMutableFields are the Network paths UpdateNetwork can change.
+var networkMutableFields = []string{
+	"name",
+	"description",
+	"admin_state",
+	"shared",
+	"metadata",
+	"bgp",
+}
+
+// parseUpdateMask checks that every path of mask names a field of msg that
+// is one of, or inside one of, the mutable paths.
+func parseUpdateMask(mask *fieldmaskpb.FieldMask, msg proto.Message, mutable []string) (updateMask, error) {
+	paths := mask.GetPaths()
+	if len(paths) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "update_mask is required")
+	}
+	if !mask.IsValid(msg) {
+		return nil, status.Errorf(codes.InvalidArgument, "update_mask has unknown fields for %s: %s",
+			msg.ProtoReflect().Descriptor().Name(), strings.Join(paths, ", "))
+	}
+
+	for _, path := range paths {
+		if !isMutable(path, mutable) {
+			return nil, status.Errorf(codes.InvalidArgument, "field %q cannot be updated", path)
+		}
+	}
+	return updateMask(paths), nil
+}
+
+// isMutable reports whether path is a mutable path or inside one.
+func isMutable(path string, mutable []string) bool {
+	return updateMask(mutable).has(path)
+}
+
+// has reports whether the mask updates path, directly or through a parent.
+func (m updateMask) has(path string) bool {
+	for _, p := range m {
+		if p == path || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+// Package apiconv converts between the API's protobuf messages and the
+// driver and registry types, for the conversions the server and agents
+// both make, so that the two sides cannot drift apart.
+package apiconv
+
+import (
+	v1 "hypervisor/api/gen"
+	"hypervisor/pkg/cluster/registry"
+	"hypervisor/pkg/compute/driver"
+)
+
+// CPUPlacementToProto converts a CPU placement, returning nil for the
+// default placement.
+func CPUPlacementToProto(p driver.CPUPlacement) *v1.CPUPlacement {
+	if p.IsZero() {
+		return nil
+	}
+	placement := &v1.CPUPlacement{DedicatedCores: p.DedicatedCores}
+	if p.NUMANode != nil {
+		node := int32(*p.NUMANode)
+		placement.NumaNode = &node
+	}
+	return placement
+}
+
+// CPUPlacementFromProto converts a CPU placement; nil is the default one.
+func CPUPlacementFromProto(p *v1.CPUPlacement) driver.CPUPlacement {
+	placement := driver.CPUPlacement{DedicatedCores: p.GetDedicatedCores()}
+	if p != nil && p.NumaNode != nil {
+		node := int(*p.NumaNode)
+		placement.NUMANode = &node
+	}
+	return placement
+}
+
+// Int32s converts CPU or NUMA node numbers to their proto form.
+func Int32s(values []int) []int32 {
+	if values == nil {
+		return nil
+	}
+	out := make([]int32, len(values))
+	for i, v := range values {
+		out[i] = int32(v)
+	}
+	return out
+}
+
+// Ints converts CPU or NUMA node numbers from their proto form.
+func Ints(values []int32) []int {
+	if values == nil {
+		return nil
+	}
+	out := make([]int, len(values))
+	for i, v := range values {
+		out[i] = int(v)
+	}
+	return out
+}
+
+// CapabilitiesToProto converts the capabilities of an instance's driver.
+func CapabilitiesToProto(caps registry.InstanceCapabilities) *v1.InstanceCapabilities {
+	return &v1.InstanceCapabilities{
+		Driver:      caps.Driver,
+		Console:     caps.Console,
+		Exec:        caps.Exec,
+		Logs:        caps.Logs,
+		Pause:       caps.Pause,
+		Suspend:     caps.Suspend,
+		Resize:      caps.Resize,
+		Migrate:     caps.Migrate,
+		Diagnostics: caps.Diagnostics,
+		Runtimes:    caps.Runtimes,
+
+		ReportsOperations: caps.ReportsOperations,
+	}
+}
+
+// CapabilitiesFromProto converts the capabilities of an instance's driver;
+// nil stays nil.
+func CapabilitiesFromProto(caps *v1.InstanceCapabilities) *registry.InstanceCapabilities {
+	if caps == nil {
+		return nil
+	}
+	return &registry.InstanceCapabilities{
+		Driver:      caps.Driver,
+		Console:     caps.Console,
+		Exec:        caps.Exec,
+		Logs:        caps.Logs,
+		Pause:       caps.Pause,
+		Suspend:     caps.Suspend,
+		Resize:      caps.Resize,
+		Migrate:     caps.Migrate,
+		Diagnostics: caps.Diagnostics,
+		Runtimes:    caps.Runtimes,
+
+		ReportsOperations: caps.ReportsOperations,
+	}
+}
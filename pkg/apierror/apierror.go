@@ -0,0 +1,125 @@
+// Package apierror builds the gRPC errors the server and agents return. Each
+// carries a google.rpc.ErrorInfo whose reason clients can branch on, plus
+// typed details such as the per-node reasons of a scheduling failure, so
+// that the CLI can tell the user what to change instead of printing a bare
+// status string.
+package apierror
+
+import (
+	"sort"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Domain is the ErrorInfo domain of errors raised by this project.
+const Domain = "hypervisor"
+
+// Reasons set in ErrorInfo. They are part of the API: clients branch on
+// them, so existing values must not change.
+const (
+	ReasonSchedulingFailed     = "SCHEDULING_FAILED"
+	ReasonInsufficientCapacity = "INSUFFICIENT_CAPACITY"
+	ReasonUnsupportedOperation = "UNSUPPORTED_OPERATION"
+	ReasonInvalidField         = "INVALID_FIELD"
+	ReasonRateLimited          = "RATE_LIMITED"
+)
+
+// Violation types of the PreconditionFailure attached to scheduling errors.
+const ViolationNode = "NODE"
+
+// New returns a status error with an ErrorInfo for reason and any further
+// details.
+func New(code codes.Code, reason, message string, metadata map[string]string, details ...protoadapt.MessageV1) error {
+	st := status.New(code, message)
+	all := append([]protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   Domain,
+		Metadata: metadata,
+	}}, details...)
+	if detailed, err := st.WithDetails(all...); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// SchedulingFailed returns a ResourceExhausted error explaining why each
+// node was rejected, keyed by node ID.
+func SchedulingFailed(message string, nodeReasons map[string]string) error {
+	nodeIDs := make([]string, 0, len(nodeReasons))
+	for id := range nodeReasons {
+		nodeIDs = append(nodeIDs, id)
+	}
+	sort.Strings(nodeIDs)
+
+	failure := &errdetails.PreconditionFailure{}
+	for _, id := range nodeIDs {
+		failure.Violations = append(failure.Violations, &errdetails.PreconditionFailure_Violation{
+			Type:        ViolationNode,
+			Subject:     id,
+			Description: nodeReasons[id],
+		})
+	}
+	return New(codes.ResourceExhausted, ReasonSchedulingFailed, message, nil, failure)
+}
+
+// InsufficientCapacity returns a ResourceExhausted error for a node that
+// lacks the capacity an operation on one of its instances needs.
+func InsufficientCapacity(message, nodeID, reason string) error {
+	return New(codes.ResourceExhausted, ReasonInsufficientCapacity, message, map[string]string{"node_id": nodeID},
+		&errdetails.PreconditionFailure{Violations: []*errdetails.PreconditionFailure_Violation{{
+			Type:        ViolationNode,
+			Subject:     nodeID,
+			Description: reason,
+		}}})
+}
+
+// Unsupported returns an Unimplemented error for an operation an instance's
+// driver cannot do. driver may be empty if it is not known.
+func Unsupported(driver, operation, message string) error {
+	metadata := map[string]string{"operation": operation}
+	if driver != "" {
+		metadata["driver"] = driver
+	}
+	return New(codes.Unimplemented, ReasonUnsupportedOperation, message, metadata)
+}
+
+// InvalidField returns an InvalidArgument error naming the request field at
+// fault.
+func InvalidField(field, message string) error {
+	return New(codes.InvalidArgument, ReasonInvalidField, message, map[string]string{"field": field},
+		&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       field,
+			Description: message,
+		}}})
+}
+
+// Info returns the ErrorInfo attached to err, or nil.
+func Info(err error) *errdetails.ErrorInfo {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
+
+// Reason returns the ErrorInfo reason of err, or "" if it has none.
+func Reason(err error) string {
+	return Info(err).GetReason()
+}
+
+// RateLimited returns a ResourceExhausted error for a call refused by a
+// rate or concurrency limit, with a RetryInfo saying when to try again.
+func RateLimited(message, limit string, retryAfter time.Duration) error {
+	return New(codes.ResourceExhausted, ReasonRateLimited, message, map[string]string{"limit": limit},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+}
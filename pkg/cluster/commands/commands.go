@@ -0,0 +1,349 @@
+// Package commands implements the per-node command queue in etcd. The server
+// enqueues commands for a node, the node's agent picks up pending commands
+// on each heartbeat, runs them and acknowledges them with their result.
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// KeyPrefix is the etcd key prefix for commands, followed by the
+	// node ID and the command ID.
+	KeyPrefix = "/hypervisor/node-commands/"
+
+	// finishedTTL is how long a finished command is kept for its result to
+	// be read.
+	finishedTTL = 24 * time.Hour
+
+	// maxAttempts bounds how often a command is run when agent restarts
+	// keep interrupting it.
+	maxAttempts = 3
+)
+
+// Command types.
+const (
+	TypeCordon      = "cordon"       // Refuse new instances
+	TypeUncordon    = "uncordon"     // Accept new instances again
+	TypeDrain       = "drain"        // Refuse new instances and stop running ones
+	TypeUpgrade     = "upgrade"      // Upgrade the agent to parameter "version"
+	TypeCollectLogs = "collect-logs" // Collect agent state and instance console logs
+)
+
+// State is the state of a command.
+type State string
+
+// Command states.
+const (
+	StatePending   State = "pending"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+)
+
+// IsFinished returns true if the command will not change anymore.
+func (s State) IsFinished() bool {
+	return s == StateSucceeded || s == StateFailed
+}
+
+var (
+	// ErrCommandNotFound is returned when a command does not exist.
+	ErrCommandNotFound = errors.New("command not found")
+
+	// ErrUnknownType is returned when enqueueing a command of an unknown type.
+	ErrUnknownType = errors.New("unknown command type")
+)
+
+// Command is a command for the agent of one node.
+type Command struct {
+	ID         string            `json:"id"`
+	NodeID     string            `json:"node_id"`
+	Type       string            `json:"type"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	State      State             `json:"state"`
+	Attempts   int               `json:"attempts,omitempty"` // Times an agent started running it
+	Message    string            `json:"message,omitempty"`  // Error or summary reported by the agent
+	Result     map[string]string `json:"result,omitempty"`   // Output reported by the agent
+	CreatedAt  time.Time         `json:"created_at"`
+	StartedAt  time.Time         `json:"started_at,omitempty"`
+	FinishedAt time.Time         `json:"finished_at,omitempty"`
+}
+
+// ValidType returns true if t is a known command type.
+func ValidType(t string) bool {
+	switch t {
+	case TypeCordon, TypeUncordon, TypeDrain, TypeUpgrade, TypeCollectLogs:
+		return true
+	}
+	return false
+}
+
+// Queue stores node commands in etcd.
+type Queue struct {
+	client *etcd.Client
+	logger *zap.Logger
+}
+
+// NewQueue creates a command queue.
+func NewQueue(client *etcd.Client, logger *zap.Logger) *Queue {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Queue{
+		client: client,
+		logger: logger,
+	}
+}
+
+// Enqueue adds a pending command for a node and returns it.
+func (q *Queue) Enqueue(ctx context.Context, nodeID, commandType string, parameters map[string]string) (*Command, error) {
+	if !ValidType(commandType) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, commandType)
+	}
+
+	// IDs start with the creation time so that a prefix scan returns a
+	// node's commands in the order they were enqueued
+	now := time.Now()
+	cmd := &Command{
+		ID:         fmt.Sprintf("%016x-%s", now.UnixNano(), uuid.New().String()[:8]),
+		NodeID:     nodeID,
+		Type:       commandType,
+		Parameters: parameters,
+		State:      StatePending,
+		CreatedAt:  now,
+	}
+
+	data, err := marshalCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.client.Put(ctx, commandKey(nodeID, cmd.ID), data); err != nil {
+		return nil, fmt.Errorf("failed to store command: %w", err)
+	}
+
+	q.logger.Info("node command enqueued",
+		zap.String("node_id", nodeID),
+		zap.String("command_id", cmd.ID),
+		zap.String("type", commandType),
+	)
+	return cmd, nil
+}
+
+// Get returns a command of a node.
+func (q *Queue) Get(ctx context.Context, nodeID, id string) (*Command, error) {
+	value, err := q.client.Get(ctx, commandKey(nodeID, id))
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, ErrCommandNotFound
+		}
+		return nil, fmt.Errorf("failed to get command: %w", err)
+	}
+	return unmarshalCommand(value)
+}
+
+// List returns the commands of a node that have not expired, oldest first.
+func (q *Queue) List(ctx context.Context, nodeID string) ([]*Command, error) {
+	values, err := q.client.GetWithPrefix(ctx, commandKey(nodeID, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commands: %w", err)
+	}
+
+	list := make([]*Command, 0, len(values))
+	for key, value := range values {
+		cmd, err := unmarshalCommand(value)
+		if err != nil {
+			q.logger.Warn("skipping unreadable command", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		list = append(list, cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// Pending returns the commands of a node not yet picked up, oldest first.
+func (q *Queue) Pending(ctx context.Context, nodeID string) ([]*Command, error) {
+	list, err := q.List(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := list[:0]
+	for _, cmd := range list {
+		if cmd.State == StatePending {
+			pending = append(pending, cmd)
+		}
+	}
+	return pending, nil
+}
+
+// Start marks a pending command running. It returns false if the command was
+// already picked up, so that a command runs at most once.
+func (q *Queue) Start(ctx context.Context, cmd *Command) (bool, error) {
+	started := false
+	_, err := q.client.Modify(ctx, commandKey(cmd.NodeID, cmd.ID), func(value string) (string, error) {
+		current, err := unmarshalCommand(value)
+		if err != nil {
+			return "", err
+		}
+		if current.State != StatePending {
+			started = false
+			return value, nil
+		}
+		started = true
+		current.State = StateRunning
+		current.Attempts++
+		current.StartedAt = time.Now()
+		*cmd = *current
+		return marshalCommand(current)
+	})
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return false, ErrCommandNotFound
+		}
+		return false, fmt.Errorf("failed to start command: %w", err)
+	}
+	return started, nil
+}
+
+// Recover handles the commands of a node left running by an agent that
+// stopped before acknowledging them. The agent runs one command at a time
+// and calls Recover before running any, so none of them is still running:
+// each is made pending to run again, or failed once it was interrupted
+// maxAttempts times.
+func (q *Queue) Recover(ctx context.Context, nodeID string) error {
+	list, err := q.List(ctx, nodeID)
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range list {
+		if cmd.State != StateRunning {
+			continue
+		}
+		if cmd.Attempts >= maxAttempts {
+			runErr := fmt.Errorf("agent stopped while running the command %d times", cmd.Attempts)
+			if err := q.Ack(ctx, cmd, "", nil, runErr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err := q.client.Modify(ctx, commandKey(nodeID, cmd.ID), func(value string) (string, error) {
+			current, err := unmarshalCommand(value)
+			if err != nil {
+				return "", err
+			}
+			if current.State != StateRunning {
+				return value, nil
+			}
+			current.State = StatePending
+			current.StartedAt = time.Time{}
+			return marshalCommand(current)
+		})
+		if err != nil && !errors.Is(err, etcd.ErrKeyNotFound) {
+			return fmt.Errorf("failed to requeue command: %w", err)
+		}
+		q.logger.Info("node command interrupted by an agent restart, queued again",
+			zap.String("node_id", nodeID),
+			zap.String("command_id", cmd.ID),
+			zap.String("type", cmd.Type),
+			zap.Int("attempts", cmd.Attempts),
+		)
+	}
+	return nil
+}
+
+// Ack records the outcome of a command: a summary message and output on
+// success, or runErr. Finished commands expire after a day.
+func (q *Queue) Ack(ctx context.Context, cmd *Command, message string, result map[string]string, runErr error) error {
+	cmd.State = StateSucceeded
+	cmd.Message = message
+	cmd.Result = result
+	cmd.FinishedAt = time.Now()
+	if runErr != nil {
+		cmd.State = StateFailed
+		cmd.Message = runErr.Error()
+	}
+
+	data, err := marshalCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if err := q.client.PutWithTTL(ctx, commandKey(cmd.NodeID, cmd.ID), data, int64(finishedTTL.Seconds())); err != nil {
+		return fmt.Errorf("failed to acknowledge command: %w", err)
+	}
+
+	q.logger.Info("node command finished",
+		zap.String("node_id", cmd.NodeID),
+		zap.String("command_id", cmd.ID),
+		zap.String("type", cmd.Type),
+		zap.String("state", string(cmd.State)),
+	)
+	return nil
+}
+
+// Wait blocks until a command has finished or ctx is done, and returns it.
+func (q *Queue) Wait(ctx context.Context, nodeID, id string) (*Command, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Watch before reading so that no update in between is missed
+	events := q.client.WatchPrefixEvents(ctx, commandKey(nodeID, id))
+
+	cmd, err := q.Get(ctx, nodeID, id)
+	if err != nil {
+		return nil, err
+	}
+	for !cmd.State.IsFinished() {
+		select {
+		case <-ctx.Done():
+			return cmd, ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				return cmd, ctx.Err()
+			}
+			if event.Key != commandKey(nodeID, id) {
+				continue
+			}
+			if event.Type == etcd.EventTypeDelete {
+				return nil, ErrCommandNotFound
+			}
+			if updated, err := unmarshalCommand(event.Value); err == nil {
+				cmd = updated
+			}
+		}
+	}
+	return cmd, nil
+}
+
+func commandKey(nodeID, id string) string {
+	return KeyPrefix + nodeID + "/" + id
+}
+
+func marshalCommand(cmd *Command) (string, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal command: %w", err)
+	}
+	return string(data), nil
+}
+
+func unmarshalCommand(value string) (*Command, error) {
+	var cmd Command
+	if err := json.Unmarshal([]byte(value), &cmd); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal command: %w", err)
+	}
+	return &cmd, nil
+}
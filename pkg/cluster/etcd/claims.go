@@ -0,0 +1,128 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Claim is a key holding the ID of the owner of a unique value, such as a
+// name. Claims are written in the transaction that stores their owner, so
+// that neither is stored without the other.
+type Claim struct {
+	Key   string
+	Owner string
+}
+
+// ClaimedError is returned when a claim is held by another owner.
+type ClaimedError struct {
+	Key    string
+	Holder string
+}
+
+func (e *ClaimedError) Error() string {
+	return fmt.Sprintf("%s is claimed by %s", e.Key, e.Holder)
+}
+
+// CheckClaims returns the claims their owner does not hold yet, for a
+// transaction to take with ClaimTxn, or a *ClaimedError for the first
+// claim another owner holds.
+func (c *Client) CheckClaims(ctx context.Context, claims []Claim) ([]Claim, error) {
+	var free []Claim
+	for _, claim := range claims {
+		holder, err := c.Get(ctx, claim.Key)
+		if errors.Is(err, ErrKeyNotFound) {
+			free = append(free, claim)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if holder != claim.Owner {
+			return nil, &ClaimedError{Key: claim.Key, Holder: holder}
+		}
+	}
+	return free, nil
+}
+
+// ClaimTxn returns the conditions and writes of a transaction taking
+// claims, each of which must still be free.
+func ClaimTxn(claims []Claim) ([]clientv3.Cmp, []clientv3.Op) {
+	cmps := make([]clientv3.Cmp, 0, len(claims))
+	ops := make([]clientv3.Op, 0, len(claims))
+	for _, claim := range claims {
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(claim.Key), "=", 0))
+		ops = append(ops, clientv3.OpPut(claim.Key, claim.Owner))
+	}
+	return cmps, ops
+}
+
+// PutClaimed stores a key-value pair together with claims, in one
+// transaction. It fails with a *ClaimedError if another owner holds one of
+// them.
+func (c *Client) PutClaimed(ctx context.Context, key, value string, claims ...Claim) error {
+	for attempt := 0; attempt < casAttempts; attempt++ {
+		free, err := c.CheckClaims(ctx, claims)
+		if err != nil {
+			return err
+		}
+		cmps, ops := ClaimTxn(free)
+
+		txnCtx, done := c.observe(ctx, "txn", key)
+		resp, err := c.client.Txn(txnCtx).
+			If(cmps...).
+			Then(append(ops, clientv3.OpPut(key, value))...).
+			Commit()
+		done(err)
+		if err != nil {
+			return fmt.Errorf("etcd put failed: %w", err)
+		}
+		if resp.Succeeded {
+			return nil
+		}
+	}
+	return ErrConflict
+}
+
+// ModifyClaimed is Modify for values that hold claims: fn also returns the
+// claims the new value takes, which are written with it. It fails with a
+// *ClaimedError if another owner holds one of them.
+func (c *Client) ModifyClaimed(ctx context.Context, key string, fn func(value string) (string, []Claim, error)) (string, error) {
+	for attempt := 0; attempt < casAttempts; attempt++ {
+		getCtx, done := c.observe(ctx, "get", key)
+		resp, err := c.client.Get(getCtx, key)
+		done(err)
+		if err != nil {
+			return "", fmt.Errorf("etcd get failed: %w", err)
+		}
+		if len(resp.Kvs) == 0 {
+			return "", ErrKeyNotFound
+		}
+
+		value, claims, err := fn(string(resp.Kvs[0].Value))
+		if err != nil {
+			return "", err
+		}
+		free, err := c.CheckClaims(ctx, claims)
+		if err != nil {
+			return "", err
+		}
+		cmps, ops := ClaimTxn(free)
+
+		txnCtx, done := c.observe(ctx, "txn", key)
+		txnResp, err := c.client.Txn(txnCtx).
+			If(append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision))...).
+			Then(append(ops, clientv3.OpPut(key, value))...).
+			Commit()
+		done(err)
+		if err != nil {
+			return "", fmt.Errorf("etcd modify failed: %w", err)
+		}
+		if txnResp.Succeeded {
+			return value, nil
+		}
+	}
+	return "", ErrConflict
+}
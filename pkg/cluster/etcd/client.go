@@ -4,11 +4,21 @@ package etcd
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
+	"hypervisor/pkg/metrics"
+	"hypervisor/pkg/tracing"
+
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
@@ -19,11 +29,106 @@ type Config struct {
 	Username    string        `mapstructure:"username"`
 	Password    string        `mapstructure:"password"`
 
-	// TLS configuration
+	// TLS configuration. Setting any of these connects over TLS, and
+	// endpoints must then not use http://. CAFile is the CA etcd's
+	// certificate is verified against (the system roots if empty);
+	// CertFile and KeyFile are the client certificate for mutual TLS.
+	// SkipVerify accepts any server certificate, for testing only.
 	CertFile   string `mapstructure:"cert_file"`
 	KeyFile    string `mapstructure:"key_file"`
 	CAFile     string `mapstructure:"ca_file"`
 	SkipVerify bool   `mapstructure:"skip_verify"`
+
+	// Namespace is prepended to every key, e.g. /clusters/prod turning
+	// /hypervisor/nodes/ into /clusters/prod/hypervisor/nodes/, so that
+	// several clusters can share one etcd deployment. Every server and
+	// agent of a cluster must use the same namespace. Empty keeps the keys
+	// at the root.
+	Namespace string `mapstructure:"namespace"`
+
+	// SecretKeyFile holds the AES-256 key (32 bytes, raw or base64)
+	// sealing the secrets stored in etcd, such as registry passwords and
+	// VPN private keys. Every server and agent of a cluster must use the
+	// same key. Empty stores them in plaintext.
+	SecretKeyFile string `mapstructure:"secret_key_file"`
+}
+
+// namespacePrefix validates the namespace and returns the prefix of every
+// key, "" for none.
+func (c Config) namespacePrefix() (string, error) {
+	ns := c.Namespace
+	if ns == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(ns, "/") {
+		return "", fmt.Errorf("etcd namespace %q must start with /", ns)
+	}
+	ns = strings.TrimRight(ns, "/")
+	// Under /hypervisor, the namespace's keys would show up in the
+	// listings of a cluster using no namespace
+	if ns == "" || ns == "/hypervisor" || strings.HasPrefix(ns, "/hypervisor/") {
+		return "", fmt.Errorf("etcd namespace %q must not be / or under /hypervisor", c.Namespace)
+	}
+	return ns, nil
+}
+
+// checkEndpoints refuses http:// endpoints when TLS is configured, as the
+// client would connect to them in cleartext.
+func (c Config) checkEndpoints() error {
+	if !c.tlsEnabled() {
+		return nil
+	}
+	for _, endpoint := range c.Endpoints {
+		if strings.HasPrefix(endpoint, "http://") {
+			return fmt.Errorf("etcd endpoint %s uses http:// although TLS is configured; use https://", endpoint)
+		}
+	}
+	return nil
+}
+
+// tlsEnabled reports whether the configuration asks for TLS.
+func (c Config) tlsEnabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != "" || c.SkipVerify
+}
+
+// tlsConfig builds the TLS configuration of the connection to etcd, nil
+// when TLS is not configured.
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if !c.tlsEnabled() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.SkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read etcd CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in etcd CA %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	switch {
+	case c.CertFile != "" && c.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load etcd client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case c.CertFile != "":
+		return nil, fmt.Errorf("etcd cert_file %s is set without key_file", c.CertFile)
+	case c.KeyFile != "":
+		return nil, fmt.Errorf("etcd key_file %s is set without cert_file", c.KeyFile)
+	}
+
+	return tlsConfig, nil
 }
 
 // DefaultConfig returns the default etcd configuration.
@@ -36,9 +141,10 @@ func DefaultConfig() Config {
 
 // Client wraps the etcd client with additional functionality.
 type Client struct {
-	client *clientv3.Client
-	config Config
-	logger *zap.Logger
+	client  *clientv3.Client
+	config  Config
+	logger  *zap.Logger
+	secrets cipher.AEAD // nil if no secret key is configured
 
 	mu     sync.RWMutex
 	closed bool
@@ -57,17 +163,50 @@ func New(cfg Config, logger *zap.Logger) (*Client, error) {
 		Password:    cfg.Password,
 	}
 
-	// TODO: Add TLS configuration if provided
+	prefix, err := cfg.namespacePrefix()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.checkEndpoints(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		clientConfig.TLS = tlsConfig
+		if cfg.SkipVerify {
+			logger.Warn("etcd server certificate is not verified (skip_verify)")
+		}
+	}
+
+	var secrets cipher.AEAD
+	if cfg.SecretKeyFile != "" {
+		if secrets, err = loadSecretKey(cfg.SecretKeyFile); err != nil {
+			return nil, err
+		}
+	}
 
 	cli, err := clientv3.New(clientConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create etcd client: %w", err)
 	}
 
+	// Namespace the client itself rather than the keys, so that the users
+	// of Raw, such as the leader election, are namespaced as well
+	if prefix != "" {
+		cli.KV = namespace.NewKV(cli.KV, prefix)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, prefix)
+		cli.Lease = namespace.NewLease(cli.Lease, prefix)
+	}
+
 	c := &Client{
-		client: cli,
-		config: cfg,
-		logger: logger,
+		client:  cli,
+		config:  cfg,
+		logger:  logger,
+		secrets: secrets,
 	}
 
 	// Verify connection
@@ -79,7 +218,13 @@ func New(cfg Config, logger *zap.Logger) (*Client, error) {
 		return nil, fmt.Errorf("failed to connect to etcd: %w", err)
 	}
 
-	logger.Info("connected to etcd", zap.Strings("endpoints", cfg.Endpoints))
+	logger.Info("connected to etcd",
+		zap.Strings("endpoints", cfg.Endpoints),
+		zap.String("namespace", prefix),
+		zap.Bool("tls", tlsConfig != nil),
+		zap.Bool("client_cert", tlsConfig != nil && len(tlsConfig.Certificates) > 0),
+		zap.Bool("sealed_secrets", secrets != nil),
+	)
 	return c, nil
 }
 
@@ -101,18 +246,72 @@ func (c *Client) Raw() *clientv3.Client {
 	return c.client
 }
 
+// Ping checks that etcd answers a linearizable read, which needs a quorum
+// of its members.
+func (c *Client) Ping(ctx context.Context) error {
+	ctx, done := c.observe(ctx, "ping", "/hypervisor/health")
+	_, err := c.client.Get(ctx, "/hypervisor/health", clientv3.WithCountOnly())
+	done(err)
+	if err != nil {
+		return fmt.Errorf("etcd unreachable: %w", err)
+	}
+	return nil
+}
+
+// observe starts measuring and tracing an etcd operation on key; the
+// returned function records its result.
+func (c *Client) observe(ctx context.Context, operation, key string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "etcd."+operation, attribute.String("etcd.key", key))
+	return ctx, func(err error) {
+		metrics.ObserveEtcdOperation(operation, start, err)
+		tracing.End(span, err)
+	}
+}
+
 // Put stores a key-value pair in etcd.
 func (c *Client) Put(ctx context.Context, key, value string, opts ...clientv3.OpOption) error {
-	_, err := c.client.Put(ctx, key, value, opts...)
+	_, err := c.PutRevision(ctx, key, value, opts...)
+	return err
+}
+
+// PutRevision stores a key-value pair in etcd and returns the revision of
+// the write.
+func (c *Client) PutRevision(ctx context.Context, key, value string, opts ...clientv3.OpOption) (int64, error) {
+	ctx, done := c.observe(ctx, "put", key)
+	resp, err := c.client.Put(ctx, key, value, opts...)
+	done(err)
 	if err != nil {
-		return fmt.Errorf("etcd put failed: %w", err)
+		return 0, fmt.Errorf("etcd put failed: %w", err)
 	}
-	return nil
+	return resp.Header.Revision, nil
+}
+
+// PutIfUnchanged stores a key-value pair only if the key was not modified
+// since revision, the ModRevision it was read at; a revision of 0 only
+// creates the key. It returns the revision of the write, or ErrConflict if
+// the key changed.
+func (c *Client) PutIfUnchanged(ctx context.Context, key, value string, revision int64, opts ...clientv3.OpOption) (int64, error) {
+	ctx, done := c.observe(ctx, "txn", key)
+	resp, err := c.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+		Then(clientv3.OpPut(key, value, opts...)).
+		Commit()
+	done(err)
+	if err != nil {
+		return 0, fmt.Errorf("etcd put failed: %w", err)
+	}
+	if !resp.Succeeded {
+		return 0, ErrConflict
+	}
+	return resp.Header.Revision, nil
 }
 
 // Get retrieves a value by key from etcd.
 func (c *Client) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (string, error) {
+	ctx, done := c.observe(ctx, "get", key)
 	resp, err := c.client.Get(ctx, key, opts...)
+	done(err)
 	if err != nil {
 		return "", fmt.Errorf("etcd get failed: %w", err)
 	}
@@ -124,9 +323,28 @@ func (c *Client) Get(ctx context.Context, key string, opts ...clientv3.OpOption)
 	return string(resp.Kvs[0].Value), nil
 }
 
+// GetRevision retrieves a value by key from etcd with the revision it was
+// last modified at, for a later PutIfUnchanged.
+func (c *Client) GetRevision(ctx context.Context, key string) (string, int64, error) {
+	ctx, done := c.observe(ctx, "get", key)
+	resp, err := c.client.Get(ctx, key)
+	done(err)
+	if err != nil {
+		return "", 0, fmt.Errorf("etcd get failed: %w", err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return "", 0, ErrKeyNotFound
+	}
+
+	return string(resp.Kvs[0].Value), resp.Kvs[0].ModRevision, nil
+}
+
 // GetWithPrefix retrieves all key-value pairs with a given prefix.
 func (c *Client) GetWithPrefix(ctx context.Context, prefix string) (map[string]string, error) {
+	ctx, done := c.observe(ctx, "get_prefix", prefix)
 	resp, err := c.client.Get(ctx, prefix, clientv3.WithPrefix())
+	done(err)
 	if err != nil {
 		return nil, fmt.Errorf("etcd get with prefix failed: %w", err)
 	}
@@ -141,16 +359,27 @@ func (c *Client) GetWithPrefix(ctx context.Context, prefix string) (map[string]s
 
 // Delete removes a key from etcd.
 func (c *Client) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) error {
-	_, err := c.client.Delete(ctx, key, opts...)
+	_, err := c.DeleteRevision(ctx, key, opts...)
+	return err
+}
+
+// DeleteRevision removes a key from etcd and returns the revision of the
+// delete.
+func (c *Client) DeleteRevision(ctx context.Context, key string, opts ...clientv3.OpOption) (int64, error) {
+	ctx, done := c.observe(ctx, "delete", key)
+	resp, err := c.client.Delete(ctx, key, opts...)
+	done(err)
 	if err != nil {
-		return fmt.Errorf("etcd delete failed: %w", err)
+		return 0, fmt.Errorf("etcd delete failed: %w", err)
 	}
-	return nil
+	return resp.Header.Revision, nil
 }
 
 // DeleteWithPrefix removes all keys with a given prefix.
 func (c *Client) DeleteWithPrefix(ctx context.Context, prefix string) error {
+	ctx, done := c.observe(ctx, "delete_prefix", prefix)
 	_, err := c.client.Delete(ctx, prefix, clientv3.WithPrefix())
+	done(err)
 	if err != nil {
 		return fmt.Errorf("etcd delete with prefix failed: %w", err)
 	}
@@ -190,7 +419,9 @@ func (c *Client) Revoke(ctx context.Context, id clientv3.LeaseID) error {
 
 // PutWithLease stores a key-value pair with an associated lease.
 func (c *Client) PutWithLease(ctx context.Context, key, value string, leaseID clientv3.LeaseID) error {
+	ctx, done := c.observe(ctx, "put", key)
 	_, err := c.client.Put(ctx, key, value, clientv3.WithLease(leaseID))
+	done(err)
 	if err != nil {
 		return fmt.Errorf("etcd put with lease failed: %w", err)
 	}
@@ -239,11 +470,16 @@ const (
 type KeyValue struct {
 	Key   string
 	Value string
+
+	// Revision the key was last modified at
+	ModRevision int64
 }
 
 // GetWithPrefixKV retrieves all key-value pairs with a given prefix as KeyValue slice.
 func (c *Client) GetWithPrefixKV(ctx context.Context, prefix string) ([]KeyValue, error) {
+	ctx, done := c.observe(ctx, "get_prefix", prefix)
 	resp, err := c.client.Get(ctx, prefix, clientv3.WithPrefix())
+	done(err)
 	if err != nil {
 		return nil, fmt.Errorf("etcd get with prefix failed: %w", err)
 	}
@@ -251,14 +487,38 @@ func (c *Client) GetWithPrefixKV(ctx context.Context, prefix string) ([]KeyValue
 	result := make([]KeyValue, 0, len(resp.Kvs))
 	for _, kv := range resp.Kvs {
 		result = append(result, KeyValue{
-			Key:   string(kv.Key),
-			Value: string(kv.Value),
+			Key:         string(kv.Key),
+			Value:       string(kv.Value),
+			ModRevision: kv.ModRevision,
 		})
 	}
 
 	return result, nil
 }
 
+// GetWithPrefixRevision retrieves all key-value pairs with a given prefix
+// and the store revision they were read at, to watch for the changes made
+// after them.
+func (c *Client) GetWithPrefixRevision(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	ctx, done := c.observe(ctx, "get_prefix", prefix)
+	resp, err := c.client.Get(ctx, prefix, clientv3.WithPrefix())
+	done(err)
+	if err != nil {
+		return nil, 0, fmt.Errorf("etcd get with prefix failed: %w", err)
+	}
+
+	result := make([]KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		result = append(result, KeyValue{
+			Key:         string(kv.Key),
+			Value:       string(kv.Value),
+			ModRevision: kv.ModRevision,
+		})
+	}
+
+	return result, resp.Header.Revision, nil
+}
+
 // PutWithTTL stores a key-value pair with a TTL.
 func (c *Client) PutWithTTL(ctx context.Context, key, value string, ttlSeconds int64) error {
 	lease, err := c.client.Grant(ctx, ttlSeconds)
@@ -266,7 +526,9 @@ func (c *Client) PutWithTTL(ctx context.Context, key, value string, ttlSeconds i
 		return fmt.Errorf("failed to create lease: %w", err)
 	}
 
+	ctx, done := c.observe(ctx, "put", key)
 	_, err = c.client.Put(ctx, key, value, clientv3.WithLease(lease.ID))
+	done(err)
 	if err != nil {
 		return fmt.Errorf("etcd put with ttl failed: %w", err)
 	}
@@ -275,11 +537,13 @@ func (c *Client) PutWithTTL(ctx context.Context, key, value string, ttlSeconds i
 
 // CreateIfNotExists creates a key only if it doesn't exist.
 func (c *Client) CreateIfNotExists(ctx context.Context, key, value string) (bool, error) {
+	ctx, done := c.observe(ctx, "txn", key)
 	txn := c.client.Txn(ctx)
 	txn = txn.If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
 	txn = txn.Then(clientv3.OpPut(key, value))
 
 	resp, err := txn.Commit()
+	done(err)
 	if err != nil {
 		return false, fmt.Errorf("create if not exists failed: %w", err)
 	}
@@ -287,14 +551,89 @@ func (c *Client) CreateIfNotExists(ctx context.Context, key, value string) (bool
 	return resp.Succeeded, nil
 }
 
+// CreateIfNotExistsWithTTL creates a key with a TTL only if it doesn't exist.
+func (c *Client) CreateIfNotExistsWithTTL(ctx context.Context, key, value string, ttlSeconds int64) (bool, error) {
+	lease, err := c.client.Grant(ctx, ttlSeconds)
+	if err != nil {
+		return false, fmt.Errorf("failed to create lease: %w", err)
+	}
+
+	txnCtx, done := c.observe(ctx, "txn", key)
+	txn := c.client.Txn(txnCtx)
+	txn = txn.If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+	txn = txn.Then(clientv3.OpPut(key, value, clientv3.WithLease(lease.ID)))
+
+	resp, err := txn.Commit()
+	done(err)
+	if err != nil {
+		return false, fmt.Errorf("create if not exists failed: %w", err)
+	}
+	if !resp.Succeeded {
+		// Nothing is attached to the lease, release it right away
+		_, _ = c.client.Revoke(ctx, lease.ID)
+	}
+
+	return resp.Succeeded, nil
+}
+
+// casAttempts bounds the retries of a compare-and-swap update.
+const casAttempts = 5
+
+// Modify atomically updates the value of an existing key. fn receives the
+// current value and returns the new one; if the key changed in between, fn
+// is called again with the newer value. It returns the stored value,
+// ErrKeyNotFound if the key does not exist, or ErrConflict if concurrent
+// writers kept winning. opts apply to the put, e.g. clientv3.WithIgnoreLease
+// to keep the key's TTL.
+func (c *Client) Modify(ctx context.Context, key string, fn func(value string) (string, error), opts ...clientv3.OpOption) (string, error) {
+	value, _, err := c.ModifyRevision(ctx, key, fn, opts...)
+	return value, err
+}
+
+// ModifyRevision is Modify, also returning the revision of the write.
+func (c *Client) ModifyRevision(ctx context.Context, key string, fn func(value string) (string, error), opts ...clientv3.OpOption) (string, int64, error) {
+	for attempt := 0; attempt < casAttempts; attempt++ {
+		getCtx, done := c.observe(ctx, "get", key)
+		resp, err := c.client.Get(getCtx, key)
+		done(err)
+		if err != nil {
+			return "", 0, fmt.Errorf("etcd get failed: %w", err)
+		}
+		if len(resp.Kvs) == 0 {
+			return "", 0, ErrKeyNotFound
+		}
+
+		value, err := fn(string(resp.Kvs[0].Value))
+		if err != nil {
+			return "", 0, err
+		}
+
+		txnCtx, done := c.observe(ctx, "txn", key)
+		txnResp, err := c.client.Txn(txnCtx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(key, value, opts...)).
+			Commit()
+		done(err)
+		if err != nil {
+			return "", 0, fmt.Errorf("etcd modify failed: %w", err)
+		}
+		if txnResp.Succeeded {
+			return value, txnResp.Header.Revision, nil
+		}
+	}
+	return "", 0, ErrConflict
+}
+
 // WatchPrefixEvents watches for changes on all keys with a given prefix and returns a channel of WatchEvents.
-func (c *Client) WatchPrefixEvents(ctx context.Context, prefix string) <-chan WatchEvent {
+// opts are passed to the watch, e.g. clientv3.WithRev to resume after a read. The channel is closed when the
+// watch ends, including when etcd compacted past the requested revision.
+func (c *Client) WatchPrefixEvents(ctx context.Context, prefix string, opts ...clientv3.OpOption) <-chan WatchEvent {
 	eventCh := make(chan WatchEvent, 100)
 
 	go func() {
 		defer close(eventCh)
 
-		watchCh := c.client.Watch(ctx, prefix, clientv3.WithPrefix())
+		watchCh := c.client.Watch(ctx, prefix, append([]clientv3.OpOption{clientv3.WithPrefix()}, opts...)...)
 		for {
 			select {
 			case <-ctx.Done():
@@ -0,0 +1,141 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+)
+
+// Elector runs a leader election on an etcd prefix using concurrency.Election.
+// Leadership is tied to a session lease, so a crashed leader is replaced once
+// its lease TTL expires.
+type Elector struct {
+	client *Client
+	prefix string
+	id     string
+	ttl    time.Duration
+	logger *zap.Logger
+
+	mu     sync.RWMutex
+	leader bool
+}
+
+// NewElector creates a new elector campaigning under prefix as id.
+func NewElector(client *Client, prefix, id string, ttl time.Duration, logger *zap.Logger) *Elector {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Elector{
+		client: client,
+		prefix: prefix,
+		id:     id,
+		ttl:    ttl,
+		logger: logger,
+	}
+}
+
+// ID returns the identity this elector campaigns with.
+func (e *Elector) ID() string {
+	return e.id
+}
+
+// IsLeader returns true while this elector holds leadership.
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader
+}
+
+// Leader returns the identity of the current leader.
+func (e *Elector) Leader(ctx context.Context) (string, error) {
+	resp, err := e.client.client.Get(ctx, e.prefix+"/", clientv3.WithFirstCreate()...)
+	if err != nil {
+		return "", fmt.Errorf("failed to get leader: %w", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Run campaigns for leadership until ctx is cancelled. onElected is called
+// with a context that is cancelled when leadership is lost; onDemoted is
+// called after that context is cancelled. Run re-campaigns after losing
+// leadership.
+func (e *Elector) Run(ctx context.Context, onElected func(ctx context.Context), onDemoted func()) {
+	for {
+		if err := e.campaign(ctx, onElected, onDemoted); err != nil && ctx.Err() == nil {
+			e.logger.Warn("leader election failed, retrying", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// campaign runs a single session: wait for leadership, lead until the
+// session or ctx ends, then resign.
+func (e *Elector) campaign(ctx context.Context, onElected func(ctx context.Context), onDemoted func()) error {
+	ttl := int(e.ttl.Seconds())
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	session, err := concurrency.NewSession(e.client.client, concurrency.WithTTL(ttl), concurrency.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to create election session: %w", err)
+	}
+	defer session.Close()
+
+	election := concurrency.NewElection(session, e.prefix)
+
+	e.logger.Info("campaigning for leadership", zap.String("id", e.id))
+	if err := election.Campaign(ctx, e.id); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return fmt.Errorf("campaign failed: %w", err)
+	}
+
+	e.setLeader(true)
+	e.logger.Info("elected leader", zap.String("id", e.id))
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	onElected(leaderCtx)
+
+	select {
+	case <-ctx.Done():
+	case <-session.Done():
+		e.logger.Warn("election session expired, stepping down", zap.String("id", e.id))
+	}
+
+	cancel()
+	e.setLeader(false)
+	onDemoted()
+
+	// Resign so a standby takes over without waiting for the lease to expire
+	resignCtx, resignCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer resignCancel()
+	if err := election.Resign(resignCtx); err != nil {
+		e.logger.Debug("failed to resign leadership", zap.Error(err))
+	}
+
+	e.logger.Info("stepped down as leader", zap.String("id", e.id))
+	return nil
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.mu.Lock()
+	e.leader = leader
+	e.mu.Unlock()
+}
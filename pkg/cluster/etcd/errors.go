@@ -11,4 +11,8 @@ var (
 
 	// ErrLeaseExpired is returned when a lease has expired.
 	ErrLeaseExpired = errors.New("lease expired")
+
+	// ErrConflict is returned when a compare-and-swap update keeps losing
+	// to concurrent writers.
+	ErrConflict = errors.New("too many concurrent updates")
 )
@@ -0,0 +1,86 @@
+package etcd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sealedPrefix marks a value sealed with the secret key.
+const sealedPrefix = "sealed:v1:"
+
+// ErrNoSecretKey is returned when a sealed value is read by a client
+// configured without the secret key.
+var ErrNoSecretKey = errors.New("value is sealed but no etcd secret_key_file is configured")
+
+// loadSecretKey reads an AES-256 key, 32 bytes either raw or base64
+// encoded, and returns the cipher sealing secrets with it.
+func loadSecretKey(path string) (cipher.AEAD, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read etcd secret key: %w", err)
+	}
+	key := data
+	if len(key) != 32 {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("etcd secret key %s must be 32 bytes, raw or base64 encoded", path)
+		}
+		key = decoded
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// SealSecret encrypts a secret to be stored in etcd with the configured
+// secret key. Without a key the secret is returned as is; an empty secret
+// stays empty.
+func (c *Client) SealSecret(secret string) (string, error) {
+	if c.secrets == nil || secret == "" {
+		return secret, nil
+	}
+	nonce := make([]byte, c.secrets.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to seal secret: %w", err)
+	}
+	sealed := c.secrets.Seal(nonce, nonce, []byte(secret), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenSecret decrypts a secret sealed by SealSecret. Values that were not
+// sealed, such as those stored before a key was configured, are returned
+// as is.
+func (c *Client) OpenSecret(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return value, nil
+	}
+	if c.secrets == nil {
+		return "", ErrNoSecretKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < c.secrets.NonceSize() {
+		return "", errors.New("failed to open secret: malformed value")
+	}
+	nonce, ciphertext := sealed[:c.secrets.NonceSize()], sealed[c.secrets.NonceSize():]
+	secret, err := c.secrets.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to open secret: %w", err)
+	}
+	return string(secret), nil
+}
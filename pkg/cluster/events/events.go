@@ -0,0 +1,294 @@
+// Package events records a queryable history of what happened to cluster
+// objects (instances, nodes, networks) in etcd.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+
+	"github.com/google/uuid"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// eventPrefix is the etcd key prefix for events. Keys embed the event
+	// time so that a prefix scan returns events in chronological order.
+	eventPrefix = "/hypervisor/events/"
+
+	// leaseReuse is how long a retention lease is shared between events.
+	leaseReuse = time.Minute
+
+	// recordTimeout bounds a single event write.
+	recordTimeout = 2 * time.Second
+)
+
+// Event types.
+const (
+	TypeNormal  = "Normal"
+	TypeWarning = "Warning"
+)
+
+// Object kinds events are recorded for.
+const (
+	KindInstance           = "instance"
+	KindNode               = "node"
+	KindNetwork            = "network"
+	KindSubnet             = "subnet"
+	KindPort               = "port"
+	KindSecurityGroup      = "security-group"
+	KindRouter             = "router"
+	KindLoadBalancer       = "load-balancer"
+	KindVPNService         = "vpn-service"
+	KindInstanceGroup      = "instance-group"
+	KindMaintenanceWindow  = "maintenance-window"
+	KindRegistryCredential = "registry-credential"
+)
+
+// Event is a single structured record of something that happened to an object.
+type Event struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`              // Normal or Warning
+	Kind      string    `json:"kind"`              // instance, node, network, ...
+	ObjectID  string    `json:"object_id"`         // ID of the object the event is about
+	NodeID    string    `json:"node_id,omitempty"` // Node involved, if any
+	Reason    string    `json:"reason"`            // Short CamelCase reason, e.g. "Started"
+	Message   string    `json:"message,omitempty"` // Human-readable details
+	Actor     string    `json:"actor"`             // Who caused the event
+	Component string    `json:"component"`         // Component that recorded the event
+}
+
+// Filter selects events in List. Empty fields match everything.
+type Filter struct {
+	Kind     string
+	ObjectID string
+	NodeID   string
+	Type     string
+	Reason   string
+	Since    time.Time
+	Limit    int // Return at most the newest Limit events (0 = no limit)
+}
+
+// Config holds event recording configuration.
+type Config struct {
+	// Retention is how long events are kept (0 keeps them forever).
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+// DefaultConfig returns the default event configuration.
+func DefaultConfig() Config {
+	return Config{
+		Retention: 7 * 24 * time.Hour,
+	}
+}
+
+// Recorder appends events to etcd. A nil Recorder discards events, so
+// components can record unconditionally.
+type Recorder struct {
+	client    *etcd.Client
+	config    Config
+	component string
+	logger    *zap.Logger
+
+	mu           sync.Mutex
+	leaseID      clientv3.LeaseID
+	leaseGranted time.Time
+}
+
+// NewRecorder creates a recorder that attributes events to component.
+func NewRecorder(client *etcd.Client, config Config, component string, logger *zap.Logger) *Recorder {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Recorder{
+		client:    client,
+		config:    config,
+		component: component,
+		logger:    logger,
+	}
+}
+
+// WithComponent returns a recorder sharing r's storage that attributes
+// events to a different component.
+func (r *Recorder) WithComponent(component string) *Recorder {
+	if r == nil {
+		return nil
+	}
+	return NewRecorder(r.client, r.config, component, r.logger)
+}
+
+// Record stores an event. Failures are logged rather than returned so that
+// recording never fails the operation being recorded.
+func (r *Recorder) Record(ctx context.Context, event Event) {
+	if r == nil {
+		return
+	}
+
+	if event.ID == "" {
+		event.ID = uuid.New().String()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Type == "" {
+		event.Type = TypeNormal
+	}
+	if event.Actor == "" {
+		event.Actor = ActorFromContext(ctx)
+	}
+	if event.Component == "" {
+		event.Component = r.component
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		r.logger.Warn("failed to marshal event", zap.Error(err))
+		return
+	}
+
+	// Record even if the caller's request was cancelled after the fact
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), recordTimeout)
+	defer cancel()
+
+	var opts []clientv3.OpOption
+	if r.config.Retention > 0 {
+		leaseID, err := r.lease(ctx)
+		if err != nil {
+			r.logger.Warn("failed to grant event lease", zap.Error(err))
+			return
+		}
+		opts = append(opts, clientv3.WithLease(leaseID))
+	}
+
+	key := fmt.Sprintf("%s%020d-%s", eventPrefix, event.Time.UnixNano(), event.ID[:8])
+	if err := r.client.Put(ctx, key, string(data), opts...); err != nil {
+		r.logger.Warn("failed to record event",
+			zap.String("kind", event.Kind),
+			zap.String("object_id", event.ObjectID),
+			zap.String("reason", event.Reason),
+			zap.Error(err),
+		)
+	}
+}
+
+// lease returns a retention lease, granting a new one at most once per
+// leaseReuse so that bursts of events share a lease.
+func (r *Recorder) lease(ctx context.Context) (clientv3.LeaseID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.leaseID != 0 && time.Since(r.leaseGranted) < leaseReuse {
+		return r.leaseID, nil
+	}
+
+	resp, err := r.client.Grant(ctx, int64(r.config.Retention.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	r.leaseID = resp.ID
+	r.leaseGranted = time.Now()
+	return r.leaseID, nil
+}
+
+// List returns the events matching filter, oldest first.
+func (r *Recorder) List(ctx context.Context, filter Filter) ([]*Event, error) {
+	start := eventPrefix
+	if !filter.Since.IsZero() {
+		start = fmt.Sprintf("%s%020d", eventPrefix, filter.Since.UnixNano())
+	}
+
+	resp, err := r.client.Raw().Get(ctx, start, clientv3.WithRange(clientv3.GetPrefixRangeEnd(eventPrefix)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list events: %w", err)
+	}
+
+	var result []*Event
+	for _, kv := range resp.Kvs {
+		var event Event
+		if err := json.Unmarshal(kv.Value, &event); err != nil {
+			r.logger.Warn("failed to unmarshal event", zap.String("key", string(kv.Key)), zap.Error(err))
+			continue
+		}
+		if filter.matches(&event) {
+			result = append(result, &event)
+		}
+	}
+
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[len(result)-filter.Limit:]
+	}
+	return result, nil
+}
+
+// Watch streams events as they are recorded until ctx is cancelled. Events
+// recorded while the watch reconnects after an etcd outage are not replayed.
+func (r *Recorder) Watch(ctx context.Context) <-chan *Event {
+	out := make(chan *Event, 100)
+
+	go func() {
+		defer close(out)
+
+		for ctx.Err() == nil {
+			for ev := range r.client.WatchPrefixEvents(ctx, eventPrefix) {
+				// Deletes are retention expiry, not new events
+				if ev.Type != etcd.EventTypePut {
+					continue
+				}
+				var event Event
+				if err := json.Unmarshal([]byte(ev.Value), &event); err != nil {
+					r.logger.Warn("failed to unmarshal event", zap.String("key", ev.Key), zap.Error(err))
+					continue
+				}
+				select {
+				case out <- &event:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+				r.logger.Warn("event watch closed, reconnecting")
+			}
+		}
+	}()
+
+	return out
+}
+
+func (f Filter) matches(event *Event) bool {
+	return (f.Kind == "" || event.Kind == f.Kind) &&
+		(f.ObjectID == "" || event.ObjectID == f.ObjectID) &&
+		(f.NodeID == "" || event.NodeID == f.NodeID) &&
+		(f.Type == "" || event.Type == f.Type) &&
+		(f.Reason == "" || event.Reason == f.Reason)
+}
+
+type actorKey struct{}
+
+// WithActor returns a context that attributes recorded events to actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns who is acting in ctx: an explicit actor, the
+// gRPC peer address, or "system" for background work.
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return "system"
+}
@@ -8,4 +8,8 @@ var (
 
 	// ErrAlreadyRunning is returned when the service is already running.
 	ErrAlreadyRunning = errors.New("heartbeat service is already running")
+
+	// errNodeChanged aborts marking a node not ready that was seen, or
+	// changed status, since it was listed.
+	errNodeChanged = errors.New("node changed since listed")
 )
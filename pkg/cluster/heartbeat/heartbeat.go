@@ -3,6 +3,7 @@ package heartbeat
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -62,6 +63,7 @@ type HeartbeatService struct {
 	cancel    context.CancelFunc
 	leaseID   clientv3.LeaseID
 	keepAlive <-chan *clientv3.LeaseKeepAliveResponse
+	onBeat    func(ctx context.Context)
 }
 
 // NewHeartbeatService creates a new heartbeat service.
@@ -140,6 +142,14 @@ func (s *HeartbeatService) Stop() error {
 	return nil
 }
 
+// OnHeartbeat sets a function called after every successful periodic
+// heartbeat, e.g. to pick up commands for the node. It must not block.
+func (s *HeartbeatService) OnHeartbeat(fn func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onBeat = fn
+}
+
 // SendHeartbeat sends a single heartbeat.
 func (s *HeartbeatService) SendHeartbeat(ctx context.Context) error {
 	_, err := s.client.KeepAliveOnce(ctx, s.leaseID)
@@ -148,13 +158,11 @@ func (s *HeartbeatService) SendHeartbeat(ctx context.Context) error {
 	}
 
 	// Update node's last seen timestamp
-	node, err := s.registry.Get(ctx, s.nodeID)
-	if err != nil {
-		return err
-	}
-
-	node.LastSeen = time.Now()
-	return s.registry.Update(ctx, node)
+	_, err = s.registry.Modify(ctx, s.nodeID, func(node *registry.Node) error {
+		node.LastSeen = time.Now()
+		return nil
+	})
+	return err
 }
 
 func (s *HeartbeatService) run(ctx context.Context) {
@@ -188,6 +196,14 @@ func (s *HeartbeatService) run(ctx context.Context) {
 					zap.Error(err),
 					zap.String("node_id", s.nodeID),
 				)
+				continue
+			}
+
+			s.mu.RLock()
+			onBeat := s.onBeat
+			s.mu.RUnlock()
+			if onBeat != nil {
+				onBeat(ctx)
 			}
 		}
 	}
@@ -324,9 +340,18 @@ func (m *Monitor) checkNodes(ctx context.Context) {
 				zap.Time("last_seen", node.LastSeen),
 			)
 
-			// Update node status
-			node.Status = registry.NodeStatusNotReady
-			if err := m.registry.Update(ctx, node); err != nil {
+			// Update node status, unless it came back since listed
+			_, err := m.registry.Modify(ctx, node.ID, func(node *registry.Node) error {
+				if node.Status != registry.NodeStatusReady || time.Since(node.LastSeen) < m.config.Timeout {
+					return errNodeChanged
+				}
+				node.Status = registry.NodeStatusNotReady
+				return nil
+			})
+			if errors.Is(err, errNodeChanged) {
+				continue
+			}
+			if err != nil {
 				m.logger.Error("failed to update node status", zap.Error(err))
 			}
 
@@ -0,0 +1,294 @@
+// Package idempotency tracks client-supplied idempotency keys in etcd, so
+// that a request retried with the same key runs at most once and the retry
+// gets the result of the first run. Keys are scoped by the tenant making the
+// request, so tenants cannot see each other's results or block each other's
+// keys.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// keyPrefix is the etcd key prefix for idempotency records, followed by
+	// the tenant and the client's key.
+	keyPrefix = "/hypervisor/idempotency/"
+
+	// defaultScope is the scope of keys sent by unauthenticated callers.
+	defaultScope = "_"
+
+	// recordTTL is how long a key is remembered after its first use.
+	recordTTL = 24 * time.Hour
+
+	// AttemptTimeout bounds an attempt at a request made with a key. The
+	// caller must give up on the attempt by then.
+	AttemptTimeout = 10 * time.Minute
+
+	// abandonAfter is how long a request may stay in progress before a retry
+	// may take over, in case the server running it died. It exceeds
+	// AttemptTimeout, so an attempt still running is never taken over.
+	abandonAfter = AttemptTimeout + 5*time.Minute
+
+	// MaxKeyLength is the longest idempotency key accepted.
+	MaxKeyLength = 128
+)
+
+// State is the state of a request made with an idempotency key.
+type State string
+
+// Record states.
+const (
+	StateInProgress State = "in-progress"
+	StateSucceeded  State = "succeeded"
+	StateFailed     State = "failed" // A retry runs the request again
+)
+
+var (
+	// ErrKeyReused is returned when a key is sent with a different request
+	// than the one it was first used for.
+	ErrKeyReused = errors.New("idempotency key was used for a different request")
+
+	// ErrInProgress is returned while another request with the key runs.
+	ErrInProgress = errors.New("a request with this idempotency key is in progress")
+
+	// ErrInvalidKey is returned for empty or overlong keys.
+	ErrInvalidKey = errors.New("invalid idempotency key")
+
+	// ErrSuperseded is returned when recording the progress or outcome of
+	// an attempt that a later attempt has taken over.
+	ErrSuperseded = errors.New("idempotency key was taken over by a later attempt")
+)
+
+// Record is what is remembered about a request made with an idempotency
+// key.
+type Record struct {
+	Scope       string `json:"scope"` // Tenant the key belongs to
+	Key         string `json:"key"`
+	Operation   string `json:"operation"`
+	Fingerprint string `json:"fingerprint"` // Hash of the request
+	State       State  `json:"state"`
+
+	// Set by the operation as it goes, so a retry after a failure can find
+	// and clean up what the failed attempt left behind
+	InstanceID string `json:"instance_id,omitempty"`
+	NodeID     string `json:"node_id,omitempty"`
+
+	Result  json.RawMessage `json:"result,omitempty"` // Result of the request once it succeeded
+	Error   string          `json:"error,omitempty"`  // Error of the last failed attempt
+	Attempt int             `json:"attempt"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Fingerprint returns a hash of a request, used to tell a retry from a
+// different request reusing the key.
+func Fingerprint(request any) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ValidKey returns an error if key cannot be used as an idempotency key.
+func ValidKey(key string) error {
+	if key == "" || len(key) > MaxKeyLength {
+		return fmt.Errorf("%w: must be 1 to %d characters", ErrInvalidKey, MaxKeyLength)
+	}
+	return nil
+}
+
+// Store keeps idempotency records in etcd.
+type Store struct {
+	client *etcd.Client
+	logger *zap.Logger
+}
+
+// NewStore creates an idempotency store.
+func NewStore(client *etcd.Client, logger *zap.Logger) *Store {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Store{
+		client: client,
+		logger: logger,
+	}
+}
+
+// Begin claims the key of tenant scope for a request; an empty scope is
+// that of unauthenticated callers. It returns the record in progress for the
+// caller to run the request, or the succeeded record whose result must be
+// returned instead. A record of a failed or abandoned attempt is taken over
+// with its instance and node kept. It returns ErrKeyReused if the key was
+// used for another request and ErrInProgress while another attempt runs.
+func (s *Store) Begin(ctx context.Context, scope, key, operation, fingerprint string) (*Record, error) {
+	if err := ValidKey(key); err != nil {
+		return nil, err
+	}
+	if scope == "" {
+		scope = defaultScope
+	}
+
+	now := time.Now()
+	record := &Record{
+		Scope:       scope,
+		Key:         key,
+		Operation:   operation,
+		Fingerprint: fingerprint,
+		State:       StateInProgress,
+		Attempt:     1,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	data, err := marshalRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	created, err := s.client.CreateIfNotExistsWithTTL(ctx, record.etcdKey(), data, int64(recordTTL.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to store idempotency key: %w", err)
+	}
+	if created {
+		return record, nil
+	}
+
+	// The key was used before
+	var existing *Record
+	_, err = s.client.Modify(ctx, record.etcdKey(), func(value string) (string, error) {
+		current, err := unmarshalRecord(value)
+		if err != nil {
+			return "", err
+		}
+		if current.Operation != operation || current.Fingerprint != fingerprint {
+			return "", ErrKeyReused
+		}
+		switch {
+		case current.State == StateSucceeded:
+			existing = current
+			return value, nil
+		case current.State == StateInProgress && time.Since(current.UpdatedAt) < abandonAfter:
+			return "", ErrInProgress
+		}
+
+		current.State = StateInProgress
+		current.Attempt++
+		current.UpdatedAt = time.Now()
+		existing = current
+		return marshalRecord(current)
+	}, clientv3.WithIgnoreLease())
+	if err != nil {
+		if errors.Is(err, ErrKeyReused) || errors.Is(err, ErrInProgress) {
+			return nil, err
+		}
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			// Expired in between; the next retry starts afresh
+			return nil, ErrInProgress
+		}
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+
+	if existing.State == StateInProgress {
+		s.logger.Info("retrying request with idempotency key",
+			zap.String("scope", scope),
+			zap.String("key", key),
+			zap.String("operation", operation),
+			zap.Int("attempt", existing.Attempt),
+			zap.String("instance_id", existing.InstanceID),
+		)
+	}
+	return existing, nil
+}
+
+// Save stores the progress recorded in record by the running attempt.
+func (s *Store) Save(ctx context.Context, record *Record) error {
+	record.UpdatedAt = time.Now()
+	return s.update(ctx, record)
+}
+
+// Complete records the result of a request that succeeded. Retries with the
+// key get result until the key expires.
+func (s *Store) Complete(ctx context.Context, record *Record, result any) error {
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return fmt.Errorf("failed to marshal result: %w", err)
+		}
+		record.Result = data
+	}
+	record.State = StateSucceeded
+	record.Error = ""
+	record.UpdatedAt = time.Now()
+	return s.update(ctx, record)
+}
+
+// Fail records that an attempt failed, so a retry with the key runs the
+// request again.
+func (s *Store) Fail(ctx context.Context, record *Record, runErr error) error {
+	record.State = StateFailed
+	record.Error = runErr.Error()
+	record.UpdatedAt = time.Now()
+	return s.update(ctx, record)
+}
+
+// update replaces the stored record, keeping the key's TTL. It returns
+// ErrSuperseded if another attempt has taken the key over since record's
+// attempt began, so a late attempt cannot overwrite a later one's record.
+func (s *Store) update(ctx context.Context, record *Record) error {
+	data, err := marshalRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Modify(ctx, record.etcdKey(), func(value string) (string, error) {
+		current, err := unmarshalRecord(value)
+		if err != nil {
+			return "", err
+		}
+		if current.Attempt != record.Attempt {
+			return "", ErrSuperseded
+		}
+		return data, nil
+	}, clientv3.WithIgnoreLease())
+	if err != nil {
+		if errors.Is(err, ErrSuperseded) {
+			return err
+		}
+		return fmt.Errorf("failed to update idempotency key: %w", err)
+	}
+	return nil
+}
+
+// etcdKey returns the etcd key of the record.
+func (r *Record) etcdKey() string {
+	return keyPrefix + url.PathEscape(r.Scope) + "/" + r.Key
+}
+
+func marshalRecord(record *Record) (string, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+	return string(data), nil
+}
+
+func unmarshalRecord(value string) (*Record, error) {
+	var record Record
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal idempotency record: %w", err)
+	}
+	return &record, nil
+}
@@ -0,0 +1,130 @@
+package latency
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+)
+
+// keyPrefix is the etcd key prefix of the nodes' matrix rows.
+const keyPrefix = "/hypervisor/latency/"
+
+// StaleAfter is how old a row may get before it is reported as stale, e.g.
+// because its node stopped probing.
+const StaleAfter = 5 * time.Minute
+
+// Path is a network path between two nodes.
+type Path string
+
+// PathUnderlay is the path between the nodes' registered addresses. Probes
+// are plain UDP, so they cannot measure the VXLAN overlay on their own.
+const PathUnderlay Path = "underlay"
+
+// PathLatency is the outcome of probing one path.
+type PathLatency struct {
+	Address  string        `json:"address"`
+	Sent     int           `json:"sent"`
+	Received int           `json:"received"`
+	MinRTT   time.Duration `json:"min_rtt"`
+	AvgRTT   time.Duration `json:"avg_rtt"`
+	MaxRTT   time.Duration `json:"max_rtt"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Reachable reports whether any probe was answered.
+func (p *PathLatency) Reachable() bool {
+	return p != nil && p.Received > 0
+}
+
+// Row holds the latency measured from one node to its peers, by peer node
+// ID and path.
+type Row struct {
+	NodeID     string                           `json:"node_id"`
+	MeasuredAt time.Time                        `json:"measured_at"`
+	Peers      map[string]map[Path]*PathLatency `json:"peers"`
+}
+
+// Stale reports whether the row has not been measured for StaleAfter.
+func (r *Row) Stale() bool {
+	return time.Since(r.MeasuredAt) > StaleAfter
+}
+
+// Matrix is the latency measured between nodes, by source node ID.
+type Matrix map[string]*Row
+
+// RTT returns the average round-trip time between two nodes over the
+// underlay, from a fresh measurement of either end. A node is zero away from
+// itself.
+func (m Matrix) RTT(from, to string) (time.Duration, bool) {
+	if from == to {
+		return 0, true
+	}
+
+	var best *PathLatency
+	for _, pair := range [][2]string{{from, to}, {to, from}} {
+		row, ok := m[pair[0]]
+		if !ok || row.Stale() {
+			continue
+		}
+		if p := row.Peers[pair[1]][PathUnderlay]; p.Reachable() {
+			best = p
+			break
+		}
+	}
+
+	if best == nil {
+		return 0, false
+	}
+	return best.AvgRTT, true
+}
+
+// Store keeps the latency matrix in etcd.
+type Store struct {
+	client *etcd.Client
+}
+
+// NewStore creates a latency matrix store.
+func NewStore(client *etcd.Client) *Store {
+	return &Store{client: client}
+}
+
+// Publish replaces a node's row of the matrix.
+func (s *Store) Publish(ctx context.Context, row *Row) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return fmt.Errorf("failed to marshal latency row: %w", err)
+	}
+	if err := s.client.Put(ctx, keyPrefix+row.NodeID, string(data)); err != nil {
+		return fmt.Errorf("failed to publish latency row: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a node's row of the matrix.
+func (s *Store) Delete(ctx context.Context, nodeID string) error {
+	if err := s.client.Delete(ctx, keyPrefix+nodeID); err != nil {
+		return fmt.Errorf("failed to delete latency row: %w", err)
+	}
+	return nil
+}
+
+// Matrix reads the rows of every node.
+func (s *Store) Matrix(ctx context.Context) (Matrix, error) {
+	kvs, err := s.client.GetWithPrefixKV(ctx, keyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read latency matrix: %w", err)
+	}
+
+	matrix := make(Matrix, len(kvs))
+	for _, kv := range kvs {
+		var row Row
+		if err := json.Unmarshal([]byte(kv.Value), &row); err != nil {
+			continue
+		}
+		matrix[row.NodeID] = &row
+	}
+	return matrix, nil
+}
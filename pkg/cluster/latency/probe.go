@@ -0,0 +1,160 @@
+// Package latency measures network round-trip times between nodes and keeps
+// them in etcd as a cluster latency matrix.
+package latency
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Config holds the latency probe configuration.
+type Config struct {
+	// Enabled runs the probe responder and measures latency to every
+	// other ready node. Every node must then accept UDP on Port from the
+	// other nodes.
+	Enabled bool `mapstructure:"enabled"`
+
+	// Port is the UDP port probes are answered on. It must be the same on
+	// every node.
+	Port int `mapstructure:"port"`
+
+	// Interval is how often the matrix row of the node is measured.
+	Interval time.Duration `mapstructure:"interval"`
+
+	// Count is the number of probes sent to each peer per measurement.
+	Count int `mapstructure:"count"`
+
+	// Timeout is how long a probe waits for its echo.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// DefaultConfig returns the default latency probe configuration.
+func DefaultConfig() Config {
+	return Config{
+		Enabled:  false,
+		Port:     50054,
+		Interval: time.Minute,
+		Count:    5,
+		Timeout:  time.Second,
+	}
+}
+
+// probeMagic starts every probe packet, so stray datagrams are ignored.
+var probeMagic = []byte("HVLP")
+
+// probeSize is the size of a probe packet: magic plus sequence number.
+const probeSize = 4 + 8
+
+// Responder echoes probe packets back to their sender.
+type Responder struct {
+	conn   net.PacketConn
+	logger *zap.Logger
+	wg     sync.WaitGroup
+}
+
+// NewResponder listens for probes on the given UDP port.
+func NewResponder(port int, logger *zap.Logger) (*Responder, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for latency probes: %w", err)
+	}
+
+	r := &Responder{conn: conn, logger: logger}
+	r.wg.Add(1)
+	go r.serve()
+	return r, nil
+}
+
+func (r *Responder) serve() {
+	defer r.wg.Done()
+
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.logger.Debug("failed to read latency probe", zap.Error(err))
+			continue
+		}
+		if n != probeSize || !bytes.HasPrefix(buf, probeMagic) {
+			continue
+		}
+		if _, err := r.conn.WriteTo(buf[:n], addr); err != nil {
+			r.logger.Debug("failed to answer latency probe", zap.String("peer", addr.String()), zap.Error(err))
+		}
+	}
+}
+
+// Close stops answering probes.
+func (r *Responder) Close() error {
+	err := r.conn.Close()
+	r.wg.Wait()
+	return err
+}
+
+// Probe sends count probes to the responder at address, one at a time, and
+// summarizes the round-trip times of those answered within timeout.
+func Probe(ctx context.Context, address string, count int, timeout time.Duration) (*PathLatency, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	result := &PathLatency{Address: address}
+	var total time.Duration
+	packet := make([]byte, probeSize)
+	reply := make([]byte, 64)
+	copy(packet, probeMagic)
+
+	for seq := uint64(0); seq < uint64(count); seq++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		binary.BigEndian.PutUint64(packet[len(probeMagic):], seq)
+		sent := time.Now()
+		if _, err := conn.Write(packet); err != nil {
+			return nil, fmt.Errorf("failed to send probe to %s: %w", address, err)
+		}
+		result.Sent++
+
+		// Wait for this probe's echo, skipping late echoes of earlier ones
+		conn.SetReadDeadline(sent.Add(timeout))
+		for {
+			n, err := conn.Read(reply)
+			if err != nil {
+				break
+			}
+			if n == probeSize && bytes.Equal(reply[:n], packet) {
+				rtt := time.Since(sent)
+				if result.Received == 0 || rtt < result.MinRTT {
+					result.MinRTT = rtt
+				}
+				result.MaxRTT = max(result.MaxRTT, rtt)
+				total += rtt
+				result.Received++
+				break
+			}
+		}
+	}
+
+	if result.Received > 0 {
+		result.AvgRTT = total / time.Duration(result.Received)
+	}
+	return result, nil
+}
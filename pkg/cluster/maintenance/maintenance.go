@@ -0,0 +1,233 @@
+// Package maintenance stores maintenance windows in etcd: recurring periods
+// during which a set of nodes is cordoned, optionally drained, and put into
+// maintenance, to be made schedulable again when the period ends.
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+)
+
+// windowPrefix is the etcd key prefix for maintenance windows, followed by
+// the window's name.
+const windowPrefix = "/hypervisor/maintenance-windows/"
+
+// MaxDuration is the longest a maintenance window may last.
+const MaxDuration = 7 * 24 * time.Hour
+
+var (
+	// ErrWindowNotFound is returned when a maintenance window does not exist.
+	ErrWindowNotFound = errors.New("maintenance window not found")
+
+	// ErrWindowExists is returned when creating a window whose name is taken.
+	ErrWindowExists = errors.New("maintenance window already exists")
+)
+
+var nameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Window is a recurring maintenance period for a set of nodes, given by
+// node IDs, a label selector or both.
+type Window struct {
+	Name         string            `json:"name"`
+	NodeIDs      []string          `json:"node_ids,omitempty"`
+	NodeSelector map[string]string `json:"node_selector,omitempty"`
+
+	// Schedule is a cron expression for when the window starts, evaluated
+	// in TimeZone (UTC if empty)
+	Schedule string        `json:"schedule"`
+	TimeZone string        `json:"time_zone,omitempty"`
+	Duration time.Duration `json:"duration"`
+
+	// Drain stops the instances on the nodes when the window starts, Force
+	// without a graceful shutdown
+	Drain bool `json:"drain,omitempty"`
+	Force bool `json:"force,omitempty"`
+
+	Status    WindowStatus `json:"status"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// WindowStatus records the window's current run.
+type WindowStatus struct {
+	// ActiveSince is when the running window started, zero when none is
+	ActiveSince time.Time `json:"active_since,omitempty"`
+
+	// Nodes are the nodes the running window put into maintenance. Only
+	// these are made schedulable again when it ends.
+	Nodes []string `json:"nodes,omitempty"`
+
+	LastStarted time.Time `json:"last_started,omitempty"`
+	LastEnded   time.Time `json:"last_ended,omitempty"`
+}
+
+// Active reports whether a run of the window is in progress.
+func (w *Window) Active() bool {
+	return !w.Status.ActiveSince.IsZero()
+}
+
+// Validate checks the window and returns its parsed schedule and time zone.
+func (w *Window) Validate() (*Schedule, *time.Location, error) {
+	if !nameRegexp.MatchString(w.Name) {
+		return nil, nil, fmt.Errorf("invalid name %q: must be a DNS label", w.Name)
+	}
+	if len(w.NodeIDs) == 0 && len(w.NodeSelector) == 0 {
+		return nil, nil, fmt.Errorf("node IDs or a node selector are required")
+	}
+	if w.Duration < time.Minute || w.Duration > MaxDuration {
+		return nil, nil, fmt.Errorf("duration %s must be between 1m and %s", w.Duration, MaxDuration)
+	}
+	if w.Force && !w.Drain {
+		return nil, nil, fmt.Errorf("force only applies to windows that drain")
+	}
+	schedule, err := ParseSchedule(w.Schedule)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc, err := w.Location()
+	if err != nil {
+		return nil, nil, err
+	}
+	return schedule, loc, nil
+}
+
+// Location returns the time zone the window's schedule is evaluated in.
+func (w *Window) Location() (*time.Location, error) {
+	if w.TimeZone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", w.TimeZone, err)
+	}
+	return loc, nil
+}
+
+// Current returns when the run of the window that covers now started, or
+// the zero time if now is outside the window.
+func (w *Window) Current(now time.Time) (time.Time, error) {
+	schedule, loc, err := w.Validate()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Last(now.In(loc), w.Duration), nil
+}
+
+// Next returns when the window next starts after now, or the zero time if
+// its schedule never fires.
+func (w *Window) Next(now time.Time) (time.Time, error) {
+	schedule, loc, err := w.Validate()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(now.In(loc)), nil
+}
+
+// Store keeps maintenance windows in etcd.
+type Store struct {
+	client *etcd.Client
+}
+
+// NewStore creates a maintenance window store.
+func NewStore(client *etcd.Client) *Store {
+	return &Store{client: client}
+}
+
+// Create stores a new window. It returns ErrWindowExists if the name is
+// taken.
+func (s *Store) Create(ctx context.Context, window *Window) error {
+	data, err := json.Marshal(window)
+	if err != nil {
+		return fmt.Errorf("failed to marshal maintenance window: %w", err)
+	}
+
+	created, err := s.client.CreateIfNotExists(ctx, windowPrefix+window.Name, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to create maintenance window: %w", err)
+	}
+	if !created {
+		return ErrWindowExists
+	}
+	return nil
+}
+
+// Get returns a window by name.
+func (s *Store) Get(ctx context.Context, name string) (*Window, error) {
+	data, err := s.client.Get(ctx, windowPrefix+name)
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, ErrWindowNotFound
+		}
+		return nil, fmt.Errorf("failed to get maintenance window: %w", err)
+	}
+	return unmarshalWindow(data)
+}
+
+// List returns all windows sorted by name.
+func (s *Store) List(ctx context.Context) ([]*Window, error) {
+	kvs, err := s.client.GetWithPrefix(ctx, windowPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list maintenance windows: %w", err)
+	}
+
+	windows := make([]*Window, 0, len(kvs))
+	for _, data := range kvs {
+		window, err := unmarshalWindow(data)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Name < windows[j].Name })
+	return windows, nil
+}
+
+// Modify atomically applies fn to a stored window. fn may be called more
+// than once if the window changes in between.
+func (s *Store) Modify(ctx context.Context, name string, fn func(*Window) error) (*Window, error) {
+	var window *Window
+	_, err := s.client.Modify(ctx, windowPrefix+name, func(value string) (string, error) {
+		var err error
+		if window, err = unmarshalWindow(value); err != nil {
+			return "", err
+		}
+		if err := fn(window); err != nil {
+			return "", err
+		}
+
+		data, err := json.Marshal(window)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal maintenance window: %w", err)
+		}
+		return string(data), nil
+	})
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, ErrWindowNotFound
+		}
+		return nil, err
+	}
+	return window, nil
+}
+
+// Delete removes a window.
+func (s *Store) Delete(ctx context.Context, name string) error {
+	if err := s.client.Delete(ctx, windowPrefix+name); err != nil {
+		return fmt.Errorf("failed to delete maintenance window: %w", err)
+	}
+	return nil
+}
+
+func unmarshalWindow(data string) (*Window, error) {
+	var window Window
+	if err := json.Unmarshal([]byte(data), &window); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal maintenance window: %w", err)
+	}
+	return &window, nil
+}
@@ -0,0 +1,241 @@
+// Package notify forwards selected cluster events to external webhooks such
+// as Slack or PagerDuty.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+
+	"go.uber.org/zap"
+)
+
+// Webhook payload formats.
+const (
+	FormatSlack     = "slack"
+	FormatPagerDuty = "pagerduty"
+	FormatGeneric   = "generic"
+)
+
+// DefaultReasons are the event reasons forwarded by webhooks that do not
+// list their own.
+var DefaultReasons = []string{
+	"NodeNotReady",
+	"FailedScheduling",
+}
+
+// Config holds the notification configuration.
+type Config struct {
+	// Enabled turns on event forwarding.
+	Enabled bool `mapstructure:"enabled"`
+
+	// Webhooks are the destinations events are forwarded to.
+	Webhooks []WebhookConfig `mapstructure:"webhooks"`
+}
+
+// WebhookConfig configures one webhook destination.
+type WebhookConfig struct {
+	// Name identifies the webhook in delivery status.
+	Name string `mapstructure:"name"`
+
+	// URL is the endpoint events are POSTed to.
+	URL string `mapstructure:"url"`
+
+	// Format selects the default payload: slack, pagerduty or generic (the
+	// event as JSON).
+	Format string `mapstructure:"format"`
+
+	// Template overrides the payload with a Go text/template executed
+	// against a Notification. The json function encodes a value as JSON.
+	Template string `mapstructure:"template"`
+
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string `mapstructure:"headers"`
+
+	// RoutingKey is the PagerDuty integration key.
+	RoutingKey string `mapstructure:"routing_key"`
+
+	// Reasons, Kinds and Types select the events to forward. Empty Reasons
+	// means DefaultReasons; empty Kinds and Types match everything.
+	Reasons []string `mapstructure:"reasons"`
+	Kinds   []string `mapstructure:"kinds"`
+	Types   []string `mapstructure:"types"`
+
+	// RateLimit is the number of notifications sent per minute, with bursts
+	// of up to Burst. Events over the limit are dropped.
+	RateLimit int `mapstructure:"rate_limit"`
+	Burst     int `mapstructure:"burst"`
+
+	// Timeout bounds a single delivery attempt.
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	// MaxRetries is how often a failed delivery is retried.
+	MaxRetries int `mapstructure:"max_retries"`
+}
+
+// DefaultConfig returns the default notification configuration.
+func DefaultConfig() Config {
+	return Config{
+		Enabled: true,
+	}
+}
+
+// withDefaults fills in unset fields.
+func (c WebhookConfig) withDefaults() WebhookConfig {
+	if c.Format == "" {
+		c.Format = FormatGeneric
+	}
+	if len(c.Reasons) == 0 {
+		c.Reasons = DefaultReasons
+	}
+	if c.RateLimit <= 0 {
+		c.RateLimit = 30
+	}
+	if c.Burst <= 0 {
+		c.Burst = 10
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.MaxRetries < 0 {
+		c.MaxRetries = 0
+	}
+	return c
+}
+
+// matches reports whether the webhook forwards event.
+func (c WebhookConfig) matches(event *events.Event) bool {
+	return slices.Contains(c.Reasons, event.Reason) &&
+		(len(c.Kinds) == 0 || slices.Contains(c.Kinds, event.Kind)) &&
+		(len(c.Types) == 0 || slices.Contains(c.Types, event.Type))
+}
+
+// Notifier forwards recorded events to webhooks. It must run on a single
+// server (the leader) so that each event is sent once; delivery status is
+// kept in etcd so any server can report it.
+type Notifier struct {
+	config   Config
+	recorder *events.Recorder
+	status   *statusStore
+	webhooks []*webhook
+	logger   *zap.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewNotifier creates a notifier. Invalid webhooks are rejected.
+func NewNotifier(config Config, recorder *events.Recorder, etcdClient *etcd.Client, logger *zap.Logger) (*Notifier, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	n := &Notifier{
+		config:   config,
+		recorder: recorder,
+		status:   &statusStore{client: etcdClient},
+		logger:   logger,
+	}
+
+	names := make(map[string]bool)
+	for _, wc := range config.Webhooks {
+		if wc.Name == "" {
+			return nil, fmt.Errorf("webhook name is required")
+		}
+		if names[wc.Name] {
+			return nil, fmt.Errorf("duplicate webhook name: %s", wc.Name)
+		}
+		names[wc.Name] = true
+
+		wh, err := newWebhook(wc.withDefaults(), n.status, logger.With(zap.String("webhook", wc.Name)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook %s: %w", wc.Name, err)
+		}
+		n.webhooks = append(n.webhooks, wh)
+	}
+
+	return n, nil
+}
+
+// Start starts forwarding events until Stop is called or ctx is cancelled.
+func (n *Notifier) Start(ctx context.Context) error {
+	if !n.config.Enabled || len(n.webhooks) == 0 {
+		n.logger.Info("notifications disabled")
+		return nil
+	}
+
+	n.ctx, n.cancel = context.WithCancel(ctx)
+
+	for _, wh := range n.webhooks {
+		// Carry delivery counters over from the previous leader
+		wh.restore(n.ctx)
+
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			wh.run(n.ctx)
+		}()
+	}
+
+	n.wg.Add(1)
+	go n.run()
+
+	n.logger.Info("notifier started", zap.Int("webhooks", len(n.webhooks)))
+	return nil
+}
+
+// Stop stops forwarding events. Queued notifications are discarded.
+func (n *Notifier) Stop() {
+	if n.cancel == nil {
+		return
+	}
+	n.cancel()
+	n.wg.Wait()
+	n.cancel = nil
+	n.logger.Info("notifier stopped")
+}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+
+	for event := range n.recorder.Watch(n.ctx) {
+		for _, wh := range n.webhooks {
+			if wh.config.matches(event) {
+				wh.enqueue(n.ctx, event)
+			}
+		}
+	}
+}
+
+// Status returns the delivery status of every configured webhook.
+func (n *Notifier) Status(ctx context.Context) ([]*WebhookStatus, error) {
+	stored, err := n.status.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*WebhookStatus, 0, len(n.webhooks))
+	for _, wh := range n.webhooks {
+		st, ok := stored[wh.config.Name]
+		if !ok {
+			st = &WebhookStatus{}
+		}
+		// Describe the webhook as configured here, not as last stored
+		st.Name = wh.config.Name
+		st.URL = redactURL(wh.config.URL)
+		st.Format = wh.config.Format
+		result = append(result, st)
+	}
+	return result, nil
+}
+
+// Enabled reports whether events are forwarded.
+func (n *Notifier) Enabled() bool {
+	return n.config.Enabled && len(n.webhooks) > 0
+}
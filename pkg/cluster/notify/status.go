@@ -0,0 +1,115 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// statusPrefix is the etcd key prefix for webhook delivery status.
+	statusPrefix = "/hypervisor/notifications/status/"
+
+	// recentDeliveries is how many deliveries are kept per webhook.
+	recentDeliveries = 20
+
+	// saveTimeout bounds a single status write.
+	saveTimeout = 2 * time.Second
+)
+
+// WebhookStatus is the delivery status of one webhook.
+type WebhookStatus struct {
+	Name            string     `json:"name"`
+	URL             string     `json:"url,omitempty"` // Scheme and host only
+	Format          string     `json:"format,omitempty"`
+	Delivered       uint64     `json:"delivered"`
+	Failed          uint64     `json:"failed"`
+	Dropped         uint64     `json:"dropped"` // Rate limited or queue full
+	LastDeliveredAt time.Time  `json:"last_delivered_at"`
+	LastFailedAt    time.Time  `json:"last_failed_at"`
+	LastDroppedAt   time.Time  `json:"last_dropped_at"`
+	LastError       string     `json:"last_error,omitempty"`
+	Recent          []Delivery `json:"recent,omitempty"` // Oldest first
+}
+
+func (s *WebhookStatus) clone() *WebhookStatus {
+	c := *s
+	c.Recent = slices.Clone(s.Recent)
+	return &c
+}
+
+// Delivery is the outcome of sending one event to a webhook.
+type Delivery struct {
+	Time       time.Time `json:"time"`
+	EventID    string    `json:"event_id"`
+	Reason     string    `json:"reason"`
+	ObjectID   string    `json:"object_id"`
+	Success    bool      `json:"success"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Attempts   int       `json:"attempts"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// statusStore persists webhook status in etcd.
+type statusStore struct {
+	client *etcd.Client
+}
+
+func (s *statusStore) save(ctx context.Context, status *WebhookStatus, logger *zap.Logger) {
+	data, err := json.Marshal(status)
+	if err != nil {
+		logger.Warn("failed to marshal delivery status", zap.Error(err))
+		return
+	}
+
+	// Keep the status even if delivery was cut short by losing leadership
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), saveTimeout)
+	defer cancel()
+
+	if err := s.client.Put(ctx, statusPrefix+status.Name, string(data)); err != nil {
+		logger.Warn("failed to store delivery status", zap.Error(err))
+	}
+}
+
+func (s *statusStore) get(ctx context.Context, name string) (*WebhookStatus, error) {
+	value, err := s.client.Get(ctx, statusPrefix+name)
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get delivery status: %w", err)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	var status WebhookStatus
+	if err := json.Unmarshal([]byte(value), &status); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal delivery status: %w", err)
+	}
+	return &status, nil
+}
+
+func (s *statusStore) list(ctx context.Context) (map[string]*WebhookStatus, error) {
+	kvs, err := s.client.GetWithPrefixKV(ctx, statusPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list delivery status: %w", err)
+	}
+
+	result := make(map[string]*WebhookStatus, len(kvs))
+	for _, kv := range kvs {
+		var status WebhookStatus
+		if err := json.Unmarshal([]byte(kv.Value), &status); err != nil {
+			continue
+		}
+		result[status.Name] = &status
+	}
+	return result, nil
+}
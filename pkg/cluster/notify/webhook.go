@@ -0,0 +1,338 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"hypervisor/pkg/cluster/events"
+
+	"go.uber.org/zap"
+)
+
+// queueSize bounds the notifications waiting for delivery per webhook.
+const queueSize = 256
+
+// Default payload templates by format.
+var defaultTemplates = map[string]string{
+	FormatSlack: `{"text": {{ json .Summary }}}`,
+	FormatPagerDuty: `{"routing_key": {{ json .RoutingKey }}, "event_action": "trigger", ` +
+		`"dedup_key": {{ json .DedupKey }}, "payload": {"summary": {{ json .Summary }}, ` +
+		`"source": {{ json .Component }}, "severity": {{ json .Severity }}, ` +
+		`"timestamp": {{ json .Time }}, "custom_details": {{ json .Event }}}}`,
+	FormatGeneric: `{{ json .Event }}`,
+}
+
+// Notification is the data webhook templates are executed against.
+type Notification struct {
+	events.Event
+
+	// Summary is a one-line description of the event.
+	Summary string
+
+	// Severity is critical, warning or info.
+	Severity string
+
+	// DedupKey identifies the condition the event is about, so repeated
+	// events for the same object and reason can be grouped.
+	DedupKey string
+
+	// RoutingKey is the webhook's PagerDuty integration key.
+	RoutingKey string
+}
+
+func newNotification(event *events.Event, config WebhookConfig) *Notification {
+	summary := fmt.Sprintf("[%s] %s: %s %s", event.Type, event.Reason, event.Kind, event.ObjectID)
+	if event.Message != "" {
+		summary += ": " + event.Message
+	}
+
+	severity := "info"
+	if event.Type == events.TypeWarning {
+		severity = "warning"
+		if event.Kind == events.KindNode {
+			severity = "critical"
+		}
+	}
+
+	return &Notification{
+		Event:      *event,
+		Summary:    summary,
+		Severity:   severity,
+		DedupKey:   event.Kind + "/" + event.ObjectID + "/" + event.Reason,
+		RoutingKey: config.RoutingKey,
+	}
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// webhook delivers notifications to one endpoint.
+type webhook struct {
+	config  WebhookConfig
+	tmpl    *template.Template
+	client  *http.Client
+	limiter *rateLimiter
+	queue   chan *events.Event
+	store   *statusStore
+	logger  *zap.Logger
+
+	mu     sync.Mutex
+	status WebhookStatus
+}
+
+func newWebhook(config WebhookConfig, store *statusStore, logger *zap.Logger) (*webhook, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", config.URL)
+	}
+
+	text := config.Template
+	if text == "" {
+		var ok bool
+		if text, ok = defaultTemplates[config.Format]; !ok {
+			return nil, fmt.Errorf("unknown format %q (must be slack, pagerduty or generic)", config.Format)
+		}
+	}
+	tmpl, err := template.New(config.Name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	if config.Format == FormatPagerDuty && config.Template == "" && config.RoutingKey == "" {
+		return nil, fmt.Errorf("pagerduty webhooks require a routing key")
+	}
+
+	return &webhook{
+		config:  config,
+		tmpl:    tmpl,
+		client:  &http.Client{Timeout: config.Timeout},
+		limiter: newRateLimiter(config.RateLimit, config.Burst),
+		queue:   make(chan *events.Event, queueSize),
+		store:   store,
+		logger:  logger,
+		status:  WebhookStatus{Name: config.Name},
+	}, nil
+}
+
+// enqueue queues an event for delivery, dropping it if the webhook is over
+// its rate limit or its queue is full.
+func (w *webhook) enqueue(ctx context.Context, event *events.Event) {
+	if !w.limiter.allow() {
+		w.drop(ctx, event, "rate limited")
+		return
+	}
+
+	select {
+	case w.queue <- event:
+	default:
+		w.drop(ctx, event, "queue full")
+	}
+}
+
+// run delivers queued notifications until ctx is cancelled.
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-w.queue:
+			w.deliver(ctx, event)
+		}
+	}
+}
+
+// deliver sends one event, retrying transient failures with backoff.
+func (w *webhook) deliver(ctx context.Context, event *events.Event) {
+	var body bytes.Buffer
+	if err := w.tmpl.Execute(&body, newNotification(event, w.config)); err != nil {
+		w.record(ctx, Delivery{
+			Time:     time.Now(),
+			EventID:  event.ID,
+			Reason:   event.Reason,
+			ObjectID: event.ObjectID,
+			Error:    fmt.Sprintf("failed to render template: %v", err),
+		})
+		return
+	}
+
+	result := Delivery{
+		EventID:  event.ID,
+		Reason:   event.Reason,
+		ObjectID: event.ObjectID,
+	}
+
+	backoff := time.Second
+	for attempt := 1; attempt <= w.config.MaxRetries+1; attempt++ {
+		result.Attempts = attempt
+
+		code, retry, err := w.post(ctx, body.Bytes())
+		result.StatusCode = code
+		if err == nil {
+			result.Success = true
+			result.Error = ""
+			break
+		}
+		result.Error = err.Error()
+		if !retry || attempt > w.config.MaxRetries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	result.Time = time.Now()
+	w.record(ctx, result)
+}
+
+// post sends a payload and reports the HTTP status, whether a failure is
+// worth retrying, and the failure.
+func (w *webhook) post(ctx context.Context, body []byte) (int, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, true, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, false, nil
+	}
+
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return resp.StatusCode, retry, fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+}
+
+// drop records an event that was not delivered.
+func (w *webhook) drop(ctx context.Context, event *events.Event, why string) {
+	w.mu.Lock()
+	w.status.Dropped++
+	w.status.LastDroppedAt = time.Now()
+	snapshot := w.status.clone()
+	w.mu.Unlock()
+
+	w.logger.Warn("dropped notification",
+		zap.String("event_id", event.ID),
+		zap.String("reason", event.Reason),
+		zap.String("why", why),
+	)
+	w.store.save(ctx, snapshot, w.logger)
+}
+
+// record updates the delivery status with the outcome of a delivery.
+func (w *webhook) record(ctx context.Context, d Delivery) {
+	w.mu.Lock()
+	if d.Success {
+		w.status.Delivered++
+		w.status.LastDeliveredAt = d.Time
+	} else {
+		w.status.Failed++
+		w.status.LastFailedAt = d.Time
+		w.status.LastError = d.Error
+	}
+	w.status.Recent = append(w.status.Recent, d)
+	if len(w.status.Recent) > recentDeliveries {
+		w.status.Recent = w.status.Recent[len(w.status.Recent)-recentDeliveries:]
+	}
+	snapshot := w.status.clone()
+	w.mu.Unlock()
+
+	if !d.Success {
+		w.logger.Warn("failed to deliver notification",
+			zap.String("event_id", d.EventID),
+			zap.String("reason", d.Reason),
+			zap.Int("attempts", d.Attempts),
+			zap.String("error", d.Error),
+		)
+	}
+	w.store.save(ctx, snapshot, w.logger)
+}
+
+// restore loads the stored delivery status, if any.
+func (w *webhook) restore(ctx context.Context) {
+	stored, err := w.store.get(ctx, w.config.Name)
+	if err != nil {
+		w.logger.Warn("failed to load delivery status", zap.Error(err))
+		return
+	}
+	if stored == nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.status = *stored
+	w.mu.Unlock()
+}
+
+// rateLimiter is a token bucket refilled at a fixed rate per minute.
+type rateLimiter struct {
+	mu       sync.Mutex
+	rate     float64 // tokens per second
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:     float64(perMinute) / 60,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		lastFill: time.Now(),
+	}
+}
+
+// allow takes a token if one is available.
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.lastFill).Seconds()*l.rate)
+	l.lastFill = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// redactURL strips everything but the scheme and host from a webhook URL,
+// since Slack and similar webhooks embed their secret in the path.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,477 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	// cacheRetryDelay is how long a cache waits before listing again
+	// after failing to list or losing its watch.
+	cacheRetryDelay = 2 * time.Second
+
+	// pendingTimeout bounds how long a write replaces the watched object
+	// in reads, should the watch not deliver it, e.g. while it is failing.
+	pendingTimeout = 10 * time.Second
+)
+
+// Index names of the registry caches.
+const (
+	indexNode   = "node"
+	indexType   = "type"
+	indexState  = "state"
+	indexLabel  = "label"
+	indexRole   = "role"
+	indexRegion = "region"
+)
+
+// indexFunc returns the values an object is indexed under.
+type indexFunc[T any] func(*T) []string
+
+// cacheEntry is a cached object and the JSON it was decoded from, which
+// reads decode again so that callers never share the cached object, with
+// the revision the object was last modified at.
+type cacheEntry[T any] struct {
+	raw string
+	obj *T
+	rev int64
+}
+
+// pendingWrite is a write made through the registry that the watch has not
+// delivered yet.
+type pendingWrite[T any] struct {
+	entry   cacheEntry[T]
+	deleted bool
+	rev     int64
+}
+
+// revisioned is implemented by the objects that carry the revision they
+// were read at, for updates to detect that they changed since.
+type revisioned interface {
+	setRevision(rev int64)
+}
+
+// registryCache is a watch-backed copy of the objects stored under an etcd
+// prefix, indexed by the values of its index functions. It lists the
+// prefix, then watches it from the revision listed, listing again when the
+// watch fails, e.g. after a compaction.
+//
+// Writes made through the registry are recorded as pending until the watch
+// delivers them, or a later change of the object, so that the writer reads
+// them back at once: pending objects replace the watched ones in reads.
+type registryCache[T any] struct {
+	name    string
+	prefix  string
+	client  *etcd.Client
+	logger  *zap.Logger
+	indexes map[string]indexFunc[T]
+
+	mu       sync.RWMutex
+	synced   bool
+	revision int64 // Revision the watched objects are at
+	watched  map[string]cacheEntry[T]
+	pending  map[string]*pendingWrite[T]
+	view     map[string]cacheEntry[T] // watched with pending applied
+	index    map[string]map[string]map[string]struct{}
+}
+
+func newRegistryCache[T any](name, prefix string, client *etcd.Client, indexes map[string]indexFunc[T], logger *zap.Logger) *registryCache[T] {
+	return &registryCache[T]{
+		name:    name,
+		prefix:  prefix,
+		client:  client,
+		logger:  logger,
+		indexes: indexes,
+		watched: make(map[string]cacheEntry[T]),
+		pending: make(map[string]*pendingWrite[T]),
+		view:    make(map[string]cacheEntry[T]),
+		index:   make(map[string]map[string]map[string]struct{}),
+	}
+}
+
+// run keeps the cache in sync with etcd until ctx is done.
+func (c *registryCache[T]) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		revision, err := c.load(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.logger.Warn("failed to load registry cache", zap.String("cache", c.name), zap.Error(err))
+			}
+		} else {
+			c.watch(ctx, revision)
+		}
+
+		c.mu.Lock()
+		c.synced = false
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(cacheRetryDelay):
+		}
+	}
+}
+
+// load replaces the cached objects with those stored in etcd and returns
+// the revision they were read at.
+func (c *registryCache[T]) load(ctx context.Context) (int64, error) {
+	kvs, revision, err := c.client.GetWithPrefixRevision(ctx, c.prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	watched := make(map[string]cacheEntry[T], len(kvs))
+	for _, kv := range kvs {
+		id, ok := c.id(kv.Key)
+		if !ok {
+			continue
+		}
+		if entry, ok := c.decode(id, kv.Value, kv.ModRevision); ok {
+			watched[id] = entry
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The listing includes the pending writes made before it; those made
+	// since are delivered by the watch
+	c.revision = revision
+	c.watched = watched
+	c.pending = make(map[string]*pendingWrite[T])
+	c.view = make(map[string]cacheEntry[T], len(watched))
+	c.index = make(map[string]map[string]map[string]struct{})
+	for id, entry := range watched {
+		c.view[id] = entry
+		c.addIndexes(id, entry.obj)
+	}
+	c.synced = true
+
+	c.logger.Debug("registry cache loaded",
+		zap.String("cache", c.name),
+		zap.Int("objects", len(watched)),
+		zap.Int64("revision", revision),
+	)
+	return revision, nil
+}
+
+// watch applies the changes made after revision until the watch fails or
+// ctx is done.
+func (c *registryCache[T]) watch(ctx context.Context, revision int64) {
+	watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	for resp := range c.client.Watch(watchCtx, c.prefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1)) {
+		if err := resp.Err(); err != nil {
+			c.logger.Warn("registry cache watch failed", zap.String("cache", c.name), zap.Error(err))
+			return
+		}
+		for _, ev := range resp.Events {
+			id, ok := c.id(string(ev.Kv.Key))
+			if !ok {
+				continue
+			}
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				entry, ok := c.decode(id, string(ev.Kv.Value), ev.Kv.ModRevision)
+				if !ok {
+					continue
+				}
+				c.mu.Lock()
+				c.watched[id] = entry
+				c.delivered(id, ev.Kv.ModRevision)
+				c.mu.Unlock()
+
+			case clientv3.EventTypeDelete:
+				c.mu.Lock()
+				delete(c.watched, id)
+				c.delivered(id, ev.Kv.ModRevision)
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+// delivered records that the watch delivered a change of id made at
+// revision rev, dropping the pending write it is, or replaces. The watch
+// delivers changes in revision order, so the cache is then at rev. c.mu
+// must be held.
+func (c *registryCache[T]) delivered(id string, rev int64) {
+	c.revision = rev
+	if p, ok := c.pending[id]; ok && p.rev <= rev {
+		delete(c.pending, id)
+	}
+	c.refresh(id)
+}
+
+// id returns the ID of the object stored at key, if key holds one.
+func (c *registryCache[T]) id(key string) (string, bool) {
+	id := strings.TrimPrefix(key, c.prefix)
+	if id == key || id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+	return id, true
+}
+
+func (c *registryCache[T]) decode(id, raw string, rev int64) (cacheEntry[T], bool) {
+	obj := new(T)
+	if err := json.Unmarshal([]byte(raw), obj); err != nil {
+		c.logger.Warn("failed to unmarshal cached object",
+			zap.String("cache", c.name),
+			zap.String("id", id),
+			zap.Error(err),
+		)
+		return cacheEntry[T]{}, false
+	}
+	return cacheEntry[T]{raw: raw, obj: obj, rev: rev}, true
+}
+
+// stored records an object the registry wrote at revision rev.
+func (c *registryCache[T]) stored(id, raw string, rev int64) {
+	if c == nil {
+		return
+	}
+	entry, ok := c.decode(id, raw, rev)
+	if !ok {
+		return
+	}
+	c.addPending(id, &pendingWrite[T]{entry: entry, rev: rev})
+}
+
+// deleted records an object the registry deleted at revision rev.
+func (c *registryCache[T]) deleted(id string, rev int64) {
+	if c == nil {
+		return
+	}
+	c.addPending(id, &pendingWrite[T]{deleted: true, rev: rev})
+}
+
+// addPending records a pending write, dropped after pendingTimeout if the
+// watch has not delivered it. A write the watch already went past is not
+// recorded: it was delivered, and possibly replaced by newer changes.
+func (c *registryCache[T]) addPending(id string, p *pendingWrite[T]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.synced {
+		return
+	}
+	if p.rev <= c.revision {
+		return
+	}
+	if current, ok := c.pending[id]; ok && current.rev > p.rev {
+		return
+	}
+	c.pending[id] = p
+	c.refresh(id)
+
+	time.AfterFunc(pendingTimeout, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.pending[id] == p {
+			delete(c.pending, id)
+			c.refresh(id)
+		}
+	})
+}
+
+// refresh updates the view and indexes of id. c.mu must be held.
+func (c *registryCache[T]) refresh(id string) {
+	if old, ok := c.view[id]; ok {
+		c.removeIndexes(id, old.obj)
+		delete(c.view, id)
+	}
+
+	entry, ok := c.watched[id]
+	if p, isPending := c.pending[id]; isPending {
+		entry, ok = p.entry, !p.deleted
+	}
+	if ok {
+		c.view[id] = entry
+		c.addIndexes(id, entry.obj)
+	}
+}
+
+func (c *registryCache[T]) addIndexes(id string, obj *T) {
+	for name, fn := range c.indexes {
+		index, ok := c.index[name]
+		if !ok {
+			index = make(map[string]map[string]struct{})
+			c.index[name] = index
+		}
+		for _, value := range fn(obj) {
+			ids, ok := index[value]
+			if !ok {
+				ids = make(map[string]struct{})
+				index[value] = ids
+			}
+			ids[id] = struct{}{}
+		}
+	}
+}
+
+func (c *registryCache[T]) removeIndexes(id string, obj *T) {
+	for name, fn := range c.indexes {
+		index := c.index[name]
+		for _, value := range fn(obj) {
+			delete(index[value], id)
+			if len(index[value]) == 0 {
+				delete(index, value)
+			}
+		}
+	}
+}
+
+// get returns a copy of the object with ID id. ok is false if the cache
+// is not in sync or does not hold the object, for the caller to read etcd.
+// Reads and writes of a nil cache, that of a registry not caching, miss.
+func (c *registryCache[T]) get(id string) (*T, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	entry, ok := c.view[id]
+	ok = ok && c.synced
+	c.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return c.copy(entry)
+}
+
+// list returns copies of all objects. ok is false if the cache is not in
+// sync.
+func (c *registryCache[T]) list() ([]*T, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	if !c.synced {
+		c.mu.RUnlock()
+		return nil, false
+	}
+	entries := make([]cacheEntry[T], 0, len(c.view))
+	for _, entry := range c.view {
+		entries = append(entries, entry)
+	}
+	c.mu.RUnlock()
+	return c.copies(entries), true
+}
+
+// listByIndex returns copies of the objects indexed under value. ok is
+// false if the cache is not in sync.
+func (c *registryCache[T]) listByIndex(name, value string) ([]*T, bool) {
+	return c.query(name, []string{value}, nil)
+}
+
+// query returns copies of the objects indexed under any of values, or of
+// all objects if name is "", that match matches, if not nil. Matching the
+// cached objects before copying them spares decoding those not returned.
+// ok is false if the cache is not in sync.
+func (c *registryCache[T]) query(name string, values []string, matches func(*T) bool) ([]*T, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	if !c.synced {
+		c.mu.RUnlock()
+		return nil, false
+	}
+
+	var entries []cacheEntry[T]
+	add := func(entry cacheEntry[T]) {
+		if matches == nil || matches(entry.obj) {
+			entries = append(entries, entry)
+		}
+	}
+	if name == "" {
+		for _, entry := range c.view {
+			add(entry)
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, value := range values {
+			for id := range c.index[name][value] {
+				if !seen[id] {
+					seen[id] = true
+					add(c.view[id])
+				}
+			}
+		}
+	}
+	c.mu.RUnlock()
+	return c.copies(entries), true
+}
+
+// indexCount returns the number of objects indexed under values, for
+// choosing the most selective index. ok is false if the cache is not in
+// sync.
+func (c *registryCache[T]) indexCount(name string, values []string) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.synced {
+		return 0, false
+	}
+	count := 0
+	for _, value := range values {
+		count += len(c.index[name][value])
+	}
+	return count, true
+}
+
+func (c *registryCache[T]) copy(entry cacheEntry[T]) (*T, bool) {
+	obj := new(T)
+	if err := json.Unmarshal([]byte(entry.raw), obj); err != nil {
+		return nil, false
+	}
+	if r, ok := any(obj).(revisioned); ok {
+		r.setRevision(entry.rev)
+	}
+	return obj, true
+}
+
+func (c *registryCache[T]) copies(entries []cacheEntry[T]) []*T {
+	objs := make([]*T, 0, len(entries))
+	for _, entry := range entries {
+		if obj, ok := c.copy(entry); ok {
+			objs = append(objs, obj)
+		}
+	}
+	return objs
+}
+
+// labelIndexValues indexes labels as key=value.
+func labelIndexValues(labels map[string]string) []string {
+	values := make([]string, 0, len(labels))
+	for k, v := range labels {
+		values = append(values, k+"="+v)
+	}
+	return values
+}
+
+func instanceIndexes() map[string]indexFunc[Instance] {
+	return map[string]indexFunc[Instance]{
+		indexNode:  func(i *Instance) []string { return []string{i.NodeID} },
+		indexType:  func(i *Instance) []string { return []string{string(i.Type)} },
+		indexState: func(i *Instance) []string { return []string{string(i.State)} },
+		indexLabel: func(i *Instance) []string { return labelIndexValues(i.Labels) },
+	}
+}
+
+func nodeIndexes() map[string]indexFunc[Node] {
+	return map[string]indexFunc[Node]{
+		indexRole:   func(n *Node) []string { return []string{string(n.Role)} },
+		indexRegion: func(n *Node) []string { return []string{n.Region} },
+		indexLabel:  func(n *Node) []string { return labelIndexValues(n.Labels) },
+	}
+}
@@ -0,0 +1,173 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+)
+
+// groupPrefix is the etcd key prefix for instance groups, keyed by name.
+const groupPrefix = "/hypervisor/instance-groups/"
+
+// GroupLabel is set on every instance of a group to the group's name.
+const GroupLabel = "hypervisor.io/instance-group"
+
+// Group errors.
+var (
+	ErrGroupNotFound = errors.New("instance group not found")
+	ErrGroupExists   = errors.New("instance group already exists")
+)
+
+// InstanceTemplate is what every instance of a group is created from.
+type InstanceTemplate struct {
+	Type              driver.InstanceType `json:"type"`
+	Spec              driver.InstanceSpec `json:"spec"`
+	Labels            map[string]string   `json:"labels,omitempty"`
+	Annotations       map[string]string   `json:"annotations,omitempty"`
+	Region            string              `json:"region,omitempty"`
+	Zone              string              `json:"zone,omitempty"`
+	HighAvailability  bool                `json:"high_availability,omitempty"`
+	SpreadConstraints []SpreadConstraint  `json:"spread_constraints,omitempty"`
+}
+
+// InstanceGroup keeps Replicas identical instances created from Template.
+// Its instances carry GroupLabel; changing the template only affects
+// instances created afterwards.
+type InstanceGroup struct {
+	Name      string           `json:"name"`
+	Replicas  int              `json:"replicas"`
+	Template  InstanceTemplate `json:"template"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+// CreateGroup stores a new instance group. It returns ErrGroupExists if the
+// name is taken.
+func (r *EtcdInstanceRegistry) CreateGroup(ctx context.Context, group *InstanceGroup) error {
+	now := time.Now()
+	group.CreatedAt, group.UpdatedAt = now, now
+
+	data, err := json.Marshal(group)
+	if err != nil {
+		return fmt.Errorf("failed to marshal instance group: %w", err)
+	}
+	created, err := r.client.CreateIfNotExists(ctx, groupPrefix+group.Name, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to create instance group: %w", err)
+	}
+	if !created {
+		return ErrGroupExists
+	}
+	return nil
+}
+
+// GetGroup returns an instance group by name.
+func (r *EtcdInstanceRegistry) GetGroup(ctx context.Context, name string) (*InstanceGroup, error) {
+	data, err := r.client.Get(ctx, groupPrefix+name)
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, ErrGroupNotFound
+		}
+		return nil, fmt.Errorf("failed to get instance group: %w", err)
+	}
+
+	var group InstanceGroup
+	if err := json.Unmarshal([]byte(data), &group); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal instance group: %w", err)
+	}
+	return &group, nil
+}
+
+// GetGroupRevision returns an instance group by name with the etcd
+// revision it was last changed at, so a caller acting on the group later
+// can tell whether it was changed or deleted meanwhile.
+func (r *EtcdInstanceRegistry) GetGroupRevision(ctx context.Context, name string) (*InstanceGroup, int64, error) {
+	resp, err := r.client.Raw().Get(ctx, groupPrefix+name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get instance group: %w", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, ErrGroupNotFound
+	}
+
+	var group InstanceGroup
+	if err := json.Unmarshal(resp.Kvs[0].Value, &group); err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal instance group: %w", err)
+	}
+	return &group, resp.Kvs[0].ModRevision, nil
+}
+
+// ListGroups returns all instance groups sorted by name.
+func (r *EtcdInstanceRegistry) ListGroups(ctx context.Context) ([]*InstanceGroup, error) {
+	data, err := r.client.GetWithPrefix(ctx, groupPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instance groups: %w", err)
+	}
+
+	groups := make([]*InstanceGroup, 0, len(data))
+	for key, value := range data {
+		var group InstanceGroup
+		if err := json.Unmarshal([]byte(value), &group); err != nil {
+			r.logger.Warn("failed to unmarshal instance group", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		groups = append(groups, &group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+// ModifyGroup atomically applies fn to the stored group.
+func (r *EtcdInstanceRegistry) ModifyGroup(ctx context.Context, name string, fn func(*InstanceGroup) error) (*InstanceGroup, error) {
+	var group *InstanceGroup
+	_, err := r.client.Modify(ctx, groupPrefix+name, func(value string) (string, error) {
+		group = &InstanceGroup{}
+		if err := json.Unmarshal([]byte(value), group); err != nil {
+			return "", fmt.Errorf("failed to unmarshal instance group: %w", err)
+		}
+		if err := fn(group); err != nil {
+			return "", err
+		}
+		group.Name = name
+		group.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(group)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal instance group: %w", err)
+		}
+		return string(data), nil
+	})
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, ErrGroupNotFound
+		}
+		return nil, err
+	}
+	return group, nil
+}
+
+// DeleteGroup removes an instance group. Its instances are not touched.
+func (r *EtcdInstanceRegistry) DeleteGroup(ctx context.Context, name string) error {
+	if err := r.client.Delete(ctx, groupPrefix+name); err != nil {
+		return fmt.Errorf("failed to delete instance group: %w", err)
+	}
+	return nil
+}
+
+// ListGroupInstances returns the instances of a group, oldest first.
+func (r *EtcdInstanceRegistry) ListGroupInstances(ctx context.Context, name string) ([]*Instance, error) {
+	members, err := r.ListByLabels(ctx, map[string]string{GroupLabel: name})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].CreatedAt.Before(members[j].CreatedAt) })
+	return members, nil
+}
@@ -11,6 +11,7 @@ import (
 
 	"hypervisor/pkg/cluster/etcd"
 	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/metrics"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
@@ -18,8 +19,12 @@ import (
 
 const (
 	// Key prefixes in etcd
-	instancePrefix       = "/hypervisor/instances/"
-	instanceByNodePrefix = "/hypervisor/instances-by-node/"
+	InstancePrefix        = "/hypervisor/instances/"
+	InstanceByNodePrefix  = "/hypervisor/instances-by-node/"
+	instanceHistoryPrefix = "/hypervisor/instance-history/"
+
+	// stateHistoryLimit bounds the number of state transitions kept per instance.
+	stateHistoryLimit = 50
 )
 
 // Common errors
@@ -48,15 +53,29 @@ type InstanceRegistry interface {
 	// ListByState returns all instances in a specific state.
 	ListByState(ctx context.Context, state driver.InstanceState) ([]*Instance, error)
 
-	// Update updates an instance's information.
+	// ListByLabels returns all instances with all the given labels.
+	ListByLabels(ctx context.Context, labels map[string]string) ([]*Instance, error)
+
+	// ListBySelector returns all instances whose labels match selector.
+	ListBySelector(ctx context.Context, selector Selector) ([]*Instance, error)
+
+	// Update updates an instance's information. It fails with
+	// etcd.ErrConflict if the instance changed since it was read.
 	Update(ctx context.Context, instance *Instance) error
 
+	// Modify atomically applies fn to the stored instance, retrying if it is
+	// changed concurrently. Only fields fn changes are written.
+	Modify(ctx context.Context, instanceID string, fn func(*Instance) error) (*Instance, error)
+
 	// UpdateState updates an instance's state.
 	UpdateState(ctx context.Context, instanceID string, state driver.InstanceState, reason string) error
 
 	// Delete removes an instance from the registry.
 	Delete(ctx context.Context, instanceID string) error
 
+	// History returns an instance's recent state transitions, oldest first.
+	History(ctx context.Context, instanceID string) ([]StateTransition, error)
+
 	// Watch watches for instance changes.
 	Watch(ctx context.Context) (<-chan InstanceEvent, error)
 
@@ -72,6 +91,10 @@ type EtcdInstanceRegistry struct {
 	// Watch cancel function
 	mu          sync.RWMutex
 	watchCancel context.CancelFunc
+
+	// Watch-backed cache serving reads, nil unless enabled
+	cache       *registryCache[Instance]
+	cacheCancel context.CancelFunc
 }
 
 // NewEtcdInstanceRegistry creates a new etcd-based instance registry.
@@ -86,17 +109,20 @@ func NewEtcdInstanceRegistry(client *etcd.Client, logger *zap.Logger) *EtcdInsta
 	}
 }
 
+// EnableCache serves the registry's reads from an in-memory copy of the
+// instances, indexed by node, type, state and label and kept in sync by a
+// watch. Reads fall back to etcd until the copy is loaded and for
+// instances it does not hold. It must be called before the registry is
+// used.
+func (r *EtcdInstanceRegistry) EnableCache(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.cache = newRegistryCache("instances", InstancePrefix, r.client, instanceIndexes(), r.logger)
+	r.cacheCancel = cancel
+	go r.cache.run(ctx)
+}
+
 // Create creates a new instance in the registry.
 func (r *EtcdInstanceRegistry) Create(ctx context.Context, instance *Instance) error {
-	// Check if instance already exists
-	_, err := r.Get(ctx, instance.ID)
-	if err == nil {
-		return ErrInstanceExists
-	}
-	if err != ErrInstanceNotFound {
-		return err
-	}
-
 	// Set timestamps
 	now := time.Now()
 	if instance.CreatedAt.IsZero() {
@@ -110,20 +136,29 @@ func (r *EtcdInstanceRegistry) Create(ctx context.Context, instance *Instance) e
 		return fmt.Errorf("failed to marshal instance: %w", err)
 	}
 
-	// Store in etcd (main key)
-	key := instancePrefix + instance.ID
-	if err := r.client.Put(ctx, key, string(data)); err != nil {
+	// Store in etcd (main key), unless the instance already exists
+	key := InstancePrefix + instance.ID
+	rev, err := r.client.PutIfUnchanged(ctx, key, string(data), 0)
+	if err != nil {
+		if errors.Is(err, etcd.ErrConflict) {
+			return ErrInstanceExists
+		}
 		return fmt.Errorf("failed to create instance: %w", err)
 	}
+	instance.Revision = rev
+	r.cache.stored(instance.ID, string(data), rev)
 
 	// Store node index (for quick lookup by node)
 	if instance.NodeID != "" {
-		nodeIndexKey := instanceByNodePrefix + instance.NodeID + "/" + instance.ID
+		nodeIndexKey := InstanceByNodePrefix + instance.NodeID + "/" + instance.ID
 		if err := r.client.Put(ctx, nodeIndexKey, instance.ID); err != nil {
 			r.logger.Warn("failed to create node index", zap.Error(err))
 		}
 	}
 
+	metrics.ObserveInstanceTransition("", string(instance.State))
+	r.recordTransition(ctx, instance, "")
+
 	r.logger.Info("instance created",
 		zap.String("instance_id", instance.ID),
 		zap.String("name", instance.Name),
@@ -136,8 +171,17 @@ func (r *EtcdInstanceRegistry) Create(ctx context.Context, instance *Instance) e
 
 // Get retrieves an instance by ID.
 func (r *EtcdInstanceRegistry) Get(ctx context.Context, instanceID string) (*Instance, error) {
-	key := instancePrefix + instanceID
-	data, err := r.client.Get(ctx, key)
+	if instance, ok := r.cache.get(instanceID); ok {
+		return instance, nil
+	}
+	return r.load(ctx, instanceID)
+}
+
+// load reads an instance from etcd, bypassing the cache, for the updates
+// that must start from the stored instance.
+func (r *EtcdInstanceRegistry) load(ctx context.Context, instanceID string) (*Instance, error) {
+	key := InstancePrefix + instanceID
+	data, rev, err := r.client.GetRevision(ctx, key)
 	if err != nil {
 		if err == etcd.ErrKeyNotFound {
 			return nil, ErrInstanceNotFound
@@ -149,24 +193,30 @@ func (r *EtcdInstanceRegistry) Get(ctx context.Context, instanceID string) (*Ins
 	if err := json.Unmarshal([]byte(data), &instance); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal instance: %w", err)
 	}
+	instance.Revision = rev
 
 	return &instance, nil
 }
 
 // List returns all instances.
 func (r *EtcdInstanceRegistry) List(ctx context.Context) ([]*Instance, error) {
-	data, err := r.client.GetWithPrefix(ctx, instancePrefix)
+	if instances, ok := r.cache.list(); ok {
+		return instances, nil
+	}
+
+	kvs, err := r.client.GetWithPrefixKV(ctx, InstancePrefix)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list instances: %w", err)
 	}
 
-	instances := make([]*Instance, 0, len(data))
-	for _, v := range data {
+	instances := make([]*Instance, 0, len(kvs))
+	for _, kv := range kvs {
 		var instance Instance
-		if err := json.Unmarshal([]byte(v), &instance); err != nil {
+		if err := json.Unmarshal([]byte(kv.Value), &instance); err != nil {
 			r.logger.Warn("failed to unmarshal instance", zap.Error(err))
 			continue
 		}
+		instance.Revision = kv.ModRevision
 		instances = append(instances, &instance)
 	}
 
@@ -175,8 +225,12 @@ func (r *EtcdInstanceRegistry) List(ctx context.Context) ([]*Instance, error) {
 
 // ListByNode returns all instances on a specific node.
 func (r *EtcdInstanceRegistry) ListByNode(ctx context.Context, nodeID string) ([]*Instance, error) {
+	if instances, ok := r.cache.listByIndex(indexNode, nodeID); ok {
+		return instances, nil
+	}
+
 	// Get instance IDs from node index
-	indexPrefix := instanceByNodePrefix + nodeID + "/"
+	indexPrefix := InstanceByNodePrefix + nodeID + "/"
 	data, err := r.client.GetWithPrefix(ctx, indexPrefix)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list instances by node: %w", err)
@@ -201,6 +255,10 @@ func (r *EtcdInstanceRegistry) ListByNode(ctx context.Context, nodeID string) ([
 
 // ListByType returns all instances of a specific type.
 func (r *EtcdInstanceRegistry) ListByType(ctx context.Context, instanceType driver.InstanceType) ([]*Instance, error) {
+	if instances, ok := r.cache.listByIndex(indexType, string(instanceType)); ok {
+		return instances, nil
+	}
+
 	instances, err := r.List(ctx)
 	if err != nil {
 		return nil, err
@@ -218,6 +276,10 @@ func (r *EtcdInstanceRegistry) ListByType(ctx context.Context, instanceType driv
 
 // ListByState returns all instances in a specific state.
 func (r *EtcdInstanceRegistry) ListByState(ctx context.Context, state driver.InstanceState) ([]*Instance, error) {
+	if instances, ok := r.cache.listByIndex(indexState, string(state)); ok {
+		return instances, nil
+	}
+
 	instances, err := r.List(ctx)
 	if err != nil {
 		return nil, err
@@ -233,13 +295,75 @@ func (r *EtcdInstanceRegistry) ListByState(ctx context.Context, state driver.Ins
 	return filtered, nil
 }
 
-// Update updates an instance's information.
+// ListByLabels returns all instances with all the given labels.
+func (r *EtcdInstanceRegistry) ListByLabels(ctx context.Context, labels map[string]string) ([]*Instance, error) {
+	return r.ListBySelector(ctx, SelectorFromLabels(labels))
+}
+
+// ListBySelector returns all instances whose labels match selector. With
+// the cache enabled, the label index narrows the instances down to those
+// of the most selective key=value or key in (...) requirement instead of
+// going through all of them.
+func (r *EtcdInstanceRegistry) ListBySelector(ctx context.Context, selector Selector) ([]*Instance, error) {
+	matches := func(instance *Instance) bool { return selector.Matches(instance.Labels) }
+
+	var values []string
+	best := -1
+	for _, req := range selector {
+		if !req.indexed() {
+			continue
+		}
+		reqValues := make([]string, len(req.Values))
+		for i, v := range req.Values {
+			reqValues[i] = req.Key + "=" + v
+		}
+		count, ok := r.cache.indexCount(indexLabel, reqValues)
+		if !ok {
+			break
+		}
+		if best < 0 || count < best {
+			values, best = reqValues, count
+		}
+	}
+	index := indexLabel
+	if best < 0 {
+		index = "" // No indexed requirement, go through all instances
+	}
+	if instances, ok := r.cache.query(index, values, matches); ok {
+		return instances, nil
+	}
+
+	instances, err := r.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]*Instance, 0)
+	for _, instance := range instances {
+		if matches(instance) {
+			filtered = append(filtered, instance)
+		}
+	}
+
+	return filtered, nil
+}
+
+// Update updates an instance's information. The instance must not have
+// changed since it was read, at instance.Revision, or Update fails with
+// etcd.ErrConflict for the caller to read it again; without a Revision, it
+// replaces whatever is stored.
 func (r *EtcdInstanceRegistry) Update(ctx context.Context, instance *Instance) error {
 	// Get existing instance to check node change
-	existing, err := r.Get(ctx, instance.ID)
+	existing, err := r.load(ctx, instance.ID)
 	if err != nil {
 		return err
 	}
+	if instance.Revision == 0 {
+		instance.Revision = existing.Revision
+	}
+	if instance.Revision != existing.Revision {
+		return fmt.Errorf("failed to update instance: %w", etcd.ErrConflict)
+	}
 
 	// Update timestamp
 	instance.UpdatedAt = time.Now()
@@ -250,57 +374,111 @@ func (r *EtcdInstanceRegistry) Update(ctx context.Context, instance *Instance) e
 		return fmt.Errorf("failed to marshal instance: %w", err)
 	}
 
-	// Store in etcd
-	key := instancePrefix + instance.ID
-	if err := r.client.Put(ctx, key, string(data)); err != nil {
+	// Store in etcd, unless changed since loaded
+	key := InstancePrefix + instance.ID
+	rev, err := r.client.PutIfUnchanged(ctx, key, string(data), existing.Revision)
+	if err != nil {
 		return fmt.Errorf("failed to update instance: %w", err)
 	}
+	instance.Revision = rev
+	r.cache.stored(instance.ID, string(data), rev)
 
-	// Handle node change (update indexes)
-	if existing.NodeID != instance.NodeID {
-		// Remove old index
-		if existing.NodeID != "" {
-			oldIndexKey := instanceByNodePrefix + existing.NodeID + "/" + instance.ID
-			if err := r.client.Delete(ctx, oldIndexKey); err != nil {
-				r.logger.Warn("failed to delete old node index", zap.Error(err))
-			}
-		}
+	metrics.ObserveInstanceTransition(string(existing.State), string(instance.State))
+	if existing.State != instance.State {
+		r.recordTransition(ctx, instance, existing.State)
+	}
 
-		// Create new index
-		if instance.NodeID != "" {
-			newIndexKey := instanceByNodePrefix + instance.NodeID + "/" + instance.ID
-			if err := r.client.Put(ctx, newIndexKey, instance.ID); err != nil {
-				r.logger.Warn("failed to create new node index", zap.Error(err))
-			}
+	r.moveNodeIndex(ctx, instance.ID, existing.NodeID, instance.NodeID)
+	return nil
+}
+
+// moveNodeIndex moves an instance's node index entry from node from to
+// node to, if it changed.
+func (r *EtcdInstanceRegistry) moveNodeIndex(ctx context.Context, instanceID, from, to string) {
+	if from == to {
+		return
+	}
+
+	// Remove old index
+	if from != "" {
+		oldIndexKey := InstanceByNodePrefix + from + "/" + instanceID
+		if err := r.client.Delete(ctx, oldIndexKey); err != nil {
+			r.logger.Warn("failed to delete old node index", zap.Error(err))
 		}
 	}
 
-	return nil
+	// Create new index
+	if to != "" {
+		newIndexKey := InstanceByNodePrefix + to + "/" + instanceID
+		if err := r.client.Put(ctx, newIndexKey, instanceID); err != nil {
+			r.logger.Warn("failed to create new node index", zap.Error(err))
+		}
+	}
 }
 
-// UpdateState updates an instance's state.
-func (r *EtcdInstanceRegistry) UpdateState(ctx context.Context, instanceID string, state driver.InstanceState, reason string) error {
-	instance, err := r.Get(ctx, instanceID)
+// Modify atomically applies fn to the stored instance. fn may be called more
+// than once if another writer updates the instance in between, so it must
+// only depend on the instance it is given. State changes are recorded in
+// the instance history, and node changes in the node index.
+func (r *EtcdInstanceRegistry) Modify(ctx context.Context, instanceID string, fn func(*Instance) error) (*Instance, error) {
+	var instance *Instance
+	var from driver.InstanceState
+	var fromNode string
+	value, rev, err := r.client.ModifyRevision(ctx, InstancePrefix+instanceID, func(value string) (string, error) {
+		instance = &Instance{}
+		if err := json.Unmarshal([]byte(value), instance); err != nil {
+			return "", fmt.Errorf("failed to unmarshal instance: %w", err)
+		}
+		from, fromNode = instance.State, instance.NodeID
+		if err := fn(instance); err != nil {
+			return "", err
+		}
+		instance.ID = instanceID
+		instance.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(instance)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal instance: %w", err)
+		}
+		return string(data), nil
+	})
 	if err != nil {
-		return err
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, ErrInstanceNotFound
+		}
+		return nil, err
 	}
+	instance.Revision = rev
+	r.cache.stored(instanceID, value, rev)
 
-	instance.State = state
-	instance.StateReason = reason
-
-	// Update StartedAt if transitioning to running
-	if state == driver.StateRunning && instance.StartedAt == nil {
-		now := time.Now()
-		instance.StartedAt = &now
+	if instance.State != from {
+		metrics.ObserveInstanceTransition(string(from), string(instance.State))
+		r.recordTransition(ctx, instance, from)
 	}
+	r.moveNodeIndex(ctx, instanceID, fromNode, instance.NodeID)
+	return instance, nil
+}
 
-	return r.Update(ctx, instance)
+// UpdateState updates an instance's state.
+func (r *EtcdInstanceRegistry) UpdateState(ctx context.Context, instanceID string, state driver.InstanceState, reason string) error {
+	_, err := r.Modify(ctx, instanceID, func(instance *Instance) error {
+		instance.State = state
+		instance.StateReason = reason
+
+		// Update StartedAt if transitioning to running
+		if state == driver.StateRunning && instance.StartedAt == nil {
+			now := time.Now()
+			instance.StartedAt = &now
+		}
+		return nil
+	})
+	return err
 }
 
 // Delete removes an instance from the registry.
 func (r *EtcdInstanceRegistry) Delete(ctx context.Context, instanceID string) error {
 	// Get instance first to clean up indexes
-	instance, err := r.Get(ctx, instanceID)
+	instance, err := r.load(ctx, instanceID)
 	if err != nil {
 		if err == ErrInstanceNotFound {
 			return nil // Already deleted
@@ -309,23 +487,103 @@ func (r *EtcdInstanceRegistry) Delete(ctx context.Context, instanceID string) er
 	}
 
 	// Delete main key
-	key := instancePrefix + instanceID
-	if err := r.client.Delete(ctx, key); err != nil {
+	key := InstancePrefix + instanceID
+	rev, err := r.client.DeleteRevision(ctx, key)
+	if err != nil {
 		return fmt.Errorf("failed to delete instance: %w", err)
 	}
+	r.cache.deleted(instanceID, rev)
 
 	// Delete node index
 	if instance.NodeID != "" {
-		indexKey := instanceByNodePrefix + instance.NodeID + "/" + instanceID
+		indexKey := InstanceByNodePrefix + instance.NodeID + "/" + instanceID
 		if err := r.client.Delete(ctx, indexKey); err != nil {
 			r.logger.Warn("failed to delete node index", zap.Error(err))
 		}
 	}
 
+	// Delete state history
+	if err := r.client.Delete(ctx, instanceHistoryPrefix+instanceID); err != nil {
+		r.logger.Warn("failed to delete instance history", zap.Error(err))
+	}
+
 	r.logger.Info("instance deleted", zap.String("instance_id", instanceID))
 	return nil
 }
 
+// History returns an instance's recent state transitions, oldest first.
+func (r *EtcdInstanceRegistry) History(ctx context.Context, instanceID string) ([]StateTransition, error) {
+	data, err := r.client.Get(ctx, instanceHistoryPrefix+instanceID)
+	if err != nil {
+		if err == etcd.ErrKeyNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get instance history: %w", err)
+	}
+
+	var history []StateTransition
+	if err := json.Unmarshal([]byte(data), &history); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal instance history: %w", err)
+	}
+	return history, nil
+}
+
+// recordTransition appends a state transition to the instance's history,
+// dropping the oldest entries beyond stateHistoryLimit. The append is a
+// compare-and-swap so concurrent updates do not lose transitions. Failures
+// are logged rather than failing the instance update.
+func (r *EtcdInstanceRegistry) recordTransition(ctx context.Context, instance *Instance, from driver.InstanceState) {
+	key := instanceHistoryPrefix + instance.ID
+	transition := StateTransition{
+		Time:   instance.UpdatedAt,
+		From:   from,
+		To:     instance.State,
+		Reason: instance.StateReason,
+		NodeID: instance.NodeID,
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		resp, err := r.client.Raw().Get(ctx, key)
+		if err != nil {
+			r.logger.Warn("failed to read instance history", zap.String("instance_id", instance.ID), zap.Error(err))
+			return
+		}
+
+		var history []StateTransition
+		cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+		if len(resp.Kvs) > 0 {
+			if err := json.Unmarshal(resp.Kvs[0].Value, &history); err != nil {
+				r.logger.Warn("discarding corrupt instance history", zap.String("instance_id", instance.ID), zap.Error(err))
+				history = nil
+			}
+			cmp = clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)
+		}
+
+		history = append(history, transition)
+		if len(history) > stateHistoryLimit {
+			history = history[len(history)-stateHistoryLimit:]
+		}
+
+		data, err := json.Marshal(history)
+		if err != nil {
+			r.logger.Warn("failed to marshal instance history", zap.Error(err))
+			return
+		}
+
+		txnResp, err := r.client.Raw().Txn(ctx).If(cmp).Then(clientv3.OpPut(key, string(data))).Commit()
+		if err != nil {
+			r.logger.Warn("failed to record instance state transition", zap.String("instance_id", instance.ID), zap.Error(err))
+			return
+		}
+		if txnResp.Succeeded {
+			return
+		}
+	}
+
+	r.logger.Warn("gave up recording instance state transition after concurrent updates",
+		zap.String("instance_id", instance.ID))
+}
+
 // Watch watches for instance changes.
 func (r *EtcdInstanceRegistry) Watch(ctx context.Context) (<-chan InstanceEvent, error) {
 	events := make(chan InstanceEvent, 100)
@@ -335,7 +593,8 @@ func (r *EtcdInstanceRegistry) Watch(ctx context.Context) (<-chan InstanceEvent,
 	r.watchCancel = cancel
 	r.mu.Unlock()
 
-	watchChan := r.client.WatchWithPrefix(watchCtx, instancePrefix)
+	// Request previous values so delete events carry the deleted instance
+	watchChan := r.client.Watch(watchCtx, InstancePrefix, clientv3.WithPrefix(), clientv3.WithPrevKV())
 
 	go func() {
 		defer close(events)
@@ -343,7 +602,7 @@ func (r *EtcdInstanceRegistry) Watch(ctx context.Context) (<-chan InstanceEvent,
 		for resp := range watchChan {
 			for _, ev := range resp.Events {
 				// Skip node index keys
-				if strings.HasPrefix(string(ev.Kv.Key), instanceByNodePrefix) {
+				if strings.HasPrefix(string(ev.Kv.Key), InstanceByNodePrefix) {
 					continue
 				}
 
@@ -367,9 +626,13 @@ func (r *EtcdInstanceRegistry) Watch(ctx context.Context) (<-chan InstanceEvent,
 
 				case clientv3.EventTypeDelete:
 					eventType = EventDeleted
-					// Extract instance ID from key
-					instanceID := strings.TrimPrefix(string(ev.Kv.Key), instancePrefix)
-					instance = &Instance{ID: instanceID}
+					var i Instance
+					if ev.PrevKv != nil && json.Unmarshal(ev.PrevKv.Value, &i) == nil {
+						instance = &i
+					} else {
+						// Extract instance ID from key
+						instance = &Instance{ID: strings.TrimPrefix(string(ev.Kv.Key), InstancePrefix)}
+					}
 				}
 
 				select {
@@ -392,5 +655,8 @@ func (r *EtcdInstanceRegistry) Close() error {
 	if r.watchCancel != nil {
 		r.watchCancel()
 	}
+	if r.cacheCancel != nil {
+		r.cacheCancel()
+	}
 	return nil
 }
@@ -13,15 +13,35 @@ type Instance struct {
 	// Core fields from driver.Instance
 	ID          string               `json:"id"`
 	Name        string               `json:"name"`
+	Description string               `json:"description,omitempty"`
 	Type        driver.InstanceType  `json:"type"`
 	State       driver.InstanceState `json:"state"`
 	StateReason string               `json:"state_reason,omitempty"`
 	Spec        driver.InstanceSpec  `json:"spec"`
 	IPAddress   string               `json:"ip_address,omitempty"`
 
+	// DesiredState is the state requested by the user (spec), as opposed to
+	// State, which is the last state observed on the node (status). The
+	// reconciler drives State toward DesiredState. Empty means unmanaged.
+	DesiredState driver.InstanceState `json:"desired_state,omitempty"`
+
 	// Cluster-specific fields
 	NodeID string `json:"node_id"` // ID of the node where instance is running
 
+	// High availability
+	HighAvailability bool `json:"high_availability,omitempty"` // Reschedule on node failure
+	RescheduleCount  int  `json:"reschedule_count,omitempty"`  // Times moved after a node failure
+
+	// How the instance is spread with others sharing its labels, kept for
+	// rescheduling
+	SpreadConstraints []SpreadConstraint `json:"spread_constraints,omitempty"`
+
+	// Optional operations the driver supports; nil until the node reports them
+	Capabilities *InstanceCapabilities `json:"capabilities,omitempty"`
+
+	// How the scheduler last placed the instance, or why it could not
+	LastScheduling *SchedulingAttempt `json:"last_scheduling,omitempty"`
+
 	// Metadata
 	Labels      map[string]string `json:"labels,omitempty"`
 	Annotations map[string]string `json:"annotations,omitempty"`
@@ -30,6 +50,98 @@ type Instance struct {
 	CreatedAt time.Time  `json:"created_at"`
 	StartedAt *time.Time `json:"started_at,omitempty"`
 	UpdatedAt time.Time  `json:"updated_at"`
+
+	// Revision is the etcd revision the instance was read at, which Update
+	// requires the stored instance to still be at. It is not stored.
+	Revision int64 `json:"-"`
+}
+
+func (i *Instance) setRevision(rev int64) { i.Revision = rev }
+
+// InstanceCapabilities lists the optional operations available for an
+// instance, as reported by the driver running it.
+type InstanceCapabilities struct {
+	Driver      string `json:"driver"`
+	Console     bool   `json:"console"`
+	Exec        bool   `json:"exec"`
+	Logs        bool   `json:"logs"`
+	Pause       bool   `json:"pause,omitempty"`
+	Suspend     bool   `json:"suspend,omitempty"`
+	Resize      bool   `json:"resize,omitempty"`
+	Migrate     bool   `json:"migrate,omitempty"`
+	Diagnostics bool   `json:"diagnostics,omitempty"`
+
+	// Container runtimes the driver can run instances under
+	Runtimes []string `json:"runtimes,omitempty"`
+
+	// ReportsOperations is set when Pause through Diagnostics were
+	// reported. Agents that predate them leave it unset, and those
+	// operations are then unknown rather than unsupported.
+	ReportsOperations bool `json:"reports_operations,omitempty"`
+}
+
+// DriverCapabilities returns the capabilities of the named driver.
+func DriverCapabilities(name string, caps driver.Capabilities) InstanceCapabilities {
+	return InstanceCapabilities{
+		Driver:      name,
+		Console:     caps.Console,
+		Exec:        caps.Exec,
+		Logs:        caps.Logs,
+		Pause:       caps.Pause,
+		Suspend:     caps.Suspend,
+		Resize:      caps.Resize,
+		Migrate:     caps.Migrate,
+		Diagnostics: caps.Diagnostics,
+		Runtimes:    caps.Runtimes,
+
+		ReportsOperations: true,
+	}
+}
+
+// SupportsRuntime reports whether the driver can run instances under
+// runtime. Drivers that do not report runtimes are assumed to support any.
+func (c *InstanceCapabilities) SupportsRuntime(runtime string) bool {
+	if len(c.Runtimes) == 0 {
+		return true
+	}
+	for _, r := range c.Runtimes {
+		if r == runtime {
+			return true
+		}
+	}
+	return false
+}
+
+// Topology keys instances can be spread across.
+const (
+	SpreadTopologyNode   = "node"
+	SpreadTopologyZone   = "zone"
+	SpreadTopologyRegion = "region"
+)
+
+// SpreadConstraint asks the scheduler to spread the instances matching
+// MatchLabels evenly across the domains of TopologyKey.
+type SpreadConstraint struct {
+	TopologyKey string            `json:"topology_key"`
+	MatchLabels map[string]string `json:"match_labels"`
+}
+
+// SchedulingAttempt records one run of the scheduler for an instance.
+type SchedulingAttempt struct {
+	Time       time.Time         `json:"time"`
+	NodeID     string            `json:"node_id,omitempty"`  // Node selected; empty if none fit
+	Candidates int               `json:"candidates"`         // Nodes considered
+	Rejected   map[string]string `json:"rejected,omitempty"` // Node ID to why it was rejected
+	Error      string            `json:"error,omitempty"`
+}
+
+// StateTransition records one change of an instance's state.
+type StateTransition struct {
+	Time   time.Time            `json:"time"`
+	From   driver.InstanceState `json:"from,omitempty"` // Empty for the initial state
+	To     driver.InstanceState `json:"to"`
+	Reason string               `json:"reason,omitempty"`
+	NodeID string               `json:"node_id,omitempty"`
 }
 
 // InstanceEvent represents an event related to an instance.
@@ -3,6 +3,8 @@ package registry
 
 import (
 	"time"
+
+	"hypervisor/pkg/compute/driver"
 )
 
 // NodeRole represents the role of a node in the cluster.
@@ -72,6 +74,9 @@ type Node struct {
 	Allocatable Resources `json:"allocatable"`
 	Allocated   Resources `json:"allocated"`
 
+	// Instance creates the agent is running or has queued
+	Creates CreateLoad `json:"creates"`
+
 	// Health conditions
 	Conditions []NodeCondition `json:"conditions"`
 
@@ -79,14 +84,51 @@ type Node struct {
 	Labels      map[string]string `json:"labels"`
 	Annotations map[string]string `json:"annotations"`
 
+	// Taints keep instances that do not tolerate them off the node
+	Taints []driver.Taint `json:"taints,omitempty"`
+
 	// Supported instance types
 	SupportedInstanceTypes []InstanceType `json:"supported_instance_types"`
 
+	// Optional operations the driver of each supported type can do; nil
+	// for nodes whose agent does not report them
+	Capabilities map[InstanceType]InstanceCapabilities `json:"capabilities,omitempty"`
+
+	// Host CPU model and features, used to match instance CPU requirements
+	CPU *driver.HostCPU `json:"cpu,omitempty"`
+
+	// Host platform and storage, collected by the agent
+	Host *HostInventory `json:"host,omitempty"`
+
+	// GPUs on the node and the instances they are passed through to
+	GPUs []driver.HostGPU `json:"gpus,omitempty"`
+
+	// SR-IOV virtual functions on the node and the instances they are
+	// passed through to
+	VFs []driver.HostVF `json:"vfs,omitempty"`
+
+	// NUMA topology and the cores dedicated to instances on each node
+	NUMA []driver.NUMANode `json:"numa,omitempty"`
+
+	// Images cached on the node, used to prefer nodes that need no pull
+	Images []string `json:"images,omitempty"`
+
+	// Versions of the agent and of each driver's hypervisor, checked when
+	// planning upgrades
+	AgentVersion   string            `json:"agent_version,omitempty"`
+	DriverVersions map[string]string `json:"driver_versions,omitempty"`
+
 	// Timestamps
 	CreatedAt time.Time `json:"created_at"`
 	LastSeen  time.Time `json:"last_seen"`
+
+	// Revision is the etcd revision the node was read at, which Update
+	// requires the stored node to still be at. It is not stored.
+	Revision int64 `json:"-"`
 }
 
+func (n *Node) setRevision(rev int64) { n.Revision = rev }
+
 // Resources represents compute resources.
 type Resources struct {
 	CPUCores    int   `json:"cpu_cores"`
@@ -95,6 +137,50 @@ type Resources struct {
 	GPUCount    int   `json:"gpu_count"`
 }
 
+// HostInventory describes a node's platform, virtualization support and
+// the filesystems instance storage lives on.
+type HostInventory struct {
+	Architecture  string `json:"architecture"` // amd64, arm64, or the kernel's name for others
+	KernelVersion string `json:"kernel_version,omitempty"`
+	OSImage       string `json:"os_image,omitempty"`
+
+	// KVM is true when /dev/kvm exists; Virtualization is the hardware
+	// extension the CPU reports (vmx, svm), empty without one
+	KVM                  bool   `json:"kvm"`
+	Virtualization       string `json:"virtualization,omitempty"`
+	NestedVirtualization bool   `json:"nested_virtualization,omitempty"`
+
+	// VhostUser is true when Open vSwitch runs the DPDK datapath and can
+	// plug vhost-user ports
+	VhostUser bool `json:"vhost_user,omitempty"`
+
+	Filesystems []Filesystem `json:"filesystems,omitempty"`
+}
+
+// Filesystem is the size of the filesystem an instance storage path is on.
+type Filesystem struct {
+	Path           string `json:"path"`
+	CapacityBytes  int64  `json:"capacity_bytes"`
+	AvailableBytes int64  `json:"available_bytes"`
+}
+
+// CreateLoad reports a node's instance creates against its concurrency limit.
+type CreateLoad struct {
+	Limit    int `json:"limit"` // 0 means unlimited
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+// Pending returns the number of creates running or waiting for a slot.
+func (l CreateLoad) Pending() int {
+	return l.InFlight + l.Queued
+}
+
+// Saturated reports whether another create would have to queue.
+func (l CreateLoad) Saturated() bool {
+	return l.Limit > 0 && l.Pending() >= l.Limit
+}
+
 // NodeCondition represents a condition of a node.
 type NodeCondition struct {
 	Type               ConditionType   `json:"type"`
@@ -134,6 +220,28 @@ func (n *Node) IsReady() bool {
 	return false
 }
 
+// SetCondition adds or replaces the condition of cond's type. The transition
+// time is kept when the status does not change. It reports whether anything
+// changed.
+func (n *Node) SetCondition(cond NodeCondition) bool {
+	for i, existing := range n.Conditions {
+		if existing.Type != cond.Type {
+			continue
+		}
+		if existing.Status == cond.Status && existing.Reason == cond.Reason && existing.Message == cond.Message {
+			return false
+		}
+		if existing.Status == cond.Status {
+			cond.LastTransitionTime = existing.LastTransitionTime
+		}
+		n.Conditions[i] = cond
+		return true
+	}
+
+	n.Conditions = append(n.Conditions, cond)
+	return true
+}
+
 // AvailableResources returns the resources available for scheduling.
 func (n *Node) AvailableResources() Resources {
 	return Resources{
@@ -154,6 +262,53 @@ func (n *Node) CanSchedule(required Resources) bool {
 		avail.GPUCount >= required.GPUCount
 }
 
+// FreeGPUs returns how many of the node's GPUs are unassigned, can be
+// passed through and match req.
+func (n *Node) FreeGPUs(req driver.GPURequest) int {
+	free := 0
+	for _, gpu := range n.GPUs {
+		if gpu.InstanceID == "" && gpu.Assignable() && req.Matches(gpu) {
+			free++
+		}
+	}
+	return free
+}
+
+// FreeVFs returns how many of the node's SR-IOV virtual functions are
+// unassigned and can be passed through.
+func (n *Node) FreeVFs() int {
+	free := 0
+	for _, vf := range n.VFs {
+		if vf.InstanceID == "" && vf.Assignable() {
+			free++
+		}
+	}
+	return free
+}
+
+// FreeDedicatedCPUs returns how many of the node's cores are not dedicated
+// to an instance, in total and on the NUMA node numaNode when it is not nil.
+// A node that reported no topology has none.
+func (n *Node) FreeDedicatedCPUs(numaNode *int) int {
+	free := 0
+	for _, node := range n.NUMA {
+		if numaNode == nil || node.ID == *numaNode {
+			free += node.FreeCPUs()
+		}
+	}
+	return free
+}
+
+// HasImage reports whether the node has reported image as cached.
+func (n *Node) HasImage(image string) bool {
+	for _, cached := range n.Images {
+		if cached == image {
+			return true
+		}
+	}
+	return false
+}
+
 // SupportsInstanceType returns true if the node supports the given instance type.
 func (n *Node) SupportsInstanceType(t InstanceType) bool {
 	for _, supported := range n.SupportedInstanceTypes {
@@ -163,3 +318,44 @@ func (n *Node) SupportsInstanceType(t InstanceType) bool {
 	}
 	return false
 }
+
+// Architecture returns the node's CPU architecture, or "" if the node has
+// not reported its inventory.
+func (n *Node) Architecture() string {
+	if n.Host == nil {
+		return ""
+	}
+	return n.Host.Architecture
+}
+
+// CapabilitiesFor returns the capabilities of the node's driver for t, or
+// nil if the node does not report them.
+func (n *Node) CapabilitiesFor(t InstanceType) *InstanceCapabilities {
+	caps, ok := n.Capabilities[t]
+	if !ok {
+		return nil
+	}
+	return &caps
+}
+
+// MatchesSelector reports whether the node has all the labels of selector.
+func (n *Node) MatchesSelector(selector map[string]string) bool {
+	for k, v := range selector {
+		if n.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// UntoleratedTaints returns the node's taints with the given effect that
+// none of the tolerations tolerates.
+func (n *Node) UntoleratedTaints(tolerations []driver.Toleration, effect string) []driver.Taint {
+	var untolerated []driver.Taint
+	for _, taint := range n.Taints {
+		if taint.Effect == effect && !taint.ToleratedBy(tolerations) {
+			untolerated = append(untolerated, taint)
+		}
+	}
+	return untolerated
+}
@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/compute/driver"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// NodeSettingsPrefix is the etcd key prefix for the labels and taints set on
+// nodes through the API. The keys outlive the node's lease, so the settings
+// are applied again when the agent re-registers after a restart.
+const NodeSettingsPrefix = "/hypervisor/node-settings/"
+
+// NodeSettings are the labels and taints an operator set on a node.
+type NodeSettings struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Taints []driver.Taint    `json:"taints,omitempty"`
+}
+
+// apply sets the settings on node. Labels the node already has, i.e. those
+// discovered or configured by its agent, are kept.
+func (s *NodeSettings) apply(node *Node) {
+	if len(s.Labels) > 0 && node.Labels == nil {
+		node.Labels = make(map[string]string, len(s.Labels))
+	}
+	for k, v := range s.Labels {
+		if _, ok := node.Labels[k]; !ok {
+			node.Labels[k] = v
+		}
+	}
+	node.Taints = s.Taints
+}
+
+// GetSettings returns the settings of a node, empty if none were set.
+func (r *EtcdRegistry) GetSettings(ctx context.Context, nodeID string) (*NodeSettings, error) {
+	data, err := r.client.Get(ctx, NodeSettingsPrefix+nodeID)
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return &NodeSettings{}, nil
+		}
+		return nil, fmt.Errorf("failed to get node settings: %w", err)
+	}
+
+	var settings NodeSettings
+	if err := json.Unmarshal([]byte(data), &settings); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal node settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// UpdateSettings atomically applies fn to the stored settings of a node,
+// then to the labels of the registered node, and gives the node the
+// resulting taints. fn may be called more than once, so it must only change
+// what it is given.
+func (r *EtcdRegistry) UpdateSettings(ctx context.Context, nodeID string, fn func(*NodeSettings)) (*Node, error) {
+	// Make sure there is a key to modify
+	if _, err := r.client.CreateIfNotExists(ctx, NodeSettingsPrefix+nodeID, "{}"); err != nil {
+		return nil, fmt.Errorf("failed to create node settings: %w", err)
+	}
+
+	var settings NodeSettings
+	_, err := r.client.Modify(ctx, NodeSettingsPrefix+nodeID, func(value string) (string, error) {
+		settings = NodeSettings{}
+		if err := json.Unmarshal([]byte(value), &settings); err != nil {
+			return "", fmt.Errorf("failed to unmarshal node settings: %w", err)
+		}
+		if settings.Labels == nil {
+			settings.Labels = make(map[string]string)
+		}
+		fn(&settings)
+
+		data, err := json.Marshal(&settings)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal node settings: %w", err)
+		}
+		return string(data), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update node settings: %w", err)
+	}
+
+	return r.Modify(ctx, nodeID, func(node *Node) error {
+		current := &NodeSettings{Labels: node.Labels}
+		if current.Labels == nil {
+			current.Labels = make(map[string]string)
+		}
+		fn(current)
+		node.Labels, node.Taints = current.Labels, settings.Taints
+		return nil
+	})
+}
+
+// Modify atomically applies fn to the stored node, keeping the node's
+// lease. fn may be called more than once if another writer updates the
+// node in between, so it must only depend on the node it is given.
+func (r *EtcdRegistry) Modify(ctx context.Context, nodeID string, fn func(*Node) error) (*Node, error) {
+	var node *Node
+	value, rev, err := r.client.ModifyRevision(ctx, NodePrefix+nodeID, func(value string) (string, error) {
+		node = &Node{}
+		if err := json.Unmarshal([]byte(value), node); err != nil {
+			return "", fmt.Errorf("failed to unmarshal node: %w", err)
+		}
+		if err := fn(node); err != nil {
+			return "", err
+		}
+		node.ID = nodeID
+
+		data, err := json.Marshal(node)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal node: %w", err)
+		}
+		return string(data), nil
+	}, clientv3.WithIgnoreLease())
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, ErrNodeNotFound
+		}
+		return nil, err
+	}
+	node.Revision = rev
+	r.cache.stored(nodeID, value, rev)
+	return node, nil
+}
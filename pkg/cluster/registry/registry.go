@@ -16,7 +16,7 @@ import (
 
 const (
 	// Key prefixes in etcd
-	nodePrefix = "/hypervisor/nodes/"
+	NodePrefix = "/hypervisor/nodes/"
 
 	// Default lease TTL
 	defaultLeaseTTL = 30 // seconds
@@ -42,7 +42,8 @@ type Registry interface {
 	// ListByRegion returns all nodes in the given region.
 	ListByRegion(ctx context.Context, region string) ([]*Node, error)
 
-	// Update updates a node's information.
+	// Update updates a node's information. It fails with etcd.ErrConflict
+	// if the node changed since it was read.
 	Update(ctx context.Context, node *Node) error
 
 	// UpdateStatus updates a node's status.
@@ -67,6 +68,10 @@ type EtcdRegistry struct {
 
 	// Watch cancel function
 	watchCancel context.CancelFunc
+
+	// Watch-backed cache serving reads, nil unless enabled
+	cache       *registryCache[Node]
+	cacheCancel context.CancelFunc
 }
 
 // NewEtcdRegistry creates a new etcd-based registry.
@@ -83,6 +88,17 @@ func NewEtcdRegistry(client *etcd.Client, logger *zap.Logger) *EtcdRegistry {
 	}
 }
 
+// EnableCache serves the registry's reads from an in-memory copy of the
+// nodes, indexed by role, region and label and kept in sync by a watch.
+// Reads fall back to etcd until the copy is loaded and for nodes it does
+// not hold. It must be called before the registry is used.
+func (r *EtcdRegistry) EnableCache(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.cache = newRegistryCache("nodes", NodePrefix, r.client, nodeIndexes(), r.logger)
+	r.cacheCancel = cancel
+	go r.cache.run(ctx)
+}
+
 // Register registers a node and returns its ID.
 func (r *EtcdRegistry) Register(ctx context.Context, node *Node) (string, error) {
 	// Generate node ID if not provided
@@ -95,6 +111,13 @@ func (r *EtcdRegistry) Register(ctx context.Context, node *Node) (string, error)
 	node.CreatedAt = now
 	node.LastSeen = now
 
+	// Restore the labels and taints set through the API before a restart
+	if settings, err := r.GetSettings(ctx, node.ID); err != nil {
+		r.logger.Warn("failed to get node settings", zap.String("node_id", node.ID), zap.Error(err))
+	} else {
+		settings.apply(node)
+	}
+
 	// Create lease
 	lease, err := r.client.Grant(ctx, r.leaseTTL)
 	if err != nil {
@@ -113,10 +136,13 @@ func (r *EtcdRegistry) Register(ctx context.Context, node *Node) (string, error)
 	}
 
 	// Store in etcd with lease
-	key := nodePrefix + node.ID
-	if err := r.client.PutWithLease(ctx, key, string(data), lease.ID); err != nil {
+	key := NodePrefix + node.ID
+	rev, err := r.client.PutRevision(ctx, key, string(data), clientv3.WithLease(lease.ID))
+	if err != nil {
 		return "", fmt.Errorf("failed to register node: %w", err)
 	}
+	node.Revision = rev
+	r.cache.stored(node.ID, string(data), rev)
 
 	r.logger.Info("node registered",
 		zap.String("node_id", node.ID),
@@ -144,10 +170,12 @@ func (r *EtcdRegistry) Deregister(ctx context.Context, nodeID string) error {
 	}
 
 	// Delete from etcd
-	key := nodePrefix + nodeID
-	if err := r.client.Delete(ctx, key); err != nil {
+	key := NodePrefix + nodeID
+	rev, err := r.client.DeleteRevision(ctx, key)
+	if err != nil {
 		return fmt.Errorf("failed to deregister node: %w", err)
 	}
+	r.cache.deleted(nodeID, rev)
 
 	r.logger.Info("node deregistered", zap.String("node_id", nodeID))
 	return nil
@@ -155,8 +183,17 @@ func (r *EtcdRegistry) Deregister(ctx context.Context, nodeID string) error {
 
 // Get retrieves a node by ID.
 func (r *EtcdRegistry) Get(ctx context.Context, nodeID string) (*Node, error) {
-	key := nodePrefix + nodeID
-	data, err := r.client.Get(ctx, key)
+	if node, ok := r.cache.get(nodeID); ok {
+		return node, nil
+	}
+	return r.load(ctx, nodeID)
+}
+
+// load reads a node from etcd, bypassing the cache, for the updates that
+// must start from the stored node.
+func (r *EtcdRegistry) load(ctx context.Context, nodeID string) (*Node, error) {
+	key := NodePrefix + nodeID
+	data, rev, err := r.client.GetRevision(ctx, key)
 	if err != nil {
 		if err == etcd.ErrKeyNotFound {
 			return nil, ErrNodeNotFound
@@ -168,24 +205,30 @@ func (r *EtcdRegistry) Get(ctx context.Context, nodeID string) (*Node, error) {
 	if err := json.Unmarshal([]byte(data), &node); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal node: %w", err)
 	}
+	node.Revision = rev
 
 	return &node, nil
 }
 
 // List returns all registered nodes.
 func (r *EtcdRegistry) List(ctx context.Context) ([]*Node, error) {
-	data, err := r.client.GetWithPrefix(ctx, nodePrefix)
+	if nodes, ok := r.cache.list(); ok {
+		return nodes, nil
+	}
+
+	kvs, err := r.client.GetWithPrefixKV(ctx, NodePrefix)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list nodes: %w", err)
 	}
 
-	nodes := make([]*Node, 0, len(data))
-	for _, v := range data {
+	nodes := make([]*Node, 0, len(kvs))
+	for _, kv := range kvs {
 		var node Node
-		if err := json.Unmarshal([]byte(v), &node); err != nil {
+		if err := json.Unmarshal([]byte(kv.Value), &node); err != nil {
 			r.logger.Warn("failed to unmarshal node", zap.Error(err))
 			continue
 		}
+		node.Revision = kv.ModRevision
 		nodes = append(nodes, &node)
 	}
 
@@ -194,6 +237,10 @@ func (r *EtcdRegistry) List(ctx context.Context) ([]*Node, error) {
 
 // ListByRole returns all nodes with the given role.
 func (r *EtcdRegistry) ListByRole(ctx context.Context, role NodeRole) ([]*Node, error) {
+	if nodes, ok := r.cache.listByIndex(indexRole, string(role)); ok {
+		return nodes, nil
+	}
+
 	nodes, err := r.List(ctx)
 	if err != nil {
 		return nil, err
@@ -211,6 +258,10 @@ func (r *EtcdRegistry) ListByRole(ctx context.Context, role NodeRole) ([]*Node,
 
 // ListByRegion returns all nodes in the given region.
 func (r *EtcdRegistry) ListByRegion(ctx context.Context, region string) ([]*Node, error) {
+	if nodes, ok := r.cache.listByIndex(indexRegion, region); ok {
+		return nodes, nil
+	}
+
 	nodes, err := r.List(ctx)
 	if err != nil {
 		return nil, err
@@ -226,7 +277,10 @@ func (r *EtcdRegistry) ListByRegion(ctx context.Context, region string) ([]*Node
 	return filtered, nil
 }
 
-// Update updates a node's information.
+// Update updates a node's information. The node must not have changed
+// since it was read, at node.Revision, or Update fails with
+// etcd.ErrConflict for the caller to read it again; without a Revision, it
+// replaces whatever is stored.
 func (r *EtcdRegistry) Update(ctx context.Context, node *Node) error {
 	node.LastSeen = time.Now()
 
@@ -235,36 +289,41 @@ func (r *EtcdRegistry) Update(ctx context.Context, node *Node) error {
 		return fmt.Errorf("failed to marshal node: %w", err)
 	}
 
-	key := nodePrefix + node.ID
+	key := NodePrefix + node.ID
 
 	r.mu.RLock()
 	leaseID, hasLease := r.leases[node.ID]
 	r.mu.RUnlock()
 
+	var opts []clientv3.OpOption
 	if hasLease {
-		if err := r.client.PutWithLease(ctx, key, string(data), leaseID); err != nil {
-			return fmt.Errorf("failed to update node: %w", err)
-		}
+		opts = append(opts, clientv3.WithLease(leaseID))
+	}
+
+	var rev int64
+	if node.Revision == 0 {
+		rev, err = r.client.PutRevision(ctx, key, string(data), opts...)
 	} else {
-		if err := r.client.Put(ctx, key, string(data)); err != nil {
-			return fmt.Errorf("failed to update node: %w", err)
-		}
+		rev, err = r.client.PutIfUnchanged(ctx, key, string(data), node.Revision, opts...)
 	}
+	if err != nil {
+		return fmt.Errorf("failed to update node: %w", err)
+	}
+	node.Revision = rev
+	r.cache.stored(node.ID, string(data), rev)
 
 	return nil
 }
 
 // UpdateStatus updates a node's status.
 func (r *EtcdRegistry) UpdateStatus(ctx context.Context, nodeID string, status NodeStatus, conditions []NodeCondition) error {
-	node, err := r.Get(ctx, nodeID)
-	if err != nil {
-		return err
-	}
-
-	node.Status = status
-	node.Conditions = conditions
-
-	return r.Update(ctx, node)
+	_, err := r.Modify(ctx, nodeID, func(node *Node) error {
+		node.Status = status
+		node.Conditions = conditions
+		node.LastSeen = time.Now()
+		return nil
+	})
+	return err
 }
 
 // Watch watches for node changes.
@@ -274,7 +333,7 @@ func (r *EtcdRegistry) Watch(ctx context.Context) (<-chan NodeEvent, error) {
 	watchCtx, cancel := context.WithCancel(ctx)
 	r.watchCancel = cancel
 
-	watchChan := r.client.WatchWithPrefix(watchCtx, nodePrefix)
+	watchChan := r.client.WatchWithPrefix(watchCtx, NodePrefix)
 
 	go func() {
 		defer close(events)
@@ -302,7 +361,7 @@ func (r *EtcdRegistry) Watch(ctx context.Context) (<-chan NodeEvent, error) {
 				case clientv3.EventTypeDelete:
 					eventType = EventDeleted
 					// Extract node ID from key
-					nodeID := string(ev.Kv.Key)[len(nodePrefix):]
+					nodeID := string(ev.Kv.Key)[len(NodePrefix):]
 					node = &Node{ID: nodeID}
 				}
 
@@ -323,6 +382,9 @@ func (r *EtcdRegistry) Close() error {
 	if r.watchCancel != nil {
 		r.watchCancel()
 	}
+	if r.cacheCancel != nil {
+		r.cacheCancel()
+	}
 	return nil
 }
 
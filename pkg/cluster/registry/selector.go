@@ -0,0 +1,198 @@
+package registry
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// SelectorOperator is how a selector requirement matches a label.
+type SelectorOperator string
+
+const (
+	SelectorEquals       SelectorOperator = "="
+	SelectorNotEquals    SelectorOperator = "!="
+	SelectorIn           SelectorOperator = "in"
+	SelectorNotIn        SelectorOperator = "notin"
+	SelectorExists       SelectorOperator = "exists"
+	SelectorDoesNotExist SelectorOperator = "!"
+)
+
+// Requirement is one term of a label selector.
+type Requirement struct {
+	Key      string
+	Operator SelectorOperator
+	Values   []string
+}
+
+// Matches reports whether labels satisfy the requirement. As with
+// Kubernetes selectors, != and notin match objects without the label.
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case SelectorEquals, SelectorIn:
+		return ok && slices.Contains(r.Values, value)
+	case SelectorNotEquals, SelectorNotIn:
+		return !ok || !slices.Contains(r.Values, value)
+	case SelectorExists:
+		return ok
+	case SelectorDoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+// indexed reports whether the requirement selects objects by label value,
+// so that the label index can find them.
+func (r Requirement) indexed() bool {
+	return r.Operator == SelectorEquals || r.Operator == SelectorIn
+}
+
+func (r Requirement) String() string {
+	switch r.Operator {
+	case SelectorEquals, SelectorNotEquals:
+		return r.Key + string(r.Operator) + r.Values[0]
+	case SelectorIn, SelectorNotIn:
+		return fmt.Sprintf("%s %s (%s)", r.Key, r.Operator, strings.Join(r.Values, ","))
+	case SelectorDoesNotExist:
+		return "!" + r.Key
+	}
+	return r.Key
+}
+
+// Selector selects objects whose labels satisfy all its requirements. An
+// empty selector selects everything.
+type Selector []Requirement
+
+// Matches reports whether labels satisfy every requirement.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	terms := make([]string, len(s))
+	for i, r := range s {
+		terms[i] = r.String()
+	}
+	return strings.Join(terms, ",")
+}
+
+// SelectorFromLabels returns the selector requiring each of labels.
+func SelectorFromLabels(labels map[string]string) Selector {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	selector := make(Selector, 0, len(keys))
+	for _, k := range keys {
+		selector = append(selector, Requirement{Key: k, Operator: SelectorEquals, Values: []string{labels[k]}})
+	}
+	return selector
+}
+
+// ParseSelector parses a comma-separated label selector, whose terms are
+// key=value (or key==value), key!=value, key in (v1,v2), key notin (v1,v2),
+// key (the label is set) and !key (the label is not set). For example:
+//
+//	app=web,tier in (frontend,cache),env!=test,!deprecated
+func ParseSelector(selector string) (Selector, error) {
+	terms, err := splitSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := make(Selector, 0, len(terms))
+	for _, term := range terms {
+		r, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// splitSelector splits a selector at the commas outside parentheses.
+func splitSelector(selector string) ([]string, error) {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			if depth++; depth > 1 {
+				return nil, fmt.Errorf("invalid selector %q: nested parentheses", selector)
+			}
+		case ')':
+			if depth--; depth < 0 {
+				return nil, fmt.Errorf("invalid selector %q: unbalanced parentheses", selector)
+			}
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("invalid selector %q: unbalanced parentheses", selector)
+	}
+	terms = append(terms, selector[start:])
+
+	nonEmpty := terms[:0]
+	for _, term := range terms {
+		if term = strings.TrimSpace(term); term != "" {
+			nonEmpty = append(nonEmpty, term)
+		}
+	}
+	return nonEmpty, nil
+}
+
+func parseRequirement(term string) (Requirement, error) {
+	// Set-based terms: key in (...), key notin (...)
+	if open := strings.Index(term, "("); open >= 0 {
+		fields := strings.Fields(term[:open])
+		if len(fields) != 2 || (fields[1] != string(SelectorIn) && fields[1] != string(SelectorNotIn)) || !strings.HasSuffix(term, ")") {
+			return Requirement{}, fmt.Errorf("invalid selector term %q: expected key in (values) or key notin (values)", term)
+		}
+		var values []string
+		for _, v := range strings.Split(term[open+1:len(term)-1], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			return Requirement{}, fmt.Errorf("invalid selector term %q: no values", term)
+		}
+		return newRequirement(term, fields[0], SelectorOperator(fields[1]), values)
+	}
+
+	for _, op := range []string{"!=", "==", "="} {
+		if key, value, ok := strings.Cut(term, op); ok {
+			operator := SelectorEquals
+			if op == "!=" {
+				operator = SelectorNotEquals
+			}
+			return newRequirement(term, strings.TrimSpace(key), operator, []string{strings.TrimSpace(value)})
+		}
+	}
+
+	if key, ok := strings.CutPrefix(term, "!"); ok {
+		return newRequirement(term, strings.TrimSpace(key), SelectorDoesNotExist, nil)
+	}
+	return newRequirement(term, term, SelectorExists, nil)
+}
+
+func newRequirement(term, key string, operator SelectorOperator, values []string) (Requirement, error) {
+	if key == "" || strings.ContainsAny(key, " \t=!(),") {
+		return Requirement{}, fmt.Errorf("invalid selector term %q: invalid label key %q", term, key)
+	}
+	return Requirement{Key: key, Operator: operator, Values: values}, nil
+}
@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     Selector
+		wantErr  bool
+	}{
+		{selector: "", want: Selector{}},
+		{selector: " , ", want: Selector{}},
+		{
+			selector: "app=web",
+			want:     Selector{{Key: "app", Operator: SelectorEquals, Values: []string{"web"}}},
+		},
+		{
+			selector: "app==web",
+			want:     Selector{{Key: "app", Operator: SelectorEquals, Values: []string{"web"}}},
+		},
+		{
+			selector: "env != test",
+			want:     Selector{{Key: "env", Operator: SelectorNotEquals, Values: []string{"test"}}},
+		},
+		{
+			selector: "tier in (frontend, cache)",
+			want:     Selector{{Key: "tier", Operator: SelectorIn, Values: []string{"frontend", "cache"}}},
+		},
+		{
+			selector: "tier notin (db)",
+			want:     Selector{{Key: "tier", Operator: SelectorNotIn, Values: []string{"db"}}},
+		},
+		{
+			selector: "gpu",
+			want:     Selector{{Key: "gpu", Operator: SelectorExists}},
+		},
+		{
+			selector: "!deprecated",
+			want:     Selector{{Key: "deprecated", Operator: SelectorDoesNotExist}},
+		},
+		{
+			selector: "app=web,tier in (frontend,cache),env!=test,!deprecated",
+			want: Selector{
+				{Key: "app", Operator: SelectorEquals, Values: []string{"web"}},
+				{Key: "tier", Operator: SelectorIn, Values: []string{"frontend", "cache"}},
+				{Key: "env", Operator: SelectorNotEquals, Values: []string{"test"}},
+				{Key: "deprecated", Operator: SelectorDoesNotExist},
+			},
+		},
+		{
+			selector: "hypervisor.io/instance-group=web",
+			want:     Selector{{Key: "hypervisor.io/instance-group", Operator: SelectorEquals, Values: []string{"web"}}},
+		},
+		{selector: "tier in (a,(b))", wantErr: true},
+		{selector: "tier in (a", wantErr: true},
+		{selector: "tier in a)", wantErr: true},
+		{selector: "tier in ()", wantErr: true},
+		{selector: "tier within (a)", wantErr: true},
+		{selector: "in (a)", wantErr: true},
+		{selector: "=web", wantErr: true},
+		{selector: "!", wantErr: true},
+		{selector: "my app=web", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			got, err := ParseSelector(tt.selector)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseSelector(%q) = %v, want an error", tt.selector, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSelector(%q): %v", tt.selector, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSelector(%q) = %#v, want %#v", tt.selector, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "frontend"}
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{selector: "", want: true},
+		{selector: "app=web", want: true},
+		{selector: "app=db", want: false},
+		{selector: "app!=db", want: true},
+		{selector: "env!=test", want: true}, // A missing label is not equal
+		{selector: "tier in (frontend,cache)", want: true},
+		{selector: "tier notin (frontend)", want: false},
+		{selector: "env notin (test)", want: true},
+		{selector: "env in (test)", want: false},
+		{selector: "app", want: true},
+		{selector: "env", want: false},
+		{selector: "!env", want: true},
+		{selector: "!app", want: false},
+		{selector: "app=web,tier=backend", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			selector, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := selector.Matches(labels); got != tt.want {
+				t.Errorf("%q matches %v = %v, want %v", tt.selector, labels, got, tt.want)
+			}
+		})
+	}
+}
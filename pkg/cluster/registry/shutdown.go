@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+)
+
+// ShutdownPrefix is the etcd key prefix for planned agent shutdowns. The
+// keys outlive the node's lease so the server can tell a planned shutdown
+// from a failure after the node key is gone.
+const ShutdownPrefix = "/hypervisor/node-shutdowns/"
+
+// Shutdown policies an agent applies to its instances when it stops.
+const (
+	ShutdownLeaveRunning = "leave-running" // Instances keep running unmanaged until the agent returns
+	ShutdownStopAll      = "stop-all"      // Instances are stopped
+	ShutdownMigrate      = "migrate"       // Instances are moved off the node first
+)
+
+// Shutdown records that a node's agent was stopped on purpose.
+type Shutdown struct {
+	NodeID string    `json:"node_id"`
+	Policy string    `json:"policy"`
+	Time   time.Time `json:"time"`
+	Until  time.Time `json:"until"` // The server treats the node as failed after this
+
+	// Instances still running on the node when the agent stopped
+	RunningInstances []string `json:"running_instances,omitempty"`
+}
+
+// MarkShutdown records a planned shutdown of a node's agent. The record
+// expires at shutdown.Until.
+func (r *EtcdRegistry) MarkShutdown(ctx context.Context, shutdown *Shutdown) error {
+	ttl := int64(time.Until(shutdown.Until).Seconds())
+	if ttl <= 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(shutdown)
+	if err != nil {
+		return fmt.Errorf("failed to marshal shutdown: %w", err)
+	}
+	if err := r.client.PutWithTTL(ctx, ShutdownPrefix+shutdown.NodeID, string(data), ttl); err != nil {
+		return fmt.Errorf("failed to record shutdown: %w", err)
+	}
+	return nil
+}
+
+// GetShutdown returns the planned shutdown of a node, or nil if its agent
+// did not announce one or the node has been down for longer than planned.
+func (r *EtcdRegistry) GetShutdown(ctx context.Context, nodeID string) (*Shutdown, error) {
+	data, err := r.client.Get(ctx, ShutdownPrefix+nodeID)
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get shutdown: %w", err)
+	}
+
+	var shutdown Shutdown
+	if err := json.Unmarshal([]byte(data), &shutdown); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal shutdown: %w", err)
+	}
+	return &shutdown, nil
+}
+
+// ClearShutdown removes the planned shutdown of a node once its agent is
+// back.
+func (r *EtcdRegistry) ClearShutdown(ctx context.Context, nodeID string) error {
+	if err := r.client.Delete(ctx, ShutdownPrefix+nodeID); err != nil {
+		return fmt.Errorf("failed to clear shutdown: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// Package registryauth stores the credentials agents pull private container
+// images with, one per OCI registry, in etcd, with the secrets sealed by the
+// etcd client's secret key. Agents watch them into a local cache; the API
+// never returns the secrets once stored.
+package registryauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// credentialPrefix is the etcd key prefix for registry credentials,
+// followed by the registry host.
+const credentialPrefix = "/hypervisor/registry-credentials/"
+
+// DockerHub is the registry images without a registry host are pulled
+// from, and the host its credentials are stored under.
+const DockerHub = "docker.io"
+
+// ErrCredentialNotFound is returned when a registry has no credential.
+var ErrCredentialNotFound = errors.New("registry credential not found")
+
+var hostRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+// Credential authenticates image pulls from one registry, with a username
+// and password (or access token) or with an identity token.
+type Credential struct {
+	// Registry is the registry host, with a port if not the default, e.g.
+	// "docker.io", "ghcr.io" or "registry.example.com:5000"
+	Registry string `json:"registry"`
+
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identity_token,omitempty"` // OAuth2 refresh token
+
+	// HasPassword and HasIdentityToken tell which secrets a redacted
+	// credential had; they are not stored.
+	HasPassword      bool `json:"-"`
+	HasIdentityToken bool `json:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate checks the credential.
+func (c *Credential) Validate() error {
+	if _, err := NormalizeHost(c.Registry); err != nil {
+		return err
+	}
+	switch {
+	case c.IdentityToken != "" && c.Password != "":
+		return fmt.Errorf("password and identity token are mutually exclusive")
+	case c.IdentityToken == "" && (c.Username == "" || c.Password == ""):
+		return fmt.Errorf("username and password, or an identity token, are required")
+	}
+	return nil
+}
+
+// Redacted returns a copy of the credential without its secrets.
+func (c *Credential) Redacted() *Credential {
+	redacted := *c
+	redacted.HasPassword = c.Password != ""
+	redacted.HasIdentityToken = c.IdentityToken != ""
+	redacted.Password = ""
+	redacted.IdentityToken = ""
+	return &redacted
+}
+
+// Secret returns the username and secret to authenticate with. An identity
+// token is returned with an empty username, which registries' token
+// services take as a refresh token.
+func (c *Credential) Secret() (username, secret string) {
+	if c.IdentityToken != "" {
+		return "", c.IdentityToken
+	}
+	return c.Username, c.Password
+}
+
+// NormalizeHost returns the registry host credentials are stored under:
+// lowercased, without a scheme or path, with Docker Hub's aliases mapped
+// to docker.io.
+func NormalizeHost(registry string) (string, error) {
+	host := strings.ToLower(strings.TrimSpace(registry))
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host = strings.TrimSuffix(host, "/")
+	if strings.Contains(host, "/") {
+		return "", fmt.Errorf("invalid registry %q: expected a host, e.g. ghcr.io", registry)
+	}
+
+	name := host
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if port == "" {
+			return "", fmt.Errorf("invalid registry %q: empty port", registry)
+		}
+		name = h
+	}
+	if !hostRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid registry %q: expected a host, e.g. ghcr.io", registry)
+	}
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		host = DockerHub
+	}
+	return host, nil
+}
+
+// Store keeps registry credentials in etcd.
+type Store struct {
+	client *etcd.Client
+}
+
+// NewStore creates a registry credential store.
+func NewStore(client *etcd.Client) *Store {
+	return &Store{client: client}
+}
+
+// Put stores a credential, replacing any for the same registry. The
+// registry must be normalized.
+func (s *Store) Put(ctx context.Context, credential *Credential) error {
+	sealed := *credential
+	var err error
+	if sealed.Password, err = s.client.SealSecret(credential.Password); err != nil {
+		return err
+	}
+	if sealed.IdentityToken, err = s.client.SealSecret(credential.IdentityToken); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&sealed)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registry credential: %w", err)
+	}
+	if err := s.client.Put(ctx, credentialPrefix+credential.Registry, string(data)); err != nil {
+		return fmt.Errorf("failed to store registry credential: %w", err)
+	}
+	return nil
+}
+
+// Get returns the credential of a registry.
+func (s *Store) Get(ctx context.Context, registry string) (*Credential, error) {
+	data, err := s.client.Get(ctx, credentialPrefix+registry)
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, ErrCredentialNotFound
+		}
+		return nil, fmt.Errorf("failed to get registry credential: %w", err)
+	}
+	return s.decode(data)
+}
+
+// List returns all credentials sorted by registry.
+func (s *Store) List(ctx context.Context) ([]*Credential, error) {
+	credentials, _, err := s.ListRevision(ctx)
+	return credentials, err
+}
+
+// ListRevision returns all credentials sorted by registry and the etcd
+// revision they were read at, to Watch the changes made after them.
+func (s *Store) ListRevision(ctx context.Context) ([]*Credential, int64, error) {
+	kvs, rev, err := s.client.GetWithPrefixRevision(ctx, credentialPrefix)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list registry credentials: %w", err)
+	}
+
+	credentials := make([]*Credential, 0, len(kvs))
+	for _, kv := range kvs {
+		credential, err := s.decode(kv.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		credentials = append(credentials, credential)
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].Registry < credentials[j].Registry })
+	return credentials, rev, nil
+}
+
+// Delete removes the credential of a registry.
+func (s *Store) Delete(ctx context.Context, registry string) error {
+	if err := s.client.Delete(ctx, credentialPrefix+registry); err != nil {
+		return fmt.Errorf("failed to delete registry credential: %w", err)
+	}
+	return nil
+}
+
+// Event is a change to a stored credential. Credential is nil when the
+// registry's credential was deleted.
+type Event struct {
+	Registry   string
+	Credential *Credential
+}
+
+// Watch returns the changes to stored credentials made after revision rev
+// until ctx is done. Values that cannot be decoded are skipped.
+func (s *Store) Watch(ctx context.Context, rev int64) <-chan Event {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for ev := range s.client.WatchPrefixEvents(ctx, credentialPrefix, clientv3.WithRev(rev+1)) {
+			event := Event{Registry: strings.TrimPrefix(ev.Key, credentialPrefix)}
+			if ev.Type == etcd.EventTypePut {
+				credential, err := s.decode(ev.Value)
+				if err != nil {
+					continue
+				}
+				event.Credential = credential
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// decode unmarshals a stored credential and opens its secrets.
+func (s *Store) decode(data string) (*Credential, error) {
+	var credential Credential
+	if err := json.Unmarshal([]byte(data), &credential); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal registry credential: %w", err)
+	}
+
+	var err error
+	if credential.Password, err = s.client.OpenSecret(credential.Password); err != nil {
+		return nil, fmt.Errorf("failed to open registry credential of %s: %w", credential.Registry, err)
+	}
+	if credential.IdentityToken, err = s.client.OpenSecret(credential.IdentityToken); err != nil {
+		return nil, fmt.Errorf("failed to open registry credential of %s: %w", credential.Registry, err)
+	}
+	return &credential, nil
+}
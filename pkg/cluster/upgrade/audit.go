@@ -0,0 +1,217 @@
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// auditKeyPrefix is the etcd key prefix of each server's deprecated call log.
+const auditKeyPrefix = "/hypervisor/audit/deprecated-calls/"
+
+// auditFlushInterval is how often recorded calls are written to etcd.
+const auditFlushInterval = 30 * time.Second
+
+// DeprecatedCall summarizes the calls made to a deprecated method.
+type DeprecatedCall struct {
+	Method     string    `json:"method"`
+	Count      int64     `json:"count"`
+	LastCaller string    `json:"last_caller"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// deprecated caches whether methods are marked deprecated in their proto
+// definition.
+var deprecated sync.Map // full method -> bool
+
+// IsDeprecated reports whether a gRPC method (/package.Service/Method) is
+// marked with `option deprecated = true` in its proto definition.
+func IsDeprecated(fullMethod string) bool {
+	if v, ok := deprecated.Load(fullMethod); ok {
+		return v.(bool)
+	}
+
+	name := strings.ReplaceAll(strings.TrimPrefix(fullMethod, "/"), "/", ".")
+	result := false
+	if desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name)); err == nil {
+		if method, ok := desc.(protoreflect.MethodDescriptor); ok {
+			if opts, ok := method.Options().(*descriptorpb.MethodOptions); ok {
+				result = opts.GetDeprecated()
+			}
+		}
+	}
+	deprecated.Store(fullMethod, result)
+	return result
+}
+
+// Auditor records the calls this server serves to deprecated methods, so an
+// upgrade plan can report the clients that still use them.
+type Auditor struct {
+	client   *etcd.Client
+	serverID string
+	logger   *zap.Logger
+
+	mu    sync.Mutex
+	calls map[string]*DeprecatedCall
+	dirty bool
+}
+
+// NewAuditor creates the deprecated call auditor of a server.
+func NewAuditor(client *etcd.Client, serverID string, logger *zap.Logger) *Auditor {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Auditor{
+		client:   client,
+		serverID: serverID,
+		logger:   logger,
+		calls:    make(map[string]*DeprecatedCall),
+	}
+}
+
+// Record notes a call to a method if it is deprecated.
+func (a *Auditor) Record(fullMethod, caller string) {
+	if !IsDeprecated(fullMethod) {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	call, ok := a.calls[fullMethod]
+	if !ok {
+		call = &DeprecatedCall{Method: fullMethod}
+		a.calls[fullMethod] = call
+	}
+	call.Count++
+	call.LastCaller = caller
+	call.LastSeen = time.Now()
+	a.dirty = true
+}
+
+// Run continues the log this server kept before a restart and writes new
+// calls to etcd until ctx is cancelled.
+func (a *Auditor) Run(ctx context.Context) {
+	if err := a.load(ctx); err != nil {
+		a.logger.Warn("failed to load deprecated call log", zap.Error(err))
+	}
+
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Keep the calls of the last interval
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			a.flush(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			a.flush(ctx)
+		}
+	}
+}
+
+func (a *Auditor) load(ctx context.Context) error {
+	value, err := a.client.Get(ctx, auditKeyPrefix+a.serverID)
+	if errors.Is(err, etcd.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var calls []DeprecatedCall
+	if err := json.Unmarshal([]byte(value), &calls); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, loaded := range calls {
+		call, ok := a.calls[loaded.Method]
+		if !ok {
+			copied := loaded
+			a.calls[loaded.Method] = &copied
+			continue
+		}
+		// Calls recorded since startup are newer
+		call.Count += loaded.Count
+	}
+	return nil
+}
+
+func (a *Auditor) flush(ctx context.Context) {
+	a.mu.Lock()
+	if !a.dirty {
+		a.mu.Unlock()
+		return
+	}
+	calls := make([]DeprecatedCall, 0, len(a.calls))
+	for _, call := range a.calls {
+		calls = append(calls, *call)
+	}
+	a.dirty = false
+	a.mu.Unlock()
+
+	data, err := json.Marshal(calls)
+	if err == nil {
+		err = a.client.Put(ctx, auditKeyPrefix+a.serverID, string(data))
+	}
+	if err != nil {
+		a.logger.Warn("failed to write deprecated call log", zap.Error(err))
+		a.mu.Lock()
+		a.dirty = true
+		a.mu.Unlock()
+	}
+}
+
+// ListDeprecatedCalls merges the deprecated call logs of every server.
+func ListDeprecatedCalls(ctx context.Context, client *etcd.Client) ([]DeprecatedCall, error) {
+	kvs, err := client.GetWithPrefixKV(ctx, auditKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deprecated calls: %w", err)
+	}
+
+	merged := make(map[string]*DeprecatedCall)
+	for _, kv := range kvs {
+		var calls []DeprecatedCall
+		if err := json.Unmarshal([]byte(kv.Value), &calls); err != nil {
+			continue
+		}
+		for _, call := range calls {
+			m, ok := merged[call.Method]
+			if !ok {
+				copied := call
+				merged[call.Method] = &copied
+				continue
+			}
+			m.Count += call.Count
+			if call.LastSeen.After(m.LastSeen) {
+				m.LastSeen = call.LastSeen
+				m.LastCaller = call.LastCaller
+			}
+		}
+	}
+
+	calls := make([]DeprecatedCall, 0, len(merged))
+	for _, call := range merged {
+		calls = append(calls, *call)
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Method < calls[j].Method })
+	return calls, nil
+}
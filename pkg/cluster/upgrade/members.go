@@ -0,0 +1,154 @@
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// serverKeyPrefix is the etcd key prefix of the running servers' records.
+const serverKeyPrefix = "/hypervisor/servers/"
+
+// memberTTL is how long the record of a crashed server outlives it.
+const memberTTL = 30 * time.Second
+
+// ServerRecord describes a running server.
+type ServerRecord struct {
+	ID            string    `json:"id"`
+	Version       string    `json:"version"`
+	SchemaVersion int       `json:"schema_version"`
+	StartedAt     time.Time `json:"started_at"`
+}
+
+// Member keeps this server's record in etcd while it runs. The record is
+// attached to a lease, so it disappears when the server stops or crashes.
+type Member struct {
+	client *etcd.Client
+	record ServerRecord
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	leaseID clientv3.LeaseID
+	cancel  context.CancelFunc
+}
+
+// NewMember creates the membership of the server with the given ID.
+func NewMember(client *etcd.Client, id, version string, logger *zap.Logger) *Member {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	return &Member{
+		client: client,
+		record: ServerRecord{
+			ID:            id,
+			Version:       version,
+			SchemaVersion: SchemaVersion,
+			StartedAt:     time.Now(),
+		},
+		logger: logger,
+	}
+}
+
+// Start publishes the record and keeps it alive until Stop.
+func (m *Member) Start(ctx context.Context) error {
+	if err := m.publish(ctx); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	m.cancel = cancel
+	m.mu.Unlock()
+
+	go m.keepAlive(ctx)
+	return nil
+}
+
+func (m *Member) publish(ctx context.Context) error {
+	data, err := json.Marshal(m.record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal server record: %w", err)
+	}
+
+	lease, err := m.client.Grant(ctx, int64(memberTTL.Seconds()))
+	if err != nil {
+		return fmt.Errorf("failed to grant server record lease: %w", err)
+	}
+	if err := m.client.PutWithLease(ctx, serverKeyPrefix+m.record.ID, string(data), lease.ID); err != nil {
+		return fmt.Errorf("failed to publish server record: %w", err)
+	}
+
+	m.mu.Lock()
+	m.leaseID = lease.ID
+	m.mu.Unlock()
+	return nil
+}
+
+// keepAlive refreshes the lease, publishing the record again if it is lost.
+func (m *Member) keepAlive(ctx context.Context) {
+	for ctx.Err() == nil {
+		m.mu.Lock()
+		leaseID := m.leaseID
+		m.mu.Unlock()
+
+		ch, err := m.client.KeepAlive(ctx, leaseID)
+		if err == nil {
+			for range ch {
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		m.logger.Warn("server record lease lost, publishing again")
+		time.Sleep(time.Second)
+		if err := m.publish(ctx); err != nil {
+			m.logger.Warn("failed to publish server record", zap.Error(err))
+		}
+	}
+}
+
+// Stop removes the record.
+func (m *Member) Stop(ctx context.Context) {
+	m.mu.Lock()
+	cancel, leaseID := m.cancel, m.leaseID
+	m.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	if leaseID == 0 {
+		return
+	}
+	if err := m.client.Revoke(ctx, leaseID); err != nil {
+		m.logger.Warn("failed to revoke server record lease", zap.Error(err))
+	}
+}
+
+// ListServers returns the records of the running servers, ordered by ID.
+func ListServers(ctx context.Context, client *etcd.Client) ([]ServerRecord, error) {
+	kvs, err := client.GetWithPrefixKV(ctx, serverKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %w", err)
+	}
+
+	servers := make([]ServerRecord, 0, len(kvs))
+	for _, kv := range kvs {
+		var record ServerRecord
+		if err := json.Unmarshal([]byte(kv.Value), &record); err != nil {
+			continue
+		}
+		servers = append(servers, record)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	return servers, nil
+}
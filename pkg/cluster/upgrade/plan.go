@@ -0,0 +1,233 @@
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/registry"
+)
+
+// ComponentKind is the kind of a cluster component.
+type ComponentKind string
+
+const (
+	ComponentServer ComponentKind = "server"
+	ComponentAgent  ComponentKind = "agent"
+	ComponentDriver ComponentKind = "driver"
+	ComponentSchema ComponentKind = "etcd-schema"
+)
+
+// Action is what an upgrade does to a component.
+type Action string
+
+const (
+	ActionNone    Action = "none"    // Already at the target
+	ActionUpgrade Action = "upgrade" // Upgraded by the plan's steps
+	ActionBlocked Action = "blocked" // Cannot be upgraded to the target
+	ActionUnknown Action = "unknown" // Version unknown or not comparable
+)
+
+// Component is a cluster component and what the upgrade does to it.
+type Component struct {
+	Kind    ComponentKind `json:"kind"`
+	Name    string        `json:"name"`
+	NodeID  string        `json:"node_id,omitempty"`
+	Version string        `json:"version"`
+	Action  Action        `json:"action"`
+	Note    string        `json:"note,omitempty"`
+}
+
+// Plan is the outcome of an upgrade dry run.
+type Plan struct {
+	Target     string           `json:"target"`
+	Components []Component      `json:"components"`
+	Steps      []string         `json:"steps"`
+	Deprecated []DeprecatedCall `json:"deprecated"`
+	Blockers   []string         `json:"blockers"`
+	Warnings   []string         `json:"warnings"`
+}
+
+// Ready reports whether nothing blocks the upgrade.
+func (p *Plan) Ready() bool {
+	return len(p.Blockers) == 0
+}
+
+// State is the inspected state of the cluster an upgrade is planned for.
+type State struct {
+	Servers       []ServerRecord
+	Nodes         []*registry.Node
+	SchemaVersion int // 0 if none is recorded
+	Deprecated    []DeprecatedCall
+}
+
+// Inspect reads the versions of the servers, the etcd schema and the
+// deprecated calls from etcd. Nodes come from the node registry.
+func Inspect(ctx context.Context, client *etcd.Client, nodes []*registry.Node) (*State, error) {
+	servers, err := ListServers(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ReadSchema(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	calls, err := ListDeprecatedCalls(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := slices.Clone(nodes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Hostname < sorted[j].Hostname })
+
+	return &State{
+		Servers:       servers,
+		Nodes:         sorted,
+		SchemaVersion: schema,
+		Deprecated:    calls,
+	}, nil
+}
+
+// BuildPlan works out the steps upgrading the cluster to target takes and
+// what blocks it. Nothing is changed.
+func BuildPlan(state *State, target Version) *Plan {
+	p := &Plan{
+		Target:     target.String(),
+		Deprecated: state.Deprecated,
+	}
+
+	release, known := lookupRelease(target)
+	if !known {
+		release = Release{SchemaVersion: SchemaVersion}
+		p.Warnings = append(p.Warnings, fmt.Sprintf(
+			"no compatibility information for %s; assuming etcd schema version %d and no removed APIs",
+			target.MinorString(), SchemaVersion))
+	}
+
+	// Servers first, one at a time, so agents never run ahead of them
+	var serverSteps []string
+	serverVersions := make(map[string]bool)
+	if len(state.Servers) == 0 {
+		p.Warnings = append(p.Warnings, "no running servers found; their versions cannot be checked")
+	}
+	for _, server := range state.Servers {
+		serverVersions[server.Version] = true
+		c := p.check(ComponentServer, server.ID, "", server.Version, target)
+		if c.Action == ActionUpgrade {
+			serverSteps = append(serverSteps, fmt.Sprintf("Upgrade server %s from %s to %s", server.ID, server.Version, target))
+		}
+	}
+	if len(serverVersions) > 1 {
+		p.Warnings = append(p.Warnings, "servers run different versions; a previous upgrade may be unfinished")
+	}
+
+	// The schema is migrated once every server runs the target release
+	var schemaSteps []string
+	schema := Component{
+		Kind:    ComponentSchema,
+		Name:    "etcd",
+		Version: fmt.Sprint(state.SchemaVersion),
+		Action:  ActionNone,
+	}
+	switch {
+	case state.SchemaVersion == 0:
+		schema.Action = ActionUnknown
+		schema.Note = "no schema version recorded; servers record it when they start"
+	case state.SchemaVersion > release.SchemaVersion:
+		schema.Action = ActionBlocked
+		p.Blockers = append(p.Blockers, fmt.Sprintf(
+			"etcd schema version %d is newer than the version %d used by %s",
+			state.SchemaVersion, release.SchemaVersion, target.MinorString()))
+	case state.SchemaVersion < release.SchemaVersion:
+		schema.Action = ActionUpgrade
+		schemaSteps = append(schemaSteps, fmt.Sprintf(
+			"Migrate the etcd schema from version %d to %d", state.SchemaVersion, release.SchemaVersion))
+	}
+	p.Components = append(p.Components, schema)
+
+	// Then the agents, node by node
+	var agentSteps []string
+	for _, node := range state.Nodes {
+		c := p.check(ComponentAgent, node.Hostname, node.ID, node.AgentVersion, target)
+		if c.Action == ActionUpgrade {
+			agentSteps = append(agentSteps, fmt.Sprintf(
+				"Cordon and drain node %s, upgrade its agent from %s to %s, then uncordon it",
+				node.Hostname, node.AgentVersion, target))
+			if !node.IsReady() {
+				p.Warnings = append(p.Warnings, fmt.Sprintf(
+					"node %s is %s; it cannot be drained until it is ready", node.Hostname, node.Status))
+			}
+		}
+
+		drivers := make([]string, 0, len(node.DriverVersions))
+		for name := range node.DriverVersions {
+			drivers = append(drivers, name)
+		}
+		sort.Strings(drivers)
+		for _, name := range drivers {
+			p.Components = append(p.Components, Component{
+				Kind:    ComponentDriver,
+				Name:    name,
+				NodeID:  node.ID,
+				Version: node.DriverVersions[name],
+				Action:  ActionNone,
+				Note:    "upgraded with the host packages",
+			})
+		}
+	}
+
+	// Deprecated APIs still in use break their clients once removed
+	for _, call := range state.Deprecated {
+		usage := fmt.Sprintf("%s was called %d times, last by %s at %s",
+			call.Method, call.Count, call.LastCaller, call.LastSeen.UTC().Format(time.RFC3339))
+		if slices.Contains(release.Removed, call.Method) {
+			p.Blockers = append(p.Blockers, fmt.Sprintf("%s is removed in %s: %s", call.Method, target.MinorString(), usage))
+		} else {
+			p.Warnings = append(p.Warnings, "deprecated API in use: "+usage)
+		}
+	}
+
+	if len(serverSteps)+len(schemaSteps)+len(agentSteps) > 0 {
+		p.Steps = append(p.Steps, "Back up etcd (etcdctl snapshot save)")
+		p.Steps = append(p.Steps, serverSteps...)
+		p.Steps = append(p.Steps, schemaSteps...)
+		p.Steps = append(p.Steps, agentSteps...)
+	}
+	return p
+}
+
+// check adds a server or agent to the plan, recording anything that blocks
+// upgrading it to target.
+func (p *Plan) check(kind ComponentKind, name, nodeID, version string, target Version) Component {
+	c := Component{Kind: kind, Name: name, NodeID: nodeID, Version: version}
+
+	current, err := ParseVersion(version)
+	switch {
+	case err != nil:
+		c.Action = ActionUnknown
+		c.Note = "version cannot be compared"
+		p.Warnings = append(p.Warnings, fmt.Sprintf("%s %s reports version %q, which cannot be checked", kind, name, version))
+	case current.Compare(target) == 0:
+		c.Action = ActionNone
+	case current.Compare(target) > 0:
+		c.Action = ActionBlocked
+		c.Note = "downgrades are not supported"
+	case current.Major != target.Major:
+		c.Action = ActionBlocked
+		c.Note = "major version upgrades are not supported"
+	case target.Minor > current.Minor+1:
+		c.Action = ActionBlocked
+		c.Note = fmt.Sprintf("skips minor releases; upgrade to v%d.%d first", current.Major, current.Minor+1)
+	default:
+		c.Action = ActionUpgrade
+	}
+
+	if c.Action == ActionBlocked {
+		p.Blockers = append(p.Blockers, fmt.Sprintf("%s %s at %s: %s", kind, name, version, c.Note))
+	}
+	p.Components = append(p.Components, c)
+	return c
+}
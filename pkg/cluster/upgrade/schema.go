@@ -0,0 +1,75 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"hypervisor/pkg/cluster/etcd"
+)
+
+// SchemaVersion is the version of the etcd data layout this build reads and
+// writes. It is bumped whenever a release changes stored objects in a way
+// older servers cannot read.
+const SchemaVersion = 1
+
+// schemaKey holds the cluster's schema version.
+const schemaKey = "/hypervisor/schema/version"
+
+// Release describes what a release requires of the cluster.
+type Release struct {
+	// SchemaVersion is the etcd schema version the release uses. Moving to a
+	// higher schema version is a migration step of the upgrade.
+	SchemaVersion int
+
+	// Removed lists the gRPC methods (/package.Service/Method) the release
+	// no longer serves.
+	Removed []string
+}
+
+// releases is the compatibility information of each minor release.
+var releases = map[string]Release{
+	"v0.1": {SchemaVersion: 1},
+}
+
+// lookupRelease returns the compatibility information of a target version.
+func lookupRelease(v Version) (Release, bool) {
+	r, ok := releases[v.MinorString()]
+	return r, ok
+}
+
+// EnsureSchema records this build's schema version if the cluster has none
+// and returns the cluster's schema version. A cluster written by a newer
+// release cannot be served by this one.
+func EnsureSchema(ctx context.Context, client *etcd.Client) (int, error) {
+	if _, err := client.CreateIfNotExists(ctx, schemaKey, strconv.Itoa(SchemaVersion)); err != nil {
+		return 0, fmt.Errorf("failed to record schema version: %w", err)
+	}
+
+	stored, err := ReadSchema(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+	if stored > SchemaVersion {
+		return stored, fmt.Errorf("cluster schema version %d is newer than the supported version %d", stored, SchemaVersion)
+	}
+	return stored, nil
+}
+
+// ReadSchema returns the cluster's schema version, or 0 if none is recorded.
+func ReadSchema(ctx context.Context, client *etcd.Client) (int, error) {
+	value, err := client.Get(ctx, schemaKey)
+	if errors.Is(err, etcd.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %w", value, err)
+	}
+	return version, nil
+}
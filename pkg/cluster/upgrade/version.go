@@ -0,0 +1,62 @@
+// Package upgrade tracks the versions of the cluster components and plans
+// upgrades between releases without changing anything.
+package upgrade
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a release version. Pre-release and build suffixes are ignored.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseVersion parses versions such as "v1.2", "1.2.3" or "v1.2.3-rc.1".
+func ParseVersion(s string) (Version, error) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if idx := strings.IndexAny(trimmed, "-+"); idx >= 0 {
+		trimmed = trimmed[:idx]
+	}
+
+	parts := strings.Split(trimmed, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+
+	nums := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q", s)
+		}
+		nums[i] = n
+	}
+	return Version{Major: nums[0], Minor: nums[1], Patch: nums[2]}, nil
+}
+
+// String returns the version as vMAJOR.MINOR.PATCH.
+func (v Version) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// MinorString returns the version as vMAJOR.MINOR.
+func (v Version) MinorString() string {
+	return fmt.Sprintf("v%d.%d", v.Major, v.Minor)
+}
+
+// Compare returns -1, 0 or 1 if v is older than, equal to or newer than o.
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
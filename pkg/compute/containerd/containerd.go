@@ -5,6 +5,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -34,6 +37,28 @@ type Config struct {
 
 	// DefaultRuntime is the default runtime to use.
 	DefaultRuntime string `mapstructure:"default_runtime"`
+
+	// Runtimes are the runtimes instances may ask for, e.g. Kata or gVisor
+	// for stronger isolation. Each is offered only if its shim is
+	// installed on the node.
+	Runtimes []string `mapstructure:"runtimes"`
+
+	// Registries configure pulls per registry host: mirrors, plain HTTP,
+	// TLS trust and static credentials. A list rather than a map keyed by
+	// host, as hosts contain dots.
+	Registries []RegistryConfig `mapstructure:"registries"`
+
+	// LogPath is the directory the stdout and stderr of containers are
+	// logged to, one file per container.
+	LogPath string `mapstructure:"log_path"`
+
+	// LogMaxSizeMB is the size a container's log is rotated at. One
+	// previous generation is kept, so a container's logs take up to twice
+	// this. Zero lets logs grow without limit.
+	LogMaxSizeMB int64 `mapstructure:"log_max_size_mb"`
+
+	// Network configures how containers are attached to the network.
+	Network NetworkConfig `mapstructure:"network"`
 }
 
 // DefaultConfig returns the default containerd configuration.
@@ -42,7 +67,11 @@ func DefaultConfig() Config {
 		Address:        "/run/containerd/containerd.sock",
 		Namespace:      "hypervisor",
 		Snapshotter:    "overlayfs",
-		DefaultRuntime: "io.containerd.runc.v2",
+		DefaultRuntime: driver.RuntimeRunc,
+		Runtimes:       []string{driver.RuntimeRunc, driver.RuntimeKata, driver.RuntimeRunsc},
+		LogPath:        "/var/log/hypervisor/containers",
+		LogMaxSizeMB:   50,
+		Network:        DefaultNetworkConfig(),
 	}
 }
 
@@ -52,8 +81,17 @@ type Driver struct {
 	logger *zap.Logger
 	client *containerd.Client
 
+	// runtimes are the configured runtimes whose shims are installed
+	runtimes []string
+
+	// credentials looks up cluster-managed registry credentials
+	credentials CredentialsFunc
+
 	mu        sync.RWMutex
 	connected bool
+
+	cancel context.CancelFunc // Stops the log rotation
+	wg     sync.WaitGroup
 }
 
 // New creates a new containerd driver.
@@ -62,6 +100,10 @@ func New(config Config, logger *zap.Logger) (*Driver, error) {
 		logger = zap.NewNop()
 	}
 
+	if err := os.MkdirAll(config.LogPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", config.LogPath, err)
+	}
+
 	client, err := containerd.New(config.Address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to containerd: %w", err)
@@ -71,13 +113,79 @@ func New(config Config, logger *zap.Logger) (*Driver, error) {
 		config:    config,
 		logger:    logger,
 		client:    client,
+		runtimes:  detectRuntimes(config, logger),
 		connected: true,
 	}
 
-	logger.Info("connected to containerd", zap.String("address", config.Address))
+	if config.LogMaxSizeMB > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		d.cancel = cancel
+		d.wg.Add(1)
+		go d.rotateLogs(ctx)
+	}
+
+	logger.Info("connected to containerd",
+		zap.String("address", config.Address),
+		zap.Strings("runtimes", d.runtimes),
+	)
 	return d, nil
 }
 
+// runtimeBinaries are the binaries a runtime needs besides its shim.
+var runtimeBinaries = map[string][]string{
+	driver.RuntimeRunsc: {"runsc"},
+}
+
+// detectRuntimes returns the default and configured runtimes whose shim,
+// and any other binary they need, is installed.
+func detectRuntimes(config Config, logger *zap.Logger) []string {
+	var runtimes []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{config.DefaultRuntime}, config.Runtimes...) {
+		runtime, err := driver.ParseRuntime(name)
+		if err != nil {
+			logger.Warn("ignoring runtime", zap.String("runtime", name), zap.Error(err))
+			continue
+		}
+		if seen[runtime] {
+			continue
+		}
+		seen[runtime] = true
+
+		missing := ""
+		for _, binary := range append([]string{driver.RuntimeShim(runtime)}, runtimeBinaries[runtime]...) {
+			if _, err := exec.LookPath(binary); err != nil {
+				missing = binary
+				break
+			}
+		}
+		if missing != "" {
+			logger.Debug("runtime not installed", zap.String("runtime", runtime), zap.String("missing", missing))
+			continue
+		}
+		runtimes = append(runtimes, runtime)
+	}
+	return runtimes
+}
+
+// runtimeFor returns the runtime a container is created with: the one the
+// spec asks for, which must be installed, or the default.
+func (d *Driver) runtimeFor(spec *driver.InstanceSpec) (string, error) {
+	if spec.Runtime == "" {
+		return d.config.DefaultRuntime, nil
+	}
+	runtime, err := driver.ParseRuntime(spec.Runtime)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", driver.ErrInvalidSpec, err)
+	}
+	for _, r := range d.runtimes {
+		if r == runtime {
+			return runtime, nil
+		}
+	}
+	return "", fmt.Errorf("%w: runtime %s is not installed on this node", driver.ErrInvalidSpec, runtime)
+}
+
 // getContext returns a context with the containerd namespace.
 func (d *Driver) getContext(ctx context.Context) context.Context {
 	return namespaces.WithNamespace(ctx, d.config.Namespace)
@@ -101,6 +209,14 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 	if !d.connected {
 		return nil, driver.ErrNotConnected
 	}
+	if _, err := driver.GuestArchitecture(spec); err != nil {
+		return nil, err
+	}
+	runtime, err := d.runtimeFor(spec)
+	if err != nil {
+		return nil, err
+	}
+	spec.Runtime = runtime
 
 	ctx = d.getContext(ctx)
 
@@ -108,7 +224,7 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 	image, err := d.client.GetImage(ctx, spec.Image)
 	if err != nil {
 		d.logger.Info("pulling image", zap.String("image", spec.Image))
-		image, err = d.client.Pull(ctx, spec.Image, containerd.WithPullUnpack)
+		image, err = d.client.Pull(ctx, spec.Image, containerd.WithPullUnpack, containerd.WithResolver(d.resolver()))
 		if err != nil {
 			return nil, fmt.Errorf("failed to pull image: %w", err)
 		}
@@ -150,16 +266,35 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 		ociOpts = append(ociOpts, withCPULimit(spec.Limits.CPUQuota, spec.Limits.CPUPeriod))
 	}
 
-	// Create container
-	container, err := d.client.NewContainer(
-		ctx,
-		containerID,
+	// Attach the network; the container joins the prepared namespace
+	att, err := d.attachNetwork(ctx, containerID, &spec.Network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach network: %w", err)
+	}
+	containerOpts := []containerd.NewContainerOpts{
 		containerd.WithImage(image),
 		containerd.WithNewSnapshot(containerID+"-snapshot", image),
+	}
+	if att != nil {
+		ociOpts = append(ociOpts, oci.WithLinuxNamespace(specs.LinuxNamespace{
+			Type: specs.NetworkNamespace,
+			Path: att.netnsPath(),
+		}))
+		containerOpts = append(containerOpts, containerd.WithContainerLabels(att.labels()))
+	}
+	containerOpts = append(containerOpts,
 		containerd.WithNewSpec(ociOpts...),
-		containerd.WithRuntime(d.config.DefaultRuntime, nil),
+		containerd.WithRuntime(runtime, nil),
 	)
+
+	// Create container
+	container, err := d.client.NewContainer(ctx, containerID, containerOpts...)
 	if err != nil {
+		if att != nil {
+			if detachErr := d.detachNetwork(ctx, containerID, att); detachErr != nil {
+				d.logger.Warn("failed to detach network", zap.String("id", containerID), zap.Error(detachErr))
+			}
+		}
 		return nil, fmt.Errorf("failed to create container: %w", err)
 	}
 
@@ -176,6 +311,7 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 	d.logger.Info("container created",
 		zap.String("id", containerID),
 		zap.String("image", spec.Image),
+		zap.String("runtime", runtime),
 	)
 
 	// Clean up container reference (we'll look it up by ID later)
@@ -200,8 +336,8 @@ func (d *Driver) Start(ctx context.Context, id string) error {
 		return driver.ErrInstanceNotFound
 	}
 
-	// Create a new task
-	task, err := container.NewTask(ctx, cio.NewCreator(cio.WithStdio))
+	// Create a new task, appending its stdout and stderr to the log
+	task, err := container.NewTask(ctx, cio.LogFile(d.logPath(id)))
 	if err != nil {
 		return fmt.Errorf("failed to create task: %w", err)
 	}
@@ -288,6 +424,11 @@ func (d *Driver) Delete(ctx context.Context, id string) error {
 		return driver.ErrInstanceNotFound
 	}
 
+	labels, err := container.Labels(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get container labels: %w", err)
+	}
+
 	// Stop task if running
 	task, err := container.Task(ctx, nil)
 	if err == nil {
@@ -300,6 +441,19 @@ func (d *Driver) Delete(ctx context.Context, id string) error {
 		return fmt.Errorf("failed to delete container: %w", err)
 	}
 
+	// Tear down the network attachment
+	if att := attachmentFromLabels(labels); att != nil {
+		if err := d.detachNetwork(ctx, id, att); err != nil {
+			d.logger.Warn("failed to detach network", zap.String("id", id), zap.Error(err))
+		}
+	}
+
+	for _, path := range []string{d.logPath(id), rotatedLogPath(d.logPath(id))} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			d.logger.Warn("failed to remove container log", zap.String("id", id), zap.Error(err))
+		}
+	}
+
 	d.logger.Info("container deleted", zap.String("id", id))
 	return nil
 }
@@ -355,6 +509,10 @@ func (d *Driver) containerToInstance(ctx context.Context, container containerd.C
 		State:     state,
 		CreatedAt: info.CreatedAt,
 		StartedAt: startedAt,
+		Spec: driver.InstanceSpec{
+			Image:   info.Image,
+			Runtime: info.Runtime.Name,
+		},
 	}
 
 	return instance, nil
@@ -432,6 +590,37 @@ func (d *Driver) Attach(ctx context.Context, id string, opts driver.AttachOption
 	return nil, driver.ErrNotSupported
 }
 
+// LogPath returns the log file a container's stdout and stderr are written
+// to.
+func (d *Driver) LogPath(ctx context.Context, id string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if !d.connected {
+		return "", driver.ErrNotConnected
+	}
+	if _, err := d.client.LoadContainer(d.getContext(ctx), id); err != nil {
+		return "", driver.ErrInstanceNotFound
+	}
+	return d.logPath(id), nil
+}
+
+func (d *Driver) logPath(id string) string {
+	return filepath.Join(d.config.LogPath, id+".log")
+}
+
+// Capabilities returns the optional operations the driver supports. Stdio
+// attach and exec are not wired up yet, and containers cannot be suspended
+// to disk or migrated.
+func (d *Driver) Capabilities() driver.Capabilities {
+	return driver.Capabilities{
+		Logs:     true,
+		Pause:    true,
+		Resize:   true,
+		Runtimes: d.runtimes,
+	}
+}
+
 // Restart restarts a container.
 func (d *Driver) Restart(ctx context.Context, id string, force bool) error {
 	if err := d.Stop(ctx, id, force); err != nil {
@@ -440,8 +629,191 @@ func (d *Driver) Restart(ctx context.Context, id string, force bool) error {
 	return d.Start(ctx, id)
 }
 
+// cpuPeriod is the CFS period CPU cores are converted to a quota with.
+const cpuPeriod = 100000
+
+// Pause freezes a container's task.
+func (d *Driver) Pause(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.connected {
+		return driver.ErrNotConnected
+	}
+
+	ctx = d.getContext(ctx)
+
+	container, err := d.client.LoadContainer(ctx, id)
+	if err != nil {
+		return driver.ErrInstanceNotFound
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return driver.ErrInstanceStopped
+	}
+
+	if err := task.Pause(ctx); err != nil {
+		return fmt.Errorf("failed to pause task: %w", err)
+	}
+
+	d.logger.Info("container paused", zap.String("id", id))
+	return nil
+}
+
+// Resume thaws a paused container's task.
+func (d *Driver) Resume(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.connected {
+		return driver.ErrNotConnected
+	}
+
+	ctx = d.getContext(ctx)
+
+	container, err := d.client.LoadContainer(ctx, id)
+	if err != nil {
+		return driver.ErrInstanceNotFound
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return driver.ErrInstanceStopped
+	}
+
+	if err := task.Resume(ctx); err != nil {
+		return fmt.Errorf("failed to resume task: %w", err)
+	}
+
+	d.logger.Info("container resumed", zap.String("id", id))
+	return nil
+}
+
+// Resize changes the CPU and memory limits of a container. The container's
+// spec is updated for its next start and, if its task is running, the new
+// limits are applied to the task's cgroup live.
+func (d *Driver) Resize(ctx context.Context, id string, cpuCores int, memoryMB int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.connected {
+		return driver.ErrNotConnected
+	}
+
+	ctx = d.getContext(ctx)
+
+	container, err := d.client.LoadContainer(ctx, id)
+	if err != nil {
+		return driver.ErrInstanceNotFound
+	}
+
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get container spec: %w", err)
+	}
+	if cpuCores > 0 {
+		if err := withCPULimit(int64(cpuCores)*cpuPeriod, cpuPeriod)(ctx, nil, nil, spec); err != nil {
+			return err
+		}
+	}
+	if memoryMB > 0 {
+		if err := oci.WithMemoryLimit(uint64(memoryMB)*1024*1024)(ctx, nil, nil, spec); err != nil {
+			return err
+		}
+	}
+
+	if err := container.Update(ctx, containerd.UpdateContainerOpts(containerd.WithSpec(spec))); err != nil {
+		return fmt.Errorf("failed to update container spec: %w", err)
+	}
+
+	if task, err := container.Task(ctx, nil); err == nil && spec.Linux != nil {
+		if err := task.Update(ctx, containerd.WithResources(spec.Linux.Resources)); err != nil {
+			return fmt.Errorf("failed to update task resources: %w", err)
+		}
+	}
+
+	d.logger.Info("container resized",
+		zap.String("id", id),
+		zap.Int("cpu_cores", cpuCores),
+		zap.Int64("memory_mb", memoryMB),
+	)
+	return nil
+}
+
+// ListImages returns the images in the driver's namespace.
+func (d *Driver) ListImages(ctx context.Context) ([]driver.ImageInfo, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if !d.connected {
+		return nil, driver.ErrNotConnected
+	}
+
+	ctx = d.getContext(ctx)
+	list, err := d.client.ListImages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	images := make([]driver.ImageInfo, 0, len(list))
+	for _, image := range list {
+		images = append(images, d.imageInfo(ctx, image))
+	}
+	return images, nil
+}
+
+// PullImage pulls and unpacks an image unless it is already present.
+func (d *Driver) PullImage(ctx context.Context, ref string, progress func(driver.PullProgress)) (*driver.ImageInfo, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if !d.connected {
+		return nil, driver.ErrNotConnected
+	}
+	if progress == nil {
+		progress = func(driver.PullProgress) {}
+	}
+
+	ctx = d.getContext(ctx)
+	if image, err := d.client.GetImage(ctx, ref); err == nil {
+		info := d.imageInfo(ctx, image)
+		progress(driver.PullProgress{Status: "cached", Current: info.SizeBytes, Total: info.SizeBytes})
+		return &info, nil
+	}
+
+	progress(driver.PullProgress{Status: "pulling"})
+	image, err := d.client.Pull(ctx, ref,
+		containerd.WithPullUnpack,
+		containerd.WithPullSnapshotter(d.config.Snapshotter),
+		containerd.WithResolver(d.resolver()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull image: %w", err)
+	}
+
+	info := d.imageInfo(ctx, image)
+	progress(driver.PullProgress{Status: "pulled", Current: info.SizeBytes, Total: info.SizeBytes})
+	d.logger.Info("pulled image", zap.String("image", ref), zap.Int64("size_bytes", info.SizeBytes))
+	return &info, nil
+}
+
+func (d *Driver) imageInfo(ctx context.Context, image containerd.Image) driver.ImageInfo {
+	size, _ := image.Size(ctx)
+	return driver.ImageInfo{
+		Ref:       image.Name(),
+		SizeBytes: size,
+		CreatedAt: image.Metadata().CreatedAt,
+	}
+}
+
 // Close releases resources.
 func (d *Driver) Close() error {
+	if d.cancel != nil {
+		d.cancel()
+		d.wg.Wait()
+	}
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
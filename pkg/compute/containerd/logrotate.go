@@ -0,0 +1,92 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// logRotateInterval is how often the size of container logs is checked.
+const logRotateInterval = 30 * time.Second
+
+// rotatedLogPath returns where the previous generation of a container's log
+// is kept.
+func rotatedLogPath(path string) string {
+	return path + ".1"
+}
+
+// rotateLogs keeps every container log under the configured size until ctx
+// is done. The shims hold the logs open for appending, so a log that grew
+// too large is copied to its previous generation and truncated in place;
+// what is written between the two is lost.
+func (d *Driver) rotateLogs(ctx context.Context) {
+	defer d.wg.Done()
+
+	maxSize := d.config.LogMaxSizeMB << 20
+	ticker := time.NewTicker(logRotateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		entries, err := os.ReadDir(d.config.LogPath)
+		if err != nil {
+			d.logger.Warn("failed to list container logs", zap.Error(err))
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || info.Size() <= maxSize {
+				continue
+			}
+			path := filepath.Join(d.config.LogPath, entry.Name())
+			if err := rotateLog(path); err != nil {
+				d.logger.Warn("failed to rotate container log", zap.String("path", path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// rotateLog replaces the previous generation of a log with its current
+// content and empties it.
+func rotateLog(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %w", err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".rotate-*")
+	if err != nil {
+		return fmt.Errorf("failed to create rotated log: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy log: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to copy log: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), rotatedLogPath(path)); err != nil {
+		return fmt.Errorf("failed to replace rotated log: %w", err)
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		return fmt.Errorf("failed to truncate log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,468 @@
+package containerd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/network/cgo"
+
+	"github.com/containernetworking/cni/libcni"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// Network attachment modes.
+const (
+	// NetworkModeOVS plugs a veth pair into the OVS integration bridge and
+	// configures the port's address inside the container.
+	NetworkModeOVS = "ovs"
+
+	// NetworkModeCNI delegates the attachment to a CNI plugin chain.
+	NetworkModeCNI = "cni"
+
+	// NetworkModeNone leaves containers without a network.
+	NetworkModeNone = "none"
+)
+
+// NetworkConfig configures how containers are attached to the network.
+type NetworkConfig struct {
+	// Mode is ovs, cni or none.
+	Mode string `mapstructure:"mode"`
+
+	// IntegrationBridge is the OVS bridge container veths are plugged into.
+	IntegrationBridge string `mapstructure:"integration_bridge"`
+
+	// CNIConfDir holds the CNI network configurations.
+	CNIConfDir string `mapstructure:"cni_conf_dir"`
+
+	// CNIBinDir holds the CNI plugin binaries.
+	CNIBinDir string `mapstructure:"cni_bin_dir"`
+
+	// CNINetwork names the CNI network to use (defaults to the first
+	// configuration in CNIConfDir).
+	CNINetwork string `mapstructure:"cni_network"`
+}
+
+// DefaultNetworkConfig returns the default container network configuration.
+func DefaultNetworkConfig() NetworkConfig {
+	return NetworkConfig{
+		Mode:              NetworkModeOVS,
+		IntegrationBridge: "br-int",
+		CNIConfDir:        "/etc/cni/net.d",
+		CNIBinDir:         "/opt/cni/bin",
+	}
+}
+
+// Container labels recording a network attachment, so that it can be torn
+// down after an agent restart.
+const (
+	labelNetMode    = "hypervisor.io/net-mode"
+	labelNetNS      = "hypervisor.io/netns"
+	labelHostIf     = "hypervisor.io/host-interface"
+	labelCNINetwork = "hypervisor.io/cni-network"
+)
+
+// containerIfName is the interface name inside the container.
+const containerIfName = "eth0"
+
+// attachment describes a container's network attachment.
+type attachment struct {
+	mode       string
+	netns      string // Named network namespace
+	hostIf     string // Host end of the container's interface
+	cniNetwork string
+}
+
+func (a *attachment) labels() map[string]string {
+	labels := map[string]string{
+		labelNetMode: a.mode,
+		labelNetNS:   a.netns,
+	}
+	if a.hostIf != "" {
+		labels[labelHostIf] = a.hostIf
+	}
+	if a.cniNetwork != "" {
+		labels[labelCNINetwork] = a.cniNetwork
+	}
+	return labels
+}
+
+// attachmentFromLabels returns the attachment recorded on a container, or
+// nil if it has none.
+func attachmentFromLabels(labels map[string]string) *attachment {
+	if labels[labelNetNS] == "" {
+		return nil
+	}
+	return &attachment{
+		mode:       labels[labelNetMode],
+		netns:      labels[labelNetNS],
+		hostIf:     labels[labelHostIf],
+		cniNetwork: labels[labelCNINetwork],
+	}
+}
+
+// netnsPath returns the path the container's runtime joins.
+func (a *attachment) netnsPath() string {
+	return filepath.Join("/var/run/netns", a.netns)
+}
+
+// attachNetwork creates a network namespace for a container and attaches it
+// to the network. The host interface is reported in netSpec.DeviceName for
+// the port binding. It returns nil if the container has no network.
+func (d *Driver) attachNetwork(ctx context.Context, containerID string, netSpec *driver.NetworkSpec) (*attachment, error) {
+	mode := d.config.Network.Mode
+	if mode == NetworkModeNone || (netSpec.PortID == "" && netSpec.NetworkID == "") {
+		return nil, nil
+	}
+
+	short := strings.ReplaceAll(containerID, "-", "")[:12]
+	att := &attachment{mode: mode, netns: "hvc-" + short}
+
+	fd, err := createNamespace(att.netns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create namespace %s: %w", att.netns, err)
+	}
+	defer fd.Close()
+
+	switch mode {
+	case NetworkModeOVS:
+		att.hostIf = "veth" + short[:8]
+		err = d.plugOVS(fd, containerID, att.hostIf, netSpec)
+	case NetworkModeCNI:
+		err = d.addCNI(ctx, containerID, att, netSpec)
+	default:
+		err = fmt.Errorf("unknown network mode %q", mode)
+	}
+	if err != nil {
+		d.detachNetwork(ctx, containerID, att)
+		return nil, err
+	}
+
+	netSpec.DeviceName = att.hostIf
+	return att, nil
+}
+
+// detachNetwork tears down a container's network attachment. Parts already
+// gone are skipped.
+func (d *Driver) detachNetwork(ctx context.Context, containerID string, att *attachment) error {
+	var errs []error
+	switch att.mode {
+	case NetworkModeOVS:
+		if att.hostIf != "" {
+			bridge := d.config.Network.IntegrationBridge
+			if err := cgo.NewOVSBridge(bridge).DeletePort(bridge, att.hostIf); err != nil {
+				errs = append(errs, err)
+			}
+			if err := deleteLink(att.hostIf); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	case NetworkModeCNI:
+		list, err := d.loadCNIConfig(att.cniNetwork)
+		if err == nil {
+			err = d.cni().DelNetworkList(ctx, list, d.cniRuntimeConf(containerID, att, nil))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete CNI attachment: %w", err))
+		}
+	}
+
+	if err := netns.DeleteNamed(att.netns); err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("failed to delete namespace %s: %w", att.netns, err))
+	}
+	return errors.Join(errs...)
+}
+
+// plugOVS connects the namespace to the integration bridge with a veth pair
+// and configures the port's MAC, address and default route on the
+// container end.
+func (d *Driver) plugOVS(fd netns.NsHandle, containerID, hostIf string, netSpec *driver.NetworkSpec) error {
+	nl, err := netlink.NewHandleAt(fd)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink handle in container namespace: %w", err)
+	}
+	defer nl.Close()
+
+	// The peer is created under a temporary name, since eth0 may exist on
+	// the host, and renamed once inside the namespace
+	peerName := "tmp" + strings.TrimPrefix(hostIf, "veth")
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: hostIf},
+		PeerName:  peerName,
+	}
+	if netSpec.MTU > 0 {
+		veth.MTU = int(netSpec.MTU)
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create veth pair %s: %w", hostIf, err)
+	}
+
+	peer, err := netlink.LinkByName(peerName)
+	if err == nil {
+		err = netlink.LinkSetNsFd(peer, int(fd))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to move %s into the container namespace: %w", peerName, err)
+	}
+
+	link, err := nl.LinkByName(peerName)
+	if err == nil {
+		err = nl.LinkSetName(link, containerIfName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", peerName, containerIfName, err)
+	}
+	if err := configureInterface(nl, netSpec); err != nil {
+		return err
+	}
+
+	host, err := netlink.LinkByName(hostIf)
+	if err == nil {
+		err = netlink.LinkSetUp(host)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", hostIf, err)
+	}
+
+	externalIDs := map[string]string{
+		"external_ids:container-id": containerID,
+		"external_ids:iface-status": "active",
+	}
+	if netSpec.PortID != "" {
+		externalIDs["external_ids:iface-id"] = netSpec.PortID
+	}
+	if netSpec.MACAddress != "" {
+		externalIDs["external_ids:attached-mac"] = netSpec.MACAddress
+	}
+
+	bridge := d.config.Network.IntegrationBridge
+	if err := cgo.NewOVSBridge(bridge).AddPort(bridge, hostIf, externalIDs); err != nil {
+		return fmt.Errorf("failed to plug %s into %s: %w", hostIf, bridge, err)
+	}
+	return nil
+}
+
+// configureInterface sets the container interface's MAC and address, brings
+// it and loopback up and routes through the subnet gateway.
+func configureInterface(nl *netlink.Handle, netSpec *driver.NetworkSpec) error {
+	link, err := nl.LinkByName(containerIfName)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %w", containerIfName, err)
+	}
+
+	if netSpec.MACAddress != "" {
+		mac, err := net.ParseMAC(netSpec.MACAddress)
+		if err != nil {
+			return fmt.Errorf("invalid MAC address %q: %w", netSpec.MACAddress, err)
+		}
+		if err := nl.LinkSetHardwareAddr(link, mac); err != nil {
+			return fmt.Errorf("failed to set MAC address of %s: %w", containerIfName, err)
+		}
+	}
+
+	if netSpec.IPAddress != "" {
+		addr, err := interfaceAddr(netSpec)
+		if err != nil {
+			return err
+		}
+		if err := nl.AddrAdd(link, &netlink.Addr{IPNet: addr}); err != nil {
+			return fmt.Errorf("failed to set address %s on %s: %w", addr, containerIfName, err)
+		}
+	}
+
+	if err := nl.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", containerIfName, err)
+	}
+	if lo, err := nl.LinkByName("lo"); err == nil {
+		if err := nl.LinkSetUp(lo); err != nil {
+			return fmt.Errorf("failed to bring up loopback: %w", err)
+		}
+	}
+
+	if netSpec.GatewayIP != "" && netSpec.IPAddress != "" {
+		gw := net.ParseIP(netSpec.GatewayIP)
+		if gw == nil {
+			return fmt.Errorf("invalid gateway address %q", netSpec.GatewayIP)
+		}
+		if err := nl.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: gw}); err != nil {
+			return fmt.Errorf("failed to set default route via %s: %w", gw, err)
+		}
+	}
+	return nil
+}
+
+// interfaceAddr returns the port's address with the subnet's prefix length,
+// or a host route if the subnet is unknown.
+func interfaceAddr(netSpec *driver.NetworkSpec) (*net.IPNet, error) {
+	ip := net.ParseIP(netSpec.IPAddress)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", netSpec.IPAddress)
+	}
+
+	if netSpec.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(netSpec.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", netSpec.Subnet, err)
+		}
+		return &net.IPNet{IP: ip, Mask: subnet.Mask}, nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// addCNI runs the CNI plugin chain against the container's namespace. The
+// allocated address and MAC are passed as capability args, which plugins
+// that support them (e.g. static IPAM, tuning) honour.
+func (d *Driver) addCNI(ctx context.Context, containerID string, att *attachment, netSpec *driver.NetworkSpec) error {
+	list, err := d.loadCNIConfig(d.config.Network.CNINetwork)
+	if err != nil {
+		return err
+	}
+	att.cniNetwork = list.Name
+
+	capabilities := make(map[string]interface{})
+	if netSpec.IPAddress != "" {
+		addr, err := interfaceAddr(netSpec)
+		if err != nil {
+			return err
+		}
+		capabilities["ips"] = []string{addr.String()}
+	}
+	if netSpec.MACAddress != "" {
+		capabilities["mac"] = netSpec.MACAddress
+	}
+
+	res, err := d.cni().AddNetworkList(ctx, list, d.cniRuntimeConf(containerID, att, capabilities))
+	if err != nil {
+		return fmt.Errorf("failed to add CNI network %s: %w", list.Name, err)
+	}
+
+	// The host end of the pair, if the plugin created one, is bound to the port
+	if result, err := types100.NewResultFromResult(res); err == nil {
+		for _, iface := range result.Interfaces {
+			if iface.Sandbox == "" && iface.Name != "" {
+				att.hostIf = iface.Name
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Driver) cni() *libcni.CNIConfig {
+	return libcni.NewCNIConfig([]string{d.config.Network.CNIBinDir}, nil)
+}
+
+func (d *Driver) cniRuntimeConf(containerID string, att *attachment, capabilities map[string]interface{}) *libcni.RuntimeConf {
+	return &libcni.RuntimeConf{
+		ContainerID:    containerID,
+		NetNS:          att.netnsPath(),
+		IfName:         containerIfName,
+		CapabilityArgs: capabilities,
+	}
+}
+
+// loadCNIConfig loads the named CNI network, or the first one in the
+// configuration directory if name is empty.
+func (d *Driver) loadCNIConfig(name string) (*libcni.NetworkConfigList, error) {
+	dir := d.config.Network.CNIConfDir
+	if name != "" {
+		list, err := libcni.LoadConfList(dir, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CNI network %s: %w", name, err)
+		}
+		return list, nil
+	}
+
+	files, err := libcni.ConfFiles(dir, []string{".conflist", ".conf", ".json"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CNI configurations: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no CNI network configured in %s", dir)
+	}
+	sort.Strings(files)
+
+	if strings.HasSuffix(files[0], ".conflist") {
+		list, err := libcni.ConfListFromFile(files[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", files[0], err)
+		}
+		return list, nil
+	}
+	conf, err := libcni.ConfFromFile(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", files[0], err)
+	}
+	return libcni.ConfListFromConf(conf)
+}
+
+// createNamespace creates a named network namespace. netns.NewNamed switches
+// the calling thread into the new namespace, so it runs on a goroutine of
+// its own whose thread is locked and switched back before it is released.
+// If switching back fails, the thread stays locked and the runtime
+// discards it when the goroutine exits.
+func createNamespace(name string) (netns.NsHandle, error) {
+	type result struct {
+		fd  netns.NsHandle
+		err error
+	}
+	ch := make(chan result, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			ch <- result{netns.None(), fmt.Errorf("failed to get network namespace: %w", err)}
+			return
+		}
+		defer origin.Close()
+
+		fd, err := netns.NewNamed(name)
+		if restoreErr := netns.Set(origin); restoreErr != nil {
+			// Never hand a thread in the wrong namespace back to the runtime
+			if err == nil {
+				fd.Close()
+				netns.DeleteNamed(name)
+			}
+			ch <- result{netns.None(), fmt.Errorf("failed to restore network namespace: %w", restoreErr)}
+			return
+		}
+		runtime.UnlockOSThread()
+		ch <- result{fd, err}
+	}()
+
+	r := <-ch
+	return r.fd, r.err
+}
+
+// deleteLink deletes a host link, and with it the peer of a veth. A missing
+// link is not an error.
+func deleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to look up %s: %w", name, err)
+	}
+	if err := netlink.LinkDel(link); err != nil && !errors.Is(err, unix.ENODEV) {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package containerd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"hypervisor/pkg/cluster/registryauth"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// RegistryConfig configures pulls from one registry, or the connection to
+// a mirror.
+type RegistryConfig struct {
+	// Host is the registry or mirror host, with a port if not the default,
+	// e.g. docker.io for Docker Hub or registry.example.com:5000.
+	Host string `mapstructure:"host"`
+
+	// Mirrors are tried in order before the registry itself, e.g.
+	// https://mirror.example.com. Each may have its own entry, by host, for
+	// TLS settings and credentials.
+	Mirrors []string `mapstructure:"mirrors"`
+
+	// Insecure pulls over plain HTTP.
+	Insecure bool `mapstructure:"insecure"`
+
+	// SkipVerify accepts any TLS certificate; CAFile adds a CA to trust.
+	SkipVerify bool   `mapstructure:"skip_verify"`
+	CAFile     string `mapstructure:"ca_file"`
+
+	// Credentials for the registry. Credentials stored in the cluster take
+	// precedence.
+	Username      string `mapstructure:"username"`
+	Password      string `mapstructure:"password"`
+	IdentityToken string `mapstructure:"identity_token"`
+}
+
+// CredentialsFunc returns the username and secret to pull from a registry
+// host with, and whether there are any. An empty username with a secret is
+// an identity token.
+type CredentialsFunc func(registry string) (username, secret string, ok bool)
+
+// SetCredentials sets where credentials for private registries are looked
+// up before the configured ones, e.g. the cluster's registry credentials.
+func (d *Driver) SetCredentials(credentials CredentialsFunc) {
+	d.credentials = credentials
+}
+
+// resolver returns the resolver images are pulled with: it authenticates
+// with the registry's credentials and tries its mirrors first.
+func (d *Driver) resolver() remotes.Resolver {
+	return docker.NewResolver(docker.ResolverOptions{Hosts: d.registryHosts})
+}
+
+// registryHosts returns the hosts to pull from a registry through: its
+// mirrors, then the registry itself.
+func (d *Driver) registryHosts(registry string) ([]docker.RegistryHost, error) {
+	key, err := registryauth.NormalizeHost(registry)
+	if err != nil {
+		return nil, err
+	}
+	config := d.registryConfig(key)
+
+	var hosts []docker.RegistryHost
+	for _, mirror := range config.Mirrors {
+		host, err := d.mirrorHost(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %w", registry, err)
+		}
+		hosts = append(hosts, host)
+	}
+
+	upstream := registry
+	if key == registryauth.DockerHub {
+		upstream = "registry-1.docker.io"
+	}
+	host, err := d.registryHost(upstream, "", config, docker.HostCapabilityPull|docker.HostCapabilityResolve)
+	if err != nil {
+		return nil, fmt.Errorf("registry %s: %w", registry, err)
+	}
+	return append(hosts, host), nil
+}
+
+// mirrorHost returns the host to pull through a mirror, given as a URL or
+// a host. Mirrors are only pulled from, and are trusted to resolve tags.
+func (d *Driver) mirrorHost(mirror string) (docker.RegistryHost, error) {
+	if !strings.Contains(mirror, "://") {
+		mirror = "https://" + mirror
+	}
+	u, err := url.Parse(mirror)
+	if err != nil || u.Host == "" {
+		return docker.RegistryHost{}, fmt.Errorf("invalid mirror %q", mirror)
+	}
+
+	key, err := registryauth.NormalizeHost(u.Host)
+	if err != nil {
+		return docker.RegistryHost{}, err
+	}
+	config := d.registryConfig(key)
+	if u.Scheme == "http" {
+		config.Insecure = true
+	}
+	return d.registryHost(u.Host, u.Path, config, docker.HostCapabilityPull|docker.HostCapabilityResolve)
+}
+
+// registryHost returns how to reach one registry or mirror host. path is
+// the API root below the host, /v2 if empty.
+func (d *Driver) registryHost(host, path string, config RegistryConfig, caps docker.HostCapabilities) (docker.RegistryHost, error) {
+	client, err := registryClient(config)
+	if err != nil {
+		return docker.RegistryHost{}, err
+	}
+
+	path = strings.TrimSuffix(path, "/")
+	if !strings.HasSuffix(path, "/v2") {
+		path += "/v2"
+	}
+	scheme := "https"
+	if config.Insecure {
+		scheme = "http"
+	}
+
+	return docker.RegistryHost{
+		Client: client,
+		Authorizer: docker.NewDockerAuthorizer(
+			docker.WithAuthClient(client),
+			docker.WithAuthCreds(d.lookupCredentials),
+		),
+		Host:         host,
+		Scheme:       scheme,
+		Path:         path,
+		Capabilities: caps,
+	}, nil
+}
+
+// registryConfig returns the configuration of a normalized registry host.
+func (d *Driver) registryConfig(host string) RegistryConfig {
+	for _, config := range d.config.Registries {
+		if key, err := registryauth.NormalizeHost(config.Host); err == nil && key == host {
+			return config
+		}
+	}
+	return RegistryConfig{}
+}
+
+// lookupCredentials returns the credentials for a host the authorizer was
+// challenged by: the cluster's, else the configured ones. Hosts without
+// any are pulled from anonymously.
+func (d *Driver) lookupCredentials(host string) (string, string, error) {
+	key, err := registryauth.NormalizeHost(host)
+	if err != nil {
+		return "", "", nil
+	}
+	if d.credentials != nil {
+		if username, secret, ok := d.credentials(key); ok {
+			return username, secret, nil
+		}
+	}
+	config := d.registryConfig(key)
+	if config.IdentityToken != "" {
+		return "", config.IdentityToken, nil
+	}
+	return config.Username, config.Password, nil
+}
+
+// registryClient returns the HTTP client for a registry's TLS settings.
+func registryClient(config RegistryConfig) (*http.Client, error) {
+	if !config.SkipVerify && config.CAFile == "" {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SkipVerify}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read registry CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in registry CA %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// CPU architectures, named as Go and OCI image platforms name them.
+const (
+	ArchAMD64 = "amd64"
+	ArchARM64 = "arm64"
+)
+
+// archAliases maps the kernel's names (uname -m) and common spellings to
+// the architectures above.
+var archAliases = map[string]string{
+	"amd64":   ArchAMD64,
+	"x86_64":  ArchAMD64,
+	"x86-64":  ArchAMD64,
+	"arm64":   ArchARM64,
+	"aarch64": ArchARM64,
+}
+
+// ParseArchitecture returns the architecture named by s, which may also be
+// the kernel's name for it, e.g. "x86_64" or "aarch64".
+func ParseArchitecture(s string) (string, error) {
+	if arch, ok := archAliases[strings.ToLower(strings.TrimSpace(s))]; ok {
+		return arch, nil
+	}
+	return "", fmt.Errorf("unsupported architecture %q (supported: %s, %s)", s, ArchAMD64, ArchARM64)
+}
+
+// HostArchitecture returns the architecture the process runs on.
+func HostArchitecture() string {
+	return runtime.GOARCH
+}
+
+// GuestArchitecture returns the architecture spec asks for, defaulting to
+// the host's. Drivers run guests of the host's architecture only, so any
+// other is refused with ErrInvalidSpec.
+func GuestArchitecture(spec *InstanceSpec) (string, error) {
+	host := HostArchitecture()
+	if spec.Architecture == "" {
+		return host, nil
+	}
+	arch, err := ParseArchitecture(spec.Architecture)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	if arch != host {
+		return "", fmt.Errorf("%w: cannot run %s guests on a %s host", ErrInvalidSpec, arch, host)
+	}
+	return arch, nil
+}
@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// HasCloudInit reports whether the spec carries data for cloud-init.
+func (s *InstanceSpec) HasCloudInit() bool {
+	return s.UserData != "" || len(s.SSHKeys) > 0
+}
+
+// NoCloudMetaData returns the meta-data file of a cloud-init NoCloud seed.
+// It is YAML; values are quoted so names and keys need no escaping.
+func NoCloudMetaData(instanceID, hostname string, sshKeys []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "instance-id: %q\n", instanceID)
+	fmt.Fprintf(&b, "local-hostname: %q\n", hostname)
+	if len(sshKeys) > 0 {
+		b.WriteString("public-keys:\n")
+		for _, key := range sshKeys {
+			fmt.Fprintf(&b, "  - %q\n", strings.TrimSpace(key))
+		}
+	}
+	return b.String()
+}
+
+// NoCloudUserData returns the user-data file of a cloud-init NoCloud seed.
+// cloud-init requires the file, so an empty cloud-config stands in when the
+// spec has none.
+func NoCloudUserData(spec *InstanceSpec) string {
+	if spec.UserData == "" {
+		return "#cloud-config\n{}\n"
+	}
+	return spec.UserData
+}
+
+// NoCloudNetworkConfig returns the network-config file of a cloud-init
+// NoCloud seed, or "" if there is nothing to configure. The guest's NIC,
+// matched by MAC address, takes its address over DHCP and the MTU of its
+// network, so guests whose driver ignores the MTU the host advertises still
+// match the datapath.
+func NoCloudNetworkConfig(netSpec NetworkSpec) string {
+	if netSpec.MTU == 0 || netSpec.MACAddress == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("version: 2\n")
+	b.WriteString("ethernets:\n")
+	b.WriteString("  nic0:\n")
+	b.WriteString("    match:\n")
+	fmt.Fprintf(&b, "      macaddress: %q\n", strings.ToLower(netSpec.MACAddress))
+	b.WriteString("    dhcp4: true\n")
+	fmt.Fprintf(&b, "    mtu: %d\n", netSpec.MTU)
+	return b.String()
+}
+
+// NoCloudSeed returns the files of a cloud-init NoCloud seed for the named
+// instance, by file name.
+func NoCloudSeed(name string, spec *InstanceSpec) map[string]string {
+	files := map[string]string{
+		"meta-data": NoCloudMetaData(name, name, spec.SSHKeys),
+		"user-data": NoCloudUserData(spec),
+	}
+	if networkConfig := NoCloudNetworkConfig(spec.Network); networkConfig != "" {
+		files["network-config"] = networkConfig
+	}
+	return files
+}
+
+// isoTools are the commands tried, in order, to build a seed ISO. They all
+// accept genisoimage's arguments.
+var isoTools = []string{"genisoimage", "mkisofs", "xorrisofs"}
+
+// WriteNoCloudISO builds a cloud-init NoCloud seed ISO (volume label
+// "cidata") at target, holding the spec's user-data, SSH keys and network
+// configuration for the named instance.
+func WriteNoCloudISO(ctx context.Context, target, name string, spec *InstanceSpec) error {
+	tool, err := findISOTool()
+	if err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp("", "seed-")
+	if err != nil {
+		return fmt.Errorf("failed to create seed directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	args := []string{"-output", target, "-volid", "cidata", "-joliet", "-rock"}
+	files := NoCloudSeed(name, spec)
+	for _, file := range []string{"meta-data", "user-data", "network-config"} {
+		content, ok := files[file]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(staging, file)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			return fmt.Errorf("failed to write seed %s: %w", file, err)
+		}
+		args = append(args, path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("failed to create seed directory: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, tool, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(target)
+		return fmt.Errorf("failed to build seed ISO: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+func findISOTool() (string, error) {
+	for _, tool := range isoTools {
+		if path, err := exec.LookPath(tool); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no ISO tool found (need one of %s)", strings.Join(isoTools, ", "))
+}
@@ -0,0 +1,229 @@
+package driver
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// CPUMode selects how the guest CPU is presented.
+type CPUMode string
+
+const (
+	// CPUModeHostModel presents a model close to the host CPU (default).
+	CPUModeHostModel CPUMode = "host-model"
+	// CPUModeHostPassthrough exposes the host CPU unchanged. Fastest, but
+	// instances can only migrate between identical hosts.
+	CPUModeHostPassthrough CPUMode = "host-passthrough"
+	// CPUModeCustom presents a named CPU model, e.g. a common baseline for a
+	// live migration pool.
+	CPUModeCustom CPUMode = "custom"
+)
+
+// CPUSpec selects the guest CPU model and features.
+type CPUSpec struct {
+	Mode             CPUMode  `json:"mode,omitempty"`
+	Model            string   `json:"model,omitempty"`             // Named model for custom mode, e.g. "Skylake-Server"
+	RequiredFeatures []string `json:"required_features,omitempty"` // e.g. ["avx512f"]
+	DisabledFeatures []string `json:"disabled_features,omitempty"`
+}
+
+// IsZero returns true if no CPU selection was made.
+func (s *CPUSpec) IsZero() bool {
+	return s.Mode == "" && s.Model == "" && len(s.RequiredFeatures) == 0 && len(s.DisabledFeatures) == 0
+}
+
+// Validate checks that the CPU selection is well formed.
+func (s *CPUSpec) Validate() error {
+	switch s.Mode {
+	case "", CPUModeHostModel, CPUModeHostPassthrough:
+		if s.Model != "" {
+			return fmt.Errorf("cpu model %q requires mode %q", s.Model, CPUModeCustom)
+		}
+	case CPUModeCustom:
+		if s.Model == "" {
+			return fmt.Errorf("cpu mode %q requires a model", CPUModeCustom)
+		}
+	default:
+		return fmt.Errorf("unknown cpu mode %q", s.Mode)
+	}
+
+	for _, required := range s.RequiredFeatures {
+		for _, disabled := range s.DisabledFeatures {
+			if NormalizeCPUFeature(required) == NormalizeCPUFeature(disabled) {
+				return fmt.Errorf("cpu feature %q is both required and disabled", required)
+			}
+		}
+	}
+	return nil
+}
+
+// HostCPU describes a node's CPU as reported by its agent.
+type HostCPU struct {
+	Vendor    string   `json:"vendor,omitempty"`
+	ModelName string   `json:"model_name,omitempty"`
+	Features  []string `json:"features,omitempty"` // Normalized feature flags
+	Models    []string `json:"models,omitempty"`   // Named models the host can run
+}
+
+// NewHostCPU builds a HostCPU from raw feature flags, normalizing them and
+// computing the named models the host supports.
+func NewHostCPU(vendor, modelName string, features []string) *HostCPU {
+	set := make(map[string]bool, len(features))
+	for _, f := range features {
+		set[NormalizeCPUFeature(f)] = true
+	}
+
+	h := &HostCPU{
+		Vendor:    vendor,
+		ModelName: modelName,
+		Features:  make([]string, 0, len(set)),
+	}
+	for f := range set {
+		h.Features = append(h.Features, f)
+	}
+	sort.Strings(h.Features)
+
+	for _, model := range CPUModels() {
+		if len(h.missing(cpuModelFeatures[model])) == 0 {
+			h.Models = append(h.Models, model)
+		}
+	}
+	return h
+}
+
+// Supports returns an error describing why the host cannot run spec, or nil.
+func (h *HostCPU) Supports(spec CPUSpec) error {
+	required := spec.RequiredFeatures
+	if spec.Mode == CPUModeCustom {
+		features, ok := cpuModelFeatures[spec.Model]
+		if !ok {
+			// Unknown to the built-in table; trust the agent's model list
+			for _, model := range h.Models {
+				if model == spec.Model {
+					return nil
+				}
+			}
+			return fmt.Errorf("cpu model %s not supported", spec.Model)
+		}
+		required = slices.Concat(features, required)
+	}
+
+	if missing := h.missing(required); len(missing) > 0 {
+		return fmt.Errorf("missing cpu features: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CheckCPUMigration returns an error if an instance with the given CPU
+// selection, running on source, cannot be live migrated to target.
+func CheckCPUMigration(spec CPUSpec, source, target *HostCPU) error {
+	if target == nil {
+		return fmt.Errorf("target node has not reported its cpu")
+	}
+
+	switch spec.Mode {
+	case CPUModeCustom:
+		// The guest sees only the named model, so the source host is irrelevant
+		return target.Supports(spec)
+
+	case CPUModeHostPassthrough:
+		if source == nil {
+			return fmt.Errorf("source node has not reported its cpu")
+		}
+		if source.Vendor != target.Vendor || source.ModelName != target.ModelName {
+			return fmt.Errorf("host-passthrough requires identical hosts: source is %s, target is %s",
+				source.ModelName, target.ModelName)
+		}
+		if missing := target.missing(source.Features); len(missing) > 0 {
+			return fmt.Errorf("target is missing cpu features: %s", strings.Join(missing, ", "))
+		}
+		return nil
+
+	default:
+		// host-model is expanded from the source host when the instance
+		// starts, so the target must provide every feature the source has
+		if source == nil {
+			return fmt.Errorf("source node has not reported its cpu")
+		}
+		if source.Vendor != target.Vendor {
+			return fmt.Errorf("cpu vendor differs: source is %s, target is %s", source.Vendor, target.Vendor)
+		}
+		if missing := target.missing(slices.Concat(source.Features, spec.RequiredFeatures)); len(missing) > 0 {
+			return fmt.Errorf("target is missing cpu features: %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
+
+// HasFeature reports whether the host provides the feature.
+func (h *HostCPU) HasFeature(feature string) bool {
+	return len(h.missing([]string{feature})) == 0
+}
+
+// missing returns the features not provided by the host.
+func (h *HostCPU) missing(features []string) []string {
+	have := make(map[string]bool, len(h.Features))
+	for _, f := range h.Features {
+		have[f] = true
+	}
+
+	var missing []string
+	for _, f := range features {
+		if !have[NormalizeCPUFeature(f)] {
+			missing = slices.Concat(missing, []string{f})
+		}
+	}
+	return missing
+}
+
+// NormalizeCPUFeature maps libvirt/QEMU ("sse4.2", "avx512-vnni") and
+// /proc/cpuinfo ("sse4_2", "avx512_vnni") feature names to one form.
+func NormalizeCPUFeature(feature string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(strings.ToLower(strings.TrimSpace(feature)))
+}
+
+// CPUModels returns the names of the built-in CPU models.
+func CPUModels() []string {
+	models := make([]string, 0, len(cpuModelFeatures))
+	for model := range cpuModelFeatures {
+		models = slices.Concat(models, []string{model})
+	}
+	sort.Strings(models)
+	return models
+}
+
+// Feature sets of common QEMU CPU models, abbreviated to the flags that
+// distinguish each generation. Used to check that a host can run a model.
+var (
+	x86Baseline = []string{"fpu", "cx8", "cmov", "mmx", "fxsr", "sse", "sse2"}
+	nehalem     = slices.Concat(x86Baseline, []string{"sse3", "ssse3", "cx16", "sse4_1", "sse4_2", "popcnt", "lahf_lm"})
+	sandyBridge = slices.Concat(nehalem, []string{"pclmulqdq", "aes", "avx", "xsave"})
+	ivyBridge   = slices.Concat(sandyBridge, []string{"f16c", "rdrand", "fsgsbase"})
+	haswell     = slices.Concat(ivyBridge, []string{"avx2", "fma", "bmi1", "bmi2", "movbe", "invpcid"})
+	broadwell   = slices.Concat(haswell, []string{"rdseed", "adx", "smap"})
+	skylake     = slices.Concat(broadwell, []string{"xsavec", "clflushopt"})
+	skylakeSrv  = slices.Concat(skylake, []string{"avx512f", "avx512dq", "avx512cd", "avx512bw", "avx512vl", "clwb"})
+	cascadelake = slices.Concat(skylakeSrv, []string{"avx512_vnni"})
+	icelake     = slices.Concat(cascadelake, []string{"avx512vbmi", "avx512_vbmi2", "gfni", "vaes", "vpclmulqdq", "avx512_bitalg", "avx512_vpopcntdq"})
+	epyc        = slices.Concat(haswell, []string{"rdseed", "adx", "smap", "clflushopt", "sha_ni", "xsavec", "misalignsse", "sse4a"})
+	epycRome    = slices.Concat(epyc, []string{"clwb", "wbnoinvd"})
+	epycMilan   = slices.Concat(epycRome, []string{"pku", "vaes", "vpclmulqdq"})
+
+	cpuModelFeatures = map[string][]string{
+		"qemu64":             slices.Concat(x86Baseline, []string{"sse3", "cx16", "lahf_lm"}),
+		"Nehalem":            nehalem,
+		"SandyBridge":        sandyBridge,
+		"IvyBridge":          ivyBridge,
+		"Haswell":            haswell,
+		"Broadwell":          broadwell,
+		"Skylake-Client":     skylake,
+		"Skylake-Server":     skylakeSrv,
+		"Cascadelake-Server": cascadelake,
+		"Icelake-Server":     icelake,
+		"EPYC":               epyc,
+		"EPYC-Rome":          epycRome,
+		"EPYC-Milan":         epycMilan,
+	}
+)
@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// BootDiagnostics is what a driver can collect to tell whether an instance
+// booted: a picture of its display and the end of its serial console.
+type BootDiagnostics struct {
+	Screenshot       []byte    // Encoded image, empty when the instance has no display or is not running
+	ScreenshotFormat string    // MIME type of Screenshot, e.g. "image/png"
+	SerialOutput     []string  // Last lines written to the serial console
+	CollectedAt      time.Time // When the diagnostics were collected
+}
+
+// DiagnosticsDriver is implemented by drivers that can collect boot
+// diagnostics. lines caps the serial output returned.
+type DiagnosticsDriver interface {
+	BootDiagnostics(ctx context.Context, id string, lines int) (*BootDiagnostics, error)
+}
+
+// maxTailBytes bounds how much of a console log TailLines reads.
+const maxTailBytes = 256 * 1024
+
+// TailLines returns the last n lines of the file at path, reading at most
+// the final 256 KiB of it. A missing file has no lines.
+func TailLines(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open console log: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat console log: %w", err)
+	}
+	offset := info.Size() - maxTailBytes
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read console log: %w", err)
+	}
+	if offset > 0 {
+		// Drop the partial first line
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil, nil
+	}
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
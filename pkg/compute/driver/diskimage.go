@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DiskImage describes a disk image file as qemu-img reports it.
+type DiskImage struct {
+	Format      string `json:"format"`       // e.g. qcow2 or raw
+	VirtualSize int64  `json:"virtual-size"` // Size the guest sees, in bytes
+	BackingFile string `json:"full-backing-filename,omitempty"`
+}
+
+// InspectDiskImage reads the format and virtual size of a disk image with
+// qemu-img info. An empty format lets qemu-img probe it.
+func InspectDiskImage(ctx context.Context, path, format string) (*DiskImage, error) {
+	args := []string{"info", "--output=json"}
+	if format != "" {
+		args = append(args, "-f", format)
+	}
+	args = append(args, path)
+
+	cmd := exec.CommandContext(ctx, "qemu-img", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		var stderr string
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			stderr = strings.TrimSpace(string(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("failed to inspect disk image %s: %s: %w", path, stderr, err)
+	}
+
+	var image DiskImage
+	if err := json.Unmarshal(out, &image); err != nil {
+		return nil, fmt.Errorf("failed to parse disk image info of %s: %w", path, err)
+	}
+	return &image, nil
+}
+
+// OverlaySize returns the virtual size argument of a qemu-img overlay
+// backed by image: sizeGB if that grows the disk, or "" to keep the
+// image's size, as an overlay smaller than its backing image would cut
+// off the end of the guest's disk.
+func OverlaySize(image *DiskImage, sizeGB int64) string {
+	if sizeGB <= 0 || sizeGB<<30 <= image.VirtualSize {
+		return ""
+	}
+	return fmt.Sprintf("%dG", sizeGB)
+}
+
+// ResolveSourceDisk checks a disk attached from a source path: the path,
+// with symlinks resolved, must lie inside dir, be a qcow2 or raw image and
+// have no backing file outside dir. It returns the resolved path and the
+// image, whose format is probed rather than guessed from the file name.
+func ResolveSourceDisk(ctx context.Context, dir, path string) (string, *DiskImage, error) {
+	resolved, err := confine(dir, path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	image, err := InspectDiskImage(ctx, resolved, "")
+	if err != nil {
+		return "", nil, err
+	}
+	switch image.Format {
+	case "qcow2", "raw":
+	default:
+		return "", nil, fmt.Errorf("%w: disk %s has unsupported format %q", ErrInvalidSpec, path, image.Format)
+	}
+	if image.BackingFile != "" {
+		if _, err := confine(dir, image.BackingFile); err != nil {
+			return "", nil, fmt.Errorf("%w: backing file of disk %s: %v", ErrInvalidSpec, path, err)
+		}
+	}
+	return resolved, image, nil
+}
+
+// confine resolves symlinks in path, relative to dir unless absolute, and
+// checks that the result lies inside dir.
+func confine(dir, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	root, err := resolvePath(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", dir, err)
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return "", fmt.Errorf("disk %s is not available: %w", path, err)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: disk %s is outside %s", ErrInvalidSpec, path, dir)
+	}
+	return resolved, nil
+}
+
+// resolvePath returns the absolute path of a file with symlinks resolved.
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(resolved)
+}
@@ -20,13 +20,14 @@ const (
 type InstanceState string
 
 const (
-	StateUnknown  InstanceState = "unknown"
-	StatePending  InstanceState = "pending"
-	StateCreating InstanceState = "creating"
-	StateRunning  InstanceState = "running"
-	StateStopped  InstanceState = "stopped"
-	StatePaused   InstanceState = "paused"
-	StateFailed   InstanceState = "failed"
+	StateUnknown   InstanceState = "unknown"
+	StatePending   InstanceState = "pending"
+	StateCreating  InstanceState = "creating"
+	StateRunning   InstanceState = "running"
+	StateStopped   InstanceState = "stopped"
+	StatePaused    InstanceState = "paused"
+	StateSuspended InstanceState = "suspended" // Memory saved to disk; start restores it
+	StateFailed    InstanceState = "failed"
 )
 
 // Instance represents a compute instance (VM, container, or microVM).
@@ -45,12 +46,23 @@ type Instance struct {
 
 // InstanceSpec defines the specification for creating an instance.
 type InstanceSpec struct {
+	// Identity assigned by the control plane. Drivers that name their
+	// resources after it (e.g. libvirt domains) fall back to a generated
+	// ID when it is empty.
+	InstanceID string `json:"instance_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+
 	// Common fields
 	Image    string `json:"image"`
 	CPUCores int    `json:"cpu_cores"`
 	MemoryMB int64  `json:"memory_mb"`
 	DiskGB   int64  `json:"disk_gb"`
 
+	// Architecture the image is built for (ArchAMD64 or ArchARM64). The
+	// instance is only placed on nodes of that architecture; empty places
+	// it on any node.
+	Architecture string `json:"architecture,omitempty"`
+
 	// VM-specific
 	Kernel     string `json:"kernel,omitempty"`
 	Initrd     string `json:"initrd,omitempty"`
@@ -62,6 +74,11 @@ type InstanceSpec struct {
 	Env        map[string]string `json:"env,omitempty"`
 	WorkingDir string            `json:"working_dir,omitempty"`
 
+	// Runtime is the containerd runtime the container runs under, e.g.
+	// RuntimeKata or RuntimeRunsc for stronger isolation. Empty uses the
+	// node's default runtime.
+	Runtime string `json:"runtime,omitempty"`
+
 	// Network
 	Network NetworkSpec `json:"network"`
 
@@ -70,6 +87,37 @@ type InstanceSpec struct {
 
 	// Resource limits
 	Limits ResourceLimits `json:"limits,omitempty"`
+
+	// Guest CPU model and features (VM only)
+	CPU CPUSpec `json:"cpu,omitempty"`
+
+	// HugePages backs guest memory with the host's hugepages (VM only)
+	HugePages bool `json:"hugepages,omitempty"`
+
+	// Dedicated cores and NUMA node preference (VM only). PinnedCPUs are
+	// the host cores the node dedicated to the vCPUs, in vCPU order, and
+	// NUMANodes the host nodes the guest memory is placed on. SharedCPUs
+	// are the host cores an instance without dedicated cores runs on,
+	// those not dedicated to any instance.
+	CPUPlacement CPUPlacement `json:"cpu_placement,omitempty"`
+	PinnedCPUs   []int        `json:"pinned_cpus,omitempty"`
+	NUMANodes    []int        `json:"numa_nodes,omitempty"`
+	SharedCPUs   []int        `json:"shared_cpus,omitempty"`
+
+	// GPUs to pass through (VM only). GPUDevices are the PCI addresses the
+	// node assigned to satisfy the request.
+	GPU        GPURequest `json:"gpu,omitempty"`
+	GPUDevices []string   `json:"gpu_devices,omitempty"`
+
+	// Guest initialization data for cloud-init, served by the node's
+	// metadata service and by the drivers' NoCloud seeds
+	UserData string   `json:"user_data,omitempty"`
+	SSHKeys  []string `json:"ssh_keys,omitempty"`
+
+	// Scheduling: the labels a node must have, and the node taints the
+	// instance tolerates
+	NodeSelector map[string]string `json:"node_selector,omitempty"`
+	Tolerations  []Toleration      `json:"tolerations,omitempty"`
 }
 
 // NetworkSpec defines network configuration.
@@ -92,6 +140,15 @@ type NetworkSpec struct {
 	PortID      string          `json:"port_id,omitempty"`      // Pre-created port ID
 	BindingType PortBindingType `json:"binding_type,omitempty"` // ovs, vhost-user, sriov
 	DeviceName  string          `json:"device_name,omitempty"`  // tap0, veth0, etc.
+
+	// SR-IOV binding: the VF the node assigned, and the VLAN its physical
+	// function tags the guest's traffic with (0 for a flat network)
+	VFAddress string `json:"vf_address,omitempty"`
+	VLANID    uint16 `json:"vlan_id,omitempty"`
+
+	// vhost-user binding: the socket the guest's NIC is served on, which
+	// the node plugged into its DPDK integration bridge
+	VhostUserSocket string `json:"vhost_user_socket,omitempty"`
 }
 
 // OverlayType represents the type of network overlay.
@@ -118,8 +175,8 @@ const (
 type DiskSpec struct {
 	Name       string `json:"name"`
 	SizeGB     int64  `json:"size_gb"`
-	Type       string `json:"type"` // ssd, hdd
-	SourcePath string `json:"source_path,omitempty"`
+	Type       string `json:"type"`                  // ssd, hdd
+	SourcePath string `json:"source_path,omitempty"` // Existing image, inside the driver's image directory
 	Boot       bool   `json:"boot,omitempty"`
 }
 
@@ -191,10 +248,85 @@ type Driver interface {
 	// Restart restarts an instance.
 	Restart(ctx context.Context, id string, force bool) error
 
+	// Capabilities returns the optional operations the driver supports.
+	Capabilities() Capabilities
+
 	// Close releases any resources held by the driver.
 	Close() error
 }
 
+// Capabilities lists the optional instance operations a driver supports.
+// Nodes advertise them per instance type, so the server can refuse an
+// operation up front instead of failing on the agent.
+type Capabilities struct {
+	Console     bool `json:"console"`     // Attach to the instance console
+	Exec        bool `json:"exec"`        // Run a command inside the instance
+	Logs        bool `json:"logs"`        // Read the instance's console or stdio log
+	Pause       bool `json:"pause"`       // Freeze and resume in memory (PauseDriver)
+	Suspend     bool `json:"suspend"`     // Suspend to disk (SuspendDriver)
+	Resize      bool `json:"resize"`      // Change cpus and memory (ResizeDriver)
+	Migrate     bool `json:"migrate"`     // Live migrate to another node
+	Diagnostics bool `json:"diagnostics"` // Collect boot diagnostics (DiagnosticsDriver)
+
+	// Runtimes are the container runtimes installed on the node, for
+	// drivers that can run containers under several
+	Runtimes []string `json:"runtimes,omitempty"`
+}
+
+// PauseDriver extends Driver with freezing a running instance in memory.
+type PauseDriver interface {
+	Driver
+
+	// Pause freezes a running instance; it keeps its memory but gets no CPU.
+	Pause(ctx context.Context, id string) error
+
+	// Resume continues a paused instance.
+	Resume(ctx context.Context, id string) error
+}
+
+// SuspendDriver extends Driver with suspending an instance to disk.
+type SuspendDriver interface {
+	Driver
+
+	// Suspend saves the memory of a running or paused instance to disk and
+	// stops it, leaving it StateSuspended. Start restores it.
+	Suspend(ctx context.Context, id string) error
+}
+
+// ResizeDriver extends Driver with changing the CPU and memory of an
+// instance.
+type ResizeDriver interface {
+	Driver
+
+	// Resize sets the vCPUs and memory of an instance; zero leaves a value
+	// unchanged. A running instance is changed live, or left untouched with
+	// ErrRestartRequired if it cannot be. A stopped instance takes the new
+	// size on its next start.
+	Resize(ctx context.Context, id string, cpuCores int, memoryMB int64) error
+}
+
+// CPUSetDriver extends Driver with moving an instance without dedicated
+// cores onto a new set of shared host cores, as cores are dedicated to
+// other instances or released by them.
+type CPUSetDriver interface {
+	Driver
+
+	// SetSharedCPUs confines the vCPUs and emulator threads of an instance
+	// to the given host cores, live if it is running and in its definition.
+	SetSharedCPUs(ctx context.Context, id string, cpus []int) error
+}
+
+// MigrateDriver extends Driver with live migrating an instance to the same
+// driver on another host.
+type MigrateDriver interface {
+	Driver
+
+	// Migrate moves a running instance to the hypervisor at host while it
+	// keeps running. On success the instance runs and is defined on the
+	// target only; on failure it keeps running here.
+	Migrate(ctx context.Context, id, host string) error
+}
+
 // HostInfo contains information about the host.
 type HostInfo struct {
 	Hostname          string `json:"hostname"`
@@ -212,3 +344,30 @@ type HostDriver interface {
 	// GetHostInfo returns information about the host.
 	GetHostInfo(ctx context.Context) (*HostInfo, error)
 }
+
+// ImageInfo describes an image cached on the host.
+type ImageInfo struct {
+	Ref       string    `json:"ref"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PullProgress reports the progress of an image pull. Total is zero while
+// the size is not known yet.
+type PullProgress struct {
+	Status  string
+	Current int64
+	Total   int64
+}
+
+// ImageDriver extends Driver with management of the host's image cache.
+type ImageDriver interface {
+	Driver
+
+	// ListImages returns the images cached on the host.
+	ListImages(ctx context.Context) ([]ImageInfo, error)
+
+	// PullImage fetches an image into the host's cache, reporting progress
+	// to progress if it is not nil. Pulling a cached image is a no-op.
+	PullImage(ctx context.Context, ref string, progress func(PullProgress)) (*ImageInfo, error)
+}
@@ -26,4 +26,8 @@ var (
 
 	// ErrInvalidSpec is returned when the instance spec is invalid.
 	ErrInvalidSpec = errors.New("invalid instance specification")
+
+	// ErrRestartRequired is returned when a change cannot be applied to a
+	// running instance and needs it stopped first.
+	ErrRestartRequired = errors.New("change requires a restart")
 )
@@ -0,0 +1,151 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PCI vendor IDs of the common GPU vendors, accepted by name in requests.
+var gpuVendorIDs = map[string]string{
+	"nvidia": "10de",
+	"amd":    "1002",
+	"intel":  "8086",
+}
+
+// GPURequest asks for GPUs to be passed through to an instance (VM only).
+type GPURequest struct {
+	Count    int    `json:"count,omitempty"`
+	Vendor   string `json:"vendor,omitempty"`    // "nvidia", "amd", "intel" or a PCI vendor ID such as "10de"
+	DeviceID string `json:"device_id,omitempty"` // PCI device ID such as "20b0"; empty accepts any model
+}
+
+// Validate checks that the GPU request is well formed.
+func (r *GPURequest) Validate() error {
+	if r.Count < 0 {
+		return fmt.Errorf("gpu count cannot be negative")
+	}
+	if r.Count == 0 && (r.Vendor != "" || r.DeviceID != "") {
+		return fmt.Errorf("gpu vendor or device given without a gpu count")
+	}
+	if r.Vendor != "" && !isPCIID(r.vendorID()) {
+		return fmt.Errorf("unknown gpu vendor %q", r.Vendor)
+	}
+	if r.DeviceID != "" && !isPCIID(strings.ToLower(r.DeviceID)) {
+		return fmt.Errorf("invalid gpu device id %q (want 4 hex digits)", r.DeviceID)
+	}
+	return nil
+}
+
+// Matches reports whether gpu satisfies the vendor and model of the request.
+func (r *GPURequest) Matches(gpu HostGPU) bool {
+	if r.Vendor != "" && r.vendorID() != gpu.VendorID {
+		return false
+	}
+	return r.DeviceID == "" || strings.ToLower(r.DeviceID) == gpu.DeviceID
+}
+
+func (r *GPURequest) vendorID() string {
+	vendor := strings.ToLower(r.Vendor)
+	if id, ok := gpuVendorIDs[vendor]; ok {
+		return id
+	}
+	return vendor
+}
+
+// HostGPU is a GPU found on a node's PCI bus.
+type HostGPU struct {
+	Address    string `json:"address"`               // PCI address, e.g. "0000:65:00.0"
+	VendorID   string `json:"vendor_id"`             // e.g. "10de"
+	DeviceID   string `json:"device_id"`             // e.g. "20b0"
+	IOMMUGroup int    `json:"iommu_group"`           // -1 without an IOMMU
+	Driver     string `json:"driver,omitempty"`      // Bound host driver, e.g. "vfio-pci"
+	InstanceID string `json:"instance_id,omitempty"` // Instance the GPU is passed through to
+}
+
+// Assignable reports whether the GPU can be passed through, which needs the
+// host IOMMU.
+func (g *HostGPU) Assignable() bool {
+	return g.IOMMUGroup >= 0
+}
+
+// PCI classes of display controllers: VGA (0x0300) and 3D (0x0302).
+var gpuClasses = []string{"0x0300", "0x0302"}
+
+// DetectGPUs lists the display controllers under sysfsRoot (normally "/sys"),
+// sorted by PCI address.
+func DetectGPUs(sysfsRoot string) ([]HostGPU, error) {
+	dir := filepath.Join(sysfsRoot, "bus", "pci", "devices")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list PCI devices: %w", err)
+	}
+
+	var gpus []HostGPU
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		class := readSysfs(filepath.Join(path, "class"))
+		if len(class) < 6 || !containsPrefix(gpuClasses, class[:6]) {
+			continue
+		}
+
+		gpu := HostGPU{
+			Address:    entry.Name(),
+			VendorID:   strings.TrimPrefix(readSysfs(filepath.Join(path, "vendor")), "0x"),
+			DeviceID:   strings.TrimPrefix(readSysfs(filepath.Join(path, "device")), "0x"),
+			IOMMUGroup: iommuGroup(path),
+		}
+		if link, err := os.Readlink(filepath.Join(path, "driver")); err == nil {
+			gpu.Driver = filepath.Base(link)
+		}
+		gpus = append(gpus, gpu)
+	}
+
+	sort.Slice(gpus, func(i, j int) bool { return gpus[i].Address < gpus[j].Address })
+	return gpus, nil
+}
+
+// iommuGroup returns the IOMMU group of the PCI device at path, or -1
+// without an IOMMU.
+func iommuGroup(path string) int {
+	link, err := os.Readlink(filepath.Join(path, "iommu_group"))
+	if err != nil {
+		return -1
+	}
+	group, err := strconv.Atoi(filepath.Base(link))
+	if err != nil {
+		return -1
+	}
+	return group
+}
+
+func readSysfs(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(string(data)))
+}
+
+func containsPrefix(prefixes []string, s string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPCIID(id string) bool {
+	if len(id) != 4 {
+		return false
+	}
+	_, err := strconv.ParseUint(id, 16, 16)
+	return err == nil
+}
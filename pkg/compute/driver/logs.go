@@ -0,0 +1,11 @@
+package driver
+
+import "context"
+
+// LogDriver is implemented by drivers that keep an instance's output in a
+// log file: the serial console of VMs and microVMs, and the stdout and
+// stderr of containers. The file is appended to while the instance runs
+// and may not exist before it first started.
+type LogDriver interface {
+	LogPath(ctx context.Context, id string) (string, error)
+}
@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CPUPlacement controls where an instance's vCPUs and memory are placed on
+// the host (VM only).
+type CPUPlacement struct {
+	DedicatedCores bool `json:"dedicated_cores,omitempty"` // Pin each vCPU to a host core no other instance is pinned to
+	NUMANode       *int `json:"numa_node,omitempty"`       // Preferred host NUMA node
+}
+
+// IsZero returns true if no placement was requested.
+func (p *CPUPlacement) IsZero() bool {
+	return !p.DedicatedCores && p.NUMANode == nil
+}
+
+// Validate checks that the placement is well formed.
+func (p *CPUPlacement) Validate() error {
+	if p.NUMANode != nil && *p.NUMANode < 0 {
+		return fmt.Errorf("numa node cannot be negative")
+	}
+	return nil
+}
+
+// NUMANode is a NUMA node of a host and the cores pinned on it.
+type NUMANode struct {
+	ID          int   `json:"id"`
+	CPUs        []int `json:"cpus"`                   // Host CPU numbers
+	MemoryBytes int64 `json:"memory_bytes,omitempty"` // Memory local to the node
+	PinnedCPUs  int   `json:"pinned_cpus,omitempty"`  // Cores dedicated to instances
+}
+
+// FreeCPUs returns how many of the node's cores are not dedicated to an
+// instance.
+func (n *NUMANode) FreeCPUs() int {
+	return len(n.CPUs) - n.PinnedCPUs
+}
+
+// DetectNUMA reads the host's NUMA topology under sysfsRoot (normally
+// "/sys"), sorted by node ID. A host without NUMA information is reported as
+// a single node holding every online CPU.
+func DetectNUMA(sysfsRoot string) ([]NUMANode, error) {
+	dirs, err := filepath.Glob(filepath.Join(sysfsRoot, "devices", "system", "node", "node[0-9]*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NUMA nodes: %w", err)
+	}
+
+	var nodes []NUMANode
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		cpus, err := ParseCPUList(readSysfs(filepath.Join(dir, "cpulist")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CPUs of NUMA node %d: %w", id, err)
+		}
+		if len(cpus) == 0 {
+			// Memory-only node
+			continue
+		}
+		nodes = append(nodes, NUMANode{
+			ID:          id,
+			CPUs:        cpus,
+			MemoryBytes: nodeMemTotal(filepath.Join(dir, "meminfo")),
+		})
+	}
+
+	if len(nodes) == 0 {
+		online := readSysfs(filepath.Join(sysfsRoot, "devices", "system", "cpu", "online"))
+		if online == "" {
+			return nil, nil
+		}
+		cpus, err := ParseCPUList(online)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse online CPUs: %w", err)
+		}
+		nodes = append(nodes, NUMANode{ID: 0, CPUs: cpus})
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+// nodeMemTotal reads the MemTotal line of a NUMA node's meminfo, which
+// looks like "Node 0 MemTotal:       32768000 kB".
+func nodeMemTotal(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[2] == "MemTotal:" {
+			kb, _ := strconv.ParseInt(fields[3], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// ParseCPUList parses a kernel CPU list such as "0-3,8,10-11".
+func ParseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list entry %q", part)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpu list entry %q", part)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// FormatCPUList formats CPU numbers as a kernel CPU list, e.g. "0-3,8".
+func FormatCPUList(cpus []int) string {
+	sorted := append([]int(nil), cpus...)
+	sort.Ints(sorted)
+
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Container runtimes, named as containerd names their shims. Kata runs each
+// container in a lightweight VM and gVisor (runsc) in a user-space kernel,
+// both isolating it more strongly than runc.
+const (
+	RuntimeRunc  = "io.containerd.runc.v2"
+	RuntimeKata  = "io.containerd.kata.v2"
+	RuntimeRunsc = "io.containerd.runsc.v1"
+)
+
+// runtimeAliases maps short names to the runtimes above.
+var runtimeAliases = map[string]string{
+	"runc":   RuntimeRunc,
+	"kata":   RuntimeKata,
+	"gvisor": RuntimeRunsc,
+	"runsc":  RuntimeRunsc,
+}
+
+// ParseRuntime returns the container runtime named by s, which may be a
+// short name ("runc", "kata", "gvisor") or a containerd runtime name of the
+// form io.containerd.<name>.<version>.
+func ParseRuntime(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if runtime, ok := runtimeAliases[s]; ok {
+		return runtime, nil
+	}
+	if RuntimeShim(s) != "" {
+		return s, nil
+	}
+	aliases := make([]string, 0, len(runtimeAliases))
+	for alias := range runtimeAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return "", fmt.Errorf("unknown container runtime %q (supported: %s, or io.containerd.<name>.<version>)", s, strings.Join(aliases, ", "))
+}
+
+// RuntimeShim returns the shim binary containerd runs for a runtime, e.g.
+// containerd-shim-kata-v2 for io.containerd.kata.v2, or "" if the name is
+// not of that form.
+func RuntimeShim(runtime string) string {
+	parts := strings.Split(runtime, ".")
+	if len(parts) != 4 || parts[0] != "io" || parts[1] != "containerd" || parts[2] == "" || parts[3] == "" {
+		return ""
+	}
+	return "containerd-shim-" + parts[2] + "-" + parts[3]
+}
@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// HostVF is an SR-IOV virtual function found on a node's PCI bus. Handed to
+// an instance, it bypasses the overlay: the guest drives the NIC directly,
+// on the VLAN the physical function tags its traffic with.
+type HostVF struct {
+	Address    string `json:"address"`               // PCI address, e.g. "0000:3b:02.1"
+	PFName     string `json:"pf_name"`               // Network device of the physical function, e.g. "ens1f0"
+	VFIndex    int    `json:"vf_index"`              // Index of the VF on its physical function
+	VendorID   string `json:"vendor_id"`             // e.g. "8086"
+	DeviceID   string `json:"device_id"`             // e.g. "154c"
+	IOMMUGroup int    `json:"iommu_group"`           // -1 without an IOMMU
+	InstanceID string `json:"instance_id,omitempty"` // Instance the VF is passed through to
+}
+
+// Assignable reports whether the VF can be passed through, which needs the
+// host IOMMU.
+func (v *HostVF) Assignable() bool {
+	return v.IOMMUGroup >= 0
+}
+
+// DetectVFs lists the SR-IOV virtual functions under sysfsRoot (normally
+// "/sys"), sorted by PCI address. With physicalFunctions given, only the VFs
+// of those network devices are listed.
+func DetectVFs(sysfsRoot string, physicalFunctions []string) ([]HostVF, error) {
+	dir := filepath.Join(sysfsRoot, "bus", "pci", "devices")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list PCI devices: %w", err)
+	}
+
+	var vfs []HostVF
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		physfn, err := os.Readlink(filepath.Join(path, "physfn"))
+		if err != nil {
+			continue // Not a virtual function
+		}
+		pfPath := filepath.Join(dir, filepath.Base(physfn))
+
+		pfName := firstEntry(filepath.Join(pfPath, "net"))
+		if pfName == "" {
+			continue // The physical function has no network device
+		}
+		if len(physicalFunctions) > 0 && !contains(physicalFunctions, pfName) {
+			continue
+		}
+		index := vfIndex(pfPath, entry.Name())
+		if index < 0 {
+			continue
+		}
+
+		vf := HostVF{
+			Address:    entry.Name(),
+			PFName:     pfName,
+			VFIndex:    index,
+			VendorID:   strings.TrimPrefix(readSysfs(filepath.Join(path, "vendor")), "0x"),
+			DeviceID:   strings.TrimPrefix(readSysfs(filepath.Join(path, "device")), "0x"),
+			IOMMUGroup: iommuGroup(path),
+		}
+		vfs = append(vfs, vf)
+	}
+
+	sort.Slice(vfs, func(i, j int) bool { return vfs[i].Address < vfs[j].Address })
+	return vfs, nil
+}
+
+// vfIndex returns the index of the VF at address on the physical function
+// at pfPath, from the function's virtfn<N> links, or -1.
+func vfIndex(pfPath, address string) int {
+	links, err := filepath.Glob(filepath.Join(pfPath, "virtfn*"))
+	if err != nil {
+		return -1
+	}
+	for _, link := range links {
+		target, err := os.Readlink(link)
+		if err != nil || filepath.Base(target) != address {
+			continue
+		}
+		var index int
+		if _, err := fmt.Sscanf(filepath.Base(link), "virtfn%d", &index); err == nil {
+			return index
+		}
+	}
+	return -1
+}
+
+// firstEntry returns the name of the first entry of dir, or "".
+func firstEntry(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	return entries[0].Name()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
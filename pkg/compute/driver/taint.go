@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Taint effects.
+const (
+	// TaintNoSchedule keeps instances that do not tolerate the taint off
+	// the node. Instances already on it are left alone.
+	TaintNoSchedule = "NoSchedule"
+
+	// TaintPreferNoSchedule makes the scheduler avoid the node for
+	// instances that do not tolerate the taint, unless no other node fits.
+	TaintPreferNoSchedule = "PreferNoSchedule"
+)
+
+// Toleration operators.
+const (
+	TolerationEqual  = "Equal"  // The taint's value must equal the toleration's
+	TolerationExists = "Exists" // Any value of the key is tolerated
+)
+
+// Taint marks a node so that only instances tolerating it are placed there,
+// e.g. to dedicate nodes to a workload.
+type Taint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Effect string `json:"effect"`
+}
+
+// Validate checks that the taint is well formed.
+func (t Taint) Validate() error {
+	if t.Key == "" {
+		return fmt.Errorf("taint key is required")
+	}
+	if strings.ContainsAny(t.Key+t.Value, "=: ,") {
+		return fmt.Errorf("taint %s: key and value cannot contain '=', ':', ',' or spaces", t)
+	}
+	switch t.Effect {
+	case TaintNoSchedule, TaintPreferNoSchedule:
+	default:
+		return fmt.Errorf("taint %s: unknown effect %q, must be %s or %s", t, t.Effect, TaintNoSchedule, TaintPreferNoSchedule)
+	}
+	return nil
+}
+
+// String formats the taint as key=value:Effect.
+func (t Taint) String() string {
+	if t.Value == "" {
+		return t.Key + ":" + t.Effect
+	}
+	return t.Key + "=" + t.Value + ":" + t.Effect
+}
+
+// ToleratedBy reports whether any of the tolerations tolerates the taint.
+func (t Taint) ToleratedBy(tolerations []Toleration) bool {
+	for _, toleration := range tolerations {
+		if toleration.Tolerates(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Toleration lets an instance be placed on nodes with matching taints. An
+// empty key with the Exists operator tolerates every taint; an empty effect
+// matches every effect.
+type Toleration struct {
+	Key      string `json:"key,omitempty"`
+	Operator string `json:"operator,omitempty"` // Equal (default) or Exists
+	Value    string `json:"value,omitempty"`
+	Effect   string `json:"effect,omitempty"`
+}
+
+// Validate checks that the toleration is well formed.
+func (t Toleration) Validate() error {
+	switch t.Operator {
+	case "", TolerationEqual:
+		if t.Key == "" {
+			return fmt.Errorf("toleration with operator %s needs a key", TolerationEqual)
+		}
+	case TolerationExists:
+		if t.Value != "" {
+			return fmt.Errorf("toleration of key %q with operator %s cannot have a value", t.Key, TolerationExists)
+		}
+	default:
+		return fmt.Errorf("toleration of key %q: unknown operator %q, must be %s or %s", t.Key, t.Operator, TolerationEqual, TolerationExists)
+	}
+	switch t.Effect {
+	case "", TaintNoSchedule, TaintPreferNoSchedule:
+	default:
+		return fmt.Errorf("toleration of key %q: unknown effect %q", t.Key, t.Effect)
+	}
+	return nil
+}
+
+// Tolerates reports whether the toleration matches the taint.
+func (t Toleration) Tolerates(taint Taint) bool {
+	if t.Effect != "" && t.Effect != taint.Effect {
+		return false
+	}
+	if t.Operator == TolerationExists {
+		return t.Key == "" || t.Key == taint.Key
+	}
+	return t.Key == taint.Key && t.Value == taint.Value
+}
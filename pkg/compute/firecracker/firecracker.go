@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
@@ -40,28 +41,50 @@ type Config struct {
 
 	// DefaultMemoryMB is the default memory in MB.
 	DefaultMemoryMB int64 `mapstructure:"default_memory_mb"`
+
+	// IntegrationBridge is the OVS bridge microVM tap devices are plugged into.
+	IntegrationBridge string `mapstructure:"integration_bridge"`
 }
 
 // DefaultConfig returns the default Firecracker configuration.
 func DefaultConfig() Config {
 	return Config{
-		BinaryPath:      "/usr/bin/firecracker",
-		KernelPath:      "/var/lib/hypervisor/kernels/vmlinux",
-		RootDrivePath:   "/var/lib/hypervisor/rootfs",
-		SocketPath:      "/var/run/hypervisor/firecracker",
-		LogPath:         "/var/log/hypervisor/firecracker",
-		DefaultVCPUs:    1,
-		DefaultMemoryMB: 512,
+		BinaryPath:        "/usr/bin/firecracker",
+		KernelPath:        "/var/lib/hypervisor/kernels/vmlinux",
+		RootDrivePath:     "/var/lib/hypervisor/rootfs",
+		SocketPath:        "/var/run/hypervisor/firecracker",
+		LogPath:           "/var/log/hypervisor/firecracker",
+		DefaultVCPUs:      1,
+		DefaultMemoryMB:   512,
+		IntegrationBridge: "br-int",
 	}
 }
 
+// mmdsAddress is where guests reach MMDS, the same address as the node's
+// metadata service so images need no per-driver configuration.
+const mmdsAddress = "169.254.169.254"
+
 // VMInstance represents a running Firecracker VM.
 type VMInstance struct {
 	ID        string
 	Machine   *firecracker.Machine
 	Spec      driver.InstanceSpec
+	TapDevice string // Empty without a network interface
 	CreatedAt time.Time
 	StartedAt *time.Time
+	Paused    bool
+}
+
+// state returns the driver state of the microVM.
+func (v *VMInstance) state() driver.InstanceState {
+	switch {
+	case v.StartedAt == nil:
+		return driver.StateStopped
+	case v.Paused:
+		return driver.StatePaused
+	default:
+		return driver.StateRunning
+	}
 }
 
 // Driver implements the compute driver interface using Firecracker.
@@ -119,6 +142,10 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	if _, err := driver.GuestArchitecture(spec); err != nil {
+		return nil, err
+	}
+
 	// Generate VM ID
 	vmID := uuid.New().String()
 
@@ -146,7 +173,7 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 
 	// Socket and log paths
 	socketPath := filepath.Join(d.config.SocketPath, vmID+".sock")
-	logPath := filepath.Join(d.config.LogPath, vmID+".log")
+	logPath := d.logPath(vmID)
 
 	// Create log file
 	logFile, err := os.Create(logPath)
@@ -154,6 +181,24 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 		return nil, fmt.Errorf("failed to create log file: %w", err)
 	}
 
+	// Plug a tap device into the integration bridge for the SDN port
+	var tap string
+	if spec.Network.PortID != "" || spec.Network.NetworkID != "" {
+		if tap, err = d.createTap(vmID, &spec.Network); err != nil {
+			logFile.Close()
+			return nil, err
+		}
+	}
+	fail := func(err error) (*driver.Instance, error) {
+		logFile.Close()
+		if tap != "" {
+			if cleanupErr := d.deleteTap(tap); cleanupErr != nil {
+				d.logger.Warn("failed to delete tap", zap.String("tap", tap), zap.Error(cleanupErr))
+			}
+		}
+		return nil, err
+	}
+
 	// Build Firecracker configuration
 	fcCfg := firecracker.Config{
 		SocketPath:      socketPath,
@@ -176,15 +221,13 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 		LogLevel: "Warning",
 	}
 
-	// Add network interface if specified
-	if spec.Network.NetworkID != "" {
-		// For simplicity, we'll use a TAP device
-		// In production, this would integrate with the networking layer
+	// Attach the tap device
+	if tap != "" {
 		fcCfg.NetworkInterfaces = []firecracker.NetworkInterface{
 			{
 				StaticConfiguration: &firecracker.StaticNetworkConfiguration{
 					MacAddress:  spec.Network.MACAddress,
-					HostDevName: spec.Network.NetworkID,
+					HostDevName: tap,
 				},
 			},
 		}
@@ -195,6 +238,17 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 		fcCfg.KernelArgs = "console=ttyS0 reboot=k panic=1 pci=off"
 	}
 
+	// Serve the cloud-init NoCloud seed from MMDS on the first interface
+	cloudInit := spec.HasCloudInit()
+	if cloudInit {
+		if len(fcCfg.NetworkInterfaces) == 0 {
+			return fail(fmt.Errorf("%w: user data and SSH keys need a network interface for MMDS", driver.ErrInvalidSpec))
+		}
+		fcCfg.NetworkInterfaces[0].AllowMMDS = true
+		fcCfg.MmdsAddress = net.ParseIP(mmdsAddress)
+		fcCfg.KernelArgs += " ds=nocloud-net;s=http://" + mmdsAddress + "/"
+	}
+
 	// Create the machine
 	cmd := firecracker.VMCommandBuilder{}.
 		WithBin(d.config.BinaryPath).
@@ -209,15 +263,23 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 
 	machine, err := firecracker.NewMachine(ctx, fcCfg, machineOpts...)
 	if err != nil {
-		logFile.Close()
-		return nil, fmt.Errorf("failed to create machine: %w", err)
+		return fail(fmt.Errorf("failed to create machine: %w", err))
+	}
+	if cloudInit {
+		machine.Handlers.FcInit = machine.Handlers.FcInit.Append(
+			firecracker.NewSetMetadataHandler(mmdsSeed(vmID, spec)),
+		)
 	}
 
+	// Report the device so the agent can bind the port to it
+	spec.Network.DeviceName = tap
+
 	now := time.Now()
 	vmInstance := &VMInstance{
 		ID:        vmID,
 		Machine:   machine,
 		Spec:      *spec,
+		TapDevice: tap,
 		CreatedAt: now,
 	}
 
@@ -283,6 +345,7 @@ func (d *Driver) Stop(ctx context.Context, id string, force bool) error {
 	}
 
 	vmInstance.StartedAt = nil
+	vmInstance.Paused = false
 
 	d.logger.Info("microVM stopped", zap.String("id", id), zap.Bool("force", force))
 	return nil
@@ -307,6 +370,13 @@ func (d *Driver) Delete(ctx context.Context, id string) error {
 	socketPath := filepath.Join(d.config.SocketPath, id+".sock")
 	os.Remove(socketPath)
 
+	// Unplug and delete the tap device
+	if vmInstance.TapDevice != "" {
+		if err := d.deleteTap(vmInstance.TapDevice); err != nil {
+			d.logger.Warn("failed to delete tap", zap.String("id", id), zap.Error(err))
+		}
+	}
+
 	delete(d.instances, id)
 
 	d.logger.Info("microVM deleted", zap.String("id", id))
@@ -323,16 +393,11 @@ func (d *Driver) Get(ctx context.Context, id string) (*driver.Instance, error) {
 		return nil, driver.ErrInstanceNotFound
 	}
 
-	state := driver.StateStopped
-	if vmInstance.StartedAt != nil {
-		state = driver.StateRunning
-	}
-
 	return &driver.Instance{
 		ID:        vmInstance.ID,
 		Name:      vmInstance.ID,
 		Type:      driver.InstanceTypeMicroVM,
-		State:     state,
+		State:     vmInstance.state(),
 		CreatedAt: vmInstance.CreatedAt,
 		StartedAt: vmInstance.StartedAt,
 		Spec:      vmInstance.Spec,
@@ -346,16 +411,11 @@ func (d *Driver) List(ctx context.Context) ([]*driver.Instance, error) {
 
 	instances := make([]*driver.Instance, 0, len(d.instances))
 	for _, vmInstance := range d.instances {
-		state := driver.StateStopped
-		if vmInstance.StartedAt != nil {
-			state = driver.StateRunning
-		}
-
 		instances = append(instances, &driver.Instance{
 			ID:        vmInstance.ID,
 			Name:      vmInstance.ID,
 			Type:      driver.InstanceTypeMicroVM,
-			State:     state,
+			State:     vmInstance.state(),
 			CreatedAt: vmInstance.CreatedAt,
 			StartedAt: vmInstance.StartedAt,
 			Spec:      vmInstance.Spec,
@@ -383,12 +443,102 @@ func (d *Driver) Stats(ctx context.Context, id string) (*driver.InstanceStats, e
 	}, nil
 }
 
+// Pause pauses a running microVM.
+func (d *Driver) Pause(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vmInstance, ok := d.instances[id]
+	if !ok {
+		return driver.ErrInstanceNotFound
+	}
+	if vmInstance.StartedAt == nil {
+		return driver.ErrInstanceStopped
+	}
+
+	if err := vmInstance.Machine.PauseVM(ctx); err != nil {
+		return fmt.Errorf("failed to pause machine: %w", err)
+	}
+	vmInstance.Paused = true
+
+	d.logger.Info("microVM paused", zap.String("id", id))
+	return nil
+}
+
+// Resume resumes a paused microVM.
+func (d *Driver) Resume(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vmInstance, ok := d.instances[id]
+	if !ok {
+		return driver.ErrInstanceNotFound
+	}
+	if vmInstance.StartedAt == nil {
+		return driver.ErrInstanceStopped
+	}
+
+	if err := vmInstance.Machine.ResumeVM(ctx); err != nil {
+		return fmt.Errorf("failed to resume machine: %w", err)
+	}
+	vmInstance.Paused = false
+
+	d.logger.Info("microVM resumed", zap.String("id", id))
+	return nil
+}
+
 // Attach attaches to a microVM's serial console.
 func (d *Driver) Attach(ctx context.Context, id string, opts driver.AttachOptions) (io.ReadWriteCloser, error) {
 	// Firecracker serial console access would require connecting to the PTY
 	return nil, driver.ErrNotSupported
 }
 
+// BootDiagnostics reads the end of a microVM's serial console, which is
+// written to its log file. Firecracker has no display to screenshot.
+func (d *Driver) BootDiagnostics(ctx context.Context, id string, lines int) (*driver.BootDiagnostics, error) {
+	d.mu.RLock()
+	_, ok := d.instances[id]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, driver.ErrInstanceNotFound
+	}
+
+	serial, err := driver.TailLines(d.logPath(id), lines)
+	if err != nil {
+		return nil, err
+	}
+	return &driver.BootDiagnostics{
+		SerialOutput: serial,
+		CollectedAt:  time.Now(),
+	}, nil
+}
+
+// LogPath returns the log file a microVM's serial console is written to.
+func (d *Driver) LogPath(ctx context.Context, id string) (string, error) {
+	d.mu.RLock()
+	_, ok := d.instances[id]
+	d.mu.RUnlock()
+	if !ok {
+		return "", driver.ErrInstanceNotFound
+	}
+	return d.logPath(id), nil
+}
+
+func (d *Driver) logPath(id string) string {
+	return filepath.Join(d.config.LogPath, id+".log")
+}
+
+// Capabilities returns the optional operations the driver supports. The
+// serial console is not exposed yet, and microVMs cannot be resized,
+// suspended to disk or migrated.
+func (d *Driver) Capabilities() driver.Capabilities {
+	return driver.Capabilities{
+		Logs:        true,
+		Pause:       true,
+		Diagnostics: true,
+	}
+}
+
 // Restart restarts a microVM.
 func (d *Driver) Restart(ctx context.Context, id string, force bool) error {
 	if err := d.Stop(ctx, id, force); err != nil {
@@ -415,3 +565,10 @@ func (d *Driver) Close() error {
 	d.logger.Info("firecracker driver closed")
 	return nil
 }
+
+// mmdsSeed returns the MMDS contents laid out as a NoCloud seed, so
+// cloud-init's nocloud-net datasource fetches meta-data, user-data and
+// network-config from the MMDS root.
+func mmdsSeed(vmID string, spec *driver.InstanceSpec) map[string]string {
+	return driver.NoCloudSeed(vmID, spec)
+}
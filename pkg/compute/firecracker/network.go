@@ -0,0 +1,89 @@
+package firecracker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/network/cgo"
+
+	"github.com/vishvananda/netlink"
+)
+
+// tapPrefix starts the names of the tap devices created for microVMs.
+const tapPrefix = "fctap"
+
+// tapName returns the tap device name of a VM, within the 15 characters
+// allowed for interface names.
+func tapName(vmID string) string {
+	return tapPrefix + strings.ReplaceAll(vmID, "-", "")[:8]
+}
+
+// createTap creates a persistent tap device for a VM, brings it up and plugs
+// it into the integration bridge. The interface's external_ids identify the
+// SDN port, so the flows installed for the port apply to it.
+func (d *Driver) createTap(vmID string, netSpec *driver.NetworkSpec) (string, error) {
+	name := tapName(vmID)
+
+	tap := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		// Firecracker opens the device with these flags
+		Flags: netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR,
+	}
+	if netSpec.MTU > 0 {
+		tap.MTU = int(netSpec.MTU)
+	}
+	if err := netlink.LinkAdd(tap); err != nil {
+		return "", fmt.Errorf("failed to create tap %s: %w", name, err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		err = netlink.LinkSetUp(link)
+	}
+	if err != nil {
+		d.deleteTap(name)
+		return "", fmt.Errorf("failed to bring up tap %s: %w", name, err)
+	}
+
+	externalIDs := map[string]string{
+		"external_ids:vm-id":        vmID,
+		"external_ids:iface-status": "active",
+	}
+	if netSpec.PortID != "" {
+		externalIDs["external_ids:iface-id"] = netSpec.PortID
+	}
+	if netSpec.MACAddress != "" {
+		externalIDs["external_ids:attached-mac"] = netSpec.MACAddress
+	}
+
+	bridge := d.config.IntegrationBridge
+	if err := cgo.NewOVSBridge(bridge).AddPort(bridge, name, externalIDs); err != nil {
+		d.deleteTap(name)
+		return "", fmt.Errorf("failed to plug tap %s into %s: %w", name, bridge, err)
+	}
+
+	return name, nil
+}
+
+// deleteTap unplugs a VM's tap device from the integration bridge and
+// deletes it. Missing devices are ignored.
+func (d *Driver) deleteTap(name string) error {
+	bridge := d.config.IntegrationBridge
+	var errs []error
+	if err := cgo.NewOVSBridge(bridge).DeletePort(bridge, name); err != nil {
+		errs = append(errs, err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		err = netlink.LinkDel(link)
+	}
+	var notFound netlink.LinkNotFoundError
+	if err != nil && !errors.As(err, &notFound) {
+		errs = append(errs, fmt.Errorf("failed to delete tap %s: %w", name, err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,102 @@
+package libvirt
+
+import (
+	"fmt"
+
+	"hypervisor/pkg/compute/driver"
+)
+
+// guestArch describes how domains of one CPU architecture are defined.
+type guestArch struct {
+	Arch     string // libvirt's name, e.g. x86_64
+	Machine  string // QEMU machine type
+	Emulator string // QEMU binary
+
+	// Firmware is the <os> firmware attribute; "efi" has libvirt pick the
+	// UEFI build and create the domain's NVRAM
+	Firmware string
+
+	// Features are the <features> children
+	Features string
+
+	// DefaultCPUMode replaces an unset CPU mode; KVM on arm only runs
+	// host-passthrough
+	DefaultCPUMode driver.CPUMode
+
+	// LegacyTimers adds the x86 rtc, pit and hpet timer tuning
+	LegacyTimers bool
+
+	// CDROMBus and CDROMDev attach the cloud-init seed. The arm virt
+	// machine has no IDE; libvirt adds a SCSI controller when a disk needs
+	// one and the domain has none.
+	CDROMBus string
+	CDROMDev string
+}
+
+var guestArches = map[string]guestArch{
+	driver.ArchAMD64: {
+		Arch:         "x86_64",
+		Machine:      "pc",
+		Emulator:     "/usr/bin/qemu-system-x86_64",
+		Features:     "<acpi/>\n    <apic/>",
+		LegacyTimers: true,
+		CDROMBus:     "ide",
+		CDROMDev:     "hdc",
+	},
+	driver.ArchARM64: {
+		Arch:           "aarch64",
+		Machine:        "virt",
+		Emulator:       "/usr/bin/qemu-system-aarch64",
+		Firmware:       "efi",
+		Features:       "<acpi/>\n    <gic version='host'/>",
+		DefaultCPUMode: driver.CPUModeHostPassthrough,
+		CDROMBus:       "scsi",
+		CDROMDev:       "sdz",
+	},
+}
+
+// guestArchFor returns how to define a guest of spec's architecture. KVM
+// runs guests of the host's architecture only; the scheduler places
+// instances on nodes of their architecture.
+func guestArchFor(spec *driver.InstanceSpec) (guestArch, error) {
+	arch, err := driver.GuestArchitecture(spec)
+	if err != nil {
+		return guestArch{}, err
+	}
+	g, ok := guestArches[arch]
+	if !ok {
+		return guestArch{}, fmt.Errorf("%w: %s guests are not supported", driver.ErrInvalidSpec, arch)
+	}
+	return g, nil
+}
+
+// osXML returns the domain's <os> element.
+func (g guestArch) osXML() string {
+	firmware := ""
+	if g.Firmware != "" {
+		firmware = fmt.Sprintf(" firmware='%s'", g.Firmware)
+	}
+	return fmt.Sprintf(`<os%s>
+    <type arch='%s' machine='%s'>hvm</type>
+  </os>`, firmware, g.Arch, g.Machine)
+}
+
+// cpuSpec returns spec with the architecture's default CPU mode applied.
+func (g guestArch) cpuSpec(spec driver.CPUSpec) driver.CPUSpec {
+	if spec.Mode == "" && g.DefaultCPUMode != "" {
+		spec.Mode = g.DefaultCPUMode
+	}
+	return spec
+}
+
+// clockXML returns the domain's <clock> element.
+func (g guestArch) clockXML() string {
+	if !g.LegacyTimers {
+		return "<clock offset='utc'/>"
+	}
+	return `<clock offset='utc'>
+    <timer name='rtc' tickpolicy='catchup'/>
+    <timer name='pit' tickpolicy='delay'/>
+    <timer name='hpet' present='no'/>
+  </clock>`
+}
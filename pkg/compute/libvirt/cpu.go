@@ -0,0 +1,164 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+
+	"hypervisor/pkg/compute/driver"
+)
+
+// cpuXML generates the domain <cpu> element for a CPU selection, with the
+// guest NUMA topology numa if not empty. Feature names are passed through as
+// given (libvirt spelling, e.g. "avx512f").
+func cpuXML(spec driver.CPUSpec, numa string) string {
+	var b strings.Builder
+
+	switch spec.Mode {
+	case driver.CPUModeHostPassthrough:
+		b.WriteString("<cpu mode='host-passthrough' check='none' migratable='on'")
+	case driver.CPUModeCustom:
+		// Forbid fallback so that every host in a migration pool presents
+		// exactly the same model
+		b.WriteString("<cpu mode='custom' match='exact' check='partial'>\n")
+		fmt.Fprintf(&b, "    <model fallback='forbid'>%s</model>", escapeXML(spec.Model))
+	default:
+		b.WriteString("<cpu mode='host-model'")
+	}
+
+	if len(spec.RequiredFeatures) == 0 && len(spec.DisabledFeatures) == 0 && numa == "" {
+		if spec.Mode == driver.CPUModeCustom {
+			b.WriteString("\n  </cpu>")
+		} else {
+			b.WriteString("/>")
+		}
+		return b.String()
+	}
+
+	if spec.Mode != driver.CPUModeCustom {
+		b.WriteString(">")
+	}
+	for _, f := range spec.RequiredFeatures {
+		fmt.Fprintf(&b, "\n    <feature policy='require' name='%s'/>", escapeXML(f))
+	}
+	for _, f := range spec.DisabledFeatures {
+		fmt.Fprintf(&b, "\n    <feature policy='disable' name='%s'/>", escapeXML(f))
+	}
+	if numa != "" {
+		b.WriteString("\n    " + numa)
+	}
+	b.WriteString("\n  </cpu>")
+
+	return b.String()
+}
+
+// escapeXML escapes a string for use in XML text or attribute values.
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// placementXML generates the <cputune> element pinning each vCPU to its
+// dedicated host core, and the <numatune> element placing guest memory on
+// the instance's NUMA nodes. The result starts with a newline so it can
+// follow the <vcpu> element directly.
+func placementXML(spec *driver.InstanceSpec) string {
+	var b strings.Builder
+	if len(spec.PinnedCPUs) > 0 {
+		b.WriteString("\n  <cputune>")
+		for vcpu, cpu := range spec.PinnedCPUs {
+			fmt.Fprintf(&b, "\n    <vcpupin vcpu='%d' cpuset='%d'/>", vcpu, cpu)
+		}
+		// Keep QEMU's own threads off other instances' cores
+		fmt.Fprintf(&b, "\n    <emulatorpin cpuset='%s'/>", driver.FormatCPUList(spec.PinnedCPUs))
+		b.WriteString("\n  </cputune>")
+	}
+
+	// A single node is preferred rather than enforced so the guest is not
+	// killed when the node runs out of memory; several are interleaved
+	switch len(spec.NUMANodes) {
+	case 0:
+	case 1:
+		fmt.Fprintf(&b, "\n  <numatune>\n    <memory mode='preferred' nodeset='%d'/>\n  </numatune>", spec.NUMANodes[0])
+	default:
+		fmt.Fprintf(&b, "\n  <numatune>\n    <memory mode='interleave' nodeset='%s'/>\n  </numatune>",
+			driver.FormatCPUList(spec.NUMANodes))
+	}
+	return b.String()
+}
+
+// vcpuCPUSetXML returns the cpuset attribute of the <vcpu> element keeping
+// a VM without dedicated cores on the node's shared cores, or "".
+func vcpuCPUSetXML(spec *driver.InstanceSpec) string {
+	if len(spec.PinnedCPUs) > 0 || len(spec.SharedCPUs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" cpuset='%s'", driver.FormatCPUList(spec.SharedCPUs))
+}
+
+// domainPlacement returns the host cores a domain's vCPUs are pinned to, in
+// vCPU order, or else the shared cores they run on, and the NUMA nodes its
+// memory is placed on, from its XML description.
+func domainPlacement(domainXML string) (pinned, shared, numaNodes []int) {
+	var dom struct {
+		VCPU struct {
+			CPUSet string `xml:"cpuset,attr"`
+		} `xml:"vcpu"`
+		VCPUPins []struct {
+			VCPU   int    `xml:"vcpu,attr"`
+			CPUSet string `xml:"cpuset,attr"`
+		} `xml:"cputune>vcpupin"`
+		Memory struct {
+			NodeSet string `xml:"nodeset,attr"`
+		} `xml:"numatune>memory"`
+	}
+	if err := xml.Unmarshal([]byte(domainXML), &dom); err != nil {
+		return nil, nil, nil
+	}
+
+	if dom.Memory.NodeSet != "" {
+		numaNodes, _ = driver.ParseCPUList(dom.Memory.NodeSet)
+	}
+
+	sort.Slice(dom.VCPUPins, func(i, j int) bool { return dom.VCPUPins[i].VCPU < dom.VCPUPins[j].VCPU })
+	for _, pin := range dom.VCPUPins {
+		cpus, err := driver.ParseCPUList(pin.CPUSet)
+		if err != nil {
+			return nil, nil, numaNodes
+		}
+		if len(cpus) != 1 {
+			// Only dedicated cores are pinned one to one; SetSharedCPUs
+			// pins every vCPU to all the shared cores
+			return nil, cpus, numaNodes
+		}
+		pinned = append(pinned, cpus[0])
+	}
+	if pinned == nil && dom.VCPU.CPUSet != "" {
+		shared, _ = driver.ParseCPUList(dom.VCPU.CPUSet)
+	}
+	return pinned, shared, numaNodes
+}
+
+// memoryBackingXML generates the domain <memoryBacking> element, or an
+// empty string for regular memory. The result starts with a newline so it
+// can follow the <vcpu> element directly.
+func memoryBackingXML(spec *driver.InstanceSpec) string {
+	if !spec.HugePages {
+		return ""
+	}
+	return "\n  <memoryBacking>\n    <hugepages/>\n  </memoryBacking>"
+}
+
+// sharedMemoryNUMAXML generates a guest <numa> element with a single cell
+// whose memory is shared with other host processes, which a vhost-user NIC
+// needs for Open vSwitch to reach the guest's buffers; "" otherwise.
+func sharedMemoryNUMAXML(spec *driver.InstanceSpec) string {
+	if spec.Network.VhostUserSocket == "" {
+		return ""
+	}
+	return fmt.Sprintf("<numa>\n      <cell id='0' cpus='0-%d' memory='%d' unit='KiB' memAccess='shared'/>\n    </numa>",
+		spec.CPUCores-1, spec.MemoryMB*1024)
+}
@@ -0,0 +1,130 @@
+package libvirt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// consoleLogDir is the subdirectory of the image directory holding the
+// serial console logs of domains.
+const consoleLogDir = "console"
+
+// consoleLogPath returns where the serial console output of a domain is
+// logged.
+func consoleLogPath(imageDir, name string) string {
+	return filepath.Join(imageDir, consoleLogDir, name+".log")
+}
+
+// consoleXML generates the serial console element, logging its output to
+// logPath so it can be read back for boot diagnostics.
+func consoleXML(logPath string) string {
+	return fmt.Sprintf(`
+    <serial type='pty'>
+      <target port='0'/>
+      <log file='%s' append='on'/>
+    </serial>
+    <console type='pty'>
+      <target type='serial' port='0'/>
+    </console>`, logPath)
+}
+
+// removeConsoleLog deletes a domain's console log.
+func removeConsoleLog(imageDir, name string) error {
+	err := os.Remove(consoleLogPath(imageDir, name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove console log: %w", err)
+	}
+	return nil
+}
+
+// ppmToPNG re-encodes a binary PPM (P6) image, the format QEMU screenshots
+// are taken in, as PNG.
+func ppmToPNG(data []byte) ([]byte, error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+
+	var magic string
+	var width, height, maxVal int
+	for i, v := range []any{&magic, &width, &height, &maxVal} {
+		if err := ppmToken(r, v); err != nil {
+			return nil, fmt.Errorf("invalid PPM header field %d: %w", i, err)
+		}
+	}
+	if magic != "P6" {
+		return nil, fmt.Errorf("unsupported PPM format %q", magic)
+	}
+	if width <= 0 || height <= 0 || maxVal <= 0 || maxVal > 255 {
+		return nil, fmt.Errorf("unsupported PPM dimensions %dx%d (max %d)", width, height, maxVal)
+	}
+	// A single whitespace byte separates the header from the pixels
+	if _, err := r.ReadByte(); err != nil {
+		return nil, fmt.Errorf("truncated PPM header: %w", err)
+	}
+
+	pixels := make([]byte, width*height*3)
+	if _, err := io.ReadFull(r, pixels); err != nil {
+		return nil, fmt.Errorf("truncated PPM data: %w", err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		img.Set(i%width, i/width, color.RGBA{
+			R: uint8(int(pixels[3*i]) * 255 / maxVal),
+			G: uint8(int(pixels[3*i+1]) * 255 / maxVal),
+			B: uint8(int(pixels[3*i+2]) * 255 / maxVal),
+			A: 255,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ppmToken reads the next whitespace-separated header token into v,
+// skipping "#" comments.
+func ppmToken(r *bufio.Reader, v any) error {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == '#':
+			if _, err := r.ReadString('\n'); err != nil {
+				return err
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			if err := r.UnreadByte(); err != nil {
+				return err
+			}
+			var token []byte
+			for {
+				c, err := r.ReadByte()
+				if err != nil {
+					return err
+				}
+				if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+					// Leave the separator after the last field for the caller
+					if err := r.UnreadByte(); err != nil {
+						return err
+					}
+					break
+				}
+				token = append(token, c)
+			}
+			_, err := fmt.Sscan(string(token), v)
+			return err
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"hypervisor/pkg/compute/driver"
+
+	"github.com/google/uuid"
+)
+
+// diskDir is the subdirectory of the image directory holding domain disks.
+const diskDir = "disks"
+
+// domainNamespace derives the UUIDs of domains whose instance ID is not a
+// UUID itself.
+var domainNamespace = uuid.MustParse("5c1b8f0e-8d4e-4f3a-9b57-3f0c6a2e9d41")
+
+// domainIdentity returns the domain name and UUID of an instance. The domain
+// is named after the control-plane instance ID, so the registry and libvirt
+// agree on it; instances created without one get a random ID.
+func domainIdentity(instanceID string) (string, string) {
+	if instanceID == "" {
+		id := uuid.NewString()
+		return id, id
+	}
+	if id, err := uuid.Parse(instanceID); err == nil {
+		return instanceID, id.String()
+	}
+	return instanceID, uuid.NewSHA1(domainNamespace, []byte(instanceID)).String()
+}
+
+// diskPath returns where the root disk of a domain is stored.
+func diskPath(imageDir, name string) string {
+	return filepath.Join(imageDir, diskDir, name+imageExt)
+}
+
+// createDisk creates a domain's root disk as a qcow2 overlay backed by the
+// image, so the image itself is never written to and is shared by every
+// domain booted from it. A sizeGB larger than the image grows the disk's
+// virtual size; a smaller one is ignored.
+func createDisk(ctx context.Context, imageDir, image, name string, sizeGB int64) (string, error) {
+	imgName, _, err := imageName(image)
+	if err != nil {
+		return "", err
+	}
+	backing := filepath.Join(imageDir, imgName+imageExt)
+	if _, err := os.Stat(backing); err != nil {
+		return "", fmt.Errorf("image %s is not available: %w", image, err)
+	}
+
+	target := diskPath(imageDir, name)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create disk directory: %w", err)
+	}
+
+	info, err := driver.InspectDiskImage(ctx, backing, "qcow2")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"create", "-f", "qcow2", "-F", "qcow2", "-b", backing, target}
+	if size := driver.OverlaySize(info, sizeGB); size != "" {
+		args = append(args, size)
+	}
+	cmd := exec.CommandContext(ctx, "qemu-img", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(target)
+		return "", fmt.Errorf("failed to create disk: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return target, nil
+}
+
+// removeDisk deletes a domain's root disk, if it has one.
+func removeDisk(imageDir, name string) error {
+	err := os.Remove(diskPath(imageDir, name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove disk: %w", err)
+	}
+	return nil
+}
+
+// diskNamePattern restricts disk names, which become file names.
+var diskNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// domainDisk is a disk as attached to a domain.
+type domainDisk struct {
+	Path   string
+	Format string // qcow2 or raw
+	Bus    string // virtio or scsi
+	Dev    string // Target device, e.g. vdb
+	SSD    bool
+	Boot   int // Boot order, 0 if not booted from
+}
+
+// dataDiskDir returns the directory holding the disks created for a
+// domain's DiskSpecs.
+func dataDiskDir(imageDir, name string) string {
+	return filepath.Join(imageDir, diskDir, name)
+}
+
+// provisionDisks lays out a domain's disks: the root disk cloned from the
+// image (if any) followed by the spec's disks. Disks without a source path
+// are created as empty qcow2 volumes of the requested size; source paths
+// must lie inside the image directory. SSDs go on the
+// virtio-scsi bus so the guest sees them as non-rotational and can discard;
+// other disks go on virtio-blk. Disks flagged Boot are booted from first,
+// then the root disk.
+func provisionDisks(ctx context.Context, imageDir, name, root string, specs []driver.DiskSpec) ([]domainDisk, error) {
+	var (
+		disks []domainDisk
+		names = make(map[string]bool)
+		next  = map[string]int{"virtio": 0, "scsi": 0}
+	)
+	attach := func(disk domainDisk) {
+		prefix := "vd"
+		if disk.Bus == "scsi" {
+			prefix = "sd"
+		}
+		disk.Dev = prefix + diskLetters(next[disk.Bus])
+		next[disk.Bus]++
+		disks = append(disks, disk)
+	}
+
+	if root != "" {
+		attach(domainDisk{Path: root, Format: "qcow2", Bus: "virtio"})
+	}
+
+	fail := func(err error) ([]domainDisk, error) {
+		removeDataDisks(imageDir, name)
+		return nil, err
+	}
+
+	for i, spec := range specs {
+		diskName := spec.Name
+		if diskName == "" {
+			diskName = fmt.Sprintf("disk%d", i)
+		}
+		if !diskNamePattern.MatchString(diskName) {
+			return fail(fmt.Errorf("invalid disk name %q", diskName))
+		}
+		if names[diskName] {
+			return fail(fmt.Errorf("duplicate disk name %q", diskName))
+		}
+		names[diskName] = true
+
+		disk := domainDisk{Bus: "virtio", Format: "qcow2"}
+		switch spec.Type {
+		case "", "hdd":
+		case "ssd":
+			disk.Bus, disk.SSD = "scsi", true
+		default:
+			return fail(fmt.Errorf("disk %s: unsupported type %q", diskName, spec.Type))
+		}
+
+		if spec.SourcePath != "" {
+			path, image, err := driver.ResolveSourceDisk(ctx, imageDir, spec.SourcePath)
+			if err != nil {
+				return fail(fmt.Errorf("disk %s: %w", diskName, err))
+			}
+			disk.Path, disk.Format = path, image.Format
+		} else {
+			if spec.SizeGB <= 0 {
+				return fail(fmt.Errorf("disk %s: size or source path is required", diskName))
+			}
+			path, err := createDataDisk(ctx, imageDir, name, diskName, spec.SizeGB)
+			if err != nil {
+				return fail(fmt.Errorf("disk %s: %w", diskName, err))
+			}
+			disk.Path = path
+		}
+
+		if spec.Boot {
+			disk.Boot = -1 // Numbered below
+		}
+		attach(disk)
+	}
+
+	// Boot disks first, in spec order, then the root disk
+	order := 1
+	for i := range disks {
+		if disks[i].Boot < 0 {
+			disks[i].Boot = order
+			order++
+		}
+	}
+	if root != "" {
+		disks[0].Boot = order
+	}
+	return disks, nil
+}
+
+// bootable reports whether any disk is booted from.
+func bootable(disks []domainDisk) bool {
+	for _, disk := range disks {
+		if disk.Boot > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// createDataDisk creates an empty qcow2 volume for one of a domain's disks.
+func createDataDisk(ctx context.Context, imageDir, name, diskName string, sizeGB int64) (string, error) {
+	dir := dataDiskDir(imageDir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create disk directory: %w", err)
+	}
+
+	target := filepath.Join(dir, diskName+imageExt)
+	cmd := exec.CommandContext(ctx, "qemu-img", "create", "-f", "qcow2", target, fmt.Sprintf("%dG", sizeGB))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(target)
+		return "", fmt.Errorf("failed to create disk: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return target, nil
+}
+
+// removeDataDisks deletes the disks created for a domain's DiskSpecs.
+// Disks attached from a source path are left alone.
+func removeDataDisks(imageDir, name string) error {
+	if err := os.RemoveAll(dataDiskDir(imageDir, name)); err != nil {
+		return fmt.Errorf("failed to remove data disks: %w", err)
+	}
+	return nil
+}
+
+// diskLetters returns the device suffix of the nth disk on a bus: a, b, ...,
+// z, aa, ab, ...
+func diskLetters(n int) string {
+	suffix := ""
+	for n++; n > 0; n = (n - 1) / 26 {
+		suffix = string(rune('a'+(n-1)%26)) + suffix
+	}
+	return suffix
+}
+
+// disksXML returns the domain's disk devices, plus the virtio-scsi
+// controller if any disk is on the SCSI bus.
+func disksXML(disks []domainDisk) string {
+	var b strings.Builder
+	scsi := false
+	for _, disk := range disks {
+		fmt.Fprintf(&b, `
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='%s'`, disk.Format)
+		if disk.SSD {
+			b.WriteString(` discard='unmap'`)
+		}
+		b.WriteString("/>\n      <source file='")
+		xml.EscapeText(&b, []byte(disk.Path))
+		fmt.Fprintf(&b, "'/>\n      <target dev='%s' bus='%s'", disk.Dev, disk.Bus)
+		if disk.SSD {
+			b.WriteString(` rotation_rate='1'`)
+		}
+		b.WriteString("/>")
+		if disk.Boot > 0 {
+			fmt.Fprintf(&b, "\n      <boot order='%d'/>", disk.Boot)
+		}
+		b.WriteString("\n    </disk>")
+		scsi = scsi || disk.Bus == "scsi"
+	}
+	if scsi {
+		b.WriteString("\n    <controller type='scsi' model='virtio-scsi'/>")
+	}
+	return b.String()
+}
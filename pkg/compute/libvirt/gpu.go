@@ -0,0 +1,60 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// hostdevsXML generates the <hostdev> elements that pass the PCI devices at
+// addrs (e.g. "0000:65:00.0") through to the guest. managed='yes' has
+// libvirt bind the devices to vfio-pci while the domain runs.
+func hostdevsXML(addrs []string) (string, error) {
+	var b strings.Builder
+	for _, addr := range addrs {
+		var domain, bus, slot, function uint
+		if _, err := fmt.Sscanf(addr, "%x:%x:%x.%x", &domain, &bus, &slot, &function); err != nil {
+			return "", fmt.Errorf("invalid PCI address %q: %w", addr, err)
+		}
+		fmt.Fprintf(&b, `
+    <hostdev mode='subsystem' type='pci' managed='yes'>
+      <source>
+        <address domain='0x%04x' bus='0x%02x' slot='0x%02x' function='0x%x'/>
+      </source>
+    </hostdev>`, domain, bus, slot, function)
+	}
+	return b.String(), nil
+}
+
+// domainPCIHostdevs returns the PCI addresses of the devices passed through
+// to a domain, from its XML description.
+func domainPCIHostdevs(domainXML string) []string {
+	var dom struct {
+		Hostdevs []struct {
+			Type    string `xml:"type,attr"`
+			Address struct {
+				Domain   string `xml:"domain,attr"`
+				Bus      string `xml:"bus,attr"`
+				Slot     string `xml:"slot,attr"`
+				Function string `xml:"function,attr"`
+			} `xml:"source>address"`
+		} `xml:"devices>hostdev"`
+	}
+	if err := xml.Unmarshal([]byte(domainXML), &dom); err != nil {
+		return nil
+	}
+
+	var addrs []string
+	for _, h := range dom.Hostdevs {
+		if h.Type != "pci" {
+			continue
+		}
+		var domain, bus, slot, function uint
+		if _, err := fmt.Sscanf(h.Address.Domain+" "+h.Address.Bus+" "+h.Address.Slot+" "+h.Address.Function,
+			"0x%x 0x%x 0x%x 0x%x", &domain, &bus, &slot, &function); err != nil {
+			continue
+		}
+		addrs = append(addrs, fmt.Sprintf("%04x:%02x:%02x.%x", domain, bus, slot, function))
+	}
+	return addrs
+}
@@ -0,0 +1,169 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"hypervisor/pkg/compute/driver"
+)
+
+// imageExt is the extension of disk images in the image directory. Domains
+// boot from <ImagePath>/<image>.qcow2.
+const imageExt = ".qcow2"
+
+// progressInterval is how many bytes are downloaded between progress reports.
+const progressInterval = 8 << 20
+
+// listImageFiles returns the disk images in dir, named as instances refer to
+// them.
+func listImageFiles(dir string) ([]driver.ImageInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image directory: %w", err)
+	}
+
+	images := make([]driver.ImageInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), imageExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		images = append(images, imageInfo(strings.TrimSuffix(entry.Name(), imageExt), info))
+	}
+	return images, nil
+}
+
+// fetchImage makes an image available in dir. A plain name must already be
+// there; an http(s) URL is downloaded, unless an image with the same name is
+// cached, and stored under the URL's base name.
+func fetchImage(ctx context.Context, dir, ref string, progress func(driver.PullProgress)) (*driver.ImageInfo, error) {
+	if progress == nil {
+		progress = func(driver.PullProgress) {}
+	}
+
+	name, source, err := imageName(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	target := filepath.Join(dir, name+imageExt)
+	if info, err := os.Stat(target); err == nil {
+		image := imageInfo(name, info)
+		progress(driver.PullProgress{Status: "cached", Current: image.SizeBytes, Total: image.SizeBytes})
+		return &image, nil
+	}
+	if source == "" {
+		return nil, fmt.Errorf("image %s is not in %s and is not a URL to download", ref, dir)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create image directory: %w", err)
+	}
+	if err := download(ctx, source, target, progress); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat image: %w", err)
+	}
+	image := imageInfo(name, info)
+	return &image, nil
+}
+
+// imageName returns the name an image is stored under in the image
+// directory and, for an http(s) URL, the URL to download it from.
+func imageName(ref string) (string, string, error) {
+	u, err := url.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ref, "", nil
+	}
+
+	name := strings.TrimSuffix(path.Base(u.Path), imageExt)
+	if name == "" || name == "." || name == "/" {
+		return "", "", fmt.Errorf("cannot derive an image name from %s", ref)
+	}
+	return name, ref, nil
+}
+
+// download fetches source into target through a temporary file, so a failed
+// download never leaves a partial image behind.
+func download(ctx context.Context, source, target string, progress func(driver.PullProgress)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return fmt.Errorf("invalid image URL: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download image: %s", resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".pull-*")
+	if err != nil {
+		return fmt.Errorf("failed to create image file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	total := max(resp.ContentLength, 0)
+	progress(driver.PullProgress{Status: "downloading", Total: total})
+
+	var current, reported int64
+	buf := make([]byte, 1<<20)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := tmp.Write(buf[:n]); err != nil {
+				tmp.Close()
+				return fmt.Errorf("failed to write image: %w", err)
+			}
+			current += int64(n)
+			if current-reported >= progressInterval {
+				reported = current
+				progress(driver.PullProgress{Status: "downloading", Current: current, Total: total})
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to download image: %w", readErr)
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("failed to store image: %w", err)
+	}
+
+	progress(driver.PullProgress{Status: "downloaded", Current: current, Total: current})
+	return nil
+}
+
+func imageInfo(name string, info os.FileInfo) driver.ImageInfo {
+	return driver.ImageInfo{
+		Ref:       name,
+		SizeBytes: info.Size(),
+		CreatedAt: info.ModTime(),
+	}
+}
@@ -0,0 +1,112 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"hypervisor/pkg/compute/driver"
+)
+
+// interfaceXML generates the guest's network interface: the SR-IOV virtual
+// function assigned to its port, a virtio NIC served to Open vSwitch over
+// the port's vhost-user socket, or otherwise a virtio NIC on the libvirt
+// network defaultNetwork. libvirt sets the VF's MAC address and VLAN on its
+// physical function before handing the VF to the guest.
+func interfaceXML(netSpec driver.NetworkSpec, defaultNetwork string) (string, error) {
+	mac := ""
+	if netSpec.MACAddress != "" {
+		mac = fmt.Sprintf("\n      <mac address='%s'/>", netSpec.MACAddress)
+	}
+
+	if netSpec.VhostUserSocket != "" {
+		// QEMU creates the socket and Open vSwitch connects to it. The
+		// network MTU is advertised to the guest's virtio driver.
+		mtu := ""
+		if netSpec.MTU > 0 {
+			mtu = fmt.Sprintf("\n      <mtu size='%d'/>", netSpec.MTU)
+		}
+		return fmt.Sprintf(`
+    <interface type='vhostuser'>%s
+      <source type='unix' path='%s' mode='server'/>
+      <model type='virtio'/>%s
+    </interface>`, mac, escapeXML(netSpec.VhostUserSocket), mtu), nil
+	}
+	if netSpec.VFAddress == "" {
+		return fmt.Sprintf(`
+    <interface type='network'>
+      <source network='%s'/>
+      <model type='virtio'/>
+    </interface>`, defaultNetwork), nil
+	}
+
+	var domain, bus, slot, function uint
+	if _, err := fmt.Sscanf(netSpec.VFAddress, "%x:%x:%x.%x", &domain, &bus, &slot, &function); err != nil {
+		return "", fmt.Errorf("invalid VF PCI address %q: %w", netSpec.VFAddress, err)
+	}
+
+	vlan := ""
+	if netSpec.VLANID != 0 {
+		vlan = fmt.Sprintf("\n      <vlan>\n        <tag id='%d'/>\n      </vlan>", netSpec.VLANID)
+	}
+	return fmt.Sprintf(`
+    <interface type='hostdev' managed='yes'>%s
+      <source>
+        <address type='pci' domain='0x%04x' bus='0x%02x' slot='0x%02x' function='0x%x'/>
+      </source>%s
+    </interface>`, mac, domain, bus, slot, function, vlan), nil
+}
+
+// domainVFInterface returns the PCI address of the SR-IOV virtual function
+// passed through to a domain as its network interface, or "".
+func domainVFInterface(domainXML string) string {
+	var dom struct {
+		Interfaces []struct {
+			Type    string `xml:"type,attr"`
+			Address struct {
+				Domain   string `xml:"domain,attr"`
+				Bus      string `xml:"bus,attr"`
+				Slot     string `xml:"slot,attr"`
+				Function string `xml:"function,attr"`
+			} `xml:"source>address"`
+		} `xml:"devices>interface"`
+	}
+	if err := xml.Unmarshal([]byte(domainXML), &dom); err != nil {
+		return ""
+	}
+
+	for _, iface := range dom.Interfaces {
+		if iface.Type != "hostdev" {
+			continue
+		}
+		var domain, bus, slot, function uint
+		if _, err := fmt.Sscanf(iface.Address.Domain+" "+iface.Address.Bus+" "+iface.Address.Slot+" "+iface.Address.Function,
+			"0x%x 0x%x 0x%x 0x%x", &domain, &bus, &slot, &function); err != nil {
+			continue
+		}
+		return fmt.Sprintf("%04x:%02x:%02x.%x", domain, bus, slot, function)
+	}
+	return ""
+}
+
+// domainVhostUserSocket returns the socket of the vhost-user interface of a
+// domain, or "".
+func domainVhostUserSocket(domainXML string) string {
+	var dom struct {
+		Interfaces []struct {
+			Type   string `xml:"type,attr"`
+			Source struct {
+				Path string `xml:"path,attr"`
+			} `xml:"source"`
+		} `xml:"devices>interface"`
+	}
+	if err := xml.Unmarshal([]byte(domainXML), &dom); err != nil {
+		return ""
+	}
+
+	for _, iface := range dom.Interfaces {
+		if iface.Type == "vhostuser" {
+			return iface.Source.Path
+		}
+	}
+	return ""
+}
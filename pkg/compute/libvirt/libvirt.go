@@ -15,8 +15,13 @@ import "C"
 
 import (
 	"context"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 	"unsafe"
@@ -43,6 +48,11 @@ type Config struct {
 
 	// ImagePath is the path where VM images are stored.
 	ImagePath string `mapstructure:"image_path"`
+
+	// MigrationURI is the libvirt URI of a live migration target, with %s
+	// standing for the target host. Disks must be on storage both hosts
+	// reach at the same path.
+	MigrationURI string `mapstructure:"migration_uri"`
 }
 
 // DefaultConfig returns the default libvirt configuration.
@@ -52,6 +62,7 @@ func DefaultConfig() Config {
 		DefaultNetwork:     "default",
 		DefaultStoragePool: "default",
 		ImagePath:          "/var/lib/hypervisor/images",
+		MigrationURI:       "qemu+tcp://%s/system",
 	}
 }
 
@@ -129,8 +140,67 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 		return nil, driver.ErrNotConnected
 	}
 
+	arch, err := guestArchFor(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	name, domainUUID := domainIdentity(spec.InstanceID)
+
+	// Clone the root disk from the image and create the requested disks
+	var root string
+	if spec.Image != "" {
+		if root, err = createDisk(ctx, d.config.ImagePath, spec.Image, name, spec.DiskGB); err != nil {
+			return nil, err
+		}
+	}
+	cleanup := func() {
+		removeDataDisks(d.config.ImagePath, name)
+		removeDisk(d.config.ImagePath, name)
+	}
+
+	disks, err := provisionDisks(ctx, d.config.ImagePath, name, root, spec.Disks)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if !bootable(disks) {
+		cleanup()
+		return nil, fmt.Errorf("instance has no image or boot disk to boot from")
+	}
+
+	// Build the cloud-init NoCloud seed
+	var seed string
+	if spec.HasCloudInit() {
+		if seed, err = writeSeedISO(ctx, d.config.ImagePath, name, spec); err != nil {
+			cleanup()
+			return nil, err
+		}
+		removeDisks := cleanup
+		cleanup = func() {
+			removeSeedISO(d.config.ImagePath, name)
+			removeDisks()
+		}
+	}
+
+	hostdevs, err := hostdevsXML(spec.GPUDevices)
+	var iface string
+	if err == nil {
+		iface, err = interfaceXML(spec.Network, d.config.DefaultNetwork)
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	// The serial console is logged for boot diagnostics
+	if err := os.MkdirAll(filepath.Dir(consoleLogPath(d.config.ImagePath, name)), 0o755); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to create console log directory: %w", err)
+	}
+
 	// Generate VM XML
-	xml := d.generateDomainXML(spec)
+	xml := d.generateDomainXML(spec, arch, name, domainUUID, disks, seed, hostdevs, iface)
 
 	cXML := C.CString(xml)
 	defer C.free(unsafe.Pointer(cXML))
@@ -138,17 +208,31 @@ func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver
 	// Define the domain (persistent)
 	ret := C.lv_domain_define(cXML)
 	if ret != C.LV_OK {
-		return nil, fmt.Errorf("failed to define domain: %s", d.getLastError())
+		defineErr := fmt.Errorf("failed to define domain: %s", d.getLastError())
+		cleanup()
+		return nil, defineErr
 	}
 
 	// Get domain info
-	name := spec.Image // Using image name as domain name for now
 	instance, err := d.getDomainInfo(name)
 	if err != nil {
+		cName := C.CString(name)
+		C.lv_domain_undefine(cName)
+		C.free(unsafe.Pointer(cName))
+		cleanup()
 		return nil, err
 	}
+	if spec.Network.VFAddress != "" || spec.Network.VhostUserSocket != "" {
+		// Report the device so the agent can bind the port to it
+		instance.Spec.Network = spec.Network
+	}
 
-	d.logger.Info("VM created", zap.String("name", name))
+	d.logger.Info("VM created",
+		zap.String("name", name),
+		zap.String("uuid", domainUUID),
+		zap.String("image", spec.Image),
+		zap.Int("disks", len(disks)),
+	)
 	return instance, nil
 }
 
@@ -224,6 +308,19 @@ func (d *Driver) Delete(ctx context.Context, id string) error {
 		return fmt.Errorf("failed to undefine domain: %s", d.getLastError())
 	}
 
+	if err := removeSeedISO(d.config.ImagePath, id); err != nil {
+		d.logger.Warn("failed to remove seed ISO", zap.String("id", id), zap.Error(err))
+	}
+	if err := removeDisk(d.config.ImagePath, id); err != nil {
+		d.logger.Warn("failed to remove disk", zap.String("id", id), zap.Error(err))
+	}
+	if err := removeDataDisks(d.config.ImagePath, id); err != nil {
+		d.logger.Warn("failed to remove data disks", zap.String("id", id), zap.Error(err))
+	}
+	if err := removeConsoleLog(d.config.ImagePath, id); err != nil {
+		d.logger.Warn("failed to remove console log", zap.String("id", id), zap.Error(err))
+	}
+
 	d.logger.Info("VM deleted", zap.String("id", id))
 	return nil
 }
@@ -254,8 +351,9 @@ func (d *Driver) getDomainInfo(name string) (*driver.Instance, error) {
 	}
 	defer C.lv_free_domain_info(&info)
 
+	// Domains are addressed by name, which is the instance ID
 	instance := &driver.Instance{
-		ID:        C.GoString(info.uuid),
+		ID:        C.GoString(info.name),
 		Name:      C.GoString(info.name),
 		Type:      driver.InstanceTypeVM,
 		State:     d.mapState(int(info.state)),
@@ -266,6 +364,29 @@ func (d *Driver) getDomainInfo(name string) (*driver.Instance, error) {
 		},
 	}
 
+	if instance.State == driver.StateStopped && info.has_managed_save != 0 {
+		instance.State = driver.StateSuspended
+	}
+
+	// Passed-through GPUs and dedicated cores are only recorded in the
+	// domain definition
+	if cXML := C.lv_domain_get_xml(cName); cXML != nil {
+		domainXML := C.GoString(cXML)
+		C.free(unsafe.Pointer(cXML))
+		instance.Spec.GPUDevices = domainPCIHostdevs(domainXML)
+		if vf := domainVFInterface(domainXML); vf != "" {
+			instance.Spec.Network.VFAddress = vf
+			instance.Spec.Network.DeviceName = vf
+			instance.Spec.Network.BindingType = driver.PortBindingSRIOV
+		}
+		if socket := domainVhostUserSocket(domainXML); socket != "" {
+			instance.Spec.Network.VhostUserSocket = socket
+			instance.Spec.Network.DeviceName = filepath.Base(socket)
+			instance.Spec.Network.BindingType = driver.PortBindingVhostUser
+		}
+		instance.Spec.PinnedCPUs, instance.Spec.SharedCPUs, instance.Spec.NUMANodes = domainPlacement(domainXML)
+	}
+
 	return instance, nil
 }
 
@@ -346,6 +467,88 @@ func (d *Driver) Attach(ctx context.Context, id string, opts driver.AttachOption
 	return nil, driver.ErrNotSupported
 }
 
+// BootDiagnostics takes a screenshot of a running VM's display, converted to
+// PNG, and reads the end of its serial console log.
+func (d *Driver) BootDiagnostics(ctx context.Context, id string, lines int) (*driver.BootDiagnostics, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if !d.connected {
+		return nil, driver.ErrNotConnected
+	}
+
+	cName := C.CString(id)
+	defer C.free(unsafe.Pointer(cName))
+
+	state := C.lv_domain_get_state(cName)
+	if state < 0 {
+		return nil, driver.ErrInstanceNotFound
+	}
+
+	diag := &driver.BootDiagnostics{CollectedAt: time.Now()}
+	if state == C.LV_DOMAIN_RUNNING {
+		var data *C.uchar
+		var size C.size_t
+		var mime *C.char
+		if ret := C.lv_domain_screenshot(cName, &data, &size, &mime); ret == C.LV_OK {
+			shot := C.GoBytes(unsafe.Pointer(data), C.int(size))
+			format := C.GoString(mime)
+			C.free(unsafe.Pointer(data))
+			C.free(unsafe.Pointer(mime))
+
+			if format == "image/x-portable-pixmap" {
+				if png, err := ppmToPNG(shot); err == nil {
+					shot, format = png, "image/png"
+				} else {
+					d.logger.Warn("failed to convert screenshot", zap.String("id", id), zap.Error(err))
+				}
+			}
+			diag.Screenshot, diag.ScreenshotFormat = shot, format
+		} else {
+			// A headless domain has no display to capture
+			d.logger.Debug("failed to take screenshot", zap.String("id", id), zap.String("error", d.getLastError()))
+		}
+	}
+
+	serial, err := driver.TailLines(consoleLogPath(d.config.ImagePath, id), lines)
+	if err != nil {
+		return nil, err
+	}
+	diag.SerialOutput = serial
+	return diag, nil
+}
+
+// LogPath returns the log file a VM's serial console is written to.
+func (d *Driver) LogPath(ctx context.Context, id string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if !d.connected {
+		return "", driver.ErrNotConnected
+	}
+
+	cName := C.CString(id)
+	defer C.free(unsafe.Pointer(cName))
+
+	if C.lv_domain_get_state(cName) < 0 {
+		return "", driver.ErrInstanceNotFound
+	}
+	return consoleLogPath(d.config.ImagePath, id), nil
+}
+
+// Capabilities returns the optional operations the driver supports. Console
+// attach is not implemented yet.
+func (d *Driver) Capabilities() driver.Capabilities {
+	return driver.Capabilities{
+		Logs:        true,
+		Pause:       true,
+		Suspend:     true,
+		Resize:      true,
+		Migrate:     true,
+		Diagnostics: true,
+	}
+}
+
 // Restart restarts a VM.
 func (d *Driver) Restart(ctx context.Context, id string, force bool) error {
 	d.mu.Lock()
@@ -377,6 +580,266 @@ func (d *Driver) Restart(ctx context.Context, id string, force bool) error {
 	return nil
 }
 
+// Pause freezes a running VM in memory.
+func (d *Driver) Pause(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.connected {
+		return driver.ErrNotConnected
+	}
+
+	cName := C.CString(id)
+	defer C.free(unsafe.Pointer(cName))
+
+	if ret := C.lv_domain_suspend(cName); ret != C.LV_OK {
+		if ret == C.LV_ERR_NOT_FOUND {
+			return driver.ErrInstanceNotFound
+		}
+		return fmt.Errorf("failed to pause domain: %s", d.getLastError())
+	}
+
+	d.logger.Info("VM paused", zap.String("id", id))
+	return nil
+}
+
+// Resume continues a paused VM.
+func (d *Driver) Resume(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.connected {
+		return driver.ErrNotConnected
+	}
+
+	cName := C.CString(id)
+	defer C.free(unsafe.Pointer(cName))
+
+	if ret := C.lv_domain_resume(cName); ret != C.LV_OK {
+		if ret == C.LV_ERR_NOT_FOUND {
+			return driver.ErrInstanceNotFound
+		}
+		return fmt.Errorf("failed to resume domain: %s", d.getLastError())
+	}
+
+	d.logger.Info("VM resumed", zap.String("id", id))
+	return nil
+}
+
+// Suspend saves a VM's memory to a libvirt managed save image and stops
+// it. Starting the domain restores the image.
+func (d *Driver) Suspend(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.connected {
+		return driver.ErrNotConnected
+	}
+
+	cName := C.CString(id)
+	defer C.free(unsafe.Pointer(cName))
+
+	if ret := C.lv_domain_managed_save(cName); ret != C.LV_OK {
+		if ret == C.LV_ERR_NOT_FOUND {
+			return driver.ErrInstanceNotFound
+		}
+		return fmt.Errorf("failed to suspend domain: %s", d.getLastError())
+	}
+
+	d.logger.Info("VM suspended to disk", zap.String("id", id))
+	return nil
+}
+
+// Resize changes the vCPUs and memory of a VM. A running VM is changed live
+// and in its definition, within the maximums it was started with; growing
+// past them returns driver.ErrRestartRequired. A stopped VM's definition is
+// changed, maximums included.
+func (d *Driver) Resize(ctx context.Context, id string, cpuCores int, memoryMB int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.connected {
+		return driver.ErrNotConnected
+	}
+
+	cName := C.CString(id)
+	defer C.free(unsafe.Pointer(cName))
+
+	var info C.lv_domain_info_t
+	ret := C.lv_domain_get_info(cName, &info)
+	if ret != C.LV_OK {
+		if ret == C.LV_ERR_NOT_FOUND {
+			return driver.ErrInstanceNotFound
+		}
+		return fmt.Errorf("failed to get domain info: %s", d.getLastError())
+	}
+	defer C.lv_free_domain_info(&info)
+
+	vcpus, maxVCPUs := uint64(info.vcpus), uint64(info.max_vcpus)
+	memoryKB, maxMemoryKB := uint64(info.memory_kb), uint64(info.max_memory_kb)
+	wantVCPUs, wantMemoryKB := vcpus, memoryKB
+	if cpuCores > 0 {
+		wantVCPUs = uint64(cpuCores)
+	}
+	if memoryMB > 0 {
+		wantMemoryKB = uint64(memoryMB) * 1024
+	}
+
+	setVCPUs := func(count uint64, flags C.uint) error {
+		if C.lv_domain_set_vcpus_flags(cName, C.uint32_t(count), flags) != C.LV_OK {
+			return fmt.Errorf("failed to set vCPUs: %s", d.getLastError())
+		}
+		return nil
+	}
+	setMemory := func(kb uint64, flags C.uint) error {
+		if C.lv_domain_set_memory_flags(cName, C.uint64_t(kb), flags) != C.LV_OK {
+			return fmt.Errorf("failed to set memory: %s", d.getLastError())
+		}
+		return nil
+	}
+
+	if info.state != C.LV_DOMAIN_SHUTOFF {
+		if wantVCPUs > maxVCPUs || wantMemoryKB > maxMemoryKB {
+			return driver.ErrRestartRequired
+		}
+		flags := C.uint(C.LV_AFFECT_LIVE | C.LV_AFFECT_CONFIG)
+		if wantVCPUs != vcpus {
+			if err := setVCPUs(wantVCPUs, flags); err != nil {
+				return err
+			}
+		}
+		if wantMemoryKB != memoryKB {
+			if err := setMemory(wantMemoryKB, flags); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := setWithMaximum(setVCPUs, vcpus, wantVCPUs); err != nil {
+			return err
+		}
+		if err := setWithMaximum(setMemory, memoryKB, wantMemoryKB); err != nil {
+			return err
+		}
+	}
+
+	d.logger.Info("VM resized",
+		zap.String("id", id),
+		zap.Uint64("vcpus", wantVCPUs),
+		zap.Uint64("memory_kb", wantMemoryKB),
+		zap.Bool("live", info.state != C.LV_DOMAIN_SHUTOFF),
+	)
+	return nil
+}
+
+// setWithMaximum sets a value and its maximum in a stopped domain's
+// definition, raising the maximum first when growing so the value never
+// exceeds it.
+func setWithMaximum(set func(value uint64, flags C.uint) error, current, want uint64) error {
+	if want == current {
+		return nil
+	}
+	steps := []C.uint{C.LV_AFFECT_CONFIG | C.LV_SET_MAXIMUM, C.LV_AFFECT_CONFIG}
+	if want < current {
+		steps[0], steps[1] = steps[1], steps[0]
+	}
+	for _, flags := range steps {
+		if err := set(want, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSharedCPUs pins every vCPU and the emulator threads of a VM without
+// dedicated cores to the given host cores, live if it is running and in
+// its definition.
+func (d *Driver) SetSharedCPUs(ctx context.Context, id string, cpus []int) error {
+	if len(cpus) == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.connected {
+		return driver.ErrNotConnected
+	}
+
+	cName := C.CString(id)
+	defer C.free(unsafe.Pointer(cName))
+
+	var info C.lv_domain_info_t
+	ret := C.lv_domain_get_info(cName, &info)
+	if ret != C.LV_OK {
+		if ret == C.LV_ERR_NOT_FOUND {
+			return driver.ErrInstanceNotFound
+		}
+		return fmt.Errorf("failed to get domain info: %s", d.getLastError())
+	}
+	running := info.state != C.LV_DOMAIN_SHUTOFF
+	C.lv_free_domain_info(&info)
+
+	cpumap := make([]byte, slices.Max(cpus)/8+1)
+	for _, cpu := range cpus {
+		cpumap[cpu/8] |= 1 << (cpu % 8)
+	}
+	flags := C.uint(C.LV_AFFECT_CONFIG)
+	if running {
+		flags |= C.LV_AFFECT_LIVE
+	}
+	if C.lv_domain_pin_cpus(cName, (*C.uchar)(unsafe.Pointer(&cpumap[0])), C.int(len(cpumap)), flags) != C.LV_OK {
+		return fmt.Errorf("failed to pin CPUs: %s", d.getLastError())
+	}
+
+	d.logger.Debug("VM moved to shared cores",
+		zap.String("id", id),
+		zap.String("cpus", driver.FormatCPUList(cpus)),
+	)
+	return nil
+}
+
+// Migrate live migrates a running VM to the libvirtd on host. The copy is
+// not interrupted by ctx once it has started.
+func (d *Driver) Migrate(ctx context.Context, id, host string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Other operations on the VM wait for the copy, not those on others
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if !d.connected {
+		return driver.ErrNotConnected
+	}
+
+	uri := d.config.MigrationURI
+	if uri == "" {
+		uri = DefaultConfig().MigrationURI
+	}
+	uri = fmt.Sprintf(uri, host)
+
+	cName := C.CString(id)
+	defer C.free(unsafe.Pointer(cName))
+	cURI := C.CString(uri)
+	defer C.free(unsafe.Pointer(cURI))
+
+	start := time.Now()
+	if ret := C.lv_domain_migrate(cName, cURI); ret != C.LV_OK {
+		if ret == C.LV_ERR_NOT_FOUND {
+			return driver.ErrInstanceNotFound
+		}
+		return fmt.Errorf("failed to migrate domain to %s: %s", host, d.getLastError())
+	}
+
+	d.logger.Info("VM migrated",
+		zap.String("id", id),
+		zap.String("target", uri),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return nil
+}
+
 // Close releases resources and disconnects from libvirt.
 func (d *Driver) Close() error {
 	d.mu.Lock()
@@ -417,6 +880,26 @@ func (d *Driver) GetHostInfo(ctx context.Context) (*driver.HostInfo, error) {
 	}, nil
 }
 
+// ListImages returns the disk images in the image directory.
+func (d *Driver) ListImages(ctx context.Context) ([]driver.ImageInfo, error) {
+	return listImageFiles(d.config.ImagePath)
+}
+
+// PullImage makes a disk image available in the image directory,
+// downloading it if ref is an http(s) URL.
+func (d *Driver) PullImage(ctx context.Context, ref string, progress func(driver.PullProgress)) (*driver.ImageInfo, error) {
+	image, err := fetchImage(ctx, d.config.ImagePath, ref, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	d.logger.Info("image available",
+		zap.String("image", image.Ref),
+		zap.Int64("size_bytes", image.SizeBytes),
+	)
+	return image, nil
+}
+
 // mapState maps libvirt domain state to driver instance state.
 func (d *Driver) mapState(state int) driver.InstanceState {
 	switch state {
@@ -437,55 +920,61 @@ func (d *Driver) mapState(state int) driver.InstanceState {
 	}
 }
 
-// generateDomainXML generates libvirt domain XML from spec.
-func (d *Driver) generateDomainXML(spec *driver.InstanceSpec) string {
+// generateDomainXML generates libvirt domain XML from spec for a guest of
+// the given architecture.
+func (d *Driver) generateDomainXML(spec *driver.InstanceSpec, arch guestArch, name, domainUUID string, disks []domainDisk, seed, hostdevs, iface string) string {
 	// This is a simplified XML template
 	// Production code should use proper XML templating
 	memoryKB := spec.MemoryMB * 1024
 
 	xml := fmt.Sprintf(`<domain type='kvm'>
   <name>%s</name>
+  <uuid>%s</uuid>%s
   <memory unit='KiB'>%d</memory>
-  <vcpu placement='static'>%d</vcpu>
-  <os>
-    <type arch='x86_64' machine='pc'>hvm</type>
-    <boot dev='hd'/>
-  </os>
+  <vcpu placement='static'%s>%d</vcpu>%s%s
+  %s
   <features>
-    <acpi/>
-    <apic/>
+    %s
   </features>
-  <cpu mode='host-model'/>
-  <clock offset='utc'>
-    <timer name='rtc' tickpolicy='catchup'/>
-    <timer name='pit' tickpolicy='delay'/>
-    <timer name='hpet' present='no'/>
-  </clock>
+  %s
+  %s
   <devices>
-    <emulator>/usr/bin/qemu-system-x86_64</emulator>
-    <disk type='file' device='disk'>
-      <driver name='qemu' type='qcow2'/>
-      <source file='%s/%s.qcow2'/>
-      <target dev='vda' bus='virtio'/>
-    </disk>
-    <interface type='network'>
-      <source network='%s'/>
-      <model type='virtio'/>
-    </interface>
-    <console type='pty'>
-      <target type='serial' port='0'/>
-    </console>
+    <emulator>%s</emulator>%s%s%s%s
+%s
     <graphics type='vnc' port='-1' autoport='yes' listen='127.0.0.1'>
       <listen type='address' address='127.0.0.1'/>
     </graphics>
   </devices>
 </domain>`,
-		spec.Image,
+		name,
+		domainUUID,
+		titleXML(spec.Name),
 		memoryKB,
+		vcpuCPUSetXML(spec),
 		spec.CPUCores,
-		d.config.ImagePath, spec.Image,
-		d.config.DefaultNetwork,
+		memoryBackingXML(spec),
+		placementXML(spec),
+		arch.osXML(),
+		arch.Features,
+		cpuXML(arch.cpuSpec(spec.CPU), sharedMemoryNUMAXML(spec)),
+		arch.clockXML(),
+		arch.Emulator,
+		disksXML(disks),
+		seedDiskXML(seed, arch),
+		hostdevs,
+		iface,
+		consoleXML(consoleLogPath(d.config.ImagePath, name)),
 	)
 
 	return xml
 }
+
+// titleXML returns the domain title showing the instance's name.
+func titleXML(name string) string {
+	if name == "" {
+		return ""
+	}
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(name))
+	return "\n  <title>" + escaped.String() + "</title>"
+}
@@ -23,6 +23,7 @@ type Config struct {
 	DefaultNetwork     string `mapstructure:"default_network"`
 	DefaultStoragePool string `mapstructure:"default_storage_pool"`
 	ImagePath          string `mapstructure:"image_path"`
+	MigrationURI       string `mapstructure:"migration_uri"`
 }
 
 // DefaultConfig returns the default libvirt configuration.
@@ -32,6 +33,7 @@ func DefaultConfig() Config {
 		DefaultNetwork:     "default",
 		DefaultStoragePool: "default",
 		ImagePath:          "/var/lib/hypervisor/images",
+		MigrationURI:       "qemu+tcp://%s/system",
 	}
 }
 
@@ -65,10 +67,35 @@ func (d *Driver) Stats(ctx context.Context, id string) (*driver.InstanceStats, e
 func (d *Driver) Attach(ctx context.Context, id string, opts driver.AttachOptions) (io.ReadWriteCloser, error) {
 	return nil, ErrLibvirtNotAvailable
 }
+func (d *Driver) Capabilities() driver.Capabilities { return driver.Capabilities{} }
+func (d *Driver) BootDiagnostics(ctx context.Context, id string, lines int) (*driver.BootDiagnostics, error) {
+	return nil, ErrLibvirtNotAvailable
+}
+func (d *Driver) LogPath(ctx context.Context, id string) (string, error) {
+	return "", ErrLibvirtNotAvailable
+}
 func (d *Driver) Restart(ctx context.Context, id string, force bool) error {
 	return ErrLibvirtNotAvailable
 }
+func (d *Driver) Pause(ctx context.Context, id string) error   { return ErrLibvirtNotAvailable }
+func (d *Driver) Resume(ctx context.Context, id string) error  { return ErrLibvirtNotAvailable }
+func (d *Driver) Suspend(ctx context.Context, id string) error { return ErrLibvirtNotAvailable }
+func (d *Driver) Resize(ctx context.Context, id string, cpuCores int, memoryMB int64) error {
+	return ErrLibvirtNotAvailable
+}
+func (d *Driver) SetSharedCPUs(ctx context.Context, id string, cpus []int) error {
+	return ErrLibvirtNotAvailable
+}
+func (d *Driver) Migrate(ctx context.Context, id, host string) error {
+	return ErrLibvirtNotAvailable
+}
 func (d *Driver) Close() error { return nil }
 func (d *Driver) GetHostInfo(ctx context.Context) (*driver.HostInfo, error) {
 	return nil, ErrLibvirtNotAvailable
 }
+func (d *Driver) ListImages(ctx context.Context) ([]driver.ImageInfo, error) {
+	return nil, ErrLibvirtNotAvailable
+}
+func (d *Driver) PullImage(ctx context.Context, ref string, progress func(driver.PullProgress)) (*driver.ImageInfo, error) {
+	return nil, ErrLibvirtNotAvailable
+}
@@ -0,0 +1,52 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"hypervisor/pkg/compute/driver"
+)
+
+// seedDir is the subdirectory of the image directory holding NoCloud seeds.
+const seedDir = "seeds"
+
+// seedPath returns where the NoCloud seed ISO of a domain is stored.
+func seedPath(imageDir, name string) string {
+	return filepath.Join(imageDir, seedDir, name+"-seed.iso")
+}
+
+// writeSeedISO builds a cloud-init NoCloud seed ISO (volume label "cidata")
+// holding the spec's user-data and SSH keys, and returns its path.
+func writeSeedISO(ctx context.Context, imageDir, name string, spec *driver.InstanceSpec) (string, error) {
+	target := seedPath(imageDir, name)
+	if err := driver.WriteNoCloudISO(ctx, target, name, spec); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// removeSeedISO deletes a domain's seed ISO, if it has one.
+func removeSeedISO(imageDir, name string) error {
+	err := os.Remove(seedPath(imageDir, name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove seed ISO: %w", err)
+	}
+	return nil
+}
+
+// seedDiskXML returns the CD-ROM device attaching a seed ISO.
+func seedDiskXML(path string, arch guestArch) string {
+	if path == "" {
+		return ""
+	}
+	return fmt.Sprintf(`
+    <disk type='file' device='cdrom'>
+      <driver name='qemu' type='raw'/>
+      <source file='%s'/>
+      <target dev='%s' bus='%s'/>
+      <readonly/>
+    </disk>`, path, arch.CDROMDev, arch.CDROMBus)
+}
@@ -0,0 +1,349 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"hypervisor/pkg/compute/driver"
+
+	"go.uber.org/zap"
+)
+
+// imageExt is the extension of disk images in the image directory. VMs boot
+// from <ImagePath>/<image>.qcow2, the layout the libvirt driver uses.
+const imageExt = ".qcow2"
+
+// diskNamePattern restricts disk names, which become file names and QEMU
+// IDs.
+var diskNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// vmDisk is a disk attached to a VM.
+type vmDisk struct {
+	Name   string `json:"name"`   // Also the QEMU drive ID
+	Path   string `json:"path"`   // Image file on the host
+	Format string `json:"format"` // qcow2 or raw
+	SSD    bool   `json:"ssd,omitempty"`
+	Boot   int    `json:"boot,omitempty"` // Boot order, 0 if not booted from
+
+	// Created disks live in the VM's directory and are deleted with it;
+	// disks attached from a source path are left alone
+	Created bool `json:"created,omitempty"`
+
+	// Port is the PCIe root port a hot-plugged disk sits on (arm64 only)
+	Port string `json:"port,omitempty"`
+}
+
+// deviceID returns the QEMU device ID of the disk.
+func (disk vmDisk) deviceID() string {
+	return "dev-" + disk.Name
+}
+
+// provisionDisks lays out a VM's disks: the root disk cloned from the
+// image (if any) followed by the spec's disks. Disks without a source path
+// are created as empty qcow2 volumes of the requested size; source paths
+// must lie inside the image directory. Disks flagged Boot are booted from
+// first, then the root disk.
+func (d *Driver) provisionDisks(ctx context.Context, id string, spec *driver.InstanceSpec) ([]vmDisk, error) {
+	var disks []vmDisk
+	names := map[string]bool{"root": true, "seed": true}
+
+	if spec.Image != "" {
+		root, err := d.createRootDisk(ctx, id, spec.Image, spec.DiskGB)
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, vmDisk{Name: "root", Path: root, Format: "qcow2", Created: true})
+	}
+
+	for i, ds := range spec.Disks {
+		name := ds.Name
+		if name == "" {
+			name = fmt.Sprintf("disk%d", i)
+		}
+		if !diskNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid disk name %q", name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate disk name %q", name)
+		}
+		names[name] = true
+
+		disk, err := d.prepareDisk(ctx, id, name, ds)
+		if err != nil {
+			return nil, err
+		}
+		if ds.Boot {
+			disk.Boot = -1 // Numbered below
+		}
+		disks = append(disks, disk)
+	}
+
+	// Boot disks first, in spec order, then the root disk
+	order := 1
+	for i := range disks {
+		if disks[i].Boot < 0 {
+			disks[i].Boot = order
+			order++
+		}
+	}
+	if spec.Image != "" {
+		disks[0].Boot = order
+	}
+	return disks, nil
+}
+
+// prepareDisk returns the disk for a DiskSpec, creating its volume unless
+// it is attached from a source path.
+func (d *Driver) prepareDisk(ctx context.Context, id, name string, ds driver.DiskSpec) (vmDisk, error) {
+	disk := vmDisk{Name: name, Format: "qcow2"}
+	switch ds.Type {
+	case "", "hdd":
+	case "ssd":
+		disk.SSD = true
+	default:
+		return vmDisk{}, fmt.Errorf("disk %s: unsupported type %q", name, ds.Type)
+	}
+
+	if ds.SourcePath != "" {
+		path, image, err := driver.ResolveSourceDisk(ctx, d.config.ImagePath, ds.SourcePath)
+		if err != nil {
+			return vmDisk{}, fmt.Errorf("disk %s: %w", name, err)
+		}
+		disk.Path, disk.Format = path, image.Format
+		return disk, nil
+	}
+
+	if ds.SizeGB <= 0 {
+		return vmDisk{}, fmt.Errorf("disk %s: size or source path is required", name)
+	}
+	disk.Path = filepath.Join(d.vmDir(id), name+imageExt)
+	disk.Created = true
+	if err := qemuImg(ctx, "create", "-f", "qcow2", disk.Path, fmt.Sprintf("%dG", ds.SizeGB)); err != nil {
+		return vmDisk{}, fmt.Errorf("disk %s: %w", name, err)
+	}
+	return disk, nil
+}
+
+// createRootDisk creates a VM's root disk as a qcow2 overlay backed by the
+// image, so the image itself is never written to. image is a name or path
+// inside the image directory. A sizeGB larger than the image grows the
+// disk; a smaller one is ignored.
+func (d *Driver) createRootDisk(ctx context.Context, id, image string, sizeGB int64) (string, error) {
+	backing := image
+	if !filepath.IsAbs(image) {
+		backing = strings.TrimSuffix(image, imageExt) + imageExt
+	}
+	backing, info, err := driver.ResolveSourceDisk(ctx, d.config.ImagePath, backing)
+	if err != nil {
+		return "", fmt.Errorf("image %s: %w", image, err)
+	}
+
+	target := filepath.Join(d.vmDir(id), "root"+imageExt)
+	args := []string{"create", "-f", "qcow2", "-F", info.Format, "-b", backing, target}
+	if size := driver.OverlaySize(info, sizeGB); size != "" {
+		args = append(args, size)
+	}
+	if err := qemuImg(ctx, args...); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+func qemuImg(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "qemu-img", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create disk: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// diskArgs returns the command line attaching a disk.
+func diskArgs(disk vmDisk) []string {
+	drive := fmt.Sprintf("file=%s,format=%s,if=none,id=%s", escapeOpt(disk.Path), disk.Format, disk.Name)
+	if disk.SSD {
+		drive += ",discard=unmap"
+	}
+
+	device := fmt.Sprintf("virtio-blk-pci,drive=%s,id=%s", disk.Name, disk.deviceID())
+	if disk.SSD {
+		// On the SCSI bus the guest sees a non-rotational disk
+		device = fmt.Sprintf("scsi-hd,bus=scsi0.0,drive=%s,id=%s,rotation_rate=1", disk.Name, disk.deviceID())
+	}
+	if disk.Port != "" {
+		device += ",bus=" + disk.Port
+	}
+	if disk.Boot > 0 {
+		device += fmt.Sprintf(",bootindex=%d", disk.Boot)
+	}
+	return []string{"-drive", drive, "-device", device}
+}
+
+// escapeOpt escapes commas in a QEMU option value.
+func escapeOpt(s string) string {
+	return strings.ReplaceAll(s, ",", ",,")
+}
+
+// AttachDisk hot-plugs a disk into a running VM and records it, so it is
+// attached again when the VM next starts. A disk without a source path is
+// created empty. SSDs cannot be hot-plugged, as the SCSI controller is only
+// added at boot.
+func (d *Driver) AttachDisk(ctx context.Context, id string, ds driver.DiskSpec) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return driver.ErrInstanceNotFound
+	}
+	if ds.Type == "ssd" {
+		return fmt.Errorf("ssd disks cannot be hot-plugged: %w", driver.ErrNotSupported)
+	}
+	if !diskNamePattern.MatchString(ds.Name) {
+		return fmt.Errorf("invalid disk name %q", ds.Name)
+	}
+	for _, disk := range vm.Disks {
+		if disk.Name == ds.Name {
+			return fmt.Errorf("disk %s is already attached", ds.Name)
+		}
+	}
+	if !d.running(ctx, vm) {
+		return driver.ErrInstanceStopped
+	}
+
+	disk, err := d.prepareDisk(ctx, id, ds.Name, ds)
+	if err != nil {
+		return err
+	}
+	if d.arch.HotplugPorts > 0 {
+		if disk.Port = freePort(vm, d.arch.HotplugPorts); disk.Port == "" {
+			return d.discardDisk(disk, fmt.Errorf("no free hot-plug port: %w", driver.ErrNotSupported))
+		}
+	}
+
+	c, err := dialQMP(ctx, d.qmpSocket(id))
+	if err != nil {
+		return d.discardDisk(disk, err)
+	}
+	defer c.Close()
+
+	if err := c.execute(ctx, "blockdev-add", map[string]any{
+		"driver":    disk.Format,
+		"node-name": disk.Name,
+		"file":      map[string]any{"driver": "file", "filename": disk.Path},
+	}, nil); err != nil {
+		return d.discardDisk(disk, fmt.Errorf("failed to add block device: %w", err))
+	}
+	device := map[string]any{"driver": "virtio-blk-pci", "drive": disk.Name, "id": disk.deviceID()}
+	if disk.Port != "" {
+		device["bus"] = disk.Port
+	}
+	if err := c.execute(ctx, "device_add", device, nil); err != nil {
+		c.execute(ctx, "blockdev-del", map[string]any{"node-name": disk.Name}, nil)
+		return d.discardDisk(disk, fmt.Errorf("failed to add disk device: %w", err))
+	}
+
+	vm.Disks = append(vm.Disks, disk)
+	if err := d.saveState(vm); err != nil {
+		return err
+	}
+
+	d.logger.Info("disk attached", zap.String("id", id), zap.String("disk", disk.Name))
+	return nil
+}
+
+// DetachDisk hot-unplugs a disk from a running VM, waiting for the guest to
+// release it, and forgets it. A disk the driver created is deleted.
+func (d *Driver) DetachDisk(ctx context.Context, id, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return driver.ErrInstanceNotFound
+	}
+	index := -1
+	for i, disk := range vm.Disks {
+		if disk.Name == name {
+			index = i
+		}
+	}
+	if index < 0 || name == "root" {
+		return fmt.Errorf("disk %s is not attached or cannot be detached", name)
+	}
+	disk := vm.Disks[index]
+
+	if d.running(ctx, vm) {
+		c, err := dialQMP(ctx, d.qmpSocket(id))
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		if err := c.execute(ctx, "device_del", map[string]any{"id": disk.deviceID()}, nil); err != nil {
+			return fmt.Errorf("failed to remove disk device: %w", err)
+		}
+		// The guest has to acknowledge the unplug before the drive can go
+		deleted := func(data json.RawMessage) bool {
+			var event struct {
+				Device string `json:"device"`
+			}
+			return json.Unmarshal(data, &event) == nil && event.Device == disk.deviceID()
+		}
+		if err := c.waitEvent(ctx, "DEVICE_DELETED", detachTimeout, deleted); err != nil {
+			return fmt.Errorf("guest did not release disk %s: %w", name, err)
+		}
+		// Drives attached at boot go with their device; hot-plugged block
+		// nodes have to be removed
+		c.execute(ctx, "blockdev-del", map[string]any{"node-name": disk.Name}, nil)
+	}
+
+	vm.Disks = append(vm.Disks[:index], vm.Disks[index+1:]...)
+	if err := d.saveState(vm); err != nil {
+		return err
+	}
+	if disk.Created {
+		if err := os.Remove(disk.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			d.logger.Warn("failed to remove disk", zap.String("path", disk.Path), zap.Error(err))
+		}
+	}
+
+	d.logger.Info("disk detached", zap.String("id", id), zap.String("disk", name))
+	return nil
+}
+
+// detachTimeout bounds how long a guest may take to release a disk.
+const detachTimeout = 30 * time.Second
+
+// discardDisk removes a disk prepared for a failed hot-plug and returns err.
+func (d *Driver) discardDisk(disk vmDisk, err error) error {
+	if disk.Created {
+		os.Remove(disk.Path)
+	}
+	return err
+}
+
+// freePort returns the first hot-plug root port no disk of the VM sits on.
+func freePort(vm *vmState, ports int) string {
+	used := make(map[string]bool)
+	for _, disk := range vm.Disks {
+		used[disk.Port] = true
+	}
+	for i := 0; i < ports; i++ {
+		if port := hotplugPort(i); !used[port] {
+			return port
+		}
+	}
+	return ""
+}
+
+func hotplugPort(i int) string {
+	return fmt.Sprintf("hp%d", i)
+}
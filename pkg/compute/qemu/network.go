@@ -0,0 +1,124 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"hypervisor/pkg/compute/driver"
+	"hypervisor/pkg/network/cgo"
+
+	"github.com/vishvananda/netlink"
+)
+
+// tapPrefix starts the names of the tap devices created for VMs.
+const tapPrefix = "qtap"
+
+// tapName returns the tap device name of a VM, within the 15 characters
+// allowed for interface names.
+func tapName(vmID string) string {
+	id := strings.ReplaceAll(vmID, "-", "")
+	if len(id) > 11 {
+		id = id[:11]
+	}
+	return tapPrefix + id
+}
+
+// virtioNetDevice returns the virtio-net device of a VM's NIC. The network
+// MTU is advertised to the guest driver with host_mtu, so the guest sizes its
+// interface to match the tap or vhost-user port behind it.
+func virtioNetDevice(netSpec driver.NetworkSpec) string {
+	device := "virtio-net-pci,netdev=net0"
+	if netSpec.MACAddress != "" {
+		device += ",mac=" + netSpec.MACAddress
+	}
+	if netSpec.MTU > 0 {
+		device += ",host_mtu=" + strconv.FormatUint(uint64(netSpec.MTU), 10)
+	}
+	return device
+}
+
+// createTap creates a persistent tap device for a VM, brings it up and plugs
+// it into the integration bridge. The interface's external_ids identify the
+// SDN port, so the flows installed for the port apply to it.
+func (d *Driver) createTap(vmID string, netSpec *driver.NetworkSpec) (string, error) {
+	name := tapName(vmID)
+
+	tap := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		// QEMU opens the device with vnet_hdr=on
+		Flags: netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR,
+	}
+	if netSpec.MTU > 0 {
+		tap.MTU = int(netSpec.MTU)
+	}
+	if err := netlink.LinkAdd(tap); err != nil {
+		return "", fmt.Errorf("failed to create tap %s: %w", name, err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		err = netlink.LinkSetUp(link)
+	}
+	if err != nil {
+		d.deleteTap(name)
+		return "", fmt.Errorf("failed to bring up tap %s: %w", name, err)
+	}
+
+	externalIDs := map[string]string{
+		"external_ids:vm-id":        vmID,
+		"external_ids:iface-status": "active",
+	}
+	if netSpec.PortID != "" {
+		externalIDs["external_ids:iface-id"] = netSpec.PortID
+	}
+	if netSpec.MACAddress != "" {
+		externalIDs["external_ids:attached-mac"] = netSpec.MACAddress
+	}
+
+	bridge := d.config.IntegrationBridge
+	if err := cgo.NewOVSBridge(bridge).AddPort(bridge, name, externalIDs); err != nil {
+		d.deleteTap(name)
+		return "", fmt.Errorf("failed to plug tap %s into %s: %w", name, bridge, err)
+	}
+
+	return name, nil
+}
+
+// deleteTap unplugs a VM's tap device from the integration bridge and
+// deletes it. Missing devices are ignored.
+func (d *Driver) deleteTap(name string) error {
+	bridge := d.config.IntegrationBridge
+	var errs []error
+	if err := cgo.NewOVSBridge(bridge).DeletePort(bridge, name); err != nil {
+		errs = append(errs, err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		err = netlink.LinkDel(link)
+	}
+	var notFound netlink.LinkNotFoundError
+	if err != nil && !errors.As(err, &notFound) {
+		errs = append(errs, fmt.Errorf("failed to delete tap %s: %w", name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// tapCounters returns the bytes the guest received and sent through its tap
+// device: what the host side of the tap sent and received.
+func tapCounters(name string) (rx, tx uint64) {
+	read := func(counter string) uint64 {
+		data, err := os.ReadFile(filepath.Join("/sys/class/net", name, "statistics", counter))
+		if err != nil {
+			return 0
+		}
+		v, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		return v
+	}
+	return read("tx_bytes"), read("rx_bytes")
+}
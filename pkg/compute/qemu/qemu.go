@@ -0,0 +1,941 @@
+// Package qemu provides a compute driver that runs VMs as qemu-system
+// processes and manages them over QMP, without libvirt. It is pure Go and
+// needs no build tags, at the cost of the features libvirt adds on top of
+// QEMU: CPU pinning, managed device binding and migration.
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"hypervisor/pkg/compute/driver"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Config holds the QEMU driver configuration.
+type Config struct {
+	// BinaryPath is the qemu-system binary. Empty uses the one for the
+	// host's architecture from PATH, e.g. qemu-system-x86_64.
+	BinaryPath string `mapstructure:"binary_path"`
+
+	// ImagePath is the directory VM images are cloned from.
+	ImagePath string `mapstructure:"image_path"`
+
+	// StatePath holds a directory per VM with its disks, seed, console
+	// log and persisted definition.
+	StatePath string `mapstructure:"state_path"`
+
+	// RunPath holds the QMP and console sockets and PID files.
+	RunPath string `mapstructure:"run_path"`
+
+	// Accelerator is the QEMU accelerator: kvm, or tcg to emulate.
+	Accelerator string `mapstructure:"accelerator"`
+
+	// AArch64Firmware is the UEFI build arm64 VMs boot.
+	AArch64Firmware string `mapstructure:"aarch64_firmware"`
+
+	// IntegrationBridge is the OVS bridge VM tap devices are plugged into.
+	IntegrationBridge string `mapstructure:"integration_bridge"`
+
+	// ShutdownTimeout bounds how long a graceful stop waits for the guest
+	// to power off.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+}
+
+// DefaultConfig returns the default QEMU configuration.
+func DefaultConfig() Config {
+	return Config{
+		ImagePath:         "/var/lib/hypervisor/images",
+		StatePath:         "/var/lib/hypervisor/qemu",
+		RunPath:           "/var/run/hypervisor/qemu",
+		Accelerator:       "kvm",
+		AArch64Firmware:   "/usr/share/AAVMF/AAVMF_CODE.fd",
+		IntegrationBridge: "br-int",
+		ShutdownTimeout:   2 * time.Minute,
+	}
+}
+
+// qemuArch describes how VMs of one CPU architecture are launched.
+type qemuArch struct {
+	Binary  string // Default qemu-system binary
+	Machine string // Machine type
+	Console string // Guest serial console device, for kernel boots
+
+	// UEFI boots the configured firmware; x86 boots QEMU's SeaBIOS
+	UEFI bool
+
+	// HotplugPorts is the number of PCIe root ports added for hot-plugged
+	// disks. The x86 pc machine hot-plugs onto its root bus.
+	HotplugPorts int
+}
+
+var qemuArches = map[string]qemuArch{
+	driver.ArchAMD64: {
+		Binary:  "qemu-system-x86_64",
+		Machine: "pc",
+		Console: "ttyS0",
+	},
+	driver.ArchARM64: {
+		Binary:       "qemu-system-aarch64",
+		Machine:      "virt",
+		Console:      "ttyAMA0",
+		UEFI:         true,
+		HotplugPorts: 8,
+	},
+}
+
+// vmState is a VM's definition, persisted as vm.json in its directory so
+// VMs survive agent restarts. QEMU processes are daemonized and keep
+// running while the agent is down.
+type vmState struct {
+	ID        string              `json:"id"`
+	Spec      driver.InstanceSpec `json:"spec"`
+	Disks     []vmDisk            `json:"disks,omitempty"`
+	Seed      string              `json:"seed,omitempty"`       // Cloud-init seed ISO
+	TapDevice string              `json:"tap_device,omitempty"` // Empty without a network interface
+	CreatedAt time.Time           `json:"created_at"`
+	StartedAt *time.Time          `json:"started_at,omitempty"`
+}
+
+// Driver implements the compute driver interface with QEMU processes.
+type Driver struct {
+	config  Config
+	logger  *zap.Logger
+	binary  string
+	version string
+	arch    qemuArch
+
+	mu  sync.RWMutex
+	vms map[string]*vmState
+}
+
+// New creates a new QEMU driver and loads the VMs defined by an earlier
+// run.
+func New(config Config, logger *zap.Logger) (*Driver, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	arch, ok := qemuArches[driver.HostArchitecture()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported host architecture %s", driver.HostArchitecture())
+	}
+
+	binary := config.BinaryPath
+	if binary == "" {
+		binary = arch.Binary
+	}
+	binary, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("qemu binary not found: %w", err)
+	}
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		return nil, fmt.Errorf("qemu-img not found: %w", err)
+	}
+	if config.Accelerator == "kvm" {
+		if _, err := os.Stat("/dev/kvm"); err != nil {
+			return nil, fmt.Errorf("kvm is not available: %w", err)
+		}
+	}
+	if arch.UEFI {
+		if _, err := os.Stat(config.AArch64Firmware); err != nil {
+			return nil, fmt.Errorf("firmware not found at %s: %w", config.AArch64Firmware, err)
+		}
+	}
+
+	out, err := exec.Command(binary, "--version").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get qemu version: %w", err)
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	version = strings.TrimPrefix(version, "QEMU emulator version ")
+
+	for _, dir := range []string{config.StatePath, config.RunPath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	d := &Driver{
+		config:  config,
+		logger:  logger,
+		binary:  binary,
+		version: version,
+		arch:    arch,
+		vms:     make(map[string]*vmState),
+	}
+	if err := d.loadState(); err != nil {
+		return nil, err
+	}
+
+	logger.Info("qemu driver initialized",
+		zap.String("binary", binary),
+		zap.String("version", version),
+		zap.String("accelerator", config.Accelerator),
+		zap.Int("vms", len(d.vms)),
+	)
+
+	return d, nil
+}
+
+// Name returns the name of the driver.
+func (d *Driver) Name() string {
+	return "qemu"
+}
+
+// Type returns the instance type this driver handles.
+func (d *Driver) Type() driver.InstanceType {
+	return driver.InstanceTypeVM
+}
+
+// Create defines a VM: it provisions its disks, cloud-init seed and tap
+// device and persists its definition. The VM is left stopped.
+func (d *Driver) Create(ctx context.Context, spec *driver.InstanceSpec) (*driver.Instance, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := driver.GuestArchitecture(spec); err != nil {
+		return nil, err
+	}
+	if err := spec.CPU.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", driver.ErrInvalidSpec, err)
+	}
+	if len(spec.PinnedCPUs) > 0 || len(spec.NUMANodes) > 0 {
+		return nil, fmt.Errorf("cpu pinning and numa placement need the libvirt driver: %w", driver.ErrNotSupported)
+	}
+	if spec.Image == "" && spec.Kernel == "" && !hasBootDisk(spec.Disks) {
+		return nil, fmt.Errorf("%w: an image, kernel or boot disk is required", driver.ErrInvalidSpec)
+	}
+
+	id := spec.InstanceID
+	if id == "" {
+		id = uuid.New().String()
+	}
+	if _, exists := d.vms[id]; exists {
+		return nil, fmt.Errorf("vm %s already exists", id)
+	}
+
+	if err := os.MkdirAll(d.vmDir(id), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create vm directory: %w", err)
+	}
+	vm := &vmState{ID: id, Spec: *spec, CreatedAt: time.Now()}
+	fail := func(err error) (*driver.Instance, error) {
+		d.cleanup(vm)
+		return nil, err
+	}
+
+	disks, err := d.provisionDisks(ctx, id, spec)
+	if err != nil {
+		return fail(err)
+	}
+	vm.Disks = disks
+
+	if spec.HasCloudInit() {
+		vm.Seed = filepath.Join(d.vmDir(id), "seed.iso")
+		if err := driver.WriteNoCloudISO(ctx, vm.Seed, id, spec); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Plug a tap device into the integration bridge for the SDN port, unless
+	// the port is bound to an SR-IOV VF, which is the device itself, or to a
+	// vhost-user port the agent plugged
+	device := spec.Network.VFAddress
+	if spec.Network.VhostUserSocket != "" {
+		device = spec.Network.DeviceName
+	}
+	if device == "" && (spec.Network.PortID != "" || spec.Network.NetworkID != "") {
+		if vm.TapDevice, err = d.createTap(id, &spec.Network); err != nil {
+			return fail(err)
+		}
+		device = vm.TapDevice
+	}
+	// Report the device so the agent can bind the port to it
+	spec.Network.DeviceName = device
+	vm.Spec.Network.DeviceName = device
+
+	if err := d.saveState(vm); err != nil {
+		return fail(err)
+	}
+	d.vms[id] = vm
+
+	d.logger.Info("vm created",
+		zap.String("id", id),
+		zap.Int("vcpus", spec.CPUCores),
+		zap.Int64("memory_mb", spec.MemoryMB),
+		zap.Int("disks", len(vm.Disks)),
+	)
+
+	return d.instance(vm, driver.StateStopped), nil
+}
+
+func hasBootDisk(disks []driver.DiskSpec) bool {
+	for _, disk := range disks {
+		if disk.Boot {
+			return true
+		}
+	}
+	return false
+}
+
+// Start launches the VM's QEMU process. QEMU daemonizes once the VM is
+// set up, so launch errors are returned here.
+func (d *Driver) Start(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return driver.ErrInstanceNotFound
+	}
+	return d.start(ctx, vm)
+}
+
+func (d *Driver) start(ctx context.Context, vm *vmState) error {
+	if d.running(ctx, vm) {
+		return nil
+	}
+
+	// Stale sockets from an earlier run would make QEMU fail to bind
+	for _, path := range []string{d.qmpSocket(vm.ID), d.consoleSocket(vm.ID), d.pidFile(vm.ID)} {
+		os.Remove(path)
+	}
+
+	cmd := exec.CommandContext(ctx, d.binary, d.commandLine(vm)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to start qemu: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+
+	now := time.Now()
+	vm.StartedAt = &now
+	if err := d.saveState(vm); err != nil {
+		d.logger.Warn("failed to save vm state", zap.String("id", vm.ID), zap.Error(err))
+	}
+
+	d.logger.Info("vm started", zap.String("id", vm.ID))
+	return nil
+}
+
+// commandLine returns the qemu-system arguments that run a VM.
+func (d *Driver) commandLine(vm *vmState) []string {
+	spec := &vm.Spec
+	cpus := spec.CPUCores
+	if cpus <= 0 {
+		cpus = 1
+	}
+	memoryMB := spec.MemoryMB
+	if memoryMB <= 0 {
+		memoryMB = 512
+	}
+
+	machine := d.arch.Machine + ",accel=" + d.config.Accelerator
+	if d.arch.UEFI && d.config.Accelerator == "kvm" {
+		machine += ",gic-version=host"
+	}
+
+	args := []string{
+		"-name", vm.ID,
+		"-machine", machine,
+		"-cpu", d.cpuModel(spec.CPU),
+		"-smp", strconv.Itoa(cpus),
+		"-m", fmt.Sprintf("%dM", memoryMB),
+		"-nodefaults", "-no-user-config",
+		"-display", "none",
+		"-daemonize",
+		"-pidfile", d.pidFile(vm.ID),
+		"-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", escapeOpt(d.qmpSocket(vm.ID))),
+		"-chardev", fmt.Sprintf("socket,id=serial0,path=%s,server=on,wait=off,logfile=%s,logappend=on",
+			escapeOpt(d.consoleSocket(vm.ID)), escapeOpt(d.consoleLog(vm.ID))),
+		"-serial", "chardev:serial0",
+	}
+	if _, err := uuid.Parse(vm.ID); err == nil {
+		args = append(args, "-uuid", vm.ID)
+	}
+	switch {
+	case spec.Network.VhostUserSocket != "":
+		// Open vSwitch maps the guest's memory to reach its buffers
+		args = append(args,
+			"-object", fmt.Sprintf("memory-backend-file,id=mem0,size=%dM,mem-path=/dev/hugepages,share=on,prealloc=on", memoryMB),
+			"-numa", "node,memdev=mem0",
+		)
+	case spec.HugePages:
+		args = append(args, "-mem-path", "/dev/hugepages", "-mem-prealloc")
+	}
+	if d.arch.UEFI {
+		args = append(args, "-bios", d.config.AArch64Firmware)
+	}
+
+	if spec.Kernel != "" {
+		args = append(args, "-kernel", spec.Kernel)
+		if spec.Initrd != "" {
+			args = append(args, "-initrd", spec.Initrd)
+		}
+		kernelArgs := spec.KernelArgs
+		if kernelArgs == "" {
+			kernelArgs = "console=" + d.arch.Console
+		}
+		args = append(args, "-append", kernelArgs)
+	}
+
+	for i := 0; i < d.arch.HotplugPorts; i++ {
+		args = append(args, "-device", fmt.Sprintf("pcie-root-port,id=%s,chassis=%d", hotplugPort(i), i+1))
+	}
+	for _, disk := range vm.Disks {
+		if disk.SSD {
+			args = append(args, "-device", "virtio-scsi-pci,id=scsi0")
+			break
+		}
+	}
+	for _, disk := range vm.Disks {
+		args = append(args, diskArgs(disk)...)
+	}
+	if vm.Seed != "" {
+		args = append(args,
+			"-drive", fmt.Sprintf("file=%s,format=raw,if=none,id=seed,readonly=on", escapeOpt(vm.Seed)),
+			"-device", "virtio-blk-pci,drive=seed",
+		)
+	}
+
+	if vm.TapDevice != "" {
+		netdev := fmt.Sprintf("tap,id=net0,ifname=%s,script=no,downscript=no", vm.TapDevice)
+		if _, err := os.Stat("/dev/vhost-net"); err == nil {
+			netdev += ",vhost=on"
+		}
+		device := virtioNetDevice(spec.Network)
+		args = append(args, "-netdev", netdev, "-device", device)
+	}
+
+	if socket := spec.Network.VhostUserSocket; socket != "" {
+		device := virtioNetDevice(spec.Network)
+		args = append(args,
+			"-chardev", fmt.Sprintf("socket,id=vhu0,path=%s,server=on,wait=off", escapeOpt(socket)),
+			"-netdev", "vhost-user,id=net0,chardev=vhu0",
+			"-device", device,
+		)
+	}
+
+	// The devices must already be bound to vfio-pci; unlike libvirt,
+	// QEMU does not rebind them
+	for _, addr := range spec.GPUDevices {
+		args = append(args, "-device", "vfio-pci,host="+addr)
+	}
+	// The agent set the VF's MAC address and VLAN on its physical function
+	if addr := spec.Network.VFAddress; addr != "" {
+		args = append(args, "-device", "vfio-pci,host="+addr)
+	}
+
+	return args
+}
+
+// cpuModel returns the -cpu argument for a CPU selection. KVM presents the
+// host CPU unless a named model is asked for; TCG emulates the richest CPU
+// it can.
+func (d *Driver) cpuModel(spec driver.CPUSpec) string {
+	model := "host"
+	if d.config.Accelerator != "kvm" {
+		model = "max"
+	}
+	if spec.Mode == driver.CPUModeCustom {
+		model = spec.Model
+	}
+	for _, feature := range spec.RequiredFeatures {
+		model += ",+" + driver.NormalizeCPUFeature(feature)
+	}
+	for _, feature := range spec.DisabledFeatures {
+		model += ",-" + driver.NormalizeCPUFeature(feature)
+	}
+	return model
+}
+
+// Stop stops a running VM. A graceful stop presses the power button and
+// waits for the guest to power off; a forced stop ends QEMU at once.
+func (d *Driver) Stop(ctx context.Context, id string, force bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return driver.ErrInstanceNotFound
+	}
+	if err := d.stop(ctx, vm, force); err != nil {
+		return err
+	}
+
+	d.logger.Info("vm stopped", zap.String("id", id), zap.Bool("force", force))
+	return nil
+}
+
+func (d *Driver) stop(ctx context.Context, vm *vmState, force bool) error {
+	if !d.running(ctx, vm) {
+		return d.stopped(vm)
+	}
+
+	command := "system_powerdown"
+	timeout := d.config.ShutdownTimeout
+	if force {
+		command = "quit"
+		timeout = qmpTimeout
+	}
+	if err := runQMP(ctx, d.qmpSocket(vm.ID), command, nil, nil); err != nil && !errors.Is(err, errNotRunning) {
+		return fmt.Errorf("failed to stop vm: %w", err)
+	}
+	if err := d.waitExit(ctx, vm, timeout); err != nil {
+		return err
+	}
+	return d.stopped(vm)
+}
+
+// stopped records that a VM is no longer running.
+func (d *Driver) stopped(vm *vmState) error {
+	os.Remove(d.pidFile(vm.ID))
+	if vm.StartedAt == nil {
+		return nil
+	}
+	vm.StartedAt = nil
+	return d.saveState(vm)
+}
+
+// waitExit waits up to timeout for a VM's QEMU process to exit.
+func (d *Driver) waitExit(ctx context.Context, vm *vmState, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if d.pid(vm.ID) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("vm %s did not stop: %w", vm.ID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Delete stops a VM if needed and removes it with its tap device and the
+// disks the driver created.
+func (d *Driver) Delete(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return driver.ErrInstanceNotFound
+	}
+	if err := d.stop(ctx, vm, true); err != nil {
+		return err
+	}
+
+	d.cleanup(vm)
+	delete(d.vms, id)
+
+	d.logger.Info("vm deleted", zap.String("id", id))
+	return nil
+}
+
+// cleanup removes everything the driver created for a VM.
+func (d *Driver) cleanup(vm *vmState) {
+	if vm.TapDevice != "" {
+		if err := d.deleteTap(vm.TapDevice); err != nil {
+			d.logger.Warn("failed to delete tap", zap.String("id", vm.ID), zap.Error(err))
+		}
+	}
+	for _, path := range []string{d.qmpSocket(vm.ID), d.consoleSocket(vm.ID), d.pidFile(vm.ID)} {
+		os.Remove(path)
+	}
+	if err := os.RemoveAll(d.vmDir(vm.ID)); err != nil {
+		d.logger.Warn("failed to remove vm directory", zap.String("id", vm.ID), zap.Error(err))
+	}
+}
+
+// Get retrieves a VM by ID.
+func (d *Driver) Get(ctx context.Context, id string) (*driver.Instance, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return nil, driver.ErrInstanceNotFound
+	}
+	return d.instance(vm, d.state(ctx, vm)), nil
+}
+
+// List lists all VMs.
+func (d *Driver) List(ctx context.Context) ([]*driver.Instance, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	instances := make([]*driver.Instance, 0, len(d.vms))
+	for _, vm := range d.vms {
+		instances = append(instances, d.instance(vm, d.state(ctx, vm)))
+	}
+	return instances, nil
+}
+
+func (d *Driver) instance(vm *vmState, state driver.InstanceState) *driver.Instance {
+	instance := &driver.Instance{
+		ID:        vm.ID,
+		Name:      vm.ID,
+		Type:      driver.InstanceTypeVM,
+		State:     state,
+		Spec:      vm.Spec,
+		CreatedAt: vm.CreatedAt,
+	}
+	if state != driver.StateStopped {
+		instance.StartedAt = vm.StartedAt
+	}
+	return instance
+}
+
+// state asks QEMU for the VM's run state. A VM without a QEMU process is
+// stopped.
+func (d *Driver) state(ctx context.Context, vm *vmState) driver.InstanceState {
+	status, err := d.status(ctx, vm)
+	if err != nil {
+		if errors.Is(err, errNotRunning) {
+			return driver.StateStopped
+		}
+		return driver.StateUnknown
+	}
+	switch status {
+	case "running":
+		return driver.StateRunning
+	case "paused", "suspended":
+		return driver.StatePaused
+	case "shutdown":
+		return driver.StateStopped
+	case "internal-error", "io-error", "guest-panicked":
+		return driver.StateFailed
+	default:
+		return driver.StateUnknown
+	}
+}
+
+// status returns the VM's status from query-status, e.g. "running".
+func (d *Driver) status(ctx context.Context, vm *vmState) (string, error) {
+	if d.pid(vm.ID) == 0 {
+		return "", errNotRunning
+	}
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := runQMP(ctx, d.qmpSocket(vm.ID), "query-status", nil, &result); err != nil {
+		return "", err
+	}
+	return result.Status, nil
+}
+
+// running reports whether the VM has a live QEMU process.
+func (d *Driver) running(ctx context.Context, vm *vmState) bool {
+	status, err := d.status(ctx, vm)
+	return err == nil && status != "shutdown"
+}
+
+// Stats returns runtime statistics for a VM: the CPU time and resident
+// memory of its QEMU process, and its disk and network traffic.
+func (d *Driver) Stats(ctx context.Context, id string) (*driver.InstanceStats, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return nil, driver.ErrInstanceNotFound
+	}
+	pid := d.pid(id)
+	if pid == 0 {
+		return nil, driver.ErrInstanceStopped
+	}
+
+	stats := &driver.InstanceStats{
+		InstanceID:  id,
+		CollectedAt: time.Now(),
+	}
+	stats.CPUTimeNs, stats.MemoryUsedBytes = processUsage(pid)
+
+	var blockStats []struct {
+		Stats struct {
+			ReadBytes  uint64 `json:"rd_bytes"`
+			WriteBytes uint64 `json:"wr_bytes"`
+		} `json:"stats"`
+	}
+	if err := runQMP(ctx, d.qmpSocket(id), "query-blockstats", nil, &blockStats); err != nil {
+		d.logger.Debug("failed to query block stats", zap.String("id", id), zap.Error(err))
+	}
+	for _, device := range blockStats {
+		stats.DiskReadBytes += device.Stats.ReadBytes
+		stats.DiskWriteBytes += device.Stats.WriteBytes
+	}
+
+	if vm.TapDevice != "" {
+		stats.NetworkRxBytes, stats.NetworkTxBytes = tapCounters(vm.TapDevice)
+	}
+	return stats, nil
+}
+
+// clockTicks is the kernel's USER_HZ, the unit of CPU times in /proc.
+const clockTicks = 100
+
+// processUsage returns the CPU time and resident memory of a process.
+func processUsage(pid int) (cpuTimeNs, rssBytes uint64) {
+	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		// Fields follow the parenthesized command name; utime and stime
+		// are the 14th and 15th fields
+		if i := strings.LastIndexByte(string(data), ')'); i >= 0 {
+			fields := strings.Fields(string(data[i+1:]))
+			if len(fields) > 12 {
+				utime, _ := strconv.ParseUint(fields[11], 10, 64)
+				stime, _ := strconv.ParseUint(fields[12], 10, 64)
+				cpuTimeNs = (utime + stime) * uint64(time.Second/clockTicks)
+			}
+		}
+	}
+	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid)); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 1 {
+			pages, _ := strconv.ParseUint(fields[1], 10, 64)
+			rssBytes = pages * uint64(os.Getpagesize())
+		}
+	}
+	return cpuTimeNs, rssBytes
+}
+
+// Pause freezes a running VM's vCPUs.
+func (d *Driver) Pause(ctx context.Context, id string) error {
+	return d.runCommand(ctx, id, "stop", "paused")
+}
+
+// Resume continues a paused VM.
+func (d *Driver) Resume(ctx context.Context, id string) error {
+	return d.runCommand(ctx, id, "cont", "resumed")
+}
+
+// runCommand runs a QMP command without arguments against a running VM.
+func (d *Driver) runCommand(ctx context.Context, id, command, event string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return driver.ErrInstanceNotFound
+	}
+	if !d.running(ctx, vm) {
+		return driver.ErrInstanceStopped
+	}
+	if err := runQMP(ctx, d.qmpSocket(id), command, nil, nil); err != nil {
+		return fmt.Errorf("failed to run %s: %w", command, err)
+	}
+
+	d.logger.Info("vm "+event, zap.String("id", id))
+	return nil
+}
+
+// Restart restarts a VM. A forced restart resets it like the reset button;
+// otherwise the guest is shut down and QEMU started again.
+func (d *Driver) Restart(ctx context.Context, id string, force bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return driver.ErrInstanceNotFound
+	}
+
+	if force && d.running(ctx, vm) {
+		if err := runQMP(ctx, d.qmpSocket(id), "system_reset", nil, nil); err != nil {
+			return fmt.Errorf("failed to reset vm: %w", err)
+		}
+		d.logger.Info("vm reset", zap.String("id", id))
+		return nil
+	}
+
+	if err := d.stop(ctx, vm, false); err != nil {
+		return err
+	}
+	return d.start(ctx, vm)
+}
+
+// Attach connects to a VM's serial console. QEMU serves one console client
+// at a time.
+func (d *Driver) Attach(ctx context.Context, id string, opts driver.AttachOptions) (io.ReadWriteCloser, error) {
+	d.mu.RLock()
+	vm, ok := d.vms[id]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, driver.ErrInstanceNotFound
+	}
+	if !d.running(ctx, vm) {
+		return nil, driver.ErrInstanceStopped
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", d.consoleSocket(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to console: %w", err)
+	}
+	return conn, nil
+}
+
+// BootDiagnostics reads the end of a VM's serial console log. VMs run
+// without a display, so there is no screenshot.
+func (d *Driver) BootDiagnostics(ctx context.Context, id string, lines int) (*driver.BootDiagnostics, error) {
+	d.mu.RLock()
+	_, ok := d.vms[id]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, driver.ErrInstanceNotFound
+	}
+
+	serial, err := driver.TailLines(d.consoleLog(id), lines)
+	if err != nil {
+		return nil, err
+	}
+	return &driver.BootDiagnostics{
+		SerialOutput: serial,
+		CollectedAt:  time.Now(),
+	}, nil
+}
+
+// LogPath returns the log file a VM's serial console is written to.
+func (d *Driver) LogPath(ctx context.Context, id string) (string, error) {
+	d.mu.RLock()
+	_, ok := d.vms[id]
+	d.mu.RUnlock()
+	if !ok {
+		return "", driver.ErrInstanceNotFound
+	}
+	return d.consoleLog(id), nil
+}
+
+// GetHostInfo returns information about the host.
+func (d *Driver) GetHostInfo(ctx context.Context) (*driver.HostInfo, error) {
+	hostname, _ := os.Hostname()
+	info := &driver.HostInfo{
+		Hostname:          hostname,
+		CPUCores:          runtime.NumCPU(),
+		HypervisorType:    "QEMU",
+		HypervisorVersion: d.version,
+	}
+
+	var si syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&si); err == nil {
+		info.MemoryBytes = int64(si.Totalram) * int64(si.Unit)
+		info.FreeMemoryBytes = int64(si.Freeram) * int64(si.Unit)
+	}
+	return info, nil
+}
+
+// Capabilities returns the optional operations the driver supports.
+// Resizing, suspending to disk and migration are left to the libvirt
+// driver.
+func (d *Driver) Capabilities() driver.Capabilities {
+	return driver.Capabilities{
+		Console:     true,
+		Logs:        true,
+		Pause:       true,
+		Diagnostics: true,
+	}
+}
+
+// Close releases resources. VMs keep running; the driver finds them again
+// on its next start.
+func (d *Driver) Close() error {
+	d.logger.Info("qemu driver closed")
+	return nil
+}
+
+func (d *Driver) vmDir(id string) string {
+	return filepath.Join(d.config.StatePath, id)
+}
+
+func (d *Driver) consoleLog(id string) string {
+	return filepath.Join(d.vmDir(id), "console.log")
+}
+
+func (d *Driver) qmpSocket(id string) string {
+	return filepath.Join(d.config.RunPath, id+".qmp")
+}
+
+func (d *Driver) consoleSocket(id string) string {
+	return filepath.Join(d.config.RunPath, id+".console")
+}
+
+func (d *Driver) pidFile(id string) string {
+	return filepath.Join(d.config.RunPath, id+".pid")
+}
+
+// pid returns the PID of a VM's QEMU process, or 0 if it is not running.
+func (d *Driver) pid(id string) int {
+	data, err := os.ReadFile(d.pidFile(id))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	// The PID may have been reused since QEMU exited
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil || !strings.HasPrefix(string(comm), "qemu") {
+		return 0
+	}
+	return pid
+}
+
+// saveState persists a VM's definition.
+func (d *Driver) saveState(vm *vmState) error {
+	data, err := json.MarshalIndent(vm, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode vm state: %w", err)
+	}
+	path := filepath.Join(d.vmDir(vm.ID), "vm.json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to save vm state: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save vm state: %w", err)
+	}
+	return nil
+}
+
+// loadState loads the VMs persisted in the state directory.
+func (d *Driver) loadState() error {
+	entries, err := os.ReadDir(d.config.StatePath)
+	if err != nil {
+		return fmt.Errorf("failed to read state directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(d.config.StatePath, entry.Name(), "vm.json"))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				d.logger.Warn("failed to read vm state", zap.String("vm", entry.Name()), zap.Error(err))
+			}
+			continue
+		}
+		var vm vmState
+		if err := json.Unmarshal(data, &vm); err != nil || vm.ID != entry.Name() {
+			d.logger.Warn("ignoring invalid vm state", zap.String("vm", entry.Name()), zap.Error(err))
+			continue
+		}
+		d.vms[vm.ID] = &vm
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package qemu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// qmpTimeout bounds one QMP exchange when the context has no deadline.
+const qmpTimeout = 30 * time.Second
+
+// errNotRunning is returned when a VM's QMP socket cannot be reached
+// because its QEMU process is gone.
+var errNotRunning = errors.New("qemu process is not running")
+
+// qmpError is an error returned by QEMU for a command.
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("qmp %s: %s", e.Class, e.Desc)
+}
+
+// qmpMessage is any message QEMU sends: the greeting, a command's return
+// or error, or an asynchronous event.
+type qmpMessage struct {
+	QMP    json.RawMessage `json:"QMP"`
+	Return json.RawMessage `json:"return"`
+	Error  *qmpError       `json:"error"`
+	Event  string          `json:"event"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// qmpConn is a QMP session over a VM's monitor socket. QEMU serves one
+// session at a time, so sessions are short-lived: one per driver operation.
+type qmpConn struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+
+	// events received while waiting for command replies, for waitEvent
+	events []qmpMessage
+}
+
+// dialQMP connects to a QMP socket, reads the greeting and leaves
+// capabilities negotiation mode so commands can be run.
+func dialQMP(ctx context.Context, path string) (*qmpConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotRunning, err)
+	}
+
+	c := &qmpConn{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(conn),
+	}
+	c.setDeadline(ctx)
+
+	var greeting qmpMessage
+	if err := c.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read qmp greeting: %w", err)
+	}
+	if greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected qmp greeting")
+	}
+	if err := c.execute(ctx, "qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// runQMP runs one command in a new session.
+func runQMP(ctx context.Context, path, command string, args, result any) error {
+	c, err := dialQMP(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.execute(ctx, command, args, result)
+}
+
+// execute runs a command and decodes its return value into result, if it
+// is not nil. Events received meanwhile are kept for waitEvent.
+func (c *qmpConn) execute(ctx context.Context, command string, args, result any) error {
+	c.setDeadline(ctx)
+
+	req := map[string]any{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := c.enc.Encode(req); err != nil {
+		return fmt.Errorf("failed to send qmp command %s: %w", command, err)
+	}
+
+	for {
+		var msg qmpMessage
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("failed to read qmp reply to %s: %w", command, err)
+		}
+		switch {
+		case msg.Event != "":
+			c.events = append(c.events, msg)
+			continue
+		case msg.Error != nil:
+			return msg.Error
+		case result != nil:
+			if err := json.Unmarshal(msg.Return, result); err != nil {
+				return fmt.Errorf("failed to decode qmp reply to %s: %w", command, err)
+			}
+		}
+		return nil
+	}
+}
+
+// waitEvent waits up to timeout for an event named event whose data
+// satisfies match, which may be nil to accept any. Events that arrived
+// during earlier commands are considered first.
+func (c *qmpConn) waitEvent(ctx context.Context, event string, timeout time.Duration, match func(data json.RawMessage) bool) error {
+	matches := func(msg qmpMessage) bool {
+		return msg.Event == event && (match == nil || match(msg.Data))
+	}
+	for i, msg := range c.events {
+		if matches(msg) {
+			c.events = append(c.events[:i], c.events[i+1:]...)
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	c.setDeadline(ctx)
+	defer c.setDeadline(context.Background())
+
+	for {
+		var msg qmpMessage
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("failed to wait for qmp event %s: %w", event, err)
+		}
+		if matches(msg) {
+			return nil
+		}
+	}
+}
+
+func (c *qmpConn) setDeadline(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(qmpTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+}
+
+// Close ends the session.
+func (c *qmpConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,242 @@
+// Package health runs the checks that tell whether a process can serve:
+// its connection to etcd, its drivers, the SDN. Results are published
+// through the standard gRPC health service (grpc.health.v1.Health), per
+// check and per gRPC service gated by them, and over HTTP for load
+// balancers and systemd.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Config configures health checking.
+type Config struct {
+	// Interval is how often the checks run.
+	Interval time.Duration `mapstructure:"interval"`
+
+	// Timeout bounds each check.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// DefaultConfig returns the default health checking configuration.
+func DefaultConfig() Config {
+	return Config{
+		Interval: 10 * time.Second,
+		Timeout:  5 * time.Second,
+	}
+}
+
+// Check tells whether a dependency is usable; an error says why not.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a check's last run.
+type Result struct {
+	Name      string
+	Healthy   bool
+	Message   string
+	CheckedAt time.Time
+}
+
+type check struct {
+	name     string
+	fn       Check
+	services []string
+}
+
+// Checker runs checks periodically and publishes their results. Until the
+// first run completes, everything is reported not serving.
+type Checker struct {
+	config Config
+	logger *zap.Logger
+	server *grpchealth.Server
+
+	mu      sync.RWMutex
+	checks  []check
+	results map[string]Result
+}
+
+// NewChecker creates a health checker.
+func NewChecker(config Config, logger *zap.Logger) *Checker {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultConfig().Interval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultConfig().Timeout
+	}
+
+	c := &Checker{
+		config:  config,
+		logger:  logger,
+		server:  grpchealth.NewServer(),
+		results: make(map[string]Result),
+	}
+	c.server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return c
+}
+
+// AddCheck adds a check, published under its name. The gRPC services
+// listed, e.g. "hypervisor.v1.ComputeService", are serving only while all
+// of their checks pass; the overall status ("") needs every check to pass.
+func (c *Checker) AddCheck(name string, fn Check, services ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, check{name: name, fn: fn, services: services})
+	c.server.SetServingStatus(name, healthpb.HealthCheckResponse_NOT_SERVING)
+	for _, service := range services {
+		c.server.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+// Register serves the gRPC health service on s.
+func (c *Checker) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, c.server)
+}
+
+// Run runs the checks until ctx is done, starting right away.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.runChecks(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown reports everything not serving from now on, so that load
+// balancers stop sending requests while the process stops.
+func (c *Checker) Shutdown() {
+	c.server.Shutdown()
+}
+
+func (c *Checker) runChecks(ctx context.Context) {
+	c.mu.RLock()
+	checks := c.checks
+	c.mu.RUnlock()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, ch := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+			defer cancel()
+
+			result := Result{Name: ch.name, Healthy: true, Message: "ok"}
+			if err := ch.fn(checkCtx); err != nil {
+				result.Healthy, result.Message = false, err.Error()
+			}
+			result.CheckedAt = time.Now()
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	healthy := true
+	services := make(map[string]bool)
+	for i, ch := range checks {
+		result := results[i]
+		if previous, ok := c.results[ch.name]; ok && previous.Healthy != result.Healthy {
+			if result.Healthy {
+				c.logger.Info("health check recovered", zap.String("check", ch.name))
+			} else {
+				c.logger.Warn("health check failing", zap.String("check", ch.name), zap.String("error", result.Message))
+			}
+		}
+		c.results[ch.name] = result
+
+		c.server.SetServingStatus(ch.name, servingStatus(result.Healthy))
+		for _, service := range ch.services {
+			ok, seen := services[service]
+			services[service] = (ok || !seen) && result.Healthy
+		}
+		healthy = healthy && result.Healthy
+	}
+	for service, ok := range services {
+		c.server.SetServingStatus(service, servingStatus(ok))
+	}
+	c.server.SetServingStatus("", servingStatus(healthy))
+}
+
+func servingStatus(healthy bool) healthpb.HealthCheckResponse_ServingStatus {
+	if healthy {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+// Results returns the results of the last run, sorted by check name.
+// Checks that have not run yet are reported failing.
+func (c *Checker) Results() []Result {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	results := make([]Result, 0, len(c.checks))
+	for _, ch := range c.checks {
+		result, ok := c.results[ch.name]
+		if !ok {
+			result = Result{Name: ch.name, Message: "not checked yet"}
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
+
+// LivenessHandler answers 200 while the process serves HTTP, for probes
+// deciding whether to restart it.
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// ReadinessHandler answers 200 when every check passed its last run and
+// 503 otherwise, listing the checks, for probes deciding whether to send
+// requests.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results := c.Results()
+
+		var body strings.Builder
+		code := http.StatusOK
+		for _, result := range results {
+			mark := "+"
+			if !result.Healthy {
+				mark, code = "-", http.StatusServiceUnavailable
+			}
+			fmt.Fprintf(&body, "[%s]%s %s\n", mark, result.Name, result.Message)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprint(w, body.String())
+	})
+}
@@ -0,0 +1,307 @@
+// Package metrics provides Prometheus metrics shared by the hypervisor server
+// and agent, and the HTTP endpoint that exposes them.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "hypervisor"
+
+// Registry holds all hypervisor metrics plus the Go runtime and process collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	grpcRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of gRPC requests handled, by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	schedulingAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scheduler",
+		Name:      "attempts_total",
+		Help:      "Instance scheduling attempts, by result.",
+	}, []string{"result"})
+
+	instanceStateTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "instance",
+		Name:      "state_transitions_total",
+		Help:      "Instance state transitions recorded in the registry.",
+	}, []string{"from", "to"})
+
+	etcdOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "etcd",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of etcd operations, by operation and result.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "result"})
+
+	driverOperationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "driver",
+		Name:      "operation_failures_total",
+		Help:      "Compute driver operations that returned an error, by driver and operation.",
+	}, []string{"driver", "operation"})
+
+	agentPoolConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "agent_pool",
+		Name:      "connections",
+		Help:      "Server connections to agents, by gRPC connectivity state.",
+	}, []string{"state"})
+
+	agentPoolEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "agent_pool",
+		Name:      "evictions_total",
+		Help:      "Agent connections closed by the health checker, by reason.",
+	}, []string{"reason"})
+
+	agentPoolFailFast = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "agent_pool",
+		Name:      "fail_fast_total",
+		Help:      "Agent calls refused without trying because the connection was down.",
+	})
+
+	grpcRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "rate_limited_total",
+		Help:      "gRPC calls refused by a rate or concurrency limit, by method and limit.",
+	}, []string{"method", "limit"})
+
+	networkFlowDrift = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "network",
+		Name:      "flow_drift_total",
+		Help:      "Flows found missing from the integration bridge by the flow audit, by owner.",
+	}, []string{"owner"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		grpcRequestDuration,
+		schedulingAttempts,
+		instanceStateTransitions,
+		etcdOperationDuration,
+		driverOperationFailures,
+		agentPoolConnections,
+		agentPoolEvictions,
+		agentPoolFailFast,
+		grpcRateLimited,
+		networkFlowDrift,
+	)
+}
+
+// Scheduling attempt results.
+const (
+	ScheduleSuccess = "success"
+	ScheduleNoNode  = "no_node"
+	ScheduleError   = "error"
+)
+
+// ObserveGRPCRequest records the latency and status of a gRPC request.
+func ObserveGRPCRequest(method string, start time.Time, err error) {
+	grpcRequestDuration.WithLabelValues(method, status.Code(err).String()).Observe(time.Since(start).Seconds())
+}
+
+// ObserveRateLimited records a gRPC call refused by a rate or concurrency
+// limit.
+func ObserveRateLimited(method, limit string) {
+	grpcRateLimited.WithLabelValues(method, limit).Inc()
+}
+
+// ObserveSchedulingAttempt records the result of an instance scheduling attempt.
+func ObserveSchedulingAttempt(result string) {
+	schedulingAttempts.WithLabelValues(result).Inc()
+}
+
+// ObserveInstanceTransition records an instance moving between states. An
+// empty from state means the instance was just created.
+func ObserveInstanceTransition(from, to string) {
+	if from == to {
+		return
+	}
+	if from == "" {
+		from = "none"
+	}
+	instanceStateTransitions.WithLabelValues(from, to).Inc()
+}
+
+// ObserveEtcdOperation records the latency and result of an etcd operation.
+func ObserveEtcdOperation(operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	etcdOperationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// ObserveDriverFailure records a failed compute driver operation.
+func ObserveDriverFailure(driver, operation string) {
+	driverOperationFailures.WithLabelValues(driver, operation).Inc()
+}
+
+// SetAgentPoolConnections records how many agent connections are in each
+// connectivity state. States missing from counts are reset to zero.
+func SetAgentPoolConnections(counts map[string]int) {
+	agentPoolConnections.Reset()
+	for state, n := range counts {
+		agentPoolConnections.WithLabelValues(state).Set(float64(n))
+	}
+}
+
+// ObserveAgentPoolEviction records an agent connection closed by the
+// health checker.
+func ObserveAgentPoolEviction(reason string) {
+	agentPoolEvictions.WithLabelValues(reason).Inc()
+}
+
+// ObserveAgentPoolFailFast records an agent call refused because the
+// connection was down.
+func ObserveAgentPoolFailFast() {
+	agentPoolFailFast.Inc()
+}
+
+// Owners of the flows audited by the agent.
+const (
+	FlowOwnerPort         = "port"
+	FlowOwnerARPResponder = "arp_responder"
+)
+
+// ObserveFlowDrift records flows of an owner found missing from the
+// integration bridge.
+func ObserveFlowDrift(owner string, missing int) {
+	networkFlowDrift.WithLabelValues(owner).Add(float64(missing))
+}
+
+// RegisterWorkQueueDepth exposes the agent's instance work queue depth,
+// as reported by depth, as a gauge. The gauge belongs to one agent, so it
+// goes on that agent's registry rather than the process-wide Registry,
+// where a second agent in the same process would panic registering it.
+func RegisterWorkQueueDepth(reg prometheus.Registerer, depth func() float64) {
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "workqueue_depth",
+		Help:      "Instance operations queued or running in the agent work queue.",
+	}, depth))
+}
+
+// RegisterCreateLoad exposes the agent's running and queued instance creates
+// as gauges on the agent's registry.
+func RegisterCreateLoad(reg prometheus.Registerer, inFlight, queued func() float64) {
+	reg.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "agent",
+			Name:      "creates_in_flight",
+			Help:      "Instance creates currently running on the agent.",
+		}, inFlight),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "agent",
+			Name:      "creates_queued",
+			Help:      "Instance creates waiting for a slot under the agent's concurrency limit.",
+		}, queued),
+	)
+}
+
+// UnaryServerInterceptor records request metrics for unary gRPC calls.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		ObserveGRPCRequest(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records request metrics for streaming gRPC calls.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		ObserveGRPCRequest(info.FullMethod, start, err)
+		return err
+	}
+}
+
+// Server serves the /metrics endpoint over HTTP.
+type Server struct {
+	httpServer *http.Server
+	mux        *http.ServeMux
+	logger     *zap.Logger
+}
+
+// NewServer creates a metrics HTTP server listening on addr. It serves
+// Registry plus the metrics of the given per-component registries.
+func NewServer(addr string, logger *zap.Logger, gatherers ...prometheus.Gatherer) *Server {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	gatherer := append(prometheus.Gatherers{Registry}, gatherers...)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{Registry: Registry}))
+
+	return &Server{
+		httpServer: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		mux:    mux,
+		logger: logger,
+	}
+}
+
+// Handle serves another endpoint next to /metrics, e.g. health probes. It
+// must be called before Start.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start starts serving metrics in the background.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.httpServer.Addr, err)
+	}
+
+	s.logger.Info("starting metrics server", zap.String("addr", s.httpServer.Addr))
+
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("metrics server error", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// Stop shuts the metrics server down.
+func (s *Server) Stop(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
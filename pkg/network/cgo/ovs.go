@@ -1,11 +1,11 @@
 // Package cgo provides Go bindings for network acceleration libraries.
-// This is a pure-Go implementation using ovs-vsctl command line tool.
+// This is a pure-Go implementation: Open vSwitch is configured through
+// ovsdb-server's management protocol and programmed with ovs-ofctl.
 package cgo
 
 import (
 	"fmt"
 	"net"
-	"os/exec"
 	"strconv"
 	"strings"
 
@@ -13,259 +13,303 @@ import (
 	"hypervisor/pkg/network/overlay"
 )
 
-// OVSBridge wraps OVS bridge operations using ovs-vsctl.
+// OVSBridge wraps OVS bridge operations. Configuration changes are OVSDB
+// transactions on a connection shared by every OVSBridge of the process.
 type OVSBridge struct {
 	name string
+	db   *OVSDBClient
 }
 
 // NewOVSBridge creates a new OVS bridge wrapper.
 func NewOVSBridge(name string) *OVSBridge {
-	return &OVSBridge{name: name}
+	return &OVSBridge{name: name, db: defaultOVSDB}
 }
 
-// CreateBridge creates an OVS bridge.
+// interfaceIntColumns are the integer columns of the Interface table that
+// AddPort options may set.
+var interfaceIntColumns = map[string]bool{
+	"mtu_request":            true,
+	"ofport_request":         true,
+	"ingress_policing_rate":  true,
+	"ingress_policing_burst": true,
+}
+
+// CreateBridge creates an OVS bridge, with its internal port, if it does
+// not exist.
 func (b *OVSBridge) CreateBridge(name string) error {
-	cmd := exec.Command("ovs-vsctl", "--may-exist", "add-br", name)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create bridge: %s: %w", string(out), err)
+	_, err := b.db.transact(
+		opAbsent("Bridge", where(cond("name", "==", name))),
+		opInsert("Interface", map[string]any{"name": name, "type": "internal"}, "iface"),
+		opInsert("Port", map[string]any{"name": name, "interfaces": ovsNamedUUID("iface")}, "port"),
+		opInsert("Bridge", map[string]any{"name": name, "ports": ovsNamedUUID("port")}, "bridge"),
+		opMutate("Open_vSwitch", where(), mutation("bridges", "insert", ovsSet(ovsNamedUUID("bridge")))),
+	)
+	if err != nil && !isOVSDBError(err, "timed out") {
+		return fmt.Errorf("failed to create bridge: %w", err)
 	}
 	return nil
 }
 
-// DeleteBridge deletes an OVS bridge.
+// DeleteBridge deletes an OVS bridge, if it exists. Its ports and
+// interfaces go with it.
 func (b *OVSBridge) DeleteBridge(name string) error {
-	cmd := exec.Command("ovs-vsctl", "--if-exists", "del-br", name)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to delete bridge: %s: %w", string(out), err)
+	uuid, err := b.findUUID("Bridge", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete bridge: %w", err)
+	}
+	if uuid == "" {
+		return nil
+	}
+
+	_, err = b.db.transact(
+		opMutate("Open_vSwitch", where(), mutation("bridges", "delete", ovsSet(ovsUUID(uuid)))),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete bridge: %w", err)
 	}
 	return nil
 }
 
 // BridgeExists checks if a bridge exists.
 func (b *OVSBridge) BridgeExists(name string) (bool, error) {
-	cmd := exec.Command("ovs-vsctl", "br-exists", name)
-	err := cmd.Run()
+	uuid, err := b.findUUID("Bridge", name)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			if exitErr.ExitCode() == 2 {
-				return false, nil
-			}
-		}
 		return false, err
 	}
-	return true, nil
+	return uuid != "", nil
 }
 
-// AddPort adds a port to the bridge.
-func (b *OVSBridge) AddPort(bridge, port string, options map[string]string) error {
-	args := []string{"--may-exist", "add-port", bridge, port}
-
-	// Add options
-	for k, v := range options {
-		args = append(args, "--", "set", "interface", port, fmt.Sprintf("%s=%s", k, v))
+// SetBridgeDatapathType sets the datapath_type of a bridge (system or netdev).
+func (b *OVSBridge) SetBridgeDatapathType(bridge, datapathType string) error {
+	results, err := b.db.transact(
+		opUpdate("Bridge", where(cond("name", "==", bridge)), map[string]any{"datapath_type": datapathType}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set bridge datapath type: %w", err)
 	}
-
-	cmd := exec.Command("ovs-vsctl", args...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add port: %s: %w", string(out), err)
+	if results[0].Count == 0 {
+		return fmt.Errorf("failed to set bridge datapath type: no bridge named %s", bridge)
 	}
 	return nil
 }
 
-// DeletePort removes a port from the bridge.
-func (b *OVSBridge) DeletePort(bridge, port string) error {
-	cmd := exec.Command("ovs-vsctl", "--if-exists", "del-port", bridge, port)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to delete port: %s: %w", string(out), err)
+// ConfigureDatapath applies the datapath mode to the Open_vSwitch table and
+// switches the configured bridges to the matching datapath_type, in one
+// transaction. Bridges that do not exist yet are skipped.
+func (b *OVSBridge) ConfigureDatapath(cfg *network.DatapathConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
 	}
-	return nil
-}
 
-// AddVXLANPort adds a VXLAN tunnel port.
-func (b *OVSBridge) AddVXLANPort(bridge, portName string, vni uint32, remoteIP, localIP net.IP) error {
-	args := []string{
-		"--may-exist", "add-port", bridge, portName,
-		"--", "set", "interface", portName,
-		"type=vxlan",
-		fmt.Sprintf("options:key=%d", vni),
-		fmt.Sprintf("options:remote_ip=%s", remoteIP.String()),
+	// Clear keys left over from a previous mode so ovs-vswitchd does not keep
+	// initializing DPDK or offloading to tc after a mode change. The keys
+	// set are cleared too, as inserting into a map keeps existing values.
+	otherConfig := cfg.OtherConfig()
+	stale := make(map[string]string, len(otherConfig))
+	for k := range otherConfig {
+		stale[k] = ""
 	}
-
-	if localIP != nil {
-		args = append(args, fmt.Sprintf("options:local_ip=%s", localIP.String()))
+	if cfg.Mode != network.DatapathDPDK {
+		for _, k := range []string{"dpdk-init", "pmd-cpu-mask", "dpdk-lcore-mask", "dpdk-socket-mem"} {
+			stale[k] = ""
+		}
 	}
-
-	cmd := exec.Command("ovs-vsctl", args...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add VXLAN port: %s: %w", string(out), err)
+	if cfg.Mode != network.DatapathHWOffload {
+		stale["tc-policy"] = ""
 	}
-	return nil
-}
 
-// DeleteVXLANPort removes a VXLAN tunnel port.
-func (b *OVSBridge) DeleteVXLANPort(bridge, portName string) error {
-	return b.DeletePort(bridge, portName)
-}
+	ops := []ovsdbOp{
+		opMutate("Open_vSwitch", where(),
+			mutation("other_config", "delete", ovsKeys(stale)),
+			mutation("other_config", "insert", ovsMap(otherConfig)),
+		),
+	}
+	for _, bridge := range cfg.Bridges {
+		ops = append(ops, opUpdate("Bridge", where(cond("name", "==", bridge)),
+			map[string]any{"datapath_type": cfg.BridgeDatapathType()}))
+	}
 
-// AddFlow adds an OpenFlow rule.
-func (b *OVSBridge) AddFlow(bridge string, rule *network.FlowRule) error {
-	flowStr := b.buildFlowString(rule)
-	cmd := exec.Command("ovs-ofctl", "add-flow", bridge, flowStr)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add flow: %s: %w", string(out), err)
+	if _, err := b.db.transact(ops...); err != nil {
+		return fmt.Errorf("failed to configure datapath: %w", err)
 	}
 	return nil
 }
 
-// buildFlowString converts a FlowRule to ovs-ofctl flow string.
-func (b *OVSBridge) buildFlowString(rule *network.FlowRule) string {
-	parts := []string{
-		fmt.Sprintf("table=%d", rule.TableID),
-		fmt.Sprintf("priority=%d", rule.Priority),
-		fmt.Sprintf("cookie=0x%x", rule.Cookie),
+// VhostUserSupported reports whether ovs-vswitchd initialized DPDK and can
+// plug vhost-user ports into netdev bridges.
+func (b *OVSBridge) VhostUserSupported() (bool, error) {
+	results, err := b.db.transact(opSelect("Open_vSwitch", where(), "dpdk_initialized", "iface_types"))
+	if err != nil {
+		return false, fmt.Errorf("failed to get datapath features: %w", err)
+	}
+	if len(results[0].Rows) == 0 {
+		return false, nil
 	}
 
-	// Match fields
-	if rule.Match.InPort > 0 {
-		parts = append(parts, fmt.Sprintf("in_port=%d", rule.Match.InPort))
+	row := results[0].Rows[0]
+	if initialized, _ := row["dpdk_initialized"].(bool); !initialized {
+		return false, nil
 	}
-	if rule.Match.DLSrc != "" {
-		parts = append(parts, fmt.Sprintf("dl_src=%s", rule.Match.DLSrc))
+	for _, ifaceType := range rowAtoms(row["iface_types"]) {
+		if ifaceType == "dpdkvhostuserclient" {
+			return true, nil
+		}
 	}
-	if rule.Match.DLDst != "" {
-		parts = append(parts, fmt.Sprintf("dl_dst=%s", rule.Match.DLDst))
+	return false, nil
+}
+
+// AddVhostUserPort plugs a vhost-user port into a netdev bridge. QEMU serves
+// the socket at socketPath and Open vSwitch connects to it as a client, so
+// either side can restart without the other losing the port. A non-zero mtu
+// is requested for the port, as DPDK ports do not follow the guest's.
+func (b *OVSBridge) AddVhostUserPort(bridge, port, socketPath string, mtu uint16, externalIDs map[string]string) error {
+	options := map[string]string{
+		"type":                      "dpdkvhostuserclient",
+		"options:vhost-server-path": socketPath,
+	}
+	if mtu != 0 {
+		options["mtu_request"] = strconv.FormatUint(uint64(mtu), 10)
 	}
-	if rule.Match.DLType > 0 {
-		parts = append(parts, fmt.Sprintf("dl_type=0x%04x", rule.Match.DLType))
+	for k, v := range externalIDs {
+		options[k] = v
 	}
-	if rule.Match.NWSrc != "" {
-		parts = append(parts, fmt.Sprintf("nw_src=%s", rule.Match.NWSrc))
+	return b.AddPort(bridge, port, options)
+}
+
+// AddPort adds a port to the bridge, or updates its interface if it exists.
+// Options set columns of the interface: "type", or a key of a map column
+// such as "options:peer" or "external_ids:iface-id".
+func (b *OVSBridge) AddPort(bridge, port string, options map[string]string) error {
+	columns, maps, err := interfaceColumns(options)
+	if err != nil {
+		return fmt.Errorf("failed to add port: %w", err)
 	}
-	if rule.Match.NWDst != "" {
-		parts = append(parts, fmt.Sprintf("nw_dst=%s", rule.Match.NWDst))
+
+	row := map[string]any{"name": port}
+	for column, value := range columns {
+		row[column] = value
 	}
-	if rule.Match.NWProto > 0 {
-		parts = append(parts, fmt.Sprintf("nw_proto=%d", rule.Match.NWProto))
+	for column, m := range maps {
+		row[column] = ovsMap(m)
 	}
-	if rule.Match.TunnelID > 0 {
-		parts = append(parts, fmt.Sprintf("tun_id=%d", rule.Match.TunnelID))
+
+	byName := where(cond("name", "==", port))
+	results, err := b.db.transact(
+		opAbsent("Interface", byName),
+		opInsert("Interface", row, "iface"),
+		opInsert("Port", map[string]any{"name": port, "interfaces": ovsNamedUUID("iface")}, "port"),
+		opMutate("Bridge", where(cond("name", "==", bridge)), mutation("ports", "insert", ovsSet(ovsNamedUUID("port")))),
+	)
+	switch {
+	case isOVSDBError(err, "timed out"):
+		// The port exists: bring its interface up to date
+		var ops []ovsdbOp
+		if len(columns) > 0 {
+			ops = append(ops, opUpdate("Interface", byName, columns))
+		}
+		for column, m := range maps {
+			ops = append(ops, opMutate("Interface", byName,
+				mutation(column, "delete", ovsKeys(m)),
+				mutation(column, "insert", ovsMap(m)),
+			))
+		}
+		if len(ops) == 0 {
+			return nil
+		}
+		if _, err := b.db.transact(ops...); err != nil {
+			return fmt.Errorf("failed to update port %s: %w", port, err)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to add port: %w", err)
+	case results[3].Count == 0:
+		return fmt.Errorf("failed to add port: no bridge named %s", bridge)
 	}
+	return nil
+}
 
-	// Actions
-	var actions []string
-	for _, action := range rule.Actions {
-		switch action.Type {
-		case network.FlowActionOutput:
-			switch v := action.Value.(type) {
-			case string:
-				actions = append(actions, fmt.Sprintf("output:%s", v))
-			case uint32:
-				actions = append(actions, fmt.Sprintf("output:%d", v))
-			}
-		case network.FlowActionGotoTable:
-			if tableID, ok := action.Value.(uint8); ok {
-				actions = append(actions, fmt.Sprintf("goto_table:%d", tableID))
+// interfaceColumns sorts AddPort options into the scalar columns of an
+// interface and the keys of its map columns.
+func interfaceColumns(options map[string]string) (map[string]any, map[string]map[string]string, error) {
+	columns := make(map[string]any)
+	maps := make(map[string]map[string]string)
+	for k, v := range options {
+		column, key, isMap := strings.Cut(k, ":")
+		switch {
+		case isMap:
+			if maps[column] == nil {
+				maps[column] = make(map[string]string)
 			}
-		case network.FlowActionSetTunnel:
-			if tunID, ok := action.Value.(uint32); ok {
-				actions = append(actions, fmt.Sprintf("set_tunnel:%d", tunID))
+			maps[column][key] = v
+		case interfaceIntColumns[column]:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q: %w", column, v, err)
 			}
-		case network.FlowActionDrop:
-			actions = append(actions, "drop")
-		case network.FlowActionController:
-			actions = append(actions, "controller")
+			columns[column] = n
+		default:
+			columns[column] = v
 		}
 	}
+	return columns, maps, nil
+}
 
-	if len(actions) > 0 {
-		parts = append(parts, "actions="+strings.Join(actions, ","))
-	} else {
-		parts = append(parts, "actions=drop")
+// DeletePort removes a port from the bridge, if it is on it.
+func (b *OVSBridge) DeletePort(bridge, port string) error {
+	uuid, err := b.findUUID("Port", port)
+	if err != nil {
+		return fmt.Errorf("failed to delete port: %w", err)
+	}
+	if uuid == "" {
+		return nil
 	}
 
-	return strings.Join(parts, ",")
-}
-
-// DeleteFlow removes an OpenFlow rule by cookie.
-func (b *OVSBridge) DeleteFlow(bridge string, cookie uint64) error {
-	flowStr := fmt.Sprintf("cookie=0x%x/-1", cookie)
-	cmd := exec.Command("ovs-ofctl", "del-flows", bridge, flowStr)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to delete flow: %s: %w", string(out), err)
+	// Ports are not root rows: removed from the bridge, they are gone
+	_, err = b.db.transact(
+		opMutate("Bridge", where(cond("name", "==", bridge)), mutation("ports", "delete", ovsSet(ovsUUID(uuid)))),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete port: %w", err)
 	}
 	return nil
 }
 
-// DeleteFlowsByMatch removes OpenFlow rules by match criteria.
-func (b *OVSBridge) DeleteFlowsByMatch(bridge string, match *network.FlowMatch) error {
-	// Build match string
-	var parts []string
-	if match.TunnelID > 0 {
-		parts = append(parts, fmt.Sprintf("tun_id=%d", match.TunnelID))
+// AddVXLANPort adds a VXLAN tunnel port.
+func (b *OVSBridge) AddVXLANPort(bridge, portName string, vni uint32, remoteIP, localIP net.IP) error {
+	options := map[string]string{
+		"type":              "vxlan",
+		"options:key":       strconv.FormatUint(uint64(vni), 10),
+		"options:remote_ip": remoteIP.String(),
 	}
-	if match.DLSrc != "" {
-		parts = append(parts, fmt.Sprintf("dl_src=%s", match.DLSrc))
+	if localIP != nil {
+		options["options:local_ip"] = localIP.String()
 	}
 
-	flowStr := strings.Join(parts, ",")
-	cmd := exec.Command("ovs-ofctl", "del-flows", bridge, flowStr)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to delete flows: %s: %w", string(out), err)
+	if err := b.AddPort(bridge, portName, options); err != nil {
+		return fmt.Errorf("failed to add VXLAN port: %w", err)
 	}
 	return nil
 }
 
-// DumpFlows returns all flows on a bridge.
-func (b *OVSBridge) DumpFlows(bridge string) ([]*network.FlowRule, error) {
-	cmd := exec.Command("ovs-ofctl", "dump-flows", bridge)
-	out, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to dump flows: %w", err)
-	}
-
-	// Parse output (simplified)
-	var flows []*network.FlowRule
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, " cookie=") {
-			// Parse flow (simplified)
-			flow := &network.FlowRule{}
-			// Extract cookie
-			if idx := strings.Index(line, "cookie="); idx >= 0 {
-				end := strings.Index(line[idx:], ",")
-				if end > 0 {
-					cookieStr := line[idx+7 : idx+end]
-					if val, err := strconv.ParseUint(strings.TrimPrefix(cookieStr, "0x"), 16, 64); err == nil {
-						flow.Cookie = val
-					}
-				}
-			}
-			flows = append(flows, flow)
-		}
-	}
-
-	return flows, nil
+// DeleteVXLANPort removes a VXLAN tunnel port.
+func (b *OVSBridge) DeleteVXLANPort(bridge, portName string) error {
+	return b.DeletePort(bridge, portName)
 }
 
 // GetPortStats retrieves port statistics.
 func (b *OVSBridge) GetPortStats(bridge, port string) (*overlay.PortStats, error) {
-	cmd := exec.Command("ovs-vsctl", "get", "interface", port, "statistics")
-	out, err := cmd.Output()
+	results, err := b.db.transact(opSelect("Interface", where(cond("name", "==", port)), "statistics"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get port stats: %w", err)
 	}
+	if len(results[0].Rows) == 0 {
+		return nil, fmt.Errorf("failed to get port stats: no interface named %s", port)
+	}
 
 	stats := &overlay.PortStats{}
-	// Parse statistics output
-	statsStr := strings.Trim(string(out), "{}\n")
-	pairs := strings.Split(statsStr, ", ")
-	for _, pair := range pairs {
-		kv := strings.Split(pair, "=")
-		if len(kv) != 2 {
-			continue
-		}
-		val, _ := strconv.ParseUint(kv[1], 10, 64)
-		switch kv[0] {
+	for key, value := range rowMap(results[0].Rows[0]["statistics"]) {
+		val, _ := strconv.ParseUint(value, 10, 64)
+		switch key {
 		case "rx_packets":
 			stats.RxPackets = val
 		case "tx_packets":
@@ -287,3 +331,16 @@ func (b *OVSBridge) GetPortStats(bridge, port string) (*overlay.PortStats, error
 
 	return stats, nil
 }
+
+// findUUID returns the UUID of the row of table with the given name, or ""
+// if there is none.
+func (b *OVSBridge) findUUID(table, name string) (string, error) {
+	results, err := b.db.transact(opSelect(table, where(cond("name", "==", name)), "_uuid"))
+	if err != nil {
+		return "", err
+	}
+	if len(results[0].Rows) == 0 {
+		return "", nil
+	}
+	return rowUUID(results[0].Rows[0]), nil
+}
@@ -0,0 +1,423 @@
+package cgo
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"hypervisor/pkg/network"
+)
+
+// defaultFlowPriority is the priority ovs-ofctl omits when dumping flows.
+const defaultFlowPriority = 32768
+
+// flowProtocols are the protocol shorthands ovs-ofctl writes in place of
+// dl_type and nw_proto matches.
+var flowProtocols = map[string]struct {
+	dlType  uint16
+	nwProto uint8
+}{
+	"ip":    {0x0800, 0},
+	"ipv6":  {0x86dd, 0},
+	"arp":   {0x0806, 0},
+	"rarp":  {0x8035, 0},
+	"icmp":  {0x0800, 1},
+	"tcp":   {0x0800, 6},
+	"udp":   {0x0800, 17},
+	"sctp":  {0x0800, 132},
+	"icmp6": {0x86dd, 58},
+	"tcp6":  {0x86dd, 6},
+	"udp6":  {0x86dd, 17},
+	"sctp6": {0x86dd, 132},
+	"mpls":  {0x8847, 0},
+	"mplsm": {0x8848, 0},
+}
+
+// reservedOutputPorts are the ports ovs-ofctl dumps as a bare action, e.g.
+// NORMAL for output:normal.
+var reservedOutputPorts = map[string]bool{
+	"NORMAL": true, "ALL": true, "FLOOD": true, "IN_PORT": true, "LOCAL": true,
+}
+
+// AddFlow adds an OpenFlow rule.
+func (b *OVSBridge) AddFlow(bridge string, rule *network.FlowRule) error {
+	flowStr := b.buildFlowString(rule)
+	cmd := exec.Command("ovs-ofctl", "add-flow", bridge, flowStr)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add flow: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+// AddFlows adds OpenFlow rules with a single ovs-ofctl run rather than one
+// per rule. ovs-ofctl parses every rule before sending any, so a malformed
+// rule adds none.
+func (b *OVSBridge) AddFlows(bridge string, rules []*network.FlowRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var flows bytes.Buffer
+	for _, rule := range rules {
+		flows.WriteString(b.buildFlowString(rule))
+		flows.WriteByte('\n')
+	}
+
+	cmd := exec.Command("ovs-ofctl", "add-flows", bridge, "-")
+	cmd.Stdin = &flows
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add %d flows: %s: %w", len(rules), string(out), err)
+	}
+	return nil
+}
+
+// buildFlowString converts a FlowRule to ovs-ofctl flow string.
+func (b *OVSBridge) buildFlowString(rule *network.FlowRule) string {
+	parts := []string{
+		fmt.Sprintf("table=%d", rule.TableID),
+		fmt.Sprintf("priority=%d", rule.Priority),
+		fmt.Sprintf("cookie=0x%x", rule.Cookie),
+	}
+
+	// Timeouts
+	if rule.IdleTimeout > 0 {
+		parts = append(parts, fmt.Sprintf("idle_timeout=%d", rule.IdleTimeout))
+	}
+	if rule.HardTimeout > 0 {
+		parts = append(parts, fmt.Sprintf("hard_timeout=%d", rule.HardTimeout))
+	}
+	if rule.SendFlowRem {
+		parts = append(parts, "send_flow_rem")
+	}
+
+	// Match fields
+	parts = append(parts, matchFields(&rule.Match)...)
+
+	// Actions
+	var actions []string
+	for _, action := range rule.Actions {
+		switch action.Type {
+		case network.FlowActionOutput:
+			switch v := action.Value.(type) {
+			case string:
+				actions = append(actions, fmt.Sprintf("output:%s", v))
+			case uint32:
+				actions = append(actions, fmt.Sprintf("output:%d", v))
+			}
+		case network.FlowActionGotoTable:
+			if tableID, ok := action.Value.(uint8); ok {
+				actions = append(actions, fmt.Sprintf("goto_table:%d", tableID))
+			}
+		case network.FlowActionSetTunnel:
+			if tunID, ok := action.Value.(uint32); ok {
+				actions = append(actions, fmt.Sprintf("set_tunnel:%d", tunID))
+			}
+		case network.FlowActionSetField:
+			if set, ok := action.Value.(*network.FieldSet); ok {
+				actions = append(actions, fmt.Sprintf("set_field:%s->%s", set.Value, set.Field))
+			}
+		case network.FlowActionPushVLAN:
+			if tpid, ok := action.Value.(uint16); ok {
+				actions = append(actions, fmt.Sprintf("push_vlan:0x%04x", tpid))
+			}
+		case network.FlowActionPopVLAN:
+			actions = append(actions, "pop_vlan")
+		case network.FlowActionMove:
+			if move, ok := action.Value.(*network.FieldMove); ok {
+				actions = append(actions, fmt.Sprintf("move:%s->%s", move.Src, move.Dst))
+			}
+		case network.FlowActionDrop:
+			actions = append(actions, "drop")
+		case network.FlowActionController:
+			actions = append(actions, "controller")
+		case network.FlowActionLearn:
+			if spec, ok := action.Value.(*network.LearnSpec); ok {
+				actions = append(actions, buildLearnAction(spec))
+			}
+		}
+	}
+
+	if len(actions) > 0 {
+		parts = append(parts, "actions="+strings.Join(actions, ","))
+	} else {
+		parts = append(parts, "actions=drop")
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// matchFields renders the set fields of a match for ovs-ofctl. Transport
+// ports and metadata are not rendered.
+func matchFields(match *network.FlowMatch) []string {
+	var parts []string
+	if match.InPort > 0 {
+		parts = append(parts, fmt.Sprintf("in_port=%d", match.InPort))
+	}
+	if match.DLSrc != "" {
+		parts = append(parts, fmt.Sprintf("dl_src=%s", match.DLSrc))
+	}
+	if match.DLDst != "" {
+		parts = append(parts, fmt.Sprintf("dl_dst=%s", match.DLDst))
+	}
+	if match.DLType > 0 {
+		parts = append(parts, fmt.Sprintf("dl_type=0x%04x", match.DLType))
+	}
+	if match.DLVlan > 0 {
+		parts = append(parts, fmt.Sprintf("dl_vlan=%d", match.DLVlan))
+	}
+	if match.NWSrc != "" {
+		parts = append(parts, fmt.Sprintf("nw_src=%s", match.NWSrc))
+	}
+	if match.NWDst != "" {
+		parts = append(parts, fmt.Sprintf("nw_dst=%s", match.NWDst))
+	}
+	if match.NWProto > 0 {
+		parts = append(parts, fmt.Sprintf("nw_proto=%d", match.NWProto))
+	}
+	if match.TunnelID > 0 {
+		parts = append(parts, fmt.Sprintf("tun_id=%d", match.TunnelID))
+	}
+	if match.ARPOp > 0 {
+		parts = append(parts, fmt.Sprintf("arp_op=%d", match.ARPOp))
+	}
+	return parts
+}
+
+// buildLearnAction renders a learn() action for ovs-ofctl.
+func buildLearnAction(spec *network.LearnSpec) string {
+	parts := []string{
+		fmt.Sprintf("table=%d", spec.TableID),
+		fmt.Sprintf("priority=%d", spec.Priority),
+		fmt.Sprintf("cookie=0x%x", spec.Cookie),
+	}
+	if spec.IdleTimeout > 0 {
+		parts = append(parts, fmt.Sprintf("idle_timeout=%d", spec.IdleTimeout))
+	}
+	if spec.HardTimeout > 0 {
+		parts = append(parts, fmt.Sprintf("hard_timeout=%d", spec.HardTimeout))
+	}
+	parts = append(parts, spec.Fields...)
+	if spec.Output != "" {
+		parts = append(parts, "output:"+spec.Output)
+	}
+	return "learn(" + strings.Join(parts, ",") + ")"
+}
+
+// DeleteFlow removes an OpenFlow rule by cookie.
+func (b *OVSBridge) DeleteFlow(bridge string, cookie uint64) error {
+	flowStr := fmt.Sprintf("cookie=0x%x/-1", cookie)
+	cmd := exec.Command("ovs-ofctl", "del-flows", bridge, flowStr)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete flow: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+// DeleteFlowsByMatch removes OpenFlow rules by match criteria.
+func (b *OVSBridge) DeleteFlowsByMatch(bridge string, match *network.FlowMatch) error {
+	flowStr := strings.Join(matchFields(match), ",")
+	cmd := exec.Command("ovs-ofctl", "del-flows", bridge, flowStr)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete flows: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+// DumpFlows returns all flows on a bridge, with their match fields and
+// actions. Fields and actions FlowRule cannot express are left out.
+func (b *OVSBridge) DumpFlows(bridge string) ([]*network.FlowRule, error) {
+	cmd := exec.Command("ovs-ofctl", "--no-names", "dump-flows", bridge)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump flows: %w", err)
+	}
+
+	var flows []*network.FlowRule
+	for _, line := range strings.Split(string(out), "\n") {
+		if flow, ok := parseFlow(line); ok {
+			flows = append(flows, flow)
+		}
+	}
+	return flows, nil
+}
+
+// parseFlow parses a flow as dumped by ovs-ofctl:
+//
+//	cookie=0x1, duration=2.1s, table=20, n_packets=0, n_bytes=0, priority=100,arp,tun_id=0x64 actions=NORMAL
+//
+// It reports false for lines that are not flows.
+func parseFlow(line string) (*network.FlowRule, bool) {
+	head, actions, ok := strings.Cut(strings.TrimSpace(line), " actions=")
+	if !ok {
+		return nil, false
+	}
+
+	flow := &network.FlowRule{Priority: defaultFlowPriority}
+	// Properties are separated by ", ", match fields by "," alone
+	for _, field := range strings.Split(strings.ReplaceAll(head, ", ", ","), ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "cookie":
+			flow.Cookie, _ = strconv.ParseUint(value, 0, 64)
+		case "table":
+			flow.TableID = uint8(parseUint(value, 8))
+		case "priority":
+			flow.Priority = uint16(parseUint(value, 16))
+		case "idle_timeout":
+			flow.IdleTimeout = uint16(parseUint(value, 16))
+		case "hard_timeout":
+			flow.HardTimeout = uint16(parseUint(value, 16))
+		case "send_flow_rem":
+			flow.SendFlowRem = true
+		default:
+			parseMatchField(&flow.Match, key, value)
+		}
+	}
+
+	for _, action := range splitActions(actions) {
+		if a, ok := parseAction(action); ok {
+			flow.Actions = append(flow.Actions, a)
+		}
+	}
+	return flow, true
+}
+
+// parseMatchField sets a match field from its ovs-ofctl form.
+func parseMatchField(match *network.FlowMatch, key, value string) {
+	// Masked fields are matched as their value
+	value, _, _ = strings.Cut(value, "/")
+
+	if proto, ok := flowProtocols[key]; ok && value == "" {
+		match.DLType = proto.dlType
+		match.NWProto = proto.nwProto
+		return
+	}
+	switch key {
+	case "in_port":
+		match.InPort = uint32(parseUint(value, 32))
+	case "dl_src":
+		match.DLSrc = value
+	case "dl_dst":
+		match.DLDst = value
+	case "dl_type":
+		match.DLType = uint16(parseUint(value, 16))
+	case "dl_vlan":
+		match.DLVlan = uint16(parseUint(value, 16))
+	case "nw_src":
+		match.NWSrc = value
+	case "nw_dst":
+		match.NWDst = value
+	case "nw_proto":
+		match.NWProto = uint8(parseUint(value, 8))
+	case "tp_src":
+		match.TPSrc = uint16(parseUint(value, 16))
+	case "tp_dst":
+		match.TPDst = uint16(parseUint(value, 16))
+	case "tun_id":
+		match.TunnelID = uint32(parseUint(value, 32))
+	case "metadata":
+		match.Metadata = parseUint(value, 64)
+	case "arp_op":
+		match.ARPOp = uint16(parseUint(value, 16))
+	}
+}
+
+// parseAction parses an action from its ovs-ofctl form.
+func parseAction(action string) (network.FlowAction, bool) {
+	if reservedOutputPorts[action] {
+		return network.FlowAction{Type: network.FlowActionOutput, Value: strings.ToLower(action)}, true
+	}
+	if inner, ok := strings.CutPrefix(action, "learn("); ok {
+		return network.FlowAction{Type: network.FlowActionLearn, Value: parseLearnAction(strings.TrimSuffix(inner, ")"))}, true
+	}
+
+	name, arg, _ := strings.Cut(action, ":")
+	switch name {
+	case "output":
+		if port, err := strconv.ParseUint(arg, 10, 32); err == nil {
+			return network.FlowAction{Type: network.FlowActionOutput, Value: uint32(port)}, true
+		}
+		return network.FlowAction{Type: network.FlowActionOutput, Value: arg}, true
+	case "goto_table":
+		return network.FlowAction{Type: network.FlowActionGotoTable, Value: uint8(parseUint(arg, 8))}, true
+	case "set_tunnel", "set_tunnel64":
+		return network.FlowAction{Type: network.FlowActionSetTunnel, Value: uint32(parseUint(arg, 32))}, true
+	case "set_field", "load":
+		if value, field, ok := strings.Cut(arg, "->"); ok {
+			return network.FlowAction{Type: network.FlowActionSetField, Value: &network.FieldSet{Field: field, Value: value}}, true
+		}
+	case "push_vlan":
+		return network.FlowAction{Type: network.FlowActionPushVLAN, Value: uint16(parseUint(arg, 16))}, true
+	case "pop_vlan", "strip_vlan":
+		return network.FlowAction{Type: network.FlowActionPopVLAN}, true
+	case "move":
+		if src, dst, ok := strings.Cut(arg, "->"); ok {
+			return network.FlowAction{Type: network.FlowActionMove, Value: &network.FieldMove{Src: src, Dst: dst}}, true
+		}
+	case "drop":
+		return network.FlowAction{Type: network.FlowActionDrop}, true
+	case "CONTROLLER", "controller":
+		return network.FlowAction{Type: network.FlowActionController}, true
+	}
+	return network.FlowAction{}, false
+}
+
+// parseLearnAction parses the arguments of a learn() action.
+func parseLearnAction(args string) *network.LearnSpec {
+	spec := &network.LearnSpec{Priority: defaultFlowPriority}
+	for _, arg := range splitActions(args) {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "table":
+			spec.TableID = uint8(parseUint(value, 8))
+		case "priority":
+			spec.Priority = uint16(parseUint(value, 16))
+		case "cookie":
+			spec.Cookie, _ = strconv.ParseUint(value, 0, 64)
+		case "idle_timeout":
+			spec.IdleTimeout = uint16(parseUint(value, 16))
+		case "hard_timeout":
+			spec.HardTimeout = uint16(parseUint(value, 16))
+		default:
+			if output, ok := strings.CutPrefix(arg, "output:"); ok {
+				spec.Output = output
+			} else {
+				spec.Fields = append(spec.Fields, arg)
+			}
+		}
+	}
+	return spec
+}
+
+// splitActions splits a list at the commas outside parentheses, which
+// separate the arguments of actions such as learn().
+func splitActions(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if start < len(s) {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+// parseUint parses a decimal or 0x-prefixed number of the given bit size,
+// returning 0 if it is not one.
+func parseUint(s string, bitSize int) uint64 {
+	n, _ := strconv.ParseUint(s, 0, bitSize)
+	return n
+}
@@ -0,0 +1,85 @@
+package cgo
+
+import (
+	"fmt"
+)
+
+// AddMirror mirrors the traffic of source to output, both ports of bridge.
+// selectSrc selects the packets the bridge receives on source, selectDst
+// those it sends out of it. A mirror with the same name is replaced.
+func (b *OVSBridge) AddMirror(bridge, name, source, output string, selectSrc, selectDst bool) error {
+	results, err := b.db.transact(
+		opSelect("Port", where(cond("name", "==", source)), "_uuid"),
+		opSelect("Port", where(cond("name", "==", output)), "_uuid"),
+		opSelect("Mirror", where(cond("name", "==", name)), "_uuid"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add mirror: %w", err)
+	}
+	if len(results[0].Rows) == 0 {
+		return fmt.Errorf("failed to add mirror: no port named %s", source)
+	}
+	if len(results[1].Rows) == 0 {
+		return fmt.Errorf("failed to add mirror: no port named %s", output)
+	}
+	sourceUUID := ovsUUID(rowUUID(results[0].Rows[0]))
+
+	mirror := map[string]any{
+		"name":        name,
+		"output_port": ovsUUID(rowUUID(results[1].Rows[0])),
+	}
+	if selectSrc {
+		mirror["select_src_port"] = ovsSet(sourceUUID)
+	}
+	if selectDst {
+		mirror["select_dst_port"] = ovsSet(sourceUUID)
+	}
+
+	byName := where(cond("name", "==", bridge))
+	var ops []ovsdbOp
+	if stale := mirrorUUIDs(results[2].Rows); len(stale) > 0 {
+		ops = append(ops, opMutate("Bridge", byName, mutation("mirrors", "delete", ovsSet(stale...))))
+	}
+	ops = append(ops,
+		opInsert("Mirror", mirror, "mirror"),
+		opMutate("Bridge", byName, mutation("mirrors", "insert", ovsSet(ovsNamedUUID("mirror")))),
+	)
+	results, err = b.db.transact(ops...)
+	if err != nil {
+		return fmt.Errorf("failed to add mirror: %w", err)
+	}
+	if results[len(results)-1].Count == 0 {
+		return fmt.Errorf("failed to add mirror: no bridge named %s", bridge)
+	}
+	return nil
+}
+
+// DeleteMirror removes a mirror from a bridge, if it exists.
+func (b *OVSBridge) DeleteMirror(bridge, name string) error {
+	results, err := b.db.transact(opSelect("Mirror", where(cond("name", "==", name)), "_uuid"))
+	if err != nil {
+		return fmt.Errorf("failed to find mirror %s: %w", name, err)
+	}
+	uuids := mirrorUUIDs(results[0].Rows)
+	if len(uuids) == 0 {
+		return nil
+	}
+
+	// Mirrors are not root rows: removed from the bridge, they are gone
+	_, err = b.db.transact(
+		opMutate("Bridge", where(cond("name", "==", bridge)), mutation("mirrors", "delete", ovsSet(uuids...))),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete mirror: %w", err)
+	}
+	return nil
+}
+
+// mirrorUUIDs returns the UUIDs of selected rows as set members.
+func mirrorUUIDs(rows []map[string]any) []any {
+	uuids := make([]any, 0, len(rows))
+	for _, row := range rows {
+		uuids = append(uuids, ovsUUID(rowUUID(row)))
+	}
+	return uuids
+}
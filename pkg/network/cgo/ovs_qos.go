@@ -0,0 +1,78 @@
+package cgo
+
+import (
+	"fmt"
+	"strconv"
+
+	"hypervisor/pkg/network"
+)
+
+// qosOwnerKey tags the QoS and Queue rows created for a port with the port's
+// ID. OVSDB keeps them after the port leaves the bridge, so they are found
+// and destroyed by the tag rather than through the port.
+const qosOwnerKey = "hypervisor-port-id"
+
+// SetPortQoS applies the bandwidth limits of a port to its device on the
+// bridge, replacing any applied before. What the instance sends is policed
+// as the interface receives it; what it receives is shaped by an HTB queue
+// on the port.
+func (b *OVSBridge) SetPortQoS(device, portID string, qos *network.PortQoS) error {
+	byName := where(cond("name", "==", device))
+	ops := clearQoSOps(device, portID)
+	policing := len(ops)
+	ops = append(ops,
+		opUpdate("Interface", byName, map[string]any{
+			"ingress_policing_rate":  qos.EgressRateKbps,
+			"ingress_policing_burst": qos.EgressBurstKb,
+		}),
+	)
+	if qos.IngressRateKbps > 0 {
+		owner := ovsMap(map[string]string{qosOwnerKey: portID})
+		maxRate := strconv.FormatUint(qos.IngressRateKbps*1000, 10)
+		queueConfig := map[string]string{"max-rate": maxRate}
+		if qos.IngressBurstKb > 0 {
+			queueConfig["burst"] = strconv.FormatUint(qos.IngressBurstKb*1000, 10)
+		}
+		ops = append(ops,
+			opInsert("Queue", map[string]any{"other_config": ovsMap(queueConfig), "external_ids": owner}, "queue"),
+			opInsert("QoS", map[string]any{
+				"type":         "linux-htb",
+				"other_config": ovsMap(map[string]string{"max-rate": maxRate}),
+				"queues":       []any{"map", []any{[]any{0, ovsNamedUUID("queue")}}},
+				"external_ids": owner,
+			}, "qos"),
+			opUpdate("Port", byName, map[string]any{"qos": ovsNamedUUID("qos")}),
+		)
+	}
+
+	// The limits replace the previous ones in one transaction
+	results, err := b.db.transact(ops...)
+	if err != nil {
+		return fmt.Errorf("failed to set port QoS: %w", err)
+	}
+	if results[policing].Count == 0 {
+		return fmt.Errorf("failed to set port QoS: no interface named %s", device)
+	}
+	return nil
+}
+
+// ClearPortQoS removes the bandwidth limits of a port from its device, if
+// still on the bridge, and destroys the QoS and Queue rows made for it.
+func (b *OVSBridge) ClearPortQoS(device, portID string) error {
+	if _, err := b.db.transact(clearQoSOps(device, portID)...); err != nil {
+		return fmt.Errorf("failed to clear port QoS: %w", err)
+	}
+	return nil
+}
+
+// clearQoSOps returns the operations removing the limits of a port.
+func clearQoSOps(device, portID string) []ovsdbOp {
+	byName := where(cond("name", "==", device))
+	owned := where(cond("external_ids", "includes", ovsMap(map[string]string{qosOwnerKey: portID})))
+	return []ovsdbOp{
+		opUpdate("Port", byName, map[string]any{"qos": ovsSet()}),
+		opUpdate("Interface", byName, map[string]any{"ingress_policing_rate": 0, "ingress_policing_burst": 0}),
+		opDelete("QoS", owned),
+		opDelete("Queue", owned),
+	}
+}
@@ -0,0 +1,119 @@
+package cgo
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TraceProbe is a packet traced through a bridge's flow tables.
+type TraceProbe struct {
+	InPort   string // Port the packet enters the bridge on
+	TunnelID uint32 // VNI the packet carries, if any
+	VLANTag  uint16 // Tag of a subport's frames, if any
+	SrcMAC   string
+	DstMAC   string
+	SrcIP    string
+	DstIP    string
+	Protocol string // icmp, tcp or udp
+	DstPort  uint16 // Of tcp and udp probes
+}
+
+// TraceResult is where a traced packet ended up.
+type TraceResult struct {
+	// Dropped is set when the datapath would drop the packet.
+	Dropped bool
+
+	// Outputs are the OpenFlow ports the packet was output to, in order.
+	Outputs []string
+
+	// Flooded is set when the packet was flooded or left to the NORMAL
+	// action rather than output to a known port.
+	Flooded bool
+
+	// TunnelDst is the remote endpoint the packet leaves for over a tunnel.
+	TunnelDst string
+
+	// LastTable is the table of the last flow the packet went through, on
+	// the bridge the trace ended on; -1 if none.
+	LastTable int
+
+	// DatapathActions are the actions the datapath would apply.
+	DatapathActions string
+
+	// Output is the full ofproto/trace output.
+	Output string
+}
+
+var (
+	traceTableRe  = regexp.MustCompile(`^\s*(\d+)\.\s`)
+	traceTunnelRe = regexp.MustCompile(`tunnel\([^)]*\bdst=([0-9a-fA-F.:]+)`)
+)
+
+// Trace runs a probe packet through the flow tables of a bridge, following
+// patch ports into the bridges they lead to, without sending anything.
+func (b *OVSBridge) Trace(bridge string, probe *TraceProbe) (*TraceResult, error) {
+	cmd := exec.Command("ovs-appctl", "ofproto/trace", bridge, probeFlow(probe))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to trace probe: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return parseTrace(string(out)), nil
+}
+
+// probeFlow returns the flow of a probe in ovs-ofctl syntax.
+func probeFlow(probe *TraceProbe) string {
+	parts := []string{probe.Protocol, "in_port=" + probe.InPort}
+	if probe.TunnelID != 0 {
+		parts = append(parts, fmt.Sprintf("tun_id=%d", probe.TunnelID))
+	}
+	if probe.VLANTag != 0 {
+		parts = append(parts, fmt.Sprintf("dl_vlan=%d", probe.VLANTag))
+	}
+	parts = append(parts,
+		"dl_src="+probe.SrcMAC,
+		"dl_dst="+probe.DstMAC,
+		"nw_src="+probe.SrcIP,
+		"nw_dst="+probe.DstIP,
+		"nw_ttl=64",
+	)
+	switch probe.Protocol {
+	case "icmp":
+		parts = append(parts, "icmp_type=8", "icmp_code=0")
+	case "tcp", "udp":
+		parts = append(parts, "tp_src=40000", fmt.Sprintf("tp_dst=%d", probe.DstPort))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseTrace extracts where a packet ended up from ofproto/trace output.
+func parseTrace(out string) *TraceResult {
+	result := &TraceResult{LastTable: -1, Output: out}
+	for _, line := range strings.Split(out, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "bridge("):
+			// Tables restart on the bridge a patch port leads to
+			result.LastTable = -1
+		case strings.HasPrefix(trimmed, "Datapath actions:"):
+			result.DatapathActions = strings.TrimSpace(strings.TrimPrefix(trimmed, "Datapath actions:"))
+		case strings.HasPrefix(trimmed, "output:"):
+			port, _, _ := strings.Cut(strings.TrimPrefix(trimmed, "output:"), " ")
+			result.Outputs = append(result.Outputs, port)
+		case trimmed == "NORMAL", trimmed == "ALL", trimmed == "FLOOD", strings.Contains(trimmed, "flooding"):
+			result.Flooded = true
+		default:
+			if m := traceTableRe.FindStringSubmatch(line); m != nil {
+				result.LastTable, _ = strconv.Atoi(m[1])
+			}
+		}
+	}
+
+	if m := traceTunnelRe.FindStringSubmatch(result.DatapathActions); m != nil {
+		result.TunnelDst = m[1]
+	}
+	result.Dropped = result.DatapathActions == "" || result.DatapathActions == "drop"
+	return result
+}
@@ -0,0 +1,374 @@
+package cgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ovsDatabase is the database of ovs-vswitchd's configuration.
+const ovsDatabase = "Open_vSwitch"
+
+// ovsdbTimeout bounds a transaction, connecting included.
+const ovsdbTimeout = 10 * time.Second
+
+// DefaultOVSDBEndpoint returns where ovsdb-server serves local clients:
+// db.sock in $OVS_RUNDIR, as for ovs-vsctl, or in /var/run/openvswitch.
+func DefaultOVSDBEndpoint() string {
+	dir := os.Getenv("OVS_RUNDIR")
+	if dir == "" {
+		dir = "/var/run/openvswitch"
+	}
+	return "unix:" + filepath.Join(dir, "db.sock")
+}
+
+// defaultOVSDB is the connection shared by every OVSBridge of the process.
+var defaultOVSDB = NewOVSDBClient(DefaultOVSDBEndpoint())
+
+// OVSDBClient is a client of the Open_vSwitch database speaking the OVSDB
+// management protocol (RFC 7047) to ovsdb-server. Every call is a single
+// transaction, so a change spanning rows of several tables applies whole
+// or not at all. The connection is opened on first use and reopened after
+// it breaks, e.g. when ovsdb-server restarts; calls are serialized on it.
+type OVSDBClient struct {
+	endpoint string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	dec    *json.Decoder
+	nextID uint64
+}
+
+// NewOVSDBClient creates a client of the ovsdb-server at endpoint, given
+// as unix:<path> or tcp:<host>:<port>.
+func NewOVSDBClient(endpoint string) *OVSDBClient {
+	return &OVSDBClient{endpoint: endpoint}
+}
+
+// ovsdbOp is an operation of a transaction.
+type ovsdbOp map[string]any
+
+// ovsdbResult is the result of an operation of a transaction.
+type ovsdbResult struct {
+	Count   int              `json:"count"`
+	UUID    []any            `json:"uuid"`
+	Rows    []map[string]any `json:"rows"`
+	Error   string           `json:"error"`
+	Details string           `json:"details"`
+}
+
+// ovsdbError is an error ovsdb-server reported for a transaction.
+type ovsdbError struct {
+	Kind    string // e.g. "constraint violation" or "timed out"
+	Details string
+}
+
+func (e *ovsdbError) Error() string {
+	if e.Details == "" {
+		return e.Kind
+	}
+	return e.Kind + ": " + e.Details
+}
+
+// isOVSDBError reports whether err is an error of the given kind reported
+// by ovsdb-server.
+func isOVSDBError(err error, kind string) bool {
+	var oerr *ovsdbError
+	return errors.As(err, &oerr) && oerr.Kind == kind
+}
+
+// ovsdbMessage is a JSON-RPC request, response or notification.
+type ovsdbMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+// transact runs operations as one transaction and returns their results.
+// It fails with an *ovsdbError if any operation, or the commit, failed.
+func (c *OVSDBClient) transact(ops ...ovsdbOp) ([]*ovsdbResult, error) {
+	params := make([]any, 0, len(ops)+1)
+	params = append(params, ovsDatabase)
+	for _, op := range ops {
+		params = append(params, op)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reused := c.conn != nil
+	raw, sent, err := c.call("transact", params)
+	if err != nil && reused && !sent {
+		// The connection broke since the last call; the request never
+		// left, so it is safe to send it again on a new one
+		raw, _, err = c.call("transact", params)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*ovsdbResult
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&results); err != nil {
+		return nil, fmt.Errorf("failed to decode transaction results: %w", err)
+	}
+	for _, result := range results {
+		if result != nil && result.Error != "" {
+			return nil, &ovsdbError{Kind: result.Error, Details: result.Details}
+		}
+	}
+	if len(results) < len(ops) {
+		return nil, fmt.Errorf("transaction returned %d results for %d operations", len(results), len(ops))
+	}
+	return results, nil
+}
+
+// call sends a request and waits for its response, answering the echo
+// requests ovsdb-server sends meanwhile. sent tells whether the request
+// was written. Called with mu held.
+func (c *OVSDBClient) call(method string, params any) (json.RawMessage, bool, error) {
+	if err := c.connect(); err != nil {
+		return nil, false, err
+	}
+	c.conn.SetDeadline(time.Now().Add(ovsdbTimeout))
+
+	c.nextID++
+	id := json.RawMessage(fmt.Sprint(c.nextID))
+	data, err := json.Marshal(map[string]any{"method": method, "params": params, "id": id})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode %s request: %w", method, err)
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		c.disconnect()
+		return nil, false, fmt.Errorf("failed to send %s request to %s: %w", method, c.endpoint, err)
+	}
+
+	for {
+		var msg ovsdbMessage
+		if err := c.dec.Decode(&msg); err != nil {
+			c.disconnect()
+			return nil, true, fmt.Errorf("failed to read %s response from %s: %w", method, c.endpoint, err)
+		}
+
+		if msg.Method == "echo" {
+			reply, _ := json.Marshal(map[string]any{"result": msg.Params, "error": nil, "id": msg.ID})
+			if _, err := c.conn.Write(reply); err != nil {
+				c.disconnect()
+				return nil, true, fmt.Errorf("failed to answer echo from %s: %w", c.endpoint, err)
+			}
+			continue
+		}
+		if !bytes.Equal(msg.ID, id) {
+			continue // A notification, or the response to an abandoned request
+		}
+
+		if len(msg.Error) > 0 && string(msg.Error) != "null" {
+			return nil, true, fmt.Errorf("%s request failed: %s", method, msg.Error)
+		}
+		return msg.Result, true, nil
+	}
+}
+
+// connect opens the connection if it is not open. Called with mu held.
+func (c *OVSDBClient) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+
+	network, address, ok := strings.Cut(c.endpoint, ":")
+	if !ok || (network != "unix" && network != "tcp") {
+		return fmt.Errorf("invalid OVSDB endpoint %q (want unix:<path> or tcp:<host>:<port>)", c.endpoint)
+	}
+	conn, err := net.DialTimeout(network, address, ovsdbTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to ovsdb-server at %s: %w", c.endpoint, err)
+	}
+	c.conn = conn
+	c.dec = json.NewDecoder(conn)
+	return nil
+}
+
+// disconnect closes a broken connection. Called with mu held.
+func (c *OVSDBClient) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.dec = nil, nil
+	}
+}
+
+// Close closes the connection.
+func (c *OVSDBClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnect()
+	return nil
+}
+
+// Operations and values of the OVSDB protocol.
+
+func opInsert(table string, row map[string]any, uuidName string) ovsdbOp {
+	op := ovsdbOp{"op": "insert", "table": table, "row": row}
+	if uuidName != "" {
+		op["uuid-name"] = uuidName
+	}
+	return op
+}
+
+func opSelect(table string, where []any, columns ...string) ovsdbOp {
+	op := ovsdbOp{"op": "select", "table": table, "where": where}
+	if len(columns) > 0 {
+		op["columns"] = columns
+	}
+	return op
+}
+
+func opUpdate(table string, where []any, row map[string]any) ovsdbOp {
+	return ovsdbOp{"op": "update", "table": table, "where": where, "row": row}
+}
+
+func opMutate(table string, where []any, mutations ...[]any) ovsdbOp {
+	return ovsdbOp{"op": "mutate", "table": table, "where": where, "mutations": mutations}
+}
+
+func opDelete(table string, where []any) ovsdbOp {
+	return ovsdbOp{"op": "delete", "table": table, "where": where}
+}
+
+// opAbsent fails the transaction with "timed out" if a row matches where.
+func opAbsent(table string, where []any) ovsdbOp {
+	return ovsdbOp{
+		"op": "wait", "table": table, "where": where, "columns": []string{"_uuid"},
+		"until": "==", "rows": []any{}, "timeout": 0,
+	}
+}
+
+// where returns the conditions of an operation.
+func where(conditions ...[]any) []any {
+	w := make([]any, 0, len(conditions))
+	for _, condition := range conditions {
+		w = append(w, condition)
+	}
+	return w
+}
+
+func cond(column, function string, value any) []any {
+	return []any{column, function, value}
+}
+
+func mutation(column, mutator string, value any) []any {
+	return []any{column, mutator, value}
+}
+
+func ovsSet(items ...any) []any {
+	if items == nil {
+		items = []any{}
+	}
+	return []any{"set", items}
+}
+
+func ovsUUID(uuid string) []any {
+	return []any{"uuid", uuid}
+}
+
+func ovsNamedUUID(name string) []any {
+	return []any{"named-uuid", name}
+}
+
+// ovsMap returns a string map, with its keys sorted for stable requests.
+func ovsMap(m map[string]string) []any {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]any, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, []any{k, m[k]})
+	}
+	return []any{"map", pairs}
+}
+
+// ovsKeys returns the set of the keys of a map, for deleting them.
+func ovsKeys(m map[string]string) []any {
+	keys := make([]any, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return ovsSet(keys...)
+}
+
+// rowUUID returns the _uuid of a selected row.
+func rowUUID(row map[string]any) string {
+	if pair, ok := row["_uuid"].([]any); ok && len(pair) == 2 {
+		s, _ := pair[1].(string)
+		return s
+	}
+	return ""
+}
+
+// rowAtoms returns the atoms of a column value: a single atom, or the
+// members of a set. UUIDs are returned as their string.
+func rowAtoms(value any) []string {
+	pair, ok := value.([]any)
+	if !ok {
+		return []string{atomString(value)}
+	}
+	if len(pair) == 2 && pair[0] == "set" {
+		members, _ := pair[1].([]any)
+		atoms := make([]string, 0, len(members))
+		for _, member := range members {
+			atoms = append(atoms, atomString(member))
+		}
+		return atoms
+	}
+	return []string{atomString(value)}
+}
+
+// rowMap returns a map column value with its keys and values as strings.
+func rowMap(value any) map[string]string {
+	m := make(map[string]string)
+	pair, ok := value.([]any)
+	if !ok || len(pair) != 2 || pair[0] != "map" {
+		return m
+	}
+	entries, _ := pair[1].([]any)
+	for _, entry := range entries {
+		kv, ok := entry.([]any)
+		if !ok || len(kv) != 2 {
+			continue
+		}
+		m[atomString(kv[0])] = atomString(kv[1])
+	}
+	return m
+}
+
+// atomString returns an atom as a string: strings as is, numbers in their
+// JSON form and UUIDs as the UUID.
+func atomString(atom any) string {
+	switch v := atom.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	case []any:
+		if len(v) == 2 && (v[0] == "uuid" || v[0] == "named-uuid") {
+			s, _ := v[1].(string)
+			return s
+		}
+	}
+	return fmt.Sprint(atom)
+}
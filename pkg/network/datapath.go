@@ -0,0 +1,202 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DatapathMode selects how OVS forwards packets on a node.
+type DatapathMode string
+
+const (
+	// DatapathKernel uses the in-kernel openvswitch module (default).
+	DatapathKernel DatapathMode = "kernel"
+	// DatapathHWOffload uses the kernel datapath with flows offloaded to the NIC via tc flower.
+	DatapathHWOffload DatapathMode = "hw-offload"
+	// DatapathDPDK uses the userspace (netdev) datapath with DPDK poll-mode drivers.
+	DatapathDPDK DatapathMode = "dpdk"
+)
+
+// DatapathFeature is a forwarding feature that the datapath must support.
+type DatapathFeature string
+
+const (
+	// DatapathFeatureConntrack is required by stateful security groups and NAT.
+	DatapathFeatureConntrack DatapathFeature = "conntrack"
+	// DatapathFeatureTunnels is required by VXLAN overlay networks.
+	DatapathFeatureTunnels DatapathFeature = "tunnels"
+)
+
+// TC offload policies accepted by OVS other_config:tc-policy.
+const (
+	TCPolicyNone   = "none"
+	TCPolicySkipSW = "skip_sw"
+	TCPolicySkipHW = "skip_hw"
+)
+
+// OVS bridge datapath_type values.
+const (
+	BridgeDatapathSystem = "system"
+	BridgeDatapathNetdev = "netdev"
+)
+
+// Datapath validation errors.
+var (
+	ErrUnknownDatapathMode    = errors.New("unknown datapath mode")
+	ErrUnsupportedFeature     = errors.New("feature not supported by datapath mode")
+	ErrInvalidPMDCPUMask      = errors.New("invalid PMD CPU mask")
+	ErrInvalidDPDKSocketMem   = errors.New("invalid DPDK socket memory")
+	ErrInvalidTCPolicy        = errors.New("invalid tc policy")
+	ErrDatapathOptionMismatch = errors.New("option not valid for datapath mode")
+)
+
+// DatapathConfig holds the per-node OVS datapath configuration.
+type DatapathConfig struct {
+	// Mode is the datapath mode: kernel, hw-offload or dpdk.
+	Mode DatapathMode `mapstructure:"mode" yaml:"mode" json:"mode"`
+
+	// TCPolicy controls tc flower offload in hw-offload mode: none, skip_sw or skip_hw.
+	TCPolicy string `mapstructure:"tc_policy" yaml:"tc_policy" json:"tc_policy"`
+
+	// PMDCPUMask is the hex CPU mask for DPDK poll-mode driver threads (e.g. "0x6").
+	PMDCPUMask string `mapstructure:"pmd_cpu_mask" yaml:"pmd_cpu_mask" json:"pmd_cpu_mask"`
+
+	// LcoreMask is the hex CPU mask for DPDK non-datapath threads.
+	LcoreMask string `mapstructure:"lcore_mask" yaml:"lcore_mask" json:"lcore_mask"`
+
+	// SocketMem is the per-NUMA-node hugepage memory in MB (e.g. "1024,1024").
+	SocketMem string `mapstructure:"socket_mem" yaml:"socket_mem" json:"socket_mem"`
+
+	// Bridges are the OVS bridges whose datapath_type follows the mode.
+	Bridges []string `mapstructure:"bridges" yaml:"bridges" json:"bridges"`
+
+	// Features lists the forwarding features in use that the mode must support.
+	Features []DatapathFeature `mapstructure:"features" yaml:"features" json:"features"`
+}
+
+// DefaultDatapathConfig returns the default datapath configuration.
+func DefaultDatapathConfig() DatapathConfig {
+	return DatapathConfig{
+		Mode:     DatapathKernel,
+		TCPolicy: TCPolicyNone,
+		Bridges:  []string{"br-int", "br-tun"},
+		Features: []DatapathFeature{DatapathFeatureConntrack, DatapathFeatureTunnels},
+	}
+}
+
+// BridgeDatapathType returns the OVS bridge datapath_type for the mode.
+func (c *DatapathConfig) BridgeDatapathType() string {
+	if c.Mode == DatapathDPDK {
+		return BridgeDatapathNetdev
+	}
+	return BridgeDatapathSystem
+}
+
+// SupportsFeature reports whether the configured mode can provide a feature.
+func (c *DatapathConfig) SupportsFeature(feature DatapathFeature) bool {
+	switch c.Mode {
+	case DatapathKernel, DatapathDPDK:
+		return feature == DatapathFeatureConntrack || feature == DatapathFeatureTunnels
+	case DatapathHWOffload:
+		switch feature {
+		case DatapathFeatureTunnels:
+			return true
+		case DatapathFeatureConntrack:
+			// Connection tracking cannot always be offloaded; flows that stay
+			// in software are rejected when the software path is skipped.
+			return c.TCPolicy != TCPolicySkipSW
+		}
+	}
+	return false
+}
+
+// Validate checks the configuration and that every feature in use is supported.
+func (c *DatapathConfig) Validate() error {
+	switch c.Mode {
+	case DatapathKernel, DatapathHWOffload, DatapathDPDK:
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownDatapathMode, c.Mode)
+	}
+
+	switch c.TCPolicy {
+	case "", TCPolicyNone, TCPolicySkipSW, TCPolicySkipHW:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidTCPolicy, c.TCPolicy)
+	}
+	if c.TCPolicy != "" && c.TCPolicy != TCPolicyNone && c.Mode != DatapathHWOffload {
+		return fmt.Errorf("%w: tc_policy requires %s", ErrDatapathOptionMismatch, DatapathHWOffload)
+	}
+
+	if c.Mode == DatapathDPDK {
+		if err := validateCPUMask(c.PMDCPUMask); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPMDCPUMask, err)
+		}
+		if c.LcoreMask != "" {
+			if err := validateCPUMask(c.LcoreMask); err != nil {
+				return fmt.Errorf("%w: lcore mask: %v", ErrInvalidPMDCPUMask, err)
+			}
+		}
+		if c.SocketMem != "" {
+			for _, v := range strings.Split(c.SocketMem, ",") {
+				if _, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32); err != nil {
+					return fmt.Errorf("%w: %q", ErrInvalidDPDKSocketMem, c.SocketMem)
+				}
+			}
+		}
+	} else if c.PMDCPUMask != "" || c.LcoreMask != "" || c.SocketMem != "" {
+		return fmt.Errorf("%w: DPDK options require %s", ErrDatapathOptionMismatch, DatapathDPDK)
+	}
+
+	for _, f := range c.Features {
+		if !c.SupportsFeature(f) {
+			return fmt.Errorf("%w: %s in %s mode", ErrUnsupportedFeature, f, c.Mode)
+		}
+	}
+
+	return nil
+}
+
+// OtherConfig returns the Open_vSwitch other_config keys for the mode.
+func (c *DatapathConfig) OtherConfig() map[string]string {
+	cfg := make(map[string]string)
+
+	switch c.Mode {
+	case DatapathHWOffload:
+		cfg["hw-offload"] = "true"
+		policy := c.TCPolicy
+		if policy == "" {
+			policy = TCPolicyNone
+		}
+		cfg["tc-policy"] = policy
+	case DatapathDPDK:
+		cfg["dpdk-init"] = "true"
+		cfg["pmd-cpu-mask"] = c.PMDCPUMask
+		if c.LcoreMask != "" {
+			cfg["dpdk-lcore-mask"] = c.LcoreMask
+		}
+		if c.SocketMem != "" {
+			cfg["dpdk-socket-mem"] = c.SocketMem
+		}
+	default:
+		cfg["hw-offload"] = "false"
+	}
+
+	return cfg
+}
+
+// validateCPUMask checks that mask is a non-zero hex CPU mask.
+func validateCPUMask(mask string) error {
+	if mask == "" {
+		return errors.New("mask is required")
+	}
+	val, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(mask), "0x"), 16, 64)
+	if err != nil {
+		return fmt.Errorf("mask %q is not hexadecimal", mask)
+	}
+	if val == 0 {
+		return fmt.Errorf("mask %q selects no CPUs", mask)
+	}
+	return nil
+}
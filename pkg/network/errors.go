@@ -0,0 +1,45 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds. Every error the network packages return for a condition the
+// caller caused wraps one of these, so callers can tell a missing resource
+// from a conflict or a bad request without matching messages; the API maps
+// each kind to a status code.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrInUse         = errors.New("in use")
+	ErrInvalid       = errors.New("invalid argument")
+	ErrExhausted     = errors.New("exhausted")
+)
+
+// kindError is an error of one of the error kinds. Its message is its own;
+// the kind is only visible through errors.Is.
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// NewError returns an error with the given message that matches kind with
+// errors.Is. It is used to declare the packages' sentinel errors.
+func NewError(kind error, msg string) error {
+	return &kindError{msg: msg, kind: kind}
+}
+
+// Invalidf formats a validation error that matches ErrInvalid.
+func Invalidf(format string, args ...any) error {
+	return &kindError{msg: fmt.Sprintf(format, args...), kind: ErrInvalid}
+}
+
+// Errors shared by the SDN controller and the overlay.
+var (
+	ErrVNIInUse  = NewError(ErrAlreadyExists, "VNI already in use")
+	ErrNoFreeVNI = NewError(ErrExhausted, "no free VNI")
+)
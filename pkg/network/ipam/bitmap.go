@@ -0,0 +1,338 @@
+package ipam
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+const (
+	bitmapKeyPrefix = "/hypervisor/network/bitmaps/"
+
+	// maxBitmapHostBits bounds the subnets tracked with a bitmap (a /12 is a
+	// 128KiB value). Larger subnets fall back to scanning allocations.
+	maxBitmapHostBits = 20
+
+	// bitmapAttempts bounds the retries of an allocation that loses a race
+	// for the bitmap to another server.
+	bitmapAttempts = 8
+)
+
+// allocationBitmap records which addresses of a subnet are allocated, so an
+// allocation reads and writes one key instead of listing every allocation.
+// It is updated in the same etcd transaction as the allocation keys and
+// guarded by its mod revision, which makes concurrent allocations from
+// different servers safe. Bit n stands for the n-th address of the CIDR.
+type allocationBitmap struct {
+	CIDR   string `json:"cidr"`   // The bitmap is rebuilt when the subnet is resized
+	Cursor uint32 `json:"cursor"` // Offset after the last dynamic allocation
+	Bits   []byte `json:"bits"`
+
+	base uint32
+	size uint32
+}
+
+func bitmapKey(subnetID string) string {
+	return bitmapKeyPrefix + subnetID
+}
+
+func allocationKey(subnetID, ipAddress string) string {
+	return fmt.Sprintf("%s%s/%s", allocationKeyPrefix, subnetID, ipAddress)
+}
+
+// bitmapSupported reports whether allocations in ipNet are tracked with a
+// bitmap.
+func bitmapSupported(ipNet *net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	return ipNet.IP.To4() != nil && bits == 32 && bits-ones <= maxBitmapHostBits
+}
+
+func newBitmap(ipNet *net.IPNet) *allocationBitmap {
+	b := &allocationBitmap{CIDR: ipNet.String()}
+	b.init(ipNet)
+	b.Bits = make([]byte, (b.size+7)/8)
+	return b
+}
+
+func (b *allocationBitmap) init(ipNet *net.IPNet) {
+	ones, bits := ipNet.Mask.Size()
+	b.base = binary.BigEndian.Uint32(ipNet.IP.Mask(ipNet.Mask).To4())
+	b.size = 1 << (bits - ones)
+}
+
+// offset returns the position of ip in the bitmap.
+func (b *allocationBitmap) offset(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, false
+	}
+	n := binary.BigEndian.Uint32(ip4) - b.base
+	return n, n < b.size
+}
+
+func (b *allocationBitmap) ip(offset uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, b.base+offset)
+	return ip
+}
+
+func (b *allocationBitmap) isSet(offset uint32) bool {
+	return b.Bits[offset/8]&(1<<(offset%8)) != 0
+}
+
+func (b *allocationBitmap) set(offset uint32) {
+	b.Bits[offset/8] |= 1 << (offset % 8)
+}
+
+func (b *allocationBitmap) clear(offset uint32) {
+	b.Bits[offset/8] &^= 1 << (offset % 8)
+}
+
+// next returns the first free address of pools at or after the cursor,
+// wrapping around to the start of each pool, so released addresses are not
+// handed out again straight away. Pools are tried in order.
+func (b *allocationBitmap) next(pools []network.IPPool, reserved uint32) (uint32, bool) {
+	for _, pool := range pools {
+		start, ok := b.offset(net.ParseIP(pool.Start))
+		if !ok {
+			continue
+		}
+		end, ok := b.offset(net.ParseIP(pool.End))
+		if !ok || end < start {
+			continue
+		}
+
+		// The cursor may lie past this pool when it was left by another one
+		from := max(b.Cursor, start)
+		if offset, ok := b.findFree(from, end, reserved); ok {
+			return offset, true
+		}
+		if from > start {
+			if offset, ok := b.findFree(start, min(from-1, end), reserved); ok {
+				return offset, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// findFree returns the first clear bit in [from, to] other than reserved.
+func (b *allocationBitmap) findFree(from, to, reserved uint32) (uint32, bool) {
+	for offset := from; offset <= to; offset++ {
+		if offset%8 == 0 && b.Bits[offset/8] == 0xff {
+			// Skip full bytes
+			offset += 7
+			continue
+		}
+		if offset != reserved && !b.isSet(offset) {
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+// readBitmap reads a subnet's bitmap and its mod revision, which is 0 when
+// the key does not exist. A missing bitmap, or one built for a different
+// CIDR, is returned as nil with the revision of the stored key.
+func (i *IPAM) readBitmap(ctx context.Context, subnetID string, ipNet *net.IPNet) (*allocationBitmap, int64, error) {
+	resp, err := i.etcdClient.Raw().Get(ctx, bitmapKey(subnetID))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get allocation bitmap: %w", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+
+	rev := resp.Kvs[0].ModRevision
+	var b allocationBitmap
+	if err := json.Unmarshal(resp.Kvs[0].Value, &b); err != nil {
+		i.logger.Warn("discarding unreadable allocation bitmap",
+			zap.String("subnet_id", subnetID),
+			zap.Error(err),
+		)
+		return nil, rev, nil
+	}
+	if b.CIDR != ipNet.String() {
+		return nil, rev, nil
+	}
+	b.init(ipNet)
+	if uint32(len(b.Bits)) != (b.size+7)/8 {
+		return nil, rev, nil
+	}
+	return &b, rev, nil
+}
+
+// loadBitmap reads a subnet's bitmap, rebuilding it from the stored
+// allocations if it is missing or stale. A rebuilt bitmap is only written
+// together with the next allocation.
+func (i *IPAM) loadBitmap(ctx context.Context, subnetID string, ipNet *net.IPNet) (*allocationBitmap, int64, error) {
+	b, rev, err := i.readBitmap(ctx, subnetID, ipNet)
+	if err != nil || b != nil {
+		return b, rev, err
+	}
+
+	allocs, err := i.ListAllocations(ctx, subnetID)
+	if err != nil {
+		return nil, 0, err
+	}
+	b = newBitmap(ipNet)
+	for _, alloc := range allocs {
+		if offset, ok := b.offset(net.ParseIP(alloc.IPAddress)); ok {
+			b.set(offset)
+		}
+	}
+
+	i.logger.Info("rebuilt allocation bitmap",
+		zap.String("subnet_id", subnetID),
+		zap.String("cidr", b.CIDR),
+		zap.Int("allocations", len(allocs)),
+	)
+	return b, rev, nil
+}
+
+// allocateFromBitmap allocates opts.IPAddress, or the next free address of
+// the request's pools if it is empty. The allocation key and the updated
+// bitmap are written in one transaction that fails if either the bitmap
+// changed or the address was taken since the bitmap was read.
+func (i *IPAM) allocateFromBitmap(ctx context.Context, subnet *network.Subnet, ipNet *net.IPNet, opts AllocationOptions) (*network.IPAllocation, error) {
+	b, rev, err := i.loadBitmap(ctx, subnet.ID, ipNet)
+	if err != nil {
+		return nil, err
+	}
+
+	dynamic := opts.IPAddress == ""
+	pools := candidatePools(subnet.AllocationPools, opts)
+	reserved := b.size // Matches no offset
+	if gw, ok := b.offset(net.ParseIP(subnet.GatewayIP)); ok {
+		reserved = gw
+	}
+
+	for attempt := 0; attempt < bitmapAttempts; attempt++ {
+		var offset uint32
+		if dynamic {
+			var ok bool
+			if offset, ok = b.next(pools, reserved); !ok {
+				return nil, fmt.Errorf("%w in subnet %s", ErrNoAvailableIPs, subnet.ID)
+			}
+			b.Cursor = offset + 1
+		} else {
+			offset, _ = b.offset(net.ParseIP(opts.IPAddress))
+		}
+		b.set(offset)
+
+		ipAddress := b.ip(offset).String()
+		allocation := newAllocation(subnet.ID, ipAddress, opts)
+		allocData, err := json.Marshal(allocation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal allocation: %w", err)
+		}
+		bitmapData, err := json.Marshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal allocation bitmap: %w", err)
+		}
+
+		allocKey := allocationKey(subnet.ID, ipAddress)
+		resp, err := i.etcdClient.Raw().Txn(ctx).
+			If(
+				clientv3.Compare(clientv3.ModRevision(bitmapKey(subnet.ID)), "=", rev),
+				clientv3.Compare(clientv3.CreateRevision(allocKey), "=", 0),
+			).
+			Then(
+				clientv3.OpPut(bitmapKey(subnet.ID), string(bitmapData)),
+				clientv3.OpPut(allocKey, string(allocData)),
+			).
+			Else(
+				clientv3.OpGet(bitmapKey(subnet.ID)),
+				clientv3.OpGet(allocKey),
+			).
+			Commit()
+		if err != nil {
+			return nil, fmt.Errorf("failed to store allocation: %w", err)
+		}
+
+		if resp.Succeeded {
+			i.logger.Info("allocated IP",
+				zap.String("ip", ipAddress),
+				zap.String("subnet_id", subnet.ID),
+				zap.String("instance_id", opts.InstanceID),
+			)
+			return allocation, nil
+		}
+
+		taken := len(resp.Responses[1].GetResponseRange().Kvs) > 0
+		if taken && !dynamic {
+			return nil, fmt.Errorf("%w: %s", ErrIPAlreadyAllocated, ipAddress)
+		}
+
+		var currentRev int64
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			currentRev = kvs[0].ModRevision
+		}
+		if taken && currentRev == rev {
+			// The bitmap missed an allocation made without it; keep the bit
+			// set and try the next address
+			continue
+		}
+
+		// Another server allocated or released first
+		if b, rev, err = i.loadBitmap(ctx, subnet.ID, ipNet); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("failed to allocate IP in subnet %s: %w", subnet.ID, etcd.ErrConflict)
+}
+
+// releaseFromBitmap deletes an allocation and clears its bit in one
+// transaction. Without a current bitmap only the allocation is deleted; the
+// bitmap is rebuilt by the next allocation.
+func (i *IPAM) releaseFromBitmap(ctx context.Context, subnetID string, ipNet *net.IPNet, ipAddress string, guards []clientv3.Cmp) error {
+	allocKey := allocationKey(subnetID, ipAddress)
+
+	for attempt := 0; attempt < bitmapAttempts; attempt++ {
+		b, rev, err := i.readBitmap(ctx, subnetID, ipNet)
+		if err != nil {
+			return err
+		}
+		offset, ok := uint32(0), false
+		if b != nil {
+			offset, ok = b.offset(net.ParseIP(ipAddress))
+		}
+		if !ok {
+			return i.deleteAllocation(ctx, allocKey, guards)
+		}
+
+		b.clear(offset)
+		data, err := json.Marshal(b)
+		if err != nil {
+			return fmt.Errorf("failed to marshal allocation bitmap: %w", err)
+		}
+
+		resp, err := i.etcdClient.Raw().Txn(ctx).
+			If(append([]clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(bitmapKey(subnetID)), "=", rev)}, guards...)...).
+			Then(
+				clientv3.OpPut(bitmapKey(subnetID), string(data)),
+				clientv3.OpDelete(allocKey),
+			).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		// The caller re-checks a guarded release from scratch
+		if len(guards) > 0 {
+			return errAllocationChanged
+		}
+	}
+	return etcd.ErrConflict
+}
@@ -0,0 +1,130 @@
+package ipam
+
+import (
+	"net"
+	"testing"
+
+	"hypervisor/pkg/network"
+)
+
+func TestAllocationBitmapNext(t *testing.T) {
+	_, ipNet, err := net.ParseCIDR("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low := network.IPPool{Start: "10.0.0.10", End: "10.0.0.20"}
+	high := network.IPPool{Start: "10.0.0.100", End: "10.0.0.110"}
+	whole := network.IPPool{Start: "10.0.0.0", End: "10.0.0.255"}
+
+	tests := []struct {
+		name     string
+		pools    []network.IPPool
+		cursor   uint32
+		set      [][2]uint32 // Inclusive offset ranges already allocated
+		reserved uint32
+		want     string // Empty when no address is free
+	}{
+		{
+			name:  "empty pool starts at its first address",
+			pools: []network.IPPool{low},
+			want:  "10.0.0.10",
+		},
+		{
+			name:   "cursor inside pool",
+			pools:  []network.IPPool{low},
+			cursor: 15,
+			want:   "10.0.0.15",
+		},
+		{
+			name:   "cursor past pool end wraps to pool start",
+			pools:  []network.IPPool{low},
+			cursor: 200,
+			want:   "10.0.0.10",
+		},
+		{
+			name:   "cursor past end of full pool stays inside the pool",
+			pools:  []network.IPPool{low},
+			cursor: 200,
+			set:    [][2]uint32{{10, 20}},
+		},
+		{
+			name:   "wraps around to addresses before the cursor",
+			pools:  []network.IPPool{low},
+			cursor: 18,
+			set:    [][2]uint32{{18, 20}},
+			want:   "10.0.0.10",
+		},
+		{
+			name:   "wrap-around finds a released address",
+			pools:  []network.IPPool{low},
+			cursor: 18,
+			set:    [][2]uint32{{10, 12}, {14, 20}},
+			want:   "10.0.0.13",
+		},
+		{
+			name:   "full pool after wrap-around",
+			pools:  []network.IPPool{low},
+			cursor: 18,
+			set:    [][2]uint32{{10, 20}},
+		},
+		{
+			name:     "reserved address is skipped",
+			pools:    []network.IPPool{low},
+			reserved: 10,
+			want:     "10.0.0.11",
+		},
+		{
+			name:  "falls through to the next pool",
+			pools: []network.IPPool{low, high},
+			set:   [][2]uint32{{10, 20}},
+			want:  "10.0.0.100",
+		},
+		{
+			name:   "cursor left by a later pool wraps in an earlier one",
+			pools:  []network.IPPool{low, high},
+			cursor: 105,
+			want:   "10.0.0.10",
+		},
+		{
+			name:  "skips full bytes",
+			pools: []network.IPPool{whole},
+			set:   [][2]uint32{{0, 16}},
+			want:  "10.0.0.17",
+		},
+		{
+			name:  "pool outside the subnet is ignored",
+			pools: []network.IPPool{{Start: "10.0.1.10", End: "10.0.1.20"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBitmap(ipNet)
+			b.Cursor = tt.cursor
+			for _, r := range tt.set {
+				for offset := r[0]; offset <= r[1]; offset++ {
+					b.set(offset)
+				}
+			}
+			reserved := tt.reserved
+			if reserved == 0 {
+				reserved = b.size
+			}
+
+			offset, ok := b.next(tt.pools, reserved)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("next() = %s, want no free address", b.ip(offset))
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("next() found no free address, want %s", tt.want)
+			}
+			if got := b.ip(offset).String(); got != tt.want {
+				t.Fatalf("next() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
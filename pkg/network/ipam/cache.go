@@ -0,0 +1,269 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/network"
+)
+
+// cacheWaitTimeout bounds how long a read waits for the allocation cache to
+// catch up with etcd before reading etcd directly.
+const cacheWaitTimeout = 2 * time.Second
+
+// allocationCache mirrors the allocations of every subnet. It is filled and
+// kept current by an etcd watch rather than by the local process, so it
+// includes allocations made by other servers. Reads first wait until the
+// cache has caught up with etcd's current revision, so they observe every
+// write that completed before them on any server.
+type allocationCache struct {
+	mu       sync.RWMutex
+	bySubnet map[string]map[string]*network.IPAllocation // subnet ID -> IP -> allocation
+	rev      int64                                       // Revision reflected; 0 until loaded
+	updated  chan struct{}                               // Closed and replaced when rev advances
+}
+
+func newAllocationCache() *allocationCache {
+	return &allocationCache{
+		bySubnet: make(map[string]map[string]*network.IPAllocation),
+		updated:  make(chan struct{}),
+	}
+}
+
+// parseAllocationKey splits an allocation key into subnet ID and IP.
+func parseAllocationKey(key string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(key, allocationKeyPrefix)
+	if !ok {
+		return "", "", false
+	}
+	idx := strings.LastIndex(rest, "/")
+	if idx <= 0 || idx == len(rest)-1 {
+		return "", "", false
+	}
+	return rest[:idx], rest[idx+1:], true
+}
+
+// reset replaces the cache contents with a full listing taken at resp's
+// revision.
+func (c *allocationCache) reset(resp *clientv3.GetResponse, logger *zap.Logger) {
+	bySubnet := make(map[string]map[string]*network.IPAllocation)
+	for _, kv := range resp.Kvs {
+		subnetID, ip, ok := parseAllocationKey(string(kv.Key))
+		if !ok {
+			continue
+		}
+		var alloc network.IPAllocation
+		if err := json.Unmarshal(kv.Value, &alloc); err != nil {
+			logger.Warn("failed to unmarshal allocation", zap.String("key", string(kv.Key)), zap.Error(err))
+			continue
+		}
+		if bySubnet[subnetID] == nil {
+			bySubnet[subnetID] = make(map[string]*network.IPAllocation)
+		}
+		bySubnet[subnetID][ip] = &alloc
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bySubnet = bySubnet
+	c.advanceLocked(resp.Header.Revision)
+}
+
+// apply applies one watch response; progress notifications have no events
+// and only advance the revision.
+func (c *allocationCache) apply(resp clientv3.WatchResponse, logger *zap.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ev := range resp.Events {
+		subnetID, ip, ok := parseAllocationKey(string(ev.Kv.Key))
+		if !ok {
+			continue
+		}
+
+		if ev.Type != clientv3.EventTypePut {
+			delete(c.bySubnet[subnetID], ip)
+			if len(c.bySubnet[subnetID]) == 0 {
+				delete(c.bySubnet, subnetID)
+			}
+			continue
+		}
+
+		var alloc network.IPAllocation
+		if err := json.Unmarshal(ev.Kv.Value, &alloc); err != nil {
+			logger.Warn("failed to unmarshal allocation", zap.String("key", string(ev.Kv.Key)), zap.Error(err))
+			continue
+		}
+		if c.bySubnet[subnetID] == nil {
+			c.bySubnet[subnetID] = make(map[string]*network.IPAllocation)
+		}
+		c.bySubnet[subnetID][ip] = &alloc
+	}
+	c.advanceLocked(resp.Header.Revision)
+}
+
+func (c *allocationCache) advanceLocked(rev int64) {
+	if rev <= c.rev {
+		return
+	}
+	c.rev = rev
+	close(c.updated)
+	c.updated = make(chan struct{})
+}
+
+// invalidate marks the cache as not loaded, e.g. while it resyncs.
+func (c *allocationCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rev = 0
+}
+
+// reached reports whether the cache reflects revision rev.
+func (c *allocationCache) reached(rev int64) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rev >= rev
+}
+
+func (c *allocationCache) ready() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rev > 0
+}
+
+// waitFor blocks until the cache reflects revision rev.
+func (c *allocationCache) waitFor(ctx context.Context, rev int64) error {
+	for {
+		c.mu.RLock()
+		current, updated := c.rev, c.updated
+		c.mu.RUnlock()
+		if current == 0 {
+			return fmt.Errorf("allocation cache is not loaded")
+		}
+		if current >= rev {
+			return nil
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// list returns copies of a subnet's allocations.
+func (c *allocationCache) list(subnetID string) []*network.IPAllocation {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	allocs := make([]*network.IPAllocation, 0, len(c.bySubnet[subnetID]))
+	for _, alloc := range c.bySubnet[subnetID] {
+		copied := *alloc
+		allocs = append(allocs, &copied)
+	}
+	return allocs
+}
+
+// get returns a copy of an allocation, or nil.
+func (c *allocationCache) get(subnetID, ipAddress string) *network.IPAllocation {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	alloc, ok := c.bySubnet[subnetID][ipAddress]
+	if !ok {
+		return nil
+	}
+	copied := *alloc
+	return &copied
+}
+
+// WatchAllocations loads every allocation into the cache and keeps it in
+// sync with etcd until ctx is cancelled. Until it has loaded, and whenever
+// it falls behind, reads go to etcd directly.
+func (i *IPAM) WatchAllocations(ctx context.Context) {
+	for ctx.Err() == nil {
+		resp, err := i.etcdClient.Raw().Get(ctx, allocationKeyPrefix, clientv3.WithPrefix())
+		if err != nil {
+			i.logger.Warn("failed to load allocations, retrying...", zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		i.cache.reset(resp, i.logger)
+		i.logger.Info("loaded allocations into cache",
+			zap.Int("count", len(resp.Kvs)),
+			zap.Int64("revision", resp.Header.Revision),
+		)
+
+		// Follow on from the listing so no change is missed in between
+		watchCtx, cancel := context.WithCancel(ctx)
+		watchCh := i.etcdClient.Raw().Watch(watchCtx, allocationKeyPrefix,
+			clientv3.WithPrefix(),
+			clientv3.WithRev(resp.Header.Revision+1),
+		)
+		for wresp := range watchCh {
+			if err := wresp.Err(); err != nil {
+				// Typically compacted past our revision; relist
+				i.logger.Warn("allocation watch failed, reloading...", zap.Error(err))
+				break
+			}
+			i.cache.apply(wresp, i.logger)
+		}
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+		i.cache.invalidate()
+		i.logger.Warn("allocation watch channel closed, reconnecting...")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// cacheCurrent reports whether reads may be served from the cache, waiting
+// for it to reach etcd's current revision.
+func (i *IPAM) cacheCurrent(ctx context.Context) bool {
+	if !i.cache.ready() {
+		return false
+	}
+
+	// A count-only read returns the current revision without the values
+	resp, err := i.etcdClient.Raw().Get(ctx, allocationKeyPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return false
+	}
+
+	// The revision is cluster-wide, but the watch only reports changes under
+	// the prefix; a progress notification carries it over to the cache
+	if !i.cache.reached(resp.Header.Revision) {
+		if err := i.etcdClient.Raw().RequestProgress(ctx); err != nil {
+			return false
+		}
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, cacheWaitTimeout)
+	defer cancel()
+	if err := i.cache.waitFor(waitCtx, resp.Header.Revision); err != nil {
+		i.logger.Debug("allocation cache behind etcd, reading etcd",
+			zap.Int64("revision", resp.Header.Revision),
+			zap.Error(err),
+		)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,17 @@
+package ipam
+
+import "hypervisor/pkg/network"
+
+// Errors returned by IPAM. Each matches one of the error kinds of package
+// network as well, e.g. ErrIPAlreadyAllocated is a network.ErrAlreadyExists;
+// malformed requests are network.ErrInvalid.
+var (
+	ErrSubnetNotFound       = network.NewError(network.ErrNotFound, "subnet not found")
+	ErrAllocationNotFound   = network.NewError(network.ErrNotFound, "allocation not found")
+	ErrPoolNotFound         = network.NewError(network.ErrNotFound, "allocation pool not found")
+	ErrReservationNotFound  = network.NewError(network.ErrNotFound, "reservation not found")
+	ErrIPAlreadyAllocated   = network.NewError(network.ErrAlreadyExists, "IP already allocated")
+	ErrNoAvailableIPs       = network.NewError(network.ErrExhausted, "no available IPs")
+	ErrSubnetHasAllocations = network.NewError(network.ErrInUse, "subnet has active allocations")
+	ErrPoolHasAllocations   = network.NewError(network.ErrInUse, "allocation pool has active allocations")
+)
@@ -2,14 +2,16 @@
 package ipam
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
 
 	"hypervisor/pkg/cluster/etcd"
@@ -19,6 +21,10 @@ import (
 const (
 	subnetKeyPrefix     = "/hypervisor/network/subnets/"
 	allocationKeyPrefix = "/hypervisor/network/allocations/"
+
+	// updateAttempts bounds the retries of an allocation update that
+	// loses a race with another writer of the allocation.
+	updateAttempts = 8
 )
 
 // IPAM provides IP address management for virtual networks.
@@ -30,128 +36,279 @@ type IPAM struct {
 	subnets   map[string]*network.Subnet
 	subnetsMu sync.RWMutex
 
-	// Local allocation tracking
-	allocations   map[string]*network.IPAllocation // indexed by IP
-	allocationsMu sync.RWMutex
+	// Watch-synchronized view of the allocations of every server
+	cache *allocationCache
 }
 
 // NewIPAM creates a new IPAM instance.
 func NewIPAM(etcdClient *etcd.Client, logger *zap.Logger) *IPAM {
 	return &IPAM{
-		etcdClient:  etcdClient,
-		logger:      logger,
-		subnets:     make(map[string]*network.Subnet),
-		allocations: make(map[string]*network.IPAllocation),
+		etcdClient: etcdClient,
+		logger:     logger,
+		subnets:    make(map[string]*network.Subnet),
+		cache:      newAllocationCache(),
 	}
 }
 
-// CreateSubnet creates a new subnet for IP allocation.
-func (i *IPAM) CreateSubnet(ctx context.Context, subnet *network.Subnet) error {
+// CreateSubnet creates a new subnet for IP allocation, taking claims, such
+// as that of its name, in the same write.
+func (i *IPAM) CreateSubnet(ctx context.Context, subnet *network.Subnet, claims ...etcd.Claim) error {
 	// Validate CIDR
 	_, ipNet, err := net.ParseCIDR(subnet.CIDR)
 	if err != nil {
-		return fmt.Errorf("invalid CIDR: %w", err)
+		return network.Invalidf("invalid CIDR: %v", err)
 	}
 
 	// Validate gateway
 	if subnet.GatewayIP != "" {
 		gwIP := net.ParseIP(subnet.GatewayIP)
 		if gwIP == nil {
-			return fmt.Errorf("invalid gateway IP: %s", subnet.GatewayIP)
+			return network.Invalidf("invalid gateway IP: %s", subnet.GatewayIP)
 		}
 		if !ipNet.Contains(gwIP) {
-			return fmt.Errorf("gateway IP %s not in subnet %s", subnet.GatewayIP, subnet.CIDR)
+			return network.Invalidf("gateway IP %s not in subnet %s", subnet.GatewayIP, subnet.CIDR)
 		}
 	}
 
 	// Generate allocation pools if not specified
 	if len(subnet.AllocationPools) == 0 {
-		pool := i.generateDefaultPool(ipNet, subnet.GatewayIP)
-		subnet.AllocationPools = []network.IPPool{pool}
+		subnet.AllocationPools = i.generateDefaultPools(ipNet, subnet.GatewayIP)
+		if len(subnet.AllocationPools) == 0 {
+			return network.Invalidf("subnet %s has no addresses to allocate besides its reserved ones", subnet.CIDR)
+		}
 	}
 
 	// Validate allocation pools
-	for _, pool := range subnet.AllocationPools {
-		startIP := net.ParseIP(pool.Start)
-		endIP := net.ParseIP(pool.End)
-		if startIP == nil || endIP == nil {
-			return fmt.Errorf("invalid IP pool: %s - %s", pool.Start, pool.End)
-		}
-		if !ipNet.Contains(startIP) || !ipNet.Contains(endIP) {
-			return fmt.Errorf("IP pool %s-%s not in subnet %s", pool.Start, pool.End, subnet.CIDR)
-		}
+	if err := validatePools(ipNet, subnet.AllocationPools); err != nil {
+		return err
+	}
+	if err := checkReserved(ipNet, subnet.GatewayIP, subnet.AllocationPools); err != nil {
+		return err
 	}
 
 	subnet.CreatedAt = time.Now()
 	subnet.UpdatedAt = time.Now()
 
-	// Store in etcd
+	if err := i.storeSubnet(ctx, subnet, claims...); err != nil {
+		return err
+	}
+
+	i.logger.Info("created subnet",
+		zap.String("subnet_id", subnet.ID),
+		zap.String("cidr", subnet.CIDR),
+		zap.String("network_id", subnet.NetworkID),
+	)
+
+	return nil
+}
+
+// storeSubnet writes a subnet, with claims, to etcd and the local cache.
+func (i *IPAM) storeSubnet(ctx context.Context, subnet *network.Subnet, claims ...etcd.Claim) error {
 	key := subnetKeyPrefix + subnet.ID
 	data, err := json.Marshal(subnet)
 	if err != nil {
 		return fmt.Errorf("failed to marshal subnet: %w", err)
 	}
 
-	if err := i.etcdClient.Put(ctx, key, string(data)); err != nil {
+	if err := i.etcdClient.PutClaimed(ctx, key, string(data), claims...); err != nil {
 		return fmt.Errorf("failed to store subnet: %w", err)
 	}
 
-	// Update local cache
 	i.subnetsMu.Lock()
 	i.subnets[subnet.ID] = subnet
 	i.subnetsMu.Unlock()
 
-	i.logger.Info("created subnet",
-		zap.String("subnet_id", subnet.ID),
-		zap.String("cidr", subnet.CIDR),
-		zap.String("network_id", subnet.NetworkID),
-	)
+	return nil
+}
+
+// validatePools checks that pools are well formed, inside the subnet and do
+// not overlap each other.
+func validatePools(ipNet *net.IPNet, pools []network.IPPool) error {
+	for idx, pool := range pools {
+		startIP := net.ParseIP(pool.Start)
+		endIP := net.ParseIP(pool.End)
+		if startIP == nil || endIP == nil {
+			return network.Invalidf("invalid IP pool: %s - %s", pool.Start, pool.End)
+		}
+		if !ipNet.Contains(startIP) || !ipNet.Contains(endIP) {
+			return network.Invalidf("IP pool %s-%s not in subnet %s", pool.Start, pool.End, ipNet.String())
+		}
+		if bytes.Compare(startIP.To16(), endIP.To16()) > 0 {
+			return network.Invalidf("IP pool %s-%s has start after end", pool.Start, pool.End)
+		}
+		switch pool.Type {
+		case "", network.IPPoolTypeDynamic, network.IPPoolTypeStatic:
+		default:
+			return network.Invalidf("IP pool %s-%s has unknown type %q", pool.Start, pool.End, pool.Type)
+		}
 
+		for _, other := range pools[:idx] {
+			if poolsOverlap(pool, other) {
+				return network.Invalidf("IP pool %s-%s overlaps pool %s-%s", pool.Start, pool.End, other.Start, other.End)
+			}
+		}
+	}
 	return nil
 }
 
-// generateDefaultPool creates a default allocation pool for a subnet.
-func (i *IPAM) generateDefaultPool(ipNet *net.IPNet, gatewayIP string) network.IPPool {
-	// Get network and broadcast addresses
-	networkIP := ipNet.IP.Mask(ipNet.Mask)
-	broadcastIP := make(net.IP, len(networkIP))
-	copy(broadcastIP, networkIP)
-	for j := range broadcastIP {
-		broadcastIP[j] |= ^ipNet.Mask[j]
+// checkReserved fails if a pool contains an address that must never be
+// allocated: the network address, the broadcast address of an IPv4 subnet,
+// or the gateway. Point-to-point /31 and /32 subnets have no network or
+// broadcast address.
+func checkReserved(ipNet *net.IPNet, gatewayIP string, pools []network.IPPool) error {
+	for _, pool := range pools {
+		for _, r := range reservedIPs(ipNet, gatewayIP) {
+			if poolsOverlap(pool, network.IPPool{Start: r.addr, End: r.addr}) {
+				return network.Invalidf("IP pool %s-%s contains the %s %s", pool.Start, pool.End, r.what, r.addr)
+			}
+		}
 	}
+	return nil
+}
 
-	// Start from network+2 (skip network and gateway)
-	startIP := incrementIP(networkIP)
-	startIP = incrementIP(startIP)
+// reservedIP is an address of a subnet that is never allocated.
+type reservedIP struct{ what, addr string }
 
-	// End at broadcast-1
-	endIP := decrementIP(broadcastIP)
+// reservedIPs returns the addresses of a subnet that are never allocated.
+func reservedIPs(ipNet *net.IPNet, gatewayIP string) []reservedIP {
+	var reserved []reservedIP
+	if ones, bits := ipNet.Mask.Size(); ones < bits-1 {
+		reserved = append(reserved, reservedIP{"network address", ipNet.IP.Mask(ipNet.Mask).String()})
+		if ipNet.IP.To4() != nil {
+			reserved = append(reserved, reservedIP{"broadcast address", broadcastIP(ipNet).String()})
+		}
+	}
+	if gatewayIP != "" {
+		reserved = append(reserved, reservedIP{"gateway", gatewayIP})
+	}
+	return reserved
+}
+
+// poolsOverlap reports whether two pools share any address.
+func poolsOverlap(a, b network.IPPool) bool {
+	aStart, aEnd := net.ParseIP(a.Start).To16(), net.ParseIP(a.End).To16()
+	bStart, bEnd := net.ParseIP(b.Start).To16(), net.ParseIP(b.End).To16()
+	return bytes.Compare(aStart, bEnd) <= 0 && bytes.Compare(bStart, aEnd) <= 0
+}
+
+// AddAllocationPool adds an allocation pool to an existing subnet.
+func (i *IPAM) AddAllocationPool(ctx context.Context, subnetID string, pool network.IPPool) (*network.Subnet, error) {
+	subnet, err := i.GetSubnet(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+	if err != nil {
+		return nil, network.Invalidf("invalid CIDR: %v", err)
+	}
+
+	updated := *subnet
+	updated.AllocationPools = append(append([]network.IPPool{}, subnet.AllocationPools...), pool)
+	if err := validatePools(ipNet, updated.AllocationPools); err != nil {
+		return nil, err
+	}
+	if err := checkReserved(ipNet, subnet.GatewayIP, []network.IPPool{pool}); err != nil {
+		return nil, err
+	}
+	updated.UpdatedAt = time.Now()
 
-	// If gateway is in the middle, we'd need to split the pool
-	// For simplicity, just use contiguous range
-	return network.IPPool{
-		Start: startIP.String(),
-		End:   endIP.String(),
+	if err := i.storeSubnet(ctx, &updated); err != nil {
+		return nil, err
 	}
+
+	i.logger.Info("added allocation pool",
+		zap.String("subnet_id", subnetID),
+		zap.String("start", pool.Start),
+		zap.String("end", pool.End),
+		zap.String("zone", pool.Zone),
+	)
+
+	return &updated, nil
 }
 
-// DeleteSubnet removes a subnet.
-func (i *IPAM) DeleteSubnet(ctx context.Context, subnetID string) error {
-	// Check for existing allocations
-	i.allocationsMu.RLock()
-	for _, alloc := range i.allocations {
-		if alloc.SubnetID == subnetID {
-			i.allocationsMu.RUnlock()
-			return fmt.Errorf("subnet has active allocations, cannot delete")
+// RemoveAllocationPool removes the pool starting at start from a subnet. It
+// fails while addresses from the pool are still allocated.
+func (i *IPAM) RemoveAllocationPool(ctx context.Context, subnetID, start string) (*network.Subnet, error) {
+	subnet, err := i.GetSubnet(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := -1
+	for j, pool := range subnet.AllocationPools {
+		if pool.Start == start {
+			idx = j
+			break
 		}
 	}
-	i.allocationsMu.RUnlock()
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: starting at %s in subnet %s", ErrPoolNotFound, start, subnetID)
+	}
+	pool := subnet.AllocationPools[idx]
 
-	// Delete from etcd
-	key := subnetKeyPrefix + subnetID
-	if err := i.etcdClient.Delete(ctx, key); err != nil {
+	allocs, err := i.ListAllocations(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+	for _, alloc := range allocs {
+		if i.isIPInPools(alloc.IPAddress, []network.IPPool{pool}) {
+			return nil, fmt.Errorf("%w, cannot remove %s-%s", ErrPoolHasAllocations, pool.Start, pool.End)
+		}
+	}
+
+	updated := *subnet
+	updated.AllocationPools = append(append([]network.IPPool{}, subnet.AllocationPools[:idx]...), subnet.AllocationPools[idx+1:]...)
+	updated.UpdatedAt = time.Now()
+
+	if err := i.storeSubnet(ctx, &updated); err != nil {
+		return nil, err
+	}
+
+	i.logger.Info("removed allocation pool",
+		zap.String("subnet_id", subnetID),
+		zap.String("start", pool.Start),
+		zap.String("end", pool.End),
+	)
+
+	return &updated, nil
+}
+
+// generateDefaultPools creates the default allocation pools of a subnet:
+// every address but the network address, the broadcast address of an IPv4
+// subnet and the gateway, split in two around a gateway that is not at
+// either end of the range.
+func (i *IPAM) generateDefaultPools(ipNet *net.IPNet, gatewayIP string) []network.IPPool {
+	return freeRanges(ipNet, gatewayIP, nil)
+}
+
+// DeleteSubnet removes a subnet. Subnets with allocations made through any
+// server cannot be deleted.
+func (i *IPAM) DeleteSubnet(ctx context.Context, subnetID string) error {
+	unallocated, err := i.unallocatedGuards(ctx, subnetID)
+	if err != nil {
+		return err
+	}
+	allocs, err := i.ListAllocations(ctx, subnetID)
+	if err != nil {
+		return err
+	}
+	if len(allocs) > 0 {
+		return fmt.Errorf("%w (%d), cannot delete", ErrSubnetHasAllocations, len(allocs))
+	}
+
+	// Delete from etcd along with its allocation bitmap, unless an address
+	// was allocated since the check
+	resp, err := i.etcdClient.Raw().Txn(ctx).If(unallocated...).Then(
+		clientv3.OpDelete(subnetKeyPrefix+subnetID),
+		clientv3.OpDelete(bitmapKey(subnetID)),
+	).Commit()
+	if err != nil {
 		return fmt.Errorf("failed to delete subnet: %w", err)
 	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%w, cannot delete: an address was allocated meanwhile", ErrSubnetHasAllocations)
+	}
 
 	// Remove from cache
 	i.subnetsMu.Lock()
@@ -175,12 +332,12 @@ func (i *IPAM) GetSubnet(ctx context.Context, subnetID string) (*network.Subnet,
 	// Fetch from etcd
 	key := subnetKeyPrefix + subnetID
 	value, err := i.etcdClient.Get(ctx, key)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return nil, fmt.Errorf("%w: %s", ErrSubnetNotFound, subnetID)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get subnet: %w", err)
 	}
-	if value == "" {
-		return nil, fmt.Errorf("subnet not found: %s", subnetID)
-	}
 
 	var subnet network.Subnet
 	if err := json.Unmarshal([]byte(value), &subnet); err != nil {
@@ -224,12 +381,25 @@ func (i *IPAM) AllocateIP(ctx context.Context, subnetID string, opts AllocationO
 		return nil, err
 	}
 
-	// If specific IP requested, try to allocate it
+	_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+	if err != nil {
+		return nil, network.Invalidf("invalid CIDR: %v", err)
+	}
+
 	if opts.IPAddress != "" {
-		return i.allocateSpecificIP(ctx, subnet, opts)
+		if err := checkRequestedIP(subnet, ipNet, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if bitmapSupported(ipNet) {
+		return i.allocateFromBitmap(ctx, subnet, ipNet, opts)
 	}
 
-	// Find next available IP
+	// Subnets too large for a bitmap scan their allocations
+	if opts.IPAddress != "" {
+		return i.allocateSpecificIP(ctx, subnet, opts)
+	}
 	return i.allocateNextIP(ctx, subnet, opts)
 }
 
@@ -240,40 +410,66 @@ type AllocationOptions struct {
 	InstanceID string
 	PortID     string
 	Hostname   string
+	Zone       string // Prefer pools with this zone affinity
+
+	// Status of the allocation, "allocated" if empty
+	status      string
+	description string
 }
 
-// allocateSpecificIP tries to allocate a specific IP address.
-func (i *IPAM) allocateSpecificIP(ctx context.Context, subnet *network.Subnet, opts AllocationOptions) (*network.IPAllocation, error) {
+// owners returns the identities matched against pool reserved-for lists.
+func (o AllocationOptions) owners() []string {
+	return []string{o.InstanceID, o.PortID, o.Hostname}
+}
+
+// checkRequestedIP checks that a specific IP may be allocated by a request.
+func checkRequestedIP(subnet *network.Subnet, ipNet *net.IPNet, opts AllocationOptions) error {
 	ip := net.ParseIP(opts.IPAddress)
 	if ip == nil {
-		return nil, fmt.Errorf("invalid IP address: %s", opts.IPAddress)
+		return network.Invalidf("invalid IP address: %s", opts.IPAddress)
 	}
 
 	// Check if IP is in subnet
-	_, ipNet, _ := net.ParseCIDR(subnet.CIDR)
 	if !ipNet.Contains(ip) {
-		return nil, fmt.Errorf("IP %s not in subnet %s", opts.IPAddress, subnet.CIDR)
+		return network.Invalidf("IP %s not in subnet %s", opts.IPAddress, subnet.CIDR)
 	}
 
-	// Check if IP is in allocation pool
-	if !i.isIPInPools(opts.IPAddress, subnet.AllocationPools) {
-		return nil, fmt.Errorf("IP %s not in allocation pools", opts.IPAddress)
+	// Check if IP is in an allocation pool this request may use
+	pool := findPool(ip, subnet.AllocationPools)
+	if pool == nil {
+		return network.Invalidf("IP %s not in allocation pools", opts.IPAddress)
 	}
+	if !pool.Allows(opts.owners()...) {
+		return network.Invalidf("IP %s is in a pool reserved for other owners", opts.IPAddress)
+	}
+	return nil
+}
 
-	// Check if IP is already allocated (use etcd transaction for atomicity)
-	allocKey := fmt.Sprintf("%s%s/%s", allocationKeyPrefix, subnet.ID, opts.IPAddress)
-
-	allocation := &network.IPAllocation{
-		ID:         fmt.Sprintf("%s-%s", subnet.ID, opts.IPAddress),
-		SubnetID:   subnet.ID,
-		IPAddress:  opts.IPAddress,
-		MACAddress: opts.MACAddress,
-		InstanceID: opts.InstanceID,
-		PortID:     opts.PortID,
-		Hostname:   opts.Hostname,
-		Status:     "allocated",
-		CreatedAt:  time.Now(),
+// newAllocation builds the allocation record of an address.
+func newAllocation(subnetID, ipAddress string, opts AllocationOptions) *network.IPAllocation {
+	status := opts.status
+	if status == "" {
+		status = network.AllocationStatusAllocated
+	}
+	return &network.IPAllocation{
+		ID:          fmt.Sprintf("%s-%s", subnetID, ipAddress),
+		SubnetID:    subnetID,
+		IPAddress:   ipAddress,
+		MACAddress:  opts.MACAddress,
+		InstanceID:  opts.InstanceID,
+		PortID:      opts.PortID,
+		Hostname:    opts.Hostname,
+		Description: opts.description,
+		Status:      status,
+		CreatedAt:   time.Now(),
 	}
+}
+
+// allocateSpecificIP tries to allocate a specific IP address.
+func (i *IPAM) allocateSpecificIP(ctx context.Context, subnet *network.Subnet, opts AllocationOptions) (*network.IPAllocation, error) {
+	// Check if IP is already allocated (use etcd transaction for atomicity)
+	allocKey := allocationKey(subnet.ID, opts.IPAddress)
+	allocation := newAllocation(subnet.ID, opts.IPAddress, opts)
 
 	data, err := json.Marshal(allocation)
 	if err != nil {
@@ -286,14 +482,9 @@ func (i *IPAM) allocateSpecificIP(ctx context.Context, subnet *network.Subnet, o
 		return nil, fmt.Errorf("failed to store allocation: %w", err)
 	}
 	if !created {
-		return nil, fmt.Errorf("IP %s already allocated", opts.IPAddress)
+		return nil, fmt.Errorf("%w: %s", ErrIPAlreadyAllocated, opts.IPAddress)
 	}
 
-	// Update local cache
-	i.allocationsMu.Lock()
-	i.allocations[opts.IPAddress] = allocation
-	i.allocationsMu.Unlock()
-
 	i.logger.Info("allocated IP",
 		zap.String("ip", opts.IPAddress),
 		zap.String("subnet_id", subnet.ID),
@@ -303,7 +494,8 @@ func (i *IPAM) allocateSpecificIP(ctx context.Context, subnet *network.Subnet, o
 	return allocation, nil
 }
 
-// allocateNextIP finds and allocates the next available IP.
+// allocateNextIP finds and allocates the next available IP by listing every
+// allocation of the subnet. It is used for subnets without a bitmap.
 func (i *IPAM) allocateNextIP(ctx context.Context, subnet *network.Subnet, opts AllocationOptions) (*network.IPAllocation, error) {
 	// Get existing allocations for this subnet
 	allocPrefix := fmt.Sprintf("%s%s/", allocationKeyPrefix, subnet.ID)
@@ -325,8 +517,9 @@ func (i *IPAM) allocateNextIP(ctx context.Context, subnet *network.Subnet, opts
 		allocated[subnet.GatewayIP] = true
 	}
 
-	// Find first available IP in pools
-	for _, pool := range subnet.AllocationPools {
+	// Find first available IP in the pools this request may use, preferring
+	// pools in the requested zone
+	for _, pool := range candidatePools(subnet.AllocationPools, opts) {
 		ip := net.ParseIP(pool.Start)
 		endIP := net.ParseIP(pool.End)
 
@@ -344,21 +537,34 @@ func (i *IPAM) allocateNextIP(ctx context.Context, subnet *network.Subnet, opts
 		}
 	}
 
-	return nil, fmt.Errorf("no available IPs in subnet %s", subnet.ID)
+	return nil, fmt.Errorf("%w in subnet %s", ErrNoAvailableIPs, subnet.ID)
 }
 
 // ReleaseIP releases an allocated IP address.
 func (i *IPAM) ReleaseIP(ctx context.Context, subnetID, ipAddress string) error {
-	allocKey := fmt.Sprintf("%s%s/%s", allocationKeyPrefix, subnetID, ipAddress)
+	return i.releaseIP(ctx, subnetID, ipAddress)
+}
 
-	if err := i.etcdClient.Delete(ctx, allocKey); err != nil {
-		return fmt.Errorf("failed to release IP: %w", err)
+// errAllocationChanged is returned by releaseIP when one of its guards fails.
+var errAllocationChanged = errors.New("allocation changed")
+
+// releaseIP releases an IP address in a transaction that only succeeds if
+// every guard holds.
+func (i *IPAM) releaseIP(ctx context.Context, subnetID, ipAddress string, guards ...clientv3.Cmp) error {
+	var ipNet *net.IPNet
+	if subnet, err := i.GetSubnet(ctx, subnetID); err == nil {
+		_, ipNet, _ = net.ParseCIDR(subnet.CIDR)
 	}
 
-	// Update local cache
-	i.allocationsMu.Lock()
-	delete(i.allocations, ipAddress)
-	i.allocationsMu.Unlock()
+	var err error
+	if ipNet != nil && bitmapSupported(ipNet) {
+		err = i.releaseFromBitmap(ctx, subnetID, ipNet, ipAddress, guards)
+	} else {
+		err = i.deleteAllocation(ctx, allocationKey(subnetID, ipAddress), guards)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release IP: %w", err)
+	}
 
 	i.logger.Info("released IP",
 		zap.String("ip", ipAddress),
@@ -368,17 +574,43 @@ func (i *IPAM) ReleaseIP(ctx context.Context, subnetID, ipAddress string) error
 	return nil
 }
 
+// deleteAllocation deletes an allocation key if every guard holds.
+func (i *IPAM) deleteAllocation(ctx context.Context, allocKey string, guards []clientv3.Cmp) error {
+	if len(guards) == 0 {
+		return i.etcdClient.Delete(ctx, allocKey)
+	}
+
+	resp, err := i.etcdClient.Raw().Txn(ctx).
+		If(guards...).
+		Then(clientv3.OpDelete(allocKey)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errAllocationChanged
+	}
+	return nil
+}
+
 // GetAllocation retrieves an IP allocation.
 func (i *IPAM) GetAllocation(ctx context.Context, subnetID, ipAddress string) (*network.IPAllocation, error) {
-	allocKey := fmt.Sprintf("%s%s/%s", allocationKeyPrefix, subnetID, ipAddress)
+	if i.cacheCurrent(ctx) {
+		if alloc := i.cache.get(subnetID, ipAddress); alloc != nil {
+			return alloc, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrAllocationNotFound, ipAddress)
+	}
+
+	allocKey := allocationKey(subnetID, ipAddress)
 
 	value, err := i.etcdClient.Get(ctx, allocKey)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return nil, fmt.Errorf("%w: %s", ErrAllocationNotFound, ipAddress)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get allocation: %w", err)
 	}
-	if value == "" {
-		return nil, fmt.Errorf("allocation not found: %s", ipAddress)
-	}
 
 	var alloc network.IPAllocation
 	if err := json.Unmarshal([]byte(value), &alloc); err != nil {
@@ -388,8 +620,54 @@ func (i *IPAM) GetAllocation(ctx context.Context, subnetID, ipAddress string) (*
 	return &alloc, nil
 }
 
+// UpdateAllocation changes an allocation in place: update is applied to the
+// stored allocation, which is written back in a transaction that fails if
+// the allocation changed or was released since it was read. The address
+// stays allocated throughout. It returns the updated allocation.
+func (i *IPAM) UpdateAllocation(ctx context.Context, subnetID, ipAddress string, update func(*network.IPAllocation)) (*network.IPAllocation, error) {
+	allocKey := allocationKey(subnetID, ipAddress)
+
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		resp, err := i.etcdClient.Raw().Get(ctx, allocKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get allocation: %w", err)
+		}
+		if len(resp.Kvs) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrAllocationNotFound, ipAddress)
+		}
+		rev := resp.Kvs[0].ModRevision
+
+		var alloc network.IPAllocation
+		if err := json.Unmarshal(resp.Kvs[0].Value, &alloc); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal allocation: %w", err)
+		}
+		update(&alloc)
+		data, err := json.Marshal(&alloc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal allocation: %w", err)
+		}
+
+		txn, err := i.etcdClient.Raw().Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(allocKey), "=", rev)).
+			Then(clientv3.OpPut(allocKey, string(data))).
+			Commit()
+		if err != nil {
+			return nil, fmt.Errorf("failed to update allocation: %w", err)
+		}
+		if txn.Succeeded {
+			return &alloc, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to update allocation %s in subnet %s: %w", ipAddress, subnetID, etcd.ErrConflict)
+}
+
 // ListAllocations returns all allocations for a subnet.
 func (i *IPAM) ListAllocations(ctx context.Context, subnetID string) ([]*network.IPAllocation, error) {
+	if i.cacheCurrent(ctx) {
+		return i.cache.list(subnetID), nil
+	}
+
 	allocPrefix := fmt.Sprintf("%s%s/", allocationKeyPrefix, subnetID)
 
 	kvs, err := i.etcdClient.GetWithPrefixKV(ctx, allocPrefix)
@@ -410,6 +688,37 @@ func (i *IPAM) ListAllocations(ctx context.Context, subnetID string) ([]*network
 	return allocs, nil
 }
 
+// candidatePools returns the dynamic pools an allocation may draw from:
+// pools in the requested zone first, then pools without zone affinity, then
+// pools in other zones.
+func candidatePools(pools []network.IPPool, opts AllocationOptions) []network.IPPool {
+	var zoned, unzoned, other []network.IPPool
+	for _, pool := range pools {
+		if pool.IsStatic() || !pool.Allows(opts.owners()...) {
+			continue
+		}
+		switch {
+		case opts.Zone != "" && pool.Zone == opts.Zone:
+			zoned = append(zoned, pool)
+		case pool.Zone == "":
+			unzoned = append(unzoned, pool)
+		default:
+			other = append(other, pool)
+		}
+	}
+	return append(append(zoned, unzoned...), other...)
+}
+
+// findPool returns the pool containing ip, or nil.
+func findPool(ip net.IP, pools []network.IPPool) *network.IPPool {
+	for idx := range pools {
+		if ipInRange(ip, net.ParseIP(pools[idx].Start), net.ParseIP(pools[idx].End)) {
+			return &pools[idx]
+		}
+	}
+	return nil
+}
+
 // isIPInPools checks if an IP is within any of the allocation pools.
 func (i *IPAM) isIPInPools(ipStr string, pools []network.IPPool) bool {
 	ip := net.ParseIP(ipStr)
@@ -429,20 +738,16 @@ func (i *IPAM) isIPInPools(ipStr string, pools []network.IPPool) bool {
 
 // ipInRange checks if an IP is within a range (inclusive).
 func ipInRange(ip, start, end net.IP) bool {
-	ip4 := ip.To4()
-	start4 := start.To4()
-	end4 := end.To4()
-
-	if ip4 == nil || start4 == nil || end4 == nil {
-		// Handle IPv6 or mixed
+	if ip == nil || start == nil || end == nil {
+		return false
+	}
+	// Addresses of different families never match
+	if (ip.To4() == nil) != (start.To4() == nil) || (ip.To4() == nil) != (end.To4() == nil) {
 		return false
 	}
 
-	ipInt := binary.BigEndian.Uint32(ip4)
-	startInt := binary.BigEndian.Uint32(start4)
-	endInt := binary.BigEndian.Uint32(end4)
-
-	return ipInt >= startInt && ipInt <= endInt
+	ip, start, end = ip.To16(), start.To16(), end.To16()
+	return bytes.Compare(ip, start) >= 0 && bytes.Compare(ip, end) <= 0
 }
 
 // incrementIP returns the next IP address.
@@ -0,0 +1,143 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+// ReservationOptions specifies a reservation of an address of a subnet.
+type ReservationOptions struct {
+	IPAddress string
+
+	// Static assigns the address to something outside the SDN, such as an
+	// external appliance identified by its MAC address or hostname. Without
+	// it the address is only held out of allocation.
+	Static     bool
+	MACAddress string
+	Hostname   string
+
+	Description string
+}
+
+// ReserveIP reserves an address of a subnet so it is never allocated to a
+// port, or allocates it statically to an appliance. The address may be
+// inside or outside the subnet's pools, but not one of its network,
+// broadcast or gateway addresses.
+func (i *IPAM) ReserveIP(ctx context.Context, subnetID string, opts ReservationOptions) (*network.IPAllocation, error) {
+	subnet, err := i.GetSubnet(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+	if err != nil {
+		return nil, network.Invalidf("invalid CIDR: %v", err)
+	}
+
+	ip := net.ParseIP(opts.IPAddress)
+	if ip == nil {
+		return nil, network.Invalidf("invalid IP address: %s", opts.IPAddress)
+	}
+	if !ipNet.Contains(ip) {
+		return nil, network.Invalidf("IP %s not in subnet %s", opts.IPAddress, subnet.CIDR)
+	}
+	for _, r := range reservedIPs(ipNet, subnet.GatewayIP) {
+		if ip.Equal(net.ParseIP(r.addr)) {
+			return nil, network.Invalidf("IP %s is the %s of subnet %s", opts.IPAddress, r.what, subnet.CIDR)
+		}
+	}
+
+	allocOpts := AllocationOptions{
+		IPAddress:   ip.String(),
+		MACAddress:  opts.MACAddress,
+		Hostname:    opts.Hostname,
+		status:      network.AllocationStatusReserved,
+		description: opts.Description,
+	}
+	if opts.Static {
+		if opts.MACAddress == "" && opts.Hostname == "" {
+			return nil, network.Invalidf("a static allocation needs the MAC address or hostname of what it is assigned to")
+		}
+		allocOpts.status = network.AllocationStatusStatic
+	}
+
+	var alloc *network.IPAllocation
+	if bitmapSupported(ipNet) {
+		alloc, err = i.allocateFromBitmap(ctx, subnet, ipNet, allocOpts)
+	} else {
+		alloc, err = i.allocateSpecificIP(ctx, subnet, allocOpts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	i.logger.Info("reserved IP",
+		zap.String("ip", alloc.IPAddress),
+		zap.String("subnet_id", subnetID),
+		zap.String("status", alloc.Status),
+	)
+	return alloc, nil
+}
+
+// ListReservations returns the reservations and static allocations of a
+// subnet.
+func (i *IPAM) ListReservations(ctx context.Context, subnetID string) ([]*network.IPAllocation, error) {
+	allocs, err := i.ListAllocations(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+
+	var reservations []*network.IPAllocation
+	for _, alloc := range allocs {
+		if alloc.IsReservation() {
+			reservations = append(reservations, alloc)
+		}
+	}
+	return reservations, nil
+}
+
+// DeleteReservation releases a reservation or static allocation. Addresses
+// allocated to ports are left alone.
+func (i *IPAM) DeleteReservation(ctx context.Context, subnetID, ipAddress string) error {
+	if ip := net.ParseIP(ipAddress); ip != nil {
+		ipAddress = ip.String()
+	}
+	allocKey := allocationKey(subnetID, ipAddress)
+
+	// The release only goes through if the allocation is still the
+	// reservation that was checked
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		resp, err := i.etcdClient.Raw().Get(ctx, allocKey)
+		if err != nil {
+			return fmt.Errorf("failed to get allocation: %w", err)
+		}
+		if len(resp.Kvs) == 0 {
+			return fmt.Errorf("%w: %s", ErrAllocationNotFound, ipAddress)
+		}
+
+		var alloc network.IPAllocation
+		if err := json.Unmarshal(resp.Kvs[0].Value, &alloc); err != nil {
+			return fmt.Errorf("failed to unmarshal allocation: %w", err)
+		}
+		if !alloc.IsReservation() {
+			return fmt.Errorf("%w: %s is %s, not reserved", ErrReservationNotFound, ipAddress, alloc.Status)
+		}
+
+		unchanged := clientv3.Compare(clientv3.ModRevision(allocKey), "=", resp.Kvs[0].ModRevision)
+		err = i.releaseIP(ctx, subnetID, ipAddress, unchanged)
+		if !errors.Is(err, errAllocationChanged) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to delete reservation %s in subnet %s: %w", ipAddress, subnetID, etcd.ErrConflict)
+}
@@ -0,0 +1,378 @@
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+// ExpandOptions controls how ExpandSubnet grows a subnet.
+type ExpandOptions struct {
+	CIDR   string // Wider CIDR containing the current one; empty keeps the current CIDR
+	Zone   string // Zone affinity for the added pools
+	DryRun bool   // Compute the result without storing it
+}
+
+// ExpandSubnet grows a subnet's allocatable space. The subnet is first
+// widened to opts.CIDR if set, then every usable address not yet covered by a
+// pool (or the gateway) is added as a dynamic pool, which also extends the
+// range served by DHCP. It returns the updated subnet and the added pools.
+func (i *IPAM) ExpandSubnet(ctx context.Context, subnetID string, opts ExpandOptions) (*network.Subnet, []network.IPPool, error) {
+	subnet, err := i.GetSubnet(ctx, subnetID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+	if err != nil {
+		return nil, nil, network.Invalidf("invalid CIDR: %v", err)
+	}
+
+	if opts.CIDR != "" && opts.CIDR != subnet.CIDR {
+		_, wider, err := net.ParseCIDR(opts.CIDR)
+		if err != nil {
+			return nil, nil, network.Invalidf("invalid CIDR: %v", err)
+		}
+
+		ones, bits := ipNet.Mask.Size()
+		widerOnes, widerBits := wider.Mask.Size()
+		if widerBits != bits || widerOnes >= ones || !wider.Contains(ipNet.IP) {
+			return nil, nil, network.Invalidf("CIDR %s does not contain subnet %s", opts.CIDR, subnet.CIDR)
+		}
+
+		if err := i.checkNetworkOverlap(ctx, subnet, wider); err != nil {
+			return nil, nil, err
+		}
+		// A point-to-point subnet's pools may hold the wider network's
+		// network or broadcast address
+		if err := checkReserved(wider, subnet.GatewayIP, subnet.AllocationPools); err != nil {
+			return nil, nil, err
+		}
+		ipNet = wider
+	}
+
+	added := freeRanges(ipNet, subnet.GatewayIP, subnet.AllocationPools)
+	if len(added) == 0 {
+		return nil, nil, network.Invalidf("subnet %s has no unallocated headroom in %s", subnetID, ipNet.String())
+	}
+	for idx := range added {
+		added[idx].Zone = opts.Zone
+	}
+
+	updated := *subnet
+	updated.CIDR = ipNet.String()
+	updated.AllocationPools = append(append([]network.IPPool{}, subnet.AllocationPools...), added...)
+	if err := validatePools(ipNet, updated.AllocationPools); err != nil {
+		return nil, nil, err
+	}
+
+	if opts.DryRun {
+		return &updated, added, nil
+	}
+
+	updated.UpdatedAt = time.Now()
+	if err := i.storeSubnet(ctx, &updated); err != nil {
+		return nil, nil, err
+	}
+
+	i.logger.Info("expanded subnet",
+		zap.String("subnet_id", subnetID),
+		zap.String("old_cidr", subnet.CIDR),
+		zap.String("cidr", updated.CIDR),
+		zap.Int("added_pools", len(added)),
+	)
+
+	return &updated, added, nil
+}
+
+// checkNetworkOverlap fails if ipNet overlaps another subnet of the same network.
+func (i *IPAM) checkNetworkOverlap(ctx context.Context, subnet *network.Subnet, ipNet *net.IPNet) error {
+	siblings, err := i.ListSubnets(ctx, subnet.NetworkID)
+	if err != nil {
+		return err
+	}
+
+	for _, sibling := range siblings {
+		if sibling.ID == subnet.ID {
+			continue
+		}
+		_, other, err := net.ParseCIDR(sibling.CIDR)
+		if err != nil {
+			continue
+		}
+		if ipNet.Contains(other.IP) || other.Contains(ipNet.IP) {
+			return network.Invalidf("CIDR %s overlaps subnet %s (%s)", ipNet.String(), sibling.ID, sibling.CIDR)
+		}
+	}
+	return nil
+}
+
+// PlanSplit divides a subnet's CIDR into one child subnet per zone. Each
+// child gets a default pool with affinity to its zone. Children are returned
+// without IDs; the caller assigns them before calling SplitSubnet.
+func (i *IPAM) PlanSplit(subnet *network.Subnet, zones []string) ([]*network.Subnet, error) {
+	if len(zones) < 2 {
+		return nil, network.Invalidf("at least two zones are required to split a subnet")
+	}
+	seen := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		if zone == "" {
+			return nil, network.Invalidf("zone names must not be empty")
+		}
+		if seen[zone] {
+			return nil, network.Invalidf("duplicate zone %q", zone)
+		}
+		seen[zone] = true
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+	if err != nil {
+		return nil, network.Invalidf("invalid CIDR: %v", err)
+	}
+
+	// Round the number of children up to a power of two
+	extra := 0
+	for 1<<extra < len(zones) {
+		extra++
+	}
+	ones, bits := ipNet.Mask.Size()
+	childOnes := ones + extra
+	if childOnes > bits-2 {
+		return nil, network.Invalidf("subnet %s is too small to split into %d subnets", subnet.CIDR, len(zones))
+	}
+
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-childOnes))
+	children := make([]*network.Subnet, 0, len(zones))
+	for idx, zone := range zones {
+		offset := new(big.Int).Mul(size, big.NewInt(int64(idx)))
+		childNet := &net.IPNet{
+			IP:   addToIP(ipNet.IP, offset),
+			Mask: net.CIDRMask(childOnes, bits),
+		}
+
+		gatewayIP := subnet.GatewayIP
+		if gw := net.ParseIP(gatewayIP); gw == nil || !childNet.Contains(gw) {
+			gatewayIP = incrementIP(childNet.IP).String()
+		}
+
+		pools := i.generateDefaultPools(childNet, gatewayIP)
+		for j := range pools {
+			pools[j].Zone = zone
+		}
+
+		children = append(children, &network.Subnet{
+			Name:            fmt.Sprintf("%s-%s", subnet.Name, zone),
+			NetworkID:       subnet.NetworkID,
+			CIDR:            childNet.String(),
+			GatewayIP:       gatewayIP,
+			DNSServers:      subnet.DNSServers,
+			AllocationPools: pools,
+			EnableDHCP:      subnet.EnableDHCP,
+			IPv6:            subnet.IPv6,
+		})
+	}
+
+	return children, nil
+}
+
+// SplitSubnet atomically replaces a subnet with children planned by
+// PlanSplit, taking claims, such as those of the children's names, in the
+// same write. The subnet must have no active allocations.
+func (i *IPAM) SplitSubnet(ctx context.Context, subnetID string, children []*network.Subnet, claims ...etcd.Claim) error {
+	subnet, err := i.GetSubnet(ctx, subnetID)
+	if err != nil {
+		return err
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+	if err != nil {
+		return network.Invalidf("invalid CIDR: %v", err)
+	}
+
+	unallocated, err := i.unallocatedGuards(ctx, subnetID)
+	if err != nil {
+		return err
+	}
+	allocs, err := i.ListAllocations(ctx, subnetID)
+	if err != nil {
+		return err
+	}
+	if len(allocs) > 0 {
+		return fmt.Errorf("%w (%d), cannot split %s", ErrSubnetHasAllocations, len(allocs), subnetID)
+	}
+
+	now := time.Now()
+	ops := []clientv3.Op{
+		clientv3.OpDelete(subnetKeyPrefix + subnetID),
+		clientv3.OpDelete(bitmapKey(subnetID)),
+	}
+	for _, child := range children {
+		if child.ID == "" {
+			return network.Invalidf("child subnet %s has no ID", child.CIDR)
+		}
+		childIP, childNet, err := net.ParseCIDR(child.CIDR)
+		if err != nil {
+			return network.Invalidf("invalid CIDR: %v", err)
+		}
+		if !ipNet.Contains(childIP) {
+			return network.Invalidf("child subnet %s not in subnet %s", child.CIDR, subnet.CIDR)
+		}
+		if err := validatePools(childNet, child.AllocationPools); err != nil {
+			return err
+		}
+		if err := checkReserved(childNet, child.GatewayIP, child.AllocationPools); err != nil {
+			return err
+		}
+
+		child.CreatedAt = now
+		child.UpdatedAt = now
+		data, err := json.Marshal(child)
+		if err != nil {
+			return fmt.Errorf("failed to marshal subnet: %w", err)
+		}
+		ops = append(ops, clientv3.OpPut(subnetKeyPrefix+child.ID, string(data)))
+	}
+
+	free, err := i.etcdClient.CheckClaims(ctx, claims)
+	if err != nil {
+		return err
+	}
+	claimCmps, claimOps := etcd.ClaimTxn(free)
+
+	resp, err := i.etcdClient.Raw().Txn(ctx).
+		If(append(unallocated, claimCmps...)...).
+		Then(append(ops, claimOps...)...).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to store split subnets: %w", err)
+	}
+	if !resp.Succeeded {
+		if _, err := i.etcdClient.CheckClaims(ctx, claims); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w, cannot split %s: an address was allocated meanwhile", ErrSubnetHasAllocations, subnetID)
+	}
+
+	i.subnetsMu.Lock()
+	delete(i.subnets, subnetID)
+	for _, child := range children {
+		i.subnets[child.ID] = child
+	}
+	i.subnetsMu.Unlock()
+
+	i.logger.Info("split subnet",
+		zap.String("subnet_id", subnetID),
+		zap.String("cidr", subnet.CIDR),
+		zap.Int("children", len(children)),
+	)
+
+	return nil
+}
+
+// unallocatedGuards returns transaction conditions that hold only while a
+// subnet has no allocations and its allocation bitmap is unchanged since
+// this call, so a subnet found empty can be replaced or removed without
+// losing an allocation made in between.
+func (i *IPAM) unallocatedGuards(ctx context.Context, subnetID string) ([]clientv3.Cmp, error) {
+	resp, err := i.etcdClient.Raw().Get(ctx, bitmapKey(subnetID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get allocation bitmap: %w", err)
+	}
+	var rev int64
+	if len(resp.Kvs) > 0 {
+		rev = resp.Kvs[0].ModRevision
+	}
+
+	allocPrefix := fmt.Sprintf("%s%s/", allocationKeyPrefix, subnetID)
+	return []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(bitmapKey(subnetID)), "=", rev),
+		clientv3.Compare(clientv3.CreateRevision(allocPrefix), "=", 0).WithPrefix(),
+	}, nil
+}
+
+// freeRanges returns the usable addresses of ipNet that are not covered by
+// pools or the gateway, as dynamic pools.
+func freeRanges(ipNet *net.IPNet, gatewayIP string, pools []network.IPPool) []network.IPPool {
+	type ipRange struct{ start, end net.IP }
+
+	taken := make([]ipRange, 0, len(pools)+1)
+	for _, pool := range pools {
+		start, end := net.ParseIP(pool.Start), net.ParseIP(pool.End)
+		if start != nil && end != nil {
+			taken = append(taken, ipRange{start.To16(), end.To16()})
+		}
+	}
+	if gw := net.ParseIP(gatewayIP); gw != nil {
+		taken = append(taken, ipRange{gw.To16(), gw.To16()})
+	}
+	sort.Slice(taken, func(a, b int) bool {
+		return bytes.Compare(taken[a].start, taken[b].start) < 0
+	})
+
+	// Skip the network address and, in IPv4, the broadcast address, which
+	// point-to-point /31 and host /32 subnets do not have (see reservedIPs)
+	cursor := ipNet.IP.Mask(ipNet.Mask).To16()
+	last := broadcastIP(ipNet).To16()
+	if ones, bits := ipNet.Mask.Size(); ones < bits-1 {
+		cursor = incrementIP(cursor)
+		if ipNet.IP.To4() != nil {
+			last = decrementIP(last)
+		}
+	}
+
+	var free []network.IPPool
+	for _, r := range taken {
+		if bytes.Compare(r.end, cursor) < 0 {
+			continue
+		}
+		if bytes.Compare(r.start, last) > 0 {
+			break
+		}
+		if bytes.Compare(r.start, cursor) > 0 {
+			free = append(free, network.IPPool{
+				Start: cursor.String(),
+				End:   decrementIP(r.start).String(),
+				Type:  network.IPPoolTypeDynamic,
+			})
+		}
+		cursor = incrementIP(r.end)
+	}
+	if bytes.Compare(cursor, last) <= 0 {
+		free = append(free, network.IPPool{
+			Start: cursor.String(),
+			End:   last.String(),
+			Type:  network.IPPoolTypeDynamic,
+		})
+	}
+
+	return free
+}
+
+// broadcastIP returns the last address of ipNet.
+func broadcastIP(ipNet *net.IPNet) net.IP {
+	networkIP := ipNet.IP.Mask(ipNet.Mask)
+	result := make(net.IP, len(networkIP))
+	for j := range networkIP {
+		result[j] = networkIP[j] | ^ipNet.Mask[j]
+	}
+	return result
+}
+
+// addToIP returns ip advanced by n addresses.
+func addToIP(ip net.IP, n *big.Int) net.IP {
+	sum := new(big.Int).Add(new(big.Int).SetBytes(ip), n).Bytes()
+	result := make(net.IP, len(ip))
+	copy(result[len(result)-len(sum):], sum)
+	return result
+}
@@ -0,0 +1,9 @@
+package overlay
+
+import "hypervisor/pkg/network"
+
+// Errors returned by the overlay manager.
+var (
+	ErrTunnelNotFound = network.NewError(network.ErrNotFound, "tunnel not found")
+	ErrVTEPNotFound   = network.NewError(network.ErrNotFound, "VTEP not found")
+)
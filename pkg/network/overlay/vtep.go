@@ -3,6 +3,7 @@ package overlay
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -15,7 +16,9 @@ import (
 )
 
 const (
-	vtepKeyPrefix       = "/hypervisor/network/vteps/"
+	// VTEPKeyPrefix is the etcd key prefix of the VTEPs, followed by the
+	// node ID.
+	VTEPKeyPrefix       = "/hypervisor/network/vteps/"
 	vtepTTL             = 60 // seconds
 	vtepRefreshInterval = 30 * time.Second
 )
@@ -52,10 +55,12 @@ func NewVTEPManager(
 	}
 }
 
-// Start begins VTEP registration and discovery.
-func (m *VTEPManager) Start(nodeID string, localIP net.IP, port uint16) error {
+// Start begins VTEP registration and discovery. The zone scopes the
+// tunnels of network segments to the VTEPs of the same zone.
+func (m *VTEPManager) Start(nodeID, zone string, localIP net.IP, port uint16) error {
 	m.localVTEP = &network.VTEP{
 		NodeID:    nodeID,
+		Zone:      zone,
 		IP:        localIP,
 		Port:      port,
 		Interface: "br-tun",
@@ -89,7 +94,7 @@ func (m *VTEPManager) Start(nodeID string, localIP net.IP, port uint16) error {
 
 // registerVTEP registers the local VTEP in etcd.
 func (m *VTEPManager) registerVTEP() error {
-	key := vtepKeyPrefix + m.localVTEP.NodeID
+	key := VTEPKeyPrefix + m.localVTEP.NodeID
 	data, err := json.Marshal(m.localVTEP)
 	if err != nil {
 		return fmt.Errorf("failed to marshal VTEP: %w", err)
@@ -130,7 +135,7 @@ func (m *VTEPManager) discoverVTEPs() error {
 	ctx, cancel := context.WithTimeout(m.ctx, 10*time.Second)
 	defer cancel()
 
-	kvs, err := m.etcdClient.GetWithPrefixKV(ctx, vtepKeyPrefix)
+	kvs, err := m.etcdClient.GetWithPrefixKV(ctx, VTEPKeyPrefix)
 	if err != nil {
 		return fmt.Errorf("failed to list VTEPs: %w", err)
 	}
@@ -164,7 +169,7 @@ func (m *VTEPManager) discoverVTEPs() error {
 func (m *VTEPManager) watchVTEPs() {
 	defer m.wg.Done()
 
-	watchCh := m.etcdClient.WatchPrefixEvents(m.ctx, vtepKeyPrefix)
+	watchCh := m.etcdClient.WatchPrefixEvents(m.ctx, VTEPKeyPrefix)
 
 	for {
 		select {
@@ -174,7 +179,7 @@ func (m *VTEPManager) watchVTEPs() {
 			if !ok {
 				m.logger.Warn("VTEP watch channel closed, reconnecting...")
 				time.Sleep(time.Second)
-				watchCh = m.etcdClient.WatchPrefixEvents(m.ctx, vtepKeyPrefix)
+				watchCh = m.etcdClient.WatchPrefixEvents(m.ctx, VTEPKeyPrefix)
 				continue
 			}
 
@@ -185,7 +190,7 @@ func (m *VTEPManager) watchVTEPs() {
 
 // handleVTEPEvent processes a VTEP change event.
 func (m *VTEPManager) handleVTEPEvent(event etcd.WatchEvent) {
-	nodeID := event.Key[len(vtepKeyPrefix):]
+	nodeID := event.Key[len(VTEPKeyPrefix):]
 
 	// Skip local VTEP
 	if nodeID == m.localVTEP.NodeID {
@@ -212,13 +217,15 @@ func (m *VTEPManager) handleVTEPEvent(event etcd.WatchEvent) {
 			)
 			// Establish tunnels to new VTEP for all networks
 			m.establishTunnelsToVTEP(&vtep)
-		} else if !oldVTEP.IP.Equal(vtep.IP) {
-			m.logger.Info("VTEP IP changed",
+		} else if !oldVTEP.IP.Equal(vtep.IP) || oldVTEP.Zone != vtep.Zone {
+			m.logger.Info("VTEP changed",
 				zap.String("node_id", vtep.NodeID),
 				zap.String("old_ip", oldVTEP.IP.String()),
 				zap.String("new_ip", vtep.IP.String()),
+				zap.String("old_zone", oldVTEP.Zone),
+				zap.String("new_zone", vtep.Zone),
 			)
-			// Re-establish tunnels with new IP
+			// Re-establish tunnels with new IP and zone
 			m.reestablishTunnelsToVTEP(oldVTEP, &vtep)
 		}
 
@@ -239,29 +246,45 @@ func (m *VTEPManager) handleVTEPEvent(event etcd.WatchEvent) {
 	}
 }
 
-// establishTunnelsToVTEP creates tunnels to a new VTEP for all active networks.
+// establishTunnelsToVTEP creates tunnels to a new VTEP for all active networks
+// and their zone segments.
 func (m *VTEPManager) establishTunnelsToVTEP(vtep *network.VTEP) {
-	// Get all registered networks
+	// Get all registered VNIs
 	m.vxlanMgr.vniMapMu.RLock()
-	networks := make([]*network.Network, 0, len(m.vxlanMgr.vniMap))
-	for _, net := range m.vxlanMgr.vniMap {
-		networks = append(networks, net)
+	vnis := make([]uint32, 0, len(m.vxlanMgr.vniMap))
+	for vni := range m.vxlanMgr.vniMap {
+		vnis = append(vnis, vni)
 	}
 	m.vxlanMgr.vniMapMu.RUnlock()
 
-	// Create tunnel for each network
-	for _, net := range networks {
-		if _, err := m.vxlanMgr.CreateTunnel(m.ctx, vtep.NodeID, vtep.IP, net.VNI); err != nil {
+	// Create tunnel for each VNI
+	for _, vni := range vnis {
+		if !m.spans(vni, vtep) {
+			continue
+		}
+		if _, err := m.vxlanMgr.CreateTunnel(m.ctx, vtep.NodeID, vtep.IP, vni); err != nil {
 			m.logger.Error("failed to create tunnel to new VTEP",
 				zap.String("remote_node", vtep.NodeID),
-				zap.Uint32("vni", net.VNI),
+				zap.Uint32("vni", vni),
 				zap.Error(err),
 			)
 		}
 	}
 }
 
-// reestablishTunnelsToVTEP recreates tunnels when VTEP IP changes.
+// spans reports whether the tunnel mesh of a VNI reaches a remote VTEP. The
+// network's own VNI spans every VTEP, while that of a segment stays between
+// the VTEPs of its zone, keeping its floods inside the zone.
+func (m *VTEPManager) spans(vni uint32, vtep *network.VTEP) bool {
+	net, ok := m.vxlanMgr.GetNetworkByVNI(vni)
+	if !ok {
+		return true
+	}
+	zone := net.SegmentZone(vni)
+	return zone == "" || (m.localVTEP != nil && m.localVTEP.Zone == zone && vtep.Zone == zone)
+}
+
+// reestablishTunnelsToVTEP recreates tunnels when VTEP IP or zone changes.
 func (m *VTEPManager) reestablishTunnelsToVTEP(oldVTEP, newVTEP *network.VTEP) {
 	// First clean up old tunnels
 	m.cleanupTunnelsToVTEP(oldVTEP)
@@ -307,7 +330,45 @@ func (m *VTEPManager) GetRemoteVTEP(nodeID string) (*network.VTEP, bool) {
 	return vtep, exists
 }
 
-// EstablishMesh creates tunnels to all remote VTEPs for a given VNI.
+// LookupVTEP reads a node's VTEP registration from etcd. Unlike
+// GetRemoteVTEP it does not depend on the manager having been started.
+func (m *VTEPManager) LookupVTEP(ctx context.Context, nodeID string) (*network.VTEP, error) {
+	value, err := m.etcdClient.Get(ctx, VTEPKeyPrefix+nodeID)
+	if errors.Is(err, etcd.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrVTEPNotFound, nodeID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VTEP: %w", err)
+	}
+
+	var vtep network.VTEP
+	if err := json.Unmarshal([]byte(value), &vtep); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal VTEP: %w", err)
+	}
+	return &vtep, nil
+}
+
+// ListVTEPs returns the VTEPs registered in etcd, those of nodes that have
+// finished their SDN bootstrap.
+func (m *VTEPManager) ListVTEPs(ctx context.Context) ([]*network.VTEP, error) {
+	kvs, err := m.etcdClient.GetWithPrefixKV(ctx, VTEPKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VTEPs: %w", err)
+	}
+
+	vteps := make([]*network.VTEP, 0, len(kvs))
+	for _, kv := range kvs {
+		var vtep network.VTEP
+		if err := json.Unmarshal([]byte(kv.Value), &vtep); err != nil {
+			continue
+		}
+		vteps = append(vteps, &vtep)
+	}
+	return vteps, nil
+}
+
+// EstablishMesh creates tunnels to all remote VTEPs for a given VNI, or to
+// those of its zone for the VNI of a network segment.
 func (m *VTEPManager) EstablishMesh(vni uint32) error {
 	m.vtepsMu.RLock()
 	vteps := make([]*network.VTEP, 0, len(m.remoteVTEPs))
@@ -318,6 +379,9 @@ func (m *VTEPManager) EstablishMesh(vni uint32) error {
 
 	var lastErr error
 	for _, vtep := range vteps {
+		if !m.spans(vni, vtep) {
+			continue
+		}
 		if _, err := m.vxlanMgr.CreateTunnel(m.ctx, vtep.NodeID, vtep.IP, vni); err != nil {
 			m.logger.Error("failed to create tunnel in mesh",
 				zap.String("remote_node", vtep.NodeID),
@@ -342,7 +406,11 @@ func (m *VTEPManager) TeardownMesh(vni uint32) error {
 
 	var lastErr error
 	for _, vtep := range vteps {
-		if err := m.vxlanMgr.DeleteTunnel(m.ctx, vtep.NodeID, vni); err != nil {
+		err := m.vxlanMgr.DeleteTunnel(m.ctx, vtep.NodeID, vni)
+		if errors.Is(err, ErrTunnelNotFound) {
+			continue // Outside the VNI's zone
+		}
+		if err != nil {
 			m.logger.Warn("failed to delete tunnel in mesh teardown",
 				zap.String("remote_node", vtep.NodeID),
 				zap.Uint32("vni", vni),
@@ -363,7 +431,7 @@ func (m *VTEPManager) Stop() error {
 	m.wg.Wait()
 
 	// Deregister local VTEP
-	key := vtepKeyPrefix + m.localVTEP.NodeID
+	key := VTEPKeyPrefix + m.localVTEP.NodeID
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -12,6 +12,11 @@ import (
 	"hypervisor/pkg/network"
 )
 
+// BaseFlowCookie marks the fallback flow Initialize installs on the
+// integration bridge. Its absence means the switch lost its flows, e.g.
+// after ovs-vswitchd restarted.
+const BaseFlowCookie = 0x1000
+
 // VXLANManager manages VXLAN tunnels and network overlays.
 type VXLANManager struct {
 	config *network.NetworkConfig
@@ -75,7 +80,7 @@ func NewVXLANManager(config *network.NetworkConfig, logger *zap.Logger, ovsClien
 
 	localIP := net.ParseIP(config.VXLANLocalIP)
 	if localIP == nil && config.VXLANLocalIP != "" {
-		return nil, fmt.Errorf("invalid VXLAN local IP: %s", config.VXLANLocalIP)
+		return nil, network.Invalidf("invalid VXLAN local IP: %s", config.VXLANLocalIP)
 	}
 
 	mgr := &VXLANManager{
@@ -89,7 +94,22 @@ func NewVXLANManager(config *network.NetworkConfig, logger *zap.Logger, ovsClien
 	return mgr, nil
 }
 
-// Initialize sets up the VXLAN infrastructure.
+// CheckBridges verifies that the integration and tunnel bridges exist.
+func (m *VXLANManager) CheckBridges() error {
+	for _, bridge := range []string{m.config.OVSBridge, m.config.OVSTunnelBridge} {
+		exists, err := m.ovsClient.BridgeExists(bridge)
+		if err != nil {
+			return fmt.Errorf("failed to check bridge %s: %w", bridge, err)
+		}
+		if !exists {
+			return fmt.Errorf("bridge %s does not exist", bridge)
+		}
+	}
+	return nil
+}
+
+// Initialize sets up the VXLAN infrastructure. It is idempotent, so it can
+// be re-run to repair a node whose bridges or flows were lost.
 func (m *VXLANManager) Initialize(ctx context.Context, nodeID string, localIP net.IP) error {
 	m.logger.Info("initializing VXLAN manager",
 		zap.String("node_id", nodeID),
@@ -169,7 +189,7 @@ func (m *VXLANManager) installBaseFlows() error {
 	baseRule := &network.FlowRule{
 		TableID:  0,
 		Priority: 1,
-		Cookie:   0x1000,
+		Cookie:   BaseFlowCookie,
 		Actions: []network.FlowAction{
 			{Type: network.FlowActionOutput, Value: "normal"},
 		},
@@ -274,7 +294,7 @@ func (m *VXLANManager) DeleteTunnel(ctx context.Context, remoteNodeID string, vn
 	tunnelKey := fmt.Sprintf("%s-%d", remoteNodeID, vni)
 	tunnel, exists := m.tunnels[tunnelKey]
 	if !exists {
-		return fmt.Errorf("tunnel not found: %s", tunnelKey)
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, tunnelKey)
 	}
 
 	portName := fmt.Sprintf("vxlan-%s", remoteNodeID[:8])
@@ -320,34 +340,43 @@ func (m *VXLANManager) ListTunnels() []*network.Tunnel {
 	return tunnels
 }
 
-// RegisterNetwork registers a network with its VNI mapping.
+// RegisterNetwork registers a network with its VNI mapping, including the
+// VNIs of its zone segments.
 func (m *VXLANManager) RegisterNetwork(net *network.Network) error {
 	if net.Type != network.NetworkTypeVXLAN {
-		return fmt.Errorf("network type must be VXLAN, got %s", net.Type)
+		return network.Invalidf("network type must be VXLAN, got %s", net.Type)
 	}
-	if net.VNI == 0 || net.VNI > 16777215 {
-		return fmt.Errorf("invalid VNI: %d (must be 1-16777215)", net.VNI)
+	vnis := net.VNIs()
+	for _, vni := range vnis {
+		if vni == 0 || vni > 16777215 {
+			return network.Invalidf("invalid VNI: %d (must be 1-16777215)", vni)
+		}
 	}
 
 	m.vniMapMu.Lock()
 	defer m.vniMapMu.Unlock()
 
-	if existing, exists := m.vniMap[net.VNI]; exists {
-		if existing.ID != net.ID {
-			return fmt.Errorf("VNI %d already in use by network %s", net.VNI, existing.ID)
+	for _, vni := range vnis {
+		if existing, exists := m.vniMap[vni]; exists {
+			if existing.ID != net.ID {
+				return fmt.Errorf("%w: VNI %d by network %s", network.ErrVNIInUse, vni, existing.ID)
+			}
 		}
 	}
 
-	m.vniMap[net.VNI] = net
+	for _, vni := range vnis {
+		m.vniMap[vni] = net
+	}
 	m.logger.Info("registered network",
 		zap.String("network_id", net.ID),
 		zap.Uint32("vni", net.VNI),
+		zap.Int("segments", len(net.Segments)),
 	)
 
 	return nil
 }
 
-// UnregisterNetwork removes a network from VNI mapping.
+// UnregisterNetwork removes a network and its segments from VNI mapping.
 func (m *VXLANManager) UnregisterNetwork(networkID string) {
 	m.vniMapMu.Lock()
 	defer m.vniMapMu.Unlock()
@@ -359,7 +388,6 @@ func (m *VXLANManager) UnregisterNetwork(networkID string) {
 				zap.String("network_id", networkID),
 				zap.Uint32("vni", vni),
 			)
-			return
 		}
 	}
 }
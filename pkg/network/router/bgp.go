@@ -0,0 +1,599 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+const (
+	networkKeyPrefix    = "/hypervisor/network/networks/"
+	floatingIPKeyPrefix = "/hypervisor/network/floating-ips/"
+
+	// bgpResyncInterval is how often the speakers are checked and their
+	// announcements recomputed even without changes.
+	bgpResyncInterval = 30 * time.Second
+)
+
+// BGPManager runs the BGP speakers of the external networks that name this
+// node as a gateway node. Each is a gobgpd dialing the upstream peers of its
+// network and announcing, as /32s with this node's address as next hop, the
+// floating IPs associated with a port and the gateway addresses of the
+// routers on the network that this node's DVR serves: a gateway address
+// only where the router's gateway is plugged, and a floating IP only where
+// it is NATed behind one. Upstream routers thus only send traffic to
+// gateway nodes that can handle it. Announcements are recomputed from etcd
+// whenever networks, routers or floating IPs change, and periodically to
+// follow what the DVR started or stopped serving since and to restart a
+// speaker that died.
+type BGPManager struct {
+	config     *network.NetworkConfig
+	logger     *zap.Logger
+	etcdClient *etcd.Client
+	dvr        *DVR
+	nodeID     string
+	nexthop    string // This node's address, also the speakers' router ID
+
+	mu       sync.Mutex
+	speakers map[string]*bgpSpeaker // By network ID
+
+	kickCh chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// bgpSpeaker is the gobgpd of an external network on this node.
+type bgpSpeaker struct {
+	apiPort int
+	config  string // Of the running gobgpd
+}
+
+// NewBGPManager creates a manager for the BGP speakers on a node, announcing
+// the node's VXLAN local IP as next hop for the addresses dvr serves.
+func NewBGPManager(
+	config *network.NetworkConfig,
+	etcdClient *etcd.Client,
+	dvr *DVR,
+	nodeID string,
+	logger *zap.Logger,
+) *BGPManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &BGPManager{
+		config:     config,
+		logger:     logger,
+		etcdClient: etcdClient,
+		dvr:        dvr,
+		nodeID:     nodeID,
+		nexthop:    config.VXLANLocalIP,
+		speakers:   make(map[string]*bgpSpeaker),
+		kickCh:     make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Start adopts the speakers left running by a previous run, brings them in
+// line with etcd and follows changes until Stop.
+func (m *BGPManager) Start() error {
+	m.adopt()
+
+	rev, err := m.reconcile()
+	if err != nil {
+		return fmt.Errorf("failed to load BGP announcements: %w", err)
+	}
+
+	m.wg.Add(4)
+	go m.loop()
+	for _, prefix := range []string{networkKeyPrefix, routerKeyPrefix, floatingIPKeyPrefix} {
+		go m.watch(prefix, rev)
+	}
+
+	m.logger.Info("BGP manager started", zap.Int("speakers", len(m.speakers)))
+	return nil
+}
+
+// Stop stops following changes. The speakers keep running, so that
+// restarting the agent does not withdraw the routes.
+func (m *BGPManager) Stop() error {
+	m.cancel()
+	m.wg.Wait()
+	return nil
+}
+
+// adopt takes over the speakers whose state a previous run left behind;
+// those no longer wanted are stopped by the first reconcile.
+func (m *BGPManager) adopt() {
+	entries, err := os.ReadDir(m.config.BGPStateDir)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		networkID := entry.Name()
+		data, err := os.ReadFile(filepath.Join(m.stateDir(networkID), "api-port"))
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			continue
+		}
+		config, _ := os.ReadFile(filepath.Join(m.stateDir(networkID), "gobgpd.toml"))
+		m.speakers[networkID] = &bgpSpeaker{apiPort: port, config: string(config)}
+	}
+}
+
+// kick asks the loop for a reconcile.
+func (m *BGPManager) kick() {
+	select {
+	case m.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+// loop reconciles when kicked, and every bgpResyncInterval.
+func (m *BGPManager) loop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(bgpResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.kickCh:
+		case <-ticker.C:
+		}
+		if _, err := m.reconcile(); err != nil {
+			m.logger.Warn("failed to reconcile BGP announcements", zap.Error(err))
+		}
+	}
+}
+
+// watch kicks a reconcile on every change under prefix, watching again from
+// a fresh revision whenever the watch ends.
+func (m *BGPManager) watch(prefix string, rev int64) {
+	defer m.wg.Done()
+
+	for {
+		watchCtx := clientv3.WithRequireLeader(m.ctx)
+		for range m.etcdClient.WatchPrefixEvents(watchCtx, prefix, clientv3.WithRev(rev+1)) {
+			m.kick()
+		}
+
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			m.logger.Warn("BGP watch ended, resyncing", zap.String("prefix", prefix))
+
+			ctx, cancel := context.WithTimeout(m.ctx, 10*time.Second)
+			_, newRev, err := m.etcdClient.GetWithPrefixRevision(ctx, prefix)
+			cancel()
+			if err == nil {
+				rev = newRev
+				m.kick()
+				break
+			}
+			m.logger.Warn("failed to resync BGP watch", zap.String("prefix", prefix), zap.Error(err))
+		}
+	}
+}
+
+// reconcile runs a speaker for every external network naming this node,
+// announcing exactly the network's addresses, and stops the others. It
+// returns the revision it first read at.
+func (m *BGPManager) reconcile() (int64, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, 10*time.Second)
+	defer cancel()
+
+	kvs, rev, err := m.etcdClient.GetWithPrefixRevision(ctx, networkKeyPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list networks: %w", err)
+	}
+	wanted := make(map[string]*network.Network)
+	for _, kv := range kvs {
+		var net network.Network
+		if err := json.Unmarshal([]byte(kv.Value), &net); err != nil {
+			m.logger.Warn("failed to unmarshal network", zap.Error(err))
+			continue
+		}
+		if net.External && net.BGP != nil && slices.Contains(net.BGP.Nodes, m.nodeID) {
+			wanted[net.ID] = &net
+		}
+	}
+
+	var prefixes map[string][]string
+	if len(wanted) > 0 {
+		if prefixes, err = m.announcements(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for networkID, net := range wanted {
+		if err := m.apply(net, prefixes[networkID]); err != nil {
+			m.logger.Error("failed to run BGP speaker",
+				zap.String("network_id", networkID),
+				zap.Error(err),
+			)
+		}
+	}
+	for networkID := range m.speakers {
+		if wanted[networkID] == nil {
+			m.teardown(networkID)
+		}
+	}
+	return rev, nil
+}
+
+// announcements returns the /32s this node announces for each external
+// network.
+func (m *BGPManager) announcements(ctx context.Context) (map[string][]string, error) {
+	routerKVs, err := m.etcdClient.GetWithPrefixKV(ctx, routerKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routers: %w", err)
+	}
+	fipKVs, err := m.etcdClient.GetWithPrefixKV(ctx, floatingIPKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list floating IPs: %w", err)
+	}
+
+	var routers []network.Router
+	for _, kv := range routerKVs {
+		var router network.Router
+		if err := json.Unmarshal([]byte(kv.Value), &router); err != nil {
+			m.logger.Warn("failed to unmarshal router", zap.Error(err))
+			continue
+		}
+		routers = append(routers, router)
+	}
+	var fips []network.FloatingIP
+	for _, kv := range fipKVs {
+		var fip network.FloatingIP
+		if err := json.Unmarshal([]byte(kv.Value), &fip); err != nil {
+			m.logger.Warn("failed to unmarshal floating IP", zap.Error(err))
+			continue
+		}
+		fips = append(fips, fip)
+	}
+	return bgpPrefixes(routers, fips, m.dvr.ServesAddress), nil
+}
+
+// apply runs the speaker of a network with its current configuration and
+// makes it announce exactly prefixes. Called with mu held.
+func (m *BGPManager) apply(net *network.Network, prefixes []string) error {
+	if _, err := parseIPv4(m.nexthop); err != nil {
+		return fmt.Errorf("failed to use node address as next hop: %w", err)
+	}
+
+	speaker, ok := m.speakers[net.ID]
+	if !ok {
+		speaker = &bgpSpeaker{apiPort: m.freeAPIPort()}
+		m.speakers[net.ID] = speaker
+	}
+
+	config := gobgpConfig(net.BGP, m.nexthop, m.nodeID)
+	if speaker.config != config || !m.running(net.ID) {
+		if err := m.runGoBGP(net.ID, speaker, config); err != nil {
+			return err
+		}
+		m.logger.Info("started BGP speaker",
+			zap.String("network_id", net.ID),
+			zap.Uint32("local_as", net.BGP.LocalAS),
+			zap.Int("peers", len(net.BGP.PeersOf(m.nodeID))),
+			zap.Int("api_port", speaker.apiPort),
+		)
+	}
+
+	announced, err := m.announced(speaker)
+	if err != nil {
+		return err
+	}
+	var added, withdrawn int
+	for _, prefix := range prefixes {
+		if announced[prefix] {
+			delete(announced, prefix)
+			continue
+		}
+		if err := m.gobgp(speaker, "global", "rib", "add", "-a", "ipv4", prefix, "nexthop", m.nexthop); err != nil {
+			return fmt.Errorf("failed to announce %s: %w", prefix, err)
+		}
+		added++
+	}
+	for prefix := range announced {
+		if err := m.gobgp(speaker, "global", "rib", "del", "-a", "ipv4", prefix); err != nil {
+			return fmt.Errorf("failed to withdraw %s: %w", prefix, err)
+		}
+		withdrawn++
+	}
+
+	if added > 0 || withdrawn > 0 {
+		m.logger.Info("updated BGP announcements",
+			zap.String("network_id", net.ID),
+			zap.Int("announced", added),
+			zap.Int("withdrawn", withdrawn),
+		)
+	}
+	return nil
+}
+
+// teardown stops the speaker of a network, withdrawing its routes, and
+// removes its state. Called with mu held.
+func (m *BGPManager) teardown(networkID string) {
+	if _, ok := m.speakers[networkID]; !ok {
+		return
+	}
+	delete(m.speakers, networkID)
+
+	m.stopGoBGP(networkID)
+	if err := os.RemoveAll(m.stateDir(networkID)); err != nil {
+		m.logger.Warn("failed to remove BGP speaker state",
+			zap.String("network_id", networkID),
+			zap.Error(err),
+		)
+	}
+
+	m.logger.Info("stopped BGP speaker", zap.String("network_id", networkID))
+}
+
+// freeAPIPort returns the lowest API port from the base not used by another
+// speaker. Called with mu held.
+func (m *BGPManager) freeAPIPort() int {
+	used := make(map[int]bool, len(m.speakers))
+	for _, speaker := range m.speakers {
+		used[speaker.apiPort] = true
+	}
+	port := int(m.config.BGPAPIPortBase)
+	for used[port] {
+		port++
+	}
+	return port
+}
+
+// runGoBGP writes the configuration of a speaker and (re)starts its gobgpd.
+// The process is started in its own session so that it outlives the agent.
+func (m *BGPManager) runGoBGP(networkID string, speaker *bgpSpeaker, config string) error {
+	m.stopGoBGP(networkID)
+
+	dir := m.stateDir(networkID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create BGP speaker state directory: %w", err)
+	}
+	// Peer passwords are in the configuration
+	configFile := filepath.Join(dir, "gobgpd.toml")
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		return fmt.Errorf("failed to write gobgpd configuration: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "api-port"), []byte(strconv.Itoa(speaker.apiPort)), 0o644); err != nil {
+		return fmt.Errorf("failed to write gobgpd API port: %w", err)
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(dir, "gobgpd.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open gobgpd log: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command("gobgpd",
+		"-f", configFile,
+		"-t", "toml",
+		"--api-hosts", net.JoinHostPort("127.0.0.1", strconv.Itoa(speaker.apiPort)),
+		"--pprof-disable",
+	)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run gobgpd: %w", err)
+	}
+	go cmd.Wait()
+
+	if err := os.WriteFile(filepath.Join(dir, "gobgpd.pid"), []byte(strconv.Itoa(cmd.Process.Pid)), 0o644); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("failed to write gobgpd pid file: %w", err)
+	}
+	speaker.config = ""
+
+	// Routes can only be added once the API is up
+	var apiErr error
+	for range 20 {
+		if apiErr = m.gobgp(speaker, "global"); apiErr == nil {
+			speaker.config = config
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return fmt.Errorf("gobgpd API did not come up: %w", apiErr)
+}
+
+// stopGoBGP stops the gobgpd of a network, if running, and waits for it to
+// exit so that its API port is free.
+func (m *BGPManager) stopGoBGP(networkID string) {
+	pid := m.pid(networkID)
+	if pid <= 0 {
+		return
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		if !errors.Is(err, syscall.ESRCH) {
+			m.logger.Warn("failed to stop gobgpd",
+				zap.String("network_id", networkID),
+				zap.Int("pid", pid),
+				zap.Error(err),
+			)
+		}
+		return
+	}
+	for range 50 {
+		if syscall.Kill(pid, 0) != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// running reports whether the gobgpd of a network is running.
+func (m *BGPManager) running(networkID string) bool {
+	return m.pid(networkID) > 0
+}
+
+// pid returns the pid of the running gobgpd of a network, or 0.
+func (m *BGPManager) pid(networkID string) int {
+	data, err := os.ReadFile(filepath.Join(m.stateDir(networkID), "gobgpd.pid"))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return 0
+	}
+	return pid
+}
+
+func (m *BGPManager) stateDir(networkID string) string {
+	return filepath.Join(m.config.BGPStateDir, networkID)
+}
+
+// announced returns the prefixes a speaker announces.
+func (m *BGPManager) announced(speaker *bgpSpeaker) (map[string]bool, error) {
+	out, err := m.gobgpOutput(speaker, "-j", "global", "rib", "-a", "ipv4")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list announced routes: %w", err)
+	}
+	return parseGoBGPRib(out)
+}
+
+// gobgp runs a gobgp command against the API of a speaker.
+func (m *BGPManager) gobgp(speaker *bgpSpeaker, args ...string) error {
+	_, err := m.gobgpOutput(speaker, args...)
+	return err
+}
+
+// gobgpOutput runs a gobgp command against the API of a speaker and returns
+// its output.
+func (m *BGPManager) gobgpOutput(speaker *bgpSpeaker, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, 10*time.Second)
+	defer cancel()
+
+	args = append([]string{"-u", "127.0.0.1", "-p", strconv.Itoa(speaker.apiPort)}, args...)
+	out, err := exec.CommandContext(ctx, "gobgp", args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// parseGoBGPRib returns the prefixes of `gobgp -j global rib`, which maps
+// each prefix to its paths.
+func parseGoBGPRib(out []byte) (map[string]bool, error) {
+	prefixes := make(map[string]bool)
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return prefixes, nil
+	}
+	var rib map[string]json.RawMessage
+	if err := json.Unmarshal(out, &rib); err != nil {
+		return nil, fmt.Errorf("failed to parse gobgp routes: %w", err)
+	}
+	for prefix := range rib {
+		prefixes[prefix] = true
+	}
+	return prefixes, nil
+}
+
+// bgpPrefixes returns, by external network, the /32s announced for it: the
+// floating IPs associated with a port and the gateway addresses of the
+// routers on it, of those serves reports this node serves.
+func bgpPrefixes(routers []network.Router, fips []network.FloatingIP, serves func(address string) bool) map[string][]string {
+	byNetwork := make(map[string]map[string]bool)
+	add := func(networkID, address string) {
+		ip := net.ParseIP(address).To4()
+		if networkID == "" || ip == nil || !serves(address) {
+			return
+		}
+		if byNetwork[networkID] == nil {
+			byNetwork[networkID] = make(map[string]bool)
+		}
+		byNetwork[networkID][ip.String()+"/32"] = true
+	}
+
+	for _, router := range routers {
+		if gw := router.ExternalGatewayInfo; gw != nil {
+			for _, fixed := range gw.ExternalFixedIPs {
+				add(gw.NetworkID, fixed.IPAddress)
+			}
+		}
+	}
+	for _, fip := range fips {
+		if fip.PortID != "" {
+			add(fip.FloatingNetworkID, fip.FloatingIP)
+		}
+	}
+
+	result := make(map[string][]string, len(byNetwork))
+	for networkID, set := range byNetwork {
+		prefixes := make([]string, 0, len(set))
+		for prefix := range set {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		result[networkID] = prefixes
+	}
+	return result
+}
+
+// gobgpConfig renders the gobgpd configuration of the speaker of an
+// external network on a node. The speaker does not listen, only dials its
+// peers, so that the speakers of several networks can run on one node.
+func gobgpConfig(config *network.BGPConfig, routerID, nodeID string) string {
+	var b strings.Builder
+	b.WriteString("[global.config]\n")
+	fmt.Fprintf(&b, "  as = %d\n", config.LocalAS)
+	fmt.Fprintf(&b, "  router-id = %q\n", routerID)
+	b.WriteString("  port = -1\n")
+
+	for _, peer := range config.PeersOf(nodeID) {
+		b.WriteString("\n[[neighbors]]\n")
+		b.WriteString("  [neighbors.config]\n")
+		fmt.Fprintf(&b, "    neighbor-address = %q\n", peer.Address)
+		fmt.Fprintf(&b, "    peer-as = %d\n", peer.RemoteAS)
+		if peer.Password != "" {
+			fmt.Fprintf(&b, "    auth-password = %q\n", peer.Password)
+		}
+	}
+	return b.String()
+}
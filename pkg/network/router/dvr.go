@@ -4,9 +4,10 @@ package router
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
-	"os/exec"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 
 	"hypervisor/pkg/cluster/etcd"
 	"hypervisor/pkg/network"
+	"hypervisor/pkg/network/cgo"
 )
 
 const (
@@ -27,6 +29,7 @@ type DVR struct {
 	logger     *zap.Logger
 	etcdClient *etcd.Client
 	nodeID     string
+	ovs        *cgo.OVSBridge
 
 	// Router namespaces on this node
 	namespaces map[string]*RouterNamespace
@@ -40,6 +43,14 @@ type DVR struct {
 	interfaces   map[string][]*RouterInterface
 	interfacesMu sync.RWMutex
 
+	// Whether routers come from ApplyRouter and RemoveRouter rather than
+	// a watch of its own
+	externalRouters bool
+
+	// Floating IPs NATed here, followed along with the routers
+	floatingIPs map[string]*followedFloatingIP
+	fipMu       sync.Mutex
+
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
@@ -50,7 +61,12 @@ type RouterNamespace struct {
 	RouterID   string
 	Name       string // e.g., "qrouter-<router-id>"
 	Interfaces []string
+	Gateway    *network.ExternalGateway // Plugged external gateway, if any
 	Created    time.Time
+
+	ns          *namespace
+	nat         *natTable
+	floatingIPs map[string]bool // NATed floating IPs
 }
 
 // RouterInterface represents a router's connection to a subnet.
@@ -60,7 +76,9 @@ type RouterInterface struct {
 	PortID     string
 	IPAddress  string
 	MACAddress string
+	PrefixLen  int
 	VNI        uint32
+	MTU        uint16
 }
 
 // NewDVR creates a new distributed virtual router.
@@ -77,26 +95,53 @@ func NewDVR(
 		logger:     logger,
 		etcdClient: etcdClient,
 		nodeID:     nodeID,
+		ovs:        cgo.NewOVSBridge(config.OVSBridge),
 		namespaces: make(map[string]*RouterNamespace),
 		routers:    make(map[string]*network.Router),
 		interfaces: make(map[string][]*RouterInterface),
 		ctx:        ctx,
 		cancel:     cancel,
+
+		floatingIPs: make(map[string]*followedFloatingIP),
 	}
 }
 
+// SetExternalRouterWatch makes the DVR take routers only from ApplyRouter
+// and RemoveRouter, for a caller that already watches them, instead of
+// loading and watching them itself. The caller then also programs the
+// floating IPs, with SetupDNAT and RemoveDNAT. It must be called before
+// Start.
+func (d *DVR) SetExternalRouterWatch(external bool) {
+	d.externalRouters = external
+}
+
 // Start starts the DVR service.
 func (d *DVR) Start() error {
 	d.logger.Info("starting distributed virtual router")
 
-	// Load existing routers
-	if err := d.loadRouters(); err != nil {
-		return fmt.Errorf("failed to load routers: %w", err)
+	// Load existing routers and their interfaces
+	if !d.externalRouters {
+		if err := d.loadRouters(); err != nil {
+			return fmt.Errorf("failed to load routers: %w", err)
+		}
+	}
+	if err := d.loadInterfaces(); err != nil {
+		return fmt.Errorf("failed to load router interfaces: %w", err)
+	}
+	if !d.externalRouters {
+		if err := d.loadFloatingIPs(); err != nil {
+			return fmt.Errorf("failed to load floating IPs: %w", err)
+		}
 	}
 
-	// Start watching for router changes
+	// Start watching for router, interface and floating IP changes
+	if !d.externalRouters {
+		d.wg.Add(2)
+		go d.watchRouters()
+		go d.watchFloatingIPs()
+	}
 	d.wg.Add(1)
-	go d.watchRouters()
+	go d.watchInterfaces()
 
 	d.logger.Info("DVR started")
 	return nil
@@ -130,7 +175,9 @@ func (d *DVR) loadRouters() error {
 					zap.String("router_id", router.ID),
 					zap.Error(err),
 				)
+				continue
 			}
+			d.syncGateway(&router)
 		}
 	}
 
@@ -163,8 +210,6 @@ func (d *DVR) watchRouters() {
 
 // handleRouterEvent processes a router change event.
 func (d *DVR) handleRouterEvent(event etcd.WatchEvent) {
-	routerID := event.Key[len(routerKeyPrefix):]
-
 	switch event.Type {
 	case etcd.EventTypePut:
 		var router network.Router
@@ -172,39 +217,380 @@ func (d *DVR) handleRouterEvent(event etcd.WatchEvent) {
 			d.logger.Warn("failed to unmarshal router event", zap.Error(err))
 			return
 		}
+		d.ApplyRouter(&router)
 
-		d.routersMu.Lock()
-		d.routers[router.ID] = &router
-		d.routersMu.Unlock()
+	case etcd.EventTypeDelete:
+		d.RemoveRouter(event.Key[len(routerKeyPrefix):])
+	}
+}
 
-		if router.Distributed {
-			if err := d.ensureNamespace(&router); err != nil {
-				d.logger.Error("failed to ensure router namespace",
-					zap.String("router_id", router.ID),
+// ApplyRouter creates or updates a router on this node: a distributed
+// router gets its namespace and external gateway.
+func (d *DVR) ApplyRouter(router *network.Router) {
+	d.routersMu.Lock()
+	d.routers[router.ID] = router
+	d.routersMu.Unlock()
+
+	if router.Distributed {
+		if err := d.ensureNamespace(router); err != nil {
+			d.logger.Error("failed to ensure router namespace",
+				zap.String("router_id", router.ID),
+				zap.Error(err),
+			)
+			return
+		}
+		d.syncGateway(router)
+		d.syncFloatingIPs()
+	}
+
+	d.logger.Info("router updated", zap.String("router_id", router.ID))
+}
+
+// RemoveRouter removes a router from this node, with its namespace and
+// gateway.
+func (d *DVR) RemoveRouter(routerID string) {
+	d.routersMu.Lock()
+	delete(d.routers, routerID)
+	d.routersMu.Unlock()
+
+	d.nsMu.Lock()
+	if ns, exists := d.namespaces[routerID]; exists && ns.Gateway != nil {
+		d.unplugGateway(ns, ns.Gateway)
+	}
+	d.nsMu.Unlock()
+
+	if err := d.deleteNamespace(routerID); err != nil {
+		d.logger.Warn("failed to delete router namespace",
+			zap.String("router_id", routerID),
+			zap.Error(err),
+		)
+	}
+	d.syncFloatingIPs()
+
+	d.logger.Info("router deleted", zap.String("router_id", routerID))
+}
+
+// loadInterfaces loads all router interfaces from etcd and plugs them into
+// their routers' namespaces.
+func (d *DVR) loadInterfaces() error {
+	ctx, cancel := context.WithTimeout(d.ctx, 10*time.Second)
+	defer cancel()
+
+	kvs, err := d.etcdClient.GetWithPrefixKV(ctx, interfaceKeyPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range kvs {
+		var iface network.RouterInterface
+		if err := json.Unmarshal([]byte(kv.Value), &iface); err != nil {
+			d.logger.Warn("failed to unmarshal router interface", zap.Error(err))
+			continue
+		}
+		d.applyInterface(&iface)
+	}
+
+	d.logger.Info("loaded router interfaces", zap.Int("count", len(kvs)))
+	return nil
+}
+
+// watchInterfaces watches for router interface changes in etcd.
+func (d *DVR) watchInterfaces() {
+	defer d.wg.Done()
+
+	watchCh := d.etcdClient.WatchPrefixEvents(d.ctx, interfaceKeyPrefix)
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case event, ok := <-watchCh:
+			if !ok {
+				d.logger.Warn("router interface watch channel closed, reconnecting...")
+				time.Sleep(time.Second)
+				watchCh = d.etcdClient.WatchPrefixEvents(d.ctx, interfaceKeyPrefix)
+				continue
+			}
+
+			d.handleInterfaceEvent(event)
+		}
+	}
+}
+
+// handleInterfaceEvent processes a router interface change event. Keys are
+// <prefix><router-id>/<subnet-id>.
+func (d *DVR) handleInterfaceEvent(event etcd.WatchEvent) {
+	switch event.Type {
+	case etcd.EventTypePut:
+		var iface network.RouterInterface
+		if err := json.Unmarshal([]byte(event.Value), &iface); err != nil {
+			d.logger.Warn("failed to unmarshal router interface event", zap.Error(err))
+			return
+		}
+		d.applyInterface(&iface)
+
+	case etcd.EventTypeDelete:
+		routerID, subnetID, ok := strings.Cut(event.Key[len(interfaceKeyPrefix):], "/")
+		if !ok {
+			return
+		}
+		if err := d.RemoveRouterInterface(d.ctx, routerID, subnetID); err != nil {
+			d.logger.Debug("router interface not plugged on this node",
+				zap.String("router_id", routerID),
+				zap.String("subnet_id", subnetID),
+			)
+			return
+		}
+		d.syncFloatingIPs()
+	}
+}
+
+// applyInterface plugs a router interface into its router's namespace, or
+// re-addresses it if the subnet's prefix changed.
+func (d *DVR) applyInterface(iface *network.RouterInterface) {
+	prefixLen := prefixLength(iface.CIDR)
+
+	d.interfacesMu.RLock()
+	var existing *RouterInterface
+	for _, ri := range d.interfaces[iface.RouterID] {
+		if ri.SubnetID == iface.SubnetID {
+			existing = ri
+			break
+		}
+	}
+	d.interfacesMu.RUnlock()
+
+	if existing != nil {
+		if existing.PrefixLen != prefixLen {
+			if _, err := d.UpdateSubnetPrefix(d.ctx, iface.SubnetID, prefixLen); err != nil {
+				d.logger.Error("failed to update router interface prefix",
+					zap.String("subnet_id", iface.SubnetID),
 					zap.Error(err),
 				)
 			}
 		}
+		return
+	}
+
+	// The interface may be seen before its router
+	if _, exists := d.GetNamespace(iface.RouterID); !exists {
+		router, err := d.lookupRouter(iface.RouterID)
+		if err != nil {
+			d.logger.Warn("failed to find router of interface",
+				zap.String("router_id", iface.RouterID),
+				zap.Error(err),
+			)
+			return
+		}
+		if !router.Distributed {
+			return
+		}
+		if err := d.ensureNamespace(router); err != nil {
+			d.logger.Error("failed to ensure router namespace",
+				zap.String("router_id", router.ID),
+				zap.Error(err),
+			)
+			return
+		}
+	}
+
+	ip := net.ParseIP(iface.IPAddress)
+	if ip == nil {
+		d.logger.Warn("router interface has an invalid IP",
+			zap.String("router_id", iface.RouterID),
+			zap.String("ip", iface.IPAddress),
+		)
+		return
+	}
+	if err := d.AddRouterInterface(d.ctx, iface.RouterID, iface.SubnetID, iface.PortID, ip, prefixLen, iface.MACAddress, iface.VNI, iface.MTU); err != nil {
+		d.logger.Error("failed to add router interface",
+			zap.String("router_id", iface.RouterID),
+			zap.String("subnet_id", iface.SubnetID),
+			zap.Error(err),
+		)
+		return
+	}
+	d.syncFloatingIPs()
+}
+
+// lookupRouter returns a router from the cache or, if it has not been seen
+// yet, from etcd.
+func (d *DVR) lookupRouter(routerID string) (*network.Router, error) {
+	d.routersMu.RLock()
+	router, exists := d.routers[routerID]
+	d.routersMu.RUnlock()
+	if exists {
+		return router, nil
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, 5*time.Second)
+	defer cancel()
+
+	value, err := d.etcdClient.Get(ctx, routerKeyPrefix+routerID)
+	if err != nil {
+		return nil, err
+	}
+
+	router = &network.Router{}
+	if err := json.Unmarshal([]byte(value), router); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal router: %w", err)
+	}
+	return router, nil
+}
+
+// syncGateway plugs, replaces or removes a router's external gateway
+// interface to match its configuration. With SNAT enabled, traffic leaving
+// through the gateway is masqueraded to the gateway IP.
+func (d *DVR) syncGateway(router *network.Router) {
+	d.nsMu.Lock()
+	defer d.nsMu.Unlock()
+
+	ns, exists := d.namespaces[router.ID]
+	if !exists {
+		return
+	}
+
+	want := router.ExternalGatewayInfo
+	if want != nil && (want.PortID == "" || len(want.ExternalFixedIPs) == 0) {
+		want = nil
+	}
+
+	if current := ns.Gateway; current != nil {
+		if want != nil && want.PortID == current.PortID {
+			if want.EnableSNAT != current.EnableSNAT {
+				if err := d.setGatewaySNAT(ns, current, want.EnableSNAT); err != nil {
+					d.logger.Error("failed to update gateway SNAT",
+						zap.String("router_id", router.ID),
+						zap.Bool("enable", want.EnableSNAT),
+						zap.Error(err),
+					)
+				}
+			}
+			return
+		}
+		d.unplugGateway(ns, current)
+	}
 
-		d.logger.Info("router updated", zap.String("router_id", router.ID))
+	if want == nil {
+		return
+	}
+	if err := d.plugGateway(ns, want); err != nil {
+		d.logger.Error("failed to plug router gateway",
+			zap.String("router_id", router.ID),
+			zap.String("port_id", want.PortID),
+			zap.Error(err),
+		)
+	}
+}
 
-	case etcd.EventTypeDelete:
-		d.routersMu.Lock()
-		delete(d.routers, routerID)
-		d.routersMu.Unlock()
+// plugGateway creates the gateway interface in a router namespace and routes
+// default traffic through the external subnet's gateway. nsMu must be held.
+func (d *DVR) plugGateway(ns *RouterNamespace, gw *network.ExternalGateway) error {
+	hostVeth := fmt.Sprintf("qg-%s", gw.PortID[:8])
+	nsVeth := fmt.Sprintf("qgi-%s", gw.PortID[:8])
 
-		if err := d.deleteNamespace(routerID); err != nil {
-			d.logger.Warn("failed to delete router namespace",
-				zap.String("router_id", routerID),
+	ip, err := parseIPv4(gw.ExternalFixedIPs[0].IPAddress)
+	if err != nil {
+		return err
+	}
+	if err := plugVeth(ns.ns, hostVeth, nsVeth, ip, prefixLength(gw.CIDR), gw.MACAddress, gw.MTU); err != nil {
+		return err
+	}
+	if err := d.ovs.AddPort(d.config.OVSBridge, hostVeth, map[string]string{
+		"external_ids:router-id": ns.RouterID,
+	}); err != nil {
+		return err
+	}
+
+	if gw.GatewayIP != "" {
+		nexthop, err := parseIPv4(gw.GatewayIP)
+		if err != nil {
+			return err
+		}
+		if err := replaceRoute(ns.ns, nil, nexthop); err != nil {
+			return err
+		}
+	}
+
+	plugged := *gw
+	plugged.EnableSNAT = false
+	ns.Gateway = &plugged
+	if gw.EnableSNAT {
+		if err := d.setGatewaySNAT(ns, ns.Gateway, true); err != nil {
+			return err
+		}
+	}
+
+	d.logger.Info("plugged router gateway",
+		zap.String("router_id", ns.RouterID),
+		zap.String("ip", ip.String()),
+		zap.String("nexthop", gw.GatewayIP),
+		zap.Bool("snat", gw.EnableSNAT),
+	)
+	return nil
+}
+
+// unplugGateway removes the gateway interface from a router namespace.
+// nsMu must be held.
+func (d *DVR) unplugGateway(ns *RouterNamespace, gw *network.ExternalGateway) {
+	if gw.EnableSNAT {
+		if err := d.setGatewaySNAT(ns, gw, false); err != nil {
+			d.logger.Warn("failed to remove gateway SNAT rule",
+				zap.String("router_id", ns.RouterID),
 				zap.Error(err),
 			)
 		}
+	}
 
-		d.logger.Info("router deleted", zap.String("router_id", routerID))
+	hostVeth := fmt.Sprintf("qg-%s", gw.PortID[:8])
+	if err := d.unplugVeth(hostVeth); err != nil {
+		d.logger.Warn("failed to remove gateway interface",
+			zap.String("router_id", ns.RouterID),
+			zap.Error(err),
+		)
 	}
+	ns.Gateway = nil
+
+	d.logger.Info("unplugged router gateway",
+		zap.String("router_id", ns.RouterID),
+		zap.String("port_id", gw.PortID),
+	)
+}
+
+// setGatewaySNAT adds or removes the rule masquerading traffic that leaves
+// through the gateway interface. nsMu must be held.
+func (d *DVR) setGatewaySNAT(ns *RouterNamespace, gw *network.ExternalGateway, enable bool) error {
+	ip, err := parseIPv4(gw.ExternalFixedIPs[0].IPAddress)
+	if err != nil {
+		return err
+	}
+
+	nsVeth := fmt.Sprintf("qgi-%s", gw.PortID[:8])
+	rule := ns.nat.snatOutRule(nsVeth, ip)
+	if enable {
+		err = ns.nat.add(rule)
+	} else {
+		err = ns.nat.remove(rule)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update gateway SNAT rule: %w", err)
+	}
+	gw.EnableSNAT = enable
+	return nil
+}
+
+// unplugVeth removes the host end of a router veth from OVS and deletes the
+// pair.
+func (d *DVR) unplugVeth(hostVeth string) error {
+	return errors.Join(
+		d.ovs.DeletePort(d.config.OVSBridge, hostVeth),
+		deleteLink(hostVeth),
+	)
 }
 
-// ensureNamespace creates a network namespace for a router if it doesn't exist.
+// ensureNamespace creates a network namespace for a router if it doesn't
+// exist. A namespace left behind by a previous run is adopted, and the
+// interfaces and rules re-applied to it are reconciled with what it has.
 func (d *DVR) ensureNamespace(router *network.Router) error {
 	d.nsMu.Lock()
 	defer d.nsMu.Unlock()
@@ -215,26 +601,23 @@ func (d *DVR) ensureNamespace(router *network.Router) error {
 
 	nsName := fmt.Sprintf("%s-%s", d.config.DVRNamespace, router.ID[:8])
 
-	// Create network namespace
-	if err := exec.Command("ip", "netns", "add", nsName).Run(); err != nil {
-		// Namespace might already exist
-		d.logger.Debug("namespace may already exist", zap.String("name", nsName))
-	}
-
-	// Enable loopback
-	if err := exec.Command("ip", "netns", "exec", nsName, "ip", "link", "set", "lo", "up").Run(); err != nil {
-		d.logger.Warn("failed to enable loopback", zap.Error(err))
+	ns, err := openNamespace(nsName)
+	if err != nil {
+		return err
 	}
-
-	// Enable IP forwarding in namespace
-	if err := exec.Command("ip", "netns", "exec", nsName, "sysctl", "-w", "net.ipv4.ip_forward=1").Run(); err != nil {
-		d.logger.Warn("failed to enable IP forwarding", zap.Error(err))
+	nat, err := openNATTable(ns)
+	if err != nil {
+		ns.close()
+		return err
 	}
 
 	d.namespaces[router.ID] = &RouterNamespace{
-		RouterID: router.ID,
-		Name:     nsName,
-		Created:  time.Now(),
+		RouterID:    router.ID,
+		Name:        nsName,
+		Created:     time.Now(),
+		ns:          ns,
+		nat:         nat,
+		floatingIPs: make(map[string]bool),
 	}
 
 	d.logger.Info("created router namespace",
@@ -247,6 +630,8 @@ func (d *DVR) ensureNamespace(router *network.Router) error {
 
 // deleteNamespace removes a router's network namespace.
 func (d *DVR) deleteNamespace(routerID string) error {
+	d.interfacesMu.Lock()
+	defer d.interfacesMu.Unlock()
 	d.nsMu.Lock()
 	defer d.nsMu.Unlock()
 
@@ -255,12 +640,23 @@ func (d *DVR) deleteNamespace(routerID string) error {
 		return nil
 	}
 
-	// Delete network namespace
-	if err := exec.Command("ip", "netns", "delete", ns.Name).Run(); err != nil {
-		return fmt.Errorf("failed to delete namespace: %w", err)
+	// Deleting the namespace deletes the veths, but not their OVS ports
+	for _, iface := range d.interfaces[routerID] {
+		hostVeth := InterfaceDevice(iface.PortID)
+		if err := d.ovs.DeletePort(d.config.OVSBridge, hostVeth); err != nil {
+			d.logger.Warn("failed to remove router interface from OVS",
+				zap.String("router_id", routerID),
+				zap.Error(err),
+			)
+		}
+	}
+
+	if err := removeNamespace(ns.ns); err != nil {
+		return err
 	}
 
 	delete(d.namespaces, routerID)
+	delete(d.interfaces, routerID)
 
 	d.logger.Info("deleted router namespace",
 		zap.String("router_id", routerID),
@@ -270,8 +666,10 @@ func (d *DVR) deleteNamespace(routerID string) error {
 	return nil
 }
 
-// AddRouterInterface adds a subnet interface to a router.
-func (d *DVR) AddRouterInterface(ctx context.Context, routerID, subnetID, portID string, ip net.IP, mac string, vni uint32) error {
+// AddRouterInterface adds a subnet interface to a router, sized to the MTU of
+// the subnet's network unless it is zero. Adding an interface that is
+// already plugged reconciles its address, MAC and MTU.
+func (d *DVR) AddRouterInterface(ctx context.Context, routerID, subnetID, portID string, ip net.IP, prefixLen int, mac string, vni uint32, mtu uint16) error {
 	d.nsMu.RLock()
 	ns, exists := d.namespaces[routerID]
 	d.nsMu.RUnlock()
@@ -280,46 +678,16 @@ func (d *DVR) AddRouterInterface(ctx context.Context, routerID, subnetID, portID
 		return fmt.Errorf("router namespace not found: %s", routerID)
 	}
 
-	// Create veth pair
-	hostVeth := fmt.Sprintf("qr-%s", portID[:8])
+	hostVeth := InterfaceDevice(portID)
 	nsVeth := fmt.Sprintf("qri-%s", portID[:8])
 
-	// Create veth pair
-	cmd := exec.Command("ip", "link", "add", hostVeth, "type", "veth", "peer", "name", nsVeth)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create veth pair: %w", err)
-	}
-
-	// Move ns end into namespace
-	cmd = exec.Command("ip", "link", "set", nsVeth, "netns", ns.Name)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to move veth to namespace: %w", err)
-	}
-
-	// Configure interface in namespace
-	mask := "/24" // TODO: Get from subnet
-	cmd = exec.Command("ip", "netns", "exec", ns.Name, "ip", "addr", "add", ip.String()+mask, "dev", nsVeth)
-	if err := cmd.Run(); err != nil {
-		d.logger.Warn("failed to add IP to interface", zap.Error(err))
-	}
-
-	// Set MAC address
-	if mac != "" {
-		cmd = exec.Command("ip", "netns", "exec", ns.Name, "ip", "link", "set", nsVeth, "address", mac)
-		if err := cmd.Run(); err != nil {
-			d.logger.Warn("failed to set MAC address", zap.Error(err))
-		}
+	if err := plugVeth(ns.ns, hostVeth, nsVeth, ip, prefixLen, mac, mtu); err != nil {
+		return err
 	}
-
-	// Bring interfaces up
-	exec.Command("ip", "link", "set", hostVeth, "up").Run()
-	exec.Command("ip", "netns", "exec", ns.Name, "ip", "link", "set", nsVeth, "up").Run()
-
-	// Add host end to OVS bridge
-	cmd = exec.Command("ovs-vsctl", "add-port", d.config.OVSBridge, hostVeth,
-		"--", "set", "interface", hostVeth, fmt.Sprintf("external_ids:router-id=%s", routerID))
-	if err := cmd.Run(); err != nil {
-		d.logger.Warn("failed to add veth to OVS", zap.Error(err))
+	if err := d.ovs.AddPort(d.config.OVSBridge, hostVeth, map[string]string{
+		"external_ids:router-id": routerID,
+	}); err != nil {
+		return err
 	}
 
 	// Store interface
@@ -329,7 +697,9 @@ func (d *DVR) AddRouterInterface(ctx context.Context, routerID, subnetID, portID
 		PortID:     portID,
 		IPAddress:  ip.String(),
 		MACAddress: mac,
+		PrefixLen:  prefixLen,
 		VNI:        vni,
+		MTU:        mtu,
 	}
 
 	d.interfacesMu.Lock()
@@ -348,6 +718,13 @@ func (d *DVR) AddRouterInterface(ctx context.Context, routerID, subnetID, portID
 	return nil
 }
 
+// InterfaceDevice returns the name of the device a router interface port
+// is plugged into the integration bridge as, on every node the router is
+// distributed to.
+func InterfaceDevice(portID string) string {
+	return fmt.Sprintf("qr-%s", portID[:8])
+}
+
 // RemoveRouterInterface removes a subnet interface from a router.
 func (d *DVR) RemoveRouterInterface(ctx context.Context, routerID, subnetID string) error {
 	d.interfacesMu.Lock()
@@ -356,17 +733,26 @@ func (d *DVR) RemoveRouterInterface(ctx context.Context, routerID, subnetID stri
 	interfaces := d.interfaces[routerID]
 	for i, iface := range interfaces {
 		if iface.SubnetID == subnetID {
-			hostVeth := fmt.Sprintf("qr-%s", iface.PortID[:8])
-
-			// Remove from OVS
-			exec.Command("ovs-vsctl", "del-port", d.config.OVSBridge, hostVeth).Run()
-
-			// Delete veth pair (deleting one end deletes both)
-			exec.Command("ip", "link", "delete", hostVeth).Run()
+			hostVeth := InterfaceDevice(iface.PortID)
+			if err := d.unplugVeth(hostVeth); err != nil {
+				return fmt.Errorf("failed to remove router interface: %w", err)
+			}
 
 			// Remove from list
 			d.interfaces[routerID] = append(interfaces[:i], interfaces[i+1:]...)
 
+			nsVeth := fmt.Sprintf("qri-%s", iface.PortID[:8])
+			d.nsMu.Lock()
+			if ns, exists := d.namespaces[routerID]; exists {
+				for j, name := range ns.Interfaces {
+					if name == nsVeth {
+						ns.Interfaces = append(ns.Interfaces[:j], ns.Interfaces[j+1:]...)
+						break
+					}
+				}
+			}
+			d.nsMu.Unlock()
+
 			d.logger.Info("removed router interface",
 				zap.String("router_id", routerID),
 				zap.String("subnet_id", subnetID),
@@ -379,7 +765,65 @@ func (d *DVR) RemoveRouterInterface(ctx context.Context, routerID, subnetID stri
 	return fmt.Errorf("interface not found for subnet %s", subnetID)
 }
 
-// AddRoute adds a static route to a router.
+// SubnetRouters returns the IDs of routers with an interface on a subnet.
+func (d *DVR) SubnetRouters(subnetID string) []string {
+	d.interfacesMu.RLock()
+	defer d.interfacesMu.RUnlock()
+
+	var routerIDs []string
+	for routerID, interfaces := range d.interfaces {
+		for _, iface := range interfaces {
+			if iface.SubnetID == subnetID {
+				routerIDs = append(routerIDs, routerID)
+				break
+			}
+		}
+	}
+	return routerIDs
+}
+
+// UpdateSubnetPrefix re-addresses the router interfaces on a subnet after its
+// CIDR changed, keeping each interface's IP. It returns the updated router
+// IDs, and the errors of the interfaces it failed to re-address.
+func (d *DVR) UpdateSubnetPrefix(ctx context.Context, subnetID string, prefixLen int) ([]string, error) {
+	d.interfacesMu.Lock()
+	defer d.interfacesMu.Unlock()
+
+	var updated []string
+	var errs []error
+	for routerID, interfaces := range d.interfaces {
+		d.nsMu.RLock()
+		ns, exists := d.namespaces[routerID]
+		d.nsMu.RUnlock()
+		if !exists {
+			continue
+		}
+
+		for _, iface := range interfaces {
+			if iface.SubnetID != subnetID {
+				continue
+			}
+
+			nsVeth := fmt.Sprintf("qri-%s", iface.PortID[:8])
+			addr := fmt.Sprintf("%s/%d", iface.IPAddress, prefixLen)
+			if err := readdress(ns.ns, nsVeth, net.ParseIP(iface.IPAddress), prefixLen); err != nil {
+				errs = append(errs, fmt.Errorf("failed to re-address interface %s of router %s: %w", addr, routerID, err))
+				continue
+			}
+			iface.PrefixLen = prefixLen
+
+			updated = append(updated, routerID)
+			d.logger.Info("updated router interface prefix",
+				zap.String("router_id", routerID),
+				zap.String("subnet_id", subnetID),
+				zap.String("address", addr),
+			)
+		}
+	}
+	return updated, errors.Join(errs...)
+}
+
+// AddRoute adds or replaces a static route of a router.
 func (d *DVR) AddRoute(ctx context.Context, routerID string, destination, nexthop string) error {
 	d.nsMu.RLock()
 	ns, exists := d.namespaces[routerID]
@@ -389,9 +833,16 @@ func (d *DVR) AddRoute(ctx context.Context, routerID string, destination, nextho
 		return fmt.Errorf("router namespace not found: %s", routerID)
 	}
 
-	cmd := exec.Command("ip", "netns", "exec", ns.Name, "ip", "route", "add", destination, "via", nexthop)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add route: %w", err)
+	dst, err := parseIPv4Net(destination)
+	if err != nil {
+		return err
+	}
+	gw, err := parseIPv4(nexthop)
+	if err != nil {
+		return err
+	}
+	if err := replaceRoute(ns.ns, dst, gw); err != nil {
+		return err
 	}
 
 	d.logger.Info("added route",
@@ -413,9 +864,12 @@ func (d *DVR) RemoveRoute(ctx context.Context, routerID string, destination stri
 		return fmt.Errorf("router namespace not found: %s", routerID)
 	}
 
-	cmd := exec.Command("ip", "netns", "exec", ns.Name, "ip", "route", "del", destination)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to remove route: %w", err)
+	dst, err := parseIPv4Net(destination)
+	if err != nil {
+		return err
+	}
+	if err := deleteRoute(ns.ns, dst); err != nil {
+		return err
 	}
 
 	d.logger.Info("removed route",
@@ -436,11 +890,15 @@ func (d *DVR) SetupSNAT(ctx context.Context, routerID string, externalIP, intern
 		return fmt.Errorf("router namespace not found: %s", routerID)
 	}
 
-	// Add SNAT rule
-	cmd := exec.Command("ip", "netns", "exec", ns.Name,
-		"iptables", "-t", "nat", "-A", "POSTROUTING",
-		"-s", internalSubnet, "-j", "SNAT", "--to-source", externalIP)
-	if err := cmd.Run(); err != nil {
+	src, err := parseIPv4Net(internalSubnet)
+	if err != nil {
+		return err
+	}
+	to, err := parseIPv4(externalIP)
+	if err != nil {
+		return err
+	}
+	if err := ns.nat.add(ns.nat.snatSourceRule(src, to)); err != nil {
 		return fmt.Errorf("failed to add SNAT rule: %w", err)
 	}
 
@@ -463,21 +921,17 @@ func (d *DVR) SetupDNAT(ctx context.Context, routerID string, floatingIP, fixedI
 		return fmt.Errorf("router namespace not found: %s", routerID)
 	}
 
-	// Add DNAT rule
-	cmd := exec.Command("ip", "netns", "exec", ns.Name,
-		"iptables", "-t", "nat", "-A", "PREROUTING",
-		"-d", floatingIP, "-j", "DNAT", "--to-destination", fixedIP)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add DNAT rule: %w", err)
+	rules, err := floatingIPRules(ns.nat, floatingIP, fixedIP)
+	if err != nil {
+		return err
 	}
-
-	// Add SNAT for return traffic
-	cmd = exec.Command("ip", "netns", "exec", ns.Name,
-		"iptables", "-t", "nat", "-A", "POSTROUTING",
-		"-s", fixedIP, "-j", "SNAT", "--to-source", floatingIP)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add return SNAT rule: %w", err)
+	// DNAT inbound traffic and SNAT return traffic, in one transaction
+	if err := ns.nat.add(rules...); err != nil {
+		return fmt.Errorf("failed to add floating IP rules: %w", err)
 	}
+	d.nsMu.Lock()
+	ns.floatingIPs[floatingIP] = true
+	d.nsMu.Unlock()
 
 	d.logger.Info("configured floating IP",
 		zap.String("router_id", routerID),
@@ -498,15 +952,16 @@ func (d *DVR) RemoveDNAT(ctx context.Context, routerID string, floatingIP, fixed
 		return fmt.Errorf("router namespace not found: %s", routerID)
 	}
 
-	// Remove DNAT rule
-	exec.Command("ip", "netns", "exec", ns.Name,
-		"iptables", "-t", "nat", "-D", "PREROUTING",
-		"-d", floatingIP, "-j", "DNAT", "--to-destination", fixedIP).Run()
-
-	// Remove SNAT rule
-	exec.Command("ip", "netns", "exec", ns.Name,
-		"iptables", "-t", "nat", "-D", "POSTROUTING",
-		"-s", fixedIP, "-j", "SNAT", "--to-source", floatingIP).Run()
+	rules, err := floatingIPRules(ns.nat, floatingIP, fixedIP)
+	if err != nil {
+		return err
+	}
+	if err := ns.nat.remove(rules...); err != nil {
+		return fmt.Errorf("failed to remove floating IP rules: %w", err)
+	}
+	d.nsMu.Lock()
+	delete(ns.floatingIPs, floatingIP)
+	d.nsMu.Unlock()
 
 	d.logger.Info("removed floating IP",
 		zap.String("router_id", routerID),
@@ -516,6 +971,22 @@ func (d *DVR) RemoveDNAT(ctx context.Context, routerID string, floatingIP, fixed
 	return nil
 }
 
+// floatingIPRules returns the NAT rules of a floating IP.
+func floatingIPRules(nat *natTable, floatingIP, fixedIP string) ([]natRule, error) {
+	floating, err := parseIPv4(floatingIP)
+	if err != nil {
+		return nil, err
+	}
+	fixed, err := parseIPv4(fixedIP)
+	if err != nil {
+		return nil, err
+	}
+	return []natRule{
+		nat.dnatRule(floating, fixed),
+		nat.snatSourceRule(hostNet(fixed), floating),
+	}, nil
+}
+
 // GetNamespace returns the namespace for a router.
 func (d *DVR) GetNamespace(routerID string) (*RouterNamespace, bool) {
 	d.nsMu.RLock()
@@ -545,11 +1016,20 @@ func (d *DVR) Stop() error {
 	d.wg.Wait()
 
 	// Clean up namespaces
-	d.nsMu.Lock()
-	for routerID := range d.namespaces {
-		d.deleteNamespace(routerID)
+	for _, ns := range d.ListNamespaces() {
+		d.deleteNamespace(ns.RouterID)
 	}
-	d.nsMu.Unlock()
 
 	return nil
 }
+
+// prefixLength returns the prefix length of a CIDR, or a host prefix if it
+// cannot be parsed.
+func prefixLength(cidr string) int {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 32
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
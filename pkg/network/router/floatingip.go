@@ -0,0 +1,234 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+// followedFloatingIP is a floating IP the DVR NATs on this node.
+type followedFloatingIP struct {
+	fip      *network.FloatingIP
+	subnetID string // Of its port, once looked up
+
+	// Where its NAT is programmed, if it is
+	routerID   string
+	floatingIP string
+	fixedIP    string
+}
+
+// loadFloatingIPs loads all floating IPs from etcd and NATs those whose
+// router is plugged here.
+func (d *DVR) loadFloatingIPs() error {
+	ctx, cancel := context.WithTimeout(d.ctx, 10*time.Second)
+	defer cancel()
+
+	kvs, err := d.etcdClient.GetWithPrefixKV(ctx, floatingIPKeyPrefix)
+	if err != nil {
+		return err
+	}
+
+	d.fipMu.Lock()
+	for _, kv := range kvs {
+		var fip network.FloatingIP
+		if err := json.Unmarshal([]byte(kv.Value), &fip); err != nil {
+			d.logger.Warn("failed to unmarshal floating IP", zap.Error(err))
+			continue
+		}
+		d.floatingIPs[fip.ID] = &followedFloatingIP{fip: &fip}
+	}
+	d.fipMu.Unlock()
+
+	d.syncFloatingIPs()
+
+	d.logger.Info("loaded floating IPs", zap.Int("count", len(kvs)))
+	return nil
+}
+
+// watchFloatingIPs watches for floating IP changes in etcd.
+func (d *DVR) watchFloatingIPs() {
+	defer d.wg.Done()
+
+	watchCh := d.etcdClient.WatchPrefixEvents(d.ctx, floatingIPKeyPrefix)
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case event, ok := <-watchCh:
+			if !ok {
+				d.logger.Warn("floating IP watch channel closed, reconnecting...")
+				time.Sleep(time.Second)
+				watchCh = d.etcdClient.WatchPrefixEvents(d.ctx, floatingIPKeyPrefix)
+				continue
+			}
+
+			d.handleFloatingIPEvent(event)
+		}
+	}
+}
+
+// handleFloatingIPEvent processes a floating IP change event.
+func (d *DVR) handleFloatingIPEvent(event etcd.WatchEvent) {
+	fipID := event.Key[len(floatingIPKeyPrefix):]
+
+	d.fipMu.Lock()
+	defer d.fipMu.Unlock()
+
+	followed := d.floatingIPs[fipID]
+	switch event.Type {
+	case etcd.EventTypePut:
+		var fip network.FloatingIP
+		if err := json.Unmarshal([]byte(event.Value), &fip); err != nil {
+			d.logger.Warn("failed to unmarshal floating IP event", zap.Error(err))
+			return
+		}
+		if followed == nil {
+			followed = &followedFloatingIP{}
+			d.floatingIPs[fipID] = followed
+		}
+		if followed.fip == nil || followed.fip.PortID != fip.PortID {
+			followed.subnetID = ""
+		}
+		followed.fip = &fip
+
+	case etcd.EventTypeDelete:
+		if followed == nil {
+			return
+		}
+		followed.fip = nil
+	}
+
+	d.syncFloatingIP(fipID, followed)
+}
+
+// syncFloatingIPs brings the NAT of every followed floating IP in line with
+// the routers plugged here, after a router or interface changed.
+func (d *DVR) syncFloatingIPs() {
+	d.fipMu.Lock()
+	defer d.fipMu.Unlock()
+
+	for fipID, followed := range d.floatingIPs {
+		d.syncFloatingIP(fipID, followed)
+	}
+}
+
+// syncFloatingIP NATs a floating IP in the namespace of its router, if that
+// router's gateway is plugged here, moving or removing the NAT programmed
+// for an earlier state. fipMu must be held.
+func (d *DVR) syncFloatingIP(fipID string, followed *followedFloatingIP) {
+	fip := followed.fip
+
+	var routerID string
+	if fip != nil && fip.PortID != "" && fip.FixedIP != "" {
+		routerID = d.floatingIPRouter(followed)
+	}
+	if followed.routerID != "" {
+		if routerID == followed.routerID && fip.FloatingIP == followed.floatingIP && fip.FixedIP == followed.fixedIP {
+			return
+		}
+		// The namespace may be gone with its rules
+		if err := d.RemoveDNAT(d.ctx, followed.routerID, followed.floatingIP, followed.fixedIP); err != nil {
+			d.logger.Debug("failed to remove floating IP NAT",
+				zap.String("fip_id", fipID),
+				zap.String("router_id", followed.routerID),
+				zap.Error(err),
+			)
+		}
+		followed.routerID = ""
+	}
+
+	if fip == nil {
+		delete(d.floatingIPs, fipID)
+		return
+	}
+	if routerID == "" {
+		return
+	}
+	if err := d.SetupDNAT(d.ctx, routerID, fip.FloatingIP, fip.FixedIP); err != nil {
+		d.logger.Error("failed to program floating IP NAT",
+			zap.String("fip_id", fipID),
+			zap.String("router_id", routerID),
+			zap.Error(err),
+		)
+		return
+	}
+	followed.routerID = routerID
+	followed.floatingIP = fip.FloatingIP
+	followed.fixedIP = fip.FixedIP
+}
+
+// floatingIPRouter returns the router a floating IP is NATed in on this
+// node: the one attached to the subnet of its port whose gateway on the
+// floating IP's network is plugged here, or "" if there is none.
+func (d *DVR) floatingIPRouter(followed *followedFloatingIP) string {
+	if followed.subnetID == "" {
+		subnetID, err := d.portSubnet(followed.fip.PortID)
+		if err != nil {
+			d.logger.Warn("failed to look up floating IP port",
+				zap.String("fip_id", followed.fip.ID),
+				zap.String("port_id", followed.fip.PortID),
+				zap.Error(err),
+			)
+			return ""
+		}
+		followed.subnetID = subnetID
+	}
+
+	routerIDs := d.SubnetRouters(followed.subnetID)
+
+	d.nsMu.RLock()
+	defer d.nsMu.RUnlock()
+	for _, routerID := range routerIDs {
+		ns, exists := d.namespaces[routerID]
+		if exists && ns.Gateway != nil && ns.Gateway.NetworkID == followed.fip.FloatingNetworkID {
+			return routerID
+		}
+	}
+	return ""
+}
+
+// portSubnet returns the subnet of a port.
+func (d *DVR) portSubnet(portID string) (string, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, 5*time.Second)
+	defer cancel()
+
+	value, err := d.etcdClient.Get(ctx, portKeyPrefix+portID)
+	if err != nil {
+		return "", err
+	}
+	var port network.Port
+	if err := json.Unmarshal([]byte(value), &port); err != nil {
+		return "", fmt.Errorf("failed to unmarshal port: %w", err)
+	}
+	return port.SubnetID, nil
+}
+
+// ServesAddress reports whether a router namespace on this node answers for
+// an external address: the IP of a plugged gateway, or a floating IP NATed
+// behind one.
+func (d *DVR) ServesAddress(address string) bool {
+	d.nsMu.RLock()
+	defer d.nsMu.RUnlock()
+
+	for _, ns := range d.namespaces {
+		if ns.Gateway == nil {
+			continue
+		}
+		if ns.floatingIPs[address] {
+			return true
+		}
+		for _, fixed := range ns.Gateway.ExternalFixedIPs {
+			if fixed.IPAddress == address {
+				return true
+			}
+		}
+	}
+	return false
+}
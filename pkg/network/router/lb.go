@@ -0,0 +1,490 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+	"hypervisor/pkg/network/cgo"
+)
+
+const (
+	loadBalancerKeyPrefix = "/hypervisor/network/loadbalancers/"
+	portKeyPrefix         = "/hypervisor/network/ports/"
+)
+
+// PortBinder binds a port to a device plugged into the integration bridge
+// of this node.
+type PortBinder func(ctx context.Context, portID, deviceName string) error
+
+// LoadBalancerManager serves the load balancers placed on this node. Each
+// gets a namespace whose interface holds the VIP on the integration bridge,
+// with a default route through the router of the VIP subnet, and a haproxy
+// in TCP mode inside it forwarding each listener's connections to its pool.
+// Members see connections coming from the VIP, so their replies return to
+// the namespace whichever subnet of the router they are on.
+type LoadBalancerManager struct {
+	config     *network.NetworkConfig
+	logger     *zap.Logger
+	etcdClient *etcd.Client
+	nodeID     string
+	ovs        *cgo.OVSBridge
+	bindPort   PortBinder
+
+	mu     sync.Mutex
+	served map[string]*servedLB // By load balancer ID
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// servedLB is a load balancer served on this node.
+type servedLB struct {
+	lb       *network.LoadBalancer
+	ns       *namespace
+	hostVeth string
+	config   string // Of the running haproxy
+	err      error  // Of the last apply
+}
+
+// NewLoadBalancerManager creates a manager for the load balancers placed on
+// a node.
+func NewLoadBalancerManager(
+	config *network.NetworkConfig,
+	etcdClient *etcd.Client,
+	nodeID string,
+	logger *zap.Logger,
+) *LoadBalancerManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &LoadBalancerManager{
+		config:     config,
+		logger:     logger,
+		etcdClient: etcdClient,
+		nodeID:     nodeID,
+		ovs:        cgo.NewOVSBridge(config.OVSBridge),
+		served:     make(map[string]*servedLB),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// SetPortBinder sets how VIP ports are bound to the interfaces plugged for
+// them. Without one, VIP ports are left unbound and get no flows.
+func (m *LoadBalancerManager) SetPortBinder(binder PortBinder) {
+	m.bindPort = binder
+}
+
+// Start serves the load balancers placed on this node and follows changes
+// to them until Stop.
+func (m *LoadBalancerManager) Start() error {
+	rev, err := m.resync()
+	if err != nil {
+		return fmt.Errorf("failed to load load balancers: %w", err)
+	}
+
+	m.wg.Add(1)
+	go m.watch(rev)
+
+	m.logger.Info("load balancer manager started")
+	return nil
+}
+
+// Stop stops following load balancers. Those served keep running, so that
+// restarting the agent does not interrupt them.
+func (m *LoadBalancerManager) Stop() error {
+	m.cancel()
+	m.wg.Wait()
+	return nil
+}
+
+// resync applies every load balancer and tears down those no longer placed
+// here. It returns the revision it read at.
+func (m *LoadBalancerManager) resync() (int64, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, 10*time.Second)
+	defer cancel()
+
+	kvs, rev, err := m.etcdClient.GetWithPrefixRevision(ctx, loadBalancerKeyPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	present := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		present[strings.TrimPrefix(kv.Key, loadBalancerKeyPrefix)] = true
+		m.handleEvent(etcd.WatchEvent{Type: etcd.EventTypePut, Key: kv.Key, Value: kv.Value})
+	}
+
+	m.mu.Lock()
+	var gone []string
+	for id := range m.served {
+		if !present[id] {
+			gone = append(gone, id)
+		}
+	}
+	m.mu.Unlock()
+	for _, id := range gone {
+		m.teardown(id)
+	}
+	return rev, nil
+}
+
+// watch applies load balancer changes, listing them again whenever the
+// watch ends so that no change is missed.
+func (m *LoadBalancerManager) watch(rev int64) {
+	defer m.wg.Done()
+
+	for {
+		watchCtx := clientv3.WithRequireLeader(m.ctx)
+		for event := range m.etcdClient.WatchPrefixEvents(watchCtx, loadBalancerKeyPrefix, clientv3.WithRev(rev+1)) {
+			m.handleEvent(event)
+		}
+
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			m.logger.Warn("load balancer watch ended, resyncing")
+
+			var err error
+			if rev, err = m.resync(); err == nil {
+				break
+			}
+			m.logger.Warn("failed to list load balancers", zap.Error(err))
+		}
+	}
+}
+
+// handleEvent serves a load balancer placed on this node, and tears down
+// one that was deleted or placed elsewhere.
+func (m *LoadBalancerManager) handleEvent(event etcd.WatchEvent) {
+	lbID := strings.TrimPrefix(event.Key, loadBalancerKeyPrefix)
+
+	var lb network.LoadBalancer
+	if event.Type == etcd.EventTypePut {
+		if err := json.Unmarshal([]byte(event.Value), &lb); err != nil {
+			m.logger.Warn("failed to unmarshal load balancer event", zap.Error(err))
+			return
+		}
+	}
+	if event.Type != etcd.EventTypePut || lb.NodeID != m.nodeID {
+		m.teardown(lbID)
+		return
+	}
+
+	status := "active"
+	if err := m.apply(&lb); err != nil {
+		m.logger.Error("failed to serve load balancer",
+			zap.String("load_balancer_id", lb.ID),
+			zap.String("vip", lb.VIPAddress),
+			zap.Error(err),
+		)
+		status = "error"
+	}
+	if lb.Status != status {
+		m.reportStatus(lb.ID, status)
+	}
+}
+
+// apply plugs the VIP of a load balancer and (re)starts its haproxy when its
+// configuration changed or it is not running.
+func (m *LoadBalancerManager) apply(lb *network.LoadBalancer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	served, ok := m.served[lb.ID]
+	if ok && served.lb.VIPPortID != lb.VIPPortID {
+		m.teardownLocked(lb.ID)
+		ok = false
+	}
+	if !ok {
+		ns, err := openNamespace(fmt.Sprintf("%s-%s", m.config.LBNamespace, lb.ID[:8]))
+		if err != nil {
+			return err
+		}
+		served = &servedLB{ns: ns, hostVeth: fmt.Sprintf("qlb-%s", lb.VIPPortID[:8])}
+		m.served[lb.ID] = served
+	}
+
+	config := haproxyConfig(lb)
+	if served.err == nil && served.lb != nil && served.config == config && sameVIP(served.lb, lb) && m.running(lb.ID) {
+		served.lb = lb
+		return nil
+	}
+	served.lb = lb
+	served.err = m.serve(lb, served, config)
+	return served.err
+}
+
+// serve plugs the VIP into the namespace, binds its port and runs haproxy
+// with config. Called with mu held.
+func (m *LoadBalancerManager) serve(lb *network.LoadBalancer, served *servedLB, config string) error {
+	ctx, cancel := context.WithTimeout(m.ctx, 10*time.Second)
+	defer cancel()
+
+	var port network.Port
+	if err := m.get(ctx, portKeyPrefix+lb.VIPPortID, &port); err != nil {
+		return fmt.Errorf("failed to get VIP port %s: %w", lb.VIPPortID, err)
+	}
+	var iface network.RouterInterface
+	if err := m.get(ctx, interfaceKeyPrefix+lb.RouterID+"/"+lb.SubnetID, &iface); err != nil {
+		return fmt.Errorf("failed to get interface of router %s on subnet %s: %w", lb.RouterID, lb.SubnetID, err)
+	}
+
+	vip, err := parseIPv4(lb.VIPAddress)
+	if err != nil {
+		return err
+	}
+	nsVeth := fmt.Sprintf("qlbi-%s", lb.VIPPortID[:8])
+	if err := plugVeth(served.ns, served.hostVeth, nsVeth, vip, prefixLength(iface.CIDR), port.MACAddress, iface.MTU); err != nil {
+		return err
+	}
+	if err := m.ovs.AddPort(m.config.OVSBridge, served.hostVeth, map[string]string{
+		"external_ids:iface-id":         port.ID,
+		"external_ids:attached-mac":     port.MACAddress,
+		"external_ids:load-balancer-id": lb.ID,
+	}); err != nil {
+		return err
+	}
+	gateway, err := parseIPv4(iface.IPAddress)
+	if err != nil {
+		return err
+	}
+	if err := replaceRoute(served.ns, nil, gateway); err != nil {
+		return err
+	}
+
+	if m.bindPort != nil && (port.NodeID != m.nodeID || port.DeviceName != served.hostVeth) {
+		if err := m.bindPort(ctx, port.ID, served.hostVeth); err != nil {
+			return err
+		}
+	}
+
+	if err := m.runHAProxy(lb.ID, served.ns.name, config); err != nil {
+		return err
+	}
+	served.config = config
+
+	m.logger.Info("serving load balancer",
+		zap.String("load_balancer_id", lb.ID),
+		zap.String("vip", lb.VIPAddress),
+		zap.Int("listeners", len(lb.Listeners)),
+	)
+	return nil
+}
+
+// teardown stops serving a load balancer here.
+func (m *LoadBalancerManager) teardown(lbID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.teardownLocked(lbID)
+}
+
+// teardownLocked stops the haproxy of a load balancer and removes its VIP
+// interface and namespace. Called with mu held.
+func (m *LoadBalancerManager) teardownLocked(lbID string) {
+	served, ok := m.served[lbID]
+	if !ok {
+		return
+	}
+	delete(m.served, lbID)
+
+	m.stopHAProxy(lbID)
+	if err := m.ovs.DeletePort(m.config.OVSBridge, served.hostVeth); err != nil {
+		m.logger.Warn("failed to remove VIP interface from OVS",
+			zap.String("load_balancer_id", lbID),
+			zap.Error(err),
+		)
+	}
+	if err := removeNamespace(served.ns); err != nil {
+		m.logger.Warn("failed to delete load balancer namespace",
+			zap.String("load_balancer_id", lbID),
+			zap.Error(err),
+		)
+	}
+	if err := os.RemoveAll(m.stateDir(lbID)); err != nil {
+		m.logger.Warn("failed to remove load balancer state",
+			zap.String("load_balancer_id", lbID),
+			zap.Error(err),
+		)
+	}
+
+	m.logger.Info("stopped serving load balancer", zap.String("load_balancer_id", lbID))
+}
+
+// runHAProxy writes the configuration of a load balancer and starts its
+// haproxy in the namespace, or reloads a running one: the new process takes
+// over the listening sockets and the old one finishes its connections.
+func (m *LoadBalancerManager) runHAProxy(lbID, nsName, config string) error {
+	dir := m.stateDir(lbID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create load balancer state directory: %w", err)
+	}
+	configFile := filepath.Join(dir, "haproxy.cfg")
+	if err := os.WriteFile(configFile, []byte(config), 0o644); err != nil {
+		return fmt.Errorf("failed to write haproxy configuration: %w", err)
+	}
+
+	pidFile := filepath.Join(dir, "haproxy.pid")
+	args := []string{"netns", "exec", nsName, "haproxy", "-f", configFile, "-p", pidFile}
+	if pid := m.pid(lbID); pid > 0 {
+		args = append(args, "-sf", strconv.Itoa(pid))
+	}
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run haproxy: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// stopHAProxy stops the haproxy of a load balancer, if running.
+func (m *LoadBalancerManager) stopHAProxy(lbID string) {
+	pid := m.pid(lbID)
+	if pid <= 0 {
+		return
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+		m.logger.Warn("failed to stop haproxy",
+			zap.String("load_balancer_id", lbID),
+			zap.Int("pid", pid),
+			zap.Error(err),
+		)
+	}
+}
+
+// running reports whether the haproxy of a load balancer is running.
+func (m *LoadBalancerManager) running(lbID string) bool {
+	return m.pid(lbID) > 0
+}
+
+// pid returns the pid of the running haproxy of a load balancer, or 0.
+func (m *LoadBalancerManager) pid(lbID string) int {
+	data, err := os.ReadFile(filepath.Join(m.stateDir(lbID), "haproxy.pid"))
+	if err != nil {
+		return 0
+	}
+	// The pid file lists one pid per process; the first is the master
+	pid, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0]))
+	if err != nil || pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return 0
+	}
+	return pid
+}
+
+func (m *LoadBalancerManager) stateDir(lbID string) string {
+	return filepath.Join(m.config.LBStateDir, lbID)
+}
+
+// get reads an object from etcd into v.
+func (m *LoadBalancerManager) get(ctx context.Context, key string, v any) error {
+	value, err := m.etcdClient.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(value), v)
+}
+
+// reportStatus records the status of a load balancer served here.
+func (m *LoadBalancerManager) reportStatus(lbID, status string) {
+	ctx, cancel := context.WithTimeout(m.ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.etcdClient.Modify(ctx, loadBalancerKeyPrefix+lbID, func(value string) (string, error) {
+		var lb network.LoadBalancer
+		if err := json.Unmarshal([]byte(value), &lb); err != nil {
+			return "", fmt.Errorf("failed to unmarshal load balancer: %w", err)
+		}
+		if lb.NodeID != m.nodeID {
+			return value, nil
+		}
+		lb.Status = status
+
+		data, err := json.Marshal(&lb)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal load balancer: %w", err)
+		}
+		return string(data), nil
+	})
+	if err != nil && !errors.Is(err, etcd.ErrKeyNotFound) {
+		m.logger.Warn("failed to report load balancer status",
+			zap.String("load_balancer_id", lbID),
+			zap.String("status", status),
+			zap.Error(err),
+		)
+	}
+}
+
+// sameVIP reports whether two versions of a load balancer plug the same
+// VIP.
+func sameVIP(a, b *network.LoadBalancer) bool {
+	return a.VIPPortID == b.VIPPortID &&
+		a.VIPAddress == b.VIPAddress &&
+		a.SubnetID == b.SubnetID &&
+		a.RouterID == b.RouterID
+}
+
+// haproxyBalance maps pool algorithms to haproxy balance algorithms.
+var haproxyBalance = map[network.LBAlgorithm]string{
+	network.LBRoundRobin:       "roundrobin",
+	network.LBLeastConnections: "leastconn",
+	network.LBSourceIP:         "source",
+}
+
+// haproxyConfig renders the haproxy configuration of a load balancer: one
+// TCP proxy per listener, checking members if its pool has a health
+// monitor.
+func haproxyConfig(lb *network.LoadBalancer) string {
+	var b strings.Builder
+	b.WriteString("global\n")
+	b.WriteString("    daemon\n")
+	b.WriteString("    maxconn 4096\n")
+	b.WriteString("\n")
+	b.WriteString("defaults\n")
+	b.WriteString("    mode tcp\n")
+	b.WriteString("    timeout connect 5s\n")
+	b.WriteString("    timeout client 1h\n")
+	b.WriteString("    timeout server 1h\n")
+
+	for _, listener := range lb.Listeners {
+		pool := listener.Pool
+		fmt.Fprintf(&b, "\nlisten %s\n", listener.ID)
+		fmt.Fprintf(&b, "    bind %s\n", net.JoinHostPort(lb.VIPAddress, strconv.Itoa(int(listener.Port))))
+		balance, ok := haproxyBalance[pool.Algorithm]
+		if !ok {
+			balance = "roundrobin"
+		}
+		fmt.Fprintf(&b, "    balance %s\n", balance)
+
+		check := ""
+		if monitor := pool.HealthMonitor; monitor != nil {
+			fmt.Fprintf(&b, "    timeout check %ds\n", monitor.Timeout)
+			check = fmt.Sprintf(" check inter %ds fall %d rise 1", monitor.Interval, monitor.MaxRetries)
+		}
+		for i, member := range pool.Members {
+			weight := member.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			fmt.Fprintf(&b, "    server member%d %s weight %d%s\n",
+				i, net.JoinHostPort(member.Address, strconv.Itoa(int(member.Port))), weight, check)
+		}
+	}
+	return b.String()
+}
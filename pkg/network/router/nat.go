@@ -0,0 +1,219 @@
+package router
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// natTableName is the nftables table holding a router's NAT rules.
+const natTableName = "hypervisor-dvr"
+
+// natRule is a NAT rule identified by a key stored in its comment, which
+// describes everything the rule matches and rewrites to. Applying a rule whose
+// key is already present is a no-op, so rules can be re-applied after an
+// agent restart without duplicating them.
+type natRule struct {
+	key   string
+	chain *nftables.Chain
+	exprs []expr.Any
+}
+
+// natTable manages the NAT rules of one router namespace over netlink.
+type natTable struct {
+	conn        *nftables.Conn
+	table       *nftables.Table
+	prerouting  *nftables.Chain
+	postrouting *nftables.Chain
+}
+
+// openNATTable ensures the router's NAT table and its base chains exist in
+// the namespace.
+func openNATTable(ns *namespace) (*natTable, error) {
+	conn, err := nftables.New(nftables.WithNetNSFd(int(ns.fd)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	t := &natTable{conn: conn}
+	t.table = conn.AddTable(&nftables.Table{
+		Name:   natTableName,
+		Family: nftables.TableFamilyIPv4,
+	})
+	t.prerouting = conn.AddChain(&nftables.Chain{
+		Name:     "prerouting",
+		Table:    t.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+	t.postrouting = conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    t.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to create NAT table: %w", err)
+	}
+	return t, nil
+}
+
+// add installs rules that are not already present.
+func (t *natTable) add(rules ...natRule) error {
+	for _, rule := range rules {
+		existing, err := t.find(rule)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		t.conn.AddRule(&nftables.Rule{
+			Table:    t.table,
+			Chain:    rule.chain,
+			Exprs:    rule.exprs,
+			UserData: userdata.AppendString(nil, userdata.TypeComment, rule.key),
+		})
+	}
+	if err := t.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add NAT rules: %w", err)
+	}
+	return nil
+}
+
+// remove deletes rules. Rules that are not present are ignored.
+func (t *natTable) remove(rules ...natRule) error {
+	for _, rule := range rules {
+		existing, err := t.find(rule)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			continue
+		}
+		if err := t.conn.DelRule(existing); err != nil {
+			return fmt.Errorf("failed to delete NAT rule %q: %w", rule.key, err)
+		}
+	}
+	if err := t.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete NAT rules: %w", err)
+	}
+	return nil
+}
+
+// find returns the installed rule with the same key, if any.
+func (t *natTable) find(rule natRule) (*nftables.Rule, error) {
+	installed, err := t.conn.GetRules(t.table, rule.chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NAT rules: %w", err)
+	}
+	for _, r := range installed {
+		if key, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok && key == rule.key {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// snatOutRule rewrites the source of traffic leaving through an interface.
+func (t *natTable) snatOutRule(ifName string, to net.IP) natRule {
+	return natRule{
+		key:   fmt.Sprintf("snat oif %s to %s", ifName, to),
+		chain: t.postrouting,
+		exprs: append([]expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifNameData(ifName)},
+		}, natTo(expr.NATTypeSourceNAT, to)...),
+	}
+}
+
+// snatSourceRule rewrites the source of traffic from a subnet or host.
+func (t *natTable) snatSourceRule(src *net.IPNet, to net.IP) natRule {
+	return natRule{
+		key:   fmt.Sprintf("snat saddr %s to %s", src, to),
+		chain: t.postrouting,
+		exprs: append(matchIPv4(12, src), natTo(expr.NATTypeSourceNAT, to)...),
+	}
+}
+
+// dnatRule rewrites the destination of traffic to an address.
+func (t *natTable) dnatRule(dst net.IP, to net.IP) natRule {
+	return natRule{
+		key:   fmt.Sprintf("dnat daddr %s to %s", dst, to),
+		chain: t.prerouting,
+		exprs: append(matchIPv4(16, hostNet(dst)), natTo(expr.NATTypeDestNAT, to)...),
+	}
+}
+
+// matchIPv4 matches the IPv4 header address at offset (12 for the source, 16
+// for the destination) against a network.
+func matchIPv4(offset uint32, ipNet *net.IPNet) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          4,
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           []byte(ipNet.Mask),
+			Xor:            make([]byte, 4),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ipNet.IP.Mask(ipNet.Mask).To4()},
+	}
+}
+
+func natTo(typ expr.NATType, to net.IP) []expr.Any {
+	return []expr.Any{
+		&expr.Immediate{Register: 1, Data: to.To4()},
+		&expr.NAT{
+			Type:       typ,
+			Family:     unix.NFPROTO_IPV4,
+			RegAddrMin: 1,
+			RegAddrMax: 1,
+			Specified:  true,
+		},
+	}
+}
+
+// ifNameData encodes an interface name the way the kernel compares it.
+func ifNameData(name string) []byte {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return data
+}
+
+// parseIPv4 parses an IPv4 address.
+func parseIPv4(s string) (net.IP, error) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %q", s)
+	}
+	return ip, nil
+}
+
+// parseIPv4Net parses an IPv4 CIDR, or a single address as a host network.
+func parseIPv4Net(s string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(s); err == nil && ipNet.IP.To4() != nil {
+		ipNet.IP = ipNet.IP.To4()
+		return ipNet, nil
+	}
+	ip, err := parseIPv4(s)
+	if err != nil {
+		return nil, err
+	}
+	return hostNet(ip), nil
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+}
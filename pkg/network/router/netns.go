@@ -0,0 +1,293 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// namespace is an open handle to a router's network namespace.
+type namespace struct {
+	name string
+	fd   netns.NsHandle
+	nl   *netlink.Handle // Netlink socket inside the namespace
+}
+
+// openNamespace opens a named network namespace, creating it if it does not
+// exist, with loopback up and IPv4 forwarding enabled. Namespaces left behind
+// by a previous run are reused.
+func openNamespace(name string) (*namespace, error) {
+	fd, err := netns.GetFromName(name)
+	if errors.Is(err, os.ErrNotExist) {
+		fd, err = createNamespace(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open namespace %s: %w", name, err)
+	}
+
+	nl, err := netlink.NewHandleAt(fd)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("failed to open netlink handle in namespace %s: %w", name, err)
+	}
+	ns := &namespace{name: name, fd: fd, nl: nl}
+
+	lo, err := nl.LinkByName("lo")
+	if err == nil {
+		err = nl.LinkSetUp(lo)
+	}
+	if err != nil {
+		ns.close()
+		return nil, fmt.Errorf("failed to bring up loopback: %w", err)
+	}
+
+	if err := ns.do(func() error {
+		return os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0o644)
+	}); err != nil {
+		ns.close()
+		return nil, fmt.Errorf("failed to enable IP forwarding: %w", err)
+	}
+	return ns, nil
+}
+
+// createNamespace creates a named network namespace visible to `ip netns`.
+// netns.NewNamed switches the calling thread into the new namespace, so the
+// thread is locked and switched back before it is released.
+func createNamespace(name string) (netns.NsHandle, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		return netns.None(), err
+	}
+	defer origin.Close()
+
+	fd, err := netns.NewNamed(name)
+	if restoreErr := netns.Set(origin); restoreErr != nil {
+		// Never hand a thread in the wrong namespace back to the runtime
+		panic(fmt.Sprintf("failed to restore network namespace: %v", restoreErr))
+	}
+	return fd, err
+}
+
+// do runs fn on a thread switched into the namespace, for operations such as
+// sysctl writes that have no netlink equivalent.
+func (ns *namespace) do(fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer origin.Close()
+
+	if err := netns.Set(ns.fd); err != nil {
+		return err
+	}
+	fnErr := fn()
+	if err := netns.Set(origin); err != nil {
+		panic(fmt.Sprintf("failed to restore network namespace: %v", err))
+	}
+	return fnErr
+}
+
+// close releases the namespace handles without deleting the namespace.
+func (ns *namespace) close() {
+	ns.nl.Close()
+	ns.fd.Close()
+}
+
+// removeNamespace closes and removes a named network namespace. Links inside
+// it are destroyed with it, which also deletes the host end of their veths.
+func removeNamespace(ns *namespace) error {
+	ns.close()
+	if err := netns.DeleteNamed(ns.name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete namespace %s: %w", ns.name, err)
+	}
+	return nil
+}
+
+// plugVeth connects a namespace to the host with a veth pair and configures
+// the namespace end with an address and optional MAC, and both ends with the
+// MTU of the network unless it is zero. It is idempotent: an existing pair is
+// reconfigured, and a host end whose peer was lost is replaced.
+func plugVeth(ns *namespace, hostName, nsName string, ip net.IP, prefixLen int, mac string, mtu uint16) error {
+	link, err := ns.nl.LinkByName(nsName)
+	if err != nil {
+		if !isLinkNotFound(err) {
+			return fmt.Errorf("failed to look up %s: %w", nsName, err)
+		}
+		if link, err = createVeth(ns, hostName, nsName); err != nil {
+			return err
+		}
+	}
+
+	if mac != "" {
+		hwAddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return fmt.Errorf("invalid MAC address %q: %w", mac, err)
+		}
+		if link.Attrs().HardwareAddr.String() != hwAddr.String() {
+			if err := ns.nl.LinkSetHardwareAddr(link, hwAddr); err != nil {
+				return fmt.Errorf("failed to set MAC address of %s: %w", nsName, err)
+			}
+		}
+	}
+
+	if mtu != 0 && link.Attrs().MTU != int(mtu) {
+		if err := ns.nl.LinkSetMTU(link, int(mtu)); err != nil {
+			return fmt.Errorf("failed to set MTU of %s: %w", nsName, err)
+		}
+	}
+
+	if err := setAddress(ns, link, ip, prefixLen); err != nil {
+		return err
+	}
+	if err := ns.nl.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", nsName, err)
+	}
+
+	host, err := netlink.LinkByName(hostName)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %w", hostName, err)
+	}
+	if mtu != 0 && host.Attrs().MTU != int(mtu) {
+		if err := netlink.LinkSetMTU(host, int(mtu)); err != nil {
+			return fmt.Errorf("failed to set MTU of %s: %w", hostName, err)
+		}
+	}
+	if err := netlink.LinkSetUp(host); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", hostName, err)
+	}
+	return nil
+}
+
+// createVeth creates a veth pair on the host and moves one end into the
+// namespace, returning that end.
+func createVeth(ns *namespace, hostName, nsName string) (netlink.Link, error) {
+	// A host end without its peer is left over from an interrupted plug
+	if err := deleteLink(hostName); err != nil {
+		return nil, err
+	}
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: hostName},
+		PeerName:  nsName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, fmt.Errorf("failed to create veth pair %s/%s: %w", hostName, nsName, err)
+	}
+
+	peer, err := netlink.LinkByName(nsName)
+	if err == nil {
+		err = netlink.LinkSetNsFd(peer, int(ns.fd))
+	}
+	if err != nil {
+		netlink.LinkDel(veth)
+		return nil, fmt.Errorf("failed to move %s to namespace %s: %w", nsName, ns.name, err)
+	}
+
+	link, err := ns.nl.LinkByName(nsName)
+	if err != nil {
+		netlink.LinkDel(veth)
+		return nil, fmt.Errorf("failed to look up %s in namespace %s: %w", nsName, ns.name, err)
+	}
+	return link, nil
+}
+
+// setAddress makes ip/prefixLen the only IPv4 address of a link in the
+// namespace, so re-addressing never leaves the link without one.
+func setAddress(ns *namespace, link netlink.Link, ip net.IP, prefixLen int) error {
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLen, 32)}}
+	if err := ns.nl.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("failed to set address %s on %s: %w", addr.IPNet, link.Attrs().Name, err)
+	}
+
+	addrs, err := ns.nl.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %s: %w", link.Attrs().Name, err)
+	}
+	for _, existing := range addrs {
+		if existing.IPNet.String() == addr.IPNet.String() {
+			continue
+		}
+		if err := ns.nl.AddrDel(link, &existing); err != nil {
+			return fmt.Errorf("failed to remove address %s from %s: %w", existing.IPNet, link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// readdress changes the prefix length of a link's address in the namespace.
+func readdress(ns *namespace, name string, ip net.IP, prefixLen int) error {
+	link, err := ns.nl.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %w", name, err)
+	}
+	return setAddress(ns, link, ip, prefixLen)
+}
+
+// deleteLink deletes a host link, and with it the peer of a veth. A missing
+// link is not an error.
+func deleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if isLinkNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to look up %s: %w", name, err)
+	}
+	if err := netlink.LinkDel(link); err != nil && !errors.Is(err, unix.ENODEV) {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+// replaceRoute adds or updates a route in the namespace. A nil destination
+// is the default route.
+func replaceRoute(ns *namespace, dst *net.IPNet, gw net.IP) error {
+	route := &netlink.Route{Dst: dst, Gw: gw}
+	if err := ns.nl.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to set route to %s via %s: %w", routeDst(dst), gw, err)
+	}
+	return nil
+}
+
+// replaceLinkRoute adds or updates a route in the namespace straight out of
+// a link, for point-to-point links such as tunnels.
+func replaceLinkRoute(ns *namespace, dst *net.IPNet, link netlink.Link) error {
+	route := &netlink.Route{Dst: dst, LinkIndex: link.Attrs().Index, Scope: netlink.SCOPE_LINK}
+	if err := ns.nl.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to set route to %s via %s: %w", routeDst(dst), link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// deleteRoute removes a route from the namespace. A missing route is not an
+// error.
+func deleteRoute(ns *namespace, dst *net.IPNet) error {
+	if err := ns.nl.RouteDel(&netlink.Route{Dst: dst}); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to delete route to %s: %w", routeDst(dst), err)
+	}
+	return nil
+}
+
+func routeDst(dst *net.IPNet) string {
+	if dst == nil {
+		return "default"
+	}
+	return dst.String()
+}
+
+func isLinkNotFound(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound)
+}
@@ -0,0 +1,515 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+const (
+	vpnKeyPrefix        = "/hypervisor/network/vpns/"
+	vpnPrivateKeyPrefix = "/hypervisor/network/vpn-keys/"
+	vpnStatusKeyPrefix  = "/hypervisor/network/vpn-status/"
+)
+
+// vpnStatusInterval is how often the tunnels of the VPN services served
+// here are reported, and services that failed to apply are retried.
+const vpnStatusInterval = 30 * time.Second
+
+// wireguardSessionLifetime is how long WireGuard keeps a session after a
+// handshake; a peer without a newer handshake is disconnected.
+const wireguardSessionLifetime = 180 * time.Second
+
+// VPNManager serves the VPN services placed on this node. Each gets a
+// WireGuard interface in its router's namespace, listening on the router's
+// external gateway, with the peers' CIDRs routed into it. Traffic to the
+// peers leaves through the tunnel rather than the gateway, so it is not
+// masqueraded.
+type VPNManager struct {
+	config     *network.NetworkConfig
+	logger     *zap.Logger
+	etcdClient *etcd.Client
+	nodeID     string
+	dvr        *DVR
+
+	mu     sync.Mutex
+	served map[string]*servedVPN // By VPN service ID
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// servedVPN is a VPN service served on this node.
+type servedVPN struct {
+	vpn    *network.VPNService
+	ns     *namespace // Of the router
+	link   string
+	config string   // Applied to the interface
+	routes []string // CIDRs routed into the interface
+	err    error    // Of the last apply
+}
+
+// NewVPNManager creates a manager for the VPN services placed on a node,
+// whose tunnels are set up in the router namespaces of dvr.
+func NewVPNManager(
+	config *network.NetworkConfig,
+	etcdClient *etcd.Client,
+	dvr *DVR,
+	nodeID string,
+	logger *zap.Logger,
+) *VPNManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &VPNManager{
+		config:     config,
+		logger:     logger,
+		etcdClient: etcdClient,
+		nodeID:     nodeID,
+		dvr:        dvr,
+		served:     make(map[string]*servedVPN),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Start serves the VPN services placed on this node and follows changes to
+// them until Stop. The DVR must have been started, so that the router
+// namespaces exist.
+func (m *VPNManager) Start() error {
+	rev, err := m.resync()
+	if err != nil {
+		return fmt.Errorf("failed to load VPN services: %w", err)
+	}
+
+	m.wg.Add(2)
+	go m.watch(rev)
+	go m.reportLoop()
+
+	m.logger.Info("VPN manager started")
+	return nil
+}
+
+// Stop stops following VPN services. Their tunnels stay up for as long as
+// the router namespaces do.
+func (m *VPNManager) Stop() error {
+	m.cancel()
+	m.wg.Wait()
+	return nil
+}
+
+// resync applies every VPN service and tears down those no longer placed
+// here. It returns the revision it read at.
+func (m *VPNManager) resync() (int64, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, 10*time.Second)
+	defer cancel()
+
+	kvs, rev, err := m.etcdClient.GetWithPrefixRevision(ctx, vpnKeyPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	present := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		present[strings.TrimPrefix(kv.Key, vpnKeyPrefix)] = true
+		m.handleEvent(etcd.WatchEvent{Type: etcd.EventTypePut, Key: kv.Key, Value: kv.Value})
+	}
+
+	m.mu.Lock()
+	var gone []string
+	for id := range m.served {
+		if !present[id] {
+			gone = append(gone, id)
+		}
+	}
+	m.mu.Unlock()
+	for _, id := range gone {
+		m.teardown(id)
+	}
+	return rev, nil
+}
+
+// watch applies VPN service changes, listing them again whenever the watch
+// ends so that no change is missed.
+func (m *VPNManager) watch(rev int64) {
+	defer m.wg.Done()
+
+	for {
+		watchCtx := clientv3.WithRequireLeader(m.ctx)
+		for event := range m.etcdClient.WatchPrefixEvents(watchCtx, vpnKeyPrefix, clientv3.WithRev(rev+1)) {
+			m.handleEvent(event)
+		}
+
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			m.logger.Warn("VPN service watch ended, resyncing")
+
+			var err error
+			if rev, err = m.resync(); err == nil {
+				break
+			}
+			m.logger.Warn("failed to list VPN services", zap.Error(err))
+		}
+	}
+}
+
+// handleEvent serves a VPN service placed on this node, and tears down one
+// that was deleted or placed elsewhere.
+func (m *VPNManager) handleEvent(event etcd.WatchEvent) {
+	vpnID := strings.TrimPrefix(event.Key, vpnKeyPrefix)
+
+	var vpn network.VPNService
+	if event.Type == etcd.EventTypePut {
+		if err := json.Unmarshal([]byte(event.Value), &vpn); err != nil {
+			m.logger.Warn("failed to unmarshal VPN service event", zap.Error(err))
+			return
+		}
+	}
+	if event.Type != etcd.EventTypePut || vpn.NodeID != m.nodeID {
+		m.teardown(vpnID)
+		return
+	}
+	m.serve(&vpn)
+}
+
+// serve applies a VPN service and reports whether it is active.
+func (m *VPNManager) serve(vpn *network.VPNService) {
+	status := "active"
+	if err := m.apply(vpn); err != nil {
+		m.logger.Error("failed to serve VPN service",
+			zap.String("vpn_id", vpn.ID),
+			zap.String("router_id", vpn.RouterID),
+			zap.Error(err),
+		)
+		status = "error"
+	}
+	if vpn.Status != status {
+		m.reportStatus(vpn.ID, status)
+	}
+}
+
+// apply sets up the WireGuard interface of a VPN service in its router's
+// namespace and routes the peers' CIDRs into it, when its configuration
+// changed or the interface is missing.
+func (m *VPNManager) apply(vpn *network.VPNService) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	served, ok := m.served[vpn.ID]
+	if !ok {
+		served = &servedVPN{link: fmt.Sprintf("wg-%s", vpn.ID[:8])}
+		m.served[vpn.ID] = served
+	}
+	served.vpn = vpn
+
+	routerNS, ok := m.dvr.GetNamespace(vpn.RouterID)
+	if !ok {
+		served.err = fmt.Errorf("namespace of router %s is not set up on this node", vpn.RouterID)
+		return served.err
+	}
+	if served.ns != routerNS.ns {
+		// The router's namespace was recreated, without the interface
+		served.ns = routerNS.ns
+		served.config = ""
+		served.routes = nil
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, 10*time.Second)
+	defer cancel()
+	sealed, err := m.etcdClient.Get(ctx, vpnPrivateKeyPrefix+vpn.ID)
+	if err != nil {
+		served.err = fmt.Errorf("failed to get private key: %w", err)
+		return served.err
+	}
+	privateKey, err := m.etcdClient.OpenSecret(sealed)
+	if err != nil {
+		served.err = fmt.Errorf("failed to open private key: %w", err)
+		return served.err
+	}
+
+	config := wireguardConfig(vpn, privateKey)
+	if _, err := served.ns.nl.LinkByName(served.link); err == nil && served.err == nil && served.config == config {
+		return nil
+	}
+	served.err = m.setup(served, config)
+	return served.err
+}
+
+// setup creates the WireGuard interface of a served VPN service if needed,
+// configures it and replaces the routes into it. Called with mu held.
+func (m *VPNManager) setup(served *servedVPN, config string) error {
+	ns := served.ns
+	link, err := ns.nl.LinkByName(served.link)
+	if err != nil {
+		if !isLinkNotFound(err) {
+			return fmt.Errorf("failed to look up %s: %w", served.link, err)
+		}
+		wg := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: served.link}}
+		if err := ns.nl.LinkAdd(wg); err != nil {
+			return fmt.Errorf("failed to create WireGuard interface %s: %w", served.link, err)
+		}
+		if link, err = ns.nl.LinkByName(served.link); err != nil {
+			return fmt.Errorf("failed to look up %s: %w", served.link, err)
+		}
+		served.routes = nil
+	}
+
+	// syncconf keeps the sessions of peers whose configuration is unchanged
+	cmd := exec.Command("ip", "netns", "exec", ns.name, "wg", "syncconf", served.link, "/dev/stdin")
+	cmd.Stdin = strings.NewReader(config)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to configure %s: %w: %s", served.link, err, strings.TrimSpace(string(out)))
+	}
+	if err := ns.nl.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", served.link, err)
+	}
+
+	var routes []string
+	for _, peer := range served.vpn.Peers {
+		routes = append(routes, peer.AllowedCIDRs...)
+	}
+	for _, cidr := range routes {
+		dst, err := parseIPv4Net(cidr)
+		if err != nil {
+			return err
+		}
+		if err := replaceLinkRoute(ns, dst, link); err != nil {
+			return err
+		}
+	}
+	for _, cidr := range served.routes {
+		if slices.Contains(routes, cidr) {
+			continue
+		}
+		if dst, err := parseIPv4Net(cidr); err == nil {
+			if err := deleteRoute(ns, dst); err != nil {
+				m.logger.Warn("failed to remove route of removed VPN peer",
+					zap.String("vpn_id", served.vpn.ID),
+					zap.String("cidr", cidr),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+	served.routes = routes
+	served.config = config
+
+	m.logger.Info("serving VPN service",
+		zap.String("vpn_id", served.vpn.ID),
+		zap.String("router_id", served.vpn.RouterID),
+		zap.String("endpoint", served.vpn.Endpoint),
+		zap.Int("peers", len(served.vpn.Peers)),
+	)
+	return nil
+}
+
+// teardown stops serving a VPN service here, deleting its interface and
+// with it the routes into the tunnel.
+func (m *VPNManager) teardown(vpnID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	served, ok := m.served[vpnID]
+	if !ok {
+		return
+	}
+	delete(m.served, vpnID)
+
+	// Without the router's namespace, the interface is gone already
+	if routerNS, ok := m.dvr.GetNamespace(served.vpn.RouterID); ok {
+		link, err := routerNS.ns.nl.LinkByName(served.link)
+		if err == nil {
+			err = routerNS.ns.nl.LinkDel(link)
+		}
+		if err != nil && !isLinkNotFound(err) {
+			m.logger.Warn("failed to delete WireGuard interface",
+				zap.String("vpn_id", vpnID),
+				zap.String("interface", served.link),
+				zap.Error(err),
+			)
+		}
+	}
+
+	m.logger.Info("stopped serving VPN service", zap.String("vpn_id", vpnID))
+}
+
+// reportLoop periodically reports the tunnels of the VPN services served
+// here, and applies again those that failed, e.g. because their router's
+// namespace was not set up yet.
+func (m *VPNManager) reportLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(vpnStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		var failed []*network.VPNService
+		var healthy []*servedVPN
+		for _, served := range m.served {
+			if served.err != nil {
+				failed = append(failed, served.vpn)
+			} else {
+				healthy = append(healthy, served)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, vpn := range failed {
+			m.serve(vpn)
+		}
+		for _, served := range healthy {
+			m.reportTunnels(served)
+		}
+	}
+}
+
+// reportTunnels records the state of a served VPN service's tunnels, as
+// WireGuard sees them.
+func (m *VPNManager) reportTunnels(served *servedVPN) {
+	m.mu.Lock()
+	vpn, nsName, link := served.vpn, served.ns.name, served.link
+	m.mu.Unlock()
+
+	out, err := exec.Command("ip", "netns", "exec", nsName, "wg", "show", link, "dump").Output()
+	if err != nil {
+		m.logger.Warn("failed to read WireGuard state",
+			zap.String("vpn_id", vpn.ID),
+			zap.String("interface", link),
+			zap.Error(err),
+		)
+		return
+	}
+
+	status := network.VPNStatus{
+		NodeID:    m.nodeID,
+		Peers:     parseWireGuardDump(vpn, string(out), time.Now()),
+		UpdatedAt: time.Now(),
+	}
+	data, err := json.Marshal(&status)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, 5*time.Second)
+	defer cancel()
+	if err := m.etcdClient.Put(ctx, vpnStatusKeyPrefix+vpn.ID, string(data)); err != nil {
+		m.logger.Warn("failed to report VPN tunnels",
+			zap.String("vpn_id", vpn.ID),
+			zap.Error(err),
+		)
+	}
+}
+
+// reportStatus records the status of a VPN service served here.
+func (m *VPNManager) reportStatus(vpnID, status string) {
+	ctx, cancel := context.WithTimeout(m.ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.etcdClient.Modify(ctx, vpnKeyPrefix+vpnID, func(value string) (string, error) {
+		var vpn network.VPNService
+		if err := json.Unmarshal([]byte(value), &vpn); err != nil {
+			return "", fmt.Errorf("failed to unmarshal VPN service: %w", err)
+		}
+		if vpn.NodeID != m.nodeID {
+			return value, nil
+		}
+		vpn.Status = status
+
+		data, err := json.Marshal(&vpn)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal VPN service: %w", err)
+		}
+		return string(data), nil
+	})
+	if err != nil && !errors.Is(err, etcd.ErrKeyNotFound) {
+		m.logger.Warn("failed to report VPN service status",
+			zap.String("vpn_id", vpnID),
+			zap.String("status", status),
+			zap.Error(err),
+		)
+	}
+}
+
+// wireguardConfig renders the configuration of a VPN service's interface in
+// the format of wg setconf.
+func wireguardConfig(vpn *network.VPNService, privateKey string) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", privateKey)
+	fmt.Fprintf(&b, "ListenPort = %d\n", vpn.ListenPort)
+
+	for _, peer := range vpn.Peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", peer.PublicKey)
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		}
+		fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(peer.AllowedCIDRs, ", "))
+		if peer.PersistentKeepalive > 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	return b.String()
+}
+
+// parseWireGuardDump extracts the state of a VPN service's peers from the
+// output of wg show dump: a line for the interface, then one per peer with
+// its public key, preshared key, endpoint, allowed IPs, latest handshake,
+// bytes received and sent, and keepalive, separated by tabs.
+func parseWireGuardDump(vpn *network.VPNService, dump string, now time.Time) []network.VPNPeerStatus {
+	byKey := make(map[string]string, len(vpn.Peers))
+	for _, peer := range vpn.Peers {
+		byKey[peer.PublicKey] = peer.ID
+	}
+
+	var peers []network.VPNPeerStatus
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	for _, line := range lines[min(1, len(lines)):] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 8 {
+			continue
+		}
+		peerID, ok := byKey[fields[0]]
+		if !ok {
+			continue
+		}
+
+		status := network.VPNPeerStatus{PeerID: peerID}
+		if fields[2] != "(none)" {
+			status.Endpoint = fields[2]
+		}
+		if handshake, err := strconv.ParseInt(fields[4], 10, 64); err == nil && handshake > 0 {
+			status.LatestHandshake = time.Unix(handshake, 0)
+			status.Connected = now.Sub(status.LatestHandshake) < wireguardSessionLifetime
+		}
+		status.RxBytes, _ = strconv.ParseUint(fields[5], 10, 64)
+		status.TxBytes, _ = strconv.ParseUint(fields[6], 10, 64)
+		peers = append(peers, status)
+	}
+	return peers
+}
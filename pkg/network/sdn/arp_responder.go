@@ -0,0 +1,128 @@
+package sdn
+
+import (
+	"fmt"
+	"net/netip"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/network"
+)
+
+// ARP responder flows answer ARP requests for a port's IP on the node the
+// request enters the overlay, with the port's MAC, instead of flooding them
+// to every VTEP of the VNI. They sit in table 21 ahead of the flood flow and
+// of the segment stitching flows, and are installed by the nodes that have
+// ports on the network for the ports bound elsewhere; requests for a local
+// port reach it over the bridge, and it stays free to answer its own
+// duplicate address probes.
+
+// arpResponderPriority places responders ahead of the table 21 flows that
+// would flood or stitch the request.
+const arpResponderPriority = 120
+
+// InstallARPResponder installs the flows answering ARP requests for a port's
+// IP on every VNI of its network, replacing those installed for an older
+// version of the port. Ports without an IP or MAC are not answered for.
+func (f *FlowManager) InstallARPResponder(port *network.Port, net *network.Network) error {
+	if f.ovsClient == nil || !f.config.ARPResponder {
+		return nil
+	}
+	if err := f.RemoveARPResponder(port.ID); err != nil {
+		return err
+	}
+	if port.IPAddress == "" || port.MACAddress == "" {
+		return nil
+	}
+
+	flows, err := arpResponderFlows(port, net)
+	if err != nil {
+		return err
+	}
+	if err := f.addFlows(port.ID, flows); err != nil {
+		f.logger.Error("failed to add ARP responder flows",
+			zap.String("port_id", port.ID),
+			zap.Error(err),
+		)
+		// Flows added before the switch rejected one share the cookie
+		if len(flows) > 0 {
+			_ = f.ovsClient.DeleteFlow(f.config.OVSBridge, flows[0].Cookie)
+		}
+		return err
+	}
+
+	f.arpFlowsMu.Lock()
+	f.arpFlows[port.ID] = flows
+	f.arpFlowsMu.Unlock()
+
+	f.logger.Debug("installed ARP responder",
+		zap.String("port_id", port.ID),
+		zap.String("ip_address", port.IPAddress),
+		zap.String("mac_address", port.MACAddress),
+	)
+	return nil
+}
+
+// RemoveARPResponder removes the flows answering ARP requests for a port.
+func (f *FlowManager) RemoveARPResponder(portID string) error {
+	f.arpFlowsMu.Lock()
+	flows, exists := f.arpFlows[portID]
+	delete(f.arpFlows, portID)
+	f.arpFlowsMu.Unlock()
+
+	if !exists || f.ovsClient == nil {
+		return nil
+	}
+
+	// All of a port's responder flows share one cookie
+	if err := f.ovsClient.DeleteFlow(f.config.OVSBridge, flows[0].Cookie); err != nil {
+		return fmt.Errorf("failed to delete ARP responder of port %s: %w", portID, err)
+	}
+	return nil
+}
+
+// arpResponderFlows builds a port's responder flows. Each turns a request
+// for the port's IP into the reply in place and sends it back out the port
+// it came in on.
+func arpResponderFlows(port *network.Port, net *network.Network) ([]*network.FlowRule, error) {
+	ip, err := netip.ParseAddr(port.IPAddress)
+	if err != nil || !ip.Is4() {
+		return nil, network.Invalidf("invalid IPv4 address %q of port %s", port.IPAddress, port.ID)
+	}
+	mac, err := parseUnicastMAC(port.MACAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := []network.FlowAction{
+		// The reply goes to the requester, from the port
+		{Type: network.FlowActionMove, Value: &network.FieldMove{Src: "NXM_OF_ETH_SRC[]", Dst: "NXM_OF_ETH_DST[]"}},
+		{Type: network.FlowActionSetField, Value: &network.FieldSet{Field: "eth_src", Value: mac}},
+		{Type: network.FlowActionSetField, Value: &network.FieldSet{Field: "arp_op", Value: "2"}},
+		// The requester's addresses become the target's
+		{Type: network.FlowActionMove, Value: &network.FieldMove{Src: "NXM_NX_ARP_SHA[]", Dst: "NXM_NX_ARP_THA[]"}},
+		{Type: network.FlowActionMove, Value: &network.FieldMove{Src: "NXM_OF_ARP_SPA[]", Dst: "NXM_OF_ARP_TPA[]"}},
+		// The port's addresses become the sender's
+		{Type: network.FlowActionSetField, Value: &network.FieldSet{Field: "arp_sha", Value: mac}},
+		{Type: network.FlowActionSetField, Value: &network.FieldSet{Field: "arp_spa", Value: ip.String()}},
+		{Type: network.FlowActionOutput, Value: "in_port"},
+	}
+
+	cookie := generateCookie("arp/" + port.ID)
+	var flows []*network.FlowRule
+	for _, vni := range net.VNIs() {
+		flows = append(flows, &network.FlowRule{
+			TableID:  21,
+			Priority: arpResponderPriority,
+			Cookie:   cookie,
+			Match: network.FlowMatch{
+				DLType:   0x0806, // ARP
+				ARPOp:    1,      // Request
+				NWDst:    ip.String(),
+				TunnelID: vni,
+			},
+			Actions: actions,
+		})
+	}
+	return flows, nil
+}
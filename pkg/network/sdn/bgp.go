@@ -0,0 +1,82 @@
+package sdn
+
+import (
+	"net/netip"
+	"slices"
+
+	"hypervisor/pkg/network"
+)
+
+// validateBGPConfig checks the BGP configuration of a network, if it has
+// one, normalizing peer addresses. A node cannot peer with the same address
+// for two networks: the upstream router would see both sessions come from
+// the node's one address.
+func (c *Controller) validateBGPConfig(net *network.Network) error {
+	config := net.BGP
+	if config == nil {
+		return nil
+	}
+	if !net.External {
+		return network.Invalidf("network %s is not external; only the addresses of external networks are advertised over BGP", net.ID)
+	}
+	if config.LocalAS == 0 {
+		return network.Invalidf("BGP local AS is required")
+	}
+	if len(config.Nodes) == 0 {
+		return network.Invalidf("BGP needs at least one gateway node to run a speaker on")
+	}
+	for i, node := range config.Nodes {
+		if node == "" {
+			return network.Invalidf("BGP gateway node IDs cannot be empty")
+		}
+		if slices.Contains(config.Nodes[:i], node) {
+			return network.Invalidf("BGP gateway node %s is listed twice", node)
+		}
+	}
+	if len(config.Peers) == 0 {
+		return network.Invalidf("BGP needs at least one peer")
+	}
+
+	for i := range config.Peers {
+		peer := &config.Peers[i]
+		ip, err := netip.ParseAddr(peer.Address)
+		if err != nil || !ip.Unmap().Is4() {
+			return network.Invalidf("BGP peer address %q is not an IPv4 address", peer.Address)
+		}
+		peer.Address = ip.Unmap().String()
+		if peer.RemoteAS == 0 {
+			return network.Invalidf("BGP peer %s needs a remote AS", peer.Address)
+		}
+		for _, other := range config.Peers[:i] {
+			if other.Address == peer.Address {
+				return network.Invalidf("BGP peer %s is listed twice", peer.Address)
+			}
+		}
+		for _, node := range peer.Nodes {
+			if !slices.Contains(config.Nodes, node) {
+				return network.Invalidf("BGP peer %s names node %s, which is not a gateway node of the network", peer.Address, node)
+			}
+		}
+	}
+
+	c.networksMu.RLock()
+	defer c.networksMu.RUnlock()
+	for _, other := range c.networks {
+		if other.ID == net.ID || other.BGP == nil {
+			continue
+		}
+		for _, node := range config.Nodes {
+			if !slices.Contains(other.BGP.Nodes, node) {
+				continue
+			}
+			for _, peer := range config.PeersOf(node) {
+				for _, otherPeer := range other.BGP.PeersOf(node) {
+					if otherPeer.Address == peer.Address {
+						return network.Invalidf("node %s already peers with %s for network %s", node, peer.Address, other.ID)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
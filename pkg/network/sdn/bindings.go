@@ -0,0 +1,48 @@
+package sdn
+
+import "hypervisor/pkg/network"
+
+// validateBinding checks that a port can be bound the way it asks to be on
+// its network. SR-IOV ports bypass Open vSwitch: their traffic leaves the
+// node on the VLAN of the VF, so they need a VLAN or flat network, and
+// nothing enforced by flows on the integration bridge applies to them.
+// vhost-user ports are on the bridge like any other, on the DPDK datapath.
+func validateBinding(port *network.Port, net *network.Network) error {
+	switch port.BindingType {
+	case "", network.PortBindingOVS, network.PortBindingVhostUser:
+	case network.PortBindingSRIOV:
+		if net.Type != network.NetworkTypeVLAN && net.Type != network.NetworkTypeFlat {
+			return network.Invalidf("SR-IOV ports need a vlan or flat network, network %s is %s", net.ID, net.Type)
+		}
+		if len(port.SecurityGroups) > 0 {
+			return network.Invalidf("security groups cannot be enforced on SR-IOV ports")
+		}
+	default:
+		return network.Invalidf("unsupported port binding type %q", port.BindingType)
+	}
+	return validateBindingQoS(port, port.QoS)
+}
+
+// validateBindingQoS checks that the bandwidth limits qos can be enforced
+// on a port as it is bound. The DPDK datapath polices what a vhost-user
+// port sends but has no HTB queues to shape what it receives.
+func validateBindingQoS(port *network.Port, qos *network.PortQoS) error {
+	if qos == nil {
+		return nil
+	}
+	switch port.BindingType {
+	case network.PortBindingSRIOV:
+		return network.Invalidf("QoS cannot be enforced on SR-IOV ports")
+	case network.PortBindingVhostUser:
+		if qos.IngressRateKbps > 0 {
+			return network.Invalidf("ingress limits cannot be enforced on vhost-user ports")
+		}
+	}
+	return nil
+}
+
+// bypassesBridge reports whether a port's traffic bypasses the integration
+// bridge, so that flows, mirrors and trunks cannot apply to it.
+func bypassesBridge(port *network.Port) bool {
+	return port.BindingType == network.PortBindingSRIOV
+}
@@ -4,13 +4,16 @@ package sdn
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 
 	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
 	"hypervisor/pkg/network"
 	"hypervisor/pkg/network/ipam"
 	"hypervisor/pkg/network/overlay"
@@ -18,7 +21,7 @@ import (
 
 const (
 	networkKeyPrefix       = "/hypervisor/network/networks/"
-	portKeyPrefix          = "/hypervisor/network/ports/"
+	PortKeyPrefix          = "/hypervisor/network/ports/" // Read by the agents too
 	securityGroupKeyPrefix = "/hypervisor/network/security-groups/"
 	routerKeyPrefix        = "/hypervisor/network/routers/"
 	floatingIPKeyPrefix    = "/hypervisor/network/floating-ips/"
@@ -36,6 +39,12 @@ type Controller struct {
 	ipam     *ipam.IPAM
 	flowMgr  *FlowManager
 
+	// Event log (nil discards events)
+	events *events.Recorder
+
+	// Programs routers and floating IPs on this host (nil only stores them)
+	routerProg RouterProgrammer
+
 	// Local state
 	networks   map[string]*network.Network
 	networksMu sync.RWMutex
@@ -50,8 +59,12 @@ type Controller struct {
 	routersMu sync.RWMutex
 
 	floatingIPs map[string]*network.FloatingIP
+	fipRouters  map[string]string // Router each floating IP's NAT is programmed in
 	fipMu       sync.RWMutex
 
+	// Revisions loadState read each watched prefix at
+	revisions map[string]int64
+
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
@@ -91,6 +104,8 @@ func NewController(
 		securityGroups: make(map[string]*network.SecurityGroup),
 		routers:        make(map[string]*network.Router),
 		floatingIPs:    make(map[string]*network.FloatingIP),
+		fipRouters:     make(map[string]string),
+		revisions:      make(map[string]int64),
 		ctx:            ctx,
 		cancel:         cancel,
 	}
@@ -98,6 +113,23 @@ func NewController(
 	return c, nil
 }
 
+// SetFlowExpiryCallback registers a callback for flow-expiry events.
+func (c *Controller) SetFlowExpiryCallback(cb FlowExpiryCallback) {
+	c.flowMgr.SetExpiryCallback(cb)
+}
+
+// SetEventRecorder sets the recorder network, subnet and port events are
+// written to.
+func (c *Controller) SetEventRecorder(recorder *events.Recorder) {
+	c.events = recorder
+}
+
+// SetRouterProgrammer sets what programs routers and floating IPs on this
+// host, such as its DVR. It must be called before Start.
+func (c *Controller) SetRouterProgrammer(p RouterProgrammer) {
+	c.routerProg = p
+}
+
 // Start starts the SDN controller.
 func (c *Controller) Start() error {
 	c.logger.Info("starting SDN controller")
@@ -107,24 +139,44 @@ func (c *Controller) Start() error {
 		return fmt.Errorf("failed to load state: %w", err)
 	}
 
-	// Start watching for changes
-	c.wg.Add(1)
-	go c.watchNetworks()
+	// Start watching for changes, from the revisions the state was loaded at
+	watches := c.resourceWatches()
+	c.wg.Add(len(watches) + 1)
+	for _, w := range watches {
+		go c.watchResource(w, c.revisions[w.prefix])
+	}
+	go func() {
+		defer c.wg.Done()
+		c.ipam.WatchAllocations(c.ctx)
+	}()
 
 	c.logger.Info("SDN controller started")
 	return nil
 }
 
+// StartLeading starts the background tasks that must only run on the elected
+// control-plane leader. They stop when ctx is cancelled.
+func (c *Controller) StartLeading(ctx context.Context) {
+	// Account for flows the switch ages out
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.flowMgr.RunExpiryReconciler(ctx, c.config.FlowExpiryInterval)
+	}()
+}
+
 // loadState loads all network state from etcd.
 func (c *Controller) loadState() error {
 	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
 	defer cancel()
 
 	// Load networks
-	kvs, err := c.etcdClient.GetWithPrefixKV(ctx, networkKeyPrefix)
+	kvs, rev, err := c.etcdClient.GetWithPrefixRevision(ctx, networkKeyPrefix)
 	if err != nil {
 		return fmt.Errorf("failed to load networks: %w", err)
 	}
+	c.revisions[networkKeyPrefix] = rev
+	loaded := make([]*network.Network, 0, len(kvs))
 	c.networksMu.Lock()
 	for _, kv := range kvs {
 		var net network.Network
@@ -133,6 +185,7 @@ func (c *Controller) loadState() error {
 			continue
 		}
 		c.networks[net.ID] = &net
+		loaded = append(loaded, &net)
 
 		// Register with VXLAN manager if applicable
 		if net.Type == network.NetworkTypeVXLAN {
@@ -145,13 +198,20 @@ func (c *Controller) loadState() error {
 		}
 	}
 	c.networksMu.Unlock()
+	c.claimExistingVNIs(ctx, loaded)
+	named := make([]namedResource, 0, len(loaded))
+	for _, net := range loaded {
+		named = append(named, namedResource{kind: NameKindNetwork, tenantID: net.TenantID, name: net.Name, id: net.ID})
+	}
 	c.logger.Info("loaded networks", zap.Int("count", len(kvs)))
 
 	// Load ports
-	kvs, err = c.etcdClient.GetWithPrefixKV(ctx, portKeyPrefix)
+	kvs, rev, err = c.etcdClient.GetWithPrefixRevision(ctx, PortKeyPrefix)
 	if err != nil {
 		return fmt.Errorf("failed to load ports: %w", err)
 	}
+	c.revisions[PortKeyPrefix] = rev
+	ports := make([]*network.Port, 0, len(kvs))
 	c.portsMu.Lock()
 	for _, kv := range kvs {
 		var port network.Port
@@ -160,15 +220,19 @@ func (c *Controller) loadState() error {
 			continue
 		}
 		c.ports[port.ID] = &port
+		ports = append(ports, &port)
+		named = append(named, namedResource{kind: NameKindPort, tenantID: c.resourceTenant(ctx, port.TenantID, port.NetworkID), name: portName(&port), id: port.ID})
 	}
 	c.portsMu.Unlock()
+	c.claimExistingMACs(ctx, ports)
 	c.logger.Info("loaded ports", zap.Int("count", len(kvs)))
 
 	// Load security groups
-	kvs, err = c.etcdClient.GetWithPrefixKV(ctx, securityGroupKeyPrefix)
+	kvs, rev, err = c.etcdClient.GetWithPrefixRevision(ctx, securityGroupKeyPrefix)
 	if err != nil {
 		return fmt.Errorf("failed to load security groups: %w", err)
 	}
+	c.revisions[securityGroupKeyPrefix] = rev
 	c.sgMu.Lock()
 	for _, kv := range kvs {
 		var sg network.SecurityGroup
@@ -177,41 +241,75 @@ func (c *Controller) loadState() error {
 			continue
 		}
 		c.securityGroups[sg.ID] = &sg
+
+		if err := c.flowMgr.InstallSecurityGroupFlows(&sg); err != nil {
+			c.logger.Warn("failed to install security group flows",
+				zap.String("sg_id", sg.ID),
+				zap.Error(err),
+			)
+		}
 	}
 	c.sgMu.Unlock()
 	c.logger.Info("loaded security groups", zap.Int("count", len(kvs)))
 
+	// Load routers
+	kvs, rev, err = c.etcdClient.GetWithPrefixRevision(ctx, routerKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to load routers: %w", err)
+	}
+	c.revisions[routerKeyPrefix] = rev
+	c.routersMu.Lock()
+	for _, kv := range kvs {
+		var router network.Router
+		if err := json.Unmarshal([]byte(kv.Value), &router); err != nil {
+			c.logger.Warn("failed to unmarshal router", zap.Error(err))
+			continue
+		}
+		c.routers[router.ID] = &router
+		c.programRouter(&router)
+	}
+	c.routersMu.Unlock()
+	c.logger.Info("loaded routers", zap.Int("count", len(kvs)))
+
+	// Load floating IPs
+	kvs, rev, err = c.etcdClient.GetWithPrefixRevision(ctx, floatingIPKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to load floating IPs: %w", err)
+	}
+	c.revisions[floatingIPKeyPrefix] = rev
+	fips := make([]*network.FloatingIP, 0, len(kvs))
+	c.fipMu.Lock()
+	for _, kv := range kvs {
+		var fip network.FloatingIP
+		if err := json.Unmarshal([]byte(kv.Value), &fip); err != nil {
+			c.logger.Warn("failed to unmarshal floating IP", zap.Error(err))
+			continue
+		}
+		c.floatingIPs[fip.ID] = &fip
+		fips = append(fips, &fip)
+	}
+	c.fipMu.Unlock()
+	for _, fip := range fips {
+		c.programFloatingIP(ctx, nil, fip)
+	}
+	c.logger.Info("loaded floating IPs", zap.Int("count", len(kvs)))
+
 	// Load subnets into IPAM
 	if err := c.ipam.LoadSubnets(ctx); err != nil {
 		return fmt.Errorf("failed to load subnets: %w", err)
 	}
+	subnets, err := c.ipam.ListSubnets(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to load subnets: %w", err)
+	}
+	for _, subnet := range subnets {
+		named = append(named, namedResource{kind: NameKindSubnet, tenantID: c.resourceTenant(ctx, subnet.TenantID, subnet.NetworkID), name: subnet.Name, id: subnet.ID})
+	}
+	c.claimExistingNames(ctx, named)
 
 	return nil
 }
 
-// watchNetworks watches for network changes in etcd.
-func (c *Controller) watchNetworks() {
-	defer c.wg.Done()
-
-	watchCh := c.etcdClient.WatchPrefixEvents(c.ctx, networkKeyPrefix)
-
-	for {
-		select {
-		case <-c.ctx.Done():
-			return
-		case event, ok := <-watchCh:
-			if !ok {
-				c.logger.Warn("network watch channel closed, reconnecting...")
-				time.Sleep(time.Second)
-				watchCh = c.etcdClient.WatchPrefixEvents(c.ctx, networkKeyPrefix)
-				continue
-			}
-
-			c.handleNetworkEvent(event)
-		}
-	}
-}
-
 // handleNetworkEvent processes a network change event.
 func (c *Controller) handleNetworkEvent(event etcd.WatchEvent) {
 	networkID := event.Key[len(networkKeyPrefix):]
@@ -237,13 +335,15 @@ func (c *Controller) handleNetworkEvent(event etcd.WatchEvent) {
 				)
 			}
 
-			// Establish tunnel mesh for this VNI
-			if err := c.vtepMgr.EstablishMesh(net.VNI); err != nil {
-				c.logger.Warn("failed to establish tunnel mesh",
-					zap.String("network_id", net.ID),
-					zap.Uint32("vni", net.VNI),
-					zap.Error(err),
-				)
+			// Establish tunnel mesh for this VNI and those of its segments
+			for _, vni := range net.VNIs() {
+				if err := c.vtepMgr.EstablishMesh(vni); err != nil {
+					c.logger.Warn("failed to establish tunnel mesh",
+						zap.String("network_id", net.ID),
+						zap.Uint32("vni", vni),
+						zap.Error(err),
+					)
+				}
 			}
 		}
 
@@ -263,11 +363,14 @@ func (c *Controller) handleNetworkEvent(event etcd.WatchEvent) {
 			c.vxlanMgr.UnregisterNetwork(networkID)
 
 			// Teardown tunnel mesh
-			if err := c.vtepMgr.TeardownMesh(net.VNI); err != nil {
-				c.logger.Warn("failed to teardown tunnel mesh",
-					zap.String("network_id", networkID),
-					zap.Error(err),
-				)
+			for _, vni := range net.VNIs() {
+				if err := c.vtepMgr.TeardownMesh(vni); err != nil {
+					c.logger.Warn("failed to teardown tunnel mesh",
+						zap.String("network_id", networkID),
+						zap.Uint32("vni", vni),
+						zap.Error(err),
+					)
+				}
 			}
 		}
 
@@ -275,35 +378,54 @@ func (c *Controller) handleNetworkEvent(event etcd.WatchEvent) {
 	}
 }
 
-// CreateNetwork creates a new virtual network.
+// CreateNetwork creates a new virtual network. A VXLAN network may be split
+// into zone segments, each with its own VNI; segments requested without a
+// VNI are allocated one.
 func (c *Controller) CreateNetwork(ctx context.Context, net *network.Network) error {
-	// Validate
+	// Every device of the datapath is sized to the network MTU, so it may
+	// not exceed what the underlay carries once encapsulated
+	maxMTU := c.config.MaxMTU(net.Type)
+	switch {
+	case net.MTU == 0:
+		net.MTU = maxMTU
+	case net.MTU > maxMTU:
+		return network.Invalidf("mtu %d exceeds %d, the most a %s network carries over an underlay MTU of %d", net.MTU, maxMTU, net.Type, c.config.MaxMTU(network.NetworkTypeFlat))
+	case net.MTU < network.MinMTU:
+		return network.Invalidf("mtu %d is below the minimum of %d", net.MTU, network.MinMTU)
+	}
+
+	// Claim the VNI, allocating one if none was requested
 	if net.Type == network.NetworkTypeVXLAN {
-		if net.VNI == 0 || net.VNI > 16777215 {
-			return fmt.Errorf("invalid VNI: %d (must be 1-16777215)", net.VNI)
+		if err := c.prepareVNI(ctx, net); err != nil {
+			return err
 		}
 	}
 
-	if net.MTU == 0 {
-		if net.Type == network.NetworkTypeVXLAN {
-			net.MTU = 1450 // VXLAN overhead
-		} else {
-			net.MTU = 1500
-		}
+	if err := c.prepareSegments(ctx, net); err != nil {
+		c.releaseNetworkVNI(ctx, net)
+		return err
 	}
 
 	net.AdminState = true
 	net.CreatedAt = time.Now()
 	net.UpdatedAt = time.Now()
 
-	// Store in etcd
+	// Store in etcd, with the claim of its name
 	key := networkKeyPrefix + net.ID
 	data, err := json.Marshal(net)
 	if err != nil {
+		c.releaseSegments(ctx, net)
+		c.releaseNetworkVNI(ctx, net)
 		return fmt.Errorf("failed to marshal network: %w", err)
 	}
 
-	if err := c.etcdClient.Put(ctx, key, string(data)); err != nil {
+	claims := nameClaims(NameKindNetwork, net.TenantID, net.ID, net.Name)
+	if err := c.etcdClient.PutClaimed(ctx, key, string(data), claims...); err != nil {
+		c.releaseSegments(ctx, net)
+		c.releaseNetworkVNI(ctx, net)
+		if err := nameInUse(err, NameKindNetwork, net.TenantID, net.Name); errors.Is(err, ErrNameInUse) {
+			return err
+		}
 		return fmt.Errorf("failed to store network: %w", err)
 	}
 
@@ -312,7 +434,18 @@ func (c *Controller) CreateNetwork(ctx context.Context, net *network.Network) er
 		zap.String("name", net.Name),
 		zap.String("type", string(net.Type)),
 		zap.Uint32("vni", net.VNI),
+		zap.Int("segments", len(net.Segments)),
 	)
+	message := fmt.Sprintf("created %s network %s (VNI %d)", net.Type, net.Name, net.VNI)
+	for _, segment := range net.Segments {
+		message += fmt.Sprintf(", zone %s (VNI %d)", segment.Zone, segment.VNI)
+	}
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindNetwork,
+		ObjectID: net.ID,
+		Reason:   "Created",
+		Message:  message,
+	})
 
 	return nil
 }
@@ -326,15 +459,20 @@ func (c *Controller) GetNetwork(ctx context.Context, networkID string) (*network
 	}
 	c.networksMu.RUnlock()
 
-	// Try etcd
+	return c.loadNetwork(ctx, networkID)
+}
+
+// loadNetwork reads a network from etcd, bypassing the cache, for the
+// changes that must start from the stored network.
+func (c *Controller) loadNetwork(ctx context.Context, networkID string) (*network.Network, error) {
 	key := networkKeyPrefix + networkID
 	value, err := c.etcdClient.Get(ctx, key)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return nil, fmt.Errorf("%w: %s", ErrNetworkNotFound, networkID)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get network: %w", err)
 	}
-	if value == "" {
-		return nil, fmt.Errorf("network not found: %s", networkID)
-	}
 
 	var net network.Network
 	if err := json.Unmarshal([]byte(value), &net); err != nil {
@@ -359,6 +497,65 @@ func (c *Controller) ListNetworks(ctx context.Context, tenantID string) ([]*netw
 	return networks, nil
 }
 
+// UpdateNetwork atomically applies fn to the stored network, retrying if it
+// is changed concurrently, and returns the updated network. fn may be called
+// more than once and must only depend on the network it is given. A new
+// name is claimed as the network is stored and the old one released after.
+// A BGP configuration is validated before it is stored.
+func (c *Controller) UpdateNetwork(ctx context.Context, networkID string, fn func(*network.Network) error) (*network.Network, error) {
+	var net *network.Network
+	var oldName string
+	_, err := c.etcdClient.ModifyClaimed(ctx, networkKeyPrefix+networkID, func(value string) (string, []etcd.Claim, error) {
+		net = &network.Network{}
+		if err := json.Unmarshal([]byte(value), net); err != nil {
+			return "", nil, fmt.Errorf("failed to unmarshal network: %w", err)
+		}
+		oldName = net.Name
+		if err := fn(net); err != nil {
+			return "", nil, err
+		}
+		if err := c.validateBGPConfig(net); err != nil {
+			return "", nil, err
+		}
+		var claims []etcd.Claim
+		if net.Name != oldName {
+			claims = nameClaims(NameKindNetwork, net.TenantID, networkID, net.Name)
+		}
+		net.ID = networkID
+		net.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(net)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to marshal network: %w", err)
+		}
+		return string(data), claims, nil
+	})
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNetworkNotFound, networkID)
+		}
+		if err := nameInUse(err, NameKindNetwork, net.TenantID, net.Name); errors.Is(err, ErrNameInUse) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to update network: %w", err)
+	}
+	if oldName != net.Name {
+		c.releaseName(ctx, NameKindNetwork, net.TenantID, oldName, networkID)
+	}
+
+	c.networksMu.Lock()
+	c.networks[net.ID] = net
+	c.networksMu.Unlock()
+
+	c.logger.Info("updated network", zap.String("network_id", networkID))
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindNetwork,
+		ObjectID: networkID,
+		Reason:   "Updated",
+	})
+	return net, nil
+}
+
 // DeleteNetwork deletes a network.
 func (c *Controller) DeleteNetwork(ctx context.Context, networkID string) error {
 	// Check for existing ports
@@ -366,18 +563,35 @@ func (c *Controller) DeleteNetwork(ctx context.Context, networkID string) error
 	for _, port := range c.ports {
 		if port.NetworkID == networkID {
 			c.portsMu.RUnlock()
-			return fmt.Errorf("network has active ports, cannot delete")
+			return fmt.Errorf("%w, cannot delete", ErrNetworkHasPorts)
 		}
 	}
 	c.portsMu.RUnlock()
 
+	// Kept to release its VNIs, read from etcd as this server's cache may
+	// not have caught up; a network missing there is deleted all the same
+	net, err := c.loadNetwork(ctx, networkID)
+	if err != nil && !errors.Is(err, ErrNetworkNotFound) {
+		return err
+	}
+
 	// Delete from etcd
 	key := networkKeyPrefix + networkID
 	if err := c.etcdClient.Delete(ctx, key); err != nil {
 		return fmt.Errorf("failed to delete network: %w", err)
 	}
+	if net != nil {
+		c.releaseSegments(ctx, net)
+		c.releaseNetworkVNI(ctx, net)
+		c.releaseName(ctx, NameKindNetwork, net.TenantID, net.Name, net.ID)
+	}
 
 	c.logger.Info("deleted network", zap.String("network_id", networkID))
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindNetwork,
+		ObjectID: networkID,
+		Reason:   "Deleted",
+	})
 	return nil
 }
 
@@ -389,21 +603,36 @@ func (c *Controller) CreatePort(ctx context.Context, port *network.Port) error {
 		return fmt.Errorf("network not found: %w", err)
 	}
 
-	// Allocate IP if not specified
-	if port.IPAddress == "" && port.SubnetID != "" {
-		alloc, err := c.ipam.AllocateIP(ctx, port.SubnetID, ipam.AllocationOptions{
-			MACAddress: port.MACAddress,
-			PortID:     port.ID,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to allocate IP: %w", err)
-		}
-		port.IPAddress = alloc.IPAddress
+	if port.QoS, err = normalizeQoS(port.QoS); err != nil {
+		return err
+	}
+	if err := validateBinding(port, net); err != nil {
+		return err
 	}
 
-	// Generate MAC if not specified
-	if port.MACAddress == "" {
-		port.MACAddress = generateMAC()
+	port.TenantID = net.TenantID
+
+	// Claim the MAC, generating one if none was requested
+	if err := c.prepareMAC(ctx, port); err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		c.releaseMAC(ctx, port)
+		return err
+	}
+
+	allocated, err := c.allocatePortIP(ctx, port)
+	if err != nil {
+		return fail(err)
+	}
+	if allocated {
+		release := fail
+		fail = func(err error) error {
+			if err := c.ipam.ReleaseIP(ctx, port.SubnetID, port.IPAddress); err != nil {
+				c.logger.Warn("failed to release IP", zap.String("ip", port.IPAddress), zap.Error(err))
+			}
+			return release(err)
+		}
 	}
 
 	port.Status = "build"
@@ -411,15 +640,19 @@ func (c *Controller) CreatePort(ctx context.Context, port *network.Port) error {
 	port.CreatedAt = time.Now()
 	port.UpdatedAt = time.Now()
 
-	// Store in etcd
-	key := portKeyPrefix + port.ID
+	// Store in etcd, with the claim of its name
+	key := PortKeyPrefix + port.ID
 	data, err := json.Marshal(port)
 	if err != nil {
-		return fmt.Errorf("failed to marshal port: %w", err)
+		return fail(fmt.Errorf("failed to marshal port: %w", err))
 	}
 
-	if err := c.etcdClient.Put(ctx, key, string(data)); err != nil {
-		return fmt.Errorf("failed to store port: %w", err)
+	claims := nameClaims(NameKindPort, port.TenantID, port.ID, portName(port))
+	if err := c.etcdClient.PutClaimed(ctx, key, string(data), claims...); err != nil {
+		if err := nameInUse(err, NameKindPort, port.TenantID, portName(port)); errors.Is(err, ErrNameInUse) {
+			return fail(err)
+		}
+		return fail(fmt.Errorf("failed to store port: %w", err))
 	}
 
 	// Update cache
@@ -433,18 +666,76 @@ func (c *Controller) CreatePort(ctx context.Context, port *network.Port) error {
 		zap.String("ip_address", port.IPAddress),
 		zap.String("mac_address", port.MACAddress),
 	)
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindPort,
+		ObjectID: port.ID,
+		Reason:   "Created",
+		Message:  fmt.Sprintf("created port on network %s with %s (%s)", port.NetworkID, port.IPAddress, port.MACAddress),
+	})
 
-	// Install flow rules for this port
-	if net.Type == network.NetworkTypeVXLAN {
-		if err := c.flowMgr.InstallPortFlows(port, net); err != nil {
-			c.logger.Warn("failed to install port flows",
-				zap.String("port_id", port.ID),
-				zap.Error(err),
-			)
+	return nil
+}
+
+// allocatePortIP allocates the address of a new port from IPAM: the
+// requested one, which must be free and in a pool the port may use, or else
+// the next free one. A requested address without a subnet is looked up in
+// the subnets of the port's network. It reports whether an allocation was
+// made; a router interface holds its subnet's gateway, which is never
+// allocated.
+func (c *Controller) allocatePortIP(ctx context.Context, port *network.Port) (bool, error) {
+	if port.SubnetID == "" {
+		if port.IPAddress == "" {
+			return false, nil
 		}
+		subnetID, err := c.subnetHolding(ctx, port.NetworkID, port.IPAddress)
+		if err != nil {
+			return false, err
+		}
+		port.SubnetID = subnetID
 	}
 
-	return nil
+	if port.RouterID != "" && port.IPAddress != "" {
+		subnet, err := c.ipam.GetSubnet(ctx, port.SubnetID)
+		if err != nil {
+			return false, err
+		}
+		if port.IPAddress == subnet.GatewayIP {
+			return false, nil
+		}
+	}
+
+	alloc, err := c.ipam.AllocateIP(ctx, port.SubnetID, ipam.AllocationOptions{
+		IPAddress:  port.IPAddress,
+		MACAddress: port.MACAddress,
+		PortID:     port.ID,
+		InstanceID: port.InstanceID,
+		Zone:       port.Zone,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to allocate IP: %w", err)
+	}
+	port.IPAddress = alloc.IPAddress
+	return true, nil
+}
+
+// subnetHolding returns the ID of the subnet of a network containing an
+// address.
+func (c *Controller) subnetHolding(ctx context.Context, networkID, ipAddress string) (string, error) {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return "", network.Invalidf("invalid IP address: %s", ipAddress)
+	}
+
+	subnets, err := c.ipam.ListSubnets(ctx, networkID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list subnets of network %s: %w", networkID, err)
+	}
+	for _, subnet := range subnets {
+		if _, ipNet, err := net.ParseCIDR(subnet.CIDR); err == nil && ipNet.Contains(ip) {
+			return subnet.ID, nil
+		}
+	}
+	return "", network.Invalidf("IP %s is in no subnet of network %s", ipAddress, networkID)
 }
 
 // BindPort binds a port to an instance and node.
@@ -453,18 +744,22 @@ func (c *Controller) BindPort(ctx context.Context, portID, instanceID, nodeID, d
 	port, exists := c.ports[portID]
 	if !exists {
 		c.portsMu.Unlock()
-		return fmt.Errorf("port not found: %s", portID)
+		return fmt.Errorf("%w: %s", ErrPortNotFound, portID)
+	}
+	if port.ParentPortID != "" {
+		c.portsMu.Unlock()
+		return network.Invalidf("port %s is a subport of %s; bind the trunk parent instead", portID, port.ParentPortID)
 	}
 
 	port.InstanceID = instanceID
 	port.NodeID = nodeID
 	port.DeviceName = deviceName
-	port.Status = "active"
+	port.Status = "build" // Until the node's network agent has programmed it
 	port.UpdatedAt = time.Now()
 	c.portsMu.Unlock()
 
 	// Update in etcd
-	key := portKeyPrefix + portID
+	key := PortKeyPrefix + portID
 	data, err := json.Marshal(port)
 	if err != nil {
 		return fmt.Errorf("failed to marshal port: %w", err)
@@ -473,43 +768,137 @@ func (c *Controller) BindPort(ctx context.Context, portID, instanceID, nodeID, d
 	if err := c.etcdClient.Put(ctx, key, string(data)); err != nil {
 		return fmt.Errorf("failed to update port: %w", err)
 	}
+	if err := c.bindSubPorts(ctx, port); err != nil {
+		return err
+	}
+
+	// Record the instance on the port's allocation, in place so the address
+	// is never free while the port holds it
+	if port.SubnetID != "" && port.IPAddress != "" {
+		_, err := c.ipam.UpdateAllocation(ctx, port.SubnetID, port.IPAddress, func(alloc *network.IPAllocation) {
+			alloc.InstanceID = instanceID
+			alloc.PortID = portID
+		})
+		switch {
+		case errors.Is(err, ipam.ErrAllocationNotFound):
+			c.logger.Warn("bound port has no IP allocation",
+				zap.String("port_id", portID),
+				zap.String("ip", port.IPAddress),
+			)
+		case err != nil:
+			return err
+		}
+	}
 
 	c.logger.Info("bound port",
 		zap.String("port_id", portID),
 		zap.String("instance_id", instanceID),
 		zap.String("node_id", nodeID),
 	)
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindPort,
+		ObjectID: portID,
+		NodeID:   nodeID,
+		Reason:   "Bound",
+		Message:  bindMessage(instanceID, deviceName),
+	})
 
-	// Update IP allocation
-	if port.SubnetID != "" && port.IPAddress != "" {
-		alloc, err := c.ipam.GetAllocation(ctx, port.SubnetID, port.IPAddress)
-		if err == nil {
-			alloc.InstanceID = instanceID
-			// Re-allocate to update
-			c.ipam.ReleaseIP(ctx, port.SubnetID, port.IPAddress)
-			c.ipam.AllocateIP(ctx, port.SubnetID, ipam.AllocationOptions{
-				IPAddress:  port.IPAddress,
-				MACAddress: port.MACAddress,
-				InstanceID: instanceID,
-				PortID:     portID,
-			})
-		}
+	return nil
+}
+
+// bindMessage describes a binding; ports of load balancers are bound to
+// an interface of their own rather than to an instance.
+func bindMessage(instanceID, deviceName string) string {
+	if instanceID == "" {
+		return "bound as " + deviceName
 	}
+	return fmt.Sprintf("bound to instance %s as %s", instanceID, deviceName)
+}
 
-	return nil
+// UnbindPort detaches a port from its instance and node, keeping its address
+// for the next binding.
+func (c *Controller) UnbindPort(ctx context.Context, portID string) (*network.Port, error) {
+	c.portsMu.Lock()
+	port, exists := c.ports[portID]
+	if !exists {
+		c.portsMu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrPortNotFound, portID)
+	}
+	if port.ParentPortID != "" {
+		c.portsMu.Unlock()
+		return nil, network.Invalidf("port %s is a subport of %s; unbind the trunk parent instead", portID, port.ParentPortID)
+	}
+
+	instanceID, nodeID := port.InstanceID, port.NodeID
+	port.InstanceID = ""
+	port.NodeID = ""
+	port.DeviceName = ""
+	port.Status = "down"
+	port.UpdatedAt = time.Now()
+	copied := *port
+	c.portsMu.Unlock()
+
+	// Update in etcd
+	key := PortKeyPrefix + portID
+	data, err := json.Marshal(&copied)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal port: %w", err)
+	}
+
+	if err := c.etcdClient.Put(ctx, key, string(data)); err != nil {
+		return nil, fmt.Errorf("failed to update port: %w", err)
+	}
+	if err := c.bindSubPorts(ctx, &copied); err != nil {
+		return nil, err
+	}
+
+	// Counters restart on the next binding
+
+	c.logger.Info("unbound port",
+		zap.String("port_id", portID),
+		zap.String("instance_id", instanceID),
+		zap.String("node_id", nodeID),
+	)
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindPort,
+		ObjectID: portID,
+		NodeID:   nodeID,
+		Reason:   "Unbound",
+		Message:  fmt.Sprintf("unbound from instance %s", instanceID),
+	})
+
+	return &copied, nil
 }
 
 // DeletePort deletes a port.
 func (c *Controller) DeletePort(ctx context.Context, portID string) error {
+	if trunk, err := c.trunkOf(ctx, portID); err != nil {
+		return err
+	} else if trunk != nil {
+		return fmt.Errorf("%w: port %s is the parent of trunk %s", ErrPortInTrunk, portID, trunk.ID)
+	}
+
+	if port, err := c.GetPort(ctx, portID); err == nil {
+		if lb, err := c.vipOwner(ctx, port); err != nil {
+			return err
+		} else if lb != nil {
+			return fmt.Errorf("%w: port %s holds the VIP of load balancer %s", ErrPortInTrunk, portID, lb.ID)
+		}
+	}
+
 	c.portsMu.Lock()
 	port, exists := c.ports[portID]
+	if exists && port.ParentPortID != "" {
+		c.portsMu.Unlock()
+		return fmt.Errorf("%w: port %s is a subport of %s", ErrPortInTrunk, portID, port.ParentPortID)
+	}
 	if exists {
 		delete(c.ports, portID)
 	}
 	c.portsMu.Unlock()
 
 	if !exists {
-		return fmt.Errorf("port not found: %s", portID)
+		return fmt.Errorf("%w: %s", ErrPortNotFound, portID)
 	}
 
 	// Release IP
@@ -522,21 +911,22 @@ func (c *Controller) DeletePort(ctx context.Context, portID string) error {
 		}
 	}
 
-	// Remove flow rules
-	if err := c.flowMgr.RemovePortFlows(port); err != nil {
-		c.logger.Warn("failed to remove port flows",
-			zap.String("port_id", portID),
-			zap.Error(err),
-		)
-	}
-
 	// Delete from etcd
-	key := portKeyPrefix + portID
+	key := PortKeyPrefix + portID
 	if err := c.etcdClient.Delete(ctx, key); err != nil {
 		return fmt.Errorf("failed to delete port: %w", err)
 	}
+	c.releaseMAC(ctx, port)
+	c.releaseName(ctx, NameKindPort, c.resourceTenant(ctx, port.TenantID, port.NetworkID), portName(port), portID)
+	c.deletePortMirrors(ctx, portID)
 
 	c.logger.Info("deleted port", zap.String("port_id", portID))
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindPort,
+		ObjectID: portID,
+		NodeID:   port.NodeID,
+		Reason:   "Deleted",
+	})
 	return nil
 }
 
@@ -549,7 +939,7 @@ func (c *Controller) GetPort(ctx context.Context, portID string) (*network.Port,
 	}
 	c.portsMu.RUnlock()
 
-	return nil, fmt.Errorf("port not found: %s", portID)
+	return nil, fmt.Errorf("%w: %s", ErrPortNotFound, portID)
 }
 
 // ListPorts returns ports with optional filters.
@@ -587,14 +977,3 @@ func (c *Controller) Stop() error {
 
 	return nil
 }
-
-// generateMAC generates a random MAC address with the local bit set.
-func generateMAC() string {
-	// Use locally administered address (second hex digit is 2, 6, A, or E)
-	// Format: fa:16:3e:xx:xx:xx (OpenStack style)
-	return fmt.Sprintf("fa:16:3e:%02x:%02x:%02x",
-		uint8(time.Now().UnixNano()>>16),
-		uint8(time.Now().UnixNano()>>8),
-		uint8(time.Now().UnixNano()),
-	)
-}
@@ -0,0 +1,51 @@
+package sdn
+
+import "hypervisor/pkg/network"
+
+// Errors returned by the controller. Each matches one of the error kinds of
+// package network as well, e.g. ErrNetworkHasPorts is a network.ErrInUse;
+// malformed requests are network.ErrInvalid.
+var (
+	ErrNetworkNotFound = network.NewError(network.ErrNotFound, "network not found")
+	ErrNetworkHasPorts = network.NewError(network.ErrInUse, "network has active ports")
+	ErrPortNotFound    = network.NewError(network.ErrNotFound, "port not found")
+	ErrNameInUse       = network.NewError(network.ErrAlreadyExists, "name already in use")
+	ErrNameNotFound    = network.NewError(network.ErrNotFound, "no resource with that name")
+	ErrMACInUse        = network.NewError(network.ErrAlreadyExists, "MAC address already in use")
+	ErrNoFreeMAC       = network.NewError(network.ErrExhausted, "no free MAC address")
+
+	ErrPortStatsNotFound = network.NewError(network.ErrNotFound, "no stats for port")
+	ErrMirrorNotFound    = network.NewError(network.ErrNotFound, "port mirror not found")
+
+	ErrTrunkNotFound    = network.NewError(network.ErrNotFound, "trunk not found")
+	ErrTrunkExists      = network.NewError(network.ErrAlreadyExists, "port is already a trunk parent")
+	ErrTrunkHasSubPorts = network.NewError(network.ErrInUse, "trunk has subports")
+	ErrSubPortNotFound  = network.NewError(network.ErrNotFound, "subport not found")
+	ErrPortInTrunk      = network.NewError(network.ErrInUse, "port is in use")
+
+	ErrRouterNotFound          = network.NewError(network.ErrNotFound, "router not found")
+	ErrRouterExists            = network.NewError(network.ErrAlreadyExists, "router already exists")
+	ErrRouterHasInterfaces     = network.NewError(network.ErrInUse, "router has interfaces")
+	ErrRouterInterfaceNotFound = network.NewError(network.ErrNotFound, "router interface not found")
+	ErrSubnetAttached          = network.NewError(network.ErrAlreadyExists, "subnet is already attached to a router")
+
+	ErrLoadBalancerNotFound = network.NewError(network.ErrNotFound, "load balancer not found")
+	ErrListenerNotFound     = network.NewError(network.ErrNotFound, "listener not found")
+	ErrListenerPortInUse    = network.NewError(network.ErrAlreadyExists, "listener port already in use")
+	ErrMemberNotFound       = network.NewError(network.ErrNotFound, "pool member not found")
+	ErrSubnetHasVIPs        = network.NewError(network.ErrInUse, "subnet has load balancer VIPs")
+	ErrNoLoadBalancerNode   = network.NewError(network.ErrExhausted, "no node can serve the load balancer")
+
+	ErrVPNServiceNotFound = network.NewError(network.ErrNotFound, "VPN service not found")
+	ErrVPNPeerNotFound    = network.NewError(network.ErrNotFound, "VPN peer not found")
+	ErrVPNPortInUse       = network.NewError(network.ErrAlreadyExists, "VPN listen port already in use")
+	ErrVPNPeerExists      = network.NewError(network.ErrAlreadyExists, "VPN peer already exists")
+	ErrRouterHasVPNs      = network.NewError(network.ErrInUse, "router has VPN services")
+	ErrNoVPNNode          = network.NewError(network.ErrExhausted, "no node can serve the VPN service")
+
+	ErrSecurityGroupNotFound = network.NewError(network.ErrNotFound, "security group not found")
+	ErrSecurityGroupExists   = network.NewError(network.ErrAlreadyExists, "security group already exists")
+	ErrSecurityGroupInUse    = network.NewError(network.ErrInUse, "security group is in use")
+	ErrRuleNotFound          = network.NewError(network.ErrNotFound, "rule not found")
+	ErrDuplicateRule         = network.NewError(network.ErrAlreadyExists, "security group already has an identical rule")
+)
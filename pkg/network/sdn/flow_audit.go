@@ -0,0 +1,88 @@
+package sdn
+
+import (
+	"fmt"
+
+	"hypervisor/pkg/network"
+)
+
+// FlowAudit is the difference between the flows the manager installed and
+// those on the bridge.
+type FlowAudit struct {
+	// Checked is how many installed flows were looked for.
+	Checked int
+
+	// Ports are the ports with port flows missing, PortFlowsMissing how
+	// many.
+	Ports            []string
+	PortFlowsMissing int
+
+	// Responders are the ports with ARP responder flows missing,
+	// ResponderFlowsMissing how many.
+	Responders            []string
+	ResponderFlowsMissing int
+}
+
+// Drifted reports whether any installed flow is missing from the bridge.
+func (a *FlowAudit) Drifted() bool {
+	return a.PortFlowsMissing+a.ResponderFlowsMissing > 0
+}
+
+// AuditFlows dumps the bridge and reports the ports whose port or ARP
+// responder flows are no longer all installed, e.g. after Open vSwitch
+// restarted or someone deleted flows by hand. Flows with a timeout are not
+// looked for, as the switch removes them on its own.
+func (f *FlowManager) AuditFlows() (*FlowAudit, error) {
+	audit := &FlowAudit{}
+	if f.ovsClient == nil {
+		return audit, nil
+	}
+
+	installed, err := f.ovsClient.DumpFlows(f.config.OVSBridge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump flows: %w", err)
+	}
+	present := make(map[flowKey]int, len(installed))
+	for _, flow := range installed {
+		present[keyOf(flow)]++
+	}
+
+	f.flowsMu.Lock()
+	audit.Ports, audit.PortFlowsMissing = audit.check(present, f.portFlows)
+	f.flowsMu.Unlock()
+
+	f.arpFlowsMu.Lock()
+	audit.Responders, audit.ResponderFlowsMissing = audit.check(present, f.arpFlows)
+	f.arpFlowsMu.Unlock()
+
+	return audit, nil
+}
+
+// check counts the flows of each owner against those present and returns
+// the owners missing some, and how many flows they miss. Flows of one owner
+// may share a key, so keys are counted rather than looked up.
+func (a *FlowAudit) check(present map[flowKey]int, owners map[string][]*network.FlowRule) ([]string, int) {
+	var drifted []string
+	total := 0
+	for owner, flows := range owners {
+		want := make(map[flowKey]int, len(flows))
+		for _, flow := range flows {
+			if !flow.HasTimeout() {
+				want[keyOf(flow)]++
+			}
+		}
+
+		missing := 0
+		for key, n := range want {
+			a.Checked += n
+			if have := present[key]; have < n {
+				missing += n - have
+			}
+		}
+		if missing > 0 {
+			total += missing
+			drifted = append(drifted, owner)
+		}
+	}
+	return drifted, total
+}
@@ -1,8 +1,10 @@
 package sdn
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -18,13 +20,50 @@ type FlowManager struct {
 	portFlows map[string][]*network.FlowRule
 	flowsMu   sync.RWMutex
 
+	// Installed security group rule flows indexed by security group ID
+	sgFlows   map[string][]*network.FlowRule
+	sgFlowsMu sync.Mutex
+
+	// Installed ARP responder flows indexed by port ID
+	arpFlows   map[string][]*network.FlowRule
+	arpFlowsMu sync.Mutex
+
+	// Flows with idle/hard timeouts, for expiry accounting
+	timedFlows   map[flowKey]*timedFlow
+	timedFlowsMu sync.Mutex
+
+	// Callback invoked when a timed flow ages out of the switch
+	expiryCallback FlowExpiryCallback
+
 	// OVS client for flow operations
 	ovsClient OVSFlowClient
 }
 
+// flowKey identifies an installed flow; flows of one owner share a cookie.
+type flowKey struct {
+	cookie   uint64
+	tableID  uint8
+	priority uint16
+}
+
+func keyOf(rule *network.FlowRule) flowKey {
+	return flowKey{cookie: rule.Cookie, tableID: rule.TableID, priority: rule.Priority}
+}
+
+// timedFlow records when a flow with a timeout was installed and by whom.
+type timedFlow struct {
+	rule        *network.FlowRule
+	owner       string
+	installedAt time.Time
+}
+
+// FlowExpiryCallback is called for each flow that aged out of the switch.
+type FlowExpiryCallback func(event network.FlowExpiryEvent)
+
 // OVSFlowClient defines the interface for OVS flow operations.
 type OVSFlowClient interface {
 	AddFlow(bridge string, rule *network.FlowRule) error
+	AddFlows(bridge string, rules []*network.FlowRule) error
 	DeleteFlow(bridge string, cookie uint64) error
 	DeleteFlowsByMatch(bridge string, match *network.FlowMatch) error
 	DumpFlows(bridge string) ([]*network.FlowRule, error)
@@ -33,9 +72,12 @@ type OVSFlowClient interface {
 // NewFlowManager creates a new flow manager.
 func NewFlowManager(config *network.NetworkConfig, logger *zap.Logger) (*FlowManager, error) {
 	return &FlowManager{
-		config:    config,
-		logger:    logger,
-		portFlows: make(map[string][]*network.FlowRule),
+		config:     config,
+		logger:     logger,
+		portFlows:  make(map[string][]*network.FlowRule),
+		sgFlows:    make(map[string][]*network.FlowRule),
+		arpFlows:   make(map[string][]*network.FlowRule),
+		timedFlows: make(map[flowKey]*timedFlow),
 		// ovsClient will be injected or use exec-based implementation
 	}, nil
 }
@@ -45,6 +87,45 @@ func (f *FlowManager) SetOVSClient(client OVSFlowClient) {
 	f.ovsClient = client
 }
 
+// SetExpiryCallback sets the callback invoked for flow-expiry events.
+func (f *FlowManager) SetExpiryCallback(cb FlowExpiryCallback) {
+	f.timedFlowsMu.Lock()
+	f.expiryCallback = cb
+	f.timedFlowsMu.Unlock()
+}
+
+// addFlows installs flows in one batch and records those with a timeout for
+// expiry accounting.
+func (f *FlowManager) addFlows(owner string, rules []*network.FlowRule) error {
+	if err := f.ovsClient.AddFlows(f.config.OVSBridge, rules); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	f.timedFlowsMu.Lock()
+	for _, rule := range rules {
+		if rule.HasTimeout() {
+			f.timedFlows[keyOf(rule)] = &timedFlow{
+				rule:        rule,
+				owner:       owner,
+				installedAt: now,
+			}
+		}
+	}
+	f.timedFlowsMu.Unlock()
+
+	return nil
+}
+
+// forgetFlows drops expiry tracking for the given flows.
+func (f *FlowManager) forgetFlows(rules ...*network.FlowRule) {
+	f.timedFlowsMu.Lock()
+	for _, rule := range rules {
+		delete(f.timedFlows, keyOf(rule))
+	}
+	f.timedFlowsMu.Unlock()
+}
+
 // InstallPortFlows installs OpenFlow rules for a port.
 func (f *FlowManager) InstallPortFlows(port *network.Port, net *network.Network) error {
 	if f.ovsClient == nil {
@@ -54,6 +135,7 @@ func (f *FlowManager) InstallPortFlows(port *network.Port, net *network.Network)
 
 	var flows []*network.FlowRule
 	cookie := generateCookie(port.ID)
+	vni := net.SegmentVNI(port.Zone)
 
 	// Flow 1: L2 learning - MAC to port binding
 	// Table 20: Unicast lookup
@@ -64,14 +146,15 @@ func (f *FlowManager) InstallPortFlows(port *network.Port, net *network.Network)
 		Cookie:   cookie,
 		Match: network.FlowMatch{
 			DLDst:    port.MACAddress,
-			TunnelID: net.VNI,
-		},
-		Actions: []network.FlowAction{
-			{Type: network.FlowActionOutput, Value: port.DeviceName},
+			TunnelID: vni,
 		},
+		Actions: deliverActions(port),
 	}
 	flows = append(flows, l2Flow)
 
+	// Flow 1b: Cross-segment stitching for multi-zone networks
+	flows = append(flows, segmentStitchFlows(port, net, vni, cookie)...)
+
 	// Flow 2: Security group ingress rules
 	for _, sgID := range port.SecurityGroups {
 		sgFlows := f.generateSecurityGroupFlows(port, sgID, "ingress", cookie)
@@ -97,18 +180,28 @@ func (f *FlowManager) InstallPortFlows(port *network.Port, net *network.Network)
 			{Type: network.FlowActionGotoTable, Value: uint8(10)}, // Continue to next table
 		},
 	}
+	if port.VLANTag != 0 {
+		// A subport's frames arrive on the parent's device tagged with its
+		// VLAN: untag them onto the subport's network, ahead of the parent's
+		// untagged frames, which may share the subport's MAC
+		antiSpoofFlow.Priority = 60
+		antiSpoofFlow.Match.DLVlan = port.VLANTag
+		antiSpoofFlow.Actions = []network.FlowAction{
+			{Type: network.FlowActionPopVLAN},
+			{Type: network.FlowActionSetTunnel, Value: vni},
+			{Type: network.FlowActionGotoTable, Value: uint8(10)},
+		}
+	}
 	flows = append(flows, antiSpoofFlow)
 
-	// Install all flows
-	for _, flow := range flows {
-		if err := f.ovsClient.AddFlow(f.config.OVSBridge, flow); err != nil {
-			f.logger.Error("failed to add flow",
-				zap.String("port_id", port.ID),
-				zap.Uint64("cookie", flow.Cookie),
-				zap.Error(err),
-			)
-			return err
-		}
+	// Install all flows with one batch
+	if err := f.addFlows(port.ID, flows); err != nil {
+		f.logger.Error("failed to add port flows",
+			zap.String("port_id", port.ID),
+			zap.Uint64("cookie", cookie),
+			zap.Error(err),
+		)
+		return err
 	}
 
 	// Store flows for later cleanup
@@ -124,6 +217,73 @@ func (f *FlowManager) InstallPortFlows(port *network.Port, net *network.Network)
 	return nil
 }
 
+// deliverActions outputs a frame to a port's device. Frames for a subport
+// leave on its parent's device tagged with the subport's VLAN.
+func deliverActions(port *network.Port) []network.FlowAction {
+	if port.VLANTag == 0 {
+		return []network.FlowAction{
+			{Type: network.FlowActionOutput, Value: port.DeviceName},
+		}
+	}
+	return []network.FlowAction{
+		{Type: network.FlowActionPushVLAN, Value: uint16(0x8100)},
+		{Type: network.FlowActionSetField, Value: &network.FieldSet{
+			Field: "vlan_vid",
+			Value: fmt.Sprintf("%d", 0x1000|uint32(port.VLANTag)), // OFPVID_PRESENT | tag
+		}},
+		{Type: network.FlowActionOutput, Value: port.DeviceName},
+	}
+}
+
+// segmentStitchFlows makes a port of a multi-zone network reachable from the
+// network's other VNIs: unicast to its MAC and ARP requests for its IP are
+// moved onto the port's segment VNI and delivered to it, so neither has to
+// be flooded beyond the sender's segment.
+func segmentStitchFlows(port *network.Port, net *network.Network, vni uint32, cookie uint64) []*network.FlowRule {
+	if len(net.Segments) == 0 {
+		return nil
+	}
+
+	deliver := append([]network.FlowAction{
+		{Type: network.FlowActionSetTunnel, Value: vni},
+	}, deliverActions(port)...)
+
+	var flows []*network.FlowRule
+	for _, other := range net.VNIs() {
+		if other == vni {
+			continue
+		}
+
+		// Table 20: Unicast from another segment
+		flows = append(flows, &network.FlowRule{
+			TableID:  20,
+			Priority: 100,
+			Cookie:   cookie,
+			Match: network.FlowMatch{
+				DLDst:    port.MACAddress,
+				TunnelID: other,
+			},
+			Actions: deliver,
+		})
+
+		// Table 21: ARP from another segment, ahead of the flood flow
+		if port.IPAddress != "" {
+			flows = append(flows, &network.FlowRule{
+				TableID:  21,
+				Priority: 110,
+				Cookie:   cookie,
+				Match: network.FlowMatch{
+					DLType:   0x0806, // ARP
+					NWDst:    port.IPAddress,
+					TunnelID: other,
+				},
+				Actions: deliver,
+			})
+		}
+	}
+	return flows
+}
+
 // generateSecurityGroupFlows creates flows for a security group.
 func (f *FlowManager) generateSecurityGroupFlows(port *network.Port, sgID, direction string, baseCookie uint64) []*network.FlowRule {
 	// TODO: Look up security group rules and generate appropriate flows
@@ -148,6 +308,7 @@ func (f *FlowManager) RemovePortFlows(port *network.Port) error {
 
 	// Delete all flows by cookie
 	for _, flow := range flows {
+		f.forgetFlows(flow)
 		if err := f.ovsClient.DeleteFlow(f.config.OVSBridge, flow.Cookie); err != nil {
 			f.logger.Warn("failed to delete flow",
 				zap.String("port_id", port.ID),
@@ -165,7 +326,8 @@ func (f *FlowManager) RemovePortFlows(port *network.Port) error {
 	return nil
 }
 
-// InstallNetworkFlows installs base flows for a network.
+// InstallNetworkFlows installs base flows for a network, for its own VNI
+// and each of its zone segments.
 func (f *FlowManager) InstallNetworkFlows(net *network.Network) error {
 	if f.ovsClient == nil {
 		return nil
@@ -173,16 +335,46 @@ func (f *FlowManager) InstallNetworkFlows(net *network.Network) error {
 
 	cookie := generateCookie(net.ID)
 
+	for _, vni := range net.VNIs() {
+		if err := f.installVNIFlows(vni, cookie); err != nil {
+			return err
+		}
+	}
+
+	f.logger.Debug("installed network flows",
+		zap.String("network_id", net.ID),
+		zap.Uint32("vni", net.VNI),
+		zap.Int("segments", len(net.Segments)),
+	)
+
+	return nil
+}
+
+// installVNIFlows installs the flood and unknown unicast flows of one VNI.
+func (f *FlowManager) installVNIFlows(vni uint32, cookie uint64) error {
 	// Flow 1: Broadcast/multicast handling for this VNI
-	// Table 21: Flood
+	// Table 21: Flood, learning the source MAC into table 20 on the way so
+	// return traffic is unicast. Learned flows share the network cookie so
+	// RemoveNetworkFlows cleans them up, and age out after the idle timeout.
 	floodFlow := &network.FlowRule{
 		TableID:  21,
 		Priority: 100,
 		Cookie:   cookie,
 		Match: network.FlowMatch{
-			TunnelID: net.VNI,
+			TunnelID: vni,
 		},
 		Actions: []network.FlowAction{
+			{Type: network.FlowActionLearn, Value: &network.LearnSpec{
+				TableID:     20,
+				Priority:    50,
+				Cookie:      cookie,
+				IdleTimeout: f.config.MACLearningIdleTimeout,
+				Fields: []string{
+					"NXM_NX_TUN_ID[]",
+					"NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[]",
+				},
+				Output: "NXM_OF_IN_PORT[]",
+			}},
 			{Type: network.FlowActionOutput, Value: "all"}, // Flood to all ports in VNI
 		},
 	}
@@ -197,7 +389,7 @@ func (f *FlowManager) InstallNetworkFlows(net *network.Network) error {
 		Priority: 1, // Low priority, fallback
 		Cookie:   cookie,
 		Match: network.FlowMatch{
-			TunnelID: net.VNI,
+			TunnelID: vni,
 		},
 		Actions: []network.FlowAction{
 			{Type: network.FlowActionGotoTable, Value: uint8(21)}, // Go to flood table
@@ -208,11 +400,6 @@ func (f *FlowManager) InstallNetworkFlows(net *network.Network) error {
 		return fmt.Errorf("failed to add unknown unicast flow: %w", err)
 	}
 
-	f.logger.Debug("installed network flows",
-		zap.String("network_id", net.ID),
-		zap.Uint32("vni", net.VNI),
-	)
-
 	return nil
 }
 
@@ -242,6 +429,7 @@ func (f *FlowManager) InstallSecurityGroupFlows(sg *network.SecurityGroup) error
 
 	cookie := generateCookie(sg.ID)
 
+	installed := make([]*network.FlowRule, 0, len(sg.Rules))
 	for _, rule := range sg.Rules {
 		flow := f.ruleToFlow(&rule, cookie)
 		if flow == nil {
@@ -254,6 +442,36 @@ func (f *FlowManager) InstallSecurityGroupFlows(sg *network.SecurityGroup) error
 				zap.String("rule_id", rule.ID),
 				zap.Error(err),
 			)
+			continue
+		}
+		installed = append(installed, flow)
+	}
+
+	f.sgFlowsMu.Lock()
+	f.sgFlows[sg.ID] = installed
+	f.sgFlowsMu.Unlock()
+
+	return nil
+}
+
+// RemoveSecurityGroupFlows removes the flows installed for a security group.
+func (f *FlowManager) RemoveSecurityGroupFlows(sgID string) error {
+	f.sgFlowsMu.Lock()
+	flows := f.sgFlows[sgID]
+	delete(f.sgFlows, sgID)
+	f.sgFlowsMu.Unlock()
+
+	if f.ovsClient == nil {
+		return nil
+	}
+
+	for _, flow := range flows {
+		if err := f.ovsClient.DeleteFlow(f.config.OVSBridge, flow.Cookie); err != nil {
+			f.logger.Warn("failed to delete security group flow",
+				zap.String("sg_id", sgID),
+				zap.Uint64("cookie", flow.Cookie),
+				zap.Error(err),
+			)
 		}
 	}
 
@@ -316,16 +534,124 @@ func (f *FlowManager) ruleToFlow(rule *network.SecurityGroupRule, baseCookie uin
 
 // UpdateSecurityGroupFlows updates flows when security group rules change.
 func (f *FlowManager) UpdateSecurityGroupFlows(sg *network.SecurityGroup) error {
-	// Remove old flows
-	if f.ovsClient != nil {
-		cookie := generateCookie(sg.ID)
-		f.ovsClient.DeleteFlow(f.config.OVSBridge, cookie)
+	// Remove old flows; each rule has its own cookie
+	if err := f.RemoveSecurityGroupFlows(sg.ID); err != nil {
+		return err
 	}
 
 	// Install new flows
 	return f.InstallSecurityGroupFlows(sg)
 }
 
+// ReconcileExpiredFlows compares tracked timed flows against the flows
+// installed on the bridge and emits an expiry event for each one the switch
+// has aged out.
+func (f *FlowManager) ReconcileExpiredFlows() ([]network.FlowExpiryEvent, error) {
+	if f.ovsClient == nil {
+		return nil, nil
+	}
+
+	f.timedFlowsMu.Lock()
+	pending := len(f.timedFlows)
+	f.timedFlowsMu.Unlock()
+	if pending == 0 {
+		return nil, nil
+	}
+
+	installed, err := f.ovsClient.DumpFlows(f.config.OVSBridge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump flows: %w", err)
+	}
+
+	present := make(map[flowKey]struct{}, len(installed))
+	for _, flow := range installed {
+		present[keyOf(flow)] = struct{}{}
+	}
+
+	now := time.Now()
+	var events []network.FlowExpiryEvent
+
+	f.timedFlowsMu.Lock()
+	for key, tf := range f.timedFlows {
+		if _, ok := present[key]; ok {
+			continue
+		}
+
+		reason := network.FlowExpiryIdle
+		if tf.rule.HardTimeout > 0 && now.Sub(tf.installedAt) >= time.Duration(tf.rule.HardTimeout)*time.Second {
+			reason = network.FlowExpiryHard
+		}
+
+		events = append(events, network.FlowExpiryEvent{
+			Bridge:      f.config.OVSBridge,
+			Cookie:      key.cookie,
+			TableID:     key.tableID,
+			Priority:    key.priority,
+			Owner:       tf.owner,
+			Reason:      reason,
+			InstalledAt: tf.installedAt,
+			ExpiredAt:   now,
+		})
+		delete(f.timedFlows, key)
+	}
+	cb := f.expiryCallback
+	f.timedFlowsMu.Unlock()
+
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	// Drop expired flows from the per-port state so later cleanup does not
+	// try to delete them again.
+	f.flowsMu.Lock()
+	for _, ev := range events {
+		flows := f.portFlows[ev.Owner]
+		for i, flow := range flows {
+			if keyOf(flow) == (flowKey{ev.Cookie, ev.TableID, ev.Priority}) {
+				f.portFlows[ev.Owner] = append(flows[:i], flows[i+1:]...)
+				break
+			}
+		}
+	}
+	f.flowsMu.Unlock()
+
+	for _, ev := range events {
+		f.logger.Info("flow expired",
+			zap.String("bridge", ev.Bridge),
+			zap.Uint64("cookie", ev.Cookie),
+			zap.Uint8("table", ev.TableID),
+			zap.String("owner", ev.Owner),
+			zap.String("reason", string(ev.Reason)),
+		)
+		if cb != nil {
+			cb(ev)
+		}
+	}
+
+	return events, nil
+}
+
+// RunExpiryReconciler periodically reconciles expired flows until ctx is done.
+func (f *FlowManager) RunExpiryReconciler(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := f.ReconcileExpiredFlows(); err != nil {
+				f.logger.Warn("failed to reconcile expired flows", zap.Error(err))
+			}
+		}
+	}
+}
+
 // Close cleans up the flow manager.
 func (f *FlowManager) Close() error {
 	// Clean up all flows if needed
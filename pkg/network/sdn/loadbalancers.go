@@ -0,0 +1,595 @@
+package sdn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/network"
+)
+
+// loadBalancerKeyPrefix holds the load balancers. The agent of the node a
+// load balancer is placed on serves its VIP and reports its status.
+const loadBalancerKeyPrefix = "/hypervisor/network/loadbalancers/"
+
+// Defaults of pool health monitors.
+const (
+	defaultMonitorInterval   = 5
+	defaultMonitorTimeout    = 5
+	defaultMonitorMaxRetries = 3
+)
+
+// CreateLoadBalancer creates a load balancer with its initial listeners.
+// The VIP is taken from the load balancer's subnet, at lb.VIPAddress if
+// given, as port lb.VIPPortID. The subnet must be attached to a distributed
+// router, through which the members are reached. Without lb.NodeID, the
+// load balancer is placed on whichever of nodes serves the fewest.
+func (c *Controller) CreateLoadBalancer(ctx context.Context, lb *network.LoadBalancer, nodes []string) error {
+	for i := range lb.Listeners {
+		if err := validateListener(&lb.Listeners[i], lb.Listeners[:i]); err != nil {
+			return err
+		}
+	}
+
+	subnet, err := c.ipam.GetSubnet(ctx, lb.SubnetID)
+	if err != nil {
+		return fmt.Errorf("subnet not found: %w", err)
+	}
+	net, err := c.GetNetwork(ctx, subnet.NetworkID)
+	if err != nil {
+		return fmt.Errorf("network not found: %w", err)
+	}
+	if net.External {
+		return network.Invalidf("subnet %s is on external network %s; put the VIP on a tenant subnet and give it a floating IP instead", subnet.ID, net.ID)
+	}
+	lb.NetworkID = net.ID
+	if lb.TenantID == "" {
+		lb.TenantID = net.TenantID
+	}
+
+	if lb.RouterID, err = c.distributedRouterOf(ctx, subnet.ID); err != nil {
+		return err
+	}
+	for _, listener := range lb.Listeners {
+		if err := c.validateMembers(ctx, lb.RouterID, listener.Pool.Members); err != nil {
+			return err
+		}
+	}
+
+	if lb.NodeID == "" {
+		if lb.NodeID, err = c.leastLoadedNode(ctx, nodes); err != nil {
+			return err
+		}
+	}
+
+	// The port allocates the requested VIP, or the next free address
+	port := &network.Port{
+		ID:             lb.VIPPortID,
+		Name:           "lb-vip-" + lb.ID,
+		NetworkID:      net.ID,
+		SubnetID:       subnet.ID,
+		IPAddress:      lb.VIPAddress,
+		LoadBalancerID: lb.ID,
+	}
+	if err := c.CreatePort(ctx, port); err != nil {
+		return fmt.Errorf("failed to create VIP port: %w", err)
+	}
+	lb.VIPAddress = port.IPAddress
+
+	lb.Status = "build"
+	lb.CreatedAt = time.Now()
+	lb.UpdatedAt = lb.CreatedAt
+	data, err := json.Marshal(lb)
+	if err == nil {
+		err = c.etcdClient.Put(ctx, loadBalancerKeyPrefix+lb.ID, string(data))
+	}
+	if err != nil {
+		c.releaseVIPPort(ctx, port.ID)
+		return fmt.Errorf("failed to store load balancer: %w", err)
+	}
+
+	c.logger.Info("created load balancer",
+		zap.String("load_balancer_id", lb.ID),
+		zap.String("vip", lb.VIPAddress),
+		zap.String("router_id", lb.RouterID),
+		zap.String("node_id", lb.NodeID),
+	)
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindLoadBalancer,
+		ObjectID: lb.ID,
+		NodeID:   lb.NodeID,
+		Reason:   "Created",
+		Message:  fmt.Sprintf("VIP %s on subnet %s with %d listeners", lb.VIPAddress, lb.SubnetID, len(lb.Listeners)),
+	})
+	return nil
+}
+
+// distributedRouterOf returns the distributed router a subnet is attached
+// to.
+func (c *Controller) distributedRouterOf(ctx context.Context, subnetID string) (string, error) {
+	interfaces, err := c.subnetInterfaces(ctx, subnetID)
+	if err != nil {
+		return "", err
+	}
+
+	c.routersMu.RLock()
+	defer c.routersMu.RUnlock()
+	for _, iface := range interfaces {
+		if router, ok := c.routers[iface.RouterID]; ok && router.Distributed {
+			return router.ID, nil
+		}
+	}
+	return "", network.Invalidf("subnet %s is not attached to a distributed router, which load balancers reach their members through", subnetID)
+}
+
+// validateMembers checks that the members of a pool are on subnets attached
+// to the load balancer's router.
+func (c *Controller) validateMembers(ctx context.Context, routerID string, members []network.LBMember) error {
+	if len(members) == 0 {
+		return nil
+	}
+	interfaces, err := c.ListRouterInterfaces(ctx, routerID)
+	if err != nil {
+		return err
+	}
+
+	var cidrs []*net.IPNet
+	for _, iface := range interfaces {
+		if _, cidr, err := net.ParseCIDR(iface.CIDR); err == nil {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	for _, member := range members {
+		ip := net.ParseIP(member.Address)
+		reachable := false
+		for _, cidr := range cidrs {
+			if cidr.Contains(ip) {
+				reachable = true
+				break
+			}
+		}
+		if !reachable {
+			return network.Invalidf("member %s is not on a subnet of router %s", member.Address, routerID)
+		}
+	}
+	return nil
+}
+
+// leastLoadedNode returns the node among nodes serving the fewest load
+// balancers.
+func (c *Controller) leastLoadedNode(ctx context.Context, nodes []string) (string, error) {
+	if len(nodes) == 0 {
+		return "", fmt.Errorf("%w: no node has finished SDN bootstrap", ErrNoLoadBalancerNode)
+	}
+	lbs, err := c.ListLoadBalancers(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	load := make(map[string]int, len(nodes))
+	for _, lb := range lbs {
+		load[lb.NodeID]++
+	}
+	return pickLeastLoaded(nodes, load), nil
+}
+
+// pickLeastLoaded returns the node among nodes with the lowest load, the
+// first by ID on a tie. nodes must not be empty.
+func pickLeastLoaded(nodes []string, load map[string]int) string {
+	sorted := append([]string(nil), nodes...)
+	sort.Strings(sorted)
+	best := sorted[0]
+	for _, node := range sorted[1:] {
+		if load[node] < load[best] {
+			best = node
+		}
+	}
+	return best
+}
+
+// validateListener checks a listener against the others of its load
+// balancer and fills in defaults.
+func validateListener(listener *network.LBListener, others []network.LBListener) error {
+	if listener.Protocol == "" {
+		listener.Protocol = "tcp"
+	}
+	if listener.Protocol != "tcp" {
+		return network.Invalidf("invalid listener protocol %q (must be tcp)", listener.Protocol)
+	}
+	if listener.Port == 0 {
+		return network.Invalidf("listener port cannot be 0")
+	}
+	for _, other := range others {
+		if other.Port == listener.Port {
+			return fmt.Errorf("%w: port %d is taken by listener %s", ErrListenerPortInUse, listener.Port, other.ID)
+		}
+	}
+	return validatePool(&listener.Pool)
+}
+
+// validatePool checks a pool and fills in defaults.
+func validatePool(pool *network.LBPool) error {
+	switch pool.Algorithm {
+	case "":
+		pool.Algorithm = network.LBRoundRobin
+	case network.LBRoundRobin, network.LBLeastConnections, network.LBSourceIP:
+	default:
+		return network.Invalidf("invalid pool algorithm %q (must be round_robin, least_connections or source_ip)", pool.Algorithm)
+	}
+	if err := validatePoolMembers(nil, pool.Members); err != nil {
+		return err
+	}
+	if pool.HealthMonitor != nil {
+		return validateHealthMonitor(pool.HealthMonitor)
+	}
+	return nil
+}
+
+// validatePoolMembers checks members to be added to a pool next to those it
+// has, and fills in their weights.
+func validatePoolMembers(existing, added []network.LBMember) error {
+	seen := make(map[string]bool, len(existing)+len(added))
+	for _, member := range existing {
+		seen[memberKey(member)] = true
+	}
+	for i := range added {
+		member := &added[i]
+		if ip := net.ParseIP(member.Address); ip == nil || ip.To4() == nil {
+			return network.Invalidf("invalid member address %q", member.Address)
+		}
+		if member.Port == 0 {
+			return network.Invalidf("port of member %s cannot be 0", member.Address)
+		}
+		if member.Weight == 0 {
+			member.Weight = 1
+		}
+		if member.Weight < 1 || member.Weight > 256 {
+			return network.Invalidf("invalid weight %d of member %s (must be 1-256)", member.Weight, memberKey(*member))
+		}
+		if seen[memberKey(*member)] {
+			return network.Invalidf("member %s is already in the pool", memberKey(*member))
+		}
+		seen[memberKey(*member)] = true
+	}
+	return nil
+}
+
+// validateHealthMonitor checks a health monitor and fills in defaults.
+func validateHealthMonitor(monitor *network.LBHealthMonitor) error {
+	if monitor.Type == "" {
+		monitor.Type = "tcp"
+	}
+	if monitor.Type != "tcp" {
+		return network.Invalidf("invalid health monitor type %q (must be tcp)", monitor.Type)
+	}
+	if monitor.Interval == 0 {
+		monitor.Interval = defaultMonitorInterval
+	}
+	if monitor.Timeout == 0 {
+		monitor.Timeout = defaultMonitorTimeout
+	}
+	if monitor.MaxRetries == 0 {
+		monitor.MaxRetries = defaultMonitorMaxRetries
+	}
+	switch {
+	case monitor.Interval < 1:
+		return network.Invalidf("health monitor interval must be at least 1 second")
+	case monitor.Timeout < 1 || monitor.Timeout > monitor.Interval:
+		return network.Invalidf("health monitor timeout must be 1-%d seconds, at most its interval", monitor.Interval)
+	case monitor.MaxRetries < 1 || monitor.MaxRetries > 10:
+		return network.Invalidf("health monitor max retries must be 1-10")
+	}
+	return nil
+}
+
+func memberKey(member network.LBMember) string {
+	return net.JoinHostPort(member.Address, fmt.Sprint(member.Port))
+}
+
+// GetLoadBalancer retrieves a load balancer by ID.
+func (c *Controller) GetLoadBalancer(ctx context.Context, lbID string) (*network.LoadBalancer, error) {
+	value, err := c.etcdClient.Get(ctx, loadBalancerKeyPrefix+lbID)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return nil, fmt.Errorf("%w: %s", ErrLoadBalancerNotFound, lbID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get load balancer: %w", err)
+	}
+
+	var lb network.LoadBalancer
+	if err := json.Unmarshal([]byte(value), &lb); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal load balancer: %w", err)
+	}
+	return &lb, nil
+}
+
+// ListLoadBalancers returns the load balancers, or those of a tenant,
+// oldest first.
+func (c *Controller) ListLoadBalancers(ctx context.Context, tenantID string) ([]*network.LoadBalancer, error) {
+	kvs, err := c.etcdClient.GetWithPrefix(ctx, loadBalancerKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list load balancers: %w", err)
+	}
+
+	lbs := make([]*network.LoadBalancer, 0, len(kvs))
+	for _, value := range kvs {
+		var lb network.LoadBalancer
+		if err := json.Unmarshal([]byte(value), &lb); err != nil {
+			continue
+		}
+		if tenantID != "" && lb.TenantID != tenantID {
+			continue
+		}
+		lbs = append(lbs, &lb)
+	}
+	sort.Slice(lbs, func(i, j int) bool {
+		return lbs[i].CreatedAt.Before(lbs[j].CreatedAt)
+	})
+	return lbs, nil
+}
+
+// DeleteLoadBalancer deletes a load balancer and releases its VIP; the
+// agent serving it tears it down.
+func (c *Controller) DeleteLoadBalancer(ctx context.Context, lbID string) error {
+	lb, err := c.GetLoadBalancer(ctx, lbID)
+	if err != nil {
+		return err
+	}
+	if err := c.etcdClient.Delete(ctx, loadBalancerKeyPrefix+lbID); err != nil {
+		return fmt.Errorf("failed to delete load balancer: %w", err)
+	}
+	c.releaseVIPPort(ctx, lb.VIPPortID)
+
+	c.logger.Info("deleted load balancer", zap.String("load_balancer_id", lbID))
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindLoadBalancer,
+		ObjectID: lbID,
+		NodeID:   lb.NodeID,
+		Reason:   "Deleted",
+		Message:  fmt.Sprintf("VIP %s released", lb.VIPAddress),
+	})
+	return nil
+}
+
+// releaseVIPPort deletes the VIP port of a deleted load balancer, logging
+// failures since the load balancer is already gone.
+func (c *Controller) releaseVIPPort(ctx context.Context, portID string) {
+	if err := c.DeletePort(ctx, portID); err != nil && !errors.Is(err, ErrPortNotFound) {
+		c.logger.Warn("failed to delete VIP port",
+			zap.String("port_id", portID),
+			zap.Error(err),
+		)
+	}
+}
+
+// vipOwner returns the load balancer holding the VIP of a port, or nil.
+func (c *Controller) vipOwner(ctx context.Context, port *network.Port) (*network.LoadBalancer, error) {
+	if port.LoadBalancerID == "" {
+		return nil, nil
+	}
+	lb, err := c.GetLoadBalancer(ctx, port.LoadBalancerID)
+	if errors.Is(err, ErrLoadBalancerNotFound) {
+		return nil, nil
+	}
+	return lb, err
+}
+
+// subnetVIPs returns the load balancers whose VIP is on a subnet.
+func (c *Controller) subnetVIPs(ctx context.Context, subnetID string) ([]*network.LoadBalancer, error) {
+	lbs, err := c.ListLoadBalancers(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var onSubnet []*network.LoadBalancer
+	for _, lb := range lbs {
+		if lb.SubnetID == subnetID {
+			onSubnet = append(onSubnet, lb)
+		}
+	}
+	return onSubnet, nil
+}
+
+// AddListener adds a listener to a load balancer.
+func (c *Controller) AddListener(ctx context.Context, lbID string, listener *network.LBListener) (*network.LoadBalancer, error) {
+	lb, err := c.GetLoadBalancer(ctx, lbID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateListener(listener, lb.Listeners); err != nil {
+		return nil, err
+	}
+	if err := c.validateMembers(ctx, lb.RouterID, listener.Pool.Members); err != nil {
+		return nil, err
+	}
+
+	updated, err := c.modifyLoadBalancer(ctx, lbID, func(lb *network.LoadBalancer) error {
+		if err := validateListener(listener, lb.Listeners); err != nil {
+			return err
+		}
+		lb.Listeners = append(lb.Listeners, *listener)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.recordLoadBalancerEvent(ctx, updated, "ListenerAdded",
+		fmt.Sprintf("listener %s on port %d with %d members", listener.ID, listener.Port, len(listener.Pool.Members)))
+	return updated, nil
+}
+
+// RemoveListener removes a listener from a load balancer.
+func (c *Controller) RemoveListener(ctx context.Context, lbID, listenerID string) (*network.LoadBalancer, error) {
+	updated, err := c.modifyLoadBalancer(ctx, lbID, func(lb *network.LoadBalancer) error {
+		i, err := findListener(lb, listenerID)
+		if err != nil {
+			return err
+		}
+		lb.Listeners = append(lb.Listeners[:i], lb.Listeners[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.recordLoadBalancerEvent(ctx, updated, "ListenerRemoved", fmt.Sprintf("listener %s removed", listenerID))
+	return updated, nil
+}
+
+// AddPoolMembers adds members to the pool of a listener.
+func (c *Controller) AddPoolMembers(ctx context.Context, lbID, listenerID string, members []network.LBMember) (*network.LoadBalancer, error) {
+	lb, err := c.GetLoadBalancer(ctx, lbID)
+	if err != nil {
+		return nil, err
+	}
+	i, err := findListener(lb, listenerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePoolMembers(lb.Listeners[i].Pool.Members, members); err != nil {
+		return nil, err
+	}
+	if err := c.validateMembers(ctx, lb.RouterID, members); err != nil {
+		return nil, err
+	}
+
+	updated, err := c.modifyLoadBalancer(ctx, lbID, func(lb *network.LoadBalancer) error {
+		i, err := findListener(lb, listenerID)
+		if err != nil {
+			return err
+		}
+		pool := &lb.Listeners[i].Pool
+		if err := validatePoolMembers(pool.Members, members); err != nil {
+			return err
+		}
+		pool.Members = append(pool.Members, members...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.recordLoadBalancerEvent(ctx, updated, "MembersAdded", fmt.Sprintf("%d members added to listener %s", len(members), listenerID))
+	return updated, nil
+}
+
+// RemovePoolMembers removes members, matched by address and port, from the
+// pool of a listener.
+func (c *Controller) RemovePoolMembers(ctx context.Context, lbID, listenerID string, members []network.LBMember) (*network.LoadBalancer, error) {
+	remove := make(map[string]bool, len(members))
+	for _, member := range members {
+		remove[memberKey(member)] = true
+	}
+
+	updated, err := c.modifyLoadBalancer(ctx, lbID, func(lb *network.LoadBalancer) error {
+		i, err := findListener(lb, listenerID)
+		if err != nil {
+			return err
+		}
+		pool := &lb.Listeners[i].Pool
+		kept := make([]network.LBMember, 0, len(pool.Members))
+		for _, member := range pool.Members {
+			if !remove[memberKey(member)] {
+				kept = append(kept, member)
+			}
+		}
+		if len(pool.Members)-len(kept) != len(remove) {
+			return fmt.Errorf("%w: not every member given is in the pool of listener %s", ErrMemberNotFound, listenerID)
+		}
+		pool.Members = kept
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.recordLoadBalancerEvent(ctx, updated, "MembersRemoved", fmt.Sprintf("%d members removed from listener %s", len(remove), listenerID))
+	return updated, nil
+}
+
+// SetHealthMonitor sets or, with a nil monitor, removes the health monitor
+// of a listener's pool.
+func (c *Controller) SetHealthMonitor(ctx context.Context, lbID, listenerID string, monitor *network.LBHealthMonitor) (*network.LoadBalancer, error) {
+	if monitor != nil {
+		if err := validateHealthMonitor(monitor); err != nil {
+			return nil, err
+		}
+	}
+
+	updated, err := c.modifyLoadBalancer(ctx, lbID, func(lb *network.LoadBalancer) error {
+		i, err := findListener(lb, listenerID)
+		if err != nil {
+			return err
+		}
+		lb.Listeners[i].Pool.HealthMonitor = monitor
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	message := fmt.Sprintf("health monitor of listener %s removed", listenerID)
+	if monitor != nil {
+		message = fmt.Sprintf("listener %s checks members every %ds", listenerID, monitor.Interval)
+	}
+	c.recordLoadBalancerEvent(ctx, updated, "HealthMonitorSet", message)
+	return updated, nil
+}
+
+func findListener(lb *network.LoadBalancer, listenerID string) (int, error) {
+	for i, listener := range lb.Listeners {
+		if listener.ID == listenerID {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%w: %s on load balancer %s", ErrListenerNotFound, listenerID, lb.ID)
+}
+
+// modifyLoadBalancer atomically updates a load balancer in etcd, marking it
+// for the agent serving it to apply again. fn may be called more than once,
+// with the latest version of the load balancer.
+func (c *Controller) modifyLoadBalancer(ctx context.Context, lbID string, fn func(*network.LoadBalancer) error) (*network.LoadBalancer, error) {
+	var lb network.LoadBalancer
+	_, err := c.etcdClient.Modify(ctx, loadBalancerKeyPrefix+lbID, func(value string) (string, error) {
+		lb = network.LoadBalancer{}
+		if err := json.Unmarshal([]byte(value), &lb); err != nil {
+			return "", fmt.Errorf("failed to unmarshal load balancer: %w", err)
+		}
+		if err := fn(&lb); err != nil {
+			return "", err
+		}
+		lb.Status = "build"
+		lb.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(&lb)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal load balancer: %w", err)
+		}
+		return string(data), nil
+	})
+	if errors.Is(err, etcd.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrLoadBalancerNotFound, lbID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lb, nil
+}
+
+// recordLoadBalancerEvent records an event about a load balancer.
+func (c *Controller) recordLoadBalancerEvent(ctx context.Context, lb *network.LoadBalancer, reason, message string) {
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindLoadBalancer,
+		ObjectID: lb.ID,
+		NodeID:   lb.NodeID,
+		Reason:   reason,
+		Message:  message,
+	})
+}
@@ -0,0 +1,153 @@
+package sdn
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/network"
+)
+
+// macKeyPrefix holds a key per MAC address given to a port, naming the port,
+// so that MACs are unique across the cluster even under concurrent creates.
+const macKeyPrefix = "/hypervisor/network/macs/"
+
+// macPrefix is the OUI of generated MACs (OpenStack style). Its first byte
+// has the locally administered bit set and the multicast bit clear.
+var macPrefix = [3]byte{0xfa, 0x16, 0x3e}
+
+// macAttempts is how many random MACs are tried before giving up; with 2^24
+// MACs per prefix, running out of attempts means the prefix is nearly full.
+const macAttempts = 16
+
+// prepareMAC claims the MAC of a new port in etcd, generating a random one
+// if the port has none. A requested MAC is normalized and must be a unicast
+// Ethernet address.
+func (c *Controller) prepareMAC(ctx context.Context, port *network.Port) error {
+	if port.MACAddress != "" {
+		mac, err := parseUnicastMAC(port.MACAddress)
+		if err != nil {
+			return err
+		}
+		port.MACAddress = mac
+		ok, err := c.claimMAC(ctx, mac, port.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrMACInUse, mac)
+		}
+		return nil
+	}
+
+	for range macAttempts {
+		mac, err := generateMAC()
+		if err != nil {
+			return err
+		}
+		ok, err := c.claimMAC(ctx, mac, port.ID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			port.MACAddress = mac
+			return nil
+		}
+	}
+	return fmt.Errorf("%w after %d attempts", ErrNoFreeMAC, macAttempts)
+}
+
+// claimMAC claims mac for a port unless another port holds it. A claim
+// already held by the port succeeds.
+func (c *Controller) claimMAC(ctx context.Context, mac, portID string) (bool, error) {
+	key := macKeyPrefix + mac
+	resp, err := c.etcdClient.Raw().Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, portID)).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim MAC %s: %w", mac, err)
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	return len(kvs) > 0 && string(kvs[0].Value) == portID, nil
+}
+
+// releaseMAC releases the MAC of a port, if the port holds it.
+func (c *Controller) releaseMAC(ctx context.Context, port *network.Port) {
+	if port.MACAddress == "" {
+		return
+	}
+	key := macKeyPrefix + port.MACAddress
+	_, err := c.etcdClient.Raw().Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", port.ID)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		c.logger.Warn("failed to release MAC",
+			zap.String("mac_address", port.MACAddress),
+			zap.String("port_id", port.ID),
+			zap.Error(err),
+		)
+	}
+}
+
+// claimExistingMACs claims the MACs of ports created before MACs were
+// claimed, so that generation cannot hand them out again.
+func (c *Controller) claimExistingMACs(ctx context.Context, ports []*network.Port) {
+	for _, port := range ports {
+		if port.MACAddress == "" {
+			continue
+		}
+		ok, err := c.claimMAC(ctx, port.MACAddress, port.ID)
+		if err != nil {
+			c.logger.Warn("failed to claim MAC of existing port",
+				zap.String("mac_address", port.MACAddress),
+				zap.String("port_id", port.ID),
+				zap.Error(err),
+			)
+			continue
+		}
+		if !ok {
+			c.logger.Warn("existing port shares its MAC with another port",
+				zap.String("mac_address", port.MACAddress),
+				zap.String("port_id", port.ID),
+			)
+		}
+	}
+}
+
+// generateMAC generates a random MAC address under macPrefix.
+func generateMAC() (string, error) {
+	var suffix [3]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", fmt.Errorf("failed to generate MAC: %w", err)
+	}
+	mac := net.HardwareAddr{macPrefix[0], macPrefix[1], macPrefix[2], suffix[0], suffix[1], suffix[2]}
+	return mac.String(), nil
+}
+
+// parseUnicastMAC parses an Ethernet MAC and returns it in canonical form.
+func parseUnicastMAC(s string) (string, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return "", network.Invalidf("invalid MAC address %q: %v", s, err)
+	}
+	if len(mac) != 6 {
+		return "", network.Invalidf("invalid MAC address %q: not an Ethernet MAC", s)
+	}
+	if mac[0]&0x01 != 0 {
+		return "", network.Invalidf("invalid MAC address %q: multicast", s)
+	}
+	if mac.String() == "00:00:00:00:00:00" {
+		return "", network.Invalidf("invalid MAC address %q: all zeros", s)
+	}
+	return mac.String(), nil
+}
@@ -0,0 +1,205 @@
+package sdn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/network"
+)
+
+// mirrorKeyPrefix holds the port mirrors. The network agent of the node the
+// source port is bound to applies them to its integration bridge and reports
+// their status.
+const mirrorKeyPrefix = "/hypervisor/network/mirrors/"
+
+// CreateMirror validates and stores a port mirror. The target port, if
+// any, must be bound to the same node as the source port, since a mirror
+// can only output to a port of the same bridge; a remote collector is
+// reached over a tunnel instead.
+func (c *Controller) CreateMirror(ctx context.Context, mirror *network.PortMirror) error {
+	if mirror.Direction == "" {
+		mirror.Direction = network.MirrorBoth
+	}
+	switch mirror.Direction {
+	case network.MirrorIngress, network.MirrorEgress, network.MirrorBoth:
+	default:
+		return network.Invalidf("invalid mirror direction %q (must be ingress, egress or both)", mirror.Direction)
+	}
+
+	source, err := c.GetPort(ctx, mirror.SourcePortID)
+	if err != nil {
+		return err
+	}
+	if bypassesBridge(source) {
+		return network.Invalidf("port %s bypasses the bridge and cannot be mirrored", source.ID)
+	}
+
+	switch {
+	case mirror.TargetPortID != "" && mirror.Tunnel != nil:
+		return network.Invalidf("a mirror has either a target port or a tunnel, not both")
+	case mirror.TargetPortID != "":
+		if mirror.TargetPortID == mirror.SourcePortID {
+			return network.Invalidf("a port cannot be mirrored to itself")
+		}
+		target, err := c.GetPort(ctx, mirror.TargetPortID)
+		if err != nil {
+			return err
+		}
+		if bypassesBridge(target) {
+			return network.Invalidf("port %s bypasses the bridge and cannot receive mirrored traffic", target.ID)
+		}
+		if source.NodeID != "" && target.NodeID != "" && source.NodeID != target.NodeID {
+			return network.Invalidf("target port %s is bound to node %s, not to node %s of the source port; mirror to a tunnel instead",
+				target.ID, target.NodeID, source.NodeID)
+		}
+	case mirror.Tunnel != nil:
+		if err := validateMirrorTunnel(mirror.Tunnel); err != nil {
+			return err
+		}
+	default:
+		return network.Invalidf("a mirror needs a target port or a tunnel")
+	}
+
+	mirror.Status = "build"
+	mirror.CreatedAt = time.Now()
+	mirror.UpdatedAt = mirror.CreatedAt
+
+	data, err := json.Marshal(mirror)
+	if err != nil {
+		return fmt.Errorf("failed to marshal mirror: %w", err)
+	}
+	if err := c.etcdClient.Put(ctx, mirrorKeyPrefix+mirror.ID, string(data)); err != nil {
+		return fmt.Errorf("failed to store mirror: %w", err)
+	}
+
+	c.logger.Info("created port mirror",
+		zap.String("mirror_id", mirror.ID),
+		zap.String("source_port_id", mirror.SourcePortID),
+		zap.String("direction", string(mirror.Direction)),
+	)
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindPort,
+		ObjectID: mirror.SourcePortID,
+		NodeID:   source.NodeID,
+		Reason:   "MirrorCreated",
+		Message:  fmt.Sprintf("mirror %s copies %s traffic to %s", mirror.ID, mirror.Direction, mirrorTargetString(mirror)),
+	})
+	return nil
+}
+
+func validateMirrorTunnel(tunnel *network.MirrorTunnel) error {
+	switch tunnel.Type {
+	case "gre":
+	case "vxlan":
+		if tunnel.Key > 16777215 {
+			return network.Invalidf("invalid mirror tunnel VNI %d (must be 0-16777215)", tunnel.Key)
+		}
+	default:
+		return network.Invalidf("invalid mirror tunnel type %q (must be gre or vxlan)", tunnel.Type)
+	}
+	if net.ParseIP(tunnel.RemoteIP) == nil {
+		return network.Invalidf("invalid mirror tunnel remote IP %q", tunnel.RemoteIP)
+	}
+	return nil
+}
+
+// GetMirror retrieves a port mirror by ID.
+func (c *Controller) GetMirror(ctx context.Context, mirrorID string) (*network.PortMirror, error) {
+	value, err := c.etcdClient.Get(ctx, mirrorKeyPrefix+mirrorID)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return nil, fmt.Errorf("%w: %s", ErrMirrorNotFound, mirrorID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mirror: %w", err)
+	}
+
+	var mirror network.PortMirror
+	if err := json.Unmarshal([]byte(value), &mirror); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal mirror: %w", err)
+	}
+	return &mirror, nil
+}
+
+// ListMirrors returns the port mirrors, or those a port is the source or
+// target of, oldest first.
+func (c *Controller) ListMirrors(ctx context.Context, portID string) ([]*network.PortMirror, error) {
+	kvs, err := c.etcdClient.GetWithPrefix(ctx, mirrorKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mirrors: %w", err)
+	}
+
+	mirrors := make([]*network.PortMirror, 0, len(kvs))
+	for _, value := range kvs {
+		var mirror network.PortMirror
+		if err := json.Unmarshal([]byte(value), &mirror); err != nil {
+			continue
+		}
+		if portID != "" && mirror.SourcePortID != portID && mirror.TargetPortID != portID {
+			continue
+		}
+		mirrors = append(mirrors, &mirror)
+	}
+	sort.Slice(mirrors, func(i, j int) bool {
+		return mirrors[i].CreatedAt.Before(mirrors[j].CreatedAt)
+	})
+	return mirrors, nil
+}
+
+// DeleteMirror deletes a port mirror; the agent applying it removes it
+// from the bridge.
+func (c *Controller) DeleteMirror(ctx context.Context, mirrorID string) error {
+	mirror, err := c.GetMirror(ctx, mirrorID)
+	if err != nil {
+		return err
+	}
+	if err := c.etcdClient.Delete(ctx, mirrorKeyPrefix+mirrorID); err != nil {
+		return fmt.Errorf("failed to delete mirror: %w", err)
+	}
+
+	c.logger.Info("deleted port mirror", zap.String("mirror_id", mirrorID))
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindPort,
+		ObjectID: mirror.SourcePortID,
+		Reason:   "MirrorDeleted",
+		Message:  fmt.Sprintf("mirror %s to %s deleted", mirror.ID, mirrorTargetString(mirror)),
+	})
+	return nil
+}
+
+// deletePortMirrors deletes the mirrors a deleted port was the source or
+// target of.
+func (c *Controller) deletePortMirrors(ctx context.Context, portID string) {
+	mirrors, err := c.ListMirrors(ctx, portID)
+	if err != nil {
+		c.logger.Warn("failed to list mirrors of deleted port",
+			zap.String("port_id", portID),
+			zap.Error(err),
+		)
+		return
+	}
+	for _, mirror := range mirrors {
+		if err := c.DeleteMirror(ctx, mirror.ID); err != nil && !errors.Is(err, ErrMirrorNotFound) {
+			c.logger.Warn("failed to delete mirror of deleted port",
+				zap.String("port_id", portID),
+				zap.String("mirror_id", mirror.ID),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func mirrorTargetString(mirror *network.PortMirror) string {
+	if mirror.Tunnel != nil {
+		return fmt.Sprintf("%s tunnel to %s", mirror.Tunnel.Type, mirror.Tunnel.RemoteIP)
+	}
+	return "port " + mirror.TargetPortID
+}
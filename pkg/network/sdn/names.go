@@ -0,0 +1,161 @@
+package sdn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+// nameKeyPrefix holds a key per named network, subnet and port, naming its
+// ID, so that names are unique within a tenant even under concurrent
+// creates.
+const nameKeyPrefix = "/hypervisor/network/names/"
+
+// Kinds of named resources. Each has its own namespace of names.
+const (
+	NameKindNetwork = "networks"
+	NameKindSubnet  = "subnets"
+	NameKindPort    = "ports"
+)
+
+// nameClaims returns the claims of names within the tenant for the
+// resource id, taken in the write that stores the resource. Empty names are
+// not claimed.
+func nameClaims(kind, tenantID, id string, names ...string) []etcd.Claim {
+	var claims []etcd.Claim
+	for _, name := range names {
+		if name != "" {
+			claims = append(claims, etcd.Claim{Key: nameKey(kind, tenantID, name), Owner: id})
+		}
+	}
+	return claims
+}
+
+// nameInUse returns ErrNameInUse for the one of names whose claim err
+// reports held by another resource, and other errors as is.
+func nameInUse(err error, kind, tenantID string, names ...string) error {
+	var claimed *etcd.ClaimedError
+	if !errors.As(err, &claimed) {
+		return err
+	}
+	for _, name := range names {
+		if nameKey(kind, tenantID, name) == claimed.Key {
+			return fmt.Errorf("%w: %s %q", ErrNameInUse, kind, name)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNameInUse, kind)
+}
+
+// releaseName releases a name claim, if id holds it.
+func (c *Controller) releaseName(ctx context.Context, kind, tenantID, name, id string) {
+	if name == "" {
+		return
+	}
+	key := nameKey(kind, tenantID, name)
+	_, err := c.etcdClient.Raw().Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", id)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		c.logger.Warn("failed to release name",
+			zap.String("kind", kind),
+			zap.String("name", name),
+			zap.String("id", id),
+			zap.Error(err),
+		)
+	}
+}
+
+// LookupName returns the ID of the resource of the given kind holding name
+// within the tenant.
+func (c *Controller) LookupName(ctx context.Context, kind, tenantID, name string) (string, error) {
+	id, err := c.etcdClient.Get(ctx, nameKey(kind, tenantID, name))
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && id == "") {
+		return "", fmt.Errorf("%w: %s %q", ErrNameNotFound, kind, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up name %q: %w", name, err)
+	}
+	return id, nil
+}
+
+// networkTenant returns the tenant of a network, which subnets and ports on
+// it share their names with, read from etcd as this server's cache may not
+// have caught up. A missing network has no tenant.
+func (c *Controller) networkTenant(ctx context.Context, networkID string) string {
+	net, err := c.loadNetwork(ctx, networkID)
+	if err != nil {
+		return ""
+	}
+	return net.TenantID
+}
+
+// resourceTenant returns the tenant a subnet or port claimed its name in:
+// the one stored with it, or for those stored before tenants were, that of
+// its network.
+func (c *Controller) resourceTenant(ctx context.Context, tenantID, networkID string) string {
+	if tenantID != "" {
+		return tenantID
+	}
+	return c.networkTenant(ctx, networkID)
+}
+
+// portName returns the name a port claims. Ports of routers are named after
+// their router, which may have several, so they claim none.
+func portName(port *network.Port) string {
+	if port.RouterID != "" {
+		return ""
+	}
+	return port.Name
+}
+
+// namedResource is a resource whose name is claimed.
+type namedResource struct {
+	kind     string
+	tenantID string
+	name     string
+	id       string
+}
+
+// claimExistingNames claims the names of resources created before names
+// were claimed. Duplicates among them keep working, but only the first
+// holds the name.
+func (c *Controller) claimExistingNames(ctx context.Context, resources []namedResource) {
+	for _, r := range resources {
+		if r.name == "" {
+			continue
+		}
+		key := nameKey(r.kind, r.tenantID, r.name)
+		created, err := c.etcdClient.CreateIfNotExists(ctx, key, r.id)
+		if err != nil {
+			c.logger.Warn("failed to claim name of existing resource",
+				zap.String("kind", r.kind),
+				zap.String("name", r.name),
+				zap.String("id", r.id),
+				zap.Error(err),
+			)
+			continue
+		}
+		if !created {
+			if owner, _ := c.etcdClient.Get(ctx, key); owner != r.id {
+				c.logger.Warn("existing resource shares its name with another",
+					zap.String("kind", r.kind),
+					zap.String("name", r.name),
+					zap.String("id", r.id),
+					zap.String("owner", owner),
+				)
+			}
+		}
+	}
+}
+
+func nameKey(kind, tenantID, name string) string {
+	return nameKeyPrefix + kind + "/" + url.PathEscape(tenantID) + "/" + url.PathEscape(name)
+}
@@ -0,0 +1,76 @@
+package sdn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+// normalizeQoS validates the bandwidth limits of a port. Limits that limit
+// nothing are dropped.
+func normalizeQoS(qos *network.PortQoS) (*network.PortQoS, error) {
+	if qos.IsZero() {
+		if qos != nil && (qos.IngressBurstKb > 0 || qos.EgressBurstKb > 0) {
+			return nil, network.Invalidf("QoS burst requires a rate in the same direction")
+		}
+		return nil, nil
+	}
+	if qos.IngressRateKbps == 0 && qos.IngressBurstKb > 0 {
+		return nil, network.Invalidf("QoS ingress burst requires an ingress rate")
+	}
+	if qos.EgressRateKbps == 0 && qos.EgressBurstKb > 0 {
+		return nil, network.Invalidf("QoS egress burst requires an egress rate")
+	}
+	copied := *qos
+	return &copied, nil
+}
+
+// SetPortQoS replaces the bandwidth limits of a port; nil removes them. The
+// network agent of the node the port is bound to applies the change.
+func (c *Controller) SetPortQoS(ctx context.Context, portID string, qos *network.PortQoS) (*network.Port, error) {
+	qos, err := normalizeQoS(qos)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated network.Port
+	_, err = c.etcdClient.Modify(ctx, PortKeyPrefix+portID, func(value string) (string, error) {
+		if err := json.Unmarshal([]byte(value), &updated); err != nil {
+			return "", fmt.Errorf("failed to unmarshal port: %w", err)
+		}
+		if err := validateBindingQoS(&updated, qos); err != nil {
+			return "", err
+		}
+		updated.QoS = qos
+		updated.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(&updated)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal port: %w", err)
+		}
+		return string(data), nil
+	})
+	if errors.Is(err, etcd.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrPortNotFound, portID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update port QoS: %w", err)
+	}
+
+	c.portsMu.Lock()
+	c.ports[portID] = &updated
+	c.portsMu.Unlock()
+
+	c.logger.Info("set port QoS",
+		zap.String("port_id", portID),
+		zap.Bool("limited", qos != nil),
+	)
+	return &updated, nil
+}
@@ -0,0 +1,624 @@
+package sdn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/network"
+)
+
+// routerInterfaceKeyPrefix is the etcd key prefix for router interfaces,
+// stored as <prefix><router-id>/<subnet-id>.
+const routerInterfaceKeyPrefix = "/hypervisor/network/router-interfaces/"
+
+// RouterProgrammer programs routers and the NAT of their floating IPs on a
+// host, as the DVR does.
+type RouterProgrammer interface {
+	ApplyRouter(router *network.Router)
+	RemoveRouter(routerID string)
+	SetupDNAT(ctx context.Context, routerID, floatingIP, fixedIP string) error
+	RemoveDNAT(ctx context.Context, routerID, floatingIP, fixedIP string) error
+}
+
+// CreateRouter creates a router. If the router has an external gateway, its
+// gateway port is allocated using gatewayPortID.
+func (c *Controller) CreateRouter(ctx context.Context, router *network.Router, gatewayPortID string) error {
+	if router.Name == "" {
+		return network.Invalidf("router name is required")
+	}
+
+	c.routersMu.Lock()
+	defer c.routersMu.Unlock()
+
+	if _, exists := c.routers[router.ID]; exists {
+		return fmt.Errorf("%w: %s", ErrRouterExists, router.ID)
+	}
+
+	router.AdminState = true
+	router.Status = "active"
+	router.CreatedAt = time.Now()
+	router.UpdatedAt = router.CreatedAt
+
+	// Allocate the gateway port before the router becomes visible
+	if gw := router.ExternalGatewayInfo; gw != nil {
+		router.ExternalGatewayInfo = nil
+		newGW, err := c.allocateGateway(ctx, router, gw.NetworkID, gw.EnableSNAT, gatewayPortID)
+		if err != nil {
+			return err
+		}
+		router.ExternalGatewayInfo = newGW
+	}
+
+	if err := c.storeRouter(ctx, router); err != nil {
+		if router.ExternalGatewayInfo != nil {
+			c.releaseRouterPort(ctx, router.ExternalGatewayInfo.PortID)
+		}
+		return err
+	}
+	c.routers[router.ID] = router
+	c.programRouter(router)
+
+	c.logger.Info("created router",
+		zap.String("router_id", router.ID),
+		zap.String("name", router.Name),
+		zap.Bool("distributed", router.Distributed),
+	)
+	c.recordRouterEvent(ctx, router.ID, "Created", fmt.Sprintf("created router %s", router.Name))
+
+	return nil
+}
+
+// GetRouter retrieves a router by ID.
+func (c *Controller) GetRouter(ctx context.Context, routerID string) (*network.Router, error) {
+	c.routersMu.RLock()
+	defer c.routersMu.RUnlock()
+
+	router, exists := c.routers[routerID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrRouterNotFound, routerID)
+	}
+	return router, nil
+}
+
+// ListRouters returns all routers, optionally of one tenant.
+func (c *Controller) ListRouters(ctx context.Context, tenantID string) ([]*network.Router, error) {
+	c.routersMu.RLock()
+	defer c.routersMu.RUnlock()
+
+	routers := make([]*network.Router, 0, len(c.routers))
+	for _, router := range c.routers {
+		if tenantID == "" || router.TenantID == tenantID {
+			routers = append(routers, router)
+		}
+	}
+	return routers, nil
+}
+
+// DeleteRouter deletes a router and its gateway port. Routers with subnet
+// interfaces or VPN services cannot be deleted.
+func (c *Controller) DeleteRouter(ctx context.Context, routerID string) error {
+	c.routersMu.Lock()
+	defer c.routersMu.Unlock()
+
+	router, exists := c.routers[routerID]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrRouterNotFound, routerID)
+	}
+
+	interfaces, err := c.ListRouterInterfaces(ctx, routerID)
+	if err != nil {
+		return err
+	}
+	if len(interfaces) > 0 {
+		return fmt.Errorf("%w (%d), remove them before deleting it", ErrRouterHasInterfaces, len(interfaces))
+	}
+	if err := c.checkRouterHasNoVPNs(ctx, routerID, "deleting the router"); err != nil {
+		return err
+	}
+
+	if err := c.etcdClient.Delete(ctx, routerKeyPrefix+routerID); err != nil {
+		return fmt.Errorf("failed to delete router: %w", err)
+	}
+	delete(c.routers, routerID)
+	c.unprogramRouter(routerID)
+
+	if router.ExternalGatewayInfo != nil {
+		c.releaseRouterPort(ctx, router.ExternalGatewayInfo.PortID)
+	}
+
+	c.logger.Info("deleted router", zap.String("router_id", routerID))
+	c.recordRouterEvent(ctx, routerID, "Deleted", "")
+
+	return nil
+}
+
+// AddRouterInterface attaches a subnet to a router. The interface port takes
+// the subnet's gateway IP, or an IP allocated from the subnet if it has none.
+func (c *Controller) AddRouterInterface(ctx context.Context, routerID, subnetID, portID string) (*network.RouterInterface, error) {
+	c.routersMu.Lock()
+	defer c.routersMu.Unlock()
+
+	router, exists := c.routers[routerID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrRouterNotFound, routerID)
+	}
+
+	subnet, err := c.ipam.GetSubnet(ctx, subnetID)
+	if err != nil {
+		return nil, fmt.Errorf("subnet not found: %w", err)
+	}
+	net, err := c.GetNetwork(ctx, subnet.NetworkID)
+	if err != nil {
+		return nil, fmt.Errorf("network not found: %w", err)
+	}
+	if net.External {
+		return nil, network.Invalidf("subnet %s is on external network %s, use it as the router gateway instead", subnetID, net.ID)
+	}
+
+	// A subnet has a single gateway, so only one router may serve it
+	for _, other := range c.routers {
+		if _, err := c.getRouterInterface(ctx, other.ID, subnetID); err == nil {
+			return nil, fmt.Errorf("%w: subnet %s, router %s", ErrSubnetAttached, subnetID, other.ID)
+		} else if !errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, err
+		}
+	}
+	if err := c.checkSubnetNotRemote(ctx, routerID, subnet.CIDR); err != nil {
+		return nil, err
+	}
+
+	port := &network.Port{
+		ID:        portID,
+		Name:      "router-interface-" + routerID,
+		NetworkID: subnet.NetworkID,
+		SubnetID:  subnetID,
+		IPAddress: subnet.GatewayIP,
+		RouterID:  routerID,
+	}
+	if err := c.CreatePort(ctx, port); err != nil {
+		return nil, fmt.Errorf("failed to create interface port: %w", err)
+	}
+
+	iface := &network.RouterInterface{
+		ID:         portID,
+		RouterID:   routerID,
+		SubnetID:   subnetID,
+		PortID:     portID,
+		NetworkID:  subnet.NetworkID,
+		IPAddress:  port.IPAddress,
+		MACAddress: port.MACAddress,
+		CIDR:       subnet.CIDR,
+		VNI:        net.VNI,
+		MTU:        net.MTU,
+		CreatedAt:  time.Now(),
+	}
+
+	data, err := json.Marshal(iface)
+	if err != nil {
+		c.releaseRouterPort(ctx, portID)
+		return nil, fmt.Errorf("failed to marshal router interface: %w", err)
+	}
+	if err := c.etcdClient.Put(ctx, routerInterfaceKey(routerID, subnetID), string(data)); err != nil {
+		c.releaseRouterPort(ctx, portID)
+		return nil, fmt.Errorf("failed to store router interface: %w", err)
+	}
+
+	c.logger.Info("added router interface",
+		zap.String("router_id", routerID),
+		zap.String("subnet_id", subnetID),
+		zap.String("ip", iface.IPAddress),
+	)
+	c.recordRouterEvent(ctx, routerID, "InterfaceAdded",
+		fmt.Sprintf("attached subnet %s (%s) to router %s as %s", subnetID, subnet.CIDR, router.Name, iface.IPAddress))
+
+	return iface, nil
+}
+
+// RemoveRouterInterface detaches a subnet from a router and deletes the
+// interface port.
+func (c *Controller) RemoveRouterInterface(ctx context.Context, routerID, subnetID string) error {
+	c.routersMu.Lock()
+	defer c.routersMu.Unlock()
+
+	if _, exists := c.routers[routerID]; !exists {
+		return fmt.Errorf("%w: %s", ErrRouterNotFound, routerID)
+	}
+
+	iface, err := c.getRouterInterface(ctx, routerID, subnetID)
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return fmt.Errorf("%w: router %s has none on subnet %s", ErrRouterInterfaceNotFound, routerID, subnetID)
+		}
+		return err
+	}
+
+	// Load balancers reach their members through the router of their VIP
+	lbs, err := c.subnetVIPs(ctx, subnetID)
+	if err != nil {
+		return err
+	}
+	for _, lb := range lbs {
+		if lb.RouterID == routerID {
+			return fmt.Errorf("%w: load balancer %s, delete it before detaching the subnet", ErrSubnetHasVIPs, lb.ID)
+		}
+	}
+
+	if err := c.etcdClient.Delete(ctx, routerInterfaceKey(routerID, subnetID)); err != nil {
+		return fmt.Errorf("failed to delete router interface: %w", err)
+	}
+	c.releaseRouterPort(ctx, iface.PortID)
+
+	c.logger.Info("removed router interface",
+		zap.String("router_id", routerID),
+		zap.String("subnet_id", subnetID),
+	)
+	c.recordRouterEvent(ctx, routerID, "InterfaceRemoved", fmt.Sprintf("detached subnet %s", subnetID))
+
+	return nil
+}
+
+// ListRouterInterfaces returns the subnet interfaces of a router.
+func (c *Controller) ListRouterInterfaces(ctx context.Context, routerID string) ([]*network.RouterInterface, error) {
+	kvs, err := c.etcdClient.GetWithPrefixKV(ctx, routerInterfaceKeyPrefix+routerID+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list router interfaces: %w", err)
+	}
+
+	interfaces := make([]*network.RouterInterface, 0, len(kvs))
+	for _, kv := range kvs {
+		var iface network.RouterInterface
+		if err := json.Unmarshal([]byte(kv.Value), &iface); err != nil {
+			c.logger.Warn("failed to unmarshal router interface", zap.Error(err))
+			continue
+		}
+		interfaces = append(interfaces, &iface)
+	}
+	return interfaces, nil
+}
+
+// SubnetRouters returns the IDs of routers with an interface on a subnet.
+func (c *Controller) SubnetRouters(ctx context.Context, subnetID string) ([]string, error) {
+	interfaces, err := c.subnetInterfaces(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+
+	routerIDs := make([]string, len(interfaces))
+	for i, iface := range interfaces {
+		routerIDs[i] = iface.RouterID
+	}
+	return routerIDs, nil
+}
+
+// ConnectingRouter returns the interfaces of a router attached to both
+// subnets, on the source subnet and on the destination one, or
+// ErrRouterNotFound if no router connects them.
+func (c *Controller) ConnectingRouter(ctx context.Context, srcSubnetID, dstSubnetID string) (*network.RouterInterface, *network.RouterInterface, error) {
+	srcInterfaces, err := c.subnetInterfaces(ctx, srcSubnetID)
+	if err != nil {
+		return nil, nil, err
+	}
+	dstInterfaces, err := c.subnetInterfaces(ctx, dstSubnetID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, src := range srcInterfaces {
+		for _, dst := range dstInterfaces {
+			if src.RouterID == dst.RouterID {
+				return src, dst, nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: none connects subnets %s and %s", ErrRouterNotFound, srcSubnetID, dstSubnetID)
+}
+
+// UpdateSubnetInterfaces records a subnet's new CIDR on the router
+// interfaces attached to it, so each node's DVR re-addresses them. It returns
+// the IDs of the updated routers.
+func (c *Controller) UpdateSubnetInterfaces(ctx context.Context, subnet *network.Subnet) ([]string, error) {
+	interfaces, err := c.subnetInterfaces(ctx, subnet.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var routerIDs []string
+	for _, iface := range interfaces {
+		if iface.CIDR == subnet.CIDR {
+			continue
+		}
+		iface.CIDR = subnet.CIDR
+
+		data, err := json.Marshal(iface)
+		if err != nil {
+			return routerIDs, fmt.Errorf("failed to marshal router interface: %w", err)
+		}
+		if err := c.etcdClient.Put(ctx, routerInterfaceKey(iface.RouterID, iface.SubnetID), string(data)); err != nil {
+			return routerIDs, fmt.Errorf("failed to update router interface: %w", err)
+		}
+		routerIDs = append(routerIDs, iface.RouterID)
+	}
+	return routerIDs, nil
+}
+
+// subnetInterfaces returns the router interfaces attached to a subnet.
+func (c *Controller) subnetInterfaces(ctx context.Context, subnetID string) ([]*network.RouterInterface, error) {
+	kvs, err := c.etcdClient.GetWithPrefixKV(ctx, routerInterfaceKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list router interfaces: %w", err)
+	}
+
+	var interfaces []*network.RouterInterface
+	for _, kv := range kvs {
+		var iface network.RouterInterface
+		if err := json.Unmarshal([]byte(kv.Value), &iface); err != nil {
+			continue
+		}
+		if iface.SubnetID == subnetID {
+			interfaces = append(interfaces, &iface)
+		}
+	}
+	return interfaces, nil
+}
+
+// SetExternalGateway connects a router to an external network, replacing any
+// previous gateway. An empty networkID removes the gateway. The gateway of a
+// router with VPN services, which their peers connect to, can only have its
+// SNAT toggled.
+func (c *Controller) SetExternalGateway(ctx context.Context, routerID, networkID string, enableSNAT bool, portID string) (*network.Router, error) {
+	c.routersMu.Lock()
+	defer c.routersMu.Unlock()
+
+	current, exists := c.routers[routerID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrRouterNotFound, routerID)
+	}
+
+	router := *current
+	oldGW := current.ExternalGatewayInfo
+
+	// Only toggle SNAT when the router stays on the same network
+	if oldGW != nil && oldGW.NetworkID == networkID {
+		gw := *oldGW
+		gw.EnableSNAT = enableSNAT
+		router.ExternalGatewayInfo = &gw
+		oldGW = nil
+	} else if err := c.checkRouterHasNoVPNs(ctx, routerID, "changing the gateway"); err != nil {
+		return nil, err
+	} else if networkID == "" {
+		router.ExternalGatewayInfo = nil
+	} else {
+		gw, err := c.allocateGateway(ctx, &router, networkID, enableSNAT, portID)
+		if err != nil {
+			return nil, err
+		}
+		router.ExternalGatewayInfo = gw
+	}
+	router.UpdatedAt = time.Now()
+
+	if err := c.storeRouter(ctx, &router); err != nil {
+		if gw := router.ExternalGatewayInfo; gw != nil && gw.PortID == portID {
+			c.releaseRouterPort(ctx, portID)
+		}
+		return nil, err
+	}
+	c.routers[routerID] = &router
+	c.programRouter(&router)
+
+	if oldGW != nil {
+		c.releaseRouterPort(ctx, oldGW.PortID)
+	}
+
+	message := "cleared external gateway"
+	if gw := router.ExternalGatewayInfo; gw != nil {
+		message = fmt.Sprintf("external gateway on network %s", gw.NetworkID)
+		if len(gw.ExternalFixedIPs) > 0 {
+			message += " with " + gw.ExternalFixedIPs[0].IPAddress
+		}
+		if gw.EnableSNAT {
+			message += ", SNAT enabled"
+		}
+	}
+	c.logger.Info("set router gateway",
+		zap.String("router_id", routerID),
+		zap.String("network_id", networkID),
+		zap.Bool("snat", enableSNAT),
+	)
+	c.recordRouterEvent(ctx, routerID, "GatewaySet", message)
+
+	return &router, nil
+}
+
+// allocateGateway creates a gateway port for router on an external network,
+// taking an IP from its first subnet.
+func (c *Controller) allocateGateway(ctx context.Context, router *network.Router, networkID string, enableSNAT bool, portID string) (*network.ExternalGateway, error) {
+	net, err := c.GetNetwork(ctx, networkID)
+	if err != nil {
+		return nil, fmt.Errorf("external network not found: %w", err)
+	}
+	if !net.External {
+		return nil, network.Invalidf("network %s is not external", networkID)
+	}
+
+	subnets, err := c.ipam.ListSubnets(ctx, networkID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subnets of network %s: %w", networkID, err)
+	}
+	if len(subnets) == 0 {
+		return nil, network.Invalidf("external network %s has no subnet to allocate a gateway IP from", networkID)
+	}
+	subnet := subnets[0]
+
+	port := &network.Port{
+		ID:        portID,
+		Name:      "router-gateway-" + router.ID,
+		NetworkID: networkID,
+		SubnetID:  subnet.ID,
+		RouterID:  router.ID,
+	}
+	if err := c.CreatePort(ctx, port); err != nil {
+		return nil, fmt.Errorf("failed to create gateway port: %w", err)
+	}
+
+	return &network.ExternalGateway{
+		NetworkID:  networkID,
+		EnableSNAT: enableSNAT,
+		ExternalFixedIPs: []network.FixedIP{
+			{SubnetID: subnet.ID, IPAddress: port.IPAddress},
+		},
+		PortID:     port.ID,
+		MACAddress: port.MACAddress,
+		GatewayIP:  subnet.GatewayIP,
+		CIDR:       subnet.CIDR,
+		VNI:        net.VNI,
+		MTU:        net.MTU,
+	}, nil
+}
+
+// releaseRouterPort deletes a router-owned port, logging failures since the
+// router change it belongs to has already been made.
+func (c *Controller) releaseRouterPort(ctx context.Context, portID string) {
+	if err := c.DeletePort(ctx, portID); err != nil {
+		c.logger.Warn("failed to delete router port",
+			zap.String("port_id", portID),
+			zap.Error(err),
+		)
+	}
+}
+
+// getRouterInterface reads one router interface from etcd.
+func (c *Controller) getRouterInterface(ctx context.Context, routerID, subnetID string) (*network.RouterInterface, error) {
+	value, err := c.etcdClient.Get(ctx, routerInterfaceKey(routerID, subnetID))
+	if err != nil {
+		if errors.Is(err, etcd.ErrKeyNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get router interface: %w", err)
+	}
+
+	var iface network.RouterInterface
+	if err := json.Unmarshal([]byte(value), &iface); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal router interface: %w", err)
+	}
+	return &iface, nil
+}
+
+// storeRouter writes a router to etcd.
+func (c *Controller) storeRouter(ctx context.Context, router *network.Router) error {
+	data, err := json.Marshal(router)
+	if err != nil {
+		return fmt.Errorf("failed to marshal router: %w", err)
+	}
+
+	if err := c.etcdClient.Put(ctx, routerKeyPrefix+router.ID, string(data)); err != nil {
+		return fmt.Errorf("failed to store router: %w", err)
+	}
+	return nil
+}
+
+// programRouter applies a router on this host, if routers are programmed.
+func (c *Controller) programRouter(router *network.Router) {
+	if c.routerProg != nil {
+		c.routerProg.ApplyRouter(router)
+	}
+}
+
+// unprogramRouter removes a router from this host, if routers are
+// programmed.
+func (c *Controller) unprogramRouter(routerID string) {
+	if c.routerProg != nil {
+		c.routerProg.RemoveRouter(routerID)
+	}
+}
+
+// programFloatingIP moves the NAT of a floating IP from its old value, if
+// it was programmed, to fip, if it is associated with a port. Either may be
+// nil. fipMu must not be held.
+func (c *Controller) programFloatingIP(ctx context.Context, old, fip *network.FloatingIP) {
+	if c.routerProg == nil {
+		return
+	}
+
+	if old != nil {
+		c.fipMu.Lock()
+		routerID, programmed := c.fipRouters[old.ID]
+		delete(c.fipRouters, old.ID)
+		c.fipMu.Unlock()
+
+		if programmed {
+			if err := c.routerProg.RemoveDNAT(ctx, routerID, old.FloatingIP, old.FixedIP); err != nil {
+				c.logger.Warn("failed to remove floating IP NAT",
+					zap.String("fip_id", old.ID),
+					zap.String("router_id", routerID),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+
+	if fip == nil || fip.PortID == "" || fip.FixedIP == "" {
+		return
+	}
+	routerID, err := c.floatingIPRouter(ctx, fip)
+	if err == nil {
+		err = c.routerProg.SetupDNAT(ctx, routerID, fip.FloatingIP, fip.FixedIP)
+	}
+	if err != nil {
+		c.logger.Warn("failed to program floating IP NAT",
+			zap.String("fip_id", fip.ID),
+			zap.String("floating_ip", fip.FloatingIP),
+			zap.Error(err),
+		)
+		return
+	}
+
+	c.fipMu.Lock()
+	c.fipRouters[fip.ID] = routerID
+	c.fipMu.Unlock()
+}
+
+// floatingIPRouter returns the router a floating IP is NATed in: the one
+// attached to the subnet of its port with a gateway on the floating IP's
+// network.
+func (c *Controller) floatingIPRouter(ctx context.Context, fip *network.FloatingIP) (string, error) {
+	port, err := c.GetPort(ctx, fip.PortID)
+	if err != nil {
+		return "", err
+	}
+	routerIDs, err := c.SubnetRouters(ctx, port.SubnetID)
+	if err != nil {
+		return "", err
+	}
+
+	c.routersMu.RLock()
+	defer c.routersMu.RUnlock()
+
+	for _, routerID := range routerIDs {
+		router, exists := c.routers[routerID]
+		if exists && router.ExternalGatewayInfo != nil && router.ExternalGatewayInfo.NetworkID == fip.FloatingNetworkID {
+			return routerID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: none routes subnet %s to network %s", ErrRouterNotFound, port.SubnetID, fip.FloatingNetworkID)
+}
+
+// recordRouterEvent records an event about a router.
+func (c *Controller) recordRouterEvent(ctx context.Context, routerID, reason, message string) {
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindRouter,
+		ObjectID: routerID,
+		Reason:   reason,
+		Message:  message,
+	})
+}
+
+func routerInterfaceKey(routerID, subnetID string) string {
+	return routerInterfaceKeyPrefix + routerID + "/" + subnetID
+}
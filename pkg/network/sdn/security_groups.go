@@ -0,0 +1,435 @@
+package sdn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/network"
+)
+
+// Security group changes are written to etcd and applied to the flow tables
+// by handleSecurityGroupEvent, so every controller watching the prefix
+// converges on the same rules regardless of which one took the request.
+
+// handleSecurityGroupEvent processes a security group change event.
+func (c *Controller) handleSecurityGroupEvent(event etcd.WatchEvent) {
+	sgID := event.Key[len(securityGroupKeyPrefix):]
+
+	switch event.Type {
+	case etcd.EventTypePut:
+		var sg network.SecurityGroup
+		if err := json.Unmarshal([]byte(event.Value), &sg); err != nil {
+			c.logger.Warn("failed to unmarshal security group event", zap.Error(err))
+			return
+		}
+
+		c.sgMu.Lock()
+		c.securityGroups[sg.ID] = &sg
+		c.sgMu.Unlock()
+
+		if err := c.flowMgr.UpdateSecurityGroupFlows(&sg); err != nil {
+			c.logger.Error("failed to update security group flows",
+				zap.String("sg_id", sg.ID),
+				zap.Error(err),
+			)
+		}
+
+		c.logger.Info("security group updated",
+			zap.String("sg_id", sg.ID),
+			zap.Int("rules", len(sg.Rules)),
+		)
+
+	case etcd.EventTypeDelete:
+		c.sgMu.Lock()
+		delete(c.securityGroups, sgID)
+		c.sgMu.Unlock()
+
+		if err := c.flowMgr.RemoveSecurityGroupFlows(sgID); err != nil {
+			c.logger.Warn("failed to remove security group flows",
+				zap.String("sg_id", sgID),
+				zap.Error(err),
+			)
+		}
+
+		c.logger.Info("security group removed", zap.String("sg_id", sgID))
+	}
+}
+
+// CreateSecurityGroup creates a new security group with the given rules.
+func (c *Controller) CreateSecurityGroup(ctx context.Context, sg *network.SecurityGroup) error {
+	if sg.Name == "" {
+		return network.Invalidf("security group name is required")
+	}
+
+	c.sgMu.Lock()
+	defer c.sgMu.Unlock()
+
+	if _, exists := c.securityGroups[sg.ID]; exists {
+		return fmt.Errorf("%w: %s", ErrSecurityGroupExists, sg.ID)
+	}
+	for i := range sg.Rules {
+		sg.Rules[i].SecurityGroupID = sg.ID
+		if err := c.validateRule(sg, &sg.Rules[i]); err != nil {
+			return err
+		}
+	}
+	if sg.Rules == nil {
+		sg.Rules = []network.SecurityGroupRule{}
+	}
+
+	sg.CreatedAt = time.Now()
+	sg.UpdatedAt = sg.CreatedAt
+
+	if err := c.storeSecurityGroup(ctx, sg); err != nil {
+		return err
+	}
+	c.securityGroups[sg.ID] = sg
+
+	c.logger.Info("created security group",
+		zap.String("sg_id", sg.ID),
+		zap.String("name", sg.Name),
+	)
+	c.recordSecurityGroupEvent(ctx, sg.ID, "Created", fmt.Sprintf("created security group %s", sg.Name))
+
+	return nil
+}
+
+// GetSecurityGroup retrieves a security group by ID.
+func (c *Controller) GetSecurityGroup(ctx context.Context, sgID string) (*network.SecurityGroup, error) {
+	c.sgMu.RLock()
+	defer c.sgMu.RUnlock()
+
+	sg, exists := c.securityGroups[sgID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrSecurityGroupNotFound, sgID)
+	}
+	return sg, nil
+}
+
+// ListSecurityGroups returns all security groups, optionally of one tenant.
+func (c *Controller) ListSecurityGroups(ctx context.Context, tenantID string) ([]*network.SecurityGroup, error) {
+	c.sgMu.RLock()
+	defer c.sgMu.RUnlock()
+
+	groups := make([]*network.SecurityGroup, 0, len(c.securityGroups))
+	for _, sg := range c.securityGroups {
+		if tenantID == "" || sg.TenantID == tenantID {
+			groups = append(groups, sg)
+		}
+	}
+
+	return groups, nil
+}
+
+// UpdateSecurityGroup changes a security group's name and description.
+// Empty values leave the field unchanged.
+func (c *Controller) UpdateSecurityGroup(ctx context.Context, sgID, name, description string) (*network.SecurityGroup, error) {
+	return c.modifySecurityGroup(ctx, sgID, "Updated", func(sg *network.SecurityGroup) (string, error) {
+		if name != "" {
+			sg.Name = name
+		}
+		if description != "" {
+			sg.Description = description
+		}
+		return fmt.Sprintf("updated security group %s", sg.Name), nil
+	})
+}
+
+// DeleteSecurityGroup deletes a security group. Groups still used by a port
+// or referenced as the remote group of another group's rule cannot be
+// deleted.
+func (c *Controller) DeleteSecurityGroup(ctx context.Context, sgID string) error {
+	c.portsMu.RLock()
+	for _, port := range c.ports {
+		for _, id := range port.SecurityGroups {
+			if id == sgID {
+				c.portsMu.RUnlock()
+				return fmt.Errorf("%w by port %s, cannot delete", ErrSecurityGroupInUse, port.ID)
+			}
+		}
+	}
+	c.portsMu.RUnlock()
+
+	c.sgMu.Lock()
+	defer c.sgMu.Unlock()
+
+	if _, exists := c.securityGroups[sgID]; !exists {
+		return fmt.Errorf("%w: %s", ErrSecurityGroupNotFound, sgID)
+	}
+	for _, other := range c.securityGroups {
+		if other.ID == sgID {
+			continue
+		}
+		for _, rule := range other.Rules {
+			if rule.RemoteGroupID == sgID {
+				return fmt.Errorf("%w by a rule of security group %s, cannot delete", ErrSecurityGroupInUse, other.ID)
+			}
+		}
+	}
+
+	key := securityGroupKeyPrefix + sgID
+	if err := c.etcdClient.Delete(ctx, key); err != nil {
+		return fmt.Errorf("failed to delete security group: %w", err)
+	}
+	delete(c.securityGroups, sgID)
+
+	c.logger.Info("deleted security group", zap.String("sg_id", sgID))
+	c.recordSecurityGroupEvent(ctx, sgID, "Deleted", "")
+
+	return nil
+}
+
+// AddSecurityGroupRule validates a rule and appends it to a security group.
+func (c *Controller) AddSecurityGroupRule(ctx context.Context, sgID string, rule network.SecurityGroupRule) (*network.SecurityGroupRule, error) {
+	sg, err := c.modifySecurityGroup(ctx, sgID, "RuleAdded", func(sg *network.SecurityGroup) (string, error) {
+		rule.SecurityGroupID = sg.ID
+		if err := c.validateRule(sg, &rule); err != nil {
+			return "", err
+		}
+		for _, existing := range sg.Rules {
+			if sameRule(&existing, &rule) {
+				return "", fmt.Errorf("%w: %s", ErrDuplicateRule, existing.ID)
+			}
+		}
+		sg.Rules = append(sg.Rules, rule)
+		return fmt.Sprintf("added rule %s: %s", rule.ID, describeRule(&rule)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sg.Rules[len(sg.Rules)-1], nil
+}
+
+// RemoveSecurityGroupRule removes a rule from a security group.
+func (c *Controller) RemoveSecurityGroupRule(ctx context.Context, sgID, ruleID string) error {
+	_, err := c.modifySecurityGroup(ctx, sgID, "RuleRemoved", func(sg *network.SecurityGroup) (string, error) {
+		for i, rule := range sg.Rules {
+			if rule.ID == ruleID {
+				sg.Rules = append(sg.Rules[:i], sg.Rules[i+1:]...)
+				return fmt.Sprintf("removed rule %s: %s", rule.ID, describeRule(&rule)), nil
+			}
+		}
+		return "", fmt.Errorf("%w: %s", ErrRuleNotFound, ruleID)
+	})
+	return err
+}
+
+// modifySecurityGroup applies fn to a copy of a security group and stores
+// the result. fn returns the message recorded with the event.
+func (c *Controller) modifySecurityGroup(
+	ctx context.Context,
+	sgID, reason string,
+	fn func(sg *network.SecurityGroup) (string, error),
+) (*network.SecurityGroup, error) {
+	c.sgMu.Lock()
+	defer c.sgMu.Unlock()
+
+	current, exists := c.securityGroups[sgID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrSecurityGroupNotFound, sgID)
+	}
+
+	// Work on a copy so a failed write leaves the cache untouched
+	sg := *current
+	sg.Rules = append([]network.SecurityGroupRule{}, current.Rules...)
+
+	message, err := fn(&sg)
+	if err != nil {
+		return nil, err
+	}
+	sg.UpdatedAt = time.Now()
+
+	if err := c.storeSecurityGroup(ctx, &sg); err != nil {
+		return nil, err
+	}
+	c.securityGroups[sg.ID] = &sg
+
+	c.logger.Info("modified security group",
+		zap.String("sg_id", sg.ID),
+		zap.String("reason", reason),
+	)
+	c.recordSecurityGroupEvent(ctx, sg.ID, reason, message)
+
+	return &sg, nil
+}
+
+// storeSecurityGroup writes a security group to etcd.
+func (c *Controller) storeSecurityGroup(ctx context.Context, sg *network.SecurityGroup) error {
+	data, err := json.Marshal(sg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal security group: %w", err)
+	}
+
+	if err := c.etcdClient.Put(ctx, securityGroupKeyPrefix+sg.ID, string(data)); err != nil {
+		return fmt.Errorf("failed to store security group: %w", err)
+	}
+	return nil
+}
+
+// validateRule checks and normalizes a rule of sg. The caller holds sgMu.
+func (c *Controller) validateRule(sg *network.SecurityGroup, rule *network.SecurityGroupRule) error {
+	if rule.ID == "" {
+		return network.Invalidf("rule ID is required")
+	}
+
+	switch rule.Direction {
+	case "ingress", "egress":
+	default:
+		return network.Invalidf("invalid rule direction %q (must be ingress or egress)", rule.Direction)
+	}
+
+	if rule.EtherType == "" {
+		rule.EtherType = "IPv4"
+	}
+	if rule.EtherType != "IPv4" && rule.EtherType != "IPv6" {
+		return network.Invalidf("invalid ether type %q (must be IPv4 or IPv6)", rule.EtherType)
+	}
+
+	rule.Protocol = strings.ToLower(rule.Protocol)
+	switch rule.Protocol {
+	case "", "any":
+		rule.Protocol = "any"
+	case "tcp", "udp", "icmp":
+	default:
+		return network.Invalidf("invalid protocol %q (must be tcp, udp, icmp or any)", rule.Protocol)
+	}
+
+	if rule.PortRangeMin != 0 || rule.PortRangeMax != 0 {
+		if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+			return network.Invalidf("port ranges are only valid for tcp and udp rules")
+		}
+		if rule.PortRangeMax == 0 {
+			rule.PortRangeMax = rule.PortRangeMin
+		}
+		if rule.PortRangeMin == 0 || rule.PortRangeMin > rule.PortRangeMax {
+			return network.Invalidf("invalid port range %d-%d", rule.PortRangeMin, rule.PortRangeMax)
+		}
+	}
+
+	if rule.RemoteIPPrefix != "" && rule.RemoteGroupID != "" {
+		return network.Invalidf("a rule may have a remote IP prefix or a remote group, not both")
+	}
+	if rule.RemoteIPPrefix != "" {
+		_, ipNet, err := net.ParseCIDR(rule.RemoteIPPrefix)
+		if err != nil {
+			return network.Invalidf("invalid remote IP prefix: %v", err)
+		}
+		if (ipNet.IP.To4() != nil) != (rule.EtherType == "IPv4") {
+			return network.Invalidf("remote IP prefix %s does not match ether type %s", rule.RemoteIPPrefix, rule.EtherType)
+		}
+		rule.RemoteIPPrefix = ipNet.String()
+	}
+	if rule.RemoteGroupID != "" && rule.RemoteGroupID != sg.ID {
+		if _, exists := c.securityGroups[rule.RemoteGroupID]; !exists {
+			return network.Invalidf("remote security group not found: %s", rule.RemoteGroupID)
+		}
+	}
+
+	return nil
+}
+
+// SecurityGroupsAllow reports whether the security groups of a port let
+// traffic through in one direction: egress to peer, or ingress from it.
+// Ports without security groups let everything through. The reason names
+// the rule that allows the traffic, or the groups none of whose rules do.
+func (c *Controller) SecurityGroupsAllow(ctx context.Context, port *network.Port, direction string, peer *network.Port, protocol string, dstPort uint16) (bool, string, error) {
+	if len(port.SecurityGroups) == 0 {
+		return true, "port has no security groups", nil
+	}
+
+	peerIP := net.ParseIP(peer.IPAddress)
+	if peerIP == nil {
+		return false, "", network.Invalidf("port %s has no valid IP address", peer.ID)
+	}
+	etherType := "IPv6"
+	if peerIP.To4() != nil {
+		etherType = "IPv4"
+	}
+
+	c.sgMu.RLock()
+	defer c.sgMu.RUnlock()
+
+	for _, sgID := range port.SecurityGroups {
+		sg, exists := c.securityGroups[sgID]
+		if !exists {
+			return false, "", fmt.Errorf("%w: %s", ErrSecurityGroupNotFound, sgID)
+		}
+		for i := range sg.Rules {
+			rule := &sg.Rules[i]
+			if rule.Direction != direction || rule.EtherType != etherType {
+				continue
+			}
+			if rule.Protocol != "any" && rule.Protocol != protocol {
+				continue
+			}
+			if rule.PortRangeMin != 0 && (dstPort < rule.PortRangeMin || dstPort > rule.PortRangeMax) {
+				continue
+			}
+			if rule.RemoteIPPrefix != "" {
+				if _, prefix, err := net.ParseCIDR(rule.RemoteIPPrefix); err != nil || !prefix.Contains(peerIP) {
+					continue
+				}
+			}
+			if rule.RemoteGroupID != "" && !slices.Contains(peer.SecurityGroups, rule.RemoteGroupID) {
+				continue
+			}
+			return true, fmt.Sprintf("allowed by rule %s of group %s", describeRule(rule), sg.Name), nil
+		}
+	}
+
+	return false, fmt.Sprintf("no %s rule of groups %s allows %s", direction, strings.Join(port.SecurityGroups, ", "), describeTraffic(protocol, dstPort)), nil
+}
+
+// describeTraffic returns a short human-readable form of a probe's traffic.
+func describeTraffic(protocol string, dstPort uint16) string {
+	if dstPort == 0 {
+		return protocol
+	}
+	return fmt.Sprintf("%s port %d", protocol, dstPort)
+}
+
+// sameRule reports whether two rules match the same traffic.
+func sameRule(a, b *network.SecurityGroupRule) bool {
+	return a.Direction == b.Direction &&
+		a.EtherType == b.EtherType &&
+		a.Protocol == b.Protocol &&
+		a.PortRangeMin == b.PortRangeMin &&
+		a.PortRangeMax == b.PortRangeMax &&
+		a.RemoteIPPrefix == b.RemoteIPPrefix &&
+		a.RemoteGroupID == b.RemoteGroupID
+}
+
+// describeRule returns a short human-readable form of a rule.
+func describeRule(rule *network.SecurityGroupRule) string {
+	s := fmt.Sprintf("%s %s %s", rule.Direction, rule.EtherType, rule.Protocol)
+	if rule.PortRangeMin != 0 {
+		s += fmt.Sprintf(" %d-%d", rule.PortRangeMin, rule.PortRangeMax)
+	}
+	switch {
+	case rule.RemoteIPPrefix != "":
+		s += " " + rule.RemoteIPPrefix
+	case rule.RemoteGroupID != "":
+		s += " group " + rule.RemoteGroupID
+	}
+	return s
+}
+
+// recordSecurityGroupEvent records an event about a security group.
+func (c *Controller) recordSecurityGroupEvent(ctx context.Context, sgID, reason, message string) {
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindSecurityGroup,
+		ObjectID: sgID,
+		Reason:   reason,
+		Message:  message,
+	})
+}
@@ -0,0 +1,175 @@
+package sdn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+// segmentVNIKeyPrefix holds a key per VNI given to a zone segment, naming
+// the network it belongs to, so concurrent creates cannot share a VNI.
+const segmentVNIKeyPrefix = "/hypervisor/network/segment-vnis/"
+
+// prepareSegments validates the zone segments of a new network and gives
+// those without a VNI a free one from the configured segment range. Every
+// segment VNI is claimed in etcd; if any cannot be, the claims already made
+// are released.
+func (c *Controller) prepareSegments(ctx context.Context, net *network.Network) error {
+	if len(net.Segments) == 0 {
+		return c.checkSegmentVNIFree(ctx, net.VNI)
+	}
+	if net.Type != network.NetworkTypeVXLAN {
+		return network.Invalidf("zone segments require a VXLAN network, got %s", net.Type)
+	}
+
+	zones := make(map[string]bool, len(net.Segments))
+	for _, segment := range net.Segments {
+		if segment.Zone == "" {
+			return network.Invalidf("segment zone cannot be empty")
+		}
+		if zones[segment.Zone] {
+			return network.Invalidf("duplicate segment for zone %s", segment.Zone)
+		}
+		zones[segment.Zone] = true
+		if segment.VNI > 16777215 {
+			return network.Invalidf("invalid VNI for zone %s: %d (must be 1-16777215)", segment.Zone, segment.VNI)
+		}
+	}
+	if err := c.checkSegmentVNIFree(ctx, net.VNI); err != nil {
+		return err
+	}
+
+	inUse := c.vnisInUse()
+	inUse[net.VNI] = true
+
+	var claimed []uint32
+	fail := func(err error) error {
+		for _, vni := range claimed {
+			c.releaseSegmentVNI(ctx, vni)
+		}
+		return err
+	}
+
+	// Requested VNIs first, so allocation cannot take one of them
+	for _, segment := range net.Segments {
+		if segment.VNI == 0 {
+			continue
+		}
+		if inUse[segment.VNI] {
+			return fail(fmt.Errorf("%w: VNI %d of zone %s", network.ErrVNIInUse, segment.VNI, segment.Zone))
+		}
+		ok, err := c.claimSegmentVNI(ctx, segment.VNI, net.ID)
+		if err != nil {
+			return fail(err)
+		}
+		if !ok {
+			return fail(fmt.Errorf("%w: VNI %d of zone %s", network.ErrVNIInUse, segment.VNI, segment.Zone))
+		}
+		claimed = append(claimed, segment.VNI)
+		inUse[segment.VNI] = true
+	}
+
+	minVNI, maxVNI := c.segmentVNIRange()
+	next := minVNI
+	for i := range net.Segments {
+		segment := &net.Segments[i]
+		for segment.VNI == 0 {
+			if next > maxVNI {
+				return fail(fmt.Errorf("%w in %d-%d for segment of zone %s", network.ErrNoFreeVNI, minVNI, maxVNI, segment.Zone))
+			}
+			vni := next
+			next++
+			if inUse[vni] {
+				continue
+			}
+			ok, err := c.claimSegmentVNI(ctx, vni, net.ID)
+			if err != nil {
+				return fail(err)
+			}
+			if ok {
+				segment.VNI = vni
+				claimed = append(claimed, vni)
+				inUse[vni] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// releaseSegments releases the VNIs claimed for a network's segments.
+func (c *Controller) releaseSegments(ctx context.Context, net *network.Network) {
+	for _, segment := range net.Segments {
+		c.releaseSegmentVNI(ctx, segment.VNI)
+	}
+}
+
+// checkSegmentVNIFree rejects a network VNI already given to a segment.
+func (c *Controller) checkSegmentVNIFree(ctx context.Context, vni uint32) error {
+	if vni == 0 {
+		return nil
+	}
+	owner, err := c.etcdClient.Get(ctx, segmentVNIKey(vni))
+	if err != nil && !errors.Is(err, etcd.ErrKeyNotFound) {
+		return fmt.Errorf("failed to check segment VNIs: %w", err)
+	}
+	if owner != "" {
+		return fmt.Errorf("%w: VNI %d by a segment of network %s", network.ErrVNIInUse, vni, owner)
+	}
+	return nil
+}
+
+// vnisInUse returns the VNIs of the known networks and their segments.
+func (c *Controller) vnisInUse() map[uint32]bool {
+	c.networksMu.RLock()
+	defer c.networksMu.RUnlock()
+
+	inUse := make(map[uint32]bool)
+	for _, net := range c.networks {
+		for _, vni := range net.VNIs() {
+			inUse[vni] = true
+		}
+	}
+	return inUse
+}
+
+// segmentVNIRange returns the configured segment VNI range, defaulting
+// unset bounds.
+func (c *Controller) segmentVNIRange() (uint32, uint32) {
+	defaults := network.DefaultNetworkConfig()
+	minVNI, maxVNI := c.config.SegmentVNIMin, c.config.SegmentVNIMax
+	if minVNI == 0 {
+		minVNI = defaults.SegmentVNIMin
+	}
+	if maxVNI == 0 || maxVNI > 16777215 {
+		maxVNI = defaults.SegmentVNIMax
+	}
+	return minVNI, maxVNI
+}
+
+func (c *Controller) claimSegmentVNI(ctx context.Context, vni uint32, networkID string) (bool, error) {
+	ok, err := c.claimVNI(ctx, segmentVNIKey(vni), networkVNIKey(vni), networkID)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim segment VNI %d: %w", vni, err)
+	}
+	return ok, nil
+}
+
+func (c *Controller) releaseSegmentVNI(ctx context.Context, vni uint32) {
+	if err := c.etcdClient.Delete(ctx, segmentVNIKey(vni)); err != nil {
+		c.logger.Warn("failed to release segment VNI",
+			zap.Uint32("vni", vni),
+			zap.Error(err),
+		)
+	}
+}
+
+func segmentVNIKey(vni uint32) string {
+	return segmentVNIKeyPrefix + strconv.FormatUint(uint64(vni), 10)
+}
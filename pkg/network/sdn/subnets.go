@@ -0,0 +1,277 @@
+package sdn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+// Subnet dependency kinds, in the order a cascading delete removes them.
+const (
+	DependencyLoadBalancer    = "load-balancer"
+	DependencyRouterInterface = "router-interface"
+	DependencyPort            = "port"
+	DependencyDHCP            = "dhcp"
+	DependencyAllocation      = "allocation"
+)
+
+var dependencyOrder = map[string]int{
+	DependencyLoadBalancer:    0,
+	DependencyRouterInterface: 1,
+	DependencyPort:            2,
+	DependencyDHCP:            3,
+	DependencyAllocation:      4,
+}
+
+// SubnetDependency is a resource that keeps a subnet from being deleted.
+type SubnetDependency struct {
+	Kind   string
+	ID     string // Load balancer, router, port or IP address, by Kind
+	Detail string
+
+	// Blocking dependencies belong to an instance and are never removed by a
+	// cascading delete; the instance must release them first.
+	Blocking bool
+}
+
+func (d SubnetDependency) String() string {
+	s := d.Kind + " " + d.ID
+	if d.Detail != "" {
+		s += " (" + d.Detail + ")"
+	}
+	return s
+}
+
+// SubnetInUseError is returned when a subnet cannot be deleted because
+// resources still depend on it.
+type SubnetInUseError struct {
+	SubnetID     string
+	Dependencies []SubnetDependency
+}
+
+func (e *SubnetInUseError) Error() string {
+	items := make([]string, len(e.Dependencies))
+	for i, dep := range e.Dependencies {
+		items[i] = dep.String()
+	}
+	return fmt.Sprintf("subnet %s is in use by %d resource(s): %s", e.SubnetID, len(items), strings.Join(items, "; "))
+}
+
+// SubnetDependencies returns the load balancer VIPs, router interfaces,
+// ports and IP allocations on a subnet, read from etcd so resources created
+// through any server are included.
+func (c *Controller) SubnetDependencies(ctx context.Context, subnetID string) ([]SubnetDependency, error) {
+	var deps []SubnetDependency
+	owned := make(map[string]bool) // IPs accounted for by a port
+
+	interfaces, err := c.subnetInterfaces(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range interfaces {
+		owned[iface.IPAddress] = true
+		deps = append(deps, SubnetDependency{
+			Kind:   DependencyRouterInterface,
+			ID:     iface.RouterID,
+			Detail: fmt.Sprintf("port %s at %s", iface.PortID, iface.IPAddress),
+		})
+	}
+
+	kvs, err := c.etcdClient.GetWithPrefixKV(ctx, PortKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ports: %w", err)
+	}
+	for _, kv := range kvs {
+		var port network.Port
+		if err := json.Unmarshal([]byte(kv.Value), &port); err != nil {
+			continue
+		}
+		if port.SubnetID != subnetID {
+			continue
+		}
+		owned[port.IPAddress] = true
+		if port.LoadBalancerID != "" {
+			// Removed together with its load balancer
+			deps = append(deps, SubnetDependency{
+				Kind:   DependencyLoadBalancer,
+				ID:     port.LoadBalancerID,
+				Detail: fmt.Sprintf("VIP %s", port.IPAddress),
+			})
+			continue
+		}
+		if port.RouterID != "" {
+			// Removed together with its router interface or gateway
+			if !isRouterInterfacePort(interfaces, port.ID) {
+				deps = append(deps, SubnetDependency{
+					Kind:     DependencyPort,
+					ID:       port.ID,
+					Detail:   fmt.Sprintf("gateway of router %s at %s", port.RouterID, port.IPAddress),
+					Blocking: true,
+				})
+			}
+			continue
+		}
+
+		dep := SubnetDependency{
+			Kind:   DependencyPort,
+			ID:     port.ID,
+			Detail: port.IPAddress,
+		}
+		if port.InstanceID != "" {
+			dep.Detail = fmt.Sprintf("%s, instance %s", port.IPAddress, port.InstanceID)
+			dep.Blocking = true
+		}
+		deps = append(deps, dep)
+	}
+
+	allocs, err := c.ipam.ListAllocations(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+	for _, alloc := range allocs {
+		if owned[alloc.IPAddress] {
+			continue
+		}
+
+		dep := SubnetDependency{
+			Kind: DependencyAllocation,
+			ID:   alloc.IPAddress,
+		}
+		switch {
+		case alloc.Status == network.AllocationStatusDHCP:
+			dep.Kind = DependencyDHCP
+			dep.Detail = alloc.Hostname
+		case alloc.InstanceID != "":
+			dep.Detail = "instance " + alloc.InstanceID
+			dep.Blocking = true
+		default:
+			dep.Detail = alloc.Status
+			if alloc.Description != "" {
+				dep.Detail += ", " + alloc.Description
+			}
+		}
+		deps = append(deps, dep)
+	}
+
+	sort.SliceStable(deps, func(i, j int) bool {
+		return dependencyOrder[deps[i].Kind] < dependencyOrder[deps[j].Kind]
+	})
+	return deps, nil
+}
+
+// CreateSubnet creates a subnet in IPAM, claiming its name within the
+// tenant of its network as it is stored.
+func (c *Controller) CreateSubnet(ctx context.Context, subnet *network.Subnet) error {
+	subnet.TenantID = c.networkTenant(ctx, subnet.NetworkID)
+	claims := nameClaims(NameKindSubnet, subnet.TenantID, subnet.ID, subnet.Name)
+	if err := c.ipam.CreateSubnet(ctx, subnet, claims...); err != nil {
+		return nameInUse(err, NameKindSubnet, subnet.TenantID, subnet.Name)
+	}
+	return nil
+}
+
+// SplitSubnet replaces a subnet with children planned by IPAM's PlanSplit,
+// moving the name claims from the subnet to its children.
+func (c *Controller) SplitSubnet(ctx context.Context, subnetID string, children []*network.Subnet) error {
+	subnet, err := c.ipam.GetSubnet(ctx, subnetID)
+	if err != nil {
+		return err
+	}
+	tenantID := c.resourceTenant(ctx, subnet.TenantID, subnet.NetworkID)
+
+	var claims []etcd.Claim
+	names := make([]string, 0, len(children))
+	for _, child := range children {
+		child.TenantID = tenantID
+		claims = append(claims, nameClaims(NameKindSubnet, tenantID, child.ID, child.Name)...)
+		names = append(names, child.Name)
+	}
+
+	if err := c.ipam.SplitSubnet(ctx, subnetID, children, claims...); err != nil {
+		return nameInUse(err, NameKindSubnet, tenantID, names...)
+	}
+	c.releaseName(ctx, NameKindSubnet, tenantID, subnet.Name, subnet.ID)
+	return nil
+}
+
+// DeleteSubnet deletes a subnet. A subnet with dependencies is only deleted
+// with cascade, which first deletes the load balancers with a VIP on it,
+// detaches its router interfaces, then deletes its ports and finally releases
+// its DHCP and other allocations. Dependencies
+// owned by instances block the delete even with cascade. It returns the
+// dependencies that were removed.
+func (c *Controller) DeleteSubnet(ctx context.Context, subnetID string, cascade bool) ([]SubnetDependency, error) {
+	subnet, err := c.ipam.GetSubnet(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+
+	deps, err := c.SubnetDependencies(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(deps) > 0 {
+		if !cascade {
+			return nil, &SubnetInUseError{SubnetID: subnetID, Dependencies: deps}
+		}
+
+		var blocking []SubnetDependency
+		for _, dep := range deps {
+			if dep.Blocking {
+				blocking = append(blocking, dep)
+			}
+		}
+		if len(blocking) > 0 {
+			return nil, &SubnetInUseError{SubnetID: subnetID, Dependencies: blocking}
+		}
+	}
+
+	for i, dep := range deps {
+		if err := c.removeSubnetDependency(ctx, subnetID, dep); err != nil {
+			return deps[:i], fmt.Errorf("failed to remove %s: %w", dep, err)
+		}
+		c.logger.Info("removed subnet dependency",
+			zap.String("subnet_id", subnetID),
+			zap.String("kind", dep.Kind),
+			zap.String("id", dep.ID),
+		)
+	}
+
+	if err := c.ipam.DeleteSubnet(ctx, subnetID); err != nil {
+		return deps, err
+	}
+	c.releaseName(ctx, NameKindSubnet, c.resourceTenant(ctx, subnet.TenantID, subnet.NetworkID), subnet.Name, subnetID)
+	return deps, nil
+}
+
+// removeSubnetDependency tears down one dependency of a subnet.
+func (c *Controller) removeSubnetDependency(ctx context.Context, subnetID string, dep SubnetDependency) error {
+	switch dep.Kind {
+	case DependencyLoadBalancer:
+		return c.DeleteLoadBalancer(ctx, dep.ID)
+	case DependencyRouterInterface:
+		return c.RemoveRouterInterface(ctx, dep.ID, subnetID)
+	case DependencyPort:
+		return c.DeletePort(ctx, dep.ID)
+	case DependencyDHCP, DependencyAllocation:
+		return c.ipam.ReleaseIP(ctx, subnetID, dep.ID)
+	}
+	return fmt.Errorf("unknown dependency kind %q", dep.Kind)
+}
+
+func isRouterInterfacePort(interfaces []*network.RouterInterface, portID string) bool {
+	for _, iface := range interfaces {
+		if iface.PortID == portID {
+			return true
+		}
+	}
+	return false
+}
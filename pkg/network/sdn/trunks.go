@@ -0,0 +1,444 @@
+package sdn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/network"
+)
+
+// Trunks are stored by ID, and each parent port names the trunk it is the
+// parent of, so that a port parents one trunk at most even under concurrent
+// creates. Subport membership is recorded on the subports themselves.
+const (
+	trunkKeyPrefix       = "/hypervisor/network/trunks/"
+	trunkParentKeyPrefix = "/hypervisor/network/trunk-parents/"
+)
+
+// CreateTrunk makes a port the parent of a new trunk and adds the trunk's
+// initial subports to it.
+func (c *Controller) CreateTrunk(ctx context.Context, trunk *network.Trunk) error {
+	parent, err := c.GetPort(ctx, trunk.ParentPortID)
+	if err != nil {
+		return err
+	}
+	if parent.ParentPortID != "" {
+		return network.Invalidf("port %s is a subport and cannot be a trunk parent", parent.ID)
+	}
+	if parent.RouterID != "" {
+		return network.Invalidf("router port %s cannot be a trunk parent", parent.ID)
+	}
+	if bypassesBridge(parent) {
+		return network.Invalidf("port %s bypasses the bridge and cannot be a trunk parent", parent.ID)
+	}
+	subPorts := trunk.SubPorts
+	if err := validateSubPorts(trunk.ParentPortID, nil, subPorts); err != nil {
+		return err
+	}
+
+	trunk.SubPorts = nil
+	trunk.CreatedAt = time.Now()
+	trunk.UpdatedAt = trunk.CreatedAt
+	data, err := json.Marshal(trunk)
+	if err != nil {
+		return fmt.Errorf("failed to marshal trunk: %w", err)
+	}
+
+	parentKey := trunkParentKeyPrefix + trunk.ParentPortID
+	resp, err := c.etcdClient.Raw().Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(parentKey), "=", 0)).
+		Then(clientv3.OpPut(parentKey, trunk.ID), clientv3.OpPut(trunkKeyPrefix+trunk.ID, string(data))).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to store trunk: %w", err)
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%w: port %s", ErrTrunkExists, trunk.ParentPortID)
+	}
+
+	if len(subPorts) > 0 {
+		updated, err := c.AddSubPorts(ctx, trunk.ID, subPorts)
+		if err != nil {
+			c.deleteTrunkKeys(ctx, trunk)
+			return err
+		}
+		*trunk = *updated
+	}
+
+	c.logger.Info("created trunk",
+		zap.String("trunk_id", trunk.ID),
+		zap.String("parent_port_id", trunk.ParentPortID),
+		zap.Int("subports", len(trunk.SubPorts)),
+	)
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindPort,
+		ObjectID: trunk.ParentPortID,
+		NodeID:   parent.NodeID,
+		Reason:   "TrunkCreated",
+		Message:  fmt.Sprintf("parent of trunk %s with %d subports", trunk.ID, len(trunk.SubPorts)),
+	})
+	return nil
+}
+
+// validateSubPorts checks subports to be added to a trunk next to those it
+// has: tags must be valid VLAN IDs, and neither tags nor ports may repeat.
+func validateSubPorts(parentPortID string, existing, added []network.SubPort) error {
+	tags := make(map[uint16]string, len(existing)+len(added))
+	ports := make(map[string]bool, len(existing)+len(added))
+	for _, sp := range existing {
+		tags[sp.VLANTag] = sp.PortID
+		ports[sp.PortID] = true
+	}
+	for _, sp := range added {
+		if sp.PortID == "" {
+			return network.Invalidf("subport ID cannot be empty")
+		}
+		if sp.PortID == parentPortID {
+			return network.Invalidf("port %s cannot be a subport of its own trunk", sp.PortID)
+		}
+		if sp.VLANTag < 1 || sp.VLANTag > 4094 {
+			return network.Invalidf("invalid VLAN tag %d of subport %s (must be 1-4094)", sp.VLANTag, sp.PortID)
+		}
+		if other, ok := tags[sp.VLANTag]; ok {
+			return network.Invalidf("VLAN tag %d of subport %s is already used by subport %s", sp.VLANTag, sp.PortID, other)
+		}
+		if ports[sp.PortID] {
+			return network.Invalidf("port %s is already a subport of the trunk", sp.PortID)
+		}
+		tags[sp.VLANTag] = sp.PortID
+		ports[sp.PortID] = true
+	}
+	return nil
+}
+
+// AddSubPorts adds subports to a trunk. Each is bound wherever the parent
+// is; a port already bound, or on a trunk, cannot be added.
+func (c *Controller) AddSubPorts(ctx context.Context, trunkID string, subPorts []network.SubPort) (*network.Trunk, error) {
+	trunk, err := c.GetTrunk(ctx, trunkID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSubPorts(trunk.ParentPortID, trunk.SubPorts, subPorts); err != nil {
+		return nil, err
+	}
+	parent, err := c.GetPort(ctx, trunk.ParentPortID)
+	if err != nil {
+		return nil, err
+	}
+
+	var added []network.SubPort
+	fail := func(err error) (*network.Trunk, error) {
+		for _, sp := range added {
+			c.releaseSubPort(ctx, trunk.ParentPortID, sp.PortID)
+		}
+		return nil, err
+	}
+	for _, sp := range subPorts {
+		if err := c.claimSubPort(ctx, parent, sp); err != nil {
+			return fail(err)
+		}
+		added = append(added, sp)
+	}
+
+	updated, err := c.modifyTrunk(ctx, trunkID, func(t *network.Trunk) error {
+		if err := validateSubPorts(t.ParentPortID, t.SubPorts, subPorts); err != nil {
+			return err
+		}
+		t.SubPorts = append(t.SubPorts, subPorts...)
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	c.logger.Info("added subports",
+		zap.String("trunk_id", trunkID),
+		zap.Int("count", len(subPorts)),
+	)
+	return updated, nil
+}
+
+// RemoveSubPorts removes subports from a trunk, unbinding them.
+func (c *Controller) RemoveSubPorts(ctx context.Context, trunkID string, portIDs []string) (*network.Trunk, error) {
+	remove := make(map[string]bool, len(portIDs))
+	for _, id := range portIDs {
+		remove[id] = true
+	}
+
+	updated, err := c.modifyTrunk(ctx, trunkID, func(t *network.Trunk) error {
+		kept := make([]network.SubPort, 0, len(t.SubPorts))
+		found := 0
+		for _, sp := range t.SubPorts {
+			if remove[sp.PortID] {
+				found++
+				continue
+			}
+			kept = append(kept, sp)
+		}
+		if found != len(remove) {
+			return fmt.Errorf("%w: not every port given is a subport of trunk %s", ErrSubPortNotFound, t.ID)
+		}
+		t.SubPorts = kept
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for id := range remove {
+		c.releaseSubPort(ctx, updated.ParentPortID, id)
+	}
+
+	c.logger.Info("removed subports",
+		zap.String("trunk_id", trunkID),
+		zap.Int("count", len(remove)),
+	)
+	return updated, nil
+}
+
+// DeleteTrunk deletes a trunk without subports; its parent becomes a plain
+// port again.
+func (c *Controller) DeleteTrunk(ctx context.Context, trunkID string) error {
+	trunk, err := c.GetTrunk(ctx, trunkID)
+	if err != nil {
+		return err
+	}
+	if len(trunk.SubPorts) > 0 {
+		return fmt.Errorf("%w: trunk %s has %d", ErrTrunkHasSubPorts, trunkID, len(trunk.SubPorts))
+	}
+	if err := c.deleteTrunkKeys(ctx, trunk); err != nil {
+		return err
+	}
+
+	c.logger.Info("deleted trunk", zap.String("trunk_id", trunkID))
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindPort,
+		ObjectID: trunk.ParentPortID,
+		Reason:   "TrunkDeleted",
+		Message:  fmt.Sprintf("trunk %s deleted", trunkID),
+	})
+	return nil
+}
+
+// deleteTrunkKeys deletes a trunk and, if still its own, the claim on its
+// parent.
+func (c *Controller) deleteTrunkKeys(ctx context.Context, trunk *network.Trunk) error {
+	parentKey := trunkParentKeyPrefix + trunk.ParentPortID
+	_, err := c.etcdClient.Raw().Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(parentKey), "=", trunk.ID)).
+		Then(clientv3.OpDelete(parentKey)).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to release trunk parent: %w", err)
+	}
+
+	if err := c.etcdClient.Delete(ctx, trunkKeyPrefix+trunk.ID); err != nil {
+		return fmt.Errorf("failed to delete trunk: %w", err)
+	}
+	return nil
+}
+
+// GetTrunk retrieves a trunk by ID.
+func (c *Controller) GetTrunk(ctx context.Context, trunkID string) (*network.Trunk, error) {
+	value, err := c.etcdClient.Get(ctx, trunkKeyPrefix+trunkID)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return nil, fmt.Errorf("%w: %s", ErrTrunkNotFound, trunkID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trunk: %w", err)
+	}
+
+	var trunk network.Trunk
+	if err := json.Unmarshal([]byte(value), &trunk); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal trunk: %w", err)
+	}
+	return &trunk, nil
+}
+
+// ListTrunks returns the trunks, oldest first.
+func (c *Controller) ListTrunks(ctx context.Context) ([]*network.Trunk, error) {
+	kvs, err := c.etcdClient.GetWithPrefix(ctx, trunkKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trunks: %w", err)
+	}
+
+	trunks := make([]*network.Trunk, 0, len(kvs))
+	for _, value := range kvs {
+		var trunk network.Trunk
+		if err := json.Unmarshal([]byte(value), &trunk); err != nil {
+			continue
+		}
+		trunks = append(trunks, &trunk)
+	}
+	sort.Slice(trunks, func(i, j int) bool {
+		return trunks[i].CreatedAt.Before(trunks[j].CreatedAt)
+	})
+	return trunks, nil
+}
+
+// trunkOf returns the trunk a port is the parent of, or nil.
+func (c *Controller) trunkOf(ctx context.Context, portID string) (*network.Trunk, error) {
+	trunkID, err := c.etcdClient.Get(ctx, trunkParentKeyPrefix+portID)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && trunkID == "") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up trunk of port %s: %w", portID, err)
+	}
+	trunk, err := c.GetTrunk(ctx, trunkID)
+	if errors.Is(err, ErrTrunkNotFound) {
+		return nil, nil
+	}
+	return trunk, err
+}
+
+// claimSubPort makes a port a subport of parent, bound where the parent is.
+func (c *Controller) claimSubPort(ctx context.Context, parent *network.Port, sp network.SubPort) error {
+	if trunk, err := c.trunkOf(ctx, sp.PortID); err != nil {
+		return err
+	} else if trunk != nil {
+		return network.Invalidf("port %s is the parent of trunk %s and cannot be a subport", sp.PortID, trunk.ID)
+	}
+
+	_, err := c.modifyPort(ctx, sp.PortID, func(port *network.Port) error {
+		switch {
+		case port.ParentPortID != "":
+			return fmt.Errorf("%w: port %s is a subport of %s", ErrPortInTrunk, port.ID, port.ParentPortID)
+		case port.NodeID != "":
+			return fmt.Errorf("%w: port %s is bound to node %s", ErrPortInTrunk, port.ID, port.NodeID)
+		case port.RouterID != "":
+			return network.Invalidf("router port %s cannot be a subport", port.ID)
+		case bypassesBridge(port):
+			return network.Invalidf("port %s bypasses the bridge and cannot be a subport", port.ID)
+		}
+		port.ParentPortID = parent.ID
+		port.VLANTag = sp.VLANTag
+		bindAsSubPort(port, parent)
+		return nil
+	})
+	return err
+}
+
+// releaseSubPort makes a subport of parent a plain, unbound port again.
+func (c *Controller) releaseSubPort(ctx context.Context, parentPortID, portID string) {
+	_, err := c.modifyPort(ctx, portID, func(port *network.Port) error {
+		if port.ParentPortID != parentPortID {
+			return nil
+		}
+		port.ParentPortID = ""
+		port.VLANTag = 0
+		bindAsSubPort(port, &network.Port{})
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrPortNotFound) {
+		c.logger.Warn("failed to release subport",
+			zap.String("port_id", portID),
+			zap.String("parent_port_id", parentPortID),
+			zap.Error(err),
+		)
+	}
+}
+
+// bindSubPorts binds the subports of a trunk parent wherever the parent is
+// now bound, or unbinds them with it.
+func (c *Controller) bindSubPorts(ctx context.Context, parent *network.Port) error {
+	trunk, err := c.trunkOf(ctx, parent.ID)
+	if err != nil || trunk == nil {
+		return err
+	}
+	for _, sp := range trunk.SubPorts {
+		_, err := c.modifyPort(ctx, sp.PortID, func(port *network.Port) error {
+			if port.ParentPortID == parent.ID {
+				bindAsSubPort(port, parent)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to bind subport %s: %w", sp.PortID, err)
+		}
+	}
+	return nil
+}
+
+// bindAsSubPort gives a subport the binding of its parent; its traffic
+// travels on the parent's device.
+func bindAsSubPort(port, parent *network.Port) {
+	port.InstanceID = parent.InstanceID
+	port.NodeID = parent.NodeID
+	port.DeviceName = parent.DeviceName
+	if parent.NodeID != "" {
+		port.Status = "build" // Until the node's network agent has programmed it
+	} else {
+		port.Status = "down"
+	}
+}
+
+// modifyPort atomically updates a port in etcd and the cache. fn may be
+// called more than once, with the latest version of the port.
+func (c *Controller) modifyPort(ctx context.Context, portID string, fn func(*network.Port) error) (*network.Port, error) {
+	var port network.Port
+	_, err := c.etcdClient.Modify(ctx, PortKeyPrefix+portID, func(value string) (string, error) {
+		port = network.Port{}
+		if err := json.Unmarshal([]byte(value), &port); err != nil {
+			return "", fmt.Errorf("failed to unmarshal port: %w", err)
+		}
+		if err := fn(&port); err != nil {
+			return "", err
+		}
+		port.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(&port)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal port: %w", err)
+		}
+		return string(data), nil
+	})
+	if errors.Is(err, etcd.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrPortNotFound, portID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.portsMu.Lock()
+	c.ports[portID] = &port
+	c.portsMu.Unlock()
+	return &port, nil
+}
+
+// modifyTrunk atomically updates a trunk in etcd.
+func (c *Controller) modifyTrunk(ctx context.Context, trunkID string, fn func(*network.Trunk) error) (*network.Trunk, error) {
+	var trunk network.Trunk
+	_, err := c.etcdClient.Modify(ctx, trunkKeyPrefix+trunkID, func(value string) (string, error) {
+		trunk = network.Trunk{}
+		if err := json.Unmarshal([]byte(value), &trunk); err != nil {
+			return "", fmt.Errorf("failed to unmarshal trunk: %w", err)
+		}
+		if err := fn(&trunk); err != nil {
+			return "", err
+		}
+		trunk.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(&trunk)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal trunk: %w", err)
+		}
+		return string(data), nil
+	})
+	if errors.Is(err, etcd.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrTrunkNotFound, trunkID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &trunk, nil
+}
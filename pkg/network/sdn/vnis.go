@@ -0,0 +1,135 @@
+package sdn
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/network"
+)
+
+// networkVNIKeyPrefix holds a key per VNI given to a VXLAN network, naming
+// the network, so concurrent creates cannot share a VNI.
+const networkVNIKeyPrefix = "/hypervisor/network/vnis/"
+
+// prepareVNI claims the VNI of a new VXLAN network in etcd, allocating a
+// free one from the configured range if the network has none.
+func (c *Controller) prepareVNI(ctx context.Context, net *network.Network) error {
+	if net.VNI != 0 {
+		if net.VNI > 16777215 {
+			return network.Invalidf("invalid VNI: %d (must be 1-16777215)", net.VNI)
+		}
+		if c.vnisInUse()[net.VNI] {
+			return fmt.Errorf("%w: VNI %d", network.ErrVNIInUse, net.VNI)
+		}
+		ok, err := c.claimNetworkVNI(ctx, net.VNI, net.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: VNI %d", network.ErrVNIInUse, net.VNI)
+		}
+		return nil
+	}
+
+	inUse := c.vnisInUse()
+	minVNI, maxVNI := c.vniRange()
+	for vni := minVNI; vni <= maxVNI; vni++ {
+		if inUse[vni] {
+			continue
+		}
+		ok, err := c.claimNetworkVNI(ctx, vni, net.ID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			net.VNI = vni
+			return nil
+		}
+	}
+	return fmt.Errorf("%w in %d-%d", network.ErrNoFreeVNI, minVNI, maxVNI)
+}
+
+// vniRange returns the configured network VNI range, defaulting unset
+// bounds.
+func (c *Controller) vniRange() (uint32, uint32) {
+	defaults := network.DefaultNetworkConfig()
+	minVNI, maxVNI := c.config.VNIMin, c.config.VNIMax
+	if minVNI == 0 {
+		minVNI = defaults.VNIMin
+	}
+	if maxVNI == 0 || maxVNI > 16777215 {
+		maxVNI = defaults.VNIMax
+	}
+	return minVNI, maxVNI
+}
+
+// claimNetworkVNI claims vni for a network unless a network or a segment
+// holds it.
+func (c *Controller) claimNetworkVNI(ctx context.Context, vni uint32, networkID string) (bool, error) {
+	ok, err := c.claimVNI(ctx, networkVNIKey(vni), segmentVNIKey(vni), networkID)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim VNI %d: %w", vni, err)
+	}
+	return ok, nil
+}
+
+// claimVNI creates key, naming networkID, if neither it nor otherKey, the
+// claim of the same VNI by the other kind of owner, exists.
+func (c *Controller) claimVNI(ctx context.Context, key, otherKey, networkID string) (bool, error) {
+	resp, err := c.etcdClient.Raw().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+			clientv3.Compare(clientv3.CreateRevision(otherKey), "=", 0),
+		).
+		Then(clientv3.OpPut(key, networkID)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// releaseNetworkVNI releases the VNI of a network, if the network holds
+// it.
+func (c *Controller) releaseNetworkVNI(ctx context.Context, net *network.Network) {
+	if net.Type != network.NetworkTypeVXLAN || net.VNI == 0 {
+		return
+	}
+	key := networkVNIKey(net.VNI)
+	_, err := c.etcdClient.Raw().Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", net.ID)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		c.logger.Warn("failed to release VNI",
+			zap.Uint32("vni", net.VNI),
+			zap.String("network_id", net.ID),
+			zap.Error(err),
+		)
+	}
+}
+
+// claimExistingVNIs claims the VNIs of networks created before VNIs were
+// claimed, so that allocation cannot hand them out again.
+func (c *Controller) claimExistingVNIs(ctx context.Context, nets []*network.Network) {
+	for _, net := range nets {
+		if net.Type != network.NetworkTypeVXLAN || net.VNI == 0 {
+			continue
+		}
+		if _, err := c.etcdClient.CreateIfNotExists(ctx, networkVNIKey(net.VNI), net.ID); err != nil {
+			c.logger.Warn("failed to claim VNI of existing network",
+				zap.Uint32("vni", net.VNI),
+				zap.String("network_id", net.ID),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func networkVNIKey(vni uint32) string {
+	return networkVNIKeyPrefix + strconv.FormatUint(uint64(vni), 10)
+}
@@ -0,0 +1,544 @@
+package sdn
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/cluster/events"
+	"hypervisor/pkg/network"
+)
+
+// Keys of VPN services. Private keys are kept apart from the services, so
+// that listing services never exposes them, and sealed with the etcd secret
+// key if one is configured; only the agent of the node serving a service
+// reads its key. That agent also reports the state of the
+// service's tunnels under vpnStatusKeyPrefix.
+const (
+	vpnKeyPrefix        = "/hypervisor/network/vpns/"
+	vpnPrivateKeyPrefix = "/hypervisor/network/vpn-keys/"
+	vpnStatusKeyPrefix  = "/hypervisor/network/vpn-status/"
+)
+
+// defaultVPNListenPort is the UDP port WireGuard listens on unless another
+// is requested.
+const defaultVPNListenPort = 51820
+
+// maxPersistentKeepalive is the longest keepalive interval WireGuard accepts.
+const maxPersistentKeepalive = 65535
+
+// CreateVPNService creates a VPN service on a router with its initial peers
+// and generates its key pair. The router must be distributed and have an
+// external gateway, whose address the peers connect to. Without vpn.NodeID,
+// the service is placed on whichever of nodes serves the fewest.
+func (c *Controller) CreateVPNService(ctx context.Context, vpn *network.VPNService, nodes []string) error {
+	router, err := c.GetRouter(ctx, vpn.RouterID)
+	if err != nil {
+		return err
+	}
+	if !router.Distributed {
+		return network.Invalidf("router %s is not distributed; VPN tunnels are served from the router's namespace", router.ID)
+	}
+	gw := router.ExternalGatewayInfo
+	if gw == nil || len(gw.ExternalFixedIPs) == 0 {
+		return network.Invalidf("router %s has no external gateway for peers to connect to", router.ID)
+	}
+	if vpn.TenantID == "" {
+		vpn.TenantID = router.TenantID
+	}
+
+	if vpn.ListenPort == 0 {
+		vpn.ListenPort = defaultVPNListenPort
+	}
+	services, err := c.ListVPNServices(ctx, "")
+	if err != nil {
+		return err
+	}
+	load := make(map[string]int, len(nodes))
+	for _, other := range services {
+		load[other.NodeID]++
+		if other.RouterID == vpn.RouterID && other.ListenPort == vpn.ListenPort {
+			return fmt.Errorf("%w: port %d by VPN service %s on router %s", ErrVPNPortInUse, vpn.ListenPort, other.ID, vpn.RouterID)
+		}
+	}
+
+	for i := range vpn.Peers {
+		if err := validateVPNPeer(&vpn.Peers[i], vpn.Peers[:i]); err != nil {
+			return err
+		}
+		if err := c.checkRemoteCIDRs(ctx, vpn.ID, vpn.RouterID, vpn.Peers[i].AllowedCIDRs); err != nil {
+			return err
+		}
+	}
+
+	if vpn.NodeID == "" {
+		if len(nodes) == 0 {
+			return fmt.Errorf("%w: no node has finished SDN bootstrap", ErrNoVPNNode)
+		}
+		vpn.NodeID = pickLeastLoaded(nodes, load)
+	}
+	vpn.Endpoint = net.JoinHostPort(gw.ExternalFixedIPs[0].IPAddress, strconv.Itoa(int(vpn.ListenPort)))
+
+	privateKey, publicKey, err := generateVPNKey()
+	if err != nil {
+		return err
+	}
+	if err := c.storeVPNKey(ctx, vpn.ID, privateKey); err != nil {
+		return err
+	}
+	vpn.PublicKey = publicKey
+
+	vpn.Status = "build"
+	vpn.CreatedAt = time.Now()
+	vpn.UpdatedAt = vpn.CreatedAt
+	data, err := json.Marshal(vpn)
+	if err == nil {
+		err = c.etcdClient.Put(ctx, vpnKeyPrefix+vpn.ID, string(data))
+	}
+	if err != nil {
+		c.deleteVPNKeys(ctx, vpn.ID)
+		return fmt.Errorf("failed to store VPN service: %w", err)
+	}
+
+	c.logger.Info("created VPN service",
+		zap.String("vpn_id", vpn.ID),
+		zap.String("router_id", vpn.RouterID),
+		zap.String("endpoint", vpn.Endpoint),
+		zap.String("node_id", vpn.NodeID),
+	)
+	c.recordVPNEvent(ctx, vpn, "Created", fmt.Sprintf("endpoint %s with %d peers", vpn.Endpoint, len(vpn.Peers)))
+	return nil
+}
+
+// storeVPNKey stores the private key of a VPN service for the node serving
+// it, sealed with the etcd secret key if one is configured.
+func (c *Controller) storeVPNKey(ctx context.Context, vpnID, privateKey string) error {
+	sealed, err := c.etcdClient.SealSecret(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to seal VPN private key: %w", err)
+	}
+	if err := c.etcdClient.Put(ctx, vpnPrivateKeyPrefix+vpnID, sealed); err != nil {
+		return fmt.Errorf("failed to store VPN private key: %w", err)
+	}
+	return nil
+}
+
+// validHost reports whether the host of a peer endpoint is an IP address or
+// a DNS name, whose labels hold only letters, digits and inner hyphens. It
+// ends up in the WireGuard configuration, one setting per line.
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// generateVPNKey generates a WireGuard key pair, returning both keys in
+// base64 as WireGuard expects them.
+func generateVPNKey() (privateKey, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate VPN key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()),
+		base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// validateVPNPeer checks a peer against the others of its service and
+// normalizes its CIDRs.
+func validateVPNPeer(peer *network.VPNPeer, others []network.VPNPeer) error {
+	key, err := base64.StdEncoding.DecodeString(peer.PublicKey)
+	if err != nil || len(key) != 32 {
+		return network.Invalidf("invalid public key of peer %q: must be 32 bytes in base64", peer.Name)
+	}
+	if peer.Endpoint != "" {
+		host, port, err := net.SplitHostPort(peer.Endpoint)
+		if err != nil || host == "" {
+			return network.Invalidf("invalid endpoint %q of peer %q: must be host:port", peer.Endpoint, peer.Name)
+		}
+		if !validHost(host) {
+			return network.Invalidf("invalid endpoint %q of peer %q: host must be an IP address or a DNS name", peer.Endpoint, peer.Name)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return network.Invalidf("invalid endpoint %q of peer %q: port must be 1-65535", peer.Endpoint, peer.Name)
+		}
+	}
+	if peer.PersistentKeepalive < 0 || peer.PersistentKeepalive > maxPersistentKeepalive {
+		return network.Invalidf("invalid persistent keepalive %d of peer %q: must be 0-%d seconds", peer.PersistentKeepalive, peer.Name, maxPersistentKeepalive)
+	}
+	if len(peer.AllowedCIDRs) == 0 {
+		return network.Invalidf("peer %q has no allowed CIDRs to route to it", peer.Name)
+	}
+
+	cidrs := make([]*net.IPNet, len(peer.AllowedCIDRs))
+	for i, s := range peer.AllowedCIDRs {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil || cidr.IP.To4() == nil {
+			return network.Invalidf("invalid allowed CIDR %q of peer %q: must be an IPv4 CIDR", s, peer.Name)
+		}
+		peer.AllowedCIDRs[i] = cidr.String()
+		cidrs[i] = cidr
+		for _, previous := range cidrs[:i] {
+			if cidrsOverlap(cidr, previous) {
+				return network.Invalidf("allowed CIDRs %s and %s of peer %q overlap", previous, cidr, peer.Name)
+			}
+		}
+	}
+
+	// WireGuard routes by allowed CIDRs, so the peers of a service may
+	// neither share a key nor CIDRs
+	for _, other := range others {
+		if other.PublicKey == peer.PublicKey {
+			return fmt.Errorf("%w: peer %s has the same public key", ErrVPNPeerExists, other.ID)
+		}
+		for _, s := range other.AllowedCIDRs {
+			_, theirs, err := net.ParseCIDR(s)
+			if err != nil {
+				continue
+			}
+			for _, ours := range cidrs {
+				if cidrsOverlap(ours, theirs) {
+					return network.Invalidf("allowed CIDR %s of peer %q overlaps %s of peer %s", ours, peer.Name, theirs, other.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkRemoteCIDRs rejects remote CIDRs of a VPN service overlapping a
+// subnet attached to its router, whose traffic would otherwise leave through
+// the tunnel, or the remote CIDRs of the router's other VPN services, which
+// share its routing table.
+func (c *Controller) checkRemoteCIDRs(ctx context.Context, vpnID, routerID string, remote []string) error {
+	interfaces, err := c.ListRouterInterfaces(ctx, routerID)
+	if err != nil {
+		return err
+	}
+	services, err := c.routerVPNs(ctx, routerID)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range remote {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			continue
+		}
+		for _, iface := range interfaces {
+			_, local, err := net.ParseCIDR(iface.CIDR)
+			if err != nil {
+				continue
+			}
+			if cidrsOverlap(cidr, local) {
+				return network.Invalidf("remote CIDR %s overlaps subnet %s (%s) of router %s", cidr, iface.SubnetID, local, routerID)
+			}
+		}
+		for _, vpn := range services {
+			if vpn.ID == vpnID {
+				continue
+			}
+			for _, peer := range vpn.Peers {
+				for _, t := range peer.AllowedCIDRs {
+					if _, theirs, err := net.ParseCIDR(t); err == nil && cidrsOverlap(cidr, theirs) {
+						return network.Invalidf("remote CIDR %s overlaps %s of peer %s of VPN service %s on the same router", cidr, theirs, peer.ID, vpn.ID)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkSubnetNotRemote rejects attaching a subnet to a router whose VPN
+// services route the subnet's addresses to a peer.
+func (c *Controller) checkSubnetNotRemote(ctx context.Context, routerID, subnetCIDR string) error {
+	_, local, err := net.ParseCIDR(subnetCIDR)
+	if err != nil {
+		return nil
+	}
+	services, err := c.routerVPNs(ctx, routerID)
+	if err != nil {
+		return err
+	}
+	for _, vpn := range services {
+		for _, peer := range vpn.Peers {
+			for _, s := range peer.AllowedCIDRs {
+				if _, remote, err := net.ParseCIDR(s); err == nil && cidrsOverlap(local, remote) {
+					return network.Invalidf("subnet %s overlaps remote CIDR %s of peer %s of VPN service %s", local, remote, peer.ID, vpn.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func cidrsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// GetVPNService retrieves a VPN service by ID.
+func (c *Controller) GetVPNService(ctx context.Context, vpnID string) (*network.VPNService, error) {
+	value, err := c.etcdClient.Get(ctx, vpnKeyPrefix+vpnID)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return nil, fmt.Errorf("%w: %s", ErrVPNServiceNotFound, vpnID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VPN service: %w", err)
+	}
+
+	var vpn network.VPNService
+	if err := json.Unmarshal([]byte(value), &vpn); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal VPN service: %w", err)
+	}
+	return &vpn, nil
+}
+
+// GetVPNStatus returns the state of a VPN service's tunnels as last reported
+// by the node serving it, or nil if it has not reported yet. A report from a
+// node the service has since moved off is ignored.
+func (c *Controller) GetVPNStatus(ctx context.Context, vpn *network.VPNService) (*network.VPNStatus, error) {
+	value, err := c.etcdClient.Get(ctx, vpnStatusKeyPrefix+vpn.ID)
+	if errors.Is(err, etcd.ErrKeyNotFound) || (err == nil && value == "") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VPN status: %w", err)
+	}
+
+	var status network.VPNStatus
+	if err := json.Unmarshal([]byte(value), &status); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal VPN status: %w", err)
+	}
+	if status.NodeID != vpn.NodeID {
+		return nil, nil
+	}
+	return &status, nil
+}
+
+// ListVPNServices returns the VPN services, or those of a tenant, oldest
+// first.
+func (c *Controller) ListVPNServices(ctx context.Context, tenantID string) ([]*network.VPNService, error) {
+	kvs, err := c.etcdClient.GetWithPrefix(ctx, vpnKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VPN services: %w", err)
+	}
+
+	services := make([]*network.VPNService, 0, len(kvs))
+	for _, value := range kvs {
+		var vpn network.VPNService
+		if err := json.Unmarshal([]byte(value), &vpn); err != nil {
+			continue
+		}
+		if tenantID != "" && vpn.TenantID != tenantID {
+			continue
+		}
+		services = append(services, &vpn)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].CreatedAt.Before(services[j].CreatedAt)
+	})
+	return services, nil
+}
+
+// routerVPNs returns the VPN services of a router.
+func (c *Controller) routerVPNs(ctx context.Context, routerID string) ([]*network.VPNService, error) {
+	services, err := c.ListVPNServices(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var onRouter []*network.VPNService
+	for _, vpn := range services {
+		if vpn.RouterID == routerID {
+			onRouter = append(onRouter, vpn)
+		}
+	}
+	return onRouter, nil
+}
+
+// checkRouterHasNoVPNs rejects a change to a router that would leave its VPN
+// services without the gateway their peers connect to.
+func (c *Controller) checkRouterHasNoVPNs(ctx context.Context, routerID, change string) error {
+	services, err := c.routerVPNs(ctx, routerID)
+	if err != nil {
+		return err
+	}
+	if len(services) > 0 {
+		return fmt.Errorf("%w: VPN service %s (and %d more), delete them before %s", ErrRouterHasVPNs, services[0].ID, len(services)-1, change)
+	}
+	return nil
+}
+
+// DeleteVPNService deletes a VPN service and its key; the agent serving it
+// tears its tunnels down.
+func (c *Controller) DeleteVPNService(ctx context.Context, vpnID string) error {
+	vpn, err := c.GetVPNService(ctx, vpnID)
+	if err != nil {
+		return err
+	}
+	if err := c.etcdClient.Delete(ctx, vpnKeyPrefix+vpnID); err != nil {
+		return fmt.Errorf("failed to delete VPN service: %w", err)
+	}
+	c.deleteVPNKeys(ctx, vpnID)
+
+	c.logger.Info("deleted VPN service", zap.String("vpn_id", vpnID))
+	c.recordVPNEvent(ctx, vpn, "Deleted", fmt.Sprintf("endpoint %s closed", vpn.Endpoint))
+	return nil
+}
+
+// deleteVPNKeys deletes the private key and status of a deleted VPN
+// service, logging failures since the service is already gone.
+func (c *Controller) deleteVPNKeys(ctx context.Context, vpnID string) {
+	for _, key := range []string{vpnPrivateKeyPrefix + vpnID, vpnStatusKeyPrefix + vpnID} {
+		if err := c.etcdClient.Delete(ctx, key); err != nil {
+			c.logger.Warn("failed to delete VPN service key",
+				zap.String("vpn_id", vpnID),
+				zap.String("key", key),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// AddVPNPeer adds a remote site to a VPN service.
+func (c *Controller) AddVPNPeer(ctx context.Context, vpnID string, peer *network.VPNPeer) (*network.VPNService, error) {
+	vpn, err := c.GetVPNService(ctx, vpnID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateVPNPeer(peer, vpn.Peers); err != nil {
+		return nil, err
+	}
+	if err := c.checkRemoteCIDRs(ctx, vpn.ID, vpn.RouterID, peer.AllowedCIDRs); err != nil {
+		return nil, err
+	}
+
+	vpn, err = c.modifyVPNService(ctx, vpnID, func(vpn *network.VPNService) error {
+		// Peers added concurrently are only known now
+		if err := validateVPNPeer(peer, vpn.Peers); err != nil {
+			return err
+		}
+		vpn.Peers = append(vpn.Peers, *peer)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.recordVPNEvent(ctx, vpn, "PeerAdded", fmt.Sprintf("peer %s routing %v", peer.ID, peer.AllowedCIDRs))
+	return vpn, nil
+}
+
+// RemoveVPNPeer removes a remote site from a VPN service.
+func (c *Controller) RemoveVPNPeer(ctx context.Context, vpnID, peerID string) (*network.VPNService, error) {
+	vpn, err := c.modifyVPNService(ctx, vpnID, func(vpn *network.VPNService) error {
+		for i, peer := range vpn.Peers {
+			if peer.ID == peerID {
+				vpn.Peers = append(vpn.Peers[:i], vpn.Peers[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s on VPN service %s", ErrVPNPeerNotFound, peerID, vpnID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.recordVPNEvent(ctx, vpn, "PeerRemoved", fmt.Sprintf("peer %s", peerID))
+	return vpn, nil
+}
+
+// RotateVPNKey gives a VPN service a new key pair. The tunnels stay down
+// until the peers are configured with the new public key.
+func (c *Controller) RotateVPNKey(ctx context.Context, vpnID string) (*network.VPNService, error) {
+	if _, err := c.GetVPNService(ctx, vpnID); err != nil {
+		return nil, err
+	}
+	privateKey, publicKey, err := generateVPNKey()
+	if err != nil {
+		return nil, err
+	}
+	// The agent reads the key when it sees the service change
+	if err := c.storeVPNKey(ctx, vpnID, privateKey); err != nil {
+		return nil, err
+	}
+
+	vpn, err := c.modifyVPNService(ctx, vpnID, func(vpn *network.VPNService) error {
+		vpn.PublicKey = publicKey
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.recordVPNEvent(ctx, vpn, "KeyRotated", "new public key "+publicKey)
+	return vpn, nil
+}
+
+// modifyVPNService atomically updates a VPN service in etcd, marking it for
+// the agent serving it to apply again. fn may be called more than once, with
+// the latest version of the service.
+func (c *Controller) modifyVPNService(ctx context.Context, vpnID string, fn func(*network.VPNService) error) (*network.VPNService, error) {
+	var vpn network.VPNService
+	_, err := c.etcdClient.Modify(ctx, vpnKeyPrefix+vpnID, func(value string) (string, error) {
+		vpn = network.VPNService{}
+		if err := json.Unmarshal([]byte(value), &vpn); err != nil {
+			return "", fmt.Errorf("failed to unmarshal VPN service: %w", err)
+		}
+		if err := fn(&vpn); err != nil {
+			return "", err
+		}
+		vpn.Status = "build"
+		vpn.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(&vpn)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal VPN service: %w", err)
+		}
+		return string(data), nil
+	})
+	if errors.Is(err, etcd.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrVPNServiceNotFound, vpnID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &vpn, nil
+}
+
+// recordVPNEvent records an event about a VPN service.
+func (c *Controller) recordVPNEvent(ctx context.Context, vpn *network.VPNService, reason, message string) {
+	c.events.Record(ctx, events.Event{
+		Kind:     events.KindVPNService,
+		ObjectID: vpn.ID,
+		NodeID:   vpn.NodeID,
+		Reason:   reason,
+		Message:  message,
+	})
+}
@@ -0,0 +1,271 @@
+package sdn
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+
+	"hypervisor/pkg/cluster/etcd"
+	"hypervisor/pkg/network"
+)
+
+// Every control-plane node runs a controller, and any of them may take a
+// request. Each mirrors the networks, ports, security groups, routers and
+// floating IPs in etcd into its caches, security group flows and, through
+// its router programmer, router namespaces and NAT by watching their
+// prefixes, so changes made through another node reach it too. Port flows
+// are left to the network agents.
+
+// resyncInterval is how long a watch waits before listing its prefix again
+// after the watch ended or the list failed.
+const resyncInterval = time.Second
+
+// resourceWatch is a prefix the controller mirrors.
+type resourceWatch struct {
+	name   string
+	prefix string
+
+	// ids returns the IDs in the cache, to find those deleted while the
+	// watch was down.
+	ids func() []string
+
+	// handle applies a change to the cache and the flows.
+	handle func(etcd.WatchEvent)
+}
+
+func (c *Controller) resourceWatches() []resourceWatch {
+	return []resourceWatch{
+		{
+			name:   "network",
+			prefix: networkKeyPrefix,
+			ids:    func() []string { return cachedIDs(&c.networksMu, c.networks) },
+			handle: c.handleNetworkEvent,
+		},
+		{
+			name:   "port",
+			prefix: PortKeyPrefix,
+			ids:    func() []string { return cachedIDs(&c.portsMu, c.ports) },
+			handle: c.handlePortEvent,
+		},
+		{
+			name:   "security group",
+			prefix: securityGroupKeyPrefix,
+			ids:    func() []string { return cachedIDs(&c.sgMu, c.securityGroups) },
+			handle: c.handleSecurityGroupEvent,
+		},
+		{
+			name:   "router",
+			prefix: routerKeyPrefix,
+			ids:    func() []string { return cachedIDs(&c.routersMu, c.routers) },
+			handle: c.handleRouterEvent,
+		},
+		{
+			name:   "floating IP",
+			prefix: floatingIPKeyPrefix,
+			ids:    func() []string { return cachedIDs(&c.fipMu, c.floatingIPs) },
+			handle: c.handleFloatingIPEvent,
+		},
+	}
+}
+
+// watchResource applies the changes to a prefix made after rev. When the
+// watch ends, because the connection to etcd or its leader was lost or etcd
+// compacted past the revision, it lists the prefix again, reconciles the
+// cache with the listing and watches from there, so no change is missed.
+func (c *Controller) watchResource(w resourceWatch, rev int64) {
+	defer c.wg.Done()
+
+	for {
+		ctx := clientv3.WithRequireLeader(c.ctx)
+		for event := range c.etcdClient.WatchPrefixEvents(ctx, w.prefix, clientv3.WithRev(rev+1)) {
+			w.handle(event)
+		}
+
+		for {
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.logger.Warn(w.name+" watch ended, resyncing", zap.String("prefix", w.prefix))
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(resyncInterval):
+			}
+
+			var err error
+			if rev, err = c.resync(w); err == nil {
+				break
+			}
+			c.logger.Warn("failed to resync "+w.name+"s", zap.Error(err))
+		}
+	}
+}
+
+// resync applies the current contents of a prefix as puts, and deletes the
+// cached entries missing from it. It returns the revision it read at.
+func (c *Controller) resync(w resourceWatch) (int64, error) {
+	kvs, rev, err := c.etcdClient.GetWithPrefixRevision(c.ctx, w.prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	present := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		present[kv.Key[len(w.prefix):]] = true
+		w.handle(etcd.WatchEvent{Type: etcd.EventTypePut, Key: kv.Key, Value: kv.Value})
+	}
+	for _, id := range w.ids() {
+		if !present[id] {
+			w.handle(etcd.WatchEvent{Type: etcd.EventTypeDelete, Key: w.prefix + id})
+		}
+	}
+
+	c.logger.Info("resynced "+w.name+"s", zap.Int("count", len(kvs)))
+	return rev, nil
+}
+
+// handlePortEvent processes a port change event. The flows of a port are
+// programmed by the network agent of the node it is bound to.
+func (c *Controller) handlePortEvent(event etcd.WatchEvent) {
+	portID := event.Key[len(PortKeyPrefix):]
+
+	switch event.Type {
+	case etcd.EventTypePut:
+		var port network.Port
+		if err := json.Unmarshal([]byte(event.Value), &port); err != nil {
+			c.logger.Warn("failed to unmarshal port event", zap.Error(err))
+			return
+		}
+
+		c.portsMu.Lock()
+		if old, exists := c.ports[port.ID]; exists && unchanged(old, event.Value) {
+			c.portsMu.Unlock()
+			return
+		}
+		c.ports[port.ID] = &port
+		c.portsMu.Unlock()
+
+		c.logger.Debug("port updated", zap.String("port_id", port.ID))
+
+	case etcd.EventTypeDelete:
+		c.portsMu.Lock()
+		_, exists := c.ports[portID]
+		delete(c.ports, portID)
+		c.portsMu.Unlock()
+
+		if exists {
+			c.logger.Info("port removed", zap.String("port_id", portID))
+		}
+	}
+}
+
+// handleRouterEvent processes a router change event, programming the
+// router on this host.
+func (c *Controller) handleRouterEvent(event etcd.WatchEvent) {
+	routerID := event.Key[len(routerKeyPrefix):]
+
+	switch event.Type {
+	case etcd.EventTypePut:
+		var router network.Router
+		if err := json.Unmarshal([]byte(event.Value), &router); err != nil {
+			c.logger.Warn("failed to unmarshal router event", zap.Error(err))
+			return
+		}
+
+		c.routersMu.Lock()
+		if old, exists := c.routers[router.ID]; exists && unchanged(old, event.Value) {
+			c.routersMu.Unlock()
+			return
+		}
+		c.routers[router.ID] = &router
+		c.routersMu.Unlock()
+
+		c.programRouter(&router)
+		c.logger.Info("router updated", zap.String("router_id", router.ID))
+
+	case etcd.EventTypeDelete:
+		c.routersMu.Lock()
+		_, exists := c.routers[routerID]
+		delete(c.routers, routerID)
+		c.routersMu.Unlock()
+
+		if exists {
+			c.unprogramRouter(routerID)
+			c.logger.Info("router removed", zap.String("router_id", routerID))
+		}
+	}
+}
+
+// handleFloatingIPEvent processes a floating IP change event, moving its
+// NAT when its association changed.
+func (c *Controller) handleFloatingIPEvent(event etcd.WatchEvent) {
+	fipID := event.Key[len(floatingIPKeyPrefix):]
+
+	switch event.Type {
+	case etcd.EventTypePut:
+		var fip network.FloatingIP
+		if err := json.Unmarshal([]byte(event.Value), &fip); err != nil {
+			c.logger.Warn("failed to unmarshal floating IP event", zap.Error(err))
+			return
+		}
+
+		c.fipMu.Lock()
+		old, exists := c.floatingIPs[fip.ID]
+		if exists && unchanged(old, event.Value) {
+			c.fipMu.Unlock()
+			return
+		}
+		c.floatingIPs[fip.ID] = &fip
+		c.fipMu.Unlock()
+
+		if !exists || floatingIPNATChanged(old, &fip) {
+			c.programFloatingIP(c.ctx, old, &fip)
+		}
+		c.logger.Info("floating IP updated",
+			zap.String("fip_id", fip.ID),
+			zap.String("floating_ip", fip.FloatingIP),
+		)
+
+	case etcd.EventTypeDelete:
+		c.fipMu.Lock()
+		fip, exists := c.floatingIPs[fipID]
+		delete(c.floatingIPs, fipID)
+		c.fipMu.Unlock()
+
+		if exists {
+			c.programFloatingIP(c.ctx, fip, nil)
+			c.logger.Info("floating IP removed", zap.String("fip_id", fipID))
+		}
+	}
+}
+
+// floatingIPNATChanged reports whether a floating IP changed in a field its
+// NAT is built from.
+func floatingIPNATChanged(old, fip *network.FloatingIP) bool {
+	return old.FloatingIP != fip.FloatingIP ||
+		old.FloatingNetworkID != fip.FloatingNetworkID ||
+		old.FixedIP != fip.FixedIP ||
+		old.PortID != fip.PortID
+}
+
+// unchanged reports whether the cached entry is the one value encodes, as
+// for the controller's own writes coming back through the watch.
+func unchanged(cached any, value string) bool {
+	data, err := json.Marshal(cached)
+	return err == nil && string(data) == value
+}
+
+// cachedIDs returns the keys of a cache.
+func cachedIDs[T any](mu *sync.RWMutex, cache map[string]T) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	ids := make([]string, 0, len(cache))
+	for id := range cache {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -3,6 +3,7 @@ package network
 
 import (
 	"net"
+	"slices"
 	"time"
 )
 
@@ -20,29 +21,104 @@ const (
 type Network struct {
 	ID          string            `json:"id"`
 	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
 	Type        NetworkType       `json:"type"`
 	VNI         uint32            `json:"vni,omitempty"`         // VXLAN Network Identifier (1-16777215)
 	VLANID      uint16            `json:"vlan_id,omitempty"`     // VLAN ID (1-4094)
-	MTU         uint16            `json:"mtu"`                   // Network MTU (default 1450 for VXLAN)
+	MTU         uint16            `json:"mtu"`                   // Network MTU (default: the underlay MTU less encapsulation overhead)
 	AdminState  bool              `json:"admin_state"`           // Administrative state
 	Shared      bool              `json:"shared"`                // Shared across tenants
 	External    bool              `json:"external"`              // Connected to external network
 	TenantID    string            `json:"tenant_id,omitempty"`   // Owner tenant
 	Labels      map[string]string `json:"labels,omitempty"`      // Custom labels
 	Annotations map[string]string `json:"annotations,omitempty"` // Custom annotations
+	Segments    []NetworkSegment  `json:"segments,omitempty"`    // Per-zone segments (VXLAN only)
+	BGP         *BGPConfig        `json:"bgp,omitempty"`         // Advertisement of its addresses (external only)
 	CreatedAt   time.Time         `json:"created_at"`
 	UpdatedAt   time.Time         `json:"updated_at"`
 }
 
+// NetworkSegment is the part of a network realized in one zone. Each segment
+// has its own VNI, tunneled only between the VTEPs of its zone, so broadcast
+// and unknown unicast stay within the zone, while unicast to the ports of
+// other segments is stitched across VNIs.
+type NetworkSegment struct {
+	Zone string `json:"zone"`
+	VNI  uint32 `json:"vni"`
+}
+
+// BGPConfig configures the advertisement of an external network's floating
+// IPs and router gateway addresses over BGP, for sites where the upstream
+// routers share no L2 segment with the nodes. Each speaker node peers with
+// the upstream routers and announces every address as a /32 with itself as
+// the next hop.
+type BGPConfig struct {
+	LocalAS uint32    `json:"local_as"`
+	Nodes   []string  `json:"nodes"` // Gateway nodes running a speaker
+	Peers   []BGPPeer `json:"peers"`
+}
+
+// BGPPeer is an upstream router the speakers of an external network peer
+// with.
+type BGPPeer struct {
+	Address  string   `json:"address"`
+	RemoteAS uint32   `json:"remote_as"`
+	Password string   `json:"password,omitempty"` // TCP MD5 signature
+	Nodes    []string `json:"nodes,omitempty"`    // Speakers peering with it, e.g. those in its rack; empty means all
+}
+
+// PeersOf returns the peers the speaker on a node peers with.
+func (c *BGPConfig) PeersOf(nodeID string) []BGPPeer {
+	var peers []BGPPeer
+	for _, peer := range c.Peers {
+		if len(peer.Nodes) == 0 || slices.Contains(peer.Nodes, nodeID) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// SegmentVNI returns the VNI of the network's segment in zone. Ports in
+// zones without a segment use the network's own VNI.
+func (n *Network) SegmentVNI(zone string) uint32 {
+	for _, segment := range n.Segments {
+		if zone != "" && segment.Zone == zone {
+			return segment.VNI
+		}
+	}
+	return n.VNI
+}
+
+// SegmentZone returns the zone of the segment using vni, or "" for the
+// network's own VNI.
+func (n *Network) SegmentZone(vni uint32) string {
+	for _, segment := range n.Segments {
+		if segment.VNI == vni {
+			return segment.Zone
+		}
+	}
+	return ""
+}
+
+// VNIs returns the network's own VNI followed by those of its segments.
+func (n *Network) VNIs() []uint32 {
+	vnis := []uint32{n.VNI}
+	for _, segment := range n.Segments {
+		vnis = append(vnis, segment.VNI)
+	}
+	return vnis
+}
+
 // Subnet represents an IP subnet within a network.
 type Subnet struct {
 	ID              string    `json:"id"`
 	Name            string    `json:"name"`
 	NetworkID       string    `json:"network_id"`
-	CIDR            string    `json:"cidr"`             // e.g., "10.0.0.0/24"
-	GatewayIP       string    `json:"gateway_ip"`       // e.g., "10.0.0.1"
-	DNSServers      []string  `json:"dns_servers"`      // e.g., ["8.8.8.8", "8.8.4.4"]
-	AllocationPools []IPPool  `json:"allocation_pools"` // IP ranges for allocation
+	TenantID        string    `json:"tenant_id,omitempty"` // Tenant of the network, which the name is unique within
+	CIDR            string    `json:"cidr"`                // e.g., "10.0.0.0/24"
+	GatewayIP       string    `json:"gateway_ip"`          // e.g., "10.0.0.1"
+	DNSServers      []string  `json:"dns_servers"`         // e.g., ["8.8.8.8", "8.8.4.4"]
+	AllocationPools []IPPool  `json:"allocation_pools"`    // IP ranges for allocation
 	EnableDHCP      bool      `json:"enable_dhcp"`
 	IPv6            bool      `json:"ipv6"`
 	CreatedAt       time.Time `json:"created_at"`
@@ -51,21 +127,76 @@ type Subnet struct {
 
 // IPPool represents a range of IP addresses available for allocation.
 type IPPool struct {
-	Start string `json:"start"` // e.g., "10.0.0.10"
-	End   string `json:"end"`   // e.g., "10.0.0.254"
+	Name        string     `json:"name,omitempty"`
+	Start       string     `json:"start"`                  // e.g., "10.0.0.10"
+	End         string     `json:"end"`                    // e.g., "10.0.0.254"
+	Type        IPPoolType `json:"type,omitempty"`         // dynamic (default) or static
+	Zone        string     `json:"zone,omitempty"`         // Preferred by instances in this zone
+	ReservedFor []string   `json:"reserved_for,omitempty"` // Instance, port or host names allowed to use the pool
+}
+
+// IPPoolType controls how addresses in a pool are handed out.
+type IPPoolType string
+
+const (
+	// IPPoolTypeDynamic pools serve automatic (DHCP-style) allocations.
+	IPPoolTypeDynamic IPPoolType = "dynamic"
+	// IPPoolTypeStatic pools only serve explicitly requested addresses.
+	IPPoolTypeStatic IPPoolType = "static"
+)
+
+// IsStatic returns true if the pool only serves explicitly requested addresses.
+func (p *IPPool) IsStatic() bool {
+	return p.Type == IPPoolTypeStatic
+}
+
+// Allows reports whether an allocation for the given owners may use the pool.
+// Pools without a reserved-for list are open to everyone.
+func (p *IPPool) Allows(owners ...string) bool {
+	if len(p.ReservedFor) == 0 {
+		return true
+	}
+	for _, reserved := range p.ReservedFor {
+		for _, owner := range owners {
+			if owner != "" && owner == reserved {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // IPAllocation represents an allocated IP address.
 type IPAllocation struct {
-	ID         string    `json:"id"`
-	SubnetID   string    `json:"subnet_id"`
-	IPAddress  string    `json:"ip_address"`
-	MACAddress string    `json:"mac_address"`
-	InstanceID string    `json:"instance_id,omitempty"` // VM/container using this IP
-	PortID     string    `json:"port_id,omitempty"`     // Virtual port ID
-	Hostname   string    `json:"hostname,omitempty"`
-	Status     string    `json:"status"` // allocated, reserved, dhcp
-	CreatedAt  time.Time `json:"created_at"`
+	ID          string    `json:"id"`
+	SubnetID    string    `json:"subnet_id"`
+	IPAddress   string    `json:"ip_address"`
+	MACAddress  string    `json:"mac_address"`
+	InstanceID  string    `json:"instance_id,omitempty"` // VM/container using this IP
+	PortID      string    `json:"port_id,omitempty"`     // Virtual port ID
+	Hostname    string    `json:"hostname,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Status      string    `json:"status"` // allocated, reserved, static, dhcp
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Statuses of an IP allocation.
+const (
+	// AllocationStatusAllocated addresses belong to a port or an instance.
+	AllocationStatusAllocated = "allocated"
+	// AllocationStatusReserved addresses are held out of allocation.
+	AllocationStatusReserved = "reserved"
+	// AllocationStatusStatic addresses are assigned to something outside
+	// the SDN, such as an external appliance, rather than to a port.
+	AllocationStatusStatic = "static"
+	// AllocationStatusDHCP addresses were leased over DHCP.
+	AllocationStatusDHCP = "dhcp"
+)
+
+// IsReservation reports whether the allocation is a reservation or a static
+// allocation rather than an address in use by a port.
+func (a *IPAllocation) IsReservation() bool {
+	return a.Status == AllocationStatusReserved || a.Status == AllocationStatusStatic
 }
 
 // Port represents a virtual network port attached to an instance.
@@ -73,6 +204,7 @@ type Port struct {
 	ID             string          `json:"id"`
 	Name           string          `json:"name,omitempty"`
 	NetworkID      string          `json:"network_id"`
+	TenantID       string          `json:"tenant_id,omitempty"` // Tenant of the network, which the name is unique within
 	SubnetID       string          `json:"subnet_id"`
 	MACAddress     string          `json:"mac_address"`
 	IPAddress      string          `json:"ip_address"`
@@ -81,12 +213,214 @@ type Port struct {
 	DeviceName     string          `json:"device_name,omitempty"` // tap0, veth0, etc.
 	SecurityGroups []string        `json:"security_groups,omitempty"`
 	AdminState     bool            `json:"admin_state"`
-	Status         string          `json:"status"` // active, down, build
+	Status         string          `json:"status"` // active, down, build, error
 	BindingType    PortBindingType `json:"binding_type"`
+	Zone           string          `json:"zone,omitempty"`             // Availability zone, used to pick an IP pool
+	RouterID       string          `json:"router_id,omitempty"`        // Router owning the port (interface or gateway)
+	QoS            *PortQoS        `json:"qos,omitempty"`              // Bandwidth limits, none if nil
+	ParentPortID   string          `json:"parent_port_id,omitempty"`   // Trunk parent of a subport
+	VLANTag        uint16          `json:"vlan_tag,omitempty"`         // Tag of a subport on its parent's device
+	LoadBalancerID string          `json:"load_balancer_id,omitempty"` // Load balancer whose VIP the port holds
 	CreatedAt      time.Time       `json:"created_at"`
 	UpdatedAt      time.Time       `json:"updated_at"`
 }
 
+// PortQoS limits the bandwidth of a port. Directions are those of the
+// instance: egress is the traffic it sends, ingress the traffic it
+// receives. A zero rate leaves the direction unlimited; a zero burst lets
+// the node pick one.
+type PortQoS struct {
+	IngressRateKbps uint64 `json:"ingress_rate_kbps,omitempty"`
+	IngressBurstKb  uint64 `json:"ingress_burst_kb,omitempty"`
+	EgressRateKbps  uint64 `json:"egress_rate_kbps,omitempty"`
+	EgressBurstKb   uint64 `json:"egress_burst_kb,omitempty"`
+}
+
+// IsZero reports whether q limits nothing.
+func (q *PortQoS) IsZero() bool {
+	return q == nil || (q.IngressRateKbps == 0 && q.EgressRateKbps == 0)
+}
+
+// PortStats holds the traffic counters of a bound port, as read by the node
+// it is bound to at UpdatedAt. Like PortQoS, directions are those of the
+// instance: Rx counts what it received, Tx what it sent.
+type PortStats struct {
+	PortID    string    `json:"port_id"`
+	NodeID    string    `json:"node_id"`
+	RxPackets uint64    `json:"rx_packets"`
+	TxPackets uint64    `json:"tx_packets"`
+	RxBytes   uint64    `json:"rx_bytes"`
+	TxBytes   uint64    `json:"tx_bytes"`
+	RxDropped uint64    `json:"rx_dropped"`
+	TxDropped uint64    `json:"tx_dropped"`
+	RxErrors  uint64    `json:"rx_errors"`
+	TxErrors  uint64    `json:"tx_errors"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Trunk lets an instance terminate several networks on one vNIC: the parent
+// port carries its own network untagged, and each subport's network tagged
+// with the subport's VLAN. Subports are bound wherever the parent is, to the
+// parent's device.
+type Trunk struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name,omitempty"`
+	ParentPortID string    `json:"parent_port_id"`
+	SubPorts     []SubPort `json:"sub_ports,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// SubPort maps a port to a VLAN tag on its trunk's parent.
+type SubPort struct {
+	PortID  string `json:"port_id"`
+	VLANTag uint16 `json:"vlan_tag"` // 1-4094
+}
+
+// PortMirror copies the traffic of a port to another port bound to the same
+// node, or to a remote collector over a tunnel, for troubleshooting. It is
+// applied by the network agent of the node the source port is bound to.
+type PortMirror struct {
+	ID           string          `json:"id"`
+	Name         string          `json:"name,omitempty"`
+	SourcePortID string          `json:"source_port_id"`
+	Direction    MirrorDirection `json:"direction"`
+	TargetPortID string          `json:"target_port_id,omitempty"` // Either a port
+	Tunnel       *MirrorTunnel   `json:"tunnel,omitempty"`         // or a tunnel receives the copies
+	Status       string          `json:"status"`                   // build, active, down, error
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+// MirrorDirection selects the traffic of the source port a mirror copies.
+// Directions are those of the port's instance.
+type MirrorDirection string
+
+const (
+	MirrorIngress MirrorDirection = "ingress" // Traffic the instance receives
+	MirrorEgress  MirrorDirection = "egress"  // Traffic the instance sends
+	MirrorBoth    MirrorDirection = "both"
+)
+
+// MirrorTunnel is a remote collector mirrored traffic is encapsulated to.
+type MirrorTunnel struct {
+	Type     string `json:"type"` // gre, vxlan
+	RemoteIP string `json:"remote_ip"`
+	Key      uint32 `json:"key,omitempty"` // GRE key or VNI
+}
+
+// LoadBalancer spreads the TCP connections made to a virtual IP over the
+// members of its listeners' pools. The VIP is a port on a subnet attached to
+// a distributed router, bound to one node, whose agent serves it from a
+// namespace of its own; members are reached through the router, so they may
+// sit on any subnet it is attached to.
+type LoadBalancer struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name,omitempty"`
+	TenantID   string       `json:"tenant_id,omitempty"`
+	NetworkID  string       `json:"network_id"`
+	SubnetID   string       `json:"subnet_id"` // Subnet of the VIP
+	RouterID   string       `json:"router_id"` // Router of the VIP subnet
+	VIPAddress string       `json:"vip_address"`
+	VIPPortID  string       `json:"vip_port_id"`
+	NodeID     string       `json:"node_id"` // Node serving the VIP
+	Listeners  []LBListener `json:"listeners,omitempty"`
+	Status     string       `json:"status"` // build, active, error
+	CreatedAt  time.Time    `json:"created_at"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+}
+
+// LBListener accepts connections on a port of its load balancer's VIP and
+// forwards them to its pool.
+type LBListener struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Protocol string `json:"protocol"` // tcp
+	Port     uint16 `json:"port"`
+	Pool     LBPool `json:"pool"`
+}
+
+// LBPool is the set of members a listener forwards to.
+type LBPool struct {
+	Algorithm     LBAlgorithm      `json:"algorithm"`
+	Members       []LBMember       `json:"members,omitempty"`
+	HealthMonitor *LBHealthMonitor `json:"health_monitor,omitempty"` // Members are assumed up if nil
+}
+
+// LBAlgorithm selects the member a new connection goes to.
+type LBAlgorithm string
+
+const (
+	LBRoundRobin       LBAlgorithm = "round_robin"
+	LBLeastConnections LBAlgorithm = "least_connections"
+	LBSourceIP         LBAlgorithm = "source_ip" // Connections from a client stick to one member
+)
+
+// LBMember is a backend of a pool.
+type LBMember struct {
+	Address string `json:"address"`
+	Port    uint16 `json:"port"`
+	Weight  int    `json:"weight,omitempty"` // Relative share of connections, 1-256; 1 if zero
+}
+
+// LBHealthMonitor checks the members of a pool by connecting to them. A
+// member that fails MaxRetries checks in a row gets no new connections until
+// a check succeeds again.
+type LBHealthMonitor struct {
+	Type       string `json:"type"`     // tcp
+	Interval   int    `json:"interval"` // Seconds between checks
+	Timeout    int    `json:"timeout"`  // Seconds a check may take
+	MaxRetries int    `json:"max_retries"`
+}
+
+// VPNService connects the subnets of a router to remote sites over
+// WireGuard. One node serves the tunnel from the router's namespace, at the
+// address of the router's external gateway; traffic to the peers' CIDRs is
+// routed into it there. The private key is kept apart from the service and
+// never leaves the controller and the serving node.
+type VPNService struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	TenantID   string    `json:"tenant_id,omitempty"`
+	RouterID   string    `json:"router_id"`
+	NodeID     string    `json:"node_id"`    // Node serving the tunnel
+	PublicKey  string    `json:"public_key"` // Base64, configured on the peers
+	ListenPort uint16    `json:"listen_port"`
+	Endpoint   string    `json:"endpoint"` // Gateway IP:port the peers connect to
+	Peers      []VPNPeer `json:"peers,omitempty"`
+	Status     string    `json:"status"` // build, active, error
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// VPNPeer is a remote site of a VPN service.
+type VPNPeer struct {
+	ID                  string   `json:"id"`
+	Name                string   `json:"name,omitempty"`
+	PublicKey           string   `json:"public_key"`                     // Base64
+	Endpoint            string   `json:"endpoint,omitempty"`             // host:port; unset for peers that connect first
+	AllowedCIDRs        []string `json:"allowed_cidrs"`                  // Remote subnets reached through the peer
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"` // Seconds; 0 disables
+}
+
+// VPNStatus is the state of a VPN service's tunnels, as last reported by the
+// node serving it.
+type VPNStatus struct {
+	NodeID    string          `json:"node_id"`
+	Peers     []VPNPeerStatus `json:"peers,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// VPNPeerStatus is the state of the tunnel to one peer.
+type VPNPeerStatus struct {
+	PeerID          string    `json:"peer_id"`
+	Endpoint        string    `json:"endpoint,omitempty"` // Where the peer was last seen
+	LatestHandshake time.Time `json:"latest_handshake,omitempty"`
+	RxBytes         uint64    `json:"rx_bytes"`
+	TxBytes         uint64    `json:"tx_bytes"`
+	Connected       bool      `json:"connected"` // Handshake recent enough for the session to be valid
+}
+
 // PortBindingType represents how a port is bound to an instance.
 type PortBindingType string
 
@@ -100,6 +434,7 @@ const (
 // VTEP represents a VXLAN Tunnel Endpoint on a compute node.
 type VTEP struct {
 	NodeID    string    `json:"node_id"`
+	Zone      string    `json:"zone,omitempty"`
 	IP        net.IP    `json:"ip"`        // Tunnel endpoint IP
 	Port      uint16    `json:"port"`      // UDP port (default 4789)
 	Interface string    `json:"interface"` // VXLAN interface name
@@ -174,6 +509,12 @@ type ExternalGateway struct {
 	NetworkID        string    `json:"network_id"`
 	EnableSNAT       bool      `json:"enable_snat"`
 	ExternalFixedIPs []FixedIP `json:"external_fixed_ips,omitempty"`
+	PortID           string    `json:"port_id,omitempty"`     // Gateway port on the external network
+	MACAddress       string    `json:"mac_address,omitempty"` // MAC of the gateway port
+	GatewayIP        string    `json:"gateway_ip,omitempty"`  // Next hop on the external subnet
+	CIDR             string    `json:"cidr,omitempty"`        // External subnet CIDR
+	VNI              uint32    `json:"vni,omitempty"`         // Segment of the external network
+	MTU              uint16    `json:"mtu,omitempty"`         // MTU of the external network
 }
 
 // FixedIP represents a fixed IP address assignment.
@@ -190,10 +531,17 @@ type Route struct {
 
 // RouterInterface represents a connection between a router and a subnet.
 type RouterInterface struct {
-	ID       string `json:"id"`
-	RouterID string `json:"router_id"`
-	SubnetID string `json:"subnet_id"`
-	PortID   string `json:"port_id"`
+	ID         string    `json:"id"`
+	RouterID   string    `json:"router_id"`
+	SubnetID   string    `json:"subnet_id"`
+	PortID     string    `json:"port_id"`
+	NetworkID  string    `json:"network_id"`
+	IPAddress  string    `json:"ip_address"`    // Usually the subnet's gateway IP
+	MACAddress string    `json:"mac_address"`   // MAC of the interface port
+	CIDR       string    `json:"cidr"`          // Subnet CIDR
+	VNI        uint32    `json:"vni"`           // Segment of the subnet's network
+	MTU        uint16    `json:"mtu,omitempty"` // MTU of the subnet's network
+	CreatedAt  time.Time `json:"created_at"`
 }
 
 // FlowRule represents an OpenFlow rule for the SDN controller.
@@ -204,8 +552,14 @@ type FlowRule struct {
 	Cookie      uint64       `json:"cookie"`
 	Match       FlowMatch    `json:"match"`
 	Actions     []FlowAction `json:"actions"`
-	IdleTimeout uint16       `json:"idle_timeout,omitempty"`
-	HardTimeout uint16       `json:"hard_timeout,omitempty"`
+	IdleTimeout uint16       `json:"idle_timeout,omitempty"`  // Seconds without a match before removal
+	HardTimeout uint16       `json:"hard_timeout,omitempty"`  // Seconds after install before removal
+	SendFlowRem bool         `json:"send_flow_rem,omitempty"` // Notify the controller on removal
+}
+
+// HasTimeout reports whether the flow is removed automatically by the switch.
+func (r *FlowRule) HasTimeout() bool {
+	return r.IdleTimeout > 0 || r.HardTimeout > 0
 }
 
 // FlowMatch represents OpenFlow match criteria.
@@ -222,6 +576,7 @@ type FlowMatch struct {
 	TPDst    uint16 `json:"tp_dst,omitempty"`    // TCP/UDP dst port
 	TunnelID uint32 `json:"tunnel_id,omitempty"` // VXLAN VNI
 	Metadata uint64 `json:"metadata,omitempty"`
+	ARPOp    uint16 `json:"arp_op,omitempty"` // 1 request, 2 reply; needs DLType ARP
 }
 
 // FlowAction represents an OpenFlow action.
@@ -245,8 +600,56 @@ const (
 	FlowActionController FlowActionType = "controller"
 	FlowActionGroup      FlowActionType = "group"
 	FlowActionSetTunnel  FlowActionType = "set_tunnel"
+	FlowActionLearn      FlowActionType = "learn"
+	FlowActionMove       FlowActionType = "move"
 )
 
+// FieldSet sets a packet field to a value (Value of FlowActionSetField).
+// Fields use OXM names, e.g. "eth_src" or "arp_spa".
+type FieldSet struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+// FieldMove copies one packet field into another (Value of FlowActionMove).
+// Fields use Nicira extension syntax, e.g. "NXM_OF_ETH_SRC[]".
+type FieldMove struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+// LearnSpec describes the flow installed by a learn action (Value of FlowActionLearn).
+// Fields use Nicira extension syntax, e.g. "NXM_OF_ETH_DST[]=NXM_OF_ETH_SRC[]".
+type LearnSpec struct {
+	TableID     uint8    `json:"table_id"`
+	Priority    uint16   `json:"priority"`
+	Cookie      uint64   `json:"cookie"`
+	IdleTimeout uint16   `json:"idle_timeout,omitempty"`
+	HardTimeout uint16   `json:"hard_timeout,omitempty"`
+	Fields      []string `json:"fields"`           // Match fields copied or derived from the packet
+	Output      string   `json:"output,omitempty"` // Output field, e.g. "NXM_OF_IN_PORT[]"
+}
+
+// FlowExpiryReason describes why the switch removed a flow.
+type FlowExpiryReason string
+
+const (
+	FlowExpiryIdle FlowExpiryReason = "idle_timeout"
+	FlowExpiryHard FlowExpiryReason = "hard_timeout"
+)
+
+// FlowExpiryEvent is emitted when a flow with a timeout ages out of the switch.
+type FlowExpiryEvent struct {
+	Bridge      string           `json:"bridge"`
+	Cookie      uint64           `json:"cookie"`
+	TableID     uint8            `json:"table_id"`
+	Priority    uint16           `json:"priority"`
+	Owner       string           `json:"owner"` // Port or network ID that installed the flow
+	Reason      FlowExpiryReason `json:"reason"`
+	InstalledAt time.Time        `json:"installed_at"`
+	ExpiredAt   time.Time        `json:"expired_at"`
+}
+
 // NetworkConfig holds configuration for the network subsystem.
 type NetworkConfig struct {
 	// OVS configuration
@@ -256,7 +659,13 @@ type NetworkConfig struct {
 	// VXLAN configuration
 	VXLANPort    uint16 `yaml:"vxlan_port" json:"vxlan_port"`         // Default: 4789
 	VXLANLocalIP string `yaml:"vxlan_local_ip" json:"vxlan_local_ip"` // Tunnel endpoint IP
-	VXLANMTU     uint16 `yaml:"vxlan_mtu" json:"vxlan_mtu"`           // Default: 1450
+
+	// MTU of the physical network carrying the overlay. Networks default
+	// to, and may not exceed, the underlay MTU, less the VXLAN overhead for
+	// VXLAN networks; raise it for jumbo-frame underlays, and the overhead
+	// to 70 for IPv6 tunnel endpoints
+	UnderlayMTU   uint16 `yaml:"underlay_mtu" json:"underlay_mtu"`     // Default: 1500
+	VXLANOverhead uint16 `yaml:"vxlan_overhead" json:"vxlan_overhead"` // Default: 50
 
 	// SDN controller configuration
 	ControllerEnabled bool   `yaml:"controller_enabled" json:"controller_enabled"`
@@ -268,6 +677,60 @@ type NetworkConfig struct {
 	// DVR configuration
 	DVREnabled   bool   `yaml:"dvr_enabled" json:"dvr_enabled"`
 	DVRNamespace string `yaml:"dvr_namespace" json:"dvr_namespace"` // Default: "qrouter"
+
+	// Load balancers served on this node: each gets a namespace for its
+	// VIP, and a haproxy whose configuration and pid file are kept under
+	// the state directory
+	LBNamespace string `yaml:"lb_namespace" json:"lb_namespace"` // Default: "qlbaas"
+	LBStateDir  string `yaml:"lb_state_dir" json:"lb_state_dir"` // Default: "/var/lib/hypervisor/lbaas"
+
+	// BGP speakers run on this node for the external networks that name it:
+	// a gobgpd each, whose configuration and pid file are kept under the
+	// state directory, serving its API on a local port counted up from the
+	// base
+	BGPStateDir    string `yaml:"bgp_state_dir" json:"bgp_state_dir"`         // Default: "/var/lib/hypervisor/bgp"
+	BGPAPIPortBase uint16 `yaml:"bgp_api_port_base" json:"bgp_api_port_base"` // Default: 50100
+
+	// Flow aging configuration
+	MACLearningIdleTimeout uint16        `yaml:"mac_learning_idle_timeout" json:"mac_learning_idle_timeout"` // Default: 300 seconds
+	FlowExpiryInterval     time.Duration `yaml:"flow_expiry_interval" json:"flow_expiry_interval"`           // Default: 30s
+
+	// Answer ARP requests for known port IPs on the integration bridge
+	// instead of flooding them across the overlay
+	ARPResponder bool `yaml:"arp_responder" json:"arp_responder"` // Default: true
+
+	// Range VXLAN networks are given VNIs from when not requested
+	// explicitly
+	VNIMin uint32 `yaml:"vni_min" json:"vni_min"` // Default: 1
+	VNIMax uint32 `yaml:"vni_max" json:"vni_max"` // Default: 8388607
+
+	// Range zone segments are given VNIs from when not requested explicitly
+	SegmentVNIMin uint32 `yaml:"segment_vni_min" json:"segment_vni_min"` // Default: 8388608
+	SegmentVNIMax uint32 `yaml:"segment_vni_max" json:"segment_vni_max"` // Default: 16777215
+}
+
+// MinMTU is the smallest MTU a network may have, the minimum IPv4 datagram
+// size every host must accept.
+const MinMTU = 576
+
+// MaxMTU returns the largest MTU a network of type t can carry over the
+// underlay, defaulting unset settings.
+func (c *NetworkConfig) MaxMTU(t NetworkType) uint16 {
+	defaults := DefaultNetworkConfig()
+	underlay, overhead := c.UnderlayMTU, c.VXLANOverhead
+	if underlay == 0 {
+		underlay = defaults.UnderlayMTU
+	}
+	if overhead == 0 {
+		overhead = defaults.VXLANOverhead
+	}
+	if t != NetworkTypeVXLAN {
+		return underlay
+	}
+	if overhead >= underlay {
+		return 0
+	}
+	return underlay - overhead
 }
 
 // DefaultNetworkConfig returns the default network configuration.
@@ -276,11 +739,26 @@ func DefaultNetworkConfig() *NetworkConfig {
 		OVSBridge:         "br-int",
 		OVSTunnelBridge:   "br-tun",
 		VXLANPort:         4789,
-		VXLANMTU:          1450,
+		UnderlayMTU:       1500,
+		VXLANOverhead:     50,
 		ControllerEnabled: true,
 		OpenFlowVersion:   "1.3",
 		DefaultSubnetCIDR: "10.0.0.0/8",
 		DVREnabled:        true,
 		DVRNamespace:      "qrouter",
+		LBNamespace:       "qlbaas",
+		LBStateDir:        "/var/lib/hypervisor/lbaas",
+		BGPStateDir:       "/var/lib/hypervisor/bgp",
+		BGPAPIPortBase:    50100,
+
+		MACLearningIdleTimeout: 300,
+		FlowExpiryInterval:     30 * time.Second,
+		ARPResponder:           true,
+
+		VNIMin: 1,
+		VNIMax: 1<<23 - 1,
+
+		SegmentVNIMin: 1 << 23,
+		SegmentVNIMax: 1<<24 - 1,
 	}
 }
@@ -0,0 +1,155 @@
+// Package tracing traces requests across the CLI, the server, the agents,
+// the drivers and etcd with OpenTelemetry. Trace context travels in gRPC
+// metadata, so a CreateInstance call can be followed from the CLI through
+// scheduling and the agent RPC down to the driver and the etcd writes.
+// Spans are exported over OTLP/gRPC to a collector.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// Config configures trace export.
+type Config struct {
+	// Enabled exports spans. When disabled, trace context received from
+	// callers is still passed on.
+	Enabled bool `mapstructure:"enabled"`
+
+	// Endpoint is the OTLP/gRPC collector address, as host:port or as a
+	// URL such as OTEL_EXPORTER_OTLP_ENDPOINT holds, e.g.
+	// https://collector:4317, whose scheme then picks TLS.
+	Endpoint string `mapstructure:"endpoint"`
+
+	// Insecure connects to a host:port endpoint without TLS.
+	Insecure bool `mapstructure:"insecure"`
+
+	// SampleRatio is the fraction of new traces recorded; requests whose
+	// caller recorded them are always recorded.
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// DefaultConfig returns the default tracing configuration.
+func DefaultConfig() Config {
+	return Config{
+		Enabled:     false,
+		Endpoint:    "localhost:4317",
+		Insecure:    true,
+		SampleRatio: 1.0,
+	}
+}
+
+// tracer starts the spans of Start. The global tracer delegates to the
+// provider set by Setup, whenever that happens.
+var tracer = otel.Tracer("hypervisor")
+
+// Setup installs the W3C trace context propagator and, if enabled, the
+// exporter of service's spans. The returned function flushes the spans
+// not exported yet and stops exporting.
+func Setup(ctx context.Context, config Config, service, version string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var opts []otlptracegrpc.Option
+	if strings.Contains(config.Endpoint, "://") {
+		u, err := url.Parse(config.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid trace endpoint %q: expected host:port or an http(s) URL", config.Endpoint)
+		}
+		opts = append(opts, otlptracegrpc.WithEndpointURL(config.Endpoint))
+	} else {
+		opts = append(opts, otlptracegrpc.WithEndpoint(config.Endpoint))
+		if config.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", service),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe service: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// ServerOption traces the calls a gRPC server serves, continuing the
+// caller's trace. Health checks are not traced.
+func ServerOption() grpc.ServerOption {
+	return grpc.StatsHandler(otelgrpc.NewServerHandler(
+		otelgrpc.WithFilter(filters.Not(filters.HealthCheck())),
+	))
+}
+
+// DialOption traces the calls made over a gRPC connection and passes the
+// trace context on to the server.
+func DialOption() grpc.DialOption {
+	return grpc.WithStatsHandler(otelgrpc.NewClientHandler(
+		otelgrpc.WithFilter(filters.Not(filters.HealthCheck())),
+	))
+}
+
+// Start starts a span named name as a child of the span in ctx. Without a
+// span in ctx, e.g. in background loops, no span is started, so that only
+// the work done for traced requests is recorded.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartTrace starts a new trace with a root span named name, for callers
+// such as the CLI that begin a request.
+func StartTrace(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithNewRoot(), trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace ctx belongs to, or "" if none.
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}